@@ -0,0 +1,75 @@
+// Command fakeprovider serves scripted Gemini, OpenAI and Anthropic responses
+// for manual QA of LuciCodex without a real provider account. Point the
+// provider endpoints at it, for example:
+//
+//	fakeprovider -addr 0.0.0.0:8089 -script responses.json &
+//	GEMINI_ENDPOINT=http://127.0.0.1:8089 GEMINI_API_KEY=fake lucicodex "show wifi"
+//
+// The script is a JSON array of responses:
+//
+//	[{"status": 429}, {"text": "{\"summary\": \"ok\", \"commands\": []}", "delay_ms": 2000}]
+//
+// Each generation request consumes the next response; the last one repeats.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/aezizhu/LuciCodex/internal/testutil"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+func run(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("fakeprovider", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("addr", "127.0.0.1:8089", "listen address")
+	script := fs.String("script", "", "JSON file with an array of scripted responses")
+	text := fs.String("text", "", "model output when no script is given (default: a one-command plan)")
+	status := fs.Int("status", 0, "HTTP status when no script is given")
+	fault := fs.String("fault", "", "induced fault when no script is given: truncate or malformed")
+	delay := fs.Int("delay-ms", 0, "latency in milliseconds when no script is given")
+	tokens := fs.Int("tokens", 100, "token usage reported when no script is given")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	responses := []testutil.FakeResponse{{Text: *text, Status: *status, Fault: *fault, DelayMS: *delay, Tokens: *tokens}}
+	if *script != "" {
+		data, err := os.ReadFile(*script)
+		if err != nil {
+			fmt.Fprintf(stderr, "fakeprovider: %v\n", err)
+			return 1
+		}
+		responses = nil
+		if err := json.Unmarshal(data, &responses); err != nil {
+			fmt.Fprintf(stderr, "fakeprovider: %s: %v\n", *script, err)
+			return 1
+		}
+	}
+	for i, r := range responses {
+		if r.Fault != "" && r.Fault != testutil.FaultTruncate && r.Fault != testutil.FaultMalformed {
+			fmt.Fprintf(stderr, "fakeprovider: response %d: unknown fault %q\n", i, r.Fault)
+			return 1
+		}
+	}
+
+	fake := testutil.NewFakeProvider(responses...)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(stderr, "%s %s\n", r.Method, r.URL.Path)
+		fake.ServeHTTP(w, r)
+	})
+	fmt.Fprintf(stderr, "fakeprovider: serving %d scripted response(s) on http://%s\n", len(responses), *addr)
+	if err := http.ListenAndServe(*addr, handler); err != nil {
+		fmt.Fprintf(stderr, "fakeprovider: %v\n", err)
+		return 1
+	}
+	return 0
+}
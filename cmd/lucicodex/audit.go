@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+)
+
+// runAuditVerify implements `lucicodex audit verify [log-file]`: it checks
+// the hash chain of the audit log and its head file, and fails with
+// AUDIT_BROKEN if entries were modified, inserted or removed.
+func runAuditVerify(e *env, path string) int {
+	if path == "" {
+		path = e.cfg.LogFile
+	}
+	if path == "" {
+		return fail(errcode.ConfigInvalid, "No audit log to verify: set log_file or pass a log file path", e.jsonOutput, e.stdout, e.stderr)
+	}
+	report, err := logging.VerifyAudit(path)
+	if err != nil {
+		code := errcode.Of(err)
+		if code == errcode.AuditBroken && !e.jsonOutput {
+			fmt.Fprintf(e.stdout, "%d entries verified before the break\n", report.Entries)
+		}
+		return fail(code, "Audit log "+path+" does not verify: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+	}
+	if e.jsonOutput {
+		enc := json.NewEncoder(e.stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(e.stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(e.stdout, "Audit log %s is intact: %s\n", path, report)
+	return 0
+}
@@ -0,0 +1,960 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/repl"
+	"github.com/aezizhu/LuciCodex/internal/server"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+	"github.com/aezizhu/LuciCodex/internal/wizard"
+)
+
+// `lucicodex <command> [flags] [args]` runs a subcommand with the global
+// flags and its own. Anything else is the implicit run command, so
+// `lucicodex "<prompt>"` keeps working, as do the older mode flags (-server,
+// -interactive, -setup, -discover, -stats) and command words given after
+// global flags (`lucicodex -json policy lint`). A command word followed by
+// what are not flags and arguments of the command begins an unquoted
+// prompt instead: `lucicodex top processes by memory` asks the model.
+
+// action runs a command once its flags are parsed and the config is loaded.
+type action func(e *env, args []string) int
+
+type command struct {
+	name     string
+	synopsis string // Arguments after the flags, for usage messages
+	summary  string
+	// flags registers the command's own flags and returns its action.
+	flags func(fs *flag.FlagSet) action
+	// noConfig commands run even when the config cannot be loaded.
+	noConfig bool
+	// prompt commands stop parsing flags at the first argument, so a prompt
+	// may contain words starting with '-'. Other commands accept flags
+	// anywhere.
+	prompt bool
+}
+
+// env is what an action runs with.
+type env struct {
+	cmd        *command
+	cfg        config.Config
+	configPath string
+	jsonOutput bool
+	verbosity  ui.Verbosity    // -q, -v, -vv
+	set        map[string]bool // Flags given on the command line
+	stdin      io.Reader
+	stdout     io.Writer
+	stderr     io.Writer
+	// prompt is the command line without the flags when the command was
+	// named by its first word, which may begin an unquoted prompt instead.
+	prompt []string
+}
+
+// usage reports wrong arguments for the running command, or runs them as a
+// prompt if they may be one.
+func (e *env) usage() int {
+	if e.prompt != nil {
+		act := runFlags(flag.NewFlagSet("lucicodex", flag.ContinueOnError))
+		args := e.prompt
+		e.prompt = nil
+		return act(e, args)
+	}
+	fmt.Fprintf(e.stderr, "Usage: lucicodex %s %s\n", e.cmd.name, e.cmd.synopsis)
+	fmt.Fprintf(e.stderr, "Run 'lucicodex %s -h' for help\n", e.cmd.name)
+	return errcode.InvalidRequest.ExitCode()
+}
+
+var commands = []*command{
+	{
+		name:     "run",
+		synopsis: "<prompt>",
+		summary:  "Plan commands for a request and run them once approved (default)",
+		flags:    runFlags,
+		prompt:   true,
+	},
+	{
+		name:     "serve",
+		synopsis: "",
+		summary:  "Run the HTTP daemon",
+		flags: func(fs *flag.FlagSet) action {
+			port := fs.Int("port", 9999, "daemon port")
+			socketPath := fs.String("socket", "", "serve the daemon API on this Unix socket instead of TCP")
+			return func(e *env, args []string) int {
+				if len(args) != 0 {
+					return e.usage()
+				}
+				if e.set["socket"] {
+					e.cfg.SocketPath = *socketPath
+				}
+				return runServe(e.cfg, *port, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "repl",
+		synopsis: "",
+		summary:  "Start an interactive session",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) != 0 {
+					return e.usage()
+				}
+				return runREPL(e.cfg, e.stdin, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "setup",
+		synopsis: "",
+		summary:  "Run the setup wizard, or import existing settings with -discover",
+		noConfig: true,
+		flags: func(fs *flag.FlagSet) action {
+			discover := fs.Bool("discover", false, "import API keys and settings found in the environment, other AI CLIs and UCI")
+			approve := fs.Bool("approve", false, "with -discover, write the changes without asking")
+			answers := fs.String("answers", "", "set up without asking, from this JSON answers file (- for stdin) and the LUCICODEX_SETUP_* variables")
+			nonInteractive := fs.Bool("non-interactive", false, "set up without asking, from the LUCICODEX_SETUP_* variables")
+			return func(e *env, args []string) int {
+				if len(args) != 0 {
+					return e.usage()
+				}
+				if *discover {
+					return runDiscover(e.configPath, *approve, e.jsonOutput, e.stdin, e.stdout, e.stderr)
+				}
+				return runSetup(*answers, *nonInteractive, e.stdin, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "policy",
+		synopsis: "audit [log-file] | lint",
+		summary:  "Check the policy against past plans, or lint the allow/deny lists",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				switch {
+				case len(args) >= 1 && len(args) <= 2 && args[0] == "audit":
+					return runPolicyAudit(e.cfg, args, e.jsonOutput, e.stdout, e.stderr)
+				case len(args) == 1 && args[0] == "lint":
+					return runPolicyLint(e.cfg, e.jsonOutput, e.stdout, e.stderr)
+				}
+				return e.usage()
+			}
+		},
+	},
+	{
+		name:     "history",
+		synopsis: "[id | export]",
+		summary:  "List recent executions, show one in full, or export them as CSV or JSON",
+		flags: func(fs *flag.FlagSet) action {
+			limit := fs.Int("n", 20, "number of executions to list")
+			format := fs.String("format", "csv", "export format: csv or json")
+			since := fs.String("since", "30d", "period exported, ending now, e.g. 7d or 12h")
+			return func(e *env, args []string) int {
+				if len(args) > 1 {
+					return e.usage()
+				}
+				if len(args) == 1 && args[0] == "export" {
+					return runHistoryExport(e.cfg, *format, *since, e.jsonOutput, e.stdout, e.stderr)
+				}
+				return runHistory(e.cfg, args, *limit, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "audit",
+		synopsis: "verify [log-file]",
+		summary:  "Check that the audit log was not modified or truncated",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) < 1 || len(args) > 2 || args[0] != "verify" {
+					return e.usage()
+				}
+				path := ""
+				if len(args) == 2 {
+					path = args[1]
+				}
+				return runAuditVerify(e, path)
+			}
+		},
+	},
+	{
+		name:     "feedback",
+		synopsis: "<id> good|bad [note]",
+		summary:  "Rate whether an execution worked",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) < 2 || len(args) > 3 {
+					return e.usage()
+				}
+				return runFeedback(e.cfg, args, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "schedule",
+		synopsis: "[list | tail <id> [lines] | stop <id> | watch <request> | digest | pipeline <name>]",
+		summary:  "Manage background jobs, and run watch probes, send digests or run pipelines on an interval",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) == 2 && args[0] == "watch" {
+					return runWatch(e.cfg, args[1], e.jsonOutput, e.stdout, e.stderr)
+				}
+				if len(args) == 2 && args[0] == "pipeline" {
+					return runSchedulePipeline(e.cfg, args[1], e.jsonOutput, e.stdout, e.stderr)
+				}
+				if len(args) == 1 && args[0] == "digest" {
+					return runScheduleDigest(e.cfg, e.jsonOutput, e.stdout, e.stderr)
+				}
+				if !isJobsCommand(append([]string{"jobs"}, args...)) {
+					return e.usage()
+				}
+				return runJobs(e.cfg, args, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "diagnose",
+		synopsis: "<ping|traceroute|nslookup|ifconfig> [target]",
+		summary:  "Run a network diagnostic without asking the model",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) < 1 || len(args) > 2 {
+					return e.usage()
+				}
+				return runDiagnose(e.cfg, args, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "tail",
+		synopsis: "[service]",
+		summary:  "Follow the system log and report bursts of errors",
+		flags: func(fs *flag.FlagSet) action {
+			var o tailOptions
+			fs.StringVar(&o.pattern, "pattern", "", "only show lines matching this regular expression")
+			fs.IntVar(&o.threshold, "threshold", 5, "error lines within -window that raise an alert (0 = never)")
+			fs.DurationVar(&o.window, "window", time.Minute, "time window for -threshold")
+			fs.BoolVar(&o.analyze, "analyze", false, "ask the model about the errors when an alert is raised")
+			fs.DurationVar(&o.duration, "for", 0, "stop after this long (0 = until interrupted)")
+			return func(e *env, args []string) int {
+				if len(args) > 1 {
+					return e.usage()
+				}
+				service := ""
+				if len(args) == 1 {
+					service = args[0]
+				}
+				return runTail(e.cfg, service, o, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "optimize-wifi",
+		synopsis: "",
+		summary:  "Survey the radio environment and plan channel and tx power changes",
+		flags: func(fs *flag.FlagSet) action {
+			o := addRunOptions(fs)
+			return func(e *env, args []string) int {
+				if len(args) != 0 {
+					return e.usage()
+				}
+				return runOptimizeWifi(e, o)
+			}
+		},
+	},
+	{
+		name:     "tune-sqm",
+		synopsis: "",
+		summary:  "Measure the WAN link and plan SQM (cake) bandwidth settings",
+		flags: func(fs *flag.FlagSet) action {
+			o := addRunOptions(fs)
+			var so sqmOptions
+			fs.StringVar(&so.speed.Tool, "tool", "", "speed test: speedtest-cli, iperf3, netperf or builtin (default: first installed, else builtin)")
+			fs.StringVar(&so.speed.Server, "server", "", "iperf3 or netperf server to measure against")
+			fs.StringVar(&so.speed.URL, "url", openwrt.DefaultSpeedURL, "download used by the builtin probe")
+			fs.DurationVar(&so.speed.Duration, "duration", openwrt.DefaultSpeedDuration, "length of each builtin, iperf3 or netperf transfer")
+			fs.BoolVar(&so.verify, "verify", true, "measure again after the SQM configuration changed")
+			fs.DurationVar(&so.timeout, "speed-timeout", 3*time.Minute, "time limit of each measurement")
+			return func(e *env, args []string) int {
+				if len(args) != 0 {
+					return e.usage()
+				}
+				return runTuneSQM(e, o, so)
+			}
+		},
+	},
+	{
+		name:     "playbook",
+		synopsis: "<file>",
+		summary:  "Run the steps of a playbook exported from the REPL, without asking the model",
+		flags: func(fs *flag.FlagSet) action {
+			dryRun := fs.Bool("dry-run", false, "only check and print the steps")
+			approve := fs.Bool("approve", false, "run without confirmation")
+			ackWarnings := fs.Bool("ack-warnings", false, "acknowledge policy warnings when running with -approve")
+			return func(e *env, args []string) int {
+				if len(args) != 1 {
+					return e.usage()
+				}
+				return runPlaybook(e, args[0], *dryRun, *approve, *ackWarnings)
+			}
+		},
+	},
+	{
+		name:     "pipeline",
+		synopsis: "list | show <name> | run <name>",
+		summary:  "List, show or run named pipelines of diagnose, plan, execute and verify phases",
+		flags: func(fs *flag.FlagSet) action {
+			var o pipelineOptions
+			fs.BoolVar(&o.dryRun, "dry-run", false, "run the diagnose, plan and verify phases without executing plans")
+			fs.BoolVar(&o.approve, "approve", false, "execute plans without confirmation")
+			fs.BoolVar(&o.ackWarnings, "ack-warnings", false, "acknowledge policy warnings when running with -approve")
+			return func(e *env, args []string) int {
+				ok := len(args) > 0
+				if ok {
+					switch args[0] {
+					case "list":
+						ok = len(args) == 1
+					case "show", "run":
+						ok = len(args) == 2
+					default:
+						ok = false
+					}
+				}
+				if !ok {
+					return e.usage()
+				}
+				return runPipeline(e, args, o)
+			}
+		},
+	},
+	{
+		name:     "template",
+		synopsis: "list | show <name> | save <name> <id> [param[:type]=value ...] | delete <name>",
+		summary:  "Save an executed plan as a template with typed parameters, or list, show or delete templates",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				ok := len(args) > 0
+				if ok {
+					switch args[0] {
+					case "list":
+						ok = len(args) == 1
+					case "show", "delete":
+						ok = len(args) == 2
+					case "save":
+						ok = len(args) >= 3
+					default:
+						ok = false
+					}
+				}
+				if !ok {
+					return e.usage()
+				}
+				return runTemplate(e, args)
+			}
+		},
+	},
+	{
+		name:     "run-plan",
+		synopsis: "<template> [--param=value ...]",
+		summary:  "Run a saved template with its parameters filled in, without asking the model",
+		// The template's parameters are not flags of the command
+		prompt: true,
+		flags: func(fs *flag.FlagSet) action {
+			dryRun := fs.Bool("dry-run", false, "only check and print the plan")
+			approve := fs.Bool("approve", false, "run without confirmation")
+			ackWarnings := fs.Bool("ack-warnings", false, "acknowledge policy warnings when running with -approve")
+			return func(e *env, args []string) int {
+				if len(args) == 0 {
+					return e.usage()
+				}
+				values, err := parseParams(fs, args[1:], "dry-run", "approve", "ack-warnings")
+				if err != nil {
+					return fail(errcode.InvalidRequest, "Error: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+				}
+				return runRunPlan(e, args[0], values, *dryRun, *approve, *ackWarnings)
+			}
+		},
+	},
+	{
+		name:     "digest",
+		synopsis: "",
+		summary:  "Summarize recent executions, failures and log errors, e.g. for a daily report",
+		flags: func(fs *flag.FlagSet) action {
+			since := fs.Duration("since", 24*time.Hour, "period covered, ending now")
+			summarize := fs.Bool("summarize", true, "ask the model for a summary")
+			send := fs.Bool("send", false, "also post the digest to the digest_webhooks")
+			return func(e *env, args []string) int {
+				if len(args) != 0 {
+					return e.usage()
+				}
+				return runDigest(e.cfg, *since, *summarize, *send, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "usage",
+		synopsis: "",
+		summary:  "Print daily request counts, success rates, provider latency and command outcomes",
+		flags: func(fs *flag.FlagSet) action {
+			days := fs.Int("days", 7, "number of days covered")
+			return func(e *env, args []string) int {
+				if len(args) != 0 {
+					return e.usage()
+				}
+				return runStats(e.cfg, *days, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "metrics",
+		synopsis: "export",
+		summary:  "Export the daily metrics rollups as CSV or JSON",
+		flags: func(fs *flag.FlagSet) action {
+			format := fs.String("format", "csv", "export format: csv or json")
+			since := fs.String("since", "30d", "period exported, ending today, e.g. 7d")
+			return func(e *env, args []string) int {
+				if len(args) != 1 || args[0] != "export" {
+					return e.usage()
+				}
+				return runMetricsExport(e.cfg, *format, *since, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "login",
+		synopsis: "[provider]",
+		summary:  "Log in to a provider with OAuth",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) > 1 {
+					return e.usage()
+				}
+				return runLogin(e.cfg, "login", args, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "logout",
+		synopsis: "[provider]",
+		summary:  "Remove a stored OAuth token",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) > 1 {
+					return e.usage()
+				}
+				return runLogin(e.cfg, "logout", args, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "token",
+		synopsis: "list | add <name> <role> | remove <name>",
+		summary:  "Manage daemon API tokens",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if !isTokenCommand(append([]string{"token"}, args...)) {
+					return e.usage()
+				}
+				return runTokens(e.cfg, args, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "pin",
+		synopsis: "list | add [endpoint] | remove <host>",
+		summary:  "Manage pinned certificates of self-hosted LLM endpoints",
+		flags: func(fs *flag.FlagSet) action {
+			yes := fs.Bool("yes", false, "pin without asking for confirmation")
+			return func(e *env, args []string) int {
+				ok := len(args) > 0
+				if ok {
+					switch args[0] {
+					case "list":
+						ok = len(args) == 1
+					case "add":
+						ok = len(args) <= 2
+					case "remove":
+						ok = len(args) == 2
+					default:
+						ok = false
+					}
+				}
+				if !ok {
+					return e.usage()
+				}
+				return runPin(e, args, *yes)
+			}
+		},
+	},
+	{
+		name:     "keys",
+		synopsis: "encrypt",
+		summary:  "Encrypt the stored API keys with a key bound to this router",
+		noConfig: true,
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) != 1 || args[0] != "encrypt" {
+					return e.usage()
+				}
+				return runKeysEncrypt(e.configPath, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "jobs",
+		synopsis: "[list | tail <id> [lines] | stop <id>]",
+		summary:  "Manage background jobs (same as schedule)",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if !isJobsCommand(append([]string{"jobs"}, args...)) {
+					return e.usage()
+				}
+				return runJobs(e.cfg, args, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "top",
+		synopsis: "",
+		summary:  "Show a live dashboard of the daemon, the running plan, jobs and LLM latency",
+		flags: func(fs *flag.FlagSet) action {
+			var o topOptions
+			fs.StringVar(&o.daemon, "daemon", "", "show the daemon at this address, e.g. http://192.168.1.1:9999 or unix:///var/run/lucicodex.sock, instead of the local files")
+			fs.StringVar(&o.token, "token", "", "token for -daemon (default: the token file of a daemon on this router)")
+			fs.DurationVar(&o.interval, "interval", 2*time.Second, "refresh interval")
+			fs.BoolVar(&o.once, "once", false, "print the dashboard once and exit")
+			return func(e *env, args []string) int {
+				if len(args) != 0 || o.interval <= 0 {
+					return e.usage()
+				}
+				return runTop(e, o)
+			}
+		},
+	},
+	{
+		name:     "watch",
+		synopsis: "<request>",
+		summary:  "Monitor the router with probes compiled from a request",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) != 1 {
+					return e.usage()
+				}
+				return runWatch(e.cfg, args[0], e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "confirm-change",
+		synopsis: "",
+		summary:  "Keep a network change armed with the safety net",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) != 0 {
+					return e.usage()
+				}
+				return runConfirmChange(e.cfg, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "export-state",
+		synopsis: "<archive>",
+		summary:  "Back up config, policy lists, tokens and history",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) != 1 {
+					return e.usage()
+				}
+				return runExportState(e.cfg, e.configPath, args[0], e.stdin, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "import-state",
+		synopsis: "<archive>",
+		summary:  "Restore a backup made with export-state",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) != 1 {
+					return e.usage()
+				}
+				return runImportState(e.cfg, e.configPath, args[0], e.stdin, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "self-update",
+		synopsis: "[check | rollback]",
+		summary:  "Update the binary from the release channel",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) > 1 {
+					return e.usage()
+				}
+				return runSelfUpdate(e.cfg, args, e.stdout, e.stderr)
+			}
+		},
+	},
+	{
+		name:     "support-bundle",
+		synopsis: "",
+		summary:  "Write a redacted archive of config, history, metrics and facts for a bug report",
+		flags: func(fs *flag.FlagSet) action {
+			output := fs.String("o", "", "archive path (default /tmp/lucicodex-support-<time>.tar.gz)")
+			yes := fs.Bool("yes", false, "include every file without reviewing it")
+			return func(e *env, args []string) int {
+				if len(args) != 0 {
+					return e.usage()
+				}
+				return runSupportBundle(e, *output, *yes)
+			}
+		},
+		noConfig: true,
+	},
+	{
+		name:     "debug",
+		synopsis: "last",
+		summary:  "Show the last LLM exchange captured with -debug-llm",
+		flags: func(fs *flag.FlagSet) action {
+			return func(e *env, args []string) int {
+				if len(args) != 1 || args[0] != "last" {
+					return e.usage()
+				}
+				return runDebugLast(e.cfg, e.jsonOutput, e.stdout, e.stderr)
+			}
+		},
+	},
+}
+
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// parses reports whether args parse as the flags and arguments of c, as
+// they must for a command word to name c rather than begin a prompt.
+func (c *command) parses(args []string) bool {
+	fs := flag.NewFlagSet("lucicodex "+c.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	addGlobalFlags(fs)
+	c.flags(fs)
+	_, err := parseArgs(fs, args, c.prompt)
+	return err == nil || errors.Is(err, flag.ErrHelp)
+}
+
+// globalFlags are accepted by every command.
+type globalFlags struct {
+	configPath  *string
+	model       *string
+	provider    *string
+	logFile     *string
+	jsonOutput  *bool
+	timeout     *int
+	recordDir   *string
+	replayDir   *string
+	debugLLM    *bool
+	temperature *float64
+	topP        *float64
+	maxOutput   *int
+	reasoning   *string
+	thinking    *int
+	showVersion *bool
+	quiet       *bool
+	verbose     *bool
+	debug       *bool
+}
+
+func addGlobalFlags(fs *flag.FlagSet) *globalFlags {
+	return &globalFlags{
+		configPath:  fs.String("config", "", "path to JSON config file"),
+		model:       fs.String("model", "", "model name"),
+		provider:    fs.String("provider", "", "provider name (gemini, openai, anthropic)"),
+		logFile:     fs.String("log-file", "", "log file path"),
+		jsonOutput:  fs.Bool("json", false, "emit JSON output"),
+		timeout:     fs.Int("timeout", 0, "per-command timeout in seconds"),
+		recordDir:   fs.String("record", "", "record redacted provider HTTP traffic to this cassette directory"),
+		replayDir:   fs.String("replay", "", "replay provider responses from this cassette directory (no network)"),
+		debugLLM:    fs.Bool("debug-llm", false, "save every prompt and raw provider response of this run (see 'lucicodex debug last')"),
+		temperature: fs.Float64("temperature", 0, "sampling temperature (0-2); provider default if unset"),
+		topP:        fs.Float64("top-p", 0, "nucleus sampling top_p (0-1]; provider default if unset"),
+		maxOutput:   fs.Int("max-output-tokens", 0, "maximum tokens in each model response (0 = provider default)"),
+		reasoning:   fs.String("reasoning-effort", "", "OpenAI reasoning effort: minimal, low, medium, high"),
+		thinking:    fs.Int("thinking-budget", 0, "Anthropic/Gemini thinking budget in tokens (0 = disabled)"),
+		showVersion: fs.Bool("version", false, "print version and exit"),
+		quiet:       fs.Bool("q", false, "quiet: print only the final summary and errors (for cron)"),
+		verbose:     fs.Bool("v", false, "verbose: also print timing and policy decisions"),
+		debug:       fs.Bool("vv", false, "debug: like -v, and trace provider HTTP requests"),
+	}
+}
+
+// verbosity returns the level selected by -q, -v and -vv.
+func (g *globalFlags) verbosity() (ui.Verbosity, error) {
+	switch {
+	case *g.quiet && (*g.verbose || *g.debug):
+		return ui.Normal, fmt.Errorf("-q cannot be combined with -v or -vv")
+	case *g.quiet:
+		return ui.Quiet, nil
+	case *g.debug:
+		return ui.Debug, nil
+	case *g.verbose:
+		return ui.Verbose, nil
+	}
+	return ui.Normal, nil
+}
+
+// loadConfig loads the config and applies the global flags in set. With
+// optional, a config that cannot be loaded yields an empty one. ok is false
+// when the command must exit with code.
+func (g *globalFlags) loadConfig(set map[string]bool, optional bool, stdout, stderr io.Writer) (cfg config.Config, code int, ok bool) {
+	cfg, err := config.Load(*g.configPath)
+	if err != nil {
+		if !optional {
+			fmt.Fprintf(stderr, "Configuration error: %v\n", err)
+			fmt.Fprintf(stderr, "Run 'lucicodex setup' to configure LuciCodex\n")
+			return cfg, errcode.ConfigInvalid.ExitCode(), false
+		}
+		cfg = config.Config{}
+	}
+
+	if set["model"] {
+		cfg.Model = *g.model
+		// Prevent provider-specific settings from overriding the explicit CLI flag
+		cfg.OpenAIModel = ""
+		cfg.AnthropicModel = ""
+	}
+	if set["provider"] {
+		cfg.Provider = *g.provider
+	}
+	if set["timeout"] {
+		cfg.TimeoutSeconds = *g.timeout
+	}
+	if set["log-file"] {
+		cfg.LogFile = *g.logFile
+	}
+	if set["record"] {
+		cfg.RecordDir = *g.recordDir
+	}
+	if set["replay"] {
+		cfg.ReplayDir = *g.replayDir
+	}
+	if set["debug-llm"] {
+		cfg.DebugLLM = *g.debugLLM
+	}
+	if set["temperature"] {
+		cfg.Temperature = g.temperature
+	}
+	if set["top-p"] {
+		cfg.TopP = g.topP
+	}
+	if set["max-output-tokens"] {
+		cfg.MaxOutputTokens = *g.maxOutput
+	}
+	if set["reasoning-effort"] {
+		cfg.ReasoningEffort = *g.reasoning
+	}
+	if set["thinking-budget"] {
+		cfg.ThinkingBudget = *g.thinking
+	}
+	if err := cfg.ValidateGeneration(); err != nil {
+		code := errcode.ConfigInvalid
+		for _, name := range []string{"temperature", "top-p", "max-output-tokens", "reasoning-effort", "thinking-budget"} {
+			if set[name] {
+				code = errcode.InvalidRequest
+			}
+		}
+		return cfg, fail(code, err.Error(), *g.jsonOutput, stdout, stderr), false
+	}
+
+	// Re-apply provider settings after CLI flag overrides
+	cfg.ApplyProviderSettings()
+	return cfg, 0, true
+}
+
+// exec parses args and runs c. implicit is set when no command was named,
+// which also accepts a command word after the global flags.
+func (c *command) exec(args []string, implicit bool, stdin io.Reader, stdout, stderr io.Writer) int {
+	name := "lucicodex " + c.name
+	if implicit {
+		name = "lucicodex"
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	g := addGlobalFlags(fs)
+	act := c.flags(fs)
+	fs.Usage = func() { c.printUsage(fs, implicit) }
+
+	rest, err := parseArgs(fs, args, c.prompt)
+	if err != nil {
+		return errcode.InvalidRequest.ExitCode()
+	}
+	if *g.showVersion {
+		fmt.Fprintf(stdout, "LuciCodex version %s\n", version)
+		return 0
+	}
+
+	verbosity, err := g.verbosity()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return errcode.InvalidRequest.ExitCode()
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	target := c
+	var prompt []string
+	// `lucicodex -- history of wan drops` is a prompt, not the history command
+	if n := len(args) - len(rest); implicit && len(rest) > 0 && (n == 0 || args[n-1] != "--") {
+		if sub := lookupCommand(rest[0]); sub != nil && sub != c && sub.parses(rest[1:]) {
+			target, prompt, rest = sub, rest, rest[1:]
+		}
+	}
+	// -setup and -discover predate the setup command
+	optional := target.noConfig || target == c && (set["setup"] || set["discover"])
+	cfg, code, ok := g.loadConfig(set, optional, stdout, stderr)
+	if !ok {
+		return code
+	}
+	if verbosity >= ui.Debug {
+		cfg.HTTPTrace = stderr
+	}
+
+	e := &env{
+		cmd:        c,
+		cfg:        cfg,
+		configPath: *g.configPath,
+		jsonOutput: *g.jsonOutput,
+		verbosity:  verbosity,
+		set:        set,
+		stdin:      stdin,
+		stdout:     stdout,
+		stderr:     stderr,
+		prompt:     prompt,
+	}
+	if target != c {
+		return target.dispatch(e, rest)
+	}
+	if !implicit && c.name != "run" {
+		e.prompt = append([]string{c.name}, rest...)
+	}
+	return act(e, rest)
+}
+
+// dispatch runs c for `lucicodex [global flags] <command> [args]`, with the
+// global flags already applied to e.
+func (c *command) dispatch(e *env, args []string) int {
+	fs := flag.NewFlagSet("lucicodex "+c.name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	act := c.flags(fs)
+	fs.Usage = func() { c.printUsage(fs, false) }
+	rest, err := parseArgs(fs, args, c.prompt)
+	if err != nil {
+		return errcode.InvalidRequest.ExitCode()
+	}
+	fs.Visit(func(f *flag.Flag) {
+		e.set[f.Name] = true
+	})
+	e.cmd = c
+	return act(e, rest)
+}
+
+// parseArgs parses the flags in args and returns the remaining arguments.
+// Unless stopAtArg is set, flags may follow arguments.
+func parseArgs(fs *flag.FlagSet, args []string, stopAtArg bool) ([]string, error) {
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		remaining := fs.Args()
+		if stopAtArg || len(remaining) == 0 {
+			return append(rest, remaining...), nil
+		}
+		// Everything after "--" is an argument
+		if n := len(args) - len(remaining); n > 0 && args[n-1] == "--" {
+			return append(rest, remaining...), nil
+		}
+		rest = append(rest, remaining[0])
+		args = remaining[1:]
+	}
+}
+
+func (c *command) printUsage(fs *flag.FlagSet, implicit bool) {
+	w := fs.Output()
+	if implicit {
+		fmt.Fprintf(w, "Usage: lucicodex [flags] <prompt>\n")
+		fmt.Fprintf(w, "       lucicodex <command> [flags] [args]\n\nCommands:\n")
+		for _, sub := range commands {
+			fmt.Fprintf(w, "  %-15s %s\n", sub.name, sub.summary)
+		}
+		fmt.Fprintf(w, "\nRun 'lucicodex <command> -h' for the flags of a command.\n\nFlags:\n")
+	} else {
+		fmt.Fprintf(w, "Usage: lucicodex %s [flags] %s\n\n%s.\n\nFlags:\n", c.name, c.synopsis, c.summary)
+	}
+	fs.PrintDefaults()
+}
+
+func runServe(cfg config.Config, port int, stderr io.Writer) int {
+	srv := server.New(cfg)
+	var err error
+	if cfg.SocketPath != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = srv.StartUnix(ctx, cfg.SocketPath)
+	} else {
+		err = srv.Start(port)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Server error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func runREPL(cfg config.Config, stdin io.Reader, stdout, stderr io.Writer) int {
+	r := repl.New(cfg, stdin, stdout)
+	if err := r.Run(context.Background()); err != nil {
+		fmt.Fprintf(stderr, "REPL error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runSetup runs the setup wizard or, with an answers file or
+// nonInteractive, sets up from the answers without asking.
+func runSetup(answers string, nonInteractive bool, stdin io.Reader, stdout, stderr io.Writer) int {
+	w := wizard.New(stdin, stdout)
+	if answers == "" && !nonInteractive {
+		if err := w.Run(); err != nil {
+			fmt.Fprintf(stderr, "Setup error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	a, err := wizard.LoadAnswers(answers, stdin, os.Getenv)
+	if err == nil {
+		err = w.RunAnswers(a)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Setup error: %v\n", err)
+		return errcode.Of(err).ExitCode()
+	}
+	return 0
+}
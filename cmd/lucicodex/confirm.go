@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/rollback"
+)
+
+// armRollback guards plans that may change connectivity. It returns false if
+// execution must not proceed.
+func armRollback(cfg config.Config, p plan.Plan, stderr io.Writer) bool {
+	st, armed, err := rollback.Guard(cfg.RollbackDir, cfg.RollbackTimeout, p)
+	if err != nil {
+		fmt.Fprintf(stderr, "Cannot arm network rollback: %v\n", err)
+		return false
+	}
+	if armed {
+		fmt.Fprintf(stderr, "This plan changes network settings. They will be reverted in %ds unless you run `lucicodex confirm-change` (rollback %s).\n",
+			cfg.RollbackTimeout, st.ID)
+	}
+	return true
+}
+
+// runConfirmChange implements `lucicodex confirm-change`.
+func runConfirmChange(cfg config.Config, stdout, stderr io.Writer) int {
+	st, err := rollback.Confirm(cfg.RollbackDir)
+	if err != nil {
+		if errors.Is(err, rollback.ErrNothingPending) {
+			if r, ok := rollback.LastReverted(cfg.RollbackDir); ok {
+				fmt.Fprintf(stderr, "Nothing to confirm: rollback %s was already reverted at %s\n", r.ID, r.Time.Format(time.DateTime))
+				return 1
+			}
+		}
+		fmt.Fprintf(stderr, "Nothing to confirm: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "Network change confirmed (rollback %s cancelled with %s left)\n", st.ID, st.Remaining().Round(time.Second))
+	return 0
+}
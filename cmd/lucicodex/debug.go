@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/llm/llmdebug"
+)
+
+// runDebugLast implements `lucicodex debug last`: it prints the most recent
+// LLM exchange captured with -debug-llm.
+func runDebugLast(cfg config.Config, jsonOutput bool, stdout, stderr io.Writer) int {
+	dir := cfg.DebugDir
+	if dir == "" {
+		dir = llmdebug.DefaultDir
+	}
+	ex, err := llmdebug.Last(dir)
+	if errors.Is(err, llmdebug.ErrNoExchange) {
+		return fail(errcode.NotFound, err.Error(), jsonOutput, stdout, stderr)
+	}
+	if err != nil {
+		return fail(errcode.Internal, "Cannot read debug bundle: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(ex); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "Exchange %d of run %s (%s)\n", ex.Seq, ex.Bundle, ex.Time.Local().Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(stdout, "%s %s\n", ex.Method, ex.URL)
+	if ex.Status != 0 {
+		fmt.Fprintf(stdout, "Status %d in %dms\n", ex.Status, ex.DurationMs)
+	}
+	if ex.Error != "" {
+		fmt.Fprintf(stdout, "Error: %s\n", ex.Error)
+	}
+	prompt := ex.Prompt
+	if prompt == "" {
+		prompt = ex.RequestBody
+	}
+	fmt.Fprintf(stdout, "\n--- Prompt ---\n%s\n", prompt)
+	fmt.Fprintf(stdout, "\n--- Raw response ---\n%s\n", ex.ResponseBody)
+	return 0
+}
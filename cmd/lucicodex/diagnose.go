@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/artifacts"
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// runDiagnose implements `lucicodex diagnose <type> [target]`: one of the
+// network diagnostics also offered to MCP clients, run directly under the
+// policy, the execution lock and the audit log.
+func runDiagnose(cfg config.Config, args []string, jsonOutput bool, stdout, stderr io.Writer) int {
+	target := ""
+	if len(args) > 1 {
+		target = args[1]
+	}
+	cmd, err := openwrt.DiagnosticCommand(args[0], target)
+	if err != nil {
+		return fail(errcode.InvalidRequest, fmt.Sprintf("Unknown diagnostic %q (want %s)", args[0], strings.Join(openwrt.DiagnosticTypes, ", ")), jsonOutput, stdout, stderr)
+	}
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: cmd, Description: args[0] + " diagnostic"}}}
+	if err := policy.New(cfg).ValidatePlan(p); err != nil {
+		return fail(errcode.PolicyDeny, "Diagnostic rejected by policy: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+
+	lock, err := execlock.Acquire("cli")
+	if err != nil {
+		return fail(errcode.Of(err), "Error: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+	defer lock.Release()
+
+	logger := logging.Open(cfg).WithExecution(artifacts.NewID())
+	logger.Plan("diagnose "+strings.Join(args, " "), p)
+	result := executor.New(cfg).RunCommand(context.Background(), 0, p.Commands[0])
+	results := executor.Results{Items: []executor.Result{result}}
+	if result.Err != nil {
+		results.Failed = 1
+	}
+	logger.Results([]logging.ResultItem{result.LogItem()})
+
+	if jsonOutput {
+		if err := ui.PrintResultsJSON(stdout, results); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+	} else {
+		ui.PrintResults(stdout, results)
+	}
+	if results.Failed > 0 {
+		return results.ErrorCode().ExitCode()
+	}
+	return 0
+}
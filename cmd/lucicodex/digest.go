@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/digest"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// digestRounds limits how many digests `lucicodex schedule digest` sends; 0
+// runs until interrupted. Tests set it to stop the loop.
+var digestRounds = 0
+
+// runDigest implements `lucicodex digest`: a report on the executions of the
+// last since, summarized by the model unless summarize is false, and sent
+// to the digest webhooks with send.
+func runDigest(cfg config.Config, since time.Duration, summarize, send, jsonOutput bool, stdout, stderr io.Writer) int {
+	if since <= 0 {
+		return fail(errcode.InvalidRequest, "-since must be positive", jsonOutput, stdout, stderr)
+	}
+	if send && len(cfg.DigestWebhooks) == 0 {
+		return fail(errcode.ConfigInvalid, "No digest webhooks configured (set digest_webhooks)", jsonOutput, stdout, stderr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), digestTimeout(cfg))
+	defer cancel()
+	r, err := digest.Generate(ctx, cfg, time.Now().Add(-since), summarize)
+	if err != nil {
+		return fail(errcode.Of(err), "Digest failed: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+	} else {
+		fmt.Fprint(stdout, r.Text())
+	}
+	if send && !sendDigest(ctx, cfg, r, stderr) {
+		return 1
+	}
+	return 0
+}
+
+// runScheduleDigest implements `lucicodex schedule digest`: every
+// digest_interval seconds (daily by default) it sends a digest of that
+// interval to the digest webhooks, until interrupted.
+func runScheduleDigest(cfg config.Config, jsonOutput bool, stdout, stderr io.Writer) int {
+	if len(cfg.DigestWebhooks) == 0 {
+		return fail(errcode.ConfigInvalid, "No digest webhooks configured (set digest_webhooks)", jsonOutput, stdout, stderr)
+	}
+	if cfg.LogFile == "" {
+		return fail(errcode.ConfigInvalid, "Digest needs the audit log (set log_file)", jsonOutput, stdout, stderr)
+	}
+	interval := time.Duration(cfg.DigestInterval) * time.Second
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	if !jsonOutput {
+		fmt.Fprintf(stdout, "Sending a digest to %d webhook(s) every %s (Ctrl-C to stop)\n", len(cfg.DigestWebhooks), interval)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for round := 1; ; round++ {
+		select {
+		case <-ctx.Done():
+			return 0
+		case now := <-tick.C:
+			gctx, cancel := context.WithTimeout(ctx, digestTimeout(cfg))
+			r, err := digest.Generate(gctx, cfg, now.Add(-interval), true)
+			if err != nil {
+				fmt.Fprintf(stderr, "digest: %v\n", err)
+			} else if sendDigest(gctx, cfg, r, stderr) && !jsonOutput {
+				fmt.Fprintf(stdout, "%s sent the digest of %d run(s)\n", now.Local().Format("2006-01-02 15:04:05"), r.Runs)
+			}
+			cancel()
+		}
+		if digestRounds > 0 && round >= digestRounds {
+			return 0
+		}
+	}
+}
+
+// sendDigest posts r to every digest webhook and reports whether all of
+// them accepted it.
+func sendDigest(ctx context.Context, cfg config.Config, r *digest.Report, stderr io.Writer) bool {
+	ok := true
+	for _, u := range cfg.DigestWebhooks {
+		if err := digest.Post(ctx, u, r); err != nil {
+			fmt.Fprintf(stderr, "digest: %v\n", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// digestTimeout bounds reading the logs and the model call of a digest.
+func digestTimeout(cfg config.Config) time.Duration {
+	secs := cfg.TimeoutSeconds
+	if secs < 60 {
+		secs = 60
+	}
+	return time.Duration(secs) * time.Second
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// discoverEnv is where -discover looks for settings; tests point it at fixtures.
+var discoverEnv = config.DefaultDiscoverEnv
+
+// keyFileNames maps API key options to their key file entries.
+var keyFileNames = map[string]string{
+	"api_key":           config.KeyGemini,
+	"openai_api_key":    config.KeyOpenAI,
+	"anthropic_api_key": config.KeyAnthropic,
+}
+
+// runDiscover implements -discover: it collects credentials and settings
+// left by other tools, shows how they would change the config file and
+// writes them after confirmation (or directly with -approve).
+func runDiscover(configPath string, approve, jsonOutput bool, stdin io.Reader, stdout, stderr io.Writer) int {
+	path := config.FilePath(configPath)
+	if path == "" {
+		path = "/etc/lucicodex/config.json"
+		if os.Geteuid() != 0 {
+			home, _ := os.UserHomeDir()
+			path = filepath.Join(home, ".config", "lucicodex", "config.json")
+		}
+	}
+	file := map[string]interface{}{}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &file); err != nil {
+			return fail(errcode.ConfigInvalid, fmt.Sprintf("Cannot parse %s: %v", path, err), jsonOutput, stdout, stderr)
+		}
+	} else if !os.IsNotExist(err) {
+		return fail(errcode.ConfigInvalid, fmt.Sprintf("Cannot read %s: %v", path, err), jsonOutput, stdout, stderr)
+	}
+
+	// Keys already in the key file count as configured
+	current := map[string]interface{}{}
+	for k, v := range file {
+		current[k] = v
+	}
+	keyFile, _ := file["api_key_file"].(string)
+	if keyFile != "" {
+		if keys, err := config.ReadKeyFile(keyFile); err == nil {
+			for option, name := range keyFileNames {
+				if v := keys[name]; v != "" {
+					current[option] = v
+				}
+			}
+		}
+	}
+
+	changes := config.ProposeChanges(current, config.Discover(discoverEnv()))
+	shown := make([]config.Change, len(changes))
+	for i, c := range changes {
+		if c.Secret {
+			c.Old, c.New = maskSecret(c.Old), maskSecret(c.New)
+		}
+		shown[i] = c
+	}
+
+	if !jsonOutput {
+		if len(changes) == 0 {
+			fmt.Fprintf(stdout, "Nothing to import: %s already has every setting found.\n", path)
+			return 0
+		}
+		fmt.Fprintf(stdout, "Proposed changes to %s:\n", path)
+		for _, c := range shown {
+			if c.Old == "" {
+				fmt.Fprintf(stdout, "  + %s: %s  (from %s)\n", c.Option, c.New, c.Source)
+			} else {
+				fmt.Fprintf(stdout, "  ~ %s: %s -> %s  (from %s)\n", c.Option, c.Old, c.New, c.Source)
+			}
+		}
+		if !approve {
+			ok, err := ui.Confirm(bufio.NewReader(stdin), stdout, "Write these changes?")
+			if err != nil {
+				fmt.Fprintf(stderr, "Confirmation error: %v\n", err)
+				return 1
+			}
+			if !ok {
+				fmt.Fprintln(stdout, "Cancelled")
+				return 0
+			}
+		}
+	}
+
+	written := false
+	if len(changes) > 0 && (approve || !jsonOutput) {
+		if err := writeDiscovered(path, file, keyFile, changes); err != nil {
+			return fail(errcode.Internal, "Cannot write config: "+err.Error(), jsonOutput, stdout, stderr)
+		}
+		written = true
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]interface{}{"path": path, "changes": shown, "written": written}); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(stdout, "✓ Configuration saved to %s\n", path)
+	return 0
+}
+
+// writeDiscovered applies changes to the config file. API keys go to the key
+// file instead when one is configured.
+func writeDiscovered(path string, file map[string]interface{}, keyFile string, changes []config.Change) error {
+	keys := map[string]string{}
+	secret := false
+	for _, c := range changes {
+		if name := keyFileNames[c.Option]; name != "" && keyFile != "" {
+			keys[name] = c.New
+			continue
+		}
+		file[c.Option] = c.New
+		secret = secret || c.Secret
+	}
+	if len(keys) > 0 {
+		if err := config.WriteKeyFile(keyFile, keys); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	if secret {
+		// An existing file keeps its mode; do not leave new keys world-readable
+		return os.Chmod(path, 0o600)
+	}
+	return nil
+}
+
+// maskSecret shows only enough of a credential to recognize it.
+func maskSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	if len(s) <= 8 {
+		return "****"
+	}
+	return s[:4] + "…" + s[len(s)-4:]
+}
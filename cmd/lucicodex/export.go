@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/export"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
+)
+
+// runHistoryExport implements `lucicodex history export`: the executions of
+// the audit log in the last since, oldest first, as CSV or JSON on stdout.
+func runHistoryExport(cfg config.Config, format, since string, jsonOutput bool, stdout, stderr io.Writer) int {
+	period, err := exportArgs(format, since)
+	if err != nil {
+		return fail(errcode.InvalidRequest, err.Error(), jsonOutput, stdout, stderr)
+	}
+	if cfg.LogFile == "" {
+		return fail(errcode.ConfigInvalid, "History is disabled (set log_file)", jsonOutput, stdout, stderr)
+	}
+	entries, err := logging.History(cfg)
+	if err != nil {
+		return fail(errcode.Internal, "Failed to read history: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+	rows := export.Executions(entries, time.Now().Add(-period))
+	if err := export.WriteExecutions(stdout, rows, format); err != nil {
+		fmt.Fprintf(stderr, "Export error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runMetricsExport implements `lucicodex metrics export`: one row per day
+// with activity among the daily rollups covering since, as CSV or JSON.
+func runMetricsExport(cfg config.Config, format, since string, jsonOutput bool, stdout, stderr io.Writer) int {
+	period, err := exportArgs(format, since)
+	if err != nil {
+		return fail(errcode.InvalidRequest, err.Error(), jsonOutput, stdout, stderr)
+	}
+	store := metrics.OpenRollupStore(cfg)
+	if store == nil {
+		return fail(errcode.ConfigInvalid, "Metrics persistence is disabled (set metrics_dir)", jsonOutput, stdout, stderr)
+	}
+	rollups, err := store.Days(export.WindowDays(period))
+	if err != nil {
+		return fail(errcode.Internal, "Failed to read metrics: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+	if err := export.WriteDays(stdout, export.Rollups(rollups), format); err != nil {
+		fmt.Fprintf(stderr, "Export error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// exportArgs checks the -format and -since flags of the export commands and
+// returns the period.
+func exportArgs(format, since string) (time.Duration, error) {
+	if err := export.CheckFormat(format); err != nil {
+		return 0, err
+	}
+	return export.ParseSince(since)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+)
+
+// runFeedback implements `lucicodex feedback <id> good|bad [note]`: it
+// records in the audit log whether an execution did what was asked.
+func runFeedback(cfg config.Config, args []string, jsonOutput bool, stdout, stderr io.Writer) int {
+	if cfg.LogFile == "" {
+		return fail(errcode.ConfigInvalid, "History is disabled (set log_file)", jsonOutput, stdout, stderr)
+	}
+	note := ""
+	if len(args) == 3 {
+		note = args[2]
+	}
+	entry, err := logging.RecordFeedback(cfg, args[0], args[1], note)
+	if err != nil {
+		return fail(errcode.Of(err), "Failed to record feedback: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]interface{}{"id": entry.ID, "feedback": entry.Feedback}); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(stdout, "Rated execution %s as %s: %s\n", entry.ID, entry.Feedback.Rating, oneLine(entry.Prompt, 60))
+	return 0
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+)
+
+// runHistory implements `lucicodex history [id]`: the last limit plans of
+// the audit log, newest first, or the plan and output of one execution.
+func runHistory(cfg config.Config, args []string, limit int, jsonOutput bool, stdout, stderr io.Writer) int {
+	if cfg.LogFile == "" {
+		return fail(errcode.ConfigInvalid, "History is disabled (set log_file)", jsonOutput, stdout, stderr)
+	}
+	entries, err := logging.History(cfg)
+	if err != nil {
+		return fail(errcode.Internal, "Failed to read history: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+
+	var result interface{}
+	if len(args) == 1 {
+		i := len(entries) - 1
+		for ; i >= 0 && entries[i].ID != args[0]; i-- {
+		}
+		if i < 0 {
+			return fail(errcode.NotFound, "No execution "+args[0]+" in "+cfg.LogFile, jsonOutput, stdout, stderr)
+		}
+		if !jsonOutput {
+			printHistoryEntry(stdout, entries[i])
+			return 0
+		}
+		result = entries[i]
+	} else {
+		if limit > 0 && len(entries) > limit {
+			entries = entries[len(entries)-limit:]
+		}
+		recent := make([]logging.HistoryEntry, 0, len(entries))
+		for i := len(entries) - 1; i >= 0; i-- {
+			recent = append(recent, entries[i])
+		}
+		if !jsonOutput {
+			if len(recent) == 0 {
+				fmt.Fprintf(stdout, "No history in %s\n", cfg.LogFile)
+				return 0
+			}
+			fmt.Fprintf(stdout, "%-16s %-16s %-9s %s\n", "TIME", "ID", "STATUS", "PROMPT")
+			for _, h := range recent {
+				id := h.ID
+				if id == "" {
+					id = "-"
+				}
+				fmt.Fprintf(stdout, "%-16s %-16s %-9s %s\n", h.Time.Local().Format("2006-01-02 15:04"), id, h.Status(), oneLine(h.Prompt, 60))
+			}
+			return 0
+		}
+		result = map[string]interface{}{"entries": recent}
+	}
+
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func printHistoryEntry(w io.Writer, h logging.HistoryEntry) {
+	fmt.Fprintf(w, "Execution %s at %s: %s\n", h.ID, h.Time.Local().Format("2006-01-02 15:04:05"), h.Status())
+	if h.Client != "" {
+		fmt.Fprintf(w, "Client: %s\n", h.Client)
+	}
+	if h.Actor != "" {
+		fmt.Fprintf(w, "Authorized by: %s (%s)\n", h.Actor, h.Role)
+	}
+	if h.Remote != "" {
+		fmt.Fprintf(w, "From: %s", h.Remote)
+		if h.Device != "" {
+			fmt.Fprintf(w, ", device %s", h.Device)
+		}
+		fmt.Fprintln(w)
+	}
+	if h.UserAgent != "" {
+		fmt.Fprintf(w, "User agent: %s\n", h.UserAgent)
+	}
+	if h.Session != "" {
+		fmt.Fprintf(w, "LuCI session: %s\n", h.Session)
+	}
+	fmt.Fprintf(w, "Prompt: %s\n", h.Prompt)
+	if h.Rejected != "" {
+		fmt.Fprintf(w, "Rejected: %s\n", h.Rejected)
+	}
+	if fb := h.Feedback; fb != nil {
+		fmt.Fprintf(w, "Feedback: %s", fb.Rating)
+		if fb.Note != "" {
+			fmt.Fprintf(w, " (%s)", fb.Note)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "\nPlan:")
+	for i, c := range h.Plan.Commands {
+		fmt.Fprintf(w, "  %d. %s\n", i+1, executor.FormatPlanned(c))
+	}
+	if len(h.Results) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nResults:")
+	for _, r := range h.Results {
+		fmt.Fprintf(w, "  %d. %s (%s)\n", r.Index+1, executor.FormatCommand(r.Command), r.Elapsed)
+		if out := strings.TrimRight(r.Output, "\n"); out != "" {
+			fmt.Fprintf(w, "     %s\n", strings.ReplaceAll(out, "\n", "\n     "))
+		}
+		if r.Error != "" {
+			fmt.Fprintf(w, "     Error: %s\n", r.Error)
+		}
+	}
+}
+
+// oneLine shortens s to a single line of at most n runes.
+func oneLine(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-3]) + "..."
+	}
+	return s
+}
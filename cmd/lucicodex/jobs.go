@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/jobs"
+)
+
+// isJobsCommand reports whether args are `jobs [list|tail <id> [lines]|stop <id>]`.
+func isJobsCommand(args []string) bool {
+	if len(args) == 0 || len(args) > 4 || args[0] != "jobs" {
+		return false
+	}
+	if len(args) == 1 {
+		return true
+	}
+	switch args[1] {
+	case "list":
+		return len(args) == 2
+	case "tail":
+		return len(args) >= 3
+	case "stop":
+		return len(args) == 3
+	}
+	return false
+}
+
+// runJobs implements the jobs subcommands for background commands started by
+// earlier plans.
+func runJobs(cfg config.Config, args []string, jsonOutput bool, stdout, stderr io.Writer) int {
+	m := jobs.Open(cfg)
+	sub := "list"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	switch sub {
+	case "tail":
+		lines := 20
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 0 {
+				fmt.Fprintf(stderr, "Invalid line count: %s\n", args[2])
+				return 1
+			}
+			lines = n
+		}
+		out, err := m.Tail(args[1], lines)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to read job %s: %v\n", args[1], err)
+			return 1
+		}
+		fmt.Fprint(stdout, out)
+		return 0
+	case "stop":
+		j, err := m.Stop(args[1])
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to stop job %s: %v\n", args[1], err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "Stopped job %s (%s)\n", j.ID, executor.FormatCommand(j.Command))
+		return 0
+	}
+
+	list, err := m.List()
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to list jobs: %v\n", err)
+		return 1
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(list); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	jobs.PrintTable(stdout, list)
+	return 0
+}
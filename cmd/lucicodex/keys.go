@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// runKeysEncrypt encrypts the plain API keys in the config file, the key
+// file and UCI with a key bound to this device. Encrypted keys are
+// decrypted transparently when the config is loaded.
+func runKeysEncrypt(configPath string, jsonOutput bool, stdout, stderr io.Writer) int {
+	done, err := config.EncryptStoredKeys(configPath)
+	if errors.Is(err, config.ErrNoDeviceKey) {
+		return fail(errcode.ConfigInvalid, err.Error(), jsonOutput, stdout, stderr)
+	} else if err != nil {
+		for _, where := range done {
+			fmt.Fprintf(stderr, "Encrypted %s\n", where)
+		}
+		return fail(errcode.Internal, "Cannot encrypt API keys: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+
+	if !jsonOutput {
+		if len(done) == 0 {
+			fmt.Fprintln(stdout, "No plain API keys found")
+			return 0
+		}
+		for _, where := range done {
+			fmt.Fprintf(stdout, "✓ Encrypted %s\n", where)
+		}
+		fmt.Fprintln(stdout, "These keys now only decrypt on this router; keep a copy of the plain keys elsewhere.")
+		return 0
+	}
+	if done == nil {
+		done = []string{}
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(map[string]interface{}{"encrypted": done}); err != nil {
+		fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+		return 1
+	}
+	return 0
+}
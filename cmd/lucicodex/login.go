@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/auth"
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+// loginTimeout bounds how long we wait for the user to authorize in a browser.
+var loginTimeout = 10 * time.Minute
+
+// runLogin implements `lucicodex login <provider>` and `lucicodex logout <provider>`.
+func runLogin(cfg config.Config, cmd string, args []string, stdout, stderr io.Writer) int {
+	provider := cfg.Provider
+	if len(args) > 0 {
+		provider = args[0]
+	}
+	if provider == "" {
+		provider = "gemini"
+	}
+	store := auth.NewStore(cfg.TokenFile)
+	if err := store.Load(); err != nil {
+		fmt.Fprintf(stderr, "Failed to read token store: %v\n", err)
+		return 1
+	}
+
+	if cmd == "logout" {
+		store.Delete(provider)
+		if err := store.Save(); err != nil {
+			fmt.Fprintf(stderr, "Failed to save token store: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "Removed stored %s token\n", provider)
+		return 0
+	}
+
+	oc := auth.ConfigFor(cfg, provider)
+	if err := oc.Validate(); err != nil {
+		fmt.Fprintf(stderr, "Cannot log in to %s: %v\n", provider, err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), loginTimeout)
+	defer cancel()
+	hc := &http.Client{Timeout: 30 * time.Second}
+
+	var tok auth.Token
+	var err error
+	if oc.DeviceURL != "" {
+		tok, err = deviceLogin(ctx, oc, hc, stdout)
+	} else {
+		tok, err = pkceLogin(ctx, oc, hc, stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Login failed: %v\n", err)
+		return 1
+	}
+
+	store.Put(tok)
+	if err := store.Save(); err != nil {
+		fmt.Fprintf(stderr, "Failed to save token store: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "Logged in to %s; token saved to %s\n", provider, store.PathOrDefault())
+	return 0
+}
+
+func deviceLogin(ctx context.Context, oc auth.OAuthConfig, hc *http.Client, stdout io.Writer) (auth.Token, error) {
+	dc, err := oc.StartDevice(ctx, hc)
+	if err != nil {
+		return auth.Token{}, err
+	}
+	if dc.VerificationURIComplete != "" {
+		fmt.Fprintf(stdout, "Open %s to authorize LuciCodex\n", dc.VerificationURIComplete)
+	} else {
+		fmt.Fprintf(stdout, "Open %s and enter code: %s\n", dc.URI(), dc.UserCode)
+	}
+	fmt.Fprintln(stdout, "Waiting for authorization...")
+	return oc.PollDevice(ctx, hc, dc)
+}
+
+// pkceLogin runs the authorization code flow with a loopback redirect. On a
+// headless router, forward the printed port over SSH (ssh -L) before opening
+// the URL.
+func pkceLogin(ctx context.Context, oc auth.OAuthConfig, hc *http.Client, stdout io.Writer) (auth.Token, error) {
+	verifier, challenge, err := auth.NewPKCE()
+	if err != nil {
+		return auth.Token{}, err
+	}
+	state, err := auth.NewState()
+	if err != nil {
+		return auth.Token{}, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return auth.Token{}, fmt.Errorf("start callback listener: %w", err)
+	}
+	redirectURI := fmt.Sprintf("http://%s/callback", ln.Addr().String())
+
+	type result struct {
+		code string
+		err  error
+	}
+	done := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		var res result
+		switch {
+		case q.Get("state") != state:
+			res.err = errors.New("state mismatch in authorization callback")
+		case q.Get("error") != "":
+			res.err = &auth.OAuthError{Code: q.Get("error"), Description: q.Get("error_description")}
+		case q.Get("code") == "":
+			res.err = errors.New("authorization callback missing code")
+		default:
+			res.code = q.Get("code")
+		}
+		if res.err != nil {
+			http.Error(w, res.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "LuciCodex is authorized. You can close this window.")
+		}
+		select {
+		case done <- res:
+		default:
+		}
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	fmt.Fprintf(stdout, "Open this URL to authorize LuciCodex:\n%s\n", oc.AuthCodeURL(state, challenge, redirectURI))
+	fmt.Fprintf(stdout, "Waiting for redirect on %s...\n", redirectURI)
+
+	select {
+	case <-ctx.Done():
+		return auth.Token{}, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			return auth.Token{}, res.err
+		}
+		return oc.Exchange(ctx, hc, res.code, verifier, redirectURI)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -12,49 +13,50 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/approver"
+	"github.com/aezizhu/LuciCodex/internal/artifacts"
+	"github.com/aezizhu/LuciCodex/internal/docs"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
 	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/firewall"
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/intent"
 	"github.com/aezizhu/LuciCodex/internal/llm"
 	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
 	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
 	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
 	"github.com/aezizhu/LuciCodex/internal/policy"
-	"github.com/aezizhu/LuciCodex/internal/repl"
-	"github.com/aezizhu/LuciCodex/internal/server"
+	"github.com/aezizhu/LuciCodex/internal/rollback"
 	"github.com/aezizhu/LuciCodex/internal/ui"
-	"github.com/aezizhu/LuciCodex/internal/wizard"
 )
 
 var version = "1.0.0"
 
-var lockPaths = []string{"/var/lock/lucicodex.lock", "/tmp/lucicodex.lock"}
-
-func acquireLock() (*os.File, string, error) {
-	var lastErr error
-
-	for i, path := range lockPaths {
-		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
-		if err == nil {
-			if i > 0 {
-				fmt.Fprintf(os.Stderr, "Note: falling back to %s\n", path)
-			}
-			return f, path, nil
-		}
-		lastErr = err
-		if os.IsExist(err) {
-			return nil, "", fmt.Errorf("execution in progress (lock file exists: %s)", path)
+// hasArtifacts reports whether any command left files in the artifacts
+// directory.
+func hasArtifacts(results executor.Results) bool {
+	for _, it := range results.Items {
+		if len(it.Artifacts) > 0 {
+			return true
 		}
 	}
-
-	return nil, "", fmt.Errorf("failed to acquire lock: %w", lastErr)
+	return false
 }
 
-func releaseLock(f *os.File) {
-	if f != nil {
-		name := f.Name()
-		f.Close()
-		os.Remove(name)
+// stdinIsPiped reports whether stdin is a pipe or regular file rather than a terminal.
+var stdinIsPiped = func(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return false
 	}
+	return st.Mode()&os.ModeCharDevice == 0
 }
 
 func main() {
@@ -62,177 +64,258 @@ func main() {
 }
 
 func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
-	fs := flag.NewFlagSet("lucicodex", flag.ContinueOnError)
-	fs.SetOutput(stderr)
+	// Started detached by rollback.Spawn; must not depend on a loadable config
+	if len(args) == 2 && args[0] == rollback.WatchdogCommand {
+		if err := rollback.Watch(args[1]); err != nil {
+			fmt.Fprintf(stderr, "Rollback failed: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if len(args) > 0 {
+		if c := lookupCommand(args[0]); c != nil && c.parses(args[1:]) {
+			return c.exec(args[1:], false, stdin, stdout, stderr)
+		}
+	}
+	return lookupCommand("run").exec(args, true, stdin, stdout, stderr)
+}
 
+// runFlags registers the flags of the run command. The mode flags that
+// predate subcommands are kept for existing scripts and init files.
+func runFlags(fs *flag.FlagSet) action {
+	o := addRunOptions(fs)
 	var (
-		configPath  = fs.String("config", "", "path to JSON config file")
-		model       = fs.String("model", "", "model name")
-		provider    = fs.String("provider", "", "provider name (gemini, openai, anthropic)")
-		dryRun      = fs.Bool("dry-run", true, "only print plan, do not execute")
-		approve     = fs.Bool("approve", false, "auto-approve plan without confirmation")
-		confirmEach = fs.Bool("confirm-each", false, "confirm each command before execution")
-		timeout     = fs.Int("timeout", 0, "per-command timeout in seconds")
-		maxCommands = fs.Int("max-commands", 0, "maximum number of commands to execute")
-		maxRetries  = fs.Int("max-retries", -1, "maximum retry attempts for failed commands (-1 = use config)")
-		autoRetry   = fs.Bool("auto-retry", true, "automatically retry failed commands with AI-generated fixes")
-		logFile     = fs.String("log-file", "", "log file path")
-		showVersion = fs.Bool("version", false, "print version and exit")
-		jsonOutput  = fs.Bool("json", false, "emit JSON output for plan and results")
-		facts       = fs.Bool("facts", true, "include environment facts in prompt")
-		interactive = fs.Bool("interactive", false, "start interactive REPL mode")
-		setup       = fs.Bool("setup", false, "run setup wizard")
-		joinArgs    = fs.Bool("join-args", false, "join all arguments into single prompt (experimental)")
-		serverMode  = fs.Bool("server", false, "run in daemon mode")
-		port        = fs.Int("port", 9999, "daemon port")
-		stream      = fs.Bool("stream", true, "stream command output in real-time")
-		summarize   = fs.Bool("summarize", true, "summarize command output with AI to answer user's question")
+		serverMode  = fs.Bool("server", false, "run in daemon mode (same as 'lucicodex serve')")
+		port        = fs.Int("port", 9999, "daemon port, with -server")
+		socketPath  = fs.String("socket", "", "with -server, serve the daemon API on this Unix socket instead of TCP")
+		interactive = fs.Bool("interactive", false, "start interactive REPL mode (same as 'lucicodex repl')")
+		setup       = fs.Bool("setup", false, "run setup wizard (same as 'lucicodex setup')")
+		discover    = fs.Bool("discover", false, "import existing settings (same as 'lucicodex setup -discover')")
+		answers     = fs.String("answers", "", "with -setup, set up without asking from this JSON answers file (- for stdin)")
+		stats       = fs.Bool("stats", false, "print daily usage statistics and exit (same as 'lucicodex usage')")
+		statsDays   = fs.Int("stats-days", 7, "number of days covered by -stats")
 	)
-
-	if err := fs.Parse(args); err != nil {
-		return 1
-	}
-
-	if *showVersion {
-		fmt.Fprintf(stdout, "LuciCodex version %s\n", version)
-		return 0
+	return func(e *env, args []string) int {
+		switch {
+		case *setup:
+			return runSetup(*answers, false, e.stdin, e.stdout, e.stderr)
+		case *discover:
+			return runDiscover(e.configPath, *o.approve, e.jsonOutput, e.stdin, e.stdout, e.stderr)
+		case *stats:
+			return runStats(e.cfg, *statsDays, e.jsonOutput, e.stdout, e.stderr)
+		case *serverMode:
+			if e.set["socket"] {
+				e.cfg.SocketPath = *socketPath
+			}
+			return runServe(e.cfg, *port, e.stderr)
+		case *interactive:
+			return runREPL(e.cfg, e.stdin, e.stdout, e.stderr)
+		}
+		return runPrompt(e, o, args)
 	}
+}
 
-	cfg, err := config.Load(*configPath)
-	if err != nil {
-		if !*setup {
-			fmt.Fprintf(stderr, "Configuration error: %v\n", err)
-			fmt.Fprintf(stderr, "Run with -setup to configure LuciCodex\n")
-			return 1
-		}
-		cfg = config.Config{}
+// addRunOptions registers the flags shared by run and the workflows built
+// on it, such as optimize-wifi.
+func addRunOptions(fs *flag.FlagSet) runOptions {
+	return runOptions{
+		dryRun:      fs.Bool("dry-run", true, "only print plan, do not execute"),
+		approve:     fs.Bool("approve", false, "auto-approve plan without confirmation"),
+		confirmEach: fs.Bool("confirm-each", false, "confirm each command before execution"),
+		maxCommands: fs.Int("max-commands", 0, "maximum number of commands to execute"),
+		maxRetries:  fs.Int("max-retries", -1, "maximum retry attempts for failed commands (-1 = use config)"),
+		planTimeout: fs.Int("plan-timeout", 0, "time budget of the whole plan in seconds, retries included (0 = none)"),
+		autoRetry:   fs.Bool("auto-retry", true, "automatically retry failed commands with AI-generated fixes"),
+		facts:       fs.Bool("facts", true, "include environment facts in prompt"),
+		joinArgs:    fs.Bool("join-args", true, "join all arguments into the prompt (the default; kept for existing scripts)"),
+		firstArg:    fs.Bool("first-arg", false, "use only the first argument as the prompt, as before prompts were joined"),
+		stream:      fs.Bool("stream", true, "stream command output in real-time"),
+		summarize:   fs.Bool("summarize", true, "summarize command output with AI to answer user's question"),
+		attachStdin: fs.Bool("stdin", true, "attach piped stdin content to the prompt"),
+		ackWarnings: fs.Bool("ack-warnings", false, "acknowledge policy warnings when executing without confirmation"),
 	}
+}
 
-	// Track which flags were explicitly set
-	setFlags := make(map[string]bool)
-	fs.Visit(func(f *flag.Flag) {
-		setFlags[f.Name] = true
-	})
+// runOptions are the flags of the run command.
+type runOptions struct {
+	dryRun      *bool
+	approve     *bool
+	confirmEach *bool
+	maxCommands *int
+	maxRetries  *int
+	planTimeout *int
+	autoRetry   *bool
+	facts       *bool
+	joinArgs    *bool
+	firstArg    *bool
+	stream      *bool
+	summarize   *bool
+	attachStdin *bool
+	ackWarnings *bool
+	// extra is a prompt block added after the request, e.g. the wireless
+	// survey of optimize-wifi
+	extra string
+}
 
-	if setFlags["model"] {
-		cfg.Model = *model
-		// Prevent provider-specific settings from overriding the explicit CLI flag
-		cfg.OpenAIModel = ""
-		cfg.AnthropicModel = ""
-	}
-	if setFlags["provider"] {
-		cfg.Provider = *provider
+// runPrompt plans the commands for a request and runs them once approved.
+func runPrompt(e *env, o runOptions, promptArgs []string) int {
+	cfg, stdin, stdout, stderr := e.cfg, e.stdin, e.stdout, e.stderr
+	v := e.verbosity
+	if e.jsonOutput && v == ui.Normal {
+		// JSON output is quiet unless -v or -vv asks for messages on stderr
+		v = ui.Quiet
 	}
-	if setFlags["timeout"] {
-		cfg.TimeoutSeconds = *timeout
-	}
-	if setFlags["max-commands"] {
-		cfg.MaxCommands = *maxCommands
-	}
-	if setFlags["max-retries"] {
-		cfg.MaxRetries = *maxRetries
-	}
-	if setFlags["log-file"] {
-		cfg.LogFile = *logFile
-	}
-	if setFlags["dry-run"] {
-		cfg.DryRun = *dryRun
+
+	if e.set["max-commands"] {
+		// An explicit cap applies to every intent
+		cfg.MaxCommands = *o.maxCommands
+		cfg.MaxReadCommands = 0
+		cfg.MaxWriteCommands = 0
 	}
-	if setFlags["approve"] {
-		cfg.AutoApprove = *approve
+	if e.set["max-retries"] {
+		cfg.MaxRetries = *o.maxRetries
 	}
-	if setFlags["auto-retry"] {
-		cfg.AutoRetry = *autoRetry
+	if e.set["plan-timeout"] {
+		if *o.planTimeout < 0 {
+			return fail(errcode.InvalidRequest, "-plan-timeout must not be negative", e.jsonOutput, stdout, stderr)
+		}
+		cfg.PlanTimeoutSeconds = *o.planTimeout
 	}
-
-	// Re-apply provider settings after CLI flag overrides
-	cfg.ApplyProviderSettings()
-
-	if !*confirmEach && cfg.ConfirmEach {
-		*confirmEach = true
+	if e.set["dry-run"] {
+		cfg.DryRun = *o.dryRun
 	}
-
-	if *setup {
-		w := wizard.New(stdin, stdout)
-		if err := w.Run(); err != nil {
-			fmt.Fprintf(stderr, "Setup error: %v\n", err)
-			return 1
-		}
-		return 0
+	if e.set["approve"] {
+		cfg.AutoApprove = *o.approve
 	}
-
-	if *serverMode {
-		srv := server.New(cfg)
-		if err := srv.Start(*port); err != nil {
-			fmt.Fprintf(stderr, "Server error: %v\n", err)
-			return 1
-		}
-		return 0
+	if e.set["auto-retry"] {
+		cfg.AutoRetry = *o.autoRetry
 	}
-
-	if *interactive {
-		r := repl.New(cfg, stdin, stdout)
-		ctx := context.Background()
-		if err := r.Run(ctx); err != nil {
-			fmt.Fprintf(stderr, "REPL error: %v\n", err)
-			return 1
-		}
-		return 0
+	if !*o.confirmEach && cfg.ConfirmEach {
+		*o.confirmEach = true
 	}
 
-	promptArgs := fs.Args()
 	if len(promptArgs) == 0 {
 		fmt.Fprintf(stderr, "Usage: lucicodex [flags] <prompt>\n")
 		fmt.Fprintf(stderr, "Run 'lucicodex -h' for help\n")
-		return 1
+		return errcode.InvalidRequest.ExitCode()
 	}
 
-	var prompt string
-	if *joinArgs {
-		prompt = strings.Join(promptArgs, " ")
-	} else {
-		prompt = promptArgs[0]
+	prompt := promptFromArgs(promptArgs, *o.firstArg || !*o.joinArgs, v, stderr)
+	// Piped input (e.g. `cat error.log | lucicodex "why is pppoe failing"`)
+	var attachment string
+	stdinConsumed := false
+	if *o.attachStdin && stdinIsPiped(stdin) {
+		content, truncated, err := prompts.ReadAttachment(stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to read stdin: %v\n", err)
+			return 1
+		}
+		attachment = prompts.FormatAttachment("stdin", content, truncated)
+		stdinConsumed = true
 	}
+	// Shared by the clarifying questions and the confirmations, which read
+	// successive lines of stdin
+	reader := bufio.NewReader(stdin)
+
 	ctx := context.Background()
 
 	llmProvider := llm.NewProvider(cfg)
-	policyEngine := policy.New(cfg)
+	policyEngine := policy.New(cfg).WithControl(openwrt.SSHControlPath(ctx)).WithTopology(openwrt.DetectTopology(ctx)).WithFirewall(firewall.Load(ctx))
 	execEngine := executor.New(cfg)
-	logger := logging.New(cfg.LogFile)
-
-	instruction := prompts.GenerateSurvivalPrompt(cfg.MaxCommands)
-	if *facts {
+	execID := artifacts.NewID()
+	logger := logging.Open(cfg).WithExecution(execID)
+
+	kind, limit := intent.ForPrompt(cfg, prompt)
+	instruction := prompts.GeneratePlanPrompt(kind, limit)
+	instruction += prompts.ExamplesBlock(prompt, cfg.FewShotExamples)
+	instruction += prompts.CommandsBlock(prompt, cfg.CommandSnippets)
+	instruction += firewall.PromptBlock(ctx, prompt)
+	instruction += prompts.FeedbackBlock(cfg, cfg.FeedbackHints)
+	var envFacts openwrt.Facts
+	if *o.facts {
 		factsCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
 		defer cancel()
-		envFacts := openwrt.CollectFacts(factsCtx)
-		if envFacts != "" {
-			instruction += "\n\nEnvironment facts (read-only):\n" + envFacts
+		factsStart := time.Now()
+		envFacts = openwrt.CollectSignedFacts(factsCtx, cfg.FactsKeyFile)
+		v.Logf(ui.Verbose, stderr, "Collected %d fact sections in %s\n", len(envFacts.Stamp.Sections), time.Since(factsStart).Round(time.Millisecond))
+		if block := envFacts.PromptBlock(); block != "" {
+			instruction += "\n\n" + block
 		}
 	}
 
-	fullPrompt := instruction + "\n\nUser request: " + prompt
+	if cfg.DocsRetrieval {
+		docsCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		block, err := docs.Retrieve(docsCtx, llmProvider, prompt, cfg.DocsTopK)
+		cancel()
+		if err != nil {
+			v.Logf(ui.Normal, stderr, "Note: documentation retrieval skipped: %v\n", err)
+		} else {
+			instruction += block
+		}
+	}
+
+	fullPrompt := instruction + "\n\nUser request: " + prompt + o.extra + attachment
+	// JSON callers get the questions in the output and answer them in the
+	// prompt of their next call
+	canAsk := cfg.ClarifyRounds > 0 && !e.jsonOutput && !stdinConsumed && !(v == ui.Quiet && cfg.AutoApprove)
+	if cfg.ClarifyRounds == 0 || (!canAsk && !e.jsonOutput) {
+		fullPrompt += prompts.NoQuestionsNotice
+	}
 
 	// Ensure minimum timeout for LLM calls (at least 60 seconds)
 	llmTimeout := cfg.TimeoutSeconds
 	if llmTimeout < 60 {
 		llmTimeout = 60
 	}
-	if !*jsonOutput {
-		fmt.Fprintf(stderr, "Using provider: %s, model: %s, timeout: %ds\n", cfg.Provider, cfg.Model, llmTimeout)
-	}
+	v.Logf(ui.Normal, stderr, "Using provider: %s, model: %s, timeout: %ds\n", cfg.Provider, cfg.Model, llmTimeout)
+	v.Logf(ui.Debug, stderr, "llm: prompt of %d bytes\n", len(fullPrompt))
 
 	// Generate plan
 	planCtx, cancel := context.WithTimeout(ctx, time.Duration(llmTimeout)*time.Second)
 	defer cancel()
 
+	planStart := time.Now()
 	p, err := llmProvider.GeneratePlan(planCtx, fullPrompt)
+	// Metrics are best effort and must never fail a run
+	_ = metrics.OpenRollupStore(cfg).Record(cfg.Provider, len(p.Commands), time.Since(planStart), err)
 	if err != nil {
-		fmt.Fprintf(stderr, "LLM error: %v\n", err)
-		return 1
+		return fail(errcode.Of(err), "LLM error: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+	v.Logf(ui.Verbose, stderr, "Plan of %d command(s) generated in %s\n", len(p.Commands), time.Since(planStart).Round(time.Millisecond))
+	v.Logf(ui.Debug, stderr, "llm: %d tokens used\n", llm.TokensUsed(llmProvider))
+
+	var answers []prompts.Clarification
+	for round := 1; canAsk && round <= cfg.ClarifyRounds && len(p.Commands) == 0 && len(p.Questions) > 0; round++ {
+		if p.Summary != "" {
+			fmt.Fprintln(stdout, p.Summary)
+		}
+		asked := len(answers)
+		for _, q := range p.Questions {
+			answer, err := ui.Ask(reader, stdout, q)
+			if err != nil {
+				break
+			}
+			answers = append(answers, prompts.Clarification{Question: q, Answer: answer})
+		}
+		if len(answers)-asked < len(p.Questions) {
+			// Input ended; the questions are shown with the response below
+			answers = answers[:asked]
+			break
+		}
+		clarifyCtx, cancel := context.WithTimeout(ctx, time.Duration(llmTimeout)*time.Second)
+		p, err = llmProvider.GeneratePlan(clarifyCtx, fullPrompt+prompts.ClarificationBlock(answers, round == cfg.ClarifyRounds))
+		cancel()
+		if err != nil {
+			return fail(errcode.Of(err), "LLM error: "+err.Error(), e.jsonOutput, stdout, stderr)
+		}
+		v.Logf(ui.Verbose, stderr, "Plan of %d command(s) generated after clarification round %d\n", len(p.Commands), round)
+	}
+	if *o.facts {
+		p.Facts = &envFacts.Stamp
 	}
 
 	if len(p.Commands) == 0 {
-		if *jsonOutput {
+		if e.jsonOutput {
 			if err := ui.PrintPlanJSON(stdout, p); err != nil {
 				fmt.Fprintf(stderr, "JSON output error: %v\n", err)
 				return 1
@@ -244,37 +327,112 @@ func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 		return 0
 	}
 
-	if cfg.MaxCommands > 0 && len(p.Commands) > cfg.MaxCommands {
-		p.Commands = p.Commands[:cfg.MaxCommands]
+	if limit > 0 && len(p.Commands) > limit {
+		v.Logf(ui.Normal, stderr, "Plan has %d commands, more than the limit of %d; asking for a shorter one\n", len(p.Commands), limit)
+		limitCtx, cancel := context.WithTimeout(ctx, time.Duration(llmTimeout)*time.Second)
+		p, err = llm.FitLimit(limitCtx, llmProvider, fullPrompt, p, limit)
+		cancel()
+		if err != nil {
+			logger.Rejected(prompt, p, err.Error())
+			return fail(errcode.Of(err), "Plan rejected: "+err.Error(), e.jsonOutput, stdout, stderr)
+		}
+		if *o.facts {
+			p.Facts = &envFacts.Stamp
+		}
 	}
 
-	// Validate plan
-	if err := policyEngine.ValidatePlan(p); err != nil {
-		fmt.Fprintf(stderr, "Plan rejected by policy: %v\n", err)
-		return 1
+	// Flag tools that are not installed, or plan their installation
+	planned := len(p.Commands)
+	p = policyEngine.CheckTools(p)
+	if added := len(p.Commands) - planned; added > 0 {
+		v.Logf(ui.Verbose, stderr, "Policy: added %d command(s) installing missing tools\n", added)
 	}
 
-	if *jsonOutput {
-		if err := ui.PrintPlanJSON(stdout, p); err != nil {
+	// Validate plan
+	if err := policyEngine.ValidatePlan(p); err != nil {
+		logger.Rejected(prompt, p, err.Error())
+		if !cfg.SuggestAlternatives {
+			return failPolicy("Plan rejected by policy: "+policy.Explain(err), policyEngine.Trace(p), e.jsonOutput, stdout, stderr)
+		}
+		v.Logf(ui.Normal, stderr, "Plan rejected by policy; asking for an alternative\n")
+		altCtx, cancel := context.WithTimeout(ctx, time.Duration(llmTimeout)*time.Second)
+		alt, altErr := policyEngine.Alternative(altCtx, llmProvider, fullPrompt+prompts.AlternativeBlock(policy.Explain(err)), err, limit)
+		cancel()
+		if altErr != nil {
+			if alt.Commands != nil {
+				logger.Rejected(prompt, alt, altErr.Error())
+			}
+			rejected := p
+			if alt.Commands != nil {
+				rejected = alt
+			}
+			return failPolicy("Plan rejected by policy: "+policy.Explain(err)+"\n"+policy.Explain(altErr), policyEngine.Trace(rejected), e.jsonOutput, stdout, stderr)
+		}
+		alt.Facts = p.Facts
+		p = alt
+	}
+	p.PolicyWarnings = policyEngine.Warnings(p)
+	p.Lint = policy.LintPlan(p)
+	p.Estimate = impact.Estimate(cfg, p, llm.TokensUsed(llmProvider))
+	// Files written through tee or uci import are shown as diffs too
+	p.FileChanges = execEngine.Stage(ctx, p)
+	v.Logf(ui.Verbose, stderr, "Policy: allowed %d command(s), %d warning(s)\n", len(p.Commands), len(p.PolicyWarnings))
+
+	switch {
+	case e.jsonOutput:
+		// The trace is for tools reading the output, not for the log
+		traced := p
+		traced.PolicyTrace = policyEngine.Trace(p)
+		if err := ui.PrintPlanJSON(stdout, traced); err != nil {
 			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
 			return 1
 		}
-	} else {
-		ui.PrintPlan(stdout, p)
+	case v == ui.Quiet && cfg.AutoApprove && !*o.confirmEach && !cfg.DryRun && p.AlternativeTo == "":
+		// Nobody reviews the plan; only the outcome is printed
+	default:
+		ui.PrintPlanElevated(stdout, p, cfg.ElevateCommand, cfg.FilePaths)
 	}
 
 	logger.Plan(prompt, p)
 
 	if cfg.DryRun {
-		if !*jsonOutput {
+		if !e.jsonOutput {
 			fmt.Fprintln(stdout, "\nDry run mode - no execution")
 		}
 		return 0
 	}
 
-	if !cfg.AutoApprove {
-		reader := bufio.NewReader(stdin)
-		ok, err := ui.Confirm(reader, stdout, "Execute these commands?")
+	// An alternative plan is not what was asked for, so it is always confirmed
+	approved := cfg.AutoApprove && p.AlternativeTo == ""
+	external := approver.Enabled(cfg)
+	if stdinConsumed && (!approved && !external || *o.confirmEach) {
+		return fail(errcode.InvalidRequest, "Cannot confirm execution: stdin was used for piped input (use -approve)", e.jsonOutput, stdout, stderr)
+	}
+
+	if external {
+		// The approver sees the plan with its warnings, so its approval
+		// acknowledges them
+		v.Logf(ui.Normal, stderr, "Waiting for the approval command...\n")
+		if err := approver.Ask(ctx, cfg, approver.Request{Source: "cli", Prompt: prompt, Plan: p}); err != nil {
+			return fail(errcode.Of(err), "Error: "+err.Error(), e.jsonOutput, stdout, stderr)
+		}
+	} else if approved {
+		// Nobody is asked, so warnings need the explicit flag
+		if err := policy.RequireAck(p, *o.ackWarnings); err != nil {
+			return fail(errcode.Of(err), "Error: "+err.Error(), e.jsonOutput, stdout, stderr)
+		}
+	} else {
+		question := "Execute these commands?"
+		if len(p.PolicyWarnings) > 0 {
+			question = "Execute these commands despite the policy warnings?"
+		}
+		if p.AlternativeTo != "" {
+			question = "Execute the alternative plan?"
+		}
+		ok, err := ui.Confirm(reader, stdout, question)
+		if w := policy.ControlWarning(p); err == nil && ok && w != nil {
+			ok, err = ui.Confirm(reader, stdout, fmt.Sprintf("Command %d may disconnect this session. Really execute it?", w.Command+1))
+		}
 		if err != nil {
 			fmt.Fprintf(stderr, "Confirmation error: %v\n", err)
 			return 1
@@ -285,28 +443,42 @@ func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 		}
 	}
 
-	lockFile, lockPath, err := acquireLock()
+	lock, err := execlock.Acquire("cli")
 	if err != nil {
-		fmt.Fprintf(stderr, "Error: %v\n", err)
-		return 1
+		return fail(errcode.Of(err), "Error: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+	defer lock.Release()
+
+	v.Logf(ui.Verbose, stderr, "Acquired execution lock: %s\n", lock.Path())
+
+	artifactsDir := ""
+	if store := artifacts.NewStore(cfg.ArtifactsDir, cfg.ArtifactsMaxMB, cfg.ArtifactsRetentionDays); store != nil {
+		if dir, err := store.Create(execID); err != nil {
+			fmt.Fprintf(stderr, "Warning: no artifacts directory: %v\n", err)
+		} else {
+			artifactsDir = dir
+			execEngine.UseArtifacts(dir)
+		}
 	}
-	defer releaseLock(lockFile)
 
-	fmt.Fprintf(stderr, "Acquired execution lock: %s\n", lockPath)
+	if !armRollback(cfg, p, stderr) {
+		return 1
+	}
 
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sigc
-		releaseLock(lockFile)
+		lock.Release()
 		os.Exit(1)
 	}()
 
 	var results executor.Results
-	if *confirmEach {
-		reader := bufio.NewReader(stdin)
+	execStart := time.Now()
+	if *o.confirmEach {
+		execEngine.StartBudget()
 		for i, cmd := range p.Commands {
-			fmt.Fprintf(stdout, "\nExecute command %d: %s\n", i+1, executor.FormatCommand(cmd.Command))
+			fmt.Fprintf(stdout, "\nExecute command %d: %s\n", i+1, executor.FormatPlanned(cmd))
 			ok, err := ui.Confirm(reader, stdout, "Proceed?")
 			if err != nil || !ok {
 				fmt.Fprintln(stdout, "Skipped")
@@ -318,7 +490,8 @@ func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 				results.Failed++
 			}
 		}
-	} else if *stream && !*jsonOutput {
+		execEngine.Verify(ctx, p, &results)
+	} else if *o.stream && v > ui.Quiet {
 		// Use streaming execution for real-time output
 		fmt.Fprintln(stdout, "\n"+ui.Colorize(ui.Bold, "Executing commands..."))
 		results = execEngine.RunPlanStreaming(ctx, p, stdout)
@@ -327,19 +500,23 @@ func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 	}
 
 	var retryLog func(format string, args ...interface{})
-	if !*jsonOutput {
+	if v > ui.Quiet {
 		retryLog = func(format string, args ...interface{}) {
 			fmt.Fprintf(stderr, format, args...)
 		}
 	}
 	results = execEngine.AutoRetry(ctx, llmProvider, policyEngine, results, retryLog)
+	v.Logf(ui.Verbose, stderr, "Executed %d command(s) in %s\n", len(results.Items), time.Since(execStart).Round(time.Millisecond))
 
-	if *jsonOutput {
+	if e.jsonOutput {
 		if err := ui.PrintResultsJSON(stdout, results); err != nil {
 			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
 			return 1
 		}
-	} else if !*stream || *confirmEach {
+	} else if v == ui.Quiet {
+		ui.PrintFailures(stderr, results)
+		ui.PrintSummary(stdout, results)
+	} else if !*o.stream || *o.confirmEach {
 		// Print full results when not streaming or when using confirm-each mode
 		ui.PrintResults(stdout, results)
 	} else {
@@ -348,19 +525,14 @@ func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 	}
 
 	// AI summarization: analyze command output and answer the user's question
-	if *summarize && !*jsonOutput && len(results.Items) > 0 {
+	// Quiet runs (cron) skip the extra model call unless -summarize is given
+	if *o.summarize && !e.jsonOutput && (v > ui.Quiet || e.set["summarize"]) && len(results.Items) > 0 {
 		// Build summary input from results
 		summaryCommands := make([]llm.SummaryCommand, 0, len(results.Items))
+		ran := make([][]string, 0, len(results.Items))
 		for _, item := range results.Items {
-			errStr := ""
-			if item.Err != nil {
-				errStr = item.Err.Error()
-			}
-			summaryCommands = append(summaryCommands, llm.SummaryCommand{
-				Command: item.Command,
-				Output:  item.Output,
-				Error:   errStr,
-			})
+			summaryCommands = append(summaryCommands, item.SummaryCommand())
+			ran = append(ran, item.Command)
 		}
 
 		sumCtx, sumCancel := context.WithTimeout(ctx, 30*time.Second)
@@ -368,34 +540,62 @@ func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 
 		summary, details, err := llm.Summarize(sumCtx, cfg, llm.SummaryInput{
 			Commands: summaryCommands,
+			Context:  strings.TrimSpace(attachment),
 			Prompt:   prompt,
+			History:  prompts.SummaryHistoryBlock(cfg, prompt, ran, cfg.SummaryHistory),
 		})
 		if err != nil {
 			// Non-fatal: just skip summarization if it fails
-			fmt.Fprintf(stderr, "Note: Could not generate summary: %v\n", err)
+			v.Logf(ui.Normal, stderr, "Note: Could not generate summary: %v\n", err)
 		} else {
 			ui.PrintAnswer(stdout, summary, details)
+			logger.Summary(summary, details)
 		}
 	}
 
 	items := make([]logging.ResultItem, 0, len(results.Items))
 	for _, it := range results.Items {
-		errStr := ""
-		if it.Err != nil {
-			errStr = it.Err.Error()
-		}
-		items = append(items, logging.ResultItem{
-			Index:   it.Index,
-			Command: it.Command,
-			Output:  it.Output,
-			Error:   errStr,
-			Elapsed: it.Elapsed,
-		})
+		items = append(items, it.LogItem())
 	}
 	logger.Results(items)
+	if !e.jsonOutput && v > ui.Quiet && hasArtifacts(results) {
+		fmt.Fprintf(stdout, "Files saved in %s (execution %s)\n", artifactsDir, execID)
+	}
 
-	if results.Failed > 0 {
-		return 1
+	if results.Failed > 0 || results.Unverified() {
+		return results.ErrorCode().ExitCode()
 	}
 	return 0
 }
+
+// fail reports a classified error: the message and remediation hint go to
+// stderr and, with -json, an error object goes to stdout. It returns the exit
+// code for code.
+func fail(code errcode.Code, msg string, jsonOutput bool, stdout, stderr io.Writer) int {
+	fmt.Fprintln(stderr, msg)
+	if hint := code.Hint(); hint != "" {
+		fmt.Fprintf(stderr, "Hint: %s\n", hint)
+	}
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(errcode.NewBody(code, msg))
+	}
+	return code.ExitCode()
+}
+
+// failPolicy is fail for a plan the policy rejected. With -json, the error
+// object also carries the policy trace of the plan (see policy.Engine.Trace),
+// so tools can show which rule blocked which command.
+func failPolicy(msg string, trace []plan.PolicyTrace, jsonOutput bool, stdout, stderr io.Writer) int {
+	code := fail(errcode.PolicyDeny, msg, false, stdout, stderr)
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			errcode.Body
+			PolicyTrace []plan.PolicyTrace `json:"policy_trace"`
+		}{errcode.NewBody(errcode.PolicyDeny, msg), trace})
+	}
+	return code
+}
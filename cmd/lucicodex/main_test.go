@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,11 +10,23 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/aezizhu/LuciCodex/internal/auth"
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
 	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/jobs"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/logtail"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/rollback"
+	"github.com/aezizhu/LuciCodex/internal/state"
 )
 
 // TestMain_Version runs the binary with -version flag
@@ -238,8 +251,8 @@ func TestRun_ConfigError(t *testing.T) {
 	var stdout, stderr strings.Builder
 	exitCode := run([]string{"-config", configPath, "prompt"}, strings.NewReader(""), &stdout, &stderr)
 
-	if exitCode != 1 {
-		t.Errorf("Expected exit code 1, got %d", exitCode)
+	if exitCode != 3 {
+		t.Errorf("Expected exit code 3, got %d", exitCode)
 	}
 	if !strings.Contains(stderr.String(), "Configuration error") {
 		t.Errorf("Expected config error, got: %s", stderr.String())
@@ -431,8 +444,8 @@ func TestRun_AutoRetry(t *testing.T) {
 func TestRun_UnknownFlag(t *testing.T) {
 	var stdout, stderr strings.Builder
 	exitCode := run([]string{"-unknown-flag"}, strings.NewReader(""), &stdout, &stderr)
-	if exitCode != 1 {
-		t.Errorf("Expected exit code 1, got %d", exitCode)
+	if exitCode != 2 {
+		t.Errorf("Expected exit code 2, got %d", exitCode)
 	}
 	if !strings.Contains(stderr.String(), "flag provided but not defined") {
 		t.Errorf("Expected flag error, got: %s", stderr.String())
@@ -448,13 +461,15 @@ func TestRun_LLMError(t *testing.T) {
 
 	tmpDir := t.TempDir()
 	configPath := filepath.Join(tmpDir, "config.json")
-	os.WriteFile(configPath, []byte(`{"api_key": "dummy"}`), 0644)
+	// Without retries or a breaker, so the failure is immediate and does
+	// not open the circuit for later tests
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy", "provider_retries": 0, "breaker_failures": 0}`), 0644)
 
 	var stdout, stderr strings.Builder
 	exitCode := run([]string{"-config", configPath, "prompt"}, strings.NewReader(""), &stdout, &stderr)
 
-	if exitCode != 1 {
-		t.Errorf("Expected exit code 1, got %d", exitCode)
+	if exitCode != 14 {
+		t.Errorf("Expected exit code 14, got %d", exitCode)
 	}
 	if !strings.Contains(stderr.String(), "LLM error") {
 		t.Errorf("Expected LLM error, got: %s", stderr.String())
@@ -486,9 +501,19 @@ func TestRun_EmptyPlan(t *testing.T) {
 }
 
 func TestRun_MaxCommands(t *testing.T) {
+	twoCommands := `{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\", \"1\"]}, {\"command\":[\"echo\", \"2\"]}]}"}]}}]}`
+	oneCommand := `{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\", \"3\"]}]}"}]}}]}`
+	var prompts []string
+	shorten := true
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		prompts = append(prompts, string(body))
 		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\", \"1\"]}, {\"command\":[\"echo\", \"2\"]}]}"}]}}]}`))
+		if shorten && len(prompts) > 1 {
+			w.Write([]byte(oneCommand))
+			return
+		}
+		w.Write([]byte(twoCommands))
 	}))
 	defer server.Close()
 	t.Setenv("GEMINI_ENDPOINT", server.URL)
@@ -502,25 +527,149 @@ func TestRun_MaxCommands(t *testing.T) {
 	exitCode := run([]string{"-config", configPath, "-max-commands=1", "-dry-run", "prompt"}, strings.NewReader(""), &stdout, &stderr)
 
 	if exitCode != 0 {
-		t.Errorf("Expected exit code 0, got %d", exitCode)
+		t.Fatalf("Expected exit code 0, got %d: %s", exitCode, stderr.String())
 	}
-	// Output should show only 1 command
+	// The plan over the limit is asked for again, not cut short
 	output := stdout.String()
-	if !strings.Contains(output, "echo 1") {
-		t.Error("Expected command 1")
+	if !strings.Contains(output, "echo 3") || strings.Contains(output, "echo 1") {
+		t.Errorf("Expected the second plan, got: %s", output)
+	}
+	if len(prompts) != 2 || !strings.Contains(prompts[1], "at most 1 are allowed") {
+		t.Errorf("Expected the limit in the second prompt, got %d prompts", len(prompts))
+	}
+
+	prompts, shorten = nil, false
+	stdout.Reset()
+	stderr.Reset()
+	exitCode = run([]string{"-config", configPath, "-max-commands=1", "-dry-run", "prompt"}, strings.NewReader(""), &stdout, &stderr)
+	if exitCode != errcode.PlanTooLarge.ExitCode() {
+		t.Errorf("Expected exit code %d, got %d", errcode.PlanTooLarge.ExitCode(), exitCode)
+	}
+	if !strings.Contains(stderr.String(), "more than the limit of 1") {
+		t.Errorf("Expected the limit in the error, got: %s", stderr.String())
+	}
+}
+
+func TestRun_MaxCommandsByIntent(t *testing.T) {
+	var prompts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		prompts = append(prompts, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\", \"1\"]}, {\"command\":[\"echo\", \"2\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy", "allowlist": ["^echo"], "max_commands": 10, "max_read_commands": 5, "max_write_commands": 1}`), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "-dry-run", "-facts=false", "restart dnsmasq"}, strings.NewReader(""), &stdout, &stderr); code != errcode.PlanTooLarge.ExitCode() {
+		t.Fatalf("write request should be held to max_write_commands, exit %d: %s", code, stderr.String())
+	}
+	if len(prompts) != 2 || !strings.Contains(prompts[0], "do not return more than 1 commands") {
+		t.Errorf("write budget not communicated in prompt")
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "-dry-run", "-facts=false", "show routes"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "echo 2") {
+		t.Error("read request should use max_read_commands")
+	}
+	if len(prompts) != 3 || !strings.Contains(prompts[2], "use up to 5 read-only commands") {
+		t.Errorf("read budget not communicated in prompt")
+	}
+}
+
+func TestRun_GenerationFlags(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": []}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy", "temperature": 1.5}`), 0644)
+
+	var stdout, stderr strings.Builder
+	args := []string{"-config", configPath, "-dry-run", "-facts=false", "-temperature", "0.2", "-max-output-tokens", "300", "-thinking-budget", "128", "show routes"}
+	if code := run(args, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+	for _, want := range []string{`"temperature":0.2`, `"maxOutputTokens":300`, `"thinkingBudget":128`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("request body missing %s: %s", want, body)
+		}
+	}
+
+	stderr.Reset()
+	code := run([]string{"-config", configPath, "-top-p", "2", "show routes"}, strings.NewReader(""), &stdout, &stderr)
+	if code != 2 {
+		t.Errorf("expected exit code 2 for an invalid -top-p, got %d", code)
 	}
-	if strings.Contains(output, "echo 2") {
-		t.Error("Did not expect command 2")
+	if !strings.Contains(stderr.String(), "top_p must be in (0, 1]") {
+		t.Errorf("unexpected stderr: %s", stderr.String())
 	}
 }
 
 func TestRun_JoinArgs(t *testing.T) {
+	var requests []string
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Verify prompt contains joined args
 		body, _ := io.ReadAll(r.Body)
-		if !strings.Contains(string(body), "User request: arg1 arg2") {
-			t.Errorf("Expected joined args in prompt, got body: %s", string(body))
+		requests = append(requests, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": []}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy"}`), 0644)
+
+	cases := []struct {
+		args    []string
+		request string
+		warning string
+	}{
+		{[]string{"arg1", "arg2"}, "User request: arg1 arg2", ""},
+		{[]string{"-join-args", "arg1", "arg2"}, "User request: arg1 arg2", ""},
+		{[]string{"-first-arg", "arg1", "arg2"}, "User request: arg1", "-first-arg ignores 1 more argument(s): arg2"},
+		{[]string{"show", "wifi", "-dryrun"}, "User request: show wifi -dryrun", "did you mean -dry-run before it?"},
+		{[]string{"show", "wifi", "-facts=false"}, "User request: show wifi -facts=false", "flags must come before it"},
+		{[]string{"ping", "-c", "1"}, "User request: ping -c 1", ""},
+		{[]string{"show", "--", "-dryrun"}, "User request: show -dryrun", ""},
+		{[]string{"--", "history", "of", "wan", "drops"}, "User request: history of wan drops", ""},
+		{[]string{"watch", "the", "wan", "interface"}, "User request: watch the wan interface", ""},
+		{[]string{"serve", "-approve"}, "User request: serve -approve", "flags must come before it"},
+	}
+	for _, tc := range cases {
+		requests = nil
+		var stdout, stderr strings.Builder
+		run(append([]string{"-config", configPath, "-facts=false"}, tc.args...), strings.NewReader(""), &stdout, &stderr)
+		if len(requests) == 0 || !strings.Contains(requests[0], tc.request) {
+			t.Errorf("%q: expected %q in the prompt, got %v", tc.args, tc.request, requests)
 		}
+		if warned := strings.Contains(stderr.String(), "Warning: "); warned != (tc.warning != "") || !strings.Contains(stderr.String(), tc.warning) {
+			t.Errorf("%q: expected warning %q, got stderr: %s", tc.args, tc.warning, stderr.String())
+		}
+	}
+}
+
+func TestRun_CommandWordPrompt(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, string(body))
 		w.Header().Set("Content-Type", "application/json")
 		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": []}"}]}}]}`))
 	}))
@@ -531,8 +680,28 @@ func TestRun_JoinArgs(t *testing.T) {
 	configPath := filepath.Join(tmpDir, "config.json")
 	os.WriteFile(configPath, []byte(`{"api_key": "dummy"}`), 0644)
 
+	// A command word whose arguments do not fit the command begins a prompt
+	for _, args := range [][]string{
+		{"top", "processes", "by", "memory"},
+		{"watch", "the", "wan", "interface"},
+		{"policy", "frobnicate"},
+	} {
+		requests = nil
+		var stdout, stderr strings.Builder
+		if code := run(append(args, "-config", configPath), strings.NewReader(""), &stdout, &stderr); code != 0 {
+			t.Errorf("%q: exit code %d, stderr: %s", args, code, stderr.String())
+		}
+		if want := "User request: " + strings.Join(args, " "); len(requests) == 0 || !strings.Contains(requests[0], want) {
+			t.Errorf("%q: expected %q in the prompt, got %v", args, want, requests)
+		}
+	}
+
+	// One that fits still runs the command
+	requests = nil
 	var stdout, stderr strings.Builder
-	run([]string{"-config", configPath, "-join-args", "arg1", "arg2"}, strings.NewReader(""), &stdout, &stderr)
+	if code := run([]string{"policy", "lint", "-config", configPath}, strings.NewReader(""), &stdout, &stderr); len(requests) != 0 {
+		t.Errorf("policy lint asked the model (exit code %d)", code)
+	}
 }
 
 func TestRun_Facts(t *testing.T) {
@@ -565,9 +734,9 @@ func TestRun_LockFailure(t *testing.T) {
 
 	// Use a temp file for locking
 	tmpLock := filepath.Join(t.TempDir(), "test.lock")
-	origLockPaths := lockPaths
-	lockPaths = []string{tmpLock}
-	defer func() { lockPaths = origLockPaths }()
+	origLockPaths := execlock.Paths
+	execlock.Paths = []string{tmpLock}
+	defer func() { execlock.Paths = origLockPaths }()
 
 	// Create the lock file to simulate it being held
 	f, err := os.OpenFile(tmpLock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
@@ -591,8 +760,8 @@ func TestRun_LockFailure(t *testing.T) {
 	// Should fail to acquire lock
 	exitCode := run([]string{"-config", configPath, "-dry-run=false", "prompt"}, strings.NewReader(""), &stdout, &stderr)
 
-	if exitCode != 1 {
-		t.Errorf("Expected exit code 1, got %d", exitCode)
+	if exitCode != 32 {
+		t.Errorf("Expected exit code 32, got %d", exitCode)
 	}
 	if !strings.Contains(stderr.String(), "execution in progress") {
 		t.Errorf("Expected lock error, got: %s", stderr.String())
@@ -748,13 +917,13 @@ func TestRun_AutoRetry_FixGenError(t *testing.T) {
 
 	tmpDir := t.TempDir()
 	configPath := filepath.Join(tmpDir, "config.json")
-	os.WriteFile(configPath, []byte(`{"api_key": "dummy", "auto_retry": true, "max_retries": 1, "auto_approve": true, "allowlist": ["^fail_cmd"]}`), 0644)
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy", "auto_retry": true, "max_retries": 1, "auto_approve": true, "allowlist": ["^fail_cmd"], "provider_retries": 0, "breaker_failures": 0}`), 0644)
 
 	var stdout, stderr strings.Builder
 	exitCode := run([]string{"-config", configPath, "-dry-run=false", "prompt"}, strings.NewReader(""), &stdout, &stderr)
 
-	if exitCode != 1 {
-		t.Errorf("Expected exit code 1, got %d", exitCode)
+	if exitCode != 30 {
+		t.Errorf("Expected exit code 30, got %d", exitCode)
 	}
 	if !strings.Contains(stderr.String(), "Failed to generate fix") {
 		t.Errorf("Expected fix generation error, got: %s", stderr.String())
@@ -788,8 +957,8 @@ func TestRun_AutoRetry_FixPlanEmpty(t *testing.T) {
 	var stdout, stderr strings.Builder
 	exitCode := run([]string{"-config", configPath, "-dry-run=false", "prompt"}, strings.NewReader(""), &stdout, &stderr)
 
-	if exitCode != 1 {
-		t.Errorf("Expected exit code 1, got %d", exitCode)
+	if exitCode != 30 {
+		t.Errorf("Expected exit code 30, got %d", exitCode)
 	}
 	if !strings.Contains(stderr.String(), "No fix commands generated") {
 		t.Errorf("Expected no fix commands error, got: %s", stderr.String())
@@ -823,10 +992,1224 @@ func TestRun_AutoRetry_FixExecFail(t *testing.T) {
 	var stdout, stderr strings.Builder
 	exitCode := run([]string{"-config", configPath, "-dry-run=false", "prompt"}, strings.NewReader(""), &stdout, &stderr)
 
-	if exitCode != 1 {
-		t.Errorf("Expected exit code 1, got %d", exitCode)
+	if exitCode != 30 {
+		t.Errorf("Expected exit code 30, got %d", exitCode)
 	}
 	if !strings.Contains(stderr.String(), "Fix attempt failed") {
 		t.Errorf("Expected fix failure message, got: %s", stderr.String())
 	}
 }
+
+func TestRun_PipedStdin(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": []}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy"}`), 0644)
+
+	logPath := filepath.Join(tmpDir, "error.log")
+	os.WriteFile(logPath, []byte("pppd: PAP authentication failed\npassword=hunter2\n"), 0644)
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var stdout, stderr strings.Builder
+	exitCode := run([]string{"-config", configPath, "-facts=false", "why is pppoe failing"}, f, &stdout, &stderr)
+	if exitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", exitCode, stderr.String())
+	}
+	if !strings.Contains(body, "PAP authentication failed") {
+		t.Errorf("Expected piped input in prompt, got body: %s", body)
+	}
+	if strings.Contains(body, "hunter2") {
+		t.Errorf("Expected secrets to be redacted, got body: %s", body)
+	}
+}
+
+func TestRun_PipedStdinNeedsApprove(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy", "allowlist": ["^echo"]}`), 0644)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("some log line\n"))
+	w.Close()
+	defer r.Close()
+
+	var stdout, stderr strings.Builder
+	exitCode := run([]string{"-config", configPath, "-facts=false", "-dry-run=false", "prompt"}, r, &stdout, &stderr)
+	if exitCode != 2 {
+		t.Errorf("Expected exit code 2, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "use -approve") {
+		t.Errorf("Expected approve hint, got: %s", stderr.String())
+	}
+}
+
+func TestRun_LoginLogout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/device":
+			w.Write([]byte(`{"device_code":"dev","user_code":"WXYZ","verification_uri":"https://example/device","interval":1}`))
+		case "/token":
+			w.Write([]byte(`{"access_token":"at","refresh_token":"rt","expires_in":3600}`))
+		}
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	tokenFile := filepath.Join(tmpDir, "tokens.json")
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"oauth_client_id": "cid", "oauth_token_url": %q, "oauth_device_url": %q, "token_file": %q}`,
+		server.URL+"/token", server.URL+"/device", tokenFile)), 0644)
+
+	var stdout, stderr strings.Builder
+	exitCode := run([]string{"-config", configPath, "login", "openai"}, strings.NewReader(""), &stdout, &stderr)
+	if exitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", exitCode, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "WXYZ") {
+		t.Errorf("Expected user code in output, got: %s", stdout.String())
+	}
+	data, _ := os.ReadFile(tokenFile)
+	if !strings.Contains(string(data), `"openai"`) || !strings.Contains(string(data), `"at"`) {
+		t.Errorf("Expected stored token, got: %s", data)
+	}
+
+	stdout.Reset()
+	exitCode = run([]string{"-config", configPath, "logout", "openai"}, strings.NewReader(""), &stdout, &stderr)
+	if exitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", exitCode, stderr.String())
+	}
+	data, _ = os.ReadFile(tokenFile)
+	if strings.Contains(string(data), `"openai"`) {
+		t.Errorf("Expected token removed, got: %s", data)
+	}
+}
+
+func TestRun_LoginNotConfigured(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"token_file": "`+filepath.Join(tmpDir, "tokens.json")+`"}`), 0644)
+
+	var stdout, stderr strings.Builder
+	exitCode := run([]string{"-config", configPath, "login", "anthropic"}, strings.NewReader(""), &stdout, &stderr)
+	if exitCode != 1 {
+		t.Errorf("Expected exit code 1, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "oauth_client_id") {
+		t.Errorf("Expected client id hint, got: %s", stderr.String())
+	}
+}
+
+func TestRun_PolicyAudit(t *testing.T) {
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "audit.log")
+	os.WriteFile(logPath, []byte(`{"ts":"2025-01-02T03:04:05Z","event":"plan","data":{"prompt":"reload wifi","plan":{"commands":[{"command":["wifi","reload"]}]}}}
+{"ts":"2025-01-02T03:04:06Z","event":"results","data":[{"index":0,"command":["wifi","reload"],"output":""}]}
+`), 0644)
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"denylist": ["^wifi"]}`), 0644)
+
+	var stdout, stderr strings.Builder
+	exitCode := run([]string{"-config", configPath, "policy", "audit", logPath}, strings.NewReader(""), &stdout, &stderr)
+	if exitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", exitCode, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "now rejected") || !strings.Contains(out, "wifi reload") || !strings.Contains(out, "denied by policy") {
+		t.Errorf("Unexpected audit output: %s", out)
+	}
+}
+
+func TestRun_PolicyLint(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"policy_rules": ["allow uci set /^wireless\\./", "deny opkg remove /[/"]}`), 0644)
+
+	var stdout, stderr strings.Builder
+	exitCode := run([]string{"-config", configPath, "policy", "lint"}, strings.NewReader(""), &stdout, &stderr)
+	if exitCode != 1 {
+		t.Fatalf("Expected exit code 1, got %d. Stderr: %s", exitCode, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "policy_rules[1]: error") || !strings.Contains(out, "1 error(s), 0 warning(s) in 2 policy entries") {
+		t.Errorf("Unexpected lint output: %s", out)
+	}
+
+	os.WriteFile(configPath, []byte(`{"policy_rules": ["allow uci set /^wireless\\./"]}`), 0644)
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "-json", "policy", "lint"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stdout: %s", code, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), `"ok": true`) {
+		t.Errorf("Unexpected lint JSON: %s", stdout.String())
+	}
+}
+
+func TestRun_AuditVerify(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	logPath := filepath.Join(tmpDir, "audit.log")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy-key", "log_file": %q}`, logPath)), 0644)
+	logger := logging.New(logPath)
+	logger.Plan("uptime", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uptime"}}}})
+	logger.Results([]logging.ResultItem{{Command: []string{"uptime"}, Output: "up 3 days"}})
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"audit", "-config", configPath, "verify"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "is intact: 2 entries verified") {
+		t.Errorf("Expected the log to verify, got: %s", stdout.String())
+	}
+
+	data, _ := os.ReadFile(logPath)
+	os.WriteFile(logPath, []byte(strings.Replace(string(data), "up 3 days", "up 9 days", 1)), 0600)
+	stdout.Reset()
+	if code := run([]string{"audit", "-config", configPath, "-json", "verify", logPath}, strings.NewReader(""), &stdout, &stderr); code != errcode.AuditBroken.ExitCode() {
+		t.Fatalf("Expected exit code %d, got %d", errcode.AuditBroken.ExitCode(), code)
+	}
+	if !strings.Contains(stdout.String(), `"AUDIT_BROKEN"`) {
+		t.Errorf("Expected the error code in the JSON output, got: %s", stdout.String())
+	}
+}
+
+func TestRun_Top(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	logPath := filepath.Join(tmpDir, "audit.log")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy-key", "log_file": %q, "jobs_dir": %q, "socket_path": %q}`, logPath, filepath.Join(tmpDir, "jobs"), filepath.Join(tmpDir, "none.sock"))), 0644)
+	logger := logging.New(logPath)
+	logger.Plan("show uptime", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uptime"}}}})
+	logger.Results([]logging.ResultItem{{Command: []string{"uptime"}, Output: "up 3 days"}})
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"top", "-config", configPath, "-once"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "not reachable") || !strings.Contains(out, "show uptime") || strings.Contains(out, "\033[2J") {
+		t.Errorf("Unexpected dashboard: %s", out)
+	}
+
+	stdout.Reset()
+	if code := run([]string{"top", "-config", configPath, "-json", "-once"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	var snap struct {
+		Source string `json:"source"`
+		Recent []struct {
+			Status string `json:"status"`
+		} `json:"recent"`
+	}
+	if err := json.Unmarshal([]byte(stdout.String()), &snap); err != nil || snap.Source != "local" || len(snap.Recent) != 1 || snap.Recent[0].Status != "ok" {
+		t.Errorf("Unexpected JSON dashboard (%v): %s", err, stdout.String())
+	}
+
+	stdout.Reset()
+	args := []string{"top", "-config", configPath, "-once", "-daemon", "unix://" + filepath.Join(tmpDir, "none.sock"), "-token", "t"}
+	if code := run(args, strings.NewReader(""), &stdout, &stderr); code == 0 {
+		t.Errorf("Expected an unreachable daemon to fail, got: %s", stdout.String())
+	}
+}
+
+func TestRun_Stats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy", "metrics_dir": %q}`, filepath.Join(tmpDir, "metrics"))), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "-facts=false", "prompt"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "-stats"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "1 requests, 100.0% successful") || !strings.Contains(out, "gemini") {
+		t.Errorf("Unexpected stats output: %s", out)
+	}
+}
+
+func TestRun_DebugLLM(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "AIzaSyA1234567890abcdefghijklmnop", "debug_dir": %q}`, filepath.Join(tmpDir, "debug"))), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "debug", "last"}, strings.NewReader(""), &stdout, &stderr); code == 0 {
+		t.Fatalf("Expected failure before any capture, got: %s", stdout.String())
+	}
+
+	if code := run([]string{"-config", configPath, "-facts=false", "-debug-llm", "show uptime"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "debug", "last"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "show uptime") || !strings.Contains(out, `\"summary\": \"Plan\"`) {
+		t.Errorf("Expected prompt and raw response, got: %s", out)
+	}
+	if strings.Contains(out, "AIzaSy") {
+		t.Errorf("API key leaked into debug output: %s", out)
+	}
+}
+
+func TestRun_Tokens(t *testing.T) {
+	tmpDir := t.TempDir()
+	tokensFile := filepath.Join(tmpDir, "api_tokens.json")
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy", "api_tokens_file": %q}`, tokensFile)), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "token", "add", "grafana", "viewer"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if _, ok := auth.NewAPITokenStore(tokensFile).Lookup(lines[len(lines)-1]); !ok {
+		t.Fatalf("Printed token not accepted: %s", stdout.String())
+	}
+
+	if code := run([]string{"-config", configPath, "token", "add", "x", "root"}, strings.NewReader(""), &stdout, &stderr); code == 0 {
+		t.Error("Expected unknown role to fail")
+	}
+
+	stdout.Reset()
+	run([]string{"-config", configPath, "token", "list"}, strings.NewReader(""), &stdout, &stderr)
+	if !strings.Contains(stdout.String(), "grafana") || !strings.Contains(stdout.String(), "viewer") {
+		t.Errorf("Unexpected list: %s", stdout.String())
+	}
+
+	if code := run([]string{"-config", configPath, "token", "remove", "grafana"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if _, ok := auth.NewAPITokenStore(tokensFile).Lookup(lines[len(lines)-1]); ok {
+		t.Error("Removed token still accepted")
+	}
+	if code := run([]string{"-config", configPath, "token", "remove", "grafana"}, strings.NewReader(""), &stdout, &stderr); code == 0 {
+		t.Error("Expected removing a missing token to fail")
+	}
+}
+
+func TestRun_Jobs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Capture\", \"commands\": [{\"command\":[\"sh\",\"-c\",\"echo capturing; sleep 30\"], \"background\": true}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy", "jobs_dir": %q}`, filepath.Join(tmpDir, "jobs"))), 0644)
+
+	var stdout, stderr strings.Builder
+	args := []string{"-config", configPath, "-facts=false", "-dry-run=false", "-approve", "-summarize=false", "capture traffic"}
+	if code := run(args, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "started background job") {
+		t.Fatalf("Expected background job start, got: %s", stdout.String())
+	}
+
+	list, err := jobs.NewManager(filepath.Join(tmpDir, "jobs")).List()
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Expected one job, got %v (%v)", list, err)
+	}
+	id := list[0].ID
+
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "jobs"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("jobs list failed: %s", stderr.String())
+	}
+	if !strings.Contains(stdout.String(), id) || !strings.Contains(stdout.String(), "running") {
+		t.Errorf("Unexpected jobs list: %s", stdout.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "jobs", "stop", id}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("jobs stop failed: %s", stderr.String())
+	}
+	if code := run([]string{"-config", configPath, "jobs", "tail", id}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("jobs tail failed: %s", stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "capturing") {
+		t.Errorf("Expected spooled output, got: %s", stdout.String())
+	}
+}
+
+func TestRun_ConfirmChange(t *testing.T) {
+	tmpDir := t.TempDir()
+	rbDir := filepath.Join(tmpDir, "rollback")
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy", "rollback_dir": %q}`, rbDir)), 0644)
+
+	oldConfigDir := rollback.ConfigDir
+	rollback.ConfigDir = t.TempDir()
+	defer func() { rollback.ConfigDir = oldConfigDir }()
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "confirm-change"}, strings.NewReader(""), &stdout, &stderr); code != 1 {
+		t.Fatalf("Expected exit code 1 with nothing pending, got %d", code)
+	}
+
+	st, err := rollback.Arm(rbDir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr.Reset()
+	if code := run([]string{"-config", configPath, "confirm-change"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "rollback "+st.ID+" cancelled") {
+		t.Errorf("Unexpected output: %s", stdout.String())
+	}
+}
+
+func TestRun_ExportImportState(t *testing.T) {
+	tmpDir := t.TempDir()
+	tokenFile := filepath.Join(tmpDir, "tokens.json")
+	logFile := filepath.Join(tmpDir, "lucicodex.log")
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy", "denylist": ["^reboot"], "token_file": %q, "log_file": %q, "metrics_dir": %q, "facts_key_file": %q}`,
+		tokenFile, logFile, filepath.Join(tmpDir, "metrics"), filepath.Join(tmpDir, "facts.key"))), 0644)
+	os.WriteFile(tokenFile, []byte(`{"gemini": {"access_token": "tok"}}`), 0600)
+	os.WriteFile(logFile, []byte("history\n"), 0644)
+
+	oldUCI := state.UCIConfigFile
+	state.UCIConfigFile = filepath.Join(tmpDir, "uci-lucicodex")
+	defer func() { state.UCIConfigFile = oldUCI }()
+
+	archive := filepath.Join(t.TempDir(), "state.tar.gz")
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "export-state", archive}, strings.NewReader("pass\n"), &stdout, &stderr); code != 0 {
+		t.Fatalf("export: exit %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "exported tokens") {
+		t.Errorf("tokens not exported: %s", stdout.String())
+	}
+
+	os.Remove(tokenFile)
+	os.Remove(logFile)
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "import-state", archive}, strings.NewReader("wrong\n"), &stdout, &stderr); code != 1 {
+		t.Fatalf("import with wrong passphrase: exit %d", code)
+	}
+	t.Setenv("LUCICODEX_STATE_PASSPHRASE", "pass")
+	if code := run([]string{"-config", configPath, "import-state", archive}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("import: exit %d: %s", code, stderr.String())
+	}
+	if data, _ := os.ReadFile(tokenFile); string(data) != `{"gemini": {"access_token": "tok"}}` {
+		t.Errorf("tokens not restored: %q", data)
+	}
+	if data, _ := os.ReadFile(logFile); string(data) != "history\n" {
+		t.Errorf("history not restored: %q", data)
+	}
+}
+
+func TestRun_PolicyWarningsNeedAck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\", \"warned\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy", "warnlist": ["^echo"]}`), 0644)
+
+	var stdout, stderr strings.Builder
+	args := []string{"-config", configPath, "-facts=false", "-dry-run=false", "-approve", "-summarize=false", "say hi"}
+	if code := run(args, strings.NewReader(""), &stdout, &stderr); code != 22 {
+		t.Fatalf("expected exit code 22 without -ack-warnings, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Policy warnings") || !strings.Contains(stderr.String(), "-ack-warnings") {
+		t.Errorf("expected warnings and hint, got stdout: %s stderr: %s", stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	args = append([]string{"-ack-warnings"}, args...)
+	if code := run(args, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit code 0 with -ack-warnings, got %d. Stderr: %s", code, stderr.String())
+	}
+}
+
+func TestRun_SelfUpdate(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy"}`), 0644)
+	exe := filepath.Join(tmpDir, "lucicodex")
+	os.WriteFile(exe, []byte("new"), 0755)
+
+	oldPath := executablePath
+	executablePath = func() (string, error) { return exe, nil }
+	defer func() { executablePath = oldPath }()
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "self-update", "rollback"}, strings.NewReader(""), &stdout, &stderr); code != 1 {
+		t.Errorf("rollback without previous binary: exit %d", code)
+	}
+
+	os.WriteFile(exe+".prev", []byte("old"), 0755)
+	stdout.Reset()
+	stderr.Reset()
+	if code := run([]string{"-config", configPath, "self-update", "rollback"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("rollback: exit %d, stderr %s", code, stderr.String())
+	}
+	if got, _ := os.ReadFile(exe); string(got) != "old" {
+		t.Errorf("binary not restored: %q", got)
+	}
+
+	// Unsigned builds refuse to fetch anything
+	stderr.Reset()
+	if code := run([]string{"-config", configPath, "self-update", "check"}, strings.NewReader(""), &stdout, &stderr); code != 1 {
+		t.Errorf("check without signing key: exit %d", code)
+	}
+	if !strings.Contains(stderr.String(), "signing key") {
+		t.Errorf("expected signing key error, got %q", stderr.String())
+	}
+}
+
+func TestRun_Discover(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"provider": "gemini", "dry_run": true}`), 0644)
+
+	oldEnv := discoverEnv
+	discoverEnv = func() config.DiscoverEnv {
+		env := map[string]string{"OPENAI_API_KEY": "sk-discovered-1234", "HTTPS_PROXY": "http://proxy:3128"}
+		return config.DiscoverEnv{Getenv: func(k string) string { return env[k] }}
+	}
+	defer func() { discoverEnv = oldEnv }()
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "-discover"}, strings.NewReader("n\n"), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "+ openai_api_key: sk-d…1234  (from $OPENAI_API_KEY)") || !strings.Contains(out, "~ provider: gemini -> openai") {
+		t.Errorf("Unexpected discover output: %s", out)
+	}
+	if strings.Contains(out, "sk-discovered-1234") {
+		t.Errorf("Secret shown unmasked: %s", out)
+	}
+	if b, _ := os.ReadFile(configPath); strings.Contains(string(b), "sk-discovered") {
+		t.Fatalf("Config written without confirmation: %s", b)
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "-discover", "-approve"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	var saved map[string]interface{}
+	b, _ := os.ReadFile(configPath)
+	if err := json.Unmarshal(b, &saved); err != nil {
+		t.Fatalf("Invalid config written: %v", err)
+	}
+	if saved["openai_api_key"] != "sk-discovered-1234" || saved["provider"] != "openai" || saved["https_proxy"] != "http://proxy:3128" || saved["dry_run"] != true {
+		t.Errorf("Unexpected config: %v", saved)
+	}
+	if st, _ := os.Stat(configPath); st.Mode().Perm() != 0600 {
+		t.Errorf("Config mode %v, want 0600", st.Mode().Perm())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "-discover"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	if !strings.Contains(stdout.String(), "Nothing to import") {
+		t.Errorf("Expected nothing to import, got: %s", stdout.String())
+	}
+}
+
+func TestRun_Watch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Watch WAN\", \"commands\": [{\"command\":[\"echo\",\"wan down\"], \"alert\": {\"message\": \"WAN is down\", \"contains\": \"down\"}}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	hook := make(chan string, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		hook <- string(b)
+	}))
+	defer webhook.Close()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy", "watch_webhooks": [%q]}`, webhook.URL)), 0644)
+
+	oldRounds := watchRounds
+	watchRounds = 1
+	defer func() { watchRounds = oldRounds }()
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "watch", "alert me if wan goes down"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "Watching 1 probe(s)") || !strings.Contains(out, "[ALERT] WAN is down") {
+		t.Errorf("Unexpected watch output: %s", out)
+	}
+	select {
+	case body := <-hook:
+		if !strings.Contains(body, `"state":"firing"`) {
+			t.Errorf("Unexpected webhook body: %s", body)
+		}
+	default:
+		t.Error("webhook was not called")
+	}
+}
+
+func TestRun_Digest(t *testing.T) {
+	hook := make(chan string, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		hook <- string(b)
+	}))
+	defer webhook.Close()
+
+	tmpDir := t.TempDir()
+	logPath := filepath.Join(tmpDir, "audit.log")
+	l := logging.New(logPath)
+	l.Plan("check wan", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"ifup", "wan"}}}})
+	l.Results([]logging.ResultItem{{Command: []string{"ifup", "wan"}, Error: "exit status 1"}})
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy", "log_file": %q, "denylist": ["^logread"], "digest_webhooks": [%q]}`, logPath, webhook.URL)), 0644)
+
+	var stdout, stderr strings.Builder
+	code := run([]string{"-config", configPath, "digest", "-since", "1h", "-summarize=false", "-send"}, strings.NewReader(""), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if out := stdout.String(); !strings.Contains(out, "1 run(s): 0 ok, 1 failed") || !strings.Contains(out, "ifup wan: exit status 1") {
+		t.Errorf("Unexpected digest: %s", out)
+	}
+	select {
+	case body := <-hook:
+		if !strings.Contains(body, `"failed":1`) || !strings.Contains(body, `"text":`) {
+			t.Errorf("Unexpected webhook body: %s", body)
+		}
+	default:
+		t.Error("webhook was not called")
+	}
+
+	if code := run([]string{"-config", configPath, "digest", "-since", "-1h"}, strings.NewReader(""), &stdout, &stderr); code != errcode.InvalidRequest.ExitCode() {
+		t.Errorf("Expected an invalid -since to fail, got %d", code)
+	}
+}
+
+func TestRun_Subcommands(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\", \"hi\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	logPath := filepath.Join(tmpDir, "audit.log")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy", "log_file": %q, "metrics_dir": %q}`, logPath, filepath.Join(tmpDir, "metrics"))), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"run", "-config", configPath, "-facts=false", "-approve", "-dry-run=false", "say hi"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("run: expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+
+	// Flags may follow the arguments of commands other than run
+	stdout.Reset()
+	if code := run([]string{"history", "-config", configPath, "-json"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("history: expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	var hist struct {
+		Entries []logging.HistoryEntry `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(stdout.String()), &hist); err != nil || len(hist.Entries) != 1 || hist.Entries[0].Prompt != "say hi" {
+		t.Fatalf("Unexpected history JSON (%v): %s", err, stdout.String())
+	}
+	stdout.Reset()
+	if code := run([]string{"history", hist.Entries[0].ID, "-config", configPath}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("history <id>: expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if out := stdout.String(); !strings.Contains(out, "Prompt: say hi") || !strings.Contains(out, "echo hi") || !strings.Contains(out, ": ok") {
+		t.Errorf("Unexpected history entry: %s", out)
+	}
+
+	stdout.Reset()
+	if code := run([]string{"feedback", hist.Entries[0].ID, "bad", "said hello instead", "-config", configPath}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("feedback: expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if code := run([]string{"feedback", "unknown", "good", "-config", configPath}, strings.NewReader(""), &stdout, &stderr); code != errcode.NotFound.ExitCode() {
+		t.Errorf("feedback for an unknown execution: exit code %d", code)
+	}
+	stdout.Reset()
+	if code := run([]string{"history", hist.Entries[0].ID, "-config", configPath}, strings.NewReader(""), &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), "Feedback: bad (said hello instead)") {
+		t.Errorf("history <id> after feedback (%d): %s", code, stdout.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"usage", "-days", "3", "-config", configPath}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("usage: expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "last 3 days: 1 requests") || !regexp.MustCompile(`echo hi\s+1\s+100.0%\s+0\s+1`).MatchString(stdout.String()) {
+		t.Errorf("Unexpected usage output: %s", stdout.String())
+	}
+
+	// The older form with global flags ahead of the command word
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "history", "-n", "1"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("legacy history: expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "say hi") {
+		t.Errorf("Unexpected history output: %s", stdout.String())
+	}
+
+	if code := run([]string{"diagnose", "portscan", "-config", configPath}, strings.NewReader(""), &stdout, &stderr); code != errcode.InvalidRequest.ExitCode() {
+		t.Errorf("Expected unknown diagnostic to fail, got exit code %d", code)
+	}
+}
+
+func TestRun_Verbosity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\", \"verbosity\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "AIzaSyA1234567890abcdefghijklmnop", "auto_approve": true, "allowlist": ["^echo"]}`), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "-q", "-facts=false", "-dry-run=false", "show uptime"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "All 1 command(s) executed successfully") {
+		t.Errorf("Expected the final summary, got: %s", stdout.String())
+	}
+	if strings.Contains(stdout.String(), "Proposed commands") || strings.Contains(stdout.String(), "Answer:") || stderr.Len() > 0 {
+		t.Errorf("Expected nothing but the summary in quiet mode, got:\n%s\nstderr:\n%s", stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	if code := run([]string{"-config", configPath, "-vv", "-facts=false", "-summarize=false", "-dry-run=false", "show uptime"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	for _, want := range []string{"Plan of 1 command(s) generated in", "Policy: allowed 1 command(s), 0 warning(s)", "Executed 1 command(s) in", "http: POST " + server.URL, "-> 200"} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("Expected %q in debug output, got:\n%s", want, stderr.String())
+		}
+	}
+	if strings.Contains(stderr.String(), "AIzaSy") {
+		t.Errorf("API key leaked into the HTTP trace: %s", stderr.String())
+	}
+
+	if code := run([]string{"-config", configPath, "-q", "-v", "show uptime"}, strings.NewReader(""), &stdout, &stderr); code != errcode.InvalidRequest.ExitCode() {
+		t.Errorf("Expected -q -v to be rejected, got exit code %d", code)
+	}
+}
+
+func TestRun_Playbook(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy-key", "allowlist": ["^echo", "^false"]}`), 0644)
+	path := filepath.Join(tmpDir, "session.yaml")
+	os.WriteFile(path, []byte(`{"version": 1, "steps": [
+		{"prompt": "greet", "plan": {"commands": [{"command": ["echo", "from-playbook"]}]}},
+		{"prompt": "break", "plan": {"commands": [{"command": ["false"]}]}},
+		{"prompt": "never", "plan": {"commands": [{"command": ["echo", "never-run"]}]}}
+	]}`), 0600)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"playbook", "-config", configPath, "-dry-run", path}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if out := stdout.String(); !strings.Contains(out, "Step 3/3:") || !strings.Contains(out, "Dry run mode") || strings.Contains(out, "\n  from-playbook") {
+		t.Errorf("Expected the steps without running them, got: %s", out)
+	}
+
+	stdout.Reset()
+	code := run([]string{"playbook", "-config", configPath, "-approve", path}, strings.NewReader(""), &stdout, &stderr)
+	if code != errcode.ExecFailed.ExitCode() {
+		t.Fatalf("Expected the failing step to fail the run, got %d. Stderr: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "\n  from-playbook") || !strings.Contains(out, "Stopped: 1 later step(s) not run") || strings.Contains(out, "\n  never-run") {
+		t.Errorf("Expected the run to stop after the failed step, got: %s", out)
+	}
+
+	os.WriteFile(path, []byte(`{"version": 1, "steps": [{"prompt": "rm", "plan": {"commands": [{"command": ["rm", "-rf", "/"]}]}}]}`), 0600)
+	if code := run([]string{"playbook", "-config", configPath, "-approve", path}, strings.NewReader(""), &stdout, &stderr); code != errcode.PolicyDeny.ExitCode() {
+		t.Errorf("Expected the policy to reject the playbook, got %d", code)
+	}
+}
+
+func TestRun_RunPlan(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	logPath := filepath.Join(tmpDir, "audit.log")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy-key", "allowlist": ["^echo"], "log_file": %q, "templates_dir": %q}`,
+		logPath, filepath.Join(tmpDir, "templates"))), 0644)
+	logger := logging.New(logPath).WithExecution("exec1")
+	logger.Plan("block aa:bb:cc:dd:ee:ff", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"echo", "blocked", "aa:bb:cc:dd:ee:ff"}}}})
+	logger.Results([]logging.ResultItem{{Command: []string{"echo", "blocked", "aa:bb:cc:dd:ee:ff"}, Output: "blocked aa:bb:cc:dd:ee:ff\n"}})
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"template", "-config", configPath, "save", "block-client", "exec1", "mac=aa:bb:cc:dd:ee:ff"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "--mac=<mac>") || !strings.Contains(stdout.String(), "{{mac}}") {
+		t.Errorf("Expected the saved template, got: %s", stdout.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"run-plan", "-config", configPath, "block-client", "--mac=11:22:33:44:55:66", "--approve"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "blocked 11:22:33:44:55:66") {
+		t.Errorf("Expected the filled-in command to run, got: %s", stdout.String())
+	}
+	entries, err := logging.ReadHistory(logPath)
+	if err != nil || len(entries) != 2 || entries[1].Prompt != "run-plan block-client: block 11:22:33:44:55:66" || entries[1].Status() != "ok" {
+		t.Errorf("Expected the run to be logged, got %+v, %v", entries, err)
+	}
+
+	for _, args := range [][]string{
+		{"block-client", "--mac=11:22:33:44:55", "-approve"},
+		{"block-client", "-approve"},
+		{"block-client", "--mac", "11:22:33:44:55:66", "--iface=lan", "-approve"},
+		{"block-client", "--mac=11:22:33:44:55:66", "-json"},
+	} {
+		stdout.Reset()
+		if code := run(append([]string{"run-plan", "-config", configPath}, args...), strings.NewReader(""), &stdout, &stderr); code != errcode.InvalidRequest.ExitCode() {
+			t.Errorf("Expected %v to be rejected, got %d", args, code)
+		}
+	}
+	if code := run([]string{"run-plan", "-config", configPath, "unknown", "--mac=11:22:33:44:55:66"}, strings.NewReader(""), &stdout, &stderr); code != errcode.NotFound.ExitCode() {
+		t.Errorf("Expected an unknown template to be reported, got %d", code)
+	}
+}
+
+func TestRun_Pipeline(t *testing.T) {
+	var planPrompt string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		planPrompt = string(b)
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Restart WAN\", \"commands\": [{\"command\":[\"echo\",\"wan restarted\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	logPath := filepath.Join(tmpDir, "audit.log")
+	dir := filepath.Join(tmpDir, "pipelines")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy-key", "allowlist": ["^echo"], "log_file": %q, "pipelines_dir": %q}`, logPath, dir)), 0644)
+	os.Mkdir(dir, 0o755)
+	os.WriteFile(filepath.Join(dir, "wan-recovery.json"), []byte(`{"description": "Bring the WAN link back", "every": "30m", "phases": [
+		{"kind": "diagnose", "commands": [{"command": ["echo", "wan is down"]}]},
+		{"name": "fix", "kind": "plan", "prompt": "Fix the WAN connection"},
+		{"kind": "execute"},
+		{"kind": "verify", "commands": [{"command": ["echo", "wan is up"], "expect": {"contains": "up"}}]}
+	]}`), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"pipeline", "-config", configPath, "list"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "diagnose,fix,execute,verify") {
+		t.Errorf("Expected the pipeline to be listed, got: %s", stdout.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"pipeline", "-config", configPath, "-approve", "run", "wan-recovery"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "Phase 4/4:") || !strings.Contains(out, "wan restarted") || !strings.Contains(out, "Pipeline wan-recovery completed") {
+		t.Errorf("Unexpected pipeline output: %s", out)
+	}
+	if !strings.Contains(planPrompt, "wan is down") {
+		t.Errorf("Expected the diagnosis in the plan prompt, got: %s", planPrompt)
+	}
+	entries, err := logging.ReadHistory(logPath)
+	if err != nil || len(entries) != 3 || entries[1].Prompt != "pipeline wan-recovery/execute: Fix the WAN connection" || entries[2].Status() != "ok" {
+		t.Errorf("Expected each phase to be logged, got %+v, %v", entries, err)
+	}
+
+	// Nobody confirms scheduled runs
+	if code := run([]string{"schedule", "-config", configPath, "pipeline", "wan-recovery"}, strings.NewReader(""), &stdout, &stderr); code != errcode.ConfigInvalid.ExitCode() {
+		t.Errorf("Expected scheduling without approval to be refused, got %d", code)
+	}
+	if code := run([]string{"pipeline", "-config", configPath, "run", "unknown"}, strings.NewReader(""), &stdout, &stderr); code != errcode.NotFound.ExitCode() {
+		t.Errorf("Expected an unknown pipeline to be reported, got %d", code)
+	}
+}
+
+func TestRun_OptimizeWifi(t *testing.T) {
+	var prompt string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		prompt = string(b)
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Move to a quiet channel\", \"commands\": [{\"command\":[\"uci\", \"set\", \"wireless.radio0.channel=100\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	bin := t.TempDir()
+	script := `#!/bin/sh
+case "$*" in
+"") printf 'wlan0     ESSID: "Home"\n          Mode: Master  Channel: 36 (5.180 GHz)\n          Tx-Power: 23 dBm\n' ;;
+"wlan0 scan") printf 'Cell 01 - Address: 66:77:88:99:AA:BB\n          Mode: Master  Channel: 36\n          Signal: -50 dBm\n' ;;
+esac
+`
+	os.WriteFile(filepath.Join(bin, "iwinfo"), []byte(script), 0o755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy"}`), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "optimize-wifi", "-facts=false"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(prompt, "wlan0: channel 36 (5 GHz), tx power 23 dBm, no clients") || !strings.Contains(prompt, "channel 36 (5 GHz): 1 AP(s)") {
+		t.Errorf("survey missing from prompt: %s", prompt)
+	}
+	if out := stdout.String(); !strings.Contains(out, "DFS channel 100") || !strings.Contains(out, "Dry run mode") {
+		t.Errorf("unexpected output: %s", out)
+	}
+}
+
+func TestRun_Tail(t *testing.T) {
+	origCommand := logtail.Command
+	logtail.Command = []string{"printf", "%s", "daemon.err dnsmasq[1]: failed to send packet\ndaemon.info netifd: wan is up\ndaemon.err dnsmasq[1]: failed to send packet\n"}
+	defer func() { logtail.Command = origCommand }()
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy"}`), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"tail", "-threshold", "2", "-config", configPath, "dnsmasq"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	if strings.Count(out, "failed to send packet") != 2 || strings.Contains(out, "netifd") || !strings.Contains(out, "[ALERT] 2 error lines within 1m0s") {
+		t.Errorf("Unexpected tail output: %s", out)
+	}
+
+	stdout.Reset()
+	if code := run([]string{"tail", "-json", "-pattern", "wan", "-config", configPath}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	var ev struct {
+		Type string `json:"type"`
+		Line struct {
+			Text string `json:"text"`
+		} `json:"line"`
+	}
+	if err := json.Unmarshal([]byte(stdout.String()), &ev); err != nil || ev.Type != "line" || ev.Line.Text != "daemon.info netifd: wan is up" {
+		t.Errorf("Unexpected JSON output (%v): %s", err, stdout.String())
+	}
+	if code := run([]string{"tail", "-config", configPath, "bad/service"}, strings.NewReader(""), &stdout, &stderr); code != errcode.InvalidRequest.ExitCode() {
+		t.Errorf("Expected an invalid service to fail, got exit code %d", code)
+	}
+}
+
+func TestRun_TuneSQM(t *testing.T) {
+	var prompt string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		prompt = string(b)
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Shape to 90%\", \"commands\": [{\"command\":[\"uci\", \"set\", \"sqm.eth1.download=85000\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	bin := t.TempDir()
+	os.WriteFile(filepath.Join(bin, "speedtest-cli"), []byte("#!/bin/sh\necho '{\"download\": 94000000, \"upload\": 18000000, \"ping\": 12}'\n"), 0o755)
+	os.WriteFile(filepath.Join(bin, "uci"), []byte(`#!/bin/sh
+[ "$*" = "-q show sqm" ] && printf "sqm.eth1=queue\nsqm.eth1.enabled='0'\nsqm.eth1.interface='eth1'\n"
+exit 0
+`), 0o755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy"}`), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "tune-sqm", "-facts=false"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(prompt, "download 94.0 Mbit/s, upload 18.0 Mbit/s, idle latency 12 ms (speedtest-cli)") || !strings.Contains(prompt, "- eth1: disabled on eth1") {
+		t.Errorf("measurement missing from prompt: %s", prompt)
+	}
+	if !strings.Contains(stderr.String(), "Before: download 94.0 Mbit/s") || !strings.Contains(stdout.String(), "Dry run mode") {
+		t.Errorf("unexpected output: %s / %s", stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	if code := run([]string{"-config", configPath, "tune-sqm", "-tool", "iperf3"}, strings.NewReader(""), &stdout, &stderr); code != 2 {
+		t.Errorf("Expected exit code 2 for iperf3 without -server, got %d", code)
+	}
+}
+
+func TestRun_Pin(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Nothing to do\", \"commands\": []}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy", "pins_file": %q}`, filepath.Join(tmpDir, "pins.json"))), 0644)
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"-config", configPath, "-dry-run", "-facts=false", "hello"}, strings.NewReader(""), &stdout, &stderr); code == 0 {
+		t.Fatal("Expected the self-signed endpoint to be rejected before pinning")
+	} else if !strings.Contains(stderr.String()+stdout.String(), "certificate") {
+		t.Errorf("Expected a certificate error, got: %s %s", stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "pin", "add", server.URL}, strings.NewReader("n\n"), &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), "Cancelled") {
+		t.Fatalf("Expected the pin to be declined, got %d: %s", code, stdout.String())
+	}
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "pin", "add", server.URL}, strings.NewReader("y\n"), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "SHA-256:") || !strings.Contains(stdout.String(), "do not trust") {
+		t.Errorf("Certificate not shown before pinning: %s", stdout.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	if code := run([]string{"-config", configPath, "-dry-run", "-facts=false", "hello"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected the pinned endpoint to be accepted, got %d. Stderr: %s", code, stderr.String())
+	}
+
+	stdout.Reset()
+	run([]string{"-config", configPath, "-json", "pin", "list"}, strings.NewReader(""), &stdout, &stderr)
+	if !strings.Contains(stdout.String(), `"host": "127.0.0.1"`) {
+		t.Errorf("Unexpected list: %s", stdout.String())
+	}
+	if code := run([]string{"-config", configPath, "pin", "remove", "127.0.0.1"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if code := run([]string{"-config", configPath, "pin", "remove", "127.0.0.1"}, strings.NewReader(""), &stdout, &stderr); code == 0 {
+		t.Error("Expected removing a missing pin to fail")
+	}
+}
+
+func TestRun_Clarify(t *testing.T) {
+	var prompts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		prompts = append(prompts, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		if len(prompts) == 1 {
+			w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Which one?\", \"commands\": [], \"questions\": [\"Which device should be blocked?\"]}"}]}}]}`))
+			return
+		}
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Block the laptop\", \"commands\": [{\"command\":[\"echo\", \"block\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy", "allowlist": ["^echo"]}`), 0644)
+
+	var stdout, stderr strings.Builder
+	code := run([]string{"-config", configPath, "-dry-run", "-facts=false", "block that device"}, strings.NewReader("the laptop\n"), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+	if len(prompts) != 2 {
+		t.Fatalf("expected 2 generations, got %d", len(prompts))
+	}
+	if !strings.Contains(prompts[1], "A: the laptop") || !strings.Contains(prompts[1], "Do not ask further questions") {
+		t.Errorf("expected the answer in the second prompt, got %s", prompts[1])
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "Which device should be blocked?") || !strings.Contains(out, "Block the laptop") {
+		t.Errorf("expected the question and the plan, got %s", out)
+	}
+
+	// Without input the questions end the run
+	prompts = nil
+	stdout.Reset()
+	code = run([]string{"-config", configPath, "-dry-run", "-facts=false", "block that device"}, strings.NewReader(""), &stdout, &stderr)
+	if code != 0 || len(prompts) != 1 {
+		t.Fatalf("expected one generation and exit 0, got %d and %d", len(prompts), code)
+	}
+	if !strings.Contains(stdout.String(), "Which device should be blocked?") {
+		t.Errorf("expected the question in the response, got %s", stdout.String())
+	}
+
+	// JSON callers get the questions; nobody is asked
+	prompts = nil
+	stdout.Reset()
+	code = run([]string{"-config", configPath, "-json", "-dry-run", "-facts=false", "block that device"}, strings.NewReader("the laptop\n"), &stdout, &stderr)
+	if code != 0 || len(prompts) != 1 {
+		t.Fatalf("expected one generation and exit 0, got %d and %d", len(prompts), code)
+	}
+	if !strings.Contains(stdout.String(), `"questions"`) {
+		t.Errorf("expected questions in the JSON output, got %s", stdout.String())
+	}
+}
+
+func TestRun_PolicyAlternative(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if calls == 1 {
+			w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Reboot\", \"commands\": [{\"command\":[\"reboot\"]}]}"}]}}]}`))
+			return
+		}
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Restart the network\", \"commands\": [{\"command\":[\"echo\", \"restart\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy", "denylist": ["^reboot # interrupts everyone"]}`), 0644)
+
+	// Without alternatives the rejection is explained
+	var stdout, stderr strings.Builder
+	code := run([]string{"-config", configPath, "-dry-run", "-facts=false", "fix the network"}, strings.NewReader(""), &stdout, &stderr)
+	if code != errcode.PolicyDeny.ExitCode() {
+		t.Fatalf("expected policy exit code, got %d", code)
+	}
+	for _, want := range []string{"Blocked command: reboot", "Matched denylist pattern: ^reboot", "Why: interrupts everyone"} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("expected %q in %s", want, stderr.String())
+		}
+	}
+
+	calls = 0
+	stdout.Reset()
+	stderr.Reset()
+	os.WriteFile(configPath, []byte(`{"api_key": "dummy", "denylist": ["^reboot # interrupts everyone"], "suggest_alternatives": true}`), 0644)
+	code = run([]string{"-config", configPath, "-dry-run", "-facts=false", "fix the network"}, strings.NewReader(""), &stdout, &stderr)
+	if code != 0 || calls != 2 {
+		t.Fatalf("expected an alternative plan, got exit %d after %d calls: %s", code, calls, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "Alternative plan") || !strings.Contains(out, "echo restart") {
+		t.Errorf("expected the alternative to be marked, got %s", out)
+	}
+}
+
+func TestRun_SupportBundle(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(`{"api_key": "AIzaSyA1234567890abcdefghijklmnop", "metrics_dir": ""}`), 0644)
+	archive := filepath.Join(tmpDir, "bundle.tar.gz")
+
+	// Keep the version, view and keep the config, leave out the rest
+	var stdout, stderr strings.Builder
+	input := "v\ny\n" + strings.Repeat("n\n", 10)
+	code := run([]string{"-config", configPath, "support-bundle", "-o", archive}, strings.NewReader("y\n"+input), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "--- config.json ---") || strings.Contains(out, "AIzaSy") || !strings.Contains(out, "Wrote "+archive+" with 2 file(s)") {
+		t.Errorf("Unexpected review: %s", out)
+	}
+	if st, err := os.Stat(archive); err != nil || st.Mode().Perm() != 0600 {
+		t.Fatalf("Expected an owner-only archive: %v", err)
+	}
+
+	// An existing file is not overwritten
+	stdout.Reset()
+	if code := run([]string{"-config", configPath, "support-bundle", "-o", archive, "-yes"}, strings.NewReader(""), &stdout, &stderr); code == 0 {
+		t.Error("Expected failure for an existing archive")
+	}
+	// Scripts skip the review
+	if code := run([]string{"-config", configPath, "-json", "support-bundle"}, strings.NewReader(""), &stdout, &stderr); code == 0 {
+		t.Error("Expected -json without -yes to fail")
+	}
+}
+
+func TestRun_ApprovalCommand(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"Plan\", \"commands\": [{\"command\":[\"echo\", \"approved\"]}]}"}]}}]}`))
+	}))
+	defer server.Close()
+	t.Setenv("GEMINI_ENDPOINT", server.URL)
+
+	tmpDir := t.TempDir()
+	approve := filepath.Join(tmpDir, "approve.sh")
+	// Approves plans whose JSON mentions "approved"
+	os.WriteFile(approve, []byte("grep -q approved || { echo 'rejected by phone'; exit 1; }\n"), 0700)
+	configPath := filepath.Join(tmpDir, "config.json")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`{"api_key": "dummy", "approval_command": "sh %s", "warnlist": ["^echo"]}`, approve)), 0644)
+
+	// Nothing is read from stdin, and the approval acknowledges the warning
+	var stdout, stderr strings.Builder
+	args := []string{"-config", configPath, "-facts=false", "-dry-run=false", "-summarize=false", "say hi"}
+	if code := run(args, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected exit code 0, got %d. Stderr: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "approved") {
+		t.Errorf("Expected the command to run, got: %s", stdout.String())
+	}
+
+	os.WriteFile(approve, []byte("echo 'rejected by phone'; exit 1\n"), 0700)
+	stdout.Reset()
+	stderr.Reset()
+	if code := run(args, strings.NewReader("y\n"), &stdout, &stderr); code != errcode.ApprovalDenied.ExitCode() {
+		t.Fatalf("Expected exit code %d, got %d. Stderr: %s", errcode.ApprovalDenied.ExitCode(), code, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "rejected by phone") {
+		t.Errorf("Expected the approver's reason, got: %s", stderr.String())
+	}
+}
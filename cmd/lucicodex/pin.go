@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/tlspin"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// runPin implements `lucicodex pin`: pins are listed, added on first use
+// after the certificate has been shown and confirmed, and removed.
+func runPin(e *env, args []string, yes bool) int {
+	store := tlspin.Open(e.cfg)
+	if store == nil {
+		return fail(errcode.ConfigInvalid, "Certificate pinning is disabled (set pins_file)", e.jsonOutput, e.stdout, e.stderr)
+	}
+
+	var result interface{}
+	switch args[0] {
+	case "list":
+		pins, err := store.List()
+		if err != nil {
+			return fail(errcode.ConfigInvalid, "Cannot read pins: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+		}
+		if !e.jsonOutput {
+			if len(pins) == 0 {
+				fmt.Fprintf(e.stdout, "No pinned certificates in %s\n", e.cfg.PinsFile)
+				return 0
+			}
+			fmt.Fprintf(e.stdout, "%-30s %-12s %s\n", "HOST", "EXPIRES", "SHA-256")
+			for _, p := range pins {
+				fmt.Fprintf(e.stdout, "%-30s %-12s %s\n", p.Host, p.NotAfter.Local().Format("2006-01-02"), tlspin.FormatFingerprint(p.Fingerprint))
+			}
+			return 0
+		}
+		if pins == nil {
+			pins = []tlspin.Pin{}
+		}
+		result = map[string]interface{}{"pins": pins}
+	case "add":
+		endpoint := e.cfg.Endpoint
+		if len(args) == 2 {
+			endpoint = args[1]
+		}
+		if endpoint == "" {
+			return fail(errcode.InvalidRequest, "No endpoint configured; give one: lucicodex pin add <host[:port]>", e.jsonOutput, e.stdout, e.stderr)
+		}
+		host, addr, err := tlspin.Address(endpoint)
+		if err != nil {
+			return fail(errcode.InvalidRequest, err.Error(), e.jsonOutput, e.stdout, e.stderr)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		cert, trusted, err := tlspin.Fetch(ctx, host, addr)
+		cancel()
+		if err != nil {
+			return fail(errcode.Internal, fmt.Sprintf("Cannot connect to %s: %v", addr, err), e.jsonOutput, e.stdout, e.stderr)
+		}
+		pin := tlspin.Pin{
+			Host:        host,
+			Fingerprint: tlspin.Fingerprint(cert),
+			Subject:     cert.Subject.String(),
+			NotAfter:    cert.NotAfter,
+			Added:       time.Now().UTC(),
+		}
+
+		if !yes {
+			if e.jsonOutput {
+				return fail(errcode.InvalidRequest, "Pinning needs -yes with -json", e.jsonOutput, e.stdout, e.stderr)
+			}
+			fmt.Fprintf(e.stdout, "Certificate presented by %s:\n", addr)
+			fmt.Fprintf(e.stdout, "  Subject: %s\n", cert.Subject)
+			fmt.Fprintf(e.stdout, "  Issuer:  %s\n", cert.Issuer)
+			fmt.Fprintf(e.stdout, "  Expires: %s\n", cert.NotAfter.Local().Format("2006-01-02 15:04"))
+			fmt.Fprintf(e.stdout, "  SHA-256: %s\n", tlspin.FormatFingerprint(pin.Fingerprint))
+			if trusted {
+				fmt.Fprintln(e.stdout, "The system CAs already trust this certificate; pinning also rejects any other certificate for this host.")
+			} else {
+				fmt.Fprintln(e.stdout, "The system CAs do not trust this certificate. Compare the fingerprint with the one on the server before trusting it.")
+			}
+			ok, err := ui.Confirm(bufio.NewReader(e.stdin), e.stdout, "Pin this certificate for "+host+"?")
+			if err != nil {
+				fmt.Fprintf(e.stderr, "Confirmation error: %v\n", err)
+				return 1
+			}
+			if !ok {
+				fmt.Fprintln(e.stdout, "Cancelled")
+				return 0
+			}
+		}
+		if err := store.Add(pin); err != nil {
+			return fail(errcode.Internal, "Cannot write pins: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+		}
+		if !e.jsonOutput {
+			fmt.Fprintf(e.stdout, "Pinned %s\n", host)
+			return 0
+		}
+		result = pin
+	case "remove":
+		found, err := store.Remove(args[1])
+		if err != nil {
+			return fail(errcode.Internal, "Cannot write pins: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+		}
+		if !found {
+			return fail(errcode.NotFound, "No pin for "+args[1], e.jsonOutput, e.stdout, e.stderr)
+		}
+		if !e.jsonOutput {
+			fmt.Fprintf(e.stdout, "Removed the pin of %s\n", args[1])
+			return 0
+		}
+		result = map[string]interface{}{"host": args[1], "removed": true}
+	}
+
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		fmt.Fprintf(e.stderr, "JSON output error: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/approver"
+	"github.com/aezizhu/LuciCodex/internal/artifacts"
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/intent"
+	"github.com/aezizhu/LuciCodex/internal/llm"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/pipeline"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// pipelineRounds limits how many times `lucicodex schedule pipeline` runs
+// its pipeline; 0 runs until interrupted. Tests set it to stop the loop.
+var pipelineRounds = 0
+
+// pipelineOptions are the flags of `lucicodex pipeline run`.
+type pipelineOptions struct {
+	dryRun, approve, ackWarnings bool
+}
+
+// runPipeline implements `lucicodex pipeline list | show <name> | run <name>`.
+func runPipeline(e *env, args []string, o pipelineOptions) int {
+	cfg, stdout, stderr := e.cfg, e.stdout, e.stderr
+	switch args[0] {
+	case "list":
+		list, errs := pipeline.List(cfg.PipelinesDir)
+		for _, err := range errs {
+			fmt.Fprintf(stderr, "Warning: %v\n", err)
+		}
+		if e.jsonOutput {
+			if list == nil {
+				list = []pipeline.Pipeline{}
+			}
+			return printPipelineJSON(e, map[string]interface{}{"pipelines": list})
+		}
+		if len(list) == 0 {
+			fmt.Fprintf(stdout, "No pipelines in %s\n", cfg.PipelinesDir)
+			return 0
+		}
+		fmt.Fprintf(stdout, "%-20s %-30s %-8s %s\n", "NAME", "PHASES", "EVERY", "DESCRIPTION")
+		for _, p := range list {
+			every := p.Every
+			if every == "" {
+				every = "-"
+			}
+			fmt.Fprintf(stdout, "%-20s %-30s %-8s %s\n", p.Name, phaseNames(p), every, oneLine(p.Description, 50))
+		}
+		return 0
+	case "show":
+		p, err := pipeline.Load(cfg.PipelinesDir, args[1])
+		if err != nil {
+			return fail(errcode.Of(err), "Cannot load pipeline: "+err.Error(), e.jsonOutput, stdout, stderr)
+		}
+		if e.jsonOutput {
+			return printPipelineJSON(e, p)
+		}
+		fmt.Fprintf(stdout, "Pipeline %s", p.Name)
+		if p.Description != "" {
+			fmt.Fprintf(stdout, ": %s", p.Description)
+		}
+		if p.Every != "" {
+			fmt.Fprintf(stdout, "\nScheduled every %s", p.Every)
+			if p.AutoApprove {
+				fmt.Fprint(stdout, ", executing without confirmation")
+			}
+		}
+		fmt.Fprintln(stdout)
+		for i, ph := range p.Phases {
+			fmt.Fprintf(stdout, "\n%d. %s (%s)\n", i+1, ph.Label(), ph.Kind)
+			if ph.Prompt != "" {
+				fmt.Fprintf(stdout, "   Prompt: %s\n", ph.Prompt)
+			}
+			for _, c := range ph.Commands {
+				fmt.Fprintf(stdout, "   $ %s\n", executor.FormatPlanned(c))
+			}
+		}
+		return 0
+	}
+
+	p, err := pipeline.Load(cfg.PipelinesDir, args[1])
+	if err != nil {
+		return fail(errcode.Of(err), "Cannot load pipeline: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+	reader := bufio.NewReader(e.stdin)
+	r := newPipelineRunner(cfg, p, !e.jsonOutput, stdout, stderr, func(ctx context.Context, prompt string, pl plan.Plan) error {
+		switch {
+		case approver.Enabled(cfg):
+			fmt.Fprintln(stderr, "Waiting for the approval command...")
+			return approver.Ask(ctx, cfg, approver.Request{Source: "cli", Prompt: prompt, Plan: pl})
+		case o.approve:
+			return policy.RequireAck(pl, o.ackWarnings)
+		}
+		question := "Execute these commands?"
+		if len(pl.PolicyWarnings) > 0 {
+			question = "Execute these commands despite the policy warnings?"
+		}
+		ok, err := ui.Confirm(reader, stdout, question)
+		if w := policy.ControlWarning(pl); err == nil && ok && w != nil {
+			ok, err = ui.Confirm(reader, stdout, fmt.Sprintf("Command %d may disconnect this session. Really execute it?", w.Command+1))
+		}
+		if err != nil {
+			return errcode.Errorf(errcode.ApprovalDenied, "confirmation error: %v", err)
+		}
+		if !ok {
+			return errcode.Errorf(errcode.ApprovalDenied, "cancelled")
+		}
+		return nil
+	})
+	r.DryRun = o.dryRun
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	res := r.Run(ctx)
+	if e.jsonOutput {
+		if code := printPipelineJSON(e, res); code != 0 {
+			return code
+		}
+	} else {
+		printPipelineResult(stdout, res)
+	}
+	if res.Status != pipeline.StatusOK {
+		return res.Code.ExitCode()
+	}
+	return 0
+}
+
+// runSchedulePipeline implements `lucicodex schedule pipeline <name>`: the
+// pipeline is run every interval it sets, until interrupted. Nobody is
+// there to confirm, so its plans are executed only with an
+// approval_command or when the pipeline sets auto_approve, and then only
+// plans without policy warnings.
+func runSchedulePipeline(cfg config.Config, name string, jsonOutput bool, stdout, stderr io.Writer) int {
+	p, err := pipeline.Load(cfg.PipelinesDir, name)
+	if err != nil {
+		return fail(errcode.Of(err), "Cannot load pipeline: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+	interval := p.Interval()
+	if interval <= 0 {
+		return fail(errcode.ConfigInvalid, fmt.Sprintf("Pipeline %s has no schedule (set every)", p.Name), jsonOutput, stdout, stderr)
+	}
+	executes := false
+	for _, ph := range p.Phases {
+		executes = executes || ph.Kind == pipeline.Execute
+	}
+	if executes && !p.AutoApprove && !approver.Enabled(cfg) {
+		return fail(errcode.ConfigInvalid, fmt.Sprintf("Pipeline %s executes plans; scheduling it needs an approval_command or auto_approve", p.Name), jsonOutput, stdout, stderr)
+	}
+	if !jsonOutput {
+		fmt.Fprintf(stdout, "Running pipeline %s every %s (Ctrl-C to stop)\n", p.Name, interval)
+	}
+
+	r := newPipelineRunner(cfg, p, false, stdout, stderr, func(ctx context.Context, prompt string, pl plan.Plan) error {
+		if approver.Enabled(cfg) {
+			return approver.Ask(ctx, cfg, approver.Request{Source: "cli", Prompt: prompt, Plan: pl})
+		}
+		return policy.RequireAck(pl, false)
+	})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for round := 1; ; round++ {
+		select {
+		case <-ctx.Done():
+			return 0
+		case now := <-tick.C:
+			res := r.Run(ctx)
+			if jsonOutput {
+				enc := json.NewEncoder(stdout)
+				if err := enc.Encode(res); err != nil {
+					fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+				}
+			} else {
+				fmt.Fprintf(stdout, "%s pipeline %s: %s\n", now.Local().Format("2006-01-02 15:04:05"), p.Name, pipelineOutcome(res))
+			}
+		}
+		if pipelineRounds > 0 && round >= pipelineRounds {
+			return 0
+		}
+	}
+}
+
+// newPipelineRunner returns a runner of p planning with the model, checking
+// plans against the policy, and running commands under the execution lock
+// and the audit log, each phase as an execution of its own. Plans are
+// executed once approve accepts them. With show, each phase is printed as
+// it ends.
+func newPipelineRunner(cfg config.Config, p pipeline.Pipeline, show bool, stdout, stderr io.Writer, approve func(ctx context.Context, prompt string, pl plan.Plan) error) *pipeline.Runner {
+	factsCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	facts := openwrt.CollectSignedFacts(factsCtx, cfg.FactsKeyFile)
+	cancel()
+	instruction := prompts.GeneratePlanPrompt(intent.Write, intent.Limit(cfg, intent.Write))
+	if block := facts.PromptBlock(); block != "" {
+		instruction += "\n\n" + block
+	}
+
+	provider := llm.NewProvider(cfg)
+	policyEngine := policy.New(cfg)
+	execEngine := executor.New(cfg)
+	llmTimeout := cfg.TimeoutSeconds
+	if llmTimeout < 60 {
+		llmTimeout = 60
+	}
+	var logf func(format string, args ...interface{})
+	if show {
+		logf = func(format string, args ...interface{}) {
+			fmt.Fprintf(stderr, format, args...)
+		}
+	}
+
+	// Execute phases are logged and approved with the prompt of the plan
+	// phase they run
+	var planned pipeline.Phase
+	phasePrompt := func(ph pipeline.Phase) string {
+		if ph.Kind == pipeline.Execute {
+			return pipelinePrompt(p, ph) + ": " + planned.Prompt
+		}
+		return pipelinePrompt(p, ph)
+	}
+	phase := 0
+	return &pipeline.Runner{
+		Pipeline:    p,
+		Instruction: instruction,
+		Plan: func(ctx context.Context, prompt string) (plan.Plan, error) {
+			planCtx, cancel := context.WithTimeout(ctx, time.Duration(llmTimeout)*time.Second)
+			defer cancel()
+			return provider.GeneratePlan(planCtx, prompt)
+		},
+		Check: func(ph pipeline.Phase, pl plan.Plan) (plan.Plan, error) {
+			planned = ph
+			pl = policyEngine.CheckTools(pl)
+			if err := policyEngine.ValidatePlan(pl); err != nil {
+				logging.Open(cfg).WithExecution(artifacts.NewID()).Rejected(phasePrompt(ph), pl, err.Error())
+				return pl, errcode.Errorf(errcode.PolicyDeny, "plan rejected by policy: %s", policy.Explain(err))
+			}
+			pl.Facts = &facts.Stamp
+			pl.PolicyWarnings = policyEngine.Warnings(pl)
+			pl.Lint = policy.LintPlan(pl)
+			return pl, nil
+		},
+		Approve: func(ctx context.Context, ph pipeline.Phase, pl plan.Plan) error {
+			return approve(ctx, phasePrompt(ph), pl)
+		},
+		Exec: func(ctx context.Context, ph pipeline.Phase, pl plan.Plan) (executor.Results, error) {
+			if ph.Kind != pipeline.Execute {
+				// The commands of the definition are checked like any plan
+				if err := policyEngine.ValidatePlan(pl); err != nil {
+					return executor.Results{}, errcode.Errorf(errcode.PolicyDeny, "rejected by policy: %s", policy.Explain(err))
+				}
+			}
+			lock, err := execlock.Acquire("cli")
+			if err != nil {
+				return executor.Results{}, err
+			}
+			defer lock.Release()
+			if ph.Kind == pipeline.Execute && !armRollback(cfg, pl, stderr) {
+				return executor.Results{}, errcode.Errorf(errcode.Internal, "cannot arm network rollback")
+			}
+			logger := logging.Open(cfg).WithExecution(artifacts.NewID())
+			logger.Plan(phasePrompt(ph), pl)
+			results := execEngine.RunPlan(ctx, pl)
+			if ph.Kind == pipeline.Execute {
+				results = execEngine.AutoRetry(ctx, provider, policyEngine, results, logf)
+			}
+			logger.Results(pipelineLogItems(results))
+			return results, nil
+		},
+		OnPhase: func(pr pipeline.PhaseResult) {
+			phase++
+			if !show {
+				return
+			}
+			fmt.Fprintf(stdout, "%s %s (%s)\n", ui.Colorize(ui.Bold, fmt.Sprintf("Phase %d/%d:", phase, len(p.Phases))), pr.Phase, pr.Kind)
+			switch {
+			case pr.Status == pipeline.StatusSkipped:
+				fmt.Fprintf(stdout, "Skipped: %s\n", pr.Reason)
+			case pr.Plan != nil:
+				ui.PrintPlanElevated(stdout, *pr.Plan, cfg.ElevateCommand, cfg.FilePaths)
+			case pr.Kind == pipeline.Plan:
+				fmt.Fprintf(stdout, "Failed: %s\n", pr.Reason)
+			default:
+				if pr.Reason != "" {
+					fmt.Fprintf(stdout, "Failed: %s\n", pr.Reason)
+				}
+				ui.PrintResults(stdout, pr.Results)
+			}
+			fmt.Fprintln(stdout)
+		},
+	}
+}
+
+// pipelinePrompt is what the audit log and the approval command see as the
+// prompt of phase ph.
+func pipelinePrompt(p pipeline.Pipeline, ph pipeline.Phase) string {
+	prompt := "pipeline " + p.Name + "/" + ph.Label()
+	if ph.Prompt != "" {
+		prompt += ": " + ph.Prompt
+	}
+	return prompt
+}
+
+// pipelineLogItems returns the commands and checks of results for the
+// audit log, checks after commands.
+func pipelineLogItems(results executor.Results) []logging.ResultItem {
+	items := make([]logging.ResultItem, 0, len(results.Items)+len(results.Checks))
+	for _, it := range results.Items {
+		items = append(items, it.LogItem())
+	}
+	for _, c := range results.Checks {
+		items = append(items, logging.ResultItem{Index: len(items), Command: c.Command.Command, Output: c.Output, Error: c.Reason})
+	}
+	return items
+}
+
+// phaseNames lists the phases of p, as in "diagnose,fix,execute,verify".
+func phaseNames(p pipeline.Pipeline) string {
+	names := make([]string, len(p.Phases))
+	for i, ph := range p.Phases {
+		names[i] = ph.Label()
+	}
+	return strings.Join(names, ",")
+}
+
+// pipelineOutcome describes how a pipeline run ended.
+func pipelineOutcome(res pipeline.Result) string {
+	if res.Status == pipeline.StatusOK {
+		return res.Status
+	}
+	for i := len(res.Phases) - 1; i >= 0; i-- {
+		if pr := res.Phases[i]; pr.Status == pipeline.StatusFailed {
+			outcome := fmt.Sprintf("%s at phase %s", res.Status, pr.Phase)
+			if pr.Reason != "" {
+				outcome += ": " + pr.Reason
+			}
+			return outcome
+		}
+	}
+	return res.Status
+}
+
+func printPipelineJSON(e *env, v interface{}) int {
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(e.stderr, "JSON output error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func printPipelineResult(w io.Writer, res pipeline.Result) {
+	status := ui.Colorize(ui.Green, "✓ Pipeline "+res.Pipeline+" completed")
+	if res.Status != pipeline.StatusOK {
+		status = ui.Colorize(ui.Red, "✗ Pipeline "+res.Pipeline+" "+pipelineOutcome(res))
+	}
+	fmt.Fprintln(w, status)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/artifacts"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/playbook"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// runPlaybook implements `lucicodex playbook <file>`: the steps of a playbook
+// exported from the REPL, run in order without the model. Every step is
+// checked against the policy before anything runs, and the run stops at the
+// first step that fails since later steps assume its changes.
+func runPlaybook(e *env, path string, dryRun, approve, ackWarnings bool) int {
+	cfg, stdout, stderr := e.cfg, e.stdout, e.stderr
+	pb, err := playbook.Load(path)
+	if err != nil {
+		return fail(errcode.Of(err), "Cannot load playbook: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+
+	factsCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	facts := openwrt.CollectSignedFacts(factsCtx, cfg.FactsKeyFile)
+	cancel()
+	if err := pb.Check(facts.Stamp); err != nil {
+		return fail(errcode.Of(err), "Preconditions not met: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+
+	policyEngine := policy.New(cfg)
+	warned := false
+	for i := range pb.Steps {
+		p := &pb.Steps[i].Plan
+		if err := policyEngine.ValidatePlan(*p); err != nil {
+			return fail(errcode.PolicyDeny, fmt.Sprintf("Step %d rejected by policy: %v", i+1, err), e.jsonOutput, stdout, stderr)
+		}
+		p.Facts = &facts.Stamp
+		p.PolicyWarnings = policyEngine.Warnings(*p)
+		p.Lint = policy.LintPlan(*p)
+		warned = warned || len(p.PolicyWarnings) > 0
+		if !e.jsonOutput {
+			fmt.Fprintf(stdout, "%s %s\n", ui.Colorize(ui.Bold, fmt.Sprintf("Step %d/%d:", i+1, len(pb.Steps))), pb.Steps[i].Prompt)
+			ui.PrintPlanElevated(stdout, *p, cfg.ElevateCommand, cfg.FilePaths)
+			fmt.Fprintln(stdout)
+		}
+	}
+	if dryRun {
+		if !e.jsonOutput {
+			fmt.Fprintln(stdout, "Dry run mode - no execution")
+		}
+		return 0
+	}
+
+	if approve {
+		if warned && !ackWarnings {
+			return fail(errcode.PolicyAck, "Error: playbook has policy warnings that must be acknowledged", e.jsonOutput, stdout, stderr)
+		}
+	} else {
+		ok, err := ui.Confirm(bufio.NewReader(e.stdin), stdout, fmt.Sprintf("Run these %d step(s)?", len(pb.Steps)))
+		if err != nil {
+			fmt.Fprintf(stderr, "Confirmation error: %v\n", err)
+			return 1
+		}
+		if !ok {
+			fmt.Fprintln(stdout, "Cancelled")
+			return 0
+		}
+	}
+
+	lock, err := execlock.Acquire("cli")
+	if err != nil {
+		return fail(errcode.Of(err), "Error: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+	defer lock.Release()
+
+	execEngine := executor.New(cfg)
+	var all executor.Results
+	for i, step := range pb.Steps {
+		if !armRollback(cfg, step.Plan, stderr) {
+			return 1
+		}
+		logger := logging.Open(cfg).WithExecution(artifacts.NewID())
+		logger.Plan("playbook "+path+": "+step.Prompt, step.Plan)
+		results := execEngine.RunPlan(context.Background(), step.Plan)
+		items := make([]logging.ResultItem, 0, len(results.Items))
+		for _, it := range results.Items {
+			items = append(items, it.LogItem())
+		}
+		logger.Results(items)
+
+		all.Items = append(all.Items, results.Items...)
+		all.Failed += results.Failed
+		if len(results.Checks) > 0 {
+			// The playbook is verified only if every step with checks is
+			all.Verified = results.Verified && (len(all.Checks) == 0 || all.Verified)
+			all.Checks = append(all.Checks, results.Checks...)
+		}
+		if !e.jsonOutput {
+			fmt.Fprintf(stdout, "%s %s\n", ui.Colorize(ui.Bold, fmt.Sprintf("Step %d/%d:", i+1, len(pb.Steps))), step.Prompt)
+			ui.PrintResults(stdout, results)
+		}
+		if results.Failed > 0 || results.Unverified() {
+			if !e.jsonOutput && i+1 < len(pb.Steps) {
+				fmt.Fprintf(stdout, "Stopped: %d later step(s) not run\n", len(pb.Steps)-i-1)
+			}
+			break
+		}
+	}
+
+	if e.jsonOutput {
+		if err := ui.PrintResultsJSON(stdout, all); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+	}
+	if all.Failed > 0 || all.Unverified() {
+		return all.ErrorCode().ExitCode()
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+// runPolicyAudit implements `lucicodex policy audit [log-file]`: it replays the
+// plans recorded in the log against the current allow/deny configuration.
+func runPolicyAudit(cfg config.Config, args []string, jsonOutput bool, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "audit" {
+		fmt.Fprintf(stderr, "Usage: lucicodex policy audit [log-file]\n")
+		return 1
+	}
+	path := cfg.LogFile
+	if len(args) > 1 {
+		path = args[1]
+	}
+	if path == "" {
+		fmt.Fprintf(stderr, "No history to audit: set log_file or pass a log file path\n")
+		return 1
+	}
+	// Another log is read as is; log_file has its history
+	entries, err := logging.ReadHistory(path)
+	if len(args) == 1 {
+		entries, err = logging.History(cfg)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read history: %v\n", err)
+		return 1
+	}
+
+	report := policy.New(cfg).AuditHistory(entries)
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "Audited %d plans from %s (%d executed commands, %d rejected plans)\n",
+		report.Plans, path, report.Executed, report.Rejected)
+	if len(report.Findings) == 0 {
+		fmt.Fprintln(stdout, "No changes: the current policy agrees with every recorded decision.")
+		return 0
+	}
+	for _, kind := range []struct{ change, title string }{
+		{policy.NowRejected, "Previously executed, now rejected:"},
+		{policy.NowAllowed, "Previously rejected, now allowed:"},
+	} {
+		first := true
+		for _, f := range report.Findings {
+			if f.Change != kind.change {
+				continue
+			}
+			if first {
+				fmt.Fprintf(stdout, "\n%s\n", kind.title)
+				first = false
+			}
+			fmt.Fprintf(stdout, "  %s  %s\n", f.Time.Local().Format("2006-01-02 15:04:05"), strings.Join(f.Command, " "))
+			fmt.Fprintf(stdout, "      prompt: %q\n", f.Prompt)
+			if f.Change == policy.NowRejected {
+				fmt.Fprintf(stdout, "      reason: %s\n", f.Reason)
+			} else {
+				fmt.Fprintf(stdout, "      was: %s\n", f.Previous)
+			}
+		}
+	}
+	return 0
+}
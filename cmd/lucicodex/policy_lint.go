@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+// runPolicyLint implements `lucicodex policy lint`: it validates the policy
+// options of the loaded configuration and the system policy files, and
+// exits non-zero on errors, since entries that fail to parse are not
+// enforced.
+func runPolicyLint(cfg config.Config, jsonOutput bool, stdout, stderr io.Writer) int {
+	issues := policy.Lint(cfg)
+	nerr := 0
+	for _, is := range issues {
+		if is.Severity == policy.LintError {
+			nerr++
+		}
+	}
+	code := 0
+	if nerr > 0 {
+		code = 1
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]interface{}{"ok": nerr == 0, "issues": issues}); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+		return code
+	}
+
+	for _, is := range issues {
+		field := is.Field
+		if is.Origin != "" {
+			field = is.Origin + ": " + field
+		}
+		fmt.Fprintf(stdout, "%s[%d]: %s: %s\n      %s\n", field, is.Index, is.Severity, is.Message, is.Value)
+	}
+	n := len(cfg.Allowlist) + len(cfg.Denylist) + len(cfg.Warnlist) + len(cfg.PolicyRules)
+	for _, l := range cfg.SystemPolicy {
+		n += len(l.Allowlist) + len(l.Denylist) + len(l.Warnlist) + len(l.PolicyRules)
+	}
+	if len(issues) == 0 {
+		fmt.Fprintf(stdout, "No problems found in %d policy entries.\n", n)
+	} else {
+		fmt.Fprintf(stdout, "%d error(s), %d warning(s) in %d policy entries.\n", nerr, len(issues)-nerr, n)
+	}
+	return code
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// promptFromArgs builds the request from the arguments of run: all of them
+// joined with spaces, or only the first with -first-arg. Flags are only
+// parsed before the prompt, so a word after it that looks like a flag is
+// probably a misplaced or misspelled one and is reported. Words after "--"
+// are taken literally.
+func promptFromArgs(args []string, firstOnly bool, v ui.Verbosity, stderr io.Writer) string {
+	words := make([]string, 0, len(args))
+	literal := false
+	for _, arg := range args {
+		if arg == "--" && !literal {
+			literal = true
+			continue
+		}
+		if !literal && looksLikeFlag(arg) {
+			name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+			switch match, dist := closestFlag(name); {
+			case dist == 0:
+				v.Logf(ui.Normal, stderr, "Warning: %s is taken as part of the prompt; flags must come before it\n", arg)
+			case match != "":
+				v.Logf(ui.Normal, stderr, "Warning: %s is taken as part of the prompt; did you mean -%s before it? (put -- before the prompt to silence this)\n", arg, match)
+			}
+		}
+		words = append(words, arg)
+	}
+	if firstOnly && len(words) > 1 {
+		v.Logf(ui.Normal, stderr, "Warning: -first-arg ignores %d more argument(s): %s\n", len(words)-1, strings.Join(words[1:], " "))
+		words = words[:1]
+	}
+	return strings.Join(words, " ")
+}
+
+// looksLikeFlag reports whether arg has the form of a flag: -name or
+// --name, but not a negative number or a lone dash.
+func looksLikeFlag(arg string) bool {
+	name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	if name == arg || name == "" {
+		return false
+	}
+	c := name[0]
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// closestFlag returns the flag of the run command, global ones included,
+// that is closest to name, and their edit distance. Up to two edits are
+// allowed for long names and one for short ones. Names of one or two
+// letters, like the -c of "ping -c 3", are more likely options of a command
+// in the prompt and never match.
+func closestFlag(name string) (string, int) {
+	if len(name) < 3 {
+		return "", -1
+	}
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	addGlobalFlags(fs)
+	runFlags(fs)
+	best, bestDist := "", 2
+	if len(name) >= 6 {
+		bestDist = 3
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(strings.ToLower(name), f.Name); d < bestDist {
+			best, bestDist = f.Name, d
+		}
+	})
+	return best, bestDist
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
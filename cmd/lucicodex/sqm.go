@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// sqmOptions are the measurement flags of tune-sqm.
+type sqmOptions struct {
+	speed   openwrt.SpeedOptions
+	verify  bool // measure again after the SQM config changed
+	timeout time.Duration
+}
+
+// runTuneSQM implements `lucicodex tune-sqm`: the WAN link is measured
+// and, with the current SQM queues, given to the model, which plans cake
+// bandwidth settings that are reviewed and run like any other plan. If the
+// plan changed the SQM config, the link is measured again to show the
+// effect.
+func runTuneSQM(e *env, o runOptions, so sqmOptions) int {
+	v := e.verbosity
+	if e.jsonOutput && v == ui.Normal {
+		v = ui.Quiet
+	}
+	switch so.speed.Tool {
+	case "", "builtin", "speedtest-cli":
+	case "iperf3", "netperf":
+		if so.speed.Server == "" {
+			return fail(errcode.InvalidRequest, "-tool "+so.speed.Tool+" needs -server", e.jsonOutput, e.stdout, e.stderr)
+		}
+	default:
+		return fail(errcode.InvalidRequest, fmt.Sprintf("Unknown -tool %q (want builtin, speedtest-cli, iperf3 or netperf)", so.speed.Tool), e.jsonOutput, e.stdout, e.stderr)
+	}
+	v.Logf(ui.Normal, e.stderr, "Measuring the link (this takes a while)...\n")
+	survey, err := measureSQM(so)
+	if err != nil {
+		return fail(errcode.ExecFailed, "Speed test failed: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+	}
+	v.Logf(ui.Normal, e.stderr, "Before: %s\n", survey.Speed)
+
+	o.extra = "\n\n" + survey.PromptBlock()
+	if survey.Config != "" {
+		o.extra += "\n\nCurrent SQM configuration:\n" + prompts.FenceOutput(survey.Config) + "\n" + prompts.UntrustedNotice
+	}
+	code := runPrompt(e, o, []string{prompts.SQMTuneRequest})
+	if code != 0 || !so.verify {
+		return code
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	config := openwrt.ReadSQMConfig(ctx)
+	cancel()
+	if config == survey.Config {
+		return 0
+	}
+	out := e.stdout
+	if e.jsonOutput {
+		out = e.stderr
+	}
+	fmt.Fprintln(out, "SQM configuration changed, measuring again...")
+	after, err := measureSQM(so)
+	if err != nil {
+		fmt.Fprintf(out, "Verification speed test failed: %v\n", err)
+		return 0
+	}
+	printSpeedComparison(out, survey.Speed, after.Speed)
+	return 0
+}
+
+// measureSQM runs the speed test and reads the SQM config.
+func measureSQM(so sqmOptions) (openwrt.SQMSurvey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), so.timeout)
+	defer cancel()
+	var s openwrt.SQMSurvey
+	speed, err := openwrt.MeasureSpeed(ctx, so.speed)
+	if err != nil {
+		return s, err
+	}
+	s.Speed = speed
+	s.Config = openwrt.ReadSQMConfig(ctx)
+	s.Queues = openwrt.ParseSQMQueues(s.Config)
+	return s, nil
+}
+
+// printSpeedComparison shows two measurements side by side.
+func printSpeedComparison(w io.Writer, before, after openwrt.SpeedResult) {
+	fmt.Fprintf(w, "%-20s %10s %10s\n", "", "BEFORE", "AFTER")
+	row := func(name string, b, a float64, unit string) {
+		if b == 0 && a == 0 {
+			return
+		}
+		fmt.Fprintf(w, "%-20s %10s %10s\n", name, fmt.Sprintf("%.1f %s", b, unit), fmt.Sprintf("%.1f %s", a, unit))
+	}
+	row("Download", before.Download, after.Download, "Mbit/s")
+	row("Upload", before.Upload, after.Upload, "Mbit/s")
+	row("Idle latency", before.Latency, after.Latency, "ms")
+	row("Loaded latency", before.LoadedLatency, after.LoadedLatency, "ms")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/state"
+)
+
+// passphraseEnv supplies the state archive passphrase non-interactively.
+const passphraseEnv = "LUCICODEX_STATE_PASSPHRASE"
+
+// readPassphrase returns the passphrase from the environment or the first
+// line of stdin. An empty passphrase means secrets are not exported.
+func readPassphrase(stdin io.Reader, stderr io.Writer, prompt string) string {
+	if v := os.Getenv(passphraseEnv); v != "" {
+		return v
+	}
+	fmt.Fprint(stderr, prompt)
+	line, _ := bufio.NewReader(stdin).ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+// runExportState implements `lucicodex export-state <out.tar.gz>`.
+func runExportState(cfg config.Config, configPath, out string, stdin io.Reader, stdout, stderr io.Writer) int {
+	pass := readPassphrase(stdin, stderr, "Passphrase to encrypt tokens and keys (empty to leave them out): ")
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		fmt.Fprintf(stderr, "Cannot create %s: %v\n", out, err)
+		return 1
+	}
+	m, err := state.Export(f, state.Items(cfg, config.FilePath(configPath)), pass)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		fmt.Fprintf(stderr, "Export failed: %v\n", err)
+		return 1
+	}
+	for _, e := range m.Entries {
+		fmt.Fprintf(stdout, "exported %-10s %s (%d files)\n", e.Name, e.Path, len(e.Files))
+	}
+	if len(m.Skipped) > 0 {
+		fmt.Fprintf(stderr, "Skipped without a passphrase: %s\n", strings.Join(m.Skipped, ", "))
+	}
+	fmt.Fprintf(stdout, "State written to %s\n", out)
+	return 0
+}
+
+// runImportState implements `lucicodex import-state <in.tar.gz>`.
+func runImportState(cfg config.Config, configPath, in string, stdin io.Reader, stdout, stderr io.Writer) int {
+	f, err := os.Open(in)
+	if err != nil {
+		fmt.Fprintf(stderr, "Cannot open %s: %v\n", in, err)
+		return 1
+	}
+	defer f.Close()
+	pass := readPassphrase(stdin, stderr, "Passphrase used at export (empty if none): ")
+	m, err := state.Import(f, state.Items(cfg, config.FilePath(configPath)), pass)
+	if err != nil {
+		fmt.Fprintf(stderr, "Import failed: %v\n", err)
+		return 1
+	}
+	for _, e := range m.Entries {
+		fmt.Fprintf(stdout, "restored %-10s (%d files)\n", e.Name, len(e.Files))
+	}
+	fmt.Fprintf(stdout, "State from %s restored; restart the lucicodex service to apply it\n", m.Created.Format("2006-01-02 15:04"))
+	return 0
+}
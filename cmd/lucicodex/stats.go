@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
+)
+
+// statsCommandLimit is the number of command patterns runStats lists.
+const statsCommandLimit = 10
+
+// runStats implements -stats: a per-day and per-provider view of the metrics
+// rollups for the last days days, plus how the most used command patterns
+// fared according to the audit log.
+func runStats(cfg config.Config, days int, jsonOutput bool, stdout, stderr io.Writer) int {
+	store := metrics.OpenRollupStore(cfg)
+	if store == nil {
+		fmt.Fprintln(stderr, "Metrics persistence is disabled (set metrics_dir)")
+		return 1
+	}
+	rollups, err := store.Days(days)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read metrics: %v\n", err)
+		return 1
+	}
+	sum := metrics.Summarize(rollups)
+	if cfg.LogFile != "" {
+		if entries, err := logging.History(cfg); err == nil {
+			sum.Commands = metrics.CommandOutcomes(entries, time.Now().AddDate(0, 0, -days))
+		}
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(sum); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "Usage over the last %d days: %d requests, %.1f%% successful\n", days, sum.Requests, sum.SuccessRate)
+	if sum.Requests == 0 {
+		return 0
+	}
+	if sum.Escalations > 0 {
+		fmt.Fprintf(stdout, "Plans escalated to the stronger model: %d\n", sum.Escalations)
+	}
+	fmt.Fprintf(stdout, "\n%-12s %8s %8s %9s\n", "DATE", "REQUESTS", "SUCCESS", "COMMANDS")
+	for _, d := range sum.Days {
+		fmt.Fprintf(stdout, "%-12s %8d %7.1f%% %9d\n", d.Date, d.Requests, d.SuccessRate, d.Commands)
+	}
+
+	names := make([]string, 0, len(sum.Providers))
+	for name := range sum.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(stdout, "\n%-12s %8s %8s %12s\n", "PROVIDER", "REQUESTS", "SUCCESS", "AVG LATENCY")
+	for _, name := range names {
+		ps := sum.Providers[name]
+		fmt.Fprintf(stdout, "%-12s %8d %7.1f%% %10.0fms\n", name, ps.Requests, ps.SuccessRate, ps.AvgLatencyMs)
+	}
+	for _, name := range names {
+		if ps := sum.Providers[name]; ps.CacheReadTokens > 0 || ps.CacheWriteTokens > 0 {
+			fmt.Fprintf(stdout, "Prompt cache of %s: %d hits, %d tokens read, %d written, %.1f%% of input tokens from the cache\n", name, ps.CacheHits, ps.CacheReadTokens, ps.CacheWriteTokens, ps.CacheHitRate)
+		}
+	}
+
+	if len(sum.Commands) == 0 {
+		return 0
+	}
+	patterns := make([]string, 0, len(sum.Commands))
+	for p := range sum.Commands {
+		patterns = append(patterns, p)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		a, b := sum.Commands[patterns[i]], sum.Commands[patterns[j]]
+		if a.Runs != b.Runs {
+			return a.Runs > b.Runs
+		}
+		return patterns[i] < patterns[j]
+	})
+	if len(patterns) > statsCommandLimit {
+		patterns = patterns[:statsCommandLimit]
+	}
+	fmt.Fprintf(stdout, "\n%-28s %6s %8s %5s %5s\n", "COMMAND", "RUNS", "SUCCESS", "GOOD", "BAD")
+	for _, p := range patterns {
+		ps := sum.Commands[p]
+		fmt.Fprintf(stdout, "%-28s %6d %7.1f%% %5d %5d\n", oneLine(p, 28), ps.Runs, ps.SuccessRate, ps.Good, ps.Bad)
+	}
+	return 0
+}
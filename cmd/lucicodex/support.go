@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/redact"
+	"github.com/aezizhu/LuciCodex/internal/support"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// runSupportBundle implements `lucicodex support-bundle`: it collects the
+// bundle, lets the user review every file unless yes is set, and writes
+// the files they keep to output.
+func runSupportBundle(e *env, output string, yes bool) int {
+	stdout, stderr := e.stdout, e.stderr
+	if e.jsonOutput && !yes {
+		return fail(errcode.InvalidRequest, "-json needs -yes: the review step is interactive", e.jsonOutput, stdout, stderr)
+	}
+	stamp := time.Now().Format("20060102-150405")
+	if output == "" {
+		output = "/tmp/lucicodex-support-" + stamp + ".tar.gz"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	files := support.Collect(ctx, e.cfg, version)
+
+	if !yes {
+		reader := bufio.NewReader(e.stdin)
+		fmt.Fprintln(stdout, ui.Colorize(ui.Bold, "The support bundle contains:"))
+		for _, f := range files {
+			fmt.Fprintf(stdout, "  %-16s %7d bytes, %d value(s) redacted\n", f.Name, len(f.Data), f.Redactions)
+		}
+		fmt.Fprintln(stdout, "Review each file before it is written; redacted values read "+redact.Marker+".")
+		var kept []support.File
+		for _, f := range files {
+			keep, err := reviewFile(reader, e, f)
+			if err != nil {
+				fmt.Fprintf(stderr, "Confirmation error: %v\n", err)
+				return 1
+			}
+			if keep {
+				kept = append(kept, f)
+			}
+		}
+		if len(kept) == 0 {
+			fmt.Fprintln(stdout, "Cancelled")
+			return 0
+		}
+		files = kept
+	}
+
+	out, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fail(errcode.Internal, "Cannot create the support bundle: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+	err = support.WriteArchive(out, "lucicodex-support-"+stamp, files)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		return fail(errcode.Internal, "Cannot write the support bundle: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+
+	if e.jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]interface{}{"path": output, "files": files}); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(stdout, "Wrote %s with %d file(s); check it once more before attaching it to a bug report.\n", output, len(files))
+	return 0
+}
+
+// reviewFile asks whether to include f, showing its contents on request.
+func reviewFile(reader *bufio.Reader, e *env, f support.File) (bool, error) {
+	for {
+		fmt.Fprintf(e.stdout, "%s %s ", ui.Colorize(ui.Bold, "Include "+f.Name+"?"), ui.Colorize(ui.Blue, "[y/n/v(iew)]:"))
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return false, err
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		case "v", "view":
+			fmt.Fprintf(e.stdout, "--- %s ---\n%s--- end of %s ---\n", f.Name, f.Data, f.Name)
+		}
+	}
+}
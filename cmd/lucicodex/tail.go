@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/logtail"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+// tailOptions are the flags of the tail command.
+type tailOptions struct {
+	pattern   string
+	threshold int
+	window    time.Duration
+	analyze   bool
+	duration  time.Duration // 0 follows until interrupted
+}
+
+// tailEvent is a line of `lucicodex tail -json` output.
+type tailEvent struct {
+	Type    string           `json:"type"` // "line", "alert" or "analysis"
+	Line    *logtail.Line    `json:"line,omitempty"`
+	Trigger *logtail.Trigger `json:"trigger,omitempty"`
+	Summary string           `json:"summary,omitempty"`
+	Details []string         `json:"details,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// runTail implements `lucicodex tail [service]`: it follows the system log,
+// optionally only the lines of one service, and reports bursts of errors,
+// asking the model about them with -analyze.
+func runTail(cfg config.Config, service string, o tailOptions, jsonOutput bool, stdout, stderr io.Writer) int {
+	if service != "" && !logtail.ValidService(service) {
+		return fail(errcode.InvalidRequest, fmt.Sprintf("Invalid service name %q", service), jsonOutput, stdout, stderr)
+	}
+	opts := logtail.Options{Service: service, Threshold: o.threshold, Window: o.window}
+	if o.pattern != "" {
+		re, err := regexp.Compile(o.pattern)
+		if err != nil {
+			return fail(errcode.InvalidRequest, "Invalid -pattern: "+err.Error(), jsonOutput, stdout, stderr)
+		}
+		opts.Pattern = re
+	}
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: logtail.Command}}}
+	if err := policy.New(cfg).ValidatePlan(p); err != nil {
+		return fail(errcode.PolicyDeny, "Log tailing rejected by policy: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if o.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.duration)
+		defer cancel()
+	}
+
+	enc := json.NewEncoder(stdout)
+	onLine := func(l logtail.Line) {
+		if jsonOutput {
+			enc.Encode(tailEvent{Type: "line", Line: &l})
+			return
+		}
+		if l.Dropped > 0 {
+			fmt.Fprintf(stderr, "[%d lines dropped]\n", l.Dropped)
+		}
+		if l.Text != "" {
+			fmt.Fprintln(stdout, l.Text)
+		}
+	}
+	onTrigger := func(tr logtail.Trigger) {
+		if jsonOutput {
+			enc.Encode(tailEvent{Type: "alert", Trigger: &tr})
+		} else {
+			fmt.Fprintf(stdout, "[ALERT] %d error lines within %s\n", tr.Errors, tr.Window)
+		}
+		if !o.analyze {
+			return
+		}
+		actx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+		defer cancel()
+		summary, details, err := logtail.Analyze(actx, cfg, service, tr)
+		switch {
+		case jsonOutput && err != nil:
+			enc.Encode(tailEvent{Type: "analysis", Error: err.Error()})
+		case jsonOutput:
+			enc.Encode(tailEvent{Type: "analysis", Summary: summary, Details: details})
+		case err != nil:
+			fmt.Fprintf(stderr, "Analysis failed: %v\n", err)
+		default:
+			fmt.Fprintf(stdout, "[ANALYSIS] %s\n", summary)
+			for _, d := range details {
+				fmt.Fprintf(stdout, "  - %s\n", d)
+			}
+		}
+	}
+
+	if !jsonOutput && o.duration == 0 {
+		fmt.Fprintln(stderr, "Following the system log (Ctrl-C to stop)")
+	}
+	if err := logtail.Follow(ctx, opts, onLine, onTrigger); err != nil {
+		return fail(errcode.Internal, "Failed to follow the log: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+	return 0
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/approver"
+	"github.com/aezizhu/LuciCodex/internal/artifacts"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+	"github.com/aezizhu/LuciCodex/internal/templates"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// runTemplate implements `lucicodex template list | show | save | delete`.
+func runTemplate(e *env, args []string) int {
+	store := templates.Open(e.cfg)
+	switch args[0] {
+	case "list":
+		list, err := store.List()
+		if err != nil {
+			return fail(errcode.Of(err), "Cannot list templates: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+		}
+		if e.jsonOutput {
+			if list == nil {
+				list = []templates.Template{}
+			}
+			return printTemplateJSON(e, map[string]interface{}{"templates": list})
+		}
+		if len(list) == 0 {
+			fmt.Fprintf(e.stdout, "No templates in %s\n", e.cfg.TemplatesDir)
+			return 0
+		}
+		fmt.Fprintf(e.stdout, "%-20s %-30s %s\n", "NAME", "PARAMETERS", "PROMPT")
+		for _, t := range list {
+			fmt.Fprintf(e.stdout, "%-20s %-30s %s\n", t.Name, templateParams(t), oneLine(t.Prompt, 50))
+		}
+		return 0
+	case "show":
+		t, err := store.Get(args[1])
+		if err != nil {
+			return fail(errcode.Of(err), "Cannot load template: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+		}
+		if e.jsonOutput {
+			return printTemplateJSON(e, t)
+		}
+		fmt.Fprintf(e.stdout, "Template %s, created %s", t.Name, t.Created.Local().Format("2006-01-02 15:04"))
+		if t.Source != "" {
+			fmt.Fprintf(e.stdout, " from execution %s", t.Source)
+		}
+		fmt.Fprintf(e.stdout, "\nPrompt: %s\nParameters: %s\n\n", t.Prompt, templateParams(t))
+		ui.PrintPlan(e.stdout, t.Plan)
+		return 0
+	case "delete":
+		if err := store.Delete(args[1]); err != nil {
+			return fail(errcode.Of(err), "Cannot delete template: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+		}
+		if e.jsonOutput {
+			return printTemplateJSON(e, map[string]string{"deleted": args[1]})
+		}
+		fmt.Fprintf(e.stdout, "Deleted template %s\n", args[1])
+		return 0
+	}
+
+	// save <name> <id> [param[:type]=value ...]
+	name, id := args[1], args[2]
+	if e.cfg.LogFile == "" {
+		return fail(errcode.ConfigInvalid, "History is disabled (set log_file)", e.jsonOutput, e.stdout, e.stderr)
+	}
+	entries, err := logging.History(e.cfg)
+	if err != nil {
+		return fail(errcode.Internal, "Failed to read history: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+	}
+	i := len(entries) - 1
+	for ; i >= 0 && entries[i].ID != id; i-- {
+	}
+	if i < 0 {
+		return fail(errcode.NotFound, "No execution "+id+" in "+e.cfg.LogFile, e.jsonOutput, e.stdout, e.stderr)
+	}
+	if status := entries[i].Status(); status != "ok" {
+		return fail(errcode.InvalidRequest, fmt.Sprintf("Execution %s is %s; only plans that were run successfully can be saved", id, status), e.jsonOutput, e.stdout, e.stderr)
+	}
+	var bindings []templates.Binding
+	for _, a := range args[3:] {
+		b, err := templates.ParseBinding(a)
+		if err != nil {
+			return fail(errcode.Of(err), "Error: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+		}
+		bindings = append(bindings, b)
+	}
+	t, err := templates.New(name, entries[i].Prompt, entries[i].Plan, bindings)
+	if err != nil {
+		return fail(errcode.Of(err), "Cannot make template: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+	}
+	t.Source = id
+	if err := store.Save(t); err != nil {
+		return fail(errcode.Of(err), "Cannot save template: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+	}
+	if e.jsonOutput {
+		return printTemplateJSON(e, t)
+	}
+	fmt.Fprintf(e.stdout, "Saved template %s with parameters %s\n", t.Name, templateParams(t))
+	ui.PrintPlan(e.stdout, t.Plan)
+	return 0
+}
+
+func printTemplateJSON(e *env, v interface{}) int {
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(e.stderr, "JSON output error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// templateParams lists the parameters of t as run-plan flags.
+func templateParams(t templates.Template) string {
+	if len(t.Params) == 0 {
+		return "none"
+	}
+	flags := make([]string, len(t.Params))
+	for i, p := range t.Params {
+		flags[i] = fmt.Sprintf("--%s=<%s>", p.Name, p.Type)
+	}
+	return strings.Join(flags, " ")
+}
+
+// runRunPlan implements `lucicodex run-plan <template> --param=value...`:
+// the template's plan with the values filled in, checked against the
+// policy and run without asking the model.
+func runRunPlan(e *env, name string, values map[string]string, dryRun, approve, ackWarnings bool) int {
+	cfg, stdout, stderr := e.cfg, e.stdout, e.stderr
+	t, err := templates.Open(cfg).Get(name)
+	if err != nil {
+		return fail(errcode.Of(err), "Cannot load template: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+	p, prompt, err := t.Instantiate(values)
+	if err != nil {
+		return fail(errcode.Of(err), "Error: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+
+	factsCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	facts := openwrt.CollectSignedFacts(factsCtx, cfg.FactsKeyFile)
+	cancel()
+	p.Facts = &facts.Stamp
+
+	logger := logging.Open(cfg).WithExecution(artifacts.NewID())
+	prompt = "run-plan " + name + ": " + prompt
+	policyEngine := policy.New(cfg)
+	if err := policyEngine.ValidatePlan(p); err != nil {
+		logger.Rejected(prompt, p, err.Error())
+		return failPolicy("Plan rejected by policy: "+policy.Explain(err), policyEngine.Trace(p), e.jsonOutput, stdout, stderr)
+	}
+	p.PolicyWarnings = policyEngine.Warnings(p)
+	p.Lint = policy.LintPlan(p)
+	if e.jsonOutput {
+		traced := p
+		traced.PolicyTrace = policyEngine.Trace(p)
+		if err := ui.PrintPlanJSON(stdout, traced); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+	} else {
+		ui.PrintPlanElevated(stdout, p, cfg.ElevateCommand, cfg.FilePaths)
+	}
+	if dryRun {
+		if !e.jsonOutput {
+			fmt.Fprintln(stdout, "\nDry run mode - no execution")
+		}
+		return 0
+	}
+
+	switch {
+	case approver.Enabled(cfg):
+		fmt.Fprintln(stderr, "Waiting for the approval command...")
+		if err := approver.Ask(context.Background(), cfg, approver.Request{Source: "cli", Prompt: prompt, Plan: p}); err != nil {
+			return fail(errcode.Of(err), "Error: "+err.Error(), e.jsonOutput, stdout, stderr)
+		}
+	case approve:
+		if err := policy.RequireAck(p, ackWarnings); err != nil {
+			return fail(errcode.Of(err), "Error: "+err.Error(), e.jsonOutput, stdout, stderr)
+		}
+	default:
+		question := "Execute these commands?"
+		if len(p.PolicyWarnings) > 0 {
+			question = "Execute these commands despite the policy warnings?"
+		}
+		reader := bufio.NewReader(e.stdin)
+		ok, err := ui.Confirm(reader, stdout, question)
+		if w := policy.ControlWarning(p); err == nil && ok && w != nil {
+			ok, err = ui.Confirm(reader, stdout, fmt.Sprintf("Command %d may disconnect this session. Really execute it?", w.Command+1))
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "Confirmation error: %v\n", err)
+			return 1
+		}
+		if !ok {
+			fmt.Fprintln(stdout, "Cancelled")
+			return 0
+		}
+	}
+
+	lock, err := execlock.Acquire("cli")
+	if err != nil {
+		return fail(errcode.Of(err), "Error: "+err.Error(), e.jsonOutput, stdout, stderr)
+	}
+	defer lock.Release()
+
+	if !armRollback(cfg, p, stderr) {
+		return 1
+	}
+	logger.Plan(prompt, p)
+	results := executor.New(cfg).RunPlan(context.Background(), p)
+	items := make([]logging.ResultItem, 0, len(results.Items))
+	for _, it := range results.Items {
+		items = append(items, it.LogItem())
+	}
+	logger.Results(items)
+
+	if e.jsonOutput {
+		if err := ui.PrintResultsJSON(stdout, results); err != nil {
+			fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+			return 1
+		}
+	} else {
+		ui.PrintResults(stdout, results)
+	}
+	if results.Failed > 0 || results.Unverified() {
+		return results.ErrorCode().ExitCode()
+	}
+	return 0
+}
+
+// parseParams reads the --name=value or --name value arguments after the
+// template name of run-plan. The command's own flags, such as -approve, may
+// be among them and are set in fs; global flags must come before the name
+// since the config is loaded by then. The rest are template parameters.
+func parseParams(fs *flag.FlagSet, args []string, own ...string) (map[string]string, error) {
+	isOwn := map[string]bool{}
+	for _, name := range own {
+		isOwn[name] = true
+	}
+	values := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if !strings.HasPrefix(a, "-") || a == "-" || a == "--" {
+			return nil, fmt.Errorf("unexpected argument %q, parameters are given as --name=value", a)
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		f := fs.Lookup(name)
+		if f != nil && !isOwn[name] {
+			return nil, fmt.Errorf("flag -%s must come before the template name", name)
+		}
+		if f != nil && !hasValue {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				value, hasValue = "true", true
+			}
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("parameter --%s has no value", name)
+			}
+			i++
+			value = args[i]
+		}
+		if f != nil {
+			if err := fs.Set(name, value); err != nil {
+				return nil, fmt.Errorf("invalid value %q for flag -%s: %v", value, name, err)
+			}
+			continue
+		}
+		if _, dup := values[name]; dup {
+			return nil, fmt.Errorf("parameter --%s given twice", name)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aezizhu/LuciCodex/internal/auth"
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// isTokenCommand reports whether args are `token list`, `token add <name>
+// <role>` or `token remove <name>`.
+func isTokenCommand(args []string) bool {
+	if len(args) < 2 || args[0] != "token" {
+		return false
+	}
+	switch args[1] {
+	case "list":
+		return len(args) == 2
+	case "add":
+		return len(args) == 4
+	case "remove":
+		return len(args) == 3
+	}
+	return false
+}
+
+// runTokens manages the daemon's API tokens and their roles. The daemon
+// picks up changes on the next request.
+func runTokens(cfg config.Config, args []string, jsonOutput bool, stdout, stderr io.Writer) int {
+	if cfg.APITokensFile == "" {
+		return fail(errcode.ConfigInvalid, "API tokens are disabled (set api_tokens_file)", jsonOutput, stdout, stderr)
+	}
+	store := auth.OpenAPITokenStore(cfg)
+	if err := store.Load(); err != nil {
+		return fail(errcode.ConfigInvalid, "Cannot read API tokens: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+
+	var result interface{}
+	switch args[0] {
+	case "list":
+		list := store.List()
+		if !jsonOutput {
+			if len(list) == 0 {
+				fmt.Fprintf(stdout, "No API tokens in %s\n", store.Path())
+				return 0
+			}
+			fmt.Fprintf(stdout, "%-20s %-9s %s\n", "NAME", "ROLE", "CREATED")
+			for _, t := range list {
+				fmt.Fprintf(stdout, "%-20s %-9s %s\n", t.Name, t.Role, t.Created.Local().Format("2006-01-02 15:04"))
+			}
+			return 0
+		}
+		tokens := []map[string]interface{}{}
+		for _, t := range list {
+			tokens = append(tokens, map[string]interface{}{"name": t.Name, "role": t.Role, "created": t.Created})
+		}
+		result = map[string]interface{}{"tokens": tokens}
+	case "add":
+		role, err := auth.ParseRole(args[2])
+		if err != nil {
+			return fail(errcode.InvalidRequest, err.Error(), jsonOutput, stdout, stderr)
+		}
+		secret, err := store.Create(args[1], role)
+		if errors.Is(err, auth.ErrTokenExists) {
+			return fail(errcode.Conflict, fmt.Sprintf("Token %s already exists; remove it first", args[1]), jsonOutput, stdout, stderr)
+		} else if err != nil {
+			return fail(errcode.InvalidRequest, err.Error(), jsonOutput, stdout, stderr)
+		}
+		if err := store.Save(); err != nil {
+			return fail(errcode.Internal, "Cannot write API tokens: "+err.Error(), jsonOutput, stdout, stderr)
+		}
+		if !jsonOutput {
+			fmt.Fprintf(stdout, "Created %s token %s. It is shown only once:\n%s\n", role, args[1], secret)
+			return 0
+		}
+		result = map[string]interface{}{"name": args[1], "role": role, "token": secret}
+	case "remove":
+		if !store.Delete(args[1]) {
+			return fail(errcode.NotFound, "No API token named "+args[1], jsonOutput, stdout, stderr)
+		}
+		if err := store.Save(); err != nil {
+			return fail(errcode.Internal, "Cannot write API tokens: "+err.Error(), jsonOutput, stdout, stderr)
+		}
+		if !jsonOutput {
+			fmt.Fprintf(stdout, "Removed token %s\n", args[1])
+			return 0
+		}
+		result = map[string]interface{}{"name": args[1], "removed": true}
+	}
+
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		fmt.Fprintf(stderr, "JSON output error: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/dashboard"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/pkg/client"
+)
+
+// topOptions are the flags of the top command.
+type topOptions struct {
+	daemon   string // Address of the daemon to show; empty reads the local files
+	token    string
+	interval time.Duration
+	once     bool
+}
+
+// defaultTopWidth is the screen width used when $COLUMNS is not set.
+const defaultTopWidth = 100
+
+// runTop implements `lucicodex top`: a dashboard of the daemon's health,
+// the execution in progress with its output, the scheduler, LLM latency and
+// recent executions, redrawn every interval until interrupted. With -json
+// each refresh is printed as one JSON object instead.
+func runTop(e *env, o topOptions) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	width := defaultTopWidth
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 40 {
+		width = n
+	}
+	enc := json.NewEncoder(e.stdout)
+	for {
+		snap, err := topSnapshot(ctx, e.cfg, o)
+		if err != nil && o.once {
+			code := client.CodeOf(err)
+			if code == "" {
+				code = errcode.Internal
+			}
+			return fail(code, "Cannot reach the daemon: "+err.Error(), e.jsonOutput, e.stdout, e.stderr)
+		}
+		switch {
+		case e.jsonOutput:
+			if err := enc.Encode(snap); err != nil {
+				fmt.Fprintf(e.stderr, "JSON output error: %v\n", err)
+				return 1
+			}
+		case o.once:
+			dashboard.Render(e.stdout, snap, width)
+		default:
+			fmt.Fprint(e.stdout, dashboard.ClearScreen)
+			dashboard.Render(e.stdout, snap, width)
+		}
+		if o.once {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-time.After(o.interval):
+		}
+	}
+}
+
+// topSnapshot fetches the dashboard from the daemon at o.daemon, or collects
+// it from the local files and asks the local daemon for its health only.
+// A daemon that cannot be reached is reported in the snapshot and, for
+// o.daemon, as the error.
+func topSnapshot(ctx context.Context, cfg config.Config, o topOptions) (dashboard.Snapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if o.daemon != "" {
+		c := client.New(o.daemon, o.token)
+		c.Retries = 0
+		d, err := c.Dashboard(ctx)
+		if err != nil {
+			return dashboard.Snapshot{Time: time.Now(), Source: o.daemon, DaemonError: err.Error()}, err
+		}
+		d.Source = o.daemon
+		return *d, nil
+	}
+	snap := dashboard.Collect(cfg)
+	addr := "http://127.0.0.1:9999"
+	if cfg.SocketPath != "" {
+		addr = "unix://" + cfg.SocketPath
+	}
+	if h, err := client.New(addr, "").Health(ctx); err != nil {
+		snap.DaemonError = err.Error()
+	} else {
+		snap.Daemon = h
+	}
+	return snap, nil
+}
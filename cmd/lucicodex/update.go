@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/update"
+)
+
+// executablePath is the binary replaced by self-update; tests point it elsewhere.
+var executablePath = func() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// runSelfUpdate implements `lucicodex self-update [check|rollback]`.
+func runSelfUpdate(cfg config.Config, args []string, stdout, stderr io.Writer) int {
+	sub := ""
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	if sub != "" && sub != "check" && sub != "rollback" {
+		fmt.Fprintf(stderr, "Usage: lucicodex self-update [check|rollback]\n")
+		return errcode.InvalidRequest.ExitCode()
+	}
+	exe, err := executablePath()
+	if err != nil {
+		fmt.Fprintf(stderr, "Cannot locate the lucicodex binary: %v\n", err)
+		return 1
+	}
+	if sub == "rollback" {
+		if err := update.Rollback(exe); err != nil {
+			fmt.Fprintf(stderr, "Rollback failed: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "Restored the previous binary; restart the lucicodex service to use it\n")
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}
+	m, err := update.Check(ctx, client, cfg.UpdateURL)
+	if err != nil {
+		fmt.Fprintf(stderr, "Update check failed: %v\n", err)
+		return 1
+	}
+	if !update.Newer(m.Version, version) {
+		fmt.Fprintf(stdout, "LuciCodex %s is up to date (latest release: %s)\n", version, m.Version)
+		return 0
+	}
+	if sub == "check" {
+		fmt.Fprintf(stdout, "LuciCodex %s is available (installed: %s, platform: %s)\n", m.Version, version, update.Platform())
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "Updating LuciCodex %s -> %s (%s)...\n", version, m.Version, update.Platform())
+	if err := update.Install(ctx, client, cfg.UpdateURL, m, exe); err != nil {
+		fmt.Fprintf(stderr, "Update failed: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "Installed %s; the previous binary is kept as %s (lucicodex self-update rollback)\n", m.Version, exe+update.PrevSuffix)
+	fmt.Fprintf(stdout, "Restart the lucicodex service to use the new version\n")
+	return 0
+}
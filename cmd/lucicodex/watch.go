@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/llm"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+	"github.com/aezizhu/LuciCodex/internal/watch"
+)
+
+// watchRounds limits how many times `lucicodex watch` runs its probes; 0 runs
+// until interrupted. Tests set it to stop the loop.
+var watchRounds = 0
+
+// runWatch implements `lucicodex watch <request>`: the model compiles the
+// request into read-only probes, which are run every watch_interval seconds
+// until interrupted. Alerts go to stdout and to the configured webhooks.
+func runWatch(cfg config.Config, request string, jsonOutput bool, stdout, stderr io.Writer) int {
+	llmTimeout := cfg.TimeoutSeconds
+	if llmTimeout < 60 {
+		llmTimeout = 60
+	}
+	planCtx, cancel := context.WithTimeout(context.Background(), time.Duration(llmTimeout)*time.Second)
+	defer cancel()
+	fullPrompt := prompts.GenerateWatchPrompt(cfg.MaxCommands) + "\n\nMonitoring request: " + request
+	p, err := llm.NewProvider(cfg).GeneratePlan(planCtx, fullPrompt)
+	if err != nil {
+		return fail(errcode.Of(err), "LLM error: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+	// Probes are independent reads, so extra ones can be dropped
+	if p, err = policy.Truncate(p, cfg.MaxCommands); err != nil {
+		return fail(errcode.Of(err), "Unusable watch plan: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+	if err := watch.Validate(p); err != nil {
+		return fail(errcode.LLMBadResponse, "Unusable watch plan: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+	if err := policy.New(cfg).ValidatePlan(p); err != nil {
+		return fail(errcode.PolicyDeny, "Watch plan rejected by policy: "+err.Error(), jsonOutput, stdout, stderr)
+	}
+
+	interval := time.Duration(cfg.WatchInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if !jsonOutput {
+		if p.Summary != "" {
+			fmt.Fprintf(stdout, "%s\n", p.Summary)
+		}
+		fmt.Fprintf(stdout, "Watching %d probe(s) every %s (Ctrl-C to stop):\n", len(p.Commands), interval)
+		for i, c := range p.Commands {
+			fmt.Fprintf(stdout, "  %d. %s\n      alert: %s\n", i, executor.FormatPlanned(c), c.Alert.Message)
+		}
+	}
+
+	notifiers := []watch.Notifier{watch.WriterNotifier{W: stdout, JSON: jsonOutput}}
+	for _, u := range cfg.WatchWebhooks {
+		notifiers = append(notifiers, watch.Webhook{URL: u})
+	}
+	w := &watch.Watcher{
+		Probes:    p.Commands,
+		Exec:      executor.New(cfg).RunCommand,
+		Notifiers: notifiers,
+		Interval:  interval,
+		OnError:   func(err error) { fmt.Fprintf(stderr, "watch: %v\n", err) },
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	w.Run(ctx, watchRounds)
+	return 0
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// runOptimizeWifi implements `lucicodex optimize-wifi`: the neighboring
+// access points and the clients' signal strengths are surveyed, and the
+// model proposes channel, tx power and band steering settings as a plan
+// that is reviewed and run like any other. Moves to DFS channels carry a
+// policy warning.
+func runOptimizeWifi(e *env, o runOptions) int {
+	v := e.verbosity
+	if e.jsonOutput && v == ui.Normal {
+		v = ui.Quiet
+	}
+	v.Logf(ui.Normal, e.stderr, "Scanning wireless networks...\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	survey := openwrt.CollectWirelessSurvey(ctx)
+	cancel()
+	if len(survey.Radios) == 0 {
+		return fail(errcode.NotFound, "No wireless interfaces found (is iwinfo installed?)", e.jsonOutput, e.stdout, e.stderr)
+	}
+	v.Logf(ui.Verbose, e.stderr, "Survey: %d radio(s), %d neighboring access point(s)\n", len(survey.Radios), len(survey.Neighbors))
+
+	o.extra = "\n\n" + survey.PromptBlock()
+	if survey.Config != "" {
+		o.extra += "\n\nCurrent wireless configuration:\n" + prompts.FenceOutput(survey.Config) + "\n" + prompts.UntrustedNotice
+	}
+	return runPrompt(e, o, []string{prompts.WifiOptimizeRequest})
+}
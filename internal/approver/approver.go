@@ -0,0 +1,100 @@
+// Package approver asks an external command to approve a plan
+// (approval_command), so executions can be approved out of band, e.g.
+// through a push notification app or a chat bot, when nobody sits at the
+// prompt.
+package approver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/procgroup"
+)
+
+// DefaultTimeout applies when approval_timeout is unset.
+const DefaultTimeout = 5 * time.Minute
+
+// maxReason bounds the command output quoted in a rejection.
+const maxReason = 200
+
+// Request is what the approval command reads on stdin.
+type Request struct {
+	Source string `json:"source"`           // "cli", "repl", "daemon" or "mcp"
+	Client string `json:"client,omitempty"` // Remote address or MCP client, for the daemon
+	// Who asked the daemon, as recorded in the audit log: the API token,
+	// and the client's User-Agent, LuCI session hint and device fingerprint
+	Actor     string    `json:"actor,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Session   string    `json:"session,omitempty"`
+	Device    string    `json:"device,omitempty"`
+	Host      string    `json:"host"` // Router hostname
+	Prompt    string    `json:"prompt"`
+	Plan      plan.Plan `json:"plan"`
+}
+
+// Enabled reports whether cfg has an approval command.
+func Enabled(cfg config.Config) bool {
+	return strings.TrimSpace(cfg.ApprovalCommand) != ""
+}
+
+// Ask runs the approval command with req and returns nil if it exits with
+// status 0. Any other outcome, including a command that cannot run or does
+// not answer within approval_timeout, is an errcode.ApprovalDenied error
+// quoting the start of its output.
+func Ask(ctx context.Context, cfg config.Config, req Request) error {
+	argv := strings.Fields(cfg.ApprovalCommand)
+	if len(argv) == 0 {
+		return errcode.Errorf(errcode.ApprovalDenied, "no approval_command configured")
+	}
+	if req.Host == "" {
+		req.Host, _ = os.Hostname()
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errcode.Wrap(errcode.Internal, err)
+	}
+
+	timeout := DefaultTimeout
+	if cfg.ApprovalTimeout > 0 {
+		timeout = time.Duration(cfg.ApprovalTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// The script's children die with it, so they cannot keep the output open
+	cmd := procgroup.KillOnCancel(exec.CommandContext(ctx, argv[0], argv[1:]...))
+	cmd.Stdin = bytes.NewReader(body)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return errcode.Errorf(errcode.ApprovalDenied, "approval command gave no answer within %s", timeout)
+	}
+	msg := "approval command rejected the plan (" + err.Error() + ")"
+	if reason := reasonOf(out.String()); reason != "" {
+		msg += ": " + reason
+	}
+	return errcode.Wrap(errcode.ApprovalDenied, errors.New(msg))
+}
+
+// reasonOf returns the first line of the command's output, shortened.
+func reasonOf(out string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	if len(line) > maxReason {
+		line = line[:maxReason] + "..."
+	}
+	return strings.TrimSpace(line)
+}
@@ -0,0 +1,60 @@
+package approver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// script writes a shell script to a temporary directory and returns the
+// approval_command running it.
+func script(t *testing.T, body string) string {
+	path := filepath.Join(t.TempDir(), "approve.sh")
+	if err := os.WriteFile(path, []byte(body), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return "sh " + path
+}
+
+func TestAsk(t *testing.T) {
+	got := filepath.Join(t.TempDir(), "request.json")
+	req := Request{Source: "cli", Prompt: "restart wifi", Plan: plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}}}
+
+	cfg := config.Config{ApprovalCommand: script(t, fmt.Sprintf("cat > %s\n", got))}
+	if !Enabled(cfg) || Enabled(config.Config{ApprovalCommand: " "}) {
+		t.Fatal("unexpected Enabled")
+	}
+	if err := Ask(context.Background(), cfg, req); err != nil {
+		t.Fatalf("expected approval, got %v", err)
+	}
+	data, _ := os.ReadFile(got)
+	var sent Request
+	if err := json.Unmarshal(data, &sent); err != nil || sent.Prompt != "restart wifi" || sent.Plan.Commands[0].Command[0] != "wifi" || sent.Host == "" {
+		t.Errorf("unexpected request %s (%v)", data, err)
+	}
+
+	cfg.ApprovalCommand = script(t, "echo 'denied from Telegram'\nexit 1\n")
+	err := Ask(context.Background(), cfg, req)
+	if errcode.Of(err) != errcode.ApprovalDenied || !strings.Contains(err.Error(), "denied from Telegram") {
+		t.Errorf("expected a denial quoting the output, got %v", err)
+	}
+
+	cfg.ApprovalCommand = script(t, "sleep 5\n")
+	cfg.ApprovalTimeout = 1
+	if err := Ask(context.Background(), cfg, req); errcode.Of(err) != errcode.ApprovalDenied || !strings.Contains(err.Error(), "no answer") {
+		t.Errorf("expected a timeout denial, got %v", err)
+	}
+
+	cfg.ApprovalCommand = "/nonexistent/approve"
+	if err := Ask(context.Background(), cfg, req); errcode.Of(err) != errcode.ApprovalDenied {
+		t.Errorf("a command that cannot run must deny, got %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+// Package artifacts gives every execution a directory for the files its
+// commands produce (backups, captures, reports). Commands run with it as
+// their working directory and find its path in $LUCICODEX_ARTIFACTS. Old
+// directories are removed by age and total size.
+package artifacts
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultDir is the default artifacts_dir (tmpfs on OpenWrt).
+const DefaultDir = "/tmp/lucicodex-artifacts"
+
+// EnvVar is the environment variable holding the artifacts directory of the
+// running execution. It is the only variable besides PATH that commands see.
+const EnvVar = "LUCICODEX_ARTIFACTS"
+
+// ErrNotFound is returned for unknown executions and files.
+var ErrNotFound = errors.New("artifact not found")
+
+// File is a file created by an execution.
+type File struct {
+	Name     string    `json:"name"` // Relative to the execution's directory, with forward slashes
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Store keeps one directory per execution under Dir. Create removes
+// directories older than MaxAge, then the oldest ones until the total size is
+// at most MaxBytes; zero disables either limit.
+type Store struct {
+	Dir      string
+	MaxBytes int64
+	MaxAge   time.Duration
+}
+
+// NewStore returns a store limited to maxMB megabytes and retentionDays
+// days, or nil if dir is empty, which disables artifacts.
+func NewStore(dir string, maxMB, retentionDays int) *Store {
+	if dir == "" {
+		return nil
+	}
+	return &Store{Dir: dir, MaxBytes: int64(maxMB) << 20, MaxAge: time.Duration(retentionDays) * 24 * time.Hour}
+}
+
+// NewID returns an execution ID that sorts by creation time.
+func NewID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
+
+// validID rejects IDs that could escape Dir.
+func validID(id string) bool {
+	if id == "" || id == "." || id == ".." {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Path returns the directory of execution id.
+func (s *Store) Path(id string) string { return filepath.Join(s.Dir, id) }
+
+// Create garbage-collects the store and makes the directory of execution id.
+func (s *Store) Create(id string) (string, error) {
+	if !validID(id) {
+		return "", errors.New("invalid execution ID " + id)
+	}
+	if _, err := s.GC(); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	dir := s.Path(id)
+	return dir, os.MkdirAll(dir, 0o700)
+}
+
+// List returns the files of execution id sorted by name.
+func (s *Store) List(id string) ([]File, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	root := s.Path(id)
+	if st, err := os.Stat(root); err != nil || !st.IsDir() {
+		return nil, ErrNotFound
+	}
+	files := []File{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		files = append(files, File{Name: filepath.ToSlash(rel), Size: info.Size(), Modified: info.ModTime().UTC()})
+		return nil
+	})
+	return files, err
+}
+
+// Open opens file name of execution id for reading. Names that leave the
+// execution's directory and anything but regular files are not found.
+func (s *Store) Open(id, name string) (*os.File, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if !validID(id) || name == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return nil, ErrNotFound
+	}
+	path := filepath.Join(s.Path(id), clean)
+	// Lstat: a command may have left a symlink pointing anywhere
+	if st, err := os.Lstat(path); err != nil || !st.Mode().IsRegular() {
+		return nil, ErrNotFound
+	}
+	return os.Open(path)
+}
+
+// GC removes expired execution directories, then the oldest ones while the
+// store exceeds MaxBytes. It returns the removed IDs.
+func (s *Store) GC() ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	type execDir struct {
+		id   string
+		mod  time.Time
+		size int64
+	}
+	var dirs []execDir
+	var total int64
+	for _, e := range entries {
+		if !e.IsDir() || !validID(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		d := execDir{id: e.Name(), mod: info.ModTime(), size: dirSize(s.Path(e.Name()))}
+		dirs = append(dirs, d)
+		total += d.size
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].mod.Before(dirs[j].mod) })
+
+	var removed []string
+	for _, d := range dirs {
+		expired := s.MaxAge > 0 && time.Since(d.mod) > s.MaxAge
+		if !expired && (s.MaxBytes <= 0 || total <= s.MaxBytes) {
+			continue
+		}
+		if err := os.RemoveAll(s.Path(d.id)); err != nil {
+			return removed, err
+		}
+		total -= d.size
+		removed = append(removed, d.id)
+	}
+	return removed, nil
+}
+
+func dirSize(dir string) int64 {
+	var n int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				n += info.Size()
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+// Snapshot records the size and modification time of every file in dir, to
+// be compared with Changed after a command ran.
+func Snapshot(dir string) map[string]File {
+	snap := map[string]File{}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				rel, _ := filepath.Rel(dir, path)
+				snap[filepath.ToSlash(rel)] = File{Size: info.Size(), Modified: info.ModTime()}
+			}
+		}
+		return nil
+	})
+	return snap
+}
+
+// Changed returns the files in dir that were created or modified since
+// before was taken, sorted by name.
+func Changed(before map[string]File, dir string) []string {
+	var names []string
+	for name, f := range Snapshot(dir) {
+		if old, ok := before[name]; !ok || old.Size != f.Size || !old.Modified.Equal(f.Modified) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,89 @@
+package artifacts
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore_CreateListOpen(t *testing.T) {
+	s := NewStore(t.TempDir(), 1, 7)
+	id := NewID()
+	dir, err := s.Create(id)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	os.MkdirAll(filepath.Join(dir, "logs"), 0o700)
+	os.WriteFile(filepath.Join(dir, "backup.tar.gz"), []byte("backup"), 0o600)
+	os.WriteFile(filepath.Join(dir, "logs", "system.log"), []byte("log"), 0o600)
+	os.Symlink("/etc/passwd", filepath.Join(dir, "passwd"))
+
+	files, err := s.List(id)
+	if err != nil || len(files) != 2 || files[0].Name != "backup.tar.gz" || files[0].Size != 6 || files[1].Name != "logs/system.log" {
+		t.Fatalf("List = %+v, %v", files, err)
+	}
+
+	f, err := s.Open(id, "logs/system.log")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	b, _ := io.ReadAll(f)
+	f.Close()
+	if string(b) != "log" {
+		t.Errorf("unexpected content %q", b)
+	}
+	for _, name := range []string{"../x", "/etc/passwd", "passwd", "logs", "", "missing"} {
+		if _, err := s.Open(id, name); err != ErrNotFound {
+			t.Errorf("Open(%q) = %v, want ErrNotFound", name, err)
+		}
+	}
+	if _, err := s.List("../.."); err != ErrNotFound {
+		t.Errorf("List with traversal = %v", err)
+	}
+	if _, err := s.Create("a/b"); err == nil {
+		t.Error("Create accepted an invalid ID")
+	}
+	if NewStore("", 1, 1) != nil {
+		t.Error("empty dir should disable the store")
+	}
+}
+
+func TestStore_GC(t *testing.T) {
+	s := &Store{Dir: t.TempDir(), MaxBytes: 1500, MaxAge: 24 * time.Hour}
+	mk := func(id string, size int, age time.Duration) {
+		dir := s.Path(id)
+		os.MkdirAll(dir, 0o700)
+		os.WriteFile(filepath.Join(dir, "f"), make([]byte, size), 0o600)
+		when := time.Now().Add(-age)
+		os.Chtimes(dir, when, when)
+	}
+	mk("expired", 10, 48*time.Hour)
+	mk("old", 1000, 3*time.Hour)
+	mk("new", 1000, time.Hour)
+
+	removed, err := s.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(removed, ",") != "expired,old" {
+		t.Fatalf("removed %v", removed)
+	}
+	if _, err := os.Stat(s.Path("new")); err != nil {
+		t.Errorf("newest directory removed: %v", err)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "kept"), []byte("a"), 0o600)
+	os.WriteFile(filepath.Join(dir, "edited"), []byte("a"), 0o600)
+	before := Snapshot(dir)
+	os.WriteFile(filepath.Join(dir, "edited"), []byte("ab"), 0o600)
+	os.WriteFile(filepath.Join(dir, "new"), []byte("a"), 0o600)
+	if got := strings.Join(Changed(before, dir), ","); got != "edited,new" {
+		t.Errorf("Changed = %s", got)
+	}
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/storage"
+)
+
+// Role is the access level of a daemon API token. Each role includes the
+// permissions of the roles below it.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // Plan, summarize, read history, facts and jobs
+	RoleOperator Role = "operator" // Execute plans, confirm changes, stop jobs, MCP tools
+	RoleAdmin    Role = "admin"    // Manage API tokens
+)
+
+var roleRank = map[Role]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// ParseRole validates a role name.
+func ParseRole(s string) (Role, error) {
+	r := Role(s)
+	if roleRank[r] == 0 {
+		return "", fmt.Errorf("unknown role %q (want viewer, operator or admin)", s)
+	}
+	return r, nil
+}
+
+// Allows reports whether r grants the permissions of required.
+func (r Role) Allows(required Role) bool {
+	return roleRank[r] > 0 && roleRank[r] >= roleRank[required]
+}
+
+// APIToken is a named daemon API token. Only a hash of the secret is stored;
+// the secret itself is shown once, when the token is created.
+type APIToken struct {
+	Name    string    `json:"name"`
+	Role    Role      `json:"role"`
+	Hash    string    `json:"hash"` // Hex SHA-256 of the secret
+	Created time.Time `json:"created"`
+}
+
+// ErrTokenExists is returned by Create for a name already in use.
+var ErrTokenExists = errors.New("a token with this name already exists")
+
+// APITokenStore keeps the daemon's API tokens and their roles in a JSON
+// document shared by the daemon and `lucicodex token`. Lookup rereads the
+// document, so tokens added or removed from the CLI apply without a daemon
+// restart.
+type APITokenStore struct {
+	path string
+	st   storage.Store
+	key  string
+
+	mu     sync.Mutex
+	tokens []APIToken
+}
+
+// NewAPITokenStore returns a store backed by the file at path.
+func NewAPITokenStore(path string) *APITokenStore {
+	return &APITokenStore{path: path, st: storage.NewFileStore(filepath.Dir(path)), key: filepath.Base(path)}
+}
+
+// OpenAPITokenStore returns the store of cfg.APITokensFile on the
+// configured storage backend.
+func OpenAPITokenStore(cfg config.Config) *APITokenStore {
+	path := cfg.APITokensFile
+	return &APITokenStore{path: path, st: storage.Open(cfg, filepath.Dir(path)), key: filepath.Base(path)}
+}
+
+// Path returns the file backing the store; with the sqlite backend, the
+// name the tokens are kept under.
+func (s *APITokenStore) Path() string { return s.path }
+
+// Load reads the store. A missing document is an empty store.
+func (s *APITokenStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadLocked()
+}
+
+func (s *APITokenStore) loadLocked() error {
+	var tokens []APIToken
+	if err := s.st.Get("", s.key, &tokens); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("load api tokens: %w", err)
+	}
+	s.tokens = tokens
+	return nil
+}
+
+// Save writes the store with mode 0600.
+func (s *APITokenStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := s.tokens
+	if tokens == nil {
+		tokens = []APIToken{}
+	}
+	return s.st.Put("", s.key, tokens)
+}
+
+// List returns the tokens in creation order.
+func (s *APITokenStore) List() []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]APIToken(nil), s.tokens...)
+}
+
+// Create adds a token and returns its secret. Call Save to persist it.
+func (s *APITokenStore) Create(name string, role Role) (string, error) {
+	if !validTokenName(name) {
+		return "", fmt.Errorf("invalid token name %q (use letters, digits, '-', '_' and '.')", name)
+	}
+	if _, err := ParseRole(string(role)); err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if t.Name == name {
+			return "", ErrTokenExists
+		}
+	}
+	s.tokens = append(s.tokens, APIToken{Name: name, Role: role, Hash: hashToken(secret), Created: time.Now().UTC()})
+	return secret, nil
+}
+
+// Delete removes the named token and reports whether it existed. Call Save
+// to persist the change.
+func (s *APITokenStore) Delete(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.tokens {
+		if t.Name == name {
+			s.tokens = append(s.tokens[:i:i], s.tokens[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the token whose secret is secret, rereading the store
+// first. A store that cannot be read matches no token.
+func (s *APITokenStore) Lookup(secret string) (APIToken, bool) {
+	if secret == "" {
+		return APIToken{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadLocked(); err != nil {
+		s.tokens = nil
+	}
+	h := []byte(hashToken(secret))
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(h, []byte(t.Hash)) == 1 {
+			return t, true
+		}
+	}
+	return APIToken{}, false
+}
+
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func validTokenName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
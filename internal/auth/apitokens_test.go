@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRole_Allows(t *testing.T) {
+	cases := []struct {
+		have, want Role
+		ok         bool
+	}{
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleOperator, false},
+		{RoleOperator, RoleViewer, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleAdmin, RoleOperator, true},
+		{Role("root"), RoleViewer, false},
+	}
+	for _, c := range cases {
+		if got := c.have.Allows(c.want); got != c.ok {
+			t.Errorf("%s.Allows(%s) = %v, want %v", c.have, c.want, got, c.ok)
+		}
+	}
+	if _, err := ParseRole("superuser"); err == nil {
+		t.Error("expected unknown role to be rejected")
+	}
+}
+
+func TestAPITokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api_tokens.json")
+	store := NewAPITokenStore(path)
+	if err := store.Load(); err != nil {
+		t.Fatalf("missing file should load as empty: %v", err)
+	}
+
+	secret, err := store.Create("dashboard", RoleViewer)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := store.Create("dashboard", RoleAdmin); !errors.Is(err, ErrTokenExists) {
+		t.Errorf("expected ErrTokenExists, got %v", err)
+	}
+	if _, err := store.Create("bad name", RoleViewer); err == nil {
+		t.Error("expected invalid name to be rejected")
+	}
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), secret) {
+		t.Error("secret stored in plain text")
+	}
+	if st, _ := os.Stat(path); st.Mode().Perm() != 0o600 {
+		t.Errorf("expected mode 0600, got %v", st.Mode().Perm())
+	}
+
+	// A second store, like the daemon, sees the token
+	daemon := NewAPITokenStore(path)
+	if tok, ok := daemon.Lookup(secret); !ok || tok.Name != "dashboard" || tok.Role != RoleViewer {
+		t.Fatalf("Lookup failed: %+v %v", tok, ok)
+	}
+	if _, ok := daemon.Lookup("wrong"); ok {
+		t.Error("wrong secret accepted")
+	}
+
+	// Removal by the CLI applies to the daemon's next lookup
+	store.Delete("dashboard")
+	time.Sleep(10 * time.Millisecond)
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	if _, ok := daemon.Lookup(secret); ok {
+		t.Error("deleted token still accepted")
+	}
+}
@@ -0,0 +1,460 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+var (
+	ErrNoClientID      = errors.New("oauth client id not configured (set oauth_client_id)")
+	ErrNoTokenURL      = errors.New("oauth token endpoint not configured (set oauth_token_url)")
+	ErrNoRefreshToken  = errors.New("oauth token expired and no refresh token is stored; run 'lucicodex login' again")
+	ErrNotLoggedIn     = errors.New("no stored oauth token; run 'lucicodex login'")
+	ErrDeviceExpired   = errors.New("device code expired before authorization completed")
+	ErrAccessDenied    = errors.New("authorization was denied")
+	ErrUnsupportedFlow = errors.New("provider has neither a device endpoint nor an authorization endpoint configured")
+)
+
+// refreshSkew refreshes tokens slightly before they expire so a request never
+// starts with a token that dies in flight.
+const refreshSkew = time.Minute
+
+// Expired reports whether the token expires within skew. Tokens without an
+// expiry never expire.
+func (t Token) Expired(skew time.Duration) bool {
+	return !t.Expiry.IsZero() && time.Now().Add(skew).After(t.Expiry)
+}
+
+// OAuthConfig describes an OAuth 2.0 client for one provider.
+type OAuthConfig struct {
+	Provider     string
+	ClientID     string
+	ClientSecret string
+	AuthURL      string // Authorization code + PKCE endpoint
+	TokenURL     string
+	DeviceURL    string // Device authorization endpoint (RFC 8628)
+	Scopes       []string
+}
+
+// KnownEndpoints holds defaults for providers that publish OAuth endpoints.
+// A client id must still be configured.
+var KnownEndpoints = map[string]OAuthConfig{
+	"gemini": {
+		AuthURL:   "https://accounts.google.com/o/oauth2/v2/auth",
+		TokenURL:  "https://oauth2.googleapis.com/token",
+		DeviceURL: "https://oauth2.googleapis.com/device/code",
+		Scopes:    []string{"https://www.googleapis.com/auth/generative-language"},
+	},
+}
+
+// ConfigFor returns the OAuth client for provider, starting from
+// KnownEndpoints and applying any oauth_* overrides from cfg.
+func ConfigFor(cfg config.Config, provider string) OAuthConfig {
+	oc := KnownEndpoints[provider]
+	oc.Provider = provider
+	oc.Scopes = append([]string(nil), oc.Scopes...)
+	if cfg.OAuthClientID != "" {
+		oc.ClientID = cfg.OAuthClientID
+	}
+	if cfg.OAuthClientSecret != "" {
+		oc.ClientSecret = cfg.OAuthClientSecret
+	}
+	if cfg.OAuthAuthURL != "" {
+		oc.AuthURL = cfg.OAuthAuthURL
+	}
+	if cfg.OAuthTokenURL != "" {
+		oc.TokenURL = cfg.OAuthTokenURL
+	}
+	if cfg.OAuthDeviceURL != "" {
+		oc.DeviceURL = cfg.OAuthDeviceURL
+	}
+	if cfg.OAuthScopes != "" {
+		oc.Scopes = strings.Fields(cfg.OAuthScopes)
+	}
+	return oc
+}
+
+// Validate checks that the client can talk to a token endpoint.
+func (c OAuthConfig) Validate() error {
+	if c.ClientID == "" {
+		return ErrNoClientID
+	}
+	if c.TokenURL == "" {
+		return ErrNoTokenURL
+	}
+	if c.DeviceURL == "" && c.AuthURL == "" {
+		return ErrUnsupportedFlow
+	}
+	return nil
+}
+
+// NewPKCE returns a random code verifier and its S256 challenge (RFC 7636).
+func NewPKCE() (verifier, challenge string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generate code verifier: %w", err)
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// NewState returns a random value for the authorization request state parameter.
+func NewState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL builds the browser URL for the authorization code + PKCE flow.
+func (c OAuthConfig) AuthCodeURL(state, challenge, redirectURI string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", c.ClientID)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("state", state)
+	v.Set("code_challenge", challenge)
+	v.Set("code_challenge_method", "S256")
+	v.Set("access_type", "offline")
+	if len(c.Scopes) > 0 {
+		v.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	sep := "?"
+	if strings.Contains(c.AuthURL, "?") {
+		sep = "&"
+	}
+	return c.AuthURL + sep + v.Encode()
+}
+
+// Exchange trades an authorization code and its PKCE verifier for a token.
+func (c OAuthConfig) Exchange(ctx context.Context, hc *http.Client, code, verifier, redirectURI string) (Token, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("code_verifier", verifier)
+	v.Set("redirect_uri", redirectURI)
+	return c.postToken(ctx, hc, v)
+}
+
+// DeviceCode is the device authorization response (RFC 8628 section 3.2).
+type DeviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURL         string `json:"verification_url"` // Google spelling
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// URI returns the page the user should open to enter the code.
+func (d DeviceCode) URI() string {
+	if d.VerificationURI != "" {
+		return d.VerificationURI
+	}
+	return d.VerificationURL
+}
+
+// StartDevice requests a device and user code.
+func (c OAuthConfig) StartDevice(ctx context.Context, hc *http.Client) (DeviceCode, error) {
+	var dc DeviceCode
+	v := url.Values{}
+	v.Set("client_id", c.ClientID)
+	if len(c.Scopes) > 0 {
+		v.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.DeviceURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return dc, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return dc, fmt.Errorf("device authorization request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return dc, parseOAuthError(resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, &dc); err != nil {
+		return dc, fmt.Errorf("decode device authorization response: %w", err)
+	}
+	if dc.DeviceCode == "" || dc.UserCode == "" {
+		return dc, errors.New("device authorization response missing device_code or user_code")
+	}
+	return dc, nil
+}
+
+// devicePollInterval is used when the server does not specify an interval.
+var devicePollInterval = 5 * time.Second
+
+// PollDevice polls the token endpoint until the user approves or denies the
+// device, the device code expires, or ctx is done.
+func (c OAuthConfig) PollDevice(ctx context.Context, hc *http.Client, dc DeviceCode) (Token, error) {
+	interval := time.Duration(dc.Interval) * time.Second
+	if interval <= 0 {
+		interval = devicePollInterval
+	}
+	if dc.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(dc.ExpiresIn)*time.Second)
+		defer cancel()
+	}
+	v := url.Values{}
+	v.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+	v.Set("device_code", dc.DeviceCode)
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return Token{}, ErrDeviceExpired
+			}
+			return Token{}, ctx.Err()
+		case <-time.After(interval):
+		}
+		tok, err := c.postToken(ctx, hc, v)
+		if err == nil {
+			return tok, nil
+		}
+		var oe *OAuthError
+		if !errors.As(err, &oe) {
+			return Token{}, err
+		}
+		switch oe.Code {
+		case "authorization_pending":
+		case "slow_down":
+			interval += devicePollInterval
+		case "access_denied":
+			return Token{}, ErrAccessDenied
+		case "expired_token":
+			return Token{}, ErrDeviceExpired
+		default:
+			return Token{}, err
+		}
+	}
+}
+
+// Refresh exchanges t's refresh token for a new access token. The refresh
+// token is carried over when the server does not rotate it.
+func (c OAuthConfig) Refresh(ctx context.Context, hc *http.Client, t Token) (Token, error) {
+	if t.RefreshToken == "" {
+		return Token{}, ErrNoRefreshToken
+	}
+	if c.TokenURL == "" {
+		return Token{}, ErrNoTokenURL
+	}
+	v := url.Values{}
+	v.Set("grant_type", "refresh_token")
+	v.Set("refresh_token", t.RefreshToken)
+	nt, err := c.postToken(ctx, hc, v)
+	if err != nil {
+		return Token{}, err
+	}
+	if nt.RefreshToken == "" {
+		nt.RefreshToken = t.RefreshToken
+	}
+	return nt, nil
+}
+
+// OAuthError is an error response from a token or device endpoint (RFC 6749 5.2).
+type OAuthError struct {
+	Status      int
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("oauth error %s: %s", e.Code, e.Description)
+	}
+	if e.Code != "" {
+		return "oauth error " + e.Code
+	}
+	return fmt.Sprintf("oauth endpoint returned status %d", e.Status)
+}
+
+func parseOAuthError(status int, body []byte) error {
+	var r struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	_ = json.Unmarshal(body, &r)
+	return &OAuthError{Status: status, Code: r.Error, Description: r.ErrorDescription}
+}
+
+func (c OAuthConfig) postToken(ctx context.Context, hc *http.Client, v url.Values) (Token, error) {
+	v.Set("client_id", c.ClientID)
+	if c.ClientSecret != "" {
+		v.Set("client_secret", c.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return Token{}, fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var r struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		Scope        string `json:"scope"`
+		Error        string `json:"error"`
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return Token{}, parseOAuthError(resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return Token{}, fmt.Errorf("decode token response: %w", err)
+	}
+	// Some servers report errors with a 200 status
+	if r.Error != "" {
+		return Token{}, parseOAuthError(resp.StatusCode, body)
+	}
+	if r.AccessToken == "" {
+		return Token{}, errors.New("token response missing access_token")
+	}
+	t := Token{
+		Provider:     c.Provider,
+		AccessToken:  r.AccessToken,
+		RefreshToken: r.RefreshToken,
+		TokenType:    r.TokenType,
+		Scope:        r.Scope,
+	}
+	if r.ExpiresIn > 0 {
+		t.Expiry = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	}
+	return t, nil
+}
+
+// TokenSource hands out a provider's stored token, refreshing and persisting
+// it when it is about to expire.
+type TokenSource struct {
+	cfg    OAuthConfig
+	store  *Store
+	client *http.Client
+	mu     sync.Mutex
+}
+
+// NewTokenSource returns a TokenSource backed by store. hc is used for refresh
+// requests and must not itself be wrapped by a Transport using this source.
+func NewTokenSource(cfg OAuthConfig, store *Store, hc *http.Client) *TokenSource {
+	if hc == nil {
+		hc = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &TokenSource{cfg: cfg, store: store, client: hc}
+}
+
+// Token returns a valid access token, refreshing it first if it has expired.
+func (s *TokenSource) Token(ctx context.Context) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.store.Get(s.cfg.Provider)
+	if !ok {
+		return Token{}, ErrNotLoggedIn
+	}
+	if !t.Expired(refreshSkew) {
+		return t, nil
+	}
+	return s.refreshLocked(ctx, t)
+}
+
+// Refresh forces a refresh, e.g. after the provider rejected the token with 401.
+func (s *TokenSource) Refresh(ctx context.Context) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.store.Get(s.cfg.Provider)
+	if !ok {
+		return Token{}, ErrNotLoggedIn
+	}
+	return s.refreshLocked(ctx, t)
+}
+
+func (s *TokenSource) refreshLocked(ctx context.Context, t Token) (Token, error) {
+	nt, err := s.cfg.Refresh(ctx, s.client, t)
+	if err != nil {
+		return Token{}, fmt.Errorf("refresh %s token: %w", s.cfg.Provider, err)
+	}
+	nt.Provider = s.cfg.Provider
+	s.store.Put(nt)
+	// A failed save only means the next process refreshes again
+	_ = s.store.Save()
+	return nt, nil
+}
+
+// Transport is an http.RoundTripper that authorizes requests with a
+// TokenSource. A 401 response triggers one refresh and retry.
+type Transport struct {
+	Source *TokenSource
+	Base   http.RoundTripper
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tok, err := t.Source.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base().RoundTrip(authorize(req, tok))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// Only retry when the body can be replayed
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	tok, rerr := t.Source.Refresh(req.Context())
+	if rerr != nil {
+		return resp, nil
+	}
+	retry := authorize(req, tok)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	resp.Body.Close()
+	return t.base().RoundTrip(retry)
+}
+
+func authorize(req *http.Request, tok Token) *http.Request {
+	r := req.Clone(req.Context())
+	typ := tok.TokenType
+	if typ == "" || strings.EqualFold(typ, "bearer") {
+		typ = "Bearer"
+	}
+	r.Header.Set("Authorization", typ+" "+tok.AccessToken)
+	return r
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+func TestNewPKCE(t *testing.T) {
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatalf("NewPKCE failed: %v", err)
+	}
+	if len(verifier) < 43 {
+		t.Errorf("verifier too short: %d", len(verifier))
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if challenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Error("challenge is not the S256 of the verifier")
+	}
+}
+
+func TestConfigFor(t *testing.T) {
+	oc := ConfigFor(config.Config{OAuthClientID: "cid", OAuthScopes: "a b"}, "gemini")
+	if oc.ClientID != "cid" || oc.TokenURL == "" || oc.DeviceURL == "" {
+		t.Errorf("unexpected config: %+v", oc)
+	}
+	if len(oc.Scopes) != 2 {
+		t.Errorf("expected scope override, got %v", oc.Scopes)
+	}
+	if err := ConfigFor(config.Config{}, "openai").Validate(); !errors.Is(err, ErrNoClientID) {
+		t.Errorf("expected ErrNoClientID, got %v", err)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	oc := OAuthConfig{ClientID: "cid", AuthURL: "https://auth.example/authorize", Scopes: []string{"s1"}}
+	u, err := url.Parse(oc.AuthCodeURL("st", "ch", "http://127.0.0.1:1/callback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge") != "ch" || q.Get("code_challenge_method") != "S256" || q.Get("state") != "st" || q.Get("client_id") != "cid" {
+		t.Errorf("unexpected query: %v", q)
+	}
+}
+
+func TestDeviceFlow(t *testing.T) {
+	old := devicePollInterval
+	devicePollInterval = 10 * time.Millisecond
+	defer func() { devicePollInterval = old }()
+
+	var polls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/device":
+			fmt.Fprint(w, `{"device_code":"dev","user_code":"ABCD","verification_url":"https://example/device","expires_in":60}`)
+		case "/token":
+			if r.Form.Get("device_code") != "dev" {
+				t.Errorf("unexpected device_code %q", r.Form.Get("device_code"))
+			}
+			if atomic.AddInt32(&polls, 1) < 3 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":"authorization_pending"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"at","refresh_token":"rt","expires_in":3600,"token_type":"Bearer"}`)
+		}
+	}))
+	defer srv.Close()
+
+	oc := OAuthConfig{Provider: "gemini", ClientID: "cid", TokenURL: srv.URL + "/token", DeviceURL: srv.URL + "/device"}
+	dc, err := oc.StartDevice(context.Background(), srv.Client())
+	if err != nil {
+		t.Fatalf("StartDevice failed: %v", err)
+	}
+	if dc.URI() != "https://example/device" || dc.UserCode != "ABCD" {
+		t.Errorf("unexpected device code: %+v", dc)
+	}
+	tok, err := oc.PollDevice(context.Background(), srv.Client(), dc)
+	if err != nil {
+		t.Fatalf("PollDevice failed: %v", err)
+	}
+	if tok.AccessToken != "at" || tok.RefreshToken != "rt" || tok.Provider != "gemini" || tok.Expired(0) {
+		t.Errorf("unexpected token: %+v", tok)
+	}
+	if polls != 3 {
+		t.Errorf("expected 3 polls, got %d", polls)
+	}
+}
+
+func TestDeviceFlow_Denied(t *testing.T) {
+	old := devicePollInterval
+	devicePollInterval = 10 * time.Millisecond
+	defer func() { devicePollInterval = old }()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"access_denied"}`)
+	}))
+	defer srv.Close()
+
+	oc := OAuthConfig{ClientID: "cid", TokenURL: srv.URL}
+	_, err := oc.PollDevice(context.Background(), srv.Client(), DeviceCode{DeviceCode: "dev"})
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("expected ErrAccessDenied, got %v", err)
+	}
+}
+
+func TestTokenSource_RefreshesExpired(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "rt" {
+			t.Errorf("unexpected refresh form: %v", r.Form)
+		}
+		fmt.Fprint(w, `{"access_token":"new","expires_in":3600}`)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store := NewStore(path)
+	store.Put(Token{Provider: "p", AccessToken: "old", RefreshToken: "rt", Expiry: time.Now().Add(-time.Hour)})
+
+	src := NewTokenSource(OAuthConfig{Provider: "p", ClientID: "cid", TokenURL: srv.URL}, store, srv.Client())
+	tok, err := src.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if tok.AccessToken != "new" || tok.RefreshToken != "rt" {
+		t.Errorf("unexpected token: %+v", tok)
+	}
+
+	// The refreshed token is persisted
+	reloaded := NewStore(path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reloaded.Get("p"); got.AccessToken != "new" {
+		t.Errorf("expected refreshed token on disk, got %+v", got)
+	}
+}
+
+func TestTransport_RetriesOn401(t *testing.T) {
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"fresh","expires_in":3600}`)
+	}))
+	defer tokenSrv.Close()
+
+	var calls int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("expected replayed body, got %q", body)
+		}
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer api.Close()
+
+	store := NewStore(filepath.Join(t.TempDir(), "tokens.json"))
+	store.Put(Token{Provider: "p", AccessToken: "revoked", RefreshToken: "rt"})
+	src := NewTokenSource(OAuthConfig{Provider: "p", ClientID: "cid", TokenURL: tokenSrv.URL}, store, tokenSrv.Client())
+	hc := &http.Client{Transport: &Transport{Source: src}}
+
+	resp, err := hc.Post(api.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 after refresh, got %d", resp.StatusCode)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
@@ -0,0 +1,147 @@
+// Package cmdref is a compact reference of the OpenWrt commands plans use
+// most: their usage, shown to the model for matching requests (see
+// prompts.SelectCommands), and their subcommands and flags, which the plan
+// linter checks before anything runs.
+package cmdref
+
+import (
+	_ "embed"
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+// Tool describes one command.
+type Tool struct {
+	Name string `json:"name"`
+	// Subcommands is every subcommand the tool accepts as its first
+	// argument; nil leaves them unchecked
+	Subcommands []string `json:"subcommands,omitempty"`
+	// Flags and ValueFlags, which take the next argument as their value,
+	// are every flag the tool accepts; without either flags are unchecked
+	Flags      []string `json:"flags,omitempty"`
+	ValueFlags []string `json:"value_flags,omitempty"`
+	// OptionsFirst tools take flags only before the subcommand
+	OptionsFirst bool      `json:"options_first,omitempty"`
+	Snippets     []Snippet `json:"snippets"`
+}
+
+// Snippet is a usage line of a tool with a short explanation.
+type Snippet struct {
+	Tool     string   `json:"-"`
+	Usage    string   `json:"usage"`
+	Text     string   `json:"text"`
+	Keywords []string `json:"keywords"`
+}
+
+//go:embed commands.json
+var commandsJSON []byte
+
+// Tools is the shipped reference.
+var Tools = mustParseTools(commandsJSON)
+
+// Snippets are the snippets of all Tools, in order.
+var Snippets = allSnippets(Tools)
+
+func mustParseTools(data []byte) []Tool {
+	var tools []Tool
+	if err := json.Unmarshal(data, &tools); err != nil {
+		panic("cmdref: invalid commands.json: " + err.Error())
+	}
+	return tools
+}
+
+func allSnippets(tools []Tool) []Snippet {
+	var out []Snippet
+	for _, t := range tools {
+		for _, s := range t.Snippets {
+			s.Tool = t.Name
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Lookup returns the tool run by argv0, which may be a path, or nil.
+func Lookup(argv0 string) *Tool {
+	name := path.Base(argv0)
+	for i := range Tools {
+		if Tools[i].Name == name {
+			return &Tools[i]
+		}
+	}
+	return nil
+}
+
+// Problem is an argument a tool does not accept.
+type Problem struct {
+	Arg        string
+	Subcommand bool // Arg is an unknown subcommand, not an unknown flag
+}
+
+// Check returns the arguments of argv its tool does not accept. Commands of
+// tools not in the reference have none.
+func Check(argv []string) []Problem {
+	if len(argv) == 0 {
+		return nil
+	}
+	t := Lookup(argv[0])
+	if t == nil {
+		return nil
+	}
+	checkFlags := t.Flags != nil || t.ValueFlags != nil
+	var problems []Problem
+	sub := ""
+	for i := 1; i < len(argv); i++ {
+		arg := argv[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			if sub == "" {
+				sub = arg
+				if t.Subcommands != nil && !contains(t.Subcommands, arg) {
+					problems = append(problems, Problem{Arg: arg, Subcommand: true})
+				}
+			}
+			continue
+		}
+		if sub != "" && t.OptionsFirst || !checkFlags {
+			continue
+		}
+		name, _, inline := strings.Cut(arg, "=")
+		switch {
+		case contains(t.ValueFlags, name):
+			if !inline {
+				i++ // Skip the value
+			}
+		case contains(t.Flags, name) || t.shortFlags(arg):
+		default:
+			problems = append(problems, Problem{Arg: arg})
+		}
+	}
+	return problems
+}
+
+// shortFlags reports whether arg combines known single-letter flags, as in
+// -qX.
+func (t *Tool) shortFlags(arg string) bool {
+	if len(arg) < 3 || strings.HasPrefix(arg, "--") {
+		return false
+	}
+	for _, c := range arg[1:] {
+		if !contains(t.Flags, "-"+string(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
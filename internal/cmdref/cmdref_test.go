@@ -0,0 +1,51 @@
+package cmdref
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTools(t *testing.T) {
+	if len(Tools) == 0 || len(Snippets) == 0 {
+		t.Fatal("expected a shipped reference")
+	}
+	for _, s := range Snippets {
+		if s.Tool == "" || s.Usage == "" || s.Text == "" || len(s.Keywords) == 0 {
+			t.Errorf("incomplete snippet %+v", s)
+		}
+	}
+	if tool := Lookup("/sbin/uci"); tool == nil || tool.Name != "uci" {
+		t.Errorf("expected uci by path, got %+v", tool)
+	}
+	if Lookup("busybox") != nil {
+		t.Error("expected no reference for busybox")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		argv []string
+		want []Problem
+	}{
+		{[]string{"uci", "set", "network.lan.ipaddr=192.168.2.1"}, nil},
+		{[]string{"uci", "-q", "get", "wireless.@wifi-iface[-1].ssid"}, nil},
+		{[]string{"uci", "-c", "/tmp/config", "-qX", "show", "network"}, nil},
+		{[]string{"uci", "-z", "show"}, []Problem{{Arg: "-z"}}},
+		{[]string{"uci", "commitall"}, []Problem{{Arg: "commitall", Subcommand: true}}},
+		{[]string{"wifi"}, nil},
+		{[]string{"wifi", "restart"}, []Problem{{Arg: "restart", Subcommand: true}}},
+		{[]string{"/usr/sbin/fw4", "-q", "reload"}, nil},
+		{[]string{"fw4", "status"}, []Problem{{Arg: "status", Subcommand: true}}},
+		{[]string{"opkg", "install", "--force-reinstall", "-d", "ram", "tcpdump"}, nil},
+		{[]string{"opkg", "install", "-y", "tcpdump"}, []Problem{{Arg: "-y"}}},
+		{[]string{"opkg", "--verbosity=2", "update"}, nil},
+		{[]string{"ubus", "call", "network.interface.wan", "status"}, nil},
+		{[]string{"iw", "dev", "wlan0", "station", "dump"}, nil},
+		{[]string{"logread", "-x"}, nil},
+	}
+	for _, tt := range tests {
+		if got := Check(tt.argv); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Check(%q) = %+v, want %+v", tt.argv, got, tt.want)
+		}
+	}
+}
@@ -1,24 +1,30 @@
 package config
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 // Validation errors
 var (
-	ErrInvalidProvider    = errors.New("invalid provider: must be 'gemini', 'openai', or 'anthropic'")
+	ErrInvalidProvider    = errors.New("invalid provider: must be 'gemini', 'openai', 'anthropic' or 'local'")
 	ErrInvalidTimeout     = errors.New("invalid timeout: must be between 1 and 600 seconds")
 	ErrInvalidMaxCommands = errors.New("invalid max_commands: must be between 1 and 100")
 	ErrInvalidMaxRetries  = errors.New("invalid max_retries: must be between 0 and 10")
 	ErrInvalidEndpoint    = errors.New("invalid endpoint: must be a valid URL")
+	ErrInvalidGeneration  = errors.New("invalid generation parameter")
+	ErrInvalidProxy       = errors.New("invalid trusted_proxies entry: must be an IP address, a CIDR or 'unix'")
 )
 
 type Config struct {
@@ -37,20 +43,217 @@ type Config struct {
 	MaxCommands    int      `json:"max_commands"`
 	Allowlist      []string `json:"allowlist"`
 	Denylist       []string `json:"denylist"`
+	Warnlist       []string `json:"warnlist"` // Allowed, but must be acknowledged
+	// PolicyRules are argument-level allow/deny/warn rules (see policy.ParseRule).
+	PolicyRules    []string `json:"policy_rules"`
 	LogFile        string   `json:"log_file"`
 	ElevateCommand string   `json:"elevate_command"`
+	// StrictPrivileges blocks plans whose needs_root claims conflict with the
+	// privilege capability table (see policy.AuditCommand).
+	StrictPrivileges bool `json:"strict_privileges"`
+	// SystemPolicy holds the layers of SystemPolicyDir. It is only read from
+	// there, never from the configuration.
+	SystemPolicy []PolicyLayer `json:"-"`
+	// AutoInstallPackages amends plans that use tools which are not installed
+	// with the opkg commands installing them (see policy.Engine.CheckTools).
+	AutoInstallPackages bool `json:"auto_install_packages"`
+	// ControlGuard protects the interface and firewall zone carrying the
+	// session that requests a plan (see policy.Engine.WithControl):
+	// "confirm" (the default) turns commands taking them down into policy
+	// warnings, "block" denies them and "off" disables the check.
+	ControlGuard string `json:"control_guard"`
+	// APGuard protects what the upstream router owns when the device is a
+	// dumb access point (see policy.Engine.WithTopology): "confirm" (the
+	// default) turns DHCP and firewall changes into policy warnings, "block"
+	// denies them and "off" disables the check.
+	APGuard string `json:"ap_guard"`
+	// FirewallGuard checks the port forwards and rules a plan adds against
+	// those configured (see policy.Engine.WithFirewall): "block" (the
+	// default) denies plans adding a section that duplicates an existing
+	// one or is shadowed by it, "confirm" turns them into policy warnings
+	// and "off" disables the check.
+	FirewallGuard string `json:"firewall_guard"`
+	// LintBlock denies plans with lint findings of this severity or worse
+	// (see policy.LintPlan): "warning" or "error". Empty or "off", the default,
+	// only reports them.
+	LintBlock string `json:"lint_block"`
+	// ApprovalCommand, if set, approves plans instead of the user at the
+	// prompt: it gets the plan as JSON on stdin and exit status 0 approves
+	// it (see internal/approver). The daemon asks it too, after the client.
+	ApprovalCommand string `json:"approval_command"`
+	// Seconds the approval command may take; 0 means 300
+	ApprovalTimeout int `json:"approval_timeout"`
+	// SuggestAlternatives asks the model for another plan avoiding the
+	// denied command when the policy rejects one; it still needs approval.
+	SuggestAlternatives bool `json:"suggest_alternatives"`
 	// Retry configuration
 	MaxRetries int  `json:"max_retries"`
 	AutoRetry  bool `json:"auto_retry"`
+	// Wall-clock budget of a whole plan, retries included; commands left
+	// when it runs out are skipped. 0 means no budget
+	PlanTimeoutSeconds int `json:"plan_timeout_seconds"`
+	// The resource guard holds back heavy commands (package installs,
+	// packet captures, throughput tests; see executor.Heavy) while the
+	// router has less than MinFreeMemoryMB of memory available, a 1-minute
+	// load average above MaxLoad per CPU or, for installs, less than
+	// MinFreeOverlayKB free on /overlay. They wait up to ResourceWait
+	// seconds for the resources to recover and are refused otherwise. 0
+	// disables a check.
+	MinFreeMemoryMB  int     `json:"min_free_memory_mb"`
+	MaxLoad          float64 `json:"max_load"`
+	MinFreeOverlayKB int     `json:"min_free_overlay_kb"`
+	ResourceWait     int     `json:"resource_wait"`
+	// LowPriority runs commands under nice and ionice, so the router's own
+	// work keeps the CPU and flash first.
+	LowPriority bool `json:"low_priority"`
+	// Times the model may ask clarifying questions (plan.Plan.Questions)
+	// before it must plan; 0 never lets it ask
+	ClarifyRounds int `json:"clarify_rounds"`
+	// Per-intent caps (see internal/intent); 0 falls back to MaxCommands
+	MaxReadCommands  int `json:"max_read_commands"`
+	MaxWriteCommands int `json:"max_write_commands"`
 	// Provider-specific API keys
 	OpenAIAPIKey    string `json:"openai_api_key"`
 	AnthropicAPIKey string `json:"anthropic_api_key"`
+	APIKeyFile      string `json:"api_key_file"` // Owner-only NAME=value file, see ReadKeyFile
 	// Provider-specific endpoints (stored separately for switching)
 	OpenAIEndpoint    string `json:"openai_endpoint"`
 	AnthropicEndpoint string `json:"anthropic_endpoint"`
 	// Provider-specific models (stored separately for switching)
 	OpenAIModel    string `json:"openai_model"`
 	AnthropicModel string `json:"anthropic_model"`
+	// EscalationModel is a stronger model of the active provider that plans
+	// once more when the configured model flags its plan as low-confidence,
+	// at most EscalationQuota times a day (see llm.NewProvider). Empty
+	// disables escalation.
+	EscalationModel string `json:"escalation_model"`
+	EscalationQuota int    `json:"escalation_quota"`
+	// The local provider runs a small model on the router itself (see
+	// llm.LocalClient): LocalCommand, if set, reads the prompt on stdin and
+	// prints the completion, as llama.cpp's llama-cli does; otherwise the
+	// llama.cpp server at LocalEndpoint completes it. LocalModel names the
+	// model in plans and logs. With LocalFallback the local model plans
+	// when the configured cloud provider cannot be reached.
+	LocalCommand  string `json:"local_command"`
+	LocalEndpoint string `json:"local_endpoint"`
+	LocalModel    string `json:"local_model"`
+	LocalFallback bool   `json:"local_fallback"`
+	// ProviderRetries is how often a provider call failing with a network
+	// error, 429 or 5xx is retried, with exponential backoff. After
+	// BreakerFailures failed calls in a row the provider's circuit opens and
+	// calls fail at once for BreakerCooldown seconds, doubling while probes
+	// keep failing (see llm.Breaker); 0 disables the breaker.
+	ProviderRetries int `json:"provider_retries"`
+	BreakerFailures int `json:"breaker_failures"`
+	BreakerCooldown int `json:"breaker_cooldown"`
+	// Generation parameters, mapped onto each provider's API; nil or zero
+	// leaves the provider default
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"top_p,omitempty"`
+	MaxOutputTokens int      `json:"max_output_tokens"`
+	ReasoningEffort string   `json:"reasoning_effort"` // OpenAI: minimal, low, medium, high
+	ThinkingBudget  int      `json:"thinking_budget"`  // Anthropic/Gemini thinking tokens
+	// Documentation retrieval (requires a provider with an embeddings API)
+	DocsRetrieval  bool   `json:"docs_retrieval"`
+	DocsTopK       int    `json:"docs_top_k"`
+	EmbeddingModel string `json:"embedding_model"`
+	// Curated examples similar to the request included in plan prompts
+	// (see prompts.SelectExamples); 0 disables them
+	FewShotExamples int `json:"few_shot_examples"`
+	// Snippets of the command reference matching the request included in
+	// plan prompts (see prompts.SelectCommands); 0 disables them
+	CommandSnippets int `json:"command_snippets"`
+	// Recent plans rated bad with `lucicodex feedback` included in plan
+	// prompts as known not to work; 0 disables them
+	FeedbackHints int `json:"feedback_hints"`
+	// SummaryHistory is how many summaries of earlier related runs from the
+	// audit log the summary request sees (see prompts.SummaryHistoryBlock),
+	// so it can answer whether things changed. 0, the default, disables it.
+	SummaryHistory int `json:"summary_history"`
+	// OAuth client used by `lucicodex login` (see internal/auth). Stored
+	// tokens take precedence over the static API keys above.
+	OAuthClientID     string `json:"oauth_client_id"`
+	OAuthClientSecret string `json:"oauth_client_secret"`
+	OAuthAuthURL      string `json:"oauth_auth_url"`
+	OAuthTokenURL     string `json:"oauth_token_url"`
+	OAuthDeviceURL    string `json:"oauth_device_url"`
+	OAuthScopes       string `json:"oauth_scopes"` // space separated
+	TokenFile         string `json:"token_file"`
+	// Provider HTTP traffic capture (see internal/llm/cassette)
+	RecordDir string `json:"record_dir"` // Write redacted request/response cassettes here
+	ReplayDir string `json:"replay_dir"` // Serve provider responses from cassettes, no network
+	// Capture every prompt and raw response of a run under DebugDir (see
+	// internal/llm/llmdebug)
+	DebugLLM bool   `json:"debug_llm"`
+	DebugDir string `json:"debug_dir"`
+	// HTTPTrace receives one line per provider HTTP exchange (set by the
+	// CLI at debug verbosity, never from a config file)
+	HTTPTrace io.Writer `json:"-"`
+	// Daily metrics rollups (see internal/metrics); empty dir disables them
+	MetricsDir           string `json:"metrics_dir"`
+	MetricsRetentionDays int    `json:"metrics_retention_days"`
+	// Background job spool directory (see internal/jobs)
+	JobsDir string `json:"jobs_dir"`
+	// Approved plans with placeholders, for run-plan (see internal/templates)
+	TemplatesDir string `json:"templates_dir"`
+	// Named workflows for `lucicodex pipeline` (see internal/pipeline)
+	PipelinesDir string `json:"pipelines_dir"`
+	// Where API tokens, metrics rollups, job records, templates and the
+	// execution history are kept (see internal/storage): "file" keeps JSON
+	// files in their own directories, "sqlite" keeps them all in the
+	// database at StoragePath, which needs a build with SQLiteDriver
+	StorageBackend string `json:"storage_backend"`
+	StoragePath    string `json:"storage_path"`
+	// Per-execution artifact directories (see internal/artifacts); empty
+	// disables them. Old ones are removed beyond the size and age limits.
+	ArtifactsDir           string `json:"artifacts_dir"`
+	ArtifactsMaxMB         int    `json:"artifacts_max_mb"`
+	ArtifactsRetentionDays int    `json:"artifacts_retention_days"`
+	// Network change safety net (see internal/rollback); 0 disables it
+	RollbackTimeout int    `json:"rollback_timeout"` // seconds to wait for confirm-change
+	RollbackDir     string `json:"rollback_dir"`
+	// Seconds a command prepared by an MCP tool can be approved (see the
+	// approve tool)
+	MCPApprovalTTL int `json:"mcp_approval_ttl"`
+	// Signed environment facts (see openwrt.Stamp). Stored plans are refused
+	// when more than FactsMaxDrift percent of the facts changed; 100 disables it.
+	FactsKeyFile  string `json:"facts_key_file"`
+	FactsMaxDrift int    `json:"facts_max_drift"`
+	// Fields of GET /v1/facts always hidden (see openwrt.RedactableFields)
+	FactsRedact []string `json:"facts_redact"`
+	// Named daemon API tokens with viewer/operator/admin roles (see
+	// auth.APITokenStore); empty disables them
+	APITokensFile string `json:"api_tokens_file"`
+	// Certificates pinned for self-hosted LLM endpoints (see internal/tlspin);
+	// empty disables pinning
+	PinsFile string `json:"pins_file"`
+	// Serve the daemon API on this Unix socket (mode 0600) instead of TCP
+	SocketPath string `json:"socket_path"`
+	// Built-in file.read/file.write commands and MCP file tools are limited
+	// to files under FilePaths of at most FileMaxBytes; overwritten files
+	// are copied to FileBackupDir first
+	FilePaths     []string `json:"file_paths"`
+	FileMaxBytes  int      `json:"file_max_bytes"`
+	FileBackupDir string   `json:"file_backup_dir"`
+	// Reverse proxies in front of the daemon (IPs, CIDRs, or "unix" for
+	// peers of SocketPath) whose X-Forwarded-For header is believed; empty
+	// trusts none
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Signed release manifest checked by `lucicodex self-update`
+	UpdateURL string `json:"update_url"`
+	// `lucicodex watch` probe interval in seconds, and URLs that receive
+	// alerts as JSON POSTs
+	WatchInterval int      `json:"watch_interval"`
+	WatchWebhooks []string `json:"watch_webhooks"`
+	// `lucicodex schedule digest` interval in seconds (daily if unset), and
+	// URLs that receive each digest as a JSON POST
+	DigestInterval int      `json:"digest_interval"`
+	DigestWebhooks []string `json:"digest_webhooks"`
+	// Commands get PATH only, plus the variables of LuciCodex's environment
+	// named in EnvPassthrough (e.g. TERM, HOME, http_proxy) and those of
+	// CommandEnv, "<command>:NAME=value" ("*" for every command)
+	EnvPassthrough []string `json:"env_passthrough"`
+	CommandEnv     []string `json:"command_env"`
 }
 
 func defaultConfig() Config {
@@ -62,40 +265,91 @@ func defaultConfig() Config {
 		DryRun:            true,
 		AutoApprove:       false,
 		TimeoutSeconds:    300,
+		ClarifyRounds:     1,
 		MaxCommands:       10,
+		MaxReadCommands:   20,
+		MaxWriteCommands:  5,
 		MaxRetries:        2,
 		AutoRetry:         true,
 		OpenAIEndpoint:    "https://api.openai.com/v1",
 		OpenAIModel:       "gpt-5-mini",
 		AnthropicEndpoint: "https://api.anthropic.com/v1",
 		AnthropicModel:    "claude-haiku-4-5-20251001",
+		EscalationQuota:   20,
+		MinFreeMemoryMB:   16,
+		MaxLoad:           3,
+		MinFreeOverlayKB:  1024,
+		ResourceWait:      30,
+		LocalEndpoint:     "http://127.0.0.1:8080",
+
+		MetricsDir:             "/tmp/lucicodex-metrics",
+		MetricsRetentionDays:   30,
+		JobsDir:                "/tmp/lucicodex-jobs",
+		TemplatesDir:           "/etc/lucicodex/templates",
+		PipelinesDir:           "/etc/lucicodex/pipelines",
+		StorageBackend:         "file",
+		ControlGuard:           "confirm",
+		APGuard:                "confirm",
+		FirewallGuard:          "block",
+		StoragePath:            "/etc/lucicodex/state.db",
+		DebugDir:               "/tmp/lucicodex-debug",
+		ArtifactsDir:           "/tmp/lucicodex-artifacts",
+		ArtifactsMaxMB:         16,
+		ArtifactsRetentionDays: 7,
+		RollbackTimeout:        90,
+		RollbackDir:            "/tmp/lucicodex-rollback",
+		MCPApprovalTTL:         300,
+		FactsKeyFile:           "/tmp/.lucicodex.facts.key",
+		FactsMaxDrift:          50,
+		APITokensFile:          "/etc/lucicodex/api_tokens.json",
+		PinsFile:               "/etc/lucicodex/pins.json",
+		UpdateURL:              "https://github.com/aezizhu/LuciCodex/releases/latest/download/manifest.json",
+		WatchInterval:          60,
+		FewShotExamples:        2,
+		CommandSnippets:        3,
+		ProviderRetries:        2,
+		BreakerFailures:        5,
+		BreakerCooldown:        30,
+		FilePaths:              []string{"/etc/config", "/tmp"},
+		FileMaxBytes:           64 * 1024,
+		FileBackupDir:          "/tmp/lucicodex-backups",
 		// No default allowlist - user approval is the safety mechanism
 		// No default denylist - trust users to review and approve commands
 		Allowlist:      []string{},
 		Denylist:       []string{},
+		Warnlist:       []string{},
+		PolicyRules:    []string{},
+		FactsRedact:    []string{},
 		ConfirmEach:    false,
 		LogFile:        "/tmp/lucicodex.log",
 		ElevateCommand: "",
 	}
 }
 
+// FilePath returns the JSON config file Load reads: path if given, otherwise
+// the first existing default location, or "" if there is none.
+func FilePath(path string) string {
+	if path != "" {
+		return path
+	}
+	if fileExists("/etc/lucicodex/config.json") {
+		return "/etc/lucicodex/config.json"
+	}
+	home, _ := os.UserHomeDir()
+	p := filepath.Join(home, ".config", "lucicodex", "config.json")
+	if fileExists(p) {
+		return p
+	}
+	return ""
+}
+
 // Load loads configuration from env, UCI (if available), and optional JSON file.
 // Precedence: env > UCI > file > defaults
 func Load(path string) (Config, error) {
 	cfg := defaultConfig()
 
 	// File
-	if path == "" {
-		if fileExists("/etc/lucicodex/config.json") {
-			path = "/etc/lucicodex/config.json"
-		} else {
-			home, _ := os.UserHomeDir()
-			p := filepath.Join(home, ".config", "lucicodex", "config.json")
-			if fileExists(p) {
-				path = p
-			}
-		}
-	}
+	path = FilePath(path)
 	if path != "" && fileExists(path) {
 		b, err := os.ReadFile(path)
 		if err != nil {
@@ -158,6 +412,28 @@ func Load(path string) (Config, error) {
 	if ep := getUci("anthropic_endpoint"); ep != "" {
 		cfg.AnthropicEndpoint = ep
 	}
+	if m := getUci("escalation_model"); m != "" {
+		cfg.EscalationModel = m
+	}
+	if n := getUci("escalation_quota"); n != "" {
+		if k, err := strconv.Atoi(n); err == nil && k >= 0 {
+			cfg.EscalationQuota = k
+		}
+	}
+	if cmd := getUci("local_command"); cmd != "" {
+		cfg.LocalCommand = cmd
+	}
+	if ep := getUci("local_endpoint"); ep != "" {
+		cfg.LocalEndpoint = ep
+	}
+	if m := getUci("local_model"); m != "" {
+		cfg.LocalModel = m
+	}
+	if fallback := getUci("local_fallback"); fallback == "1" {
+		cfg.LocalFallback = true
+	} else if fallback == "0" {
+		cfg.LocalFallback = false
+	}
 
 	// Load settings from UCI
 	if dryRun := getUci("dry_run"); dryRun == "1" {
@@ -170,16 +446,159 @@ func Load(path string) (Config, error) {
 	} else if confirmEach == "0" {
 		cfg.ConfirmEach = false
 	}
+	if strict := getUci("strict_privileges"); strict == "1" {
+		cfg.StrictPrivileges = true
+	} else if strict == "0" {
+		cfg.StrictPrivileges = false
+	}
+	if guard := getUci("control_guard"); guard != "" {
+		cfg.ControlGuard = guard
+	}
+	if guard := getUci("ap_guard"); guard != "" {
+		cfg.APGuard = guard
+	}
+	if guard := getUci("firewall_guard"); guard != "" {
+		cfg.FirewallGuard = guard
+	}
+	if block := getUci("lint_block"); block != "" {
+		cfg.LintBlock = block
+	}
+	if cmd := getUci("approval_command"); cmd != "" {
+		cfg.ApprovalCommand = cmd
+	}
+	if secs := getUci("approval_timeout"); secs != "" {
+		if n, err := strconv.Atoi(secs); err == nil && n > 0 {
+			cfg.ApprovalTimeout = n
+		}
+	}
+	if install := getUci("auto_install_packages"); install == "1" {
+		cfg.AutoInstallPackages = true
+	} else if install == "0" {
+		cfg.AutoInstallPackages = false
+	}
+	if suggest := getUci("suggest_alternatives"); suggest == "1" {
+		cfg.SuggestAlternatives = true
+	} else if suggest == "0" {
+		cfg.SuggestAlternatives = false
+	}
+	if docs := getUci("docs_retrieval"); docs == "1" {
+		cfg.DocsRetrieval = true
+	} else if docs == "0" {
+		cfg.DocsRetrieval = false
+	}
+	if n := getUci("few_shot_examples"); n != "" {
+		if k, err := strconv.Atoi(n); err == nil && k >= 0 {
+			cfg.FewShotExamples = k
+		}
+	}
+	if n := getUci("command_snippets"); n != "" {
+		if k, err := strconv.Atoi(n); err == nil && k >= 0 {
+			cfg.CommandSnippets = k
+		}
+	}
+	if n := getUci("provider_retries"); n != "" {
+		if k, err := strconv.Atoi(n); err == nil && k >= 0 {
+			cfg.ProviderRetries = k
+		}
+	}
+	if n := getUci("breaker_failures"); n != "" {
+		if k, err := strconv.Atoi(n); err == nil && k >= 0 {
+			cfg.BreakerFailures = k
+		}
+	}
+	if secs := getUci("breaker_cooldown"); secs != "" {
+		if k, err := strconv.Atoi(secs); err == nil && k > 0 {
+			cfg.BreakerCooldown = k
+		}
+	}
+	if n := getUci("feedback_hints"); n != "" {
+		if k, err := strconv.Atoi(n); err == nil && k >= 0 {
+			cfg.FeedbackHints = k
+		}
+	}
+	if n := getUci("summary_history"); n != "" {
+		if k, err := strconv.Atoi(n); err == nil && k >= 0 {
+			cfg.SummaryHistory = k
+		}
+	}
 	if timeout := getUci("timeout"); timeout != "" {
 		if t, err := strconv.Atoi(timeout); err == nil && t > 0 {
 			cfg.TimeoutSeconds = t
 		}
 	}
+	if timeout := getUci("plan_timeout"); timeout != "" {
+		if t, err := strconv.Atoi(timeout); err == nil && t >= 0 {
+			cfg.PlanTimeoutSeconds = t
+		}
+	}
+	if n := getUci("min_free_memory"); n != "" {
+		if k, err := strconv.Atoi(n); err == nil && k >= 0 {
+			cfg.MinFreeMemoryMB = k
+		}
+	}
+	if v := getUci("max_load"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 {
+			cfg.MaxLoad = f
+		}
+	}
+	if n := getUci("min_free_overlay"); n != "" {
+		if k, err := strconv.Atoi(n); err == nil && k >= 0 {
+			cfg.MinFreeOverlayKB = k
+		}
+	}
+	if secs := getUci("resource_wait"); secs != "" {
+		if n, err := strconv.Atoi(secs); err == nil && n >= 0 {
+			cfg.ResourceWait = n
+		}
+	}
+	if low := getUci("low_priority"); low == "1" {
+		cfg.LowPriority = true
+	} else if low == "0" {
+		cfg.LowPriority = false
+	}
+	if n := getUci("clarify_rounds"); n != "" {
+		if k, err := strconv.Atoi(n); err == nil && k >= 0 {
+			cfg.ClarifyRounds = k
+		}
+	}
 	if maxCmds := getUci("max_commands"); maxCmds != "" {
 		if m, err := strconv.Atoi(maxCmds); err == nil && m > 0 {
 			cfg.MaxCommands = m
 		}
 	}
+	if maxCmds := getUci("max_read_commands"); maxCmds != "" {
+		if m, err := strconv.Atoi(maxCmds); err == nil && m >= 0 {
+			cfg.MaxReadCommands = m
+		}
+	}
+	if maxCmds := getUci("max_write_commands"); maxCmds != "" {
+		if m, err := strconv.Atoi(maxCmds); err == nil && m >= 0 {
+			cfg.MaxWriteCommands = m
+		}
+	}
+	if v := getUci("temperature"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			cfg.Temperature = &f
+		}
+	}
+	if v := getUci("top_p"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			cfg.TopP = &f
+		}
+	}
+	if v := getUci("max_output_tokens"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.MaxOutputTokens = n
+		}
+	}
+	if v := getUci("reasoning_effort"); v != "" {
+		cfg.ReasoningEffort = v
+	}
+	if v := getUci("thinking_budget"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.ThinkingBudget = n
+		}
+	}
 	if logFile := getUci("log_file"); logFile != "" {
 		cfg.LogFile = logFile
 	}
@@ -192,53 +611,205 @@ func Load(path string) (Config, error) {
 	if proxy := getUci("no_proxy"); proxy != "" {
 		cfg.NoProxy = proxy
 	}
+	if id := getUci("oauth_client_id"); id != "" {
+		cfg.OAuthClientID = id
+	}
+	if secret := getUci("oauth_client_secret"); secret != "" {
+		cfg.OAuthClientSecret = secret
+	}
+	if tf := getUci("token_file"); tf != "" {
+		cfg.TokenFile = tf
+	}
+	if dir := getUci("metrics_dir"); dir != "" {
+		cfg.MetricsDir = dir
+	}
+	if days := getUci("metrics_retention_days"); days != "" {
+		if d, err := strconv.Atoi(days); err == nil && d > 0 {
+			cfg.MetricsRetentionDays = d
+		}
+	}
+	if f := getUci("api_tokens_file"); f != "" {
+		cfg.APITokensFile = f
+	}
+	if f := getUci("pins_file"); f != "" {
+		cfg.PinsFile = f
+	}
+	if dir := getUci("jobs_dir"); dir != "" {
+		cfg.JobsDir = dir
+	}
+	if dir := getUci("templates_dir"); dir != "" {
+		cfg.TemplatesDir = dir
+	}
+	if dir := getUci("pipelines_dir"); dir != "" {
+		cfg.PipelinesDir = dir
+	}
+	if backend := getUci("storage_backend"); backend != "" {
+		cfg.StorageBackend = backend
+	}
+	if path := getUci("storage_path"); path != "" {
+		cfg.StoragePath = path
+	}
+	if dir := getUci("artifacts_dir"); dir != "" {
+		cfg.ArtifactsDir = dir
+	}
+	if mb := getUci("artifacts_max_mb"); mb != "" {
+		if n, err := strconv.Atoi(mb); err == nil && n >= 0 {
+			cfg.ArtifactsMaxMB = n
+		}
+	}
+	if days := getUci("artifacts_retention_days"); days != "" {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			cfg.ArtifactsRetentionDays = n
+		}
+	}
+	if secs := getUci("rollback_timeout"); secs != "" {
+		if n, err := strconv.Atoi(secs); err == nil && n >= 0 {
+			cfg.RollbackTimeout = n
+		}
+	}
+	if secs := getUci("mcp_approval_ttl"); secs != "" {
+		if n, err := strconv.Atoi(secs); err == nil && n > 0 {
+			cfg.MCPApprovalTTL = n
+		}
+	}
+	if path := getUci("facts_key_file"); path != "" {
+		cfg.FactsKeyFile = path
+	}
+	if path := getUci("socket_path"); path != "" {
+		cfg.SocketPath = path
+	}
+	if paths := getUci("file_paths"); paths != "" {
+		cfg.FilePaths = strings.Fields(paths)
+	}
+	if n := getUci("file_max_bytes"); n != "" {
+		if b, err := strconv.Atoi(n); err == nil && b >= 0 {
+			cfg.FileMaxBytes = b
+		}
+	}
+	if dir := getUci("file_backup_dir"); dir != "" {
+		cfg.FileBackupDir = dir
+	}
+	if proxies := getUci("trusted_proxies"); proxies != "" {
+		cfg.TrustedProxies = strings.Fields(proxies)
+	}
+	if u := getUci("update_url"); u != "" {
+		cfg.UpdateURL = u
+	}
+	if secs := getUci("watch_interval"); secs != "" {
+		if n, err := strconv.Atoi(secs); err == nil && n > 0 {
+			cfg.WatchInterval = n
+		}
+	}
+	if hooks := getUci("watch_webhook"); hooks != "" {
+		// A UCI list reads back as space-separated values
+		cfg.WatchWebhooks = strings.Fields(hooks)
+	}
+	if secs := getUci("digest_interval"); secs != "" {
+		if n, err := strconv.Atoi(secs); err == nil && n > 0 {
+			cfg.DigestInterval = n
+		}
+	}
+	if hooks := getUci("digest_webhook"); hooks != "" {
+		cfg.DigestWebhooks = strings.Fields(hooks)
+	}
+	if names := getUci("env_passthrough"); names != "" {
+		cfg.EnvPassthrough = strings.Fields(names)
+	}
+	if entries := getUci("command_env"); entries != "" {
+		cfg.CommandEnv = strings.Fields(entries)
+	}
+	if fields := getUci("facts_redact"); fields != "" {
+		cfg.FactsRedact = strings.Fields(fields)
+	}
+	if pct := getUci("facts_max_drift"); pct != "" {
+		if n, err := strconv.Atoi(pct); err == nil && n >= 0 && n <= 100 {
+			cfg.FactsMaxDrift = n
+		}
+	}
+	if path := getUci("api_key_file"); path != "" {
+		cfg.APIKeyFile = path
+	}
+
+	// Keys kept out of the config file and UCI
+	if cfg.APIKeyFile != "" {
+		if err := cfg.applyKeyFile(); err != nil {
+			return cfg, err
+		}
+	}
 
-	// Environment variables override everything
-	if v := strings.TrimSpace(os.Getenv("LUCICODEX_PROVIDER")); v != "" {
+	// Environment variables override everything. Each may instead name a
+	// file holding the value via NAME_FILE, e.g. GEMINI_API_KEY_FILE.
+	var envErr error
+	env := func(name string) string {
+		v, err := lookupEnv(name)
+		if err != nil && envErr == nil {
+			envErr = err
+		}
+		return v
+	}
+	if v := env("LUCICODEX_PROVIDER"); v != "" {
 		cfg.Provider = v
 	}
-	if v := strings.TrimSpace(os.Getenv("GEMINI_API_KEY")); v != "" {
+	if v := env("GEMINI_API_KEY"); v != "" {
 		cfg.APIKey = v
 	}
-	if v := strings.TrimSpace(os.Getenv("OPENAI_API_KEY")); v != "" {
+	if v := env("OPENAI_API_KEY"); v != "" {
 		cfg.OpenAIAPIKey = v
 	}
-	if v := strings.TrimSpace(os.Getenv("ANTHROPIC_API_KEY")); v != "" {
+	if v := env("ANTHROPIC_API_KEY"); v != "" {
 		cfg.AnthropicAPIKey = v
 	}
-	if v := strings.TrimSpace(os.Getenv("LUCICODEX_MODEL")); v != "" {
+	if v := env("LUCICODEX_MODEL"); v != "" {
 		cfg.Model = v
 	}
-	if v := strings.TrimSpace(os.Getenv("GEMINI_ENDPOINT")); v != "" {
+	if v := env("GEMINI_ENDPOINT"); v != "" {
 		cfg.Endpoint = v
 	}
-	if v := strings.TrimSpace(os.Getenv("LUCICODEX_LOG_FILE")); v != "" {
+	if v := env("LUCICODEX_LOG_FILE"); v != "" {
 		cfg.LogFile = v
 	}
-	if v := strings.TrimSpace(os.Getenv("LUCICODEX_ELEVATE")); v != "" {
+	if v := env("LUCICODEX_ELEVATE"); v != "" {
 		cfg.ElevateCommand = v
 	}
-	if v := strings.TrimSpace(os.Getenv("LUCICODEX_CONFIRM_EACH")); v != "" {
+	if v := env("LUCICODEX_CONFIRM_EACH"); v != "" {
 		cfg.ConfirmEach = v == "1" || strings.ToLower(v) == "true"
 	}
-	if v := strings.TrimSpace(os.Getenv("LUCICODEX_AUTO_RETRY")); v != "" {
+	if v := env("LUCICODEX_AUTO_RETRY"); v != "" {
 		cfg.AutoRetry = v == "1" || strings.ToLower(v) == "true"
 	}
-	if v := strings.TrimSpace(os.Getenv("LUCICODEX_MAX_RETRIES")); v != "" {
+	if v := env("LUCICODEX_MAX_RETRIES"); v != "" {
 		if r, err := strconv.Atoi(v); err == nil && r >= 0 {
 			cfg.MaxRetries = r
 		}
 	}
-	if v := strings.TrimSpace(os.Getenv("HTTP_PROXY")); v != "" {
+	if v := env("LUCICODEX_OAUTH_CLIENT_ID"); v != "" {
+		cfg.OAuthClientID = v
+	}
+	if v := env("LUCICODEX_OAUTH_CLIENT_SECRET"); v != "" {
+		cfg.OAuthClientSecret = v
+	}
+	if v := env("HTTP_PROXY"); v != "" {
 		cfg.HTTPProxy = v
 	}
-	if v := strings.TrimSpace(os.Getenv("HTTPS_PROXY")); v != "" {
+	if v := env("HTTPS_PROXY"); v != "" {
 		cfg.HTTPSProxy = v
 	}
-	if v := strings.TrimSpace(os.Getenv("NO_PROXY")); v != "" {
+	if v := env("NO_PROXY"); v != "" {
 		cfg.NoProxy = v
 	}
 
+	if envErr != nil {
+		return cfg, envErr
+	}
+	if err := cfg.decryptKeys(); err != nil {
+		return cfg, err
+	}
+	layers, err := LoadSystemPolicy(SystemPolicyDir)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.SystemPolicy = layers
+
 	// Set active Model and Endpoint based on provider
 	cfg.ApplyProviderSettings()
 
@@ -271,6 +842,17 @@ func (cfg *Config) ApplyProviderSettings() {
 		} else {
 			cfg.Endpoint = "https://api.anthropic.com/v1"
 		}
+	case "local":
+		if cfg.LocalModel != "" {
+			cfg.Model = cfg.LocalModel
+		} else if cfg.Model == "" || cfg.Model == "gemini-2.5-pro" {
+			cfg.Model = "local"
+		}
+		if cfg.LocalEndpoint != "" {
+			cfg.Endpoint = cfg.LocalEndpoint
+		} else {
+			cfg.Endpoint = "http://127.0.0.1:8080"
+		}
 	default: // gemini
 		if cfg.Model == "" {
 			cfg.Model = "gemini-2.5-pro"
@@ -281,11 +863,26 @@ func (cfg *Config) ApplyProviderSettings() {
 	}
 }
 
+// SQLiteDriver is the database/sql driver of the sqlite storage backend.
+// The standard build links none, to stay free of cgo and dependencies;
+// builds that want the backend add a driver package registering this name.
+var SQLiteDriver = "sqlite3"
+
+// sqliteLinked reports whether the build has SQLiteDriver.
+func sqliteLinked() bool {
+	for _, d := range sql.Drivers() {
+		if d == SQLiteDriver {
+			return true
+		}
+	}
+	return false
+}
+
 // Validate checks configuration values and returns an error if any are invalid.
 func (cfg *Config) Validate() error {
 	// Validate provider
 	switch cfg.Provider {
-	case "gemini", "openai", "anthropic":
+	case "gemini", "openai", "anthropic", "local":
 		// Valid
 	default:
 		return fmt.Errorf("%w: got '%s'", ErrInvalidProvider, cfg.Provider)
@@ -295,12 +892,95 @@ func (cfg *Config) Validate() error {
 	if cfg.TimeoutSeconds < 1 || cfg.TimeoutSeconds > 600 {
 		return fmt.Errorf("%w: got %d", ErrInvalidTimeout, cfg.TimeoutSeconds)
 	}
+	if cfg.ClarifyRounds < 0 || cfg.ClarifyRounds > 5 {
+		return fmt.Errorf("invalid clarify_rounds: must be between 0 and 5, got %d", cfg.ClarifyRounds)
+	}
+	if cfg.PlanTimeoutSeconds < 0 {
+		return fmt.Errorf("invalid plan_timeout_seconds: must not be negative, got %d", cfg.PlanTimeoutSeconds)
+	}
+	if cfg.MinFreeMemoryMB < 0 || cfg.MaxLoad < 0 || cfg.MinFreeOverlayKB < 0 {
+		return fmt.Errorf("invalid resource thresholds: min_free_memory_mb, max_load and min_free_overlay_kb must not be negative")
+	}
+	if cfg.ResourceWait < 0 || cfg.ResourceWait > 600 {
+		return fmt.Errorf("invalid resource_wait: must be between 0 and 600, got %d", cfg.ResourceWait)
+	}
 
 	// Validate max commands
 	if cfg.MaxCommands < 1 || cfg.MaxCommands > 100 {
 		return fmt.Errorf("%w: got %d", ErrInvalidMaxCommands, cfg.MaxCommands)
 	}
 
+	if cfg.MaxReadCommands < 0 || cfg.MaxReadCommands > 100 {
+		return fmt.Errorf("%w: max_read_commands got %d", ErrInvalidMaxCommands, cfg.MaxReadCommands)
+	}
+	if cfg.MaxWriteCommands < 0 || cfg.MaxWriteCommands > 100 {
+		return fmt.Errorf("%w: max_write_commands got %d", ErrInvalidMaxCommands, cfg.MaxWriteCommands)
+	}
+
+	if err := cfg.ValidateGeneration(); err != nil {
+		return err
+	}
+
+	if cfg.EscalationQuota < 0 {
+		return fmt.Errorf("invalid escalation_quota: must not be negative, got %d", cfg.EscalationQuota)
+	}
+	if cfg.FewShotExamples < 0 || cfg.FewShotExamples > 10 {
+		return fmt.Errorf("invalid few_shot_examples: must be between 0 and 10, got %d", cfg.FewShotExamples)
+	}
+	if cfg.CommandSnippets < 0 || cfg.CommandSnippets > 10 {
+		return fmt.Errorf("invalid command_snippets: must be between 0 and 10, got %d", cfg.CommandSnippets)
+	}
+	if cfg.ProviderRetries < 0 || cfg.ProviderRetries > 5 {
+		return fmt.Errorf("invalid provider_retries: must be between 0 and 5, got %d", cfg.ProviderRetries)
+	}
+	if cfg.BreakerFailures < 0 {
+		return fmt.Errorf("invalid breaker_failures: must not be negative, got %d", cfg.BreakerFailures)
+	}
+	if cfg.BreakerFailures > 0 && (cfg.BreakerCooldown < 1 || cfg.BreakerCooldown > 3600) {
+		return fmt.Errorf("invalid breaker_cooldown: must be between 1 and 3600 seconds, got %d", cfg.BreakerCooldown)
+	}
+	switch cfg.StorageBackend {
+	case "", "file":
+	case "sqlite":
+		if cfg.StoragePath == "" {
+			return fmt.Errorf("storage_path is required for the sqlite storage backend")
+		}
+		if !sqliteLinked() {
+			return fmt.Errorf("storage_backend sqlite is not available in this build: no %q database driver is linked", SQLiteDriver)
+		}
+	default:
+		return fmt.Errorf("invalid storage_backend %q: must be file or sqlite", cfg.StorageBackend)
+	}
+	switch cfg.ControlGuard {
+	case "", "confirm", "block", "off":
+	default:
+		return fmt.Errorf("invalid control_guard %q: must be confirm, block or off", cfg.ControlGuard)
+	}
+	switch cfg.APGuard {
+	case "", "confirm", "block", "off":
+	default:
+		return fmt.Errorf("invalid ap_guard %q: must be confirm, block or off", cfg.APGuard)
+	}
+	switch cfg.FirewallGuard {
+	case "", "confirm", "block", "off":
+	default:
+		return fmt.Errorf("invalid firewall_guard %q: must be confirm, block or off", cfg.FirewallGuard)
+	}
+	if cfg.ApprovalTimeout < 0 {
+		return fmt.Errorf("invalid approval_timeout: must not be negative, got %d", cfg.ApprovalTimeout)
+	}
+	switch cfg.LintBlock {
+	case "", "off", "warning", "error":
+	default:
+		return fmt.Errorf("invalid lint_block %q: must be warning, error or off", cfg.LintBlock)
+	}
+	if cfg.FeedbackHints < 0 || cfg.FeedbackHints > 10 {
+		return fmt.Errorf("invalid feedback_hints: must be between 0 and 10, got %d", cfg.FeedbackHints)
+	}
+	if cfg.SummaryHistory < 0 || cfg.SummaryHistory > 10 {
+		return fmt.Errorf("invalid summary_history: must be between 0 and 10, got %d", cfg.SummaryHistory)
+	}
+
 	// Validate max retries
 	if cfg.MaxRetries < 0 || cfg.MaxRetries > 10 {
 		return fmt.Errorf("%w: got %d", ErrInvalidMaxRetries, cfg.MaxRetries)
@@ -324,10 +1004,67 @@ func (cfg *Config) Validate() error {
 			return fmt.Errorf("invalid anthropic_endpoint: %v", err)
 		}
 	}
+	if cfg.LocalEndpoint != "" {
+		if _, err := url.ParseRequestURI(cfg.LocalEndpoint); err != nil {
+			return fmt.Errorf("invalid local_endpoint: %v", err)
+		}
+	}
+
+	for _, p := range cfg.FilePaths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("invalid file_paths entry: must be an absolute path, got '%s'", p)
+		}
+	}
+	if cfg.FileMaxBytes < 0 {
+		return fmt.Errorf("invalid file_max_bytes: got %d", cfg.FileMaxBytes)
+	}
+
+	for _, p := range cfg.TrustedProxies {
+		if p == "unix" || net.ParseIP(p) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(p); err != nil {
+			return fmt.Errorf("%w: got '%s'", ErrInvalidProxy, p)
+		}
+	}
+
+	for _, name := range cfg.EnvPassthrough {
+		if err := checkEnvName(name); err != nil {
+			return fmt.Errorf("invalid env_passthrough entry: %v", err)
+		}
+	}
+	for _, entry := range cfg.CommandEnv {
+		if _, _, _, err := ParseCommandEnv(entry); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// ValidateGeneration checks the generation parameters against the ranges
+// all providers accept.
+func (cfg *Config) ValidateGeneration() error {
+	if cfg.Temperature != nil && (*cfg.Temperature < 0 || *cfg.Temperature > 2) {
+		return fmt.Errorf("%w: temperature must be between 0 and 2, got %g", ErrInvalidGeneration, *cfg.Temperature)
+	}
+	if cfg.TopP != nil && (*cfg.TopP <= 0 || *cfg.TopP > 1) {
+		return fmt.Errorf("%w: top_p must be in (0, 1], got %g", ErrInvalidGeneration, *cfg.TopP)
+	}
+	if cfg.MaxOutputTokens < 0 {
+		return fmt.Errorf("%w: max_output_tokens must not be negative", ErrInvalidGeneration)
+	}
+	if cfg.ThinkingBudget < 0 {
+		return fmt.Errorf("%w: thinking_budget must not be negative", ErrInvalidGeneration)
+	}
+	switch cfg.ReasoningEffort {
+	case "", "minimal", "low", "medium", "high":
+	default:
+		return fmt.Errorf("%w: reasoning_effort must be minimal, low, medium or high, got %q", ErrInvalidGeneration, cfg.ReasoningEffort)
+	}
+	return nil
+}
+
 var fileExists = func(p string) bool {
 	st, err := os.Stat(p)
 	return err == nil && !st.IsDir()
@@ -338,7 +1075,8 @@ var execCommand = exec.Command
 var lookPath = exec.LookPath
 var osStat = os.Stat
 
-func uciGet(key string) (string, error) {
+// uciBinary returns the uci command to run.
+func uciBinary() string {
 	// Try common UCI paths - web server might not have /sbin in PATH
 	uciPaths := []string{"/sbin/uci", "/usr/sbin/uci", "uci"}
 	var uciCmd string
@@ -361,8 +1099,11 @@ func uciGet(key string) (string, error) {
 		// The mock will handle it regardless of path existence
 		uciCmd = "uci"
 	}
+	return uciCmd
+}
 
-	cmd := execCommand(uciCmd, "-q", "get", key)
+func uciGet(key string) (string, error) {
+	cmd := execCommand(uciBinary(), "-q", "get", key)
 	out, err := cmd.Output()
 	if err != nil {
 		// If exit code is 1, it means key not found, which is fine.
@@ -376,3 +1117,34 @@ func uciGet(key string) (string, error) {
 	}
 	return strings.TrimSpace(string(out)), nil
 }
+
+// SetUCI sets options of the lucicodex.main section, creating it if needed,
+// and commits them.
+func SetUCI(options map[string]string) error {
+	if err := uciRun("set", "lucicodex.main=settings"); err != nil {
+		return fmt.Errorf("uci set lucicodex.main: %w", err)
+	}
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := uciRun("set", "lucicodex.main."+name+"="+options[name]); err != nil {
+			return fmt.Errorf("uci set lucicodex.main.%s: %w", name, err)
+		}
+	}
+	if err := uciRun("commit", "lucicodex"); err != nil {
+		return fmt.Errorf("uci commit: %w", err)
+	}
+	return nil
+}
+
+// uciRun runs a uci command that changes the configuration.
+func uciRun(args ...string) error {
+	out, err := execCommand(uciBinary(), append([]string{"-q"}, args...)...).CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return err
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -377,6 +380,25 @@ func TestApplyProviderSettings(t *testing.T) {
 			wantModel:    "gemini-pro",
 			wantEndpoint: "https://custom.gemini.com",
 		},
+		{
+			name: "Local Defaults",
+			cfg: Config{
+				Provider: "local",
+				Model:    "gemini-2.5-pro",
+			},
+			wantModel:    "local",
+			wantEndpoint: "http://127.0.0.1:8080",
+		},
+		{
+			name: "Local Explicit",
+			cfg: Config{
+				Provider:      "local",
+				LocalModel:    "qwen2.5-1.5b",
+				LocalEndpoint: "http://192.168.1.10:8080",
+			},
+			wantModel:    "qwen2.5-1.5b",
+			wantEndpoint: "http://192.168.1.10:8080",
+		},
 	}
 
 	for _, tt := range tests {
@@ -494,3 +516,121 @@ func TestLoad_AllEnvVars(t *testing.T) {
 		t.Errorf("got NoProxy %q", cfg.NoProxy)
 	}
 }
+
+func TestValidateGeneration(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	valid := []Config{
+		{},
+		{Temperature: f(0), TopP: f(1), MaxOutputTokens: 4096, ReasoningEffort: "minimal", ThinkingBudget: 1024},
+		{Temperature: f(2)},
+	}
+	for i, cfg := range valid {
+		if err := cfg.ValidateGeneration(); err != nil {
+			t.Errorf("case %d: unexpected error %v", i, err)
+		}
+	}
+	invalid := []Config{
+		{Temperature: f(-0.1)},
+		{Temperature: f(2.5)},
+		{TopP: f(0)},
+		{MaxOutputTokens: -1},
+		{ThinkingBudget: -5},
+		{ReasoningEffort: "extreme"},
+	}
+	for i, cfg := range invalid {
+		if err := cfg.ValidateGeneration(); !errors.Is(err, ErrInvalidGeneration) {
+			t.Errorf("case %d: expected ErrInvalidGeneration, got %v", i, err)
+		}
+	}
+}
+
+func TestValidate_TrustedProxies(t *testing.T) {
+	cfg := Config{Provider: "gemini", TimeoutSeconds: 30, MaxCommands: 10}
+	cfg.TrustedProxies = []string{"127.0.0.1", "192.168.1.0/24", "::1", "unix"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, bad := range []string{"localhost", "10.0.0.0/33", ""} {
+		cfg.TrustedProxies = []string{bad}
+		if err := cfg.Validate(); !errors.Is(err, ErrInvalidProxy) {
+			t.Errorf("%q: expected ErrInvalidProxy, got %v", bad, err)
+		}
+	}
+}
+
+func TestValidate_CommandEnv(t *testing.T) {
+	cfg := Config{Provider: "gemini", TimeoutSeconds: 30, MaxCommands: 10}
+	cfg.EnvPassthrough = []string{"TERM", "HOME", "http_proxy"}
+	cfg.CommandEnv = []string{"opkg:http_proxy=http://proxy:3128", "*:LANG=C", "wget:no_proxy="}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if command, name, value, _ := ParseCommandEnv("opkg:http_proxy=http://proxy:3128"); command != "opkg" || name != "http_proxy" || value != "http://proxy:3128" {
+		t.Errorf("unexpected parse %q %q %q", command, name, value)
+	}
+	for _, bad := range []string{"opkg", "opkg:http_proxy", ":A=1", "/bin/opkg:A=1", "opkg:LD_PRELOAD=/tmp/x.so", "opkg:PATH=/tmp", "opkg:1A=1"} {
+		cfg.CommandEnv = []string{bad}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+	cfg.CommandEnv = nil
+	cfg.EnvPassthrough = []string{"LD_LIBRARY_PATH"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for LD_LIBRARY_PATH")
+	}
+}
+
+func TestValidate_Local(t *testing.T) {
+	cfg := Config{Provider: "local", TimeoutSeconds: 30, MaxCommands: 10, LocalEndpoint: "http://127.0.0.1:8080"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	cfg.LocalEndpoint = "127.0.0.1:8080"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for an endpoint without a scheme")
+	}
+}
+
+func TestValidate_ResourceGuard(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	cfg.MaxLoad = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for a negative max_load")
+	}
+	cfg.MaxLoad = 0
+	cfg.ResourceWait = 601
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for resource_wait over 600")
+	}
+}
+
+type noDriver struct{}
+
+func (noDriver) Open(string) (driver.Conn, error) { return nil, errors.New("not a database") }
+
+func TestValidate_Storage(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.StorageBackend = "sqlite"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "not available in this build") {
+		t.Errorf("expected sqlite to be refused without a driver, got %v", err)
+	}
+
+	sql.Register("lucicodex-test-sqlite", noDriver{})
+	defer func(name string) { SQLiteDriver = name }(SQLiteDriver)
+	SQLiteDriver = "lucicodex-test-sqlite"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	cfg.StoragePath = ""
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error without storage_path")
+	}
+	cfg.StorageBackend = "redis"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Finding is a setting found outside LuciCodex's own config file, such as an
+// API key exported for another AI CLI.
+type Finding struct {
+	Option string `json:"option"` // JSON config option, e.g. "openai_api_key"
+	Value  string `json:"value"`
+	Source string `json:"source"` // Where it was found, e.g. "$OPENAI_API_KEY"
+	Secret bool   `json:"secret"`
+}
+
+// DiscoverEnv is where Discover looks; tests point it at fixtures.
+type DiscoverEnv struct {
+	Getenv func(string) string
+	Home   string
+	UCI    func(key string) (string, error) // nil skips UCI
+}
+
+// DefaultDiscoverEnv inspects the real environment, home directory and UCI.
+func DefaultDiscoverEnv() DiscoverEnv {
+	home, _ := os.UserHomeDir()
+	return DiscoverEnv{Getenv: os.Getenv, Home: home, UCI: uciGet}
+}
+
+// SecretOptions are the config options holding credentials.
+var SecretOptions = map[string]bool{
+	"api_key":             true,
+	"openai_api_key":      true,
+	"anthropic_api_key":   true,
+	"oauth_client_secret": true,
+}
+
+// discoverUCI maps lucicodex UCI options to config options. They are applied
+// at load time but kept out of the config file, which makes them easy to miss.
+var discoverUCI = []struct{ uci, option string }{
+	{"provider", "provider"},
+	{"key", "api_key"},
+	{"openai_key", "openai_api_key"},
+	{"anthropic_key", "anthropic_api_key"},
+	{"model", "model"},
+	{"endpoint", "endpoint"},
+	{"openai_model", "openai_model"},
+	{"openai_endpoint", "openai_endpoint"},
+	{"anthropic_model", "anthropic_model"},
+	{"anthropic_endpoint", "anthropic_endpoint"},
+	{"http_proxy", "http_proxy"},
+	{"https_proxy", "https_proxy"},
+	{"no_proxy", "no_proxy"},
+}
+
+// discoverEnvVars maps environment variables used by LuciCodex and other
+// tools to config options.
+var discoverEnvVars = []struct{ name, option string }{
+	{"GEMINI_API_KEY", "api_key"},
+	{"GOOGLE_API_KEY", "api_key"},
+	{"OPENAI_API_KEY", "openai_api_key"},
+	{"ANTHROPIC_API_KEY", "anthropic_api_key"},
+	{"OPENAI_BASE_URL", "openai_endpoint"},
+	{"ANTHROPIC_BASE_URL", "anthropic_endpoint"},
+	{"HTTPS_PROXY", "https_proxy"},
+	{"https_proxy", "https_proxy"},
+	{"HTTP_PROXY", "http_proxy"},
+	{"http_proxy", "http_proxy"},
+	{"NO_PROXY", "no_proxy"},
+	{"no_proxy", "no_proxy"},
+}
+
+// Discover looks for credentials and settings left by other tools: UCI
+// options, environment variables, OpenAI CLI key files and Google
+// application default credentials. Options may be found more than once; the
+// first finding is the most specific.
+func Discover(env DiscoverEnv) []Finding {
+	var out []Finding
+	add := func(option, value, source string) {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return
+		}
+		out = append(out, Finding{Option: option, Value: value, Source: source, Secret: SecretOptions[option]})
+	}
+
+	if env.UCI != nil {
+		for _, section := range []string{"main", "@settings[0]", "@api[0]"} {
+			for _, o := range discoverUCI {
+				key := "lucicodex." + section + "." + o.uci
+				if v, err := env.UCI(key); err == nil {
+					add(o.option, v, "uci "+key)
+				}
+			}
+		}
+	}
+
+	if env.Getenv != nil {
+		for _, v := range discoverEnvVars {
+			add(v.option, env.Getenv(v.name), "$"+v.name)
+		}
+	}
+
+	if env.Home != "" {
+		// ~/.openai is either a bare key or a directory of key files
+		dot := filepath.Join(env.Home, ".openai")
+		if st, err := os.Stat(dot); err == nil && !st.IsDir() {
+			add("openai_api_key", readKeyLike(dot, "OPENAI_API_KEY"), dot)
+		} else if err == nil {
+			for _, name := range []string{"api_key", "auth.json"} {
+				p := filepath.Join(dot, name)
+				add("openai_api_key", readKeyLike(p, "OPENAI_API_KEY"), p)
+			}
+		}
+		p := filepath.Join(env.Home, ".codex", "auth.json")
+		add("openai_api_key", readKeyLike(p, "OPENAI_API_KEY"), p)
+	}
+
+	adc := ""
+	if env.Getenv != nil {
+		adc = env.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if adc == "" && env.Home != "" {
+		adc = filepath.Join(env.Home, ".config", "gcloud", "application_default_credentials.json")
+	}
+	if adc != "" {
+		var creds struct {
+			Type         string `json:"type"`
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+		}
+		if b, err := os.ReadFile(adc); err == nil && json.Unmarshal(b, &creds) == nil && creds.Type == "authorized_user" {
+			add("oauth_client_id", creds.ClientID, adc)
+			add("oauth_client_secret", creds.ClientSecret, adc)
+		}
+	}
+	return out
+}
+
+// readKeyLike reads name from a JSON object, a NAME=value file or a file
+// holding nothing but the value. It returns "" if the file is missing.
+func readKeyLike(path, name string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var obj map[string]interface{}
+	if json.Unmarshal(b, &obj) == nil {
+		s, _ := obj[name].(string)
+		return s
+	}
+	text := strings.TrimSpace(string(b))
+	if !strings.Contains(text, "=") && !strings.ContainsAny(text, " \n") {
+		return text
+	}
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for sc.Scan() {
+		k, v, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if ok && strings.TrimSpace(strings.TrimPrefix(k, "export ")) == name {
+			return strings.Trim(strings.TrimSpace(v), `"'`)
+		}
+	}
+	return ""
+}
+
+// Change is a proposed edit of one config file option.
+type Change struct {
+	Option string `json:"option"`
+	Old    string `json:"old"`
+	New    string `json:"new"`
+	Source string `json:"source"`
+	Secret bool   `json:"secret"`
+}
+
+// providerKeyOptions maps providers to the option holding their API key.
+var providerKeyOptions = []struct{ provider, option string }{
+	{"gemini", "api_key"},
+	{"openai", "openai_api_key"},
+	{"anthropic", "anthropic_api_key"},
+}
+
+// ProposeChanges merges findings into the options of a config file. The
+// first finding for an option wins and values the file already holds are
+// skipped. If the resulting provider has no API key but another provider
+// does, switching to that provider is proposed as well.
+func ProposeChanges(file map[string]interface{}, findings []Finding) []Change {
+	var changes []Change
+	merged := map[string]string{}
+	for k, v := range file {
+		if s, ok := v.(string); ok {
+			merged[k] = s
+		}
+	}
+	seen := map[string]bool{}
+	for _, f := range findings {
+		if seen[f.Option] {
+			continue
+		}
+		seen[f.Option] = true
+		if merged[f.Option] == f.Value {
+			continue
+		}
+		changes = append(changes, Change{Option: f.Option, Old: merged[f.Option], New: f.Value, Source: f.Source, Secret: f.Secret})
+		merged[f.Option] = f.Value
+	}
+
+	provider := merged["provider"]
+	if provider == "" {
+		provider = "gemini"
+	}
+	for _, p := range providerKeyOptions {
+		if p.provider == provider && merged[p.option] != "" {
+			return changes
+		}
+	}
+	for _, p := range providerKeyOptions {
+		if merged[p.option] == "" || seen["provider"] {
+			continue
+		}
+		changes = append(changes, Change{Option: "provider", Old: merged["provider"], New: p.provider, Source: p.option + " is set"})
+		break
+	}
+	return changes
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	home := t.TempDir()
+	os.WriteFile(filepath.Join(home, ".openai"), []byte("sk-from-dotfile\n"), 0600)
+	os.MkdirAll(filepath.Join(home, ".codex"), 0700)
+	os.WriteFile(filepath.Join(home, ".codex", "auth.json"), []byte(`{"OPENAI_API_KEY": "sk-from-codex"}`), 0600)
+	os.MkdirAll(filepath.Join(home, ".config", "gcloud"), 0700)
+	os.WriteFile(filepath.Join(home, ".config", "gcloud", "application_default_credentials.json"),
+		[]byte(`{"type": "authorized_user", "client_id": "cid.apps.googleusercontent.com", "client_secret": "csecret", "refresh_token": "r"}`), 0600)
+
+	env := map[string]string{
+		"ANTHROPIC_API_KEY": "sk-ant-env",
+		"https_proxy":       "http://proxy:3128",
+	}
+	uci := map[string]string{"lucicodex.@settings[0].model": "gemini-3-flash"}
+	found := Discover(DiscoverEnv{
+		Getenv: func(k string) string { return env[k] },
+		Home:   home,
+		UCI: func(k string) (string, error) {
+			if v, ok := uci[k]; ok {
+				return v, nil
+			}
+			return "", errors.New("not found")
+		},
+	})
+
+	want := []Finding{
+		{Option: "model", Value: "gemini-3-flash", Source: "uci lucicodex.@settings[0].model"},
+		{Option: "anthropic_api_key", Value: "sk-ant-env", Source: "$ANTHROPIC_API_KEY", Secret: true},
+		{Option: "https_proxy", Value: "http://proxy:3128", Source: "$https_proxy"},
+		{Option: "openai_api_key", Value: "sk-from-dotfile", Source: filepath.Join(home, ".openai"), Secret: true},
+		{Option: "openai_api_key", Value: "sk-from-codex", Source: filepath.Join(home, ".codex", "auth.json"), Secret: true},
+		{Option: "oauth_client_id", Value: "cid.apps.googleusercontent.com", Source: filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")},
+		{Option: "oauth_client_secret", Value: "csecret", Source: filepath.Join(home, ".config", "gcloud", "application_default_credentials.json"), Secret: true},
+	}
+	if len(found) != len(want) {
+		t.Fatalf("got %d findings, want %d: %+v", len(found), len(want), found)
+	}
+	for i := range want {
+		if found[i] != want[i] {
+			t.Errorf("finding %d = %+v, want %+v", i, found[i], want[i])
+		}
+	}
+}
+
+func TestReadKeyLike(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"bare":   "sk-bare",
+		"env":    "# keys\nexport OPENAI_API_KEY=\"sk-env\"\nOTHER=x\n",
+		"json":   `{"OPENAI_API_KEY": "sk-json"}`,
+		"other":  "OTHER=x\n",
+		"prose":  "not a key at all",
+		"jsonno": `{"tokens": {}}`,
+	}
+	want := map[string]string{"bare": "sk-bare", "env": "sk-env", "json": "sk-json"}
+	for name, content := range cases {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte(content), 0600)
+		if got := readKeyLike(p, "OPENAI_API_KEY"); got != want[name] {
+			t.Errorf("%s: got %q, want %q", name, got, want[name])
+		}
+	}
+	if got := readKeyLike(filepath.Join(dir, "missing"), "OPENAI_API_KEY"); got != "" {
+		t.Errorf("missing file: got %q", got)
+	}
+}
+
+func TestProposeChanges(t *testing.T) {
+	file := map[string]interface{}{"provider": "gemini", "model": "gemini-3-flash", "dry_run": true}
+	changes := ProposeChanges(file, []Finding{
+		{Option: "model", Value: "gemini-3-flash", Source: "uci"},
+		{Option: "openai_api_key", Value: "sk-1", Source: "$OPENAI_API_KEY", Secret: true},
+		{Option: "openai_api_key", Value: "sk-2", Source: "~/.openai", Secret: true},
+		{Option: "https_proxy", Value: "http://p:1", Source: "$HTTPS_PROXY"},
+	})
+	want := []Change{
+		{Option: "openai_api_key", New: "sk-1", Source: "$OPENAI_API_KEY", Secret: true},
+		{Option: "https_proxy", New: "http://p:1", Source: "$HTTPS_PROXY"},
+		{Option: "provider", Old: "gemini", New: "openai", Source: "openai_api_key is set"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("got %+v, want %+v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d = %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+
+	// No provider switch when the configured provider has a key
+	changes = ProposeChanges(map[string]interface{}{"api_key": "g"}, []Finding{{Option: "anthropic_api_key", Value: "a", Secret: true}})
+	if len(changes) != 1 || changes[0].Option != "anthropic_api_key" {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+}
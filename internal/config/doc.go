@@ -18,6 +18,10 @@
 //   - AnthropicAPIKey - Anthropic API key
 //   - DryRun         - Preview commands without execution
 //   - TimeoutSeconds - Per-command timeout
+//   - PlanTimeoutSeconds - Time budget of a whole plan
+//   - MinFreeMemoryMB, MaxLoad, MinFreeOverlayKB - Thresholds of the
+//     resource guard for heavy commands
+//   - ClarifyRounds  - Clarifying questions allowed before planning
 //   - MaxCommands    - Maximum commands per plan
 //
 // Example usage:
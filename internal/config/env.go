@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseCommandEnv splits a command_env entry, "<command>:NAME=value", into
+// the command it applies to ("*" for every command) and the variable.
+func ParseCommandEnv(entry string) (command, name, value string, err error) {
+	command, assignment, ok := strings.Cut(entry, ":")
+	if ok {
+		name, value, ok = strings.Cut(assignment, "=")
+	}
+	if !ok || command == "" || strings.Contains(command, "/") {
+		return "", "", "", fmt.Errorf("invalid command_env entry %q: must be <command>:NAME=value", entry)
+	}
+	if err := checkEnvName(name); err != nil {
+		return "", "", "", fmt.Errorf("invalid command_env entry %q: %v", entry, err)
+	}
+	return command, name, value, nil
+}
+
+// checkEnvName accepts names of environment variables that commands may be
+// given. PATH is always set, and the dynamic loader variables would let a
+// config entry inject code into every command.
+func checkEnvName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty variable name")
+	}
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return fmt.Errorf("invalid variable name %q", name)
+		}
+	}
+	if name == "PATH" || strings.HasPrefix(name, "LD_") {
+		return fmt.Errorf("%s cannot be set", name)
+	}
+	return nil
+}
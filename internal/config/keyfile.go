@@ -0,0 +1,144 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrInsecureKeyFile is returned for key files readable by group or others.
+var ErrInsecureKeyFile = errors.New("key file must only be accessible by its owner (chmod 600)")
+
+// Key file entries, named like the environment variables they stand in for.
+const (
+	KeyGemini    = "GEMINI_API_KEY"
+	KeyOpenAI    = "OPENAI_API_KEY"
+	KeyAnthropic = "ANTHROPIC_API_KEY"
+)
+
+// ProviderKeyName returns the key file entry holding provider's API key.
+func ProviderKeyName(provider string) string {
+	switch provider {
+	case "openai":
+		return KeyOpenAI
+	case "anthropic":
+		return KeyAnthropic
+	default:
+		return KeyGemini
+	}
+}
+
+// ReadKeyFile parses a key file of NAME=value lines. Blank lines and lines
+// starting with # are ignored.
+func ReadKeyFile(path string) (map[string]string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("api_key_file: %w", err)
+	}
+	if st.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("api_key_file %s: %w", path, ErrInsecureKeyFile)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("api_key_file: %w", err)
+	}
+	defer f.Close()
+
+	keys := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("api_key_file %s: malformed line %q", path, name)
+		}
+		keys[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return keys, sc.Err()
+}
+
+// WriteKeyFile stores keys in path with mode 0600, keeping entries of an
+// existing file that keys does not replace.
+func WriteKeyFile(path string, keys map[string]string) error {
+	merged := map[string]string{}
+	if _, err := os.Stat(path); err == nil {
+		existing, err := ReadKeyFile(path)
+		if err != nil {
+			return err
+		}
+		merged = existing
+	}
+	for name, value := range keys {
+		merged[name] = value
+	}
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("# LuciCodex API keys\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%s\n", name, merged[name])
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// applyKeyFile fills the API keys from cfg.APIKeyFile.
+func (cfg *Config) applyKeyFile() error {
+	keys, err := ReadKeyFile(cfg.APIKeyFile)
+	if err != nil {
+		return err
+	}
+	if v := keys[KeyGemini]; v != "" {
+		cfg.APIKey = v
+	}
+	if v := keys[KeyOpenAI]; v != "" {
+		cfg.OpenAIAPIKey = v
+	}
+	if v := keys[KeyAnthropic]; v != "" {
+		cfg.AnthropicAPIKey = v
+	}
+	return nil
+}
+
+// lookupEnv returns the trimmed value of the environment variable name or,
+// if it is unset, the trimmed contents of the file named by name_FILE.
+func lookupEnv(name string) (string, error) {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v, nil
+	}
+	path := strings.TrimSpace(os.Getenv(name + "_FILE"))
+	if path == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyFile_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := WriteKeyFile(path, map[string]string{KeyGemini: "g-1", KeyOpenAI: "o-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKeyFile(path, map[string]string{KeyOpenAI: "o-2"}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(path)
+	if err != nil || st.Mode().Perm() != 0o600 {
+		t.Fatalf("expected mode 0600, got %v, %v", st, err)
+	}
+	keys, err := ReadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[KeyGemini] != "g-1" || keys[KeyOpenAI] != "o-2" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+
+	os.Chmod(path, 0o644)
+	if _, err := ReadKeyFile(path); !errors.Is(err, ErrInsecureKeyFile) {
+		t.Errorf("expected ErrInsecureKeyFile, got %v", err)
+	}
+}
+
+func TestLoad_KeyFileAndEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys")
+	os.WriteFile(keyFile, []byte("# keys\nANTHROPIC_API_KEY = file-anthropic\nGEMINI_API_KEY=file-gemini\n"), 0o600)
+	cfgPath := filepath.Join(dir, "config.json")
+	os.WriteFile(cfgPath, []byte(`{"api_key": "json-gemini", "api_key_file": "`+keyFile+`"}`), 0o600)
+
+	secret := filepath.Join(dir, "openai")
+	os.WriteFile(secret, []byte("env-file-openai\n"), 0o600)
+	t.Setenv("GEMINI_API_KEY", "")
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("OPENAI_API_KEY_FILE", secret)
+
+	cfg, err := Load(cfgPath)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.APIKey != "file-gemini" || cfg.AnthropicAPIKey != "file-anthropic" {
+		t.Errorf("key file not applied: %q %q", cfg.APIKey, cfg.AnthropicAPIKey)
+	}
+	if cfg.OpenAIAPIKey != "env-file-openai" {
+		t.Errorf("OPENAI_API_KEY_FILE not applied: %q", cfg.OpenAIAPIKey)
+	}
+
+	t.Setenv("OPENAI_API_KEY", "env-openai")
+	if cfg, _ := Load(cfgPath); cfg.OpenAIAPIKey != "env-openai" {
+		t.Errorf("variable should win over its _FILE form, got %q", cfg.OpenAIAPIKey)
+	}
+
+	t.Setenv("GEMINI_API_KEY_FILE", filepath.Join(dir, "missing"))
+	if _, err := Load(cfgPath); err == nil {
+		t.Error("expected error for unreadable GEMINI_API_KEY_FILE")
+	}
+}
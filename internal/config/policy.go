@@ -0,0 +1,53 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SystemPolicyDir holds the system policy files, one layer each (see
+// PolicyLayer). It is not an option, so that a user configuration cannot
+// point it elsewhere.
+var SystemPolicyDir = "/etc/lucicodex/policy.d"
+
+// PolicyLayer is a system policy file: policy entries shipped with a package
+// or managed centrally. The policy engine checks every command against each
+// layer and against the policy options of the configuration, which can only
+// restrict what the layers allow, never loosen it.
+type PolicyLayer struct {
+	Origin      string   `json:"-"` // Path of the file
+	Allowlist   []string `json:"allowlist"`
+	Denylist    []string `json:"denylist"`
+	Warnlist    []string `json:"warnlist"`
+	PolicyRules []string `json:"policy_rules"`
+	// StrictPrivileges enables strict_privileges whatever the configuration says
+	StrictPrivileges bool `json:"strict_privileges"`
+}
+
+// LoadSystemPolicy reads the *.json files of dir in name order. A missing
+// directory has no layers; a file that cannot be read or parsed is an
+// error, so that a broken system policy is not silently dropped.
+func LoadSystemPolicy(dir string) ([]PolicyLayer, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	var layers []PolicyLayer
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("system policy: %w", err)
+		}
+		var l PolicyLayer
+		if err := json.Unmarshal(b, &l); err != nil {
+			return nil, fmt.Errorf("system policy %s: %w", p, err)
+		}
+		l.Origin = p
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
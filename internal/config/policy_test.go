@@ -0,0 +1,50 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSystemPolicy(t *testing.T) {
+	dir := t.TempDir()
+	if layers, err := LoadSystemPolicy(filepath.Join(dir, "missing")); err != nil || len(layers) != 0 {
+		t.Fatalf("a missing directory has no layers: %v, %v", layers, err)
+	}
+	os.WriteFile(filepath.Join(dir, "20-site.json"), []byte(`{"warnlist": ["^reboot"]}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "10-base.json"), []byte(`{"denylist": ["^firstboot"], "strict_privileges": true}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "README"), []byte("not a layer"), 0o644)
+
+	layers, err := LoadSystemPolicy(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 || layers[0].Origin != filepath.Join(dir, "10-base.json") || layers[0].Denylist[0] != "^firstboot" || !layers[0].StrictPrivileges || layers[1].Warnlist[0] != "^reboot" {
+		t.Errorf("unexpected layers: %+v", layers)
+	}
+
+	os.WriteFile(filepath.Join(dir, "30-broken.json"), []byte(`{"denylist": [`), 0o644)
+	if _, err := LoadSystemPolicy(dir); err == nil || !strings.Contains(err.Error(), "30-broken.json") {
+		t.Errorf("a broken file should fail loading, got %v", err)
+	}
+}
+
+func TestLoad_SystemPolicy(t *testing.T) {
+	dir := t.TempDir()
+	old := SystemPolicyDir
+	SystemPolicyDir = dir
+	defer func() { SystemPolicyDir = old }()
+	os.WriteFile(filepath.Join(dir, "base.json"), []byte(`{"denylist": ["^firstboot"]}`), 0o644)
+
+	// The configuration cannot replace the system layers
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"api_key": "k", "SystemPolicy": [], "system_policy": []}`), 0o600)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.SystemPolicy) != 1 || cfg.SystemPolicy[0].Denylist[0] != "^firstboot" {
+		t.Errorf("unexpected system policy: %+v", cfg.SystemPolicy)
+	}
+}
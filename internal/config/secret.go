@@ -0,0 +1,228 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EncryptedPrefix marks an API key encrypted with EncryptSecret. Such values
+// may stand anywhere a plain key does: the JSON config, UCI, the key file or
+// the environment.
+const EncryptedPrefix = "enc:v1:"
+
+// ErrNoDeviceKey is returned when no machine ID is available to derive the
+// encryption key from.
+var ErrNoDeviceKey = errors.New("no machine ID found to derive the key encryption key")
+
+// ErrUndecryptable is returned for encrypted keys that do not decrypt on this
+// device, e.g. keys restored from another router's backup.
+var ErrUndecryptable = errors.New("cannot decrypt API key: it was encrypted on another device or is corrupt")
+
+// machineIDPaths are read in order for the device identity keys are bound
+// to. OpenWrt has no machine-id, so the MAC address of eth0 follows.
+var machineIDPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id", "/sys/class/net/eth0/address"}
+
+// saltSize is the length of the random salt stored with every value.
+const saltSize = 16
+
+// deviceKey derives the AES-256 key for salt from the machine ID.
+func deviceKey(salt []byte) ([]byte, error) {
+	for _, p := range machineIDPaths {
+		b, err := os.ReadFile(p)
+		if id := strings.TrimSpace(string(b)); err == nil && id != "" {
+			h := sha256.New()
+			h.Write([]byte("lucicodex-keys-v1\x00"))
+			h.Write([]byte(id))
+			h.Write(salt)
+			return h.Sum(nil), nil
+		}
+	}
+	return nil, ErrNoDeviceKey
+}
+
+// IsEncrypted reports whether s was produced by EncryptSecret.
+func IsEncrypted(s string) bool {
+	return strings.HasPrefix(s, EncryptedPrefix)
+}
+
+// EncryptSecret encrypts plain with AES-GCM under a key derived from this
+// device's machine ID and a random salt. The result only decrypts here, so
+// a copied config file or backup does not reveal the key.
+func EncryptSecret(plain string) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	gcm, err := deviceCipher(salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	blob := append(append(salt, nonce...), gcm.Seal(nil, nonce, []byte(plain), nil)...)
+	return EncryptedPrefix + base64.RawStdEncoding.EncodeToString(blob), nil
+}
+
+// DecryptSecret returns the plain value of s, or s itself if it is not
+// encrypted.
+func DecryptSecret(s string) (string, error) {
+	if !IsEncrypted(s) {
+		return s, nil
+	}
+	blob, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(s, EncryptedPrefix))
+	if err != nil || len(blob) < saltSize {
+		return "", ErrUndecryptable
+	}
+	gcm, err := deviceCipher(blob[:saltSize])
+	if err != nil {
+		return "", err
+	}
+	rest := blob[saltSize:]
+	if len(rest) < gcm.NonceSize() {
+		return "", ErrUndecryptable
+	}
+	plain, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", ErrUndecryptable
+	}
+	return string(plain), nil
+}
+
+func deviceCipher(salt []byte) (cipher.AEAD, error) {
+	key, err := deviceKey(salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptKeys replaces encrypted API keys with their plain values.
+func (cfg *Config) decryptKeys() error {
+	for _, key := range []*string{&cfg.APIKey, &cfg.OpenAIAPIKey, &cfg.AnthropicAPIKey} {
+		plain, err := DecryptSecret(*key)
+		if err != nil {
+			return err
+		}
+		*key = plain
+	}
+	return nil
+}
+
+// Options holding API keys, in the JSON config and in UCI.
+var (
+	keyOptions    = []string{"api_key", "openai_api_key", "anthropic_api_key"}
+	uciKeyOptions = []string{"key", "openai_key", "anthropic_key"}
+	uciSections   = []string{"main", "@settings[0]", "@api[0]"}
+)
+
+// EncryptStoredKeys encrypts the plain API keys kept in the JSON config at
+// path, in the key file it names and in UCI, and returns where it did so.
+// Keys that are already encrypted are left alone.
+func EncryptStoredKeys(path string) ([]string, error) {
+	var done []string
+	path = FilePath(path)
+
+	keyFile := ""
+	if path != "" && fileExists(path) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return done, err
+		}
+		file := map[string]interface{}{}
+		if err := json.Unmarshal(b, &file); err != nil {
+			return done, fmt.Errorf("%s: %w", path, err)
+		}
+		keyFile, _ = file["api_key_file"].(string)
+		changed := false
+		for _, option := range keyOptions {
+			v, _ := file[option].(string)
+			if v == "" || IsEncrypted(v) {
+				continue
+			}
+			enc, err := EncryptSecret(v)
+			if err != nil {
+				return done, err
+			}
+			file[option] = enc
+			changed = true
+			done = append(done, path+": "+option)
+		}
+		if changed {
+			data, err := json.MarshalIndent(file, "", "  ")
+			if err != nil {
+				return done, err
+			}
+			if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+				return done, err
+			}
+		}
+	}
+
+	for _, section := range uciSections {
+		if v, _ := uciGet("lucicodex." + section + ".api_key_file"); v != "" && keyFile == "" {
+			keyFile = v
+		}
+	}
+	if keyFile != "" && fileExists(keyFile) {
+		keys, err := ReadKeyFile(keyFile)
+		if err != nil {
+			return done, err
+		}
+		update := map[string]string{}
+		for _, name := range []string{KeyGemini, KeyOpenAI, KeyAnthropic} {
+			if v := keys[name]; v != "" && !IsEncrypted(v) {
+				enc, err := EncryptSecret(v)
+				if err != nil {
+					return done, err
+				}
+				update[name] = enc
+				done = append(done, keyFile+": "+name)
+			}
+		}
+		if len(update) > 0 {
+			if err := WriteKeyFile(keyFile, update); err != nil {
+				return done, err
+			}
+		}
+	}
+
+	changed := false
+	for _, section := range uciSections {
+		for _, option := range uciKeyOptions {
+			key := "lucicodex." + section + "." + option
+			v, err := uciGet(key)
+			if err != nil || v == "" || IsEncrypted(v) {
+				continue
+			}
+			enc, err := EncryptSecret(v)
+			if err != nil {
+				return done, err
+			}
+			if err := uciRun("set", key+"="+enc); err != nil {
+				return done, fmt.Errorf("uci set %s: %w", key, err)
+			}
+			changed = true
+			done = append(done, "uci: "+key)
+		}
+	}
+	if changed {
+		if err := uciRun("commit", "lucicodex"); err != nil {
+			return done, fmt.Errorf("uci commit: %w", err)
+		}
+	}
+	return done, nil
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withMachineID binds key encryption to id for the rest of the test.
+func withMachineID(t *testing.T, id string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "machine-id")
+	os.WriteFile(path, []byte(id+"\n"), 0o644)
+	orig := machineIDPaths
+	machineIDPaths = []string{filepath.Join(t.TempDir(), "missing"), path}
+	t.Cleanup(func() { machineIDPaths = orig })
+}
+
+func TestEncryptSecret(t *testing.T) {
+	withMachineID(t, "router-a")
+	enc, err := EncryptSecret("sk-123")
+	if err != nil || !IsEncrypted(enc) || strings.Contains(enc, "sk-123") {
+		t.Fatalf("EncryptSecret = %q, %v", enc, err)
+	}
+	if again, _ := EncryptSecret("sk-123"); again == enc {
+		t.Error("encrypting twice gave the same ciphertext")
+	}
+	if plain, err := DecryptSecret(enc); err != nil || plain != "sk-123" {
+		t.Errorf("DecryptSecret = %q, %v", plain, err)
+	}
+	if plain, err := DecryptSecret("sk-plain"); err != nil || plain != "sk-plain" {
+		t.Errorf("plain value changed: %q, %v", plain, err)
+	}
+	if _, err := DecryptSecret(EncryptedPrefix + "bm9ub25zZW5zZQ"); !errors.Is(err, ErrUndecryptable) {
+		t.Errorf("corrupt value: %v", err)
+	}
+
+	withMachineID(t, "router-b")
+	if _, err := DecryptSecret(enc); !errors.Is(err, ErrUndecryptable) {
+		t.Errorf("decrypted on another device: %v", err)
+	}
+
+	machineIDPaths = nil
+	if _, err := EncryptSecret("sk-123"); !errors.Is(err, ErrNoDeviceKey) {
+		t.Errorf("without machine ID: %v", err)
+	}
+}
+
+func TestEncryptStoredKeys(t *testing.T) {
+	withMachineID(t, "router-a")
+	t.Setenv("GEMINI_API_KEY", "")
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "keys")
+	os.WriteFile(keyFile, []byte("OPENAI_API_KEY=sk-openai\n"), 0o600)
+	cfgPath := filepath.Join(dir, "config.json")
+	os.WriteFile(cfgPath, []byte(`{"api_key": "g-key", "api_key_file": "`+keyFile+`", "max_commands": 7}`), 0o600)
+
+	done, err := EncryptStoredKeys(cfgPath)
+	if err != nil || len(done) != 2 {
+		t.Fatalf("EncryptStoredKeys = %v, %v", done, err)
+	}
+	b, _ := os.ReadFile(cfgPath)
+	var file map[string]interface{}
+	json.Unmarshal(b, &file)
+	if s, _ := file["api_key"].(string); !IsEncrypted(s) || file["max_commands"] != 7.0 {
+		t.Errorf("config file = %s", b)
+	}
+	if keys, _ := ReadKeyFile(keyFile); !IsEncrypted(keys[KeyOpenAI]) {
+		t.Errorf("key file = %v", keys)
+	}
+
+	cfg, err := Load(cfgPath)
+	if err != nil || cfg.APIKey != "g-key" || cfg.OpenAIAPIKey != "sk-openai" {
+		t.Fatalf("Load = %q %q, %v", cfg.APIKey, cfg.OpenAIAPIKey, err)
+	}
+	if done, err := EncryptStoredKeys(cfgPath); err != nil || len(done) != 0 {
+		t.Errorf("second run = %v, %v", done, err)
+	}
+
+	withMachineID(t, "router-b")
+	if _, err := Load(cfgPath); !errors.Is(err, ErrUndecryptable) {
+		t.Errorf("Load on another device: %v", err)
+	}
+}
@@ -79,6 +79,24 @@ func TestHelperProcess(t *testing.T) {
 				fmt.Print("123")
 			case "lucicodex.main.max_commands":
 				fmt.Print("456")
+			case "lucicodex.main.max_read_commands":
+				fmt.Print("30")
+			case "lucicodex.main.max_write_commands":
+				fmt.Print("0")
+			case "lucicodex.main.temperature":
+				fmt.Print("0.4")
+			case "lucicodex.main.min_free_memory":
+				fmt.Print("8")
+			case "lucicodex.main.max_load":
+				fmt.Print("1.5")
+			case "lucicodex.main.resource_wait":
+				fmt.Print("0")
+			case "lucicodex.main.low_priority":
+				fmt.Print("1")
+			case "lucicodex.main.thinking_budget":
+				fmt.Print("2048")
+			case "lucicodex.main.reasoning_effort":
+				fmt.Print("medium")
 			case "lucicodex.main.log_file":
 				fmt.Print("/tmp/uci.log")
 			case "lucicodex.main.http_proxy":
@@ -348,6 +366,18 @@ func TestLoad_UCI_AllFields(t *testing.T) {
 	if cfg.MaxCommands != 456 {
 		t.Errorf("got MaxCommands %d", cfg.MaxCommands)
 	}
+	if cfg.MaxReadCommands != 30 || cfg.MaxWriteCommands != 0 {
+		t.Errorf("got MaxReadCommands %d, MaxWriteCommands %d", cfg.MaxReadCommands, cfg.MaxWriteCommands)
+	}
+	if cfg.MinFreeMemoryMB != 8 || cfg.MaxLoad != 1.5 || cfg.MinFreeOverlayKB != 1024 || cfg.ResourceWait != 0 || !cfg.LowPriority {
+		t.Errorf("got resource guard %d MB, load %g, %d KB, wait %d, low priority %v", cfg.MinFreeMemoryMB, cfg.MaxLoad, cfg.MinFreeOverlayKB, cfg.ResourceWait, cfg.LowPriority)
+	}
+	if cfg.Temperature == nil || *cfg.Temperature != 0.4 || cfg.TopP != nil {
+		t.Errorf("got Temperature %v, TopP %v", cfg.Temperature, cfg.TopP)
+	}
+	if cfg.ThinkingBudget != 2048 || cfg.ReasoningEffort != "medium" {
+		t.Errorf("got ThinkingBudget %d, ReasoningEffort %q", cfg.ThinkingBudget, cfg.ReasoningEffort)
+	}
 	if cfg.LogFile != "/tmp/uci.log" {
 		t.Errorf("got LogFile %q", cfg.LogFile)
 	}
@@ -461,3 +491,26 @@ func TestUciGetRobustness(t *testing.T) {
 		}
 	})
 }
+
+func TestSetUCI(t *testing.T) {
+	var calls []string
+	oldExecCommand := execCommand
+	execCommand = func(command string, args ...string) *exec.Cmd {
+		calls = append(calls, fmt.Sprint(args))
+		return fakeExecCommand(command, args...)
+	}
+	defer func() { execCommand = oldExecCommand }()
+
+	if err := SetUCI(map[string]string{"provider": "openai", "dry_run": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"[-q set lucicodex.main=settings]",
+		"[-q set lucicodex.main.dry_run=1]",
+		"[-q set lucicodex.main.provider=openai]",
+		"[-q commit lucicodex]",
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
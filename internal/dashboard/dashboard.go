@@ -0,0 +1,145 @@
+// Package dashboard gathers and draws what `lucicodex top` shows: the
+// daemon's health, the execution in progress with its live output, the
+// scheduler's jobs and pending rollback, recent LLM latency and recent
+// executions. Collect reads it from the files of the local installation;
+// the daemon serves the same Snapshot at /v1/dashboard.
+package dashboard
+
+import (
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/jobs"
+	"github.com/aezizhu/LuciCodex/internal/live"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
+	"github.com/aezizhu/LuciCodex/internal/rollback"
+)
+
+// How much of each list a snapshot holds.
+const (
+	RecentExecutions = 8
+	QueuedJobs       = 8
+	LatencySamples   = 40
+)
+
+// Snapshot is the dashboard at one point in time.
+type Snapshot struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"` // "local" or the daemon's address
+	// Daemon is the daemon's health; DaemonError says why it is unknown
+	Daemon      *Health           `json:"daemon,omitempty"`
+	DaemonError string            `json:"daemon_error,omitempty"`
+	Running     *Running          `json:"running,omitempty"` // Nil when no execution holds the lock
+	Jobs        []jobs.Job        `json:"jobs"`              // Running jobs first, then the newest
+	Rollback    *rollback.State   `json:"rollback,omitempty"`
+	Latency     []metrics.Sample  `json:"latency"` // Oldest first
+	Recent      []Execution       `json:"recent"`  // Newest first
+	Errors      map[string]string `json:"errors,omitempty"`
+}
+
+// Health is the answer of the daemon's /health?verbose=1.
+type Health struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks"`
+}
+
+// Check is one check of Health.
+type Check struct {
+	Status  string      `json:"status"`
+	Message string      `json:"message,omitempty"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// Running is the execution holding the execution lock.
+type Running struct {
+	Owner string `json:"owner"` // e.g. "cli", "daemon" or "mcp:<client>"
+	PID   int    `json:"pid"`
+	// The plan logged last, if it has no results yet
+	ID       string    `json:"id,omitempty"`
+	Prompt   string    `json:"prompt,omitempty"`
+	Started  time.Time `json:"started,omitempty"`
+	Commands []string  `json:"commands,omitempty"`
+	// The command running or run last, if the holder publishes it
+	Live *live.Status `json:"live,omitempty"`
+}
+
+// Execution is one entry of the audit log.
+type Execution struct {
+	ID       string    `json:"id,omitempty"`
+	Time     time.Time `json:"time"`
+	Status   string    `json:"status"`
+	Prompt   string    `json:"prompt"`
+	Commands int       `json:"commands"`
+	Actor    string    `json:"actor,omitempty"`
+}
+
+// Collect reads the snapshot from the execution lock, the live feed, the
+// audit log, the job records, the rollback state and the metrics rollups of
+// cfg. Daemon is left to the caller. Sources that cannot be read are named
+// in Errors.
+func Collect(cfg config.Config) Snapshot {
+	s := Snapshot{Time: time.Now(), Source: "local", Jobs: []jobs.Job{}, Latency: []metrics.Sample{}, Recent: []Execution{}}
+	failed := func(source string, err error) {
+		if s.Errors == nil {
+			s.Errors = map[string]string{}
+		}
+		s.Errors[source] = err.Error()
+	}
+
+	var history []logging.HistoryEntry
+	if cfg.LogFile != "" {
+		var err error
+		if history, err = logging.History(cfg); err != nil {
+			failed("history", err)
+		}
+	}
+	for i := len(history) - 1; i >= 0 && len(s.Recent) < RecentExecutions; i-- {
+		h := history[i]
+		s.Recent = append(s.Recent, Execution{ID: h.ID, Time: h.Time, Status: h.Status(), Prompt: h.Prompt, Commands: len(h.Plan.Commands), Actor: h.Actor})
+	}
+
+	if owner, pid, held := execlock.Current(); held {
+		r := &Running{Owner: owner, PID: pid}
+		if n := len(history); n > 0 && history[n-1].Status() == "planned" {
+			h := history[n-1]
+			r.ID, r.Prompt, r.Started = h.ID, h.Prompt, h.Time
+			for _, c := range h.Plan.Commands {
+				r.Commands = append(r.Commands, executor.FormatPlanned(c))
+			}
+		}
+		if st, err := live.Read(); err == nil && st.PID == pid {
+			r.Live = &st
+		}
+		s.Running = r
+	}
+
+	if list, err := jobs.Open(cfg).List(); err != nil {
+		failed("jobs", err)
+	} else {
+		for _, j := range list {
+			if j.State == jobs.StateRunning && len(s.Jobs) < QueuedJobs {
+				s.Jobs = append(s.Jobs, j)
+			}
+		}
+		for _, j := range list {
+			if j.State != jobs.StateRunning && len(s.Jobs) < QueuedJobs {
+				s.Jobs = append(s.Jobs, j)
+			}
+		}
+	}
+	if st, pending, err := rollback.Pending(cfg.RollbackDir); err != nil {
+		failed("rollback", err)
+	} else if pending {
+		s.Rollback = &st
+	}
+
+	if samples, err := metrics.OpenRollupStore(cfg).Recent(LatencySamples); err != nil {
+		failed("metrics", err)
+	} else if samples != nil {
+		s.Latency = samples
+	}
+	return s
+}
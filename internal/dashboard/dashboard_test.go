@@ -0,0 +1,89 @@
+package dashboard
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
+	"github.com/aezizhu/LuciCodex/internal/live"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestSparkline(t *testing.T) {
+	if got := Sparkline([]float64{100, 200, 800, 450}); got != "▁▂█▄" {
+		t.Errorf("unexpected sparkline %q", got)
+	}
+	if got := Sparkline([]float64{5, 5}); got != "▁▁" {
+		t.Errorf("expected a flat line for equal values, got %q", got)
+	}
+	if got := Sparkline(nil); got != "" {
+		t.Errorf("expected nothing for no values, got %q", got)
+	}
+}
+
+var ansi = regexp.MustCompile("\033\\[[0-9;]*[A-Za-z]")
+
+func TestCollectAndRender(t *testing.T) {
+	dir := t.TempDir()
+	oldPaths, oldLive := execlock.Paths, live.Path
+	defer func() { execlock.Paths, live.Path = oldPaths, oldLive }()
+	execlock.Paths = []string{filepath.Join(dir, "lucicodex.lock")}
+	live.Path = filepath.Join(dir, "live.json")
+
+	cfg := config.Config{LogFile: filepath.Join(dir, "audit.log"), JobsDir: filepath.Join(dir, "jobs"), RollbackDir: filepath.Join(dir, "rollback"), MetricsDir: filepath.Join(dir, "metrics")}
+	s := Collect(cfg)
+	if s.Running != nil || len(s.Recent) != 0 || len(s.Jobs) != 0 || len(s.Latency) != 0 || s.Errors != nil {
+		t.Fatalf("expected an empty dashboard, got %+v", s)
+	}
+
+	l := logging.Open(cfg)
+	l.Plan("show the time", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"date"}}}})
+	l.Results([]logging.ResultItem{{Command: []string{"date"}, Output: "Mon"}})
+	l.Plan("restart wifi", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "down"}}, {Command: []string{"wifi", "up"}}}})
+	store := metrics.OpenRollupStore(cfg)
+	store.Record("gemini", 1, 300*time.Millisecond, nil)
+	store.Record("gemini", 1, 900*time.Millisecond, errors.New("timeout"))
+	lock, err := execlock.Acquire("cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+	live.Start(0, "wifi down").Finish("radio0 disabled\n", false)
+	live.Start(1, "wifi up")
+
+	s = Collect(cfg)
+	r := s.Running
+	if r == nil || r.Owner != "cli" || r.Prompt != "restart wifi" || len(r.Commands) != 2 || r.Live == nil || r.Live.Index != 1 {
+		t.Fatalf("unexpected running execution %+v", r)
+	}
+	if len(s.Recent) != 2 || s.Recent[0].Prompt != "restart wifi" || s.Recent[1].Status != "ok" {
+		t.Errorf("unexpected recent executions %+v", s.Recent)
+	}
+	if len(s.Latency) != 2 || !s.Latency[1].Failed {
+		t.Errorf("unexpected latency samples %+v", s.Latency)
+	}
+
+	var b strings.Builder
+	Render(&b, s, 80)
+	out := ansi.ReplaceAllString(b.String(), "")
+	for _, want := range []string{
+		"running held by cli",
+		"Prompt: restart wifi",
+		"✓ [1] wifi down",
+		"▶ [2] wifi up",
+		"gemini     ▁█  last 900ms, avg 600ms over 2, 1 failed",
+		"ok       show the time",
+		"no background jobs",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package dashboard
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// ClearScreen moves the cursor home and clears the terminal, before each
+// frame of `lucicodex top`.
+const ClearScreen = "\033[H\033[2J"
+
+// OutputLines is how many lines of the running command's output Render shows.
+const OutputLines = 8
+
+// sparks are the levels of a sparkline, lowest first.
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// Sparkline draws values as one character each, scaled between the lowest
+// and the highest.
+func Sparkline(values []float64) string {
+	if len(values) == 0 {
+		return ""
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	out := make([]rune, len(values))
+	for i, v := range values {
+		level := 0
+		if hi > lo {
+			level = int((v - lo) / (hi - lo) * float64(len(sparks)-1))
+		}
+		out[i] = sparks[level]
+	}
+	return string(out)
+}
+
+// statusColor pads status to width and colors it: green for ok and
+// running, yellow for degraded and for plans that did not run, red for
+// failures.
+func statusColor(status string, width int) string {
+	padded := fmt.Sprintf("%-*s", width, status)
+	switch status {
+	case "ok", "running":
+		return ui.Colorize(ui.Green, padded)
+	case "degraded", "planned", "rejected", "stopped":
+		return ui.Colorize(ui.Yellow, padded)
+	case "failed":
+		return ui.Colorize(ui.Red, padded)
+	}
+	return padded
+}
+
+// clip fits s on one line of width columns.
+func clip(s string, width int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); width > 3 && len(r) > width {
+		return string(r[:width-3]) + "..."
+	}
+	return s
+}
+
+// Render draws s for a terminal of width columns.
+func Render(w io.Writer, s Snapshot, width int) {
+	heading := func(title string) {
+		fmt.Fprintf(w, "\n%s\n", ui.Colorize(ui.Bold, title))
+	}
+	fmt.Fprintf(w, "%s  %s  %s\n", ui.Colorize(ui.Bold, "LuciCodex top"), s.Source, s.Time.Local().Format("2006-01-02 15:04:05"))
+
+	switch {
+	case s.Daemon != nil:
+		fmt.Fprintf(w, "Daemon: %s", statusColor(s.Daemon.Status, 0))
+		names := make([]string, 0, len(s.Daemon.Checks))
+		for name := range s.Daemon.Checks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var notes []string
+		for _, name := range names {
+			if c := s.Daemon.Checks[name]; c.Status != "ok" || name == "lock" && c.Message != "" {
+				notes = append(notes, fmt.Sprintf("%s %s: %s", name, c.Status, c.Message))
+			}
+		}
+		if len(notes) == 0 {
+			fmt.Fprintf(w, " (%d checks passed)\n", len(names))
+		} else {
+			fmt.Fprintln(w)
+			for _, n := range notes {
+				fmt.Fprintf(w, "  %s\n", clip(n, width-2))
+			}
+		}
+	case s.DaemonError != "":
+		fmt.Fprintf(w, "Daemon: %s (%s)\n", ui.Colorize(ui.Red, "not reachable"), clip(s.DaemonError, width-25))
+	}
+	for _, source := range sortedKeys(s.Errors) {
+		fmt.Fprintf(w, "%s %s\n", ui.Colorize(ui.Yellow, "Cannot read "+source+":"), clip(s.Errors[source], width-len(source)-13))
+	}
+
+	heading("Execution")
+	if r := s.Running; r == nil {
+		fmt.Fprintln(w, "  idle")
+	} else {
+		fmt.Fprintf(w, "  %s held by %s (pid %d)", ui.Colorize(ui.Green, "running"), r.Owner, r.PID)
+		if r.ID != "" {
+			fmt.Fprintf(w, ", execution %s for %s", r.ID, s.Time.Sub(r.Started).Round(time.Second))
+		}
+		fmt.Fprintln(w)
+		if r.Prompt != "" {
+			fmt.Fprintf(w, "  %s\n", clip("Prompt: "+r.Prompt, width-2))
+		}
+		current := -1
+		if r.Live != nil {
+			current = r.Live.Index
+		}
+		for i, c := range r.Commands {
+			mark := " "
+			switch {
+			case i < current || i == current && !r.Live.Running && !r.Live.Failed:
+				mark = ui.Colorize(ui.Green, "✓")
+			case i == current && r.Live.Running:
+				mark = ui.Colorize(ui.Blue, "▶")
+			case i == current:
+				mark = ui.Colorize(ui.Red, "✗")
+			}
+			fmt.Fprintf(w, "  %s %s\n", mark, clip(fmt.Sprintf("[%d] %s", i+1, c), width-4))
+		}
+		if l := r.Live; l != nil {
+			if len(r.Commands) == 0 {
+				state := "finished"
+				if l.Running {
+					state = "running for " + s.Time.Sub(l.Started).Round(time.Second).String()
+				}
+				fmt.Fprintf(w, "  %s\n", clip(fmt.Sprintf("[%d] %s (%s)", l.Index+1, l.Command, state), width-2))
+			}
+			lines := strings.Split(strings.TrimRight(l.Output, "\n"), "\n")
+			if len(lines) > OutputLines {
+				lines = lines[len(lines)-OutputLines:]
+			}
+			for _, line := range lines {
+				if line != "" {
+					fmt.Fprintf(w, "    │ %s\n", clip(line, width-6))
+				}
+			}
+		}
+	}
+
+	heading("Scheduler")
+	if s.Rollback != nil {
+		fmt.Fprintf(w, "  %s network change %s reverts in %s unless confirmed\n", ui.Colorize(ui.Yellow, "rollback"), s.Rollback.ID, s.Rollback.Deadline.Sub(s.Time).Round(time.Second))
+	}
+	if len(s.Jobs) == 0 {
+		fmt.Fprintln(w, "  no background jobs")
+	}
+	for _, j := range s.Jobs {
+		age := s.Time.Sub(j.Started).Round(time.Second)
+		if j.Ended != nil {
+			age = j.Ended.Sub(j.Started).Round(time.Second)
+		}
+		fmt.Fprintf(w, "  %-18s %s %-8s %s\n", j.ID, statusColor(j.State, 7), age, clip(strings.Join(j.Command, " "), width-40))
+	}
+
+	heading("LLM latency")
+	if len(s.Latency) == 0 {
+		fmt.Fprintln(w, "  no requests recorded")
+	}
+	var providers []string
+	byProvider := map[string][]float64{}
+	failures := map[string]int{}
+	for _, sample := range s.Latency {
+		if byProvider[sample.Provider] == nil {
+			providers = append(providers, sample.Provider)
+		}
+		byProvider[sample.Provider] = append(byProvider[sample.Provider], float64(sample.Duration)/float64(time.Millisecond))
+		if sample.Failed {
+			failures[sample.Provider]++
+		}
+	}
+	sort.Strings(providers)
+	for _, name := range providers {
+		ms := byProvider[name]
+		var sum float64
+		for _, v := range ms {
+			sum += v
+		}
+		line := fmt.Sprintf("  %-10s %s  last %.0fms, avg %.0fms over %d", name, Sparkline(ms), ms[len(ms)-1], sum/float64(len(ms)), len(ms))
+		if n := failures[name]; n > 0 {
+			line += ui.Colorize(ui.Red, fmt.Sprintf(", %d failed", n))
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	heading("Recent executions")
+	if len(s.Recent) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, e := range s.Recent {
+		fmt.Fprintf(w, "  %s %s %s\n", e.Time.Local().Format("01-02 15:04"), statusColor(e.Status, 8), clip(e.Prompt, width-27))
+	}
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,285 @@
+// Package digest condenses the audit log of a period into a report of what
+// changed, what failed and which errors the system log shows, with a summary
+// by the model, for `lucicodex digest`, /v1/digest and daily webhooks.
+package digest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/llm"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/logtail"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+// Limits on what a report lists and what is sent to the model.
+const (
+	maxRuns            = 50 // Of Changes and of Failures, the most recent
+	maxLogErrors       = 30
+	maxSummaryCommands = 30
+)
+
+// Run is an execution listed in a report.
+type Run struct {
+	ID     string    `json:"id,omitempty"`
+	Time   time.Time `json:"time"`
+	Prompt string    `json:"prompt"`
+	Status string    `json:"status"` // As logging.HistoryEntry.Status
+	// Who asked, for runs requested through the daemon (see
+	// logging.HistoryEntry)
+	Actor   string   `json:"actor,omitempty"`
+	Remote  string   `json:"remote,omitempty"`
+	Session string   `json:"session,omitempty"`
+	Device  string   `json:"device,omitempty"`
+	Changes []string `json:"changes,omitempty"` // Executed commands that may change state
+	Errors  []string `json:"errors,omitempty"`  // Failed commands, or the policy error
+}
+
+// Report is the digest of the executions logged between Since and Until.
+type Report struct {
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+	Runs     int       `json:"runs"`
+	OK       int       `json:"ok"`
+	Failed   int       `json:"failed"`
+	Rejected int       `json:"rejected"`
+	Planned  int       `json:"planned"` // Dry runs and cancelled plans
+	Changes  []Run     `json:"changes,omitempty"`
+	Failures []Run     `json:"failures,omitempty"` // Failed and rejected runs
+	// Error lines of the system log in the period, redacted
+	LogErrors []string `json:"log_errors,omitempty"`
+	// Written by the model; SummaryError says why there is none
+	Summary      string   `json:"summary,omitempty"`
+	Details      []string `json:"details,omitempty"`
+	SummaryError string   `json:"summary_error,omitempty"`
+}
+
+// Build collects the entries logged between since and until.
+func Build(entries []logging.HistoryEntry, since, until time.Time) *Report {
+	r := &Report{Since: since, Until: until}
+	for _, h := range entries {
+		if h.Time.Before(since) || h.Time.After(until) {
+			continue
+		}
+		r.Runs++
+		run := Run{ID: h.ID, Time: h.Time, Prompt: h.Prompt, Status: h.Status(), Actor: h.Actor, Remote: h.Remote, Session: h.Session, Device: h.Device}
+		switch run.Status {
+		case "ok":
+			r.OK++
+		case "failed":
+			r.Failed++
+		case "rejected":
+			r.Rejected++
+			run.Errors = []string{h.Rejected}
+		case "planned":
+			r.Planned++
+		}
+		for _, res := range h.Results {
+			if res.Error != "" {
+				run.Errors = append(run.Errors, executor.FormatCommand(res.Command)+": "+res.Error)
+			} else if impact.IsWrite(res.Command) {
+				run.Changes = append(run.Changes, executor.FormatCommand(res.Command))
+			}
+		}
+		if len(run.Changes) > 0 {
+			r.Changes = append(r.Changes, run)
+		}
+		if len(run.Errors) > 0 {
+			r.Failures = append(r.Failures, run)
+		}
+	}
+	if len(r.Changes) > maxRuns {
+		r.Changes = r.Changes[len(r.Changes)-maxRuns:]
+	}
+	if len(r.Failures) > maxRuns {
+		r.Failures = r.Failures[len(r.Failures)-maxRuns:]
+	}
+	return r
+}
+
+// Generate reads the audit log of cfg and, if the policy allows reading it,
+// the system log, and reports on the time since since. With summarize, the
+// model is asked for a summary; if that fails, the report says why in
+// SummaryError instead of failing.
+func Generate(ctx context.Context, cfg config.Config, since time.Time, summarize bool) (*Report, error) {
+	if cfg.LogFile == "" {
+		return nil, errcode.Errorf(errcode.ConfigInvalid, "the audit log is disabled (set log_file)")
+	}
+	entries, err := logging.History(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := Build(entries, since, time.Now())
+
+	dump := plan.PlannedCommand{Command: logtail.DumpCommand}
+	if policy.New(cfg).ValidateCommand(0, dump) == nil {
+		// A router without logread still gets a digest of its runs
+		r.LogErrors, _ = logtail.Errors(ctx, since, maxLogErrors)
+	}
+
+	if summarize {
+		if err := r.Summarize(ctx, cfg); err != nil {
+			r.SummaryError = err.Error()
+		}
+	}
+	return r, nil
+}
+
+// Summarize asks the model of cfg for a summary of r in a single request
+// covering all of its runs. A report without changes, failures or log
+// errors is summarized without asking.
+func (r *Report) Summarize(ctx context.Context, cfg config.Config) error {
+	if len(r.Changes) == 0 && len(r.Failures) == 0 && len(r.LogErrors) == 0 {
+		r.Summary = fmt.Sprintf("Nothing changed or failed; %d run(s) completed.", r.Runs)
+		r.Details = nil
+		return nil
+	}
+
+	var commands []llm.SummaryCommand
+	var requests []string
+	for _, run := range r.runs() {
+		requests = append(requests, run.Prompt)
+		for _, c := range run.Changes {
+			commands = append(commands, llm.SummaryCommand{Command: []string{c}, Output: "requested as: " + run.Prompt})
+		}
+		for _, e := range run.Errors {
+			commands = append(commands, llm.SummaryCommand{Command: []string{run.Prompt}, Error: e})
+		}
+	}
+	if len(commands) > maxSummaryCommands {
+		commands = commands[len(commands)-maxSummaryCommands:]
+	}
+	if len(r.LogErrors) > 0 {
+		commands = append(commands, llm.SummaryCommand{Command: logtail.DumpCommand, Output: strings.Join(r.LogErrors, "\n")})
+	}
+
+	summary, details, err := llm.Summarize(ctx, cfg, llm.SummaryInput{
+		Prompt: fmt.Sprintf("Write a digest of this OpenWrt router's activity from %s to %s for its administrator: what changed, what failed and why, and notable findings in the system log.",
+			r.Since.Local().Format("2006-01-02 15:04"), r.Until.Local().Format("2006-01-02 15:04")),
+		Context: fmt.Sprintf("%d runs: %d ok, %d failed, %d rejected by policy, %d not executed. Requests: %s",
+			r.Runs, r.OK, r.Failed, r.Rejected, r.Planned, strings.Join(requests, "; ")),
+		Commands: commands,
+	})
+	if err != nil {
+		return err
+	}
+	r.Summary, r.Details = summary, details
+	return nil
+}
+
+// runs returns the runs listed in r, oldest first, each once.
+func (r *Report) runs() []Run {
+	var out []Run
+	seen := map[string]bool{}
+	for _, list := range [][]Run{r.Changes, r.Failures} {
+		for _, run := range list {
+			key := run.ID + run.Time.String()
+			if !seen[key] {
+				seen[key] = true
+				out = append(out, run)
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out
+}
+
+// origin describes who asked for run, as " (by ACTOR from REMOTE, LuCI
+// session SESSION)", or "" for runs on the router itself.
+func (run Run) origin() string {
+	var parts []string
+	if run.Actor != "" {
+		parts = append(parts, "by "+run.Actor)
+	}
+	if run.Remote != "" {
+		parts = append(parts, "from "+run.Remote)
+	}
+	s := strings.Join(parts, " ")
+	if run.Session != "" {
+		if s != "" {
+			s += ", "
+		}
+		s += "LuCI session " + run.Session
+	}
+	if s == "" {
+		return ""
+	}
+	return " (" + s + ")"
+}
+
+// Text renders r as plain text, e.g. for the body of an email.
+func (r *Report) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "LuciCodex digest %s to %s\n", r.Since.Local().Format("2006-01-02 15:04"), r.Until.Local().Format("2006-01-02 15:04"))
+	fmt.Fprintf(&b, "%d run(s): %d ok, %d failed, %d rejected, %d not executed\n", r.Runs, r.OK, r.Failed, r.Rejected, r.Planned)
+	if r.Summary != "" {
+		fmt.Fprintf(&b, "\n%s\n", r.Summary)
+		for _, d := range r.Details {
+			fmt.Fprintf(&b, "  - %s\n", d)
+		}
+	}
+	if r.SummaryError != "" {
+		fmt.Fprintf(&b, "\nNo summary: %s\n", r.SummaryError)
+	}
+	section := func(title string, runs []Run, items func(Run) []string) {
+		if len(runs) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n%s:\n", title)
+		for _, run := range runs {
+			fmt.Fprintf(&b, "  %s %s%s\n", run.Time.Local().Format("2006-01-02 15:04"), run.Prompt, run.origin())
+			for _, item := range items(run) {
+				fmt.Fprintf(&b, "    %s\n", item)
+			}
+		}
+	}
+	section("Changes", r.Changes, func(run Run) []string { return run.Changes })
+	section("Failures", r.Failures, func(run Run) []string { return run.Errors })
+	if len(r.LogErrors) > 0 {
+		fmt.Fprintf(&b, "\nSystem log errors:\n")
+		for _, l := range r.LogErrors {
+			fmt.Fprintf(&b, "  %s\n", l)
+		}
+	}
+	return b.String()
+}
+
+// Post sends r as JSON to url, with the plain text rendering in a "text"
+// field for webhooks that relay it by email or chat.
+func Post(ctx context.Context, url string, r *Report) error {
+	body, err := json.Marshal(struct {
+		*Report
+		Text string `json:"text"`
+	}{r, r.Text()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: HTTP %d", url, resp.StatusCode)
+	}
+	return nil
+}
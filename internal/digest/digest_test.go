@@ -0,0 +1,112 @@
+package digest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/logtail"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/testutil"
+)
+
+// writeLog logs an applied change requested through the daemon, a failed
+// command, a rejected plan and a read-only query.
+func writeLog(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := logging.New(path)
+	daemon := l.WithRemote("192.168.1.23").WithActor("alice", "operator").WithDevice("Mozilla/5.0", "root:1a2b3c4d")
+	daemon.Plan("restart wifi", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}})
+	daemon.Results([]logging.ResultItem{{Command: []string{"wifi", "reload"}}})
+	l.Plan("check wan", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"ifup", "wan"}}}})
+	l.Results([]logging.ResultItem{{Command: []string{"ifup", "wan"}, Error: "exit status 1"}})
+	l.Rejected("wipe it", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"firstboot"}}}}, "command 0 denied by policy")
+	l.Plan("show ip", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"ip", "addr"}}}})
+	l.Results([]logging.ResultItem{{Command: []string{"ip", "addr"}, Output: "inet 192.168.1.1"}})
+	return path
+}
+
+func TestBuild(t *testing.T) {
+	entries, err := logging.ReadHistory(writeLog(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Build(entries, time.Now().Add(-time.Hour), time.Now())
+	if r.Runs != 4 || r.OK != 2 || r.Failed != 1 || r.Rejected != 1 {
+		t.Fatalf("unexpected counts %+v", r)
+	}
+	if len(r.Changes) != 1 || r.Changes[0].Prompt != "restart wifi" || r.Changes[0].Changes[0] != "wifi reload" || r.Changes[0].Device == "" {
+		t.Errorf("unexpected changes %+v", r.Changes)
+	}
+	if len(r.Failures) != 2 || r.Failures[0].Errors[0] != "ifup wan: exit status 1" || r.Failures[1].Status != "rejected" {
+		t.Errorf("unexpected failures %+v", r.Failures)
+	}
+	text := r.Text()
+	for _, want := range []string{"4 run(s): 2 ok, 1 failed, 1 rejected", "Changes:", "restart wifi (by alice from 192.168.1.23, LuCI session root:1a2b3c4d)", "wifi reload", "Failures:", "denied by policy"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected %q in %s", want, text)
+		}
+	}
+
+	if r := Build(entries, time.Now().Add(time.Minute), time.Now().Add(time.Hour)); r.Runs != 0 {
+		t.Errorf("expected no runs in a later period, got %d", r.Runs)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	old := logtail.DumpCommand
+	logtail.DumpCommand = []string{"printf", "%s", "daemon.err netifd: Interface 'wan' has lost the connection\ndaemon.info dnsmasq: ok\n"}
+	defer func() { logtail.DumpCommand = old }()
+
+	server, fake := testutil.MockProviderServer(t, testutil.FakeResponse{Text: `{"summary": "Wi-Fi was reloaded; the WAN is down.", "details": ["ifup wan failed"]}`})
+	defer server.Close()
+	cfg := testutil.FakeProviderConfig(config.Config{LogFile: writeLog(t)}, "anthropic", server.URL)
+
+	r, err := Generate(context.Background(), cfg, time.Now().Add(-time.Hour), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.LogErrors) != 1 || !strings.Contains(r.LogErrors[0], "lost the connection") {
+		t.Errorf("unexpected log errors %q", r.LogErrors)
+	}
+	if r.Summary != "Wi-Fi was reloaded; the WAN is down." || len(r.Details) != 1 || r.SummaryError != "" {
+		t.Errorf("unexpected summary %+v", r)
+	}
+	// All runs go to the model in one request
+	reqs := fake.Requests()
+	if len(reqs) != 1 || !strings.Contains(reqs[0].Body, "restart wifi") || !strings.Contains(reqs[0].Body, "exit status 1") || !strings.Contains(reqs[0].Body, "lost the connection") {
+		t.Errorf("unexpected requests %+v", reqs)
+	}
+
+	// A log dump denied by the policy is left out
+	cfg.Denylist = []string{"^printf"}
+	if r, _ := Generate(context.Background(), cfg, time.Now().Add(-time.Hour), false); len(r.LogErrors) != 0 || r.Summary != "" {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if _, err := Generate(context.Background(), config.Config{}, time.Now(), false); err == nil {
+		t.Error("expected an error without log_file")
+	}
+}
+
+func TestPost(t *testing.T) {
+	var got map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	r := &Report{Runs: 3, OK: 3, Summary: "All good"}
+	if err := Post(context.Background(), server.URL, r); err != nil {
+		t.Fatal(err)
+	}
+	if got["runs"] != 3.0 || !strings.Contains(got["text"].(string), "All good") {
+		t.Errorf("unexpected payload %v", got)
+	}
+}
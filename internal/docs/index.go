@@ -0,0 +1,189 @@
+// Package docs provides a small local vector index over the OpenWrt
+// documentation snippets shipped with LuciCodex.
+//
+// Vectors are computed on first use with the active provider's embeddings
+// API and cached on disk per embedding model, so subsequent runs only embed
+// the user's query.
+package docs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/llm"
+)
+
+// CacheDir holds cached snippet vectors (tmpfs on OpenWrt).
+var CacheDir = "/tmp/lucicodex-docs"
+
+// DefaultTopK is used when no k is configured.
+const DefaultTopK = 3
+
+// Match is a retrieved chunk with its cosine similarity to the query.
+type Match struct {
+	Chunk
+	Score float64 `json:"score"`
+}
+
+// Index is an in-memory vector index over Chunks.
+type Index struct {
+	Model   string      `json:"model"`
+	Digest  string      `json:"digest"`
+	Chunks  []Chunk     `json:"chunks"`
+	Vectors [][]float32 `json:"vectors"`
+}
+
+// corpusDigest identifies the snippet set so stale caches are rebuilt.
+func corpusDigest(chunks []Chunk) string {
+	h := sha256.New()
+	for _, c := range chunks {
+		h.Write([]byte(c.Topic))
+		h.Write([]byte{0})
+		h.Write([]byte(c.Text))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Build embeds all chunks with e.
+func Build(ctx context.Context, e llm.Embedder, chunks []Chunk) (*Index, error) {
+	texts := make([]string, len(chunks))
+	for i, c := range chunks {
+		texts[i] = c.Topic + ": " + c.Text
+	}
+	vectors, err := e.Embed(ctx, texts)
+	if err != nil {
+		return nil, fmt.Errorf("embed docs: %w", err)
+	}
+	if len(vectors) != len(chunks) {
+		return nil, fmt.Errorf("embed docs: expected %d vectors, got %d", len(chunks), len(vectors))
+	}
+	return &Index{
+		Model:   e.EmbeddingModel(),
+		Digest:  corpusDigest(chunks),
+		Chunks:  chunks,
+		Vectors: vectors,
+	}, nil
+}
+
+// Load builds the index for the shipped Snippets, reusing the on-disk cache in
+// cacheDir when it matches the embedding model and corpus.
+func Load(ctx context.Context, e llm.Embedder, cacheDir string) (*Index, error) {
+	if cacheDir == "" {
+		cacheDir = CacheDir
+	}
+	path := filepath.Join(cacheDir, cacheFileName(e.EmbeddingModel()))
+	digest := corpusDigest(Snippets)
+
+	if data, err := os.ReadFile(path); err == nil {
+		var idx Index
+		if json.Unmarshal(data, &idx) == nil && idx.Model == e.EmbeddingModel() && idx.Digest == digest && len(idx.Vectors) == len(idx.Chunks) {
+			return &idx, nil
+		}
+	}
+
+	idx, err := Build(ctx, e, Snippets)
+	if err != nil {
+		return nil, err
+	}
+	// Cache failures are not fatal: the index is still usable for this run.
+	if err := os.MkdirAll(cacheDir, 0o700); err == nil {
+		if data, err := json.Marshal(idx); err == nil {
+			_ = os.WriteFile(path, data, 0o600)
+		}
+	}
+	return idx, nil
+}
+
+func cacheFileName(model string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, model)
+	return "index-" + safe + ".json"
+}
+
+// Search returns the k chunks most similar to the query vector.
+func (idx *Index) Search(query []float32, k int) []Match {
+	if k <= 0 {
+		k = DefaultTopK
+	}
+	matches := make([]Match, 0, len(idx.Chunks))
+	for i, v := range idx.Vectors {
+		matches = append(matches, Match{Chunk: idx.Chunks[i], Score: cosine(query, v)})
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+	return matches
+}
+
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// ErrNoEmbeddings is returned when the provider has no embeddings API.
+var ErrNoEmbeddings = errors.New("provider does not support embeddings")
+
+// Retrieve embeds the query with the provider and returns a prompt block with
+// the top-k documentation chunks. It returns ErrNoEmbeddings if the provider
+// does not implement llm.Embedder.
+func Retrieve(ctx context.Context, p llm.Provider, query string, k int) (string, error) {
+	e, ok := p.(llm.Embedder)
+	if !ok {
+		return "", ErrNoEmbeddings
+	}
+	idx, err := Load(ctx, e, CacheDir)
+	if err != nil {
+		return "", err
+	}
+	qv, err := e.Embed(ctx, []string{query})
+	if err != nil {
+		return "", fmt.Errorf("embed query: %w", err)
+	}
+	if len(qv) != 1 {
+		return "", fmt.Errorf("embed query: expected 1 vector, got %d", len(qv))
+	}
+	return FormatMatches(idx.Search(qv[0], k)), nil
+}
+
+// FormatMatches renders retrieved chunks as a prompt block.
+func FormatMatches(matches []Match) string {
+	if len(matches) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n\nRelevant OpenWrt documentation (prefer these commands and paths):\n")
+	for _, m := range matches {
+		b.WriteString("- ")
+		b.WriteString(m.Topic)
+		b.WriteString(": ")
+		b.WriteString(m.Text)
+		b.WriteString("\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,111 @@
+package docs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// wordEmbedder embeds text as counts over a tiny fixed vocabulary.
+type wordEmbedder struct {
+	calls int
+	texts int
+}
+
+var vocab = []string{"wireless", "wifi", "firewall", "port", "pppoe", "package", "opkg", "log"}
+
+func (w *wordEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	w.calls++
+	w.texts += len(texts)
+	out := make([][]float32, len(texts))
+	for i, t := range texts {
+		v := make([]float32, len(vocab))
+		lower := strings.ToLower(t)
+		for j, word := range vocab {
+			v[j] = float32(strings.Count(lower, word))
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (w *wordEmbedder) EmbeddingModel() string { return "test/words" }
+
+func (w *wordEmbedder) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	return plan.Plan{}, nil
+}
+
+func (w *wordEmbedder) GenerateErrorFix(ctx context.Context, cmd, out string, attempt int) (plan.Plan, error) {
+	return plan.Plan{}, nil
+}
+
+func TestIndex_Search(t *testing.T) {
+	idx, err := Build(context.Background(), &wordEmbedder{}, Snippets)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	qv, _ := (&wordEmbedder{}).Embed(context.Background(), []string{"open a firewall port"})
+	matches := idx.Search(qv[0], 2)
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(matches))
+	}
+	if !strings.Contains(matches[0].Topic, "port forwarding") && !strings.Contains(matches[0].Topic, "firewall") {
+		t.Errorf("expected firewall-related top match, got %q", matches[0].Topic)
+	}
+	if matches[0].Score < matches[1].Score {
+		t.Errorf("matches not sorted by score: %v", matches)
+	}
+}
+
+func TestLoad_UsesCache(t *testing.T) {
+	dir := t.TempDir()
+	e := &wordEmbedder{}
+
+	if _, err := Load(context.Background(), e, dir); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index-test_words.json")); err != nil {
+		t.Fatalf("expected cache file: %v", err)
+	}
+	if _, err := Load(context.Background(), e, dir); err != nil {
+		t.Fatalf("second Load failed: %v", err)
+	}
+	if e.calls != 1 {
+		t.Errorf("expected snippets to be embedded once, got %d calls", e.calls)
+	}
+}
+
+func TestRetrieve(t *testing.T) {
+	CacheDir = t.TempDir()
+	defer func() { CacheDir = "/tmp/lucicodex-docs" }()
+
+	block, err := Retrieve(context.Background(), &wordEmbedder{}, "why is pppoe failing", 1)
+	if err != nil {
+		t.Fatalf("Retrieve failed: %v", err)
+	}
+	if !strings.Contains(block, "Relevant OpenWrt documentation") || !strings.Contains(block, "wan pppoe") {
+		t.Errorf("unexpected block: %q", block)
+	}
+}
+
+type noEmbed struct{}
+
+func (noEmbed) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	return plan.Plan{}, nil
+}
+
+func (noEmbed) GenerateErrorFix(ctx context.Context, cmd, out string, attempt int) (plan.Plan, error) {
+	return plan.Plan{}, nil
+}
+
+func TestRetrieve_NoEmbeddings(t *testing.T) {
+	_, err := Retrieve(context.Background(), noEmbed{}, "q", 1)
+	if !errors.Is(err, ErrNoEmbeddings) {
+		t.Errorf("expected ErrNoEmbeddings, got %v", err)
+	}
+}
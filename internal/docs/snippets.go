@@ -0,0 +1,33 @@
+package docs
+
+// Chunk is a short, self-contained piece of OpenWrt documentation.
+type Chunk struct {
+	Topic string `json:"topic"`
+	Text  string `json:"text"`
+}
+
+// Snippets is the documentation corpus shipped with LuciCodex. Keep entries
+// short: they are embedded once per model and the top matches are pasted into
+// the planning prompt.
+var Snippets = []Chunk{
+	{"uci basics", "uci show <config> prints a config; uci get <config>.<section>.<option> reads one value; uci set <config>.<section>.<option>=<value> stages a change; uci commit <config> writes it to /etc/config/<config>. Staged changes are listed by uci changes and discarded by uci revert <config>."},
+	{"uci anonymous sections", "Anonymous sections are addressed as <config>.@<type>[<index>], e.g. wireless.@wifi-iface[0].ssid. Index -1 is the last section. uci add <config> <type> creates a new anonymous section and prints its name."},
+	{"network interfaces", "Logical interfaces live in /etc/config/network (network.lan, network.wan). Apply changes with /etc/init.d/network reload or ifup <iface>. Inspect runtime state with ifstatus <iface> or ubus call network.interface.<iface> status."},
+	{"lan ip address", "Change the LAN address with uci set network.lan.ipaddr=192.168.2.1 and uci commit network, then /etc/init.d/network restart. Existing SSH/LuCI sessions will drop when the address changes."},
+	{"wan pppoe", "PPPoE WAN: uci set network.wan.proto=pppoe, network.wan.username and network.wan.password, then uci commit network and ifup wan. pppd logs appear in logread -e pppd; 'PAP authentication failed' means wrong credentials."},
+	{"dhcp and dns", "dnsmasq is configured in /etc/config/dhcp. Static leases are 'host' sections with name, mac and ip options. Restart with /etc/init.d/dnsmasq restart. Current leases are in /tmp/dhcp.leases."},
+	{"wireless", "Radios are wifi-device sections and networks are wifi-iface sections in /etc/config/wireless. Apply changes with wifi reload (not wifi restart). Runtime status: wifi status or iwinfo <ifname> info; connected clients: iwinfo <ifname> assoclist."},
+	{"wireless channel", "Set the channel with uci set wireless.radio0.channel=<n> (or auto) and uci commit wireless, then wifi reload. Scan neighbours with iwinfo <ifname> scan."},
+	{"firewall zones", "fw4 (nftables) reads /etc/config/firewall. Zones group networks (lan, wan); forwarding sections allow traffic between zones. Apply with fw4 reload or /etc/init.d/firewall reload; fw4 print shows the generated ruleset."},
+	{"port forwarding", "Port forwards are 'redirect' sections: uci add firewall redirect, then set name, src=wan, src_dport, dest=lan, dest_ip, dest_port, proto=tcp and target=DNAT. Commit firewall and run fw4 reload."},
+	{"firewall rules", "Traffic rules are 'rule' sections with src, dest, proto, dest_port and target (ACCEPT, REJECT, DROP). Opening a port on the router itself uses src=wan without dest."},
+	{"packages", "Package management uses opkg (apk on newer snapshots). Run opkg update before opkg install <pkg>. opkg list-installed shows installed packages; opkg info <pkg> shows details. /tmp is RAM: avoid installing large packages on small flash."},
+	{"services", "Init scripts live in /etc/init.d/<service> and accept start, stop, restart, reload, enable, disable and enabled. procd services can be inspected with ubus call service list."},
+	{"system logs", "logread prints the system log ring buffer; logread -l 50 shows the last 50 lines and logread -e <pattern> filters. Kernel messages are in dmesg. Logs do not survive reboot unless log_file is configured."},
+	{"system info", "ubus call system board shows model, release and kernel; ubus call system info shows uptime, memory and load. free and df -h show memory and storage; /proc/uptime holds seconds since boot."},
+	{"routing", "ip route shows the routing table and ip -6 route the IPv6 table. Static routes are 'route' sections in /etc/config/network with interface, target, netmask and gateway."},
+	{"diagnostics", "ping -c 4 <host>, traceroute <host> and nslookup <name> are available in busybox. ip addr and ip link show interface state; ifstatus wan shows the WAN lease and DNS servers."},
+	{"sysupgrade", "sysupgrade flashes new firmware and reboots; -n discards settings. It is destructive: never run it without an explicit user request. sysupgrade -b <file>.tar.gz creates a configuration backup."},
+	{"time and ntp", "NTP is configured in /etc/config/system (system.ntp). date shows the current time. /etc/init.d/sysntpd restart re-syncs the clock."},
+	{"sqm", "Smart queue management comes from the sqm-scripts package (luci-app-sqm). Configure /etc/config/sqm with interface, download and upload in kbit/s at about 85-95% of measured line rate, then /etc/init.d/sqm restart."},
+}
@@ -0,0 +1,201 @@
+// Package errcode defines the error taxonomy shared by the CLI and the daemon.
+// Every failure is classified into a Code, which determines the process exit
+// status, the HTTP status of API responses and a remediation hint.
+package errcode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Code identifies a class of failure. Codes are part of the public API (JSON
+// responses and documentation) and must not be renamed.
+type Code string
+
+const (
+	Internal         Code = "INTERNAL"
+	InvalidRequest   Code = "INVALID_REQUEST"
+	ConfigInvalid    Code = "CONFIG_INVALID"
+	Unauthorized     Code = "UNAUTHORIZED"
+	Forbidden        Code = "FORBIDDEN"
+	NotFound         Code = "NOT_FOUND"
+	Conflict         Code = "CONFLICT"
+	MethodNotAllowed Code = "METHOD_NOT_ALLOWED"
+	RateLimited      Code = "RATE_LIMITED"
+	// RequestTooLarge is a request body or WebSocket message over the
+	// endpoint's size limit
+	RequestTooLarge Code = "REQUEST_TOO_LARGE"
+	// UnsupportedMediaType is a request body not declared as JSON
+	UnsupportedMediaType Code = "UNSUPPORTED_MEDIA_TYPE"
+	// AuditBroken is an audit log whose hash chain does not verify (see
+	// logging.VerifyAudit)
+	AuditBroken Code = "AUDIT_BROKEN"
+
+	LLMNoKey       Code = "LLM_NO_KEY"
+	LLMAuth        Code = "LLM_AUTH"
+	LLMRateLimit   Code = "LLM_RATE_LIMIT"
+	LLMTimeout     Code = "LLM_TIMEOUT"
+	LLMUnavailable Code = "LLM_UNAVAILABLE"
+	LLMBadResponse Code = "LLM_BAD_RESPONSE"
+	// Offline is a provider endpoint that failed the connectivity check
+	// before an LLM request (see llm.ErrOffline)
+	Offline Code = "OFFLINE"
+
+	PolicyDeny     Code = "POLICY_DENY"
+	PolicyAck      Code = "POLICY_ACK_REQUIRED"
+	FactsMismatch  Code = "FACTS_MISMATCH"
+	ApprovalDenied Code = "APPROVAL_DENIED"
+	// PlanTooLarge is a plan with more commands than the request's limit,
+	// even after the model was asked again (see llm.FitLimit)
+	PlanTooLarge Code = "PLAN_TOO_LARGE"
+
+	ExecFailed  Code = "EXEC_FAILED"
+	ExecTimeout Code = "EXEC_TIMEOUT"
+	ExecLocked  Code = "EXEC_LOCKED"
+	ExecBudget  Code = "EXEC_BUDGET_EXCEEDED"
+	// ExecUnverified is a plan whose commands succeeded but whose
+	// verification commands did not see the expected result
+	ExecUnverified Code = "EXEC_UNVERIFIED"
+	// ResourcesLow is a heavy command the resource guard refused because
+	// the router stayed short of memory, CPU or overlay space (see
+	// executor.Heavy)
+	ResourcesLow Code = "RESOURCES_LOW"
+)
+
+// Spec describes how a Code is surfaced.
+type Spec struct {
+	ExitCode   int
+	HTTPStatus int
+	Hint       string
+}
+
+var specs = map[Code]Spec{
+	Internal:             {1, http.StatusInternalServerError, "Unexpected failure; rerun with the log file enabled and report the error."},
+	InvalidRequest:       {2, http.StatusBadRequest, "Check the command line arguments or request body."},
+	ConfigInvalid:        {3, http.StatusInternalServerError, "Fix the configuration file or UCI settings, or run `lucicodex -setup`."},
+	Unauthorized:         {4, http.StatusUnauthorized, "Send the daemon token from /tmp/.lucicodex.token in the X-Auth-Token header."},
+	Forbidden:            {8, http.StatusForbidden, "The token's role does not allow this endpoint; use a viewer, operator or admin token as documented."},
+	NotFound:             {5, http.StatusNotFound, "Check the identifier; it may have expired or never existed."},
+	Conflict:             {6, http.StatusConflict, "The resource is not in a state that allows this operation; check its status first."},
+	MethodNotAllowed:     {2, http.StatusMethodNotAllowed, "Use the HTTP method documented for this endpoint."},
+	RateLimited:          {7, http.StatusTooManyRequests, "The daemon is throttling requests; slow down and retry."},
+	RequestTooLarge:      {2, http.StatusRequestEntityTooLarge, "The request body is over the endpoint's size limit; shorten the prompt or send fewer commands per request."},
+	UnsupportedMediaType: {2, http.StatusUnsupportedMediaType, "Send the request body as JSON with Content-Type: application/json."},
+	AuditBroken:          {9, http.StatusInternalServerError, "The audit log was modified or truncated after it was written; compare it with a copy or the logs forwarded off the router."},
+
+	LLMNoKey:       {10, http.StatusBadRequest, "Configure an API key for the provider in LuCI, UCI or the environment, or run `lucicodex login`."},
+	LLMAuth:        {11, http.StatusBadGateway, "The provider rejected the credentials; verify the API key or log in again."},
+	LLMRateLimit:   {12, http.StatusTooManyRequests, "The provider is rate limiting requests; wait and retry, or switch provider/model."},
+	LLMTimeout:     {13, http.StatusGatewayTimeout, "The provider did not answer in time; increase timeout or retry."},
+	LLMUnavailable: {14, http.StatusBadGateway, "The provider could not be reached; check WAN connectivity, DNS, proxy settings and the endpoint."},
+	LLMBadResponse: {15, http.StatusBadGateway, "The model returned an unusable plan; rephrase the request or try another model."},
+	Offline:        {16, http.StatusServiceUnavailable, "The router cannot resolve or connect to the provider endpoint; check that the WAN is up, then DNS and proxy settings."},
+
+	PolicyDeny:     {20, http.StatusForbidden, "A command was blocked by the allowlist/denylist; rephrase the request or adjust the policy."},
+	PolicyAck:      {22, http.StatusPreconditionRequired, "The plan triggered policy warnings; review them and rerun with -ack-warnings (CLI) or \"ack_warnings\": true (API)."},
+	ApprovalDenied: {23, http.StatusForbidden, "The approval_command did not approve the plan; check the approver (e.g. the push or chat app) and its output."},
+	FactsMismatch:  {21, http.StatusConflict, "The router changed since the plan was generated, or the plan's facts stamp is invalid; generate a new plan."},
+	PlanTooLarge:   {24, http.StatusUnprocessableEntity, "The model needs more commands than max_commands (or max_read_commands/max_write_commands) allows; split the request or raise the limit."},
+
+	ExecFailed:     {30, http.StatusInternalServerError, "One or more commands failed; inspect their output."},
+	ExecTimeout:    {31, http.StatusGatewayTimeout, "A command exceeded the per-command timeout; raise timeout or run it as a background job."},
+	ExecLocked:     {32, http.StatusConflict, "Another LuciCodex execution holds the lock; wait for it to finish."},
+	ExecBudget:     {33, http.StatusGatewayTimeout, "The plan ran out of its time budget before all commands ran; raise plan_timeout_seconds or split the request."},
+	ExecUnverified: {34, http.StatusInternalServerError, "The commands ran, but the plan's verification found the change did not take effect; inspect the checks."},
+	ResourcesLow:   {35, http.StatusServiceUnavailable, "The router was short of memory, CPU or overlay space for a heavy command; free some or retry later, or adjust min_free_memory, max_load and min_free_overlay."},
+}
+
+// Spec returns how c is surfaced; unknown codes are treated as Internal.
+func (c Code) Spec() Spec {
+	if s, ok := specs[c]; ok {
+		return s
+	}
+	return specs[Internal]
+}
+
+func (c Code) ExitCode() int   { return c.Spec().ExitCode }
+func (c Code) HTTPStatus() int { return c.Spec().HTTPStatus }
+func (c Code) Hint() string    { return c.Spec().Hint }
+
+// Codes returns every defined code, for documentation and tests.
+func Codes() []Code {
+	out := make([]Code, 0, len(specs))
+	for c := range specs {
+		out = append(out, c)
+	}
+	return out
+}
+
+// Coder is implemented by errors that know their own Code.
+type Coder interface {
+	ErrorCode() Code
+}
+
+// Error attaches a Code to an underlying error without changing its message.
+type Error struct {
+	Code Code
+	Err  error
+}
+
+func (e *Error) Error() string   { return e.Err.Error() }
+func (e *Error) Unwrap() error   { return e.Err }
+func (e *Error) ErrorCode() Code { return e.Code }
+
+// Wrap tags err with code. It returns nil for a nil err.
+func Wrap(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// Errorf formats an error tagged with code.
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+// Of classifies err. Errors carrying a code (directly or wrapped) keep it;
+// everything else is Internal.
+func Of(err error) Code {
+	if err == nil {
+		return ""
+	}
+	var c Coder
+	if errors.As(err, &c) {
+		return c.ErrorCode()
+	}
+	return Internal
+}
+
+// Body is the JSON error object returned by every daemon endpoint. Error
+// stays a plain string for clients that predate the taxonomy.
+type Body struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+	Code  Code   `json:"code"`
+	Hint  string `json:"hint,omitempty"`
+}
+
+// NewBody builds the response body for msg under code.
+func NewBody(code Code, msg string) Body {
+	return Body{Error: msg, Code: code, Hint: code.Hint()}
+}
+
+// WriteHTTP writes a JSON error response for code with the given message.
+func WriteHTTP(w http.ResponseWriter, code Code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code.HTTPStatus())
+	json.NewEncoder(w).Encode(NewBody(code, msg))
+}
+
+// WriteHTTPError classifies err and writes it with an optional message prefix.
+func WriteHTTPError(w http.ResponseWriter, prefix string, err error) {
+	msg := err.Error()
+	if prefix != "" {
+		msg = prefix + ": " + msg
+	}
+	WriteHTTP(w, Of(err), msg)
+}
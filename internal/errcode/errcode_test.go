@@ -0,0 +1,68 @@
+package errcode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCodes_Specs(t *testing.T) {
+	for _, c := range Codes() {
+		s := c.Spec()
+		if s.ExitCode == 0 {
+			t.Errorf("%s: exit code must be non-zero", c)
+		}
+		if s.HTTPStatus < 400 {
+			t.Errorf("%s: HTTP status %d is not an error", c, s.HTTPStatus)
+		}
+		if s.Hint == "" {
+			t.Errorf("%s: missing hint", c)
+		}
+	}
+	if Code("BOGUS").ExitCode() != Internal.ExitCode() {
+		t.Error("unknown codes should fall back to INTERNAL")
+	}
+}
+
+func TestOf(t *testing.T) {
+	if Of(nil) != "" {
+		t.Error("nil error should have no code")
+	}
+	if Of(errors.New("boom")) != Internal {
+		t.Error("plain errors should be INTERNAL")
+	}
+	err := fmt.Errorf("context: %w", Wrap(PolicyDeny, errors.New("denied")))
+	if Of(err) != PolicyDeny {
+		t.Errorf("wrapped code lost: %s", Of(err))
+	}
+	if err.Error() != "context: denied" {
+		t.Errorf("Wrap changed the message: %q", err.Error())
+	}
+	if Wrap(ExecFailed, nil) != nil {
+		t.Error("Wrap(nil) should be nil")
+	}
+	if Of(Errorf(ExecLocked, "held by %d", 42)) != ExecLocked {
+		t.Error("Errorf code lost")
+	}
+}
+
+func TestWriteHTTPError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	WriteHTTPError(rr, "Policy error", Wrap(PolicyDeny, errors.New("command 0 denied")))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status = %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type = %q", ct)
+	}
+	var b Body
+	if err := json.Unmarshal(rr.Body.Bytes(), &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.OK || b.Code != PolicyDeny || b.Error != "Policy error: command 0 denied" || b.Hint == "" {
+		t.Errorf("unexpected body: %+v", b)
+	}
+}
@@ -0,0 +1,91 @@
+// Package execlock serializes command execution between the CLI, the daemon
+// and MCP clients. The lock is a file created exclusively; it records who
+// holds it so a blocked caller can say what it is waiting for.
+package execlock
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// Paths are tried in order; later paths are fallbacks for systems where the
+// earlier directories are missing or read-only. Tests override them.
+var Paths = []string{"/var/lock/lucicodex.lock", "/tmp/lucicodex.lock"}
+
+// Lock is a held execution lock.
+type Lock struct {
+	f    *os.File
+	path string
+}
+
+// Acquire takes the execution lock on behalf of owner, e.g. "cli" or
+// "mcp:inspector/1.0". It fails with errcode.ExecLocked if another execution
+// holds it.
+func Acquire(owner string) (*Lock, error) {
+	var lastErr error
+	for _, path := range Paths {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "pid=%d owner=%s\n", os.Getpid(), owner)
+			return &Lock{f: f, path: path}, nil
+		}
+		lastErr = err
+		if os.IsExist(err) {
+			if holder := Holder(path); holder != "" {
+				return nil, errcode.Errorf(errcode.ExecLocked, "execution in progress (lock file exists: %s, held by %s)", path, holder)
+			}
+			return nil, errcode.Errorf(errcode.ExecLocked, "execution in progress (lock file exists: %s)", path)
+		}
+	}
+	return nil, fmt.Errorf("failed to acquire lock: %w", lastErr)
+}
+
+// Holder returns the owner recorded in the lock file at path, or "" if it
+// cannot be read.
+func Holder(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Current returns the owner and process of the held lock, if any.
+func Current() (owner string, pid int, held bool) {
+	for _, path := range Paths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		for _, field := range strings.Fields(Holder(path)) {
+			if v, ok := strings.CutPrefix(field, "pid="); ok {
+				pid, _ = strconv.Atoi(v)
+			} else if v, ok := strings.CutPrefix(field, "owner="); ok {
+				owner = v
+			}
+		}
+		return owner, pid, true
+	}
+	return "", 0, false
+}
+
+// Path returns the lock file in use.
+func (l *Lock) Path() string {
+	if l == nil {
+		return ""
+	}
+	return l.path
+}
+
+// Release removes the lock file. It is safe to call more than once.
+func (l *Lock) Release() {
+	if l == nil || l.f == nil {
+		return
+	}
+	l.f.Close()
+	os.Remove(l.path)
+	l.f = nil
+}
@@ -0,0 +1,47 @@
+package execlock
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+func TestAcquire(t *testing.T) {
+	dir := t.TempDir()
+	orig := Paths
+	Paths = []string{filepath.Join(dir, "missing", "a.lock"), filepath.Join(dir, "b.lock")}
+	defer func() { Paths = orig }()
+
+	l, err := Acquire("cli")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if l.Path() != Paths[1] {
+		t.Fatalf("expected fallback path, got %s", l.Path())
+	}
+
+	_, err = Acquire("mcp:inspector/1.0")
+	if errcode.Of(err) != errcode.ExecLocked {
+		t.Fatalf("expected EXEC_LOCKED, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "owner=cli") {
+		t.Errorf("expected holder in error, got %v", err)
+	}
+	if owner, pid, held := Current(); !held || owner != "cli" || pid != os.Getpid() {
+		t.Errorf("Current() = %q, %d, %v", owner, pid, held)
+	}
+
+	l.Release()
+	l.Release()
+	if _, _, held := Current(); held {
+		t.Error("expected no lock held after release")
+	}
+	l, err = Acquire("cli")
+	if err != nil {
+		t.Fatalf("Acquire after release: %v", err)
+	}
+	l.Release()
+}
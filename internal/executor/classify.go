@@ -0,0 +1,126 @@
+package executor
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Failure classes recognized by Diagnose. They describe deterministic
+// failures, which fail the same way no matter how often they are retried.
+const (
+	FailureUnknown    = ""
+	FailureNotFound   = "command_not_found"
+	FailureReadOnly   = "read_only_fs"
+	FailurePermission = "permission_denied"
+	FailureUCIEntry   = "uci_entry_not_found"
+)
+
+// Diagnosis is what AutoRetry knows about a failure before asking the model.
+type Diagnosis struct {
+	Class    string
+	Hint     string     // What the user can do about it; may be empty
+	Fix      *plan.Plan // Local remediation to run instead of a model fix
+	Hopeless bool       // No fix plan can help; skip the retry
+}
+
+// geteuid is overridden by tests.
+var geteuid = os.Geteuid
+
+// Diagnose classifies a failed command. Failures it does not recognize get
+// an empty Diagnosis and are left to the model.
+func (e *Engine) Diagnose(res Result) Diagnosis {
+	if res.Err == nil || len(res.Command) == 0 {
+		return Diagnosis{}
+	}
+	text := strings.ToLower(res.Output + "\n" + res.Err.Error())
+
+	if name, ok := missingCommand(res, text); ok {
+		d := Diagnosis{Class: FailureNotFound}
+		if pkg := openwrt.PackageFor(name); pkg != "" {
+			// The model cannot install packages on its own behalf
+			d.Hint = name + " is not installed; install it with: opkg update && opkg install " + pkg
+			d.Hopeless = true
+		}
+		return d
+	}
+
+	if strings.Contains(text, "read-only file system") {
+		return Diagnosis{
+			Class:    FailureReadOnly,
+			Hint:     "the target is on a read-only filesystem; /rom is squashfs, so change the copy under /etc or /overlay instead",
+			Hopeless: true,
+		}
+	}
+
+	if errors.Is(res.Err, fs.ErrPermission) || strings.Contains(text, "permission denied") || strings.Contains(text, "operation not permitted") {
+		d := Diagnosis{Class: FailurePermission, Hopeless: true}
+		switch {
+		case geteuid() == 0:
+			d.Hint = "permission denied even as root; the target may be protected by the kernel or mounted read-only"
+		case strings.TrimSpace(e.cfg.ElevateCommand) == "":
+			d.Hint = "run LuciCodex as root or set elevate_command"
+		case !res.NeedsRoot:
+			d.Hint = "retrying with elevate_command"
+			d.Fix = &plan.Plan{
+				Summary:  "Retry with elevated privileges",
+				Commands: []plan.PlannedCommand{{Command: res.Command, Pipe: res.Pipe, NeedsRoot: true, Description: "Rerun as root"}},
+			}
+			d.Hopeless = false
+		default:
+			d.Hint = "permission denied despite elevate_command; check that it grants root"
+		}
+		return d
+	}
+
+	if filepath.Base(res.Command[0]) == "uci" && strings.Contains(text, "entry not found") {
+		d := Diagnosis{Class: FailureUCIEntry, Hopeless: true, Hint: "no such UCI entry"}
+		if cfg := uciConfigArg(res.Command); cfg != "" {
+			d.Hint += "; list the existing keys with: uci show " + cfg
+		}
+		return d
+	}
+	return Diagnosis{}
+}
+
+// missingCommand reports whether the failure was an executable that does not
+// exist, and its name.
+func missingCommand(res Result, text string) (string, bool) {
+	var execErr *exec.Error
+	if errors.As(res.Err, &execErr) && errors.Is(execErr.Err, exec.ErrNotFound) {
+		return filepath.Base(execErr.Name), true
+	}
+	var pathErr *fs.PathError
+	if errors.As(res.Err, &pathErr) && pathErr.Op == "fork/exec" && errors.Is(pathErr, fs.ErrNotExist) {
+		return filepath.Base(pathErr.Path), true
+	}
+	name := filepath.Base(res.Command[0])
+	if strings.Contains(text, name+": not found") || strings.Contains(text, name+": command not found") {
+		return name, true
+	}
+	return "", false
+}
+
+// uciConfigArg returns the config name of the key a uci command operates on,
+// e.g. "network" for `uci get network.lan.ipaddr`.
+func uciConfigArg(argv []string) string {
+	for _, a := range argv[1:] {
+		if strings.HasPrefix(a, "-") {
+			continue
+		}
+		switch a {
+		case "get", "set", "delete", "add_list", "del_list", "rename", "show", "reorder":
+			continue
+		}
+		cfg, _, _ := strings.Cut(a, ".")
+		cfg, _, _ = strings.Cut(cfg, "=")
+		return cfg
+	}
+	return ""
+}
@@ -5,11 +5,19 @@
 //
 // Key features:
 //   - Safe command execution with minimal environment (PATH only)
-//   - Per-command timeout enforcement
+//   - Per-command timeout enforcement, within an optional budget for the
+//     whole plan
 //   - Output size limiting to prevent memory exhaustion
+//   - A resource guard deferring or refusing heavy commands while the
+//     router is short of memory, CPU or overlay space, and optional low
+//     priority execution under nice and ionice
 //   - Streaming output support for real-time feedback
+//   - Diffs of files written by tee or uci import before approval, and
+//     writing exactly the reviewed content (see Engine.Stage)
 //   - Automatic retry with AI-generated fixes
 //   - Memory-efficient string builder pooling
+//   - Fault injection for testing in builds with the faults tag
+//     (LUCICODEX_FAULTS; see ParseFaults)
 //
 // Example usage:
 //
@@ -0,0 +1,81 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+// envKey carries the engine's commandVars to the command runners.
+type envKey struct{}
+
+// commandVars are the variables commands get besides PATH (see
+// config.EnvPassthrough and config.CommandEnv).
+type commandVars struct {
+	passthrough []string            // NAME=value from this process's environment
+	byCommand   map[string][]string // NAME=value by command name, "*" for all
+	elevate     []string            // Prefix of elevated commands
+	priority    []string            // Prefix of low priority commands
+}
+
+// newCommandVars resolves the variables of cfg, or returns nil if there are
+// none. Invalid command_env entries are rejected by config.Validate; any
+// that get here are ignored.
+func newCommandVars(cfg config.Config) *commandVars {
+	if len(cfg.EnvPassthrough) == 0 && len(cfg.CommandEnv) == 0 {
+		return nil
+	}
+	v := &commandVars{byCommand: map[string][]string{}, elevate: fieldsSafe(cfg.ElevateCommand), priority: lowPriority(cfg)}
+	for _, name := range cfg.EnvPassthrough {
+		if value, ok := os.LookupEnv(name); ok {
+			v.passthrough = append(v.passthrough, name+"="+value)
+		}
+	}
+	for _, entry := range cfg.CommandEnv {
+		if command, name, value, err := config.ParseCommandEnv(entry); err == nil {
+			v.byCommand[command] = append(v.byCommand[command], name+"="+value)
+		}
+	}
+	return v
+}
+
+// forCommand returns the variables for argv. Variables set for every
+// command come before those for the command's name, which win when exec
+// removes duplicates.
+func (v *commandVars) forCommand(argv []string) []string {
+	if v == nil || len(argv) == 0 {
+		return nil
+	}
+	if len(v.priority) > 0 && len(argv) > len(v.priority) && equalArgs(argv[:len(v.priority)], v.priority) {
+		argv = argv[len(v.priority):]
+	}
+	if len(v.elevate) > 0 && len(argv) > len(v.elevate) && equalArgs(argv[:len(v.elevate)], v.elevate) {
+		argv = argv[len(v.elevate):]
+	}
+	argv = unwrapFault(argv)
+	env := append([]string(nil), v.passthrough...)
+	env = append(env, v.byCommand["*"]...)
+	return append(env, v.byCommand[path.Base(argv[0])]...)
+}
+
+// withEnv passes the engine's command variables to the runners under ctx.
+func (e *Engine) withEnv(ctx context.Context) context.Context {
+	if v := newCommandVars(e.cfg); v != nil {
+		return context.WithValue(ctx, envKey{}, v)
+	}
+	return ctx
+}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
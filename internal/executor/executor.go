@@ -12,9 +12,15 @@ import (
 	"sync"
 	"time"
 
+	"github.com/aezizhu/LuciCodex/internal/artifacts"
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/jobs"
+	"github.com/aezizhu/LuciCodex/internal/live"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
 	"github.com/aezizhu/LuciCodex/internal/plan"
 	"github.com/aezizhu/LuciCodex/internal/policy"
+	"github.com/aezizhu/LuciCodex/internal/procgroup"
 )
 
 // Output size limits to prevent unbounded memory growth
@@ -26,18 +32,80 @@ const (
 // ErrOutputTruncated indicates command output was truncated due to size limits
 var ErrOutputTruncated = errors.New("output truncated: exceeded maximum size limit")
 
+// ErrBudgetExceeded marks commands cut off or skipped because the plan ran
+// out of its wall-clock budget (config.PlanTimeoutSeconds).
+var ErrBudgetExceeded = errors.New("plan time budget exceeded")
+
+// ErrCancelled marks commands skipped because the context of the plan was
+// cancelled, as when the client that asked for it disconnected.
+var ErrCancelled = errors.New("plan cancelled")
+
 type Result struct {
 	Index     int
 	Command   []string
+	Pipe      [][]string // Further pipeline stages (see plan.PlannedCommand.Pipe)
+	NeedsRoot bool       // Copied from the planned command
 	Output    string
 	Err       error
 	Elapsed   time.Duration
-	Truncated bool // True if output was truncated due to size limits
+	Truncated bool   // True if output was truncated due to size limits
+	JobID     string // Set when the command was started as a background job
+	Artifacts []string // Files created or modified in the artifacts directory
+	Skipped   bool     // Not run: the plan's time budget was spent, its context cancelled or the resource guard refused it
+	Stdout    string    // Stdout alone, when the runner captured the streams apart
+	Stderr    string    // Stderr alone, likewise; Output has both
+	ExitCode  int       // 0 on success, -1 if the command did not exit by itself
+	Signal    string    // Signal that killed the command, if any
+	Started   time.Time // Zero for skipped commands
+	Finished  time.Time
 }
 
 type Results struct {
 	Items  []Result
 	Failed int
+	// Checks are the outcomes of the plan's verification commands, run
+	// after its commands; Verified is set when there are some and all passed
+	Checks   []Check
+	Verified bool
+}
+
+// ErrorCode classifies a run with failures: EXEC_BUDGET_EXCEEDED if the
+// plan ran out of time, EXEC_TIMEOUT if any failed command hit its timeout,
+// RESOURCES_LOW if the resource guard refused one, EXEC_FAILED otherwise, and EXEC_UNVERIFIED if the commands succeeded but
+// a verification command did not. It is empty when nothing failed.
+func (r Results) ErrorCode() errcode.Code {
+	if r.Failed == 0 {
+		if r.Unverified() {
+			return errcode.ExecUnverified
+		}
+		return ""
+	}
+	code := errcode.ExecFailed
+	for _, it := range r.Items {
+		if it.Err == nil {
+			continue
+		}
+		switch errcode.Of(it.Err) {
+		case errcode.ExecBudget:
+			return errcode.ExecBudget
+		case errcode.ExecTimeout:
+			code = errcode.ExecTimeout
+		case errcode.ResourcesLow:
+			if code == errcode.ExecFailed {
+				code = errcode.ResourcesLow
+			}
+		}
+	}
+	return code
+}
+
+// classifyErr tags a command error with the timeout code when the command's
+// context expired.
+func classifyErr(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errcode.Wrap(errcode.ExecTimeout, err)
+	}
+	return err
 }
 
 // stringBuilderPool reuses string builders to reduce allocations during streaming
@@ -63,16 +131,116 @@ func DefaultRunCommand(ctx context.Context, argv []string) (string, error) {
 	} else {
 		cmd = exec.CommandContext(ctx, argv[0], argv[1:]...)
 	}
-	// Drop env except PATH
-	cmd.Env = minimalEnv()
+	// Cancelling ctx kills whatever the command started too
+	procgroup.KillOnCancel(cmd)
+	// Drop env except PATH and the configured variables
+	cmd.Dir, cmd.Env = commandEnv(ctx, argv)
+	cmd.Stdin = commandStdin(ctx)
 
-	out, err := cmd.CombinedOutput()
+	out := &limitedBuffer{max: MaxOutputSize}
+	cmd.Stdout, cmd.Stderr = outputWriters(ctx, out)
+	err := cmd.Run()
 	// Truncate output if it exceeds the limit
-	if len(out) > MaxOutputSize {
-		truncated := out[:MaxOutputSize]
-		return string(truncated) + "\n... [output truncated] ...", err
+	if out.truncated {
+		return out.String() + "\n... [output truncated] ...", err
 	}
-	return string(out), err
+	return out.String(), err
+}
+
+// For testing, allow overriding pipeline execution
+type pipelineFn func(ctx context.Context, stages [][]string) (string, error)
+
+var runPipeline pipelineFn = DefaultRunPipeline
+
+// DefaultRunPipeline runs stages connected by pipes, without a shell: each
+// stage's stdout feeds the next stage's stdin. The output is the last stage's
+// stdout plus every stage's stderr. As in a shell, the error is that of the
+// last stage, so an early exit of a downstream filter (head) is not a failure.
+func DefaultRunPipeline(ctx context.Context, stages [][]string) (string, error) {
+	out := &limitedBuffer{max: MaxOutputSize}
+	cmds := make([]*exec.Cmd, len(stages))
+	for i, argv := range stages {
+		if len(argv) == 0 {
+			return "", fmt.Errorf("pipeline stage %d is empty", i+1)
+		}
+		cmds[i] = procgroup.KillOnCancel(exec.CommandContext(ctx, argv[0], argv[1:]...))
+		cmds[i].Dir, cmds[i].Env = commandEnv(ctx, argv)
+		_, cmds[i].Stderr = outputWriters(ctx, out)
+	}
+	cmds[len(cmds)-1].Stdout, _ = outputWriters(ctx, out)
+	cmds[0].Stdin = commandStdin(ctx)
+
+	// The parent's copies of the pipe ends are closed once the children have
+	// them, so each reader sees EOF when its writer exits
+	var ends []*os.File
+	closeEnds := func() {
+		for _, f := range ends {
+			f.Close()
+		}
+	}
+	for i := 0; i < len(cmds)-1; i++ {
+		r, w, err := os.Pipe()
+		if err != nil {
+			closeEnds()
+			return "", err
+		}
+		cmds[i].Stdout = w
+		cmds[i+1].Stdin = r
+		ends = append(ends, r, w)
+	}
+
+	for i, c := range cmds {
+		if err := c.Start(); err != nil {
+			closeEnds()
+			for _, started := range cmds[:i] {
+				started.Process.Kill()
+				started.Wait()
+			}
+			return out.String(), fmt.Errorf("pipeline stage %d: %w", i+1, err)
+		}
+	}
+	closeEnds()
+
+	var err error
+	for i, c := range cmds {
+		if werr := c.Wait(); i == len(cmds)-1 {
+			err = werr
+		}
+	}
+	s := out.String()
+	if out.truncated {
+		s += "\n... [output truncated] ...\n"
+	}
+	return s, err
+}
+
+// limitedBuffer collects output from several processes, dropping anything
+// beyond max bytes.
+type limitedBuffer struct {
+	mu        sync.Mutex
+	buf       strings.Builder
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.max - b.buf.Len(); len(p) > room {
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
 }
 
 // GetRunCommand returns the current run command function.
@@ -86,17 +254,125 @@ func SetRunCommand(fn execFn) {
 }
 
 type Engine struct {
-	cfg config.Config
+	cfg          config.Config
+	artifactsDir string
+	deadline     time.Time // End of the plan's time budget; zero if none
+	staged       map[int]*stagedWrite // Kept by Stage, by command index
 }
 
 func New(cfg config.Config) *Engine { return &Engine{cfg: cfg} }
 
+// UseArtifacts runs foreground commands in dir with artifacts.EnvVar set to
+// it, and records the files they create or modify in Result.Artifacts.
+// Background jobs are not affected.
+func (e *Engine) UseArtifacts(dir string) { e.artifactsDir = dir }
+
+// workDirKey carries the artifacts directory from the engine to the
+// command runners.
+type workDirKey struct{}
+
+// commandEnv returns the working directory and environment for argv run
+// under ctx: PATH, the engine's command variables (see withEnv), and the
+// artifacts directory when the engine uses one.
+func commandEnv(ctx context.Context, argv []string) (string, []string) {
+	env := minimalEnv()
+	if v, ok := ctx.Value(envKey{}).(*commandVars); ok {
+		env = append(env, v.forCommand(argv)...)
+	}
+	dir, _ := ctx.Value(workDirKey{}).(string)
+	if dir == "" {
+		return "", env
+	}
+	return dir, append(env, artifacts.EnvVar+"="+dir)
+}
+
+// withArtifacts prepares ctx for running a command in the artifacts
+// directory. done fills in r.Artifacts once the command has finished.
+func (e *Engine) withArtifacts(ctx context.Context) (context.Context, func(r *Result)) {
+	if e.artifactsDir == "" {
+		return ctx, func(*Result) {}
+	}
+	before := artifacts.Snapshot(e.artifactsDir)
+	return context.WithValue(ctx, workDirKey{}, e.artifactsDir), func(r *Result) {
+		r.Artifacts = artifacts.Changed(before, e.artifactsDir)
+	}
+}
+
+// StartBudget starts the plan's wall-clock budget (PlanTimeoutSeconds) now.
+// RunPlan and RunPlanStreaming call it; callers that run a plan command by
+// command call it before the first one.
+func (e *Engine) StartBudget() {
+	e.deadline = time.Time{}
+	if e.cfg.PlanTimeoutSeconds > 0 {
+		e.deadline = time.Now().Add(time.Duration(e.cfg.PlanTimeoutSeconds) * time.Second)
+	}
+}
+
+// budgetSpent reports whether the plan's time budget has run out.
+func (e *Engine) budgetSpent() bool {
+	return !e.deadline.IsZero() && !time.Now().Before(e.deadline)
+}
+
+// commandTimeout returns how long the next command may run: the per-command
+// timeout, cut to what is left of the budget. cut reports whether the budget
+// is the limit.
+func (e *Engine) commandTimeout() (timeout time.Duration, cut bool) {
+	timeout = time.Duration(e.cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	if !e.deadline.IsZero() {
+		if left := time.Until(e.deadline); left < timeout {
+			return left, true
+		}
+	}
+	return timeout, false
+}
+
+// budgetErr classifies the error of a command that timed out because the
+// budget cut its timeout.
+func budgetErr(err error, cut bool) error {
+	if cut && errcode.Of(err) == errcode.ExecTimeout {
+		return errcode.Wrap(errcode.ExecBudget, fmt.Errorf("%w: %w", ErrBudgetExceeded, err))
+	}
+	return err
+}
+
+// skippedResult is the result of a command the budget left no time for.
+func skippedResult(index int, pc plan.PlannedCommand) Result {
+	return Result{
+		Index:     index,
+		Command:   pc.Command,
+		Pipe:      pc.Pipe,
+		NeedsRoot: pc.NeedsRoot,
+		Err:       errcode.Wrap(errcode.ExecBudget, ErrBudgetExceeded),
+		Skipped:   true,
+	}
+}
+
+// cancelledResult is the result of a command skipped because ctx is done.
+func cancelledResult(ctx context.Context, index int, pc plan.PlannedCommand) Result {
+	r := skippedResult(index, pc)
+	r.Err = errcode.Wrap(errcode.ExecFailed, fmt.Errorf("%w: %w", ErrCancelled, ctx.Err()))
+	return r
+}
+
 // FixPlanner provides fixes for failed commands.
 type FixPlanner interface {
 	GenerateErrorFix(ctx context.Context, originalCommand string, errorOutput string, attempt int) (plan.Plan, error)
 }
 
+// RunPlan runs the commands of p in order, then its verification commands.
+// Once the plan's time budget is spent, the remaining commands are skipped.
 func (e *Engine) RunPlan(ctx context.Context, p plan.Plan) Results {
+	e.StartBudget()
+	results := e.runPlan(ctx, p)
+	e.Verify(ctx, p, &results)
+	return results
+}
+
+// runPlan is RunPlan within the budget already started, as fix plans run.
+func (e *Engine) runPlan(ctx context.Context, p plan.Plan) Results {
 	results := Results{
 		Items: make([]Result, 0, len(p.Commands)), // Pre-allocate for efficiency
 	}
@@ -114,53 +390,137 @@ func (e *Engine) RunPlan(ctx context.Context, p plan.Plan) Results {
 // The onStart callback is called when a command begins execution.
 // The onOutput callback is called for each line of output.
 // The onComplete callback is called when a command finishes.
+// Once the plan's time budget is spent, the cutoff is announced and the
+// remaining commands are skipped.
 func (e *Engine) RunPlanStreaming(ctx context.Context, p plan.Plan, w io.Writer) Results {
+	e.StartBudget()
 	results := Results{
 		Items: make([]Result, 0, len(p.Commands)), // Pre-allocate for efficiency
 	}
 	for i, pc := range p.Commands {
+		if e.budgetSpent() {
+			fmt.Fprintf(w, "\n\033[33m⏱ Plan time budget of %ds exceeded; skipping the remaining %d command(s)\033[0m\n", e.cfg.PlanTimeoutSeconds, len(p.Commands)-i)
+			for j := i; j < len(p.Commands); j++ {
+				results.Items = append(results.Items, skippedResult(j, p.Commands[j]))
+				results.Failed++
+			}
+			break
+		}
 		r := e.runOneStreaming(ctx, i, pc, w)
 		if r.Err != nil {
 			results.Failed++
 		}
 		results.Items = append(results.Items, r)
 	}
+	if len(p.Verify) > 0 {
+		e.Verify(ctx, p, &results)
+		printChecks(w, results.Checks)
+	}
 	return results
 }
 
-func (e *Engine) runOneStreaming(ctx context.Context, index int, pc plan.PlannedCommand, w io.Writer) Result {
+func (e *Engine) runOneStreaming(ctx context.Context, index int, pc plan.PlannedCommand, w io.Writer) (r Result) {
 	start := time.Now()
-	r := Result{Index: index, Command: pc.Command}
+	ctx, done := e.withArtifacts(e.withEnv(ctx))
+	defer func() {
+		done(&r)
+		r.finish(start)
+	}()
+	r = Result{Index: index, Command: pc.Command, Pipe: pc.Pipe, NeedsRoot: pc.NeedsRoot}
 	if len(pc.Command) == 0 {
 		r.Err = errors.New("empty command")
 		return r
 	}
+	if e.budgetSpent() {
+		fmt.Fprintf(w, "\n\033[1m[%d] Skipped:\033[0m %s (plan time budget exceeded)\n", index+1, FormatPlanned(pc))
+		return skippedResult(index, pc)
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintf(w, "\n\033[1m[%d] Skipped:\033[0m %s (cancelled)\n", index+1, FormatPlanned(pc))
+		return cancelledResult(ctx, index, pc)
+	}
+	if err := e.guard(ctx, pc, func(msg string) {
+		fmt.Fprintf(w, "\n\033[33m⏳ [%d] %s\033[0m\n", index+1, msg)
+	}); err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintf(w, "\n\033[1m[%d] Skipped:\033[0m %s (cancelled)\n", index+1, FormatPlanned(pc))
+			return cancelledResult(ctx, index, pc)
+		}
+		fmt.Fprintf(w, "\n\033[1m[%d] Skipped:\033[0m %s (%v)\n", index+1, FormatPlanned(pc), err)
+		return refusedResult(index, pc, err)
+	}
 
 	// Show command being executed
-	fmt.Fprintf(w, "\n\033[1m[%d] Executing:\033[0m %s\n", index+1, FormatCommand(pc.Command))
+	fmt.Fprintf(w, "\n\033[1m[%d] Executing:\033[0m %s\n", index+1, FormatPlanned(pc))
+	feed := live.Start(index, FormatPlanned(pc))
+	defer func() { feed.Finish(r.Output, r.Err != nil) }()
 
-	timeout := time.Duration(e.cfg.TimeoutSeconds) * time.Second
-	if timeout <= 0 {
-		timeout = 30 * time.Second
+	if pc.IsBuiltin() {
+		r = e.runBuiltin(ctx, index, pc)
+		for _, line := range strings.Split(strings.TrimRight(r.Output, "\n"), "\n") {
+			if line != "" {
+				fmt.Fprintf(w, "  %s\n", line)
+			}
+		}
+		if r.Err != nil {
+			fmt.Fprintf(w, "  \033[31m✗ Failed\033[0m (%s): %v\n", r.Elapsed, r.Err)
+		} else {
+			fmt.Fprintf(w, "  \033[32m✓ Done\033[0m (%s)\n", r.Elapsed)
+		}
+		return r
+	}
+
+	if pc.Background {
+		r = e.startJob(index, pc)
+		if r.Err != nil {
+			fmt.Fprintf(w, "  \033[31m✗ Failed\033[0m: %v\n", r.Err)
+		} else {
+			fmt.Fprintf(w, "  %s", r.Output)
+		}
+		return r
 	}
+
+	timeout, cut := e.commandTimeout()
 	cctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	argv := pc.Command
-	if pc.NeedsRoot && strings.TrimSpace(e.cfg.ElevateCommand) != "" {
-		elev := fieldsSafe(e.cfg.ElevateCommand)
-		if len(elev) > 0 {
-			argv = append(elev, argv...)
+	if sw := e.takeStaged(index, pc); sw != nil || len(pc.Pipe) > 0 {
+		// Pipeline and staged output is shown once the command finishes
+		pctx, s := withStreams(cctx)
+		var out string
+		var err error
+		if sw != nil {
+			out, err = e.runStaged(pctx, pc, sw)
+		} else {
+			out, err = runPipeline(pctx, e.elevateStages(pc))
 		}
+		r.Output = out
+		r.Err = budgetErr(classifyErr(cctx, err), cut)
+		r.Elapsed = time.Since(start)
+		s.fill(&r)
+		for _, line := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+			if line != "" {
+				fmt.Fprintf(w, "  %s\n", line)
+			}
+		}
+		if r.Err != nil {
+			fmt.Fprintf(w, "  \033[31m✗ Failed\033[0m (%s): %v\n", r.Elapsed, r.Err)
+		} else {
+			fmt.Fprintf(w, "  \033[32m✓ Done\033[0m (%s)\n", r.Elapsed)
+		}
+		return r
 	}
 
+	argv := e.elevate(pc.NeedsRoot, pc.Command)
+
 	var cmd *exec.Cmd
 	if len(argv) == 1 {
 		cmd = exec.CommandContext(cctx, argv[0])
 	} else {
 		cmd = exec.CommandContext(cctx, argv[0], argv[1:]...)
 	}
-	cmd.Env = minimalEnv()
+	procgroup.KillOnCancel(cmd)
+	cmd.Dir, cmd.Env = commandEnv(cctx, argv)
 
 	// Create pipes for stdout and stderr
 	stdout, err := cmd.StdoutPipe()
@@ -190,6 +550,8 @@ func (e *Engine) runOneStreaming(ctx context.Context, index int, pc plan.Planned
 	var outputMu sync.Mutex
 	var wg sync.WaitGroup
 	var truncated bool
+	var s streams
+	s.stdout.max, s.stderr.max = MaxOutputSize, MaxOutputSize
 	wg.Add(2)
 
 	// Stream stdout with size limit
@@ -207,7 +569,9 @@ func (e *Engine) runOneStreaming(ctx context.Context, index int, pc plan.Planned
 				outputBuf.WriteString("\n... [output truncated] ...\n")
 			}
 			outputMu.Unlock()
+			fmt.Fprintln(&s.stdout, line)
 			fmt.Fprintf(w, "  %s\n", line)
+			fmt.Fprintln(feed, line)
 		}
 		if err := scanner.Err(); err != nil {
 			outputMu.Lock()
@@ -231,7 +595,9 @@ func (e *Engine) runOneStreaming(ctx context.Context, index int, pc plan.Planned
 				outputBuf.WriteString("\n... [output truncated] ...\n")
 			}
 			outputMu.Unlock()
+			fmt.Fprintln(&s.stderr, line)
 			fmt.Fprintf(w, "  \033[33m%s\033[0m\n", line) // Yellow for stderr
+			fmt.Fprintln(feed, line)
 		}
 		if err := scanner.Err(); err != nil {
 			outputMu.Lock()
@@ -243,9 +609,10 @@ func (e *Engine) runOneStreaming(ctx context.Context, index int, pc plan.Planned
 	wg.Wait()
 	err = cmd.Wait()
 	r.Output = outputBuf.String()
-	r.Err = err
+	r.Err = budgetErr(classifyErr(cctx, err), cut)
 	r.Elapsed = time.Since(start)
 	r.Truncated = truncated
+	s.fill(&r)
 
 	// Show completion status
 	if r.Err != nil {
@@ -262,34 +629,107 @@ func (e *Engine) RunCommand(ctx context.Context, index int, pc plan.PlannedComma
 	return e.runOne(ctx, index, pc)
 }
 
-func (e *Engine) runOne(ctx context.Context, index int, pc plan.PlannedCommand) Result {
+// RunCommandStreaming executes a single planned command, streaming its output to w.
+func (e *Engine) RunCommandStreaming(ctx context.Context, index int, pc plan.PlannedCommand, w io.Writer) Result {
+	return e.runOneStreaming(ctx, index, pc, w)
+}
+
+func (e *Engine) runOne(ctx context.Context, index int, pc plan.PlannedCommand) (r Result) {
 	start := time.Now()
-	r := Result{Index: index, Command: pc.Command}
+	ctx, done := e.withArtifacts(e.withEnv(ctx))
+	defer func() {
+		done(&r)
+		r.finish(start)
+	}()
+	r = Result{Index: index, Command: pc.Command, Pipe: pc.Pipe, NeedsRoot: pc.NeedsRoot}
 	if len(pc.Command) == 0 {
 		r.Err = errors.New("empty command")
 		return r
 	}
-	// Set a timeout per command
-	timeout := time.Duration(e.cfg.TimeoutSeconds) * time.Second
-	if timeout <= 0 {
-		timeout = 30 * time.Second
+	if e.budgetSpent() {
+		return skippedResult(index, pc)
+	}
+	if ctx.Err() != nil {
+		return cancelledResult(ctx, index, pc)
+	}
+	if err := e.guard(ctx, pc, nil); err != nil {
+		if ctx.Err() != nil {
+			return cancelledResult(ctx, index, pc)
+		}
+		return refusedResult(index, pc, err)
 	}
+	feed := live.Start(index, FormatPlanned(pc))
+	defer func() { feed.Finish(r.Output, r.Err != nil) }()
+	if pc.IsBuiltin() {
+		return e.runBuiltin(ctx, index, pc)
+	}
+	if pc.Background {
+		return e.startJob(index, pc)
+	}
+	// Set a timeout per command, within the plan's budget
+	timeout, cut := e.commandTimeout()
 	cctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	// No shell; exec argv directly. Optionally prefix with elevation tool.
-	argv := pc.Command
-	if pc.NeedsRoot && strings.TrimSpace(e.cfg.ElevateCommand) != "" {
+	var out string
+	var err error
+	sctx, s := withStreams(cctx)
+	if sw := e.takeStaged(index, pc); sw != nil {
+		out, err = e.runStaged(sctx, pc, sw)
+	} else if len(pc.Pipe) > 0 {
+		out, err = runPipeline(sctx, e.elevateStages(pc))
+	} else {
+		out, err = runCommand(sctx, e.elevate(pc.NeedsRoot, pc.Command))
+	}
+	r.Output = out
+	r.Err = budgetErr(classifyErr(cctx, err), cut)
+	r.Elapsed = time.Since(start)
+	s.fill(&r)
+	return r
+}
+
+// elevate prefixes argv with the elevation command when needsRoot is set,
+// and that with the low priority wrapper when LowPriority is (see
+// lowPriority), so the elevated command inherits the priority. In faults
+// builds, a command matching a fault is replaced by its script first.
+func (e *Engine) elevate(needsRoot bool, argv []string) []string {
+	argv = faults.apply(argv)
+	if needsRoot && strings.TrimSpace(e.cfg.ElevateCommand) != "" {
 		// Split elevate command into tokens (simple whitespace split; avoid shell features)
-		elev := fieldsSafe(e.cfg.ElevateCommand)
-		if len(elev) > 0 {
+		if elev := fieldsSafe(e.cfg.ElevateCommand); len(elev) > 0 {
 			argv = append(elev, argv...)
 		}
 	}
+	if prio := lowPriority(e.cfg); len(prio) > 0 {
+		return append(prio, argv...)
+	}
+	return argv
+}
 
-	out, err := runCommand(cctx, argv)
-	r.Output = out
-	r.Err = err
+// elevateStages returns pc's pipeline stages, each elevated if pc needs root.
+func (e *Engine) elevateStages(pc plan.PlannedCommand) [][]string {
+	stages := pc.Stages()
+	for i, argv := range stages {
+		stages[i] = e.elevate(pc.NeedsRoot, argv)
+	}
+	return stages
+}
+
+// startJob launches a background command detached from the plan. It is not
+// bound by the per-command timeout; use the jobs commands to follow or stop it.
+func (e *Engine) startJob(index int, pc plan.PlannedCommand) Result {
+	start := time.Now()
+	r := Result{Index: index, Command: pc.Command}
+	argv := e.elevate(pc.NeedsRoot, pc.Command)
+	env := append(minimalEnv(), newCommandVars(e.cfg).forCommand(argv)...)
+	j, err := jobs.Open(e.cfg).Start(argv, env)
 	r.Elapsed = time.Since(start)
+	if err != nil {
+		r.Err = fmt.Errorf("start background job: %w", err)
+		return r
+	}
+	r.JobID = j.ID
+	r.Output = fmt.Sprintf("started background job %s (pid %d); follow with `lucicodex jobs tail %s`\n", j.ID, j.PID, j.ID)
 	return r
 }
 
@@ -341,15 +781,40 @@ func FormatCommand(argv []string) string {
 	return b.String()
 }
 
+// FormatPlanned is FormatCommand for a planned command, showing pipeline
+// stages separated by " | ".
+func FormatPlanned(pc plan.PlannedCommand) string {
+	parts := make([]string, 0, 1+len(pc.Pipe))
+	for _, argv := range pc.Stages() {
+		parts = append(parts, FormatCommand(argv))
+	}
+	return strings.Join(parts, " | ")
+}
+
 // AutoRetry attempts to fix each failing command up to MaxRetries using the provided planner.
+// Failures are diagnosed first (see Diagnose): known local remediations are
+// tried before asking the planner, and hopeless failures are not retried.
+// Once every command succeeded, a failed verification (see Verify) is
+// retried the same way, and the checks run again after each fix.
+// Fixes run within what is left of the plan's time budget; once it is spent,
+// or ctx is cancelled, retrying stops, and skipped commands are not retried.
 // It validates fix plans with the supplied policy engine (if non-nil) before execution.
 // Optional logf can be provided to emit user-facing messages.
 func (e *Engine) AutoRetry(ctx context.Context, planner FixPlanner, pol *policy.Engine, results Results, logf func(format string, args ...interface{})) Results {
-	if !e.cfg.AutoRetry || e.cfg.MaxRetries <= 0 || results.Failed == 0 {
+	if !e.cfg.AutoRetry || e.cfg.MaxRetries <= 0 || (results.Failed == 0 && !results.Unverified()) {
 		return results
 	}
 
-	for attempt := 1; attempt <= e.cfg.MaxRetries && results.Failed > 0; attempt++ {
+	hopeless := map[int]bool{}
+	localTried := map[int]bool{}
+	verifyHopeless := false
+	for attempt := 1; attempt <= e.cfg.MaxRetries && (results.Failed > 0 || results.Unverified() && !verifyHopeless); attempt++ {
+		if results.Failed == 0 {
+			if !e.retryVerification(ctx, planner, pol, &results, attempt, logf) {
+				verifyHopeless = true
+			}
+			continue
+		}
 		// Snapshot failing indices to avoid re-processing appended fix results within the same attempt.
 		failing := make([]int, 0, results.Failed)
 		for i := range results.Items {
@@ -357,56 +822,73 @@ func (e *Engine) AutoRetry(ctx context.Context, planner FixPlanner, pol *policy.
 				failing = append(failing, i)
 			}
 		}
+		fixed := false
 		for _, idx := range failing {
 			res := &results.Items[idx]
-			if res.Err == nil || results.Failed == 0 {
+			if res.Err == nil || results.Failed == 0 || hopeless[idx] || res.Skipped {
 				continue
 			}
+			if e.budgetSpent() {
+				if logf != nil {
+					logf("\nNot retrying: the plan's time budget is spent\n")
+				}
+				return results
+			}
+			if ctx.Err() != nil {
+				if logf != nil {
+					logf("\nNot retrying: the plan was cancelled\n")
+				}
+				return results
+			}
 
-			origCmd := FormatCommand(res.Command)
+			origCmd := FormatPlanned(plan.PlannedCommand{Command: res.Command, Pipe: res.Pipe})
 			if logf != nil {
 				logf("\n??  Command failed: %s\n", origCmd)
 				logf("Error: %v\n", res.Err)
 				logf("Output: %s\n", res.Output)
-				logf("?? Attempting automatic fix (attempt %d/%d)...\n", attempt, e.cfg.MaxRetries)
 			}
 
-			fixCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-			fixPlan, err := planner.GenerateErrorFix(fixCtx, origCmd, res.Output, attempt)
-			cancel()
-			if err != nil || len(fixPlan.Commands) == 0 {
+			diag := e.Diagnose(*res)
+			if diag.Hint != "" && logf != nil {
+				logf("Diagnosis: %s\n", diag.Hint)
+			}
+			if diag.Hopeless {
+				hopeless[idx] = true
 				if logf != nil {
-					if err != nil {
-						logf("Failed to generate fix: %v\n", err)
-					} else {
-						logf("No fix commands generated\n")
-					}
+					logf("Not retrying: this failure cannot be fixed automatically\n")
 				}
 				continue
 			}
-
-			if pol != nil {
-				if err := pol.ValidatePlan(fixPlan); err != nil {
-					if logf != nil {
-						logf("Fix plan rejected by policy: %v\n", err)
-					}
-					continue
-				}
+			if logf != nil {
+				logf("?? Attempting automatic fix (attempt %d/%d)...\n", attempt, e.cfg.MaxRetries)
 			}
 
-			if logf != nil {
-				if fixPlan.Summary != "" {
-					logf("\n?? Fix plan: %s\n", fixPlan.Summary)
-				}
-				for _, cmd := range fixPlan.Commands {
-					logf("  ? %s\n", FormatCommand(cmd.Command))
+			var fixPlan plan.Plan
+			var err error
+			if diag.Fix != nil && !localTried[idx] {
+				// Known remediation; the model is only asked if it fails
+				localTried[idx] = true
+				fixPlan = *diag.Fix
+			} else if prompts.Suspicious(res.Output) {
+				// The model would see text planted in the output; a plan
+				// built from it is never run without review
+				hopeless[idx] = true
+				if logf != nil {
+					logf("Not retrying: the output contains instruction-like text, fix it manually\n")
 				}
+				continue
+			} else {
+				fixPlan, err = e.askFix(ctx, planner, origCmd, res.Output, attempt)
+			}
+			if !acceptFix(fixPlan, err, pol, logf) {
+				continue
 			}
 
-			fixResults := e.RunPlan(ctx, fixPlan)
+			fixResults := e.runPlan(ctx, fixPlan)
 			if fixResults.Failed == 0 {
 				results.Items[idx].Err = nil
 				results.Failed--
+				fixed = true
 				if logf != nil {
 					logf("? Fix successful!\n")
 				}
@@ -424,7 +906,119 @@ func (e *Engine) AutoRetry(ctx context.Context, planner FixPlanner, pol *policy.
 			}
 			results.Items = append(results.Items, fixResults.Items...)
 		}
+		if fixed && len(results.Checks) > 0 {
+			// The checks may have failed because of a command that is fixed now
+			results.setChecks(e.verify(ctx, checkCommands(results.Checks)))
+		}
 	}
 
 	return results
 }
+
+// retryVerification asks for a fix of the first failed check of results,
+// runs it and then all checks again. It returns false if the check cannot
+// be fixed automatically.
+func (e *Engine) retryVerification(ctx context.Context, planner FixPlanner, pol *policy.Engine, results *Results, attempt int, logf func(format string, args ...interface{})) bool {
+	var check Check
+	for _, c := range results.Checks {
+		if !c.Passed {
+			check = c
+			break
+		}
+	}
+	if e.budgetSpent() {
+		if logf != nil {
+			logf("\nNot retrying: the plan's time budget is spent\n")
+		}
+		return false
+	}
+	if ctx.Err() != nil {
+		if logf != nil {
+			logf("\nNot retrying: the plan was cancelled\n")
+		}
+		return false
+	}
+	cmd := FormatPlanned(check.Command)
+	if logf != nil {
+		logf("\n??  Verification failed: %s\n", cmd)
+		logf("Reason: %s\n", check.Reason)
+	}
+	if prompts.Suspicious(check.Output) {
+		if logf != nil {
+			logf("Not retrying: the output contains instruction-like text, fix it manually\n")
+		}
+		return false
+	}
+	if logf != nil {
+		logf("?? Attempting automatic fix (attempt %d/%d)...\n", attempt, e.cfg.MaxRetries)
+	}
+	fixPlan, err := e.askFix(ctx, planner, cmd, "Verification failed: "+check.Reason+"\n"+check.Output, attempt)
+	if !acceptFix(fixPlan, err, pol, logf) {
+		return true
+	}
+	fixResults := e.runPlan(ctx, fixPlan)
+	results.Items = append(results.Items, fixResults.Items...)
+	results.setChecks(e.verify(ctx, checkCommands(results.Checks)))
+	if logf != nil {
+		if results.Verified {
+			logf("? Verification passed!\n")
+		} else {
+			logf("? Still unverified\n")
+		}
+	}
+	return true
+}
+
+// askFix asks the planner for a fix of a failed command, within what is
+// left of the plan's time budget.
+func (e *Engine) askFix(ctx context.Context, planner FixPlanner, cmd, output string, attempt int) (plan.Plan, error) {
+	fixTimeout := 30 * time.Second
+	if !e.deadline.IsZero() && time.Until(e.deadline) < fixTimeout {
+		fixTimeout = time.Until(e.deadline)
+	}
+	fixCtx, cancel := context.WithTimeout(ctx, fixTimeout)
+	defer cancel()
+	return planner.GenerateErrorFix(fixCtx, cmd, output, attempt)
+}
+
+// acceptFix reports whether a generated fix plan may run: it has commands,
+// passes the policy and raises no warnings, since nobody can acknowledge
+// them during an automatic retry.
+func acceptFix(fixPlan plan.Plan, err error, pol *policy.Engine, logf func(format string, args ...interface{})) bool {
+	if err != nil || len(fixPlan.Commands) == 0 {
+		if logf != nil {
+			if err != nil {
+				logf("Failed to generate fix: %v\n", err)
+			} else {
+				logf("No fix commands generated\n")
+			}
+		}
+		return false
+	}
+
+	if pol != nil {
+		if err := pol.ValidatePlan(fixPlan); err != nil {
+			if logf != nil {
+				logf("Fix plan rejected by policy: %v\n", err)
+			}
+			return false
+		}
+		// Nobody can acknowledge warnings during an automatic retry
+		if w := pol.Warnings(fixPlan); len(w) > 0 {
+			if logf != nil {
+				logf("Fix plan skipped: %s\n", w[0].Message)
+			}
+			return false
+		}
+	}
+
+	if logf != nil {
+		if fixPlan.Summary != "" {
+			logf("\n?? Fix plan: %s\n", fixPlan.Summary)
+		}
+		for _, cmd := range fixPlan.Commands {
+			logf("  ? %s\n", FormatPlanned(cmd))
+		}
+	}
+	return true
+}
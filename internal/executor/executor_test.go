@@ -3,10 +3,14 @@ package executor
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/jobs"
 	"github.com/aezizhu/LuciCodex/internal/plan"
 	"github.com/aezizhu/LuciCodex/internal/testutil"
 )
@@ -122,6 +126,13 @@ func TestRunCommand_WithTimeout(t *testing.T) {
 
 	testutil.AssertError(t, result.Err)
 	testutil.AssertContains(t, result.Err.Error(), "context deadline exceeded")
+	if errcode.Of(result.Err) != errcode.ExecTimeout {
+		t.Errorf("expected EXEC_TIMEOUT, got %s", errcode.Of(result.Err))
+	}
+	results := Results{Items: []Result{{Err: errors.New("exit status 1")}, result}, Failed: 2}
+	if results.ErrorCode() != errcode.ExecTimeout {
+		t.Errorf("expected run classified as EXEC_TIMEOUT, got %s", results.ErrorCode())
+	}
 }
 
 func TestRunCommand_WithElevation(t *testing.T) {
@@ -372,6 +383,107 @@ func TestDefaultRunCommand_RealExecution(t *testing.T) {
 	testutil.AssertContains(t, output, "test")
 }
 
+func TestEngine_UseArtifacts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping real execution in short mode")
+	}
+
+	dir := t.TempDir()
+	e := New(config.Config{TimeoutSeconds: 5})
+	e.UseArtifacts(dir)
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"sh", "-c", "echo report > report.txt; echo $LUCICODEX_ARTIFACTS"}},
+		{Command: []string{"pwd"}},
+		{Command: []string{"sh", "-c", "touch -d @0 kept; true"}},
+	}}
+	results := e.RunPlan(context.Background(), p)
+	testutil.AssertEqual(t, results.Failed, 0)
+	testutil.AssertEqual(t, strings.TrimSpace(results.Items[0].Output), dir)
+	testutil.AssertEqual(t, strings.Join(results.Items[0].Artifacts, ","), "report.txt")
+	testutil.AssertEqual(t, strings.TrimSpace(results.Items[1].Output), dir)
+	testutil.AssertEqual(t, len(results.Items[1].Artifacts), 0)
+	testutil.AssertEqual(t, strings.Join(results.Items[2].Artifacts, ","), "kept")
+
+	// Without an artifacts directory commands see PATH only
+	out, err := DefaultRunCommand(context.Background(), []string{"sh", "-c", "echo x$LUCICODEX_ARTIFACTS"})
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, strings.TrimSpace(out), "x")
+}
+
+func TestEngine_CommandEnv(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping real execution in short mode")
+	}
+
+	t.Setenv("LUCICODEX_TEST_PROXY", "http://proxy:3128")
+	t.Setenv("LUCICODEX_TEST_SECRET", "hunter22")
+	e := New(config.Config{
+		TimeoutSeconds: 5,
+		EnvPassthrough: []string{"LUCICODEX_TEST_PROXY", "LUCICODEX_TEST_UNSET"},
+		CommandEnv:     []string{"*:LANG=C", "sh:LANG=C.UTF-8", "sh:TERM=dumb", "opkg:http_proxy=http://other:8080"},
+	})
+	script := "echo $LUCICODEX_TEST_PROXY,$LUCICODEX_TEST_SECRET,$LANG,$TERM,$http_proxy"
+	want := "http://proxy:3128,,C.UTF-8,dumb,"
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"sh", "-c", script}},
+		{Command: []string{"echo"}, Pipe: [][]string{{"sh", "-c", "cat; " + script}}},
+	}}
+	results := e.RunPlan(context.Background(), p)
+	testutil.AssertEqual(t, results.Failed, 0)
+	testutil.AssertEqual(t, strings.TrimSpace(results.Items[0].Output), want)
+	testutil.AssertEqual(t, strings.TrimSpace(results.Items[1].Output), want)
+
+	var buf strings.Builder
+	results = e.RunPlanStreaming(context.Background(), plan.Plan{Commands: p.Commands[:1]}, &buf)
+	testutil.AssertEqual(t, strings.TrimSpace(results.Items[0].Output), want)
+
+	// Variables for every command apply to the others too
+	results = e.RunPlan(context.Background(), plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"env"}}}})
+	testutil.AssertTrue(t, strings.Contains(results.Items[0].Output, "LANG=C\n"))
+	testutil.AssertTrue(t, !strings.Contains(results.Items[0].Output, "TERM="))
+}
+
+func TestRunPlan_ResultStreams(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping real execution in short mode")
+	}
+
+	e := New(config.Config{TimeoutSeconds: 5})
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"sh", "-c", "echo out; echo err >&2; exit 3"}},
+		{Command: []string{"sh", "-c", "kill -TERM $$"}},
+		{Command: []string{"echo", "a"}, Pipe: [][]string{{"sh", "-c", "cat; echo b >&2"}}},
+		{Command: []string{"/nonexistent/cmd"}},
+	}}
+	check := func(results Results) {
+		t.Helper()
+		r := results.Items[0]
+		testutil.AssertEqual(t, r.Stdout, "out\n")
+		testutil.AssertEqual(t, r.Stderr, "err\n")
+		testutil.AssertContains(t, r.Output, "out\n")
+		testutil.AssertContains(t, r.Output, "err\n")
+		testutil.AssertEqual(t, r.ExitCode, 3)
+		testutil.AssertTrue(t, !r.Started.IsZero() && !r.Finished.Before(r.Started))
+		testutil.AssertEqual(t, results.Items[1].ExitCode, -1)
+		testutil.AssertEqual(t, results.Items[1].Signal, "terminated")
+		testutil.AssertEqual(t, results.Items[2].Stdout, "a\n")
+		testutil.AssertEqual(t, results.Items[2].Stderr, "b\n")
+		testutil.AssertEqual(t, results.Items[2].ExitCode, 0)
+		testutil.AssertEqual(t, results.Items[3].ExitCode, -1)
+	}
+	check(e.RunPlan(context.Background(), p))
+	var buf strings.Builder
+	check(e.RunPlanStreaming(context.Background(), p, &buf))
+
+	item := e.RunPlan(context.Background(), plan.Plan{Commands: p.Commands[:1]}).Items[0].LogItem()
+	testutil.AssertEqual(t, item.Stderr, "err\n")
+	testutil.AssertEqual(t, item.ExitCode, 3)
+	testutil.AssertTrue(t, item.Started != nil && item.Finished != nil)
+	sc := e.RunPlan(context.Background(), plan.Plan{Commands: p.Commands[:1]}).Items[0].SummaryCommand()
+	testutil.AssertEqual(t, sc.Output, "out\n")
+	testutil.AssertTrue(t, sc.ExitCode != nil && *sc.ExitCode == 3)
+}
+
 func TestDefaultRunCommand_Timeout(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping timeout test in short mode")
@@ -417,3 +529,146 @@ func TestMinimalEnv_Empty(t *testing.T) {
 	}
 	testutil.AssertTrue(t, found)
 }
+
+func TestRunCommand_Background(t *testing.T) {
+	cfg := testutil.DefaultTestConfig()
+	cfg.JobsDir = t.TempDir()
+	engine := New(cfg)
+
+	originalRunCommand := runCommand
+	defer func() { runCommand = originalRunCommand }()
+	runCommand = func(ctx context.Context, argv []string) (string, error) {
+		t.Fatal("background command must not run in the foreground")
+		return "", nil
+	}
+
+	pc := plan.PlannedCommand{Command: []string{"sleep", "30"}, Background: true}
+	result := engine.RunCommand(context.Background(), 0, pc)
+	testutil.AssertNoError(t, result.Err)
+	testutil.AssertTrue(t, result.JobID != "")
+	testutil.AssertContains(t, result.Output, "started background job "+result.JobID)
+
+	m := jobs.Open(cfg)
+	j, err := m.Get(result.JobID)
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, j.State, jobs.StateRunning)
+	_, err = m.Stop(result.JobID)
+	testutil.AssertNoError(t, err)
+}
+
+func TestDefaultRunPipeline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping real execution in short mode")
+	}
+
+	ctx := context.Background()
+	output, err := DefaultRunPipeline(ctx, [][]string{{"printf", "a\nb\nc\n"}, {"grep", "-v", "b"}, {"tr", "a-z", "A-Z"}})
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, output, "A\nC\n")
+
+	// The exit status is that of the last stage
+	_, err = DefaultRunPipeline(ctx, [][]string{{"printf", "a\n"}, {"grep", "x"}})
+	testutil.AssertError(t, err)
+
+	_, err = DefaultRunPipeline(ctx, [][]string{{"printf", "a\n"}, {"/nonexistent/cmd"}})
+	testutil.AssertError(t, err)
+	testutil.AssertContains(t, err.Error(), "stage 2")
+}
+
+func TestRunPlan_Pipeline(t *testing.T) {
+	cfg := testutil.DefaultTestConfig()
+	cfg.ElevateCommand = "sudo"
+	engine := New(cfg)
+
+	var got [][]string
+	oldPipeline := runPipeline
+	defer func() { runPipeline = oldPipeline }()
+	runPipeline = func(ctx context.Context, stages [][]string) (string, error) {
+		got = stages
+		return "filtered", nil
+	}
+
+	p := plan.Plan{Commands: []plan.PlannedCommand{{
+		Command:   []string{"logread"},
+		Pipe:      [][]string{{"grep", "dhcp"}},
+		NeedsRoot: true,
+	}}}
+	res := engine.RunPlan(context.Background(), p)
+
+	testutil.AssertEqual(t, res.Failed, 0)
+	testutil.AssertEqual(t, res.Items[0].Output, "filtered")
+	testutil.AssertEqual(t, len(got), 2)
+	testutil.AssertEqual(t, strings.Join(got[0], " "), "sudo logread")
+	testutil.AssertEqual(t, strings.Join(got[1], " "), "sudo grep dhcp")
+	testutil.AssertEqual(t, FormatPlanned(p.Commands[0]), "logread | grep dhcp")
+}
+
+func TestRunPlan_Budget(t *testing.T) {
+	cfg := testutil.DefaultTestConfig()
+	cfg.TimeoutSeconds = 30
+	cfg.PlanTimeoutSeconds = 1
+	cfg.AutoRetry = true
+	cfg.MaxRetries = 2
+	engine := New(cfg)
+
+	originalRunCommand := runCommand
+	defer func() { runCommand = originalRunCommand }()
+	runCommand = func(ctx context.Context, argv []string) (string, error) {
+		if argv[0] == "slow" {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		return "ok", nil
+	}
+
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"echo", "first"}},
+		{Command: []string{"slow"}},
+		{Command: []string{"echo", "never"}},
+	}}
+	start := time.Now()
+	results := engine.RunPlan(context.Background(), p)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("budget not enforced, plan took %s", elapsed)
+	}
+	if len(results.Items) != 3 || results.Failed != 2 || results.Items[0].Err != nil {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if r := results.Items[1]; r.Skipped || errcode.Of(r.Err) != errcode.ExecBudget || !errors.Is(r.Err, ErrBudgetExceeded) {
+		t.Errorf("expected the running command cut off by the budget, got %+v", r)
+	}
+	if r := results.Items[2]; !r.Skipped || errcode.Of(r.Err) != errcode.ExecBudget {
+		t.Errorf("expected the last command skipped, got %+v", r)
+	}
+	if results.ErrorCode() != errcode.ExecBudget {
+		t.Errorf("expected EXEC_BUDGET_EXCEEDED, got %s", results.ErrorCode())
+	}
+
+	// No retries once the budget is spent
+	planner := &stubFixPlanner{}
+	var log strings.Builder
+	results = engine.AutoRetry(context.Background(), planner, nil, results, func(format string, args ...interface{}) {
+		log.WriteString(fmt.Sprintf(format, args...))
+	})
+	if len(planner.calls) != 0 || !strings.Contains(log.String(), "time budget is spent") {
+		t.Errorf("expected no retry, got calls %v, log %q", planner.calls, log.String())
+	}
+}
+
+func TestRunPlanStreaming_Budget(t *testing.T) {
+	cfg := testutil.DefaultTestConfig()
+	cfg.TimeoutSeconds = 30
+	cfg.PlanTimeoutSeconds = 1
+	engine := New(cfg)
+
+	var out strings.Builder
+	results := engine.RunPlanStreaming(context.Background(), plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"sleep", "5"}},
+		{Command: []string{"echo", "never"}},
+	}}, &out)
+	if len(results.Items) != 2 || !results.Items[1].Skipped || results.Failed != 2 {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	testutil.AssertContains(t, out.String(), "plan time budget exceeded")
+	testutil.AssertContains(t, out.String(), "Plan time budget of 1s exceeded; skipping the remaining 1 command(s)")
+}
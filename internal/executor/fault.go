@@ -0,0 +1,193 @@
+package executor
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault injection makes chosen commands fail, hang or flood their output, so
+// AutoRetry, truncation, timeouts and streaming can be exercised end to end
+// on a development machine or in integration tests. It is only active in
+// binaries built with the faults tag (see fault_inject.go), which read the
+// rules from LUCICODEX_FAULTS:
+//
+//	LUCICODEX_FAULTS='uci commit=fail;logread=hang:5s;cat=flood:2M;opkg=flaky:2'
+//
+// Each rule is match=kind[:arg]. match is "*" for every command, or the
+// leading arguments of the commands it applies to, the first compared by
+// base name. The first matching rule wins. Kinds:
+//
+//	fail[:code]       exit with code (default 1) without running the command
+//	flaky[:n]         fail the first n (default 1) matching runs, then run it
+//	hang[:duration]   wait duration (default a day), then run the command
+//	flood[:size]      print size bytes of lines (default 1M) instead of running it
+//
+// Faulted commands run as sh -c scripts, so they take the same exec,
+// timeout and output paths as real ones.
+
+// FaultKind is what a Fault does to a command.
+type FaultKind string
+
+const (
+	FaultFail  FaultKind = "fail"
+	FaultFlaky FaultKind = "flaky"
+	FaultHang  FaultKind = "hang"
+	FaultFlood FaultKind = "flood"
+)
+
+// Fault is a rule of LUCICODEX_FAULTS.
+type Fault struct {
+	Match []string // Leading arguments; ["*"] matches every command
+	Kind  FaultKind
+	Code  int           // Exit status for fail and flaky
+	Times int           // Failing runs left for flaky
+	Delay time.Duration // Wait for hang
+	Size  int64         // Bytes of output for flood
+}
+
+// faultMarker is $0 of fault scripts, so they can be told apart from
+// commands a plan runs through sh itself (see unwrapFault).
+const faultMarker = "lucicodex-fault"
+
+// faultMessage is printed on stderr by failing fault scripts.
+const faultMessage = "lucicodex: injected failure"
+
+// FaultSet is the faults injected into commands.
+type FaultSet struct {
+	mu     sync.Mutex
+	faults []Fault
+}
+
+// faults is nil unless a faults build read LUCICODEX_FAULTS.
+var faults *FaultSet
+
+// ParseFaults parses rules in the LUCICODEX_FAULTS format.
+func ParseFaults(spec string) (*FaultSet, error) {
+	s := &FaultSet{}
+	for _, rule := range strings.Split(spec, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		f, err := parseFault(rule)
+		if err != nil {
+			return nil, fmt.Errorf("fault %q: %w", strings.TrimSpace(rule), err)
+		}
+		s.faults = append(s.faults, f)
+	}
+	return s, nil
+}
+
+func parseFault(rule string) (Fault, error) {
+	match, action, ok := strings.Cut(rule, "=")
+	f := Fault{Match: strings.Fields(match)}
+	if !ok || len(f.Match) == 0 {
+		return f, fmt.Errorf("expected match=kind[:arg]")
+	}
+	kind, arg, hasArg := strings.Cut(strings.TrimSpace(action), ":")
+	f.Kind = FaultKind(kind)
+	var err error
+	switch f.Kind {
+	case FaultFail:
+		f.Code = 1
+		if hasArg {
+			if f.Code, err = strconv.Atoi(arg); err != nil || f.Code < 1 || f.Code > 255 {
+				return f, fmt.Errorf("exit code must be 1-255")
+			}
+		}
+	case FaultFlaky:
+		f.Code, f.Times = 1, 1
+		if hasArg {
+			if f.Times, err = strconv.Atoi(arg); err != nil || f.Times < 1 {
+				return f, fmt.Errorf("count must be a positive number")
+			}
+		}
+	case FaultHang:
+		f.Delay = 24 * time.Hour
+		if hasArg {
+			if f.Delay, err = time.ParseDuration(arg); err != nil || f.Delay <= 0 {
+				return f, fmt.Errorf("invalid duration %q", arg)
+			}
+		}
+	case FaultFlood:
+		f.Size = 1 << 20
+		if hasArg {
+			if f.Size, err = parseSize(arg); err != nil {
+				return f, err
+			}
+		}
+	default:
+		return f, fmt.Errorf("unknown kind %q (fail, flaky, hang or flood)", kind)
+	}
+	return f, nil
+}
+
+// parseSize parses a byte count with an optional K or M suffix.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult, s = 1<<10, strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, strings.TrimSuffix(s, "M")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+func (f Fault) matches(argv []string) bool {
+	if len(f.Match) == 1 && f.Match[0] == "*" {
+		return true
+	}
+	if len(argv) < len(f.Match) || path.Base(argv[0]) != f.Match[0] {
+		return false
+	}
+	return equalArgs(argv[1:len(f.Match)], f.Match[1:])
+}
+
+// apply returns argv rewritten by the first fault matching it, or argv.
+func (s *FaultSet) apply(argv []string) []string {
+	if s == nil || len(argv) == 0 {
+		return argv
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.faults {
+		f := &s.faults[i]
+		if !f.matches(argv) {
+			continue
+		}
+		var script string
+		switch f.Kind {
+		case FaultFail:
+			script = fmt.Sprintf("echo '%s' >&2; exit %d", faultMessage, f.Code)
+		case FaultFlaky:
+			if f.Times == 0 {
+				return argv
+			}
+			f.Times--
+			script = fmt.Sprintf("echo '%s' >&2; exit %d", faultMessage, f.Code)
+		case FaultHang:
+			script = fmt.Sprintf(`sleep %d; exec "$@"`, int64(math.Ceil(f.Delay.Seconds())))
+		case FaultFlood:
+			script = fmt.Sprintf("yes 'lucicodex injected output' | head -c %d", f.Size)
+		}
+		return append([]string{"sh", "-c", script, faultMarker}, argv...)
+	}
+	return argv
+}
+
+// unwrapFault returns the command a fault script stands for, or argv.
+func unwrapFault(argv []string) []string {
+	if len(argv) > 4 && argv[0] == "sh" && argv[1] == "-c" && argv[3] == faultMarker {
+		return argv[4:]
+	}
+	return argv
+}
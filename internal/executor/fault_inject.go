@@ -0,0 +1,25 @@
+//go:build faults
+
+package executor
+
+import (
+	"fmt"
+	"os"
+)
+
+// faultsEnv holds the fault rules of a faults build (see fault.go).
+const faultsEnv = "LUCICODEX_FAULTS"
+
+func init() {
+	spec := os.Getenv(faultsEnv)
+	if spec == "" {
+		return
+	}
+	s, err := ParseFaults(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring %s: %v\n", faultsEnv, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: fault injection is active (%s=%s)\n", faultsEnv, spec)
+	faults = s
+}
@@ -0,0 +1,113 @@
+package executor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/testutil"
+)
+
+// withFaults injects the faults of spec for the rest of the test.
+func withFaults(t *testing.T, spec string) {
+	s, err := ParseFaults(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faults = s
+	t.Cleanup(func() { faults = nil })
+}
+
+func TestParseFaults(t *testing.T) {
+	s, err := ParseFaults("uci commit=fail:3; logread=hang:1500ms;cat=flood:2K ;* = flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.faults) != 4 {
+		t.Fatalf("expected 4 faults, got %+v", s.faults)
+	}
+	f := s.faults
+	if f[0].Kind != FaultFail || f[0].Code != 3 || strings.Join(f[0].Match, " ") != "uci commit" {
+		t.Errorf("unexpected fail fault %+v", f[0])
+	}
+	if f[1].Delay.Milliseconds() != 1500 || f[2].Size != 2048 || f[3].Times != 1 {
+		t.Errorf("unexpected faults %+v", f[1:])
+	}
+
+	for _, bad := range []string{"uci", "=fail", "uci=explode", "uci=fail:0", "uci=hang:soon", "cat=flood:-1", "opkg=flaky:x"} {
+		if _, err := ParseFaults(bad); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestFaultSet_Apply(t *testing.T) {
+	s, _ := ParseFaults("uci commit=fail;opkg=flaky:2")
+	argv := []string{"/sbin/uci", "commit", "network"}
+	got := s.apply(argv)
+	if got[0] != "sh" || got[3] != faultMarker || !equalArgs(unwrapFault(got), argv) {
+		t.Errorf("unexpected fault command %q", got)
+	}
+	if got := s.apply([]string{"uci", "show"}); len(got) != 2 {
+		t.Errorf("uci show should run as it is, got %q", got)
+	}
+	for i, want := range []bool{true, true, false} {
+		if faulted := s.apply([]string{"opkg", "update"})[0] == "sh"; faulted != want {
+			t.Errorf("run %d: faulted = %v, want %v", i+1, faulted, want)
+		}
+	}
+	var none *FaultSet
+	if got := none.apply(argv); len(got) != 3 {
+		t.Errorf("no faults should leave commands alone, got %q", got)
+	}
+}
+
+func TestEngine_Faults(t *testing.T) {
+	ctx := context.Background()
+	cfg := testutil.DefaultTestConfig()
+	cfg.TimeoutSeconds = 1
+	withFaults(t, "true=fail:4;echo=flood:600K;sleep=hang:30s")
+
+	r := New(cfg).RunCommand(ctx, 0, plan.PlannedCommand{Command: []string{"true"}})
+	if r.Err == nil || !strings.Contains(r.Output, faultMessage) {
+		t.Errorf("expected an injected failure, got %+v", r)
+	}
+
+	r = New(cfg).RunCommand(ctx, 0, plan.PlannedCommand{Command: []string{"echo", "hi"}})
+	if r.Err != nil || !strings.HasSuffix(r.Output, "[output truncated] ...") {
+		t.Errorf("expected truncated output, got %v and %d bytes", r.Err, len(r.Output))
+	}
+
+	var out strings.Builder
+	r = New(cfg).RunCommandStreaming(ctx, 0, plan.PlannedCommand{Command: []string{"echo", "hi"}}, &out)
+	if !r.Truncated || strings.Count(out.String(), "lucicodex injected output") < 20000 {
+		t.Errorf("expected streamed and truncated output, got %d bytes", len(r.Output))
+	}
+
+	r = New(cfg).RunCommand(ctx, 0, plan.PlannedCommand{Command: []string{"sleep", "0"}})
+	if errcode.Of(r.Err) != errcode.ExecTimeout {
+		t.Errorf("expected a timeout, got %v", r.Err)
+	}
+}
+
+func TestAutoRetry_FlakyFault(t *testing.T) {
+	ctx := context.Background()
+	cfg := testutil.DefaultTestConfig()
+	cfg.AutoRetry, cfg.MaxRetries = true, 1
+	withFaults(t, "echo=flaky")
+	engine := New(cfg)
+
+	results := engine.RunPlan(ctx, plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"echo", "ok"}}}})
+	if results.Failed != 1 {
+		t.Fatalf("expected the first run to fail, got %+v", results)
+	}
+	planner := &stubFixPlanner{plans: map[string]plan.Plan{
+		"echo ok": {Commands: []plan.PlannedCommand{{Command: []string{"echo", "ok"}}}},
+	}}
+	results = engine.AutoRetry(ctx, planner, nil, results, t.Logf)
+	if results.Failed != 0 || results.Items[0].Err != nil {
+		t.Errorf("expected the retry to succeed, got %+v", results)
+	}
+}
@@ -0,0 +1,34 @@
+package executor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/files"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// runFile carries out a built-in file command (see plan.FileRead). The path
+// is checked against file_paths again since the file system may have
+// changed since the plan was validated.
+func (e *Engine) runFile(index int, pc plan.PlannedCommand) Result {
+	start := time.Now()
+	r := Result{Index: index, Command: pc.Command}
+	op, path, _ := pc.FileOp()
+	switch op {
+	case plan.FileRead:
+		r.Output, r.Err = files.Read(path, e.cfg.FilePaths, e.cfg.FileMaxBytes)
+	case plan.FileWrite:
+		backup, err := files.Write(path, pc.Content, e.cfg.FilePaths, e.cfg.FileMaxBytes, e.cfg.FileBackupDir)
+		r.Err = err
+		switch {
+		case err != nil:
+		case backup != "":
+			r.Output = fmt.Sprintf("wrote %d bytes to %s; previous version saved as %s\n", len(pc.Content), path, backup)
+		default:
+			r.Output = fmt.Sprintf("created %s with %d bytes\n", path, len(pc.Content))
+		}
+	}
+	r.Elapsed = time.Since(start)
+	return r
+}
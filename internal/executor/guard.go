@@ -0,0 +1,213 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// ErrResourcesLow marks heavy commands the resource guard refused because
+// the router stayed short of memory, CPU or overlay space.
+var ErrResourcesLow = errors.New("not enough system resources")
+
+// Resources is what the router has to spare, as read before a heavy
+// command. Values that cannot be read are negative and not checked.
+type Resources struct {
+	MemAvailableKB int64   // MemAvailable of /proc/meminfo
+	Load1          float64 // 1-minute load average
+	CPUs           int
+	OverlayFreeKB  int64 // Free space of /overlay
+}
+
+// readResources is replaced in tests.
+var readResources = func() Resources {
+	return Resources{
+		MemAvailableKB: memAvailableKB("/proc/meminfo"),
+		Load1:          loadAverage("/proc/loadavg"),
+		CPUs:           runtime.NumCPU(),
+		OverlayFreeKB:  diskFreeKB("/overlay"),
+	}
+}
+
+// resourcePoll is how often a deferred command checks the resources again.
+var resourcePoll = 5 * time.Second
+
+// Heavy reports whether argv strains a small router enough for the resource
+// guard to hold it back, and what it is. overlay is set when it also
+// writes to the overlay, as package installs do.
+func Heavy(argv []string) (what string, overlay bool) {
+	if len(argv) == 0 {
+		return "", false
+	}
+	switch name := path.Base(argv[0]); name {
+	case "opkg", "apk":
+		for _, a := range argv[1:] {
+			switch a {
+			case "install", "upgrade", "add":
+				return "package install", true
+			case "update":
+				return "package list update", false
+			}
+		}
+	case "tcpdump", "tshark":
+		return "packet capture", false
+	case "iperf", "iperf3":
+		return "throughput test", false
+	}
+	return "", false
+}
+
+// heavyCommand is Heavy for any stage of pc.
+func heavyCommand(pc plan.PlannedCommand) (what string, overlay bool) {
+	for _, argv := range pc.Stages() {
+		if w, o := Heavy(argv); w != "" {
+			return w, o
+		}
+	}
+	return "", false
+}
+
+// shortage explains which thresholds of cfg res falls short of, or returns
+// "" if it meets them all. Overlay space only counts when overlay is set.
+func shortage(cfg config.Config, res Resources, overlay bool) string {
+	var short []string
+	if cfg.MinFreeMemoryMB > 0 && res.MemAvailableKB >= 0 && res.MemAvailableKB < int64(cfg.MinFreeMemoryMB)*1024 {
+		short = append(short, fmt.Sprintf("%d MB of memory available, below min_free_memory of %d MB", res.MemAvailableKB/1024, cfg.MinFreeMemoryMB))
+	}
+	if cfg.MaxLoad > 0 && res.Load1 >= 0 && res.CPUs > 0 && res.Load1/float64(res.CPUs) > cfg.MaxLoad {
+		short = append(short, fmt.Sprintf("load average %.2f on %d CPU(s), above max_load of %g per CPU", res.Load1, res.CPUs, cfg.MaxLoad))
+	}
+	if overlay && cfg.MinFreeOverlayKB > 0 && res.OverlayFreeKB >= 0 && res.OverlayFreeKB < int64(cfg.MinFreeOverlayKB) {
+		short = append(short, fmt.Sprintf("%d KB free on /overlay, below min_free_overlay of %d KB", res.OverlayFreeKB, cfg.MinFreeOverlayKB))
+	}
+	return strings.Join(short, "; ")
+}
+
+// guard checks that the router can take pc before it runs. A heavy command
+// finding resources short is deferred: notify is told, and the resources
+// are checked again every resourcePoll for up to ResourceWait seconds,
+// within the plan's budget. If they do not recover the command is refused
+// with ErrResourcesLow. It returns ctx's error if ctx ends while waiting.
+func (e *Engine) guard(ctx context.Context, pc plan.PlannedCommand, notify func(msg string)) error {
+	what, overlay := heavyCommand(pc)
+	if what == "" {
+		return nil
+	}
+	short := shortage(e.cfg, readResources(), overlay)
+	if short == "" {
+		return nil
+	}
+	wait := time.Duration(e.cfg.ResourceWait) * time.Second
+	if !e.deadline.IsZero() {
+		if left := time.Until(e.deadline); left < wait {
+			wait = left
+		}
+	}
+	if wait > 0 {
+		if notify != nil {
+			notify(fmt.Sprintf("%s deferred: %s; waiting up to %s", what, short, wait.Round(time.Second)))
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		ticker := time.NewTicker(resourcePoll)
+		defer ticker.Stop()
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+				break wait
+			case <-ticker.C:
+				if short = shortage(e.cfg, readResources(), overlay); short == "" {
+					return nil
+				}
+			}
+		}
+	}
+	return errcode.Wrap(errcode.ResourcesLow, fmt.Errorf("%w for %s: %s", ErrResourcesLow, what, short))
+}
+
+// refusedResult is the result of a command the resource guard refused.
+func refusedResult(index int, pc plan.PlannedCommand, err error) Result {
+	r := skippedResult(index, pc)
+	r.Err = err
+	return r
+}
+
+// lowPriority returns the prefix that runs a command at low priority with
+// LowPriority set: nice, and ionice in the idle class where it is
+// installed (busybox builds often leave it out).
+func lowPriority(cfg config.Config) []string {
+	if !cfg.LowPriority {
+		return nil
+	}
+	prefix := []string{"nice", "-n", "10"}
+	if _, err := lookPath("ionice"); err == nil {
+		prefix = append(prefix, "ionice", "-c", "3")
+	}
+	return prefix
+}
+
+// lookPath is replaced in tests.
+var lookPath = exec.LookPath
+
+// memAvailableKB returns MemAvailable from the meminfo file at path, or
+// MemFree plus page cache on kernels without it, or -1.
+func memAvailableKB(path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	fields := map[string]int64{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		name, rest, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		if v := strings.Fields(rest); len(v) > 0 {
+			if n, err := strconv.ParseInt(v[0], 10, 64); err == nil {
+				fields[name] = n
+			}
+		}
+	}
+	if n, ok := fields["MemAvailable"]; ok {
+		return n
+	}
+	if n, ok := fields["MemFree"]; ok {
+		return n + fields["Buffers"] + fields["Cached"]
+	}
+	return -1
+}
+
+// loadAverage returns the 1-minute load average from the loadavg file at
+// path, or -1.
+func loadAverage(path string) float64 {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	v := strings.Fields(string(b))
+	if len(v) == 0 {
+		return -1
+	}
+	load, err := strconv.ParseFloat(v[0], 64)
+	if err != nil {
+		return -1
+	}
+	return load
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package executor
+
+import "syscall"
+
+// diskFreeKB returns the space available on the filesystem holding path,
+// or -1 if it cannot be read (e.g. there is no /overlay off OpenWrt).
+func diskFreeKB(path string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize) / 1024
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package executor
+
+// diskFreeKB is only implemented on Linux; elsewhere overlay space is not
+// checked.
+func diskFreeKB(path string) int64 { return -1 }
@@ -0,0 +1,175 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/testutil"
+)
+
+// withResources makes the guard read the resources next returns.
+func withResources(t *testing.T, next func() Resources) {
+	origRead, origPoll := readResources, resourcePoll
+	readResources, resourcePoll = next, 10*time.Millisecond
+	t.Cleanup(func() { readResources, resourcePoll = origRead, origPoll })
+}
+
+func TestHeavy(t *testing.T) {
+	for argv, want := range map[string]string{
+		"opkg install tcpdump":                   "package install",
+		"/bin/opkg --force-depends upgrade luci": "package install",
+		"apk add iperf3":                         "package install",
+		"opkg update":                            "package list update",
+		"tcpdump -i br-lan -c 100":               "packet capture",
+		"iperf3 -c 192.168.1.2":                  "throughput test",
+		"opkg list-installed":                    "",
+		"uci show network":                       "",
+	} {
+		if got, _ := Heavy(strings.Fields(argv)); got != want {
+			t.Errorf("%s: got %q, want %q", argv, got, want)
+		}
+	}
+	if _, overlay := Heavy([]string{"opkg", "update"}); overlay {
+		t.Error("a list update does not write to the overlay")
+	}
+}
+
+func TestShortage(t *testing.T) {
+	cfg := config.Config{MinFreeMemoryMB: 16, MaxLoad: 2, MinFreeOverlayKB: 1024}
+	ok := Resources{MemAvailableKB: 64 * 1024, Load1: 1.5, CPUs: 2, OverlayFreeKB: 4096}
+	if s := shortage(cfg, ok, true); s != "" {
+		t.Errorf("expected no shortage, got %q", s)
+	}
+	low := Resources{MemAvailableKB: 8 * 1024, Load1: 5, CPUs: 2, OverlayFreeKB: 100}
+	s := shortage(cfg, low, true)
+	for _, want := range []string{"8 MB of memory available", "load average 5.00 on 2 CPU(s)", "100 KB free on /overlay"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("expected %q in %q", want, s)
+		}
+	}
+	if s := shortage(cfg, low, false); strings.Contains(s, "overlay") {
+		t.Errorf("overlay space only counts for installs, got %q", s)
+	}
+	if s := shortage(config.Config{}, low, true); s != "" {
+		t.Errorf("zero thresholds disable the checks, got %q", s)
+	}
+	if s := shortage(cfg, Resources{MemAvailableKB: -1, Load1: -1, CPUs: 1, OverlayFreeKB: -1}, true); s != "" {
+		t.Errorf("unknown resources are not checked, got %q", s)
+	}
+}
+
+func TestEngine_ResourceGuard(t *testing.T) {
+	original := runCommand
+	defer func() { runCommand = original }()
+	var ran []string
+	runCommand = func(ctx context.Context, argv []string) (string, error) {
+		ran = append(ran, strings.Join(argv, " "))
+		return "", nil
+	}
+	low := Resources{MemAvailableKB: 4 * 1024, Load1: 0.1, CPUs: 1, OverlayFreeKB: -1}
+	withResources(t, func() Resources { return low })
+
+	cfg := testutil.DefaultTestConfig()
+	cfg.MinFreeMemoryMB = 16
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"opkg", "install", "tcpdump"}},
+		{Command: []string{"uci", "show", "network"}},
+	}}
+	results := New(cfg).RunPlan(context.Background(), p)
+	r := results.Items[0]
+	if !r.Skipped || !errors.Is(r.Err, ErrResourcesLow) || !strings.Contains(r.Err.Error(), "package install") {
+		t.Fatalf("expected the install to be refused, got %+v", r)
+	}
+	if results.Failed != 1 || results.ErrorCode() != errcode.ResourcesLow || len(ran) != 1 || ran[0] != "uci show network" {
+		t.Errorf("expected only the light command to run, got %v, %s", ran, results.ErrorCode())
+	}
+
+	// Deferred until memory is freed
+	cfg.ResourceWait = 5
+	checks := 0
+	withResources(t, func() Resources {
+		if checks++; checks > 2 {
+			return Resources{MemAvailableKB: 32 * 1024, Load1: 0.1, CPUs: 1, OverlayFreeKB: -1}
+		}
+		return low
+	})
+	ran = nil
+	results = New(cfg).RunPlan(context.Background(), plan.Plan{Commands: p.Commands[:1]})
+	if results.Failed != 0 || len(ran) != 1 || checks != 3 {
+		t.Fatalf("expected the install to run once memory recovered, got %+v", results)
+	}
+
+	// Refused when it does not recover in time
+	withResources(t, func() Resources { return low })
+	cfg.ResourceWait = 1
+	var out strings.Builder
+	results = New(cfg).RunPlanStreaming(context.Background(), plan.Plan{Commands: p.Commands[:1]}, &out)
+	if !results.Items[0].Skipped || results.ErrorCode() != errcode.ResourcesLow {
+		t.Fatalf("expected the install to be refused, got %+v", results)
+	}
+	testutil.AssertContains(t, out.String(), "package install deferred: 4 MB of memory available, below min_free_memory of 16 MB; waiting up to 1s")
+	testutil.AssertContains(t, out.String(), "Skipped:\033[0m opkg install tcpdump (not enough system resources")
+
+	// Cancelled while waiting
+	cfg.ResourceWait = 5
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r = New(cfg).RunCommand(ctx, 0, p.Commands[0])
+	if !r.Skipped || !errors.Is(r.Err, ErrCancelled) {
+		t.Errorf("expected the command to be cancelled, got %+v", r)
+	}
+}
+
+func TestEngine_LowPriority(t *testing.T) {
+	original := runCommand
+	defer func() { runCommand = original }()
+	var captured []string
+	runCommand = func(ctx context.Context, argv []string) (string, error) {
+		captured = argv
+		return "", nil
+	}
+	origLookPath := lookPath
+	defer func() { lookPath = origLookPath }()
+
+	cfg := testutil.DefaultTestConfig()
+	cfg.LowPriority = true
+	cfg.ElevateCommand = "sudo"
+	lookPath = func(string) (string, error) { return "", errors.New("not found") }
+	New(cfg).RunCommand(context.Background(), 0, plan.PlannedCommand{Command: []string{"uci", "show"}, NeedsRoot: true})
+	testutil.AssertEqual(t, strings.Join(captured, " "), "nice -n 10 sudo uci show")
+
+	lookPath = func(string) (string, error) { return "/usr/bin/ionice", nil }
+	New(cfg).RunCommand(context.Background(), 0, plan.PlannedCommand{Command: []string{"uci", "show"}})
+	testutil.AssertEqual(t, strings.Join(captured, " "), "nice -n 10 ionice -c 3 uci show")
+
+	// Per-command variables still go by the command's own name
+	cfg.CommandEnv = []string{"uci:LANG=C"}
+	v := newCommandVars(cfg)
+	env := v.forCommand([]string{"nice", "-n", "10", "ionice", "-c", "3", "sudo", "uci", "show"})
+	if len(env) != 1 || env[0] != "LANG=C" {
+		t.Errorf("unexpected variables %v", env)
+	}
+}
+
+func TestReadResources(t *testing.T) {
+	dir := t.TempDir()
+	meminfo := filepath.Join(dir, "meminfo")
+	os.WriteFile(meminfo, []byte("MemTotal:  125000 kB\nMemFree:   20000 kB\nMemAvailable:   61440 kB\n"), 0o644)
+	testutil.AssertEqual(t, memAvailableKB(meminfo), int64(61440))
+	os.WriteFile(meminfo, []byte("MemTotal:  125000 kB\nMemFree:   20000 kB\nBuffers:   1000 kB\nCached:   9000 kB\n"), 0o644)
+	testutil.AssertEqual(t, memAvailableKB(meminfo), int64(30000))
+	testutil.AssertEqual(t, memAvailableKB(filepath.Join(dir, "missing")), int64(-1))
+
+	loadavg := filepath.Join(dir, "loadavg")
+	os.WriteFile(loadavg, []byte("0.42 0.30 0.25 1/120 4242\n"), 0o644)
+	testutil.AssertEqual(t, loadAverage(loadavg), 0.42)
+	testutil.AssertEqual(t, loadAverage(filepath.Join(dir, "missing")), -1.0)
+}
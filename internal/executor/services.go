@@ -0,0 +1,54 @@
+package executor
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/services"
+)
+
+// runBuiltin carries out a command LuciCodex implements itself (see
+// plan.PlannedCommand.IsBuiltin).
+func (e *Engine) runBuiltin(ctx context.Context, index int, pc plan.PlannedCommand) Result {
+	if _, _, ok := pc.FileOp(); ok {
+		return e.runFile(index, pc)
+	}
+	return e.runService(ctx, index, pc)
+}
+
+// runService carries out a built-in service command (see plan.ServiceList)
+// through procd. Actions other than list and status are followed by the
+// status of the service, so the output shows their effect.
+func (e *Engine) runService(ctx context.Context, index int, pc plan.PlannedCommand) Result {
+	start := time.Now()
+	r := Result{Index: index, Command: pc.Command}
+	timeout, cut := e.commandTimeout()
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	action, name, _ := pc.ServiceOp()
+	switch action {
+	case "list":
+		var list []services.Service
+		list, r.Err = services.List(cctx)
+		var b strings.Builder
+		for _, s := range list {
+			b.WriteString(s.String() + "\n")
+		}
+		r.Output = b.String()
+	default:
+		if action != "status" {
+			if r.Err = services.Control(cctx, name, action); r.Err != nil {
+				break
+			}
+		}
+		var s services.Service
+		if s, r.Err = services.Status(cctx, name); r.Err == nil {
+			r.Output = s.String() + "\n"
+		}
+	}
+	r.Err = budgetErr(classifyErr(cctx, r.Err), cut)
+	r.Elapsed = time.Since(start)
+	return r
+}
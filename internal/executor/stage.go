@@ -0,0 +1,351 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/files"
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Staging shows what commands writing files through tee or uci import will
+// change before they are approved. The stages feeding the writer are run
+// by Stage when they only produce text (see stageable), without elevation,
+// and their output is kept. Only files under FilePaths are staged, and
+// nothing is in a dry run. When the plan runs, the writer is fed the kept output instead
+// of running them again, so the file gets exactly what was reviewed; a
+// file that changed since it was staged is not written.
+
+// stagedWrite is the input of a writing command, kept by Stage.
+type stagedWrite struct {
+	stages  [][]string // The command's stages, to recognize it when it runs
+	writer  []string   // The writing stage, without uci's -f option
+	content string
+	files   []stagedFile
+}
+
+// stagedFile is a file as it was when its change was staged.
+type stagedFile struct {
+	path   string
+	old    string
+	exists bool
+}
+
+// fileWrite is what a tee or uci import stage writes.
+type fileWrite struct {
+	writer      []string // The stage, without uci's -f option
+	paths       []string
+	append      bool
+	input       string // File uci import reads instead of stdin
+	unsupported string // Why the write cannot be staged
+}
+
+// uciValueOptions are the uci options that take a value.
+var uciValueOptions = map[string]bool{"-c": true, "-d": true, "-f": true, "-p": true, "-P": true}
+
+// uciSubcommand returns the subcommand of a uci argv, its arguments and the
+// values of the options before it.
+func uciSubcommand(argv []string) (sub string, args []string, opts map[string]string) {
+	opts = map[string]string{}
+	for i := 1; i < len(argv); i++ {
+		a := argv[i]
+		switch {
+		case uciValueOptions[a] && i+1 < len(argv):
+			opts[a] = argv[i+1]
+			i++
+		case strings.HasPrefix(a, "-"):
+			opts[a] = ""
+		default:
+			return a, argv[i+1:], opts
+		}
+	}
+	return "", nil, opts
+}
+
+// writesFile reports the files argv writes as tee or uci import.
+func writesFile(argv []string) (w fileWrite, ok bool) {
+	if len(argv) == 0 {
+		return w, false
+	}
+	switch path.Base(argv[0]) {
+	case "tee":
+		w.writer = argv
+		for _, a := range argv[1:] {
+			switch {
+			case a == "-a" || a == "--append":
+				w.append = true
+			case a == "-i" || a == "--ignore-interrupts" || a == "--":
+			case strings.HasPrefix(a, "-") && a != "-":
+				w.unsupported = "tee option " + a + " is not previewed"
+			default:
+				w.paths = append(w.paths, a)
+			}
+		}
+		return w, len(w.paths) > 0
+	case "uci":
+		sub, args, opts := uciSubcommand(argv)
+		if sub != "import" {
+			return w, false
+		}
+		if len(args) == 0 {
+			w.unsupported = "importing every package is not previewed"
+			return w, true
+		}
+		dir := "/etc/config"
+		if d, ok := opts["-c"]; ok {
+			dir = d
+		}
+		w.paths = []string{filepath.Join(dir, args[0])}
+		switch _, merge := opts["-m"]; {
+		case merge:
+			w.unsupported = "merging imports are not previewed"
+		case opts["-p"] != "" || opts["-P"] != "":
+			w.unsupported = "imports into a delta directory are not previewed"
+		}
+		w.input = opts["-f"]
+		for i := 0; i < len(argv); i++ {
+			if argv[i] == "-f" && i+1 < len(argv) {
+				i++
+				continue
+			}
+			w.writer = append(w.writer, argv[i])
+		}
+		return w, true
+	}
+	return w, false
+}
+
+// stageable reports whether argv only produces text from its arguments,
+// files or input, so Stage may run it before the plan is approved.
+func stageable(argv []string) bool {
+	if len(argv) == 0 || impact.IsWrite(argv) {
+		return false
+	}
+	switch path.Base(argv[0]) {
+	case "echo", "printf", "cat", "head", "cut", "tr", "uniq", "grep", "base64":
+		// Not sed or jq: their scripts can write files, run commands or
+		// read files named in them
+		return true
+	case "sort", "tail":
+		for _, a := range argv[1:] {
+			if strings.HasPrefix(a, "-o") || strings.HasPrefix(a, "--output") || a == "-f" || a == "-F" || strings.HasPrefix(a, "--follow") {
+				return false
+			}
+		}
+		return true
+	case "uci":
+		sub, _, _ := uciSubcommand(argv)
+		return sub == "export" || sub == "show" || sub == "get"
+	}
+	return false
+}
+
+// Stage works out the changes of the commands of p that write files through
+// tee or uci import, so they can be reviewed as diffs before approval. The
+// stages feeding a writer run now if stageable allows; the engine keeps
+// their output for when the command runs (see runStaged). Changes that
+// cannot be staged are returned with an Error and run as planned. Callers
+// stage plans that passed policy validation only.
+func (e *Engine) Stage(ctx context.Context, p plan.Plan) []plan.FileChange {
+	var changes []plan.FileChange
+	for i, pc := range p.Commands {
+		stages := pc.Stages()
+		for j, argv := range stages {
+			w, ok := writesFile(argv)
+			if !ok {
+				continue
+			}
+			switch {
+			case w.unsupported != "":
+			case e.cfg.DryRun:
+				w.unsupported = "not staged in a dry run"
+			case j != len(stages)-1:
+				w.unsupported = path.Base(argv[0]) + " is not the last stage of its pipeline"
+			case w.input != "" && j > 0:
+				w.unsupported = "uci import reads -f instead of the pipeline"
+			default:
+				w.unsupported = e.confine(w)
+			}
+			if w.unsupported != "" {
+				changes = append(changes, unstaged(i, w.paths, w.unsupported)...)
+				continue
+			}
+			sw, err := e.stage(ctx, pc, stages[:j], w)
+			if err != nil {
+				changes = append(changes, unstaged(i, w.paths, err.Error())...)
+				continue
+			}
+			for _, f := range sw.files {
+				content := sw.content
+				if w.append {
+					content = f.old + content
+				}
+				changes = append(changes, plan.FileChange{Command: i, Path: f.path, Diff: files.PreviewContent(f.old, f.exists, content)})
+			}
+			if e.staged == nil {
+				e.staged = map[int]*stagedWrite{}
+			}
+			e.staged[i] = sw
+		}
+	}
+	return changes
+}
+
+// confine returns why w cannot be staged if it reads or writes a file
+// outside FilePaths, or "".
+func (e *Engine) confine(w fileWrite) string {
+	paths := w.paths
+	if w.input != "" {
+		paths = append([]string{w.input}, paths...)
+	}
+	for _, p := range paths {
+		if _, err := files.Check(p, e.cfg.FilePaths); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+func unstaged(index int, paths []string, reason string) []plan.FileChange {
+	if len(paths) == 0 {
+		paths = []string{""}
+	}
+	changes := make([]plan.FileChange, len(paths))
+	for i, p := range paths {
+		changes[i] = plan.FileChange{Command: index, Path: p, Error: reason}
+	}
+	return changes
+}
+
+// stage runs the stages feeding the writer w of pc unelevated, or reads the
+// file uci import reads, and records the files w writes as they are now.
+func (e *Engine) stage(ctx context.Context, pc plan.PlannedCommand, feed [][]string, w fileWrite) (*stagedWrite, error) {
+	sw := &stagedWrite{stages: pc.Stages(), writer: w.writer}
+	switch {
+	case w.input != "":
+		b, err := readLimited(w.input)
+		if err != nil {
+			return nil, err
+		}
+		sw.content = b
+	case len(feed) > 0:
+		for _, argv := range feed {
+			if !stageable(argv) {
+				return nil, fmt.Errorf("%s is not run before approval", path.Base(argv[0]))
+			}
+		}
+		timeout, _ := e.commandTimeout()
+		cctx, cancel := context.WithTimeout(e.withEnv(ctx), timeout)
+		defer cancel()
+		sctx, s := withStreams(cctx)
+		var err error
+		if len(feed) == 1 {
+			_, err = runCommand(sctx, e.elevate(false, feed[0]))
+		} else {
+			stages := make([][]string, len(feed))
+			for i, argv := range feed {
+				stages[i] = e.elevate(false, argv)
+			}
+			_, err = runPipeline(sctx, stages)
+		}
+		var r Result
+		s.fill(&r)
+		if err != nil {
+			return nil, fmt.Errorf("staging failed: %w", err)
+		}
+		if r.Truncated {
+			return nil, fmt.Errorf("staging failed: output larger than %d bytes", MaxOutputSize)
+		}
+		sw.content = r.Stdout
+	}
+	// Without a feed the writer reads nothing, as when it runs
+	for _, p := range w.paths {
+		f := stagedFile{path: p}
+		b, err := os.ReadFile(p)
+		switch {
+		case err == nil:
+			f.old, f.exists = string(b), true
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+		sw.files = append(sw.files, f)
+	}
+	return sw, nil
+}
+
+// readLimited returns the contents of the file at p, which may be at most
+// MaxOutputSize bytes.
+func readLimited(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, MaxOutputSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > MaxOutputSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", p, MaxOutputSize)
+	}
+	return string(b), nil
+}
+
+// takeStaged returns what Stage kept for command index if pc is still the
+// command it staged, and forgets it: staged content is written once.
+func (e *Engine) takeStaged(index int, pc plan.PlannedCommand) *stagedWrite {
+	sw := e.staged[index]
+	if sw == nil {
+		return nil
+	}
+	stages := pc.Stages()
+	if len(stages) != len(sw.stages) {
+		return nil
+	}
+	for i := range stages {
+		if !equalArgs(stages[i], sw.stages[i]) {
+			return nil
+		}
+	}
+	delete(e.staged, index)
+	return sw
+}
+
+// runStaged runs the writer of a staged command with the staged content as
+// its input, after checking its files are as they were when staged.
+func (e *Engine) runStaged(ctx context.Context, pc plan.PlannedCommand, sw *stagedWrite) (string, error) {
+	for _, f := range sw.files {
+		b, err := os.ReadFile(f.path)
+		exists := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if exists != f.exists || string(b) != f.old {
+			return "", fmt.Errorf("%s changed after its diff was shown; plan again", f.path)
+		}
+	}
+	return runCommand(withStdin(ctx, sw.content), e.elevate(pc.NeedsRoot, sw.writer))
+}
+
+// stdinKey carries the input of a command from the engine to the runners.
+type stdinKey struct{}
+
+// withStdin returns ctx giving the command run under it s as its input.
+func withStdin(ctx context.Context, s string) context.Context {
+	return context.WithValue(ctx, stdinKey{}, s)
+}
+
+// commandStdin returns the input of the command run under ctx, or nil for
+// none.
+func commandStdin(ctx context.Context) io.Reader {
+	if s, ok := ctx.Value(stdinKey{}).(string); ok {
+		return strings.NewReader(s)
+	}
+	return nil
+}
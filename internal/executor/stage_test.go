@@ -0,0 +1,195 @@
+package executor
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/testutil"
+)
+
+func TestWritesFile(t *testing.T) {
+	w, ok := writesFile([]string{"tee", "-a", "/tmp/a", "/tmp/b"})
+	if !ok || !w.append || strings.Join(w.paths, " ") != "/tmp/a /tmp/b" {
+		t.Errorf("unexpected tee write %+v", w)
+	}
+	w, ok = writesFile([]string{"uci", "-c", "/tmp/cfg", "-f", "/tmp/net", "import", "network"})
+	if !ok || w.paths[0] != "/tmp/cfg/network" || w.input != "/tmp/net" || strings.Join(w.writer, " ") != "uci -c /tmp/cfg import network" {
+		t.Errorf("unexpected uci import %+v", w)
+	}
+	for _, argv := range []string{"uci import", "uci -m import network", "tee -p /tmp/a"} {
+		if w, ok := writesFile(strings.Fields(argv)); !ok || w.unsupported == "" {
+			t.Errorf("%s: expected an unsupported write, got %+v", argv, w)
+		}
+	}
+	for _, argv := range []string{"uci show network", "tee", "cat /etc/config/network"} {
+		if _, ok := writesFile(strings.Fields(argv)); ok {
+			t.Errorf("%s: not a file write", argv)
+		}
+	}
+}
+
+func TestStageable(t *testing.T) {
+	for argv, want := range map[string]bool{
+		"printf a\\n":              true,
+		"sed s/a/b/ /etc/hosts":    false,
+		"jq -r .a /tmp/x.json":     false,
+		"sed -i s/a/b/ /etc/hosts": false,
+		"sort -o /etc/hosts":       false,
+		"tail -f /var/log/x":       false,
+		"uci export network":       true,
+		"uci set network.lan=x":    false,
+		"curl http://example.com":  false,
+	} {
+		if got := stageable(strings.Fields(argv)); got != want {
+			t.Errorf("%s: got %v, want %v", argv, got, want)
+		}
+	}
+}
+
+func TestEngine_StageTee(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	src, target := filepath.Join(dir, "src"), filepath.Join(dir, "hosts")
+	os.WriteFile(src, []byte("127.0.0.1 localhost\n10.0.0.2 nas\n"), 0o644)
+	os.WriteFile(target, []byte("127.0.0.1 localhost\n10.0.0.1 nas\n"), 0o644)
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"cat", src}, Pipe: [][]string{{"tee", target}}},
+	}}
+
+	cfg := testutil.DefaultTestConfig()
+	cfg.FilePaths = []string{dir}
+	engine := New(cfg)
+	changes := engine.Stage(ctx, p)
+	if len(changes) != 1 || changes[0].Path != target || changes[0].Error != "" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	testutil.AssertContains(t, changes[0].Diff, "-10.0.0.1 nas\n+10.0.0.2 nas")
+
+	// The reviewed content is written, even if the source changed since
+	os.WriteFile(src, []byte("something else\n"), 0o644)
+	var out strings.Builder
+	results := engine.RunPlanStreaming(ctx, p, &out)
+	if results.Failed != 0 {
+		t.Fatalf("unexpected failure %+v", results.Items[0])
+	}
+	got, _ := os.ReadFile(target)
+	testutil.AssertEqual(t, string(got), "127.0.0.1 localhost\n10.0.0.2 nas\n")
+	testutil.AssertContains(t, out.String(), "10.0.0.2 nas")
+
+	// Staged content is used once; a target changed since is not written
+	engine.Stage(ctx, p)
+	os.WriteFile(target, []byte("edited meanwhile\n"), 0o644)
+	results = engine.RunPlan(ctx, p)
+	if results.Failed != 1 || !strings.Contains(results.Items[0].Err.Error(), "changed after its diff was shown") {
+		t.Fatalf("expected the write to be refused, got %+v", results.Items[0])
+	}
+	got, _ = os.ReadFile(target)
+	testutil.AssertEqual(t, string(got), "edited meanwhile\n")
+}
+
+func TestEngine_StageUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "out")
+	cfg := testutil.DefaultTestConfig()
+	cfg.FilePaths = []string{dir}
+	engine := New(cfg)
+	changes := engine.Stage(context.Background(), plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"echo", "hi"}},
+		{Command: []string{"curl", "http://example.com"}, Pipe: [][]string{{"tee", target}}},
+		{Command: []string{"tee", target}, Pipe: [][]string{{"grep", "x"}}},
+	}})
+	if len(changes) != 2 || changes[0].Command != 1 || changes[0].Error != "curl is not run before approval" || changes[1].Error == "" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	if len(engine.staged) != 0 {
+		t.Errorf("nothing should be staged, got %v", engine.staged)
+	}
+}
+
+func TestEngine_StageSedWriteNotRun(t *testing.T) {
+	dir := t.TempDir()
+	victim, target := filepath.Join(dir, "victim"), filepath.Join(dir, "out")
+	cfg := testutil.DefaultTestConfig()
+	cfg.FilePaths = []string{dir}
+	engine := New(cfg)
+	changes := engine.Stage(context.Background(), plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"echo", "x"}, Pipe: [][]string{{"sed", "w " + victim}, {"tee", target}}},
+	}})
+	if len(changes) != 1 || changes[0].Error != "sed is not run before approval" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	if _, err := os.Stat(victim); !os.IsNotExist(err) {
+		t.Errorf("sed ran while staging: %v", err)
+	}
+}
+
+func TestEngine_StageConfined(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	secret := filepath.Join(other, "secret")
+	os.WriteFile(secret, []byte("hunter2\n"), 0o644)
+	cfg := testutil.DefaultTestConfig()
+	cfg.FilePaths = []string{dir}
+	engine := New(cfg)
+	changes := engine.Stage(context.Background(), plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"echo", "x"}, Pipe: [][]string{{"tee", secret}}},
+		{Command: []string{"uci", "-c", dir, "-f", secret, "import", "network"}},
+	}})
+	if len(changes) != 2 || changes[0].Error == "" || changes[1].Error == "" {
+		t.Fatalf("expected both writes refused, got %+v", changes)
+	}
+	for _, c := range changes {
+		if strings.Contains(c.Diff, "hunter2") {
+			t.Errorf("staging read a file outside file_paths: %+v", c)
+		}
+	}
+
+	// Nothing is staged in a dry run
+	cfg.FilePaths, cfg.DryRun = []string{dir, other}, true
+	changes = New(cfg).Stage(context.Background(), plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"echo", "x"}, Pipe: [][]string{{"tee", secret}}},
+	}})
+	if len(changes) != 1 || changes[0].Error != "not staged in a dry run" {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+}
+
+func TestEngine_StageUCIImport(t *testing.T) {
+	original := runCommand
+	defer func() { runCommand = original }()
+	var ran []string
+	var stdin string
+	runCommand = func(ctx context.Context, argv []string) (string, error) {
+		ran = argv
+		if r := commandStdin(ctx); r != nil {
+			b, _ := io.ReadAll(r)
+			stdin = string(b)
+		}
+		return "", nil
+	}
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "network.new")
+	os.WriteFile(filepath.Join(dir, "network"), []byte("config interface 'lan'\n\toption proto 'dhcp'\n"), 0o644)
+	os.WriteFile(input, []byte("config interface 'lan'\n\toption proto 'static'\n"), 0o644)
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "-c", dir, "-f", input, "import", "network"}}}}
+
+	cfg := testutil.DefaultTestConfig()
+	cfg.FilePaths = []string{dir}
+	engine := New(cfg)
+	changes := engine.Stage(context.Background(), p)
+	if len(changes) != 1 || changes[0].Path != filepath.Join(dir, "network") {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	testutil.AssertContains(t, changes[0].Diff, "-\toption proto 'dhcp'\n+\toption proto 'static'")
+
+	if results := engine.RunPlan(context.Background(), p); results.Failed != 0 {
+		t.Fatalf("unexpected failure %+v", results.Items[0])
+	}
+	testutil.AssertEqual(t, strings.Join(ran, " "), "uci -c "+dir+" import network")
+	testutil.AssertEqual(t, stdin, "config interface 'lan'\n\toption proto 'static'\n")
+}
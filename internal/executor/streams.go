@@ -0,0 +1,116 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/llm"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+)
+
+// streamsKey carries a *streams from the engine to the command runners.
+type streamsKey struct{}
+
+// streams receives a command's stdout and stderr separately, besides the
+// combined output the runners return. For a pipeline, stdout is the last
+// stage's and stderr that of every stage.
+type streams struct {
+	stdout, stderr limitedBuffer
+}
+
+// withStreams returns ctx carrying new streams for the runners to fill.
+func withStreams(ctx context.Context) (context.Context, *streams) {
+	s := &streams{
+		stdout: limitedBuffer{max: MaxOutputSize},
+		stderr: limitedBuffer{max: MaxOutputSize},
+	}
+	return context.WithValue(ctx, streamsKey{}, s), s
+}
+
+// outputWriters returns where a runner sends a command's stdout and stderr:
+// combined, and also to the streams of ctx if it has any.
+func outputWriters(ctx context.Context, combined io.Writer) (stdout, stderr io.Writer) {
+	s, ok := ctx.Value(streamsKey{}).(*streams)
+	if !ok {
+		return combined, combined
+	}
+	return io.MultiWriter(combined, &s.stdout), io.MultiWriter(combined, &s.stderr)
+}
+
+// fill copies the captured streams to r.
+func (s *streams) fill(r *Result) {
+	r.Stdout, r.Stderr = s.stdout.String(), s.stderr.String()
+	if s.stdout.truncated || s.stderr.truncated {
+		r.Truncated = true
+	}
+}
+
+// exitStatus returns the exit code of a command that ended with err and the
+// signal that killed it, if any. The code is -1 if the command did not exit
+// by itself: it could not start, or a signal or the timeout ended it.
+func exitStatus(err error) (code int, signal string) {
+	if err == nil {
+		return 0, ""
+	}
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return -1, ""
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return -1, ws.Signal().String()
+	}
+	return ee.ExitCode(), ""
+}
+
+// finish records when the command of r started and ended, and its exit
+// status. Skipped commands never ran, so they keep zero times.
+func (r *Result) finish(start time.Time) {
+	r.ExitCode, r.Signal = exitStatus(r.Err)
+	if r.Skipped {
+		return
+	}
+	r.Started = start
+	r.Finished = start.Add(r.Elapsed)
+}
+
+// LogItem returns r as recorded in the audit log.
+func (r Result) LogItem() logging.ResultItem {
+	item := logging.ResultItem{
+		Index:     r.Index,
+		Command:   r.Command,
+		Output:    r.Output,
+		Stderr:    r.Stderr,
+		Elapsed:   r.Elapsed,
+		ExitCode:  r.ExitCode,
+		Signal:    r.Signal,
+		Artifacts: r.Artifacts,
+	}
+	if r.Err != nil {
+		item.Error = r.Err.Error()
+	}
+	if !r.Started.IsZero() {
+		item.Started, item.Finished = &r.Started, &r.Finished
+	}
+	return item
+}
+
+// SummaryCommand returns r as input for llm.Summarize: stdout and stderr
+// apart when they were captured separately, and the exit status.
+func (r Result) SummaryCommand() llm.SummaryCommand {
+	c := llm.SummaryCommand{Command: r.Command, Output: r.Output, Signal: r.Signal}
+	if r.Stdout != "" || r.Stderr != "" {
+		c.Output, c.Stderr = r.Stdout, r.Stderr
+	}
+	if r.Err != nil {
+		c.Error = r.Err.Error()
+		if r.ExitCode > 0 {
+			code := r.ExitCode
+			c.ExitCode = &code
+		}
+	}
+	return c
+}
@@ -0,0 +1,178 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Check is the outcome of a verification command (see plan.Plan.Verify).
+type Check struct {
+	Index   int // Index into Plan.Verify
+	Command plan.PlannedCommand
+	Output  string
+	Passed  bool
+	Reason  string // Why it did not pass: the command's error or the unmet expectation
+}
+
+// Unverified reports whether a verification command of the plan failed.
+func (r Results) Unverified() bool {
+	return len(r.Checks) > 0 && !r.Verified
+}
+
+// Verify runs the verification commands of p, if any, and records their
+// outcome in results. Checks left when the plan's time budget is spent fail
+// without running.
+func (e *Engine) Verify(ctx context.Context, p plan.Plan, results *Results) {
+	if len(p.Verify) > 0 {
+		results.setChecks(e.verify(ctx, p.Verify))
+	}
+}
+
+func (e *Engine) verify(ctx context.Context, commands []plan.PlannedCommand) []Check {
+	checks := make([]Check, 0, len(commands))
+	for i, pc := range commands {
+		c := Check{Index: i, Command: pc}
+		if e.budgetSpent() {
+			c.Reason = "skipped: the plan's time budget is spent"
+			checks = append(checks, c)
+			continue
+		}
+		r := e.runOne(ctx, i, pc)
+		c.Output = r.Output
+		if r.Err != nil {
+			c.Reason = r.Err.Error()
+		} else if pc.Expect != nil {
+			if err := expect(*pc.Expect, r.Output); err != nil {
+				c.Reason = err.Error()
+			}
+		}
+		c.Passed = c.Reason == ""
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// setChecks records checks as the verification of r.
+func (r *Results) setChecks(checks []Check) {
+	r.Checks = checks
+	r.Verified = len(checks) > 0
+	for _, c := range checks {
+		if !c.Passed {
+			r.Verified = false
+		}
+	}
+}
+
+// checkCommands returns the commands checks ran, to run them again.
+func checkCommands(checks []Check) []plan.PlannedCommand {
+	commands := make([]plan.PlannedCommand, len(checks))
+	for i, c := range checks {
+		commands[i] = c.Command
+	}
+	return commands
+}
+
+// printChecks shows the outcome of each check after a streamed run.
+func printChecks(w io.Writer, checks []Check) {
+	fmt.Fprintf(w, "\n\033[1mVerification:\033[0m\n")
+	for _, c := range checks {
+		if c.Passed {
+			fmt.Fprintf(w, "  \033[32m✓\033[0m %s\n", FormatPlanned(c.Command))
+		} else {
+			fmt.Fprintf(w, "  \033[31m✗\033[0m %s: %s\n", FormatPlanned(c.Command), c.Reason)
+		}
+	}
+}
+
+// expect returns why output does not meet x, or nil if it does.
+func expect(x plan.Expect, output string) error {
+	if x.Contains != "" && !strings.Contains(output, x.Contains) {
+		return fmt.Errorf("output does not contain %q", x.Contains)
+	}
+	if x.Regex != "" {
+		re, err := regexp.Compile(x.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+		if !re.MatchString(output) {
+			return fmt.Errorf("output does not match /%s/", x.Regex)
+		}
+	}
+	if x.JSONPath == "" {
+		return nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(output), &doc); err != nil {
+		return fmt.Errorf("output is not JSON, cannot select %s", x.JSONPath)
+	}
+	v, err := lookupJSON(doc, x.JSONPath)
+	if err != nil {
+		return fmt.Errorf("%s: %v", x.JSONPath, err)
+	}
+	if x.Equals != "" {
+		if got := jsonText(v); got != x.Equals {
+			return fmt.Errorf("%s is %s, expected %s", x.JSONPath, got, x.Equals)
+		}
+	}
+	return nil
+}
+
+// errNoValue is the error of a JSON path that selects nothing.
+var errNoValue = errors.New("no such value")
+
+// lookupJSON returns the value at path in a decoded JSON document: object
+// keys separated by dots and array indexes in brackets, with an optional
+// leading "$", as in "$.ipv4-address[0].address".
+func lookupJSON(doc interface{}, path string) (interface{}, error) {
+	v := doc
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	for rest != "" {
+		if rest[0] == '[' {
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in %q", path)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q in %q", rest[1:end], path)
+			}
+			arr, ok := v.([]interface{})
+			if !ok || n < 0 || n >= len(arr) {
+				return nil, errNoValue
+			}
+			v, rest = arr[n], strings.TrimPrefix(rest[end+1:], ".")
+			continue
+		}
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errNoValue
+		}
+		if v, ok = obj[rest[:end]]; !ok {
+			return nil, errNoValue
+		}
+		rest = strings.TrimPrefix(rest[end:], ".")
+	}
+	return v, nil
+}
+
+// jsonText is a JSON value as Expect.Equals compares it: strings as they
+// are, anything else as JSON.
+func jsonText(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
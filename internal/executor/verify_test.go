@@ -0,0 +1,139 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+func TestExpect(t *testing.T) {
+	status := `{"up": true, "ipv4-address": [{"address": "192.168.1.1", "mask": 24}], "proto": "static"}`
+	tests := []struct {
+		name   string
+		x      plan.Expect
+		output string
+		want   string // substring of the error, "" for a match
+	}{
+		{"contains", plan.Expect{Contains: "static"}, status, ""},
+		{"contains missing", plan.Expect{Contains: "dhcp"}, status, `does not contain "dhcp"`},
+		{"regex", plan.Expect{Regex: `mask": \d+`}, status, ""},
+		{"regex missing", plan.Expect{Regex: `^down`}, status, "does not match"},
+		{"json bool", plan.Expect{JSONPath: "up", Equals: "true"}, status, ""},
+		{"json array", plan.Expect{JSONPath: "$.ipv4-address[0].address", Equals: "192.168.1.1"}, status, ""},
+		{"json number", plan.Expect{JSONPath: "ipv4-address[0].mask", Equals: "24"}, status, ""},
+		{"json differs", plan.Expect{JSONPath: "proto", Equals: "dhcp"}, status, "proto is static, expected dhcp"},
+		{"json present", plan.Expect{JSONPath: "proto"}, status, ""},
+		{"json absent", plan.Expect{JSONPath: "ipv6-address"}, status, "no such value"},
+		{"json out of range", plan.Expect{JSONPath: "ipv4-address[1]"}, status, "no such value"},
+		{"not json", plan.Expect{JSONPath: "up"}, "lan is up", "not JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := expect(tt.x, tt.output)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("expected a match, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestRunPlan_Verify(t *testing.T) {
+	old := GetRunCommand()
+	defer SetRunCommand(old)
+	SetRunCommand(func(ctx context.Context, argv []string) (string, error) {
+		switch argv[0] {
+		case "status":
+			return `{"up": false}`, nil
+		case "broken":
+			return "", errors.New("exit status 1")
+		}
+		return "ok", nil
+	})
+
+	engine := New(config.Config{TimeoutSeconds: 1})
+	p := plan.Plan{
+		Commands: []plan.PlannedCommand{{Command: []string{"change"}}},
+		Verify: []plan.PlannedCommand{
+			{Command: []string{"check"}, Expect: &plan.Expect{Contains: "ok"}},
+			{Command: []string{"status"}, Expect: &plan.Expect{JSONPath: "up", Equals: "true"}},
+			{Command: []string{"broken"}},
+		},
+	}
+	results := engine.RunPlan(context.Background(), p)
+	if results.Failed != 0 {
+		t.Fatalf("expected the commands to succeed, got %d failures", results.Failed)
+	}
+	if len(results.Checks) != 3 {
+		t.Fatalf("expected 3 checks, got %d", len(results.Checks))
+	}
+	if !results.Checks[0].Passed || results.Checks[1].Passed || results.Checks[2].Passed {
+		t.Fatalf("unexpected check outcomes: %+v", results.Checks)
+	}
+	if !results.Unverified() {
+		t.Fatal("expected the plan to be unverified")
+	}
+	if code := results.ErrorCode(); code != errcode.ExecUnverified {
+		t.Fatalf("expected %s, got %s", errcode.ExecUnverified, code)
+	}
+
+	p.Verify = p.Verify[:1]
+	results = engine.RunPlan(context.Background(), p)
+	if !results.Verified || results.Unverified() || results.ErrorCode() != "" {
+		t.Fatalf("expected the plan to be verified, got %+v", results.Checks)
+	}
+}
+
+func TestAutoRetry_FailedVerification(t *testing.T) {
+	old := GetRunCommand()
+	defer SetRunCommand(old)
+	up := false
+	SetRunCommand(func(ctx context.Context, argv []string) (string, error) {
+		switch argv[0] {
+		case "ifup":
+			up = true
+		case "status":
+			if up {
+				return `{"up": true}`, nil
+			}
+			return `{"up": false}`, nil
+		}
+		return "", nil
+	})
+
+	engine := New(config.Config{MaxRetries: 2, AutoRetry: true, TimeoutSeconds: 1})
+	pol := policy.New(config.Config{Allowlist: []string{`^uci(\s|$)`, `^status(\s|$)`, `^ifup(\s|$)`}})
+	p := plan.Plan{
+		Commands: []plan.PlannedCommand{{Command: []string{"uci", "commit", "network"}}},
+		Verify:   []plan.PlannedCommand{{Command: []string{"status"}, Expect: &plan.Expect{JSONPath: "up", Equals: "true"}}},
+	}
+	results := engine.RunPlan(context.Background(), p)
+	if !results.Unverified() {
+		t.Fatal("expected the plan to be unverified before the retry")
+	}
+
+	fp := &stubFixPlanner{plans: map[string]plan.Plan{
+		"status": {Commands: []plan.PlannedCommand{{Command: []string{"ifup"}}}},
+	}}
+	results = engine.AutoRetry(context.Background(), fp, pol, results, nil)
+	if len(fp.calls) != 1 {
+		t.Fatalf("expected one fix request, got %v", fp.calls)
+	}
+	if !results.Verified {
+		t.Fatalf("expected the fix to verify the plan, got %+v", results.Checks)
+	}
+	if len(results.Items) != 2 {
+		t.Fatalf("expected the fix command appended, got %d items", len(results.Items))
+	}
+}
@@ -0,0 +1,202 @@
+// Package export writes the audit log and the metrics rollups as flat
+// tables, in CSV for spreadsheets or as a JSON array of rows for tools such
+// as the Grafana JSON datasource, for `lucicodex history export`,
+// `lucicodex metrics export` and the matching daemon endpoints.
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
+)
+
+// Formats accepted by WriteExecutions and WriteDays.
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// ContentType returns the MIME type of format.
+func ContentType(format string) string {
+	if format == FormatJSON {
+		return "application/json"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// CheckFormat returns an error unless format is csv or json.
+func CheckFormat(format string) error {
+	if format != FormatCSV && format != FormatJSON {
+		return fmt.Errorf("unknown format %q (use csv or json)", format)
+	}
+	return nil
+}
+
+// ParseSince parses a period such as "7d", "36h" or "90m": a number of days
+// with the d suffix, or a Go duration. It must be positive.
+func ParseSince(s string) (time.Duration, error) {
+	var d time.Duration
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		days, err := strconv.Atoi(n)
+		if err != nil {
+			return 0, fmt.Errorf("invalid period %q", s)
+		}
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid period %q", s)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("period %q must be positive", s)
+	}
+	return d, nil
+}
+
+// WindowDays returns the number of daily rollups that cover since, today
+// included.
+func WindowDays(since time.Duration) int {
+	return int((since + 24*time.Hour - 1) / (24 * time.Hour))
+}
+
+// Execution is one row of the history export.
+type Execution struct {
+	Time       time.Time `json:"time"`
+	ID         string    `json:"id"`
+	Prompt     string    `json:"prompt"`
+	Commands   []string  `json:"commands"`
+	Status     string    `json:"status"`
+	DurationMs int64     `json:"duration_ms"` // Total run time of the executed commands
+}
+
+// Executions returns the rows for the entries from since on, oldest first.
+// Commands are those executed, or those planned if none ran.
+func Executions(entries []logging.HistoryEntry, since time.Time) []Execution {
+	rows := []Execution{}
+	for _, h := range entries {
+		if h.Time.Before(since) {
+			continue
+		}
+		row := Execution{Time: h.Time.UTC(), ID: h.ID, Prompt: h.Prompt, Commands: []string{}, Status: h.Status()}
+		var elapsed time.Duration
+		for _, r := range h.Results {
+			row.Commands = append(row.Commands, executor.FormatCommand(r.Command))
+			elapsed += r.Elapsed
+		}
+		if len(h.Results) == 0 {
+			for _, c := range h.Plan.Commands {
+				row.Commands = append(row.Commands, executor.FormatCommand(c.Command))
+			}
+		}
+		row.DurationMs = elapsed.Milliseconds()
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Day is one row of the metrics export.
+type Day struct {
+	Date         string  `json:"date"`
+	Time         int64   `json:"time"` // Start of the day in Unix milliseconds, for time series
+	Requests     int64   `json:"requests"`
+	Successes    int64   `json:"successes"`
+	Failures     int64   `json:"failures"`
+	SuccessRate  float64 `json:"success_rate"`
+	Commands     int64   `json:"commands"`
+	LLMRequests  int64   `json:"llm_requests"`
+	LLMFailures  int64   `json:"llm_failures"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"` // Of LLM requests, over all providers
+	Escalations  int64   `json:"escalations"`    // Plans asked again of the stronger model
+}
+
+// Rollups returns the rows for rollups, in their order.
+func Rollups(rollups []metrics.DailyRollup) []Day {
+	rows := []Day{}
+	for _, r := range rollups {
+		row := Day{Date: r.Date, Requests: r.Requests, Successes: r.Successes, Failures: r.Failures, Commands: r.Commands, Escalations: r.Escalations}
+		if t, err := time.ParseInLocation("2006-01-02", r.Date, time.Local); err == nil {
+			row.Time = t.UnixMilli()
+		}
+		if r.Requests > 0 {
+			row.SuccessRate = float64(r.Successes) / float64(r.Requests) * 100
+		}
+		var total time.Duration
+		for _, ps := range r.Providers {
+			row.LLMRequests += ps.Requests
+			row.LLMFailures += ps.Failures
+			total += ps.TotalTime
+		}
+		if row.LLMRequests > 0 {
+			row.AvgLatencyMs = float64(total) / float64(row.LLMRequests) / float64(time.Millisecond)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// WriteExecutions writes rows to w in format. In CSV the commands share one
+// cell, separated by "; ".
+func WriteExecutions(w io.Writer, rows []Execution, format string) error {
+	if format == FormatJSON {
+		return writeJSON(w, rows)
+	}
+	records := [][]string{{"time", "id", "prompt", "commands", "status", "duration_ms"}}
+	for _, r := range rows {
+		records = append(records, []string{
+			r.Time.Format(time.RFC3339),
+			r.ID,
+			cell(r.Prompt),
+			cell(strings.Join(r.Commands, "; ")),
+			r.Status,
+			strconv.FormatInt(r.DurationMs, 10),
+		})
+	}
+	return csv.NewWriter(w).WriteAll(records)
+}
+
+// WriteDays writes rows to w in format.
+func WriteDays(w io.Writer, rows []Day, format string) error {
+	if format == FormatJSON {
+		return writeJSON(w, rows)
+	}
+	records := [][]string{{"date", "requests", "successes", "failures", "success_rate", "commands", "llm_requests", "llm_failures", "avg_latency_ms", "escalations"}}
+	for _, r := range rows {
+		records = append(records, []string{
+			r.Date,
+			strconv.FormatInt(r.Requests, 10),
+			strconv.FormatInt(r.Successes, 10),
+			strconv.FormatInt(r.Failures, 10),
+			strconv.FormatFloat(r.SuccessRate, 'f', 1, 64),
+			strconv.FormatInt(r.Commands, 10),
+			strconv.FormatInt(r.LLMRequests, 10),
+			strconv.FormatInt(r.LLMFailures, 10),
+			strconv.FormatFloat(r.AvgLatencyMs, 'f', 0, 64),
+			strconv.FormatInt(r.Escalations, 10),
+		})
+	}
+	return csv.NewWriter(w).WriteAll(records)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// cell keeps a spreadsheet from evaluating free text that starts like a
+// formula by prefixing it with a quote.
+func cell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,98 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestParseSince(t *testing.T) {
+	for in, want := range map[string]time.Duration{"7d": 7 * 24 * time.Hour, "12h": 12 * time.Hour, "90m": 90 * time.Minute} {
+		if got, err := ParseSince(in); err != nil || got != want {
+			t.Errorf("ParseSince(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "d", "0d", "-1h", "week", "1.5d"} {
+		if _, err := ParseSince(in); err == nil {
+			t.Errorf("ParseSince(%q) should fail", in)
+		}
+	}
+	if WindowDays(24*time.Hour) != 1 || WindowDays(36*time.Hour) != 2 || WindowDays(7*24*time.Hour) != 7 {
+		t.Error("WindowDays should round up to whole days")
+	}
+}
+
+func TestExecutions(t *testing.T) {
+	now := time.Now()
+	entries := []logging.HistoryEntry{
+		{ID: "old", Time: now.Add(-48 * time.Hour), Prompt: "too old"},
+		{ID: "a", Time: now.Add(-time.Hour), Prompt: "=HYPERLINK(\"x\")",
+			Plan:    plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}}, {Command: []string{"echo", "a b"}}}},
+			Results: []logging.ResultItem{{Command: []string{"uci", "show"}, Elapsed: time.Second}, {Command: []string{"echo", "a b"}, Elapsed: 250 * time.Millisecond, Error: "exit status 1"}}},
+		{ID: "b", Time: now, Prompt: "dry run",
+			Plan: plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}}},
+	}
+	rows := Executions(entries, now.Add(-24*time.Hour))
+	if len(rows) != 2 || rows[0].ID != "a" || rows[1].ID != "b" {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+	if rows[0].Status != "failed" || rows[0].DurationMs != 1250 || len(rows[0].Commands) != 2 {
+		t.Errorf("unexpected executed row: %+v", rows[0])
+	}
+	if rows[1].Status != "planned" || rows[1].DurationMs != 0 || rows[1].Commands[0] != "wifi reload" {
+		t.Errorf("planned commands should be listed when none ran: %+v", rows[1])
+	}
+
+	var b bytes.Buffer
+	if err := WriteExecutions(&b, rows, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(b.String(), "\n")
+	if lines[0] != "time,id,prompt,commands,status,duration_ms" {
+		t.Errorf("unexpected header: %q", lines[0])
+	}
+	if !strings.Contains(lines[1], `,a,"'=HYPERLINK(""x"")","uci show; echo ""a b""",failed,1250`) {
+		t.Errorf("formula should be quoted and commands joined: %q", lines[1])
+	}
+
+	b.Reset()
+	if err := WriteExecutions(&b, rows, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var back []Execution
+	if err := json.Unmarshal(b.Bytes(), &back); err != nil || len(back) != 2 || back[0].Prompt != entries[1].Prompt {
+		t.Errorf("JSON should keep the prompt as is: %v %s", err, b.String())
+	}
+}
+
+func TestRollups(t *testing.T) {
+	rows := Rollups([]metrics.DailyRollup{{
+		Date: "2026-10-01", Requests: 4, Successes: 3, Failures: 1, Commands: 6, Escalations: 1,
+		Providers: map[string]*metrics.ProviderStats{
+			"gemini": {Requests: 3, TotalTime: 600 * time.Millisecond},
+			"openai": {Requests: 1, Failures: 1, TotalTime: 200 * time.Millisecond},
+		},
+	}})
+	if len(rows) != 1 {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+	r := rows[0]
+	if r.SuccessRate != 75 || r.LLMRequests != 4 || r.LLMFailures != 1 || r.AvgLatencyMs != 200 || r.Time == 0 {
+		t.Errorf("unexpected row: %+v", r)
+	}
+
+	var b bytes.Buffer
+	if err := WriteDays(&b, rows, FormatCSV); err != nil {
+		t.Fatal(err)
+	}
+	want := "date,requests,successes,failures,success_rate,commands,llm_requests,llm_failures,avg_latency_ms,escalations\n2026-10-01,4,3,1,75.0,6,4,1,200,1\n"
+	if b.String() != want {
+		t.Errorf("unexpected CSV:\n%s", b.String())
+	}
+}
@@ -0,0 +1,150 @@
+package files
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 2
+
+// maxDiffCells bounds the table of the line diff; larger changes are shown
+// as the old lines removed and the new ones added.
+const maxDiffCells = 1 << 20
+
+// Diff returns a line diff of a and b in the style of diff -u, without
+// file headers: hunks start with "@@ -l,n +l,n @@" and lines with "-", "+"
+// or " ".
+func Diff(a, b string) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change and the end of its hunk
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		from := first - diffContext
+		if from < start {
+			from = start
+		}
+		to := first
+		for gap := 0; to < len(ops) && gap <= 2*diffContext; to++ {
+			if ops[to].kind == ' ' {
+				gap++
+			} else {
+				gap = 0
+			}
+		}
+		// Keep diffContext lines of the trailing unchanged run
+		end := to
+		for end > first && ops[end-1].kind == ' ' {
+			end--
+		}
+		if end += diffContext; end > len(ops) {
+			end = len(ops)
+		}
+
+		hunk := ops[from:end]
+		aStart, bStart := hunk[0].a, hunk[0].b
+		aLen, bLen := 0, 0
+		for _, op := range hunk {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart+1, aLen, bStart+1, bLen)
+		for _, op := range hunk {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			out.WriteByte('\n')
+		}
+		start = end
+	}
+	return strings.TrimRight(out.String(), "\n")
+}
+
+// diffOp is a line of the diff with its index in a and b.
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+	a, b int
+}
+
+// diffLines returns the edit script from a to b. Common prefixes and
+// suffixes are matched directly; the rest uses a longest common
+// subsequence table.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		ops = append(ops, diffOp{' ', a[pre], pre, pre})
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	if len(ma)*len(mb) > maxDiffCells {
+		for i, l := range ma {
+			ops = append(ops, diffOp{'-', l, pre + i, pre})
+		}
+		for j, l := range mb {
+			ops = append(ops, diffOp{'+', l, pre + len(ma), pre + j})
+		}
+	} else {
+		// lcs[i][j] is the LCS length of ma[i:] and mb[j:]
+		lcs := make([][]int32, len(ma)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(mb)+1)
+		}
+		for i := len(ma) - 1; i >= 0; i-- {
+			for j := len(mb) - 1; j >= 0; j-- {
+				if ma[i] == mb[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(ma) || j < len(mb) {
+			switch {
+			case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+				ops = append(ops, diffOp{' ', ma[i], pre + i, pre + j})
+				i++
+				j++
+			case j == len(mb) || (i < len(ma) && lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, diffOp{'-', ma[i], pre + i, pre + j})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', mb[j], pre + i, pre + j})
+				j++
+			}
+		}
+	}
+
+	for k := 0; k < suf; k++ {
+		ia, ib := len(a)-suf+k, len(b)-suf+k
+		ops = append(ops, diffOp{' ', a[ia], ia, ib})
+	}
+	return ops
+}
+
+// splitLines splits s into lines without their newlines.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
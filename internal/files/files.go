@@ -0,0 +1,178 @@
+// Package files implements the built-in file.read and file.write commands
+// (see plan.FileRead): reads and writes confined to allowlisted directories,
+// with size caps, previews of writes as diffs, and a backup of every file
+// that is overwritten.
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// Check returns the absolute, cleaned form of path if it lies within one of
+// roots. Symlinks are resolved first, so a link under an allowed directory
+// cannot point outside of it. For a file that does not exist yet, its
+// directory is resolved instead.
+func Check(path string, roots []string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", errcode.Errorf(errcode.PolicyDeny, "%s: file paths must be absolute", path)
+	}
+	clean := filepath.Clean(path)
+	resolved, err := resolve(clean)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range roots {
+		r := filepath.Clean(root)
+		if rr, err := filepath.EvalSymlinks(r); err == nil {
+			r = rr
+		}
+		if resolved == r || strings.HasPrefix(resolved, strings.TrimSuffix(r, "/")+"/") {
+			return clean, nil
+		}
+	}
+	return "", errcode.Errorf(errcode.PolicyDeny, "%s is outside the allowed file paths (%s)", path, strings.Join(roots, ", "))
+}
+
+// resolve follows symlinks in path, or in its directory if path does not
+// exist. When neither exists path is returned as is: nothing can be read
+// or written there anyway.
+func resolve(path string) (string, error) {
+	if r, err := filepath.EvalSymlinks(path); err == nil {
+		return r, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return path, nil
+	} else if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+// Read returns the contents of path, which must be a regular file within
+// roots. Files larger than max bytes are refused.
+func Read(path string, roots []string, max int) (string, error) {
+	clean, err := Check(path, roots)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(clean)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err != nil {
+		return "", err
+	} else if !st.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	data, err := io.ReadAll(io.LimitReader(f, int64(max)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > max {
+		return "", errcode.Errorf(errcode.PolicyDeny, "%s is larger than file_max_bytes (%d)", path, max)
+	}
+	return string(data), nil
+}
+
+// Write replaces path with content. An existing file is first copied to
+// backupDir, whose copy is returned, and keeps its permissions; new files
+// are created with mode 0644. The file is replaced atomically.
+func Write(path, content string, roots []string, max int, backupDir string) (backup string, err error) {
+	clean, err := Check(path, roots)
+	if err != nil {
+		return "", err
+	}
+	if len(content) > max {
+		return "", errcode.Errorf(errcode.PolicyDeny, "content for %s is larger than file_max_bytes (%d)", path, max)
+	}
+	mode := os.FileMode(0o644)
+	if st, err := os.Stat(clean); err == nil {
+		if !st.Mode().IsRegular() {
+			return "", fmt.Errorf("%s is not a regular file", path)
+		}
+		mode = st.Mode().Perm()
+		if backup, err = Backup(clean, backupDir); err != nil {
+			return "", fmt.Errorf("back up %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(clean), ".lucicodex-*")
+	if err != nil {
+		return backup, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return backup, err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return backup, err
+	}
+	if err := tmp.Close(); err != nil {
+		return backup, err
+	}
+	return backup, os.Rename(tmp.Name(), clean)
+}
+
+// Backup copies path to a new file in dir named after the time and the
+// path, e.g. 20261016-120000-etc_config_dhcp, readable by its owner only.
+func Backup(path, dir string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	name := time.Now().Format("20060102-150405") + "-" + strings.ReplaceAll(strings.TrimPrefix(filepath.Clean(path), "/"), "/", "_")
+	f, err := os.CreateTemp(dir, name+"-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// Preview describes what writing content to path would change: a diff
+// against the current file, or the line count of a new one.
+func Preview(path, content string) string {
+	old, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return PreviewContent("", false, content)
+	}
+	if err != nil {
+		return "cannot read current file: " + err.Error()
+	}
+	return PreviewContent(string(old), true, content)
+}
+
+// PreviewContent is Preview for a file whose current contents were already
+// read: old, if exists is set.
+func PreviewContent(old string, exists bool, content string) string {
+	if !exists {
+		return fmt.Sprintf("new file, %d line(s)", len(splitLines(content)))
+	}
+	if old == content {
+		return "no changes"
+	}
+	return Diff(old, content)
+}
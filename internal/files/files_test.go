@@ -0,0 +1,97 @@
+package files
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+func TestCheck(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0o600)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "link"))
+	roots := []string{root}
+
+	for _, ok := range []string{root + "/dhcp", root + "/sub/../dhcp"} {
+		if _, err := Check(ok, roots); err != nil {
+			t.Errorf("%s: unexpected error %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"dhcp", root + "/../secret", outside + "/secret", root + "/link", root + "2/dhcp"} {
+		if _, err := Check(bad, roots); errcode.Of(err) != errcode.PolicyDeny {
+			t.Errorf("%s: expected POLICY_DENY, got %v", bad, err)
+		}
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	root := t.TempDir()
+	backups := filepath.Join(t.TempDir(), "backups")
+	roots := []string{root}
+	path := filepath.Join(root, "dhcp")
+
+	backup, err := Write(path, "config dnsmasq\n", roots, 1024, backups)
+	if err != nil || backup != "" {
+		t.Fatalf("create: %q %v", backup, err)
+	}
+	os.Chmod(path, 0o600)
+
+	backup, err = Write(path, "config dnsmasq\n\toption domain 'lan'\n", roots, 1024, backups)
+	if err != nil {
+		t.Fatalf("overwrite: %v", err)
+	}
+	if data, _ := os.ReadFile(backup); string(data) != "config dnsmasq\n" || !strings.Contains(filepath.Base(backup), "dhcp") {
+		t.Errorf("backup %s holds %q", backup, data)
+	}
+	if st, _ := os.Stat(path); st.Mode().Perm() != 0o600 {
+		t.Errorf("mode not kept: %v", st.Mode())
+	}
+
+	got, err := Read(path, roots, 1024)
+	if err != nil || got != "config dnsmasq\n\toption domain 'lan'\n" {
+		t.Errorf("read %q, %v", got, err)
+	}
+	if _, err := Read(path, roots, 10); errcode.Of(err) != errcode.PolicyDeny {
+		t.Errorf("read over the cap: %v", err)
+	}
+	if _, err := Write(path, strings.Repeat("x", 11), roots, 10, backups); errcode.Of(err) != errcode.PolicyDeny {
+		t.Errorf("write over the cap: %v", err)
+	}
+	if _, err := Read(filepath.Join(root, "missing"), roots, 10); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network")
+	if got := Preview(path, "a\nb\n"); got != "new file, 2 line(s)" {
+		t.Errorf("new file: %q", got)
+	}
+	os.WriteFile(path, []byte("a\nb\n"), 0o644)
+	if got := Preview(path, "a\nb\n"); got != "no changes" {
+		t.Errorf("same content: %q", got)
+	}
+	if got := Preview(path, "a\nc\n"); got != "@@ -1,2 +1,2 @@\n a\n-b\n+c" {
+		t.Errorf("diff: %q", got)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	new := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n"
+	want := strings.Join([]string{
+		"@@ -1,5 +1,5 @@", " 1", " 2", "-3", "+three", " 4", " 5",
+		"@@ -9,2 +9,3 @@", " 9", " 10", "+11",
+	}, "\n")
+	if got := Diff(old, new); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got := Diff("a\n", "a\n"); got != "" {
+		t.Errorf("identical: %q", got)
+	}
+}
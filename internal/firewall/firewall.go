@@ -0,0 +1,278 @@
+// Package firewall reads the port forwards (redirect sections) and traffic
+// rules (rule sections) of the firewall configuration, recognises requests
+// to forward or open a port, and finds the existing sections a new one
+// would duplicate or be shadowed by. The planner shows the model what it
+// finds, and the policy refuses plans adding such a section without
+// changing the existing one (see policy.Engine.WithFirewall).
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+)
+
+// Section types compared by Compare.
+const (
+	Redirect    = "redirect"
+	TrafficRule = "rule"
+)
+
+// Rule is a redirect or rule section of the firewall configuration.
+type Rule struct {
+	// Section is how `uci show` names the section: its name, or
+	// "@<type>[<index>]" if it is anonymous
+	Section string            `json:"section"`
+	Type    string            `json:"type"`
+	Options map[string]string `json:"options"`
+}
+
+// Load returns the redirect and rule sections of the firewall
+// configuration, in order, from `uci -q show firewall`. It returns nil if
+// the configuration cannot be read, and an empty list if it has none.
+func Load(ctx context.Context) []Rule {
+	return Parse(openwrt.GetRunCommand()(ctx, "uci", "-q", "show", "firewall"))
+}
+
+// Parse returns the redirect and rule sections of out, the output of
+// `uci show firewall`. It returns nil if out has no firewall sections at
+// all.
+func Parse(out string) []Rule {
+	var rules []Rule
+	sections := false
+	index := map[string]int{}
+	for _, line := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || !strings.HasPrefix(k, "firewall.") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(k, "firewall."), ".", 2)
+		if len(parts) == 1 {
+			sections = true
+			if v == Redirect || v == TrafficRule {
+				rules = append(rules, Rule{Section: parts[0], Type: v, Options: map[string]string{}})
+				index[parts[0]] = len(rules) - 1
+			}
+			continue
+		}
+		if i, ok := index[parts[0]]; ok {
+			rules[i].Options[parts[1]] = unquote(v)
+		}
+	}
+	if !sections {
+		return nil
+	}
+	if rules == nil {
+		rules = []Rule{}
+	}
+	return rules
+}
+
+// unquote turns a uci value into its words: 'tcp' 'udp', the way `uci
+// show` prints a list, becomes "tcp udp".
+func unquote(v string) string {
+	var words []string
+	for _, w := range strings.Fields(v) {
+		words = append(words, strings.Trim(w, `'"`))
+	}
+	return strings.Join(words, " ")
+}
+
+// Enabled reports whether the section is in effect.
+func (r Rule) Enabled() bool {
+	return r.Options["enabled"] != "0"
+}
+
+// Target returns what the section does with matching traffic: DNAT or SNAT
+// for a redirect, ACCEPT, REJECT, DROP and so on for a rule.
+func (r Rule) Target() string {
+	if t := strings.ToUpper(r.Options["target"]); t != "" {
+		return t
+	}
+	if r.Type == Redirect {
+		return "DNAT"
+	}
+	return "ACCEPT"
+}
+
+// Port returns the port or ports the section matches: src_dport for a
+// redirect, dest_port for a rule.
+func (r Rule) Port() string {
+	if r.Type == Redirect {
+		return r.Options["src_dport"]
+	}
+	return r.Options["dest_port"]
+}
+
+// destPort returns the port a redirect forwards to, the matched one if it
+// does not say.
+func (r Rule) destPort() string {
+	if p := r.Options["dest_port"]; p != "" {
+		return p
+	}
+	return r.Port()
+}
+
+// protos returns the protocols the section matches, "tcp udp" if it does
+// not say.
+func (r Rule) protos() []string {
+	p := strings.ToLower(r.Options["proto"])
+	if p == "" {
+		p = "tcp udp"
+	}
+	return strings.Fields(p)
+}
+
+// Describe says what the section does, such as "forwards wan tcp port 443
+// to 192.168.1.10:443".
+func (r Rule) Describe() string {
+	from := r.Options["src"]
+	if from == "" {
+		from = "any"
+	}
+	proto := strings.Join(r.protos(), "/")
+	if r.Type == Redirect {
+		return fmt.Sprintf("forwards %s %s port %s to %s:%s", from, proto, r.Port(), r.Options["dest_ip"], r.destPort())
+	}
+	verb := map[string]string{"ACCEPT": "accepts", "REJECT": "rejects", "DROP": "drops"}[r.Target()]
+	if verb == "" {
+		verb = "sends to " + r.Target()
+	}
+	to := "the router"
+	if d := r.Options["dest"]; d != "" {
+		to = "zone " + d
+	}
+	return fmt.Sprintf("%s %s %s port %s to %s", verb, from, proto, r.Port(), to)
+}
+
+// String names the section as uci does, with its name option if it has one.
+func (r Rule) String() string {
+	s := "firewall." + r.Section
+	if n := r.Options["name"]; n != "" {
+		s += fmt.Sprintf(" (%q)", n)
+	}
+	return s
+}
+
+// How an added section clashes with an existing one.
+const (
+	// Duplicate: the existing section already does the same thing
+	Duplicate = "duplicate"
+	// Shadow: the existing section matches the same traffic but does
+	// something else, and wins since it comes first
+	Shadow = "shadow"
+)
+
+// Conflict is an existing section an added one clashes with.
+type Conflict struct {
+	Existing Rule   `json:"existing"`
+	Kind     string `json:"kind"` // Duplicate or Shadow
+}
+
+// Reason explains the conflict for an added section.
+func (c Conflict) Reason() string {
+	if c.Kind == Duplicate {
+		return fmt.Sprintf("duplicates %s, which already %s", c.Existing, c.Existing.Describe())
+	}
+	return fmt.Sprintf("is shadowed by %s, which %s and comes first", c.Existing, c.Existing.Describe())
+}
+
+// Compare reports whether added, a section appended to the configuration,
+// duplicates existing or is shadowed by it: both are enabled sections of
+// the same type matching overlapping ports of the same protocols from the
+// same zone. Sections without a port, SNAT redirects and sections limited
+// to different addresses never clash.
+func Compare(existing, added Rule) (Conflict, bool) {
+	if existing.Type != added.Type || !existing.Enabled() || !added.Enabled() {
+		return Conflict{}, false
+	}
+	if existing.Type == Redirect && (existing.Target() != "DNAT" || added.Target() != "DNAT") {
+		return Conflict{}, false
+	}
+	same := []string{"src", "src_ip", "src_dip"}
+	if existing.Type == TrafficRule {
+		same = append(same, "dest", "dest_ip")
+	}
+	for _, o := range same {
+		if !strings.EqualFold(existing.Options[o], added.Options[o]) {
+			return Conflict{}, false
+		}
+	}
+	if !familiesOverlap(existing.Options["family"], added.Options["family"]) ||
+		!overlap(existing.protos(), added.protos()) || !portsOverlap(existing.Port(), added.Port()) {
+		return Conflict{}, false
+	}
+	c := Conflict{Existing: existing, Kind: Shadow}
+	if existing.Type == Redirect {
+		if existing.Options["dest_ip"] == added.Options["dest_ip"] && existing.destPort() == added.destPort() {
+			c.Kind = Duplicate
+		}
+	} else if existing.Target() == added.Target() {
+		c.Kind = Duplicate
+	}
+	return c, true
+}
+
+// Check returns the sections of existing that added clashes with.
+func Check(added Rule, existing []Rule) []Conflict {
+	var out []Conflict
+	for _, r := range existing {
+		if c, ok := Compare(r, added); ok {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func familiesOverlap(a, b string) bool {
+	unset := func(f string) bool { return f == "" || f == "any" }
+	return unset(a) || unset(b) || strings.EqualFold(a, b)
+}
+
+func overlap(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y || x == "all" || y == "all" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// portsOverlap reports whether two port specifications share a port. Each
+// is a list of ports and ranges such as "80 443 8000-8080"; an empty one
+// or one that does not parse shares none.
+func portsOverlap(a, b string) bool {
+	ra, rb := portRanges(a), portRanges(b)
+	for _, x := range ra {
+		for _, y := range rb {
+			if x[0] <= y[1] && y[0] <= x[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func portRanges(spec string) [][2]int {
+	var out [][2]int
+	for _, f := range strings.Fields(spec) {
+		lo, hi, isRange := strings.Cut(strings.ReplaceAll(f, ":", "-"), "-")
+		from, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(hi); err != nil || to < from {
+				return nil
+			}
+		}
+		out = append(out, [2]int{from, to})
+	}
+	return out
+}
@@ -0,0 +1,179 @@
+package firewall
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+const uciShowFirewall = `firewall.@defaults[0]=defaults
+firewall.@zone[0]=zone
+firewall.@zone[0].name='lan'
+firewall.@rule[0]=rule
+firewall.@rule[0].name='Allow-DHCP-Renew'
+firewall.@rule[0].src='wan'
+firewall.@rule[0].proto='udp'
+firewall.@rule[0].dest_port='68'
+firewall.@rule[0].target='ACCEPT'
+firewall.@redirect[0]=redirect
+firewall.@redirect[0].name='https'
+firewall.@redirect[0].src='wan'
+firewall.@redirect[0].src_dport='443'
+firewall.@redirect[0].proto='tcp'
+firewall.@redirect[0].dest='lan'
+firewall.@redirect[0].dest_ip='192.168.1.5'
+firewall.@redirect[0].target='DNAT'
+firewall.no_ssh=rule
+firewall.no_ssh.src='wan'
+firewall.no_ssh.proto='tcp' 'udp'
+firewall.no_ssh.dest_port='2200-2299'
+firewall.no_ssh.target='REJECT'
+`
+
+func TestParse(t *testing.T) {
+	rules := Parse(uciShowFirewall)
+	if len(rules) != 3 {
+		t.Fatalf("expected 3 sections, got %+v", rules)
+	}
+	if r := rules[2]; r.Section != "no_ssh" || r.Type != TrafficRule || r.Options["proto"] != "tcp udp" || r.Target() != "REJECT" {
+		t.Errorf("unexpected rule %+v", r)
+	}
+	if Parse("") != nil {
+		t.Error("expected nil without a firewall configuration")
+	}
+	if rules := Parse("firewall.@defaults[0]=defaults\n"); rules == nil || len(rules) != 0 {
+		t.Errorf("expected an empty list, got %#v", rules)
+	}
+}
+
+func TestParseIntent(t *testing.T) {
+	cases := []struct {
+		request string
+		want    Intent
+		ok      bool
+	}{
+		{"forward port 443 to 192.168.1.10", Intent{Forward: true, Proto: "tcp udp", Port: "443", DestIP: "192.168.1.10", DestPort: "443"}, true},
+		{"Forward TCP port 8080 to 192.168.1.20 port 80", Intent{Forward: true, Proto: "tcp", Port: "8080", DestIP: "192.168.1.20", DestPort: "80"}, true},
+		{"set up port forwarding of 2222/tcp to 10.0.0.2:22", Intent{Forward: true, Proto: "tcp", Port: "2222", DestIP: "10.0.0.2", DestPort: "22"}, true},
+		{"open udp port 51820", Intent{Proto: "udp", Port: "51820"}, true},
+		{"forward port 443", Intent{}, false},
+		{"show the firewall rules", Intent{}, false},
+	}
+	for _, c := range cases {
+		got, ok := ParseIntent(c.request)
+		if ok != c.ok || got != c.want {
+			t.Errorf("ParseIntent(%q) = %+v, %v; want %+v, %v", c.request, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	rules := Parse(uciShowFirewall)
+	forward := func(request string) []Conflict {
+		in, _ := ParseIntent(request)
+		return Check(in.Rule(), rules)
+	}
+	if c := forward("forward tcp port 443 to 192.168.1.5"); len(c) != 1 || c[0].Kind != Duplicate {
+		t.Errorf("expected a duplicate, got %+v", c)
+	}
+	if c := forward("forward port 443 to 192.168.1.10"); len(c) != 1 || c[0].Kind != Shadow || !strings.Contains(c[0].Reason(), `firewall.@redirect[0] ("https")`) {
+		t.Errorf("expected a shadowed forward, got %+v", c)
+	}
+	if c := forward("forward udp port 443 to 192.168.1.10"); len(c) != 0 {
+		t.Errorf("expected other protocols not to clash, got %+v", c)
+	}
+	if c := forward("open tcp port 2250"); len(c) != 1 || c[0].Kind != Shadow || c[0].Existing.Section != "no_ssh" {
+		t.Errorf("expected the REJECT range to shadow the rule, got %+v", c)
+	}
+	if c := forward("open udp port 68"); len(c) != 1 || c[0].Kind != Duplicate {
+		t.Errorf("expected a duplicate rule, got %+v", c)
+	}
+
+	disabled := Parse(uciShowFirewall)
+	disabled[1].Options["enabled"] = "0"
+	in, _ := ParseIntent("forward port 443 to 192.168.1.10")
+	if c := Check(in.Rule(), disabled); len(c) != 0 {
+		t.Errorf("expected disabled sections not to clash, got %+v", c)
+	}
+}
+
+func TestCheckPlan(t *testing.T) {
+	rules := Parse(uciShowFirewall)
+	cmd := func(argv ...string) plan.PlannedCommand { return plan.PlannedCommand{Command: argv} }
+	add := []plan.PlannedCommand{
+		cmd("uci", "add", "firewall", "redirect"),
+		cmd("uci", "set", "firewall.@redirect[-1].src=wan"),
+		cmd("uci", "set", "firewall.@redirect[-1].src_dport=443"),
+		cmd("uci", "set", "firewall.@redirect[-1].proto=tcp"),
+		cmd("uci", "set", "firewall.@redirect[-1].dest_ip=192.168.1.10"),
+		cmd("uci", "commit", "firewall"),
+	}
+	f := CheckPlan(add, rules)
+	if len(f) != 1 || f[0].Command != 0 || f[0].Kind != Shadow || f[0].Added.Section != "@redirect[1]" {
+		t.Fatalf("expected the new redirect to be shadowed, got %+v", f)
+	}
+	if !strings.Contains(f[0].Message(), "adds a firewall redirect that is shadowed by firewall.@redirect[0]") {
+		t.Errorf("unexpected message %q", f[0].Message())
+	}
+
+	// Changing or deleting the existing section resolves the conflict
+	for _, fix := range []plan.PlannedCommand{
+		cmd("uci", "delete", "firewall.@redirect[0]"),
+		cmd("uci", "set", "firewall.@redirect[0].src_dport=8443"),
+	} {
+		if f := CheckPlan(append([]plan.PlannedCommand{fix}, add...), rules); len(f) != 0 {
+			t.Errorf("expected %v to resolve the conflict, got %+v", fix.Command, f)
+		}
+	}
+
+	// So does editing the existing section instead of adding one
+	edit := []plan.PlannedCommand{cmd("uci", "set", "firewall.@redirect[0].dest_ip=192.168.1.10")}
+	if f := CheckPlan(edit, rules); len(f) != 0 {
+		t.Errorf("expected no findings, got %+v", f)
+	}
+
+	// Named sections and a removed addition
+	named := []plan.PlannedCommand{
+		cmd("uci", "set", "firewall.ssh_in=rule"),
+		cmd("uci", "set", "firewall.ssh_in.src=wan"),
+		cmd("uci", "set", "firewall.ssh_in.dest_port=2222"),
+		cmd("uci", "set", "firewall.ssh_in.proto=tcp"),
+	}
+	if f := CheckPlan(named, rules); len(f) != 1 || f[0].Existing.Section != "no_ssh" {
+		t.Errorf("expected the named rule to be shadowed by no_ssh, got %+v", f)
+	}
+	if f := CheckPlan(append(named, cmd("uci", "delete", "firewall.ssh_in")), rules); len(f) != 0 {
+		t.Errorf("expected a deleted addition to be ignored, got %+v", f)
+	}
+}
+
+func TestPromptBlock(t *testing.T) {
+	original := openwrt.GetRunCommand()
+	defer openwrt.SetRunCommand(original)
+	openwrt.SetRunCommand(func(ctx context.Context, name string, args ...string) string {
+		if name+" "+strings.Join(args, " ") == "uci -q show firewall" {
+			return uciShowFirewall
+		}
+		return ""
+	})
+
+	block := PromptBlock(context.Background(), "forward port 443 to 192.168.1.10")
+	for _, want := range []string{
+		"Firewall check for this request (a section that forwards wan tcp/udp port 443 to 192.168.1.10:443)",
+		`It is shadowed by firewall.@redirect[0] ("https"), which forwards wan tcp port 443 to 192.168.1.5:443`,
+		"are refused",
+	} {
+		if !strings.Contains(block, want) {
+			t.Errorf("block lacks %q:\n%s", want, block)
+		}
+	}
+	if block := PromptBlock(context.Background(), "open tcp port 8080"); !strings.Contains(block, "No existing redirect or rule matches this port") {
+		t.Errorf("unexpected block %q", block)
+	}
+	if block := PromptBlock(context.Background(), "show the firewall"); block != "" {
+		t.Errorf("expected no block, got %q", block)
+	}
+}
@@ -0,0 +1,109 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	forwardRE = regexp.MustCompile(`\b(?:forward|forwarding|redirect|dnat)\b`)
+	openRE    = regexp.MustCompile(`\b(?:open|allow|unblock|expose)\b`)
+	portRE    = regexp.MustCompile(`\bports?\s+(\d{1,5}(?:[-:]\d{1,5})?)\b|\b(\d{1,5})/(?:tcp|udp)\b`)
+	destRE    = regexp.MustCompile(`\b(?:to|->)\s+(\d{1,3}(?:\.\d{1,3}){3})(?::(\d{1,5}))?(?:\s+(?:on\s+)?ports?\s+(\d{1,5}(?:[-:]\d{1,5})?))?`)
+	protoRE   = regexp.MustCompile(`\b(tcp|udp)\b`)
+)
+
+// Intent is a request to forward a port from the wan to a host, or to open
+// a port of the router itself.
+type Intent struct {
+	Forward bool   // A port forward; otherwise opening a port
+	Proto   string // "tcp", "udp" or, if the request names neither, "tcp udp"
+	Port    string // The port or range on the wan side
+	// DestIP and DestPort are where a port forward goes; DestPort is Port
+	// if the request does not say
+	DestIP   string
+	DestPort string
+}
+
+// ParseIntent recognises requests such as "forward port 443 to
+// 192.168.1.10", "forward tcp port 8080 to 192.168.1.20 port 80" or "open
+// udp port 51820".
+func ParseIntent(request string) (Intent, bool) {
+	s := strings.ToLower(request)
+	m := portRE.FindStringSubmatch(s)
+	if m == nil {
+		return Intent{}, false
+	}
+	in := Intent{Port: m[1] + m[2], Proto: "tcp udp"}
+	if protos := protoRE.FindAllString(s, -1); len(protos) > 0 {
+		seen := map[string]bool{}
+		var list []string
+		for _, p := range protos {
+			if !seen[p] {
+				seen[p] = true
+				list = append(list, p)
+			}
+		}
+		in.Proto = strings.Join(list, " ")
+	}
+	d := destRE.FindStringSubmatch(s)
+	switch {
+	case forwardRE.MatchString(s) && d != nil:
+		in.Forward, in.DestIP, in.DestPort = true, d[1], d[2]+d[3]
+		if in.DestPort == "" {
+			in.DestPort = in.Port
+		}
+	case openRE.MatchString(s) && d == nil:
+	default:
+		return Intent{}, false
+	}
+	return in, true
+}
+
+// Rule returns the section carrying out the intent, as added to the wan
+// zone.
+func (in Intent) Rule() Rule {
+	if in.Forward {
+		return Rule{Section: "@redirect[-1]", Type: Redirect, Options: map[string]string{
+			"src": "wan", "src_dport": in.Port, "proto": in.Proto,
+			"dest": "lan", "dest_ip": in.DestIP, "dest_port": in.DestPort, "target": "DNAT",
+		}}
+	}
+	return Rule{Section: "@rule[-1]", Type: TrafficRule, Options: map[string]string{
+		"src": "wan", "dest_port": in.Port, "proto": in.Proto, "target": "ACCEPT",
+	}}
+}
+
+// PromptBlock checks a request to forward or open a port (see ParseIntent)
+// against the firewall configuration and tells the model what it found:
+// the sections the new one would duplicate or be shadowed by, which a plan
+// must change or delete rather than add another, or that there are none.
+// It returns "" for other requests, or if the configuration cannot be read.
+func PromptBlock(ctx context.Context, request string) string {
+	in, ok := ParseIntent(request)
+	if !ok {
+		return ""
+	}
+	rules := Load(ctx)
+	if rules == nil {
+		return ""
+	}
+	return FormatCheck(in, Check(in.Rule(), rules))
+}
+
+// FormatCheck renders the conflicts of in as a prompt block.
+func FormatCheck(in Intent, conflicts []Conflict) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "\n\nFirewall check for this request (a section that %s):\n", in.Rule().Describe())
+	if len(conflicts) == 0 {
+		b.WriteString("- No existing redirect or rule matches this port; add a new section.")
+		return b.String()
+	}
+	for _, c := range conflicts {
+		fmt.Fprintf(b, "- It %s.\n", c.Reason())
+	}
+	b.WriteString("Change or delete these sections with `uci set firewall.<section>.<option>=...` or `uci delete firewall.<section>` instead of adding another: plans adding a section that duplicates an existing one or is shadowed by it are refused.")
+	return b.String()
+}
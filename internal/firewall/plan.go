@@ -0,0 +1,190 @@
+package firewall
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Finding is a section a plan adds that clashes with an existing one the
+// plan leaves alone.
+type Finding struct {
+	Command int  // Index of the command adding the section
+	Added   Rule // The section as the plan configures it
+	Conflict
+}
+
+// Message explains the finding.
+func (f Finding) Message() string {
+	return fmt.Sprintf("adds a firewall %s that %s; change or delete that section instead", f.Added.Type, f.Conflict.Reason())
+}
+
+// CheckPlan follows the uci commands of cmds through the firewall
+// configuration whose redirect and rule sections are existing, and returns
+// the sections they add that duplicate an existing section or are shadowed
+// by one. Existing sections the plan changes or deletes are left out, since
+// the plan takes care of them. Changes made by `uci batch` or `uci import`
+// cannot be followed and are ignored.
+func CheckPlan(cmds []plan.PlannedCommand, existing []Rule) []Finding {
+	if len(existing) == 0 {
+		return nil
+	}
+	s := &simulation{existing: existing, touched: map[int]bool{}}
+	for i, c := range cmds {
+		for _, argv := range c.Stages() {
+			s.uci(i, argv)
+		}
+	}
+	var out []Finding
+	for _, a := range s.added {
+		if a.deleted {
+			continue
+		}
+		for j, r := range existing {
+			if s.touched[j] {
+				continue
+			}
+			if c, ok := Compare(r, a.rule); ok {
+				out = append(out, Finding{Command: a.command, Added: a.rule, Conflict: c})
+			}
+		}
+	}
+	return out
+}
+
+// simulation tracks the sections a plan adds and the existing ones it
+// touches.
+type simulation struct {
+	existing []Rule
+	touched  map[int]bool // Indexes of existing sections the plan changes
+	added    []*addedRule
+}
+
+type addedRule struct {
+	command int
+	rule    Rule
+	deleted bool
+}
+
+// uci applies `uci <op> firewall...` to the simulation.
+func (s *simulation) uci(i int, argv []string) {
+	if len(argv) == 0 || path.Base(argv[0]) != "uci" {
+		return
+	}
+	args := argv[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		if args[0] == "-c" || args[0] == "-d" || args[0] == "-p" || args[0] == "-P" {
+			args = args[1:] // Takes a value
+		}
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return
+	}
+	op, key := args[0], args[1]
+	if op == "add" {
+		if key == "firewall" && len(args) > 2 && (args[2] == Redirect || args[2] == TrafficRule) {
+			s.added = append(s.added, &addedRule{command: i, rule: Rule{
+				Section: fmt.Sprintf("@%s[%d]", args[2], s.count(args[2])),
+				Type:    args[2],
+				Options: map[string]string{},
+			}})
+		}
+		return
+	}
+	key, value, _ := strings.Cut(key, "=")
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) < 2 || parts[0] != "firewall" {
+		return
+	}
+	value = unquote(value)
+	existing, added := s.resolve(parts[1])
+	if existing < 0 && added == nil {
+		if op == "set" && len(parts) == 2 && (value == Redirect || value == TrafficRule) {
+			s.added = append(s.added, &addedRule{command: i, rule: Rule{Section: parts[1], Type: value, Options: map[string]string{}}})
+		}
+		return
+	}
+	if existing >= 0 {
+		s.touched[existing] = true
+		return
+	}
+	switch {
+	case len(parts) == 2:
+		if op == "delete" {
+			added.deleted = true
+		}
+	case op == "set":
+		added.rule.Options[parts[2]] = value
+	case op == "add_list":
+		added.rule.Options[parts[2]] = strings.TrimSpace(added.rule.Options[parts[2]] + " " + value)
+	case op == "delete":
+		delete(added.rule.Options, parts[2])
+	}
+}
+
+// count returns the number of sections of type typ, existing and added.
+func (s *simulation) count(typ string) int {
+	n := 0
+	for _, r := range s.existing {
+		if r.Type == typ {
+			n++
+		}
+	}
+	for _, a := range s.added {
+		if a.rule.Type == typ {
+			n++
+		}
+	}
+	return n
+}
+
+// resolve finds the section a plan refers to as section: a name, or
+// "@<type>[<index>]" counting existing sections and then added ones, with
+// negative indexes counting from the end. It returns the index of an
+// existing section, or -1 and the added one, or -1 and nil if there is
+// neither.
+func (s *simulation) resolve(section string) (int, *addedRule) {
+	if typ, idx, ok := strings.Cut(strings.TrimPrefix(section, "@"), "["); ok && strings.HasPrefix(section, "@") {
+		n, err := strconv.Atoi(strings.TrimSuffix(idx, "]"))
+		if err != nil {
+			return -1, nil
+		}
+		var existing []int
+		for j, r := range s.existing {
+			if r.Type == typ {
+				existing = append(existing, j)
+			}
+		}
+		var added []*addedRule
+		for _, a := range s.added {
+			if a.rule.Type == typ {
+				added = append(added, a)
+			}
+		}
+		if n < 0 {
+			n += len(existing) + len(added)
+		}
+		switch {
+		case n < 0 || n >= len(existing)+len(added):
+			return -1, nil
+		case n < len(existing):
+			return existing[n], nil
+		}
+		return -1, added[n-len(existing)]
+	}
+	for j, r := range s.existing {
+		if r.Section == section {
+			return j, nil
+		}
+	}
+	for _, a := range s.added {
+		if a.rule.Section == section {
+			return -1, a
+		}
+	}
+	return -1, nil
+}
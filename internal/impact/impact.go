@@ -0,0 +1,263 @@
+// Package impact estimates what running a plan will disrupt, so it can be
+// weighed before approval: how many commands change state, which services
+// restart, how long the router is expected to be unavailable and the worst
+// case execution time.
+package impact
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// restartSeconds is the typical loss of service, in seconds, while a service
+// restarts or reloads on a small router. Unknown services use
+// defaultRestartSeconds.
+var restartSeconds = map[string]int{
+	"network":  30,
+	"wifi":     15,
+	"firewall": 5,
+	"dnsmasq":  3,
+	"odhcpd":   2,
+	"uhttpd":   2,
+	"rpcd":     2,
+	"dropbear": 1,
+}
+
+const (
+	defaultRestartSeconds = 5
+	rebootSeconds         = 90
+	defaultTimeoutSeconds = 30 // Matches the executor's fallback
+)
+
+// serviceActions are init script actions that change running state.
+var serviceActions = map[string]bool{
+	"start": true, "stop": true, "restart": true, "reload": true,
+	"enable": true, "disable": true,
+}
+
+// downActions are serviceActions that interrupt the service.
+var downActions = map[string]bool{"stop": true, "restart": true, "reload": true}
+
+// Estimate computes the impact of p. tokens is the number of LLM tokens the
+// request has consumed so far.
+func Estimate(cfg config.Config, p plan.Plan, tokens int) *plan.Estimate {
+	e := &plan.Estimate{Commands: len(p.Commands), TokensUsed: tokens}
+	timeout := cfg.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultTimeoutSeconds
+	}
+	restarted := map[string]bool{}
+	for _, c := range p.Commands {
+		if !c.Background {
+			e.TimeBudgetSeconds += timeout
+		}
+		write := false
+		for _, argv := range c.Stages() {
+			if IsWrite(argv) {
+				write = true
+			}
+			if isReboot(argv) {
+				e.Reboot = true
+			}
+			if svc := restartedService(argv); svc != "" {
+				restarted[svc] = true
+			}
+		}
+		if write {
+			e.WriteCommands++
+		}
+	}
+	for svc := range restarted {
+		e.Services = append(e.Services, svc)
+	}
+	sort.Strings(e.Services)
+
+	if e.Reboot {
+		// Everything is down while the router reboots
+		e.DowntimeSeconds = rebootSeconds
+		return e
+	}
+	for _, svc := range e.Services {
+		if s, ok := restartSeconds[svc]; ok {
+			e.DowntimeSeconds += s
+		} else {
+			e.DowntimeSeconds += defaultRestartSeconds
+		}
+	}
+	return e
+}
+
+// Risk categories of a command, from least to most disruptive.
+const (
+	RiskRead    = "read"    // Only reads state
+	RiskWrite   = "write"   // Changes configuration or state
+	RiskService = "service" // Interrupts a service
+	RiskReboot  = "reboot"  // Takes the router down
+)
+
+// Risk returns the category of the most disruptive stage of c.
+func Risk(c plan.PlannedCommand) string {
+	risk := RiskRead
+	for _, argv := range c.Stages() {
+		switch {
+		case isReboot(argv):
+			return RiskReboot
+		case restartedService(argv) != "":
+			risk = RiskService
+		case IsWrite(argv) && risk == RiskRead:
+			risk = RiskWrite
+		}
+	}
+	return risk
+}
+
+// restartedService returns the service whose operation argv interrupts, if
+// any. Built-in service commands name it exactly.
+func restartedService(argv []string) string {
+	if len(argv) == 0 {
+		return ""
+	}
+	argv = plan.InitArgv(argv)
+	name := path.Base(argv[0])
+	args := argv[1:]
+	switch {
+	case strings.HasPrefix(argv[0], "/etc/init.d/"):
+		if len(args) > 0 && downActions[args[0]] {
+			return name
+		}
+	case name == "service":
+		if len(args) > 1 && downActions[args[1]] {
+			return args[0]
+		}
+	case name == "wifi":
+		if len(args) == 0 || args[0] != "status" {
+			return "wifi"
+		}
+	case name == "fw4" || name == "fw3":
+		if len(args) > 0 && downActions[args[0]] {
+			return "firewall"
+		}
+	case name == "ifup" || name == "ifdown":
+		return "network"
+	case name == "ubus":
+		// ubus call network reload / ubus call network.interface.wan down
+		if len(args) >= 3 && args[0] == "call" && strings.HasPrefix(args[1], "network") {
+			switch args[2] {
+			case "reload", "restart", "down", "up":
+				return "network"
+			}
+		}
+	}
+	return ""
+}
+
+func isReboot(argv []string) bool {
+	if len(argv) == 0 {
+		return false
+	}
+	switch path.Base(argv[0]) {
+	case "reboot", "poweroff", "halt", "sysupgrade", "firstboot":
+		return true
+	}
+	return false
+}
+
+// uciWriteOps are uci subcommands that change configuration.
+var uciWriteOps = map[string]bool{
+	"set": true, "add": true, "add_list": true, "del_list": true, "delete": true,
+	"rename": true, "reorder": true, "commit": true, "revert": true, "import": true, "batch": true,
+}
+
+// writeCommands always change state, whatever their arguments.
+var writeCommands = map[string]bool{
+	"rm": true, "mv": true, "cp": true, "mkdir": true, "rmdir": true, "touch": true,
+	"chmod": true, "chown": true, "ln": true, "tee": true, "dd": true,
+	"kill": true, "killall": true, "reboot": true, "poweroff": true, "halt": true,
+	"sysupgrade": true, "firstboot": true, "jffs2reset": true, "passwd": true,
+	"ifup": true, "ifdown": true, "reload_config": true, "crontab": true,
+	plan.FileWrite: true,
+}
+
+// ipWriteOps are `ip` object actions that change interfaces, addresses or routes.
+var ipWriteOps = map[string]bool{
+	"add": true, "del": true, "delete": true, "set": true, "change": true,
+	"replace": true, "flush": true, "append": true,
+}
+
+// IsIPWrite reports whether the arguments of `ip`, as in
+// ip [options] <object> <action> ..., change interfaces, addresses or routes.
+// The rollback safety net uses it too, so both agree on what `ip` changes.
+func IsIPWrite(args []string) bool {
+	for i, a := range args {
+		if strings.HasPrefix(a, "-") {
+			continue
+		}
+		return i+1 < len(args) && ipWriteOps[args[i+1]]
+	}
+	return false
+}
+
+// IsWrite reports whether argv may change configuration or system state.
+// Commands it does not recognize are treated as read-only.
+func IsWrite(argv []string) bool {
+	if len(argv) == 0 {
+		return false
+	}
+	argv = plan.InitArgv(argv)
+	name := path.Base(argv[0])
+	args := argv[1:]
+	if writeCommands[name] {
+		return true
+	}
+	switch {
+	case strings.HasPrefix(argv[0], "/etc/init.d/"):
+		return len(args) > 0 && serviceActions[args[0]]
+	case name == "service":
+		return len(args) > 1 && serviceActions[args[1]]
+	case name == "uci":
+		for _, a := range args {
+			if !strings.HasPrefix(a, "-") {
+				return uciWriteOps[a]
+			}
+		}
+	case name == "wifi" || name == "fw4" || name == "fw3":
+		return restartedService(argv) != ""
+	case name == "opkg" || name == "apk":
+		for _, a := range args {
+			switch a {
+			case "install", "remove", "upgrade", "update", "add", "del", "fix":
+				return true
+			}
+		}
+	case name == "sed":
+		for _, a := range args {
+			if strings.HasPrefix(a, "-i") || strings.HasPrefix(a, "--in-place") {
+				return true
+			}
+		}
+	case name == "ip":
+		return IsIPWrite(args)
+	case name == "ubus":
+		return len(args) >= 3 && args[0] == "call" && !readOnlyMethod(args[2])
+	case name == "date":
+		for _, a := range args {
+			if a == "-s" || strings.HasPrefix(a, "--set") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readOnlyMethod reports whether a ubus method name only queries state.
+func readOnlyMethod(m string) bool {
+	switch m {
+	case "status", "dump", "list", "info", "board", "get", "state", "devices", "assoclist", "scan":
+		return true
+	}
+	return strings.HasPrefix(m, "get")
+}
@@ -0,0 +1,96 @@
+package impact
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestEstimate(t *testing.T) {
+	cfg := config.Config{TimeoutSeconds: 20}
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"uci", "show", "network"}},
+		{Command: []string{"uci", "set", "network.lan.ipaddr=192.168.2.1"}},
+		{Command: []string{"uci", "commit", "network"}},
+		{Command: []string{"/etc/init.d/network", "restart"}},
+		{Command: []string{"fw4", "reload"}},
+		{Command: []string{plan.ServiceRestart, "dnsmasq"}},
+		{Command: []string{"logread"}, Pipe: [][]string{{"tee", "/tmp/log"}}},
+		{Command: []string{"sleep", "600"}, Background: true},
+	}}
+	e := Estimate(cfg, p, 1500)
+
+	want := &plan.Estimate{
+		Commands:          8,
+		WriteCommands:     6,
+		Services:          []string{"dnsmasq", "firewall", "network"},
+		DowntimeSeconds:   38,
+		TokensUsed:        1500,
+		TimeBudgetSeconds: 140,
+	}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("Estimate = %+v, want %+v", e, want)
+	}
+
+	p.Commands = append(p.Commands, plan.PlannedCommand{Command: []string{"reboot"}})
+	e = Estimate(cfg, p, 0)
+	if !e.Reboot || e.DowntimeSeconds != rebootSeconds {
+		t.Errorf("reboot not accounted for: %+v", e)
+	}
+}
+
+func TestIsWrite(t *testing.T) {
+	cases := []struct {
+		argv []string
+		want bool
+	}{
+		{[]string{"uci", "-q", "get", "system.@system[0].hostname"}, false},
+		{[]string{"uci", "-q", "delete", "firewall.rule1"}, true},
+		{[]string{"/etc/init.d/dnsmasq", "status"}, false},
+		{[]string{"/etc/init.d/dnsmasq", "enable"}, true},
+		{[]string{"service", "uhttpd", "restart"}, true},
+		{[]string{plan.ServiceStatus, "uhttpd"}, false},
+		{[]string{plan.ServiceList}, false},
+		{[]string{plan.ServiceDisable, "uhttpd"}, true},
+		{[]string{"wifi", "status"}, false},
+		{[]string{"wifi"}, true},
+		{[]string{"opkg", "list-installed"}, false},
+		{[]string{"opkg", "install", "tcpdump"}, true},
+		{[]string{"ip", "route", "show"}, false},
+		{[]string{"ip", "-4", "route", "add", "default", "via", "10.0.0.1"}, true},
+		{[]string{"ubus", "call", "system", "board"}, false},
+		{[]string{"ubus", "call", "network.interface.wan", "down"}, true},
+		{[]string{"sed", "-i", "s/a/b/", "/etc/rc.local"}, true},
+		{[]string{"sed", "-n", "1p", "/etc/rc.local"}, false},
+		{[]string{"rm", "/tmp/x"}, true},
+		{[]string{"cat", "/etc/config/network"}, false},
+	}
+	for _, c := range cases {
+		if got := IsWrite(c.argv); got != c.want {
+			t.Errorf("IsWrite(%v) = %v, want %v", c.argv, got, c.want)
+		}
+	}
+}
+
+func TestRisk(t *testing.T) {
+	cases := []struct {
+		c    plan.PlannedCommand
+		want string
+	}{
+		{plan.PlannedCommand{Command: []string{"uci", "show", "network"}}, RiskRead},
+		{plan.PlannedCommand{Command: []string{"uci", "set", "network.lan.ipaddr=10.0.0.1"}}, RiskWrite},
+		{plan.PlannedCommand{Command: []string{"/etc/init.d/network", "restart"}}, RiskService},
+		{plan.PlannedCommand{Command: []string{plan.ServiceReload, "dnsmasq"}}, RiskService},
+		{plan.PlannedCommand{Command: []string{plan.ServiceEnable, "dnsmasq"}}, RiskWrite},
+		{plan.PlannedCommand{Command: []string{"logread"}, Pipe: [][]string{{"tee", "/tmp/log"}}}, RiskWrite},
+		{plan.PlannedCommand{Command: []string{"uci", "commit"}, Pipe: [][]string{{"wifi", "reload"}}}, RiskService},
+		{plan.PlannedCommand{Command: []string{"reboot"}}, RiskReboot},
+	}
+	for _, c := range cases {
+		if got := Risk(c.c); got != c.want {
+			t.Errorf("Risk(%v) = %s, want %s", c.c.Stages(), got, c.want)
+		}
+	}
+}
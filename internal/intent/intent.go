@@ -0,0 +1,82 @@
+// Package intent classifies requests so the planner can size plans to the
+// task: diagnostics legitimately need many read-only commands, while
+// configuration changes should stay small and reviewable.
+package intent
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+// Intent is the broad category of a request.
+type Intent string
+
+const (
+	General Intent = "general" // Could not tell; the plain max_commands cap applies
+	Read    Intent = "read"    // Diagnostics and status questions
+	Write   Intent = "write"   // Requests that change configuration or state
+)
+
+// writeWords mark a request that changes something. They win over readWords
+// so "check the wan and fix it" gets the smaller write budget.
+var writeWords = map[string]bool{
+	"set": true, "change": true, "enable": true, "disable": true, "configure": true,
+	"add": true, "remove": true, "delete": true, "install": true, "uninstall": true,
+	"update": true, "upgrade": true, "restart": true, "reboot": true, "reload": true,
+	"block": true, "unblock": true, "allow": true, "deny": true, "open": true, "close": true,
+	"forward": true, "rename": true, "create": true, "apply": true, "fix": true,
+	"reset": true, "start": true, "stop": true, "turn": true, "switch": true,
+	"assign": true, "limit": true, "flush": true, "kill": true, "commit": true,
+	"replace": true, "move": true, "edit": true, "modify": true, "repair": true,
+}
+
+// readWords mark diagnostics and questions.
+var readWords = map[string]bool{
+	"show": true, "list": true, "what": true, "which": true, "check": true,
+	"status": true, "diagnose": true, "troubleshoot": true, "why": true, "display": true,
+	"get": true, "find": true, "view": true, "monitor": true, "inspect": true,
+	"test": true, "ping": true, "trace": true, "traceroute": true, "scan": true,
+	"log": true, "logs": true, "debug": true, "how": true, "is": true, "are": true,
+	"who": true, "where": true, "report": true, "analyze": true, "audit": true,
+	"count": true, "measure": true, "explain": true, "investigate": true,
+}
+
+// Classify picks the intent of prompt from its keywords.
+func Classify(prompt string) Intent {
+	words := strings.FieldsFunc(strings.ToLower(prompt), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	read := false
+	for _, w := range words {
+		if writeWords[w] {
+			return Write
+		}
+		if readWords[w] {
+			read = true
+		}
+	}
+	if read {
+		return Read
+	}
+	return General
+}
+
+// Limit returns the command cap for a request of kind in. Categories without
+// a configured limit fall back to MaxCommands.
+func Limit(cfg config.Config, in Intent) int {
+	switch {
+	case in == Read && cfg.MaxReadCommands > 0:
+		return cfg.MaxReadCommands
+	case in == Write && cfg.MaxWriteCommands > 0:
+		return cfg.MaxWriteCommands
+	}
+	return cfg.MaxCommands
+}
+
+// ForPrompt classifies prompt and returns its intent and command cap.
+func ForPrompt(cfg config.Config, prompt string) (Intent, int) {
+	in := Classify(prompt)
+	return in, Limit(cfg, in)
+}
@@ -0,0 +1,49 @@
+package intent
+
+import (
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		prompt string
+		want   Intent
+	}{
+		{"what is my ip", Read},
+		{"Show WiFi status", Read},
+		{"why is the internet slow?", Read},
+		{"diagnose dns resolution", Read},
+		{"set the lan ip to 10.0.0.1", Write},
+		{"Restart the firewall", Write},
+		{"check the wan link and fix it", Write},
+		{"install tcpdump", Write},
+		{"hello", General},
+		{"", General},
+		{"settings", General}, // whole words only
+	}
+	for _, c := range cases {
+		if got := Classify(c.prompt); got != c.want {
+			t.Errorf("Classify(%q) = %s, want %s", c.prompt, got, c.want)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	cfg := config.Config{MaxCommands: 10, MaxReadCommands: 20, MaxWriteCommands: 5}
+	if got := Limit(cfg, Read); got != 20 {
+		t.Errorf("read limit = %d", got)
+	}
+	if got := Limit(cfg, Write); got != 5 {
+		t.Errorf("write limit = %d", got)
+	}
+	if got := Limit(cfg, General); got != 10 {
+		t.Errorf("general limit = %d", got)
+	}
+
+	cfg.MaxReadCommands = 0
+	if in, got := ForPrompt(cfg, "list interfaces"); in != Read || got != 10 {
+		t.Errorf("unset read limit should fall back to max_commands: %s %d", in, got)
+	}
+}
@@ -0,0 +1,346 @@
+// Package jobs manages long-running commands (packet captures, speed tests)
+// that the executor starts in the background. Each job's record is kept in
+// the storage backend as <id>.json and its spooled output in the directory
+// <id>, so jobs started by one CLI invocation can be listed, tailed and
+// stopped by the next.
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/storage"
+)
+
+// DefaultDir is used when no jobs directory is configured (tmpfs on OpenWrt).
+const DefaultDir = "/tmp/lucicodex-jobs"
+
+// Job states reported by List and Get.
+const (
+	StateRunning = "running"
+	StateExited  = "exited"
+	StateStopped = "stopped"
+)
+
+// ErrNotFound is returned for unknown job IDs.
+var ErrNotFound = errors.New("job not found")
+
+// Job is the persisted description of a background command.
+type Job struct {
+	ID       string     `json:"id"`
+	Command  []string   `json:"command"`
+	PID      int        `json:"pid"`
+	Started  time.Time  `json:"started"`
+	Ended    *time.Time `json:"ended,omitempty"`
+	ExitCode *int       `json:"exit_code,omitempty"` // Known only when the starting process reaped it
+	Stopped  bool       `json:"stopped,omitempty"`
+	State    string     `json:"state"`
+}
+
+// Manager starts and tracks jobs under Dir.
+type Manager struct {
+	Dir string
+	st  storage.Store
+	mu  sync.Mutex
+}
+
+var (
+	managersMu sync.Mutex
+	managers   = map[string]*Manager{}
+)
+
+// Open returns the process-wide Manager for cfg.JobsDir, keeping job
+// records on the configured storage backend, so the executor, REPL and
+// server serialize their updates to the same job records.
+func Open(cfg config.Config) *Manager {
+	dir := cfg.JobsDir
+	if dir == "" {
+		dir = DefaultDir
+	}
+	managersMu.Lock()
+	defer managersMu.Unlock()
+	if m, ok := managers[dir]; ok {
+		return m
+	}
+	m := &Manager{Dir: dir, st: storage.Open(cfg, dir)}
+	managers[dir] = m
+	return m
+}
+
+// NewManager returns a Manager keeping job records as files in dir.
+func NewManager(dir string) *Manager {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Manager{Dir: dir, st: storage.NewFileStore(dir)}
+}
+
+func (m *Manager) jobDir(id string) string { return filepath.Join(m.Dir, id) }
+
+// OutputPath returns the file that receives the job's stdout and stderr.
+func (m *Manager) OutputPath(id string) string {
+	return filepath.Join(m.jobDir(id), "output.log")
+}
+
+func newID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Start launches argv detached in its own session with output spooled to a
+// file. env, if non-nil, replaces the process environment. The job keeps
+// running after the calling process exits.
+func (m *Manager) Start(argv []string, env []string) (Job, error) {
+	if len(argv) == 0 {
+		return Job{}, errors.New("empty command")
+	}
+	id := newID()
+	if err := os.MkdirAll(m.jobDir(id), 0o700); err != nil {
+		return Job{}, err
+	}
+	out, err := os.OpenFile(m.OutputPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return Job{}, err
+	}
+	defer out.Close()
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = env
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(m.jobDir(id))
+		return Job{}, err
+	}
+
+	j := Job{ID: id, Command: argv, PID: cmd.Process.Pid, Started: time.Now(), State: StateRunning}
+	if err := m.save(j); err != nil {
+		return j, err
+	}
+
+	// Reap the process while we are alive so its exit code is recorded. If we
+	// exit first the job is reparented to init and its exit code is lost.
+	go func() {
+		err := cmd.Wait()
+		code := 0
+		if err != nil {
+			code = -1
+			var ee *exec.ExitError
+			if errors.As(err, &ee) {
+				code = ee.ExitCode()
+			}
+		}
+		m.update(id, func(cur *Job) {
+			now := time.Now()
+			cur.Ended = &now
+			cur.ExitCode = &code
+		})
+	}()
+	return j, nil
+}
+
+func recordKey(id string) string { return id + ".json" }
+
+func (m *Manager) save(j Job) error {
+	return m.st.Put("", recordKey(j.ID), j)
+}
+
+func (m *Manager) load(id string) (Job, error) {
+	var j Job
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return j, ErrNotFound
+	}
+	if err := m.st.Get("", recordKey(id), &j); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return j, ErrNotFound
+		}
+		return j, err
+	}
+	j.State = state(j)
+	return j, nil
+}
+
+// update applies fn to the job's record under the storage lock, which also
+// excludes other processes updating it.
+func (m *Manager) update(id string, fn func(*Job)) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var j Job
+	err := m.st.Update("", recordKey(id), &j, func() error {
+		if j.ID != id {
+			return ErrNotFound
+		}
+		fn(&j)
+		return nil
+	})
+	j.State = state(j)
+	return j, err
+}
+
+// state derives the current state from the record and the process table.
+func state(j Job) string {
+	switch {
+	case j.Stopped:
+		return StateStopped
+	case j.Ended != nil:
+		return StateExited
+	case processAlive(j.PID):
+		return StateRunning
+	default:
+		return StateExited
+	}
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	// A zombie still exists but has finished
+	if !processExists(pid) {
+		return false
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// Format: pid (comm) state ...; comm may contain spaces
+	if i := strings.LastIndexByte(string(data), ')'); i >= 0 && i+2 < len(data) {
+		return data[i+2] != 'Z'
+	}
+	return true
+}
+
+// Get returns a single job.
+func (m *Manager) Get(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.load(id)
+}
+
+// List returns all known jobs, newest first.
+func (m *Manager) List() ([]Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, err := m.st.List("")
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(keys))
+	for _, key := range keys {
+		id, ok := strings.CutSuffix(key, ".json")
+		if !ok {
+			continue
+		}
+		if j, err := m.load(id); err == nil {
+			jobs = append(jobs, j)
+		}
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].Started.After(jobs[k].Started) })
+	return jobs, nil
+}
+
+// maxTailBytes bounds how much of a spool file Tail reads.
+const maxTailBytes = 64 * 1024
+
+// Tail returns the last n lines of the job's output (all buffered lines if n <= 0).
+func (m *Manager) Tail(id string, n int) (string, error) {
+	if _, err := m.Get(id); err != nil {
+		return "", err
+	}
+	f, err := os.Open(m.OutputPath(id))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := st.Size() - maxTailBytes
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, offset, st.Size()-offset))
+	if err != nil {
+		return "", err
+	}
+	text := string(data)
+	if offset > 0 {
+		// Drop the partial first line
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = text[i+1:]
+		}
+	}
+	if n > 0 {
+		lines := strings.SplitAfter(strings.TrimSuffix(text, "\n"), "\n")
+		if len(lines) > n {
+			lines = lines[len(lines)-n:]
+		}
+		text = strings.Join(lines, "")
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+	}
+	return text, nil
+}
+
+// stopGrace is how long Stop waits after SIGTERM before sending SIGKILL.
+var stopGrace = 3 * time.Second
+
+// Stop terminates the job's process group.
+func (m *Manager) Stop(id string) (Job, error) {
+	j, err := m.Get(id)
+	if err != nil {
+		return j, err
+	}
+	if j.State != StateRunning {
+		return j, fmt.Errorf("job %s is not running (%s)", id, j.State)
+	}
+	_ = signalGroup(j.PID, false)
+	deadline := time.Now().Add(stopGrace)
+	for processAlive(j.PID) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if processAlive(j.PID) {
+		_ = signalGroup(j.PID, true)
+	}
+
+	return m.update(id, func(cur *Job) {
+		cur.Stopped = true
+		if cur.Ended == nil {
+			now := time.Now()
+			cur.Ended = &now
+		}
+	})
+}
+
+// PrintTable renders jobs as the table shown by `lucicodex jobs` and the REPL.
+func PrintTable(w io.Writer, list []Job) {
+	if len(list) == 0 {
+		fmt.Fprintln(w, "No background jobs")
+		return
+	}
+	fmt.Fprintf(w, "%-10s %-8s %8s %-20s %s\n", "ID", "STATE", "PID", "STARTED", "COMMAND")
+	for _, j := range list {
+		state := j.State
+		if j.State == StateExited && j.ExitCode != nil {
+			state = fmt.Sprintf("exit %d", *j.ExitCode)
+		}
+		fmt.Fprintf(w, "%-10s %-8s %8d %-20s %s\n", j.ID, state, j.PID, j.Started.Format(time.DateTime), strings.Join(j.Command, " "))
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !unix
+
+package jobs
+
+import (
+	"os"
+	"os/exec"
+)
+
+// detach is only implemented on Unix (sessions); jobs elsewhere run in the
+// process group of the caller.
+func detach(cmd *exec.Cmd) {}
+
+func processExists(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
+
+// signalGroup kills the job's process; without process groups, what it
+// started keeps running and there is no graceful SIGTERM.
+func signalGroup(pid int, kill bool) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
@@ -0,0 +1,107 @@
+package jobs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/testutil"
+)
+
+func waitState(t *testing.T, m *Manager, id, want string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j, err := m.Get(id)
+		testutil.AssertNoError(t, err)
+		// A finished job is also waited on until it is reaped, after which
+		// its record is no longer written
+		if j.State == want && (want == StateRunning || j.ExitCode != nil) {
+			return j
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s stayed %s, want %s", id, j.State, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestManager_StartAndTail(t *testing.T) {
+	m := NewManager(t.TempDir())
+	j, err := m.Start([]string{"sh", "-c", "echo one; echo two; echo three >&2; exit 3"}, nil)
+	testutil.AssertNoError(t, err)
+	testutil.AssertTrue(t, j.PID > 0)
+
+	j = waitState(t, m, j.ID, StateExited)
+	// The exit code is recorded by the reaper once Wait returns
+	for i := 0; i < 250 && j.ExitCode == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		j, _ = m.Get(j.ID)
+	}
+	if j.ExitCode == nil || *j.ExitCode != 3 {
+		t.Errorf("expected exit code 3, got %v", j.ExitCode)
+	}
+
+	out, err := m.Tail(j.ID, 2)
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, out, "two\nthree\n")
+
+	out, err = m.Tail(j.ID, 0)
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, out, "one\ntwo\nthree\n")
+}
+
+func TestManager_ListAndStop(t *testing.T) {
+	m := NewManager(t.TempDir())
+	j, err := m.Start([]string{"sleep", "30"}, nil)
+	testutil.AssertNoError(t, err)
+
+	list, err := m.List()
+	testutil.AssertNoError(t, err)
+	if len(list) != 1 || list[0].ID != j.ID || list[0].State != StateRunning {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+
+	stopped, err := m.Stop(j.ID)
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, stopped.State, StateStopped)
+	waitState(t, m, j.ID, StateStopped)
+
+	if _, err := m.Stop(j.ID); err == nil {
+		t.Error("expected error stopping a stopped job")
+	}
+}
+
+func TestManager_Unknown(t *testing.T) {
+	m := NewManager(t.TempDir())
+	for _, id := range []string{"nope", "../etc", ""} {
+		if _, err := m.Tail(id, 1); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Tail(%q): expected ErrNotFound, got %v", id, err)
+		}
+	}
+	list, err := NewManager(t.TempDir() + "/missing").List()
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, len(list), 0)
+}
+
+func TestManager_TailLargeOutput(t *testing.T) {
+	m := NewManager(t.TempDir())
+	j, err := m.Start([]string{"true"}, nil)
+	testutil.AssertNoError(t, err)
+	waitState(t, m, j.ID, StateExited)
+
+	var b strings.Builder
+	for b.Len() < 2*maxTailBytes {
+		b.WriteString("0123456789012345678901234567890123456789\n")
+	}
+	b.WriteString("last\n")
+	testutil.AssertNoError(t, os.WriteFile(m.OutputPath(j.ID), []byte(b.String()), 0o600))
+
+	out, err := m.Tail(j.ID, 0)
+	testutil.AssertNoError(t, err)
+	testutil.AssertTrue(t, len(out) <= maxTailBytes)
+	testutil.AssertTrue(t, strings.HasSuffix(out, "last\n"))
+	testutil.AssertTrue(t, strings.HasPrefix(out, "0123"))
+}
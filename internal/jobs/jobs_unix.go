@@ -0,0 +1,30 @@
+//go:build unix
+
+package jobs
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detach starts cmd in a new session: no controlling terminal, and the
+// job's process group can be signalled as a whole by Stop.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// processExists sends signal 0, which checks that pid exists.
+func processExists(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+// signalGroup sends SIGTERM, or SIGKILL if kill is set, to the process
+// group of the job whose session leader is pid.
+func signalGroup(pid int, kill bool) error {
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+	// Negative PID signals the whole process group created by Setsid
+	return syscall.Kill(-pid, sig)
+}
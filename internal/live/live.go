@@ -0,0 +1,118 @@
+// Package live publishes the command an execution is running and its output
+// so far, for `lucicodex top` in another process. Executions hold the
+// execution lock (see execlock), so there is one feed: the executor
+// rewrites the file at Path as each command starts, prints output and
+// finishes. The feed is best effort; failures to write it are ignored.
+package live
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Path is the feed file (tmpfs on OpenWrt). Tests override it.
+var Path = "/tmp/lucicodex-live.json"
+
+// OutputLimit is how much of the end of a command's output the feed keeps.
+const OutputLimit = 4096
+
+// flushInterval limits how often output rewrites the feed.
+const flushInterval = 250 * time.Millisecond
+
+// Status is the command an execution runs or ran last.
+type Status struct {
+	PID      int       `json:"pid"`   // Of the executing process
+	Index    int       `json:"index"` // Of the command in its plan, from 0
+	Command  string    `json:"command"`
+	Started  time.Time `json:"started"`
+	Output   string    `json:"output"`  // The last OutputLimit bytes
+	Running  bool      `json:"running"` // Unset once the command finished
+	Failed   bool      `json:"failed,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// Feed publishes one command. Its methods may be called concurrently.
+type Feed struct {
+	mu      sync.Mutex
+	st      Status
+	flushed time.Time
+}
+
+// Start publishes that the command at index, formatted as command, started.
+func Start(index int, command string) *Feed {
+	f := &Feed{st: Status{PID: os.Getpid(), Index: index, Command: command, Started: time.Now(), Running: true}}
+	f.mu.Lock()
+	f.flush()
+	f.mu.Unlock()
+	return f
+}
+
+// Write adds output of the command, publishing it at most every
+// flushInterval. It never fails, so it can be used in an io.MultiWriter.
+func (f *Feed) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.st.Output = tail(f.st.Output + string(p))
+	if time.Since(f.flushed) >= flushInterval {
+		f.flush()
+	}
+	return len(p), nil
+}
+
+// Finish publishes that the command finished. output replaces what was
+// written if it is not empty, for commands whose output is only known at
+// the end.
+func (f *Feed) Finish(output string, failed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if output != "" {
+		f.st.Output = tail(output)
+	}
+	f.st.Running, f.st.Failed, f.st.Finished = false, failed, time.Now()
+	f.flush()
+}
+
+// tail returns the last OutputLimit bytes of s.
+func tail(s string) string {
+	if len(s) <= OutputLimit {
+		return s
+	}
+	return s[len(s)-OutputLimit:]
+}
+
+// flush replaces the feed file with the status. f.mu must be held.
+func (f *Feed) flush() {
+	f.flushed = time.Now()
+	data, err := json.Marshal(f.st)
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(Path), ".live-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		return
+	}
+	os.Rename(tmp.Name(), Path)
+}
+
+// Read returns the last published status. It may belong to an execution
+// that has ended; compare PID with the holder of the execution lock.
+func Read() (Status, error) {
+	var st Status
+	data, err := os.ReadFile(Path)
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
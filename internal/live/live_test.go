@@ -0,0 +1,42 @@
+package live
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFeed(t *testing.T) {
+	orig := Path
+	Path = filepath.Join(t.TempDir(), "live.json")
+	defer func() { Path = orig }()
+
+	if _, err := Read(); !os.IsNotExist(err) {
+		t.Fatalf("expected no feed, got %v", err)
+	}
+	f := Start(2, "logread -f")
+	st, err := Read()
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if st.PID != os.Getpid() || st.Index != 2 || st.Command != "logread -f" || !st.Running {
+		t.Errorf("unexpected status after Start: %+v", st)
+	}
+
+	f.Write([]byte(strings.Repeat("x", OutputLimit)))
+	f.Write([]byte("last line\n"))
+	f.Finish("", true)
+	st, _ = Read()
+	if st.Running || !st.Failed || st.Finished.IsZero() {
+		t.Errorf("unexpected status after Finish: %+v", st)
+	}
+	if len(st.Output) != OutputLimit || !strings.HasSuffix(st.Output, "last line\n") {
+		t.Errorf("expected the last %d bytes of output, got %d ending %q", OutputLimit, len(st.Output), st.Output[len(st.Output)-12:])
+	}
+
+	Start(3, "uptime").Finish("up 3 days\n", false)
+	if st, _ = Read(); st.Output != "up 3 days\n" || st.Failed {
+		t.Errorf("expected the final output, got %+v", st)
+	}
+}
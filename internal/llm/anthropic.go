@@ -1,10 +1,7 @@
 package llm
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -12,12 +9,16 @@ import (
 
 	"github.com/aezizhu/LuciCodex/internal/config"
 	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
 	"github.com/aezizhu/LuciCodex/internal/plan"
 )
 
 type AnthropicClient struct {
+	tokenCounter
 	httpClient *http.Client
 	cfg        config.Config
+	oauth      bool // authorized by a stored OAuth token instead of the API key
+	store      *metrics.RollupStore
 }
 
 func NewAnthropicClient(cfg config.Config) *AnthropicClient {
@@ -26,7 +27,9 @@ func NewAnthropicClient(cfg config.Config) *AnthropicClient {
 	if timeout < 60*time.Second {
 		timeout = 60 * time.Second
 	}
-	return &AnthropicClient{httpClient: newHTTPClient(cfg, timeout), cfg: cfg}
+	c := &AnthropicClient{httpClient: withRetries(cfg, "anthropic", newHTTPClient(cfg, timeout)), cfg: cfg, store: metrics.OpenRollupStore(cfg)}
+	c.oauth = useOAuth(cfg, "anthropic", c.httpClient)
+	return c
 }
 
 type anthropicMessage struct {
@@ -35,21 +38,119 @@ type anthropicMessage struct {
 }
 
 type anthropicReq struct {
-	Model     string             `json:"model"`
-	Messages  []anthropicMessage `json:"messages"`
-	MaxTokens int                `json:"max_tokens"`
+	Model       string             `json:"model"`
+	System      []anthropicBlock   `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	TopP        *float64           `json:"top_p,omitempty"`
+	Thinking    *anthropicThinking `json:"thinking,omitempty"`
+}
+
+// anthropicBlock is a text block of the system prompt. A block with
+// CacheControl ends a prefix the API caches for later requests.
+type anthropicBlock struct {
+	Type         string                 `json:"type"`
+	Text         string                 `json:"text"`
+	CacheControl *anthropicCacheControl `json:"cache_control,omitempty"`
+}
+
+type anthropicCacheControl struct {
+	Type string `json:"type"`
+}
+
+type anthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+// minThinkingBudget is the smallest budget the Messages API accepts.
+const minThinkingBudget = 1024
+
+// newRequest builds a messages request with the configured generation
+// parameters applied. defaultMaxTokens is used when max_output_tokens is unset.
+// The instructions and environment facts of a plan prompt are sent as system
+// blocks marked for caching, so repeated requests reuse them; the rest of the
+// prompt is the user message.
+func (c *AnthropicClient) newRequest(model, prompt string, defaultMaxTokens int) anthropicReq {
+	sections := prompts.Split(prompt)
+	body := anthropicReq{
+		Model:       model,
+		Messages:    []anthropicMessage{{Role: "user", Content: sections.Request}},
+		MaxTokens:   defaultMaxTokens,
+		Temperature: c.cfg.Temperature,
+		TopP:        c.cfg.TopP,
+	}
+	for _, text := range []string{sections.Instructions, sections.Facts} {
+		if text != "" {
+			body.System = append(body.System, anthropicBlock{Type: "text", Text: text, CacheControl: &anthropicCacheControl{Type: "ephemeral"}})
+		}
+	}
+	if c.cfg.MaxOutputTokens > 0 {
+		body.MaxTokens = c.cfg.MaxOutputTokens
+	}
+	if c.cfg.ThinkingBudget > 0 {
+		budget := c.cfg.ThinkingBudget
+		if budget < minThinkingBudget {
+			budget = minThinkingBudget
+		}
+		body.Thinking = &anthropicThinking{Type: "enabled", BudgetTokens: budget}
+		// Thinking is incompatible with sampling overrides, and the budget
+		// counts against max_tokens, so leave room for the answer
+		body.Temperature, body.TopP = nil, nil
+		if body.MaxTokens <= budget {
+			body.MaxTokens = budget + defaultMaxTokens
+		}
+	}
+	return body
 }
 
 type anthropicResp struct {
 	Content []struct {
+		Type string `json:"type"`
 		Text string `json:"text"`
 	} `json:"content"`
+	Usage struct {
+		InputTokens              int `json:"input_tokens"`
+		OutputTokens             int `json:"output_tokens"`
+		CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+		CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	} `json:"usage"`
+}
+
+// recordUsage counts the tokens of r and records its prompt caching in the
+// metrics rollups. The API reports cached tokens apart from input_tokens.
+func (c *AnthropicClient) recordUsage(r anthropicResp) {
+	u := r.Usage
+	input := u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+	c.addTokens(input + u.OutputTokens)
+	_ = c.store.RecordCache("anthropic", metrics.CacheUsage{
+		InputTokens:      input,
+		CacheReadTokens:  u.CacheReadInputTokens,
+		CacheWriteTokens: u.CacheCreationInputTokens,
+	})
+}
+
+// text returns the first text block, skipping thinking blocks.
+func (r anthropicResp) text() string {
+	for _, c := range r.Content {
+		if c.Type == "" || c.Type == "text" {
+			return c.Text
+		}
+	}
+	return ""
 }
 
+// GeneratePlan asks the model for a plan, and once more if its response
+// does not match the plan schema (see repairPlan).
 func (c *AnthropicClient) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	return repairPlan(ctx, prompt, c.generatePlan)
+}
+
+func (c *AnthropicClient) generatePlan(ctx context.Context, prompt string) (plan.Plan, error) {
 	var zero plan.Plan
-	if c.cfg.AnthropicAPIKey == "" {
-		return zero, errors.New("missing Anthropic API key - configure it in LuCI or set ANTHROPIC_API_KEY environment variable")
+	if c.cfg.AnthropicAPIKey == "" && !c.oauth {
+		return zero, NewAPIError("anthropic", 0, "missing Anthropic API key - configure it in LuCI or set ANTHROPIC_API_KEY environment variable", ErrNoAPIKey)
 	}
 	model := c.cfg.Model
 	if model == "" {
@@ -63,37 +164,47 @@ func (c *AnthropicClient) GeneratePlan(ctx context.Context, prompt string) (plan
 	// Ensure endpoint ends properly for messages
 	url := strings.TrimSuffix(endpoint, "/") + "/messages"
 
-	body := anthropicReq{Model: model, MaxTokens: 2048}
-	body.Messages = []anthropicMessage{{Role: "user", Content: prompt}}
-	b, err := json.Marshal(body)
+	body := c.newRequest(model, prompt, 2048)
+	b, release, err := encodeRequest(body)
 	if err != nil {
 		return zero, fmt.Errorf("marshal request: %w", err)
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	defer release()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, b)
 	if err != nil {
 		return zero, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", c.cfg.AnthropicAPIKey)
+	if !c.oauth {
+		req.Header.Set("x-api-key", c.cfg.AnthropicAPIKey)
+	}
 	req.Header.Set("anthropic-version", "2023-06-01")
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return zero, err
+		if ctx.Err() != nil {
+			return zero, NewAPIError("anthropic", 0, "request cancelled", ErrContextCancelled)
+		}
+		return zero, NewAPIError("anthropic", 0, "request failed", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		data := readErrorBody(resp.Body)
-		return zero, fmt.Errorf("anthropic http %d: %s", resp.StatusCode, string(data))
+		return zero, NewAPIError("anthropic", resp.StatusCode, string(data), ErrRequestFailed)
 	}
 	var ar anthropicResp
-	if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
-		return zero, err
+	if err := decodeResponse(resp.Body, &ar); err != nil {
+		return zero, NewParseError("anthropic", "response decoding", "", err)
 	}
+	c.recordUsage(ar)
 	if len(ar.Content) == 0 {
-		return zero, errors.New("empty response")
+		return zero, NewAPIError("anthropic", 0, "empty response from API", ErrInvalidResponse)
+	}
+	text := ar.text()
+	p, err := plan.TryUnmarshalPlan(text)
+	if err != nil {
+		return zero, NewParseError("anthropic", "plan extraction", text, err)
 	}
-	text := ar.Content[0].Text
-	return plan.TryUnmarshalPlan(text)
+	return p, nil
 }
 
 func (c *AnthropicClient) GenerateErrorFix(ctx context.Context, originalCommand string, errorOutput string, attempt int) (plan.Plan, error) {
@@ -103,8 +214,8 @@ func (c *AnthropicClient) GenerateErrorFix(ctx context.Context, originalCommand
 
 // Summarize returns summary/details using Anthropic messages API.
 func (c *AnthropicClient) Summarize(ctx context.Context, prompt string) (string, []string, error) {
-	if c.cfg.AnthropicAPIKey == "" {
-		return "", nil, errors.New("missing Anthropic API key - configure it in LuCI or set ANTHROPIC_API_KEY environment variable")
+	if c.cfg.AnthropicAPIKey == "" && !c.oauth {
+		return "", nil, NewAPIError("anthropic", 0, "missing Anthropic API key - configure it in LuCI or set ANTHROPIC_API_KEY environment variable", ErrNoAPIKey)
 	}
 	model := c.cfg.Model
 	if model == "" {
@@ -116,36 +227,42 @@ func (c *AnthropicClient) Summarize(ctx context.Context, prompt string) (string,
 	}
 	url := strings.TrimSuffix(endpoint, "/") + "/messages"
 
-	body := anthropicReq{Model: model, MaxTokens: 1024}
-	body.Messages = []anthropicMessage{{Role: "user", Content: prompt}}
-	b, err := json.Marshal(body)
+	body := c.newRequest(model, prompt, 1024)
+	b, release, err := encodeRequest(body)
 	if err != nil {
 		return "", nil, fmt.Errorf("marshal request: %w", err)
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	defer release()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, b)
 	if err != nil {
 		return "", nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", c.cfg.AnthropicAPIKey)
+	if !c.oauth {
+		req.Header.Set("x-api-key", c.cfg.AnthropicAPIKey)
+	}
 	req.Header.Set("anthropic-version", "2023-06-01")
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return "", nil, err
+		if ctx.Err() != nil {
+			return "", nil, NewAPIError("anthropic", 0, "request cancelled", ErrContextCancelled)
+		}
+		return "", nil, NewAPIError("anthropic", 0, "request failed", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		data := readErrorBody(resp.Body)
-		return "", nil, fmt.Errorf("anthropic http %d: %s", resp.StatusCode, string(data))
+		return "", nil, NewAPIError("anthropic", resp.StatusCode, string(data), ErrRequestFailed)
 	}
 	var ar anthropicResp
-	if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
-		return "", nil, err
+	if err := decodeResponse(resp.Body, &ar); err != nil {
+		return "", nil, NewParseError("anthropic", "response decoding", "", err)
 	}
+	c.recordUsage(ar)
 	if len(ar.Content) == 0 {
-		return "", nil, errors.New("empty response")
+		return "", nil, NewAPIError("anthropic", 0, "empty response from API", ErrInvalidResponse)
 	}
-	text := ar.Content[0].Text
+	text := ar.text()
 	summary, details := parseSummary(text)
 	return summary, details, nil
 }
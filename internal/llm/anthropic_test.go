@@ -6,14 +6,19 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/intent"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
 	"github.com/aezizhu/LuciCodex/internal/testutil"
 )
 
 func TestAnthropicClient_GeneratePlan_Success(t *testing.T) {
 	mockResponse := anthropicResp{
 		Content: []struct {
+			Type string `json:"type"`
 			Text string `json:"text"`
 		}{
 			{Text: `{"summary": "test plan", "commands": [{"command": ["echo", "hello"]}]}`},
@@ -71,13 +76,14 @@ func TestAnthropicClient_Error(t *testing.T) {
 	_, err := client.GeneratePlan(context.Background(), "test")
 
 	testutil.AssertError(t, err)
-	testutil.AssertContains(t, err.Error(), "anthropic http 401")
+	testutil.AssertContains(t, err.Error(), "anthropic API error (HTTP 401)")
 	testutil.AssertContains(t, err.Error(), "invalid key")
 }
 
 func TestAnthropicClient_GenerateErrorFix(t *testing.T) {
 	mockResponse := anthropicResp{
 		Content: []struct {
+			Type string `json:"type"`
 			Text string `json:"text"`
 		}{
 			{Text: `{"summary": "fix plan", "commands": [{"command": ["fix", "it"]}]}`},
@@ -144,3 +150,85 @@ func TestAnthropicClient_EdgeCases(t *testing.T) {
 	testutil.AssertError(t, err)
 	testutil.AssertContains(t, err.Error(), "empty response")
 }
+
+func TestAnthropicClient_GenerationParams(t *testing.T) {
+	var got map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = nil
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"content":[{"type":"thinking","thinking":"..."},{"type":"text","text":"{\"summary\":\"ok\",\"commands\":[]}"}]}`))
+	}))
+	defer server.Close()
+
+	temp := 0.3
+	cfg := config.Config{AnthropicAPIKey: "k", Endpoint: server.URL, Temperature: &temp}
+	p, err := NewAnthropicClient(cfg).GeneratePlan(context.Background(), "p")
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, p.Summary, "ok")
+	testutil.AssertEqual(t, got["temperature"], 0.3)
+	testutil.AssertEqual(t, got["max_tokens"], float64(2048))
+	if _, ok := got["thinking"]; ok {
+		t.Error("thinking sent without a budget")
+	}
+
+	// Thinking drops sampling overrides and keeps max_tokens above the budget
+	cfg.ThinkingBudget = 4096
+	_, err = NewAnthropicClient(cfg).GeneratePlan(context.Background(), "p")
+	testutil.AssertNoError(t, err)
+	if _, ok := got["temperature"]; ok {
+		t.Error("temperature must be omitted when thinking is enabled")
+	}
+	testutil.AssertEqual(t, got["max_tokens"], float64(4096+2048))
+	th, _ := got["thinking"].(map[string]interface{})
+	testutil.AssertEqual(t, th["type"], "enabled")
+	testutil.AssertEqual(t, th["budget_tokens"], float64(4096))
+}
+
+func TestAnthropicClient_PromptCaching(t *testing.T) {
+	var got anthropicReq
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = anthropicReq{}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"content":[{"type":"text","text":"{\"summary\":\"ok\",\"commands\":[]}"}],"usage":{"input_tokens":0,"output_tokens":10,"cache_creation_input_tokens":100,"cache_read_input_tokens":900}}`))
+	}))
+	defer server.Close()
+
+	cfg := config.Config{AnthropicAPIKey: "k", Endpoint: server.URL, MetricsDir: t.TempDir()}
+	c := NewAnthropicClient(cfg)
+	instructions := prompts.GeneratePlanPrompt(intent.Read, 5)
+	facts := "Environment facts (read-only; collected 2026-10-17T00:00:00Z):\n# uname -a\nLinux OpenWrt"
+	_, err := c.GeneratePlan(context.Background(), instructions+"\n\n"+facts+"\n\nUser request: show the time")
+	testutil.AssertNoError(t, err)
+
+	if len(got.System) != 2 || got.System[0].Text != instructions || got.System[1].Text != facts {
+		t.Fatalf("unexpected system blocks %+v", got.System)
+	}
+	for _, b := range got.System {
+		if b.CacheControl == nil || b.CacheControl.Type != "ephemeral" {
+			t.Errorf("expected an ephemeral cache_control on %q", b.Text)
+		}
+	}
+	if len(got.Messages) != 1 || got.Messages[0].Content != "User request: show the time" {
+		t.Errorf("expected only the request in the user message, got %+v", got.Messages)
+	}
+	testutil.AssertEqual(t, c.TokensUsed(), 1010)
+
+	rollups, err := metrics.OpenRollupStore(cfg).Days(1)
+	testutil.AssertNoError(t, err)
+	if len(rollups) != 0 {
+		t.Fatalf("expected cache usage alone not to count as a request, got %+v", rollups)
+	}
+	metrics.OpenRollupStore(cfg).Record("anthropic", 0, time.Second, nil)
+	rollups, _ = metrics.OpenRollupStore(cfg).Days(1)
+	a := metrics.Summarize(rollups).Providers["anthropic"]
+	if a.CacheHits != 1 || a.CacheReadTokens != 900 || a.CacheWriteTokens != 100 || a.CacheHitRate != 90 {
+		t.Errorf("unexpected cache summary %+v", a)
+	}
+
+	// Other prompts are sent whole
+	_, err = c.GenerateErrorFix(context.Background(), "logread", "not found", 1)
+	testutil.AssertNoError(t, err)
+	if len(got.System) != 0 || len(got.Messages) != 1 {
+		t.Errorf("expected no system blocks for an error fix, got %+v", got)
+	}
+}
@@ -0,0 +1,335 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+// Circuit states of a Breaker.
+const (
+	BreakerClosed   = "closed"    // Calls go through
+	BreakerOpen     = "open"      // Calls fail at once with ErrCircuitOpen
+	BreakerHalfOpen = "half-open" // One probe call goes through
+)
+
+// maxBreakerCooldown caps the cooldown, which doubles with every failed
+// probe.
+const maxBreakerCooldown = 10 * time.Minute
+
+// Backoff between retries of a call: retryBaseDelay, doubling up to
+// retryMaxDelay, with up to half of it added as jitter. A Retry-After
+// header of up to retryMaxDelay is honoured instead.
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 8 * time.Second
+)
+
+// Breaker is the circuit breaker of one provider. It is shared by every
+// client of the provider in the process, so plans, error fixes, summaries
+// and embeddings all stop calling a provider that keeps failing. After
+// threshold failed calls in a row it opens for the cooldown; then one probe
+// call is let through, which closes it on success and otherwise opens it
+// again for twice as long.
+type Breaker struct {
+	mu          sync.Mutex
+	provider    string
+	threshold   int
+	base        time.Duration // Cooldown after the circuit first opens
+	cooldown    time.Duration
+	state       string
+	failures    int // Failed calls in a row
+	openedAt    time.Time
+	probing     bool
+	lastError   string
+	transitions map[string]int64 // Keyed by "<from>-><to>"
+	changed     time.Time
+}
+
+// BreakerState is a snapshot of a Breaker.
+type BreakerState struct {
+	Provider    string           `json:"provider"`
+	State       string           `json:"state"`
+	Failures    int              `json:"consecutive_failures"`
+	Threshold   int              `json:"threshold"`
+	Cooldown    float64          `json:"cooldown_seconds"`
+	OpenedAt    time.Time        `json:"opened_at,omitempty"`
+	RetryAt     time.Time        `json:"retry_at,omitempty"` // When an open circuit lets a probe through
+	Changed     time.Time        `json:"changed,omitempty"`  // Last state transition
+	LastError   string           `json:"last_error,omitempty"`
+	Transitions map[string]int64 `json:"transitions"`
+}
+
+// breakers holds the Breaker of each provider.
+var breakers = struct {
+	mu sync.Mutex
+	m  map[string]*Breaker
+}{m: map[string]*Breaker{}}
+
+// BreakerFor returns the Breaker of provider, configured from cfg. It
+// returns nil if cfg disables the breaker.
+func BreakerFor(cfg config.Config, provider string) *Breaker {
+	if cfg.BreakerFailures <= 0 {
+		return nil
+	}
+	base := time.Duration(cfg.BreakerCooldown) * time.Second
+	if base <= 0 {
+		base = 30 * time.Second
+	}
+	breakers.mu.Lock()
+	defer breakers.mu.Unlock()
+	b := breakers.m[provider]
+	if b == nil {
+		b = &Breaker{provider: provider, state: BreakerClosed, cooldown: base, transitions: map[string]int64{}}
+		breakers.m[provider] = b
+	}
+	b.mu.Lock()
+	b.threshold, b.base = cfg.BreakerFailures, base
+	if b.state == BreakerClosed {
+		b.cooldown = base
+	}
+	b.mu.Unlock()
+	return b
+}
+
+// Breakers returns the state of every provider's breaker, sorted by
+// provider. Providers not called yet have none.
+func Breakers() []BreakerState {
+	breakers.mu.Lock()
+	list := make([]*Breaker, 0, len(breakers.m))
+	for _, b := range breakers.m {
+		list = append(list, b)
+	}
+	breakers.mu.Unlock()
+	out := make([]BreakerState, 0, len(list))
+	for _, b := range list {
+		out = append(out, b.State())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Provider < out[j].Provider })
+	return out
+}
+
+// State returns a snapshot of b.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerState{
+		Provider:    b.provider,
+		State:       b.state,
+		Failures:    b.failures,
+		Threshold:   b.threshold,
+		Cooldown:    b.cooldown.Seconds(),
+		Changed:     b.changed,
+		LastError:   b.lastError,
+		Transitions: make(map[string]int64, len(b.transitions)),
+	}
+	if b.state != BreakerClosed {
+		st.OpenedAt = b.openedAt
+		st.RetryAt = b.openedAt.Add(b.cooldown)
+	}
+	for t, n := range b.transitions {
+		st.Transitions[t] = n
+	}
+	return st
+}
+
+// allow reports whether a call may go through now, and otherwise returns
+// an ErrCircuitOpen error. A call allowed while half-open is the probe. A
+// nil b allows every call.
+func (b *Breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		retry := b.openedAt.Add(b.cooldown)
+		if time.Now().Before(retry) {
+			return fmt.Errorf("%w: %s failed %d times in a row (last: %s); next attempt in %s",
+				ErrCircuitOpen, b.provider, b.failures, b.lastError, time.Until(retry).Round(time.Second))
+		}
+		b.transition(BreakerHalfOpen)
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return fmt.Errorf("%w: %s is being probed after %d failures", ErrCircuitOpen, b.provider, b.failures)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// release ends a call that allow let through without counting it, as when
+// the caller cancelled it. A nil b does nothing.
+func (b *Breaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// record counts the outcome of a call that allow let through; failure is
+// nil for a successful one. A nil b does nothing.
+func (b *Breaker) record(failure error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if failure == nil {
+		b.failures = 0
+		b.cooldown = b.base
+		if b.state != BreakerClosed {
+			b.transition(BreakerClosed)
+		}
+		return
+	}
+	b.failures++
+	b.lastError = failure.Error()
+	switch {
+	case b.state == BreakerHalfOpen:
+		// The probe failed: back off further
+		b.cooldown *= 2
+		if b.cooldown > maxBreakerCooldown {
+			b.cooldown = maxBreakerCooldown
+		}
+		b.open()
+	case b.state == BreakerClosed && b.failures >= b.threshold:
+		b.open()
+	}
+}
+
+func (b *Breaker) open() {
+	b.openedAt = time.Now()
+	b.transition(BreakerOpen)
+}
+
+// transition moves b to state and counts the transition. Callers hold b.mu.
+func (b *Breaker) transition(state string) {
+	b.transitions[b.state+"->"+state]++
+	b.state = state
+	b.changed = time.Now()
+}
+
+// retryTransport retries calls failing with a network error, 429 or 5xx
+// up to retries times with exponential backoff, and guards them with a
+// provider's Breaker: a call counts as failed only once its retries are
+// used up.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	breaker *Breaker // nil disables the breaker
+}
+
+// retrySleep waits for d or until ctx is done. Tests replace it.
+var retrySleep = func(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withRetries makes client retry failed calls to provider and stop calling
+// it while its circuit is open, as configured by cfg. Replayed traffic
+// needs neither.
+func withRetries(cfg config.Config, provider string, client *http.Client) *http.Client {
+	if cfg.ReplayDir != "" || cfg.ProviderRetries <= 0 && cfg.BreakerFailures <= 0 {
+		return client
+	}
+	client.Transport = &retryTransport{base: client.Transport, retries: cfg.ProviderRetries, breaker: BreakerFor(cfg, provider)}
+	return client
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+	retries := t.retries
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		retries = 0 // The body cannot be sent again
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		failure := callFailure(resp, err)
+		if req.Context().Err() != nil {
+			// Cancelled by the caller: says nothing about the provider
+			t.breaker.release()
+			return resp, err
+		}
+		if failure == nil || attempt >= retries || errors.Is(err, ErrOffline) {
+			t.breaker.record(failure)
+			return resp, err
+		}
+		delay := backoff(attempt, resp)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if err := retrySleep(req.Context(), delay); err != nil {
+			t.breaker.release()
+			return nil, err
+		}
+		if req, err = rewind(req); err != nil {
+			t.breaker.record(failure)
+			return nil, err
+		}
+	}
+}
+
+// callFailure returns why a call failed in a way that says the provider is
+// failing: a network error or a 429 or 5xx response. Other errors, such as
+// a rejected API key, are the caller's and return nil.
+func callFailure(resp *http.Response, err error) error {
+	switch {
+	case err != nil:
+		return err
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before retry attempt+1.
+func backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			if d := time.Duration(secs) * time.Second; d <= retryMaxDelay {
+				return d
+			}
+		}
+	}
+	d := retryBaseDelay << attempt
+	if d > retryMaxDelay || d <= 0 {
+		d = retryMaxDelay
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// rewind returns a copy of req whose body can be sent again.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	r.Body = body
+	return r, nil
+}
@@ -0,0 +1,152 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// resetBreakers forgets every provider's breaker and makes retries wait
+// for nothing.
+func resetBreakers(t *testing.T) {
+	origSleep := retrySleep
+	retrySleep = func(ctx context.Context, d time.Duration) error { return ctx.Err() }
+	t.Cleanup(func() {
+		retrySleep = origSleep
+		breakers.mu.Lock()
+		breakers.m = map[string]*Breaker{}
+		breakers.mu.Unlock()
+	})
+	breakers.mu.Lock()
+	breakers.m = map[string]*Breaker{}
+	breakers.mu.Unlock()
+}
+
+func TestRetryTransport_Retries(t *testing.T) {
+	resetBreakers(t)
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"candidates":[{"content":{"parts":[{"text":"{\"summary\":\"ok\",\"commands\":[]}"}]}}]}`))
+	}))
+	defer server.Close()
+
+	cfg := config.Config{Provider: "gemini", APIKey: "k", Endpoint: server.URL, ProviderRetries: 2, BreakerFailures: 5, BreakerCooldown: 30}
+	if _, err := NewGeminiClient(cfg).GeneratePlan(context.Background(), "hi"); err != nil {
+		t.Fatalf("expected the third attempt to succeed, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+	if st := BreakerFor(cfg, "gemini").State(); st.State != BreakerClosed || st.Failures != 0 {
+		t.Errorf("unexpected breaker %+v", st)
+	}
+
+	// Client errors are not retried
+	atomic.StoreInt32(&calls, 0)
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer auth.Close()
+	cfg.Endpoint = auth.URL
+	if _, err := NewGeminiClient(cfg).GeneratePlan(context.Background(), "hi"); errcode.Of(err) != errcode.LLMAuth || calls != 1 {
+		t.Errorf("expected one call failing with LLM_AUTH, got %d calls and %v", calls, err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	resetBreakers(t)
+	var calls int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"candidates":[{"content":{"parts":[{"text":"{\"summary\":\"ok\",\"details\":[]}"}]}}]}`))
+	}))
+	defer server.Close()
+
+	cfg := config.Config{Provider: "gemini", APIKey: "k", Endpoint: server.URL, BreakerFailures: 2, BreakerCooldown: 30}
+	client := NewGeminiClient(cfg)
+	for i := 0; i < 2; i++ {
+		client.GeneratePlan(context.Background(), "hi")
+	}
+	b := BreakerFor(cfg, "gemini")
+	if st := b.State(); st.State != BreakerOpen || st.Failures != 2 || st.LastError != "HTTP 500" {
+		t.Fatalf("expected an open circuit, got %+v", st)
+	}
+
+	// Summaries share the breaker and fail without a call
+	_, _, err := NewGeminiClient(cfg).Summarize(context.Background(), "hi")
+	if !errors.Is(err, ErrCircuitOpen) || errcode.Of(err) != errcode.LLMUnavailable || calls != 2 {
+		t.Fatalf("expected the open circuit to refuse the call, got %v after %d calls", err, calls)
+	}
+
+	// After the cooldown a failed probe doubles it
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-time.Minute)
+	b.mu.Unlock()
+	client.GeneratePlan(context.Background(), "hi")
+	if st := b.State(); st.State != BreakerOpen || st.Cooldown != 60 || calls != 3 {
+		t.Fatalf("expected the failed probe to reopen the circuit for 60s, got %+v after %d calls", st, calls)
+	}
+
+	// A successful probe closes it
+	healthy.Store(true)
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+	b.mu.Unlock()
+	if _, _, err := client.Summarize(context.Background(), "hi"); err != nil {
+		t.Fatal(err)
+	}
+	st := b.State()
+	if st.State != BreakerClosed || st.Failures != 0 || st.Cooldown != 30 {
+		t.Errorf("expected a closed circuit, got %+v", st)
+	}
+	want := map[string]int64{"closed->open": 1, "open->half-open": 2, "half-open->open": 1, "half-open->closed": 1}
+	for k, n := range want {
+		if st.Transitions[k] != n {
+			t.Errorf("transitions %v, want %v", st.Transitions, want)
+			break
+		}
+	}
+	if list := Breakers(); len(list) != 1 || list[0].Provider != "gemini" {
+		t.Errorf("unexpected breakers %+v", list)
+	}
+}
+
+func TestBreaker_HalfOpenAllowsOneProbe(t *testing.T) {
+	resetBreakers(t)
+	b := BreakerFor(config.Config{BreakerFailures: 1, BreakerCooldown: 1}, "openai")
+	b.record(errors.New("boom"))
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-time.Hour)
+	b.mu.Unlock()
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected a probe, got %v", err)
+	}
+	if err := b.allow(); err == nil || !strings.Contains(err.Error(), "being probed") {
+		t.Fatalf("expected a second call to wait for the probe, got %v", err)
+	}
+	b.release()
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected a new probe after a cancelled one, got %v", err)
+	}
+	if BreakerFor(config.Config{}, "openai") != nil {
+		t.Error("expected breaker_failures=0 to disable the breaker")
+	}
+}
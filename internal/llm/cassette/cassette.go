@@ -0,0 +1,276 @@
+// Package cassette records LLM provider HTTP traffic to disk and replays it
+// without network access. Secrets are redacted before anything is written, so
+// cassettes can be attached to bug reports and checked into testdata.
+package cassette
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aezizhu/LuciCodex/internal/redact"
+)
+
+// Interaction is one recorded request/response pair.
+type Interaction struct {
+	Seq      int      `json:"seq"`
+	Key      string   `json:"key"` // Hash of method, redacted URL and redacted body
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+type Response struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+}
+
+// secretHeaders are replaced with redact.Marker when recorded.
+var secretHeaders = map[string]bool{
+	"Authorization":  true,
+	"X-Api-Key":      true,
+	"X-Goog-Api-Key": true,
+	"Cookie":         true,
+}
+
+func redactHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		if secretHeaders[http.CanonicalHeaderKey(k)] {
+			out[k] = redact.Marker
+			continue
+		}
+		out[k] = strings.Join(v, ", ")
+	}
+	return out
+}
+
+// requestKey identifies a request independently of the credentials used.
+func requestKey(method, url, body string) string {
+	h := sha256.Sum256([]byte(method + " " + url + "\n" + body))
+	return hex.EncodeToString(h[:8])
+}
+
+// readBody drains r.Body and restores it so the request can still be sent.
+func readBody(r *http.Request) (string, error) {
+	if r.Body == nil {
+		return "", nil
+	}
+	b, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	return string(b), nil
+}
+
+// Recorder is an http.RoundTripper that forwards requests to Base and writes
+// each redacted interaction to Dir as NNNN-<key>.json.
+type Recorder struct {
+	Dir  string
+	Base http.RoundTripper
+}
+
+// seqMu serializes numbering across Recorders sharing a directory.
+var seqMu sync.Mutex
+
+// write stores it under the next free sequence number in r.Dir. Numbering
+// continues after existing cassettes so successive runs append.
+func (r *Recorder) write(it Interaction) error {
+	seqMu.Lock()
+	defer seqMu.Unlock()
+	if err := os.MkdirAll(r.Dir, 0o700); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(r.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	it.Seq = len(files) + 1
+	data, err := json.MarshalIndent(it, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%04d-%s.json", it.Seq, it.Key)
+	return os.WriteFile(filepath.Join(r.Dir, name), data, 0o600)
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	base := r.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	url := redact.String(req.URL.String())
+	rbody := redact.String(body)
+	it := Interaction{
+		Key: requestKey(req.Method, url, rbody),
+		Request: Request{
+			Method:  req.Method,
+			URL:     url,
+			Headers: redactHeaders(req.Header),
+			Body:    rbody,
+		},
+		Response: Response{
+			Status:  resp.StatusCode,
+			Headers: map[string]string{"Content-Type": resp.Header.Get("Content-Type")},
+			Body:    redact.String(string(respBody)),
+		},
+	}
+	if err := r.write(it); err != nil {
+		return nil, fmt.Errorf("cassette: %w", err)
+	}
+	return resp, nil
+}
+
+// Replayer is an http.RoundTripper that answers requests from the cassettes in
+// Dir and never touches the network. A request is matched by its key first;
+// otherwise the next unused interaction with the same method and URL is
+// served, so runs whose prompts differ slightly (e.g. live facts) still replay.
+type Replayer struct {
+	Dir string
+
+	mu     sync.Mutex
+	loaded bool
+	items  []Interaction
+	used   []bool
+}
+
+var (
+	replayersMu sync.Mutex
+	replayers   = map[string]*Replayer{}
+)
+
+// OpenReplayer returns the Replayer for dir, shared by every client in the
+// process so each recorded interaction is served at most once per run.
+func OpenReplayer(dir string) *Replayer {
+	replayersMu.Lock()
+	defer replayersMu.Unlock()
+	if p, ok := replayers[dir]; ok {
+		return p
+	}
+	p := &Replayer{Dir: dir}
+	replayers[dir] = p
+	return p
+}
+
+// ErrNoInteraction is returned when no recorded interaction matches a request.
+type ErrNoInteraction struct {
+	Method, URL string
+}
+
+func (e *ErrNoInteraction) Error() string {
+	return fmt.Sprintf("cassette: no recorded response for %s %s", e.Method, e.URL)
+}
+
+func (p *Replayer) load() error {
+	if p.loaded {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(p.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("cassette: no recordings in %s", p.Dir)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("cassette: %w", err)
+		}
+		var it Interaction
+		if err := json.Unmarshal(data, &it); err != nil {
+			return fmt.Errorf("cassette: parse %s: %w", filepath.Base(f), err)
+		}
+		p.items = append(p.items, it)
+	}
+	sort.SliceStable(p.items, func(i, j int) bool { return p.items[i].Seq < p.items[j].Seq })
+	p.used = make([]bool, len(p.items))
+	p.loaded = true
+	return nil
+}
+
+func (p *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	url := redact.String(req.URL.String())
+	key := requestKey(req.Method, url, redact.String(body))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	match := -1
+	for i, it := range p.items {
+		if !p.used[i] && it.Key == key {
+			match = i
+			break
+		}
+	}
+	if match < 0 {
+		for i, it := range p.items {
+			if !p.used[i] && it.Request.Method == req.Method && it.Request.URL == url {
+				match = i
+				break
+			}
+		}
+	}
+	if match < 0 {
+		return nil, &ErrNoInteraction{Method: req.Method, URL: url}
+	}
+	p.used[match] = true
+	it := p.items[match]
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", it.Response.Status, http.StatusText(it.Response.Status)),
+		StatusCode:    it.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(strings.NewReader(it.Response.Body)),
+		ContentLength: int64(len(it.Response.Body)),
+		Request:       req,
+	}
+	for k, v := range it.Response.Headers {
+		if v != "" {
+			resp.Header.Set(k, v)
+		}
+	}
+	return resp, nil
+}
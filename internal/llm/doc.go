@@ -7,15 +7,19 @@
 //   - GeminiClient    - Google Gemini API (gemini-3-flash default)
 //   - OpenAIClient    - OpenAI API (gpt-5-mini default)
 //   - AnthropicClient - Anthropic API (claude-haiku-4-5-20251001 default)
+//   - LocalClient     - A small model on the router (a command or llama.cpp server)
 //
 // Error handling:
 //   - APIError    - Wraps HTTP errors from LLM APIs with status codes
-//   - ParseError  - Wraps JSON parsing failures with context
+//   - ParseError  - Wraps JSON parsing failures with context, including
+//     where a plan failed validation against plan.Schema
 //
 // The package includes helper functions for:
 //   - Automatic provider selection based on configuration
+//   - Falling back to the local model when a cloud provider is unreachable
 //   - HTTP client configuration with proxy support
 //   - Response parsing and plan extraction
+//   - Asking the model once more when its plan fails schema validation
 //   - Command output summarization
 //
 // Example usage:
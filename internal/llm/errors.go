@@ -1,8 +1,12 @@
 package llm
 
 import (
+	"context"
 	"errors"
 	"fmt"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
 )
 
 // LLM error types for better error handling and categorization
@@ -21,6 +25,17 @@ var (
 
 	// ErrRequestFailed indicates a generic request failure
 	ErrRequestFailed = errors.New("request failed")
+
+	// ErrResponseTooLarge indicates a response body beyond maxResponseBodySize
+	ErrResponseTooLarge = errors.New("response too large")
+
+	// ErrOffline indicates the endpoint failed the connectivity check made
+	// before each request (see preflightTransport)
+	ErrOffline = errors.New("provider endpoint unreachable")
+
+	// ErrCircuitOpen indicates the provider failed too often in a row and
+	// is not called until its cooldown ends (see Breaker)
+	ErrCircuitOpen = errors.New("provider circuit open")
 )
 
 // APIError represents an error returned by the LLM API
@@ -60,6 +75,27 @@ func (e *APIError) IsTransient() bool {
 	return e.StatusCode == 429 || e.StatusCode == 500 || e.StatusCode == 502 || e.StatusCode == 503 || e.StatusCode == 504
 }
 
+// ErrorCode classifies the error for exit codes and API responses.
+func (e *APIError) ErrorCode() errcode.Code {
+	switch {
+	case errors.Is(e.Err, ErrNoAPIKey):
+		return errcode.LLMNoKey
+	case errors.Is(e.Err, ErrOffline):
+		return errcode.Offline
+	case errors.Is(e.Err, ErrCircuitOpen):
+		return errcode.LLMUnavailable
+	case e.IsRateLimited():
+		return errcode.LLMRateLimit
+	case e.IsAuthError():
+		return errcode.LLMAuth
+	case errors.Is(e.Err, ErrContextCancelled) || errors.Is(e.Err, context.DeadlineExceeded):
+		return errcode.LLMTimeout
+	case errors.Is(e.Err, ErrInvalidResponse):
+		return errcode.LLMBadResponse
+	}
+	return errcode.LLMUnavailable
+}
+
 // NewAPIError creates a new APIError with the given parameters
 func NewAPIError(provider string, statusCode int, message string, err error) *APIError {
 	return &APIError{
@@ -76,6 +112,9 @@ type ParseError struct {
 	Stage    string // e.g., "response parsing", "plan extraction"
 	Input    string // truncated input that failed to parse
 	Err      error
+	// Violations are the places a plan that was JSON did not match
+	// plan.Schema, if that was the failure.
+	Violations []plan.Violation
 }
 
 func (e *ParseError) Error() string {
@@ -89,12 +128,20 @@ func (e *ParseError) Unwrap() error {
 	return e.Err
 }
 
+// ErrorCode classifies the error for exit codes and API responses.
+func (e *ParseError) ErrorCode() errcode.Code { return errcode.LLMBadResponse }
+
 // NewParseError creates a new ParseError
 func NewParseError(provider, stage, input string, err error) *ParseError {
-	return &ParseError{
+	pe := &ParseError{
 		Provider: provider,
 		Stage:    stage,
 		Input:    input,
 		Err:      err,
 	}
+	var schemaErr *plan.SchemaError
+	if errors.As(err, &schemaErr) {
+		pe.Violations = schemaErr.Violations
+	}
+	return pe
 }
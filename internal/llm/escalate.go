@@ -0,0 +1,88 @@
+package llm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// escalatingProvider plans with the configured model and, when that model
+// flags its plan as low-confidence, asks the stronger EscalationModel once
+// more. Escalations are taken from a daily quota kept in the metrics
+// rollups, or per process when metrics persistence is disabled.
+type escalatingProvider struct {
+	Provider
+	strong Provider
+	model  string
+	quota  int
+	store  *metrics.RollupStore
+
+	mu   sync.Mutex
+	day  string // Date of used, without a store
+	used int
+}
+
+// escalatingEmbedder keeps the embeddings API of the configured client.
+type escalatingEmbedder struct {
+	*escalatingProvider
+	Embedder
+}
+
+func newEscalatingProvider(cfg config.Config, p Provider) Provider {
+	strongCfg := cfg
+	strongCfg.Model = cfg.EscalationModel
+	e := &escalatingProvider{
+		Provider: p,
+		strong:   newClient(strongCfg),
+		model:    cfg.EscalationModel,
+		quota:    cfg.EscalationQuota,
+		store:    metrics.OpenRollupStore(cfg),
+	}
+	if em, ok := p.(Embedder); ok {
+		return escalatingEmbedder{e, em}
+	}
+	return e
+}
+
+// GeneratePlan returns the plan of the configured model, or that of the
+// stronger model if the first is low-confidence and the quota allows. A
+// failed escalation keeps the first plan.
+func (p *escalatingProvider) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	pl, err := p.Provider.GeneratePlan(ctx, prompt)
+	if err != nil || !pl.LowConfidence || !p.take() {
+		return pl, err
+	}
+	strong, err := p.strong.GeneratePlan(ctx, prompt)
+	if err != nil {
+		return pl, nil
+	}
+	strong.EscalatedTo = p.model
+	return strong, nil
+}
+
+// take takes one escalation from today's quota.
+func (p *escalatingProvider) take() bool {
+	if p.store != nil {
+		ok, err := p.store.Escalate(p.quota)
+		return ok && err == nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if today := time.Now().Format("2006-01-02"); p.day != today {
+		p.day, p.used = today, 0
+	}
+	if p.used >= p.quota {
+		return false
+	}
+	p.used++
+	return true
+}
+
+// TokensUsed counts the tokens of both models.
+func (p *escalatingProvider) TokensUsed() int {
+	return TokensUsed(p.Provider) + TokensUsed(p.strong)
+}
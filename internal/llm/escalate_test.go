@@ -0,0 +1,75 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+type stubPlanProvider struct {
+	plan  plan.Plan
+	err   error
+	calls int
+}
+
+func (s *stubPlanProvider) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	s.calls++
+	return s.plan, s.err
+}
+
+func (s *stubPlanProvider) GenerateErrorFix(ctx context.Context, originalCommand, errorOutput string, attempt int) (plan.Plan, error) {
+	return s.GeneratePlan(ctx, originalCommand)
+}
+
+func TestEscalatingProvider(t *testing.T) {
+	unsure := plan.Plan{Summary: "small", LowConfidence: true, Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}}}}
+	sure := plan.Plan{Summary: "small", Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}}}}
+	better := plan.Plan{Summary: "strong", Commands: []plan.PlannedCommand{{Command: []string{"ubus", "call", "system", "board"}}}}
+
+	small := &stubPlanProvider{plan: sure}
+	strong := &stubPlanProvider{plan: better}
+	p := &escalatingProvider{Provider: small, strong: strong, model: "gemini-2.5-pro", quota: 1}
+
+	got, err := p.GeneratePlan(context.Background(), "x")
+	if err != nil || got.Summary != "small" || strong.calls != 0 {
+		t.Fatalf("a confident plan must not escalate: %+v, %v, %d calls", got, err, strong.calls)
+	}
+
+	small.plan = unsure
+	got, err = p.GeneratePlan(context.Background(), "x")
+	if err != nil || got.Summary != "strong" || got.EscalatedTo != "gemini-2.5-pro" {
+		t.Fatalf("expected the stronger model's plan, got %+v, %v", got, err)
+	}
+
+	got, _ = p.GeneratePlan(context.Background(), "x")
+	if got.Summary != "small" || strong.calls != 1 {
+		t.Fatalf("expected the quota to stop a second escalation, got %+v", got)
+	}
+
+	p = &escalatingProvider{Provider: small, strong: &stubPlanProvider{err: errors.New("down")}, model: "m", quota: 1}
+	if got, err = p.GeneratePlan(context.Background(), "x"); err != nil || got.Summary != "small" {
+		t.Fatalf("a failed escalation must keep the first plan, got %+v, %v", got, err)
+	}
+}
+
+func TestNewProvider_Escalation(t *testing.T) {
+	cfg := config.Config{Provider: "gemini", Model: "gemini-3-flash", EscalationModel: "gemini-2.5-pro", EscalationQuota: 5}
+	p := NewProvider(cfg)
+	if _, ok := p.(Embedder); !ok {
+		t.Fatal("escalation must keep the embeddings API")
+	}
+	if _, ok := p.(escalatingEmbedder); !ok {
+		t.Fatalf("expected an escalating provider, got %T", p)
+	}
+	cfg.EscalationQuota = 0
+	if _, ok := NewProvider(cfg).(*GeminiClient); !ok {
+		t.Fatal("a zero quota must disable escalation")
+	}
+	cfg.Provider, cfg.EscalationQuota = "anthropic", 5
+	if _, ok := NewProvider(cfg).(Embedder); ok {
+		t.Fatal("a provider without embeddings must not gain them")
+	}
+}
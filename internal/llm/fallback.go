@@ -0,0 +1,90 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// fallbackProvider plans with the configured cloud provider and, when that
+// cannot be reached, with the local model (config.Config.LocalFallback), so
+// a router whose WAN is down can still be diagnosed.
+type fallbackProvider struct {
+	Provider
+	local    *LocalClient
+	provider string
+}
+
+// fallbackEmbedder keeps the embeddings API of the configured client.
+type fallbackEmbedder struct {
+	*fallbackProvider
+	Embedder
+}
+
+func newFallbackProvider(cfg config.Config, p Provider) Provider {
+	f := &fallbackProvider{Provider: p, local: NewLocalClient(cfg), provider: cfg.Provider}
+	if em, ok := p.(Embedder); ok {
+		return fallbackEmbedder{f, em}
+	}
+	return f
+}
+
+// unreachable reports whether err says the provider could not be reached
+// or is failing, rather than that the request was refused or cancelled: it
+// is offline, its circuit is open, the request failed on the network or
+// the provider answered with a 5xx.
+func unreachable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, ErrOffline) || errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.StatusCode >= 500 {
+		return true
+	}
+	return apiErr.StatusCode == 0 && !errors.Is(apiErr.Err, ErrNoAPIKey) &&
+		!errors.Is(apiErr.Err, ErrInvalidResponse) && !errors.Is(apiErr.Err, ErrContextCancelled)
+}
+
+// GeneratePlan returns the plan of the configured provider or, if it cannot
+// be reached, that of the local model, marked with FallbackFrom. If the
+// local model fails too, the provider's error is returned.
+func (p *fallbackProvider) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	pl, err := p.Provider.GeneratePlan(ctx, prompt)
+	if !unreachable(ctx, err) {
+		return pl, err
+	}
+	local, lerr := p.local.GeneratePlan(ctx, prompt)
+	if lerr != nil {
+		return pl, fmt.Errorf("%w (local fallback: %v)", err, lerr)
+	}
+	local.FallbackFrom = p.provider
+	return local, nil
+}
+
+// GenerateErrorFix is GeneratePlan for error fixes.
+func (p *fallbackProvider) GenerateErrorFix(ctx context.Context, originalCommand string, errorOutput string, attempt int) (plan.Plan, error) {
+	pl, err := p.Provider.GenerateErrorFix(ctx, originalCommand, errorOutput, attempt)
+	if !unreachable(ctx, err) {
+		return pl, err
+	}
+	local, lerr := p.local.GenerateErrorFix(ctx, originalCommand, errorOutput, attempt)
+	if lerr != nil {
+		return pl, fmt.Errorf("%w (local fallback: %v)", err, lerr)
+	}
+	local.FallbackFrom = p.provider
+	return local, nil
+}
+
+// TokensUsed counts the tokens of both models.
+func (p *fallbackProvider) TokensUsed() int {
+	return TokensUsed(p.Provider) + p.local.TokensUsed()
+}
@@ -1,9 +1,7 @@
 package llm
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
@@ -14,8 +12,10 @@ import (
 )
 
 type GeminiClient struct {
+	tokenCounter
 	httpClient *http.Client
 	cfg        config.Config
+	oauth      bool // authorized by a stored OAuth token instead of the API key
 }
 
 func NewGeminiClient(cfg config.Config) *GeminiClient {
@@ -24,10 +24,22 @@ func NewGeminiClient(cfg config.Config) *GeminiClient {
 	if timeout < 60*time.Second {
 		timeout = 60 * time.Second
 	}
-	return &GeminiClient{
-		httpClient: newHTTPClient(cfg, timeout),
+	c := &GeminiClient{
+		httpClient: withRetries(cfg, "gemini", newHTTPClient(cfg, timeout)),
 		cfg:        cfg,
 	}
+	c.oauth = useOAuth(cfg, "gemini", c.httpClient)
+	return c
+}
+
+// methodURL returns the REST URL for model:method, passing the API key as a
+// query parameter unless the client is using OAuth.
+func (c *GeminiClient) methodURL(model, method string) string {
+	u := fmt.Sprintf("%s/models/%s:%s", c.cfg.Endpoint, model, method)
+	if !c.oauth {
+		u += "?key=" + c.cfg.APIKey
+	}
+	return u
 }
 
 // API request/response shapes (minimal for our use)
@@ -37,7 +49,30 @@ type generateContentRequest struct {
 }
 
 type generationConfig struct {
-	ResponseMimeType string `json:"response_mime_type,omitempty"`
+	ResponseMimeType string          `json:"response_mime_type,omitempty"`
+	Temperature      *float64        `json:"temperature,omitempty"`
+	TopP             *float64        `json:"topP,omitempty"`
+	MaxOutputTokens  int             `json:"maxOutputTokens,omitempty"`
+	ThinkingConfig   *thinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+type thinkingConfig struct {
+	ThinkingBudget int `json:"thinkingBudget"`
+}
+
+// generationConfig returns the JSON-mode generation config with the
+// configured sampling and thinking parameters applied.
+func (c *GeminiClient) generationConfig() *generationConfig {
+	gc := &generationConfig{
+		ResponseMimeType: "application/json",
+		Temperature:      c.cfg.Temperature,
+		TopP:             c.cfg.TopP,
+		MaxOutputTokens:  c.cfg.MaxOutputTokens,
+	}
+	if c.cfg.ThinkingBudget > 0 {
+		gc.ThinkingConfig = &thinkingConfig{ThinkingBudget: c.cfg.ThinkingBudget}
+	}
+	return gc
 }
 
 type content struct {
@@ -54,32 +89,42 @@ type generateContentResponse struct {
 		Content content `json:"content"`
 	} `json:"candidates"`
 	PromptFeedback any `json:"promptFeedback,omitempty"`
+	UsageMetadata  struct {
+		TotalTokenCount int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
 }
 
+// GeneratePlan asks the model for a plan, and once more if its response
+// does not match the plan schema (see repairPlan).
 func (c *GeminiClient) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	return repairPlan(ctx, prompt, c.generatePlan)
+}
+
+func (c *GeminiClient) generatePlan(ctx context.Context, prompt string) (plan.Plan, error) {
 	var zero plan.Plan
-	if c.cfg.APIKey == "" {
+	if c.cfg.APIKey == "" && !c.oauth {
 		return zero, NewAPIError("gemini", 0, "missing API key - configure in LuCI or set GEMINI_API_KEY", ErrNoAPIKey)
 	}
 	model := c.cfg.Model
 	if model == "" {
 		model = "gemini-3-flash"
 	}
-	url := fmt.Sprintf("%s/models/%s:generateContent?key=%s", c.cfg.Endpoint, model, c.cfg.APIKey)
+	url := c.methodURL(model, "generateContent")
 
 	reqBody := generateContentRequest{
 		Contents: []content{{
 			Role:  "user",
 			Parts: []part{{Text: prompt}},
 		}},
-		Config: &generationConfig{ResponseMimeType: "application/json"},
+		Config: c.generationConfig(),
 	}
-	b, err := json.Marshal(reqBody)
+	b, release, err := encodeRequest(reqBody)
 	if err != nil {
 		return zero, NewAPIError("gemini", 0, "failed to marshal request", err)
 	}
+	defer release()
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, b)
 	if err != nil {
 		return zero, NewAPIError("gemini", 0, "failed to create request", err)
 	}
@@ -99,9 +144,10 @@ func (c *GeminiClient) GeneratePlan(ctx context.Context, prompt string) (plan.Pl
 	}
 
 	var gcr generateContentResponse
-	if err := json.NewDecoder(resp.Body).Decode(&gcr); err != nil {
+	if err := decodeResponse(resp.Body, &gcr); err != nil {
 		return zero, NewParseError("gemini", "response decoding", "", err)
 	}
+	c.addTokens(gcr.UsageMetadata.TotalTokenCount)
 	if len(gcr.Candidates) == 0 || len(gcr.Candidates[0].Content.Parts) == 0 {
 		return zero, NewAPIError("gemini", 0, "empty response from API", ErrInvalidResponse)
 	}
@@ -120,28 +166,29 @@ func (c *GeminiClient) GenerateErrorFix(ctx context.Context, originalCommand str
 
 // Summarize returns summary/details using the active Gemini model.
 func (c *GeminiClient) Summarize(ctx context.Context, prompt string) (string, []string, error) {
-	if c.cfg.APIKey == "" {
+	if c.cfg.APIKey == "" && !c.oauth {
 		return "", nil, NewAPIError("gemini", 0, "missing API key - configure in LuCI or set GEMINI_API_KEY", ErrNoAPIKey)
 	}
 	model := c.cfg.Model
 	if model == "" {
 		model = "gemini-3-flash"
 	}
-	url := fmt.Sprintf("%s/models/%s:generateContent?key=%s", c.cfg.Endpoint, model, c.cfg.APIKey)
+	url := c.methodURL(model, "generateContent")
 
 	reqBody := generateContentRequest{
 		Contents: []content{{
 			Role:  "user",
 			Parts: []part{{Text: prompt}},
 		}},
-		Config: &generationConfig{ResponseMimeType: "application/json"},
+		Config: c.generationConfig(),
 	}
-	b, err := json.Marshal(reqBody)
+	b, release, err := encodeRequest(reqBody)
 	if err != nil {
 		return "", nil, NewAPIError("gemini", 0, "failed to marshal request", err)
 	}
+	defer release()
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, b)
 	if err != nil {
 		return "", nil, NewAPIError("gemini", 0, "failed to create request", err)
 	}
@@ -161,9 +208,10 @@ func (c *GeminiClient) Summarize(ctx context.Context, prompt string) (string, []
 	}
 
 	var gcr generateContentResponse
-	if err := json.NewDecoder(resp.Body).Decode(&gcr); err != nil {
+	if err := decodeResponse(resp.Body, &gcr); err != nil {
 		return "", nil, NewParseError("gemini", "response decoding", "", err)
 	}
+	c.addTokens(gcr.UsageMetadata.TotalTokenCount)
 	if len(gcr.Candidates) == 0 || len(gcr.Candidates[0].Content.Parts) == 0 {
 		return "", nil, NewAPIError("gemini", 0, "empty response from API", ErrInvalidResponse)
 	}
@@ -171,3 +219,80 @@ func (c *GeminiClient) Summarize(ctx context.Context, prompt string) (string, []
 	summary, details := parseSummary(text)
 	return summary, details, nil
 }
+
+type embedContentRequest struct {
+	Model   string  `json:"model"`
+	Content content `json:"content"`
+}
+
+type batchEmbedRequest struct {
+	Requests []embedContentRequest `json:"requests"`
+}
+
+type batchEmbedResponse struct {
+	Embeddings []struct {
+		Values []float32 `json:"values"`
+	} `json:"embeddings"`
+}
+
+// EmbeddingModel returns the configured embedding model or the Gemini default.
+func (c *GeminiClient) EmbeddingModel() string {
+	if c.cfg.EmbeddingModel != "" {
+		return c.cfg.EmbeddingModel
+	}
+	return "text-embedding-004"
+}
+
+// Embed returns one embedding vector per input text using batchEmbedContents.
+func (c *GeminiClient) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if c.cfg.APIKey == "" && !c.oauth {
+		return nil, NewAPIError("gemini", 0, "missing API key - configure in LuCI or set GEMINI_API_KEY", ErrNoAPIKey)
+	}
+	model := c.EmbeddingModel()
+	url := c.methodURL(model, "batchEmbedContents")
+
+	reqBody := batchEmbedRequest{Requests: make([]embedContentRequest, 0, len(texts))}
+	for _, t := range texts {
+		reqBody.Requests = append(reqBody.Requests, embedContentRequest{
+			Model:   "models/" + model,
+			Content: content{Parts: []part{{Text: t}}},
+		})
+	}
+	b, release, err := encodeRequest(reqBody)
+	if err != nil {
+		return nil, NewAPIError("gemini", 0, "failed to marshal request", err)
+	}
+	defer release()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, b)
+	if err != nil {
+		return nil, NewAPIError("gemini", 0, "failed to create request", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, NewAPIError("gemini", 0, "request cancelled", ErrContextCancelled)
+		}
+		return nil, NewAPIError("gemini", 0, "request failed", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data := readErrorBody(resp.Body)
+		return nil, NewAPIError("gemini", resp.StatusCode, string(data), ErrRequestFailed)
+	}
+
+	var ber batchEmbedResponse
+	if err := decodeResponse(resp.Body, &ber); err != nil {
+		return nil, NewParseError("gemini", "response decoding", "", err)
+	}
+	if len(ber.Embeddings) != len(texts) {
+		return nil, NewAPIError("gemini", 0, fmt.Sprintf("expected %d embeddings, got %d", len(texts), len(ber.Embeddings)), ErrInvalidResponse)
+	}
+	out := make([][]float32, len(ber.Embeddings))
+	for i, e := range ber.Embeddings {
+		out[i] = e.Values
+	}
+	return out, nil
+}
@@ -1,14 +1,20 @@
 package llm
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/llm/cassette"
+	"github.com/aezizhu/LuciCodex/internal/llm/llmdebug"
+	"github.com/aezizhu/LuciCodex/internal/tlspin"
 )
 
 // maxErrorBodySize limits error response reads to prevent memory exhaustion
@@ -21,6 +27,66 @@ func readErrorBody(body io.Reader) []byte {
 	return data
 }
 
+// maxResponseBodySize caps successful responses. Plans and summaries are a
+// few KB and embedding batches well below this; anything larger would only
+// get the process OOM-killed on a 64MB router.
+const maxResponseBodySize = 4 << 20
+
+// decodeResponse decodes the JSON body of a successful response into v as it
+// streams in, without buffering the body, and fails with
+// ErrResponseTooLarge beyond maxResponseBodySize.
+func decodeResponse(body io.Reader, v interface{}) error {
+	return json.NewDecoder(&cappedReader{r: body, n: maxResponseBodySize}).Decode(v)
+}
+
+// cappedReader is an io.LimitReader that fails instead of ending early, so
+// a cut off body is not mistaken for a truncated JSON document.
+type cappedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.n <= 0 {
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	return n, err
+}
+
+// requestBufPool holds the buffers requests are marshaled into, so each
+// request does not allocate its prompt-sized body anew.
+var requestBufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// maxPooledRequestSize keeps the occasional huge request (a large
+// attachment) from pinning its buffer in the pool.
+const maxPooledRequestSize = 256 << 10
+
+// encodeRequest marshals v like json.Marshal into a pooled buffer. Call
+// release once the response body is closed, when the transport is done
+// with the request body.
+func encodeRequest(v interface{}) (body *bytes.Reader, release func(), err error) {
+	buf := requestBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	release = func() {
+		if buf.Cap() <= maxPooledRequestSize {
+			requestBufPool.Put(buf)
+		}
+	}
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		release()
+		return nil, nil, err
+	}
+	// Encode adds a newline json.Marshal does not; recorded cassettes
+	// match on the exact body
+	buf.Truncate(buf.Len() - 1)
+	return bytes.NewReader(buf.Bytes()), release, nil
+}
+
 func newHTTPClient(cfg config.Config, timeout time.Duration) *http.Client {
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.Proxy = proxyFunc(cfg)
@@ -42,10 +108,39 @@ func newHTTPClient(cfg config.Config, timeout time.Duration) *http.Client {
 	}
 	transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
 
+	// Hosts pinned with `lucicodex pin add` are checked against their pin
+	// instead of the system CAs
+	if pins, _ := tlspin.Open(cfg).List(); len(pins) > 0 {
+		transport.DialTLSContext = tlspin.DialTLSContext(transport.TLSClientConfig, pins)
+	}
+
+	// Replayed requests need no network, so only live ones are checked
+	var rt http.RoundTripper = newPreflightTransport(transport, transport.Proxy)
+	switch {
+	case cfg.ReplayDir != "":
+		rt = cassette.OpenReplayer(cfg.ReplayDir)
+	case cfg.RecordDir != "":
+		rt = &cassette.Recorder{Dir: cfg.RecordDir, Base: rt}
+	}
+	if cfg.DebugLLM {
+		rt = llmdebug.Open(debugDir(cfg)).Transport(rt)
+	}
+	if cfg.HTTPTrace != nil {
+		rt = &traceTransport{w: cfg.HTTPTrace, base: rt}
+	}
+
 	return &http.Client{
 		Timeout:   timeout,
-		Transport: transport,
+		Transport: rt,
+	}
+}
+
+// debugDir returns where -debug-llm bundles go.
+func debugDir(cfg config.Config) string {
+	if cfg.DebugDir != "" {
+		return cfg.DebugDir
 	}
+	return llmdebug.DefaultDir
 }
 
 func proxyFunc(cfg config.Config) func(*http.Request) (*url.URL, error) {
@@ -1,8 +1,15 @@
 package llm
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -20,6 +27,23 @@ func TestNewHTTPClient(t *testing.T) {
 	}
 }
 
+func TestProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") != "" || r.Header.Get("Authorization") != "" {
+			t.Error("probe should not send credentials")
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	cfg := config.Config{Provider: "anthropic", AnthropicEndpoint: server.URL, AnthropicAPIKey: "sk-test"}
+	if err := Probe(context.Background(), cfg); err != nil {
+		t.Errorf("a refused request still means reachable: %v", err)
+	}
+	server.Close()
+	if err := Probe(context.Background(), cfg); err == nil {
+		t.Error("expected an error for a closed endpoint")
+	}
+}
+
 func TestProxyFunc(t *testing.T) {
 	// Clear proxy env vars to ensure deterministic testing
 	t.Setenv("HTTP_PROXY", "")
@@ -196,3 +220,81 @@ func TestShouldBypassProxy(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeResponse(t *testing.T) {
+	var or openaiResp
+	if err := decodeResponse(strings.NewReader(`{"choices": [{"message": {"content": "hi"}}]}`), &or); err != nil || or.Choices[0].Message.Content != "hi" {
+		t.Fatalf("decodeResponse = %+v, %v", or, err)
+	}
+	huge := `{"choices": [{"message": {"content": "` + strings.Repeat("x", maxResponseBodySize) + `"}}]}`
+	if err := decodeResponse(strings.NewReader(huge), &or); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("expected ErrResponseTooLarge, got %v", err)
+	}
+}
+
+func TestEncodeRequest(t *testing.T) {
+	req := openaiReq{Model: "gpt-4o-mini", Messages: []openaiMessage{{Role: "user", Content: "<b>restart wifi</b>"}}}
+	want, _ := json.Marshal(req)
+	for i := 0; i < 2; i++ {
+		body, release, err := encodeRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(body)
+		release()
+		// Recorded cassettes match on the exact bytes json.Marshal produced
+		if !bytes.Equal(got, want) {
+			t.Errorf("encodeRequest = %s, want %s", got, want)
+		}
+	}
+}
+
+// runawayResponse is a chat completion of about 16MB, such as a misbehaving
+// endpoint or proxy streaming far more than any plan.
+var runawayResponse = `{"choices": [{"message": {"content": "` + strings.Repeat("lorem ipsum ", 16<<17) + `"}}], "usage": {"total_tokens": 1}}`
+
+// The benchmarks compare the clients' capped decode and pooled encode with
+// the unbounded buffering they replace. B/op is what one request adds to
+// the heap, which bounds the peak RSS on routers without swap.
+func BenchmarkDecodeResponse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var or openaiResp
+		if err := decodeResponse(strings.NewReader(runawayResponse), &or); !errors.Is(err, ErrResponseTooLarge) {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeResponse_ReadAll(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var or openaiResp
+		data, _ := io.ReadAll(strings.NewReader(runawayResponse))
+		if err := json.Unmarshal(data, &or); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeRequest(b *testing.B) {
+	req := openaiReq{Model: "gpt-4o-mini", Messages: []openaiMessage{{Role: "user", Content: strings.Repeat("uci show network\n", 4096)}}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, release, err := encodeRequest(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		release()
+	}
+}
+
+func BenchmarkEncodeRequest_Marshal(b *testing.B) {
+	req := openaiReq{Model: "gpt-4o-mini", Messages: []openaiMessage{{Role: "user", Content: strings.Repeat("uci show network\n", 4096)}}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
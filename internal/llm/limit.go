@@ -0,0 +1,36 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+// FitLimit returns p if it has at most limit commands (no limit if limit
+// <= 0). Otherwise gen is asked once more, with prompt followed by
+// prompts.LimitBlock, and that plan is returned if it fits, with a warning
+// saying so. Plans over the limit are never cut short: the tail of a plan is
+// where the uci commit and the service reloads its changes need are. A plan
+// still over the limit is a *policy.LimitError.
+func FitLimit(ctx context.Context, gen policy.Generator, prompt string, p plan.Plan, limit int) (plan.Plan, error) {
+	if limit <= 0 || len(p.Commands) <= limit {
+		return p, nil
+	}
+	first := len(p.Commands)
+	again, err := gen.GeneratePlan(ctx, prompt+prompts.LimitBlock(limit, first))
+	if err != nil {
+		return p, fmt.Errorf("%w; asking again failed: %v", &policy.LimitError{Commands: first, Limit: limit}, err)
+	}
+	if len(again.Commands) == 0 {
+		// The model gave up; the first plan is the one refused
+		return p, &policy.LimitError{Commands: first, Limit: limit, Retried: true}
+	}
+	if len(again.Commands) > limit {
+		return again, &policy.LimitError{Commands: len(again.Commands), Limit: limit, Retried: true}
+	}
+	again.Warnings = append(again.Warnings, fmt.Sprintf("The first plan had %d commands, more than the limit of %d; this one was planned again within it.", first, limit))
+	return again, nil
+}
@@ -0,0 +1,74 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+// seqGenerator returns its plans in turn and records the prompts.
+type seqGenerator struct {
+	plans   []plan.Plan
+	err     error
+	prompts []string
+}
+
+func (g *seqGenerator) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	g.prompts = append(g.prompts, prompt)
+	if g.err != nil {
+		return plan.Plan{}, g.err
+	}
+	p := g.plans[0]
+	g.plans = g.plans[1:]
+	return p, nil
+}
+
+func TestFitLimit(t *testing.T) {
+	long := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"uci", "set", "a.b.c=1"}}, {Command: []string{"uci", "set", "a.b.d=2"}},
+		{Command: []string{"uci", "set", "a.b.e=3"}}, {Command: []string{"uci", "commit", "a"}},
+	}}
+	short := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "batch"}}, {Command: []string{"uci", "commit", "a"}}}}
+
+	gen := &seqGenerator{}
+	if p, err := FitLimit(context.Background(), gen, "p", short, 3); err != nil || len(p.Commands) != 2 || len(gen.prompts) != 0 {
+		t.Fatalf("a plan within the limit must be kept, got %+v, %v", p, err)
+	}
+	if _, err := FitLimit(context.Background(), gen, "p", long, 0); err != nil || len(gen.prompts) != 0 {
+		t.Fatalf("no limit must keep the plan, got %v", err)
+	}
+
+	gen = &seqGenerator{plans: []plan.Plan{short}}
+	p, err := FitLimit(context.Background(), gen, "User request: set a", long, 3)
+	if err != nil || len(p.Commands) != 2 {
+		t.Fatalf("expected the shorter plan, got %+v, %v", p, err)
+	}
+	if !strings.HasPrefix(gen.prompts[0], "User request: set a") || !strings.Contains(gen.prompts[0], "had 4 commands, but at most 3") {
+		t.Errorf("unexpected prompt %q", gen.prompts[0])
+	}
+	if len(p.Warnings) != 1 || !strings.Contains(p.Warnings[0], "planned again") {
+		t.Errorf("expected a warning about the second plan, got %v", p.Warnings)
+	}
+
+	gen = &seqGenerator{plans: []plan.Plan{long}}
+	_, err = FitLimit(context.Background(), gen, "p", long, 3)
+	var le *policy.LimitError
+	if !errors.As(err, &le) || !le.Retried || le.Commands != 4 || le.Limit != 3 || errcode.Of(err) != errcode.PlanTooLarge {
+		t.Errorf("expected a LimitError after asking again, got %v", err)
+	}
+
+	gen = &seqGenerator{plans: []plan.Plan{{Summary: "cannot"}}}
+	if _, err = FitLimit(context.Background(), gen, "p", long, 3); errcode.Of(err) != errcode.PlanTooLarge {
+		t.Errorf("expected an empty second plan to be refused, got %v", err)
+	}
+
+	gen = &seqGenerator{err: errors.New("provider down")}
+	if _, err = FitLimit(context.Background(), gen, "p", long, 3); errcode.Of(err) != errcode.PlanTooLarge || !strings.Contains(err.Error(), "provider down") {
+		t.Errorf("expected both errors, got %v", err)
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
 	"github.com/aezizhu/LuciCodex/internal/plan"
 	"github.com/aezizhu/LuciCodex/internal/testutil"
 )
@@ -385,3 +388,200 @@ func containsHelper(s, substr string) bool {
 	}
 	return false
 }
+
+func TestGeminiClient_Embed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/models/text-embedding-004:batchEmbedContents") {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var req batchEmbedRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Requests) != 2 || req.Requests[0].Model != "models/text-embedding-004" {
+			t.Errorf("unexpected request: %+v", req)
+		}
+		w.Write([]byte(`{"embeddings": [{"values": [1, 0]}, {"values": [0, 1]}]}`))
+	}))
+	defer server.Close()
+
+	client := NewGeminiClient(config.Config{APIKey: "test-key", Endpoint: server.URL})
+	vecs, err := client.Embed(context.Background(), []string{"a", "b"})
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, len(vecs), 2)
+	testutil.AssertEqual(t, vecs[1][1], float32(1))
+}
+
+func TestGeminiClient_OAuthToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "" {
+			t.Errorf("API key should not be sent when using OAuth: %s", r.URL.RawQuery)
+		}
+		if r.Header.Get("Authorization") != "Bearer oauth-token" {
+			t.Errorf("expected bearer token, got %q", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"ok\", \"commands\": []}"}]}}]}`))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "tokens.json")
+	os.WriteFile(tokenFile, []byte(`{"gemini": {"provider": "gemini", "access_token": "oauth-token"}}`), 0600)
+
+	client := NewGeminiClient(config.Config{Endpoint: server.URL, TokenFile: tokenFile})
+	p, err := client.GeneratePlan(context.Background(), "test")
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, p.Summary, "ok")
+}
+
+func TestGeminiClient_RecordReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"candidates": [{"content": {"parts": [{"text": "{\"summary\": \"recorded\", \"commands\": []}"}]}}]}`))
+	}))
+	dir := t.TempDir()
+
+	cfg := config.Config{APIKey: "test-key", Endpoint: server.URL, RecordDir: dir}
+	p, err := NewGeminiClient(cfg).GeneratePlan(context.Background(), "test")
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, p.Summary, "recorded")
+	server.Close()
+
+	cfg.RecordDir = ""
+	cfg.ReplayDir = dir
+	p, err = NewGeminiClient(cfg).GeneratePlan(context.Background(), "test")
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, p.Summary, "recorded")
+}
+
+func TestAPIError_ErrorCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		want errcode.Code
+	}{
+		{NewAPIError("gemini", 0, "failed", ErrNoAPIKey), errcode.LLMNoKey},
+		{NewAPIError("openai", 429, "failed", nil), errcode.LLMRateLimit},
+		{NewAPIError("openai", 401, "failed", nil), errcode.LLMAuth},
+		{NewAPIError("anthropic", 500, "failed", nil), errcode.LLMUnavailable},
+		{NewAPIError("gemini", 0, "failed", context.DeadlineExceeded), errcode.LLMTimeout},
+		{NewParseError("gemini", "plan", "not json", ErrInvalidResponse), errcode.LLMBadResponse},
+	}
+	for i, c := range cases {
+		if got := errcode.Of(c.err); got != c.want {
+			t.Errorf("case %d (%v): got %s, want %s", i, c.err, got, c.want)
+		}
+	}
+}
+
+func TestGeminiClient_GenerationParams(t *testing.T) {
+	var got map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Config map[string]interface{} `json:"generationConfig"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		got = req.Config
+		w.Write([]byte(`{"candidates":[{"content":{"parts":[{"text":"{\"summary\":\"ok\",\"commands\":[]}"}]}}]}`))
+	}))
+	defer server.Close()
+
+	temp := 0.2
+	cfg := config.Config{APIKey: "k", Model: "gemini-2.5-flash", Endpoint: server.URL}
+	if _, err := NewGeminiClient(cfg).GeneratePlan(context.Background(), "p"); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"temperature", "topP", "maxOutputTokens", "thinkingConfig"} {
+		if _, ok := got[k]; ok {
+			t.Errorf("%s sent without being configured", k)
+		}
+	}
+
+	cfg.Temperature = &temp
+	cfg.MaxOutputTokens = 512
+	cfg.ThinkingBudget = 256
+	if _, err := NewGeminiClient(cfg).GeneratePlan(context.Background(), "p"); err != nil {
+		t.Fatal(err)
+	}
+	if got["temperature"] != 0.2 || got["maxOutputTokens"] != float64(512) {
+		t.Errorf("unexpected generationConfig: %v", got)
+	}
+	if tc, _ := got["thinkingConfig"].(map[string]interface{}); tc["thinkingBudget"] != float64(256) {
+		t.Errorf("expected thinking budget 256, got %v", got["thinkingConfig"])
+	}
+}
+
+func TestProviders_TokensUsed(t *testing.T) {
+	planText := `{\"summary\":\"ok\",\"commands\":[]}`
+	bodies := map[string]string{
+		"gemini":    `{"candidates":[{"content":{"parts":[{"text":"` + planText + `"}]}}],"usageMetadata":{"totalTokenCount":120}}`,
+		"openai":    `{"choices":[{"message":{"content":"` + planText + `"}}],"usage":{"total_tokens":120}}`,
+		"anthropic": `{"content":[{"type":"text","text":"` + planText + `"}],"usage":{"input_tokens":100,"output_tokens":20}}`,
+	}
+	for name, body := range bodies {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		cfg := config.Config{
+			Provider: name, APIKey: "k", OpenAIAPIKey: "k", AnthropicAPIKey: "k",
+			Endpoint: server.URL, OpenAIEndpoint: server.URL, AnthropicEndpoint: server.URL,
+		}
+		p := NewProvider(cfg)
+		for i := 0; i < 2; i++ {
+			if _, err := p.GeneratePlan(context.Background(), "p"); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if got := TokensUsed(p); got != 240 {
+			t.Errorf("%s: TokensUsed = %d, want 240", name, got)
+		}
+		server.Close()
+	}
+}
+
+func TestProviders_FakeProviderTokens(t *testing.T) {
+	for _, name := range []string{"gemini", "openai", "anthropic"} {
+		server, _ := testutil.MockProviderServer(t, testutil.FakeResponse{Text: `{"summary":"ok","commands":[]}`, Tokens: 120})
+		p := NewProvider(testutil.FakeProviderConfig(config.Config{}, name, server.URL))
+		for i := 0; i < 2; i++ {
+			if _, err := p.GeneratePlan(context.Background(), "p"); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if got := TokensUsed(p); got != 240 {
+			t.Errorf("%s: TokensUsed = %d, want 240", name, got)
+		}
+		server.Close()
+	}
+}
+
+func TestProviders_FakeProviderFaults(t *testing.T) {
+	for _, name := range []string{"gemini", "openai", "anthropic"} {
+		server, fake := testutil.MockProviderServer(t,
+			testutil.FakeResponse{Status: http.StatusTooManyRequests},
+			testutil.FakeResponse{Fault: testutil.FaultMalformed},
+			testutil.FakeResponse{Fault: testutil.FaultTruncate},
+			testutil.FakeResponse{Text: "not a plan"},
+			testutil.FakeResponse{DelayMS: 500},
+			testutil.FakeResponse{},
+		)
+		p := NewProvider(testutil.FakeProviderConfig(config.Config{}, name, server.URL))
+		for _, want := range []errcode.Code{errcode.LLMRateLimit, errcode.LLMBadResponse, errcode.LLMBadResponse, errcode.LLMBadResponse} {
+			_, err := p.GeneratePlan(context.Background(), "p")
+			if got := errcode.Of(err); got != want {
+				t.Errorf("%s: got %s (%v), want %s", name, got, err, want)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := p.GeneratePlan(ctx, "p")
+		cancel()
+		if got := errcode.Of(err); got != errcode.LLMTimeout {
+			t.Errorf("%s: slow response: got %s (%v), want %s", name, got, err, errcode.LLMTimeout)
+		}
+
+		pl, err := p.GeneratePlan(context.Background(), "p")
+		if err != nil || len(pl.Commands) != 1 || pl.Commands[0].Command[0] != "echo" {
+			t.Errorf("%s: default plan: %+v, %v", name, pl, err)
+		}
+		if reqs := fake.Requests(); len(reqs) != 6 || reqs[0].Wire != name {
+			t.Errorf("%s: unexpected requests %+v", name, reqs)
+		}
+		server.Close()
+	}
+}
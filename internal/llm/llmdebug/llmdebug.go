@@ -0,0 +1,267 @@
+// Package llmdebug captures the exact prompt sent and the raw response
+// received for every LLM call of a run (-debug-llm). Each run gets a bundle
+// directory of numbered exchanges, redacted like cassettes, so a plan that
+// fails to parse can be inspected with `lucicodex debug last`.
+package llmdebug
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/artifacts"
+	"github.com/aezizhu/LuciCodex/internal/redact"
+)
+
+// DefaultDir is the default debug_dir (tmpfs on OpenWrt).
+const DefaultDir = "/tmp/lucicodex-debug"
+
+// KeepBundles is how many run bundles are kept; older ones are removed when
+// a new run starts capturing.
+const KeepBundles = 10
+
+// ErrNoExchange is returned by Last when nothing was captured yet.
+var ErrNoExchange = errors.New("no LLM exchange captured; run with -debug-llm first")
+
+// Exchange is one LLM call. Prompt and Response are the text parts of the
+// request and response bodies; the bodies themselves are kept verbatim
+// apart from redaction.
+type Exchange struct {
+	Seq          int       `json:"seq"`
+	Bundle       string    `json:"bundle"`
+	Time         time.Time `json:"time"`
+	DurationMs   int64     `json:"duration_ms"`
+	Method       string    `json:"method"`
+	URL          string    `json:"url"`
+	Status       int       `json:"status,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Prompt       string    `json:"prompt"`
+	Response     string    `json:"response"`
+	RequestBody  string    `json:"request_body"`
+	ResponseBody string    `json:"response_body"`
+}
+
+// Bundle is the capture directory of one run.
+type Bundle struct {
+	Root string
+	ID   string
+
+	mu  sync.Mutex
+	seq int
+}
+
+var (
+	bundlesMu sync.Mutex
+	bundles   = map[string]*Bundle{}
+)
+
+// Open returns the bundle of this process under root, shared by every
+// client so all exchanges of a run are numbered in one sequence. The
+// directory is created on the first exchange.
+func Open(root string) *Bundle {
+	bundlesMu.Lock()
+	defer bundlesMu.Unlock()
+	if b, ok := bundles[root]; ok {
+		return b
+	}
+	b := &Bundle{Root: root, ID: artifacts.NewID()}
+	bundles[root] = b
+	return b
+}
+
+// Dir returns the bundle's directory.
+func (b *Bundle) Dir() string { return filepath.Join(b.Root, b.ID) }
+
+// Transport returns an http.RoundTripper that forwards requests to base and
+// writes each exchange to the bundle.
+func (b *Bundle) Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{bundle: b, base: base}
+}
+
+type transport struct {
+	bundle *Bundle
+	base   http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	ex := Exchange{
+		Time:        time.Now().UTC(),
+		Method:      req.Method,
+		URL:         redact.String(req.URL.String()),
+		RequestBody: redact.String(string(reqBody)),
+		Prompt:      redact.String(extractText(reqBody, "text", "content", "system")),
+	}
+	resp, err := base.RoundTrip(req)
+	ex.DurationMs = time.Since(ex.Time).Milliseconds()
+	if err != nil {
+		ex.Error = redact.String(err.Error())
+		t.bundle.write(ex)
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	// A failed read is captured too; the client sees the same error
+	resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(respBody), errReader{err}))
+	ex.Status = resp.StatusCode
+	ex.ResponseBody = redact.String(string(respBody))
+	ex.Response = redact.String(extractText(respBody, "text", "content"))
+	if err != nil {
+		ex.Error = redact.String(err.Error())
+	}
+	// Capturing is best effort; it must never fail the call being debugged
+	t.bundle.write(ex)
+	return resp, nil
+}
+
+// errReader returns err once the captured body is exhausted, or EOF.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
+
+func (b *Bundle) write(ex Exchange) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.seq == 0 {
+		if err := os.MkdirAll(b.Dir(), 0o700); err != nil {
+			return err
+		}
+		prune(b.Root, b.ID)
+	}
+	b.seq++
+	ex.Seq = b.seq
+	ex.Bundle = b.ID
+	data, err := json.MarshalIndent(ex, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(b.Dir(), fmt.Sprintf("%04d.json", ex.Seq)), append(data, '\n'), 0o600)
+}
+
+// prune removes the oldest bundles under root beyond KeepBundles, never
+// the current one.
+func prune(root, current string) {
+	ids := bundleIDs(root)
+	for len(ids) > KeepBundles {
+		if ids[0] != current {
+			os.RemoveAll(filepath.Join(root, ids[0]))
+		}
+		ids = ids[1:]
+	}
+}
+
+// bundleIDs lists the bundles under root, oldest first.
+func bundleIDs(root string) []string {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Last returns the most recent exchange captured under root.
+func Last(root string) (Exchange, error) {
+	ids := bundleIDs(root)
+	for i := len(ids) - 1; i >= 0; i-- {
+		files, _ := filepath.Glob(filepath.Join(root, ids[i], "*.json"))
+		if len(files) == 0 {
+			continue
+		}
+		sort.Strings(files)
+		data, err := os.ReadFile(files[len(files)-1])
+		if err != nil {
+			return Exchange{}, err
+		}
+		var ex Exchange
+		if err := json.Unmarshal(data, &ex); err != nil {
+			return Exchange{}, fmt.Errorf("%s: %w", files[len(files)-1], err)
+		}
+		return ex, nil
+	}
+	return Exchange{}, ErrNoExchange
+}
+
+// extractText joins the string values of the given keys found anywhere in a
+// JSON body. This covers the Gemini (parts[].text), OpenAI
+// (messages[].content) and Anthropic (system, content[].text) formats
+// without knowing which one was used. Bodies that are not JSON are returned
+// as they are.
+func extractText(body []byte, keys ...string) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return string(body)
+	}
+	want := map[string]bool{}
+	for _, k := range keys {
+		want[k] = true
+	}
+	var parts []string
+	var walk func(interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			names := make([]string, 0, len(v))
+			for k := range v {
+				names = append(names, k)
+			}
+			// Map order is random; keep the system prompt ahead of messages
+			sort.Slice(names, func(i, j int) bool {
+				si, sj := strings.HasPrefix(names[i], "system"), strings.HasPrefix(names[j], "system")
+				if si != sj {
+					return si
+				}
+				return names[i] < names[j]
+			})
+			for _, k := range names {
+				if s, ok := v[k].(string); ok {
+					if want[k] && strings.TrimSpace(s) != "" {
+						parts = append(parts, s)
+					}
+					continue
+				}
+				walk(v[k])
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+	return strings.Join(parts, "\n\n")
+}
@@ -0,0 +1,96 @@
+package llmdebug
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransportAndLast(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"content": [{"type": "text", "text": "{\"summary\": \"ok\"}"}]}`))
+	}))
+	defer server.Close()
+	root := t.TempDir()
+
+	if _, err := Last(root); !errors.Is(err, ErrNoExchange) {
+		t.Fatalf("expected ErrNoExchange, got %v", err)
+	}
+
+	b := &Bundle{Root: root, ID: "20260101-000000-aaaaaa"}
+	client := &http.Client{Transport: b.Transport(nil)}
+	for _, prompt := range []string{"first", "second"} {
+		body := `{"system": "You are a router assistant", "messages": [{"role": "user", "content": "` + prompt + `"}]}`
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/messages", strings.NewReader(body))
+		req.Header.Set("X-Api-Key", "sk-ant-REDACTED")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(got), "summary") {
+			t.Errorf("transport altered response: %s", got)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(b.Dir(), "*.json"))
+	if len(files) != 2 {
+		t.Fatalf("expected two exchanges, got %v", files)
+	}
+	ex, err := Last(root)
+	if err != nil {
+		t.Fatalf("Last failed: %v", err)
+	}
+	if ex.Seq != 2 || ex.Bundle != b.ID || ex.Status != http.StatusOK {
+		t.Errorf("unexpected exchange: %+v", ex)
+	}
+	if ex.Prompt != "You are a router assistant\n\nsecond" {
+		t.Errorf("unexpected prompt: %q", ex.Prompt)
+	}
+	if ex.Response != `{"summary": "ok"}` {
+		t.Errorf("unexpected response text: %q", ex.Response)
+	}
+}
+
+func TestTransport_RedactsAndRecordsErrors(t *testing.T) {
+	root := t.TempDir()
+	b := &Bundle{Root: root, ID: "20260101-000000-bbbbbb"}
+	client := &http.Client{Transport: b.Transport(nil)}
+	_, err := client.Post("http://127.0.0.1:1/v1/chat?key=AIzaSyA1234567890abcdefghijklmnop", "application/json",
+		strings.NewReader(`{"messages": [{"role": "user", "content": "wifi password is hunter2"}], "password": "hunter2"}`))
+	if err == nil {
+		t.Fatal("expected connection error")
+	}
+	data, _ := os.ReadFile(filepath.Join(b.Dir(), "0001.json"))
+	if len(data) == 0 {
+		t.Fatal("failed exchange was not captured")
+	}
+	if strings.Contains(string(data), "AIzaSy") || strings.Contains(string(data), `"password": "hunter2"`) {
+		t.Errorf("secret written to debug bundle: %s", data)
+	}
+	ex, _ := Last(root)
+	if ex.Error == "" || ex.Status != 0 {
+		t.Errorf("expected error to be recorded: %+v", ex)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	root := t.TempDir()
+	for _, id := range []string{"20250101-000000-000001", "20250101-000000-000002"} {
+		os.MkdirAll(filepath.Join(root, id), 0o700)
+	}
+	for i := 0; i < KeepBundles; i++ {
+		os.MkdirAll(filepath.Join(root, "20260101-000000-00000"+string(rune('a'+i))), 0o700)
+	}
+	prune(root, "20250101-000000-000001")
+	ids := bundleIDs(root)
+	if len(ids) != KeepBundles+1 || ids[0] != "20250101-000000-000001" {
+		t.Errorf("expected oldest non-current bundle removed, got %v", ids)
+	}
+}
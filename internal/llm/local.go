@@ -0,0 +1,243 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/procgroup"
+)
+
+// localMaxTokens bounds the completions of local models unless
+// MaxOutputTokens says otherwise: a plan fits, and a small model that
+// rambles on does not keep a router's CPU busy for minutes.
+const localMaxTokens = 512
+
+// Schemas the llama.cpp server constrains completions to, so a small model
+// cannot answer with anything but the JSON asked for.
+var (
+	localPlanSchema = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"summary": map[string]string{"type": "string"},
+			"commands": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"command":     map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}, "minItems": 1},
+						"description": map[string]string{"type": "string"},
+						"needs_root":  map[string]string{"type": "boolean"},
+					},
+					"required": []string{"command", "description"},
+				},
+			},
+			"warnings": map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}},
+		},
+		"required": []string{"summary", "commands"},
+	}
+	localSummarySchema = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"summary": map[string]string{"type": "string"},
+			"details": map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}},
+		},
+		"required": []string{"summary"},
+	}
+)
+
+// LocalClient plans with a small model running on the router: it runs
+// LocalCommand with the prompt on stdin, or asks the llama.cpp server at
+// LocalEndpoint. Plan prompts are shortened for small models (see
+// prompts.CompactPlanPrompt), and the server is held to the plan's JSON
+// schema.
+type LocalClient struct {
+	tokenCounter
+	httpClient *http.Client
+	cfg        config.Config
+	endpoint   string
+}
+
+func NewLocalClient(cfg config.Config) *LocalClient {
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	// Small models on router CPUs are slow; prompts alone can take a minute
+	if timeout < 120*time.Second {
+		timeout = 120 * time.Second
+	}
+	c := &LocalClient{cfg: cfg, endpoint: cfg.LocalEndpoint}
+	if cfg.Provider == "local" {
+		// Endpoint is that of the local provider, overrides included (see
+		// config.ApplyProviderSettings)
+		c.endpoint = cfg.Endpoint
+	}
+	if c.endpoint == "" {
+		c.endpoint = "http://127.0.0.1:8080"
+	}
+	c.httpClient = withRetries(cfg, "local", newHTTPClient(cfg, timeout))
+	return c
+}
+
+type localReq struct {
+	Prompt      string      `json:"prompt"`
+	NPredict    int         `json:"n_predict"`
+	Temperature *float64    `json:"temperature,omitempty"`
+	TopP        *float64    `json:"top_p,omitempty"`
+	JSONSchema  interface{} `json:"json_schema,omitempty"`
+	CachePrompt bool        `json:"cache_prompt"`
+}
+
+type localResp struct {
+	Content         string `json:"content"`
+	TokensPredicted int    `json:"tokens_predicted"`
+	TokensEvaluated int    `json:"tokens_evaluated"`
+}
+
+// GeneratePlan asks the model for a plan, and once more if its response
+// does not match the plan schema (see repairPlan).
+func (c *LocalClient) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	return repairPlan(ctx, prompt, c.generatePlan)
+}
+
+func (c *LocalClient) generatePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	var zero plan.Plan
+	text, err := c.complete(ctx, prompts.CompactPlanPrompt(prompt), localPlanSchema)
+	if err != nil {
+		return zero, err
+	}
+	p, err := plan.TryUnmarshalPlan(text)
+	if err != nil {
+		return zero, NewParseError("local", "plan extraction", text, err)
+	}
+	return p, nil
+}
+
+func (c *LocalClient) GenerateErrorFix(ctx context.Context, originalCommand string, errorOutput string, attempt int) (plan.Plan, error) {
+	prompt := prompts.GenerateErrorFixPrompt(originalCommand, errorOutput, attempt)
+	return c.GeneratePlan(ctx, prompt)
+}
+
+// Summarize sends a summarization prompt and returns the summary plus optional detail bullets.
+func (c *LocalClient) Summarize(ctx context.Context, prompt string) (string, []string, error) {
+	text, err := c.complete(ctx, prompt, localSummarySchema)
+	if err != nil {
+		return "", nil, err
+	}
+	summary, details := parseSummary(strings.TrimSpace(text))
+	return summary, details, nil
+}
+
+// complete returns the model's completion of prompt, held to schema by the
+// llama.cpp server; a local command gets no schema.
+func (c *LocalClient) complete(ctx context.Context, prompt string, schema interface{}) (string, error) {
+	if argv := strings.Fields(c.cfg.LocalCommand); len(argv) > 0 {
+		return c.run(ctx, argv, prompt)
+	}
+	body := localReq{
+		Prompt:      prompt,
+		NPredict:    c.cfg.MaxOutputTokens,
+		Temperature: c.cfg.Temperature,
+		TopP:        c.cfg.TopP,
+		JSONSchema:  schema,
+		CachePrompt: true,
+	}
+	if body.NPredict <= 0 {
+		body.NPredict = localMaxTokens
+	}
+	b, release, err := encodeRequest(body)
+	if err != nil {
+		return "", fmt.Errorf("marshal request: %w", err)
+	}
+	defer release()
+	url := strings.TrimSuffix(c.endpoint, "/") + "/completion"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, b)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", NewAPIError("local", 0, "request cancelled", ErrContextCancelled)
+		}
+		return "", NewAPIError("local", 0, "request failed", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data := readErrorBody(resp.Body)
+		return "", NewAPIError("local", resp.StatusCode, string(data), ErrRequestFailed)
+	}
+	var lr localResp
+	if err := decodeResponse(resp.Body, &lr); err != nil {
+		return "", NewParseError("local", "response decoding", "", err)
+	}
+	c.addTokens(lr.TokensPredicted + lr.TokensEvaluated)
+	if strings.TrimSpace(lr.Content) == "" {
+		return "", NewAPIError("local", 0, "empty response from the model", ErrInvalidResponse)
+	}
+	return lr.Content, nil
+}
+
+// run completes prompt with the local command argv.
+func (c *LocalClient) run(ctx context.Context, argv []string, prompt string) (string, error) {
+	cmd := procgroup.KillOnCancel(exec.CommandContext(ctx, argv[0], argv[1:]...))
+	cmd.Stdin = strings.NewReader(prompt)
+	var stdout bytes.Buffer
+	cmd.Stdout = &cappedWriter{w: &stdout, n: maxResponseBodySize}
+	// Inference tools log freely on stderr and end with what went wrong
+	stderr := &tailWriter{n: maxErrorBodySize}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", NewAPIError("local", 0, "command cancelled", ErrContextCancelled)
+		}
+		if errors.Is(err, ErrResponseTooLarge) {
+			return "", NewParseError("local", "response reading", "", err)
+		}
+		msg := "command failed"
+		lines := strings.Split(strings.TrimSpace(string(stderr.buf)), "\n")
+		if line := lines[len(lines)-1]; line != "" {
+			msg += ": " + line
+		}
+		return "", NewAPIError("local", 0, msg, err)
+	}
+	if strings.TrimSpace(stdout.String()) == "" {
+		return "", NewAPIError("local", 0, "empty response from the model", ErrInvalidResponse)
+	}
+	return stdout.String(), nil
+}
+
+// cappedWriter is cappedReader for the output of a local command.
+type cappedWriter struct {
+	w *bytes.Buffer
+	n int64
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > c.n {
+		return 0, ErrResponseTooLarge
+	}
+	c.n -= int64(len(p))
+	return c.w.Write(p)
+}
+
+// tailWriter keeps the last n bytes written to it.
+type tailWriter struct {
+	buf []byte
+	n   int
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.n {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.n:]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,166 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/intent"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+const localPlanJSON = `{"summary": "show the lan address", "commands": [{"command": ["uci", "get", "network.lan.ipaddr"], "description": "LAN address"}]}`
+
+// localServer is a llama.cpp server answering /completion with content.
+func localServer(t *testing.T, content string, seen *localReq) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/completion" {
+			http.NotFound(w, r)
+			return
+		}
+		if seen != nil {
+			if err := json.NewDecoder(r.Body).Decode(seen); err != nil {
+				t.Errorf("bad request: %v", err)
+			}
+		}
+		json.NewEncoder(w).Encode(localResp{Content: content, TokensPredicted: 40, TokensEvaluated: 200})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLocalClient_Server(t *testing.T) {
+	var seen localReq
+	srv := localServer(t, localPlanJSON, &seen)
+	cfg := config.Config{Provider: "local", Endpoint: srv.URL}
+	c := NewLocalClient(cfg)
+
+	prompt := prompts.GeneratePlanPrompt(intent.Read, 5) + prompts.ExamplesBlock("show the lan address", 1) +
+		"\n\nUser request: show the lan address"
+	p, err := c.GeneratePlan(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(p.Commands) != 1 || p.Commands[0].Command[0] != "uci" {
+		t.Errorf("unexpected plan %+v", p)
+	}
+	if c.TokensUsed() != 240 {
+		t.Errorf("expected 240 tokens, got %d", c.TokensUsed())
+	}
+	if seen.NPredict != localMaxTokens || seen.JSONSchema == nil || !seen.CachePrompt {
+		t.Errorf("unexpected request %+v", seen)
+	}
+	if seen.Prompt != prompts.CompactPlanPrompt(prompt) || strings.Contains(seen.Prompt, "Examples of correct plans") {
+		t.Errorf("expected the compact prompt, got:\n%s", seen.Prompt)
+	}
+
+	summary, _, err := c.Summarize(context.Background(), "summarize")
+	if err != nil || summary != "show the lan address" {
+		t.Errorf("unexpected summary %q, %v", summary, err)
+	}
+}
+
+func TestLocalClient_Command(t *testing.T) {
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ok := script("ok", "cat >"+filepath.Join(dir, "prompt")+"\necho '"+localPlanJSON+"'\n")
+	c := NewLocalClient(config.Config{Provider: "local", LocalCommand: ok})
+	p, err := c.GeneratePlan(context.Background(), "\n\nUser request: show the lan address")
+	if err != nil || len(p.Commands) != 1 {
+		t.Fatalf("unexpected plan %+v, %v", p, err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "prompt")); !strings.Contains(string(b), "show the lan address") {
+		t.Errorf("expected the prompt on stdin, got %q", b)
+	}
+
+	fail := script("fail", "echo 'loading model' >&2\necho 'error: model not found' >&2\nexit 1\n")
+	c = NewLocalClient(config.Config{Provider: "local", LocalCommand: fail + " -m model.gguf"})
+	_, err = c.GeneratePlan(context.Background(), "x")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !strings.Contains(apiErr.Message, "error: model not found") {
+		t.Errorf("expected the last stderr line in the error, got %v", err)
+	}
+
+	empty := script("empty", "cat >/dev/null\n")
+	c = NewLocalClient(config.Config{Provider: "local", LocalCommand: empty})
+	if _, err = c.GeneratePlan(context.Background(), "x"); !errors.Is(err, ErrInvalidResponse) {
+		t.Errorf("expected ErrInvalidResponse, got %v", err)
+	}
+}
+
+func TestFallbackProvider(t *testing.T) {
+	srv := localServer(t, localPlanJSON, nil)
+	cloud := &stubPlanProvider{plan: plan.Plan{Summary: "cloud"}}
+	p := newFallbackProvider(config.Config{Provider: "gemini", LocalEndpoint: srv.URL}, cloud)
+
+	got, err := p.GeneratePlan(context.Background(), "x")
+	if err != nil || got.Summary != "cloud" || got.FallbackFrom != "" {
+		t.Fatalf("a reachable provider must plan, got %+v, %v", got, err)
+	}
+
+	for _, unreachableErr := range []error{
+		fmt.Errorf("preflight: %w", ErrOffline),
+		fmt.Errorf("gemini: %w", ErrCircuitOpen),
+		NewAPIError("gemini", 503, "overloaded", ErrRequestFailed),
+		NewAPIError("gemini", 0, "request failed", errors.New("dial tcp: no route to host")),
+	} {
+		cloud.err = unreachableErr
+		got, err = p.GeneratePlan(context.Background(), "x")
+		if err != nil || got.Summary != "show the lan address" || got.FallbackFrom != "gemini" {
+			t.Errorf("%v: expected the local plan, got %+v, %v", unreachableErr, got, err)
+		}
+	}
+
+	for _, refusal := range []error{
+		NewAPIError("gemini", 401, "bad key", ErrRequestFailed),
+		NewAPIError("gemini", 0, "missing key", ErrNoAPIKey),
+		NewAPIError("gemini", 0, "empty response from API", ErrInvalidResponse),
+	} {
+		cloud.err = refusal
+		if _, err = p.GeneratePlan(context.Background(), "x"); err != refusal {
+			t.Errorf("%v: expected no fallback, got %v", refusal, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cloud.err = NewAPIError("gemini", 0, "request failed", context.Canceled)
+	if _, err = p.GeneratePlan(ctx, "x"); err != cloud.err {
+		t.Errorf("a cancelled request must not fall back, got %v", err)
+	}
+
+	down := newFallbackProvider(config.Config{Provider: "gemini", LocalEndpoint: "http://127.0.0.1:1"}, cloud)
+	cloud.err = fmt.Errorf("preflight: %w", ErrOffline)
+	if _, err = down.GeneratePlan(context.Background(), "x"); !errors.Is(err, ErrOffline) || !strings.Contains(err.Error(), "local fallback") {
+		t.Errorf("expected both errors, got %v", err)
+	}
+}
+
+func TestNewProvider_Local(t *testing.T) {
+	if _, ok := NewProvider(config.Config{Provider: "local"}).(*LocalClient); !ok {
+		t.Fatal("expected a local client")
+	}
+	if _, ok := NewProvider(config.Config{Provider: "local", LocalFallback: true}).(*LocalClient); !ok {
+		t.Fatal("the local provider must not fall back to itself")
+	}
+	p := NewProvider(config.Config{Provider: "gemini", LocalFallback: true})
+	if _, ok := p.(fallbackEmbedder); !ok {
+		t.Fatalf("expected a fallback provider keeping the embeddings API, got %T", p)
+	}
+}
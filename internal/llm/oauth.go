@@ -0,0 +1,26 @@
+package llm
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/auth"
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+// useOAuth wraps hc so requests carry the OAuth token stored for provider by
+// `lucicodex login`, refreshing it on expiry or a 401. It reports false, leaving
+// hc untouched, when no token is stored and the static API key should be used.
+func useOAuth(cfg config.Config, provider string, hc *http.Client) bool {
+	store := auth.NewStore(cfg.TokenFile)
+	if err := store.Load(); err != nil {
+		return false
+	}
+	if _, ok := store.Get(provider); !ok {
+		return false
+	}
+	// Refreshes go through a separate client so they are not themselves authorized
+	src := auth.NewTokenSource(auth.ConfigFor(cfg, provider), store, newHTTPClient(cfg, 30*time.Second))
+	hc.Transport = &auth.Transport{Source: src, Base: hc.Transport}
+	return true
+}
@@ -1,10 +1,7 @@
 package llm
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -16,8 +13,10 @@ import (
 )
 
 type OpenAIClient struct {
+	tokenCounter
 	httpClient *http.Client
 	cfg        config.Config
+	oauth      bool // authorized by a stored OAuth token instead of the API key
 }
 
 func NewOpenAIClient(cfg config.Config) *OpenAIClient {
@@ -26,7 +25,9 @@ func NewOpenAIClient(cfg config.Config) *OpenAIClient {
 	if timeout < 60*time.Second {
 		timeout = 60 * time.Second
 	}
-	return &OpenAIClient{httpClient: newHTTPClient(cfg, timeout), cfg: cfg}
+	c := &OpenAIClient{httpClient: withRetries(cfg, "openai", newHTTPClient(cfg, timeout)), cfg: cfg}
+	c.oauth = useOAuth(cfg, "openai", c.httpClient)
+	return c
 }
 
 type openaiMessage struct {
@@ -35,9 +36,27 @@ type openaiMessage struct {
 }
 
 type openaiReq struct {
-	Model          string            `json:"model"`
-	Messages       []openaiMessage   `json:"messages"`
-	ResponseFormat map[string]string `json:"response_format,omitempty"`
+	Model               string            `json:"model"`
+	Messages            []openaiMessage   `json:"messages"`
+	ResponseFormat      map[string]string `json:"response_format,omitempty"`
+	Temperature         *float64          `json:"temperature,omitempty"`
+	TopP                *float64          `json:"top_p,omitempty"`
+	MaxCompletionTokens int               `json:"max_completion_tokens,omitempty"`
+	ReasoningEffort     string            `json:"reasoning_effort,omitempty"`
+}
+
+// newRequest builds a JSON-mode chat request with the configured generation
+// parameters applied.
+func (c *OpenAIClient) newRequest(model, prompt string) openaiReq {
+	return openaiReq{
+		Model:               model,
+		Messages:            []openaiMessage{{Role: "user", Content: prompt}},
+		ResponseFormat:      map[string]string{"type": "json_object"},
+		Temperature:         c.cfg.Temperature,
+		TopP:                c.cfg.TopP,
+		MaxCompletionTokens: c.cfg.MaxOutputTokens,
+		ReasoningEffort:     c.cfg.ReasoningEffort,
+	}
 }
 
 type openaiResp struct {
@@ -46,18 +65,21 @@ type openaiResp struct {
 			Content string `json:"content"`
 		} `json:"message"`
 	} `json:"choices"`
+	Usage struct {
+		TotalTokens int `json:"total_tokens"`
+	} `json:"usage"`
 }
 
-type openaiSummary struct {
-	Summary string   `json:"summary"`
-	Details []string `json:"details,omitempty"`
-	Status  string   `json:"status,omitempty"`
+// GeneratePlan asks the model for a plan, and once more if its response
+// does not match the plan schema (see repairPlan).
+func (c *OpenAIClient) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	return repairPlan(ctx, prompt, c.generatePlan)
 }
 
-func (c *OpenAIClient) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+func (c *OpenAIClient) generatePlan(ctx context.Context, prompt string) (plan.Plan, error) {
 	var zero plan.Plan
-	if c.cfg.OpenAIAPIKey == "" {
-		return zero, errors.New("missing OpenAI API key - configure it in LuCI or set OPENAI_API_KEY environment variable")
+	if c.cfg.OpenAIAPIKey == "" && !c.oauth {
+		return zero, NewAPIError("openai", 0, "missing OpenAI API key - configure it in LuCI or set OPENAI_API_KEY environment variable", ErrNoAPIKey)
 	}
 	model := c.cfg.Model
 	if model == "" {
@@ -71,14 +93,13 @@ func (c *OpenAIClient) GeneratePlan(ctx context.Context, prompt string) (plan.Pl
 	// Ensure endpoint ends properly for chat completions
 	url := strings.TrimSuffix(endpoint, "/") + "/chat/completions"
 
-	body := openaiReq{Model: model}
-	body.Messages = []openaiMessage{{Role: "user", Content: prompt}}
-	body.ResponseFormat = map[string]string{"type": "json_object"}
-	b, err := json.Marshal(body)
+	body := c.newRequest(model, prompt)
+	b, release, err := encodeRequest(body)
 	if err != nil {
 		return zero, fmt.Errorf("marshal request: %w", err)
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	defer release()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, b)
 	if err != nil {
 		return zero, err
 	}
@@ -86,22 +107,30 @@ func (c *OpenAIClient) GeneratePlan(ctx context.Context, prompt string) (plan.Pl
 	req.Header.Set("Authorization", "Bearer "+c.cfg.OpenAIAPIKey)
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return zero, err
+		if ctx.Err() != nil {
+			return zero, NewAPIError("openai", 0, "request cancelled", ErrContextCancelled)
+		}
+		return zero, NewAPIError("openai", 0, "request failed", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		data := readErrorBody(resp.Body)
-		return zero, fmt.Errorf("openai http %d: %s", resp.StatusCode, string(data))
+		return zero, NewAPIError("openai", resp.StatusCode, string(data), ErrRequestFailed)
 	}
 	var or openaiResp
-	if err := json.NewDecoder(resp.Body).Decode(&or); err != nil {
-		return zero, err
+	if err := decodeResponse(resp.Body, &or); err != nil {
+		return zero, NewParseError("openai", "response decoding", "", err)
 	}
+	c.addTokens(or.Usage.TotalTokens)
 	if len(or.Choices) == 0 {
-		return zero, errors.New("empty response")
+		return zero, NewAPIError("openai", 0, "empty response from API", ErrInvalidResponse)
 	}
 	text := or.Choices[0].Message.Content
-	return plan.TryUnmarshalPlan(text)
+	p, err := plan.TryUnmarshalPlan(text)
+	if err != nil {
+		return zero, NewParseError("openai", "plan extraction", text, err)
+	}
+	return p, nil
 }
 
 func (c *OpenAIClient) GenerateErrorFix(ctx context.Context, originalCommand string, errorOutput string, attempt int) (plan.Plan, error) {
@@ -111,8 +140,8 @@ func (c *OpenAIClient) GenerateErrorFix(ctx context.Context, originalCommand str
 
 // Summarize sends a summarization prompt and returns the summary plus optional detail bullets.
 func (c *OpenAIClient) Summarize(ctx context.Context, prompt string) (string, []string, error) {
-	if c.cfg.OpenAIAPIKey == "" {
-		return "", nil, errors.New("missing OpenAI API key - configure it in LuCI or set OPENAI_API_KEY environment variable")
+	if c.cfg.OpenAIAPIKey == "" && !c.oauth {
+		return "", nil, NewAPIError("openai", 0, "missing OpenAI API key - configure it in LuCI or set OPENAI_API_KEY environment variable", ErrNoAPIKey)
 	}
 
 	model := c.cfg.Model
@@ -126,17 +155,14 @@ func (c *OpenAIClient) Summarize(ctx context.Context, prompt string) (string, []
 	}
 	url := strings.TrimSuffix(endpoint, "/") + "/chat/completions"
 
-	body := openaiReq{
-		Model:          model,
-		Messages:       []openaiMessage{{Role: "user", Content: prompt}},
-		ResponseFormat: map[string]string{"type": "json_object"},
-	}
+	body := c.newRequest(model, prompt)
 
-	b, err := json.Marshal(body)
+	b, release, err := encodeRequest(body)
 	if err != nil {
 		return "", nil, fmt.Errorf("marshal request: %w", err)
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	defer release()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, b)
 	if err != nil {
 		return "", nil, err
 	}
@@ -145,29 +171,98 @@ func (c *OpenAIClient) Summarize(ctx context.Context, prompt string) (string, []
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return "", nil, err
+		if ctx.Err() != nil {
+			return "", nil, NewAPIError("openai", 0, "request cancelled", ErrContextCancelled)
+		}
+		return "", nil, NewAPIError("openai", 0, "request failed", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		data := readErrorBody(resp.Body)
-		return "", nil, fmt.Errorf("openai http %d: %s", resp.StatusCode, string(data))
+		return "", nil, NewAPIError("openai", resp.StatusCode, string(data), ErrRequestFailed)
 	}
 
 	var or openaiResp
-	if err := json.NewDecoder(resp.Body).Decode(&or); err != nil {
-		return "", nil, err
+	if err := decodeResponse(resp.Body, &or); err != nil {
+		return "", nil, NewParseError("openai", "response decoding", "", err)
 	}
+	c.addTokens(or.Usage.TotalTokens)
 	if len(or.Choices) == 0 {
-		return "", nil, errors.New("empty response")
+		return "", nil, NewAPIError("openai", 0, "empty response from API", ErrInvalidResponse)
 	}
 
-	text := or.Choices[0].Message.Content
-	var parsed openaiSummary
-	if err := json.Unmarshal([]byte(text), &parsed); err == nil && parsed.Summary != "" {
-		return parsed.Summary, parsed.Details, nil
+	summary, details := parseSummary(or.Choices[0].Message.Content)
+	return summary, details, nil
+}
+
+type openaiEmbeddingReq struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type openaiEmbeddingResp struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+// EmbeddingModel returns the configured embedding model or the OpenAI default.
+func (c *OpenAIClient) EmbeddingModel() string {
+	if c.cfg.EmbeddingModel != "" {
+		return c.cfg.EmbeddingModel
+	}
+	return "text-embedding-3-small"
+}
+
+// Embed returns one embedding vector per input text using the embeddings API.
+func (c *OpenAIClient) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	if c.cfg.OpenAIAPIKey == "" && !c.oauth {
+		return nil, NewAPIError("openai", 0, "missing OpenAI API key - configure it in LuCI or set OPENAI_API_KEY environment variable", ErrNoAPIKey)
+	}
+	endpoint := c.cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.openai.com/v1"
 	}
+	url := strings.TrimSuffix(endpoint, "/") + "/embeddings"
 
-	// Fallback: return raw text if JSON parsing failed
-	return text, nil, nil
+	b, release, err := encodeRequest(openaiEmbeddingReq{Model: c.EmbeddingModel(), Input: texts})
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+	defer release()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, b)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.cfg.OpenAIAPIKey)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, NewAPIError("openai", 0, "request cancelled", ErrContextCancelled)
+		}
+		return nil, NewAPIError("openai", 0, "request failed", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data := readErrorBody(resp.Body)
+		return nil, NewAPIError("openai", resp.StatusCode, string(data), ErrRequestFailed)
+	}
+	var er openaiEmbeddingResp
+	if err := decodeResponse(resp.Body, &er); err != nil {
+		return nil, NewParseError("openai", "response decoding", "", err)
+	}
+	if len(er.Data) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(er.Data))
+	}
+	out := make([][]float32, len(texts))
+	for _, d := range er.Data {
+		if d.Index < 0 || d.Index >= len(out) {
+			return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+		}
+		out[d.Index] = d.Embedding
+	}
+	return out, nil
 }
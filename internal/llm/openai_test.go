@@ -110,7 +110,7 @@ func TestOpenAIClient_Error(t *testing.T) {
 	_, err := client.GeneratePlan(context.Background(), "test")
 
 	testutil.AssertError(t, err)
-	testutil.AssertContains(t, err.Error(), "openai http 400")
+	testutil.AssertContains(t, err.Error(), "openai API error (HTTP 400)")
 	testutil.AssertContains(t, err.Error(), "invalid key")
 }
 
@@ -156,3 +156,57 @@ func TestOpenAIClient_EdgeCases(t *testing.T) {
 	testutil.AssertError(t, err)
 	testutil.AssertContains(t, err.Error(), "empty response")
 }
+
+func TestOpenAIClient_Embed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/embeddings" {
+			t.Errorf("expected path /embeddings, got %s", r.URL.Path)
+		}
+		var req openaiEmbeddingReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Model != "text-embedding-3-small" || len(req.Input) != 2 {
+			t.Errorf("unexpected request: %+v", req)
+		}
+		// Return out of order to verify index handling
+		w.Write([]byte(`{"data": [{"index": 1, "embedding": [0, 1]}, {"index": 0, "embedding": [1, 0]}]}`))
+	}))
+	defer server.Close()
+
+	client := NewOpenAIClient(config.Config{OpenAIAPIKey: "test-key", Endpoint: server.URL})
+	vecs, err := client.Embed(context.Background(), []string{"a", "b"})
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, len(vecs), 2)
+	testutil.AssertEqual(t, vecs[0][0], float32(1))
+	testutil.AssertEqual(t, vecs[1][1], float32(1))
+}
+
+func TestOpenAIClient_GenerationParams(t *testing.T) {
+	var got map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = nil
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"choices":[{"message":{"content":"{\"summary\":\"ok\",\"commands\":[]}"}}]}`))
+	}))
+	defer server.Close()
+
+	cfg := config.Config{OpenAIAPIKey: "k", Model: "gpt-4o-mini", Endpoint: server.URL}
+	if _, err := NewOpenAIClient(cfg).GeneratePlan(context.Background(), "p"); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"temperature", "top_p", "max_completion_tokens", "reasoning_effort"} {
+		if _, ok := got[k]; ok {
+			t.Errorf("%s sent without being configured", k)
+		}
+	}
+
+	topP := 0.9
+	cfg.TopP = &topP
+	cfg.MaxOutputTokens = 800
+	cfg.ReasoningEffort = "low"
+	if _, _, err := NewOpenAIClient(cfg).Summarize(context.Background(), "p"); err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertEqual(t, got["top_p"], 0.9)
+	testutil.AssertEqual(t, got["max_completion_tokens"], float64(800))
+	testutil.AssertEqual(t, got["reasoning_effort"], "low")
+}
@@ -0,0 +1,95 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// preflightTimeout bounds the connectivity check made before each request.
+const preflightTimeout = 2 * time.Second
+
+// preflightTransport checks that the endpoint of each request, or the proxy
+// it goes through, resolves and accepts a TCP connection before sending the
+// request. When the WAN is down the request then fails with ErrOffline
+// within preflightTimeout instead of hanging until the request times out.
+type preflightTransport struct {
+	base  http.RoundTripper
+	proxy func(*http.Request) (*url.URL, error)
+	// Replaced in tests
+	lookupHost  func(ctx context.Context, host string) ([]string, error)
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func newPreflightTransport(base http.RoundTripper, proxy func(*http.Request) (*url.URL, error)) *preflightTransport {
+	return &preflightTransport{
+		base:        base,
+		proxy:       proxy,
+		lookupHost:  net.DefaultResolver.LookupHost,
+		dialContext: (&net.Dialer{}).DialContext,
+	}
+}
+
+func (t *preflightTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.check(req); err != nil {
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// check resolves the host req connects to first and dials its addresses in
+// turn, as net.Dialer does, until one accepts.
+func (t *preflightTransport) check(req *http.Request) error {
+	target := req.URL
+	if t.proxy != nil {
+		if u, err := t.proxy(req); err == nil && u != nil {
+			target = u
+		}
+	}
+	host, port := target.Hostname(), target.Port()
+	if port == "" {
+		port = "443"
+		if target.Scheme == "http" {
+			port = "80"
+		}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), preflightTimeout)
+	defer cancel()
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		var err error
+		addrs, err = t.lookupHost(ctx, host)
+		if err == nil && len(addrs) == 0 {
+			err = errors.New("no addresses")
+		}
+		if err != nil {
+			return fmt.Errorf("%w: cannot resolve %s: %v", ErrOffline, host, err)
+		}
+	}
+	var firstErr error
+	for i, addr := range addrs {
+		// Each address gets an equal share of the time left
+		deadline, _ := ctx.Deadline()
+		dctx, dcancel := context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(addrs)-i))
+		conn, err := t.dialContext(dctx, "tcp", net.JoinHostPort(addr, port))
+		dcancel()
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("%w: cannot connect to %s: %v", ErrOffline, net.JoinHostPort(host, port), firstErr)
+}
@@ -0,0 +1,114 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+func TestPreflightTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	tr := newPreflightTransport(http.DefaultTransport, nil)
+	client := &http.Client{Transport: tr}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("a reachable endpoint must pass: %v", err)
+	}
+	resp.Body.Close()
+
+	// A closed port fails the dial
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	if _, err := client.Get("http://" + closed); !errors.Is(err, ErrOffline) {
+		t.Fatalf("expected ErrOffline for a closed port, got %v", err)
+	}
+
+	// DNS failure, without touching the network
+	tr.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	start := time.Now()
+	_, err = client.Get("https://generativelanguage.googleapis.com/v1beta")
+	if !errors.Is(err, ErrOffline) {
+		t.Fatalf("expected ErrOffline when DNS fails, got %v", err)
+	}
+	if time.Since(start) > preflightTimeout {
+		t.Fatalf("the check took %s", time.Since(start))
+	}
+	if code := NewAPIError("gemini", 0, "request failed", err).ErrorCode(); code != errcode.Offline {
+		t.Fatalf("expected %s, got %s", errcode.Offline, code)
+	}
+}
+
+func TestPreflightTransport_EveryAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	tr := newPreflightTransport(http.DefaultTransport, nil)
+	tr.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"2001:db8::1", "127.0.0.1"}, nil
+	}
+	var dialed []string
+	tr.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr != net.JoinHostPort("127.0.0.1", port) {
+			return nil, errors.New("network is unreachable")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	req, _ := http.NewRequest("GET", "http://llm.example:"+port, nil)
+	if err := tr.check(req); err != nil {
+		t.Fatalf("the second address accepts, got %v", err)
+	}
+	if len(dialed) != 2 {
+		t.Errorf("expected both addresses dialed, got %v", dialed)
+	}
+
+	tr.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"2001:db8::1", "2001:db8::2"}, nil
+	}
+	dialed = nil
+	if err := tr.check(req); !errors.Is(err, ErrOffline) || len(dialed) != 2 {
+		t.Errorf("expected ErrOffline after both addresses, got %v (dialed %v)", err, dialed)
+	}
+}
+
+func TestPreflightTransport_Proxy(t *testing.T) {
+	var dialed string
+	tr := newPreflightTransport(roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}), func(*http.Request) (*url.URL, error) {
+		return url.Parse("http://10.0.0.2:3128")
+	})
+	tr.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+	req, _ := http.NewRequest(http.MethodPost, "https://api.openai.com/v1/chat/completions", nil)
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if dialed != "10.0.0.2:3128" {
+		t.Fatalf("expected the proxy to be checked, dialed %q", dialed)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
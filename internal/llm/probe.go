@@ -0,0 +1,44 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+// Probe checks that the endpoint of the configured provider answers, through
+// the configured proxy and TLS pins. Any HTTP response counts, as requests
+// without a key are expected to be refused; only network and TLS errors
+// fail. It sends no API key and uses no tokens. For a local provider
+// running a command, it checks that the command exists.
+func Probe(ctx context.Context, cfg config.Config) error {
+	if cfg.ReplayDir != "" {
+		// Replays need no provider
+		return nil
+	}
+	cfg.ApplyProviderSettings()
+	if argv := strings.Fields(cfg.LocalCommand); cfg.Provider == "local" && len(argv) > 0 {
+		if _, err := exec.LookPath(argv[0]); err != nil {
+			return fmt.Errorf("local command: %w", err)
+		}
+		return nil
+	}
+	cfg.RecordDir, cfg.DebugLLM, cfg.HTTPTrace = "", false, nil
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, cfg.Endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("%s endpoint %q: %w", cfg.Provider, cfg.Endpoint, err)
+	}
+	resp, err := newHTTPClient(cfg, 10*time.Second).Do(req)
+	if err != nil {
+		return fmt.Errorf("%s endpoint unreachable: %w", cfg.Provider, err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBodySize))
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,40 @@
+package prompts
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Clarification is a question the model asked instead of planning (see
+// plan.Plan.Questions) and the user's answer.
+type Clarification struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+// NoQuestionsNotice is added to a plan prompt when nobody can answer a
+// clarifying question.
+const NoQuestionsNotice = "\n\nThe user cannot answer questions: do not return questions. Plan for the most likely interpretation and state the assumption in warnings."
+
+// ClarificationBlock gives the model the user's answers to its questions.
+// With final, the model may not ask again. It returns "" without answers.
+func ClarificationBlock(answers []Clarification, final bool) string {
+	if len(answers) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n\nYou asked the user to clarify the request; the answers are:\n")
+	for _, c := range answers {
+		answer := strings.Join(strings.Fields(c.Answer), " ")
+		if answer == "" {
+			answer = "(no answer)"
+		}
+		fmt.Fprintf(&b, "Q: %s\nA: %s\n", strings.Join(strings.Fields(c.Question), " "), answer)
+	}
+	if final {
+		b.WriteString("Do not ask further questions: plan with these answers, or explain in the summary what is still missing.")
+	} else {
+		b.WriteString("Plan with these answers; ask again only if the request is still ambiguous.")
+	}
+	return b.String()
+}
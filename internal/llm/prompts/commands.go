@@ -0,0 +1,40 @@
+package prompts
+
+import (
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/cmdref"
+)
+
+// SelectCommands returns up to k snippets of the command reference most
+// similar to request, scored like SelectExamples by the shared words of the
+// request and each snippet's tool, usage and keywords.
+func SelectCommands(request string, k int) []cmdref.Snippet {
+	texts := make([]string, len(cmdref.Snippets))
+	for i, s := range cmdref.Snippets {
+		texts[i] = s.Tool + " " + s.Usage + " " + strings.Join(s.Keywords, " ")
+	}
+	var selected []cmdref.Snippet
+	for _, i := range rank(texts, request, k) {
+		selected = append(selected, cmdref.Snippets[i])
+	}
+	return selected
+}
+
+// FormatCommands renders snippets as a prompt block.
+func FormatCommands(snippets []cmdref.Snippet) string {
+	if len(snippets) == 0 {
+		return ""
+	}
+	b := &strings.Builder{}
+	b.WriteString("\n\nOpenWrt command reference (use only these subcommands and flags of these tools):\n")
+	for _, s := range snippets {
+		b.WriteString("- " + s.Usage + ": " + s.Text + "\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// CommandsBlock is FormatCommands of the k snippets most similar to request.
+func CommandsBlock(request string, k int) string {
+	return FormatCommands(SelectCommands(request, k))
+}
@@ -0,0 +1,36 @@
+package prompts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/intent"
+)
+
+func TestSelectCommands(t *testing.T) {
+	got := SelectCommands("restart the wifi after changing the ssid", 2)
+	if len(got) == 0 || got[0].Tool != "wifi" {
+		t.Fatalf("expected a wifi snippet first, got %+v", got)
+	}
+	if got := SelectCommands("install tcpdump", 1); len(got) != 1 || got[0].Tool != "opkg" {
+		t.Errorf("expected the opkg install snippet, got %+v", got)
+	}
+	if got := SelectCommands("install tcpdump", 0); got != nil {
+		t.Errorf("expected no snippets for k=0, got %+v", got)
+	}
+	if got := SelectCommands("xyzzy", 3); len(got) != 0 {
+		t.Errorf("expected no snippets without shared words, got %+v", got)
+	}
+
+	block := CommandsBlock("open a port on the firewall", 2)
+	if !strings.HasPrefix(block, "\n\nOpenWrt command reference") || !strings.Contains(block, "fw4 reload") {
+		t.Errorf("unexpected block:\n%s", block)
+	}
+
+	// The reference belongs to the request section of a plan prompt
+	instruction := GeneratePlanPrompt(intent.Read, 5)
+	s := Split(instruction + block + "\n\nUser request: open a port")
+	if s.Instructions != instruction || !strings.HasPrefix(s.Request, "OpenWrt command reference") {
+		t.Errorf("unexpected sections %+v", s)
+	}
+}
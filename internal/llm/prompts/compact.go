@@ -0,0 +1,42 @@
+package prompts
+
+import "strings"
+
+// compactInstructions replace those of GeneratePlanPrompt for small local
+// models, which follow a few plain rules and a flat schema better than the
+// full instructions, and have little context to spare.
+const compactInstructions = planPreamble + ` Reply with one JSON object and nothing else:
+{"summary": string, "commands": [{"command": [string, ...], "description": string, "needs_root": bool}], "warnings": [string]}
+Rules:
+- Each command is an argv array: no shell syntax (|, >, &&, $()).
+- Use OpenWrt tools: uci, ubus, logread, dmesg, wifi, ip, opkg.
+- Questions about the router get read-only commands; change it only when asked to.
+- After uci set, add uci commit for the same config.
+- For a greeting, "commands" is [] and "summary" replies.`
+
+// CompactPlanPrompt shortens a plan prompt built on GeneratePlanPrompt for
+// a small model: the instructions become compactInstructions with the
+// command limit of the original, the environment facts are kept, and of the
+// rest only the user request and what follows it are kept, without the
+// examples, command reference and documentation. Other prompts are returned
+// as they are.
+func CompactPlanPrompt(prompt string) string {
+	s := Split(prompt)
+	if s.Instructions == "" {
+		return prompt
+	}
+	b := &strings.Builder{}
+	b.WriteString(compactInstructions)
+	// The command limit is the last paragraph of the instructions
+	if i := strings.LastIndex(s.Instructions, "\n\n"); i >= 0 {
+		b.WriteString("\n" + strings.TrimSpace(s.Instructions[i:]))
+	}
+	if s.Facts != "" {
+		b.WriteString("\n\n" + strings.TrimSpace(s.Facts))
+	}
+	rest := "\n\n" + s.Request
+	if i := strings.Index(rest, requestHeader); i >= 0 {
+		b.WriteString(rest[i:])
+	}
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package prompts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/intent"
+)
+
+func TestCompactPlanPrompt(t *testing.T) {
+	instruction := GeneratePlanPrompt(intent.Read, 5)
+	facts := "Environment facts (read-only; collected 2026-10-17T00:00:00Z):\n# uci show network\nnetwork.lan.proto='static'"
+	prompt := instruction + ExamplesBlock("open port 22 on the firewall", 1) + CommandsBlock("open port 22", 1) +
+		"\n\n" + facts + "\n\nUser request: show the lan address" + NoQuestionsNotice
+
+	got := CompactPlanPrompt(prompt)
+	for _, want := range []string{
+		compactInstructions,
+		"use up to 5 read-only commands",
+		facts,
+		"User request: show the lan address" + NoQuestionsNotice,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("compact prompt lacks %q:\n%s", want, got)
+		}
+	}
+	for _, dropped := range []string{"Examples of correct plans", "OpenWrt command reference", "BE ACTION-ORIENTED"} {
+		if strings.Contains(got, dropped) {
+			t.Errorf("compact prompt keeps %q", dropped)
+		}
+	}
+	if len(got) >= len(prompt)/2 {
+		t.Errorf("expected the prompt to shrink by half, %d of %d bytes", len(got), len(prompt))
+	}
+
+	// Other prompts are left alone
+	fix := GenerateErrorFixPrompt("logread", "not found", 1)
+	if CompactPlanPrompt(fix) != fix {
+		t.Error("expected an error fix prompt to be kept")
+	}
+}
@@ -0,0 +1,150 @@
+package prompts
+
+import (
+	_ "embed"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Example is a curated request with a plan known to be correct, shown to
+// the model as few-shot context for similar requests.
+type Example struct {
+	Request  string    `json:"request"`
+	Keywords []string  `json:"keywords"`
+	Plan     plan.Plan `json:"plan"`
+}
+
+//go:embed examples.json
+var examplesJSON []byte
+
+// Examples is the shipped library, mostly UCI changes whose exact syntax
+// (section selectors, add_list, commit and reload) models get wrong.
+var Examples = mustParseExamples(examplesJSON)
+
+func mustParseExamples(data []byte) []Example {
+	var examples []Example
+	if err := json.Unmarshal(data, &examples); err != nil {
+		panic("prompts: invalid examples.json: " + err.Error())
+	}
+	return examples
+}
+
+// stopWords carry no meaning for matching requests.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "the": true, "to": true, "of": true,
+	"on": true, "in": true, "for": true, "with": true, "my": true, "me": true,
+	"is": true, "it": true, "at": true, "from": true, "please": true, "how": true,
+	"i": true, "can": true, "do": true, "what": true, "set": true, "change": true,
+}
+
+// terms splits text into lowercase words without stop words, with a plural
+// "s" removed so "clients" matches "client".
+func terms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	out := words[:0]
+	for _, w := range words {
+		if stopWords[w] {
+			continue
+		}
+		if len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") {
+			w = strings.TrimSuffix(w, "s")
+		}
+		out = append(out, w)
+	}
+	return out
+}
+
+// SelectExamples returns up to k examples most similar to request, scored
+// by the shared words of the request and each example's request and
+// keywords (see rank). Examples sharing no word are never returned.
+func SelectExamples(request string, k int) []Example {
+	texts := make([]string, len(Examples))
+	for i, ex := range Examples {
+		texts[i] = ex.Request + " " + strings.Join(ex.Keywords, " ")
+	}
+	var selected []Example
+	for _, i := range rank(texts, request, k) {
+		selected = append(selected, Examples[i])
+	}
+	return selected
+}
+
+// rank returns the indexes of up to k texts sharing the most words with
+// request, best first, weighted so that words common to many texts count
+// less. Texts sharing no word are never returned.
+func rank(texts []string, request string, k int) []int {
+	if k <= 0 {
+		return nil
+	}
+	docs := make([]map[string]bool, len(texts))
+	df := map[string]int{}
+	for i, text := range texts {
+		docs[i] = map[string]bool{}
+		for _, t := range terms(text) {
+			if !docs[i][t] {
+				docs[i][t] = true
+				df[t]++
+			}
+		}
+	}
+
+	query := map[string]bool{}
+	for _, t := range terms(request) {
+		query[t] = true
+	}
+	type scored struct {
+		i     int
+		score float64
+	}
+	var matches []scored
+	for i, doc := range docs {
+		score := 0.0
+		for t := range query {
+			if doc[t] {
+				score += math.Log(1 + float64(len(texts))/float64(df[t]))
+			}
+		}
+		if score > 0 {
+			matches = append(matches, scored{i, score})
+		}
+	}
+	sort.SliceStable(matches, func(a, b int) bool { return matches[a].score > matches[b].score })
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+	out := make([]int, len(matches))
+	for j, m := range matches {
+		out[j] = m.i
+	}
+	return out
+}
+
+// FormatExamples renders examples as a prompt block.
+func FormatExamples(examples []Example) string {
+	if len(examples) == 0 {
+		return ""
+	}
+	b := &strings.Builder{}
+	b.WriteString("\n\nExamples of correct plans for similar requests (follow their UCI syntax, adapt the values):\n")
+	for _, ex := range examples {
+		data, err := json.Marshal(ex.Plan)
+		if err != nil {
+			continue
+		}
+		b.WriteString("Request: " + ex.Request + "\n")
+		b.WriteString("Plan: " + string(data) + "\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// ExamplesBlock is FormatExamples of the k examples most similar to request.
+func ExamplesBlock(request string, k int) string {
+	return FormatExamples(SelectExamples(request, k))
+}
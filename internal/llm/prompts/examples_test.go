@@ -0,0 +1,92 @@
+package prompts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+// TestExamples_Valid keeps the library correct: every plan passes the
+// policy, uses UCI paths of the form config.section.option, and commits
+// every config it changes.
+func TestExamples_Valid(t *testing.T) {
+	if len(Examples) < 10 {
+		t.Fatalf("expected the shipped library, got %d examples", len(Examples))
+	}
+	engine := policy.New(config.Config{})
+	for _, ex := range Examples {
+		if ex.Request == "" || len(ex.Plan.Commands) == 0 {
+			t.Errorf("%q: empty example", ex.Request)
+			continue
+		}
+		if err := engine.ValidatePlan(ex.Plan); err != nil {
+			t.Errorf("%q: rejected by policy: %v", ex.Request, err)
+		}
+		changed, committed := map[string]bool{}, map[string]bool{}
+		for _, c := range ex.Plan.Commands {
+			if len(c.Command) < 3 || c.Command[0] != "uci" {
+				continue
+			}
+			arg := c.Command[2]
+			switch c.Command[1] {
+			case "set", "add_list":
+				if !strings.Contains(arg, "=") || strings.Count(strings.SplitN(arg, "=", 2)[0], ".") != 2 {
+					t.Errorf("%q: malformed uci %s %s", ex.Request, c.Command[1], arg)
+				}
+				changed[strings.SplitN(arg, ".", 2)[0]] = true
+			case "add", "delete":
+				changed[strings.SplitN(arg, ".", 2)[0]] = true
+			case "commit":
+				committed[arg] = true
+			}
+		}
+		for cfg := range changed {
+			if !committed[cfg] {
+				t.Errorf("%q: changes %s without committing it", ex.Request, cfg)
+			}
+		}
+	}
+}
+
+func TestSelectExamples(t *testing.T) {
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{"set my wifi password to hunter22", "change the wifi password to s3cretpass"},
+		{"open port 443 and forward it to my NAS at 192.168.1.9", "forward port 8080 to 192.168.1.50 port 80"},
+		{"reserve an address for my printer's MAC", "give my laptop aa:bb:cc:dd:ee:ff the fixed IP 192.168.1.20"},
+		{"Which devices are connected to the wireless?", "show connected wifi clients"},
+	}
+	for _, tt := range tests {
+		got := SelectExamples(tt.request, 2)
+		if len(got) == 0 || got[0].Request != tt.want {
+			t.Errorf("%q: got %+v, want %q first", tt.request, got, tt.want)
+		}
+	}
+
+	if got := SelectExamples("hello there", 2); len(got) != 0 {
+		t.Errorf("unrelated request matched %d examples", len(got))
+	}
+	if got := SelectExamples("wifi password", 0); got != nil {
+		t.Errorf("k=0 returned examples: %+v", got)
+	}
+	if got := SelectExamples("wifi", 3); len(got) != 3 {
+		t.Errorf("expected 3 wifi examples, got %d", len(got))
+	}
+}
+
+func TestExamplesBlock(t *testing.T) {
+	block := ExamplesBlock("change the wifi name", 1)
+	if !strings.Contains(block, "Request: change the wifi name to HomeNet") || !strings.Contains(block, `"uci","set","wireless.@wifi-iface[0].ssid=HomeNet"`) {
+		t.Errorf("unexpected block: %s", block)
+	}
+	if strings.Count(block, "Request: ") != 1 {
+		t.Errorf("expected one example: %s", block)
+	}
+	if ExamplesBlock("hello", 2) != "" {
+		t.Error("expected no block without a match")
+	}
+}
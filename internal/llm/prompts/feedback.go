@@ -0,0 +1,60 @@
+package prompts
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/redact"
+)
+
+// KnownFailuresBlock lists the last n plans in entries that users rated
+// bad (see logging.Feedback), so the model does not suggest them again.
+// It returns "" when there are none.
+func KnownFailuresBlock(entries []logging.HistoryEntry, n int) string {
+	var bad []logging.HistoryEntry
+	for i := len(entries) - 1; i >= 0 && len(bad) < n; i-- {
+		if fb := entries[i].Feedback; fb != nil && fb.Rating == logging.RatingBad {
+			bad = append(bad, entries[i])
+		}
+	}
+	if len(bad) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n\nKnown not to work here (the user rated these earlier plans as failed; do not suggest them again unchanged):\n")
+	for _, h := range bad {
+		cmds := make([]string, 0, len(h.Plan.Commands))
+		for _, c := range h.Plan.Commands {
+			cmds = append(cmds, strings.Join(c.Command, " "))
+		}
+		fmt.Fprintf(&b, "- Request: %s\n  Commands: %s\n", oneLine(h.Prompt), oneLine(strings.Join(cmds, "; ")))
+		if h.Feedback.Note != "" {
+			fmt.Fprintf(&b, "  User note: %s\n", oneLine(h.Feedback.Note))
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// FeedbackBlock is KnownFailuresBlock of the history of cfg.LogFile (see
+// logging.History). It is empty when n is 0 or the history cannot be read.
+func FeedbackBlock(cfg config.Config, n int) string {
+	if n <= 0 || cfg.LogFile == "" {
+		return ""
+	}
+	entries, err := logging.History(cfg)
+	if err != nil {
+		return ""
+	}
+	return KnownFailuresBlock(entries, n)
+}
+
+// oneLine redacts s and collapses it to a single line of at most 200 runes.
+func oneLine(s string) string {
+	s = strings.Join(strings.Fields(redact.String(s)), " ")
+	if r := []rune(s); len(r) > 200 {
+		s = string(r[:197]) + "..."
+	}
+	return s
+}
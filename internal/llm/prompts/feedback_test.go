@@ -0,0 +1,37 @@
+package prompts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestKnownFailuresBlock(t *testing.T) {
+	entry := func(prompt, rating, note string) logging.HistoryEntry {
+		h := logging.HistoryEntry{Prompt: prompt, Plan: plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}}}
+		if rating != "" {
+			h.Feedback = &logging.Feedback{Rating: rating, Note: note}
+		}
+		return h
+	}
+	entries := []logging.HistoryEntry{
+		entry("oldest failure", logging.RatingBad, ""),
+		entry("fix roaming", logging.RatingBad, "clients\nstill drop"),
+		entry("worked", logging.RatingGood, ""),
+		entry("unrated", "", ""),
+	}
+	if got := KnownFailuresBlock(entries[2:], 3); got != "" {
+		t.Errorf("expected no block without bad ratings, got %q", got)
+	}
+	got := KnownFailuresBlock(entries, 1)
+	for _, want := range []string{"Known not to work here", "Request: fix roaming", "Commands: wifi reload", "User note: clients still drop"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("block lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "oldest failure") {
+		t.Errorf("block exceeds the limit:\n%s", got)
+	}
+}
@@ -0,0 +1,96 @@
+package prompts
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+)
+
+// maxEarlierRunsSize bounds the earlier runs block, so a long history cannot
+// crowd the current output out of the summary request.
+const maxEarlierRunsSize = 2000
+
+// EarlierRunsBlock renders the summaries of the last n entries related to
+// the current run, oldest first, for the summary request: entries that ran
+// one of commands, or whose request shares at least half its words with
+// prompt (of the shorter of the two). Entries without a summary are
+// skipped, and the oldest ones are dropped to stay within
+// maxEarlierRunsSize. It returns "" when none match.
+func EarlierRunsBlock(entries []logging.HistoryEntry, prompt string, commands [][]string, n int) string {
+	ran := map[string]bool{}
+	for _, argv := range commands {
+		ran[strings.Join(argv, " ")] = true
+	}
+	words := map[string]bool{}
+	for _, w := range terms(prompt) {
+		words[w] = true
+	}
+
+	var lines []string
+	size := 0
+	for i := len(entries) - 1; i >= 0 && len(lines) < n; i-- {
+		h := entries[i]
+		if h.Summary == "" || !related(h, ran, words) {
+			continue
+		}
+		line := fmt.Sprintf("- %s, request %q (%s): %s\n", h.Time.UTC().Format("2006-01-02 15:04 UTC"), oneLine(h.Prompt), h.Status(), oneLine(h.Summary))
+		if size+len(line) > maxEarlierRunsSize {
+			break
+		}
+		size += len(line)
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Earlier runs of related requests, from the audit log (compare with them if the user asks about changes over time):\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		b.WriteString(lines[i])
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// related reports whether h executed one of the commands in ran or its
+// request shares at least half of the words of the shorter of it and words.
+func related(h logging.HistoryEntry, ran, words map[string]bool) bool {
+	for _, r := range h.Results {
+		if ran[strings.Join(r.Command, " ")] {
+			return true
+		}
+	}
+	if len(words) == 0 {
+		return false
+	}
+	theirs := map[string]bool{}
+	shared := 0
+	for _, w := range terms(h.Prompt) {
+		if !theirs[w] {
+			theirs[w] = true
+			if words[w] {
+				shared++
+			}
+		}
+	}
+	fewer := len(words)
+	if len(theirs) < fewer {
+		fewer = len(theirs)
+	}
+	return shared > 0 && 2*shared >= fewer
+}
+
+// SummaryHistoryBlock is EarlierRunsBlock of the history of cfg.LogFile
+// (see logging.History). It is empty when n is 0 or the history cannot be
+// read.
+func SummaryHistoryBlock(cfg config.Config, prompt string, commands [][]string, n int) string {
+	if n <= 0 || cfg.LogFile == "" {
+		return ""
+	}
+	entries, err := logging.History(cfg)
+	if err != nil {
+		return ""
+	}
+	return EarlierRunsBlock(entries, prompt, commands, n)
+}
@@ -0,0 +1,63 @@
+package prompts
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestEarlierRunsBlock(t *testing.T) {
+	day := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	entry := func(days int, prompt, summary string, argv ...string) logging.HistoryEntry {
+		return logging.HistoryEntry{
+			Time:    day.AddDate(0, 0, days),
+			Prompt:  prompt,
+			Summary: summary,
+			Results: []logging.ResultItem{{Command: argv}},
+		}
+	}
+	entries := []logging.HistoryEntry{
+		entry(0, "how fast is my wan", "Download 48 Mbit/s.", "speedtest"),
+		entry(1, "is the wifi channel busy", "Channel 36 is 60% busy.", "iw", "dev", "phy0-ap0", "survey", "dump"),
+		entry(2, "check wan speed", "", "speedtest"),
+		entry(3, "ping google", "Latency 21 ms, password=hunter22.", "ping", "-c", "4", "8.8.8.8"),
+	}
+	got := EarlierRunsBlock(entries, "did my wan speed improve", [][]string{{"ping", "-c", "4", "8.8.8.8"}}, 5)
+	for _, want := range []string{"Earlier runs", "2025-03-01 09:00 UTC", "Download 48 Mbit/s.", "Latency 21 ms"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("block lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Channel 36") || strings.Contains(got, "hunter22") {
+		t.Errorf("unrelated or secret content in the block:\n%s", got)
+	}
+	if strings.Index(got, "Download") > strings.Index(got, "Latency") {
+		t.Errorf("runs are not oldest first:\n%s", got)
+	}
+	if got := EarlierRunsBlock(entries, "did my wan speed improve", nil, 1); strings.Contains(got, "Latency") || !strings.Contains(got, "Download") {
+		t.Errorf("unexpected block with n=1:\n%s", got)
+	}
+	if got := EarlierRunsBlock(entries, "reboot", nil, 5); got != "" {
+		t.Errorf("expected no block, got %q", got)
+	}
+}
+
+func TestSummaryHistoryBlock(t *testing.T) {
+	cfg := config.Config{LogFile: filepath.Join(t.TempDir(), "audit.log")}
+	l := logging.Open(cfg).WithExecution("e1")
+	l.Plan("how fast is my wan", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"speedtest"}}}})
+	l.Summary("Download 48 Mbit/s.", nil)
+	l.Results([]logging.ResultItem{{Command: []string{"speedtest"}}})
+
+	if got := SummaryHistoryBlock(cfg, "wan speed", [][]string{{"speedtest"}}, 0); got != "" {
+		t.Errorf("expected no block when disabled, got %q", got)
+	}
+	if got := SummaryHistoryBlock(cfg, "wan speed", [][]string{{"speedtest"}}, 3); !strings.Contains(got, "Download 48 Mbit/s.") {
+		t.Errorf("logged summary missing:\n%s", got)
+	}
+}
@@ -3,6 +3,8 @@ package prompts
 import (
 	"strings"
 	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/intent"
 )
 
 func TestGenerateSurvivalPrompt(t *testing.T) {
@@ -62,3 +64,77 @@ func TestGenerateSurvivalPromptWithLimit(t *testing.T) {
 		})
 	}
 }
+
+func TestGeneratePlanPrompt_Intent(t *testing.T) {
+	read := GeneratePlanPrompt(intent.Read, 20)
+	if !strings.Contains(read, "use up to 20 read-only commands") {
+		t.Errorf("read prompt missing its budget:\n%s", read)
+	}
+	write := GeneratePlanPrompt(intent.Write, 5)
+	if !strings.Contains(write, "keep the change minimal and do not return more than 5 commands") {
+		t.Errorf("write prompt missing its budget:\n%s", write)
+	}
+	if GeneratePlanPrompt(intent.General, 7) != GenerateSurvivalPrompt(7) {
+		t.Error("general intent should match the survival prompt")
+	}
+}
+
+func TestReadAttachment(t *testing.T) {
+	content, truncated, err := ReadAttachment(strings.NewReader("hello"))
+	if err != nil || truncated || content != "hello" {
+		t.Fatalf("unexpected result: %q %v %v", content, truncated, err)
+	}
+
+	big := strings.Repeat("a", MaxAttachmentSize+10)
+	content, truncated, err = ReadAttachment(strings.NewReader(big))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !truncated || len(content) != MaxAttachmentSize {
+		t.Errorf("expected truncation to %d bytes, got %d (truncated=%v)", MaxAttachmentSize, len(content), truncated)
+	}
+}
+
+func TestFormatAttachment(t *testing.T) {
+	block := FormatAttachment("stdin", "pppd: auth failed\npassword=hunter2\n", true)
+	if !strings.Contains(block, "Attached input (stdin") {
+		t.Errorf("expected attachment header, got %q", block)
+	}
+	if strings.Contains(block, "hunter2") {
+		t.Errorf("expected secret to be redacted, got %q", block)
+	}
+	if !strings.Contains(block, "attachment truncated") {
+		t.Errorf("expected truncation note, got %q", block)
+	}
+	if FormatAttachment("stdin", "  \n", false) != "" {
+		t.Error("expected empty block for blank input")
+	}
+}
+
+func TestClarificationBlock(t *testing.T) {
+	if ClarificationBlock(nil, true) != "" {
+		t.Error("expected empty block without answers")
+	}
+	answers := []Clarification{
+		{Question: "Which device?", Answer: "  the\nlaptop "},
+		{Question: "Block for how long?", Answer: ""},
+	}
+	block := ClarificationBlock(answers, false)
+	for _, want := range []string{"Q: Which device?\nA: the laptop\n", "A: (no answer)", "ask again only if"} {
+		if !strings.Contains(block, want) {
+			t.Errorf("expected %q in %q", want, block)
+		}
+	}
+	if !strings.Contains(ClarificationBlock(answers, true), "Do not ask further questions") {
+		t.Error("expected the final block to forbid more questions")
+	}
+}
+
+func TestFactsRefreshedNotice(t *testing.T) {
+	if FactsRefreshedNotice(nil) != "" {
+		t.Error("expected no notice without changed configs")
+	}
+	if n := FactsRefreshedNotice([]string{"network", "wireless"}); !strings.Contains(n, "Facts refreshed") || !strings.Contains(n, "network, wireless configuration") {
+		t.Errorf("unexpected notice %q", n)
+	}
+}
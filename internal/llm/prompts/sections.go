@@ -0,0 +1,59 @@
+package prompts
+
+import "strings"
+
+// planPreamble starts the instructions of GeneratePlanPrompt.
+const planPreamble = "You are an OpenWrt router command planner."
+
+// Headers of the blocks callers append to GeneratePlanPrompt, in order.
+const (
+	examplesHeader = "\n\nExamples of correct plans"      // FormatExamples
+	commandsHeader = "\n\nOpenWrt command reference"      // FormatCommands
+	failuresHeader = "\n\nKnown not to work here"         // KnownFailuresBlock
+	factsHeader    = "\n\nEnvironment facts ("            // openwrt.Facts.PromptBlock
+	docsHeader     = "\n\nRelevant OpenWrt documentation" // docs.FormatMatches
+	requestHeader  = "\n\nUser request: "
+)
+
+// Sections are the parts of a plan prompt by how often they change.
+// Instructions, from GeneratePlanPrompt, change only with the intent and the
+// command limit. Facts, the environment facts with FactsRefreshedNotice,
+// change with the router's state. Request is the rest in order: examples,
+// command reference, known failures, documentation, the user request and
+// what follows it.
+// Providers that cache prompt prefixes send the sections in this order.
+type Sections struct {
+	Instructions string
+	Facts        string
+	Request      string
+}
+
+// Split returns the Sections of a plan prompt. Other prompts, such as those
+// of error fixes and summaries, are all Request.
+func Split(prompt string) Sections {
+	if !strings.HasPrefix(prompt, planPreamble) || !strings.Contains(prompt, requestHeader) {
+		return Sections{Request: prompt}
+	}
+	end := firstOf(prompt, 0, examplesHeader, commandsHeader, failuresHeader, factsHeader, docsHeader, requestHeader)
+	s := Sections{Instructions: prompt[:end]}
+	rest := prompt[end:]
+	if i := strings.Index(rest, factsHeader); i >= 0 && i < strings.Index(rest, requestHeader) {
+		j := firstOf(rest, i+len(factsHeader), docsHeader, requestHeader)
+		s.Facts = rest[i+2 : j]
+		rest = rest[:i] + rest[j:]
+	}
+	s.Request = strings.TrimPrefix(rest, "\n\n")
+	return s
+}
+
+// firstOf returns the index of the first of headers in s at or after from,
+// or len(s) if there is none.
+func firstOf(s string, from int, headers ...string) int {
+	first := len(s)
+	for _, h := range headers {
+		if i := strings.Index(s[from:], h); i >= 0 && from+i < first {
+			first = from + i
+		}
+	}
+	return first
+}
@@ -0,0 +1,43 @@
+package prompts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/intent"
+)
+
+func TestSplit(t *testing.T) {
+	instruction := GeneratePlanPrompt(intent.Read, 5)
+	examples := ExamplesBlock("open port 22 on the firewall", 1)
+	if examples == "" {
+		t.Fatal("expected an example")
+	}
+	facts := "Environment facts (read-only; collected 2026-10-17T00:00:00Z):\n# uname -a\nLinux OpenWrt\n\n# uci show network\nnetwork.lan.proto='static'"
+	docs := "\n\nRelevant OpenWrt documentation (prefer these commands and paths):\n- firewall: use fw4"
+	prompt := instruction + examples + "\n\n" + facts + FactsRefreshedNotice([]string{"network"}) + docs + "\n\nUser request: open port 22" + NoQuestionsNotice
+
+	s := Split(prompt)
+	if s.Instructions != instruction {
+		t.Errorf("unexpected instructions:\n%s", s.Instructions)
+	}
+	if s.Facts != facts+FactsRefreshedNotice([]string{"network"}) {
+		t.Errorf("unexpected facts:\n%s", s.Facts)
+	}
+	wantRequest := strings.TrimPrefix(examples, "\n\n") + docs + "\n\nUser request: open port 22" + NoQuestionsNotice
+	if s.Request != wantRequest {
+		t.Errorf("unexpected request:\n%s", s.Request)
+	}
+
+	// Without facts or other blocks
+	s = Split(instruction + "\n\nUser request: hi")
+	if s.Instructions != instruction || s.Facts != "" || s.Request != "User request: hi" {
+		t.Errorf("unexpected sections %+v", s)
+	}
+
+	// Other prompts are not split
+	fix := GenerateErrorFixPrompt("logread", "not found", 1)
+	if s := Split(fix); s.Instructions != "" || s.Facts != "" || s.Request != fix {
+		t.Errorf("expected an error fix prompt to stay whole, got %+v", s)
+	}
+}
@@ -2,6 +2,7 @@ package llm
 
 import (
     "context"
+    "sync"
 
     "github.com/aezizhu/LuciCodex/internal/config"
     "github.com/aezizhu/LuciCodex/internal/plan"
@@ -13,13 +14,74 @@ type Provider interface {
     GenerateErrorFix(ctx context.Context, originalCommand string, errorOutput string, attempt int) (plan.Plan, error)
 }
 
-// NewProvider returns a Provider based on configuration.
+// Embedder is an optional capability of a Provider that can compute text
+// embeddings. Not every provider offers an embeddings API (Anthropic does not),
+// so callers type-assert: if e, ok := p.(llm.Embedder); ok { ... }.
+type Embedder interface {
+    Embed(ctx context.Context, texts []string) ([][]float32, error)
+    // EmbeddingModel identifies the vector space so cached vectors from a
+    // different model are never compared against each other.
+    EmbeddingModel() string
+}
+
+// UsageReporter is an optional capability of a Provider that counts the
+// tokens (prompt plus response) consumed by its generation requests.
+type UsageReporter interface {
+    TokensUsed() int
+}
+
+// TokensUsed returns the tokens p has consumed, or 0 if it does not count them.
+func TokensUsed(p Provider) int {
+    if u, ok := p.(UsageReporter); ok {
+        return u.TokensUsed()
+    }
+    return 0
+}
+
+// tokenCounter implements UsageReporter for the built-in clients.
+type tokenCounter struct {
+    mu     sync.Mutex
+    tokens int
+}
+
+func (t *tokenCounter) addTokens(n int) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.tokens += n
+}
+
+// TokensUsed returns the tokens consumed since the client was created.
+func (t *tokenCounter) TokensUsed() int {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.tokens
+}
+
+// NewProvider returns a Provider based on configuration. With an
+// EscalationModel, plans the configured model flags as low-confidence are
+// asked again of that model (see escalatingProvider). With LocalFallback,
+// the local model plans when a cloud provider cannot be reached (see
+// fallbackProvider).
 func NewProvider(cfg config.Config) Provider {
+    p := newClient(cfg)
+    if cfg.EscalationModel != "" && cfg.EscalationModel != cfg.Model && cfg.EscalationQuota > 0 {
+        p = newEscalatingProvider(cfg, p)
+    }
+    if cfg.LocalFallback && cfg.Provider != "local" {
+        p = newFallbackProvider(cfg, p)
+    }
+    return p
+}
+
+// newClient returns the client of the configured provider.
+func newClient(cfg config.Config) Provider {
     switch cfg.Provider {
     case "openai":
         return NewOpenAIClient(cfg)
     case "anthropic":
         return NewAnthropicClient(cfg)
+    case "local":
+        return NewLocalClient(cfg)
     default:
         return NewGeminiClient(cfg)
     }
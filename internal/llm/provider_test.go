@@ -51,3 +51,15 @@ func TestNewProvider(t *testing.T) {
 		})
 	}
 }
+
+func TestEmbedderCapability(t *testing.T) {
+	if _, ok := NewProvider(config.Config{Provider: "gemini"}).(Embedder); !ok {
+		t.Error("expected GeminiClient to implement Embedder")
+	}
+	if _, ok := NewProvider(config.Config{Provider: "openai"}).(Embedder); !ok {
+		t.Error("expected OpenAIClient to implement Embedder")
+	}
+	if _, ok := NewProvider(config.Config{Provider: "anthropic"}).(Embedder); ok {
+		t.Error("AnthropicClient should not implement Embedder")
+	}
+}
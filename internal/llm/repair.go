@@ -0,0 +1,32 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// repairPlan returns the plan generate makes for prompt. When the model's
+// response is JSON that does not match plan.Schema, the model is told where
+// it failed and asked once more (see prompts.RepairBlock). If the second
+// response fails too, the first error is returned with the second.
+func repairPlan(ctx context.Context, prompt string, generate func(context.Context, string) (plan.Plan, error)) (plan.Plan, error) {
+	p, err := generate(ctx, prompt)
+	var parseErr *ParseError
+	if err == nil || !errors.As(err, &parseErr) || len(parseErr.Violations) == 0 || ctx.Err() != nil {
+		return p, err
+	}
+	violations := make([]string, len(parseErr.Violations))
+	for i, v := range parseErr.Violations {
+		violations[i] = v.String()
+	}
+	repaired, rerr := generate(ctx, prompt+prompts.RepairBlock(violations))
+	if rerr != nil {
+		return p, fmt.Errorf("%w (after asking for a repair: %v)", err, rerr)
+	}
+	repaired.Warnings = append(repaired.Warnings, fmt.Sprintf("The model's first response failed validation at %s; it was asked to correct it.", violations[0]))
+	return repaired, nil
+}
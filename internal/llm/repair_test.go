@@ -0,0 +1,46 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/testutil"
+)
+
+func TestGeneratePlan_SchemaRepair(t *testing.T) {
+	const bad = `{"summary": "s", "commands": [{"command": ["uptime"]}, {"command": "uci show network"}]}`
+	for _, name := range []string{"gemini", "openai", "anthropic"} {
+		server, fake := testutil.MockProviderServer(t,
+			testutil.FakeResponse{Text: bad}, testutil.FakeResponse{},
+			testutil.FakeResponse{Text: bad}, testutil.FakeResponse{Text: `{"commands": [{"command": []}]}`})
+		p := NewProvider(testutil.FakeProviderConfig(config.Config{}, name, server.URL))
+		pl, err := p.GeneratePlan(context.Background(), "p")
+		if err != nil || len(pl.Commands) != 1 || pl.Commands[0].Command[0] != "echo" {
+			t.Fatalf("%s: expected the repaired plan, got %+v, %v", name, pl, err)
+		}
+		if len(pl.Warnings) != 1 || !strings.Contains(pl.Warnings[0], "commands[1].command: expected array, got string") {
+			t.Errorf("%s: expected a warning about the repair, got %v", name, pl.Warnings)
+		}
+		reqs := fake.Requests()
+		if len(reqs) != 2 || !strings.Contains(reqs[1].Body, "failed validation at commands[1].command: expected array, got string") {
+			t.Errorf("%s: expected the violation in the second request, got %+v", name, reqs)
+		}
+
+		_, err = p.GeneratePlan(context.Background(), "p")
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || len(parseErr.Violations) != 1 || parseErr.Violations[0].Path != "commands[1].command" {
+			t.Errorf("%s: expected the first violations, got %v", name, err)
+		}
+		if errcode.Of(err) != errcode.LLMBadResponse || !strings.Contains(err.Error(), "commands[0].command: expected at least 1 items") {
+			t.Errorf("%s: expected both failures, got %s %v", name, errcode.Of(err), err)
+		}
+		if reqs := fake.Requests(); len(reqs) != 4 {
+			t.Errorf("%s: expected a single repair, got %d requests", name, len(reqs))
+		}
+		server.Close()
+	}
+}
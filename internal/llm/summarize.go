@@ -7,13 +7,17 @@ import (
 	"strings"
 
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
 )
 
 // SummaryCommand represents a single executed command with its output and error.
 type SummaryCommand struct {
-	Command []string `json:"command"`
-	Output  string   `json:"output"`
-	Error   string   `json:"error"`
+	Command  []string `json:"command"`
+	Output   string   `json:"output"`
+	Error    string   `json:"error"`
+	Stderr   string   `json:"stderr,omitempty"`    // Set when Output holds stdout alone
+	ExitCode *int     `json:"exit_code,omitempty"` // Set for commands that exited with a failure status
+	Signal   string   `json:"signal,omitempty"`
 }
 
 // SummaryInput contains execution outputs plus optional user context.
@@ -21,26 +25,35 @@ type SummaryInput struct {
 	Commands []SummaryCommand
 	Context  string
 	Prompt   string
+	History  string // Earlier related runs (see prompts.SummaryHistoryBlock)
 }
 
 // Summarize generates a concise summary of execution outputs using the selected provider.
+// With LocalFallback, the local model summarizes when a cloud provider cannot
+// be reached.
 func Summarize(ctx context.Context, cfg config.Config, input SummaryInput) (string, []string, error) {
+	prompt := buildSummaryPrompt(input)
+	var summary string
+	var details []string
+	var err error
 	switch cfg.Provider {
 	case "openai":
-		client := NewOpenAIClient(cfg)
-		prompt := buildSummaryPrompt(input)
-		return client.Summarize(ctx, prompt)
+		summary, details, err = NewOpenAIClient(cfg).Summarize(ctx, prompt)
 	case "gemini":
-		client := NewGeminiClient(cfg)
-		prompt := buildSummaryPrompt(input)
-		return client.Summarize(ctx, prompt)
+		summary, details, err = NewGeminiClient(cfg).Summarize(ctx, prompt)
 	case "anthropic":
-		client := NewAnthropicClient(cfg)
-		prompt := buildSummaryPrompt(input)
-		return client.Summarize(ctx, prompt)
+		summary, details, err = NewAnthropicClient(cfg).Summarize(ctx, prompt)
+	case "local":
+		return NewLocalClient(cfg).Summarize(ctx, prompt)
 	default:
 		return "", nil, fmt.Errorf("unsupported provider for summarization: %s", cfg.Provider)
 	}
+	if cfg.LocalFallback && unreachable(ctx, err) {
+		if s, d, lerr := NewLocalClient(cfg).Summarize(ctx, prompt); lerr == nil {
+			return s, d, nil
+		}
+	}
+	return summary, details, err
 }
 
 func buildSummaryPrompt(input SummaryInput) string {
@@ -66,18 +79,34 @@ func buildSummaryPrompt(input SummaryInput) string {
 		b.WriteString("\n\n")
 	}
 
+	b.WriteString(prompts.UntrustedNotice + "\n\n")
+	if input.History != "" {
+		b.WriteString(input.History)
+		b.WriteString("\n\n")
+	}
 	b.WriteString("COMMAND EXECUTION RESULTS:\n")
 	for i, cmd := range input.Commands {
 		cmdLine := strings.Join(cmd.Command, " ")
 		b.WriteString(fmt.Sprintf("%d) Command: %s\n", i+1, cmdLine))
 		if cmd.Output != "" {
 			b.WriteString("Output:\n")
-			b.WriteString(truncate(cmd.Output, 1500))
+			b.WriteString(prompts.FenceOutput(truncate(cmd.Output, 1500)))
 			b.WriteString("\n")
 		}
+		if cmd.Stderr != "" {
+			b.WriteString("Stderr:\n")
+			b.WriteString(prompts.FenceOutput(truncate(cmd.Stderr, 600)))
+			b.WriteString("\n")
+		}
+		switch {
+		case cmd.Signal != "":
+			b.WriteString(fmt.Sprintf("Killed by signal: %s\n", cmd.Signal))
+		case cmd.ExitCode != nil:
+			b.WriteString(fmt.Sprintf("Exit code: %d\n", *cmd.ExitCode))
+		}
 		if cmd.Error != "" {
-			b.WriteString("Error: ")
-			b.WriteString(truncate(cmd.Error, 600))
+			b.WriteString("Error:\n")
+			b.WriteString(prompts.FenceOutput(truncate(cmd.Error, 600)))
 			b.WriteString("\n")
 		}
 		b.WriteString("\n")
@@ -88,13 +117,25 @@ func buildSummaryPrompt(input SummaryInput) string {
 }
 
 // parseSummary attempts to parse JSON {"summary": "...", "details": [...]} and falls back to text.
+// Summaries are built from command output and never run anything: commands
+// in the response, e.g. planted in the output to be echoed back as a plan,
+// are dropped.
 func parseSummary(text string) (string, []string) {
 	var payload struct {
-		Summary string   `json:"summary"`
-		Details []string `json:"details"`
+		Summary  string          `json:"summary"`
+		Details  []string        `json:"details"`
+		Commands json.RawMessage `json:"commands"`
 	}
-	if err := json.Unmarshal([]byte(text), &payload); err == nil && payload.Summary != "" {
-		return payload.Summary, payload.Details
+	if err := json.Unmarshal([]byte(text), &payload); err == nil {
+		if len(payload.Commands) > 0 && string(payload.Commands) != "null" {
+			payload.Details = append(payload.Details, "Commands in the summary were ignored; summaries never run commands.")
+			if payload.Summary == "" {
+				payload.Summary = "The model answered with commands instead of a summary."
+			}
+		}
+		if payload.Summary != "" {
+			return payload.Summary, payload.Details
+		}
 	}
 	return text, nil
 }
@@ -0,0 +1,40 @@
+package llm
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/redact"
+)
+
+// traceTransport writes a line per request to w: method, redacted URL,
+// status, duration and body sizes. Bodies are not read, so streamed
+// responses are traced when their headers arrive.
+type traceTransport struct {
+	w    io.Writer
+	base http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	url := redact.String(req.URL.String())
+	if err != nil {
+		fmt.Fprintf(t.w, "http: %s %s failed after %s: %s\n", req.Method, url, elapsed, redact.String(err.Error()))
+		return nil, err
+	}
+	fmt.Fprintf(t.w, "http: %s %s -> %d in %s (sent %s, received %s)\n",
+		req.Method, url, resp.StatusCode, elapsed, byteCount(req.ContentLength), byteCount(resp.ContentLength))
+	return resp, nil
+}
+
+// byteCount formats a Content-Length, which is -1 when unknown.
+func byteCount(n int64) string {
+	if n < 0 {
+		return "? bytes"
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
@@ -0,0 +1,220 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// The log is an append-only audit trail: every entry carries its sequence
+// number ("seq") and the SHA-256 of the line before it ("prev"), so editing,
+// inserting or removing an entry breaks the chain. The sequence number and
+// hash of the last entry are also kept in a head file next to the log,
+// which reveals entries cut from the end. VerifyAudit checks both.
+
+// AuditHead is the position of the last entry, kept in HeadPath(log).
+type AuditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// HeadPath returns the head file of the log at path.
+func HeadPath(path string) string {
+	return path + ".head"
+}
+
+// hashLine returns the chain hash of a log line without its newline.
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// chainFrom returns the sequence number and prev hash of an entry written
+// after last, the last line of the log ("" for an empty log). Entries
+// written before chaining have no sequence number; the chain then starts
+// at 1 and links to them.
+func chainFrom(last []byte) (seq int64, prev string) {
+	if len(last) == 0 {
+		return 1, ""
+	}
+	var e struct {
+		Seq int64 `json:"seq"`
+	}
+	json.Unmarshal(last, &e)
+	return e.Seq + 1, hashLine(last)
+}
+
+// lastLine returns the last complete line of f, without its newline, and
+// whether f ends with a newline.
+func lastLine(f *os.File) ([]byte, bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	end := info.Size()
+	if end == 0 {
+		return nil, true, nil
+	}
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, end-1); err != nil {
+		return nil, false, err
+	}
+	terminated := b[0] == '\n'
+	if terminated {
+		end--
+	}
+	var tail []byte
+	const chunk = 64 * 1024
+	for pos := end; pos > 0; {
+		n := int64(chunk)
+		if n > pos {
+			n = pos
+		}
+		pos -= n
+		b := make([]byte, n)
+		if _, err := f.ReadAt(b, pos); err != nil {
+			return nil, false, err
+		}
+		tail = append(b, tail...)
+		if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+			return tail[i+1:], terminated, nil
+		}
+	}
+	return tail, terminated, nil
+}
+
+// writeHead replaces the head file of the log at path.
+func writeHead(path string, h AuditHead) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	head := HeadPath(path)
+	tmp, err := os.CreateTemp(filepath.Dir(head), ".head-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), head)
+}
+
+// AuditReport describes a log that passed VerifyAudit.
+type AuditReport struct {
+	Entries int       `json:"entries"` // Chained entries checked
+	Legacy  int       `json:"legacy"`  // Entries written before chaining, not covered
+	Head    AuditHead `json:"head"`    // The last entry
+}
+
+// VerifyAudit checks the hash chain of the log at path against its head
+// file. It fails with AUDIT_BROKEN at the first entry that was modified,
+// inserted or removed, or if entries were cut from the end of the log.
+func VerifyAudit(path string) (AuditReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return AuditReport{}, errcode.Errorf(errcode.NotFound, "no audit log at %s", path)
+		}
+		return AuditReport{}, err
+	}
+	defer f.Close()
+
+	var r AuditReport
+	broken := func(format string, args ...any) (AuditReport, error) {
+		return r, errcode.Errorf(errcode.AuditBroken, format, args...)
+	}
+	rd := bufio.NewReader(f)
+	prevHash := ""
+	for n := 1; ; n++ {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return broken("line %d is incomplete: the log was cut or a write was interrupted", n)
+			}
+			break
+		}
+		if err != nil {
+			return r, err
+		}
+		line = line[:len(line)-1]
+		var e struct {
+			Seq  *int64 `json:"seq"`
+			Prev string `json:"prev"`
+		}
+		if json.Unmarshal(line, &e) != nil || e.Seq == nil {
+			if r.Entries > 0 {
+				return broken("line %d is not a chained entry: it was modified or inserted", n)
+			}
+			r.Legacy++
+			prevHash = hashLine(line)
+			continue
+		}
+		want := r.Head.Seq + 1
+		if r.Entries == 0 && *e.Seq != 1 {
+			return broken("line %d is entry %d: entries 1 to %d were removed", n, *e.Seq, *e.Seq-1)
+		}
+		if r.Entries > 0 && *e.Seq != want {
+			if *e.Seq > want {
+				return broken("line %d is entry %d: entries %d to %d were removed", n, *e.Seq, want, *e.Seq-1)
+			}
+			return broken("line %d is entry %d, expected %d: entries were reordered or duplicated", n, *e.Seq, want)
+		}
+		if e.Prev != prevHash {
+			return broken("line %d does not follow line %d: an entry was modified, inserted or removed", n, n-1)
+		}
+		prevHash = hashLine(line)
+		r.Entries++
+		r.Head = AuditHead{Seq: *e.Seq, Hash: prevHash}
+	}
+
+	data, err := os.ReadFile(HeadPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		if r.Entries == 0 {
+			return r, nil
+		}
+		return broken("head file %s is missing: cannot tell whether entries were cut from the end", HeadPath(path))
+	}
+	if err != nil {
+		return r, err
+	}
+	var head AuditHead
+	if err := json.Unmarshal(data, &head); err != nil {
+		return broken("head file %s is invalid: %v", HeadPath(path), err)
+	}
+	switch {
+	case head.Seq > r.Head.Seq:
+		return broken("the log ends at entry %d but entry %d was written: entries were cut from the end", r.Head.Seq, head.Seq)
+	case head.Seq < r.Head.Seq:
+		return broken("the head file records entry %d but the log goes on to entry %d: entries were appended by another writer", head.Seq, r.Head.Seq)
+	case head.Hash != r.Head.Hash:
+		return broken("entry %d differs from the one recorded in the head file: it was modified", head.Seq)
+	}
+	return r, nil
+}
+
+// String summarizes the report for the terminal.
+func (r AuditReport) String() string {
+	s := fmt.Sprintf("%d entries verified", r.Entries)
+	if r.Legacy > 0 {
+		s += fmt.Sprintf(", %d older entries without a chain", r.Legacy)
+	}
+	if r.Entries > 0 {
+		s += fmt.Sprintf("; last entry %d, hash %s", r.Head.Seq, r.Head.Hash)
+	}
+	return s
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// writeAudit writes a log of three chained entries and returns its path
+// and lines.
+func writeAudit(t *testing.T, legacy string) (string, []string) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if legacy != "" {
+		os.WriteFile(path, []byte(legacy), 0600)
+	}
+	l := New(path).WithExecution("e1").WithActor("ops-bot", "operator")
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}}
+	l.Plan("reload wifi", p)
+	l.Results([]ResultItem{{Command: []string{"wifi", "reload"}}})
+	l.Rejected("wipe", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"rm", "-rf", "/"}}}}, "denied")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	return path, lines[:len(lines)-1]
+}
+
+func TestAuditEntries(t *testing.T) {
+	_, lines := writeAudit(t, "")
+	var entries []map[string]any
+	for _, line := range lines {
+		var e map[string]any
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if entries[0]["seq"] != 1.0 || entries[0]["prev"] != "" || entries[2]["seq"] != 3.0 {
+		t.Errorf("unexpected chain fields: %v %v", entries[0], entries[2])
+	}
+	if entries[1]["prev"] != hashLine([]byte(strings.TrimSuffix(lines[0], "\n"))) {
+		t.Error("prev is not the hash of the previous line")
+	}
+	if entries[0]["actor"] != "ops-bot" || entries[0]["role"] != "operator" || entries[0]["uid"] == nil {
+		t.Errorf("who is not recorded: %v", entries[0])
+	}
+	data := entries[0]["data"].(map[string]any)
+	if h, _ := data["plan_hash"].(string); len(h) != 64 {
+		t.Errorf("expected a plan hash, got %v", data["plan_hash"])
+	}
+	if entries[1]["outcome"] != "ok" || entries[2]["outcome"] != "rejected" {
+		t.Errorf("unexpected outcomes %v, %v", entries[1]["outcome"], entries[2]["outcome"])
+	}
+}
+
+func TestVerifyAudit(t *testing.T) {
+	path, lines := writeAudit(t, "")
+	r, err := VerifyAudit(path)
+	if err != nil {
+		t.Fatalf("expected an intact log, got %v", err)
+	}
+	if r.Entries != 3 || r.Legacy != 0 || r.Head.Seq != 3 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if h, _ := ReadHistory(path); len(h) != 2 || h[0].Actor != "ops-bot" || h[0].Status() != "ok" {
+		t.Errorf("history does not read chained entries: %+v", h)
+	}
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"modified", []string{lines[0], strings.Replace(lines[1], `"ok"`, `"failed"`, 1), lines[2]}, "line 3 does not follow line 2"},
+		{"removed", []string{lines[0], lines[2]}, "entries 2 to 2 were removed"},
+		{"removed first", []string{lines[1], lines[2]}, "entries 1 to 1 were removed"},
+		{"truncated", []string{lines[0], lines[1]}, "cut from the end"},
+		{"cut mid-line", []string{lines[0], lines[1], lines[2][:20]}, "line 3 is incomplete"},
+		{"inserted", []string{lines[0], "{\"event\":\"plan\"}\n", lines[1], lines[2]}, "line 2 is not a chained entry"},
+		{"last modified", []string{lines[0], lines[1], strings.Replace(lines[2], "denied", "allowed", 1)}, "entry 3 differs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.WriteFile(path, []byte(strings.Join(tt.lines, "")), 0600)
+			_, err := VerifyAudit(path)
+			if errcode.Of(err) != errcode.AuditBroken || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected %s containing %q, got %v", errcode.AuditBroken, tt.want, err)
+			}
+		})
+	}
+
+	os.WriteFile(path, []byte(strings.Join(lines, "")), 0600)
+	os.Remove(HeadPath(path))
+	if _, err := VerifyAudit(path); err == nil || !strings.Contains(err.Error(), "head file") {
+		t.Errorf("expected the missing head file to be reported, got %v", err)
+	}
+	if _, err := VerifyAudit(filepath.Join(t.TempDir(), "none.log")); errcode.Of(err) != errcode.NotFound {
+		t.Errorf("expected %s for a missing log, got %v", errcode.NotFound, err)
+	}
+}
+
+func TestVerifyAudit_Legacy(t *testing.T) {
+	legacy := `{"ts":"2025-01-01T00:00:00Z","event":"plan","data":{"prompt":"old"}}` + "\n"
+	path, _ := writeAudit(t, legacy)
+	r, err := VerifyAudit(path)
+	if err != nil || r.Entries != 3 || r.Legacy != 1 {
+		t.Fatalf("expected 3 entries after 1 legacy one, got %+v, %v", r, err)
+	}
+
+	// A cut-off write is closed off before the next entry
+	os.WriteFile(path, []byte(`{"ts":"2025-01-01T00:00:00Z","eve`), 0600)
+	New(path).Summary("s", nil)
+	data, _ := os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 || !strings.Contains(lines[1], `"seq":1`) {
+		t.Errorf("expected the entry on its own line, got %q", data)
+	}
+}
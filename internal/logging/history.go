@@ -0,0 +1,178 @@
+package logging
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/storage"
+)
+
+// The execution history is kept in the storage layer (see internal/storage),
+// one document per execution keyed by its ID, in HistoryDir with the file
+// backend. The audit log stays the tamper-evident record; the history is
+// what `lucicodex history`, the dashboard, the digest and the prompt hints
+// read, without parsing the whole log. The executions logged before the
+// history existed are imported from the log the first time it is read.
+
+// maxHistory is how many executions the history keeps. Older ones are
+// dropped, oldest first; they remain in the audit log.
+const maxHistory = 1000
+
+// historyImport marks the history as imported from the audit log.
+type historyImport struct {
+	Log  string    `json:"log"`
+	Time time.Time `json:"time"`
+}
+
+// Open returns a logger for cfg.LogFile that also records every execution
+// in the history (see History).
+func Open(cfg config.Config) *Logger {
+	l := New(cfg.LogFile)
+	l.history = historyStore(cfg)
+	return l
+}
+
+// History returns the executions in the history of cfg.LogFile, oldest
+// first. There is none without a log file.
+func History(cfg config.Config) ([]HistoryEntry, error) {
+	st := historyStore(cfg)
+	if st == nil {
+		return nil, nil
+	}
+	if err := importLog(st, cfg.LogFile); err != nil {
+		return nil, err
+	}
+	keys, err := st.List("")
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]HistoryEntry, 0, len(keys))
+	for _, k := range keys {
+		var h HistoryEntry
+		if err := st.Get("", k, &h); err != nil {
+			if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrCorrupt) {
+				continue
+			}
+			return nil, err
+		}
+		entries = append(entries, h)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, nil
+}
+
+// HistoryDir returns the directory of the history of the log at path.
+func HistoryDir(path string) string {
+	return path + ".history"
+}
+
+func historyStore(cfg config.Config) storage.Store {
+	if cfg.LogFile == "" {
+		return nil
+	}
+	return storage.Open(cfg, HistoryDir(cfg.LogFile))
+}
+
+// importLog copies the executions of the audit log at path into st once.
+// Importing is idempotent, so processes that race to do it agree.
+func importLog(st storage.Store, path string) error {
+	var done historyImport
+	err := st.Get("meta", "import.json", &done)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrCorrupt) {
+		return err
+	}
+	entries, err := ReadHistory(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > maxHistory {
+		entries = entries[len(entries)-maxHistory:]
+	}
+	for _, h := range entries {
+		if err := st.Put("", historyKey(h.ID, h.Time), h); err != nil {
+			return err
+		}
+	}
+	if err := trimHistory(st); err != nil {
+		return err
+	}
+	return st.Put("meta", "import.json", historyImport{Log: path, Time: time.Now().UTC()})
+}
+
+// historyKey names the document of an execution: its ID, or for entries
+// without a usable one, the time it was logged. Both sort by time.
+func historyKey(id string, ts time.Time) string {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		id = ts.UTC().Format("20060102-150405.000000000")
+	}
+	return id + ".json"
+}
+
+// trimHistory drops the oldest executions beyond maxHistory.
+func trimHistory(st storage.Store) error {
+	keys, err := st.List("")
+	if err != nil || len(keys) <= maxHistory {
+		return err
+	}
+	for _, k := range keys[:len(keys)-maxHistory] {
+		if err := st.Delete("", k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordPlan adds a plan logged at ts to the history, rejected if reason
+// is set. Later results go to it unless it was rejected.
+func (l *Logger) recordPlan(ts time.Time, prompt string, p plan.Plan, reason string) {
+	if l.history == nil || ts.IsZero() {
+		return
+	}
+	h := HistoryEntry{ID: l.id, Time: ts, Client: l.client, Remote: l.remote, Actor: l.actor, Role: l.role, UserAgent: l.agent, Session: l.session, Device: Device(l.remote, l.agent), Prompt: prompt, Plan: p, Rejected: reason}
+	key := historyKey(l.id, ts)
+	l.mu.Lock()
+	l.last = ""
+	if reason == "" {
+		l.last = key
+	}
+	l.mu.Unlock()
+	if l.history.Put("", key, h) == nil {
+		_ = trimHistory(l.history)
+	}
+}
+
+// errSkip leaves a history entry as it is.
+var errSkip = errors.New("skip history entry")
+
+// recordUpdate applies fn to the history entry of the logger's last plan,
+// or of its execution. Entries the history does not have are not created,
+// and fn returning false leaves the entry unchanged.
+func (l *Logger) recordUpdate(fn func(h *HistoryEntry) bool) {
+	if l.history == nil {
+		return
+	}
+	l.mu.Lock()
+	key := l.last
+	l.mu.Unlock()
+	if key == "" {
+		if l.id == "" {
+			return
+		}
+		key = historyKey(l.id, time.Time{})
+	}
+	var h HistoryEntry
+	_ = l.history.Update("", key, &h, func() error {
+		if h.Time.IsZero() || !fn(&h) {
+			return errSkip
+		}
+		return nil
+	})
+}
@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	cfg := config.Config{LogFile: path}
+	uptime := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uptime"}}}}
+
+	// Executions logged before the history existed are imported once
+	old := `{"ts":"2025-01-02T03:04:05Z","event":"plan","data":{"prompt":"old","plan":{"commands":[{"command":["uptime"]}]}}}
+{"ts":"2025-01-02T03:04:06Z","event":"results","data":[{"index":0,"command":["uptime"],"output":"up"}]}
+`
+	if err := os.WriteFile(path, []byte(old), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := History(cfg)
+	if err != nil || len(entries) != 1 || entries[0].Prompt != "old" || entries[0].Status() != "ok" {
+		t.Fatalf("History = %+v, %v", entries, err)
+	}
+	New(path).Plan("log only", uptime)
+
+	exec := Open(cfg).WithExecution("20261017-100000-abcdef").WithActor("alice", "admin")
+	exec.Plan("check uptime", uptime)
+	exec.Results([]ResultItem{{Index: 0, Command: []string{"uptime"}, Error: "exit status 1"}})
+	exec.Summary("Uptime failed.", nil)
+	// Without an execution ID, results go to the logger's last plan
+	repl := Open(cfg)
+	repl.Rejected("reboot", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"reboot"}}}}, "denied")
+	repl.Results([]ResultItem{{Index: 0, Command: []string{"reboot"}}})
+	repl.Plan("check again", uptime)
+	repl.Results([]ResultItem{{Index: 0, Command: []string{"uptime"}, Output: "up"}})
+
+	entries, err = History(cfg)
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("History = %+v, %v", entries, err)
+	}
+	if h := entries[1]; h.ID != "20261017-100000-abcdef" || h.Actor != "alice" || h.Status() != "failed" || h.Summary != "Uptime failed." {
+		t.Errorf("unexpected execution %+v", h)
+	}
+	if h := entries[2]; h.Prompt != "reboot" || h.Status() != "rejected" || len(h.Results) != 0 {
+		t.Errorf("unexpected rejected plan %+v", h)
+	}
+	if h := entries[3]; h.Prompt != "check again" || h.Status() != "ok" {
+		t.Errorf("unexpected plan %+v", h)
+	}
+
+	// The audit log has everything, including what bypassed the history
+	if logged, err := ReadHistory(path); err != nil || len(logged) != 5 {
+		t.Errorf("ReadHistory = %d entries, %v", len(logged), err)
+	}
+	if entries, err := History(config.Config{}); entries != nil || err != nil {
+		t.Errorf("expected no history without a log, got %+v, %v", entries, err)
+	}
+}
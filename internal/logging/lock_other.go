@@ -0,0 +1,16 @@
+//go:build !unix
+
+package logging
+
+import "os"
+
+// lockFile is only implemented on Unix (flock). Elsewhere entries are
+// serialized within the process only, so processes sharing a log can break
+// its chain.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
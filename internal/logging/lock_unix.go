@@ -0,0 +1,17 @@
+//go:build unix
+
+package logging
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the log, waiting for other processes.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -1,59 +1,428 @@
 package logging
 
 import (
+    "bufio"
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
-    "fmt"
     "os"
     "sync"
     "time"
 
+    "github.com/aezizhu/LuciCodex/internal/config"
+    "github.com/aezizhu/LuciCodex/internal/errcode"
     "github.com/aezizhu/LuciCodex/internal/plan"
+    "github.com/aezizhu/LuciCodex/internal/storage"
 )
 
 type Logger struct {
-    path string
-    mu   sync.Mutex
+    path    string
+    client  string
+    remote  string
+    id      string
+    actor   string
+    role    string
+    agent   string
+    session string
+    history storage.Store // Set by Open
+    last    string        // History key of the last accepted plan
+    mu      sync.Mutex
 }
 
 func New(path string) *Logger { return &Logger{path: path} }
 
-func (l *Logger) writeJSON(event string, data any) {
+// WithClient returns a logger for the same file that tags every entry with
+// client, e.g. the MCP client that requested an execution.
+func (l *Logger) WithClient(client string) *Logger {
+    c := l.clone()
+    c.client = client
+    return c
+}
+
+// WithRemote returns a logger for the same file that tags every entry with
+// the address of the client that made the request.
+func (l *Logger) WithRemote(addr string) *Logger {
+    c := l.clone()
+    c.remote = addr
+    return c
+}
+
+// WithExecution returns a logger for the same file that tags every entry
+// with the execution ID, which also names its artifacts directory.
+func (l *Logger) WithExecution(id string) *Logger {
+    c := l.clone()
+    c.id = id
+    return c
+}
+
+// WithActor returns a logger for the same file that tags every entry with
+// who authorized the request: the name and role of the daemon API token.
+// Entries without an actor were made on the router itself, by the user
+// whose uid they record.
+func (l *Logger) WithActor(name, role string) *Logger {
+    c := l.clone()
+    c.actor, c.role = name, role
+    return c
+}
+
+// WithDevice returns a logger for the same file that tags every entry with
+// what the client said about itself: its User-Agent and, for requests made
+// through LuCI, a hint of the LuCI session. Entries with a user agent also
+// get a device fingerprint (see Device). These tell admins apart, but unlike
+// the actor they are not authenticated.
+func (l *Logger) WithDevice(userAgent, session string) *Logger {
+    c := l.clone()
+    c.agent, c.session = userAgent, session
+    return c
+}
+
+// clone returns a logger for the same file with the same tags.
+func (l *Logger) clone() *Logger {
+    return &Logger{path: l.path, client: l.client, remote: l.remote, id: l.id, actor: l.actor, role: l.role, agent: l.agent, session: l.session, history: l.history}
+}
+
+// Device fingerprints the device a request came from: the first 12 hex
+// digits of the SHA-256 of its address and user agent. It is "" without
+// a user agent.
+func Device(remote, userAgent string) string {
+    if userAgent == "" {
+        return ""
+    }
+    sum := sha256.Sum256([]byte(remote + "\n" + userAgent))
+    return hex.EncodeToString(sum[:6])
+}
+
+func (l *Logger) writeJSON(event string, data any) time.Time {
+    return l.writeEntry(event, data, nil)
+}
+
+// writeEntry appends an entry to the audit chain (see VerifyAudit), with
+// fields added at the top level, and returns its time, or the zero time if
+// it was not written. The file is locked while the last entry is read and
+// the new one written, so the CLI and the daemon can share it.
+func (l *Logger) writeEntry(event string, data any, fields map[string]any) time.Time {
     if l.path == "" {
-        return
+        return time.Time{}
     }
     l.mu.Lock()
     defer l.mu.Unlock()
-    f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+    f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o600)
     if err != nil {
-        return
+        return time.Time{}
     }
     defer f.Close()
+    if err := lockFile(f); err != nil {
+        return time.Time{}
+    }
+    defer unlockFile(f)
+
+    last, terminated, err := lastLine(f)
+    if err != nil {
+        return time.Time{}
+    }
+    seq, prev := chainFrom(last)
+    now := time.Now().UTC()
     entry := map[string]any{
-        "ts":    time.Now().UTC().Format(time.RFC3339Nano),
+        "ts":    now.Format(time.RFC3339Nano),
         "event": event,
         "data":  data,
+        "seq":   seq,
+        "prev":  prev,
+        "uid":   os.Getuid(),
+    }
+    for k, v := range fields {
+        entry[k] = v
+    }
+    if l.client != "" {
+        entry["client"] = l.client
+    }
+    if l.remote != "" {
+        entry["remote"] = l.remote
+    }
+    if l.id != "" {
+        entry["id"] = l.id
+    }
+    if l.actor != "" {
+        entry["actor"] = l.actor
+        entry["role"] = l.role
+    }
+    if l.agent != "" {
+        entry["user_agent"] = l.agent
+        entry["device"] = Device(l.remote, l.agent)
+    }
+    if l.session != "" {
+        entry["session"] = l.session
     }
     b, err := json.Marshal(entry)
     if err != nil {
-        return
+        return time.Time{}
+    }
+    line := append(b, '\n')
+    if !terminated {
+        // A write was cut short; keep the entry on a line of its own
+        line = append([]byte{'\n'}, line...)
+    }
+    if _, err := f.Write(line); err != nil {
+        return time.Time{}
+    }
+    _ = writeHead(l.path, AuditHead{Seq: seq, Hash: hashLine(b)})
+    return now
+}
+
+// planHash identifies a plan in the audit log: the SHA-256 of its JSON.
+func planHash(p plan.Plan) string {
+    b, err := json.Marshal(p)
+    if err != nil {
+        return ""
     }
-    _, _ = fmt.Fprintln(f, string(b))
+    sum := sha256.Sum256(b)
+    return hex.EncodeToString(sum[:])
 }
 
+// Plan records a plan before it is executed. Plans are stored with their
+// schema version so ReadHistory can migrate them after format changes.
 func (l *Logger) Plan(prompt string, p plan.Plan) {
-    l.writeJSON("plan", map[string]any{"prompt": prompt, "plan": p})
+    if p.Version == 0 {
+        p.Version = plan.SchemaVersion
+    }
+    ts := l.writeJSON("plan", map[string]any{"prompt": prompt, "plan": p, "plan_hash": planHash(p)})
+    l.recordPlan(ts, prompt, p, "")
 }
 
 type ResultItem struct {
-    Index   int           `json:"index"`
-    Command []string      `json:"command"`
-    Output  string        `json:"output"`
-    Error   string        `json:"error,omitempty"`
-    Elapsed time.Duration `json:"elapsed"`
+    Index     int           `json:"index"`
+    Command   []string      `json:"command"`
+    Output    string        `json:"output"`
+    Error     string        `json:"error,omitempty"`
+    Elapsed   time.Duration `json:"elapsed"`
+    Artifacts []string      `json:"artifacts,omitempty"` // Files the command left in the artifacts directory
+    Stderr    string        `json:"stderr,omitempty"`    // Stderr alone when captured apart; Output has both
+    ExitCode  int           `json:"exit_code"`           // -1 if the command did not exit by itself
+    Signal    string        `json:"signal,omitempty"`
+    Started   *time.Time    `json:"started,omitempty"`
+    Finished  *time.Time    `json:"finished,omitempty"`
 }
 
+// Results records the executed commands. The entry's outcome is "failed"
+// if any of them failed, "ok" otherwise.
 func (l *Logger) Results(items []ResultItem) {
-    l.writeJSON("results", items)
+    outcome := "ok"
+    for _, it := range items {
+        if it.Error != "" {
+            outcome = "failed"
+        }
+    }
+    if l.writeEntry("results", items, map[string]any{"outcome": outcome}).IsZero() {
+        return
+    }
+    l.recordUpdate(func(h *HistoryEntry) bool {
+        h.Results = append(h.Results, items...)
+        return h.Rejected == ""
+    })
+}
+
+// Ratings accepted by Feedback.
+const (
+    RatingGood = "good"
+    RatingBad  = "bad"
+)
+
+// Feedback is a user's verdict on an execution: whether it did what was
+// asked, and optionally why not.
+type Feedback struct {
+    Rating string    `json:"rating"` // RatingGood or RatingBad
+    Note   string    `json:"note,omitempty"`
+    Time   time.Time `json:"time"`
+}
+
+// Feedback records a rating for the execution the logger is tagged with
+// (see WithExecution). A later rating replaces an earlier one.
+func (l *Logger) Feedback(rating, note string) {
+    ts := l.writeJSON("feedback", map[string]any{"rating": rating, "note": note})
+    if ts.IsZero() || l.id == "" {
+        return
+    }
+    l.recordUpdate(func(h *HistoryEntry) bool {
+        h.Feedback = &Feedback{Rating: rating, Note: note, Time: ts}
+        return true
+    })
+}
+
+// RecordFeedback rates execution id in the history of cfg.LogFile after
+// checking that the rating is valid and the execution is in the history.
+func RecordFeedback(cfg config.Config, id, rating, note string) (HistoryEntry, error) {
+    if rating != RatingGood && rating != RatingBad {
+        return HistoryEntry{}, errcode.Errorf(errcode.InvalidRequest, "rating must be %s or %s, got %q", RatingGood, RatingBad, rating)
+    }
+    entries, err := History(cfg)
+    if err != nil {
+        return HistoryEntry{}, err
+    }
+    for i := len(entries) - 1; i >= 0; i-- {
+        if entries[i].ID == id && id != "" {
+            Open(cfg).WithExecution(id).Feedback(rating, note)
+            h := entries[i]
+            h.Feedback = &Feedback{Rating: rating, Note: note, Time: time.Now().UTC()}
+            return h, nil
+        }
+    }
+    return HistoryEntry{}, errcode.Errorf(errcode.NotFound, "no execution %s in %s", id, cfg.LogFile)
 }
 
+// Summary records the answer summarized from an execution's output, so
+// later summaries can refer to it.
+func (l *Logger) Summary(summary string, details []string) {
+    if l.writeJSON("summary", map[string]any{"summary": summary, "details": details}).IsZero() {
+        return
+    }
+    l.recordUpdate(func(h *HistoryEntry) bool {
+        h.Summary = summary
+        return true
+    })
+}
+
+// Rejected records a plan that was blocked by policy, so later policy audits
+// can tell whether a changed configuration would now allow it.
+func (l *Logger) Rejected(prompt string, p plan.Plan, reason string) {
+    if p.Version == 0 {
+        p.Version = plan.SchemaVersion
+    }
+    ts := l.writeEntry("plan_rejected", map[string]any{"prompt": prompt, "plan": p, "plan_hash": planHash(p), "reason": reason}, map[string]any{"outcome": "rejected"})
+    l.recordPlan(ts, prompt, p, reason)
+}
+
+// HistoryEntry is a plan in the history (see History), or read back from
+// the log, together with its outcome.
+type HistoryEntry struct {
+    ID        string       `json:"id,omitempty"` // Execution ID; names the artifacts directory
+    Time      time.Time    `json:"time"`
+    Client    string       `json:"client,omitempty"`     // Set for executions requested by MCP clients
+    Remote    string       `json:"remote,omitempty"`     // Address of the client, for requests to the daemon
+    Actor     string       `json:"actor,omitempty"`      // API token that authorized the request (see WithActor)
+    Role      string       `json:"role,omitempty"`
+    UserAgent string       `json:"user_agent,omitempty"` // Sent by the client (see WithDevice)
+    Session   string       `json:"session,omitempty"`    // LuCI session hint
+    Device    string       `json:"device,omitempty"`     // Fingerprint of the client (see Device)
+    Prompt    string       `json:"prompt"`
+    Plan      plan.Plan    `json:"plan"`
+    Rejected  string       `json:"rejected,omitempty"` // Policy error if the plan was blocked
+    Results   []ResultItem `json:"results,omitempty"`  // Executed commands; empty for dry runs
+    Feedback  *Feedback    `json:"feedback,omitempty"` // Latest rating by the user, if any
+    Summary   string       `json:"summary,omitempty"`  // Answer summarized from the results, if any
+}
+
+// Status summarizes the outcome of the entry: "rejected", "planned" (not
+// executed), "failed" or "ok".
+func (h HistoryEntry) Status() string {
+    switch {
+    case h.Rejected != "":
+        return "rejected"
+    case len(h.Results) == 0:
+        return "planned"
+    }
+    for _, r := range h.Results {
+        if r.Error != "" {
+            return "failed"
+        }
+    }
+    return "ok"
+}
 
+// ReadHistory parses a log written by Logger and returns its plans in order,
+// for logs other than the one History keeps, and to import that one.
+// Each "results" event is attached to the most recent accepted plan. Lines
+// that are not valid log entries are skipped. Feedback events are attached
+// to the plan with the same execution ID, and so are summaries, or to the
+// most recent accepted plan if they have none.
+func ReadHistory(path string) ([]HistoryEntry, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var entries []HistoryEntry
+    last := -1
+    sc := bufio.NewScanner(f)
+    sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+    for sc.Scan() {
+        var raw struct {
+            TS      string          `json:"ts"`
+            Event   string          `json:"event"`
+            Client  string          `json:"client"`
+            Remote  string          `json:"remote"`
+            Actor   string          `json:"actor"`
+            Role    string          `json:"role"`
+            Agent   string          `json:"user_agent"`
+            Session string          `json:"session"`
+            Device  string          `json:"device"`
+            ID      string          `json:"id"`
+            Data    json.RawMessage `json:"data"`
+        }
+        if json.Unmarshal(sc.Bytes(), &raw) != nil {
+            continue
+        }
+        ts, _ := time.Parse(time.RFC3339Nano, raw.TS)
+        switch raw.Event {
+        case "plan", "plan_rejected":
+            var d struct {
+                Prompt string          `json:"prompt"`
+                Plan   json.RawMessage `json:"plan"`
+                Reason string          `json:"reason"`
+            }
+            if json.Unmarshal(raw.Data, &d) != nil {
+                continue
+            }
+            // Older plans are migrated; plans from a newer build are skipped
+            p, err := plan.Decode(d.Plan)
+            if err != nil {
+                last = -1
+                continue
+            }
+            entries = append(entries, HistoryEntry{ID: raw.ID, Time: ts, Client: raw.Client, Remote: raw.Remote, Actor: raw.Actor, Role: raw.Role, UserAgent: raw.Agent, Session: raw.Session, Device: raw.Device, Prompt: d.Prompt, Plan: p, Rejected: d.Reason})
+            last = -1
+            if raw.Event == "plan" {
+                last = len(entries) - 1
+            }
+        case "results":
+            var items []ResultItem
+            if last < 0 || json.Unmarshal(raw.Data, &items) != nil {
+                continue
+            }
+            entries[last].Results = append(entries[last].Results, items...)
+        case "summary":
+            var d struct {
+                Summary string `json:"summary"`
+            }
+            if json.Unmarshal(raw.Data, &d) != nil {
+                continue
+            }
+            target := last
+            if raw.ID != "" {
+                target = -1
+                for i := len(entries) - 1; i >= 0; i-- {
+                    if entries[i].ID == raw.ID {
+                        target = i
+                        break
+                    }
+                }
+            }
+            if target >= 0 {
+                entries[target].Summary = d.Summary
+            }
+        case "feedback":
+            var fb Feedback
+            if raw.ID == "" || json.Unmarshal(raw.Data, &fb) != nil {
+                continue
+            }
+            fb.Time = ts
+            for i := len(entries) - 1; i >= 0; i-- {
+                if entries[i].ID == raw.ID {
+                    entries[i].Feedback = &fb
+                    break
+                }
+            }
+        }
+    }
+    return entries, sc.Err()
+}
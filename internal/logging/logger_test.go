@@ -9,6 +9,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
 	"github.com/aezizhu/LuciCodex/internal/plan"
 )
 
@@ -137,3 +139,118 @@ func TestLogger_FileError(t *testing.T) {
 
 	// Should not panic and should return early
 }
+
+func TestReadHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := New(path)
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}}}}
+	exec := l.WithExecution("20261016-120000-abcdef").WithClient("mcp:inspector/1.0")
+	exec.Plan("show config", p)
+	exec.Results([]ResultItem{{Index: 0, Command: []string{"uci", "show"}, Artifacts: []string{"uci.txt"}}})
+	l.Rejected("reboot please", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"reboot"}}}}, "command 0 denied by policy")
+	// Results without a preceding accepted plan are ignored
+	l.Results([]ResultItem{{Index: 0, Command: []string{"stray"}}})
+
+	entries, err := ReadHistory(path)
+	if err != nil {
+		t.Fatalf("ReadHistory failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Prompt != "show config" || len(entries[0].Results) != 1 || entries[0].Time.IsZero() ||
+		entries[0].ID != "20261016-120000-abcdef" || entries[0].Client != "mcp:inspector/1.0" || entries[0].Results[0].Artifacts[0] != "uci.txt" {
+		t.Errorf("unexpected first entry: %+v", entries[0])
+	}
+	if entries[1].Rejected == "" || len(entries[1].Results) != 0 || entries[1].ID != "" {
+		t.Errorf("unexpected rejected entry: %+v", entries[1])
+	}
+}
+
+func TestLogger_WithDevice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	ua := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)"
+	l := New(path).WithRemote("192.168.1.23").WithActor("alice", "operator").WithDevice(ua, "root:1a2b3c4d")
+	l.WithExecution("20261017-090000-abcdef").Plan("restart wifi", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}})
+	New(path).Plan("show config", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}}}})
+
+	entries, err := ReadHistory(path)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ReadHistory = %+v, %v", entries, err)
+	}
+	h := entries[0]
+	if h.Actor != "alice" || h.Remote != "192.168.1.23" || h.UserAgent != ua || h.Session != "root:1a2b3c4d" || h.ID != "20261017-090000-abcdef" {
+		t.Errorf("client not recorded: %+v", h)
+	}
+	if h.Device == "" || h.Device != Device("192.168.1.23", ua) || len(h.Device) != 12 {
+		t.Errorf("unexpected device %q", h.Device)
+	}
+	if Device("192.168.1.24", ua) == h.Device || Device("192.168.1.23", "") != "" {
+		t.Error("device should depend on the address and need a user agent")
+	}
+	if h := entries[1]; h.UserAgent != "" || h.Session != "" || h.Device != "" {
+		t.Errorf("CLI entries have no client hints: %+v", h)
+	}
+}
+
+func TestRecordFeedback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	cfg := config.Config{LogFile: path}
+	exec := Open(cfg).WithExecution("20261016-120000-abcdef")
+	exec.Plan("fix wifi", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}})
+	exec.Results([]ResultItem{{Index: 0, Command: []string{"wifi", "reload"}}})
+
+	if _, err := RecordFeedback(cfg, "20261016-120000-abcdef", "meh", ""); errcode.Of(err) != errcode.InvalidRequest {
+		t.Errorf("invalid rating: %v", err)
+	}
+	if _, err := RecordFeedback(cfg, "unknown", RatingBad, ""); errcode.Of(err) != errcode.NotFound {
+		t.Errorf("unknown execution: %v", err)
+	}
+	if _, err := RecordFeedback(cfg, "20261016-120000-abcdef", RatingGood, ""); err != nil {
+		t.Fatal(err)
+	}
+	h, err := RecordFeedback(cfg, "20261016-120000-abcdef", RatingBad, "clients still drop")
+	if err != nil || h.Feedback.Rating != RatingBad {
+		t.Fatalf("RecordFeedback = %+v, %v", h, err)
+	}
+
+	entries, err := ReadHistory(path)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ReadHistory = %d entries, %v", len(entries), err)
+	}
+	if fb := entries[0].Feedback; fb == nil || fb.Rating != RatingBad || fb.Note != "clients still drop" || fb.Time.IsZero() {
+		t.Errorf("latest rating not attached: %+v", fb)
+	}
+	if entries, err = History(cfg); err != nil || len(entries) != 1 || entries[0].Feedback == nil || entries[0].Feedback.Note != "clients still drop" {
+		t.Errorf("latest rating not in the history: %+v, %v", entries, err)
+	}
+}
+
+func TestReadHistory_PlanVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log := `{"ts":"2025-01-02T03:04:05Z","event":"plan","data":{"prompt":"old","plan":{"commands":[{"command":["uptime"]}]}}}
+{"ts":"2025-01-02T03:04:06Z","event":"plan","data":{"prompt":"future","plan":{"version":99,"commands":[{"command":["uptime"]}]}}}
+{"ts":"2025-01-02T03:04:07Z","event":"results","data":[{"index":0,"command":["uptime"],"output":"up"}]}
+`
+	if err := os.WriteFile(path, []byte(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	New(path).Plan("new", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"date"}}}})
+
+	entries, err := ReadHistory(path)
+	if err != nil {
+		t.Fatalf("ReadHistory failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Prompt != "old" || entries[1].Prompt != "new" {
+		t.Fatalf("expected the unsupported plan to be skipped, got %+v", entries)
+	}
+	// The results of the skipped plan must not be attached to the previous one
+	if len(entries[0].Results) != 0 {
+		t.Errorf("unexpected results: %+v", entries[0].Results)
+	}
+	for _, e := range entries {
+		if e.Plan.Version != plan.SchemaVersion {
+			t.Errorf("%s: expected version %d, got %d", e.Prompt, plan.SchemaVersion, e.Plan.Version)
+		}
+	}
+}
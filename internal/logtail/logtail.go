@@ -0,0 +1,218 @@
+// Package logtail follows the system log (logread -f) for `lucicodex tail`,
+// the log_tail MCP tool and WebSocket tail sessions. Lines can be filtered
+// by service and pattern, are redacted, and are handed to a slow consumer
+// through a bounded buffer that drops lines instead of growing. A burst of
+// error lines within a time window raises a Trigger, e.g. to ask the model
+// what went wrong.
+package logtail
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/llm"
+	"github.com/aezizhu/LuciCodex/internal/procgroup"
+	"github.com/aezizhu/LuciCodex/internal/redact"
+)
+
+// Command follows the system log, printing new lines as they are logged.
+var Command = []string{"logread", "-f"}
+
+// DumpCommand prints the lines the system log holds.
+var DumpCommand = []string{"logread"}
+
+// timeLayout is the timestamp logread starts its lines with.
+const timeLayout = "Mon Jan _2 15:04:05 2006"
+
+// Defaults for Options fields left zero.
+const (
+	DefaultBuffer  = 256
+	DefaultWindow  = time.Minute
+	DefaultContext = 50
+)
+
+// DefaultErrorPattern matches lines counted towards Options.Threshold: the
+// syslog priorities err and above, and common error words.
+var DefaultErrorPattern = regexp.MustCompile(`(?i)\.(err|crit|alert|emerg)\s|\b(error|failed|failure|fatal|panic|denied|timed? ?out)\b`)
+
+// Options select the lines to follow.
+type Options struct {
+	Service string         // Only lines logged by this program, e.g. dnsmasq
+	Pattern *regexp.Regexp // Only lines matching this
+	// Error lines within Window that raise a Trigger; 0 disables triggers
+	Threshold    int
+	Window       time.Duration
+	ErrorPattern *regexp.Regexp // DefaultErrorPattern if nil
+	Buffer       int            // Lines held for a slow consumer before dropping
+	Context      int            // Recent lines attached to a Trigger
+}
+
+// Line is one followed log line.
+type Line struct {
+	Time  time.Time `json:"time"`
+	Text  string    `json:"text"` // Redacted
+	Error bool      `json:"error,omitempty"`
+	// Lines dropped before this one because the consumer fell behind
+	Dropped int64 `json:"dropped,omitempty"`
+}
+
+// Trigger reports that Threshold error lines were logged within Window.
+// Counting starts over after each trigger.
+type Trigger struct {
+	Time   time.Time     `json:"time"`
+	Errors int           `json:"errors"`
+	Window time.Duration `json:"window"`
+	Lines  []string      `json:"lines"` // The most recent lines, oldest first
+}
+
+var validService = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ValidService reports whether name can be used as Options.Service.
+func ValidService(name string) bool {
+	return validService.MatchString(name)
+}
+
+// serviceMatcher matches lines logged by service, such as
+// "daemon.info dnsmasq[1234]: ..." or "kern.warn kernel: ...".
+func serviceMatcher(service string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|\s)` + regexp.QuoteMeta(service) + `(\[\d+\])?:`)
+}
+
+// Follow runs Command and calls onLine for every matching line, and
+// onTrigger (if not nil) when the error threshold is reached, until ctx is
+// done or the command exits. Both callbacks run on the calling goroutine.
+// Lines dropped after the last delivered one are reported by a final Line
+// without text.
+func Follow(ctx context.Context, opts Options, onLine func(Line), onTrigger func(Trigger)) error {
+	if opts.Service != "" && !ValidService(opts.Service) {
+		return fmt.Errorf("invalid service name %q", opts.Service)
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = DefaultBuffer
+	}
+	if opts.Window <= 0 {
+		opts.Window = DefaultWindow
+	}
+	if opts.Context <= 0 {
+		opts.Context = DefaultContext
+	}
+	if opts.ErrorPattern == nil {
+		opts.ErrorPattern = DefaultErrorPattern
+	}
+	var service *regexp.Regexp
+	if opts.Service != "" {
+		service = serviceMatcher(opts.Service)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := procgroup.KillOnCancel(exec.CommandContext(ctx, Command[0], Command[1:]...))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	lines := make(chan Line, opts.Buffer)
+	var dropped atomic.Int64
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(stdout)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			text := sc.Text()
+			if service != nil && !service.MatchString(text) || opts.Pattern != nil && !opts.Pattern.MatchString(text) {
+				continue
+			}
+			l := Line{Time: time.Now(), Text: redact.String(text), Error: opts.ErrorPattern.MatchString(text)}
+			select {
+			case lines <- l:
+			default:
+				dropped.Add(1)
+			}
+		}
+	}()
+
+	var recent []string
+	var errorTimes []time.Time
+	for l := range lines {
+		l.Dropped = dropped.Swap(0)
+		onLine(l)
+
+		recent = append(recent, l.Text)
+		if len(recent) > opts.Context {
+			recent = recent[len(recent)-opts.Context:]
+		}
+		if !l.Error || opts.Threshold <= 0 || onTrigger == nil {
+			continue
+		}
+		errorTimes = append(errorTimes, l.Time)
+		for len(errorTimes) > 0 && l.Time.Sub(errorTimes[0]) > opts.Window {
+			errorTimes = errorTimes[1:]
+		}
+		if len(errorTimes) >= opts.Threshold {
+			onTrigger(Trigger{Time: l.Time, Errors: len(errorTimes), Window: opts.Window, Lines: append([]string(nil), recent...)})
+			errorTimes = nil
+		}
+	}
+
+	if n := dropped.Swap(0); n > 0 {
+		onLine(Line{Time: time.Now(), Dropped: n})
+	}
+
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("%s: %w", strings.Join(Command, " "), err)
+	}
+	return nil
+}
+
+// Errors returns the last limit (if > 0) error lines, as matched by
+// DefaultErrorPattern, that DumpCommand prints with a timestamp not before
+// since. Lines are redacted.
+func Errors(ctx context.Context, since time.Time, limit int) ([]string, error) {
+	out, err := exec.CommandContext(ctx, DumpCommand[0], DumpCommand[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", strings.Join(DumpCommand, " "), err)
+	}
+	var lines []string
+	for _, text := range strings.Split(string(out), "\n") {
+		if !DefaultErrorPattern.MatchString(text) {
+			continue
+		}
+		if len(text) >= len(timeLayout) {
+			if t, err := time.ParseInLocation(timeLayout, text[:len(timeLayout)], time.Local); err == nil && t.Before(since) {
+				continue
+			}
+		}
+		lines = append(lines, redact.String(text))
+	}
+	if limit > 0 && len(lines) > limit {
+		lines = lines[len(lines)-limit:]
+	}
+	return lines, nil
+}
+
+// Analyze asks the model of cfg what the lines of tr show and how to fix
+// it. It returns a summary and details as llm.Summarize does.
+func Analyze(ctx context.Context, cfg config.Config, service string, tr Trigger) (string, []string, error) {
+	subject := "the system log"
+	if service != "" {
+		subject = service
+	}
+	return llm.Summarize(ctx, cfg, llm.SummaryInput{
+		Prompt: fmt.Sprintf("%s logged %d error lines within %s. What is going wrong and how can it be fixed?", subject, tr.Errors, tr.Window),
+		Commands: []llm.SummaryCommand{{
+			Command: Command,
+			Output:  strings.Join(tr.Lines, "\n"),
+		}},
+	})
+}
@@ -0,0 +1,104 @@
+package logtail
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLog makes Command print log instead of following the system log.
+func fakeLog(t *testing.T, log string) {
+	old := Command
+	Command = []string{"printf", "%s", log}
+	t.Cleanup(func() { Command = old })
+}
+
+const sample = `Thu Oct 16 12:00:00 2026 daemon.info dnsmasq[1234]: started, version 2.90
+Thu Oct 16 12:00:01 2026 daemon.err odhcpd[99]: failed to bind socket
+Thu Oct 16 12:00:02 2026 daemon.warn dnsmasq[1234]: DHCP packet received on wan which has no address
+Thu Oct 16 12:00:03 2026 daemon.err dnsmasq[1234]: failed to send packet: Network unreachable
+Thu Oct 16 12:00:04 2026 daemon.info dnsmasq-dhcp[1234]: DHCPACK(br-lan) 192.168.1.20
+Thu Oct 16 12:00:05 2026 daemon.err dnsmasq[1234]: failed to send packet: Network unreachable
+`
+
+func TestFollow_Filters(t *testing.T) {
+	fakeLog(t, sample)
+	var got []Line
+	err := Follow(context.Background(), Options{Service: "dnsmasq"}, func(l Line) { got = append(got, l) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 || !strings.Contains(got[0].Text, "started") || got[0].Error || !got[2].Error {
+		t.Fatalf("unexpected lines: %+v", got)
+	}
+
+	got = nil
+	err = Follow(context.Background(), Options{Service: "dnsmasq", Pattern: regexp.MustCompile(`unreachable`)}, func(l Line) { got = append(got, l) }, nil)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("pattern filter: %d lines, %v", len(got), err)
+	}
+
+	if err := Follow(context.Background(), Options{Service: "dns masq"}, func(Line) {}, nil); err == nil {
+		t.Error("expected an invalid service name to fail")
+	}
+}
+
+func TestFollow_Trigger(t *testing.T) {
+	fakeLog(t, sample)
+	var triggers []Trigger
+	opts := Options{Threshold: 2, Window: time.Minute}
+	if err := Follow(context.Background(), opts, func(Line) {}, func(tr Trigger) { triggers = append(triggers, tr) }); err != nil {
+		t.Fatal(err)
+	}
+	// Three error lines: the second fires, the third starts counting over
+	if len(triggers) != 1 || triggers[0].Errors != 2 || len(triggers[0].Lines) != 4 || !strings.Contains(triggers[0].Lines[3], "Network unreachable") {
+		t.Fatalf("unexpected triggers: %+v", triggers)
+	}
+}
+
+func TestFollow_DropsForSlowConsumer(t *testing.T) {
+	fakeLog(t, strings.Repeat("daemon.info test: line\n", 50))
+	var delivered, dropped int64
+	err := Follow(context.Background(), Options{Buffer: 1}, func(l Line) {
+		if l.Text != "" {
+			delivered++
+		}
+		dropped += l.Dropped
+		time.Sleep(10 * time.Millisecond)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped == 0 || delivered+dropped != 50 {
+		t.Errorf("delivered %d, dropped %d of 50 lines", delivered, dropped)
+	}
+}
+
+func TestFollow_CommandFails(t *testing.T) {
+	old := Command
+	Command = []string{"false"}
+	defer func() { Command = old }()
+	if err := Follow(context.Background(), Options{}, func(Line) {}, nil); err == nil {
+		t.Error("expected an error when the log command fails")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	old := DumpCommand
+	DumpCommand = []string{"printf", "%s", sample}
+	defer func() { DumpCommand = old }()
+
+	since := time.Date(2026, time.October, 16, 12, 0, 2, 0, time.Local)
+	lines, err := Errors(context.Background(), since, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "Thu Oct 16 12:00:03") {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+	if lines, _ := Errors(context.Background(), time.Time{}, 1); len(lines) != 1 || !strings.HasPrefix(lines[0], "Thu Oct 16 12:00:05") {
+		t.Errorf("limit: %q", lines)
+	}
+}
@@ -60,8 +60,11 @@ type Collector struct {
 	saveInterval time.Duration
 	stopChan     chan struct{}
 	doneChan     chan struct{}
+	server       *ServerStats
 }
 
+// NewCollector returns a collector saving to filePath every few minutes and
+// on Stop. With an empty filePath the metrics are kept in memory only.
 func NewCollector(filePath string) *Collector {
 	c := &Collector{
 		metrics: &Metrics{
@@ -76,6 +79,11 @@ func NewCollector(filePath string) *Collector {
 		saveInterval: 5 * time.Minute,
 		stopChan:     make(chan struct{}),
 		doneChan:     make(chan struct{}),
+		server:       newServerStats(),
+	}
+	if filePath == "" {
+		close(c.doneChan)
+		return c
 	}
 
 	// Load existing metrics
@@ -137,6 +145,11 @@ func (c *Collector) RecordRequest(provider, prompt string, p plan.Plan, duration
 	c.addRecentRequest(req)
 }
 
+// Server returns the daemon's HTTP, WebSocket and MCP counters.
+func (c *Collector) Server() *ServerStats {
+	return c.server
+}
+
 func (c *Collector) addRecentRequest(req RequestMetric) {
 	if len(c.metrics.RecentRequests) >= c.metrics.maxRecent {
 		// Shift left to remove oldest
@@ -187,6 +200,9 @@ func (c *Collector) GetMetrics() *Metrics {
 }
 
 func (c *Collector) Save() error {
+	if c.filePath == "" {
+		return nil
+	}
 	m := c.snapshot()
 	data, err := json.MarshalIndent(m, "", "  ")
 	if err != nil {
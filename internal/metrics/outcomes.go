@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/logging"
+)
+
+// PatternStats is how commands of one pattern (see CommandPattern) fared:
+// how often they ran and failed, and how the executions they were part of
+// were rated by users.
+type PatternStats struct {
+	Runs        int64   `json:"runs"`
+	Failures    int64   `json:"failures"`
+	Good        int64   `json:"good"` // Runs in executions rated good
+	Bad         int64   `json:"bad"`  // Runs in executions rated bad
+	SuccessRate float64 `json:"success_rate"`
+}
+
+// CommandPattern groups argv with similar commands: the program and its
+// first argument if that is a plain word, e.g. "uci set", "ubus call" or
+// "/etc/init.d/network restart". Options, numbers, paths, addresses and UCI
+// keys are not part of the pattern.
+func CommandPattern(argv []string) string {
+	if len(argv) == 0 {
+		return ""
+	}
+	pattern := argv[0]
+	if len(argv) > 1 && argv[1] != "" && !strings.ContainsAny(argv[1][:1], "-0123456789") && !strings.ContainsAny(argv[1], "./=:@'\"") {
+		pattern += " " + argv[1]
+	}
+	if strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "/etc/init.d/") {
+		pattern = path.Base(pattern)
+	}
+	return pattern
+}
+
+// CommandOutcomes aggregates the executed commands of history entries
+// logged since the given time by command pattern.
+func CommandOutcomes(entries []logging.HistoryEntry, since time.Time) map[string]*PatternStats {
+	stats := map[string]*PatternStats{}
+	for _, h := range entries {
+		if h.Time.Before(since) {
+			continue
+		}
+		for _, r := range h.Results {
+			pattern := CommandPattern(r.Command)
+			if pattern == "" {
+				continue
+			}
+			ps := stats[pattern]
+			if ps == nil {
+				ps = &PatternStats{}
+				stats[pattern] = ps
+			}
+			ps.Runs++
+			if r.Error != "" {
+				ps.Failures++
+			}
+			if h.Feedback != nil {
+				switch h.Feedback.Rating {
+				case logging.RatingGood:
+					ps.Good++
+				case logging.RatingBad:
+					ps.Bad++
+				}
+			}
+		}
+	}
+	for _, ps := range stats {
+		ps.SuccessRate = percent(ps.Runs-ps.Failures, ps.Runs)
+	}
+	return stats
+}
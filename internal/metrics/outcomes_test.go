@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/logging"
+)
+
+func TestCommandPattern(t *testing.T) {
+	cases := map[string][]string{
+		"uci set":                     {"uci", "set", "wireless.radio0.channel=36"},
+		"ubus call":                   {"ubus", "call", "network.interface.wan", "status"},
+		"/etc/init.d/network restart": {"/etc/init.d/network", "restart"},
+		"ping":                        {"ping", "-c", "4", "8.8.8.8"},
+		"opkg install":                {"opkg", "install", "tcpdump"},
+		"ip route":                    {"/sbin/ip", "route", "show"},
+		"logread":                     {"logread"},
+		"":                            {},
+	}
+	for want, argv := range cases {
+		if got := CommandPattern(argv); got != want {
+			t.Errorf("CommandPattern(%q) = %q, want %q", argv, got, want)
+		}
+	}
+}
+
+func TestCommandOutcomes(t *testing.T) {
+	now := time.Now()
+	entries := []logging.HistoryEntry{
+		{Time: now.AddDate(0, 0, -30), Results: []logging.ResultItem{{Command: []string{"wifi", "reload"}}}},
+		{Time: now, Feedback: &logging.Feedback{Rating: logging.RatingGood}, Results: []logging.ResultItem{
+			{Command: []string{"wifi", "reload"}},
+			{Command: []string{"uci", "commit", "wireless"}},
+		}},
+		{Time: now, Feedback: &logging.Feedback{Rating: logging.RatingBad}, Results: []logging.ResultItem{
+			{Command: []string{"wifi", "reload"}, Error: "exit status 1"},
+		}},
+	}
+	stats := CommandOutcomes(entries, now.AddDate(0, 0, -7))
+	wifi := stats["wifi reload"]
+	if wifi == nil || wifi.Runs != 2 || wifi.Failures != 1 || wifi.Good != 1 || wifi.Bad != 1 || wifi.SuccessRate != 50 {
+		t.Errorf("unexpected wifi reload stats: %+v", wifi)
+	}
+	if uci := stats["uci commit"]; uci == nil || uci.Runs != 1 || uci.SuccessRate != 100 {
+		t.Errorf("unexpected uci commit stats: %+v", uci)
+	}
+}
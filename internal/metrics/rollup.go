@@ -0,0 +1,401 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/storage"
+)
+
+// DefaultRetentionDays is how many daily rollup files are kept when no
+// retention is configured.
+const DefaultRetentionDays = 30
+
+const dayLayout = "2006-01-02"
+
+// RecentSamples is how many of the day's latest requests a rollup keeps
+// individually, for the latency sparkline of `lucicodex top`.
+const RecentSamples = 60
+
+// DailyRollup aggregates all requests recorded on one (local) day.
+type DailyRollup struct {
+	Date      string                    `json:"date"`
+	Requests  int64                     `json:"requests"`
+	Successes int64                     `json:"successes"`
+	Failures  int64                     `json:"failures"`
+	Commands  int64                     `json:"commands"`
+	Providers map[string]*ProviderStats `json:"providers"`
+	Errors    map[string]int64          `json:"errors,omitempty"`
+	// Escalations counts plans asked again of a stronger model (see Escalate)
+	Escalations int64 `json:"escalations,omitempty"`
+	// The last RecentSamples requests, oldest first
+	Recent []Sample `json:"recent,omitempty"`
+}
+
+// Sample is one recorded LLM request.
+type Sample struct {
+	Time     time.Time     `json:"time"`
+	Provider string        `json:"provider"`
+	Duration time.Duration `json:"duration_ns"`
+	Failed   bool          `json:"failed,omitempty"`
+}
+
+// ProviderStats accumulates LLM latency for one provider.
+type ProviderStats struct {
+	Requests  int64         `json:"requests"`
+	Failures  int64         `json:"failures"`
+	TotalTime time.Duration `json:"total_time_ns"`
+	// Prompt caching, for providers that report it (see RecordCache)
+	InputTokens      int64 `json:"input_tokens,omitempty"`
+	CacheReadTokens  int64 `json:"cache_read_tokens,omitempty"`
+	CacheWriteTokens int64 `json:"cache_write_tokens,omitempty"`
+	CacheHits        int64 `json:"cache_hits,omitempty"`
+}
+
+// CacheUsage is the prompt caching of one LLM response. InputTokens counts
+// all tokens of the prompt, including those read from or written to the
+// cache.
+type CacheUsage struct {
+	InputTokens      int
+	CacheReadTokens  int
+	CacheWriteTokens int
+}
+
+// RollupStore persists one DailyRollup document per day and prunes those
+// older than RetentionDays. Updates read, merge and rewrite the day's
+// document so short-lived CLI runs and the daemon can share it.
+type RollupStore struct {
+	RetentionDays int
+
+	st  storage.Store
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = map[string]*RollupStore{}
+)
+
+// OpenRollupStore returns the process-wide store for cfg.MetricsDir so
+// concurrent requests in the daemon serialize their updates. It returns nil
+// when the directory is empty, which disables persistence.
+func OpenRollupStore(cfg config.Config) *RollupStore {
+	dir := cfg.MetricsDir
+	if dir == "" {
+		return nil
+	}
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if s, ok := stores[dir]; ok {
+		if cfg.MetricsRetentionDays > 0 {
+			s.mu.Lock()
+			s.RetentionDays = cfg.MetricsRetentionDays
+			s.mu.Unlock()
+		}
+		return s
+	}
+	s := NewRollupStore(storage.Open(cfg, dir), cfg.MetricsRetentionDays)
+	stores[dir] = s
+	return s
+}
+
+func NewRollupStore(st storage.Store, retentionDays int) *RollupStore {
+	if retentionDays <= 0 {
+		retentionDays = DefaultRetentionDays
+	}
+	return &RollupStore{RetentionDays: retentionDays, st: st, now: time.Now}
+}
+
+func rollupKey(date string) string {
+	return "metrics-" + date + ".json"
+}
+
+func newRollup(date string) *DailyRollup {
+	return &DailyRollup{Date: date, Providers: map[string]*ProviderStats{}, Errors: map[string]int64{}}
+}
+
+func (s *RollupStore) load(date string) (*DailyRollup, error) {
+	r := newRollup(date)
+	if err := s.st.Get("", rollupKey(date), r); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return r, nil
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// Record adds one LLM request to today's rollup. A nil store ignores it.
+func (s *RollupStore) Record(provider string, numCommands int, duration time.Duration, err error) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	date := s.now().Format(dayLayout)
+	r := newRollup(date)
+	newDay := false
+	uErr := s.st.Update("", rollupKey(date), r, func() error {
+		if r.Providers == nil {
+			r.Providers = map[string]*ProviderStats{}
+		}
+		if r.Errors == nil {
+			r.Errors = map[string]int64{}
+		}
+		newDay = r.Requests == 0
+
+		r.Requests++
+		r.Commands += int64(numCommands)
+		ps := r.Providers[provider]
+		if ps == nil {
+			ps = &ProviderStats{}
+			r.Providers[provider] = ps
+		}
+		ps.Requests++
+		ps.TotalTime += duration
+		if err == nil {
+			r.Successes++
+		} else {
+			r.Failures++
+			ps.Failures++
+			r.Errors[fmt.Sprintf("%T", err)]++
+		}
+		r.Recent = append(r.Recent, Sample{Time: s.now(), Provider: provider, Duration: duration, Failed: err != nil})
+		if len(r.Recent) > RecentSamples {
+			r.Recent = r.Recent[len(r.Recent)-RecentSamples:]
+		}
+		return nil
+	})
+	if uErr != nil {
+		return uErr
+	}
+	if newDay {
+		return s.prune()
+	}
+	return nil
+}
+
+// RecordCache adds the prompt caching of one response to today's rollup of
+// provider. The request itself is counted by Record. A nil store ignores it.
+func (s *RollupStore) RecordCache(provider string, u CacheUsage) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	date := s.now().Format(dayLayout)
+	r := newRollup(date)
+	return s.st.Update("", rollupKey(date), r, func() error {
+		if r.Providers == nil {
+			r.Providers = map[string]*ProviderStats{}
+		}
+		ps := r.Providers[provider]
+		if ps == nil {
+			ps = &ProviderStats{}
+			r.Providers[provider] = ps
+		}
+		ps.InputTokens += int64(u.InputTokens)
+		ps.CacheReadTokens += int64(u.CacheReadTokens)
+		ps.CacheWriteTokens += int64(u.CacheWriteTokens)
+		if u.CacheReadTokens > 0 {
+			ps.CacheHits++
+		}
+		return nil
+	})
+}
+
+// errQuotaSpent stops Escalate from rewriting a rollup whose quota is spent.
+var errQuotaSpent = errors.New("escalation quota spent")
+
+// Escalate takes one escalation to a stronger model (see
+// config.Config.EscalationModel) from today's quota and records it in
+// today's rollup. It reports false once quota escalations were recorded
+// today. Like the rollup, the quota is shared by the CLI and the daemon.
+func (s *RollupStore) Escalate(quota int) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	date := s.now().Format(dayLayout)
+	r := newRollup(date)
+	err := s.st.Update("", rollupKey(date), r, func() error {
+		if r.Escalations >= int64(quota) {
+			return errQuotaSpent
+		}
+		r.Escalations++
+		return nil
+	})
+	if errors.Is(err, errQuotaSpent) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// prune removes rollups older than the retention window.
+func (s *RollupStore) prune() error {
+	keys, err := s.st.List("")
+	if err != nil {
+		return err
+	}
+	cutoff := s.now().AddDate(0, 0, -s.RetentionDays+1).Format(dayLayout)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "metrics-") || !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		date := strings.TrimSuffix(strings.TrimPrefix(key, "metrics-"), ".json")
+		if _, err := time.Parse(dayLayout, date); err != nil {
+			continue
+		}
+		if date < cutoff {
+			_ = s.st.Delete("", key)
+		}
+	}
+	return nil
+}
+
+// Days returns the rollups for the last n days (today included), oldest first.
+// Days without activity are omitted.
+func (s *RollupStore) Days(n int) ([]DailyRollup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n <= 0 {
+		n = s.RetentionDays
+	}
+	today := s.now()
+	var out []DailyRollup
+	for i := n - 1; i >= 0; i-- {
+		date := today.AddDate(0, 0, -i).Format(dayLayout)
+		r, err := s.load(date)
+		if err != nil {
+			return nil, err
+		}
+		if r.Requests > 0 {
+			out = append(out, *r)
+		}
+	}
+	return out, nil
+}
+
+// Recent returns the last n requests recorded today and yesterday, oldest
+// first; at most RecentSamples of each day are kept. A nil store has none.
+func (s *RollupStore) Recent(n int) ([]Sample, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	today := s.now()
+	var out []Sample
+	for _, day := range []time.Time{today.AddDate(0, 0, -1), today} {
+		r, err := s.load(day.Format(dayLayout))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r.Recent...)
+	}
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out, nil
+}
+
+// DaySummary is the per-day view returned by aggregation queries.
+type DaySummary struct {
+	Date        string  `json:"date"`
+	Requests    int64   `json:"requests"`
+	SuccessRate float64 `json:"success_rate"`
+	Commands    int64   `json:"commands"`
+	Escalations int64   `json:"escalations"`
+}
+
+// ProviderSummary is the per-provider view returned by aggregation queries.
+type ProviderSummary struct {
+	Requests     int64   `json:"requests"`
+	SuccessRate  float64 `json:"success_rate"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	// Prompt caching: responses that read from the cache, the tokens read
+	// and written, and the percentage of input tokens read from the cache
+	CacheHits        int64   `json:"cache_hits,omitempty"`
+	CacheReadTokens  int64   `json:"cache_read_tokens,omitempty"`
+	CacheWriteTokens int64   `json:"cache_write_tokens,omitempty"`
+	CacheHitRate     float64 `json:"cache_hit_rate,omitempty"`
+}
+
+// StatsSummary aggregates a range of daily rollups.
+type StatsSummary struct {
+	Days        []DaySummary               `json:"days"`
+	Providers   map[string]ProviderSummary `json:"providers"`
+	Requests    int64                      `json:"requests"`
+	SuccessRate float64                    `json:"success_rate"`
+	Escalations int64                      `json:"escalations"`
+	// Outcomes per command pattern from the audit log (see CommandOutcomes);
+	// set by callers that have one
+	Commands map[string]*PatternStats `json:"commands,omitempty"`
+}
+
+// Summarize computes per-day success rates and per-provider average latency.
+func Summarize(rollups []DailyRollup) StatsSummary {
+	sum := StatsSummary{Days: []DaySummary{}, Providers: map[string]ProviderSummary{}}
+	var successes int64
+	totals := map[string]*ProviderStats{}
+	for _, r := range rollups {
+		sum.Days = append(sum.Days, DaySummary{
+			Date:        r.Date,
+			Requests:    r.Requests,
+			SuccessRate: percent(r.Successes, r.Requests),
+			Commands:    r.Commands,
+			Escalations: r.Escalations,
+		})
+		sum.Requests += r.Requests
+		sum.Escalations += r.Escalations
+		successes += r.Successes
+		for name, ps := range r.Providers {
+			t := totals[name]
+			if t == nil {
+				t = &ProviderStats{}
+				totals[name] = t
+			}
+			t.Requests += ps.Requests
+			t.Failures += ps.Failures
+			t.TotalTime += ps.TotalTime
+			t.InputTokens += ps.InputTokens
+			t.CacheReadTokens += ps.CacheReadTokens
+			t.CacheWriteTokens += ps.CacheWriteTokens
+			t.CacheHits += ps.CacheHits
+		}
+	}
+	sort.Slice(sum.Days, func(i, j int) bool { return sum.Days[i].Date < sum.Days[j].Date })
+	sum.SuccessRate = percent(successes, sum.Requests)
+	for name, t := range totals {
+		ps := ProviderSummary{
+			Requests:         t.Requests,
+			SuccessRate:      percent(t.Requests-t.Failures, t.Requests),
+			CacheHits:        t.CacheHits,
+			CacheReadTokens:  t.CacheReadTokens,
+			CacheWriteTokens: t.CacheWriteTokens,
+			CacheHitRate:     percent(t.CacheReadTokens, t.InputTokens),
+		}
+		if t.Requests > 0 {
+			ps.AvgLatencyMs = float64(t.TotalTime) / float64(t.Requests) / float64(time.Millisecond)
+		}
+		sum.Providers[name] = ps
+	}
+	return sum
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total) * 100
+}
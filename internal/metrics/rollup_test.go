@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/storage"
+)
+
+func TestRollupStore_RecordAndSummarize(t *testing.T) {
+	dir := t.TempDir()
+	s := NewRollupStore(storage.NewFileStore(dir), 7)
+	day := time.Date(2025, 3, 10, 12, 0, 0, 0, time.Local)
+	s.now = func() time.Time { return day }
+
+	s.Record("gemini", 2, 100*time.Millisecond, nil)
+	s.Record("gemini", 0, 300*time.Millisecond, errors.New("boom"))
+	day = day.AddDate(0, 0, 1)
+	s.Record("openai", 1, 50*time.Millisecond, nil)
+
+	rollups, err := s.Days(7)
+	if err != nil {
+		t.Fatalf("Days failed: %v", err)
+	}
+	if len(rollups) != 2 || rollups[0].Date != "2025-03-10" || rollups[1].Date != "2025-03-11" {
+		t.Fatalf("unexpected rollups: %+v", rollups)
+	}
+
+	sum := Summarize(rollups)
+	if sum.Requests != 3 {
+		t.Errorf("expected 3 requests, got %d", sum.Requests)
+	}
+	if sum.Days[0].SuccessRate != 50 || sum.Days[1].SuccessRate != 100 {
+		t.Errorf("unexpected daily success rates: %+v", sum.Days)
+	}
+	if g := sum.Providers["gemini"]; g.AvgLatencyMs != 200 || g.SuccessRate != 50 {
+		t.Errorf("unexpected gemini summary: %+v", g)
+	}
+	if o := sum.Providers["openai"]; o.AvgLatencyMs != 50 {
+		t.Errorf("unexpected openai summary: %+v", o)
+	}
+}
+
+func TestRollupStore_Prune(t *testing.T) {
+	dir := t.TempDir()
+	s := NewRollupStore(storage.NewFileStore(dir), 3)
+	day := time.Date(2025, 3, 1, 12, 0, 0, 0, time.Local)
+	s.now = func() time.Time { return day }
+	for i := 0; i < 5; i++ {
+		s.Record("gemini", 0, time.Millisecond, nil)
+		day = day.AddDate(0, 0, 1)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "metrics-*.json"))
+	if len(files) != 3 {
+		t.Errorf("expected 3 retained rollups, got %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "metrics-2025-03-01.json")); !os.IsNotExist(err) {
+		t.Error("expected oldest rollup to be pruned")
+	}
+}
+
+func TestOpenRollupStore(t *testing.T) {
+	if OpenRollupStore(config.Config{}) != nil {
+		t.Error("expected nil store for empty dir")
+	}
+	// A nil store ignores records
+	var s *RollupStore
+	if err := s.Record("gemini", 0, 0, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	dir := t.TempDir()
+	cfg := config.Config{MetricsDir: dir, MetricsRetentionDays: 5}
+	if OpenRollupStore(cfg) != OpenRollupStore(cfg) {
+		t.Error("expected the same store for the same dir")
+	}
+}
+
+func TestRollupStore_Escalate(t *testing.T) {
+	s := NewRollupStore(storage.NewFileStore(t.TempDir()), 7)
+	day := time.Date(2025, 3, 10, 12, 0, 0, 0, time.Local)
+	s.now = func() time.Time { return day }
+
+	for i := 0; i < 2; i++ {
+		if ok, err := s.Escalate(2); !ok || err != nil {
+			t.Fatalf("escalation %d: got %v, %v", i, ok, err)
+		}
+	}
+	if ok, err := s.Escalate(2); ok || err != nil {
+		t.Fatalf("expected the quota to be spent, got %v, %v", ok, err)
+	}
+	s.Record("gemini", 1, time.Millisecond, nil)
+	day = day.AddDate(0, 0, 1)
+	if ok, _ := s.Escalate(2); !ok {
+		t.Fatal("expected a new quota the next day")
+	}
+	s.Record("gemini", 1, time.Millisecond, nil)
+
+	rollups, err := s.Days(7)
+	if err != nil {
+		t.Fatalf("Days failed: %v", err)
+	}
+	sum := Summarize(rollups)
+	if sum.Escalations != 3 || sum.Days[0].Escalations != 2 || sum.Days[1].Escalations != 1 {
+		t.Fatalf("unexpected escalation counts: %+v", sum)
+	}
+}
+
+func TestRollupStore_Recent(t *testing.T) {
+	s := NewRollupStore(storage.NewFileStore(t.TempDir()), 7)
+	day := time.Date(2025, 3, 10, 12, 0, 0, 0, time.Local)
+	s.now = func() time.Time { return day }
+
+	for i := 0; i < RecentSamples+5; i++ {
+		s.Record("gemini", 1, time.Duration(i)*time.Millisecond, nil)
+	}
+	day = day.AddDate(0, 0, 1)
+	s.Record("openai", 1, time.Second, errors.New("boom"))
+
+	samples, err := s.Recent(10)
+	if err != nil {
+		t.Fatalf("Recent failed: %v", err)
+	}
+	if len(samples) != 10 {
+		t.Fatalf("expected 10 samples, got %d", len(samples))
+	}
+	if last := samples[9]; last.Provider != "openai" || !last.Failed || last.Duration != time.Second {
+		t.Errorf("expected today's request last, got %+v", last)
+	}
+	if first := samples[0]; first.Provider != "gemini" || first.Duration != time.Duration(RecentSamples-4)*time.Millisecond {
+		t.Errorf("unexpected oldest sample %+v", first)
+	}
+
+	samples, _ = s.Recent(1000)
+	if len(samples) != RecentSamples+1 {
+		t.Errorf("expected %d samples kept over two days, got %d", RecentSamples+1, len(samples))
+	}
+	if samples, err := (*RollupStore)(nil).Recent(5); samples != nil || err != nil {
+		t.Errorf("expected nothing from a nil store, got %v, %v", samples, err)
+	}
+}
+
+func TestRollupStore_RecordCache(t *testing.T) {
+	s := NewRollupStore(storage.NewFileStore(t.TempDir()), 7)
+	s.now = func() time.Time { return time.Date(2025, 3, 10, 12, 0, 0, 0, time.Local) }
+
+	s.Record("anthropic", 1, 100*time.Millisecond, nil)
+	s.RecordCache("anthropic", CacheUsage{InputTokens: 1000, CacheWriteTokens: 900})
+	s.Record("anthropic", 1, 100*time.Millisecond, nil)
+	s.RecordCache("anthropic", CacheUsage{InputTokens: 1000, CacheReadTokens: 900})
+
+	rollups, err := s.Days(1)
+	if err != nil {
+		t.Fatalf("Days failed: %v", err)
+	}
+	a := Summarize(rollups).Providers["anthropic"]
+	if a.Requests != 2 || a.CacheHits != 1 || a.CacheReadTokens != 900 || a.CacheWriteTokens != 900 || a.CacheHitRate != 45 {
+		t.Errorf("unexpected anthropic summary: %+v", a)
+	}
+	if err := (*RollupStore)(nil).RecordCache("anthropic", CacheUsage{}); err != nil {
+		t.Errorf("expected a nil store to ignore cache usage, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ServerStats instruments the daemon: per-endpoint request counts, status
+// codes, durations and in-flight gauges, WebSocket sessions and MCP methods.
+// It is safe for concurrent use and kept in memory only.
+type ServerStats struct {
+	mu        sync.Mutex
+	started   time.Time
+	endpoints map[string]*EndpointStats
+	sessions  SessionStats
+	mcp       map[string]int64
+}
+
+// EndpointStats are the counters of one route.
+type EndpointStats struct {
+	Requests      int64            `json:"requests"`
+	InFlight      int64            `json:"in_flight"`
+	Statuses      map[string]int64 `json:"statuses"` // Keyed by status code
+	TotalDuration time.Duration    `json:"total_duration_ns"`
+	MaxDuration   time.Duration    `json:"max_duration_ns"`
+}
+
+// SessionStats describe WebSocket sessions.
+type SessionStats struct {
+	Opened        int64         `json:"opened"`
+	Active        int64         `json:"active"`
+	TotalDuration time.Duration `json:"total_duration_ns"`
+	MaxDuration   time.Duration `json:"max_duration_ns"`
+}
+
+// ServerSnapshot is a consistent copy of ServerStats.
+type ServerSnapshot struct {
+	Started    time.Time                `json:"started"`
+	InFlight   int64                    `json:"in_flight"`
+	Endpoints  map[string]EndpointStats `json:"endpoints"`
+	WebSocket  SessionStats             `json:"websocket"`
+	MCPMethods map[string]int64         `json:"mcp_methods"`
+}
+
+func newServerStats() *ServerStats {
+	return &ServerStats{
+		started:   time.Now(),
+		endpoints: map[string]*EndpointStats{},
+		mcp:       map[string]int64{},
+	}
+}
+
+// Begin counts a request to endpoint as in flight. The returned function
+// records its status code and duration when the request is done.
+func (s *ServerStats) Begin(endpoint string) func(status int) {
+	start := time.Now()
+	s.mu.Lock()
+	e := s.endpoints[endpoint]
+	if e == nil {
+		e = &EndpointStats{Statuses: map[string]int64{}}
+		s.endpoints[endpoint] = e
+	}
+	e.InFlight++
+	s.mu.Unlock()
+
+	return func(status int) {
+		d := time.Since(start)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		e.InFlight--
+		e.Requests++
+		e.Statuses[strconv.Itoa(status)]++
+		e.TotalDuration += d
+		if d > e.MaxDuration {
+			e.MaxDuration = d
+		}
+	}
+}
+
+// SessionOpened counts a WebSocket session as active. The returned function
+// records its duration when it closes.
+func (s *ServerStats) SessionOpened() func() {
+	start := time.Now()
+	s.mu.Lock()
+	s.sessions.Opened++
+	s.sessions.Active++
+	s.mu.Unlock()
+
+	return func() {
+		d := time.Since(start)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.sessions.Active--
+		s.sessions.TotalDuration += d
+		if d > s.sessions.MaxDuration {
+			s.sessions.MaxDuration = d
+		}
+	}
+}
+
+// CountMCP counts one MCP JSON-RPC call of method.
+func (s *ServerStats) CountMCP(method string) {
+	s.mu.Lock()
+	s.mcp[method]++
+	s.mu.Unlock()
+}
+
+// Snapshot returns a copy of the current counters.
+func (s *ServerStats) Snapshot() ServerSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := ServerSnapshot{
+		Started:    s.started,
+		Endpoints:  make(map[string]EndpointStats, len(s.endpoints)),
+		WebSocket:  s.sessions,
+		MCPMethods: make(map[string]int64, len(s.mcp)),
+	}
+	for name, e := range s.endpoints {
+		c := *e
+		c.Statuses = make(map[string]int64, len(e.Statuses))
+		for code, n := range e.Statuses {
+			c.Statuses[code] = n
+		}
+		out.Endpoints[name] = c
+		out.InFlight += e.InFlight
+	}
+	for m, n := range s.mcp {
+		out.MCPMethods[m] = n
+	}
+	return out
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestServerStats(t *testing.T) {
+	s := NewCollector("").Server()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			done := s.Begin("/v1/plan")
+			if i%5 == 0 {
+				done(500)
+			} else {
+				done(200)
+			}
+			s.CountMCP("tools/call")
+		}(i)
+	}
+	wg.Wait()
+
+	open := s.Begin("/v1/execute")
+	closeSession := s.SessionOpened()
+	snap := s.Snapshot()
+	if snap.InFlight != 1 || snap.WebSocket.Active != 1 {
+		t.Errorf("expected one request and one session in flight: %+v", snap)
+	}
+	open(200)
+	closeSession()
+
+	snap = s.Snapshot()
+	plan := snap.Endpoints["/v1/plan"]
+	if plan.Requests != 50 || plan.Statuses["200"] != 40 || plan.Statuses["500"] != 10 {
+		t.Errorf("unexpected /v1/plan stats: %+v", plan)
+	}
+	if plan.TotalDuration < plan.MaxDuration {
+		t.Errorf("max duration %v exceeds total %v", plan.MaxDuration, plan.TotalDuration)
+	}
+	if snap.InFlight != 0 || snap.WebSocket.Active != 0 || snap.WebSocket.Opened != 1 {
+		t.Errorf("unexpected gauges after completion: %+v", snap)
+	}
+	if snap.MCPMethods["tools/call"] != 50 {
+		t.Errorf("expected 50 MCP calls, got %v", snap.MCPMethods)
+	}
+
+	// Snapshots are copies
+	snap.Endpoints["/v1/plan"].Statuses["200"] = 0
+	if s.Snapshot().Endpoints["/v1/plan"].Statuses["200"] != 40 {
+		t.Error("snapshot shares its maps with the live counters")
+	}
+}
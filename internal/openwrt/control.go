@@ -0,0 +1,132 @@
+package openwrt
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ControlPath is how the session requesting a plan reaches the router: the
+// logical interface its traffic arrives on and the firewall zones of that
+// interface. Commands taking these down cut the session off.
+type ControlPath struct {
+	Client    string   `json:"client"`           // Source IP of the session
+	Interface string   `json:"interface"`        // Logical interface, e.g. "lan"
+	Device    string   `json:"device,omitempty"` // e.g. "br-lan"
+	Zones     []string `json:"zones,omitempty"`  // Firewall zone names
+	// UCI sections of Zones, e.g. "lan" or "@zone[0]"
+	ZoneSections []string `json:"zone_sections,omitempty"`
+}
+
+// SSHControlPath returns the control path of the SSH session this process
+// runs in, if any.
+func SSHControlPath(ctx context.Context) *ControlPath {
+	client, local := sshSession(os.Getenv)
+	if client == "" {
+		return nil
+	}
+	return FindControlPath(ctx, client, local)
+}
+
+// sshSession returns the client and router addresses of the SSH session
+// described by SSH_CONNECTION in getenv, if any.
+func sshSession(getenv func(string) string) (client, local string) {
+	// "<client ip> <client port> <server ip> <server port>"
+	fields := strings.Fields(getenv("SSH_CONNECTION"))
+	if len(fields) != 4 {
+		return "", ""
+	}
+	return fields[0], fields[2]
+}
+
+// FindControlPath returns the path of a session from client to the router
+// address local, which may be empty if unknown. The interface holding local
+// is preferred; otherwise it is the one whose subnet contains client.
+// Sessions from the router itself have no path, and neither have clients no
+// interface serves, e.g. ones routed through the WAN.
+func FindControlPath(ctx context.Context, client, local string) *ControlPath {
+	clientIP := net.ParseIP(client)
+	if clientIP == nil || clientIP.IsLoopback() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	ifaces, err := parseInterfaceDump(runCommand(ctx, "ubus", "call", "network.interface", "dump", "{}"))
+	if err != nil {
+		return nil
+	}
+
+	found := findInterface(ifaces, func(cidr *net.IPNet, addr net.IP) bool { return addr.Equal(net.ParseIP(local)) })
+	if found == nil {
+		found = findInterface(ifaces, func(cidr *net.IPNet, addr net.IP) bool { return cidr.Contains(clientIP) })
+	}
+	if found == nil {
+		return nil
+	}
+
+	cp := &ControlPath{Client: clientIP.String(), Interface: found.Name, Device: found.Device}
+	cp.Zones, cp.ZoneSections = zonesOf(runCommand(ctx, "uci", "-q", "show", "firewall"), found.Name)
+	return cp
+}
+
+// findInterface returns the first interface with an address for which
+// match is true.
+func findInterface(ifaces []InterfaceFacts, match func(cidr *net.IPNet, addr net.IP) bool) *InterfaceFacts {
+	for i, f := range ifaces {
+		for _, a := range append(append([]string(nil), f.IPv4...), f.IPv6...) {
+			if addr, cidr, err := net.ParseCIDR(a); err == nil && match(cidr, addr) {
+				return &ifaces[i]
+			}
+		}
+	}
+	return nil
+}
+
+// zonesOf returns the names and UCI sections of the zones in `uci show
+// firewall` output that list the network iface.
+func zonesOf(out, iface string) (names, sections []string) {
+	type zone struct{ name, section string }
+	var zones []*zone
+	bySection := map[string]*zone{}
+	member := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || !strings.HasPrefix(k, "firewall.") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(k, "firewall."), ".", 2)
+		section := parts[0]
+		if len(parts) == 1 {
+			if v == "zone" {
+				z := &zone{section: section}
+				zones = append(zones, z)
+				bySection[section] = z
+			}
+			continue
+		}
+		z := bySection[section]
+		if z == nil {
+			continue
+		}
+		switch parts[1] {
+		case "name":
+			z.name = strings.Trim(v, `'"`)
+		case "network":
+			// A list reads back as 'lan' 'lan6'
+			for _, n := range strings.Fields(v) {
+				if strings.Trim(n, `'"`) == iface {
+					member[section] = true
+				}
+			}
+		}
+	}
+	for _, z := range zones {
+		if member[z.section] {
+			names = append(names, z.name)
+			sections = append(sections, z.section)
+		}
+	}
+	return names, sections
+}
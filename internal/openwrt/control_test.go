@@ -0,0 +1,61 @@
+package openwrt
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const uciShowFirewall = `firewall.@defaults[0]=defaults
+firewall.@zone[0]=zone
+firewall.@zone[0].name='lan'
+firewall.@zone[0].network='lan' 'lan6'
+firewall.@zone[0].input='ACCEPT'
+firewall.wan=zone
+firewall.wan.name='wan'
+firewall.wan.network='wan' 'wan6'
+firewall.@forwarding[0]=forwarding
+firewall.@forwarding[0].src='lan'
+`
+
+func TestFindControlPath(t *testing.T) {
+	original := GetRunCommand()
+	defer SetRunCommand(original)
+	SetRunCommand(func(ctx context.Context, name string, args ...string) string {
+		switch name + " " + strings.Join(args, " ") {
+		case "ubus call network.interface dump {}":
+			return `{"interface": [{"interface": "lan", "up": true, "proto": "static", "l3_device": "br-lan", "ipv4-address": [{"address": "192.168.8.1", "mask": 24}]}, {"interface": "wan", "up": true, "proto": "dhcp", "l3_device": "eth0", "ipv4-address": [{"address": "203.0.113.7", "mask": 24}]}]}`
+		case "uci -q show firewall":
+			return uciShowFirewall
+		}
+		return ""
+	})
+
+	cp := FindControlPath(context.Background(), "192.168.8.100", "")
+	if cp == nil || cp.Interface != "lan" || cp.Device != "br-lan" || cp.Client != "192.168.8.100" {
+		t.Fatalf("unexpected path %+v", cp)
+	}
+	if len(cp.Zones) != 1 || cp.Zones[0] != "lan" || cp.ZoneSections[0] != "@zone[0]" {
+		t.Errorf("unexpected zones %+v", cp)
+	}
+
+	// The address the session arrived at wins over the client's subnet
+	if cp := FindControlPath(context.Background(), "198.51.100.4", "203.0.113.7"); cp == nil || cp.Interface != "wan" || cp.ZoneSections[0] != "wan" {
+		t.Errorf("unexpected path %+v", cp)
+	}
+	for _, client := range []string{"127.0.0.1", "unix", "198.51.100.4"} {
+		if cp := FindControlPath(context.Background(), client, ""); cp != nil {
+			t.Errorf("expected no path for %s, got %+v", client, cp)
+		}
+	}
+}
+
+func TestSSHSession(t *testing.T) {
+	env := map[string]string{"SSH_CONNECTION": "192.168.8.100 52144 192.168.8.1 22"}
+	if client, local := sshSession(func(k string) string { return env[k] }); client != "192.168.8.100" || local != "192.168.8.1" {
+		t.Errorf("unexpected session %q %q", client, local)
+	}
+	if client, _ := sshSession(func(string) string { return "" }); client != "" {
+		t.Errorf("expected no session, got %q", client)
+	}
+}
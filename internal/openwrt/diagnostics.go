@@ -0,0 +1,34 @@
+package openwrt
+
+import "fmt"
+
+// DiagnosticTypes lists the network diagnostics known to DiagnosticCommand.
+var DiagnosticTypes = []string{"ping", "traceroute", "nslookup", "ifconfig"}
+
+// DiagnosticCommand returns the command that runs a network diagnostic. An
+// empty target uses a well-known default (all interfaces for ifconfig).
+func DiagnosticCommand(kind, target string) ([]string, error) {
+	switch kind {
+	case "ping":
+		if target == "" {
+			target = "8.8.8.8"
+		}
+		return []string{"ping", "-c", "4", target}, nil
+	case "traceroute":
+		if target == "" {
+			target = "8.8.8.8"
+		}
+		return []string{"traceroute", "-m", "10", target}, nil
+	case "nslookup":
+		if target == "" {
+			target = "google.com"
+		}
+		return []string{"nslookup", target}, nil
+	case "ifconfig":
+		if target != "" {
+			return []string{"ifconfig", target}, nil
+		}
+		return []string{"ifconfig"}, nil
+	}
+	return nil, fmt.Errorf("unknown diagnostic type: %s", kind)
+}
@@ -27,6 +27,12 @@ type factResult struct {
 // to improve planning quality. It tolerates missing tools and timeouts.
 // Commands run in parallel for faster collection on resource-constrained routers.
 func CollectFacts(ctx context.Context) string {
+	return formatFacts(collectSections(ctx))
+}
+
+// collectSections runs the fact commands and returns their trimmed, size
+// capped output in deterministic order. Empty results are dropped.
+func collectSections(ctx context.Context) []factResult {
 	// Apply an overall cap
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
@@ -45,12 +51,18 @@ func CollectFacts(ctx context.Context) string {
 		{3, "uci show network", "uci", []string{"-q", "show", "network"}},
 		{4, "uci show wireless", "uci", []string{"-q", "show", "wireless"}},
 		{5, "fw4 print", "fw4", []string{"print"}},
+		{6, "optional tools", "sh", []string{"-c", toolsScript()}},
 	}
 
 	// Collect facts in parallel
 	results := make([]factResult, len(commands))
 	var wg sync.WaitGroup
-	wg.Add(len(commands))
+	wg.Add(len(commands) + 1)
+	var topology *Topology
+	go func() {
+		defer wg.Done()
+		topology = DetectTopology(ctx)
+	}()
 
 	for i, fc := range commands {
 		go func(idx int, f factCmd) {
@@ -63,26 +75,37 @@ func CollectFacts(ctx context.Context) string {
 		}(i, fc)
 	}
 	wg.Wait()
+	// Only routers that are access points or mesh nodes get this section
+	results = append(results, factResult{order: len(commands), name: "topology", value: topology.String()})
 
-	// Build output in deterministic order
-	var b bytes.Buffer
-	b.Grow(8192) // Pre-allocate for typical fact size
+	sections := make([]factResult, 0, len(results))
 	for _, r := range results {
 		out := strings.TrimSpace(r.value)
 		if out == "" {
 			continue
 		}
-		if b.Len() > 0 {
-			b.WriteString("\n\n")
-		}
-		b.WriteString(r.name)
-		b.WriteString(":\n")
 		// Limit very large outputs
 		const max = 4096
 		if len(out) > max {
 			out = out[:max]
 		}
-		b.WriteString(out)
+		r.value = out
+		sections = append(sections, r)
+	}
+	return sections
+}
+
+// formatFacts renders sections as the facts block embedded in prompts.
+func formatFacts(sections []factResult) string {
+	var b bytes.Buffer
+	b.Grow(8192) // Pre-allocate for typical fact size
+	for _, r := range sections {
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(r.name)
+		b.WriteString(":\n")
+		b.WriteString(r.value)
 	}
 	return b.String()
 }
@@ -141,3 +141,90 @@ func TestDefaultRun(t *testing.T) {
 		t.Errorf("expected empty output for timeout, got %q", out)
 	}
 }
+
+func TestCollectSystemFacts(t *testing.T) {
+	originalRunCommand := runCommand
+	defer func() { runCommand = originalRunCommand }()
+
+	runCommand = func(ctx context.Context, name string, args ...string) string {
+		switch strings.Join(append([]string{name}, args...), " ") {
+		case "ubus call system board {}":
+			return `{"hostname": "gw", "model": "GL.iNet GL-MT3000", "board_name": "glinet,gl-mt3000", "kernel": "5.15.150", "release": {"description": "OpenWrt 23.05.3"}}`
+		case "ubus call system info {}":
+			return `{"uptime": 3600, "load": [65536, 32768, 0], "memory": {"total": 536870912, "free": 268435456, "available": 402653184}, "root": {"total": 98304, "used": 1024, "avail": 97280}}`
+		case "ubus call network.interface dump {}":
+			return `{"interface": [{"interface": "lan", "up": true, "proto": "static", "l3_device": "br-lan", "ipv4-address": [{"address": "192.168.8.1", "mask": 24}]}, {"interface": "wan", "up": false, "proto": "dhcp", "device": "eth0"}]}`
+		case "uci -q show wireless":
+			return "wireless.radio0=wifi-device\nwireless.radio0.band='5g'\nwireless.radio0.channel='36'\n" +
+				"wireless.default_radio0=wifi-iface\nwireless.default_radio0.device='radio0'\nwireless.default_radio0.ssid='Home'\nwireless.default_radio0.key='hunter22'\nwireless.default_radio0.mode='ap'\n"
+		case "cat /tmp/dhcp.leases":
+			return "1700000000 aa:bb:cc:dd:ee:ff 192.168.8.100 phone *\n1700000001 aa:bb:cc:dd:ee:00 192.168.8.101 laptop *\n"
+		}
+		return ""
+	}
+
+	f := CollectSystemFacts(context.Background())
+	if f.Hostname != "gw" || f.Board != "glinet,gl-mt3000" || f.Firmware != "OpenWrt 23.05.3" || f.Uptime != 3600 {
+		t.Fatalf("unexpected board facts %+v", f)
+	}
+	if f.Memory.Total != 524288 || len(f.Load) != 3 || f.Load[0] != 1 || f.Load[1] != 0.5 {
+		t.Errorf("unexpected info facts %+v %v", f.Memory, f.Load)
+	}
+	if len(f.Disks) != 1 || f.Disks[0].Mount != "/" || f.Disks[0].Free != 97280 {
+		t.Errorf("unexpected disks %+v", f.Disks)
+	}
+	if len(f.Interfaces) != 2 || f.Interfaces[0].Device != "br-lan" || f.Interfaces[0].IPv4[0] != "192.168.8.1/24" || f.Interfaces[1].Device != "eth0" {
+		t.Errorf("unexpected interfaces %+v", f.Interfaces)
+	}
+	if len(f.Radios) != 1 || f.Radios[0].Band != "5g" || len(f.Radios[0].Networks) != 1 || f.Radios[0].Networks[0].SSID != "Home" {
+		t.Errorf("unexpected radios %+v", f.Radios)
+	}
+	if f.DHCPLeases != 2 || f.Errors != nil {
+		t.Errorf("unexpected leases %d, errors %v", f.DHCPLeases, f.Errors)
+	}
+
+	r := f.Redact([]string{"SSID", "ipv4", "bogus"})
+	if r.Radios[0].Networks[0].SSID != "[REDACTED]" || r.Interfaces[0].IPv4[0] != "[REDACTED]" || r.Hostname != "gw" {
+		t.Errorf("unexpected redaction %+v", r)
+	}
+	if f.Radios[0].Networks[0].SSID != "Home" || f.Interfaces[0].IPv4[0] != "192.168.8.1/24" {
+		t.Error("Redact modified the original")
+	}
+	if strings.Join(r.Redacted, ",") != "ssid,ipv4" {
+		t.Errorf("unexpected redacted list %v", r.Redacted)
+	}
+}
+
+func TestCollectSystemFacts_MissingTools(t *testing.T) {
+	originalRunCommand := runCommand
+	defer func() { runCommand = originalRunCommand }()
+	runCommand = func(ctx context.Context, name string, args ...string) string { return "" }
+
+	f := CollectSystemFacts(context.Background())
+	if len(f.Errors) != 3 || f.Interfaces == nil || f.Radios == nil || f.DHCPLeases != 0 {
+		t.Errorf("unexpected facts %+v", f)
+	}
+}
+
+func TestCollectFacts_OptionalTools(t *testing.T) {
+	originalRunCommand := runCommand
+	defer func() { runCommand = originalRunCommand }()
+
+	runCommand = func(ctx context.Context, name string, args ...string) string {
+		if name != "sh" {
+			return ""
+		}
+		if len(args) != 2 || !strings.Contains(args[1], "opkg install tcpdump") {
+			t.Errorf("unexpected tools script %q", args)
+		}
+		return "tcpdump: not installed (opkg install tcpdump)\n"
+	}
+
+	facts := CollectFacts(context.Background())
+	if facts != "optional tools:\ntcpdump: not installed (opkg install tcpdump)" {
+		t.Errorf("unexpected facts:\n%s", facts)
+	}
+	if PackageFor("/usr/bin/traceroute") != "traceroute" || PackageFor("uci") != "" {
+		t.Error("PackageFor does not map executables to packages")
+	}
+}
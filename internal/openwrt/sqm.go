@@ -0,0 +1,324 @@
+package openwrt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSpeedURL is downloaded by the built-in speed probe.
+const DefaultSpeedURL = "https://speed.cloudflare.com/__down?bytes=200000000"
+
+// DefaultSpeedDuration bounds the built-in probe and the iperf3 and netperf
+// runs in each direction.
+const DefaultSpeedDuration = 10 * time.Second
+
+// speedCommand runs a speed measurement tool; a test takes tens of seconds,
+// longer than a wireless scan. It returns the output even when the tool
+// fails, as iperf3 reports errors in its JSON.
+var speedCommand runFn = func(ctx context.Context, name string, args ...string) string {
+	cctx, cancel := context.WithTimeout(ctx, 90*time.Second)
+	defer cancel()
+	out, _ := exec.CommandContext(cctx, name, args...).Output()
+	return string(out)
+}
+
+// SpeedTools are the external measurement tools, in order of preference.
+// iperf3 and netperf need a server to measure against.
+var SpeedTools = []string{"speedtest-cli", "iperf3", "netperf"}
+
+// SpeedOptions select how the link is measured.
+type SpeedOptions struct {
+	// One of SpeedTools or "builtin"; empty picks the first installed tool
+	// that can run, falling back to the built-in download probe
+	Tool     string
+	Server   string        // iperf3 or netperf server
+	URL      string        // Download of the built-in probe; DefaultSpeedURL if empty
+	Duration time.Duration // DefaultSpeedDuration if zero
+}
+
+// SpeedResult is one measurement of the WAN link. Rates are in Mbit/s,
+// latencies in milliseconds; zero means not measured.
+type SpeedResult struct {
+	Tool          string  `json:"tool"`
+	Download      float64 `json:"download_mbps"`
+	Upload        float64 `json:"upload_mbps,omitempty"`
+	Latency       float64 `json:"latency_ms,omitempty"`
+	LoadedLatency float64 `json:"loaded_latency_ms,omitempty"` // While downloading
+}
+
+// String formats the result for people and the model.
+func (r SpeedResult) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "download %.1f Mbit/s", r.Download)
+	if r.Upload > 0 {
+		fmt.Fprintf(&b, ", upload %.1f Mbit/s", r.Upload)
+	} else {
+		b.WriteString(", upload not measured")
+	}
+	if r.Latency > 0 {
+		fmt.Fprintf(&b, ", idle latency %.0f ms", r.Latency)
+	}
+	if r.LoadedLatency > 0 {
+		fmt.Fprintf(&b, ", latency under load %.0f ms", r.LoadedLatency)
+	}
+	return b.String() + " (" + r.Tool + ")"
+}
+
+// MeasureSpeed measures the WAN link with the tool chosen by opts.
+func MeasureSpeed(ctx context.Context, opts SpeedOptions) (SpeedResult, error) {
+	if opts.Duration <= 0 {
+		opts.Duration = DefaultSpeedDuration
+	}
+	if opts.URL == "" {
+		opts.URL = DefaultSpeedURL
+	}
+	tool := opts.Tool
+	if tool == "" {
+		tool = "builtin"
+		for _, t := range SpeedTools {
+			if Installed(t) && (t == "speedtest-cli" || opts.Server != "") {
+				tool = t
+				break
+			}
+		}
+	}
+	if (tool == "iperf3" || tool == "netperf") && opts.Server == "" {
+		return SpeedResult{Tool: tool}, fmt.Errorf("%s needs a server to measure against", tool)
+	}
+	secs := strconv.Itoa(int(opts.Duration / time.Second))
+	switch tool {
+	case "speedtest-cli":
+		return parseSpeedtestCLI(speedCommand(ctx, "speedtest-cli", "--json", "--secure"))
+	case "iperf3":
+		down, err := parseIperf3(speedCommand(ctx, "iperf3", "-c", opts.Server, "-J", "-R", "-t", secs))
+		if err != nil {
+			return SpeedResult{Tool: tool}, err
+		}
+		up, err := parseIperf3(speedCommand(ctx, "iperf3", "-c", opts.Server, "-J", "-t", secs))
+		if err != nil {
+			return SpeedResult{Tool: tool}, err
+		}
+		return SpeedResult{Tool: tool, Download: down, Upload: up, Latency: pingLatency(ctx, opts.Server)}, nil
+	case "netperf":
+		down, err := parseNetperf(speedCommand(ctx, "netperf", "-H", opts.Server, "-t", "TCP_MAERTS", "-l", secs, "-P", "0", "-f", "m"))
+		if err != nil {
+			return SpeedResult{Tool: tool}, err
+		}
+		up, err := parseNetperf(speedCommand(ctx, "netperf", "-H", opts.Server, "-t", "TCP_STREAM", "-l", secs, "-P", "0", "-f", "m"))
+		if err != nil {
+			return SpeedResult{Tool: tool}, err
+		}
+		return SpeedResult{Tool: tool, Download: down, Upload: up, Latency: pingLatency(ctx, opts.Server)}, nil
+	case "builtin":
+		return probeDownload(ctx, opts.URL, opts.Duration)
+	}
+	return SpeedResult{Tool: tool}, fmt.Errorf("unknown speed test tool %q (want %s or builtin)", tool, strings.Join(SpeedTools, ", "))
+}
+
+func parseSpeedtestCLI(out string) (SpeedResult, error) {
+	r := SpeedResult{Tool: "speedtest-cli"}
+	var v struct {
+		Download float64 `json:"download"` // bit/s
+		Upload   float64 `json:"upload"`
+		Ping     float64 `json:"ping"`
+	}
+	if err := json.Unmarshal([]byte(out), &v); err != nil || v.Download == 0 {
+		return r, errors.New("speedtest-cli returned no result")
+	}
+	r.Download, r.Upload, r.Latency = v.Download/1e6, v.Upload/1e6, v.Ping
+	return r, nil
+}
+
+// parseIperf3 returns the received rate of `iperf3 -J` output in Mbit/s.
+func parseIperf3(out string) (float64, error) {
+	var v struct {
+		End struct {
+			SumReceived struct {
+				BitsPerSecond float64 `json:"bits_per_second"`
+			} `json:"sum_received"`
+		} `json:"end"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(out), &v); err != nil {
+		return 0, errors.New("iperf3 returned no result")
+	}
+	if v.Error != "" {
+		return 0, fmt.Errorf("iperf3: %s", v.Error)
+	}
+	return v.End.SumReceived.BitsPerSecond / 1e6, nil
+}
+
+// parseNetperf reads the throughput, the last field of `netperf -P 0 -f m`.
+func parseNetperf(out string) (float64, error) {
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return 0, errors.New("netperf returned no result")
+	}
+	mbps, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("netperf: unexpected output %q", strings.TrimSpace(out))
+	}
+	return mbps, nil
+}
+
+var rePingAvg = regexp.MustCompile(`min/avg/max[^=]*=\s*[\d.]+/([\d.]+)/`)
+
+// pingLatency returns the average round trip to host in milliseconds, or 0
+// if it cannot be pinged.
+func pingLatency(ctx context.Context, host string) float64 {
+	m := rePingAvg.FindStringSubmatch(speedCommand(ctx, "ping", "-c", "5", "-q", host))
+	if m == nil {
+		return 0
+	}
+	ms, _ := strconv.ParseFloat(m[1], 64)
+	return ms
+}
+
+// probeDownload downloads rawURL for up to d and pings its host before and
+// during the download, so bufferbloat shows as higher latency under load.
+func probeDownload(ctx context.Context, rawURL string, d time.Duration) (SpeedResult, error) {
+	r := SpeedResult{Tool: "builtin"}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return r, fmt.Errorf("invalid speed test URL %q", rawURL)
+	}
+	r.Latency = pingLatency(ctx, u.Hostname())
+
+	dctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	loaded := make(chan float64, 1)
+	go func() { loaded <- pingLatency(dctx, u.Hostname()) }()
+
+	req, err := http.NewRequestWithContext(dctx, "GET", rawURL, nil)
+	if err != nil {
+		return r, err
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return r, fmt.Errorf("speed test download: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return r, fmt.Errorf("speed test download: %s", resp.Status)
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start)
+	r.LoadedLatency = <-loaded
+	if n == 0 || elapsed <= 0 {
+		return r, errors.New("speed test download returned no data")
+	}
+	r.Download = float64(n) * 8 / elapsed.Seconds() / 1e6
+	return r, nil
+}
+
+// SQMQueue is a queue section of /etc/config/sqm. Rates are in kbit/s;
+// 0 means unshaped.
+type SQMQueue struct {
+	Section   string `json:"section"`
+	Enabled   bool   `json:"enabled"`
+	Interface string `json:"interface"`
+	Download  int    `json:"download"`
+	Upload    int    `json:"upload"`
+	Qdisc     string `json:"qdisc,omitempty"`
+	Script    string `json:"script,omitempty"`
+	LinkLayer string `json:"linklayer,omitempty"`
+	Overhead  int    `json:"overhead,omitempty"`
+}
+
+// SQMSurvey is what tune-sqm tells the model about the link.
+type SQMSurvey struct {
+	Speed  SpeedResult `json:"speed"`
+	Queues []SQMQueue  `json:"queues"`
+	Config string      `json:"-"` // uci show sqm
+}
+
+// ReadSQMConfig returns the output of `uci show sqm`, empty when sqm-scripts
+// is not installed or has no queues.
+func ReadSQMConfig(ctx context.Context) string {
+	return strings.TrimSpace(scanCommand(ctx, "uci", "-q", "show", "sqm"))
+}
+
+// ParseSQMQueues reads the queue sections of `uci show sqm` output.
+func ParseSQMQueues(out string) []SQMQueue {
+	var queues []SQMQueue
+	index := map[string]int{}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || !strings.HasPrefix(key, "sqm.") {
+			continue
+		}
+		value = strings.Trim(value, "'")
+		parts := strings.SplitN(strings.TrimPrefix(key, "sqm."), ".", 2)
+		if len(parts) == 1 {
+			if value == "queue" {
+				index[parts[0]] = len(queues)
+				queues = append(queues, SQMQueue{Section: parts[0]})
+			}
+			continue
+		}
+		i, ok := index[parts[0]]
+		if !ok {
+			continue
+		}
+		q := &queues[i]
+		switch parts[1] {
+		case "enabled":
+			q.Enabled = value == "1"
+		case "interface":
+			q.Interface = value
+		case "download":
+			q.Download, _ = strconv.Atoi(value)
+		case "upload":
+			q.Upload, _ = strconv.Atoi(value)
+		case "qdisc":
+			q.Qdisc = value
+		case "script":
+			q.Script = value
+		case "linklayer":
+			q.LinkLayer = value
+		case "overhead":
+			q.Overhead, _ = strconv.Atoi(value)
+		}
+	}
+	return queues
+}
+
+// PromptBlock summarizes the measurement and the SQM queues for the model.
+func (s SQMSurvey) PromptBlock() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Link measurement: %s\n", s.Speed)
+	if len(s.Queues) == 0 {
+		b.WriteString("SQM queues: none (sqm-scripts is not installed or not configured)\n")
+	} else {
+		b.WriteString("SQM queues:\n")
+	}
+	for _, q := range s.Queues {
+		state := "disabled"
+		if q.Enabled {
+			state = "enabled"
+		}
+		fmt.Fprintf(&b, "- %s: %s on %s, download %d kbit/s, upload %d kbit/s", q.Section, state, q.Interface, q.Download, q.Upload)
+		if q.Qdisc != "" {
+			fmt.Fprintf(&b, ", qdisc %s", q.Qdisc)
+		}
+		if q.Script != "" {
+			fmt.Fprintf(&b, ", script %s", q.Script)
+		}
+		if q.LinkLayer != "" && q.LinkLayer != "none" {
+			fmt.Fprintf(&b, ", link layer %s overhead %d", q.LinkLayer, q.Overhead)
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
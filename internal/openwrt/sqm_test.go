@@ -0,0 +1,118 @@
+package openwrt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const uciShowSQM = `sqm.eth1=queue
+sqm.eth1.enabled='1'
+sqm.eth1.interface='eth1'
+sqm.eth1.download='85000'
+sqm.eth1.upload='10000'
+sqm.eth1.qdisc='cake'
+sqm.eth1.script='piece_of_cake.qos'
+sqm.eth1.linklayer='none'
+sqm.@other[0]=other
+sqm.@other[0].enabled='1'
+`
+
+func TestParseSQMQueues(t *testing.T) {
+	queues := ParseSQMQueues(uciShowSQM)
+	if len(queues) != 1 {
+		t.Fatalf("expected one queue, got %+v", queues)
+	}
+	q := queues[0]
+	if !q.Enabled || q.Interface != "eth1" || q.Download != 85000 || q.Upload != 10000 || q.Qdisc != "cake" || q.Script != "piece_of_cake.qos" {
+		t.Errorf("unexpected queue: %+v", q)
+	}
+
+	s := SQMSurvey{Speed: SpeedResult{Tool: "builtin", Download: 93.4, Latency: 12, LoadedLatency: 80}, Queues: queues}
+	block := s.PromptBlock()
+	for _, want := range []string{
+		"download 93.4 Mbit/s, upload not measured, idle latency 12 ms, latency under load 80 ms (builtin)",
+		"- eth1: enabled on eth1, download 85000 kbit/s, upload 10000 kbit/s, qdisc cake, script piece_of_cake.qos",
+	} {
+		if !strings.Contains(block, want) {
+			t.Errorf("prompt block missing %q:\n%s", want, block)
+		}
+	}
+	if block := (SQMSurvey{}).PromptBlock(); !strings.Contains(block, "SQM queues: none") {
+		t.Errorf("expected no queues, got:\n%s", block)
+	}
+}
+
+func TestMeasureSpeed_Tools(t *testing.T) {
+	orig := speedCommand
+	defer func() { speedCommand = orig }()
+	var calls []string
+	speedCommand = func(ctx context.Context, name string, args ...string) string {
+		cmd := name + " " + strings.Join(args, " ")
+		calls = append(calls, cmd)
+		switch {
+		case name == "speedtest-cli":
+			return `{"download": 95000000.0, "upload": 19500000.0, "ping": 14.2}`
+		case name == "iperf3" && strings.Contains(cmd, "-R"):
+			return `{"end": {"sum_received": {"bits_per_second": 90000000}}}`
+		case name == "iperf3":
+			return `{"end": {"sum_received": {"bits_per_second": 20000000}}}`
+		case name == "netperf":
+			return " 87380  16384  16384    10.00      45.67\n"
+		case name == "ping":
+			return "5 packets transmitted, 5 packets received, 0% packet loss\nround-trip min/avg/max = 9.1/11.5/15.0 ms\n"
+		}
+		return ""
+	}
+	ctx := context.Background()
+
+	r, err := MeasureSpeed(ctx, SpeedOptions{Tool: "speedtest-cli"})
+	if err != nil || r.Download != 95 || r.Upload != 19.5 || r.Latency != 14.2 {
+		t.Errorf("speedtest-cli: %+v, %v", r, err)
+	}
+	r, err = MeasureSpeed(ctx, SpeedOptions{Tool: "iperf3", Server: "192.0.2.1", Duration: 5 * time.Second})
+	if err != nil || r.Download != 90 || r.Upload != 20 || r.Latency != 11.5 {
+		t.Errorf("iperf3: %+v, %v", r, err)
+	}
+	if !strings.Contains(strings.Join(calls, "\n"), "iperf3 -c 192.0.2.1 -J -R -t 5") {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+	r, err = MeasureSpeed(ctx, SpeedOptions{Tool: "netperf", Server: "192.0.2.1"})
+	if err != nil || r.Download != 45.67 {
+		t.Errorf("netperf: %+v, %v", r, err)
+	}
+	if _, err := MeasureSpeed(ctx, SpeedOptions{Tool: "iperf3"}); err == nil {
+		t.Error("expected iperf3 without a server to fail")
+	}
+	if _, err := MeasureSpeed(ctx, SpeedOptions{Tool: "fast.com"}); err == nil {
+		t.Error("expected an unknown tool to fail")
+	}
+	if _, err := parseIperf3(`{"error": "unable to connect to server"}`); err == nil || !strings.Contains(err.Error(), "unable to connect") {
+		t.Errorf("expected the iperf3 error, got %v", err)
+	}
+}
+
+func TestMeasureSpeed_Builtin(t *testing.T) {
+	orig := speedCommand
+	defer func() { speedCommand = orig }()
+	speedCommand = func(ctx context.Context, name string, args ...string) string { return "" }
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1<<20))
+	}))
+	defer srv.Close()
+
+	r, err := MeasureSpeed(context.Background(), SpeedOptions{Tool: "builtin", URL: srv.URL})
+	if err != nil {
+		t.Fatalf("builtin probe failed: %v", err)
+	}
+	if r.Tool != "builtin" || r.Download <= 0 || r.Upload != 0 {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	if _, err := MeasureSpeed(context.Background(), SpeedOptions{Tool: "builtin", URL: srv.URL + "/missing\x7f"}); err == nil {
+		t.Error("expected an invalid URL to fail")
+	}
+}
@@ -0,0 +1,248 @@
+package openwrt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// Stamp is the tamper-evident metadata of a facts collection. It records
+// when and where the facts were gathered and a hash of every section, and is
+// signed with a key that never leaves the router, so a plan carrying a stamp
+// can later be matched against the environment it was generated for.
+type Stamp struct {
+	Collected time.Time         `json:"collected"`
+	Board     string            `json:"board,omitempty"`
+	Firmware  string            `json:"firmware,omitempty"`
+	Sections  map[string]string `json:"sections"`      // Fact name -> SHA-256 of its content
+	MAC       string            `json:"mac,omitempty"` // HMAC-SHA256 of the fields above; empty when unsigned
+}
+
+// Facts is a facts block together with its stamp.
+type Facts struct {
+	Text  string
+	Stamp Stamp
+}
+
+// Errors returned by Stamp.Verify.
+var (
+	ErrUnsigned = errors.New("facts stamp is not signed")
+	ErrBadMAC   = errors.New("facts stamp signature mismatch")
+)
+
+// CollectSignedFacts collects facts like CollectFacts and stamps them with the
+// key in keyFile (created on first use). If the key is unavailable the stamp
+// is left unsigned rather than failing the request.
+func CollectSignedFacts(ctx context.Context, keyFile string) Facts {
+	sections := collectSections(ctx)
+	key, _ := LoadFactsKey(keyFile)
+	return Facts{Text: formatFacts(sections), Stamp: newStamp(sections, time.Now(), key)}
+}
+
+// PromptBlock renders the facts for inclusion in a model prompt, headed by
+// the stamp metadata. It is empty when no facts were collected.
+func (f Facts) PromptBlock() string {
+	if f.Text == "" {
+		return ""
+	}
+	meta := []string{"collected " + f.Stamp.Collected.UTC().Format(time.RFC3339)}
+	if f.Stamp.Board != "" {
+		meta = append(meta, "board "+f.Stamp.Board)
+	}
+	if f.Stamp.Firmware != "" {
+		meta = append(meta, "firmware "+f.Stamp.Firmware)
+	}
+	if f.Stamp.MAC != "" {
+		meta = append(meta, "hmac-sha256 "+f.Stamp.MAC)
+	}
+	return "Environment facts (read-only; " + strings.Join(meta, ", ") + "):\n" + f.Text
+}
+
+func newStamp(sections []factResult, collected time.Time, key []byte) Stamp {
+	s := Stamp{Collected: collected.UTC(), Sections: make(map[string]string, len(sections))}
+	for _, r := range sections {
+		sum := sha256.Sum256([]byte(r.value))
+		s.Sections[r.name] = hex.EncodeToString(sum[:])
+		switch r.name {
+		case "ubus system board":
+			s.Board, s.Firmware = parseBoard(r.value, s.Firmware)
+		case "/etc/os-release":
+			if s.Firmware == "" {
+				s.Firmware = parseOSRelease(r.value)
+			}
+		}
+	}
+	if len(key) > 0 {
+		s.MAC = s.sign(key)
+	}
+	return s
+}
+
+// parseBoard extracts the board name and firmware description from
+// `ubus call system board`, keeping fallback when no release is reported.
+func parseBoard(out, fallback string) (board, firmware string) {
+	var b struct {
+		BoardName string `json:"board_name"`
+		Model     string `json:"model"`
+		Release   struct {
+			Description string `json:"description"`
+		} `json:"release"`
+	}
+	if json.Unmarshal([]byte(out), &b) != nil {
+		return "", fallback
+	}
+	board = b.BoardName
+	if board == "" {
+		board = b.Model
+	}
+	firmware = b.Release.Description
+	if firmware == "" {
+		firmware = fallback
+	}
+	return board, firmware
+}
+
+func parseOSRelease(out string) string {
+	vals := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			vals[k] = strings.Trim(v, `"'`)
+		}
+	}
+	if v := vals["OPENWRT_RELEASE"]; v != "" {
+		return v
+	}
+	return vals["PRETTY_NAME"]
+}
+
+// canonical is the byte string covered by the MAC. Values are quoted so a
+// board or firmware string cannot forge additional lines.
+func (s Stamp) canonical() []byte {
+	var b strings.Builder
+	b.WriteString("lucicodex-facts-v1\n")
+	fmt.Fprintf(&b, "collected=%s\n", s.Collected.UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&b, "board=%s\n", strconv.Quote(s.Board))
+	fmt.Fprintf(&b, "firmware=%s\n", strconv.Quote(s.Firmware))
+	names := make([]string, 0, len(s.Sections))
+	for name := range s.Sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "section %s=%s\n", strconv.Quote(name), strconv.Quote(s.Sections[name]))
+	}
+	return []byte(b.String())
+}
+
+func (s Stamp) sign(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(s.canonical())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the stamp's signature against key.
+func (s Stamp) Verify(key []byte) error {
+	if s.MAC == "" {
+		return ErrUnsigned
+	}
+	got, err := hex.DecodeString(s.MAC)
+	if err != nil {
+		return ErrBadMAC
+	}
+	want, _ := hex.DecodeString(s.sign(key))
+	if !hmac.Equal(got, want) {
+		return ErrBadMAC
+	}
+	return nil
+}
+
+// Drift returns how far current has moved from stored, from 0 (identical) to
+// 1. A different board or firmware counts as complete drift; otherwise it is
+// the fraction of fact sections that changed, appeared or disappeared.
+func Drift(stored, current Stamp) float64 {
+	if stored.Board != current.Board || stored.Firmware != current.Firmware {
+		return 1
+	}
+	total, changed := 0, 0
+	for name, sum := range stored.Sections {
+		total++
+		if current.Sections[name] != sum {
+			changed++
+		}
+	}
+	for name := range current.Sections {
+		if _, ok := stored.Sections[name]; !ok {
+			total++
+			changed++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(changed) / float64(total)
+}
+
+// CheckStamp verifies that stored was signed by this router and that the
+// current facts have not drifted more than maxDriftPercent from it. Failures
+// are classified as errcode.FactsMismatch.
+func CheckStamp(stored, current Stamp, key []byte, maxDriftPercent int) error {
+	if len(key) == 0 {
+		return errcode.Errorf(errcode.FactsMismatch, "cannot verify plan facts: no signing key")
+	}
+	if err := stored.Verify(key); err != nil {
+		return errcode.Wrap(errcode.FactsMismatch, fmt.Errorf("plan facts rejected: %w", err))
+	}
+	if d := Drift(stored, current); d*100 > float64(maxDriftPercent) {
+		return errcode.Errorf(errcode.FactsMismatch,
+			"environment changed since the plan was generated at %s: %.0f%% of facts differ (max %d%%)",
+			stored.Collected.Format(time.RFC3339), d*100, maxDriftPercent)
+	}
+	return nil
+}
+
+// LoadFactsKey returns the signing key stored hex-encoded in path, creating
+// a random one if the file does not exist. An empty path disables signing.
+func LoadFactsKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(data)))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	// O_EXCL: if another process created the key first, use theirs
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		if os.IsExist(err) {
+			return LoadFactsKey(path)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
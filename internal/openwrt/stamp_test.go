@@ -0,0 +1,126 @@
+package openwrt
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// mockRouter replaces runCommand with a fixed router whose network config
+// can be changed between collections.
+func mockRouter(t *testing.T, network *string) {
+	original := runCommand
+	t.Cleanup(func() { runCommand = original })
+	runCommand = func(ctx context.Context, name string, args ...string) string {
+		switch name {
+		case "cat":
+			return "NAME=\"OpenWrt\"\nOPENWRT_RELEASE=\"OpenWrt 23.05.3 r23809\""
+		case "uname":
+			return "Linux OpenWrt 5.15.150"
+		case "ubus":
+			return `{"board_name": "glinet,gl-mt3000", "release": {"description": "OpenWrt 23.05.3 r23809-234f1a2efa"}}`
+		case "uci":
+			if args[2] == "network" {
+				return *network
+			}
+			return "wireless.radio0.disabled='0'"
+		}
+		return ""
+	}
+}
+
+func TestCollectSignedFacts(t *testing.T) {
+	network := "network.lan.ipaddr='192.168.1.1'"
+	mockRouter(t, &network)
+	keyFile := filepath.Join(t.TempDir(), "facts.key")
+
+	f := CollectSignedFacts(context.Background(), keyFile)
+	if f.Stamp.Board != "glinet,gl-mt3000" || f.Stamp.Firmware != "OpenWrt 23.05.3 r23809-234f1a2efa" {
+		t.Errorf("metadata: board=%q firmware=%q", f.Stamp.Board, f.Stamp.Firmware)
+	}
+	if len(f.Stamp.Sections) != 5 {
+		t.Errorf("expected 5 section hashes, got %d", len(f.Stamp.Sections))
+	}
+	key, err := LoadFactsKey(keyFile)
+	if err != nil || len(key) != 32 {
+		t.Fatalf("key: %v (%d bytes)", err, len(key))
+	}
+	if info, _ := os.Stat(keyFile); info.Mode().Perm() != 0o600 {
+		t.Errorf("key file mode %v", info.Mode().Perm())
+	}
+	if err := f.Stamp.Verify(key); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	block := f.PromptBlock()
+	if !strings.HasPrefix(block, "Environment facts (read-only; collected ") ||
+		!strings.Contains(block, "board glinet,gl-mt3000") || !strings.Contains(block, "hmac-sha256 "+f.Stamp.MAC) {
+		t.Errorf("prompt block header: %q", strings.SplitN(block, "\n", 2)[0])
+	}
+
+	tampered := f.Stamp
+	tampered.Firmware = "OpenWrt 24.10.0"
+	if err := tampered.Verify(key); err != ErrBadMAC {
+		t.Errorf("tampered stamp verified: %v", err)
+	}
+	if err := (Stamp{}).Verify(key); err != ErrUnsigned {
+		t.Errorf("unsigned stamp: %v", err)
+	}
+}
+
+func TestCollectSignedFacts_NoKey(t *testing.T) {
+	network := ""
+	mockRouter(t, &network)
+	f := CollectSignedFacts(context.Background(), "")
+	if f.Stamp.MAC != "" {
+		t.Error("stamp should be unsigned without a key file")
+	}
+	if f.Stamp.Firmware != "OpenWrt 23.05.3 r23809-234f1a2efa" {
+		t.Errorf("firmware: %q", f.Stamp.Firmware)
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	if got := parseOSRelease("PRETTY_NAME=\"OpenWrt SNAPSHOT\""); got != "OpenWrt SNAPSHOT" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCheckStamp(t *testing.T) {
+	network := "network.lan.ipaddr='192.168.1.1'"
+	mockRouter(t, &network)
+	keyFile := filepath.Join(t.TempDir(), "facts.key")
+	key, _ := LoadFactsKey(keyFile)
+
+	stored := CollectSignedFacts(context.Background(), keyFile).Stamp
+	if err := CheckStamp(stored, CollectSignedFacts(context.Background(), keyFile).Stamp, key, 0); err != nil {
+		t.Errorf("unchanged router rejected: %v", err)
+	}
+
+	network = "network.lan.ipaddr='10.0.0.1'"
+	current := CollectSignedFacts(context.Background(), keyFile).Stamp
+	if d := Drift(stored, current); d != 0.2 {
+		t.Errorf("drift = %v, want 0.2", d)
+	}
+	if err := CheckStamp(stored, current, key, 50); err != nil {
+		t.Errorf("small drift rejected: %v", err)
+	}
+	err := CheckStamp(stored, current, key, 10)
+	if errcode.Of(err) != errcode.FactsMismatch || !strings.Contains(err.Error(), "20% of facts differ") {
+		t.Errorf("large drift: %v", err)
+	}
+
+	other := current
+	other.Board = "tplink,archer-c7-v2"
+	if Drift(stored, other) != 1 {
+		t.Error("board change should be full drift")
+	}
+
+	otherKey := make([]byte, 32)
+	if err := CheckStamp(stored, current, otherKey, 100); errcode.Of(err) != errcode.FactsMismatch {
+		t.Errorf("stamp from another key accepted: %v", err)
+	}
+}
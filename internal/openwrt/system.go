@@ -0,0 +1,349 @@
+package openwrt
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SystemFacts is the router state as structured data, for dashboards and
+// monitoring rather than prompts. Sizes are in KiB.
+type SystemFacts struct {
+	Collected  time.Time         `json:"collected"`
+	Hostname   string            `json:"hostname"`
+	Model      string            `json:"model"`
+	Board      string            `json:"board"`
+	Firmware   string            `json:"firmware"`
+	Kernel     string            `json:"kernel"`
+	Uptime     int64             `json:"uptime_seconds"`
+	Load       []float64         `json:"load,omitempty"` // 1, 5 and 15 minute load averages
+	Memory     MemoryFacts       `json:"memory"`
+	Disks      []DiskFacts       `json:"disks"`
+	Interfaces []InterfaceFacts  `json:"interfaces"`
+	Radios     []RadioFacts      `json:"radios"`
+	DHCPLeases int               `json:"dhcp_leases"`
+	Topology   *Topology         `json:"topology,omitempty"` // Nil for a plain router outside any mesh
+	Redacted   []string          `json:"redacted,omitempty"` // Fields hidden by Redact
+	Errors     map[string]string `json:"errors,omitempty"`   // Sources that could not be read
+}
+
+// MemoryFacts is the memory usage reported by `ubus call system info`.
+type MemoryFacts struct {
+	Total     int64 `json:"total_kb"`
+	Free      int64 `json:"free_kb"`
+	Available int64 `json:"available_kb"`
+	Buffered  int64 `json:"buffered_kb"`
+	Cached    int64 `json:"cached_kb"`
+}
+
+// DiskFacts is the usage of one filesystem.
+type DiskFacts struct {
+	Mount string `json:"mount"`
+	Total int64  `json:"total_kb"`
+	Used  int64  `json:"used_kb"`
+	Free  int64  `json:"free_kb"`
+}
+
+// InterfaceFacts is one logical network interface.
+type InterfaceFacts struct {
+	Name   string   `json:"name"`
+	Proto  string   `json:"proto"`
+	Device string   `json:"device,omitempty"`
+	Up     bool     `json:"up"`
+	IPv4   []string `json:"ipv4,omitempty"` // CIDR notation
+	IPv6   []string `json:"ipv6,omitempty"`
+}
+
+// RadioFacts is one wifi-device with its wifi-iface sections.
+type RadioFacts struct {
+	Name     string          `json:"name"`
+	Band     string          `json:"band,omitempty"`
+	Channel  string          `json:"channel,omitempty"`
+	HTMode   string          `json:"htmode,omitempty"`
+	Country  string          `json:"country,omitempty"`
+	Disabled bool            `json:"disabled"`
+	Networks []WirelessFacts `json:"networks"`
+}
+
+// WirelessFacts is one wifi-iface. Keys are never included.
+type WirelessFacts struct {
+	Name       string `json:"name"`
+	SSID       string `json:"ssid"`
+	Mode       string `json:"mode"`
+	Network    string `json:"network,omitempty"`
+	Encryption string `json:"encryption,omitempty"`
+	Disabled   bool   `json:"disabled"`
+}
+
+// RedactableFields are the field names accepted by Redact.
+var RedactableFields = []string{"hostname", "ssid", "ipv4", "ipv6"}
+
+// CollectSystemFacts gathers SystemFacts from ubus, UCI and the DHCP lease
+// file. Like CollectFacts it tolerates missing tools; sources that return
+// nothing usable are listed in Errors.
+func CollectSystemFacts(ctx context.Context) SystemFacts {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	sources := []struct {
+		name string
+		cmd  string
+		args []string
+	}{
+		{"board", "ubus", []string{"call", "system", "board", "{}"}},
+		{"info", "ubus", []string{"call", "system", "info", "{}"}},
+		{"interfaces", "ubus", []string{"call", "network.interface", "dump", "{}"}},
+		{"wireless", "uci", []string{"-q", "show", "wireless"}},
+		{"leases", "cat", []string{"/tmp/dhcp.leases"}},
+	}
+	out := make([]string, len(sources))
+	var wg sync.WaitGroup
+	wg.Add(len(sources) + 1)
+	var topology *Topology
+	go func() {
+		defer wg.Done()
+		topology = DetectTopology(ctx)
+	}()
+	for i, src := range sources {
+		go func(i int, cmd string, args []string) {
+			defer wg.Done()
+			out[i] = runCommand(ctx, cmd, args...)
+		}(i, src.cmd, src.args)
+	}
+	wg.Wait()
+
+	f := SystemFacts{Collected: time.Now().UTC(), Disks: []DiskFacts{}, Interfaces: []InterfaceFacts{}, Radios: []RadioFacts{}, Topology: topology}
+	fail := func(source, msg string) {
+		if f.Errors == nil {
+			f.Errors = map[string]string{}
+		}
+		f.Errors[source] = msg
+	}
+
+	var board struct {
+		Hostname  string `json:"hostname"`
+		Model     string `json:"model"`
+		BoardName string `json:"board_name"`
+		Kernel    string `json:"kernel"`
+		Release   struct {
+			Description string `json:"description"`
+		} `json:"release"`
+	}
+	if json.Unmarshal([]byte(out[0]), &board) == nil {
+		f.Hostname, f.Model, f.Board, f.Kernel = board.Hostname, board.Model, board.BoardName, board.Kernel
+		f.Firmware = board.Release.Description
+	} else {
+		fail("board", "ubus call system board failed")
+	}
+
+	var info struct {
+		Uptime int64   `json:"uptime"`
+		Load   []int64 `json:"load"`
+		Memory struct {
+			Total     int64 `json:"total"`
+			Free      int64 `json:"free"`
+			Available int64 `json:"available"`
+			Buffered  int64 `json:"buffered"`
+			Cached    int64 `json:"cached"`
+		} `json:"memory"`
+		Root *diskInfo `json:"root"`
+		Tmp  *diskInfo `json:"tmp"`
+	}
+	if json.Unmarshal([]byte(out[1]), &info) == nil {
+		f.Uptime = info.Uptime
+		for _, l := range info.Load {
+			// ubus reports load averages scaled by 65536
+			f.Load = append(f.Load, float64(l*100/65536)/100)
+		}
+		m := info.Memory
+		f.Memory = MemoryFacts{Total: m.Total / 1024, Free: m.Free / 1024, Available: m.Available / 1024, Buffered: m.Buffered / 1024, Cached: m.Cached / 1024}
+		if info.Root != nil {
+			f.Disks = append(f.Disks, info.Root.facts("/"))
+		}
+		if info.Tmp != nil {
+			f.Disks = append(f.Disks, info.Tmp.facts("/tmp"))
+		}
+	} else {
+		fail("info", "ubus call system info failed")
+	}
+
+	if ifaces, err := parseInterfaceDump(out[2]); err == nil {
+		f.Interfaces = ifaces
+	} else {
+		fail("interfaces", "ubus call network.interface dump failed")
+	}
+
+	f.Radios = parseWireless(out[3])
+
+	for _, line := range strings.Split(out[4], "\n") {
+		if strings.TrimSpace(line) != "" {
+			f.DHCPLeases++
+		}
+	}
+	return f
+}
+
+// diskInfo is a filesystem entry of `ubus call system info`, in KiB.
+type diskInfo struct {
+	Total int64 `json:"total"`
+	Free  int64 `json:"free"`
+	Used  int64 `json:"used"`
+	Avail int64 `json:"avail"`
+}
+
+func (d diskInfo) facts(mount string) DiskFacts {
+	return DiskFacts{Mount: mount, Total: d.Total, Used: d.Used, Free: d.Avail}
+}
+
+func parseInterfaceDump(out string) ([]InterfaceFacts, error) {
+	type addr struct {
+		Address string `json:"address"`
+		Mask    int    `json:"mask"`
+	}
+	var dump struct {
+		Interface []struct {
+			Interface string `json:"interface"`
+			Up        bool   `json:"up"`
+			Proto     string `json:"proto"`
+			L3Device  string `json:"l3_device"`
+			Device    string `json:"device"`
+			IPv4      []addr `json:"ipv4-address"`
+			IPv6      []addr `json:"ipv6-address"`
+		} `json:"interface"`
+	}
+	if err := json.Unmarshal([]byte(out), &dump); err != nil {
+		return nil, err
+	}
+	ifaces := make([]InterfaceFacts, 0, len(dump.Interface))
+	for _, i := range dump.Interface {
+		dev := i.L3Device
+		if dev == "" {
+			dev = i.Device
+		}
+		fi := InterfaceFacts{Name: i.Interface, Proto: i.Proto, Device: dev, Up: i.Up}
+		for _, a := range i.IPv4 {
+			fi.IPv4 = append(fi.IPv4, a.Address+"/"+strconv.Itoa(a.Mask))
+		}
+		for _, a := range i.IPv6 {
+			fi.IPv6 = append(fi.IPv6, a.Address+"/"+strconv.Itoa(a.Mask))
+		}
+		ifaces = append(ifaces, fi)
+	}
+	return ifaces, nil
+}
+
+// parseWireless builds radios from `uci show wireless` output. Interfaces
+// are attached to their radio; options not listed in RadioFacts and
+// WirelessFacts, in particular keys, are ignored.
+func parseWireless(out string) []RadioFacts {
+	types := map[string]string{}
+	opts := map[string]map[string]string{}
+	var order []string
+	for _, line := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || !strings.HasPrefix(k, "wireless.") {
+			continue
+		}
+		v = strings.Trim(v, "'")
+		parts := strings.SplitN(strings.TrimPrefix(k, "wireless."), ".", 2)
+		if len(parts) == 1 {
+			types[parts[0]] = v
+			opts[parts[0]] = map[string]string{}
+			order = append(order, parts[0])
+		} else if o := opts[parts[0]]; o != nil {
+			o[parts[1]] = v
+		}
+	}
+
+	radios := []RadioFacts{}
+	index := map[string]int{}
+	for _, name := range order {
+		if types[name] != "wifi-device" {
+			continue
+		}
+		o := opts[name]
+		index[name] = len(radios)
+		radios = append(radios, RadioFacts{
+			Name: name, Band: o["band"], Channel: o["channel"], HTMode: o["htmode"], Country: o["country"],
+			Disabled: o["disabled"] == "1", Networks: []WirelessFacts{},
+		})
+	}
+	for _, name := range order {
+		if types[name] != "wifi-iface" {
+			continue
+		}
+		o := opts[name]
+		i, ok := index[o["device"]]
+		if !ok {
+			continue
+		}
+		radios[i].Networks = append(radios[i].Networks, WirelessFacts{
+			Name: name, SSID: o["ssid"], Mode: o["mode"], Network: o["network"],
+			Encryption: o["encryption"], Disabled: o["disabled"] == "1",
+		})
+	}
+	return radios
+}
+
+// Redact returns a copy of f with the named fields (see RedactableFields)
+// replaced by "[REDACTED]". Unknown names are ignored.
+func (f SystemFacts) Redact(fields []string) SystemFacts {
+	hide := map[string]bool{}
+	for _, name := range fields {
+		hide[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	const mask = "[REDACTED]"
+	var redacted []string
+	for _, name := range RedactableFields {
+		if hide[name] {
+			redacted = append(redacted, name)
+		}
+	}
+	if len(redacted) == 0 {
+		return f
+	}
+	f.Redacted = redacted
+
+	if hide["hostname"] && f.Hostname != "" {
+		f.Hostname = mask
+	}
+	ifaces := make([]InterfaceFacts, len(f.Interfaces))
+	for i, fi := range f.Interfaces {
+		if hide["ipv4"] {
+			fi.IPv4 = maskAll(fi.IPv4, mask)
+		}
+		if hide["ipv6"] {
+			fi.IPv6 = maskAll(fi.IPv6, mask)
+		}
+		ifaces[i] = fi
+	}
+	f.Interfaces = ifaces
+	radios := make([]RadioFacts, len(f.Radios))
+	for i, r := range f.Radios {
+		nets := make([]WirelessFacts, len(r.Networks))
+		for j, n := range r.Networks {
+			if hide["ssid"] && n.SSID != "" {
+				n.SSID = mask
+			}
+			nets[j] = n
+		}
+		r.Networks = nets
+		radios[i] = r
+	}
+	f.Radios = radios
+	return f
+}
+
+func maskAll(vals []string, mask string) []string {
+	if len(vals) == 0 {
+		return vals
+	}
+	out := make([]string, len(vals))
+	for i := range out {
+		out[i] = mask
+	}
+	return out
+}
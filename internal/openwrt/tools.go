@@ -0,0 +1,78 @@
+package openwrt
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// OptionalTools maps commands missing from a default OpenWrt image to the
+// opkg package providing them.
+var OptionalTools = map[string]string{
+	"arp-scan":    "arp-scan",
+	"conntrack":   "conntrack",
+	"curl":        "curl",
+	"dig":         "bind-dig",
+	"ethtool":     "ethtool",
+	"host":        "bind-host",
+	"htop":        "htop",
+	"ip6tables":   "ip6tables-nft",
+	"iperf3":      "iperf3",
+	"iptables":    "iptables-nft",
+	"iw":          "iw",
+	"iwinfo":      "iwinfo",
+	"jq":          "jq",
+	"lsof":        "lsof",
+	"mtr":         "mtr",
+	"nmap":        "nmap",
+	"openssl":     "openssl-util",
+	"socat":       "socat",
+	"ss":          "ss",
+	"tc":          "tc-full",
+	"tcpdump":     "tcpdump",
+	"traceroute":  "traceroute",
+	"traceroute6": "iputils-traceroute6",
+	"wg":          "wireguard-tools",
+	"wget":        "wget-ssl",
+}
+
+// lookPath is overridden by tests.
+var lookPath = exec.LookPath
+
+// Installed reports whether the executable name can be run: an existing file
+// for a path, otherwise a match in PATH.
+func Installed(name string) bool {
+	if strings.ContainsRune(name, '/') {
+		info, err := os.Stat(name)
+		return err == nil && !info.IsDir()
+	}
+	_, err := lookPath(name)
+	return err == nil
+}
+
+// PackageFor returns the opkg package providing the executable name, or ""
+// if it is not one of OptionalTools.
+func PackageFor(name string) string {
+	return OptionalTools[filepath.Base(name)]
+}
+
+// toolsScript is the shell run for the "optional tools" fact: one line per
+// tool of OptionalTools saying whether it is installed, and if not which
+// package provides it. It runs through runCommand like the other facts so
+// the model sees the router's tools, not those of the host running tests.
+func toolsScript() string {
+	names := make([]string, 0, len(OptionalTools))
+	for name := range OptionalTools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "if command -v %s >/dev/null 2>&1; then echo '%s: installed'; else echo '%s: not installed (opkg install %s)'; fi\n",
+			name, name, name, OptionalTools[name])
+	}
+	return b.String()
+}
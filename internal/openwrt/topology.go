@@ -0,0 +1,255 @@
+package openwrt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles of a device in Topology.
+const (
+	RoleRouter = "router"
+	RoleAP     = "ap" // Dumb access point: the upstream router routes and serves DHCP
+)
+
+// Mesh protocols of MeshLink.
+const (
+	MeshBatman = "batman-adv"
+	Mesh80211s = "802.11s"
+)
+
+// Topology is the place of the device in the network: whether it routes or
+// only bridges clients onto the network of an upstream router, and the
+// mesh links it takes part in.
+type Topology struct {
+	Role    string     `json:"role"`
+	Reasons []string   `json:"reasons,omitempty"` // Why the device counts as an access point
+	Uplink  string     `json:"uplink,omitempty"`  // Interface an access point reaches the upstream router on
+	Mesh    []MeshLink `json:"mesh,omitempty"`
+}
+
+// MeshLink is one mesh the device takes part in.
+type MeshLink struct {
+	Protocol  string     `json:"protocol"`
+	Interface string     `json:"interface"`         // bat0, or the 802.11s wifi-iface or its device
+	MeshID    string     `json:"mesh_id,omitempty"` // 802.11s only
+	Peers     []MeshPeer `json:"peers"`
+}
+
+// MeshPeer is a neighbouring mesh node.
+type MeshPeer struct {
+	MAC      string `json:"mac"`
+	Via      string `json:"via,omitempty"`       // Interface it is seen on
+	LastSeen string `json:"last_seen,omitempty"` // batman-adv only
+	Signal   string `json:"signal,omitempty"`    // 802.11s only, e.g. "-52 dBm"
+}
+
+// IsAP reports whether t describes a dumb access point.
+func (t *Topology) IsAP() bool {
+	return t != nil && t.Role == RoleAP
+}
+
+// DetectTopology works out the role and mesh links of the device from UCI,
+// batctl and iw. It returns nil for a plain router outside any mesh, which
+// needs no special treatment. Like CollectFacts it tolerates missing tools.
+func DetectTopology(ctx context.Context) *Topology {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	sources := [][]string{
+		{"uci", "-q", "show", "network"},
+		{"uci", "-q", "show", "dhcp"},
+		{"uci", "-q", "show", "wireless"},
+		{"iw", "dev"},
+	}
+	out := make([]string, len(sources))
+	var wg sync.WaitGroup
+	wg.Add(len(sources))
+	for i, argv := range sources {
+		go func(i int, argv []string) {
+			defer wg.Done()
+			out[i] = runCommand(ctx, argv[0], argv[1:]...)
+		}(i, argv)
+	}
+	wg.Wait()
+
+	network, dhcp, wireless := parseUCI(out[0], "network"), parseUCI(out[1], "dhcp"), parseUCI(out[2], "wireless")
+	t := topologyOf(network, dhcp)
+	for _, name := range network.order {
+		if network.types[name] == "interface" && network.opts[name]["proto"] == "batadv" {
+			link := MeshLink{Protocol: MeshBatman, Interface: name}
+			link.Peers = parseBatmanNeighbors(runCommand(ctx, "batctl", "meshif", name, "n", "-H"))
+			t.Mesh = append(t.Mesh, link)
+		}
+	}
+	meshDevs := parseMeshDevices(out[3])
+	var links []MeshLink
+	for _, name := range wireless.order {
+		o := wireless.opts[name]
+		if wireless.types[name] == "wifi-iface" && o["mode"] == "mesh" && o["disabled"] != "1" {
+			links = append(links, MeshLink{Protocol: Mesh80211s, Interface: name, MeshID: o["mesh_id"]})
+		}
+	}
+	for i := range links {
+		// The kernel device is the ifname option, or the only mesh point
+		dev := wireless.opts[links[i].Interface]["ifname"]
+		if dev == "" && len(links) == 1 && len(meshDevs) == 1 {
+			dev = meshDevs[0]
+		}
+		if dev != "" {
+			links[i].Interface = dev
+			links[i].Peers = parseStations(runCommand(ctx, "iw", "dev", dev, "station", "dump"), dev)
+		}
+		if links[i].Peers == nil {
+			links[i].Peers = []MeshPeer{}
+		}
+	}
+	t.Mesh = append(t.Mesh, links...)
+
+	if t.Role == RoleRouter && len(t.Mesh) == 0 {
+		return nil
+	}
+	return &t
+}
+
+// uciConfig is the parsed `uci show <config>` output: section types,
+// options, and section names in order.
+type uciConfig struct {
+	types map[string]string
+	opts  map[string]map[string]string
+	order []string
+}
+
+func parseUCI(out, config string) uciConfig {
+	c := uciConfig{types: map[string]string{}, opts: map[string]map[string]string{}}
+	for _, line := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || !strings.HasPrefix(k, config+".") {
+			continue
+		}
+		v = strings.Trim(v, "'")
+		parts := strings.SplitN(strings.TrimPrefix(k, config+"."), ".", 2)
+		if len(parts) == 1 {
+			c.types[parts[0]] = v
+			c.opts[parts[0]] = map[string]string{}
+			c.order = append(c.order, parts[0])
+		} else if o := c.opts[parts[0]]; o != nil {
+			o[parts[1]] = v
+		}
+	}
+	return c
+}
+
+// topologyOf decides the role from the network and dhcp configs. The device
+// is an access point when the DHCP server of lan is disabled and it either
+// has no wan interface or takes its lan address by DHCP from upstream.
+func topologyOf(network, dhcp uciConfig) Topology {
+	t := Topology{Role: RoleRouter}
+	lan, ok := network.opts["lan"]
+	if !ok || network.types["lan"] != "interface" {
+		return t
+	}
+	dhcpOff := false
+	for _, name := range dhcp.order {
+		o := dhcp.opts[name]
+		if dhcp.types[name] == "dhcp" && o["interface"] == "lan" {
+			dhcpOff = o["ignore"] == "1"
+		}
+	}
+	if !dhcpOff {
+		return t
+	}
+	var reasons []string
+	if w, ok := network.opts["wan"]; !ok || network.types["wan"] != "interface" || w["proto"] == "none" || w["disabled"] == "1" {
+		reasons = append(reasons, "no wan interface")
+	}
+	if lan["proto"] == "dhcp" {
+		reasons = append(reasons, "lan takes its address by DHCP")
+	}
+	if len(reasons) == 0 {
+		return t
+	}
+	t.Role = RoleAP
+	t.Reasons = append([]string{"DHCP server disabled on lan"}, reasons...)
+	t.Uplink = "lan"
+	return t
+}
+
+// parseBatmanNeighbors parses `batctl n -H`: "<if> <mac> <last-seen>" lines.
+func parseBatmanNeighbors(out string) []MeshPeer {
+	peers := []MeshPeer{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 || strings.Count(f[1], ":") != 5 {
+			continue
+		}
+		peers = append(peers, MeshPeer{MAC: f[1], Via: f[0], LastSeen: f[2]})
+	}
+	return peers
+}
+
+// parseMeshDevices returns the mesh point interfaces listed by `iw dev`.
+func parseMeshDevices(out string) []string {
+	var devs []string
+	current := ""
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		switch {
+		case len(f) == 2 && f[0] == "Interface":
+			current = f[1]
+		case len(f) == 3 && f[0] == "type" && f[1] == "mesh" && f[2] == "point" && current != "":
+			devs = append(devs, current)
+		}
+	}
+	return devs
+}
+
+// parseStations parses `iw dev <dev> station dump` into peers seen on dev.
+func parseStations(out, dev string) []MeshPeer {
+	peers := []MeshPeer{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		switch {
+		case len(f) >= 2 && f[0] == "Station":
+			peers = append(peers, MeshPeer{MAC: f[1], Via: dev})
+		case len(f) >= 2 && f[0] == "signal:" && len(peers) > 0:
+			peers[len(peers)-1].Signal = f[1] + " dBm"
+		}
+	}
+	return peers
+}
+
+// String renders t for the facts block of prompts, telling the model what
+// the role allows. It is empty for a nil t.
+func (t *Topology) String() string {
+	if t == nil {
+		return ""
+	}
+	var b strings.Builder
+	if t.IsAP() {
+		fmt.Fprintf(&b, "role: dumb access point (%s); uplink %s\n", strings.Join(t.Reasons, ", "), t.Uplink)
+		b.WriteString("The upstream router does routing, DHCP and the firewall. Do not plan DHCP or firewall changes here; plan wireless, bridge and local settings only.\n")
+	} else {
+		b.WriteString("role: router\n")
+	}
+	for _, m := range t.Mesh {
+		fmt.Fprintf(&b, "mesh: %s on %s", m.Protocol, m.Interface)
+		if m.MeshID != "" {
+			fmt.Fprintf(&b, ", mesh_id %q", m.MeshID)
+		}
+		fmt.Fprintf(&b, ", %d peer(s)\n", len(m.Peers))
+		for _, p := range m.Peers {
+			fmt.Fprintf(&b, "  %s via %s", p.MAC, p.Via)
+			if p.LastSeen != "" {
+				fmt.Fprintf(&b, ", last seen %s ago", p.LastSeen)
+			}
+			if p.Signal != "" {
+				fmt.Fprintf(&b, ", signal %s", p.Signal)
+			}
+			b.WriteString("\n")
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
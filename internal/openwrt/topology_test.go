@@ -0,0 +1,62 @@
+package openwrt
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDetectTopology(t *testing.T) {
+	originalRunCommand := runCommand
+	defer func() { runCommand = originalRunCommand }()
+
+	outputs := map[string]string{
+		"uci -q show network": "network.lan=interface\nnetwork.lan.proto='dhcp'\n" +
+			"network.bat0=interface\nnetwork.bat0.proto='batadv'\n" +
+			"network.mesh0=interface\nnetwork.mesh0.proto='batadv_hardif'\nnetwork.mesh0.master='bat0'\n",
+		"uci -q show dhcp": "dhcp.lan=dhcp\ndhcp.lan.interface='lan'\ndhcp.lan.ignore='1'\n",
+		"uci -q show wireless": "wireless.radio0=wifi-device\n" +
+			"wireless.mesh=wifi-iface\nwireless.mesh.device='radio0'\nwireless.mesh.mode='mesh'\nwireless.mesh.mesh_id='home-mesh'\nwireless.mesh.key='hunter22'\n",
+		"iw dev":                         "phy#0\n\tInterface phy0-mesh0\n\t\tifindex 9\n\t\ttype mesh point\n\tInterface phy0-ap0\n\t\ttype AP\n",
+		"batctl meshif bat0 n -H":        "  phy0-mesh0  02:ba:de:af:fe:01    0.340s\n  phy0-mesh0  02:ba:de:af:fe:02    1.020s\n",
+		"iw dev phy0-mesh0 station dump": "Station 02:ba:de:af:fe:01 (on phy0-mesh0)\n\tinactive time:\t10 ms\n\tsignal:  \t-52 [-55, -54] dBm\n",
+	}
+	runCommand = func(ctx context.Context, name string, args ...string) string {
+		return outputs[strings.Join(append([]string{name}, args...), " ")]
+	}
+
+	topo := DetectTopology(context.Background())
+	if !topo.IsAP() || topo.Uplink != "lan" || len(topo.Reasons) != 3 {
+		t.Fatalf("unexpected role %+v", topo)
+	}
+	if len(topo.Mesh) != 2 {
+		t.Fatalf("unexpected mesh links %+v", topo.Mesh)
+	}
+	bat, s := topo.Mesh[0], topo.Mesh[1]
+	if bat.Protocol != MeshBatman || bat.Interface != "bat0" || len(bat.Peers) != 2 || bat.Peers[1].LastSeen != "1.020s" {
+		t.Errorf("unexpected batman link %+v", bat)
+	}
+	if s.Protocol != Mesh80211s || s.Interface != "phy0-mesh0" || s.MeshID != "home-mesh" || len(s.Peers) != 1 || s.Peers[0].Signal != "-52 dBm" {
+		t.Errorf("unexpected 802.11s link %+v", s)
+	}
+	text := topo.String()
+	for _, want := range []string{"role: dumb access point", "Do not plan DHCP or firewall changes", "mesh: batman-adv on bat0, 2 peer(s)", `mesh_id "home-mesh"`} {
+		if !strings.Contains(text, want) {
+			t.Errorf("topology text lacks %q:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "hunter22") {
+		t.Error("mesh key leaked into the facts")
+	}
+	if facts := CollectFacts(context.Background()); !strings.Contains(facts, "topology:\nrole: dumb access point") {
+		t.Errorf("facts lack the topology section:\n%s", facts)
+	}
+
+	// A router with a DHCP server and a wan interface is not worth a section
+	outputs["uci -q show network"] = "network.lan=interface\nnetwork.lan.proto='static'\nnetwork.wan=interface\nnetwork.wan.proto='dhcp'\n"
+	outputs["uci -q show dhcp"] = "dhcp.lan=dhcp\ndhcp.lan.interface='lan'\n"
+	outputs["uci -q show wireless"] = ""
+	if topo := DetectTopology(context.Background()); topo != nil {
+		t.Errorf("expected no topology for a plain router, got %+v", topo)
+	}
+}
@@ -0,0 +1,250 @@
+package openwrt
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scanCommand runs the slower commands of a wireless survey; a scan takes
+// several seconds, longer than the fact collection budget.
+var scanCommand runFn = func(ctx context.Context, name string, args ...string) string {
+	cctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(cctx, name, args...).CombinedOutput()
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
+
+// Radio is a wireless interface of the router.
+type Radio struct {
+	Interface string `json:"interface"`
+	Channel   int    `json:"channel"`
+	TxPower   int    `json:"txpower,omitempty"` // dBm
+	// Signal strengths of the associated clients, in dBm
+	ClientSignals []int `json:"client_signals"`
+}
+
+// Neighbor is an access point seen in a scan. SSIDs are not kept: they
+// are chosen by strangers and not needed to pick a channel.
+type Neighbor struct {
+	Channel int `json:"channel"`
+	Signal  int `json:"signal"` // dBm
+}
+
+// WirelessSurvey is what optimize-wifi tells the model about the radio
+// environment.
+type WirelessSurvey struct {
+	Radios    []Radio    `json:"radios"`
+	Neighbors []Neighbor `json:"neighbors"`
+	Config    string     `json:"-"` // uci show wireless
+}
+
+// IsDFSChannel reports whether a 5 GHz channel needs radar detection (DFS)
+// in most regulatory domains: the radio must listen before transmitting
+// and leave the channel when radar appears, dropping all clients.
+func IsDFSChannel(channel int) bool {
+	return channel >= 52 && channel <= 144
+}
+
+// Band returns "2.4 GHz" or "5 GHz" for a channel number as reported by
+// iwinfo. 6 GHz channels overlap 5 GHz numbers and are only told apart by
+// frequency, so they are reported as 5 GHz here.
+func Band(channel int) string {
+	switch {
+	case channel >= 1 && channel <= 14:
+		return "2.4 GHz"
+	case channel >= 32:
+		return "5 GHz"
+	}
+	return "unknown band"
+}
+
+var (
+	reChannel = regexp.MustCompile(`Channel:\s*(\d+)`)
+	reTxPower = regexp.MustCompile(`Tx-Power:\s*(\d+)\s*dBm`)
+	reSignal  = regexp.MustCompile(`Signal:\s*(-?\d+)\s*dBm`)
+	reAssoc   = regexp.MustCompile(`(?m)^[0-9A-Fa-f]{2}(?::[0-9A-Fa-f]{2}){5}\s+(-?\d+)\s*dBm`)
+	reIwFreq  = regexp.MustCompile(`freq:\s*(\d+)`)
+	reIwSig   = regexp.MustCompile(`signal:\s*(-?\d+)`)
+)
+
+// CollectWirelessSurvey scans for neighboring access points on every
+// wireless interface (iwinfo, or iw when iwinfo is missing) and collects
+// the signal strength of associated clients.
+func CollectWirelessSurvey(ctx context.Context) WirelessSurvey {
+	var s WirelessSurvey
+	s.Radios = parseIwinfoDevices(scanCommand(ctx, "iwinfo"))
+	for i := range s.Radios {
+		r := &s.Radios[i]
+		scan := scanCommand(ctx, "iwinfo", r.Interface, "scan")
+		neighbors := parseIwinfoScan(scan)
+		if scan == "" {
+			neighbors = parseIwScan(scanCommand(ctx, "iw", "dev", r.Interface, "scan"))
+		}
+		s.Neighbors = append(s.Neighbors, neighbors...)
+		r.ClientSignals = parseAssoclist(scanCommand(ctx, "iwinfo", r.Interface, "assoclist"))
+	}
+	s.Config = strings.TrimSpace(scanCommand(ctx, "uci", "show", "wireless"))
+	return s
+}
+
+// parseIwinfoDevices reads the interfaces listed by a bare `iwinfo`.
+func parseIwinfoDevices(out string) []Radio {
+	var radios []Radio
+	for _, block := range splitBlocks(out) {
+		fields := strings.Fields(block)
+		if len(fields) == 0 {
+			continue
+		}
+		r := Radio{Interface: fields[0]}
+		if m := reChannel.FindStringSubmatch(block); m != nil {
+			r.Channel, _ = strconv.Atoi(m[1])
+		}
+		if m := reTxPower.FindStringSubmatch(block); m != nil {
+			r.TxPower, _ = strconv.Atoi(m[1])
+		}
+		radios = append(radios, r)
+	}
+	return radios
+}
+
+// splitBlocks splits output into blocks that start with an unindented line.
+func splitBlocks(out string) []string {
+	var blocks []string
+	var cur strings.Builder
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" && line[0] != ' ' && line[0] != '\t' && cur.Len() > 0 {
+			blocks = append(blocks, cur.String())
+			cur.Reset()
+		}
+		cur.WriteString(line + "\n")
+	}
+	if strings.TrimSpace(cur.String()) != "" {
+		blocks = append(blocks, cur.String())
+	}
+	return blocks
+}
+
+// parseIwinfoScan reads the cells of `iwinfo <dev> scan`.
+func parseIwinfoScan(out string) []Neighbor {
+	var neighbors []Neighbor
+	for _, cell := range strings.Split(out, "Cell ")[1:] {
+		ch, sig := reChannel.FindStringSubmatch(cell), reSignal.FindStringSubmatch(cell)
+		if ch == nil || sig == nil {
+			continue
+		}
+		n := Neighbor{}
+		n.Channel, _ = strconv.Atoi(ch[1])
+		n.Signal, _ = strconv.Atoi(sig[1])
+		neighbors = append(neighbors, n)
+	}
+	return neighbors
+}
+
+// parseIwScan reads the BSS entries of `iw dev <dev> scan`.
+func parseIwScan(out string) []Neighbor {
+	var neighbors []Neighbor
+	for _, bss := range strings.Split(out, "\nBSS ")[1:] {
+		freq, sig := reIwFreq.FindStringSubmatch(bss), reIwSig.FindStringSubmatch(bss)
+		if freq == nil || sig == nil {
+			continue
+		}
+		mhz, _ := strconv.Atoi(freq[1])
+		n := Neighbor{Channel: channelOf(mhz)}
+		n.Signal, _ = strconv.Atoi(sig[1])
+		neighbors = append(neighbors, n)
+	}
+	return neighbors
+}
+
+// channelOf converts a 2.4 or 5 GHz frequency in MHz to its channel.
+func channelOf(mhz int) int {
+	switch {
+	case mhz == 2484:
+		return 14
+	case mhz >= 2412 && mhz < 2484:
+		return (mhz - 2407) / 5
+	case mhz >= 5000 && mhz < 5900:
+		return (mhz - 5000) / 5
+	}
+	return 0
+}
+
+// parseAssoclist reads client signal strengths from `iwinfo <dev> assoclist`.
+func parseAssoclist(out string) []int {
+	var signals []int
+	for _, m := range reAssoc.FindAllStringSubmatch(out, -1) {
+		if sig, err := strconv.Atoi(m[1]); err == nil {
+			signals = append(signals, sig)
+		}
+	}
+	return signals
+}
+
+// PromptBlock summarizes the survey for the model: each radio with its
+// clients, and per band how crowded each channel is.
+func (s WirelessSurvey) PromptBlock() string {
+	var b strings.Builder
+	b.WriteString("Wireless survey of this router:\n")
+	if len(s.Radios) == 0 {
+		b.WriteString("No wireless interfaces found (iwinfo returned nothing).\n")
+	}
+	for _, r := range s.Radios {
+		fmt.Fprintf(&b, "- %s: channel %d (%s", r.Interface, r.Channel, Band(r.Channel))
+		if IsDFSChannel(r.Channel) {
+			b.WriteString(", DFS")
+		}
+		b.WriteString(")")
+		if r.TxPower > 0 {
+			fmt.Fprintf(&b, ", tx power %d dBm", r.TxPower)
+		}
+		if n := len(r.ClientSignals); n > 0 {
+			sum, weakest := 0, 0
+			for _, sig := range r.ClientSignals {
+				sum += sig
+				if sig < weakest {
+					weakest = sig
+				}
+			}
+			fmt.Fprintf(&b, ", %d client(s), average signal %d dBm, weakest %d dBm", n, sum/n, weakest)
+		} else {
+			b.WriteString(", no clients")
+		}
+		b.WriteString("\n")
+	}
+
+	type usage struct {
+		count, strongest int
+	}
+	channels := map[int]*usage{}
+	for _, n := range s.Neighbors {
+		u := channels[n.Channel]
+		if u == nil {
+			u = &usage{strongest: n.Signal}
+			channels[n.Channel] = u
+		}
+		u.count++
+		if n.Signal > u.strongest {
+			u.strongest = n.Signal
+		}
+	}
+	nums := make([]int, 0, len(channels))
+	for ch := range channels {
+		nums = append(nums, ch)
+	}
+	sort.Ints(nums)
+	fmt.Fprintf(&b, "Neighboring access points: %d\n", len(s.Neighbors))
+	for _, ch := range nums {
+		u := channels[ch]
+		fmt.Fprintf(&b, "- channel %d (%s): %d AP(s), strongest %d dBm\n", ch, Band(ch), u.count, u.strongest)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,236 @@
+// Package pipeline runs named workflows that chain the diagnostic,
+// planning, execution and verification phases of a request, such as
+// wan-recovery: diagnose → fix → verify. Each phase's output feeds the
+// prompts of the plan phases after it, so the model fixes what the
+// diagnosis found and can try again after a failed verification. This is
+// a middle ground between one-shot prompts and an agent: the phases and
+// their order are fixed, and every plan is checked and approved as usual.
+//
+// Pipelines are defined one per JSON file in pipelines_dir, named after the
+// file (wan-recovery.json). Definitions are JSON only; YAML is not parsed:
+//
+//	{
+//	  "description": "Bring the WAN link back",
+//	  "every": "30m",
+//	  "phases": [
+//	    {"kind": "diagnose", "commands": [{"command": ["ifstatus", "wan"]}, {"command": ["ping", "-c", "3", "1.1.1.1"]}]},
+//	    {"kind": "plan", "prompt": "Fix the WAN connection if the diagnosis shows it is down; return no commands if it works"},
+//	    {"kind": "execute"},
+//	    {"kind": "verify", "commands": [{"command": ["ping", "-c", "3", "1.1.1.1"], "expect": {"contains": " 0% packet loss"}}]}
+//	  ]
+//	}
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Kind is what a phase does.
+type Kind string
+
+const (
+	// Diagnose runs read-only commands; their output is passed on
+	Diagnose Kind = "diagnose"
+	// Plan asks the model for a plan for its prompt, given the output of
+	// the phases before it
+	Plan Kind = "plan"
+	// Execute runs the plan of the last plan phase once approved
+	Execute Kind = "execute"
+	// Verify runs read-only commands with optional expectations (see
+	// plan.Expect); the pipeline is unverified if the last verification
+	// fails
+	Verify Kind = "verify"
+)
+
+// maxPromptChars bounds the prompt of a plan phase, as for requests to the
+// daemon.
+const maxPromptChars = 4096
+
+var nameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Pipeline is a named sequence of phases.
+type Pipeline struct {
+	Name        string `json:"name"` // The file name without its extension
+	Description string `json:"description,omitempty"`
+	// Every is how often `lucicodex schedule pipeline` runs the pipeline,
+	// as a duration such as "30m"
+	Every string `json:"every,omitempty"`
+	// AutoApprove lets execute phases run without confirmation when the
+	// pipeline is scheduled. Plans with policy warnings still need an
+	// approval_command.
+	AutoApprove bool    `json:"auto_approve,omitempty"`
+	Phases      []Phase `json:"phases"`
+}
+
+// Phase is a step of a pipeline.
+type Phase struct {
+	Name     string                `json:"name,omitempty"` // Defaults to the kind
+	Kind     Kind                  `json:"kind"`
+	Prompt   string                `json:"prompt,omitempty"`   // For plan phases
+	Commands []plan.PlannedCommand `json:"commands,omitempty"` // For diagnose and verify phases
+}
+
+// Interval returns how often the pipeline is scheduled, or 0 if it is not.
+func (p Pipeline) Interval() time.Duration {
+	d, _ := time.ParseDuration(p.Every)
+	return d
+}
+
+// Validate checks that p can run: a valid name, known phase kinds with
+// what they need, read-only diagnose and verify commands, and a plan phase
+// before every execute phase.
+func (p Pipeline) Validate() error {
+	if !nameRe.MatchString(p.Name) {
+		return errcode.Errorf(errcode.InvalidRequest, "invalid pipeline name %q (lowercase letters, digits, - and _)", p.Name)
+	}
+	if p.Every != "" {
+		if d, err := time.ParseDuration(p.Every); err != nil || d < time.Minute {
+			return errcode.Errorf(errcode.InvalidRequest, "every must be a duration of at least 1m, got %q", p.Every)
+		}
+	}
+	if len(p.Phases) == 0 {
+		return errcode.Errorf(errcode.InvalidRequest, "pipeline %s has no phases", p.Name)
+	}
+	names := map[string]bool{}
+	planned := false
+	for i, ph := range p.Phases {
+		name := ph.Label()
+		if names[name] {
+			return errcode.Errorf(errcode.InvalidRequest, "phase %d: duplicate name %q", i+1, name)
+		}
+		names[name] = true
+		if err := ph.check(planned); err != nil {
+			return errcode.Errorf(errcode.InvalidRequest, "phase %d (%s): %v", i+1, name, err)
+		}
+		planned = planned || ph.Kind == Plan
+	}
+	return nil
+}
+
+// Label returns the name of the phase, or its kind if it has none.
+func (ph Phase) Label() string {
+	if ph.Name != "" {
+		return ph.Name
+	}
+	return string(ph.Kind)
+}
+
+func (ph Phase) check(planned bool) error {
+	switch ph.Kind {
+	case Diagnose, Verify:
+		if ph.Prompt != "" {
+			return fmt.Errorf("only plan phases have a prompt")
+		}
+		if len(ph.Commands) == 0 {
+			return fmt.Errorf("no commands")
+		}
+		for j, c := range ph.Commands {
+			if len(c.Command) == 0 {
+				return fmt.Errorf("command %d is empty", j+1)
+			}
+			if c.Background || c.Alert != nil {
+				return fmt.Errorf("command %d: background commands and alerts are not allowed", j+1)
+			}
+			if c.Expect != nil && ph.Kind != Verify {
+				return fmt.Errorf("command %d: only verify phases check expectations", j+1)
+			}
+			for _, argv := range c.Stages() {
+				if impact.IsWrite(argv) {
+					return fmt.Errorf("command %d may change the router; only plan phases may do that", j+1)
+				}
+			}
+		}
+	case Plan:
+		if strings.TrimSpace(ph.Prompt) == "" {
+			return fmt.Errorf("no prompt")
+		}
+		if len([]rune(ph.Prompt)) > maxPromptChars {
+			return fmt.Errorf("prompt too long (max %d chars)", maxPromptChars)
+		}
+		if len(ph.Commands) > 0 {
+			return fmt.Errorf("plan phases get their commands from the model")
+		}
+	case Execute:
+		if ph.Prompt != "" || len(ph.Commands) > 0 {
+			return fmt.Errorf("execute phases run the last plan and take no prompt or commands")
+		}
+		if !planned {
+			return fmt.Errorf("no plan phase before it")
+		}
+	default:
+		return fmt.Errorf("unknown kind %q (diagnose, plan, execute or verify)", ph.Kind)
+	}
+	return nil
+}
+
+// Load reads and validates the pipeline name from dir.
+func Load(dir, name string) (Pipeline, error) {
+	if !nameRe.MatchString(name) {
+		return Pipeline{}, errcode.Errorf(errcode.InvalidRequest, "invalid pipeline name %q", name)
+	}
+	path := filepath.Join(dir, name+".json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Pipeline{}, errcode.Errorf(errcode.NotFound, "no pipeline %s in %s", name, dir)
+	}
+	if err != nil {
+		return Pipeline{}, err
+	}
+	return parse(name, path, data)
+}
+
+func parse(name, path string, data []byte) (Pipeline, error) {
+	var p Pipeline
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return Pipeline{}, errcode.Errorf(errcode.ConfigInvalid, "%s: %v", path, err)
+	}
+	p.Name = name
+	if err := p.Validate(); err != nil {
+		return Pipeline{}, errcode.Wrap(errcode.ConfigInvalid, fmt.Errorf("%s: %w", path, err))
+	}
+	return p, nil
+}
+
+// List returns the pipelines in dir by name. Files that do not parse are
+// returned as errors alongside the valid pipelines; a missing dir has none.
+func List(dir string) ([]Pipeline, []error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, []error{err}
+	}
+	var (
+		pipelines []Pipeline
+		errs      []error
+	)
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".json")
+		if e.IsDir() || name == e.Name() || !nameRe.MatchString(name) {
+			continue
+		}
+		p, err := Load(dir, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pipelines = append(pipelines, p)
+	}
+	sort.Slice(pipelines, func(i, j int) bool { return pipelines[i].Name < pipelines[j].Name })
+	return pipelines, errs
+}
@@ -0,0 +1,224 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+const wanRecovery = `{
+  "description": "Bring the WAN link back",
+  "every": "30m",
+  "phases": [
+    {"kind": "diagnose", "commands": [{"command": ["ifstatus", "wan"]}]},
+    {"name": "fix", "kind": "plan", "prompt": "Fix the WAN connection"},
+    {"kind": "execute"},
+    {"kind": "verify", "commands": [{"command": ["ping", "-c", "1", "1.1.1.1"], "expect": {"contains": "1 received"}}]}
+  ]
+}`
+
+func TestLoadList(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "wan-recovery.json"), []byte(wanRecovery), 0o644)
+	os.WriteFile(filepath.Join(dir, "wan-check.yaml"), []byte("phases:\n  - kind: diagnose\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"phases": [{"kind": "execute"}]}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "README.txt"), []byte("not a pipeline"), 0o644)
+
+	p, err := Load(dir, "wan-recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "wan-recovery" || len(p.Phases) != 4 || p.Phases[1].Label() != "fix" || p.Phases[2].Label() != "execute" || p.Interval().Minutes() != 30 {
+		t.Errorf("unexpected pipeline %+v", p)
+	}
+
+	for _, name := range []string{"missing", "wan-check"} {
+		if _, err := Load(dir, name); errcode.Of(err) != errcode.NotFound {
+			t.Errorf("%s: expected not found, got %v", name, err)
+		}
+	}
+	if _, err := Load(dir, "../wan-recovery"); errcode.Of(err) != errcode.InvalidRequest {
+		t.Errorf("expected an invalid name, got %v", err)
+	}
+	_, err = Load(dir, "broken")
+	if errcode.Of(err) != errcode.ConfigInvalid || !strings.Contains(err.Error(), "no plan phase before it") {
+		t.Errorf("expected an invalid pipeline, got %v", err)
+	}
+
+	pipelines, errs := List(dir)
+	if len(pipelines) != 1 || pipelines[0].Name != "wan-recovery" || len(errs) != 1 {
+		t.Errorf("unexpected list %+v %v", pipelines, errs)
+	}
+	if pipelines, errs := List(filepath.Join(dir, "none")); pipelines != nil || errs != nil {
+		t.Errorf("a missing directory has no pipelines, got %+v %v", pipelines, errs)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	read := []plan.PlannedCommand{{Command: []string{"ifstatus", "wan"}}}
+	for want, phases := range map[string][]Phase{
+		"no phases":                  nil,
+		"no commands":                {{Kind: Diagnose}},
+		"may change the router":      {{Kind: Diagnose, Commands: []plan.PlannedCommand{{Command: []string{"uci", "commit"}}}}},
+		"only verify phases check":   {{Kind: Diagnose, Commands: []plan.PlannedCommand{{Command: []string{"ls"}, Expect: &plan.Expect{Contains: "x"}}}}},
+		"no prompt":                  {{Kind: Plan, Prompt: " "}},
+		"get their commands":         {{Kind: Plan, Prompt: "x", Commands: read}},
+		"duplicate name":             {{Kind: Diagnose, Commands: read}, {Kind: Diagnose, Commands: read}},
+		"unknown kind":               {{Kind: "reboot"}},
+		"take no prompt or commands": {{Kind: Plan, Prompt: "x"}, {Kind: Execute, Prompt: "y"}},
+	} {
+		err := Pipeline{Name: "p", Phases: phases}.Validate()
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v", want, err)
+		}
+	}
+	if err := (Pipeline{Name: "p", Every: "10s", Phases: []Phase{{Kind: Diagnose, Commands: read}}}).Validate(); err == nil {
+		t.Error("expected intervals under a minute to be refused")
+	}
+	if err := (Pipeline{Name: "p", Phases: []Phase{{Kind: Diagnose, Commands: read}, {Kind: Verify, Commands: read}}}).Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// stubRunner runs p with a model returning plans in order and commands
+// whose output is their argv.
+func stubRunner(t *testing.T, p Pipeline, plans ...plan.Plan) (*Runner, *[]string) {
+	var planPrompts []string
+	r := &Runner{
+		Pipeline:    p,
+		Instruction: "Plan commands.",
+		Plan: func(ctx context.Context, prompt string) (plan.Plan, error) {
+			planPrompts = append(planPrompts, prompt)
+			if len(plans) == 0 {
+				t.Fatal("unexpected plan request")
+			}
+			next := plans[0]
+			plans = plans[1:]
+			return next, nil
+		},
+		Check:   func(ph Phase, p plan.Plan) (plan.Plan, error) { return p, nil },
+		Approve: func(ctx context.Context, ph Phase, p plan.Plan) error { return nil },
+		Exec: func(ctx context.Context, ph Phase, p plan.Plan) (executor.Results, error) {
+			var results executor.Results
+			for _, c := range p.Commands {
+				r := executor.Result{Command: c.Command, Output: strings.Join(c.Command, " ") + " output"}
+				if c.Command[0] == "false" {
+					r.Err = errors.New("exit status 1")
+					results.Failed++
+				}
+				results.Items = append(results.Items, r)
+			}
+			for i, c := range p.Verify {
+				passed := c.Command[0] != "false"
+				results.Checks = append(results.Checks, executor.Check{Index: i, Command: c, Passed: passed})
+				results.Verified = passed && (i == 0 || results.Verified)
+			}
+			return results, nil
+		},
+	}
+	return r, &planPrompts
+}
+
+func TestRun(t *testing.T) {
+	p, _ := parse("wan-recovery", "wan-recovery.json", []byte(wanRecovery))
+	fix := plan.Plan{Summary: "Restart WAN", Commands: []plan.PlannedCommand{{Command: []string{"ifup", "wan"}}}}
+	r, prompts := stubRunner(t, p, fix)
+	var seen []string
+	r.OnPhase = func(pr PhaseResult) { seen = append(seen, pr.Phase+"="+pr.Status) }
+
+	res := r.Run(context.Background())
+	if res.Status != StatusOK || res.Code != "" || len(res.Phases) != 4 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if strings.Join(seen, " ") != "diagnose=ok fix=ok execute=ok verify=ok" {
+		t.Errorf("unexpected phases %v", seen)
+	}
+	// The diagnosis feeds the fix, as untrusted output
+	prompt := (*prompts)[0]
+	for _, want := range []string{"Plan commands.", `"wan-recovery" pipeline (Bring the WAN link back)`, "Phase diagnose (diagnose): ok\n<<<\n$ ifstatus wan\nifstatus wan output\n>>>", "User request: Fix the WAN connection"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("prompt lacks %q:\n%s", want, prompt)
+		}
+	}
+	if !strings.Contains(res.Phases[2].Output, "ifup wan output") {
+		t.Errorf("unexpected execute output %q", res.Phases[2].Output)
+	}
+}
+
+func TestRun_Outcomes(t *testing.T) {
+	read := []plan.PlannedCommand{{Command: []string{"ifstatus", "wan"}}}
+	failing := []plan.PlannedCommand{{Command: []string{"false"}}}
+	p := Pipeline{Name: "retry", Phases: []Phase{
+		{Kind: Verify, Commands: failing},
+		{Name: "fix", Kind: Plan, Prompt: "Fix it"},
+		{Kind: Execute},
+		{Name: "check", Kind: Verify, Commands: failing},
+	}}
+
+	// Nothing to do: execute is skipped, and the last check decides
+	r, prompts := stubRunner(t, p, plan.Plan{Summary: "All good"})
+	res := r.Run(context.Background())
+	if res.Status != StatusUnverified || res.Code != errcode.ExecUnverified || res.Phases[2].Status != StatusSkipped {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if !strings.Contains((*prompts)[0], "Phase verify (verify): failed\n<<<\n$ false (failed: )") {
+		t.Errorf("the failed check should feed the plan:\n%s", (*prompts)[0])
+	}
+
+	// A failed execution stops the pipeline
+	r, _ = stubRunner(t, p, plan.Plan{Commands: failing})
+	res = r.Run(context.Background())
+	if res.Status != StatusFailed || res.Code != errcode.ExecFailed || len(res.Phases) != 3 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	// So does a denied approval
+	p.Phases[3].Commands = read
+	r, _ = stubRunner(t, p, plan.Plan{Commands: read})
+	r.Approve = func(ctx context.Context, ph Phase, p plan.Plan) error {
+		return errcode.Errorf(errcode.ApprovalDenied, "denied")
+	}
+	if res = r.Run(context.Background()); res.Code != errcode.ApprovalDenied || len(res.Phases) != 3 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	// A dry run plans without executing
+	r, _ = stubRunner(t, p, plan.Plan{Commands: read})
+	r.DryRun = true
+	r.Exec = func(ctx context.Context, ph Phase, p plan.Plan) (executor.Results, error) {
+		if ph.Kind == Execute {
+			t.Error("a dry run executed its plan")
+		}
+		return executor.Results{Verified: true}, nil
+	}
+	if res = r.Run(context.Background()); res.Status != StatusOK || res.Phases[2].Reason != "dry run" {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	// Plans the policy rejects fail
+	r, _ = stubRunner(t, p, plan.Plan{Commands: read})
+	r.Check = func(ph Phase, p plan.Plan) (plan.Plan, error) {
+		return p, errcode.Errorf(errcode.PolicyDeny, "blocked")
+	}
+	if res = r.Run(context.Background()); res.Code != errcode.PolicyDeny || len(res.Phases) != 2 {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+func TestCapOutput(t *testing.T) {
+	s := strings.Repeat("line\n", 3*maxPhaseOutput/5)
+	got := capOutput(s + "last\n")
+	if len(got) > maxPhaseOutput+64 || !strings.HasPrefix(got, "[earlier output truncated]\nline\n") || !strings.HasSuffix(got, "last\n") {
+		t.Errorf("unexpected capped output of %d bytes", len(got))
+	}
+	if capOutput("short") != "short" {
+		t.Error("short output should be kept")
+	}
+}
@@ -0,0 +1,279 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// maxPhaseOutput bounds the output of a phase given to later plan phases.
+const maxPhaseOutput = 8 * 1024
+
+// Status of a phase or a pipeline run.
+const (
+	StatusOK         = "ok"
+	StatusFailed     = "failed"
+	StatusUnverified = "unverified"
+	StatusSkipped    = "skipped"
+)
+
+// PhaseResult is the outcome of a phase.
+type PhaseResult struct {
+	Phase  string     `json:"phase"`
+	Kind   Kind       `json:"kind"`
+	Status string     `json:"status"`
+	Reason string     `json:"reason,omitempty"`
+	Plan   *plan.Plan `json:"plan,omitempty"` // For plan phases
+	// Output is what the phase found or did, as given to later plan phases
+	Output  string           `json:"output,omitempty"`
+	Results executor.Results `json:"-"`
+}
+
+// Result is the outcome of a pipeline run.
+type Result struct {
+	Pipeline string        `json:"pipeline"`
+	Status   string        `json:"status"`
+	Code     errcode.Code  `json:"error_code,omitempty"`
+	Phases   []PhaseResult `json:"phases"`
+}
+
+// Runner runs a pipeline. The model, the policy, the executor and the
+// approval are supplied by the caller, as for watch.Watcher.
+type Runner struct {
+	Pipeline Pipeline
+	// Instruction starts the prompt of every plan phase (see
+	// prompts.GeneratePlanPrompt)
+	Instruction string
+	// Plan asks the model for a plan for prompt
+	Plan func(ctx context.Context, prompt string) (plan.Plan, error)
+	// Check validates the plan of phase ph against the policy, returning it
+	// with its warnings; plans it rejects fail their phase
+	Check func(ph Phase, p plan.Plan) (plan.Plan, error)
+	// Approve is asked before an execute phase runs its plan
+	Approve func(ctx context.Context, ph Phase, p plan.Plan) error
+	// Exec runs the commands of a diagnose phase, the checks of a verify
+	// phase (as plan.Plan.Verify) or the approved plan of an execute phase.
+	// An error means the commands could not be run at all.
+	Exec func(ctx context.Context, ph Phase, p plan.Plan) (executor.Results, error)
+	// DryRun plans without executing: execute phases are skipped
+	DryRun bool
+	// OnPhase, if set, is called after each phase
+	OnPhase func(PhaseResult)
+}
+
+// Run runs the phases in order. Diagnose and verify phases run their
+// commands whatever earlier phases did, so a failed verification can be
+// planned for again; a plan phase that fails, or an execute phase whose
+// commands fail, stops the pipeline. The run is unverified if its last
+// verify phase did not pass.
+func (r *Runner) Run(ctx context.Context) Result {
+	res := Result{Pipeline: r.Pipeline.Name, Status: StatusOK}
+	var current *plan.Plan // The plan the next execute phase runs
+	for _, ph := range r.Pipeline.Phases {
+		if err := ctx.Err(); err != nil {
+			res.Status, res.Code = StatusFailed, errcode.Of(err)
+			break
+		}
+		pr := PhaseResult{Phase: ph.Label(), Kind: ph.Kind, Status: StatusOK}
+		switch ph.Kind {
+		case Diagnose:
+			var err error
+			pr.Results, err = r.Exec(ctx, ph, plan.Plan{Commands: ph.Commands})
+			if err != nil {
+				pr.Reason = err.Error()
+			}
+			if err != nil || pr.Results.Failed > 0 {
+				// The failure is what the next plan phase works from
+				pr.Status = StatusFailed
+			}
+			pr.Output = commandOutput(pr.Results)
+		case Plan:
+			p, err := r.plan(ctx, ph, res.Phases)
+			current = nil
+			if err != nil {
+				pr.Status, pr.Reason = StatusFailed, err.Error()
+				res.Status, res.Code = StatusFailed, errcode.Of(err)
+				break
+			}
+			pr.Plan = &p
+			pr.Output = planOutput(p)
+			if len(p.Commands) > 0 {
+				current = &p
+			}
+		case Execute:
+			switch {
+			case current == nil:
+				pr.Status, pr.Reason = StatusSkipped, "the plan has no commands"
+			case r.DryRun:
+				pr.Status, pr.Reason = StatusSkipped, "dry run"
+			default:
+				var err error
+				pr.Results, err = r.execute(ctx, ph, *current)
+				switch {
+				case err != nil:
+					pr.Status, pr.Reason = StatusFailed, err.Error()
+					res.Status, res.Code = StatusFailed, errcode.Of(err)
+				case pr.Results.Failed > 0 || pr.Results.Unverified():
+					pr.Status = StatusFailed
+					res.Status, res.Code = StatusFailed, pr.Results.ErrorCode()
+				}
+				pr.Output = commandOutput(pr.Results)
+			}
+			current = nil
+		case Verify:
+			var err error
+			pr.Results, err = r.Exec(ctx, ph, plan.Plan{Verify: ph.Commands})
+			if err != nil {
+				pr.Reason = err.Error()
+			}
+			if err != nil || !pr.Results.Verified {
+				pr.Status = StatusFailed
+			}
+			pr.Output = checkOutput(pr.Results)
+		}
+		res.Phases = append(res.Phases, pr)
+		if r.OnPhase != nil {
+			r.OnPhase(pr)
+		}
+		if res.Status == StatusFailed {
+			break
+		}
+	}
+	if res.Status == StatusOK {
+		res.Status, res.Code = r.verified(res.Phases)
+	}
+	return res
+}
+
+// verified returns the status of a run that did not fail, from its last
+// verify phase.
+func (r *Runner) verified(phases []PhaseResult) (string, errcode.Code) {
+	for i := len(phases) - 1; i >= 0; i-- {
+		if phases[i].Kind == Verify {
+			if phases[i].Status != StatusOK {
+				return StatusUnverified, errcode.ExecUnverified
+			}
+			break
+		}
+	}
+	return StatusOK, ""
+}
+
+// execute runs p once approved.
+func (r *Runner) execute(ctx context.Context, ph Phase, p plan.Plan) (executor.Results, error) {
+	if err := r.Approve(ctx, ph, p); err != nil {
+		return executor.Results{}, err
+	}
+	return r.Exec(ctx, ph, p)
+}
+
+// plan asks the model for the plan of ph, given what the phases before it
+// did, and checks it against the policy.
+func (r *Runner) plan(ctx context.Context, ph Phase, earlier []PhaseResult) (plan.Plan, error) {
+	p, err := r.Plan(ctx, r.prompt(ph, earlier))
+	if err != nil {
+		return p, err
+	}
+	if len(p.Commands) == 0 {
+		return p, nil
+	}
+	return r.Check(ph, p)
+}
+
+// prompt returns the prompt of plan phase ph.
+func (r *Runner) prompt(ph Phase, earlier []PhaseResult) string {
+	var b strings.Builder
+	b.WriteString(r.Instruction)
+	fmt.Fprintf(&b, "\n\nThis request is a phase of the %q pipeline", r.Pipeline.Name)
+	if r.Pipeline.Description != "" {
+		fmt.Fprintf(&b, " (%s)", r.Pipeline.Description)
+	}
+	b.WriteString(". Return no commands if nothing needs doing.")
+	if len(earlier) > 0 {
+		b.WriteString("\n\nResults of the earlier phases:\n")
+		for _, pr := range earlier {
+			fmt.Fprintf(&b, "\nPhase %s (%s): %s", pr.Phase, pr.Kind, pr.Status)
+			if pr.Reason != "" {
+				fmt.Fprintf(&b, " (%s)", pr.Reason)
+			}
+			if pr.Output == "" {
+				b.WriteString("\n")
+				continue
+			}
+			if pr.Kind == Plan {
+				// The model's own words, not router output
+				b.WriteString("\n" + pr.Output + "\n")
+				continue
+			}
+			b.WriteString("\n" + prompts.FenceOutput(pr.Output) + "\n")
+		}
+		b.WriteString("\n" + prompts.UntrustedNotice)
+	}
+	b.WriteString("\n\nUser request: " + ph.Prompt + prompts.NoQuestionsNotice)
+	return b.String()
+}
+
+// commandOutput renders the commands of results and their output.
+func commandOutput(results executor.Results) string {
+	var b strings.Builder
+	for _, it := range results.Items {
+		fmt.Fprintf(&b, "$ %s\n", strings.Join(it.Command, " "))
+		if it.Err != nil {
+			fmt.Fprintf(&b, "(failed: %v)\n", it.Err)
+		}
+		if out := strings.TrimRight(it.Output, "\n"); out != "" {
+			b.WriteString(out + "\n")
+		}
+	}
+	b.WriteString(checkOutput(results))
+	return capOutput(b.String())
+}
+
+// checkOutput renders the checks of results and their output.
+func checkOutput(results executor.Results) string {
+	var b strings.Builder
+	for _, c := range results.Checks {
+		result := "passed"
+		if !c.Passed {
+			result = "failed: " + c.Reason
+		}
+		fmt.Fprintf(&b, "$ %s (%s)\n", executor.FormatPlanned(c.Command), result)
+		if out := strings.TrimRight(c.Output, "\n"); out != "" {
+			b.WriteString(out + "\n")
+		}
+	}
+	return capOutput(b.String())
+}
+
+// planOutput renders what a plan phase decided.
+func planOutput(p plan.Plan) string {
+	var b strings.Builder
+	if p.Summary != "" {
+		b.WriteString(p.Summary + "\n")
+	}
+	for _, c := range p.Commands {
+		fmt.Fprintf(&b, "- %s\n", executor.FormatPlanned(c))
+	}
+	if len(p.Commands) == 0 {
+		b.WriteString("(no commands)\n")
+	}
+	return capOutput(b.String())
+}
+
+// capOutput keeps the end of s, where failures usually show, within
+// maxPhaseOutput bytes.
+func capOutput(s string) string {
+	if len(s) <= maxPhaseOutput {
+		return s
+	}
+	s = s[len(s)-maxPhaseOutput:]
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:]
+	}
+	return "[earlier output truncated]\n" + s
+}
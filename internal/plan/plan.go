@@ -2,8 +2,11 @@ package plan
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
 )
 
 // PlannedCommand represents a single command to execute safely without shell interpolation.
@@ -11,32 +14,301 @@ type PlannedCommand struct {
 	Command     []string `json:"command"`
 	Description string   `json:"description,omitempty"`
 	NeedsRoot   bool     `json:"needs_root,omitempty"`
+	Background  bool     `json:"background,omitempty"` // Run detached as a job (see internal/jobs)
+	// Pipe holds further pipeline stages: each reads the previous stage's
+	// stdout, as in `command | pipe[0] | pipe[1]`. Stages are wired by the
+	// executor, never by a shell.
+	Pipe [][]string `json:"pipe,omitempty"`
+	// Alert makes the command a watch probe: it is run periodically and the
+	// alert fires while the condition holds (see internal/watch).
+	Alert *Alert `json:"alert,omitempty"`
+	// Content is the new contents of the file for a FileWrite command.
+	Content string `json:"content,omitempty"`
+	// Expect is what a verification command (see Plan.Verify) must output.
+	Expect *Expect `json:"expect,omitempty"`
+}
+
+// Built-in file commands are carried out by LuciCodex itself, not by an
+// executable, and only within the configured file_paths (see internal/files).
+// Their argv is [name, path]: FileRead returns the file, FileWrite replaces
+// it with Content after backing up the old one.
+const (
+	FileRead  = "file.read"
+	FileWrite = "file.write"
+)
+
+// FileOp returns the built-in file command c runs and its path, if any.
+func (c PlannedCommand) FileOp() (op, path string, ok bool) {
+	if len(c.Command) == 0 || (c.Command[0] != FileRead && c.Command[0] != FileWrite) {
+		return "", "", false
+	}
+	if len(c.Command) > 1 {
+		path = c.Command[1]
+	}
+	return c.Command[0], path, true
+}
+
+// Built-in service commands list, inspect and control init services through
+// procd (see internal/services) instead of running /etc/init.d scripts. Their
+// argv is [ServiceList] or [name, service], such as
+// ["service.restart", "dnsmasq"].
+const (
+	ServiceList    = "service.list"
+	ServiceStatus  = "service.status"
+	ServiceStart   = "service.start"
+	ServiceStop    = "service.stop"
+	ServiceRestart = "service.restart"
+	ServiceReload  = "service.reload"
+	ServiceEnable  = "service.enable"
+	ServiceDisable = "service.disable"
+)
+
+// serviceCommands maps the built-in service commands to their actions.
+var serviceCommands = map[string]string{
+	ServiceList: "list", ServiceStatus: "status", ServiceStart: "start", ServiceStop: "stop",
+	ServiceRestart: "restart", ServiceReload: "reload", ServiceEnable: "enable", ServiceDisable: "disable",
+}
+
+// ServiceCommand returns the built-in service command of action, such as
+// ServiceRestart for "restart", or "" if there is none.
+func ServiceCommand(action string) string {
+	for name, a := range serviceCommands {
+		if a == action {
+			return name
+		}
+	}
+	return ""
+}
+
+// ServiceOp returns the action of the built-in service command c runs and
+// the service it applies to, if any.
+func (c PlannedCommand) ServiceOp() (action, service string, ok bool) {
+	if len(c.Command) == 0 {
+		return "", "", false
+	}
+	action, ok = serviceCommands[c.Command[0]]
+	if ok && len(c.Command) > 1 {
+		service = c.Command[1]
+	}
+	return action, service, ok
+}
+
+// IsBuiltin reports whether c is carried out by LuciCodex itself rather
+// than by an executable.
+func (c PlannedCommand) IsBuiltin() bool {
+	_, _, file := c.FileOp()
+	_, _, service := c.ServiceOp()
+	return file || service
+}
+
+// InitArgv returns the init script call a built-in service command argv
+// amounts to, such as ["/etc/init.d/dnsmasq", "restart"] for
+// ["service.restart", "dnsmasq"], so code that understands init scripts
+// understands it too. Any other argv is returned as is.
+func InitArgv(argv []string) []string {
+	if len(argv) != 2 {
+		return argv
+	}
+	action, ok := serviceCommands[argv[0]]
+	if !ok || action == "list" {
+		return argv
+	}
+	return []string{"/etc/init.d/" + argv[1], action}
+}
+
+// Alert is the condition under which a watch probe fires. It holds when any
+// of the set criteria is met.
+type Alert struct {
+	Message  string `json:"message"`            // Shown when the alert fires
+	Failed   bool   `json:"failed,omitempty"`   // The command fails
+	Contains string `json:"contains,omitempty"` // The output contains this text
+	Missing  string `json:"missing,omitempty"`  // The output lacks this text
+	// Pattern is a regular expression applied to the output. With Op, its
+	// first capture group is compared to Value, or the number of matches if
+	// it has no group; without Op, any match fires the alert.
+	Pattern string  `json:"pattern,omitempty"`
+	Op      string  `json:"op,omitempty"` // <, <=, >, >=, == or !=
+	Value   float64 `json:"value,omitempty"`
+}
+
+// Expect is the expected output of a verification command. Every set
+// criterion must hold, and the command must succeed.
+type Expect struct {
+	Contains string `json:"contains,omitempty"` // The output contains this text
+	Regex    string `json:"regex,omitempty"`    // A regular expression matches the output
+	// JSONPath selects a value of the output parsed as JSON, such as "up"
+	// or "$.ipv4-address[0].address". It must exist and, if Equals is set,
+	// be that text (numbers and booleans as JSON writes them).
+	JSONPath string `json:"json_path,omitempty"`
+	Equals   string `json:"equals,omitempty"`
+}
+
+// Stages returns the argv of every stage, starting with Command.
+func (c PlannedCommand) Stages() [][]string {
+	return append([][]string{c.Command}, c.Pipe...)
 }
 
 // Plan is the structured response expected from the model.
 type Plan struct {
+	// Version is the schema version (see SchemaVersion). Plans parsed from
+	// the model are always stamped with the current one.
+	Version  int              `json:"version,omitempty"`
 	Summary  string           `json:"summary,omitempty"`
 	Commands []PlannedCommand `json:"commands"`
+	// Verify holds read-only commands run after Commands, each with an
+	// Expect, that check the plan reached its goal (see executor.Check).
+	Verify   []PlannedCommand `json:"verify,omitempty"`
 	Warnings []string         `json:"warnings,omitempty"`
+	// Questions are asked by the model instead of planning when a request
+	// is ambiguous; Commands is then empty. The answers go back in a new
+	// generation (see prompts.ClarificationBlock).
+	Questions []string `json:"questions,omitempty"`
+	// LowConfidence is set by the model when it is unsure the plan does what
+	// was asked, so that a stronger model may plan again (see
+	// config.Config.EscalationModel).
+	LowConfidence bool `json:"low_confidence,omitempty"`
+	// EscalatedTo is set locally to the stronger model that produced the
+	// plan after the configured one flagged low confidence.
+	EscalatedTo string `json:"escalated_to,omitempty"`
+	// FallbackFrom is set locally to the cloud provider that could not be
+	// reached when the local model produced the plan instead.
+	FallbackFrom string `json:"fallback_from,omitempty"`
+	// AlternativeTo is set locally on a plan the model proposed after the
+	// policy rejected its first one, and explains the rejection.
+	AlternativeTo string `json:"alternative_to,omitempty"`
+	// Facts identifies the environment the plan was generated against. It is
+	// set locally after generation, never taken from the model.
+	Facts *openwrt.Stamp `json:"facts,omitempty"`
+	// PolicyWarnings lists warn-tier policy rules matched by the commands. Like
+	// Facts it is set locally (see policy.Engine.Warnings).
+	PolicyWarnings []PolicyWarning `json:"policy_warnings,omitempty"`
+	// Estimate is the expected impact of running the plan, shown before
+	// approval. Like Facts it is set locally (see impact.Estimate).
+	Estimate *Estimate `json:"estimate,omitempty"`
+	// MissingTools lists executables of the plan that are not installed.
+	// Like Facts it is set locally (see policy.Engine.CheckTools).
+	MissingTools []MissingTool `json:"missing_tools,omitempty"`
+	// Lint lists likely mistakes found by static analysis of the commands.
+	// Like Facts it is set locally (see policy.LintPlan).
+	Lint []LintFinding `json:"lint,omitempty"`
+	// PolicyTrace explains the policy's verdict on each command, for JSON
+	// output. Like Facts it is set locally (see policy.Engine.Trace).
+	PolicyTrace []PolicyTrace `json:"policy_trace,omitempty"`
+	// FileChanges are the files commands write through tee or uci import,
+	// diffed before approval. Like Facts it is set locally (see
+	// executor.Engine.Stage).
+	FileChanges []FileChange `json:"file_changes,omitempty"`
+}
+
+// Estimate summarizes what running a plan will disrupt and cost.
+type Estimate struct {
+	Commands          int      `json:"commands"`
+	WriteCommands     int      `json:"write_commands"` // Commands that change configuration or state
+	Services          []string `json:"services_restarted,omitempty"`
+	Reboot            bool     `json:"reboot,omitempty"`
+	DowntimeSeconds   int      `json:"downtime_seconds"`    // Expected loss of service
+	TokensUsed        int      `json:"tokens_used"`         // LLM tokens consumed by the request so far
+	TimeBudgetSeconds int      `json:"time_budget_seconds"` // Worst case: every command hits its timeout
+}
+
+// MissingTool is a planned executable that is not installed on the router.
+type MissingTool struct {
+	Command int    `json:"command"`           // Index into Plan.Commands
+	Tool    string `json:"tool"`              // Executable name as planned
+	Package string `json:"package,omitempty"` // opkg package providing it, if known
+}
+
+// FileChange is a file a command writes through an external program, such
+// as tee or uci import, with the change it makes.
+type FileChange struct {
+	Command int    `json:"command"` // Index into Plan.Commands
+	Path    string `json:"path"`
+	Diff    string `json:"diff,omitempty"`  // As files.Preview; empty with Error
+	Error   string `json:"error,omitempty"` // Why the change could not be staged
+}
+
+// Severities of a LintFinding, from least to most severe.
+const (
+	LintInfo    = "info"
+	LintWarning = "warning"
+	LintError   = "error"
+)
+
+// LintFinding is a likely mistake in a plan, such as committing a config no
+// command changed. Unlike policy warnings, findings need no acknowledgement
+// unless lint_block turns them into denials.
+type LintFinding struct {
+	Command  int    `json:"command"`  // Index into Plan.Commands
+	Rule     string `json:"rule"`     // Name of the check, e.g. "commit-unchanged"
+	Severity string `json:"severity"` // LintInfo, LintWarning or LintError
+	Message  string `json:"message"`
+}
+
+// PolicyWarning is a warn-tier policy rule that matched a planned command.
+// Warned commands may run, but only once the warning is acknowledged.
+type PolicyWarning struct {
+	Command int    `json:"command"` // Index into Plan.Commands
+	Rule    string `json:"rule"`    // Matching warnlist pattern or policy rule
+	Message string `json:"message"`
+}
+
+// Verdicts of a PolicyTrace.
+const (
+	VerdictAllow = "allow"
+	VerdictWarn  = "warn" // Allowed once the warnings are acknowledged
+	VerdictDeny  = "deny"
+)
+
+// PolicyTrace is how the policy decided on a planned command: the rules it
+// evaluated, which of them matched, the verdict and the command's risk.
+type PolicyTrace struct {
+	Command int         `json:"command"` // Index into Plan.Commands
+	Verdict string      `json:"verdict"` // VerdictAllow, VerdictWarn or VerdictDeny
+	Risk    string      `json:"risk"`    // See impact.Risk
+	Reason  string      `json:"reason,omitempty"`
+	Rules   []RuleTrace `json:"rules"`
+}
+
+// RuleTrace is a policy rule evaluated for a command.
+type RuleTrace struct {
+	Rule    string `json:"rule"`            // Pattern, policy rule or name of a built-in check
+	Kind    string `json:"kind"`            // allowlist, denylist, warnlist, rule or builtin
+	Layer   string `json:"layer,omitempty"` // System policy file; "" for the configuration
+	Stage   int    `json:"stage,omitempty"` // Pipeline stage, 0 for the command itself
+	Matched bool   `json:"matched"`
 }
 
 // TryUnmarshalPlan attempts to decode a JSON string to Plan.
-// It tries to extract JSON from markdown code blocks or raw text.
+// It tries to extract JSON from markdown code blocks or raw text. JSON that
+// does not match Schema is refused with a *SchemaError naming where.
 func TryUnmarshalPlan(s string) (Plan, error) {
 	var p Plan
-
-	// First try direct unmarshal
-	if err := json.Unmarshal([]byte(s), &p); err == nil && len(p.Commands) > 0 {
-		return p, nil
+	text := s
+	if !json.Valid([]byte(text)) {
+		// Try extracting from markdown/text
+		text = extractJSON(s)
 	}
-
-	// Try extracting from markdown/text
-	extracted := extractJSON(s)
-	if err := json.Unmarshal([]byte(extracted), &p); err == nil {
-		return p, nil
+	if err := Validate([]byte(text)); err != nil {
+		var schemaErr *SchemaError
+		if errors.As(err, &schemaErr) {
+			return p, err
+		}
+		return p, fmt.Errorf("failed to parse plan from: %s", s)
 	}
-
-	return p, fmt.Errorf("failed to parse plan from: %s", s)
+	if err := json.Unmarshal([]byte(text), &p); err != nil {
+		return p, fmt.Errorf("failed to parse plan from: %s", s)
+	}
+	p.Facts = nil // Only the local collector may vouch for facts
+	p.PolicyWarnings = nil
+	p.Estimate = nil
+	p.MissingTools = nil
+	p.Lint = nil
+	p.EscalatedTo = ""
+	p.FallbackFrom = ""
+	p.PolicyTrace = nil
+	p.FileChanges = nil
+	p.Version = SchemaVersion
+	return p, nil
 }
 
 func extractJSON(s string) string {
@@ -327,3 +327,47 @@ func TestExtractJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestTryUnmarshalPlan_IgnoresModelFacts(t *testing.T) {
+	p, err := TryUnmarshalPlan(`{"commands": [{"command": ["uptime"]}], "facts": {"board": "forged", "mac": "00"}}`)
+	if err != nil {
+		t.Fatalf("TryUnmarshalPlan failed: %v", err)
+	}
+	if p.Facts != nil {
+		t.Errorf("facts stamp taken from model output: %+v", p.Facts)
+	}
+}
+
+func TestTryUnmarshalPlan_IgnoresModelPolicyWarnings(t *testing.T) {
+	p, err := TryUnmarshalPlan(`{"commands": [{"command": ["uptime"]}], "policy_warnings": [{"command": 0, "rule": "x"}], "estimate": {"downtime_seconds": 0}}`)
+	if err != nil {
+		t.Fatalf("TryUnmarshalPlan failed: %v", err)
+	}
+	if p.PolicyWarnings != nil {
+		t.Errorf("policy warnings taken from model output: %+v", p.PolicyWarnings)
+	}
+	if p.Estimate != nil {
+		t.Errorf("estimate taken from model output: %+v", p.Estimate)
+	}
+}
+
+func TestPlannedCommand_ServiceOp(t *testing.T) {
+	c := PlannedCommand{Command: []string{ServiceRestart, "dnsmasq"}}
+	if action, name, ok := c.ServiceOp(); !ok || action != "restart" || name != "dnsmasq" || !c.IsBuiltin() {
+		t.Errorf("ServiceOp() = %q, %q, %v", action, name, ok)
+	}
+	if _, _, ok := (PlannedCommand{Command: []string{"service", "dnsmasq", "restart"}}).ServiceOp(); ok {
+		t.Error("expected the service executable not to be a built-in")
+	}
+	if ServiceCommand("reload") != ServiceReload || ServiceCommand("kill") != "" {
+		t.Error("unexpected ServiceCommand")
+	}
+	if got := InitArgv([]string{ServiceStop, "network"}); len(got) != 2 || got[0] != "/etc/init.d/network" || got[1] != "stop" {
+		t.Errorf("InitArgv() = %q", got)
+	}
+	for _, argv := range [][]string{{ServiceList}, {"uci", "commit"}} {
+		if got := InitArgv(argv); len(got) != len(argv) || got[0] != argv[0] {
+			t.Errorf("InitArgv(%q) = %q", argv, got)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package plan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// SchemaVersion is the plan format written by this build, in Plan.Version.
+//
+// Version history:
+//
+//	0  Plans written before versioning: no "version" field. The fields are
+//	   those of version 1, so the migration only stamps the version.
+//	1  Adds "version".
+//
+// A change that older readers would misinterpret (a renamed field, a field
+// whose meaning changes) bumps SchemaVersion and adds a migration from the
+// previous version. New optional fields do not need one.
+const SchemaVersion = 1
+
+// ErrUnsupportedVersion is returned for plans with a version this build does
+// not know, typically written by a newer LuciCodex or plugin.
+var ErrUnsupportedVersion = errors.New("unsupported plan schema version")
+
+// migrations[v] rewrites a decoded plan object from version v to v+1.
+var migrations = map[int]func(obj map[string]interface{}) error{
+	0: func(obj map[string]interface{}) error { return nil },
+}
+
+// CheckVersion reports whether a plan of version v can be read, after
+// migration, by this build.
+func CheckVersion(v int) error {
+	if v < 0 || v > SchemaVersion {
+		return errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("%w %d (this build supports up to %d)", ErrUnsupportedVersion, v, SchemaVersion))
+	}
+	return nil
+}
+
+// Decode parses a plan that was stored or produced outside this process,
+// such as a history entry, a plugin's output or a plan sent for direct
+// execution. Older versions are migrated to SchemaVersion; newer or unknown
+// versions are rejected. Unlike TryUnmarshalPlan it keeps the locally set
+// fields (Facts, PolicyWarnings, Estimate, MissingTools, Lint); callers that
+// do not trust the source must clear them.
+func Decode(data []byte) (Plan, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return Plan{}, errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("invalid plan: %w", err))
+	}
+	if obj == nil {
+		return Plan{}, errcode.Wrap(errcode.InvalidRequest, errors.New("invalid plan: not an object"))
+	}
+	v, err := versionOf(obj)
+	if err != nil {
+		return Plan{}, err
+	}
+	if err := CheckVersion(v); err != nil {
+		return Plan{}, err
+	}
+	for ; v < SchemaVersion; v++ {
+		if err := migrations[v](obj); err != nil {
+			return Plan{}, errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("migrate plan from version %d: %w", v, err))
+		}
+		obj["version"] = v + 1
+	}
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return Plan{}, err
+	}
+	var p Plan
+	if err := json.Unmarshal(b, &p); err != nil {
+		return Plan{}, errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("invalid plan: %w", err))
+	}
+	return p, nil
+}
+
+// versionOf returns the "version" of a decoded plan object, 0 if absent.
+func versionOf(obj map[string]interface{}) (int, error) {
+	raw, ok := obj["version"]
+	if !ok || raw == nil {
+		return 0, nil
+	}
+	f, ok := raw.(float64)
+	if !ok || f != float64(int(f)) {
+		return 0, errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("%w %v", ErrUnsupportedVersion, raw))
+	}
+	return int(f), nil
+}
@@ -0,0 +1,54 @@
+package plan
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+func TestDecode_MigratesUnversioned(t *testing.T) {
+	p, err := Decode([]byte(`{"summary": "old", "commands": [{"command": ["uptime"]}], "facts": {"hash": "abc"}}`))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if p.Version != SchemaVersion {
+		t.Errorf("expected version %d, got %d", SchemaVersion, p.Version)
+	}
+	if p.Summary != "old" || len(p.Commands) != 1 || p.Commands[0].Command[0] != "uptime" {
+		t.Errorf("unexpected plan: %+v", p)
+	}
+	if p.Facts == nil {
+		t.Error("Decode should keep the facts stamp of a stored plan")
+	}
+}
+
+func TestDecode_RejectsUnsupportedVersions(t *testing.T) {
+	for _, body := range []string{
+		`{"version": 99, "commands": []}`,
+		`{"version": -1, "commands": []}`,
+		`{"version": 1.5, "commands": []}`,
+		`{"version": "1", "commands": []}`,
+	} {
+		_, err := Decode([]byte(body))
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("%s: expected ErrUnsupportedVersion, got %v", body, err)
+		}
+		if errcode.Of(err) != errcode.InvalidRequest {
+			t.Errorf("%s: expected INVALID_REQUEST, got %s", body, errcode.Of(err))
+		}
+	}
+	if _, err := Decode([]byte(`[1, 2]`)); err == nil {
+		t.Error("expected an error for a non-object plan")
+	}
+}
+
+func TestTryUnmarshalPlan_StampsVersion(t *testing.T) {
+	p, err := TryUnmarshalPlan(`{"version": 7, "commands": [{"command": ["uptime"]}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != SchemaVersion {
+		t.Errorf("model output should get the current version, got %d", p.Version)
+	}
+}
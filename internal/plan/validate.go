@@ -0,0 +1,216 @@
+package plan
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Schema is the JSON Schema of the plan a model returns (plan.schema.json).
+// Models are told its shape in the prompt; their responses are checked
+// against it before they are decoded, so a mistake is reported at its path
+// rather than as a failed unmarshal.
+//
+//go:embed plan.schema.json
+var Schema []byte
+
+// schemaRoot is Schema decoded for Validate.
+var schemaRoot = mustParseSchema(Schema)
+
+func mustParseSchema(data []byte) map[string]interface{} {
+	var root map[string]interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		panic("plan: invalid plan.schema.json: " + err.Error())
+	}
+	return root
+}
+
+// maxViolations bounds the violations reported for one document, so the
+// feedback to the model stays short.
+const maxViolations = 10
+
+// Violation is a place where a document does not match Schema.
+type Violation struct {
+	Path    string `json:"path"` // Such as "commands[2].command"
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	return v.Path + ": " + v.Message
+}
+
+// SchemaError is returned for a plan that is JSON but does not match Schema.
+type SchemaError struct {
+	Violations []Violation
+}
+
+func (e *SchemaError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.String()
+	}
+	return "plan does not match the schema: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the JSON document data against Schema. It returns a
+// *SchemaError listing the violations, or the syntax error if data is not
+// JSON.
+func Validate(data []byte) error {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	var out []Violation
+	validate(schemaRoot, doc, "", &out)
+	if len(out) > 0 {
+		return &SchemaError{Violations: out}
+	}
+	return nil
+}
+
+// validate appends the violations of v against the schema node to out. It
+// understands the keywords plan.schema.json uses: $ref to #/$defs, type,
+// enum, properties, required, items and minItems.
+func validate(node map[string]interface{}, v interface{}, path string, out *[]Violation) {
+	if len(*out) >= maxViolations {
+		return
+	}
+	if ref, ok := node["$ref"].(string); ok {
+		defs, _ := schemaRoot["$defs"].(map[string]interface{})
+		node, _ = defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+	}
+	report := func(format string, args ...interface{}) {
+		p := path
+		if p == "" {
+			p = "the plan"
+		}
+		*out = append(*out, Violation{Path: p, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if enum, ok := node["enum"].([]interface{}); ok {
+		for _, e := range enum {
+			if e == v {
+				return
+			}
+		}
+		var allowed []string
+		for _, e := range enum {
+			if e != nil {
+				allowed = append(allowed, fmt.Sprintf("%q", e))
+			}
+		}
+		got := kindOf(v)
+		if s, ok := v.(string); ok {
+			got = fmt.Sprintf("%q", s)
+		}
+		report("expected one of %s, got %s", strings.Join(allowed, ", "), got)
+		return
+	}
+	if types := schemaTypes(node["type"]); len(types) > 0 && !hasType(types, v) {
+		var want []string
+		for _, t := range types {
+			if t != "null" {
+				want = append(want, t)
+			}
+		}
+		report("expected %s, got %s", strings.Join(want, " or "), kindOf(v))
+		return
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		required, _ := node["required"].([]interface{})
+		for _, r := range required {
+			if name, _ := r.(string); val[name] == nil {
+				*out = append(*out, Violation{Path: join(path, name), Message: "is required"})
+			}
+		}
+		props, _ := node["properties"].(map[string]interface{})
+		for _, name := range sortedKeys(props) {
+			if pv, ok := val[name]; ok {
+				sub, _ := props[name].(map[string]interface{})
+				validate(sub, pv, join(path, name), out)
+			}
+		}
+	case []interface{}:
+		if n, ok := node["minItems"].(float64); ok && float64(len(val)) < n {
+			report("expected at least %d items, got %d", int(n), len(val))
+		}
+		if items, ok := node["items"].(map[string]interface{}); ok {
+			for i, item := range val {
+				validate(items, item, fmt.Sprintf("%s[%d]", path, i), out)
+			}
+		}
+	}
+}
+
+// schemaTypes returns the types a "type" keyword allows.
+func schemaTypes(t interface{}) []string {
+	switch t := t.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		var types []string
+		for _, s := range t {
+			if s, ok := s.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func hasType(types []string, v interface{}) bool {
+	kind := kindOf(v)
+	for _, t := range types {
+		if t == kind {
+			return true
+		}
+		if t == "integer" && kind == "number" && v.(float64) == math.Trunc(v.(float64)) {
+			return true
+		}
+	}
+	return false
+}
+
+// kindOf names the JSON type of a decoded value. Integers are numbers
+// here; hasType tells them apart.
+func kindOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// sortedKeys returns the keys of m in order, so violations are reported
+// the same way every time.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
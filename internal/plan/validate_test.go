@@ -0,0 +1,55 @@
+package plan
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, doc := range []string{
+		`{"version": 1, "summary": "s", "commands": [{"command": ["uci", "set", "x=1"], "description": "d", "needs_root": true, "background": false, "pipe": [["grep", "x"]]}, {"command": ["file.write", "/etc/config/x"], "content": "c"}], "verify": [{"command": ["uci", "get", "x"], "expect": {"equals": "1"}}], "warnings": ["w"], "low_confidence": false}`,
+		`{"summary": "hi", "commands": []}`,
+		`{"summary": "x", "commands": null, "questions": ["which one?"], "extra": 1}`,
+		`{"commands": [{"command": ["ping", "-c", "1", "8.8.8.8"], "pipe": null, "alert": {"message": "down", "failed": true, "op": null}}]}`,
+	} {
+		if err := Validate([]byte(doc)); err != nil {
+			t.Errorf("%s: %v", doc, err)
+		}
+	}
+
+	for doc, want := range map[string][]string{
+		`[]`: {"the plan: expected object, got array"},
+		`{"commands": [{"command": ["a"]}, {"command": ["b"]}, {"command": "uci show"}]}`: {"commands[2].command: expected array, got string"},
+		`{"commands": [{"description": "x"}], "warnings": "none"}`:                        {"commands[0].command: is required", "warnings: expected array, got string"},
+		`{"commands": [{"command": []}], "low_confidence": "yes"}`:                        {"commands[0].command: expected at least 1 items, got 0", "low_confidence: expected boolean, got string"},
+		`{"verify": [{"command": ["ip", 4], "expect": {"equals": 1}}]}`:                   {"verify[0].command[1]: expected string, got number", "verify[0].expect.equals: expected string, got number"},
+		`{"version": 1.5, "commands": [{"command": ["x"], "alert": {"op": "~"}}]}`:        {`commands[0].alert.op: expected one of "", "<", "<=", ">", ">=", "==", "!=", got "~"`, "version: expected integer, got number"},
+	} {
+		err := Validate([]byte(doc))
+		var schemaErr *SchemaError
+		if !errors.As(err, &schemaErr) {
+			t.Errorf("%s: expected a SchemaError, got %v", doc, err)
+			continue
+		}
+		var got []string
+		for _, v := range schemaErr.Violations {
+			got = append(got, v.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got %q, want %q", doc, got, want)
+		}
+	}
+
+	if err := Validate([]byte(`{"commands": [`)); err == nil || errors.As(err, new(*SchemaError)) {
+		t.Errorf("expected a syntax error, got %v", err)
+	}
+}
+
+func TestTryUnmarshalPlan_SchemaError(t *testing.T) {
+	_, err := TryUnmarshalPlan("Here is the plan:\n```json\n{\"commands\": [{\"command\": \"uptime\"}]}\n```")
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) || len(schemaErr.Violations) != 1 || schemaErr.Violations[0].Path != "commands[0].command" {
+		t.Errorf("expected a violation at commands[0].command, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+// Package playbook stores sequences of plans that worked, exported from an
+// interactive session, so they can be run again without the model.
+//
+// Playbooks are written as indented JSON. JSON is a subset of YAML, so a
+// playbook may be named *.yaml and read by YAML tools.
+package playbook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Version is the playbook format written by this build.
+const Version = 1
+
+// Playbook is an ordered list of steps and the environment they assume.
+type Playbook struct {
+	Version       int           `json:"version"`
+	Created       time.Time     `json:"created"`
+	Preconditions Preconditions `json:"preconditions"`
+	Steps         []Step        `json:"steps"`
+}
+
+// Preconditions are the facts the steps were run against. Empty fields are
+// not checked.
+type Preconditions struct {
+	Board    string `json:"board,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// Step is a request and the commands that carried it out.
+type Step struct {
+	Prompt string    `json:"prompt"`
+	Plan   plan.Plan `json:"plan"`
+}
+
+// Recorder collects the steps of a session.
+type Recorder struct {
+	steps []Step
+	pre   Preconditions
+}
+
+// Record adds a step. facts is the stamp the plan was generated against;
+// the first board and firmware seen become the playbook's preconditions.
+func (r *Recorder) Record(prompt string, p plan.Plan, facts *openwrt.Stamp) {
+	if len(p.Commands) == 0 {
+		return
+	}
+	if facts != nil && r.pre == (Preconditions{}) {
+		r.pre = Preconditions{Board: facts.Board, Firmware: facts.Firmware}
+	}
+	r.steps = append(r.steps, Step{Prompt: prompt, Plan: plan.Plan{
+		Version:  plan.SchemaVersion,
+		Summary:  p.Summary,
+		Commands: p.Commands,
+	}})
+}
+
+// Len returns the number of recorded steps.
+func (r *Recorder) Len() int { return len(r.steps) }
+
+// Playbook returns the recorded steps as a playbook created now.
+func (r *Recorder) Playbook() Playbook {
+	return Playbook{
+		Version:       Version,
+		Created:       time.Now().UTC().Truncate(time.Second),
+		Preconditions: r.pre,
+		Steps:         append([]Step(nil), r.steps...),
+	}
+}
+
+// Save writes pb to path, readable by its owner only since the commands
+// may contain secrets.
+func Save(path string, pb Playbook) error {
+	data, err := json.MarshalIndent(pb, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".playbook-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads a playbook. Plans of an older schema version are migrated;
+// newer playbook or plan versions are refused.
+func Load(path string) (Playbook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Playbook{}, err
+	}
+	var raw struct {
+		Playbook
+		Steps []struct {
+			Prompt string          `json:"prompt"`
+			Plan   json.RawMessage `json:"plan"`
+		} `json:"steps"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Playbook{}, errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("invalid playbook %s: %w", path, err))
+	}
+	pb := raw.Playbook
+	if pb.Version < 1 || pb.Version > Version {
+		return Playbook{}, errcode.Errorf(errcode.InvalidRequest, "unsupported playbook version %d (this build supports up to %d)", pb.Version, Version)
+	}
+	if len(raw.Steps) == 0 {
+		return Playbook{}, errcode.Wrap(errcode.InvalidRequest, errors.New("playbook has no steps"))
+	}
+	pb.Steps = make([]Step, 0, len(raw.Steps))
+	for i, s := range raw.Steps {
+		p, err := plan.Decode(s.Plan)
+		if err != nil {
+			return Playbook{}, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		// Computed locally before execution, never taken from the file
+		p.Facts = nil
+		p.PolicyWarnings = nil
+		p.Estimate = nil
+		p.MissingTools = nil
+		p.Lint = nil
+		p.FileChanges = nil
+		pb.Steps = append(pb.Steps, Step{Prompt: s.Prompt, Plan: p})
+	}
+	return pb, nil
+}
+
+// Check reports whether the router described by facts meets the
+// preconditions.
+func (pb Playbook) Check(facts openwrt.Stamp) error {
+	pre := pb.Preconditions
+	if pre.Board != "" && facts.Board != pre.Board {
+		return errcode.Errorf(errcode.FactsMismatch, "playbook was recorded on board %q, this router is %q", pre.Board, facts.Board)
+	}
+	if pre.Firmware != "" && facts.Firmware != pre.Firmware {
+		return errcode.Errorf(errcode.FactsMismatch, "playbook was recorded on firmware %q, this router runs %q", pre.Firmware, facts.Firmware)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package playbook
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestSaveLoad(t *testing.T) {
+	var r Recorder
+	stamp := &openwrt.Stamp{Board: "glinet,gl-mt6000", Firmware: "OpenWrt 23.05.3", MAC: "abc"}
+	r.Record("nothing", plan.Plan{}, stamp)
+	r.Record("enable wifi", plan.Plan{
+		Summary:        "Enable",
+		Commands:       []plan.PlannedCommand{{Command: []string{"uci", "set", "wireless.radio0.disabled=0"}, NeedsRoot: true}},
+		PolicyWarnings: []plan.PolicyWarning{{Rule: "uci"}},
+		Facts:          stamp,
+	}, stamp)
+	r.Record("reload", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}}, &openwrt.Stamp{Board: "other"})
+
+	path := filepath.Join(t.TempDir(), "session.yaml")
+	if err := Save(path, r.Playbook()); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected an owner-only file, got %v %v", info, err)
+	}
+
+	pb, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pb.Steps) != 2 || pb.Steps[0].Prompt != "enable wifi" || !pb.Steps[0].Plan.Commands[0].NeedsRoot {
+		t.Fatalf("unexpected steps %+v", pb.Steps)
+	}
+	if pb.Steps[0].Plan.Facts != nil || pb.Steps[0].Plan.PolicyWarnings != nil || pb.Steps[0].Plan.Version != plan.SchemaVersion {
+		t.Errorf("locally set fields were stored: %+v", pb.Steps[0].Plan)
+	}
+	if pb.Preconditions != (Preconditions{Board: "glinet,gl-mt6000", Firmware: "OpenWrt 23.05.3"}) {
+		t.Errorf("unexpected preconditions %+v", pb.Preconditions)
+	}
+
+	if err := pb.Check(*stamp); err != nil {
+		t.Errorf("matching router rejected: %v", err)
+	}
+	err = pb.Check(openwrt.Stamp{Board: "glinet,gl-mt6000", Firmware: "OpenWrt 24.10.0"})
+	if errcode.Of(err) != errcode.FactsMismatch || !strings.Contains(err.Error(), "24.10.0") {
+		t.Errorf("expected a firmware mismatch, got %v", err)
+	}
+}
+
+func TestLoad_Versions(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name, body string
+		ok         bool
+	}{
+		{"unversioned plan", `{"version": 1, "steps": [{"prompt": "p", "plan": {"commands": [{"command": ["true"]}]}}]}`, true},
+		{"newer plan", `{"version": 1, "steps": [{"prompt": "p", "plan": {"version": 99, "commands": [{"command": ["true"]}]}}]}`, false},
+		{"newer playbook", `{"version": 2, "steps": [{"prompt": "p", "plan": {"commands": [{"command": ["true"]}]}}]}`, false},
+		{"no steps", `{"version": 1, "steps": []}`, false},
+		{"not json", `steps: []`, false},
+	}
+	for _, c := range cases {
+		path := filepath.Join(dir, "pb.yaml")
+		os.WriteFile(path, []byte(c.body), 0o600)
+		pb, err := Load(path)
+		if c.ok && (err != nil || pb.Steps[0].Plan.Version != plan.SchemaVersion) {
+			t.Errorf("%s: expected a migrated plan, got %+v, %v", c.name, pb, err)
+		}
+		if !c.ok && errcode.Of(err) != errcode.InvalidRequest {
+			t.Errorf("%s: expected INVALID_REQUEST, got %v", c.name, err)
+		}
+	}
+	if _, err := Load(filepath.Join(dir, "missing.yaml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+}
@@ -11,6 +11,7 @@ import (
     "time"
 
     "github.com/aezizhu/LuciCodex/internal/plan"
+    "github.com/aezizhu/LuciCodex/internal/procgroup"
 )
 
 // Plugin represents a plugin that can extend LuciCodex functionality
@@ -44,7 +45,7 @@ type execFn func(ctx context.Context, path string, args ...string) ([]byte, erro
 var executeCommand execFn = defaultExecute
 
 func defaultExecute(ctx context.Context, path string, args ...string) ([]byte, error) {
-	cmd := exec.CommandContext(ctx, path, args...)
+	cmd := procgroup.KillOnCancel(exec.CommandContext(ctx, path, args...))
 	return cmd.Output()
 }
 
@@ -167,10 +168,18 @@ func (p *ExternalPlugin) GeneratePlan(ctx context.Context, prompt string) (plan.
 		return plan.Plan{}, fmt.Errorf("plugin execution failed: %w", err)
 	}
 
-	var planResult plan.Plan
-	if err := json.Unmarshal(output, &planResult); err != nil {
+	// Plugins may emit plans of an older schema version
+	planResult, err := plan.Decode(output)
+	if err != nil {
 		return plan.Plan{}, fmt.Errorf("invalid plan output: %w", err)
 	}
+	// Only the local collector and policy engine may set these
+	planResult.Facts = nil
+	planResult.PolicyWarnings = nil
+	planResult.Estimate = nil
+	planResult.MissingTools = nil
+	planResult.Lint = nil
+	planResult.FileChanges = nil
 
 	return planResult, nil
 }
@@ -0,0 +1,87 @@
+package policy
+
+import (
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Audit change kinds.
+const (
+	NowRejected = "now_rejected" // Executed in the past, blocked by the current policy
+	NowAllowed  = "now_allowed"  // Blocked in the past, accepted by the current policy
+)
+
+// AuditFinding is a historical command whose policy outcome has changed.
+type AuditFinding struct {
+	Time     time.Time `json:"time"`
+	Prompt   string    `json:"prompt"`
+	Index    int       `json:"index"`
+	Command  []string  `json:"command"`
+	Change   string    `json:"change"`
+	Reason   string    `json:"reason"`             // Current policy decision
+	Previous string    `json:"previous,omitempty"` // Original rejection for NowAllowed findings
+}
+
+// AuditReport summarizes a replay of history against the current policy.
+type AuditReport struct {
+	Plans    int            `json:"plans"`
+	Executed int            `json:"executed_commands"`
+	Rejected int            `json:"rejected_plans"`
+	Findings []AuditFinding `json:"findings"`
+}
+
+// AuditHistory replays logged plans against the engine. Commands that were
+// executed are checked one by one; plans that were rejected are checked as a
+// whole, since their original rejection may have been caused by any command.
+func (e *Engine) AuditHistory(entries []logging.HistoryEntry) AuditReport {
+	r := AuditReport{Plans: len(entries), Findings: []AuditFinding{}}
+	for _, h := range entries {
+		if h.Rejected != "" {
+			r.Rejected++
+			if e.ValidatePlan(h.Plan) != nil {
+				continue
+			}
+			for i, c := range h.Plan.Commands {
+				r.Findings = append(r.Findings, AuditFinding{
+					Time: h.Time, Prompt: h.Prompt, Index: i, Command: c.Command,
+					Change: NowAllowed, Reason: "accepted by current policy", Previous: h.Rejected,
+				})
+			}
+			continue
+		}
+		for _, item := range h.Results {
+			r.Executed++
+			if err := e.ValidateCommand(item.Index, executedCommand(h.Plan, item)); err != nil {
+				r.Findings = append(r.Findings, AuditFinding{
+					Time: h.Time, Prompt: h.Prompt, Index: item.Index, Command: item.Command,
+					Change: NowRejected, Reason: err.Error(),
+				})
+			}
+		}
+	}
+	return r
+}
+
+// executedCommand returns the planned command behind a result, keeping the
+// model's needs_root claim when the argv matches so strict privilege checks
+// see the same input they saw at execution time.
+func executedCommand(p plan.Plan, item logging.ResultItem) plan.PlannedCommand {
+	if item.Index >= 0 && item.Index < len(p.Commands) && equalArgv(p.Commands[item.Index].Command, item.Command) {
+		return p.Commands[item.Index]
+	}
+	return plan.PlannedCommand{Command: item.Command}
+}
+
+func equalArgv(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
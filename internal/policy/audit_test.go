@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestAuditHistory(t *testing.T) {
+	history := []logging.HistoryEntry{
+		{
+			Prompt: "restart wifi",
+			Plan: plan.Plan{Commands: []plan.PlannedCommand{
+				{Command: []string{"wifi", "status"}},
+				{Command: []string{"wifi", "reload"}},
+			}},
+			Results: []logging.ResultItem{
+				{Index: 0, Command: []string{"wifi", "status"}},
+				{Index: 1, Command: []string{"wifi", "reload"}},
+			},
+		},
+		{
+			Prompt:   "show leases",
+			Plan:     plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"cat", "/tmp/dhcp.leases"}}}},
+			Rejected: "command 0 denied by policy",
+		},
+		{
+			Prompt:   "reboot",
+			Plan:     plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"reboot"}}}},
+			Rejected: "command 0 denied by policy",
+		},
+	}
+
+	e := New(config.Config{Denylist: []string{"^wifi reload", "^reboot"}})
+	r := e.AuditHistory(history)
+
+	if r.Plans != 3 || r.Executed != 2 || r.Rejected != 2 {
+		t.Errorf("unexpected counts: %+v", r)
+	}
+	if len(r.Findings) != 2 {
+		t.Fatalf("expected 2 findings, got %+v", r.Findings)
+	}
+	if f := r.Findings[0]; f.Change != NowRejected || f.Index != 1 || f.Reason != "command 1 denied by policy" {
+		t.Errorf("unexpected rejected finding: %+v", f)
+	}
+	if f := r.Findings[1]; f.Change != NowAllowed || f.Prompt != "show leases" || f.Previous == "" {
+		t.Errorf("unexpected allowed finding: %+v", f)
+	}
+}
+
+func TestValidateCommand_StrictPrivileges(t *testing.T) {
+	e := New(config.Config{StrictPrivileges: true})
+	if err := e.ValidateCommand(0, plan.PlannedCommand{Command: []string{"uci", "commit"}}); err == nil {
+		t.Error("expected privilege conflict for uci commit without needs_root")
+	}
+	if err := e.ValidateCommand(0, plan.PlannedCommand{Command: []string{"uci", "commit"}, NeedsRoot: true}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// ControlRule names the control path check in warnings and denials.
+const ControlRule = "control-interface"
+
+// WithControl returns an engine that also guards cp, the path of the session
+// requesting the plan, according to control_guard: commands that would take
+// down its interface or firewall zone become warnings, or with "block" are
+// denied. A nil cp, or control_guard "off", returns e unchanged.
+func (e *Engine) WithControl(cp *openwrt.ControlPath) *Engine {
+	if cp == nil || e.cfg.ControlGuard == "off" {
+		return e
+	}
+	guarded := *e
+	guarded.control = cp
+	return &guarded
+}
+
+// ControlWarning returns the first warning of p about cutting off the
+// control path, if any. Whoever confirms such a plan is asked twice.
+func ControlWarning(p plan.Plan) *plan.PolicyWarning {
+	for i, w := range p.PolicyWarnings {
+		if w.Rule == ControlRule {
+			return &p.PolicyWarnings[i]
+		}
+	}
+	return nil
+}
+
+// blocksControl reports whether commands cutting off the control path are
+// denied rather than flagged.
+func (e *Engine) blocksControl() bool {
+	return e.control != nil && e.cfg.ControlGuard == "block"
+}
+
+// controlHit returns how argv would cut off the session on e.control, or ""
+// if it would not.
+func (e *Engine) controlHit(argv []string) string {
+	cp := e.control
+	if cp == nil || len(argv) == 0 {
+		return ""
+	}
+	argv = plan.InitArgv(argv)
+	iface := fmt.Sprintf("interface %q, which carries this session from %s", cp.Interface, cp.Client)
+	name := path.Base(argv[0])
+	args := argv[1:]
+	switch {
+	case name == "ifdown" || name == "ifup":
+		// ifup restarts an interface that is up
+		for _, a := range args {
+			if a == cp.Interface || a == "-a" {
+				return "takes down " + iface
+			}
+		}
+	case name == "ubus":
+		if len(args) >= 3 && args[0] == "call" && (args[2] == "down" || args[2] == "remove") {
+			if args[1] == "network.interface."+cp.Interface ||
+				args[1] == "network.interface" && len(args) > 3 && strings.Contains(strings.ReplaceAll(args[3], " ", ""), `"interface":"`+cp.Interface+`"`) {
+				return "takes down " + iface
+			}
+		}
+	case name == "ip":
+		// ip link set [dev] <device> down
+		if cp.Device != "" && len(args) >= 4 && args[0] == "link" && args[1] == "set" && args[len(args)-1] == "down" && contains(args, cp.Device) {
+			return fmt.Sprintf("takes down device %s of %s", cp.Device, iface)
+		}
+	case name == "ifconfig":
+		if cp.Device != "" && len(args) >= 2 && args[0] == cp.Device && args[len(args)-1] == "down" {
+			return fmt.Sprintf("takes down device %s of %s", cp.Device, iface)
+		}
+	case argv[0] == "/etc/init.d/network" || name == "service" && len(args) > 0 && args[0] == "network":
+		action := ""
+		if name == "service" && len(args) > 1 {
+			action = args[1]
+		} else if name != "service" && len(args) > 0 {
+			action = args[0]
+		}
+		if action == "stop" || action == "restart" {
+			return action + "s every interface, including " + iface
+		}
+	case name == "uci":
+		return e.uciControlHit(args, iface)
+	}
+	return ""
+}
+
+// uciControlHit checks `uci <op> <key>[=<value>]` for changes to the
+// control interface or its firewall zones.
+func (e *Engine) uciControlHit(args []string, iface string) string {
+	cp := e.control
+	i := 0
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		i++
+	}
+	if i+1 >= len(args) {
+		return ""
+	}
+	op := args[i]
+	key, value, _ := strings.Cut(args[i+1], "=")
+	value = strings.Trim(value, `'"`)
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	option := ""
+	if len(parts) == 3 {
+		option = parts[2]
+	}
+	switch op {
+	case "set", "delete", "rename", "add_list", "del_list":
+	default:
+		return ""
+	}
+
+	if parts[0] == "network" && parts[1] == cp.Interface {
+		if option == "" {
+			return "changes " + iface
+		}
+		return fmt.Sprintf("changes option %s of %s; applying it restarts the interface", option, iface)
+	}
+	if parts[0] != "firewall" {
+		return ""
+	}
+	for j, section := range cp.ZoneSections {
+		if parts[1] != section {
+			continue
+		}
+		zone := fmt.Sprintf("firewall zone %q of %s", cp.Zones[j], iface)
+		switch {
+		case option == "" && op == "delete":
+			return "deletes " + zone
+		case option == "network" && (op == "delete" || op == "del_list" && value == cp.Interface || op == "set" && !contains(strings.Fields(value), cp.Interface)):
+			return "removes the interface from " + zone
+		case option == "input" && op == "set" && (value == "REJECT" || value == "DROP"):
+			return fmt.Sprintf("sets %s to %s incoming connections", zone, value)
+		}
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+var lanPath = &openwrt.ControlPath{
+	Client:       "192.168.8.100",
+	Interface:    "lan",
+	Device:       "br-lan",
+	Zones:        []string{"lan"},
+	ZoneSections: []string{"@zone[0]"},
+}
+
+func TestControlGuard_Confirm(t *testing.T) {
+	e := New(config.Config{ControlGuard: "confirm"}).WithControl(lanPath)
+	hits := [][]string{
+		{"ifdown", "lan"},
+		{"ubus", "call", "network.interface.lan", "down"},
+		{"ubus", "call", "network.interface", "down", `{"interface": "lan"}`},
+		{"ip", "link", "set", "dev", "br-lan", "down"},
+		{"ifconfig", "br-lan", "down"},
+		{"/etc/init.d/network", "restart"},
+		{"service", "network", "stop"},
+		{plan.ServiceRestart, "network"},
+		{"uci", "set", "network.lan.ipaddr=10.0.0.1"},
+		{"uci", "delete", "network.lan"},
+		{"uci", "delete", "firewall.@zone[0]"},
+		{"uci", "del_list", "firewall.@zone[0].network=lan"},
+		{"uci", "set", "firewall.@zone[0].network=lan6"},
+		{"uci", "set", "firewall.@zone[0].input=REJECT"},
+	}
+	for _, argv := range hits {
+		p := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}}, {Command: argv}}}
+		if err := e.ValidatePlan(p); err != nil {
+			t.Errorf("%v: unexpected error %v", argv, err)
+		}
+		p.PolicyWarnings = e.Warnings(p)
+		w := ControlWarning(p)
+		if w == nil || w.Command != 1 || !strings.Contains(w.Message, `interface "lan"`) {
+			t.Errorf("%v: unexpected warnings %+v", argv, p.PolicyWarnings)
+		}
+	}
+
+	misses := [][]string{
+		{"ifdown", "wan"},
+		{"ip", "link", "set", "eth0", "down"},
+		{"/etc/init.d/network", "reload"},
+		{plan.ServiceReload, "network"},
+		{"uci", "set", "network.wan.proto=dhcp"},
+		{"uci", "set", "firewall.@zone[0].network=lan lan6"},
+		{"uci", "set", "firewall.@zone[1].input=REJECT"},
+		{"uci", "show", "network.lan"},
+	}
+	for _, argv := range misses {
+		p := plan.Plan{Commands: []plan.PlannedCommand{{Command: argv}}}
+		if ws := e.Warnings(p); len(ws) != 0 {
+			t.Errorf("%v: unexpected warnings %+v", argv, ws)
+		}
+	}
+}
+
+func TestControlGuard_Block(t *testing.T) {
+	e := New(config.Config{ControlGuard: "block"}).WithControl(lanPath)
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"logread"}, Pipe: [][]string{{"ifdown", "lan"}}}}}
+	err := e.ValidatePlan(p)
+	d, ok := AsDenial(err)
+	if !ok || d.Rule != ControlRule || d.Stage != 1 || !strings.Contains(d.Explain(), "Why: it takes down interface \"lan\", which carries this session from 192.168.8.100") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if ws := e.Warnings(p); len(ws) != 0 {
+		t.Errorf("blocked commands should not warn, got %+v", ws)
+	}
+
+	// Without a known session, or with the guard off, nothing is guarded
+	for _, e := range []*Engine{New(config.Config{ControlGuard: "block"}).WithControl(nil), New(config.Config{ControlGuard: "off"}).WithControl(lanPath)} {
+		if err := e.ValidatePlan(p); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+}
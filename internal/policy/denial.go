@@ -0,0 +1,116 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Denial is the error of a command blocked by a denylist pattern or a deny
+// rule. Its message is the short form logged and compared by the audit;
+// Explain gives the details shown to the user.
+type Denial struct {
+	Command     int      // Index of the command in the plan
+	Stage       int      // Pipeline stage, 0 for the command itself
+	Argv        []string // The blocked argv
+	Pattern     string   // Denylist pattern, if the denylist blocked it
+	Rule        string   // Source of the deny rule, if a rule blocked it
+	Description string   // Why the pattern or rule exists, if it says
+	Layer       string   // System policy file of the pattern or rule; "" for the configuration
+	name        string
+}
+
+func (d *Denial) Error() string {
+	from := ""
+	if d.Layer != "" {
+		from = " (system policy " + d.Layer + ")"
+	}
+	if d.Rule != "" {
+		return fmt.Sprintf("%s denied by policy rule %q%s", d.name, d.Rule, from)
+	}
+	return fmt.Sprintf("%s denied by policy%s", d.name, from)
+}
+
+// Explain describes the denial: the offending command, the pattern or rule
+// it matched, if the configuration says why that is dangerous and, for a
+// system policy, which file set it.
+func (d *Denial) Explain() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Blocked command: %s\n", quoteArgv(d.Argv))
+	if d.Rule != "" {
+		fmt.Fprintf(&b, "Matched policy rule: %s\n", d.Rule)
+	} else {
+		fmt.Fprintf(&b, "Matched denylist pattern: %s\n", d.Pattern)
+	}
+	if d.Description != "" {
+		fmt.Fprintf(&b, "Why: %s\n", d.Description)
+	}
+	if d.Layer != "" {
+		fmt.Fprintf(&b, "Set by the system policy %s, which the configuration cannot loosen\n", d.Layer)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// AsDenial returns the Denial err wraps, if any.
+func AsDenial(err error) (*Denial, bool) {
+	var d *Denial
+	ok := errors.As(err, &d)
+	return d, ok
+}
+
+// Explain returns the message of err followed, for a denial, by its
+// details.
+func Explain(err error) string {
+	if d, ok := AsDenial(err); ok {
+		return err.Error() + "\n" + d.Explain()
+	}
+	return err.Error()
+}
+
+func quoteArgv(argv []string) string {
+	parts := make([]string, len(argv))
+	for i, a := range argv {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"\\") {
+			a = strconv.Quote(a)
+		}
+		parts[i] = a
+	}
+	return strings.Join(parts, " ")
+}
+
+// Generator produces plans from prompts, as llm.Provider does.
+type Generator interface {
+	GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error)
+}
+
+// Alternative asks gen for another plan after ValidatePlan rejected one with
+// the error rejected; prompt is the original prompt followed by
+// prompts.AlternativeBlock of Explain(rejected). An alternative over limit
+// commands (if > 0) is refused rather than cut short (see LimitError); it is
+// checked like any plan and marked with AlternativeTo, so that callers show
+// it as such and ask before running it.
+func (e *Engine) Alternative(ctx context.Context, gen Generator, prompt string, rejected error, limit int) (plan.Plan, error) {
+	alt, err := gen.GeneratePlan(ctx, prompt)
+	if err != nil {
+		return alt, fmt.Errorf("no alternative: %w", err)
+	}
+	if len(alt.Commands) == 0 {
+		return alt, errcode.Errorf(errcode.PolicyDeny, "no alternative: %s", alt.Summary)
+	}
+	if limit > 0 && len(alt.Commands) > limit {
+		return alt, fmt.Errorf("no alternative: %w", &LimitError{Commands: len(alt.Commands), Limit: limit})
+	}
+	alt = e.CheckTools(alt)
+	if err := e.ValidatePlan(alt); err != nil {
+		return alt, errcode.Wrap(errcode.PolicyDeny, fmt.Errorf("the alternative was rejected too: %w", err))
+	}
+	alt.AlternativeTo = Explain(rejected)
+	alt.PolicyWarnings = e.Warnings(alt)
+	alt.Lint = LintPlan(alt)
+	return alt, nil
+}
@@ -0,0 +1,102 @@
+package policy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestDenial_Explain(t *testing.T) {
+	e := New(config.Config{
+		Denylist:    []string{`^rm -rf /( |$) # wipes the root filesystem`, `^reboot`},
+		Warnlist:    []string{`^wifi # drops wireless clients`},
+		PolicyRules: []string{`deny opkg remove ** /^luci/ ** # removing LuCI locks you out of the web interface`},
+	})
+
+	err := e.ValidatePlan(plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"uci", "show"}},
+		{Command: []string{"logread"}, Pipe: [][]string{{"rm", "-rf", "/"}}},
+	}})
+	d, ok := AsDenial(err)
+	if !ok {
+		t.Fatalf("expected a denial, got %v", err)
+	}
+	if errcode.Of(err) != errcode.PolicyDeny || err.Error() != "command 1 stage 1 denied by policy" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if d.Command != 1 || d.Stage != 1 || d.Pattern != `^rm -rf /( |$)` {
+		t.Errorf("unexpected denial %+v", d)
+	}
+	want := "Blocked command: rm -rf /\nMatched denylist pattern: ^rm -rf /( |$)\nWhy: wipes the root filesystem"
+	if d.Explain() != want {
+		t.Errorf("Explain() = %q, want %q", d.Explain(), want)
+	}
+
+	err = e.ValidateCommand(0, plan.PlannedCommand{Command: []string{"opkg", "remove", "luci-base"}})
+	explained := Explain(err)
+	for _, s := range []string{`denied by policy rule "deny opkg remove ** /^luci/ **"`, "Blocked command: opkg remove luci-base", "Why: removing LuCI locks you out"} {
+		if !strings.Contains(explained, s) {
+			t.Errorf("expected %q in %q", s, explained)
+		}
+	}
+
+	// Entries without a description only name the pattern
+	err = e.ValidateCommand(0, plan.PlannedCommand{Command: []string{"reboot"}})
+	if got := Explain(err); strings.Contains(got, "Why:") || !strings.Contains(got, "Matched denylist pattern: ^reboot") {
+		t.Errorf("unexpected explanation %q", got)
+	}
+
+	w := e.Warnings(plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}})
+	if len(w) != 1 || w[0].Rule != "^wifi" || !strings.HasSuffix(w[0].Message, ": drops wireless clients") {
+		t.Errorf("unexpected warnings %+v", w)
+	}
+}
+
+type fakeGenerator struct {
+	plan   plan.Plan
+	prompt string
+}
+
+func (f *fakeGenerator) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	f.prompt = prompt
+	return f.plan, nil
+}
+
+func TestEngine_Alternative(t *testing.T) {
+	e := New(config.Config{Denylist: []string{`^reboot # interrupts everyone`}})
+	rejected := e.ValidatePlan(plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"reboot"}}}})
+
+	gen := &fakeGenerator{plan: plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"/etc/init.d/network", "restart"}},
+		{Command: []string{"logread"}},
+	}}}
+	alt, err := e.Alternative(context.Background(), gen, "User request: fix the network\n"+Explain(rejected), rejected, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(gen.prompt, "User request: fix the network") || !strings.Contains(gen.prompt, "Why: interrupts everyone") {
+		t.Errorf("unexpected prompt %q", gen.prompt)
+	}
+	if len(alt.Commands) != 2 || !strings.Contains(alt.AlternativeTo, "Blocked command: reboot") {
+		t.Errorf("unexpected alternative %+v", alt)
+	}
+
+	// An alternative over the limit is not cut short
+	if _, err := e.Alternative(context.Background(), gen, "p", rejected, 1); errcode.Of(err) != errcode.PlanTooLarge {
+		t.Errorf("expected PLAN_TOO_LARGE, got %v", err)
+	}
+
+	// An alternative is checked like any plan
+	gen.plan = plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"reboot", "-f"}}}}
+	if _, err := e.Alternative(context.Background(), gen, "p", rejected, 0); err == nil || !strings.Contains(err.Error(), "rejected too") {
+		t.Errorf("expected the alternative to be rejected, got %v", err)
+	}
+	gen.plan = plan.Plan{Summary: "There is no safe way"}
+	if _, err := e.Alternative(context.Background(), gen, "p", rejected, 0); err == nil || !strings.Contains(err.Error(), "There is no safe way") {
+		t.Errorf("expected no alternative, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package policy
+
+import (
+	"fmt"
+
+	"github.com/aezizhu/LuciCodex/internal/files"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// checkFile checks a built-in file command (see plan.FileRead): one path
+// within file_paths, run in the foreground without pipes, and for writes
+// content within file_max_bytes. Deny and allow patterns and rules still
+// apply to its argv afterwards.
+func (e *Engine) checkFile(i int, c plan.PlannedCommand) error {
+	op, path, _ := c.FileOp()
+	if len(c.Command) != 2 {
+		return fmt.Errorf("command %d: %s takes exactly one path", i, op)
+	}
+	if len(c.Pipe) > 0 || c.Background {
+		return fmt.Errorf("command %d: %s cannot be piped or run in the background", i, op)
+	}
+	if op == plan.FileRead && c.Content != "" {
+		return fmt.Errorf("command %d: content is only valid for %s", i, plan.FileWrite)
+	}
+	if op == plan.FileWrite && len(c.Content) > e.cfg.FileMaxBytes {
+		return fmt.Errorf("command %d: content of %d bytes exceeds file_max_bytes (%d)", i, len(c.Content), e.cfg.FileMaxBytes)
+	}
+	if _, err := files.Check(path, e.cfg.FilePaths); err != nil {
+		return fmt.Errorf("command %d: %w", i, err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package policy
+
+import (
+	"fmt"
+
+	"github.com/aezizhu/LuciCodex/internal/firewall"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// FirewallRule names the firewall conflict check in warnings and denials.
+const FirewallRule = "firewall-conflict"
+
+// WithFirewall returns an engine that checks the port forwards and rules a
+// plan adds against rules, the redirect and rule sections configured (see
+// firewall.Load): sections that duplicate an existing one, or are shadowed
+// by one, that the plan does not change or delete are denied according to
+// firewall_guard, or with "confirm" become warnings. A nil rules, or
+// firewall_guard "off", returns e unchanged.
+func (e *Engine) WithFirewall(rules []firewall.Rule) *Engine {
+	if rules == nil || e.cfg.FirewallGuard == "off" {
+		return e
+	}
+	guarded := *e
+	guarded.firewall = rules
+	return &guarded
+}
+
+// blocksFirewall reports whether firewall conflicts are denied rather than
+// flagged.
+func (e *Engine) blocksFirewall() bool {
+	return e.firewall != nil && e.cfg.FirewallGuard != "confirm"
+}
+
+// firewallConflict returns the denial of the first firewall conflict of p,
+// if they are denied.
+func (e *Engine) firewallConflict(p plan.Plan) error {
+	if !e.blocksFirewall() {
+		return nil
+	}
+	for _, f := range firewall.CheckPlan(p.Commands, e.firewall) {
+		return &Denial{
+			Command:     f.Command,
+			Argv:        p.Commands[f.Command].Command,
+			Rule:        FirewallRule,
+			Description: "it " + f.Message(),
+			name:        fmt.Sprintf("command %d", f.Command),
+		}
+	}
+	return nil
+}
+
+// firewallWarnings returns the firewall conflicts of p as warnings, if they
+// are not denied.
+func (e *Engine) firewallWarnings(p plan.Plan) []plan.PolicyWarning {
+	if e.firewall == nil || e.blocksFirewall() {
+		return nil
+	}
+	var out []plan.PolicyWarning
+	for _, f := range firewall.CheckPlan(p.Commands, e.firewall) {
+		out = append(out, plan.PolicyWarning{
+			Command: f.Command,
+			Rule:    FirewallRule,
+			Message: fmt.Sprintf("command %d %s", f.Command, f.Message()),
+		})
+	}
+	return out
+}
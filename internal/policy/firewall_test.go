@@ -0,0 +1,63 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/firewall"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+var httpsForward = firewall.Parse(`firewall.@zone[0]=zone
+firewall.@redirect[0]=redirect
+firewall.@redirect[0].name='https'
+firewall.@redirect[0].src='wan'
+firewall.@redirect[0].src_dport='443'
+firewall.@redirect[0].dest_ip='192.168.1.5'
+`)
+
+func TestFirewallGuard(t *testing.T) {
+	add := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"uci", "add", "firewall", "redirect"}},
+		{Command: []string{"uci", "set", "firewall.@redirect[-1].src=wan"}},
+		{Command: []string{"uci", "set", "firewall.@redirect[-1].src_dport=443"}},
+		{Command: []string{"uci", "set", "firewall.@redirect[-1].dest_ip=192.168.1.10"}},
+		{Command: []string{"uci", "commit", "firewall"}},
+	}}
+	edit := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"uci", "set", "firewall.@redirect[0].dest_ip=192.168.1.10"}},
+		{Command: []string{"uci", "commit", "firewall"}},
+	}}
+
+	e := New(config.Config{FirewallGuard: "block"}).WithFirewall(httpsForward)
+	var d *Denial
+	err := e.ValidatePlan(add)
+	if !errors.As(err, &d) || d.Rule != FirewallRule || d.Command != 0 || !strings.Contains(d.Explain(), `shadowed by firewall.@redirect[0] ("https")`) {
+		t.Fatalf("expected a %s denial of command 0, got %v", FirewallRule, err)
+	}
+	if err := e.ValidatePlan(edit); err != nil {
+		t.Errorf("changing the existing forward must pass: %v", err)
+	}
+	if w := e.Warnings(add); len(w) != 0 {
+		t.Errorf("blocked plans must not warn too: %+v", w)
+	}
+
+	e = New(config.Config{FirewallGuard: "confirm"}).WithFirewall(httpsForward)
+	if err := e.ValidatePlan(add); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if w := e.Warnings(add); len(w) != 1 || w[0].Rule != FirewallRule || !strings.HasPrefix(w[0].Message, "command 0 adds a firewall redirect") {
+		t.Errorf("unexpected warnings %+v", w)
+	}
+
+	for _, e := range []*Engine{
+		New(config.Config{FirewallGuard: "off"}).WithFirewall(httpsForward),
+		New(config.Config{FirewallGuard: "block"}).WithFirewall(nil),
+	} {
+		if err := e.ValidatePlan(add); err != nil || len(e.Warnings(add)) != 0 {
+			t.Errorf("expected no check, got %v", err)
+		}
+	}
+}
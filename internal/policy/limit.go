@@ -0,0 +1,120 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// LimitError is the error of a plan with more commands than its limit (see
+// llm.FitLimit and Truncate). Severed is set when cutting the plan down to
+// the limit would drop a command that commits or applies changes of the
+// commands kept.
+type LimitError struct {
+	Commands int  // Commands in the plan
+	Limit    int  // Commands allowed
+	Retried  bool // The model was asked again for a plan within the limit
+	Severed  *int // Index of the commit or reload truncation would drop
+}
+
+func (e *LimitError) Error() string {
+	msg := fmt.Sprintf("the plan has %d commands, more than the limit of %d", e.Commands, e.Limit)
+	if e.Retried {
+		msg += ", even when the model was asked again"
+	}
+	if e.Severed != nil {
+		msg += fmt.Sprintf("; cutting it short would drop command %d, which commits or applies the changes before it", *e.Severed)
+	}
+	return msg
+}
+
+func (e *LimitError) ErrorCode() errcode.Code { return errcode.PlanTooLarge }
+
+// Truncate cuts p down to limit commands (no limit if limit <= 0) for
+// callers that accept a partial plan, such as watch probes. It refuses with
+// a *LimitError when a dropped command commits or applies changes made by
+// the commands kept, since the kept changes would then be left uncommitted
+// or unapplied.
+func Truncate(p plan.Plan, limit int) (plan.Plan, error) {
+	if limit <= 0 || len(p.Commands) <= limit {
+		return p, nil
+	}
+	if changes(p.Commands[:limit]) {
+		for i := limit; i < len(p.Commands); i++ {
+			if finalizes(p.Commands[i]) {
+				return p, &LimitError{Commands: len(p.Commands), Limit: limit, Severed: &i}
+			}
+		}
+	}
+	p.Commands = p.Commands[:limit]
+	return p, nil
+}
+
+// changes reports whether any of cmds changes a UCI config or writes a
+// file under /etc/config.
+func changes(cmds []plan.PlannedCommand) bool {
+	for _, c := range cmds {
+		if op, file, ok := c.FileOp(); ok {
+			if op == plan.FileWrite && path.Dir(file) == "/etc/config" {
+				return true
+			}
+			continue
+		}
+		for _, argv := range c.Stages() {
+			if len(argv) > 1 && path.Base(argv[0]) == "uci" {
+				switch uciOp(argv[1:]) {
+				case "set", "add", "add_list", "del_list", "delete", "rename", "reorder", "batch", "import":
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// finalizes reports whether c commits UCI changes or reloads, restarts or
+// starts a service so they take effect.
+func finalizes(c plan.PlannedCommand) bool {
+	for _, argv := range c.Stages() {
+		if len(argv) == 0 {
+			continue
+		}
+		argv = plan.InitArgv(argv)
+		switch name := path.Base(argv[0]); {
+		case name == "uci":
+			if uciOp(argv[1:]) == "commit" {
+				return true
+			}
+		case name == "wifi":
+			return len(argv) == 1 || argv[1] == "reload" || argv[1] == "up"
+		case name == "reload_config":
+			return true
+		case name == "service" && len(argv) > 2:
+			return applies(argv[2])
+		case path.Dir(argv[0]) == "/etc/init.d" && len(argv) > 1:
+			return applies(argv[1])
+		}
+	}
+	return false
+}
+
+// applies reports whether an init script action applies configuration.
+func applies(action string) bool {
+	return action == "reload" || action == "restart" || action == "start"
+}
+
+// uciOp returns the operation of uci arguments, after their flags.
+func uciOp(args []string) string {
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		if args[0] == "-c" || args[0] == "-d" || args[0] == "-p" || args[0] == "-P" {
+			args = args[1:] // Takes a value
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
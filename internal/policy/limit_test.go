@@ -0,0 +1,49 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func commands(argvs ...string) []plan.PlannedCommand {
+	var out []plan.PlannedCommand
+	for _, a := range argvs {
+		out = append(out, plan.PlannedCommand{Command: strings.Fields(a)})
+	}
+	return out
+}
+
+func TestTruncate(t *testing.T) {
+	reads := plan.Plan{Commands: commands("logread", "ip addr", "ubus call system board")}
+	p, err := Truncate(reads, 2)
+	if err != nil || len(p.Commands) != 2 {
+		t.Fatalf("read-only commands may be dropped, got %+v, %v", p, err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cmds    []plan.PlannedCommand
+		severed int
+	}{
+		{"commit", commands("uci set network.lan.ipaddr=10.0.0.1", "logread", "uci commit network"), 2},
+		{"reload", commands("uci -q set dhcp.lan.start=50", "uci commit dhcp", "/etc/init.d/dnsmasq restart"), 2},
+		{"service", commands("uci delete firewall.@rule[3]", "uci commit", "service.reload firewall"), 2},
+		{"wifi", commands("uci set wireless.radio0.channel=6", "uci commit wireless", "wifi"), 2},
+		{"file", append([]plan.PlannedCommand{{Command: []string{plan.FileWrite, "/etc/config/system"}, Content: "x"}, {Command: []string{"logread"}}}, commands("reload_config")...), 2},
+	} {
+		_, err := Truncate(plan.Plan{Commands: tc.cmds}, 2)
+		var le *LimitError
+		if !errors.As(err, &le) || le.Severed == nil || *le.Severed != tc.severed {
+			t.Errorf("%s: expected command %d to be severed, got %v", tc.name, tc.severed, err)
+		}
+	}
+
+	// A commit is only needed by changes that are kept
+	p, err = Truncate(plan.Plan{Commands: commands("uci show network", "logread", "uci commit network")}, 2)
+	if err != nil || len(p.Commands) != 2 {
+		t.Errorf("expected the plan to be cut, got %+v, %v", p, err)
+	}
+}
@@ -0,0 +1,259 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/cmdref"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// serviceConfigs maps init scripts to the UCI config they read, so a reload
+// can be matched to the changes it applies.
+var serviceConfigs = map[string]string{
+	"network":  "network",
+	"firewall": "firewall",
+	"dnsmasq":  "dhcp",
+	"odhcpd":   "dhcp",
+	"uhttpd":   "uhttpd",
+	"dropbear": "dropbear",
+	"system":   "system",
+	"sysntpd":  "system",
+	"wifi":     "wireless", // `wifi reload`
+}
+
+// severityRank orders the lint severities for lint_block.
+var severityRank = map[string]int{plan.LintInfo: 1, plan.LintWarning: 2, plan.LintError: 3}
+
+// linter follows the UCI changes of a plan command by command.
+type linter struct {
+	findings []plan.LintFinding
+	changed  map[string]int // Config -> last command changing it; "*" for uci batch/import
+	edited   map[string]int // config.section -> last command setting one of its options
+	deleted  map[string]int // config.section -> command deleting it
+	wanZones map[string]bool
+}
+
+// LintPlan checks the commands of p for likely mistakes the policy rules cannot
+// see, because they depend on the order of the commands or on what a UCI
+// value means: commits and service reloads without a preceding change,
+// changes never committed, quotes that make it into a value literally,
+// edits of a section the plan deletes, opening the wan zone to incoming
+// connections, and subcommands and flags the command reference (see
+// cmdref) says a tool does not accept. Callers attach the findings to the plan; with lint_block,
+// ValidatePlan denies plans with severe ones.
+func LintPlan(p plan.Plan) []plan.LintFinding {
+	l := &linter{
+		changed:  map[string]int{},
+		edited:   map[string]int{},
+		deleted:  map[string]int{},
+		wanZones: map[string]bool{"wan": true, "@zone[1]": true},
+	}
+	committed := map[string]int{} // Config -> last command committing it
+	for i, c := range p.Commands {
+		if op, file, ok := c.FileOp(); ok {
+			if op == plan.FileWrite && path.Dir(file) == "/etc/config" {
+				l.changed[path.Base(file)] = i
+				committed[path.Base(file)] = i // Written directly
+			}
+			continue
+		}
+		for _, argv := range c.Stages() {
+			if len(argv) == 0 {
+				continue
+			}
+			argv = plan.InitArgv(argv)
+			l.reference(i, argv)
+			switch name := path.Base(argv[0]); {
+			case name == "uci":
+				for _, config := range l.uci(i, argv[1:]) {
+					committed[config] = i
+				}
+			case name == "wifi" && len(argv) > 1 && (argv[1] == "reload" || argv[1] == "up"):
+				l.reload(i, "wifi")
+			case name == "service" && len(argv) > 2:
+				l.service(i, argv[1], argv[2])
+			case strings.HasPrefix(argv[0], "/etc/init.d/") && len(argv) > 1:
+				l.service(i, name, argv[1])
+			}
+		}
+	}
+
+	var pending []string
+	for config, i := range l.changed {
+		c, ok := committed[config]
+		all, okAll := committed["*"]
+		if config != "*" && (!ok || c < i) && (!okAll || all < i) {
+			pending = append(pending, config)
+		}
+	}
+	sort.Strings(pending)
+	for _, config := range pending {
+		i := l.changed[config]
+		l.add(i, "uncommitted", plan.LintInfo, "changes %s, but no later command commits it; the change is lost on reboot and not applied by reloads", config)
+	}
+	sort.SliceStable(l.findings, func(a, b int) bool { return l.findings[a].Command < l.findings[b].Command })
+	return l.findings
+}
+
+// lintBlock returns the first finding severe enough to deny the plan under
+// lint_block, if any.
+func (e *Engine) lintBlock(findings []plan.LintFinding) *plan.LintFinding {
+	min := severityRank[e.cfg.LintBlock]
+	if min == 0 {
+		return nil
+	}
+	for i, f := range findings {
+		if severityRank[f.Severity] >= min {
+			return &findings[i]
+		}
+	}
+	return nil
+}
+
+func (l *linter) add(i int, rule, severity, format string, args ...interface{}) {
+	l.findings = append(l.findings, plan.LintFinding{
+		Command:  i,
+		Rule:     rule,
+		Severity: severity,
+		Message:  fmt.Sprintf("command %d ", i) + fmt.Sprintf(format, args...),
+	})
+}
+
+// uci checks `uci <op> ...` and returns the configs it commits.
+func (l *linter) uci(i int, args []string) []string {
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		if args[0] == "-c" || args[0] == "-d" || args[0] == "-p" || args[0] == "-P" {
+			args = args[1:] // Takes a value
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	op, args := args[0], args[1:]
+	switch op {
+	case "commit":
+		if len(args) == 0 {
+			if len(l.changed) == 0 {
+				l.add(i, "commit-unchanged", plan.LintInfo, "commits, but no earlier command changes a config")
+			}
+			return []string{"*"}
+		}
+		for _, config := range args {
+			if _, ok := l.changed[config]; !ok && !l.batched() {
+				l.add(i, "commit-unchanged", plan.LintInfo, "commits %s, but no earlier command changes it", config)
+			}
+		}
+		return args
+	case "batch", "import":
+		l.changed["*"] = i
+		return nil
+	case "add":
+		if len(args) > 0 {
+			l.changed[args[0]] = i
+		}
+		return nil
+	case "set", "add_list", "del_list", "delete", "rename", "reorder":
+	default:
+		return nil
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	key, value, hasValue := strings.Cut(args[0], "=")
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) < 2 {
+		return nil
+	}
+	config, section := parts[0], parts[0]+"."+parts[1]
+	l.changed[config] = i
+
+	if hasValue && (op == "set" || op == "add_list") {
+		for _, q := range []string{"'", `"`} {
+			if strings.Count(value, q)%2 == 1 {
+				l.add(i, "unbalanced-quote", plan.LintError, "sets %s to %s, which has an unbalanced %s quote; commands run without a shell, so quotes end up in the value", key, value, q)
+				break
+			}
+		}
+	}
+
+	if len(parts) == 2 {
+		switch {
+		case op == "delete":
+			if j, ok := l.edited[section]; ok {
+				l.add(i, "delete-edited", plan.LintError, "deletes section %s, discarding the changes command %d makes to it", section, j)
+			}
+			l.deleted[section] = i
+			delete(l.edited, section)
+		case op == "set":
+			// Recreates the section, as in `uci delete x.y; uci set x.y=type`
+			delete(l.deleted, section)
+		}
+		return nil
+	}
+
+	option := parts[2]
+	if j, ok := l.deleted[section]; ok {
+		l.add(i, "delete-edited", plan.LintError, "changes section %s, which command %d deletes; recreate it with `uci set %s=<type>` first", section, j, section)
+	}
+	l.edited[section] = i
+	if config == "firewall" && op == "set" {
+		v := strings.Trim(value, `'"`)
+		switch {
+		case option == "name" && v == "wan":
+			l.wanZones[parts[1]] = true
+		case option == "input" && strings.EqualFold(v, "ACCEPT") && l.wanZones[parts[1]]:
+			l.add(i, "wan-input-accept", plan.LintError, "sets the wan zone's input to ACCEPT, which exposes every service of the router to the internet; open single ports with a rule instead")
+		}
+	}
+	return nil
+}
+
+// reference checks argv against the command reference.
+func (l *linter) reference(i int, argv []string) {
+	tool := path.Base(argv[0])
+	for _, p := range cmdref.Check(argv) {
+		if p.Subcommand {
+			l.add(i, "unknown-subcommand", plan.LintWarning, "runs %s %s, but %s has no %s subcommand; it has %s", tool, p.Arg, tool, p.Arg, strings.Join(cmdref.Lookup(tool).Subcommands, ", "))
+		} else {
+			l.add(i, "unknown-flag", plan.LintWarning, "passes %s to %s, which does not accept it", p.Arg, tool)
+		}
+	}
+}
+
+// service checks an init script action.
+func (l *linter) service(i int, name, action string) {
+	if action == "reload" || action == "restart" {
+		l.reload(i, name)
+	}
+}
+
+// reload flags reloading a service whose config the plan does not change,
+// when it does change others: the reload then most likely targets the
+// wrong service.
+func (l *linter) reload(i int, service string) {
+	config, ok := serviceConfigs[service]
+	if !ok || len(l.changed) == 0 || l.batched() {
+		return
+	}
+	if _, ok := l.changed[config]; ok {
+		return
+	}
+	var changed []string
+	for c := range l.changed {
+		changed = append(changed, c)
+	}
+	sort.Strings(changed)
+	l.add(i, "reload-unchanged", plan.LintWarning, "reloads %s, but the plan changes %s, not %s", service, strings.Join(changed, ", "), config)
+}
+
+// batched reports whether an earlier uci batch or import may have changed
+// any config.
+func (l *linter) batched() bool {
+	_, ok := l.changed["*"]
+	return ok
+}
@@ -0,0 +1,123 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func planOf(argvs ...[]string) plan.Plan {
+	var p plan.Plan
+	for _, argv := range argvs {
+		p.Commands = append(p.Commands, plan.PlannedCommand{Command: argv})
+	}
+	return p
+}
+
+func TestLintPlan(t *testing.T) {
+	cases := []struct {
+		name  string
+		p     plan.Plan
+		rules []string // Expected rule of each finding
+	}{
+		{"clean", planOf(
+			[]string{"uci", "set", "network.lan.ipaddr=192.168.2.1"},
+			[]string{"uci", "commit", "network"},
+			[]string{"/etc/init.d/network", "reload"},
+		), nil},
+		{"recreated section", planOf(
+			[]string{"uci", "-q", "delete", "network.guest"},
+			[]string{"uci", "set", "network.guest=interface"},
+			[]string{"uci", "set", "network.guest.proto=static"},
+			[]string{"uci", "commit"},
+		), nil},
+		{"read only", planOf([]string{"uci", "show", "network"}, []string{"service", "network", "restart"}), nil},
+		{"commit unchanged", planOf([]string{"uci", "commit", "firewall"}), []string{"commit-unchanged"}},
+		{"uncommitted", planOf([]string{"uci", "set", "system.@system[0].hostname=gw"}), []string{"uncommitted"}},
+		{"commit before change", planOf(
+			[]string{"uci", "commit"},
+			[]string{"uci", "set", "system.@system[0].hostname=gw"},
+		), []string{"commit-unchanged", "uncommitted"}},
+		{"reload unchanged", planOf(
+			[]string{"uci", "set", "dhcp.lan.limit=50"},
+			[]string{"uci", "commit", "dhcp"},
+			[]string{"/etc/init.d/network", "restart"},
+		), []string{"reload-unchanged"}},
+		{"unbalanced quote", planOf(
+			[]string{"uci", "set", "system.@system[0].hostname='gw"},
+			[]string{"uci", "commit", "system"},
+		), []string{"unbalanced-quote"}},
+		{"delete edited", planOf(
+			[]string{"uci", "set", "network.guest.proto=static"},
+			[]string{"uci", "delete", "network.guest"},
+			[]string{"uci", "commit", "network"},
+		), []string{"delete-edited"}},
+		{"edit deleted", planOf(
+			[]string{"uci", "delete", "network.guest"},
+			[]string{"uci", "set", "network.guest.proto=static"},
+			[]string{"uci", "commit", "network"},
+		), []string{"delete-edited"}},
+		{"wan input", planOf(
+			[]string{"uci", "set", "firewall.@zone[1].input=ACCEPT"},
+			[]string{"uci", "commit", "firewall"},
+		), []string{"wan-input-accept"}},
+		{"named wan zone", planOf(
+			[]string{"uci", "set", "firewall.z2.name=wan"},
+			[]string{"uci", "set", "firewall.z2.input=accept"},
+			[]string{"uci", "commit", "firewall"},
+		), []string{"wan-input-accept"}},
+		{"lan input", planOf(
+			[]string{"uci", "set", "firewall.lan.input=ACCEPT"},
+			[]string{"uci", "commit", "firewall"},
+		), nil},
+		{"config file written", plan.Plan{Commands: []plan.PlannedCommand{
+			{Command: []string{plan.FileWrite, "/etc/config/dhcp"}, Content: "config dnsmasq\n"},
+			{Command: []string{"/etc/init.d/dnsmasq", "restart"}},
+		}}, nil},
+		{"unknown subcommand", planOf(
+			[]string{"uci", "set", "wireless.radio0.channel=6"},
+			[]string{"uci", "commit", "wireless"},
+			[]string{"wifi", "restart"},
+		), []string{"unknown-subcommand"}},
+		{"unknown flag", planOf([]string{"opkg", "update"}, []string{"opkg", "install", "-y", "tcpdump"}), []string{"unknown-flag"}},
+	}
+	for _, c := range cases {
+		findings := LintPlan(c.p)
+		var rules []string
+		for _, f := range findings {
+			rules = append(rules, f.Rule)
+		}
+		if strings.Join(rules, ",") != strings.Join(c.rules, ",") {
+			t.Errorf("%s: expected %v, got %+v", c.name, c.rules, findings)
+		}
+	}
+
+	// The command reference names the accepted subcommands
+	findings := LintPlan(planOf([]string{"fw4", "status"}))
+	if len(findings) != 1 || !strings.Contains(findings[0].Message, "fw4 has no status subcommand; it has start, stop") {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+}
+
+func TestLintBlock(t *testing.T) {
+	p := planOf(
+		[]string{"uci", "set", "firewall.wan.input=ACCEPT"},
+		[]string{"uci", "commit", "firewall"},
+	)
+	if err := New(config.Config{}).ValidatePlan(p); err != nil {
+		t.Fatalf("lint findings must not block by default: %v", err)
+	}
+	err := New(config.Config{LintBlock: "error"}).ValidatePlan(p)
+	d, ok := AsDenial(err)
+	if !ok || d.Rule != "lint:wan-input-accept" || d.Command != 0 || !strings.Contains(d.Explain(), "exposes every service") {
+		t.Fatalf("expected a lint denial, got %v", err)
+	}
+
+	// Info findings never block
+	uncommitted := planOf([]string{"uci", "set", "system.@system[0].hostname=gw"})
+	if err := New(config.Config{LintBlock: "warning"}).ValidatePlan(uncommitted); err != nil {
+		t.Errorf("unexpected denial: %v", err)
+	}
+}
@@ -6,75 +6,380 @@ import (
 	"strings"
 
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/firewall"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
 	"github.com/aezizhu/LuciCodex/internal/plan"
 )
 
 type Engine struct {
-	cfg      config.Config
+	cfg config.Config
+	// The policy options of cfg, and the system policy layers every command
+	// must pass as well
+	layer
+	system []layer
+	strict bool
+	// The session requesting the plan, if known (see WithControl)
+	control *openwrt.ControlPath
+	// The device's place in the network, if it is an access point (see WithTopology)
+	topology *openwrt.Topology
+	// The redirect and rule sections of the firewall (see WithFirewall)
+	firewall []firewall.Rule
+}
+
+// layer is the compiled policy of one source: the configuration or a system
+// policy file (see config.PolicyLayer).
+type layer struct {
+	origin   string // Path of the system policy file; "" for the configuration
 	allowREs []*regexp.Regexp
 	denyREs  []*regexp.Regexp
+	warnREs  []*regexp.Regexp
+	rules    []Rule
+	// Descriptions of the denylist and warnlist entries that have one
+	descriptions map[*regexp.Regexp]string
 }
 
 func New(cfg config.Config) *Engine {
-	e := &Engine{cfg: cfg}
+	e := &Engine{cfg: cfg, strict: cfg.StrictPrivileges}
+	e.layer = newLayer("", cfg.Allowlist, cfg.Denylist, cfg.Warnlist, cfg.PolicyRules)
+	for _, l := range cfg.SystemPolicy {
+		e.system = append(e.system, newLayer(l.Origin, l.Allowlist, l.Denylist, l.Warnlist, l.PolicyRules))
+		e.strict = e.strict || l.StrictPrivileges
+	}
+	return e
+}
+
+func newLayer(origin string, allowlist, denylist, warnlist, policyRules []string) layer {
+	l := layer{origin: origin, descriptions: map[*regexp.Regexp]string{}}
 	// Pre-allocate slices to avoid repeated allocations during append
-	if len(cfg.Allowlist) > 0 {
-		e.allowREs = make([]*regexp.Regexp, 0, len(cfg.Allowlist))
-		for _, p := range cfg.Allowlist {
+	if len(allowlist) > 0 {
+		l.allowREs = make([]*regexp.Regexp, 0, len(allowlist))
+		for _, entry := range allowlist {
+			p, _ := splitDescription(entry)
 			if re, err := regexp.Compile(p); err == nil {
-				e.allowREs = append(e.allowREs, re)
+				l.allowREs = append(l.allowREs, re)
 			}
 		}
 	}
-	if len(cfg.Denylist) > 0 {
-		e.denyREs = make([]*regexp.Regexp, 0, len(cfg.Denylist))
-		for _, p := range cfg.Denylist {
+	if len(denylist) > 0 {
+		l.denyREs = make([]*regexp.Regexp, 0, len(denylist))
+		for _, entry := range denylist {
+			p, description := splitDescription(entry)
 			if re, err := regexp.Compile(p); err == nil {
-				e.denyREs = append(e.denyREs, re)
+				l.denyREs = append(l.denyREs, re)
+				if description != "" {
+					l.descriptions[re] = description
+				}
 			}
 		}
 	}
-	return e
+	for _, entry := range warnlist {
+		p, description := splitDescription(entry)
+		if re, err := regexp.Compile(p); err == nil {
+			l.warnREs = append(l.warnREs, re)
+			if description != "" {
+				l.descriptions[re] = description
+			}
+		}
+	}
+	for _, src := range policyRules {
+		if r, err := ParseRule(src); err == nil {
+			l.rules = append(l.rules, r)
+		}
+	}
+	return l
+}
+
+// layers returns the system layers followed by that of the configuration.
+func (e *Engine) layers() []*layer {
+	out := make([]*layer, 0, len(e.system)+1)
+	for i := range e.system {
+		out = append(out, &e.system[i])
+	}
+	return append(out, &e.layer)
+}
+
+// from names the layer in messages: "" for the configuration, so that its
+// messages read as before there were layers.
+func (l *layer) from() string {
+	if l.origin == "" {
+		return ""
+	}
+	return " (system policy " + l.origin + ")"
 }
 
 func (e *Engine) ValidatePlan(p plan.Plan) error {
 	for i, c := range p.Commands {
-		if len(c.Command) == 0 {
-			return fmt.Errorf("command %d is empty", i)
+		if err := e.checkCommand(i, c); err != nil {
+			return errcode.Wrap(errcode.PolicyDeny, err)
+		}
+	}
+	for i, c := range p.Verify {
+		if err := e.checkVerify(i, c); err != nil {
+			return errcode.Wrap(errcode.PolicyDeny, err)
+		}
+	}
+	if err := e.firewallConflict(p); err != nil {
+		return errcode.Wrap(errcode.PolicyDeny, err)
+	}
+	if f := e.lintBlock(LintPlan(p)); f != nil {
+		return errcode.Wrap(errcode.PolicyDeny, &Denial{
+			Command:     f.Command,
+			Argv:        p.Commands[f.Command].Command,
+			Rule:        "lint:" + f.Rule,
+			Description: strings.TrimPrefix(f.Message, fmt.Sprintf("command %d ", f.Command)),
+			name:        fmt.Sprintf("command %d", f.Command),
+		})
+	}
+	if e.strict {
+		return errcode.Wrap(errcode.PolicyDeny, CheckPrivileges(p))
+	}
+	return nil
+}
+
+// ValidateCommand applies the same checks as ValidatePlan to a single command.
+// i is only used in error messages.
+func (e *Engine) ValidateCommand(i int, c plan.PlannedCommand) error {
+	if err := e.checkCommand(i, c); err != nil {
+		return errcode.Wrap(errcode.PolicyDeny, err)
+	}
+	if e.strict {
+		if a := AuditCommand(i, c); a.Conflict != "" {
+			return errcode.Errorf(errcode.PolicyDeny, "command %d privilege conflict: %s", i, a.Conflict)
+		}
+	}
+	return nil
+}
+
+// Warnings returns the warn-tier rules matched by p's commands, commands
+// moving a radio to a DFS channel and, unless they are blocked, commands
+// cutting off the control path (see WithControl), changing DHCP and the
+// firewall of an access point (see WithTopology) or adding firewall
+// sections that clash with existing ones (see WithFirewall). Unlike deny
+// rules they do not block the plan; callers attach them to the plan and
+// require acknowledgement before executing it (see RequireAck).
+func (e *Engine) Warnings(p plan.Plan) []plan.PolicyWarning {
+	var out []plan.PolicyWarning
+	for i, c := range p.Commands {
+		for _, l := range e.layers() {
+			out = append(out, l.warnings(i, c)...)
+		}
+		if w := dfsWarning(i, c); w != nil {
+			out = append(out, *w)
+		}
+		if !e.blocksControl() {
+			for _, argv := range c.Stages() {
+				if hit := e.controlHit(argv); hit != "" {
+					out = append(out, plan.PolicyWarning{
+						Command: i,
+						Rule:    ControlRule,
+						Message: fmt.Sprintf("command %d %s", i, hit),
+					})
+					break
+				}
+			}
 		}
-		// Basic argv checks
-		for j, a := range c.Command {
-			if strings.TrimSpace(a) == "" {
-				return fmt.Errorf("command %d arg %d is empty", i, j)
+		if !e.blocksAP() {
+			for _, argv := range c.Stages() {
+				if hit := e.apHit(argv); hit != "" {
+					out = append(out, plan.PolicyWarning{
+						Command: i,
+						Rule:    APRule,
+						Message: fmt.Sprintf("command %d %s", i, hit),
+					})
+					break
+				}
 			}
-			if strings.ContainsAny(a, "\x00") {
-				return fmt.Errorf("command %d arg %d contains NUL", i, j)
+		}
+	}
+	return append(out, e.firewallWarnings(p)...)
+}
+
+// warnings returns the warn rules and warnlist entries of l matched by
+// command i.
+func (l *layer) warnings(i int, c plan.PlannedCommand) []plan.PolicyWarning {
+	var out []plan.PolicyWarning
+	for _, r := range l.rules {
+		if r.Action != RuleWarn {
+			continue
+		}
+		for _, argv := range c.Stages() {
+			if r.Match(argv) {
+				out = append(out, plan.PolicyWarning{
+					Command: i,
+					Rule:    r.Source,
+					Message: warnMessage(i, r.Source, l.from(), r.Description),
+				})
+				break
 			}
 		}
-		if strings.ContainsAny(c.Command[0], "|&;<>`$") {
-			return fmt.Errorf("command %d contains shell metacharacters in argv[0]", i)
+	}
+	for _, re := range l.warnREs {
+		for _, argv := range c.Stages() {
+			if re.MatchString(strings.Join(argv, " ")) {
+				out = append(out, plan.PolicyWarning{
+					Command: i,
+					Rule:    re.String(),
+					Message: warnMessage(i, re.String(), l.from(), l.descriptions[re]),
+				})
+				break
+			}
 		}
+	}
+	return out
+}
 
-		cmdStr := strings.Join(c.Command, " ")
+func warnMessage(i int, rule, from, description string) string {
+	msg := fmt.Sprintf("command %d matches warn rule %q%s", i, rule, from)
+	if description != "" {
+		msg += ": " + description
+	}
+	return msg
+}
+
+// RequireAck refuses to run a plan with unacknowledged policy warnings. It is
+// used wherever nobody is prompted before execution.
+func RequireAck(p plan.Plan, acknowledged bool) error {
+	if len(p.PolicyWarnings) == 0 || acknowledged {
+		return nil
+	}
+	return errcode.Errorf(errcode.PolicyAck, "plan has %d policy warning(s) that must be acknowledged", len(p.PolicyWarnings))
+}
+
+func (e *Engine) checkCommand(i int, c plan.PlannedCommand) error {
+	if len(c.Pipe) > 0 && c.Background {
+		return fmt.Errorf("command %d: background pipelines are not supported", i)
+	}
+	if _, _, ok := c.FileOp(); ok {
+		if err := e.checkFile(i, c); err != nil {
+			return err
+		}
+	} else if _, _, ok := c.ServiceOp(); ok {
+		if err := e.checkService(i, c); err != nil {
+			return err
+		}
+	} else if c.Content != "" {
+		return fmt.Errorf("command %d: content is only valid for %s", i, plan.FileWrite)
+	}
+	// Every pipeline stage is a separate process and is checked on its own
+	for s, argv := range c.Stages() {
+		name := fmt.Sprintf("command %d", i)
+		if s > 0 {
+			name = fmt.Sprintf("command %d stage %d", i, s)
+		}
+		err := e.checkArgv(name, argv)
+		if err == nil && e.blocksControl() {
+			if hit := e.controlHit(argv); hit != "" {
+				err = &Denial{Argv: argv, Rule: ControlRule, Description: "it " + hit, name: name}
+			}
+		}
+		if err == nil && e.blocksAP() {
+			if hit := e.apHit(argv); hit != "" {
+				err = &Denial{Argv: argv, Rule: APRule, Description: "it " + hit, name: name}
+			}
+		}
+		if err != nil {
+			if d, ok := err.(*Denial); ok {
+				d.Command, d.Stage = i, s
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Engine) checkArgv(name string, argv []string) error {
+	if len(argv) == 0 {
+		return fmt.Errorf("%s is empty", name)
+	}
+	// Basic argv checks
+	for j, a := range argv {
+		if strings.TrimSpace(a) == "" {
+			return fmt.Errorf("%s arg %d is empty", name, j)
+		}
+		if strings.ContainsAny(a, "\x00") {
+			return fmt.Errorf("%s arg %d contains NUL", name, j)
+		}
+	}
+	if strings.ContainsAny(argv[0], "|&;<>`$") {
+		return fmt.Errorf("%s contains shell metacharacters in argv[0]", name)
+	}
 
-		for _, re := range e.denyREs {
+	// A command must pass every layer, so the configuration can only
+	// restrict what the system policy allows
+	for _, l := range e.layers() {
+		if err := l.check(name, argv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check applies the denylist, the allowlist and the rules of l.
+func (l *layer) check(name string, argv []string) error {
+	cmdStr := strings.Join(argv, " ")
+
+	for _, re := range l.denyREs {
+		if re.MatchString(cmdStr) {
+			return &Denial{Argv: argv, Pattern: re.String(), Description: l.descriptions[re], Layer: l.origin, name: name}
+		}
+	}
+
+	if len(l.allowREs) > 0 {
+		allowed := false
+		for _, re := range l.allowREs {
 			if re.MatchString(cmdStr) {
-				return fmt.Errorf("command %d denied by policy", i)
+				allowed = true
+				break
 			}
 		}
+		if !allowed {
+			return fmt.Errorf("%s not allowed by policy%s", name, l.from())
+		}
+	}
+	return l.checkRules(name, argv)
+}
 
-		if len(e.allowREs) > 0 {
-			allowed := false
-			for _, re := range e.allowREs {
-				if re.MatchString(cmdStr) {
-					allowed = true
-					break
-				}
+// checkDeny applies only the denylist and the deny rules of l.
+func (l *layer) checkDeny(name string, argv []string) error {
+	cmdStr := strings.Join(argv, " ")
+	for _, re := range l.denyREs {
+		if re.MatchString(cmdStr) {
+			return &Denial{Argv: argv, Pattern: re.String(), Description: l.descriptions[re], Layer: l.origin, name: name}
+		}
+	}
+	for _, r := range l.rules {
+		if r.Action == RuleDeny && r.Match(argv) {
+			return &Denial{Argv: argv, Rule: r.Source, Description: r.Description, Layer: l.origin, name: name}
+		}
+	}
+	return nil
+}
+
+// checkRules applies the argument-level rules. Deny rules block any matching
+// command. Allow rules only restrict commands starting with their subject:
+// such a command must match at least one of the allow rules covering it.
+func (l *layer) checkRules(name string, argv []string) error {
+	var covering []Rule
+	for _, r := range l.rules {
+		switch r.Action {
+		case RuleDeny:
+			if r.Match(argv) {
+				return &Denial{Argv: argv, Rule: r.Source, Description: r.Description, Layer: l.origin, name: name}
 			}
-			if !allowed {
-				return fmt.Errorf("command %d not allowed by policy", i)
+		case RuleAllow:
+			if r.covers(argv) {
+				covering = append(covering, r)
 			}
 		}
 	}
-	return nil
+	if len(covering) == 0 {
+		return nil
+	}
+	for _, r := range covering {
+		if r.Match(argv) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s not allowed by policy rules for %q%s", name, strings.Join(covering[0].Subject(), " "), l.from())
 }
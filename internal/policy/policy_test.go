@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
 	"github.com/aezizhu/LuciCodex/internal/plan"
 )
 
@@ -22,6 +23,10 @@ func TestValidatePlan(t *testing.T) {
 		{"ok uci", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}}}}, true},
 		{"deny rm", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"rm", "-rf", "/"}}}}, false},
 		{"not allowed", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"echo", "hi"}}}}, false},
+		{"ok pipe", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}, Pipe: [][]string{{"ubus", "list"}}}}}, true},
+		{"pipe stage not allowed", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}, Pipe: [][]string{{"sh"}}}}}, false},
+		{"pipe stage empty", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}, Pipe: [][]string{{}}}}}, false},
+		{"background pipe", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "show"}, Pipe: [][]string{{"ubus", "list"}}, Background: true}}}, false},
 	}
 	for _, c := range cases {
 		err := e.ValidatePlan(c.p)
@@ -90,3 +95,190 @@ func TestNew_InvalidRegex(t *testing.T) {
 		t.Error("expected 0 denyREs")
 	}
 }
+
+func TestWarnings(t *testing.T) {
+	e := New(config.Config{
+		Denylist: []string{`^rm\s`},
+		Warnlist: []string{`^uci commit`, `^/etc/init\.d/\S+ restart`, "("},
+	})
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"uci", "show"}},
+		{Command: []string{"uci", "commit", "firewall"}},
+		{Command: []string{"/etc/init.d/firewall", "restart"}},
+	}}
+	if err := e.ValidatePlan(p); err != nil {
+		t.Fatalf("warn rules must not block: %v", err)
+	}
+	w := e.Warnings(p)
+	if len(w) != 2 || w[0].Command != 1 || w[1].Command != 2 || w[0].Rule != `^uci commit` {
+		t.Fatalf("unexpected warnings: %+v", w)
+	}
+
+	if err := RequireAck(p, false); err != nil {
+		t.Errorf("plan without attached warnings needs no ack: %v", err)
+	}
+	p.PolicyWarnings = w
+	if err := RequireAck(p, false); errcode.Of(err) != errcode.PolicyAck {
+		t.Errorf("expected POLICY_ACK_REQUIRED, got %v", err)
+	}
+	if err := RequireAck(p, true); err != nil {
+		t.Errorf("acknowledged warnings: %v", err)
+	}
+}
+
+func TestWarnings_DFSChannel(t *testing.T) {
+	e := New(config.Config{})
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"uci", "set", "wireless.radio0.channel=36"}},
+		{Command: []string{"uci", "set", "wireless.radio0.channel='100'"}},
+		{Command: []string{"uci", "get", "wireless.radio0.channel=52"}},
+		{Command: []string{"uci", "set", "wireless.radio0.channel=auto"}},
+	}}
+	w := e.Warnings(p)
+	if len(w) != 1 || w[0].Command != 1 || w[0].Rule != "dfs-channel" || !strings.Contains(w[0].Message, "DFS channel 100") {
+		t.Fatalf("unexpected warnings: %+v", w)
+	}
+}
+
+func TestValidatePlan_FileCommands(t *testing.T) {
+	dir := t.TempDir()
+	e := New(config.Config{FilePaths: []string{dir}, FileMaxBytes: 16})
+	file := func(argv []string, content string) plan.PlannedCommand {
+		return plan.PlannedCommand{Command: argv, Content: content}
+	}
+	cases := []struct {
+		name string
+		c    plan.PlannedCommand
+		ok   bool
+	}{
+		{"read", file([]string{plan.FileRead, dir + "/dhcp"}, ""), true},
+		{"write", file([]string{plan.FileWrite, dir + "/dhcp"}, "config dnsmasq\n"), true},
+		{"outside file_paths", file([]string{plan.FileRead, "/etc/shadow"}, ""), false},
+		{"escape with ..", file([]string{plan.FileRead, dir + "/../shadow"}, ""), false},
+		{"relative", file([]string{plan.FileRead, "dhcp"}, ""), false},
+		{"two paths", file([]string{plan.FileRead, dir + "/a", dir + "/b"}, ""), false},
+		{"content too large", file([]string{plan.FileWrite, dir + "/dhcp"}, strings.Repeat("x", 17)), false},
+		{"content on read", file([]string{plan.FileRead, dir + "/dhcp"}, "x"), false},
+		{"content on other command", file([]string{"uci", "show"}, "x"), false},
+		{"piped", plan.PlannedCommand{Command: []string{plan.FileRead, dir + "/dhcp"}, Pipe: [][]string{{"grep", "lan"}}}, false},
+	}
+	for _, c := range cases {
+		err := e.ValidatePlan(plan.Plan{Commands: []plan.PlannedCommand{c.c}})
+		if c.ok != (err == nil) {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
+
+func TestValidatePlan_ServiceCommands(t *testing.T) {
+	e := New(config.Config{Denylist: []string{`^/etc/init\.d/firewall stop`}})
+	cases := []struct {
+		name string
+		c    plan.PlannedCommand
+		ok   bool
+	}{
+		{"list", plan.PlannedCommand{Command: []string{plan.ServiceList}}, true},
+		{"restart", plan.PlannedCommand{Command: []string{plan.ServiceRestart, "dnsmasq"}}, true},
+		{"list with a name", plan.PlannedCommand{Command: []string{plan.ServiceList, "dnsmasq"}}, false},
+		{"no name", plan.PlannedCommand{Command: []string{plan.ServiceStart}}, false},
+		{"path as name", plan.PlannedCommand{Command: []string{plan.ServiceStop, "../../bin/sh"}}, false},
+		{"background", plan.PlannedCommand{Command: []string{plan.ServiceRestart, "dnsmasq"}, Background: true}, false},
+		{"content", plan.PlannedCommand{Command: []string{plan.ServiceStatus, "dnsmasq"}, Content: "x"}, false},
+		{"denied as init script", plan.PlannedCommand{Command: []string{plan.ServiceStop, "firewall"}}, false},
+	}
+	for _, c := range cases {
+		err := e.ValidatePlan(plan.Plan{Commands: []plan.PlannedCommand{c.c}})
+		if c.ok != (err == nil) {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
+
+func TestValidatePlan_Verify(t *testing.T) {
+	e := New(config.Config{})
+	cases := []struct {
+		name string
+		c    plan.PlannedCommand
+		ok   bool
+	}{
+		{"read", plan.PlannedCommand{Command: []string{"uci", "get", "network.lan.ipaddr"}, Expect: &plan.Expect{Contains: "192.168.1.1"}}, true},
+		{"json", plan.PlannedCommand{Command: []string{"ubus", "call", "network.interface.lan", "status"}, Expect: &plan.Expect{JSONPath: "up", Equals: "true"}}, true},
+		{"write", plan.PlannedCommand{Command: []string{"uci", "set", "network.lan.ipaddr=10.0.0.1"}}, false},
+		{"write in a pipe stage", plan.PlannedCommand{Command: []string{"uci", "show"}, Pipe: [][]string{{"uci", "commit"}}}, false},
+		{"background", plan.PlannedCommand{Command: []string{"logread", "-f"}, Background: true}, false},
+		{"file write", plan.PlannedCommand{Command: []string{plan.FileWrite, "/tmp/x"}, Content: "x"}, false},
+		{"invalid regex", plan.PlannedCommand{Command: []string{"uci", "show"}, Expect: &plan.Expect{Regex: "("}}, false},
+		{"equals without path", plan.PlannedCommand{Command: []string{"uci", "show"}, Expect: &plan.Expect{Equals: "1"}}, false},
+		{"denied", plan.PlannedCommand{Command: []string{"rm", "-rf", "/"}}, false},
+	}
+	for _, c := range cases {
+		err := e.ValidatePlan(plan.Plan{Verify: []plan.PlannedCommand{c.c}})
+		if c.ok != (err == nil) {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), "verification command 0") {
+			t.Errorf("%s: the error should name the verification command: %v", c.name, err)
+		}
+	}
+}
+
+func TestSystemPolicy(t *testing.T) {
+	system := config.PolicyLayer{
+		Origin:      "/etc/lucicodex/policy.d/10-base.json",
+		Allowlist:   []string{`^uci\s`, `^wifi`},
+		Denylist:    []string{`^uci\s.*\bfirewall\b # managed centrally`},
+		Warnlist:    []string{`^wifi\s+down`},
+		PolicyRules: []string{`deny uci set /^system\./`},
+	}
+	// The user layer tries to loosen the system policy: a wider allowlist
+	// and no denylist. It can still restrict further.
+	e := New(config.Config{
+		Allowlist:    []string{`.*`},
+		Denylist:     []string{`^wifi\s+up`},
+		SystemPolicy: []config.PolicyLayer{system},
+	})
+	check := func(argv ...string) error {
+		return e.ValidatePlan(plan.Plan{Commands: []plan.PlannedCommand{{Command: argv}}})
+	}
+	if err := check("uci", "show", "network"); err != nil {
+		t.Errorf("allowed by both layers: %v", err)
+	}
+	if err := check("reboot"); err == nil || !strings.Contains(err.Error(), "not allowed by policy (system policy /etc/lucicodex/policy.d/10-base.json)") {
+		t.Errorf("the user allowlist must not widen the system one: %v", err)
+	}
+	err := check("uci", "set", "firewall.@zone[0].input=ACCEPT")
+	d, ok := AsDenial(err)
+	if !ok || d.Layer != system.Origin || !strings.Contains(err.Error(), "denied by policy (system policy ") {
+		t.Fatalf("expected a system denial, got %v", err)
+	}
+	if !strings.Contains(d.Explain(), "Why: managed centrally") || !strings.Contains(d.Explain(), "Set by the system policy "+system.Origin) {
+		t.Errorf("unexpected explanation:\n%s", d.Explain())
+	}
+	if err := check("uci", "set", "system.@system[0].hostname=x"); err == nil || !strings.Contains(err.Error(), `denied by policy rule "deny uci set /^system\\./" (system policy `) {
+		t.Errorf("expected the system rule to deny: %v", err)
+	}
+	if err := check("wifi", "up"); err == nil || strings.Contains(err.Error(), "system policy") {
+		t.Errorf("the user denylist should still apply: %v", err)
+	}
+
+	w := e.Warnings(plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "down"}}}})
+	if len(w) != 1 || w[0].Message != `command 0 matches warn rule "^wifi\\s+down" (system policy /etc/lucicodex/policy.d/10-base.json)` {
+		t.Errorf("unexpected warnings: %+v", w)
+	}
+
+	strict := New(config.Config{SystemPolicy: []config.PolicyLayer{{Origin: "s.json", StrictPrivileges: true}}})
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"opkg", "install", "curl"}}}}
+	if err := strict.ValidatePlan(p); err == nil {
+		t.Error("strict_privileges of the system policy should apply")
+	}
+}
+
+func TestLint_SystemPolicy(t *testing.T) {
+	issues := Lint(config.Config{
+		Denylist:     []string{"("},
+		SystemPolicy: []config.PolicyLayer{{Origin: "/etc/lucicodex/policy.d/a.json", PolicyRules: []string{"block ls"}}},
+	})
+	if len(issues) != 2 || issues[0].Origin != "/etc/lucicodex/policy.d/a.json" || issues[0].Field != "policy_rules" || issues[1].Origin != "" {
+		t.Errorf("unexpected issues: %+v", issues)
+	}
+}
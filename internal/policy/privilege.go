@@ -0,0 +1,201 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// PrivilegeAudit describes why a planned command needs root, according to the
+// capability table below, and whether that matches the model's needs_root claim.
+type PrivilegeAudit struct {
+	Index    int      `json:"index"`
+	Reasons  []string `json:"reasons,omitempty"`  // Capabilities that require root
+	Claimed  bool     `json:"claimed"`            // needs_root as returned by the model
+	ReadOnly bool     `json:"read_only"`          // Command is known not to need root
+	Conflict string   `json:"conflict,omitempty"` // Non-empty when claim and table disagree
+}
+
+// RequiresRoot reports whether the capability table says root is needed.
+func (a PrivilegeAudit) RequiresRoot() bool { return len(a.Reasons) > 0 }
+
+// uciWriteOps are uci subcommands that modify /etc/config.
+var uciWriteOps = map[string]bool{
+	"set": true, "add": true, "add_list": true, "del_list": true, "delete": true,
+	"rename": true, "reorder": true, "commit": true, "revert": true, "import": true, "batch": true,
+}
+
+// fileWriters are tools that modify the paths given to them as arguments.
+var fileWriters = map[string]bool{
+	"tee": true, "cp": true, "mv": true, "rm": true, "touch": true, "mkdir": true,
+	"rmdir": true, "ln": true, "chmod": true, "chown": true, "sed": true, "install": true,
+}
+
+// listeners are tools that may bind a socket given a port argument.
+var listeners = map[string]bool{
+	"nc": true, "ncat": true, "socat": true, "uhttpd": true, "dropbear": true, "httpd": true,
+}
+
+// readOnlyCommands never need root on a stock OpenWrt image.
+var readOnlyCommands = map[string]bool{
+	"cat": true, "ls": true, "logread": true, "dmesg": true, "free": true, "df": true,
+	"uname": true, "uptime": true, "ps": true, "top": true, "ping": true, "traceroute": true,
+	"nslookup": true, "echo": true, "date": true, "head": true, "tail": true, "grep": true,
+	"wc": true, "ifstatus": true, "iwinfo": true, "pwd": true, "whoami": true, "id": true,
+	plan.ServiceList: true,
+}
+
+// AuditCommand classifies a single planned command against the capability table.
+func AuditCommand(index int, pc plan.PlannedCommand) PrivilegeAudit {
+	a := PrivilegeAudit{Index: index, Claimed: pc.NeedsRoot}
+	if len(pc.Command) == 0 {
+		return a
+	}
+	argv := plan.InitArgv(pc.Command)
+	name := path.Base(argv[0])
+	sub := ""
+	if len(argv) > 1 {
+		sub = argv[1]
+	}
+
+	switch {
+	case name == "uci":
+		// Skip leading flags such as -q or -c <dir>
+		op := ""
+		for i := 1; i < len(argv); i++ {
+			switch {
+			case argv[i] == "-c" || argv[i] == "-d" || argv[i] == "-f" || argv[i] == "-p" || argv[i] == "-P":
+				i++
+				continue
+			case strings.HasPrefix(argv[i], "-"):
+				continue
+			}
+			op = argv[i]
+			break
+		}
+		if uciWriteOps[op] {
+			a.Reasons = append(a.Reasons, "writes /etc/config")
+		} else {
+			a.ReadOnly = true
+		}
+	case name == "ubus":
+		if sub == "call" || sub == "send" {
+			a.Reasons = append(a.Reasons, "talks to ubus")
+		} else {
+			a.ReadOnly = true
+		}
+	case name == "opkg" || name == "apk":
+		switch sub {
+		case "install", "remove", "upgrade", "update", "add", "del":
+			a.Reasons = append(a.Reasons, "modifies installed packages")
+		default:
+			a.ReadOnly = true
+		}
+	case strings.HasPrefix(argv[0], "/etc/init.d/") || name == "service":
+		op := sub
+		if name == "service" && len(argv) > 2 {
+			op = argv[2]
+		}
+		switch op {
+		case "", "status", "enabled", "info":
+			a.ReadOnly = op != ""
+		default:
+			a.Reasons = append(a.Reasons, "controls system services")
+		}
+	case name == "wifi":
+		if sub != "status" {
+			a.Reasons = append(a.Reasons, "reconfigures wireless interfaces")
+		} else {
+			a.ReadOnly = true
+		}
+	case name == "fw4" || name == "fw3":
+		if sub == "print" || sub == "check" {
+			a.ReadOnly = true
+		} else {
+			a.Reasons = append(a.Reasons, "reloads firewall rules")
+		}
+	case name == "ip":
+		if containsAny(argv[1:], "add", "del", "delete", "set", "change", "replace", "flush") {
+			a.Reasons = append(a.Reasons, "changes network interfaces or routes")
+		} else {
+			a.ReadOnly = true
+		}
+	case name == "reboot" || name == "sysupgrade" || name == "mount" || name == "umount" || name == "firstboot":
+		a.Reasons = append(a.Reasons, "performs a system-level operation")
+	case readOnlyCommands[name]:
+		a.ReadOnly = true
+	}
+
+	if fileWriters[name] && (name != "sed" || containsPrefix(argv[1:], "-i")) {
+		for _, arg := range argv[1:] {
+			if strings.HasPrefix(arg, "/etc/") || arg == "/etc" {
+				a.Reasons = append(a.Reasons, "writes /etc")
+				break
+			}
+		}
+	}
+
+	if listeners[name] {
+		for _, arg := range argv[1:] {
+			if port, err := strconv.Atoi(strings.TrimPrefix(arg, ":")); err == nil && port > 0 && port < 1024 {
+				a.Reasons = append(a.Reasons, fmt.Sprintf("binds privileged port %d", port))
+				break
+			}
+		}
+	}
+
+	if a.RequiresRoot() {
+		a.ReadOnly = false
+	}
+
+	switch {
+	case a.RequiresRoot() && !pc.NeedsRoot:
+		a.Conflict = "needs_root is false but command " + strings.Join(a.Reasons, ", ")
+	case pc.NeedsRoot && a.ReadOnly:
+		a.Conflict = "needs_root is true but command is read-only"
+	}
+	return a
+}
+
+// AuditPlan audits every command in the plan.
+func AuditPlan(p plan.Plan) []PrivilegeAudit {
+	audits := make([]PrivilegeAudit, 0, len(p.Commands))
+	for i, c := range p.Commands {
+		audits = append(audits, AuditCommand(i, c))
+	}
+	return audits
+}
+
+// CheckPrivileges returns an error for the first command whose needs_root claim
+// conflicts with the capability table.
+func CheckPrivileges(p plan.Plan) error {
+	for _, a := range AuditPlan(p) {
+		if a.Conflict != "" {
+			return fmt.Errorf("command %d privilege conflict: %s", a.Index, a.Conflict)
+		}
+	}
+	return nil
+}
+
+func containsAny(args []string, words ...string) bool {
+	for _, a := range args {
+		for _, w := range words {
+			if a == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsPrefix(args []string, prefix string) bool {
+	for _, a := range args {
+		if strings.HasPrefix(a, prefix) {
+			return true
+		}
+	}
+	return false
+}
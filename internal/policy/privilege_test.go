@@ -0,0 +1,62 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestAuditCommand(t *testing.T) {
+	cases := []struct {
+		name     string
+		cmd      plan.PlannedCommand
+		reason   string
+		readOnly bool
+		conflict bool
+	}{
+		{"uci set", plan.PlannedCommand{Command: []string{"uci", "set", "network.lan.ipaddr=10.0.0.1"}, NeedsRoot: true}, "writes /etc/config", false, false},
+		{"uci -q show", plan.PlannedCommand{Command: []string{"uci", "-q", "show", "network"}}, "", true, false},
+		{"ubus call", plan.PlannedCommand{Command: []string{"ubus", "call", "system", "board"}, NeedsRoot: true}, "talks to ubus", false, false},
+		{"init.d restart", plan.PlannedCommand{Command: []string{"/etc/init.d/network", "restart"}, NeedsRoot: true}, "controls system services", false, false},
+		{"tee /etc", plan.PlannedCommand{Command: []string{"tee", "/etc/banner"}, NeedsRoot: true}, "writes /etc", false, false},
+		{"listen port", plan.PlannedCommand{Command: []string{"nc", "-l", "-p", "80"}, NeedsRoot: true}, "binds privileged port 80", false, false},
+		{"under-claimed", plan.PlannedCommand{Command: []string{"opkg", "install", "curl"}}, "modifies installed packages", false, true},
+		{"over-claimed", plan.PlannedCommand{Command: []string{"cat", "/proc/uptime"}, NeedsRoot: true}, "", true, true},
+		{"unknown", plan.PlannedCommand{Command: []string{"mytool"}, NeedsRoot: true}, "", false, false},
+	}
+	for _, c := range cases {
+		a := AuditCommand(0, c.cmd)
+		if c.reason != "" && !strings.Contains(strings.Join(a.Reasons, ","), c.reason) {
+			t.Errorf("%s: expected reason %q, got %v", c.name, c.reason, a.Reasons)
+		}
+		if c.reason == "" && a.RequiresRoot() {
+			t.Errorf("%s: expected no root reasons, got %v", c.name, a.Reasons)
+		}
+		if a.ReadOnly != c.readOnly {
+			t.Errorf("%s: expected read-only %v, got %v", c.name, c.readOnly, a.ReadOnly)
+		}
+		if (a.Conflict != "") != c.conflict {
+			t.Errorf("%s: expected conflict %v, got %q", c.name, c.conflict, a.Conflict)
+		}
+	}
+}
+
+func TestValidatePlan_StrictPrivileges(t *testing.T) {
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "commit", "network"}}}}
+
+	if err := New(config.Config{}).ValidatePlan(p); err != nil {
+		t.Fatalf("expected plan to pass without strict mode: %v", err)
+	}
+
+	err := New(config.Config{StrictPrivileges: true}).ValidatePlan(p)
+	if err == nil || !strings.Contains(err.Error(), "privilege conflict") {
+		t.Fatalf("expected privilege conflict in strict mode, got %v", err)
+	}
+
+	p.Commands[0].NeedsRoot = true
+	if err := New(config.Config{StrictPrivileges: true}).ValidatePlan(p); err != nil {
+		t.Fatalf("expected consistent claim to pass strict mode: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+// Rule actions.
+const (
+	RuleAllow = "allow"
+	RuleDeny  = "deny"
+	RuleWarn  = "warn"
+)
+
+type tokenKind int
+
+const (
+	tokLiteral tokenKind = iota // Exact argument
+	tokAny                      // * matches one argument
+	tokRest                     // ** matches zero or more arguments
+	tokRegex                    // /re/ matches one argument
+)
+
+type token struct {
+	kind tokenKind
+	lit  string
+	re   *regexp.Regexp
+}
+
+// Rule is an argument-level policy rule. Its source form is an action
+// followed by one pattern per argv position:
+//
+//	allow uci set /^(wireless|network\.lan)\./
+//	deny opkg remove ** /^luci/ **
+//
+// A pattern is a literal argument, * (any one argument), ** (any number of
+// arguments) or /re/ (one argument matching the regular expression re).
+// Patterns are separated by whitespace, so regular expressions use \s rather
+// than spaces. The first pattern must be the literal command name. A lone #
+// starts a description of the rule, shown when it blocks or warns:
+//
+//	deny opkg remove ** /^luci/ ** # removing LuCI locks you out of the web interface
+type Rule struct {
+	Action      string
+	Source      string // The rule without its description
+	Description string
+	tokens      []token
+}
+
+// ParseRule parses the source form of a rule.
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	var description string
+	for i, f := range fields {
+		if f == "#" {
+			description = strings.Join(fields[i+1:], " ")
+			fields = fields[:i]
+			break
+		}
+	}
+	if len(fields) == 0 {
+		return Rule{}, fmt.Errorf("empty rule")
+	}
+	r := Rule{Action: fields[0], Source: strings.Join(fields, " "), Description: description}
+	switch r.Action {
+	case RuleAllow, RuleDeny, RuleWarn:
+	default:
+		return Rule{}, fmt.Errorf("unknown action %q (want allow, deny or warn)", r.Action)
+	}
+	if len(fields) == 1 {
+		return Rule{}, fmt.Errorf("rule has no command")
+	}
+	for i, f := range fields[1:] {
+		var t token
+		switch {
+		case f == "*":
+			t.kind = tokAny
+		case f == "**":
+			t.kind = tokRest
+		case len(f) >= 2 && strings.HasPrefix(f, "/") && strings.HasSuffix(f, "/"):
+			re, err := regexp.Compile(f[1 : len(f)-1])
+			if err != nil {
+				return Rule{}, fmt.Errorf("argument %d: %v", i, err)
+			}
+			t = token{kind: tokRegex, re: re}
+		default:
+			t = token{kind: tokLiteral, lit: f}
+		}
+		if i == 0 && t.kind != tokLiteral {
+			return Rule{}, fmt.Errorf("argument 0 must be a literal command name")
+		}
+		r.tokens = append(r.tokens, t)
+	}
+	return r, nil
+}
+
+// Match reports whether argv matches every pattern of the rule.
+func (r Rule) Match(argv []string) bool {
+	return matchTokens(r.tokens, argv)
+}
+
+// Subject returns the leading literal arguments of the rule, such as
+// ["uci", "set"]. Allow rules only restrict commands starting with their
+// subject.
+func (r Rule) Subject() []string {
+	var out []string
+	for _, t := range r.tokens {
+		if t.kind != tokLiteral {
+			break
+		}
+		out = append(out, t.lit)
+	}
+	return out
+}
+
+func (r Rule) covers(argv []string) bool {
+	subject := r.Subject()
+	if len(argv) < len(subject) {
+		return false
+	}
+	for i, s := range subject {
+		if argv[i] != s {
+			return false
+		}
+	}
+	return true
+}
+
+func matchTokens(toks []token, argv []string) bool {
+	if len(toks) == 0 {
+		return len(argv) == 0
+	}
+	t := toks[0]
+	if t.kind == tokRest {
+		for i := 0; i <= len(argv); i++ {
+			if matchTokens(toks[1:], argv[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(argv) == 0 {
+		return false
+	}
+	switch t.kind {
+	case tokLiteral:
+		if argv[0] != t.lit {
+			return false
+		}
+	case tokRegex:
+		if !t.re.MatchString(argv[0]) {
+			return false
+		}
+	}
+	return matchTokens(toks[1:], argv[1:])
+}
+
+// Lint severities.
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+// LintIssue is a problem found in the policy configuration.
+type LintIssue struct {
+	Severity string `json:"severity"`
+	Field    string `json:"field"`            // Config option, e.g. "policy_rules"
+	Origin   string `json:"origin,omitempty"` // System policy file, if the entry is not from the configuration
+	Index    int    `json:"index"`
+	Value    string `json:"value"`
+	Message  string `json:"message"`
+}
+
+// Lint validates the policy options of cfg and its system policy layers.
+// New silently skips entries that fail to compile, so errors reported here
+// are rules that are not enforced.
+func Lint(cfg config.Config) []LintIssue {
+	issues := []LintIssue{}
+	for _, l := range cfg.SystemPolicy {
+		issues = append(issues, lintLayer(l.Origin, l.Allowlist, l.Denylist, l.Warnlist, l.PolicyRules)...)
+	}
+	return append(issues, lintLayer("", cfg.Allowlist, cfg.Denylist, cfg.Warnlist, cfg.PolicyRules)...)
+}
+
+func lintLayer(origin string, allowlist, denylist, warnlist, policyRules []string) []LintIssue {
+	var issues []LintIssue
+	add := func(severity, field string, i int, value, format string, args ...interface{}) {
+		issues = append(issues, LintIssue{
+			Severity: severity,
+			Field:    field,
+			Origin:   origin,
+			Index:    i,
+			Value:    value,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, list := range []struct {
+		field    string
+		patterns []string
+	}{
+		{"allowlist", allowlist},
+		{"denylist", denylist},
+		{"warnlist", warnlist},
+	} {
+		seen := map[string]int{}
+		for i, entry := range list.patterns {
+			p, _ := splitDescription(entry)
+			if _, err := regexp.Compile(p); err != nil {
+				add(LintError, list.field, i, entry, "invalid pattern: %v", err)
+			}
+			if j, ok := seen[p]; ok {
+				add(LintWarning, list.field, i, entry, "duplicate of entry %d", j)
+			} else {
+				seen[p] = i
+			}
+		}
+	}
+
+	seen := map[string]int{}
+	for i, s := range policyRules {
+		r, err := ParseRule(s)
+		if err != nil {
+			add(LintError, "policy_rules", i, s, "%v", err)
+			continue
+		}
+		if j, ok := seen[r.Source]; ok {
+			add(LintWarning, "policy_rules", i, s, "duplicate of rule %d", j)
+			continue
+		}
+		seen[r.Source] = i
+		if r.Action == RuleAllow && len(r.tokens) > 0 && r.tokens[len(r.tokens)-1].kind == tokRest && len(r.Subject()) == len(r.tokens)-1 {
+			add(LintWarning, "policy_rules", i, s, "allows every %q command and restricts nothing", strings.Join(r.Subject(), " "))
+		}
+	}
+	return issues
+}
+
+// splitDescription splits an allowlist, denylist or warnlist entry into its
+// pattern and the description following " # ", if any.
+func splitDescription(entry string) (pattern, description string) {
+	pattern, description, ok := strings.Cut(entry, " # ")
+	if !ok {
+		return entry, ""
+	}
+	return strings.TrimRight(pattern, " "), strings.TrimSpace(description)
+}
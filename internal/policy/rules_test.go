@@ -0,0 +1,150 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestParseRule(t *testing.T) {
+	bad := []string{
+		"",
+		"allow",
+		"permit uci set",
+		"allow * set",
+		"deny opkg remove /[/",
+	}
+	for _, s := range bad {
+		if _, err := ParseRule(s); err == nil {
+			t.Errorf("ParseRule(%q) expected error", s)
+		}
+	}
+
+	r, err := ParseRule("  allow   uci set /^wireless\\./ ")
+	if err != nil {
+		t.Fatalf("ParseRule: %v", err)
+	}
+	if r.Action != RuleAllow || r.Source != `allow uci set /^wireless\./` {
+		t.Fatalf("unexpected rule %+v", r)
+	}
+	if got := strings.Join(r.Subject(), " "); got != "uci set" {
+		t.Fatalf("Subject() = %q", got)
+	}
+}
+
+func TestRule_Match(t *testing.T) {
+	cases := []struct {
+		rule string
+		argv []string
+		want bool
+	}{
+		{`allow uci set /^(wireless|network\.lan)\./`, []string{"uci", "set", "wireless.radio0.disabled=0"}, true},
+		{`allow uci set /^(wireless|network\.lan)\./`, []string{"uci", "set", "network.wan.proto=dhcp"}, false},
+		{`allow uci set /^(wireless|network\.lan)\./`, []string{"uci", "set"}, false},
+		{`allow uci set /^(wireless|network\.lan)\./`, []string{"uci", "set", "wireless.x=1", "extra"}, false},
+		{`deny opkg remove ** /^luci/ **`, []string{"opkg", "remove", "luci-base"}, true},
+		{`deny opkg remove ** /^luci/ **`, []string{"opkg", "remove", "--force-depends", "htop", "luci-app-firewall"}, true},
+		{`deny opkg remove ** /^luci/ **`, []string{"opkg", "remove", "htop"}, false},
+		{`deny opkg remove ** /^luci/ **`, []string{"opkg", "install", "luci"}, false},
+		{`warn reboot **`, []string{"reboot"}, true},
+		{`warn ip * show`, []string{"ip", "addr", "show"}, true},
+		{`warn ip * show`, []string{"ip", "show"}, false},
+	}
+	for _, c := range cases {
+		r, err := ParseRule(c.rule)
+		if err != nil {
+			t.Fatalf("ParseRule(%q): %v", c.rule, err)
+		}
+		if got := r.Match(c.argv); got != c.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", c.rule, c.argv, got, c.want)
+		}
+	}
+}
+
+func TestEngine_PolicyRules(t *testing.T) {
+	e := New(config.Config{PolicyRules: []string{
+		`allow uci set /^wireless\./`,
+		`allow uci set /^network\.lan\./`,
+		`deny opkg remove ** /^luci/ **`,
+		`warn uci commit **`,
+		`deny broken /[/`, // Invalid rules are skipped
+	}})
+	cases := []struct {
+		argv []string
+		want string
+	}{
+		{[]string{"uci", "set", "wireless.radio0.channel=6"}, ""},
+		{[]string{"uci", "set", "network.lan.ipaddr=192.168.2.1"}, ""},
+		{[]string{"uci", "set", "network.wan.proto=static"}, `not allowed by policy rules for "uci set"`},
+		{[]string{"uci", "show", "network"}, ""},
+		{[]string{"opkg", "remove", "luci-base"}, `denied by policy rule "deny opkg remove ** /^luci/ **"`},
+		{[]string{"opkg", "remove", "htop"}, ""},
+		{[]string{"broken", "["}, ""},
+	}
+	for _, c := range cases {
+		err := e.ValidateCommand(0, plan.PlannedCommand{Command: c.argv})
+		if c.want == "" {
+			if err != nil {
+				t.Errorf("%q: unexpected error %v", c.argv, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: error %v, want %q", c.argv, err, c.want)
+		}
+	}
+
+	// Pipeline stages are checked individually
+	err := e.ValidatePlan(plan.Plan{Commands: []plan.PlannedCommand{{
+		Command: []string{"opkg", "list-installed"},
+		Pipe:    [][]string{{"uci", "set", "dhcp.lan.start=10"}},
+	}}})
+	if err == nil || !strings.Contains(err.Error(), "command 0 stage 1") {
+		t.Fatalf("expected stage error, got %v", err)
+	}
+
+	ws := e.Warnings(plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"uci", "show"}},
+		{Command: []string{"uci", "commit", "wireless"}},
+	}})
+	if len(ws) != 1 || ws[0].Command != 1 || ws[0].Rule != "warn uci commit **" {
+		t.Fatalf("unexpected warnings %+v", ws)
+	}
+}
+
+func TestLint(t *testing.T) {
+	if issues := Lint(config.Config{
+		Denylist:    []string{`^rm\s`},
+		PolicyRules: []string{`allow uci set /^wireless\./`},
+	}); len(issues) != 0 {
+		t.Fatalf("expected no issues, got %+v", issues)
+	}
+
+	issues := Lint(config.Config{
+		Allowlist:   []string{`^uci`, `^uci`},
+		Denylist:    []string{`(`},
+		PolicyRules: []string{`allow uci set /[/`, `deny  reboot`, `deny reboot`, `allow uci **`, `block x`},
+	})
+	type key struct {
+		severity, field string
+		index           int
+	}
+	want := map[key]bool{
+		{LintWarning, "allowlist", 1}:    true,
+		{LintError, "denylist", 0}:       true,
+		{LintError, "policy_rules", 0}:   true,
+		{LintWarning, "policy_rules", 2}: true,
+		{LintWarning, "policy_rules", 3}: true,
+		{LintError, "policy_rules", 4}:   true,
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("got %d issues, want %d: %+v", len(issues), len(want), issues)
+	}
+	for _, is := range issues {
+		if !want[key{is.Severity, is.Field, is.Index}] {
+			t.Errorf("unexpected issue %+v", is)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package policy
+
+import (
+	"fmt"
+
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/services"
+)
+
+// checkService checks a built-in service command (see plan.ServiceList): a
+// valid service name, except for service.list which takes none, run in the
+// foreground without pipes or content. Its argv is then checked as usual,
+// and the deny patterns and rules also apply to the init script call it
+// amounts to (see plan.InitArgv), so denying `/etc/init.d/network stop`
+// denies service.stop network too.
+func (e *Engine) checkService(i int, c plan.PlannedCommand) error {
+	action, name, _ := c.ServiceOp()
+	if action == "list" {
+		if len(c.Command) != 1 {
+			return fmt.Errorf("command %d: %s takes no arguments", i, plan.ServiceList)
+		}
+	} else if len(c.Command) != 2 {
+		return fmt.Errorf("command %d: %s takes exactly one service name", i, c.Command[0])
+	}
+	if len(c.Pipe) > 0 || c.Background {
+		return fmt.Errorf("command %d: %s cannot be piped or run in the background", i, c.Command[0])
+	}
+	if c.Content != "" {
+		return fmt.Errorf("command %d: content is only valid for %s", i, plan.FileWrite)
+	}
+	if action == "list" {
+		return nil
+	}
+	if !services.ValidName(name) {
+		return fmt.Errorf("command %d: invalid service name %q", i, name)
+	}
+	argv := plan.InitArgv(c.Command)
+	for _, l := range e.layers() {
+		if err := l.checkDeny(fmt.Sprintf("command %d", i), argv); err != nil {
+			if d, ok := err.(*Denial); ok {
+				d.Command = i
+			}
+			return err
+		}
+	}
+	return nil
+}
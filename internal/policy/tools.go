@@ -0,0 +1,99 @@
+package policy
+
+import (
+	"path"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// installed is overridden by tests.
+var installed = openwrt.Installed
+
+// CheckTools records in p.MissingTools the executables of p that are not
+// installed, except those whose package an earlier command of the plan
+// installs. With auto_install_packages it amends the plan instead: commands
+// installing the packages of the missing tools are inserted first, unless
+// the policy would reject them, and only tools without a known package stay
+// listed. Call it before ValidatePlan so the amendment is validated too.
+func (e *Engine) CheckTools(p plan.Plan) plan.Plan {
+	var missing []plan.MissingTool
+	pending := map[string]bool{} // Packages installed by earlier commands
+	for i, c := range p.Commands {
+		if c.IsBuiltin() {
+			continue
+		}
+		for _, argv := range c.Stages() {
+			if len(argv) == 0 || installed(argv[0]) {
+				continue
+			}
+			pkg := openwrt.PackageFor(argv[0])
+			if pkg != "" && pending[pkg] {
+				continue
+			}
+			missing = append(missing, plan.MissingTool{Command: i, Tool: argv[0], Package: pkg})
+		}
+		for _, pkg := range opkgInstalls(c.Command) {
+			pending[pkg] = true
+		}
+	}
+	p.MissingTools = missing
+	if !e.cfg.AutoInstallPackages {
+		return p
+	}
+
+	var pkgs, tools []string
+	var unknown []plan.MissingTool
+	seen := map[string]bool{}
+	for _, m := range missing {
+		switch {
+		case m.Package == "":
+			unknown = append(unknown, m)
+		case !seen[m.Package]:
+			seen[m.Package] = true
+			pkgs = append(pkgs, m.Package)
+			tools = append(tools, path.Base(m.Tool))
+		}
+	}
+	if len(pkgs) == 0 {
+		return p
+	}
+	install := []plan.PlannedCommand{
+		{Command: []string{"opkg", "update"}, NeedsRoot: true, Description: "Update the package lists"},
+		{Command: append([]string{"opkg", "install"}, pkgs...), NeedsRoot: true, Description: "Install " + strings.Join(tools, ", ") + ", which the plan needs but is not installed"},
+	}
+	for i, c := range install {
+		if e.ValidateCommand(i, c) != nil {
+			return p
+		}
+	}
+	p.Commands = append(install, p.Commands...)
+	for i := range unknown {
+		unknown[i].Command += len(install)
+	}
+	p.MissingTools = unknown
+	return p
+}
+
+// opkgInstalls returns the packages an `opkg install` command installs.
+func opkgInstalls(argv []string) []string {
+	if len(argv) < 2 || path.Base(argv[0]) != "opkg" {
+		return nil
+	}
+	var pkgs []string
+	install := false
+	for _, a := range argv[1:] {
+		switch {
+		case strings.HasPrefix(a, "-"):
+		case !install:
+			if a != "install" {
+				return nil
+			}
+			install = true
+		default:
+			pkgs = append(pkgs, a)
+		}
+	}
+	return pkgs
+}
@@ -0,0 +1,58 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestCheckTools(t *testing.T) {
+	orig := installed
+	defer func() { installed = orig }()
+	installed = func(name string) bool {
+		return name == "ping" || name == "grep" || name == "opkg"
+	}
+
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"ping", "-c", "1", "8.8.8.8"}},
+		{Command: []string{"traceroute", "8.8.8.8"}, Pipe: [][]string{{"grep", "ms"}}},
+		{Command: []string{"opkg", "install", "tcpdump"}},
+		{Command: []string{"tcpdump", "-c", "10"}},
+		{Command: []string{"mytool"}},
+	}}
+
+	got := New(config.Config{}).CheckTools(p)
+	want := []plan.MissingTool{
+		{Command: 1, Tool: "traceroute", Package: "traceroute"},
+		{Command: 4, Tool: "mytool"},
+	}
+	if !reflect.DeepEqual(got.MissingTools, want) {
+		t.Fatalf("missing tools = %+v, want %+v", got.MissingTools, want)
+	}
+	if len(got.Commands) != len(p.Commands) {
+		t.Fatalf("plan amended without auto_install_packages: %+v", got.Commands)
+	}
+
+	// The amendment installs traceroute first; mytool has no package
+	got = New(config.Config{AutoInstallPackages: true}).CheckTools(p)
+	if len(got.Commands) != len(p.Commands)+2 {
+		t.Fatalf("expected 2 install commands, got %+v", got.Commands)
+	}
+	if !reflect.DeepEqual(got.Commands[1].Command, []string{"opkg", "install", "traceroute"}) || !got.Commands[1].NeedsRoot {
+		t.Errorf("unexpected install command %+v", got.Commands[1])
+	}
+	if want := []plan.MissingTool{{Command: 6, Tool: "mytool"}}; !reflect.DeepEqual(got.MissingTools, want) {
+		t.Errorf("missing tools after amendment = %+v, want %+v", got.MissingTools, want)
+	}
+	if again := New(config.Config{AutoInstallPackages: true}).CheckTools(got); len(again.Commands) != len(got.Commands) {
+		t.Errorf("CheckTools amended an amended plan: %+v", again.Commands)
+	}
+
+	// A policy that denies opkg leaves the plan as it was
+	denied := New(config.Config{AutoInstallPackages: true, Denylist: []string{"^opkg install"}}).CheckTools(p)
+	if len(denied.Commands) != len(p.Commands) || len(denied.MissingTools) != 2 {
+		t.Errorf("denied amendment changed the plan: %+v", denied)
+	}
+}
@@ -0,0 +1,81 @@
+package policy
+
+import (
+	"path"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// APRule names the access point check in warnings and denials.
+const APRule = "access-point"
+
+// WithTopology returns an engine that knows the device's place in the
+// network. On a dumb access point, commands changing DHCP or the firewall,
+// which the upstream router owns, become warnings according to ap_guard, or
+// with "block" are denied. A t that is not an access point, or ap_guard
+// "off", returns e unchanged.
+func (e *Engine) WithTopology(t *openwrt.Topology) *Engine {
+	if !t.IsAP() || e.cfg.APGuard == "off" {
+		return e
+	}
+	guarded := *e
+	guarded.topology = t
+	return &guarded
+}
+
+// blocksAP reports whether DHCP and firewall changes on an access point are
+// denied rather than flagged.
+func (e *Engine) blocksAP() bool {
+	return e.topology != nil && e.cfg.APGuard == "block"
+}
+
+// apServices are the init scripts of services an access point leaves to
+// the upstream router.
+var apServices = map[string]string{"dnsmasq": "DHCP", "odhcpd": "DHCP", "firewall": "firewall"}
+
+// apHit returns how argv would change what the upstream router of an access
+// point is in charge of, or "" if it would not.
+func (e *Engine) apHit(argv []string) string {
+	if e.topology == nil || len(argv) == 0 {
+		return ""
+	}
+	argv = plan.InitArgv(argv)
+	const upstream = " on a dumb access point; the upstream router is in charge of it"
+	name := path.Base(argv[0])
+	args := argv[1:]
+	if name == "service" && len(args) > 0 {
+		name, args = args[0], args[1:]
+	} else if !strings.HasPrefix(argv[0], "/etc/init.d/") && name != "fw4" && name != "uci" {
+		return ""
+	}
+	switch {
+	case name == "uci":
+		i := 0
+		for i < len(args) && strings.HasPrefix(args[i], "-") {
+			i++
+		}
+		if i+1 >= len(args) {
+			return ""
+		}
+		switch args[i] {
+		case "set", "add", "delete", "rename", "add_list", "del_list", "reorder":
+		default:
+			return ""
+		}
+		config, _, _ := strings.Cut(args[i+1], ".")
+		if config == "dhcp" || config == "firewall" {
+			return "changes the " + config + " configuration" + upstream
+		}
+	case name == "fw4" || apServices[name] != "":
+		what := apServices[name]
+		if name == "fw4" {
+			what = "firewall"
+		}
+		if len(args) > 0 && (args[0] == "start" || args[0] == "restart" || args[0] == "reload" || args[0] == "enable") {
+			return args[0] + "s the " + what + " service" + upstream
+		}
+	}
+	return ""
+}
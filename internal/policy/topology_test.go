@@ -0,0 +1,68 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+var dumbAP = &openwrt.Topology{Role: openwrt.RoleAP, Reasons: []string{"DHCP server disabled on lan", "no wan interface"}, Uplink: "lan"}
+
+func TestAPGuard(t *testing.T) {
+	hits := [][]string{
+		{"uci", "set", "dhcp.lan.ignore=0"},
+		{"uci", "add", "dhcp", "host"},
+		{"uci", "-q", "delete", "firewall.@rule[2]"},
+		{"/etc/init.d/dnsmasq", "restart"},
+		{"service", "firewall", "enable"},
+		{"fw4", "reload"},
+	}
+	misses := [][]string{
+		{"uci", "show", "dhcp"},
+		{"uci", "set", "wireless.radio0.channel=36"},
+		{"/etc/init.d/dnsmasq", "status"},
+		{"fw4", "print"},
+		{"wifi", "reload"},
+	}
+
+	e := New(config.Config{APGuard: "confirm"}).WithTopology(dumbAP)
+	for _, argv := range hits {
+		p := plan.Plan{Commands: []plan.PlannedCommand{{Command: argv}}}
+		if err := e.ValidatePlan(p); err != nil {
+			t.Errorf("%v: unexpected error %v", argv, err)
+		}
+		w := e.Warnings(p)
+		if len(w) != 1 || w[0].Rule != APRule || !strings.Contains(w[0].Message, "access point") {
+			t.Errorf("%v: unexpected warnings %+v", argv, w)
+		}
+	}
+	for _, argv := range misses {
+		if w := e.Warnings(plan.Plan{Commands: []plan.PlannedCommand{{Command: argv}}}); len(w) != 0 {
+			t.Errorf("%v: unexpected warnings %+v", argv, w)
+		}
+	}
+
+	e = New(config.Config{APGuard: "block"}).WithTopology(dumbAP)
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: hits[0]}}}
+	var d *Denial
+	if err := e.ValidatePlan(p); !errors.As(err, &d) || d.Rule != APRule {
+		t.Errorf("expected an %s denial, got %v", APRule, err)
+	}
+	if w := e.Warnings(p); len(w) != 0 {
+		t.Errorf("blocked commands must not warn too: %+v", w)
+	}
+
+	for _, e := range []*Engine{
+		New(config.Config{APGuard: "off"}).WithTopology(dumbAP),
+		New(config.Config{APGuard: "block"}).WithTopology(&openwrt.Topology{Role: openwrt.RoleRouter}),
+		New(config.Config{APGuard: "block"}).WithTopology(nil),
+	} {
+		if err := e.ValidatePlan(p); err != nil || len(e.Warnings(p)) != 0 {
+			t.Errorf("unexpected guard on %+v: %v", e.topology, err)
+		}
+	}
+}
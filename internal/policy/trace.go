@@ -0,0 +1,84 @@
+package policy
+
+import (
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Trace explains the decision of ValidatePlan and Warnings on each command
+// of p, for JSON output: every pattern and rule of every layer evaluated
+// for its stages and whether it matched, the built-in checks that fired,
+// the verdict and the command's risk category (see impact.Risk).
+func (e *Engine) Trace(p plan.Plan) []plan.PolicyTrace {
+	warnings := e.Warnings(p)
+	block := e.lintBlock(LintPlan(p))
+	out := make([]plan.PolicyTrace, 0, len(p.Commands))
+	for i, c := range p.Commands {
+		t := plan.PolicyTrace{Command: i, Verdict: plan.VerdictAllow, Risk: impact.Risk(c), Rules: []plan.RuleTrace{}}
+		for s, argv := range c.Stages() {
+			for _, l := range e.layers() {
+				t.Rules = append(t.Rules, l.trace(s, argv)...)
+			}
+		}
+		if err := e.ValidateCommand(i, c); err != nil {
+			t.Verdict, t.Reason = plan.VerdictDeny, err.Error()
+			if d, ok := AsDenial(err); ok && d.Pattern == "" {
+				addBuiltin(&t, d.Rule, d.Stage)
+			}
+		} else if block != nil && block.Command == i {
+			t.Verdict, t.Reason = plan.VerdictDeny, block.Message
+			addBuiltin(&t, "lint:"+block.Rule, 0)
+		}
+		for _, w := range warnings {
+			if w.Command != i {
+				continue
+			}
+			addBuiltin(&t, w.Rule, 0)
+			if t.Verdict == plan.VerdictAllow {
+				t.Verdict, t.Reason = plan.VerdictWarn, w.Message
+			}
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// trace evaluates every pattern and rule of l for argv, stage s of a
+// command, without stopping at the first match as check does. Allow rules
+// are only evaluated for the commands they cover.
+func (l *layer) trace(s int, argv []string) []plan.RuleTrace {
+	cmdStr := strings.Join(argv, " ")
+	var out []plan.RuleTrace
+	add := func(rule, kind string, matched bool) {
+		out = append(out, plan.RuleTrace{Rule: rule, Kind: kind, Layer: l.origin, Stage: s, Matched: matched})
+	}
+	for _, re := range l.denyREs {
+		add(re.String(), "denylist", re.MatchString(cmdStr))
+	}
+	for _, re := range l.allowREs {
+		add(re.String(), "allowlist", re.MatchString(cmdStr))
+	}
+	for _, re := range l.warnREs {
+		add(re.String(), "warnlist", re.MatchString(cmdStr))
+	}
+	for _, r := range l.rules {
+		if r.Action == RuleAllow && !r.covers(argv) {
+			continue
+		}
+		add(r.Source, "rule", r.Match(argv))
+	}
+	return out
+}
+
+// addBuiltin records a matched built-in check, such as ControlRule, unless
+// the rule is a pattern or policy rule that matched already.
+func addBuiltin(t *plan.PolicyTrace, rule string, stage int) {
+	for _, r := range t.Rules {
+		if r.Matched && r.Rule == rule {
+			return
+		}
+	}
+	t.Rules = append(t.Rules, plan.RuleTrace{Rule: rule, Kind: "builtin", Stage: stage, Matched: true})
+}
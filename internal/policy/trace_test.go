@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestTrace(t *testing.T) {
+	e := New(config.Config{
+		Denylist:    []string{`^rm\s`},
+		Warnlist:    []string{`^wifi\s+down`},
+		PolicyRules: []string{`allow uci set /^wireless\./`, `deny opkg remove ** /^luci/ **`},
+		SystemPolicy: []config.PolicyLayer{{
+			Origin:   "/etc/lucicodex/policy.d/10-base.json",
+			Denylist: []string{`^mtd\s`},
+		}},
+	})
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"uci", "set", "wireless.radio0.channel=6"}},
+		{Command: []string{"wifi", "down"}},
+		{Command: []string{"rm", "-rf", "/etc/config"}},
+		{Command: []string{"uci", "set", "network.lan.ipaddr=10.0.0.1"}},
+		{Command: []string{"uci", "set", "wireless.radio0.channel=52"}},
+		{Command: []string{"reboot"}},
+	}}
+	trace := e.Trace(p)
+	if len(trace) != len(p.Commands) {
+		t.Fatalf("expected a trace per command, got %d", len(trace))
+	}
+
+	want := []struct {
+		verdict, risk string
+		matched       []string
+	}{
+		{plan.VerdictAllow, impact.RiskWrite, []string{"allow uci set /^wireless\\./"}},
+		{plan.VerdictWarn, impact.RiskService, []string{`^wifi\s+down`}},
+		{plan.VerdictDeny, impact.RiskWrite, []string{`^rm\s`}},
+		{plan.VerdictDeny, impact.RiskWrite, nil},
+		{plan.VerdictWarn, impact.RiskWrite, []string{"allow uci set /^wireless\\./", "dfs-channel"}},
+		{plan.VerdictAllow, impact.RiskReboot, nil},
+	}
+	for i, w := range want {
+		tr := trace[i]
+		if tr.Command != i || tr.Verdict != w.verdict || tr.Risk != w.risk {
+			t.Errorf("command %d: got %s/%s, want %s/%s (%s)", i, tr.Verdict, tr.Risk, w.verdict, w.risk, tr.Reason)
+		}
+		var matched []string
+		for _, r := range tr.Rules {
+			if r.Matched {
+				matched = append(matched, r.Rule)
+			}
+		}
+		if strings.Join(matched, "|") != strings.Join(w.matched, "|") {
+			t.Errorf("command %d: matched %q, want %q", i, matched, w.matched)
+		}
+		if tr.Verdict != plan.VerdictAllow && tr.Reason == "" {
+			t.Errorf("command %d: a %s verdict needs a reason", i, tr.Verdict)
+		}
+	}
+
+	// Every layer is evaluated, the system policy included
+	var system bool
+	for _, r := range trace[0].Rules {
+		if r.Layer == "/etc/lucicodex/policy.d/10-base.json" && r.Kind == "denylist" && !r.Matched {
+			system = true
+		}
+	}
+	if !system {
+		t.Errorf("expected the system denylist in the trace: %+v", trace[0].Rules)
+	}
+	// The wireless allow rule does not cover the network change, which no
+	// allow rule permits
+	if !strings.Contains(trace[3].Reason, "not allowed by policy rules") {
+		t.Errorf("unexpected reason: %s", trace[3].Reason)
+	}
+}
@@ -0,0 +1,40 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// checkVerify checks a verification command (see plan.Plan.Verify) like a
+// command of the plan, and that it only reads: a check must not change what
+// it looks at. Errors name it "verification command i".
+func (e *Engine) checkVerify(i int, c plan.PlannedCommand) error {
+	if err := e.checkCommand(i, c); err != nil {
+		return fmt.Errorf("verification %w", err)
+	}
+	if c.Background {
+		return fmt.Errorf("verification command %d cannot run in the background", i)
+	}
+	if op, _, ok := c.FileOp(); ok && op == plan.FileWrite {
+		return fmt.Errorf("verification command %d is not read-only: %s", i, op)
+	}
+	for _, argv := range c.Stages() {
+		if impact.IsWrite(argv) {
+			return fmt.Errorf("verification command %d is not read-only: %s", i, quoteArgv(argv))
+		}
+	}
+	if x := c.Expect; x != nil {
+		if x.Regex != "" {
+			if _, err := regexp.Compile(x.Regex); err != nil {
+				return fmt.Errorf("verification command %d: invalid regex: %v", i, err)
+			}
+		}
+		if x.Equals != "" && x.JSONPath == "" {
+			return fmt.Errorf("verification command %d: equals needs a json_path", i)
+		}
+	}
+	return nil
+}
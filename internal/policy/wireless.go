@@ -0,0 +1,40 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// reWirelessChannel matches `uci set wireless.<section>.channel=<n>`.
+var reWirelessChannel = regexp.MustCompile(`^wireless\.[^.=]+\.channel=['"]?(\d+)['"]?$`)
+
+// dfsWarning flags commands that move a radio to a DFS channel. The radio
+// then listens for radar for up to ten minutes before it transmits, and
+// drops its clients whenever radar is detected, so such a change is only
+// made knowingly.
+func dfsWarning(i int, c plan.PlannedCommand) *plan.PolicyWarning {
+	for _, argv := range c.Stages() {
+		if len(argv) < 3 || argv[0] != "uci" {
+			continue
+		}
+		for _, arg := range argv[1:] {
+			m := reWirelessChannel.FindStringSubmatch(strings.TrimSpace(arg))
+			if m == nil || argv[1] != "set" {
+				continue
+			}
+			if ch, _ := strconv.Atoi(m[1]); openwrt.IsDFSChannel(ch) {
+				return &plan.PolicyWarning{
+					Command: i,
+					Rule:    "dfs-channel",
+					Message: fmt.Sprintf("command %d sets DFS channel %d: the radio waits up to 10 minutes for radar before transmitting and drops clients when radar is detected", i, ch),
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+// Package procgroup makes cancelling a command's context kill everything the
+// command started. exec.CommandContext kills only the process it started, so
+// the children of a shell, an init script or an elevation tool would keep
+// running, and keep the command's output open, after a client disconnected
+// or a timeout expired.
+package procgroup
+
+import "time"
+
+// WaitDelay is how long Wait waits for the output of a killed command to
+// close, in case a child escaped the group by starting a session of its own.
+const WaitDelay = time.Second
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package procgroup
+
+import "os/exec"
+
+// KillOnCancel is only implemented on Unix (process groups). Elsewhere
+// cancelling kills the command but not what it started; cmd only gets
+// WaitDelay, so Wait does not block on output a child keeps open.
+func KillOnCancel(cmd *exec.Cmd) *exec.Cmd {
+	cmd.WaitDelay = WaitDelay
+	return cmd
+}
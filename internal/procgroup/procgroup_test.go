@@ -0,0 +1,78 @@
+//go:build unix
+
+package procgroup
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// alive reports whether pid runs, zombies counting as gone.
+func alive(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// The state follows the command name, in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestKillOnCancel(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := KillOnCancel(exec.CommandContext(ctx, "sh", "-c", "sleep 30 & echo $!; wait"))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatalf("unexpected output %q", line)
+	}
+
+	cancel()
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the cancelled command to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cancelled command did not return")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for alive(child) {
+		if time.Now().After(deadline) {
+			t.Fatalf("child %d outlived the cancelled command", child)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKillOnCancel_Finished(t *testing.T) {
+	cmd := KillOnCancel(exec.CommandContext(context.Background(), "true"))
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !cmd.SysProcAttr.Setpgid {
+		t.Error("expected a process group of its own")
+	}
+}
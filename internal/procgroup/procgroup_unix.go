@@ -0,0 +1,30 @@
+//go:build unix
+
+package procgroup
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// KillOnCancel sets cmd, made with exec.CommandContext, up to start in a
+// process group of its own and to kill the whole group with SIGKILL once its
+// context is done. It returns cmd.
+func KillOnCancel(cmd *exec.Cmd) *exec.Cmd {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		// Negative PID signals the whole process group created by Setpgid
+		err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	cmd.WaitDelay = WaitDelay
+	return cmd
+}
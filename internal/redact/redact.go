@@ -0,0 +1,58 @@
+// Package redact masks secrets (API keys, passwords, tokens) in free-form text
+// before it is sent to an LLM provider or written to disk.
+package redact
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Marker replaces any redacted value.
+const Marker = "<REDACTED>"
+
+// sensitiveKeys are option/variable names whose values are always masked.
+var sensitiveKeys = []string{"password", "passwd", "secret", "token", "psk", "key", "auth", "credential"}
+
+var (
+	// Well-known provider key formats (OpenAI, Anthropic, Gemini) and bearer tokens.
+	tokenPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`sk-ant-[A-Za-z0-9_\-]{10,}`),
+		regexp.MustCompile(`sk-[A-Za-z0-9_\-]{16,}`),
+		regexp.MustCompile(`AIza[0-9A-Za-z_\-]{20,}`),
+		regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._\-]{8,}`),
+	}
+	// key=value and key: value forms, plus UCI "option key 'value'" lines
+	// where the value must be quoted so plain prose is left alone.
+	assignRE = regexp.MustCompile(`(?i)([A-Za-z0-9_.\-]*(?:` + strings.Join(sensitiveKeys, "|") + `)[A-Za-z0-9_.\-]*)(\s*[=:]\s*|\s+)('[^']*'|"[^"]*"|[^\s&]+)`)
+	// Query string parameters such as ?key=... used by the Gemini API.
+	queryRE = regexp.MustCompile(`(?i)([?&](?:key|token|api_key|access_token)=)[^&\s]+`)
+	// JSON string fields such as "access_token": "..." in OAuth responses.
+	jsonRE = regexp.MustCompile(`(?i)("[A-Za-z0-9_.\-]*(?:` + strings.Join(sensitiveKeys, "|") + `)[A-Za-z0-9_.\-]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+)
+
+// String returns s with secrets replaced by Marker.
+func String(s string) string {
+	if s == "" {
+		return s
+	}
+	for _, re := range tokenPatterns {
+		s = re.ReplaceAllString(s, Marker)
+	}
+	s = queryRE.ReplaceAllString(s, "${1}"+Marker)
+	s = jsonRE.ReplaceAllString(s, "${1}\""+Marker+"\"")
+	return assignRE.ReplaceAllStringFunc(s, func(m string) string {
+		parts := assignRE.FindStringSubmatch(m)
+		name, sep, value := parts[1], parts[2], parts[3]
+		quoted := strings.HasPrefix(value, "'") || strings.HasPrefix(value, `"`)
+		if value == Marker || (strings.TrimSpace(sep) == "" && !quoted) {
+			return m
+		}
+		switch {
+		case strings.HasPrefix(value, "'"):
+			return name + sep + "'" + Marker + "'"
+		case strings.HasPrefix(value, `"`):
+			return name + sep + `"` + Marker + `"`
+		}
+		return name + sep + Marker
+	})
+}
@@ -0,0 +1,42 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	cases := []struct {
+		name   string
+		in     string
+		secret string
+		keep   string
+	}{
+		{"openai key", "using sk-abcdefghijklmnopqrstuvwx now", "sk-abcdefghijklmnopqrstuvwx", "using"},
+		{"gemini key", "AIzaSyA1234567890abcdefghijklmnop", "AIzaSyA1234567890abcdefghijklmnop", ""},
+		{"bearer", "Authorization: Bearer abcdef123456", "abcdef123456", "Authorization"},
+		{"assignment", "password=hunter2 user=root", "hunter2", "user=root"},
+		{"uci option", "\toption key 'supersecret'", "supersecret", "option key"},
+		{"query", "https://x/y?key=abc123&alt=json", "abc123", "alt=json"},
+		{"json field", `{"access_token": "ya29.abc\"def", "expires_in": 3600}`, "ya29", `"expires_in": 3600`},
+	}
+	for _, c := range cases {
+		got := String(c.in)
+		if strings.Contains(got, c.secret) {
+			t.Errorf("%s: secret leaked: %q", c.name, got)
+		}
+		if !strings.Contains(got, Marker) {
+			t.Errorf("%s: expected marker in %q", c.name, got)
+		}
+		if c.keep != "" && !strings.Contains(got, c.keep) {
+			t.Errorf("%s: expected %q to be kept in %q", c.name, c.keep, got)
+		}
+	}
+}
+
+func TestString_LeavesProseAlone(t *testing.T) {
+	in := "pppoe authentication failed: the key point is the password prompt"
+	if got := String(in); got != in {
+		t.Errorf("expected prose unchanged, got %q", got)
+	}
+}
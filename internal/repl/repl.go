@@ -5,16 +5,29 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/aezizhu/LuciCodex/internal/approver"
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/docs"
 	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/firewall"
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/intent"
+	"github.com/aezizhu/LuciCodex/internal/jobs"
 	"github.com/aezizhu/LuciCodex/internal/llm"
 	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
 	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
 	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/playbook"
 	"github.com/aezizhu/LuciCodex/internal/policy"
+	"github.com/aezizhu/LuciCodex/internal/rollback"
 	"github.com/aezizhu/LuciCodex/internal/ui"
 )
 
@@ -28,6 +41,10 @@ type REPL struct {
 	maxHistory   int
 	reader       *bufio.Reader
 	writer       io.Writer
+	step         bool // Prompt before each command of an approved plan
+	session      playbook.Recorder
+	vars         map[string]string // Set with let, expanded in prompts
+	touched      []string          // Configs the last plan changed (see rollback.Touched), noted in the next prompt
 }
 
 func New(cfg config.Config, reader io.Reader, writer io.Writer) *REPL {
@@ -35,9 +52,9 @@ func New(cfg config.Config, reader io.Reader, writer io.Writer) *REPL {
 	return &REPL{
 		cfg:          cfg,
 		provider:     llm.NewProvider(cfg),
-		policyEngine: policy.New(cfg),
+		policyEngine: policy.New(cfg).WithControl(openwrt.SSHControlPath(context.Background())).WithTopology(openwrt.DetectTopology(context.Background())).WithFirewall(firewall.Load(context.Background())),
 		execEngine:   executor.New(cfg),
-		logger:       logging.New(cfg.LogFile),
+		logger:       logging.Open(cfg),
 		history:      make([]string, 0, maxHist), // Pre-allocate capacity
 		maxHistory:   maxHist,
 		reader:       bufio.NewReader(reader),
@@ -93,8 +110,32 @@ func (r *REPL) handleCommand(ctx context.Context, line string, output io.Writer)
 	case line == "status":
 		r.showStatus(output)
 		return nil
+	case line == "confirm-change":
+		st, err := rollback.Confirm(r.cfg.RollbackDir)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(output, "Network change confirmed (rollback %s cancelled)\n", st.ID)
+		return nil
+	case strings.HasPrefix(line, "export "):
+		return r.handleExport(strings.Fields(line)[1:], output)
+	case line == "jobs" || strings.HasPrefix(line, "jobs "):
+		return r.handleJobs(strings.Fields(line)[1:], output)
 	case strings.HasPrefix(line, "set "):
 		return r.handleSet(line[4:], output)
+	case strings.HasPrefix(line, "let "):
+		return r.handleLet(ctx, line[4:], output)
+	case line == "vars":
+		r.showVars(output)
+		return nil
+	case strings.HasPrefix(line, "unset "):
+		name := strings.TrimPrefix(strings.TrimSpace(line[6:]), "$")
+		if _, ok := r.vars[name]; !ok {
+			return fmt.Errorf("no variable named %s", name)
+		}
+		delete(r.vars, name)
+		fmt.Fprintf(output, "Removed $%s\n", name)
+		return nil
 	case strings.HasPrefix(line, "!"):
 		return r.handleHistoryCommand(line[1:], ctx, output)
 	default:
@@ -103,46 +144,125 @@ func (r *REPL) handleCommand(ctx context.Context, line string, output io.Writer)
 }
 
 func (r *REPL) executePrompt(ctx context.Context, prompt string, output io.Writer) error {
+	// History keeps the references, so re-running uses the current values
 	r.addToHistory(prompt)
+	prompt = r.expandVars(prompt)
+
+	prompt, attachment, err := expandAttachments(prompt)
+	if err != nil {
+		return err
+	}
 
 	// Build instruction with facts
-	instruction := prompts.GenerateSurvivalPrompt(r.cfg.MaxCommands)
+	kind, limit := intent.ForPrompt(r.cfg, prompt)
+	instruction := prompts.GeneratePlanPrompt(kind, limit)
+	instruction += prompts.ExamplesBlock(prompt, r.cfg.FewShotExamples)
+	instruction += prompts.CommandsBlock(prompt, r.cfg.CommandSnippets)
+	instruction += firewall.PromptBlock(ctx, prompt)
+	instruction += prompts.FeedbackBlock(r.cfg, r.cfg.FeedbackHints)
 	// Collect environment facts for better context
 	factsCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
-	facts := openwrt.CollectFacts(factsCtx)
+	facts := openwrt.CollectSignedFacts(factsCtx, r.cfg.FactsKeyFile)
 	cancel()
-	if facts != "" {
-		instruction += "\n\nEnvironment facts (read-only):\n" + facts
+	if block := facts.PromptBlock(); block != "" {
+		instruction += "\n\n" + block + prompts.FactsRefreshedNotice(r.touched)
+	}
+	r.touched = nil
+
+	if r.cfg.DocsRetrieval {
+		docsCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		if block, err := docs.Retrieve(docsCtx, r.provider, prompt, r.cfg.DocsTopK); err == nil {
+			instruction += block
+		}
+		cancel()
 	}
 
-	fullPrompt := instruction + "\n\nUser request: " + prompt
+	fullPrompt := instruction + "\n\nUser request: " + prompt + attachment
+	if r.cfg.ClarifyRounds == 0 {
+		fullPrompt += prompts.NoQuestionsNotice
+	}
 
 	// Generate plan
 	planCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
 
+	planStart := time.Now()
+	tokensBefore := llm.TokensUsed(r.provider) // The provider lives for the session
 	p, err := r.provider.GeneratePlan(planCtx, fullPrompt)
+	_ = metrics.OpenRollupStore(r.cfg).Record(r.cfg.Provider, len(p.Commands), time.Since(planStart), err)
 	if err != nil {
 		return fmt.Errorf("LLM error: %w", err)
 	}
 
+	var answers []prompts.Clarification
+	for round := 1; round <= r.cfg.ClarifyRounds && len(p.Commands) == 0 && len(p.Questions) > 0; round++ {
+		if p.Summary != "" {
+			fmt.Fprintln(output, p.Summary)
+		}
+		asked := len(answers)
+		for _, q := range p.Questions {
+			answer, err := ui.Ask(r.reader, output, q)
+			if err != nil {
+				break
+			}
+			answers = append(answers, prompts.Clarification{Question: q, Answer: answer})
+		}
+		if len(answers)-asked < len(p.Questions) {
+			answers = answers[:asked]
+			break
+		}
+		clarifyCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		p, err = r.provider.GeneratePlan(clarifyCtx, fullPrompt+prompts.ClarificationBlock(answers, round == r.cfg.ClarifyRounds))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("LLM error: %w", err)
+		}
+	}
+	p.Facts = &facts.Stamp
+
 	if len(p.Commands) == 0 {
 		// Display the LLM's conversational response
 		ui.PrintResponse(output, p)
 		return nil
 	}
 
-	if r.cfg.MaxCommands > 0 && len(p.Commands) > r.cfg.MaxCommands {
-		p.Commands = p.Commands[:r.cfg.MaxCommands]
+	if limit > 0 && len(p.Commands) > limit {
+		fmt.Fprintf(output, "Plan has %d commands, more than the limit of %d; asking for a shorter one...\n", len(p.Commands), limit)
+		limitCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		p, err = llm.FitLimit(limitCtx, r.provider, fullPrompt, p, limit)
+		cancel()
+		if err != nil {
+			r.logger.Rejected(prompt, p, err.Error())
+			return rejected(err)
+		}
+		p.Facts = &facts.Stamp
 	}
 
 	// Validate plan
+	p = r.policyEngine.CheckTools(p)
 	if err := r.policyEngine.ValidatePlan(p); err != nil {
-		return fmt.Errorf("Plan rejected: %w", err)
+		r.logger.Rejected(prompt, p, err.Error())
+		if !r.cfg.SuggestAlternatives {
+			return rejected(err)
+		}
+		fmt.Fprintln(output, "Plan rejected by policy; asking for an alternative...")
+		altCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		alt, altErr := r.policyEngine.Alternative(altCtx, r.provider, fullPrompt+prompts.AlternativeBlock(policy.Explain(err)), err, limit)
+		cancel()
+		if altErr != nil {
+			fmt.Fprintln(output, policy.Explain(altErr))
+			return rejected(err)
+		}
+		alt.Facts = p.Facts
+		p = alt
 	}
+	p.PolicyWarnings = r.policyEngine.Warnings(p)
+	p.Lint = policy.LintPlan(p)
+	p.Estimate = impact.Estimate(r.cfg, p, llm.TokensUsed(r.provider)-tokensBefore)
+	p.FileChanges = r.execEngine.Stage(ctx, p)
 
 	// Show plan
-	ui.PrintPlan(output, p)
+	ui.PrintPlanElevated(output, p, r.cfg.ElevateCommand, r.cfg.FilePaths)
 	r.logger.Plan(prompt, p)
 
 	if r.cfg.DryRun {
@@ -150,33 +270,67 @@ func (r *REPL) executePrompt(ctx context.Context, prompt string, output io.Write
 		return nil
 	}
 
-	// Confirm execution
-	if !r.cfg.AutoApprove {
-		ok, err := ui.Confirm(r.reader, output, "Execute these commands?")
+	// Confirm execution; policy warnings and alternative plans need an
+	// explicit yes even with auto-approve. An approval command decides
+	// instead of the user.
+	if approver.Enabled(r.cfg) {
+		fmt.Fprintln(output, "Waiting for the approval command...")
+		if err := approver.Ask(ctx, r.cfg, approver.Request{Source: "repl", Prompt: prompt, Plan: p}); err != nil {
+			fmt.Fprintf(output, "Not approved: %v\n", err)
+			return nil
+		}
+	} else if !r.cfg.AutoApprove || len(p.PolicyWarnings) > 0 || p.AlternativeTo != "" {
+		question := "Execute these commands?"
+		if len(p.PolicyWarnings) > 0 {
+			question = "Execute these commands despite the policy warnings?"
+		}
+		if p.AlternativeTo != "" {
+			question = "Execute the alternative plan?"
+		}
+		ok, err := ui.Confirm(r.reader, output, question)
+		if w := policy.ControlWarning(p); err == nil && ok && w != nil {
+			ok, err = ui.Confirm(r.reader, output, fmt.Sprintf("Command %d may disconnect this session. Really execute it?", w.Command+1))
+		}
 		if err != nil || !ok {
 			fmt.Fprintln(output, "Cancelled")
 			return nil
 		}
 	}
 
+	st, armed, err := rollback.Guard(r.cfg.RollbackDir, r.cfg.RollbackTimeout, p)
+	if err != nil {
+		return fmt.Errorf("cannot arm network rollback: %w", err)
+	}
+	if armed {
+		fmt.Fprintf(output, "Network settings will be reverted in %ds unless you type confirm-change (rollback %s)\n", r.cfg.RollbackTimeout, st.ID)
+	}
+
 	// Execute with streaming output
-	fmt.Fprintln(output, "\n"+ui.Colorize(ui.Bold, "Executing commands..."))
-	results := r.execEngine.RunPlanStreaming(ctx, p, output)
+	var results executor.Results
+	if r.step {
+		fmt.Fprintln(output, "\n"+ui.Colorize(ui.Bold, "Stepping through commands..."))
+		results = r.stepThrough(ctx, p, output)
+		r.execEngine.Verify(ctx, p, &results)
+	} else {
+		fmt.Fprintln(output, "\n"+ui.Colorize(ui.Bold, "Executing commands..."))
+		results = r.execEngine.RunPlanStreaming(ctx, p, output)
+	}
 	ui.PrintSummary(output, results)
+	done := succeeded(p, results)
+	r.session.Record(prompt, done, p.Facts)
+	if r.touched = rollback.Touched(done); len(r.touched) > 0 {
+		// The device may have become an access point or stopped being one, and
+		// the firewall sections may have changed
+		r.policyEngine = policy.New(r.cfg).WithControl(openwrt.SSHControlPath(ctx)).WithTopology(openwrt.DetectTopology(ctx)).WithFirewall(firewall.Load(ctx))
+	}
 
 	// AI summarization: analyze command output and answer the user's question
 	if len(results.Items) > 0 {
 		summaryCommands := make([]llm.SummaryCommand, 0, len(results.Items))
+		ran := make([][]string, 0, len(results.Items))
 		for _, item := range results.Items {
-			errStr := ""
-			if item.Err != nil {
-				errStr = item.Err.Error()
-			}
-			summaryCommands = append(summaryCommands, llm.SummaryCommand{
-				Command: item.Command,
-				Output:  item.Output,
-				Error:   errStr,
-			})
+			summaryCommands = append(summaryCommands, item.SummaryCommand())
+			ran = append(ran, item.Command)
 		}
 
 		sumCtx, sumCancel := context.WithTimeout(ctx, 30*time.Second)
@@ -184,33 +338,63 @@ func (r *REPL) executePrompt(ctx context.Context, prompt string, output io.Write
 
 		summary, details, err := llm.Summarize(sumCtx, r.cfg, llm.SummaryInput{
 			Commands: summaryCommands,
+			Context:  strings.TrimSpace(attachment),
 			Prompt:   prompt,
+			History:  prompts.SummaryHistoryBlock(r.cfg, prompt, ran, r.cfg.SummaryHistory),
 		})
 		if err == nil {
 			ui.PrintAnswer(output, summary, details)
+			r.logger.Summary(summary, details)
 		}
 	}
 
 	// Audit results
 	items := make([]logging.ResultItem, 0, len(results.Items))
 	for _, it := range results.Items {
-		errStr := ""
-		if it.Err != nil {
-			errStr = it.Err.Error()
-		}
-		items = append(items, logging.ResultItem{
-			Index:   it.Index,
-			Command: it.Command,
-			Output:  it.Output,
-			Error:   errStr,
-			Elapsed: it.Elapsed,
-		})
+		items = append(items, it.LogItem())
 	}
 	r.logger.Results(items)
 
 	return nil
 }
 
+// rejected is the error of a plan the policy denied, with the details of
+// the denial.
+func rejected(err error) error {
+	if d, ok := policy.AsDenial(err); ok {
+		return fmt.Errorf("Plan rejected: %w\n%s", err, d.Explain())
+	}
+	return fmt.Errorf("Plan rejected: %w", err)
+}
+
+// expandAttachments strips @file tokens from the prompt and returns the
+// remaining prompt text along with the formatted attachment blocks.
+func expandAttachments(line string) (string, string, error) {
+	var words []string
+	var attachments strings.Builder
+	for _, word := range strings.Fields(line) {
+		if len(word) < 2 || word[0] != '@' {
+			words = append(words, word)
+			continue
+		}
+		path := word[1:]
+		f, err := os.Open(path)
+		if err != nil {
+			return "", "", fmt.Errorf("attach %s: %w", path, err)
+		}
+		content, truncated, err := prompts.ReadAttachment(f)
+		f.Close()
+		if err != nil {
+			return "", "", fmt.Errorf("attach %s: %w", path, err)
+		}
+		attachments.WriteString(prompts.FormatAttachment(filepath.Base(path), content, truncated))
+	}
+	if attachments.Len() == 0 {
+		return line, "", nil
+	}
+	return strings.Join(words, " "), attachments.String(), nil
+}
+
 func (r *REPL) addToHistory(cmd string) {
 	r.history = append(r.history, cmd)
 	if len(r.history) > r.maxHistory {
@@ -225,9 +409,20 @@ func (r *REPL) showHelp(output io.Writer) {
 	fmt.Fprintln(output, "  clear                   - Clear history")
 	fmt.Fprintln(output, "  status                  - Show current configuration")
 	fmt.Fprintln(output, "  set <key>=<value>       - Change configuration")
+	fmt.Fprintln(output, "  set step=true           - Confirm, skip, edit or fix each command as it runs")
+	fmt.Fprintln(output, "  set temp=0.2            - Tune the model (temp, top_p, max_tokens, reasoning, thinking; =default resets)")
+	fmt.Fprintln(output, "  let <name> = <text>     - Set a variable; $name in later prompts is replaced by its value")
+	fmt.Fprintln(output, "  let <name> = !run <cmd> - Run a command and keep its output in a variable")
+	fmt.Fprintln(output, "  vars, unset <name>      - List or remove variables")
+	fmt.Fprintln(output, "  confirm-change          - Keep network changes and cancel the automatic revert")
+	fmt.Fprintln(output, "  export playbook <file>  - Save the commands that succeeded so far as a playbook")
+	fmt.Fprintln(output, "  jobs                    - List background jobs")
+	fmt.Fprintln(output, "  jobs tail <id> [lines]  - Show recent output of a background job")
+	fmt.Fprintln(output, "  jobs stop <id>          - Stop a background job")
 	fmt.Fprintln(output, "  !<number>               - Re-run command from history")
 	fmt.Fprintln(output, "  exit, quit              - Exit interactive mode")
 	fmt.Fprintln(output, "  <natural language>      - Execute AI-planned commands")
+	fmt.Fprintln(output, "  ... @<file>             - Attach a file's contents to the prompt")
 }
 
 func (r *REPL) showHistory(output io.Writer) {
@@ -250,8 +445,36 @@ func (r *REPL) showStatus(output io.Writer) {
 	fmt.Fprintf(output, "Model: %s\n", r.cfg.Model)
 	fmt.Fprintf(output, "Dry run: %t\n", r.cfg.DryRun)
 	fmt.Fprintf(output, "Auto approve: %t\n", r.cfg.AutoApprove)
-	fmt.Fprintf(output, "Max commands: %d\n", r.cfg.MaxCommands)
+	fmt.Fprintf(output, "Step mode: %t\n", r.step)
+	fmt.Fprintf(output, "Max commands: %d (read %d, write %d)\n", r.cfg.MaxCommands,
+		intent.Limit(r.cfg, intent.Read), intent.Limit(r.cfg, intent.Write))
 	fmt.Fprintf(output, "Timeout: %ds\n", r.cfg.TimeoutSeconds)
+	fmt.Fprintf(output, "Generation: %s\n", generationSummary(r.cfg))
+}
+
+// generationSummary describes the generation parameters that differ from the
+// provider defaults.
+func generationSummary(cfg config.Config) string {
+	var parts []string
+	if cfg.Temperature != nil {
+		parts = append(parts, fmt.Sprintf("temp=%g", *cfg.Temperature))
+	}
+	if cfg.TopP != nil {
+		parts = append(parts, fmt.Sprintf("top_p=%g", *cfg.TopP))
+	}
+	if cfg.MaxOutputTokens > 0 {
+		parts = append(parts, fmt.Sprintf("max_tokens=%d", cfg.MaxOutputTokens))
+	}
+	if cfg.ReasoningEffort != "" {
+		parts = append(parts, "reasoning="+cfg.ReasoningEffort)
+	}
+	if cfg.ThinkingBudget > 0 {
+		parts = append(parts, fmt.Sprintf("thinking=%d", cfg.ThinkingBudget))
+	}
+	if len(parts) == 0 {
+		return "provider defaults"
+	}
+	return strings.Join(parts, " ")
 }
 
 func (r *REPL) handleSet(setting string, output io.Writer) error {
@@ -269,6 +492,9 @@ func (r *REPL) handleSet(setting string, output io.Writer) error {
 	case "auto-approve":
 		r.cfg.AutoApprove = value == "true"
 		fmt.Fprintf(output, "Set auto-approve to %t\n", r.cfg.AutoApprove)
+	case "step":
+		r.step = value == "true"
+		fmt.Fprintf(output, "Set step to %t\n", r.step)
 	case "provider":
 		r.cfg.Provider = value
 		r.cfg.ApplyProviderSettings() // Apply provider-specific defaults
@@ -278,6 +504,8 @@ func (r *REPL) handleSet(setting string, output io.Writer) error {
 		r.cfg.Model = value
 		r.provider = llm.NewProvider(r.cfg)
 		fmt.Fprintf(output, "Set model to %s\n", r.cfg.Model)
+	case "temp", "temperature", "top_p", "max_tokens", "reasoning", "thinking":
+		return r.setGeneration(key, value, output)
 	default:
 		return fmt.Errorf("unknown setting: %s", key)
 	}
@@ -285,6 +513,101 @@ func (r *REPL) handleSet(setting string, output io.Writer) error {
 	return nil
 }
 
+// setGeneration updates a model generation parameter. "default" (or an empty
+// value) restores the provider default.
+func (r *REPL) setGeneration(key, value string, output io.Writer) error {
+	cfg := r.cfg
+	reset := value == "" || value == "default"
+	parseFloat := func() (*float64, error) {
+		if reset {
+			return nil, nil
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", key, value)
+		}
+		return &f, nil
+	}
+	parseInt := func() (int, error) {
+		if reset {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %s", key, value)
+		}
+		return n, nil
+	}
+
+	var err error
+	switch key {
+	case "temp", "temperature":
+		cfg.Temperature, err = parseFloat()
+	case "top_p":
+		cfg.TopP, err = parseFloat()
+	case "max_tokens":
+		cfg.MaxOutputTokens, err = parseInt()
+	case "thinking":
+		cfg.ThinkingBudget, err = parseInt()
+	case "reasoning":
+		cfg.ReasoningEffort = value
+		if reset {
+			cfg.ReasoningEffort = ""
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := cfg.ValidateGeneration(); err != nil {
+		return err
+	}
+
+	r.cfg = cfg
+	r.provider = llm.NewProvider(r.cfg)
+	if reset {
+		value = "provider default"
+	}
+	fmt.Fprintf(output, "Set %s to %s\n", key, value)
+	return nil
+}
+
+func (r *REPL) handleJobs(args []string, output io.Writer) error {
+	m := jobs.Open(r.cfg)
+	if len(args) == 0 || (len(args) == 1 && args[0] == "list") {
+		list, err := m.List()
+		if err != nil {
+			return err
+		}
+		jobs.PrintTable(output, list)
+		return nil
+	}
+	switch {
+	case args[0] == "tail" && (len(args) == 2 || len(args) == 3):
+		lines := 20
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid line count: %s", args[2])
+			}
+			lines = n
+		}
+		out, err := m.Tail(args[1], lines)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(output, out)
+		return nil
+	case args[0] == "stop" && len(args) == 2:
+		j, err := m.Stop(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(output, "Stopped job %s (%s)\n", j.ID, executor.FormatCommand(j.Command))
+		return nil
+	}
+	return fmt.Errorf("usage: jobs [list|tail <id> [lines]|stop <id>]")
+}
+
 func (r *REPL) handleHistoryCommand(indexStr string, ctx context.Context, output io.Writer) error {
 	if len(r.history) == 0 {
 		return fmt.Errorf("no history")
@@ -307,3 +630,49 @@ func (r *REPL) handleHistoryCommand(indexStr string, ctx context.Context, output
 	fmt.Fprintf(output, "Re-running: %s\n", cmd)
 	return r.executePrompt(ctx, cmd, output)
 }
+
+// handleExport implements `export playbook <file>`.
+func (r *REPL) handleExport(args []string, output io.Writer) error {
+	if len(args) != 2 || args[0] != "playbook" {
+		return fmt.Errorf("usage: export playbook <file>")
+	}
+	if r.session.Len() == 0 {
+		return fmt.Errorf("no commands have succeeded in this session")
+	}
+	if err := playbook.Save(args[1], r.session.Playbook()); err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Saved %d step(s) to %s; run them with: lucicodex playbook %s\n", r.session.Len(), args[1], args[1])
+	return nil
+}
+
+// succeeded returns the plan as it was actually carried out: the commands
+// that ran without error, including steps edited or added as fixes while
+// stepping, in the order they ran.
+func succeeded(p plan.Plan, results executor.Results) plan.Plan {
+	out := plan.Plan{Summary: p.Summary}
+	for _, it := range results.Items {
+		if it.Err != nil {
+			continue
+		}
+		pc := plan.PlannedCommand{Command: it.Command, Pipe: it.Pipe, NeedsRoot: it.NeedsRoot}
+		if it.Index < len(p.Commands) && sameCommand(p.Commands[it.Index], pc) {
+			pc = p.Commands[it.Index] // Keep the description and options
+		}
+		out.Commands = append(out.Commands, pc)
+	}
+	return out
+}
+
+func sameCommand(a, b plan.PlannedCommand) bool {
+	as, bs := a.Stages(), b.Stages()
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		if strings.Join(as[i], "\x00") != strings.Join(bs[i], "\x00") {
+			return false
+		}
+	}
+	return true
+}
@@ -4,21 +4,26 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/aezizhu/LuciCodex/internal/config"
 	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/playbook"
 	"github.com/aezizhu/LuciCodex/internal/testutil"
 )
 
 // MockProvider implements llm.Provider for testing
 type MockProvider struct {
-	Plan plan.Plan
-	Err  error
+	Plan       plan.Plan
+	Err        error
+	LastPrompt string
 }
 
 func (m *MockProvider) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	m.LastPrompt = prompt
 	return m.Plan, m.Err
 }
 
@@ -157,6 +162,32 @@ exit
 	testutil.AssertContains(t, outStr, "usage: set key=value")
 }
 
+func TestREPL_SetGeneration(t *testing.T) {
+	input := `set temp=0.2
+set max_tokens=900
+set reasoning=high
+set top_p=5
+set temp=abc
+status
+set temp=default
+exit
+`
+	var output bytes.Buffer
+	r := New(config.Config{Provider: "openai"}, strings.NewReader(input), &output)
+	testutil.AssertNoError(t, r.Run(context.Background()))
+
+	outStr := testutil.StripAnsi(output.String())
+	testutil.AssertContains(t, outStr, "Set temp to 0.2")
+	testutil.AssertContains(t, outStr, "top_p must be in (0, 1]")
+	testutil.AssertContains(t, outStr, "invalid temp: abc")
+	testutil.AssertContains(t, outStr, "Generation: temp=0.2 max_tokens=900 reasoning=high")
+	testutil.AssertContains(t, outStr, "Set temp to provider default")
+	if r.cfg.Temperature != nil || r.cfg.TopP != nil {
+		t.Errorf("expected temperature reset and top_p unchanged, got %v %v", r.cfg.Temperature, r.cfg.TopP)
+	}
+	testutil.AssertEqual(t, r.cfg.MaxOutputTokens, 900)
+}
+
 func TestREPL_LLMError(t *testing.T) {
 	input := "do something\nexit\n"
 	var output bytes.Buffer
@@ -236,15 +267,17 @@ func TestREPL_MaxCommands(t *testing.T) {
 			{Command: []string{"echo", "2"}},
 		},
 	}
-	r.provider = &MockProvider{Plan: mockPlan}
+	mock := &MockProvider{Plan: mockPlan}
+	r.provider = mock
 
 	err := r.Run(context.Background())
 	testutil.AssertNoError(t, err)
 
-	// Should only show first command
+	// The plan is asked for again, and refused rather than cut short
 	outStr := testutil.StripAnsi(output.String())
-	testutil.AssertContains(t, outStr, "echo 1")
-	testutil.AssertNotContains(t, outStr, "echo 2")
+	testutil.AssertContains(t, mock.LastPrompt, "at most 1 are allowed")
+	testutil.AssertContains(t, outStr, "more than the limit of 1")
+	testutil.AssertNotContains(t, outStr, "echo 1")
 }
 
 func TestREPL_ConfirmationCancellation(t *testing.T) {
@@ -362,3 +395,248 @@ func TestREPL_ExecutionResults(t *testing.T) {
 	outStr := testutil.StripAnsi(output.String())
 	testutil.AssertContains(t, outStr, "echo test")
 }
+
+func TestREPL_FactsRefreshed(t *testing.T) {
+	r := New(config.Config{Provider: "test", DryRun: true}, strings.NewReader(""), &bytes.Buffer{})
+	mock := &MockProvider{Plan: plan.Plan{Summary: "Nothing to do"}}
+	r.provider = mock
+	r.touched = []string{"network", "wireless"}
+
+	testutil.AssertNoError(t, r.executePrompt(context.Background(), "show the LAN address", &bytes.Buffer{}))
+	testutil.AssertContains(t, mock.LastPrompt, "Facts refreshed: an earlier plan of this session changed the network, wireless configuration")
+	testutil.AssertNoError(t, r.executePrompt(context.Background(), "show the LAN address", &bytes.Buffer{}))
+	if strings.Contains(mock.LastPrompt, "Facts refreshed") {
+		t.Error("the notice should only follow the first prompt after the change")
+	}
+}
+
+func TestREPL_FileAttachment(t *testing.T) {
+	logPath := testutil.TempFile(t, "pppd: PAP authentication failed\npassword=hunter2\n")
+
+	input := "why is pppoe failing @" + logPath + "\nexit\n"
+	var output bytes.Buffer
+	cfg := config.Config{Provider: "test", DryRun: true}
+
+	r := New(cfg, strings.NewReader(input), &output)
+	mock := &MockProvider{Plan: plan.Plan{Summary: "ok"}}
+	r.provider = mock
+
+	testutil.AssertNoError(t, r.Run(context.Background()))
+
+	testutil.AssertContains(t, mock.LastPrompt, "User request: why is pppoe failing")
+	testutil.AssertContains(t, mock.LastPrompt, "PAP authentication failed")
+	testutil.AssertNotContains(t, mock.LastPrompt, "hunter2")
+	testutil.AssertNotContains(t, mock.LastPrompt, "@"+logPath)
+}
+
+func TestREPL_FileAttachmentMissing(t *testing.T) {
+	input := "explain @/nonexistent/file.txt\nexit\n"
+	var output bytes.Buffer
+	cfg := config.Config{Provider: "test", DryRun: true}
+
+	r := New(cfg, strings.NewReader(input), &output)
+	r.provider = &MockProvider{}
+
+	testutil.AssertNoError(t, r.Run(context.Background()))
+	testutil.AssertContains(t, output.String(), "attach /nonexistent/file.txt")
+}
+
+// stepProvider returns separate plans for the request and for error fixes
+type stepProvider struct {
+	Plan plan.Plan
+	Fix  plan.Plan
+}
+
+func (s *stepProvider) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	return s.Plan, nil
+}
+
+func (s *stepProvider) GenerateErrorFix(ctx context.Context, cmd, output string, attempt int) (plan.Plan, error) {
+	return s.Fix, nil
+}
+
+func TestREPL_StepThrough(t *testing.T) {
+	input := strings.Join([]string{
+		"set step=true",
+		"do things",
+		"y",           // approve plan
+		"s",           // skip echo one
+		"e",           // edit echo two
+		"rm -rf /tmp", // rejected by policy
+		"e",           // edit again
+		"echo edited", // accepted
+		"",            // run (default)
+		"r",           // run false
+		"f",           // ask AI to fix
+		"r",           // run queued fix
+		"exit",
+	}, "\n") + "\n"
+	var output bytes.Buffer
+	cfg := config.Config{Provider: "test", DryRun: false, Denylist: []string{"^rm"}}
+	r := New(cfg, strings.NewReader(input), &output)
+	r.provider = &stepProvider{
+		Plan: plan.Plan{Summary: "Steps", Commands: []plan.PlannedCommand{
+			{Command: []string{"echo", "one"}},
+			{Command: []string{"echo", "two"}},
+			{Command: []string{"false"}},
+		}},
+		Fix: plan.Plan{Summary: "Fix", Commands: []plan.PlannedCommand{{Command: []string{"echo", "fixed"}}}},
+	}
+
+	err := r.Run(context.Background())
+	testutil.AssertNoError(t, err)
+
+	out := testutil.StripAnsi(output.String())
+	testutil.AssertContains(t, out, "Set step to true")
+	testutil.AssertContains(t, out, "Step 1/3: echo one")
+	testutil.AssertContains(t, out, "Skipped")
+	testutil.AssertContains(t, out, "Edit rejected")
+	testutil.AssertContains(t, out, "Step 2/3: echo edited")
+	testutil.AssertContains(t, out, "Fix plan (queued as next steps)")
+	testutil.AssertContains(t, out, "Step 4/4: echo fixed")
+	if strings.Contains(out, "Executing: echo one") {
+		t.Errorf("skipped step was executed: %s", out)
+	}
+	testutil.AssertContains(t, out, "fixed")
+}
+
+func TestREPL_StepThroughAbort(t *testing.T) {
+	input := "set step=true\ndo things\ny\na\nexit\n"
+	var output bytes.Buffer
+	r := New(config.Config{Provider: "test", DryRun: false}, strings.NewReader(input), &output)
+	r.provider = &MockProvider{Plan: plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"echo", "never"}}}}}
+
+	testutil.AssertNoError(t, r.Run(context.Background()))
+	out := testutil.StripAnsi(output.String())
+	testutil.AssertContains(t, out, "Aborted")
+	if strings.Contains(out, "Executing: echo never") {
+		t.Errorf("command ran after abort: %s", out)
+	}
+}
+
+func TestREPL_ExportPlaybook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.yaml")
+	input := strings.Join([]string{
+		"export playbook " + path, // nothing succeeded yet
+		"set step=true",
+		"do things",
+		"y",           // approve plan
+		"e",           // edit echo one
+		"echo edited", // accepted
+		"",            // run
+		"",            // run false
+		"f",           // ask AI to fix
+		"r",           // run queued fix
+		"export playbook " + path,
+		"exit",
+	}, "\n") + "\n"
+	var output bytes.Buffer
+	cfg := config.Config{Provider: "test", DryRun: false}
+	r := New(cfg, strings.NewReader(input), &output)
+	r.provider = &stepProvider{
+		Plan: plan.Plan{Summary: "Steps", Commands: []plan.PlannedCommand{
+			{Command: []string{"echo", "one"}},
+			{Command: []string{"false"}},
+		}},
+		Fix: plan.Plan{Summary: "Fix", Commands: []plan.PlannedCommand{{Command: []string{"echo", "fixed"}}}},
+	}
+
+	testutil.AssertNoError(t, r.Run(context.Background()))
+	out := testutil.StripAnsi(output.String())
+	testutil.AssertContains(t, out, "Error: no commands have succeeded in this session")
+	testutil.AssertContains(t, out, "Saved 1 step(s) to "+path)
+
+	pb, err := playbook.Load(path)
+	testutil.AssertNoError(t, err)
+	if len(pb.Steps) != 1 || pb.Steps[0].Prompt != "do things" {
+		t.Fatalf("unexpected steps: %+v", pb.Steps)
+	}
+	var got [][]string
+	for _, c := range pb.Steps[0].Plan.Commands {
+		got = append(got, c.Command)
+	}
+	// The failed command is left out; the edit and the fix are kept
+	if want := [][]string{{"echo", "edited"}, {"echo", "fixed"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("playbook commands = %v, want %v", got, want)
+	}
+}
+
+func TestREPL_Variables(t *testing.T) {
+	input := strings.Join([]string{
+		"let wanip = !run echo 203.0.113.7",
+		"let gw = via-${wanip}",
+		"why is $wanip unreachable $gw, not $HOME",
+		"vars",
+		"unset wanip",
+		"let 1x = a",
+		"let bad = !run rm -rf /tmp/x",
+		"exit",
+	}, "\n") + "\n"
+	var output bytes.Buffer
+	mock := &MockProvider{Plan: plan.Plan{Summary: "Answer"}}
+	r := New(config.Config{Provider: "test", DryRun: false, Denylist: []string{"^rm"}}, strings.NewReader(input), &output)
+	r.provider = mock
+
+	testutil.AssertNoError(t, r.Run(context.Background()))
+	out := testutil.StripAnsi(output.String())
+	testutil.AssertContains(t, mock.LastPrompt, "User request: why is 203.0.113.7 unreachable via-203.0.113.7, not $HOME")
+	testutil.AssertContains(t, out, "$wanip = 203.0.113.7")
+	testutil.AssertContains(t, out, "$gw              via-203.0.113.7")
+	testutil.AssertContains(t, out, "Removed $wanip")
+	testutil.AssertContains(t, out, `invalid variable name "1x"`)
+	testutil.AssertContains(t, out, "command rejected")
+	if r.history[0] != "why is $wanip unreachable $gw, not $HOME" {
+		t.Errorf("history should keep the references, got %q", r.history[0])
+	}
+
+	// Commands are not run in dry-run mode
+	output.Reset()
+	r = New(config.Config{Provider: "test", DryRun: true}, strings.NewReader("let x = !run echo hi\nvars\nexit\n"), &output)
+	testutil.AssertNoError(t, r.Run(context.Background()))
+	out = testutil.StripAnsi(output.String())
+	testutil.AssertContains(t, out, "dry run mode")
+	testutil.AssertContains(t, out, "No variables")
+}
+
+// clarifyProvider asks a question first and plans once it is answered
+type clarifyProvider struct {
+	Prompts []string
+}
+
+func (c *clarifyProvider) GeneratePlan(ctx context.Context, prompt string) (plan.Plan, error) {
+	c.Prompts = append(c.Prompts, prompt)
+	if len(c.Prompts) == 1 {
+		return plan.Plan{Summary: "Which one?", Questions: []string{"Which device should be blocked?"}}, nil
+	}
+	return plan.Plan{Summary: "Block it", Commands: []plan.PlannedCommand{{Command: []string{"echo", "block"}}}}, nil
+}
+
+func (c *clarifyProvider) GenerateErrorFix(ctx context.Context, cmd, output string, attempt int) (plan.Plan, error) {
+	return plan.Plan{}, nil
+}
+
+func TestREPL_Clarify(t *testing.T) {
+	var output bytes.Buffer
+	p := &clarifyProvider{}
+	r := New(config.Config{Provider: "test", DryRun: true, ClarifyRounds: 1}, strings.NewReader("block that device\nthe laptop\nexit\n"), &output)
+	r.provider = p
+
+	testutil.AssertNoError(t, r.Run(context.Background()))
+	if len(p.Prompts) != 2 {
+		t.Fatalf("expected 2 generations, got %d", len(p.Prompts))
+	}
+	testutil.AssertContains(t, p.Prompts[1], "Q: Which device should be blocked?\nA: the laptop")
+	out := testutil.StripAnsi(output.String())
+	testutil.AssertContains(t, out, "Which device should be blocked?")
+	testutil.AssertContains(t, out, "echo block")
+
+	// With no rounds the model is told not to ask
+	p = &clarifyProvider{}
+	r = New(config.Config{Provider: "test", DryRun: true}, strings.NewReader("block that device\nexit\n"), &output)
+	r.provider = p
+	testutil.AssertNoError(t, r.Run(context.Background()))
+	if len(p.Prompts) != 1 {
+		t.Fatalf("expected 1 generation, got %d", len(p.Prompts))
+	}
+	testutil.AssertContains(t, p.Prompts[0], "cannot answer questions")
+}
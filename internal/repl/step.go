@@ -0,0 +1,153 @@
+package repl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// stepThrough executes an approved plan one command at a time. Before each
+// command the user can run, skip, edit or abort; after a failure they can ask
+// the AI for a fix, whose commands are queued as the next steps.
+func (r *REPL) stepThrough(ctx context.Context, p plan.Plan, output io.Writer) executor.Results {
+	steps := append([]plan.PlannedCommand(nil), p.Commands...)
+	results := executor.Results{Items: make([]executor.Result, 0, len(steps))}
+	attempts := 0
+
+	for i := 0; i < len(steps); i++ {
+		pc := steps[i]
+		fmt.Fprintf(output, "\n%s %s\n", ui.Colorize(ui.Bold, fmt.Sprintf("Step %d/%d:", i+1, len(steps))), executor.FormatPlanned(pc))
+		if pc.Description != "" {
+			fmt.Fprintf(output, "  %s\n", pc.Description)
+		}
+
+		switch r.readStepAction(output, "[r]un, [s]kip, [e]dit, [a]bort", "r") {
+		case "s":
+			fmt.Fprintln(output, "Skipped")
+			continue
+		case "a":
+			fmt.Fprintln(output, "Aborted")
+			return results
+		case "e":
+			if edited, ok := r.editStep(i, pc, output); ok {
+				steps[i] = edited
+			}
+			i-- // Show the step again
+			continue
+		case "r":
+		default:
+			fmt.Fprintln(output, "Unknown action")
+			i--
+			continue
+		}
+
+		res := r.execEngine.RunCommandStreaming(ctx, i, pc, output)
+		results.Items = append(results.Items, res)
+		if res.Err == nil {
+			continue
+		}
+		results.Failed++
+
+	failed:
+		for {
+			switch r.readStepAction(output, "Step failed: [f]ix with AI, [r]etry, [c]ontinue, [a]bort", "c") {
+			case "f":
+				attempts++
+				fix, ok := r.planFix(ctx, res, attempts, output)
+				if !ok {
+					continue
+				}
+				// Queue fix commands right after the failed step
+				rest := append(fix.Commands, steps[i+1:]...)
+				steps = append(steps[:i+1], rest...)
+				break failed
+			case "r":
+				i--
+				break failed
+			case "c":
+				break failed
+			case "a":
+				fmt.Fprintln(output, "Aborted")
+				return results
+			default:
+				fmt.Fprintln(output, "Unknown action")
+			}
+		}
+	}
+	return results
+}
+
+// readStepAction prompts for a single-letter action; EOF aborts.
+func (r *REPL) readStepAction(output io.Writer, choices, def string) string {
+	fmt.Fprintf(output, "%s (default %s): ", ui.Colorize(ui.Blue, choices), def)
+	line, err := r.reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "a"
+	}
+	line = strings.ToLower(strings.TrimSpace(line))
+	if line == "" {
+		return def
+	}
+	return line[:1]
+}
+
+// editStep reads a replacement argv for step i. The line is split on
+// whitespace, never by a shell, and must pass the policy engine.
+func (r *REPL) editStep(i int, pc plan.PlannedCommand, output io.Writer) (plan.PlannedCommand, bool) {
+	fmt.Fprintf(output, "New command (was: %s): ", executor.FormatPlanned(pc))
+	line, err := r.reader.ReadString('\n')
+	if err != nil && line == "" {
+		return pc, false
+	}
+	argv := strings.Fields(line)
+	if len(argv) == 0 {
+		fmt.Fprintln(output, "Unchanged")
+		return pc, false
+	}
+	edited := pc
+	edited.Command = argv
+	edited.Pipe = nil
+	if err := r.policyEngine.ValidateCommand(i, edited); err != nil {
+		fmt.Fprintf(output, "Edit rejected: %v\n", err)
+		return pc, false
+	}
+	return edited, true
+}
+
+// planFix asks the provider for a fix for a failed step and validates it.
+func (r *REPL) planFix(ctx context.Context, res executor.Result, attempt int, output io.Writer) (plan.Plan, bool) {
+	errOutput := res.Output
+	if strings.TrimSpace(errOutput) == "" && res.Err != nil {
+		errOutput = res.Err.Error()
+	}
+	fixCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	fix, err := r.provider.GenerateErrorFix(fixCtx, executor.FormatPlanned(plan.PlannedCommand{Command: res.Command, Pipe: res.Pipe}), errOutput, attempt)
+	if err != nil {
+		fmt.Fprintf(output, "Failed to generate fix: %v\n", err)
+		return fix, false
+	}
+	if len(fix.Commands) == 0 {
+		fmt.Fprintln(output, "No fix commands generated")
+		return fix, false
+	}
+	if err := r.policyEngine.ValidatePlan(fix); err != nil {
+		fmt.Fprintf(output, "Fix plan rejected by policy: %v\n", err)
+		return fix, false
+	}
+	// Each queued step is still confirmed, which acknowledges any warning
+	fix.PolicyWarnings = r.policyEngine.Warnings(fix)
+	if prompts.Suspicious(res.Output) {
+		fmt.Fprintln(output, "Warning: the failed command's output contains instruction-like text; check the fix before running it")
+	}
+	fmt.Fprintln(output, "Fix plan (queued as next steps):")
+	ui.PrintPlanElevated(output, fix, r.cfg.ElevateCommand, r.cfg.FilePaths)
+	return fix, true
+}
@@ -0,0 +1,138 @@
+package repl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/ui"
+)
+
+// maxVarSize bounds a captured value, which ends up in every prompt that
+// references it.
+const maxVarSize = 16 * 1024
+
+var (
+	reVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	reVarRef  = regexp.MustCompile(`\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))`)
+)
+
+// expandVars replaces $name and ${name} with the values of session
+// variables. References to unknown names are left as they are, so prompts
+// may still mention shell variables.
+func (r *REPL) expandVars(s string) string {
+	if len(r.vars) == 0 {
+		return s
+	}
+	return reVarRef.ReplaceAllStringFunc(s, func(ref string) string {
+		m := reVarRef.FindStringSubmatch(ref)
+		name := m[1] + m[2]
+		if v, ok := r.vars[name]; ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// handleLet implements `let <name> = <text>` and `let <name> = !run
+// <command>`. The command is split on whitespace, never by a shell, after
+// expanding variables, and runs under the policy like a planned command.
+func (r *REPL) handleLet(ctx context.Context, def string, output io.Writer) error {
+	name, value, ok := strings.Cut(def, "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || name == "" {
+		return fmt.Errorf("usage: let <name> = <text> | !run <command>")
+	}
+	if !reVarName.MatchString(name) {
+		return fmt.Errorf("invalid variable name %q: use letters, digits and _", name)
+	}
+
+	cmdline, isRun := strings.CutPrefix(value, "!run ")
+	if !isRun {
+		r.setVar(name, r.expandVars(value), output)
+		return nil
+	}
+	argv := strings.Fields(r.expandVars(cmdline))
+	if len(argv) == 0 {
+		return fmt.Errorf("usage: let <name> = !run <command>")
+	}
+	if r.cfg.DryRun {
+		return fmt.Errorf("dry run mode - no execution (set dry-run=false to capture command output)")
+	}
+	pc := plan.PlannedCommand{Command: argv}
+	if err := r.policyEngine.ValidateCommand(0, pc); err != nil {
+		return fmt.Errorf("command rejected: %w", err)
+	}
+	p := plan.Plan{Summary: "let " + name, Commands: []plan.PlannedCommand{pc}}
+	if w := r.policyEngine.Warnings(p); len(w) > 0 {
+		fmt.Fprintf(output, "%s %s\n", ui.Colorize(ui.Yellow, "Warning:"), w[0].Message)
+		ok, err := ui.Confirm(r.reader, output, "Run it anyway?")
+		if err != nil || !ok {
+			fmt.Fprintln(output, "Cancelled")
+			return nil
+		}
+	}
+
+	r.logger.Plan("let "+name+" = !run "+cmdline, p)
+	res := r.execEngine.RunCommand(ctx, 0, pc)
+	r.logger.Results([]logging.ResultItem{res.LogItem()})
+	if res.Err != nil {
+		if out := strings.TrimSpace(res.Output); out != "" {
+			fmt.Fprintln(output, out)
+		}
+		return fmt.Errorf("%s failed: %w", executor.FormatCommand(argv), res.Err)
+	}
+	if prompts.Suspicious(res.Output) {
+		fmt.Fprintln(output, "Warning: the output contains instruction-like text; check $"+name+" before using it in a prompt")
+	}
+	r.setVar(name, strings.TrimRight(res.Output, "\n"), output)
+	return nil
+}
+
+// setVar stores a variable, truncated to maxVarSize.
+func (r *REPL) setVar(name, value string, output io.Writer) {
+	if len(value) > maxVarSize {
+		value = value[:maxVarSize]
+		fmt.Fprintf(output, "Note: $%s truncated to %d bytes\n", name, maxVarSize)
+	}
+	if r.vars == nil {
+		r.vars = map[string]string{}
+	}
+	r.vars[name] = value
+	fmt.Fprintf(output, "$%s = %s\n", name, preview(value))
+}
+
+// showVars lists the session variables.
+func (r *REPL) showVars(output io.Writer) {
+	if len(r.vars) == 0 {
+		fmt.Fprintln(output, "No variables")
+		return
+	}
+	names := make([]string, 0, len(r.vars))
+	for name := range r.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(output, "$%-15s %s\n", name, preview(r.vars[name]))
+	}
+}
+
+// preview shortens a value to its first line.
+func preview(v string) string {
+	first, _, multi := strings.Cut(v, "\n")
+	if len(first) > 60 {
+		first, multi = first[:60], true
+	}
+	if multi {
+		return fmt.Sprintf("%s... (%d lines, %d bytes)", first, strings.Count(v, "\n")+1, len(v))
+	}
+	return first
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package rollback
+
+import "os/exec"
+
+// detach is only implemented on Unix (sessions).
+func detach(cmd *exec.Cmd) {}
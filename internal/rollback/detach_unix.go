@@ -0,0 +1,14 @@
+//go:build unix
+
+package rollback
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detach starts cmd in a new session, so it outlives the session that
+// armed the rollback.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
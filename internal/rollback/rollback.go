@@ -0,0 +1,459 @@
+// Package rollback protects remote sessions from plans that cut off network
+// access. Before such a plan runs, the network related UCI configs are copied
+// aside and a watchdog is armed; unless the change is confirmed in time, the
+// snapshot is restored and the affected services are restarted, similar to
+// LuCI's apply/rollback.
+package rollback
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/artifacts"
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// DefaultDir holds the pending snapshot (tmpfs on OpenWrt, so a reboot also
+// discards a stale rollback).
+const DefaultDir = "/tmp/lucicodex-rollback"
+
+// ConfigDir is the UCI config directory; tests point it elsewhere.
+var ConfigDir = "/etc/config"
+
+// Configs are the UCI packages that are snapshotted and restored.
+var Configs = []string{"network", "firewall", "wireless", "dhcp"}
+
+// restartCommands bring each config's service in line with the restored file.
+var restartCommands = map[string][]string{
+	"network":  {"/etc/init.d/network", "restart"},
+	"firewall": {"/etc/init.d/firewall", "restart"},
+	"wireless": {"wifi", "reload"},
+	"dhcp":     {"/etc/init.d/dnsmasq", "restart"},
+}
+
+var (
+	// ErrPending is returned when arming while an earlier change is unconfirmed.
+	ErrPending = errors.New("a previous network change is awaiting confirmation (run `lucicodex confirm-change`)")
+	// ErrNothingPending is returned when confirming with no armed rollback.
+	ErrNothingPending = errors.New("no network change is awaiting confirmation")
+)
+
+// State describes an armed rollback.
+type State struct {
+	ID        string    `json:"id"`
+	Armed     time.Time `json:"armed"`
+	Deadline  time.Time `json:"deadline"`
+	ConfigDir string    `json:"config_dir"`
+	Configs   []string  `json:"configs"` // Configs that existed when the snapshot was taken
+}
+
+// Remaining returns the time left before the revert.
+func (s State) Remaining() time.Duration {
+	if d := time.Until(s.Deadline); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Reverted records a rollback that was carried out.
+type Reverted struct {
+	State
+	Time   time.Time `json:"time"`
+	Errors []string  `json:"errors,omitempty"`
+}
+
+func statePath(dir string) string    { return filepath.Join(dir, "state.json") }
+func revertedPath(dir string) string { return filepath.Join(dir, "reverted.json") }
+func snapshotDir(dir string) string  { return filepath.Join(dir, "snapshot") }
+
+// isNetworkConfig reports whether a uci package is one of Configs.
+func isNetworkConfig(name string) bool {
+	for _, c := range Configs {
+		if name == c {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceActions are init script and fw4 actions that change running state.
+var serviceActions = map[string]bool{
+	"start": true, "stop": true, "restart": true, "reload": true, "flush": true,
+}
+
+// Affects reports whether any command in p may change network connectivity.
+func Affects(p plan.Plan) bool {
+	return len(Touched(p)) > 0
+}
+
+// Touched returns the Configs, in their order, whose settings or running
+// state the commands of p may change.
+func Touched(p plan.Plan) []string {
+	touched := map[string]bool{}
+	for _, c := range p.Commands {
+		for _, name := range touchedBy(c.Command) {
+			touched[name] = true
+		}
+	}
+	var out []string
+	for _, name := range Configs {
+		if touched[name] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// serviceConfigs are the Configs behind the init scripts that apply them.
+var serviceConfigs = map[string]string{
+	"network": "network", "firewall": "firewall", "dnsmasq": "dhcp", "odhcpd": "dhcp",
+}
+
+func touchedBy(argv []string) []string {
+	if len(argv) == 0 {
+		return nil
+	}
+	argv = plan.InitArgv(argv)
+	name := path.Base(argv[0])
+	args := argv[1:]
+	switch {
+	case argv[0] == plan.FileWrite:
+		// Writing a network config file directly, bypassing uci
+		if len(args) > 0 && path.Dir(path.Clean(args[0])) == "/etc/config" && isNetworkConfig(path.Base(args[0])) {
+			return []string{path.Base(args[0])}
+		}
+	case name == "uci":
+		return uciTouched(args)
+	case strings.HasPrefix(argv[0], "/etc/init.d/"):
+		if c, ok := serviceConfigs[name]; ok && len(args) > 0 && serviceActions[args[0]] {
+			return []string{c}
+		}
+	case name == "fw4" || name == "fw3":
+		if len(args) > 0 && serviceActions[args[0]] {
+			return []string{"firewall"}
+		}
+	case name == "wifi":
+		if len(args) == 0 || args[0] != "status" {
+			return []string{"wireless"}
+		}
+	case name == "iw":
+		return []string{"wireless"}
+	case name == "ifup" || name == "ifdown" || name == "brctl":
+		return []string{"network"}
+	case name == "ip":
+		if impact.IsIPWrite(args) {
+			return []string{"network"}
+		}
+	case name == "ubus":
+		// ubus call network[.interface.x] <method>
+		if len(args) >= 3 && args[0] == "call" && strings.HasPrefix(args[1], "network") &&
+			args[2] != "status" && args[2] != "dump" {
+			return []string{"network"}
+		}
+	}
+	return nil
+}
+
+func uciTouched(args []string) []string {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-c" || a == "-d" || a == "-f" || a == "-p" || a == "-P":
+			i++
+			continue
+		case strings.HasPrefix(a, "-"):
+			continue
+		}
+		switch a {
+		case "set", "add", "add_list", "del_list", "delete", "rename", "reorder", "commit", "revert", "import", "batch":
+		default:
+			return nil
+		}
+		if i+1 >= len(args) {
+			// Bare commit/import/batch may touch every package
+			if a == "commit" || a == "import" || a == "batch" {
+				return Configs
+			}
+			return nil
+		}
+		pkg := args[i+1]
+		if j := strings.IndexAny(pkg, ".="); j >= 0 {
+			pkg = pkg[:j]
+		}
+		if isNetworkConfig(pkg) {
+			return []string{pkg}
+		}
+		return nil
+	}
+	return nil
+}
+
+func readState(dir string) (State, error) {
+	var st State
+	data, err := os.ReadFile(statePath(dir))
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("parse rollback state: %w", err)
+	}
+	return st, nil
+}
+
+func writeJSON(p string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Pending returns the armed rollback in dir, if any.
+func Pending(dir string) (State, bool, error) {
+	st, err := readState(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, false, nil
+		}
+		return st, false, err
+	}
+	return st, true, nil
+}
+
+// LastReverted returns the most recent rollback carried out in dir, if any.
+func LastReverted(dir string) (Reverted, bool) {
+	var r Reverted
+	data, err := os.ReadFile(revertedPath(dir))
+	if err != nil || json.Unmarshal(data, &r) != nil {
+		return r, false
+	}
+	return r, true
+}
+
+// Arm snapshots the network configs and records a revert deadline. The
+// caller must start a watchdog (Spawn or Watch) for the revert to happen.
+func Arm(dir string, timeout time.Duration) (State, error) {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	if _, ok, err := Pending(dir); err != nil {
+		return State{}, err
+	} else if ok {
+		return State{}, ErrPending
+	}
+	snap := snapshotDir(dir)
+	if err := os.RemoveAll(snap); err != nil {
+		return State{}, err
+	}
+	if err := os.MkdirAll(snap, 0o700); err != nil {
+		return State{}, err
+	}
+	now := time.Now()
+	st := State{ID: artifacts.NewID(), Armed: now, Deadline: now.Add(timeout), ConfigDir: ConfigDir, Configs: []string{}}
+	for _, name := range Configs {
+		data, err := os.ReadFile(filepath.Join(ConfigDir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return State{}, fmt.Errorf("snapshot %s: %w", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(snap, name), data, 0o600); err != nil {
+			return State{}, fmt.Errorf("snapshot %s: %w", name, err)
+		}
+		st.Configs = append(st.Configs, name)
+	}
+	if err := writeJSON(statePath(dir), st); err != nil {
+		return State{}, err
+	}
+	os.Remove(revertedPath(dir))
+	return st, nil
+}
+
+// Guard arms a rollback and spawns its watchdog when p may change network
+// connectivity. timeoutSeconds <= 0 disables the safety net. armed is false
+// when nothing needed protecting.
+func Guard(dir string, timeoutSeconds int, p plan.Plan) (st State, armed bool, err error) {
+	if timeoutSeconds <= 0 || !Affects(p) {
+		return st, false, nil
+	}
+	st, err = Arm(dir, time.Duration(timeoutSeconds)*time.Second)
+	if err != nil {
+		return st, false, err
+	}
+	if err := Spawn(dir); err != nil {
+		Confirm(dir)
+		return st, false, fmt.Errorf("start rollback watchdog: %w", err)
+	}
+	return st, true, nil
+}
+
+// Confirm keeps the current configuration and disarms the watchdog.
+func Confirm(dir string) (State, error) {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	st, ok, err := Pending(dir)
+	if err != nil {
+		return st, err
+	}
+	// Removing the state file is the commit point; a watchdog that lost the
+	// race finds it gone and exits.
+	if !ok || os.Remove(statePath(dir)) != nil {
+		return st, ErrNothingPending
+	}
+	os.RemoveAll(snapshotDir(dir))
+	return st, nil
+}
+
+// watchInterval is how often Watch checks for a confirmation.
+var watchInterval = time.Second
+
+// Watch blocks until the pending rollback in dir is confirmed or its deadline
+// passes, in which case the snapshot is restored.
+func Watch(dir string) error {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	st, ok, err := Pending(dir)
+	if err != nil || !ok {
+		return err
+	}
+	for {
+		wait := st.Remaining()
+		if wait <= 0 {
+			break
+		}
+		if wait > watchInterval {
+			wait = watchInterval
+		}
+		time.Sleep(wait)
+		cur, ok, err := Pending(dir)
+		if err != nil || !ok || cur.ID != st.ID {
+			return err
+		}
+	}
+	return revert(dir, st)
+}
+
+// runCommand executes a service restart; overridden in tests.
+var runCommand = func(argv []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(argv, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// revert restores st's snapshot. It claims the state file first so a
+// concurrent Confirm cannot succeed after the restore has started.
+func revert(dir string, st State) error {
+	claimed := statePath(dir) + ".reverting"
+	if err := os.Rename(statePath(dir), claimed); err != nil {
+		if os.IsNotExist(err) {
+			return nil // Confirmed just in time
+		}
+		return err
+	}
+	defer os.Remove(claimed)
+
+	rec := Reverted{State: st, Time: time.Now()}
+	snapshotted := map[string]bool{}
+	restart := []string{"network", "firewall"}
+	for _, name := range st.Configs {
+		snapshotted[name] = true
+	}
+	for _, name := range Configs {
+		live := filepath.Join(st.ConfigDir, name)
+		cur, curErr := os.ReadFile(live)
+		if !snapshotted[name] {
+			// Created by the plan
+			if curErr == nil {
+				if err := os.Remove(live); err != nil {
+					rec.Errors = append(rec.Errors, err.Error())
+				}
+			}
+			continue
+		}
+		saved, err := os.ReadFile(filepath.Join(snapshotDir(dir), name))
+		if err != nil {
+			rec.Errors = append(rec.Errors, err.Error())
+			continue
+		}
+		if curErr == nil && bytes.Equal(cur, saved) {
+			continue
+		}
+		if err := os.WriteFile(live, saved, 0o644); err != nil {
+			rec.Errors = append(rec.Errors, err.Error())
+			continue
+		}
+		if name == "wireless" || name == "dhcp" {
+			restart = append(restart, name)
+		}
+	}
+	// Network and firewall are always restarted: the plan may have changed
+	// runtime state (ip, ifdown) without touching the files.
+	for _, name := range Configs {
+		// Drop uncommitted changes so a later commit cannot reapply them
+		_ = runCommand([]string{"uci", "-q", "revert", name})
+	}
+	for _, name := range restart {
+		if err := runCommand(restartCommands[name]); err != nil {
+			rec.Errors = append(rec.Errors, err.Error())
+		}
+	}
+	if err := writeJSON(revertedPath(dir), rec); err != nil {
+		return err
+	}
+	os.RemoveAll(snapshotDir(dir))
+	if len(rec.Errors) > 0 {
+		return fmt.Errorf("rollback completed with errors: %s", strings.Join(rec.Errors, "; "))
+	}
+	return nil
+}
+
+// WatchdogCommand is the hidden subcommand that runs Watch in a detached
+// process (see cmd/lucicodex).
+const WatchdogCommand = "rollback-watchdog"
+
+// Spawn starts Watch(dir) in a detached copy of the running executable so the
+// revert still happens when the session that armed it is lost with the
+// network. Tests replace it with an in-process watcher.
+var Spawn = func(dir string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if dir == "" {
+		dir = DefaultDir
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, "watchdog.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	cmd := exec.Command(exe, WatchdogCommand, dir)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
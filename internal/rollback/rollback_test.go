@@ -0,0 +1,174 @@
+package rollback
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/testutil"
+)
+
+func TestAffects(t *testing.T) {
+	tests := []struct {
+		argv []string
+		want bool
+	}{
+		{[]string{"uci", "set", "network.lan.ipaddr=192.168.2.1"}, true},
+		{[]string{"uci", "-q", "delete", "firewall.@rule[0]"}, true},
+		{[]string{"uci", "commit", "network"}, true},
+		{[]string{"uci", "commit"}, true},
+		{[]string{"uci", "set", "system.@system[0].hostname=x"}, false},
+		{[]string{"uci", "show", "network"}, false},
+		{[]string{"/etc/init.d/network", "restart"}, true},
+		{[]string{"/etc/init.d/network", "status"}, false},
+		{[]string{"/etc/init.d/uhttpd", "restart"}, false},
+		{[]string{"fw4", "reload"}, true},
+		{[]string{"fw4", "print"}, false},
+		{[]string{"wifi", "reload"}, true},
+		{[]string{"wifi", "status"}, false},
+		{[]string{"ifdown", "wan"}, true},
+		{[]string{"ip", "-4", "addr", "add", "10.0.0.1/24", "dev", "br-lan"}, true},
+		{[]string{"ip", "route", "del", "default"}, true},
+		{[]string{"ip", "addr"}, false},
+		{[]string{"ip", "route", "show"}, false},
+		{[]string{"ubus", "call", "network", "reload"}, true},
+		{[]string{"ubus", "call", "network.interface.wan", "status"}, false},
+		{[]string{"logread"}, false},
+	}
+	for _, tt := range tests {
+		got := Affects(plan.Plan{Commands: []plan.PlannedCommand{{Command: tt.argv}}})
+		if got != tt.want {
+			t.Errorf("Affects(%v) = %v, want %v", tt.argv, got, tt.want)
+		}
+	}
+}
+
+func TestTouched(t *testing.T) {
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{"wifi", "reload"}},
+		{Command: []string{"uci", "set", "dhcp.lan.limit=50"}},
+		{Command: []string{"/etc/init.d/dnsmasq", "restart"}},
+		{Command: []string{"uci", "show", "network"}},
+	}}
+	if got := strings.Join(Touched(p), ","); got != "wireless,dhcp" {
+		t.Errorf("Touched = %q, want wireless,dhcp", got)
+	}
+	if got := Touched(plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "commit"}}}}); len(got) != len(Configs) {
+		t.Errorf("a bare commit should touch every config: %v", got)
+	}
+}
+
+// setup points ConfigDir at a temp directory seeded with a network config and
+// stubs out service restarts.
+func setup(t *testing.T) (dir, cfgDir string, ran *[]string) {
+	t.Helper()
+	cfgDir = t.TempDir()
+	dir = t.TempDir()
+	os.WriteFile(filepath.Join(cfgDir, "network"), []byte("config interface 'lan'\n\toption ipaddr '192.168.1.1'\n"), 0o644)
+	os.WriteFile(filepath.Join(cfgDir, "firewall"), []byte("config defaults\n"), 0o644)
+
+	oldDir, oldRun, oldInterval := ConfigDir, runCommand, watchInterval
+	ConfigDir = cfgDir
+	watchInterval = 10 * time.Millisecond
+	var cmds []string
+	runCommand = func(argv []string) error {
+		cmds = append(cmds, strings.Join(argv, " "))
+		return nil
+	}
+	t.Cleanup(func() { ConfigDir, runCommand, watchInterval = oldDir, oldRun, oldInterval })
+	return dir, cfgDir, &cmds
+}
+
+func TestWatch_RevertsUnconfirmedChange(t *testing.T) {
+	dir, cfgDir, ran := setup(t)
+	st, err := Arm(dir, 50*time.Millisecond)
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, strings.Join(st.Configs, ","), "network,firewall")
+
+	// The plan changes the LAN address and adds a wireless config
+	os.WriteFile(filepath.Join(cfgDir, "network"), []byte("config interface 'lan'\n\toption ipaddr '10.0.0.1'\n"), 0o644)
+	os.WriteFile(filepath.Join(cfgDir, "wireless"), []byte("config wifi-device 'radio0'\n"), 0o644)
+
+	testutil.AssertNoError(t, Watch(dir))
+
+	data, _ := os.ReadFile(filepath.Join(cfgDir, "network"))
+	testutil.AssertContains(t, string(data), "192.168.1.1")
+	testutil.AssertFalse(t, testutil.FileExists(filepath.Join(cfgDir, "wireless")))
+	cmds := strings.Join(*ran, "\n")
+	testutil.AssertContains(t, cmds, "uci -q revert network")
+	testutil.AssertContains(t, cmds, "/etc/init.d/network restart")
+	testutil.AssertContains(t, cmds, "/etc/init.d/firewall restart")
+
+	_, ok, _ := Pending(dir)
+	testutil.AssertFalse(t, ok)
+	r, ok := LastReverted(dir)
+	testutil.AssertTrue(t, ok)
+	testutil.AssertEqual(t, r.ID, st.ID)
+	if _, err := Confirm(dir); !errors.Is(err, ErrNothingPending) {
+		t.Errorf("expected ErrNothingPending after revert, got %v", err)
+	}
+}
+
+func TestWatch_ConfirmedChangeIsKept(t *testing.T) {
+	dir, cfgDir, ran := setup(t)
+	st, err := Arm(dir, time.Minute)
+	testutil.AssertNoError(t, err)
+	os.WriteFile(filepath.Join(cfgDir, "network"), []byte("changed\n"), 0o644)
+
+	if _, err := Arm(dir, time.Minute); !errors.Is(err, ErrPending) {
+		t.Errorf("expected ErrPending while unconfirmed, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- Watch(dir) }()
+	confirmed, err := Confirm(dir)
+	testutil.AssertNoError(t, err)
+	testutil.AssertEqual(t, confirmed.ID, st.ID)
+
+	select {
+	case err := <-done:
+		testutil.AssertNoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchdog did not exit after confirmation")
+	}
+	data, _ := os.ReadFile(filepath.Join(cfgDir, "network"))
+	testutil.AssertEqual(t, string(data), "changed\n")
+	testutil.AssertEqual(t, len(*ran), 0)
+}
+
+func TestGuard(t *testing.T) {
+	dir, _, _ := setup(t)
+	oldSpawn := Spawn
+	defer func() { Spawn = oldSpawn }()
+	spawned := 0
+	Spawn = func(string) error { spawned++; return nil }
+
+	readOnly := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "show", "network"}}}}
+	_, armed, err := Guard(dir, 60, readOnly)
+	testutil.AssertNoError(t, err)
+	testutil.AssertFalse(t, armed)
+
+	change := plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "commit", "network"}}}}
+	_, armed, err = Guard(dir, 0, change)
+	testutil.AssertNoError(t, err)
+	testutil.AssertFalse(t, armed)
+
+	st, armed, err := Guard(dir, 60, change)
+	testutil.AssertNoError(t, err)
+	testutil.AssertTrue(t, armed)
+	testutil.AssertEqual(t, spawned, 1)
+	testutil.AssertTrue(t, st.Remaining() > 50*time.Second)
+
+	// A failed watchdog start must not leave the rollback armed
+	Confirm(dir)
+	Spawn = func(string) error { return errors.New("boom") }
+	if _, _, err := Guard(dir, 60, change); err == nil {
+		t.Fatal("expected error when the watchdog cannot start")
+	}
+	_, ok, _ := Pending(dir)
+	testutil.AssertFalse(t, ok)
+}
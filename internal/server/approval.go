@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/approver"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+// defaultApprovalTTL applies when mcp_approval_ttl is unset
+const defaultApprovalTTL = 5 * time.Minute
+
+// maxPendingApprovals bounds the prepared commands kept; the oldest is
+// dropped first.
+const maxPendingApprovals = 64
+
+// pendingApproval is a set of commands an MCP tool prepared, waiting for the
+// approve tool.
+type pendingApproval struct {
+	prompt  string // Recorded in the audit log
+	client  string // MCP client that prepared it
+	plan    plan.Plan
+	ack     bool // Policy warnings were acknowledged when preparing
+	expires time.Time
+}
+
+// approvals holds pending approvals by token.
+type approvals struct {
+	mu sync.Mutex
+	m  map[string]*pendingApproval
+}
+
+// add stores pa and returns its token.
+func (a *approvals) add(pa *pendingApproval) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.m == nil {
+		a.m = map[string]*pendingApproval{}
+	}
+	now := time.Now()
+	var oldest string
+	for t, p := range a.m {
+		if now.After(p.expires) {
+			delete(a.m, t)
+		} else if oldest == "" || p.expires.Before(a.m[oldest].expires) {
+			oldest = t
+		}
+	}
+	if len(a.m) >= maxPendingApprovals {
+		delete(a.m, oldest)
+	}
+	a.m[token] = pa
+	return token, nil
+}
+
+// take removes and returns the approval of token, if it has not expired.
+func (a *approvals) take(token string) (*pendingApproval, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pa, ok := a.m[token]
+	delete(a.m, token)
+	if !ok || time.Now().After(pa.expires) {
+		return nil, false
+	}
+	return pa, true
+}
+
+// restore puts back an approval taken under token, e.g. when approving it
+// failed before anything ran.
+func (a *approvals) restore(token string, pa *pendingApproval) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.m[token] = pa
+}
+
+// approvalTTL is how long prepared commands can be approved.
+func (s *Server) approvalTTL() time.Duration {
+	if s.cfg.MCPApprovalTTL > 0 {
+		return time.Duration(s.cfg.MCPApprovalTTL) * time.Second
+	}
+	return defaultApprovalTTL
+}
+
+// prepareApproval checks commands against the policy and, unless it denies
+// them, keeps them for the approve tool. The result is the pending command
+// envelope every tool that changes the router returns: the commands, an
+// approval token and when it expires. text describes the change to the
+// user.
+func (s *Server) prepareApproval(ctx context.Context, client, prompt, text string, commands []plan.PlannedCommand, ack bool) interface{} {
+	p := plan.Plan{Commands: commands}
+	policyEngine := policy.New(s.cfg).WithControl(controlPath(ctx, s.cfg, clientAddrFrom(ctx), localAddrFrom(ctx))).WithTopology(deviceTopology(ctx, s.cfg)).WithFirewall(deviceFirewall(ctx, s.cfg))
+	if err := policyEngine.ValidatePlan(p); err != nil {
+		return map[string]interface{}{
+			"content": []map[string]string{{"type": "text", "text": "Policy violation: " + policy.Explain(err)}},
+			"isError": true,
+		}
+	}
+	p.PolicyWarnings = policyEngine.Warnings(p)
+	p.Lint = policy.LintPlan(p)
+
+	expires := time.Now().Add(s.approvalTTL())
+	token, err := s.approvals.add(&pendingApproval{prompt: prompt, client: client, plan: p, ack: ack, expires: expires})
+	if err != nil {
+		return map[string]interface{}{
+			"content": []map[string]string{{"type": "text", "text": "Error: " + err.Error()}},
+			"isError": true,
+		}
+	}
+
+	argvs := make([][]string, len(commands))
+	for i, c := range commands {
+		argvs[i] = c.Command
+	}
+	for _, w := range p.PolicyWarnings {
+		text += "\nPolicy warning: " + w.Message
+	}
+	for _, f := range p.Lint {
+		text += "\nLint " + f.Severity + ": " + f.Message
+	}
+	text += fmt.Sprintf("\nNothing was run; call approve with token %s within %s to run it.", token, s.approvalTTL())
+	result := map[string]interface{}{
+		"content":          []map[string]string{{"type": "text", "text": text}},
+		"pendingCommands":  argvs,
+		"requiresApproval": true,
+		"approvalToken":    token,
+		"expiresAt":        expires.UTC().Format(time.RFC3339),
+	}
+	if len(argvs) == 1 {
+		result["pendingCommand"] = argvs[0]
+	}
+	if len(p.PolicyWarnings) > 0 {
+		result["policyWarnings"] = p.PolicyWarnings
+	}
+	if len(p.Lint) > 0 {
+		result["lint"] = p.Lint
+	}
+	return result
+}
+
+// toolApprove runs the commands prepared under a token. They are checked
+// against the policy again, as it may have changed since, and recorded in
+// the audit log under the client that approved them.
+func (s *Server) toolApprove(ctx context.Context, client string, args json.RawMessage) (interface{}, *MCPError) {
+	var params struct {
+		Token       string `json:"token"`
+		AckWarnings bool   `json:"ack_warnings"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil || params.Token == "" {
+		return nil, &MCPError{Code: MCPInvalidParams, Message: "token is required"}
+	}
+	pa, ok := s.approvals.take(params.Token)
+	if !ok {
+		return map[string]interface{}{
+			"content": []map[string]string{{"type": "text", "text": "Unknown or expired approval token; call the tool again to prepare the commands"}},
+			"isError": true,
+		}, nil
+	}
+	prompt := pa.prompt
+	if pa.client != client {
+		prompt += " (prepared by " + mcpClientTag(pa.client) + ")"
+	}
+	ack := pa.ack || params.AckWarnings
+	if approver.Enabled(s.cfg) {
+		// The approver sees the warnings; its answer is final
+		req := approvalRequest(ctx, prompt, pa.plan)
+		req.Source, req.Client = "mcp", mcpClientTag(client)
+		if err := approver.Ask(ctx, s.cfg, req); err != nil {
+			return map[string]interface{}{
+				"content": []map[string]string{{"type": "text", "text": "Not approved: " + err.Error()}},
+				"isError": true,
+			}, nil
+		}
+		ack = true
+	}
+	if err := policy.RequireAck(pa.plan, ack); err != nil {
+		s.approvals.restore(params.Token, pa)
+		return map[string]interface{}{
+			"content": []map[string]string{{"type": "text", "text": "Policy warning: " + pa.plan.PolicyWarnings[0].Message + "; call approve again with ack_warnings=true to run it"}},
+			"isError": true,
+		}, nil
+	}
+	result, ran := s.runToolPlan(ctx, client, prompt, pa.plan, ack)
+	if !ran {
+		// E.g. the execution lock was held; the token can be used again
+		s.approvals.restore(params.Token, pa)
+	}
+	return result, nil
+}
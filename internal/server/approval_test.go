@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+)
+
+func TestServer_MCPApproval(t *testing.T) {
+	dir := t.TempDir()
+	origPaths := execlock.Paths
+	execlock.Paths = []string{filepath.Join(dir, "lucicodex.lock")}
+	defer func() { execlock.Paths = origPaths }()
+
+	cfg := config.Config{
+		LogFile:        filepath.Join(dir, "lucicodex.log"),
+		Allowlist:      []string{"^echo", "^uci", "^/etc/init.d/"},
+		Denylist:       []string{"^echo secret"},
+		Warnlist:       []string{"^echo loud"},
+		TimeoutSeconds: 5,
+	}
+	s := New(cfg)
+	call := func(name string, args map[string]interface{}) map[string]interface{} {
+		t.Helper()
+		params, _ := json.Marshal(map[string]interface{}{"name": name, "arguments": args})
+		body := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":` + string(params) + `}`
+		req, _ := http.NewRequest("POST", "/v1/mcp", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		var resp struct {
+			Result map[string]interface{} `json:"result"`
+			Error  *MCPError              `json:"error"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Error != nil {
+			t.Fatalf("%s: bad response %q", name, rr.Body.String())
+		}
+		return resp.Result
+	}
+	text := func(result map[string]interface{}) string {
+		b, _ := json.Marshal(result["content"])
+		return string(b)
+	}
+
+	// uci_commit with reload prepares both commands under one token
+	res := call("uci_commit", map[string]interface{}{"config": "network", "reload": true})
+	if res["requiresApproval"] != true || res["approvalToken"] == nil || res["expiresAt"] == nil {
+		t.Fatalf("unexpected envelope %v", res)
+	}
+	if cmds, _ := json.Marshal(res["pendingCommands"]); string(cmds) != `[["uci","commit","network"],["/etc/init.d/network","reload"]]` {
+		t.Errorf("unexpected pending commands %s", cmds)
+	}
+
+	// Denied commands get no token
+	res = call("exec", map[string]interface{}{"command": []string{"echo", "secret"}})
+	if res["isError"] != true || res["approvalToken"] != nil || !strings.Contains(text(res), "Policy violation") {
+		t.Fatalf("unexpected result %v", res)
+	}
+
+	// Warnings must be acknowledged when approving; the token survives until then
+	res = call("exec", map[string]interface{}{"command": []string{"echo", "loud"}})
+	token := res["approvalToken"]
+	if token == nil || res["policyWarnings"] == nil {
+		t.Fatalf("unexpected envelope %v", res)
+	}
+	if res := call("approve", map[string]interface{}{"token": token}); res["isError"] != true || !strings.Contains(text(res), "ack_warnings=true") {
+		t.Fatalf("unexpected result %v", res)
+	}
+	if res := call("approve", map[string]interface{}{"token": token, "ack_warnings": true}); res["isError"] == true || !strings.Contains(text(res), "loud") {
+		t.Fatalf("unexpected result %v", res)
+	}
+	entries, err := logging.ReadHistory(cfg.LogFile)
+	if err != nil || len(entries) != 1 || entries[0].Prompt != "mcp exec: " || entries[0].Plan.Commands[0].Command[1] != "loud" {
+		t.Fatalf("history = %+v, %v", entries, err)
+	}
+
+	// Expired tokens are refused
+	res = call("exec", map[string]interface{}{"command": []string{"echo", "late"}})
+	s.approvals.mu.Lock()
+	s.approvals.m[res["approvalToken"].(string)].expires = time.Now().Add(-time.Second)
+	s.approvals.mu.Unlock()
+	if res := call("approve", map[string]interface{}{"token": res["approvalToken"]}); res["isError"] != true || !strings.Contains(text(res), "expired") {
+		t.Fatalf("unexpected result %v", res)
+	}
+}
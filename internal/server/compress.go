@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minCompressSize is the smallest response compressed: below it the gzip
+// framing and the router's CPU cost more than the bytes saved.
+const minCompressSize = 1024
+
+// gzipWriters are reused across responses; BestSpeed keeps compression
+// cheap on router CPUs while still shrinking JSON several times.
+var gzipWriters = sync.Pool{New: func() interface{} {
+	gz, _ := gzip.NewWriterLevel(io.Discard, gzip.BestSpeed)
+	return gz
+}}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if c := strings.ToLower(strings.TrimSpace(coding)); c != "gzip" && c != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressWriter gzips a response for a client that accepts it. The first
+// minCompressSize bytes are held back to decide: smaller responses are sent
+// as they are, as are responses that are already encoded, are event streams
+// or have no body. A handler that flushes before the decision is streaming,
+// and the response is sent uncompressed so every flush reaches the client
+// at once; WebSocket upgrades are never wrapped (see ServeHTTP).
+type compressWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+	raw    bool // Decided against compression: writes go straight through
+}
+
+func newCompressWriter(w http.ResponseWriter) *compressWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &compressWriter{ResponseWriter: w}
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.status != 0 || c.raw || c.gz != nil {
+		return
+	}
+	c.status = code
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified {
+		c.sendRaw()
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	switch {
+	case c.raw:
+		return c.ResponseWriter.Write(b)
+	case c.gz != nil:
+		return c.gz.Write(b)
+	}
+	c.buf = append(c.buf, b...)
+	if len(c.buf) < minCompressSize {
+		return len(b), nil
+	}
+	h := c.Header()
+	if h.Get("Content-Encoding") != "" || strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		if err := c.sendRaw(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	c.ResponseWriter.WriteHeader(c.status)
+	c.gz = gzipWriters.Get().(*gzip.Writer)
+	c.gz.Reset(c.ResponseWriter)
+	buf := c.buf
+	c.buf = nil
+	if _, err := c.gz.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sendRaw decides against compression and sends what is held back.
+func (c *compressWriter) sendRaw() error {
+	c.raw = true
+	if c.status != 0 {
+		c.ResponseWriter.WriteHeader(c.status)
+	}
+	buf := c.buf
+	c.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := c.ResponseWriter.Write(buf)
+	return err
+}
+
+func (c *compressWriter) Flush() {
+	if c.gz != nil {
+		c.gz.Flush()
+	} else if !c.raw {
+		c.sendRaw()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	c.raw = true
+	return hj.Hijack()
+}
+
+// Close ends the response: it finishes the gzip stream or sends a response
+// too small to compress.
+func (c *compressWriter) Close() error {
+	if c.gz != nil {
+		err := c.gz.Close()
+		c.gz.Reset(io.Discard)
+		gzipWriters.Put(c.gz)
+		c.gz = nil
+		return err
+	}
+	if c.raw || c.status == 0 {
+		return nil
+	}
+	if c.Header().Get("Content-Length") == "" {
+		c.Header().Set("Content-Length", strconv.Itoa(len(c.buf)))
+	}
+	return c.sendRaw()
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                        false,
+		"gzip":                    true,
+		"deflate, gzip;q=0.8":     true,
+		"GZIP":                    true,
+		"*":                       true,
+		"br":                      false,
+		"gzip;q=0":                false,
+		"gzip; q=0.0, identity":   false,
+		"identity, *;q=1, br;q=0": true,
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(r); got != want {
+			t.Errorf("%q: got %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestServeHTTP_Compression(t *testing.T) {
+	s := New(config.Config{JobsDir: t.TempDir()})
+	big := strings.Repeat(`{"name": "lan", "proto": "static"}`, 100)
+	s.mux.HandleFunc("/test/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, big)
+	})
+	s.mux.HandleFunc("/test/small", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"ok": true}`)
+	})
+	s.mux.HandleFunc("/test/stream", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "line 1\n")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, big)
+	})
+	s.mux.HandleFunc("/test/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, big)
+	})
+	s.mux.HandleFunc("/test/created", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, big)
+	})
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/test/big", "gzip, deflate")
+	if rr.Header().Get("Content-Encoding") != "gzip" || rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("expected a gzipped response, got headers %v", rr.Header())
+	}
+	if rr.Body.Len() >= len(big)/4 {
+		t.Errorf("expected the body to shrink, %d of %d bytes", rr.Body.Len(), len(big))
+	}
+	gz, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(gz); err != nil || string(b) != big {
+		t.Errorf("unexpected body %d bytes, %v", len(b), err)
+	}
+
+	rr = get("/test/created", "gzip")
+	if rr.Code != http.StatusCreated || rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected a gzipped 201, got %d %v", rr.Code, rr.Header())
+	}
+
+	for _, tc := range []struct{ path, acceptEncoding string }{
+		{"/test/big", ""},
+		{"/test/big", "gzip;q=0"},
+		{"/test/small", "gzip"},
+		{"/test/stream", "gzip"},
+		{"/test/events", "gzip"},
+	} {
+		rr := get(tc.path, tc.acceptEncoding)
+		if rr.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s with %q: expected no compression", tc.path, tc.acceptEncoding)
+		}
+		if rr.Code != http.StatusOK || !strings.HasSuffix(rr.Body.String(), `}`) {
+			t.Errorf("%s with %q: unexpected response %d %q", tc.path, tc.acceptEncoding, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := get("/test/small", "gzip"); rr.Header().Get("Content-Length") != "12" {
+		t.Errorf("expected the length of a small response, got %v", rr.Header())
+	}
+	if rr := get("/test/stream", "gzip"); !rr.Flushed || !strings.HasPrefix(rr.Body.String(), "line 1\n") {
+		t.Error("expected the streamed response to be flushed as it is")
+	}
+}
+
+func TestWithETag(t *testing.T) {
+	body := `{"ok": true, "jobs": []}`
+	calls := 0
+	h := withETag(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Query().Get("fail") == "1" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	})
+	get := func(query, ifNoneMatch string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/v1/jobs"+query, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		return rr
+	}
+
+	rr := get("", "")
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || rr.Body.String() != body || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("unexpected response %d %q, ETag %q", rr.Code, rr.Body.String(), etag)
+	}
+	for _, match := range []string{etag, strings.TrimPrefix(etag, "W/"), `"other", ` + etag, "*"} {
+		rr = get("", match)
+		if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 || rr.Header().Get("ETag") != etag {
+			t.Errorf("%s: expected 304, got %d %q", match, rr.Code, rr.Body.String())
+		}
+	}
+	if rr = get("", `W/"other"`); rr.Code != http.StatusOK || rr.Body.String() != body {
+		t.Errorf("expected the body for another ETag, got %d", rr.Code)
+	}
+
+	body = `{"ok": true, "jobs": [{"id": "1"}]}`
+	if rr = get("", etag); rr.Code != http.StatusOK || rr.Header().Get("ETag") == etag {
+		t.Errorf("expected a new ETag for a changed body, got %d %q", rr.Code, rr.Header().Get("ETag"))
+	}
+	if rr = get("?fail=1", "*"); rr.Code != http.StatusInternalServerError || rr.Header().Get("ETag") != "" {
+		t.Errorf("errors must not be cached, got %d %v", rr.Code, rr.Header())
+	}
+	if calls != 8 {
+		t.Errorf("expected the handler to run for every request, ran %d times", calls)
+	}
+}
+
+func TestServer_ETagRoutes(t *testing.T) {
+	s := New(config.Config{Provider: "gemini", JobsDir: t.TempDir()})
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/v1/jobs", nil)
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		req.Header.Set("Accept-Encoding", "gzip")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := get("")
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected an ETag, got %d %v", rr.Code, rr.Header())
+	}
+	if rr = get(etag); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 || rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected an empty 304, got %d %v %q", rr.Code, rr.Header(), rr.Body.String())
+	}
+}
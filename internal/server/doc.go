@@ -7,14 +7,17 @@
 // Security features:
 //   - Token-based authentication (token stored in /tmp/.lucicodex.token)
 //   - Rate limiting (token bucket algorithm)
-//   - Localhost-only binding (127.0.0.1)
-//   - Request validation and sanitization
+//   - Localhost-only binding (127.0.0.1), or a Unix domain socket with
+//     mode 0600 and peer-credential logging (StartUnix)
+//   - Request validation and sanitization: per-endpoint body limits, JSON
+//     bodies only, prompt length caps and a WebSocket message limit
 //
 // API endpoints:
 //   - POST /v1/plan      - Generate an execution plan from a prompt
 //   - POST /v1/execute   - Execute commands from a plan
 //   - POST /v1/summarize - Summarize command outputs
-//   - GET  /health       - Health check (no auth required)
+//   - GET  /health       - Health of the daemon and its dependencies (no auth
+//     required; ?verbose=1 adds details)
 //
 // Example usage:
 //
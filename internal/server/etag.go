@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// withETag wraps a GET handler whose response only changes with the state
+// it reports, so clients polling it can revalidate instead of downloading it
+// again: a 200 response gets an ETag of its body, and a request whose
+// If-None-Match names that ETag gets 304 Not Modified without a body. The
+// ETag is weak since the body may be sent gzipped (see compressWriter).
+func withETag(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			handler(w, r)
+			return
+		}
+		rec := &bufferWriter{header: w.Header()}
+		handler(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status != http.StatusOK {
+			w.WriteHeader(rec.status)
+			w.Write(rec.buf.Bytes())
+			return
+		}
+		sum := sha256.Sum256(rec.buf.Bytes())
+		etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Del("Content-Length")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(rec.buf.Bytes())
+	}
+}
+
+// etagMatches reports whether the If-None-Match header ifNoneMatch names
+// etag, comparing weakly as RFC 9110 requires.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferWriter holds a response back until the handler has finished.
+// Headers go to the real response directly.
+type bufferWriter struct {
+	header http.Header
+	status int
+	buf    bytes.Buffer
+}
+
+func (b *bufferWriter) Header() http.Header { return b.header }
+
+func (b *bufferWriter) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.buf.Write(p)
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// Graceful restart: on SIGUSR2 the daemon starts the binary at its original
+// path with the same arguments, passing the listening socket and its state
+// (auth token, rate limiter levels, MCP sessions). Once the new daemon
+// accepts connections, the old one stops accepting, lets in-flight requests
+// and streaming executions finish within handoverDrainTimeout and exits.
+//
+// procd tracks the PID it started, so that process never exits early: after
+// its own handover it stays as a supervisor that forwards signals to the
+// serving daemon and exits with it. Later generations are reparented to it
+// (Linux child subreaper), so restarts do not build a chain of processes.
+
+// handoverEnv marks a daemon started by a handover. It inherits the listener
+// as fd 3, reads the state from fd 4 and reports readiness on fd 5.
+const handoverEnv = "LUCICODEX_HANDOVER"
+
+const (
+	handoverReadyTimeout = 10 * time.Second
+	// handoverDrainTimeout covers the longest write timeout of a request
+	handoverDrainTimeout = 2 * time.Minute
+)
+
+// handoverState is what a daemon passes to its successor.
+type handoverState struct {
+	Token        string             `json:"token"`
+	Limiter      float64            `json:"limiter"`            // Before per-client limits: the level of 127.0.0.1
+	Limiters     map[string]float64 `json:"limiters,omitempty"` // Per client address
+	ToolLimiters map[string]float64 `json:"tool_limiters,omitempty"`
+	MCPClients   map[string]string  `json:"mcp_clients,omitempty"`
+}
+
+// readHandoverState returns the state passed by the previous daemon, if this
+// process was started by a handover. ok is false if the state could not be
+// read; the daemon then keeps the listener but makes a new token.
+func readHandoverState() (st handoverState, inherited, ok bool) {
+	if os.Getenv(handoverEnv) != "1" {
+		return st, false, false
+	}
+	os.Unsetenv(handoverEnv)
+	f := os.NewFile(4, "handover-state")
+	defer f.Close()
+	st, ok = decodeHandoverState(f)
+	return st, true, ok
+}
+
+// decodeHandoverState reads the state written by handOver from r.
+func decodeHandoverState(r io.Reader) (handoverState, bool) {
+	var st handoverState
+	if err := json.NewDecoder(r).Decode(&st); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to read handover state: %v\n", err)
+		return handoverState{}, false
+	}
+	return st, true
+}
+
+func (s *Server) handoverState() handoverState {
+	st := handoverState{
+		Token:        s.token,
+		Limiter:      s.limiters.get("127.0.0.1").level(),
+		Limiters:     s.limiters.levels(),
+		ToolLimiters: map[string]float64{},
+		MCPClients:   map[string]string{},
+	}
+	for name, l := range s.toolLimiters {
+		st.ToolLimiters[name] = l.level()
+	}
+	s.mcpMu.Lock()
+	for id, client := range s.mcpClients {
+		st.MCPClients[id] = client
+	}
+	s.mcpMu.Unlock()
+	return st
+}
+
+// adoptHandoverState continues where the previous daemon left off.
+func (s *Server) adoptHandoverState(st handoverState) {
+	if st.Limiters == nil {
+		// From a daemon that had one limiter, shared by all its
+		// clients; they all came through the loopback address
+		st.Limiters = map[string]float64{"127.0.0.1": st.Limiter}
+	}
+	for client, level := range st.Limiters {
+		s.limiters.get(client).setLevel(level)
+	}
+	for name, level := range st.ToolLimiters {
+		if l := s.toolLimiters[name]; l != nil {
+			l.setLevel(level)
+		}
+	}
+	for id, client := range st.MCPClients {
+		s.mcpClients[id] = client
+	}
+}
+
+// listen returns the listener inherited from the previous daemon, or a new
+// one from listen.
+func (s *Server) listen(listen func() (net.Listener, error)) (net.Listener, error) {
+	if !s.inherited {
+		return listen()
+	}
+	f := os.NewFile(3, "handover-listener")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited listener: %w", err)
+	}
+	if u, ok := ln.(*net.UnixListener); ok {
+		// Listeners made from files leave the socket behind by default
+		u.SetUnlinkOnClose(true)
+	}
+	return ln, nil
+}
+
+// serve runs srv on ln until ctx is done or the daemon has handed over to
+// a new one after SIGUSR2.
+func (s *Server) serve(ctx context.Context, srv *http.Server, ln net.Listener) error {
+	restart := make(chan os.Signal, 1)
+	notifyRestart(restart)
+	defer signal.Stop(restart)
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	if s.inherited {
+		ready := os.NewFile(5, "handover-ready")
+		ready.Write([]byte{1})
+		ready.Close()
+	}
+
+	for {
+		select {
+		case err := <-errc:
+			ln.Close()
+			return err
+		case <-ctx.Done():
+			shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			srv.Shutdown(shutCtx)
+			cancel()
+			<-errc
+			return nil
+		case <-restart:
+			successor, err := s.handOver(ln)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Restart failed, still serving: %v\n", err)
+				continue
+			}
+			fmt.Printf("Handed over to pid %d, draining connections\n", successor)
+			if u, ok := ln.(*net.UnixListener); ok {
+				// The socket now belongs to the new daemon
+				u.SetUnlinkOnClose(false)
+			}
+			s.drain(srv)
+			<-errc
+			if !s.inherited {
+				superviseSuccessors(successor)
+			}
+			return nil
+		}
+	}
+}
+
+// handOver starts the new daemon with the listener and state and waits until
+// it is serving. It returns the new daemon's PID.
+func (s *Server) handOver(ln net.Listener) (int, error) {
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return 0, fmt.Errorf("cannot pass a %T", ln)
+	}
+	lnFile, err := fl.File()
+	if err != nil {
+		return 0, err
+	}
+	defer lnFile.Close()
+	// Not os.Executable: after an upgrade it names the replaced binary
+	exe, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return 0, err
+	}
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer stateR.Close()
+	defer stateW.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyR.Close()
+	defer readyW.Close()
+
+	if !s.inherited {
+		if err := setSubreaper(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v; later restarts will not be supervised\n", err)
+		}
+	}
+	cmd := exec.Command(exe)
+	// Same command line, which is how the supervisor recognizes successors
+	cmd.Args = os.Args
+	cmd.Env = append(os.Environ(), handoverEnv+"=1")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, stateR, readyW}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	stateR.Close()
+	readyW.Close()
+
+	if err := json.NewEncoder(stateW).Encode(s.handoverState()); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+	stateW.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(handoverReadyTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("new daemon did not start: %v", err)
+	}
+	// Reaped by superviseSuccessors, or by init once this process exits
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// drain stops accepting connections and waits for in-flight requests and
+// WebSocket streams to finish, closing what is left after
+// handoverDrainTimeout.
+func (s *Server) drain(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), handoverDrainTimeout)
+	defer cancel()
+	srv.Shutdown(ctx)
+	done := make(chan struct{})
+	go func() {
+		s.streams.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		fmt.Println("Drain deadline reached, closing remaining connections")
+	}
+	srv.Close()
+}
+
+// childrenRunning returns the PIDs of this process's children running the
+// command line cmdline (NUL separated, as in /proc/<pid>/cmdline).
+func childrenRunning(cmdline string) []int {
+	if cmdline == "" {
+		return nil
+	}
+	dirs, _ := os.ReadDir("/proc")
+	self := os.Getpid()
+	var pids []int
+	for _, d := range dirs {
+		var pid int
+		if _, err := fmt.Sscanf(d.Name(), "%d", &pid); err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + d.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces; fields resume after ')'
+		i := strings.LastIndexByte(string(stat), ')')
+		if i < 0 {
+			continue
+		}
+		var state string
+		var ppid int
+		if _, err := fmt.Sscanf(string(stat[i+1:]), " %s %d", &state, &ppid); err != nil || ppid != self || state == "Z" {
+			continue
+		}
+		if b, err := os.ReadFile("/proc/" + d.Name() + "/cmdline"); err == nil && string(b) == cmdline {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
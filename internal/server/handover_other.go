@@ -0,0 +1,12 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// notifyRestart is only implemented on Unix (SIGUSR2); elsewhere the
+// daemon is restarted by stopping it.
+func notifyRestart(c chan<- os.Signal) {}
+
+// superviseSuccessors is never reached without notifyRestart.
+func superviseSuccessors(first int) {}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+func TestHandoverState(t *testing.T) {
+	old := New(config.Config{})
+	for i := 0; i < 10; i++ {
+		old.limiters.get("127.0.0.1").allow()
+	}
+	old.limiters.get("192.0.2.7").allow()
+	old.toolLimiters["exec"].allow()
+	old.mcpClients["abc"] = "claude-desktop/1.0"
+
+	st := old.handoverState()
+	if st.Token != old.GetToken() || st.Limiters["127.0.0.1"] < 19 || st.Limiters["127.0.0.1"] > 21 || st.Limiters["192.0.2.7"] > 29.5 {
+		t.Fatalf("unexpected state: %+v", st)
+	}
+
+	next := New(config.Config{})
+	next.adoptHandoverState(st)
+	if l := next.limiters.get("127.0.0.1").level(); l < 19 || l > 21 {
+		t.Errorf("rate limiter not carried over: %v", l)
+	}
+	if l := next.limiters.get("192.0.2.7").level(); l > 29.5 {
+		t.Errorf("rate limiter of second client not carried over: %v", l)
+	}
+	if l := next.toolLimiters["exec"].level(); l >= 5 {
+		t.Errorf("tool limiter not carried over: %v", l)
+	}
+	if next.mcpClients["abc"] != "claude-desktop/1.0" {
+		t.Errorf("MCP sessions not carried over: %v", next.mcpClients)
+	}
+}
+
+func TestHandoverState_SingleLimiter(t *testing.T) {
+	// State written by a daemon with one limiter for all clients
+	next := New(config.Config{})
+	next.adoptHandoverState(handoverState{Limiter: 3})
+	if l := next.limiters.get("127.0.0.1").level(); l < 3 || l > 4 {
+		t.Errorf("shared limiter not applied to loopback: %v", l)
+	}
+}
+
+func TestRateLimiter_SetLevel(t *testing.T) {
+	rl := newRateLimiter(5, 1)
+	rl.setLevel(100)
+	if l := rl.level(); l != 5 {
+		t.Errorf("level above max: %v", l)
+	}
+	rl.setLevel(0)
+	if rl.allow() {
+		t.Error("empty limiter allowed a request")
+	}
+}
+
+func TestChildrenRunning(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no /proc")
+	}
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skip("sleep not available")
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	pids := childrenRunning("sleep\x0030\x00")
+	if len(pids) != 1 || pids[0] != cmd.Process.Pid {
+		t.Errorf("expected child %d, got %v", cmd.Process.Pid, pids)
+	}
+	if pids := childrenRunning("sleep\x0031\x00"); len(pids) != 0 {
+		t.Errorf("matched another command line: %v", pids)
+	}
+}
+
+func TestDecodeHandoverState_BadPayload(t *testing.T) {
+	for _, payload := range []string{"", "not json", `{"token": 42}`} {
+		st, ok := decodeHandoverState(strings.NewReader(payload))
+		if ok || st.Token != "" {
+			t.Errorf("%q: got %+v, %v; want no state", payload, st, ok)
+		}
+	}
+	st, ok := decodeHandoverState(strings.NewReader(`{"token":"abc","limiter":3}`))
+	if !ok || st.Token != "abc" || st.Limiter != 3 {
+		t.Errorf("unexpected state %+v, %v", st, ok)
+	}
+}
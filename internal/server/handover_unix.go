@@ -0,0 +1,51 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// notifyRestart relays SIGUSR2, which asks for a graceful restart, to c.
+func notifyRestart(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// superviseSuccessors keeps the process procd started alive while a
+// successor serves: termination signals and SIGUSR2 are forwarded, and it
+// returns once no successor is left.
+func superviseSuccessors(first int) {
+	sigs := make(chan os.Signal, 4)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	self, _ := os.ReadFile("/proc/self/cmdline")
+	known := map[int]bool{first: true}
+	for {
+		// Successors of successors are reparented to us
+		for _, pid := range childrenRunning(string(self)) {
+			known[pid] = true
+		}
+		for pid := range known {
+			var ws syscall.WaitStatus
+			if p, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); p == pid || err != nil {
+				delete(known, pid)
+			}
+		}
+		if len(known) == 0 {
+			return
+		}
+		select {
+		case sig := <-sigs:
+			for pid := range known {
+				syscall.Kill(pid, sig.(syscall.Signal))
+			}
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/dashboard"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
+	"github.com/aezizhu/LuciCodex/internal/jobs"
+	"github.com/aezizhu/LuciCodex/internal/llm"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/rollback"
+)
+
+// Statuses of a health check and, as the worst of them, of /health.
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailed   = "failed"
+)
+
+// healthProbeTTL is how long /health reuses a provider probe, so frequent
+// health checks do not reach out to the provider each time.
+const healthProbeTTL = time.Minute
+
+// healthDisks are the filesystems whose free space /health reports; a
+// missing one (e.g. /overlay off OpenWrt) is left out. Tests override them.
+var healthDisks = []struct{ name, path string }{
+	{"tmp_space", "/tmp"},
+	{"overlay_space", "/overlay"},
+}
+
+// Free space below which a filesystem is degraded, or failed.
+const (
+	diskLowPercent = 10
+	diskFullBytes  = 1 << 20
+)
+
+// probeProvider is llm.Probe; tests replace it.
+var probeProvider = llm.Probe
+
+// healthCheck is the result of one check of /health. Detail is only sent
+// with ?verbose=1.
+type healthCheck struct {
+	Status  string      `json:"status"`
+	Message string      `json:"message,omitempty"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// providerProbe is the cached result of the last provider probe.
+type providerProbe struct {
+	mu   sync.Mutex
+	time time.Time
+	err  error
+}
+
+// handleHealth reports the daemon's dependencies: the configuration, the
+// provider, free space, the execution lock, background work and the last
+// execution. It answers 503 only if a check failed, i.e. the daemon cannot
+// work at all, so monitors can act on the status code alone.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	verbose := r.URL.Query().Get("verbose") == "1"
+	status, checks := s.health(r.Context())
+	if !verbose {
+		for name, c := range checks {
+			c.Detail = nil
+			checks[name] = c
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status == healthFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// health runs the checks of /health and returns them with the worst status.
+func (s *Server) health(ctx context.Context) (string, map[string]healthCheck) {
+	checks := map[string]healthCheck{
+		"config":         s.checkConfig(),
+		"provider":       s.checkProvider(ctx),
+		"lock":           checkLock(),
+		"scheduler":      s.checkScheduler(),
+		"last_execution": s.checkLastExecution(),
+	}
+	for _, d := range healthDisks {
+		if c, ok := checkDisk(d.path); ok {
+			checks[d.name] = c
+		}
+	}
+	status := healthOK
+	for _, c := range checks {
+		if c.Status == healthFailed || c.Status == healthDegraded && status == healthOK {
+			status = c.Status
+		}
+	}
+	return status, checks
+}
+
+// providerHealth is the circuit breaker of a provider, as reported by
+// /v1/providers/health.
+type providerHealth struct {
+	llm.BreakerState
+	Active bool `json:"active"` // The daemon's configured provider
+}
+
+// handleProvidersHealth reports the circuit breaker of each provider (see
+// llm.Breaker): whether calls go through, the failures in a row and how
+// often the circuit changed state. Providers not called since the daemon
+// started are reported closed.
+func (s *Server) handleProvidersHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	states := map[string]llm.BreakerState{}
+	for _, st := range llm.Breakers() {
+		states[st.Provider] = st
+	}
+	var providers []providerHealth
+	for _, name := range []string{"gemini", "openai", "anthropic", "local"} {
+		st, ok := states[name]
+		if !ok {
+			st = llm.BreakerState{Provider: name, State: llm.BreakerClosed, Threshold: s.cfg.BreakerFailures,
+				Cooldown: float64(s.cfg.BreakerCooldown), Transitions: map[string]int64{}}
+		}
+		providers = append(providers, providerHealth{BreakerState: st, Active: name == s.cfg.Provider})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":              true,
+		"breaker_enabled": s.cfg.BreakerFailures > 0,
+		"providers":       providers,
+	})
+}
+
+// handleDashboard serves what `lucicodex top -daemon` shows: the daemon's
+// health with the snapshot of dashboard.Collect.
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	snap := dashboard.Collect(s.cfg)
+	snap.Source = "daemon"
+	status, checks := s.health(r.Context())
+	snap.Daemon = &dashboard.Health{Status: status, Checks: map[string]dashboard.Check{}}
+	for name, c := range checks {
+		snap.Daemon.Checks[name] = dashboard.Check(c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":        true,
+		"dashboard": snap,
+	})
+}
+
+// checkConfig validates the configuration the daemon runs with. Invalid
+// settings degrade it; the daemon falls back to defaults where it can.
+func (s *Server) checkConfig() healthCheck {
+	cfg := s.cfg
+	if err := cfg.Validate(); err != nil {
+		return healthCheck{Status: healthDegraded, Message: err.Error()}
+	}
+	return healthCheck{Status: healthOK, Detail: map[string]interface{}{
+		"provider": cfg.Provider,
+		"dry_run":  cfg.DryRun,
+	}}
+}
+
+// checkProvider probes the provider's endpoint, at most once per
+// healthProbeTTL. An unreachable provider degrades the daemon: it still
+// serves history, facts and stored plans.
+func (s *Server) checkProvider(ctx context.Context) healthCheck {
+	s.probe.mu.Lock()
+	defer s.probe.mu.Unlock()
+	if time.Since(s.probe.time) >= healthProbeTTL {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		s.probe.err = probeProvider(ctx, s.cfg)
+		cancel()
+		s.probe.time = time.Now()
+	}
+	detail := map[string]interface{}{"checked": s.probe.time}
+	if s.probe.err != nil {
+		return healthCheck{Status: healthDegraded, Message: s.probe.err.Error(), Detail: detail}
+	}
+	// The endpoint answers, but calls may still be failing
+	for _, st := range llm.Breakers() {
+		if st.Provider == s.cfg.Provider && st.State != llm.BreakerClosed {
+			detail["circuit"] = st.State
+			return healthCheck{Status: healthDegraded, Message: fmt.Sprintf("circuit %s after %d failed calls: %s", st.State, st.Failures, st.LastError), Detail: detail}
+		}
+	}
+	return healthCheck{Status: healthOK, Detail: detail}
+}
+
+// checkDisk reports the free space of the filesystem holding path, and
+// false if there is none.
+func checkDisk(path string) (healthCheck, bool) {
+	if _, err := os.Stat(path); err != nil {
+		return healthCheck{}, false
+	}
+	free, total, err := diskSpace(path)
+	if err != nil {
+		return healthCheck{Status: healthOK, Message: err.Error()}, true
+	}
+	c := healthCheck{Status: healthOK, Detail: map[string]uint64{"free_bytes": free, "total_bytes": total}}
+	switch {
+	case free < diskFullBytes:
+		c.Status, c.Message = healthFailed, fmt.Sprintf("%s is full (%d KiB free)", path, free>>10)
+	case total > 0 && free*100 < total*diskLowPercent:
+		c.Status, c.Message = healthDegraded, fmt.Sprintf("%s is low on space (%d KiB free)", path, free>>10)
+	}
+	return c, true
+}
+
+// checkLock reports who holds the execution lock. A held lock is normal
+// while a plan runs.
+func checkLock() healthCheck {
+	for _, path := range execlock.Paths {
+		if _, err := os.Stat(path); err == nil {
+			holder := execlock.Holder(path)
+			return healthCheck{Status: healthOK, Message: "held by " + holder, Detail: map[string]interface{}{"held": true, "path": path, "holder": holder}}
+		}
+	}
+	return healthCheck{Status: healthOK, Detail: map[string]interface{}{"held": false}}
+}
+
+// checkScheduler reports the background work the daemon waits on: running
+// jobs and an armed network rollback. A rollback past its deadline means its
+// watchdog did not revert the change.
+func (s *Server) checkScheduler() healthCheck {
+	c := healthCheck{Status: healthOK}
+	detail := map[string]interface{}{}
+	if list, err := jobs.Open(s.cfg).List(); err != nil {
+		c.Status, c.Message = healthDegraded, "cannot list jobs: "+err.Error()
+	} else {
+		running := 0
+		for _, j := range list {
+			if j.State == jobs.StateRunning {
+				running++
+			}
+		}
+		detail["jobs_running"] = running
+	}
+	st, pending, err := rollback.Pending(s.cfg.RollbackDir)
+	switch {
+	case err != nil:
+		c.Status, c.Message = healthDegraded, "cannot read rollback state: "+err.Error()
+	case pending && st.Remaining() == 0 && time.Since(st.Deadline) > 30*time.Second:
+		c.Status, c.Message = healthDegraded, fmt.Sprintf("network rollback %s is overdue since %s", st.ID, st.Deadline.Format(time.RFC3339))
+	case pending:
+		c.Message = fmt.Sprintf("network change awaiting confirmation for %ds", int(st.Remaining().Seconds()))
+	}
+	detail["rollback_pending"] = pending
+	if pending {
+		detail["rollback_deadline"] = st.Deadline
+	}
+	c.Detail = detail
+	return c
+}
+
+// checkLastExecution reports the outcome of the latest entry of the audit
+// log. A failed execution degrades the daemon until the next one succeeds.
+// /health needs no token, so the prompt is left out.
+func (s *Server) checkLastExecution() healthCheck {
+	if s.cfg.LogFile == "" {
+		return healthCheck{Status: healthOK, Message: "audit log disabled"}
+	}
+	entries, err := logging.History(s.cfg)
+	if err == nil && len(entries) == 0 {
+		return healthCheck{Status: healthOK, Message: "no executions yet"}
+	}
+	if err != nil {
+		return healthCheck{Status: healthDegraded, Message: "cannot read the audit log: " + err.Error()}
+	}
+	last := entries[len(entries)-1]
+	c := healthCheck{Status: healthOK, Message: last.Status(), Detail: map[string]interface{}{
+		"id":   last.ID,
+		"time": last.Time,
+	}}
+	if last.Status() == "failed" {
+		c.Status = healthDegraded
+	}
+	return c
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/dashboard"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
+	"github.com/aezizhu/LuciCodex/internal/live"
+	"github.com/aezizhu/LuciCodex/internal/llm"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// stubProbe makes provider probes return err and counts them.
+func stubProbe(t *testing.T, err error) *int {
+	calls := new(int)
+	old := probeProvider
+	probeProvider = func(context.Context, config.Config) error {
+		*calls++
+		return err
+	}
+	t.Cleanup(func() { probeProvider = old })
+	return calls
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func getHealth(t *testing.T, s *Server, query string) (int, healthResponse) {
+	req, _ := http.NewRequest("GET", "/health"+query, nil)
+	rr := httptest.NewRecorder()
+	s.mux.ServeHTTP(rr, req)
+	var resp healthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid body %q: %v", rr.Body.String(), err)
+	}
+	return rr.Code, resp
+}
+
+func TestServer_Health(t *testing.T) {
+	calls := stubProbe(t, nil)
+	oldDisks, oldPaths := healthDisks, execlock.Paths
+	defer func() { healthDisks, execlock.Paths = oldDisks, oldPaths }()
+	healthDisks = healthDisks[:0:0]
+	execlock.Paths = []string{filepath.Join(t.TempDir(), "lucicodex.lock")}
+
+	cfg := config.Config{Provider: "openai", TimeoutSeconds: 30, MaxCommands: 10, JobsDir: t.TempDir(), RollbackDir: t.TempDir(), LogFile: filepath.Join(t.TempDir(), "audit.log")}
+	s := New(cfg)
+
+	code, resp := getHealth(t, s, "")
+	if code != http.StatusOK || resp.Status != healthOK {
+		t.Fatalf("unexpected health %d %+v", code, resp)
+	}
+	for _, name := range []string{"config", "provider", "lock", "scheduler", "last_execution"} {
+		c, ok := resp.Checks[name]
+		if !ok || c.Status != healthOK || c.Detail != nil {
+			t.Errorf("unexpected %s check %+v", name, c)
+		}
+	}
+	if resp.Checks["last_execution"].Message != "no executions yet" {
+		t.Errorf("unexpected last execution %+v", resp.Checks["last_execution"])
+	}
+
+	// A failed execution and a held lock show up; the probe is cached
+	l := logging.Open(cfg)
+	l.Plan("check wan", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"ifup", "wan"}}}})
+	l.Results([]logging.ResultItem{{Command: []string{"ifup", "wan"}, Error: "exit status 1"}})
+	lock, err := execlock.Acquire("cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+	code, resp = getHealth(t, s, "?verbose=1")
+	if code != http.StatusOK || resp.Status != healthDegraded || resp.Checks["last_execution"].Status != healthDegraded {
+		t.Fatalf("unexpected health %d %+v", code, resp)
+	}
+	if c := resp.Checks["lock"]; !strings.Contains(c.Message, "owner=cli") || c.Detail.(map[string]interface{})["held"] != true {
+		t.Errorf("unexpected lock check %+v", c)
+	}
+	if d, ok := resp.Checks["last_execution"].Detail.(map[string]interface{}); !ok || d["id"] == nil || d["prompt"] != nil {
+		t.Errorf("expected details with verbose, got %+v", resp.Checks["last_execution"])
+	}
+	if *calls != 1 {
+		t.Errorf("expected one probe, got %d", *calls)
+	}
+}
+
+func TestServer_Dashboard(t *testing.T) {
+	stubProbe(t, nil)
+	oldDisks, oldPaths, oldLive := healthDisks, execlock.Paths, live.Path
+	defer func() { healthDisks, execlock.Paths, live.Path = oldDisks, oldPaths, oldLive }()
+	healthDisks = healthDisks[:0:0]
+	dir := t.TempDir()
+	execlock.Paths = []string{filepath.Join(dir, "lucicodex.lock")}
+	live.Path = filepath.Join(dir, "live.json")
+
+	cfg := config.Config{Provider: "openai", TimeoutSeconds: 30, MaxCommands: 10, JobsDir: t.TempDir(), RollbackDir: t.TempDir(), LogFile: filepath.Join(dir, "audit.log")}
+	s := New(cfg)
+	l := logging.Open(cfg)
+	l.Plan("restart wifi", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}})
+	lock, err := execlock.Acquire("daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+	live.Start(0, "wifi reload")
+
+	req, _ := http.NewRequest("GET", "/v1/dashboard", nil)
+	req.Header.Set("X-Auth-Token", s.GetToken())
+	rr := httptest.NewRecorder()
+	s.mux.ServeHTTP(rr, req)
+	var resp struct {
+		Dashboard dashboard.Snapshot `json:"dashboard"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("unexpected response %d %s", rr.Code, rr.Body.String())
+	}
+	d := resp.Dashboard
+	if d.Source != "daemon" || d.Daemon == nil || d.Daemon.Status != healthOK || d.Daemon.Checks["lock"].Detail == nil {
+		t.Errorf("unexpected daemon status %+v", d.Daemon)
+	}
+	r := d.Running
+	if r == nil || r.Owner != "daemon" || r.Prompt != "restart wifi" || len(r.Commands) != 1 || r.Live == nil || !r.Live.Running || r.Live.Command != "wifi reload" {
+		t.Errorf("unexpected running execution %+v", r)
+	}
+	if len(d.Recent) != 1 || d.Recent[0].Status != "planned" {
+		t.Errorf("unexpected recent executions %+v", d.Recent)
+	}
+}
+
+func TestServer_HealthDegraded(t *testing.T) {
+	stubProbe(t, errors.New("openai endpoint unreachable: no route to host"))
+	s := New(config.Config{})
+	code, resp := getHealth(t, s, "")
+	if code != http.StatusOK || resp.Status != healthDegraded {
+		t.Fatalf("unexpected health %d %+v", code, resp)
+	}
+	if c := resp.Checks["provider"]; c.Status != healthDegraded || !strings.Contains(c.Message, "no route to host") {
+		t.Errorf("unexpected provider check %+v", c)
+	}
+	if c := resp.Checks["config"]; c.Status != healthDegraded || !strings.Contains(c.Message, "provider") {
+		t.Errorf("unexpected config check %+v", c)
+	}
+}
+
+func TestCheckDisk(t *testing.T) {
+	if _, ok := checkDisk(filepath.Join(t.TempDir(), "missing")); ok {
+		t.Error("expected no check for a missing path")
+	}
+	c, ok := checkDisk(t.TempDir())
+	if !ok || c.Status == "" {
+		t.Errorf("unexpected check %+v", c)
+	}
+}
+
+func TestServer_ProvidersHealth(t *testing.T) {
+	stubProbe(t, nil)
+	oldDisks := healthDisks
+	defer func() { healthDisks = oldDisks }()
+	healthDisks = healthDisks[:0:0]
+	var healthy atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"candidates":[{"content":{"parts":[{"text":"{\"summary\":\"ok\",\"commands\":[]}"}]}}]}`))
+	}))
+	defer upstream.Close()
+	cfg := config.Config{Provider: "gemini", APIKey: "k", Endpoint: upstream.URL, BreakerFailures: 1, BreakerCooldown: 1,
+		TimeoutSeconds: 30, JobsDir: t.TempDir(), RollbackDir: t.TempDir()}
+	client := llm.NewGeminiClient(cfg)
+	defer func() {
+		// Close the circuit again for other tests
+		healthy.Store(true)
+		time.Sleep(time.Second)
+		client.GeneratePlan(context.Background(), "hi")
+	}()
+	client.GeneratePlan(context.Background(), "hi")
+
+	s := New(cfg)
+	req, _ := http.NewRequest("GET", "/v1/providers/health", nil)
+	req.Header.Set("X-Auth-Token", s.GetToken())
+	rr := httptest.NewRecorder()
+	s.mux.ServeHTTP(rr, req)
+	var resp struct {
+		Enabled   bool `json:"breaker_enabled"`
+		Providers []struct {
+			Provider    string           `json:"provider"`
+			State       string           `json:"state"`
+			Active      bool             `json:"active"`
+			LastError   string           `json:"last_error"`
+			Transitions map[string]int64 `json:"transitions"`
+		} `json:"providers"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || !resp.Enabled || len(resp.Providers) != 4 {
+		t.Fatalf("unexpected response %d %s", rr.Code, rr.Body.String())
+	}
+	gemini, openai := resp.Providers[0], resp.Providers[1]
+	if gemini.Provider != "gemini" || gemini.State != "open" || !gemini.Active || gemini.LastError != "HTTP 502" || gemini.Transitions["closed->open"] != 1 {
+		t.Errorf("unexpected gemini breaker %+v", gemini)
+	}
+	if openai.Provider != "openai" || openai.State != "closed" || openai.Active {
+		t.Errorf("unexpected openai breaker %+v", openai)
+	}
+
+	_, health := getHealth(t, s, "")
+	if c := health.Checks["provider"]; c.Status != healthDegraded || !strings.Contains(c.Message, "circuit open") {
+		t.Errorf("expected the open circuit to degrade the provider check, got %+v", c)
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+const (
+	// idempotencyTTL is how long a result is replayed for retries.
+	idempotencyTTL = time.Hour
+	// maxIdempotencyEntries bounds the memory held by cached results; the
+	// oldest are dropped first.
+	maxIdempotencyEntries = 64
+	// maxIdempotencyKey is the longest Idempotency-Key accepted.
+	maxIdempotencyKey = 255
+)
+
+// idempotencyEntry is the response to the first request with a key.
+type idempotencyEntry struct {
+	done    chan struct{} // Closed when the response below is complete
+	digest  string        // Hash of the request body, to detect reused keys
+	created time.Time
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+// idempotencyCache holds /v1/execute responses by token and Idempotency-Key
+// so that a client retrying after a dropped connection gets the result of
+// the first attempt instead of running the plan again.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{entries: map[string]*idempotencyEntry{}}
+}
+
+// begin returns the entry for key and whether it already existed. A new
+// entry must be finished with finish or abandon.
+func (c *idempotencyCache) begin(key, digest string) (*idempotencyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if e := c.entries[key]; e != nil && now.Sub(e.created) < idempotencyTTL {
+		return e, true
+	}
+	var oldest string
+	for k, e := range c.entries {
+		if now.Sub(e.created) >= idempotencyTTL {
+			delete(c.entries, k)
+		} else if oldest == "" || e.created.Before(c.entries[oldest].created) {
+			oldest = k
+		}
+	}
+	if len(c.entries) >= maxIdempotencyEntries {
+		delete(c.entries, oldest)
+	}
+	e := &idempotencyEntry{done: make(chan struct{}), digest: digest, created: now}
+	c.entries[key] = e
+	return e, false
+}
+
+// finish stores the response of e and wakes requests waiting for it.
+func (c *idempotencyCache) finish(e *idempotencyEntry, status int, header http.Header, body []byte) {
+	e.status, e.header, e.body = status, header, body
+	close(e.done)
+}
+
+// abandon forgets key, e.g. after a server error, so a retry runs again.
+func (c *idempotencyCache) abandon(key string, e *idempotencyEntry) {
+	c.mu.Lock()
+	if c.entries[key] == e {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// withIdempotency wraps handler so that requests with an Idempotency-Key
+// header run at most once per token and key within idempotencyTTL. A retry
+// while the first request is still running waits for its result. Reusing a
+// key for a different request body is a conflict.
+func (s *Server) withIdempotency(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			errcode.WriteHTTP(w, errcode.InvalidRequest, fmt.Sprintf("Idempotency-Key longer than %d bytes", maxIdempotencyKey))
+			return
+		}
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys are scoped to the token so clients cannot read each
+		// other's results; only a hash of the token is kept
+		scope := sha256.Sum256([]byte(requestToken(r)))
+		cacheKey := hex.EncodeToString(scope[:8]) + ":" + key
+		sum := sha256.Sum256(body)
+		digest := hex.EncodeToString(sum[:])
+
+		e, existed := s.idempotency.begin(cacheKey, digest)
+		if existed {
+			if e.digest != digest {
+				errcode.WriteHTTP(w, errcode.Conflict, "Idempotency-Key was already used for a different request")
+				return
+			}
+			select {
+			case <-e.done:
+			case <-r.Context().Done():
+				return
+			}
+			if e.status == 0 {
+				// The first attempt was abandoned; the client may retry
+				errcode.WriteHTTP(w, errcode.Conflict, "The first request with this Idempotency-Key failed; retry it")
+				return
+			}
+			fmt.Printf("Replaying /v1/execute result for Idempotency-Key %q\n", key)
+			for k, v := range e.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+
+		rec := &captureWriter{ResponseWriter: w}
+		stored := false
+		defer func() {
+			if !stored {
+				s.idempotency.abandon(cacheKey, e)
+			}
+		}()
+		handler(rec, r)
+		if rec.status == 0 || rec.status >= 500 {
+			return
+		}
+		// rec.buf holds the body as the handler wrote it, before any
+		// compression; the replay is encoded anew
+		header := w.Header().Clone()
+		for _, k := range []string{"Content-Encoding", "Content-Length", "Vary"} {
+			header.Del(k)
+		}
+		s.idempotency.finish(e, rec.status, header, rec.buf.Bytes())
+		stored = true
+	}
+}
+
+// captureWriter writes through to the client and keeps a copy of the
+// response for later replays.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (c *captureWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.buf.Write(b)
+	return c.ResponseWriter.Write(b)
+}
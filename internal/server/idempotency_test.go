@@ -0,0 +1,109 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+func TestServer_ExecuteIdempotencyKey(t *testing.T) {
+	s := New(config.Config{TimeoutSeconds: 10, ArtifactsDir: t.TempDir()})
+	do := func(key, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/v1/execute", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", token)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr
+	}
+	idOf := func(rr *httptest.ResponseRecorder) string {
+		var resp struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp.ID
+	}
+	body := `{"commands": [{"command": ["date", "+%s%N"]}]}`
+
+	first := do("retry-1", s.GetToken(), body)
+	if first.Code != http.StatusOK || idOf(first) == "" {
+		t.Fatalf("first request: %d %s", first.Code, first.Body.String())
+	}
+	retry := do("retry-1", s.GetToken(), body)
+	if retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry ran again: %s vs %s", retry.Body.String(), first.Body.String())
+	}
+	if other := do("retry-2", s.GetToken(), body); idOf(other) == idOf(first) {
+		t.Error("a new key replayed the old result")
+	}
+	if plain := do("", s.GetToken(), body); idOf(plain) == idOf(first) {
+		t.Error("a request without a key replayed a result")
+	}
+
+	if rr := do("retry-1", s.GetToken(), `{"commands": [{"command": ["echo", "other"]}]}`); rr.Code != http.StatusConflict {
+		t.Errorf("reused key with another body: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do(strings.Repeat("k", 300), s.GetToken(), body); rr.Code != http.StatusBadRequest {
+		t.Errorf("oversized key: %d", rr.Code)
+	}
+}
+
+func TestServer_IdempotencyReplayCompressed(t *testing.T) {
+	s := New(config.Config{TimeoutSeconds: 10, ArtifactsDir: t.TempDir()})
+	do := func() (*httptest.ResponseRecorder, string) {
+		req, _ := http.NewRequest("POST", "/v1/execute", strings.NewReader(`{"commands": [{"command": ["seq", "1", "400"]}]}`))
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Idempotency-Key", "gzip-1")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		if rr.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("expected a gzipped response, got %d %v", rr.Code, rr.Header())
+		}
+		gz, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("body is not gzip: %v", err)
+		}
+		b, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr, string(b)
+	}
+
+	first, body := do()
+	if first.Code != http.StatusOK || len(body) < 1024 {
+		t.Fatalf("first request: %d %d bytes", first.Code, len(body))
+	}
+	retry, replayed := do()
+	if retry.Header().Get("Idempotent-Replayed") != "true" || replayed != body {
+		t.Errorf("unexpected replay %v: %s", retry.Header(), replayed)
+	}
+}
+
+func TestIdempotencyCache_Bounded(t *testing.T) {
+	c := newIdempotencyCache()
+	for i := 0; i < maxIdempotencyEntries+10; i++ {
+		e, existed := c.begin(strings.Repeat("x", i+1), "digest")
+		if existed {
+			t.Fatalf("key %d already existed", i)
+		}
+		c.finish(e, http.StatusOK, http.Header{}, nil)
+	}
+	if len(c.entries) != maxIdempotencyEntries {
+		t.Errorf("cache holds %d entries, want %d", len(c.entries), maxIdempotencyEntries)
+	}
+	if _, existed := c.begin("x", "digest"); existed {
+		t.Error("oldest entry was kept")
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// ServeHTTP routes r through the instrumented mux: every request, including
+// unknown paths and WebSocket upgrades, is counted under its route pattern
+// with its status code and duration. Responses are gzipped for clients
+// that accept it (see compressWriter), except WebSocket upgrades.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, pattern := s.mux.Handler(r)
+	if pattern == "" {
+		// Arbitrary paths would make the endpoint set unbounded
+		pattern = "unmatched"
+	}
+	done := s.metrics.Server().Begin(pattern)
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() { done(rec.code()) }()
+	if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" || !acceptsGzip(r) {
+		s.mux.ServeHTTP(rec, r)
+		return
+	}
+	cw := newCompressWriter(rec)
+	defer cw.Close()
+	s.mux.ServeHTTP(cw, r)
+}
+
+// statusRecorder remembers the status code written through it. It keeps
+// the Hijacker and Flusher of the underlying writer for WebSocket upgrades
+// and streamed responses.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, buf, err := hj.Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+func (r *statusRecorder) code() int {
+	if r.status == 0 {
+		// Nothing written: net/http sends 200
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// handleMetrics serves the daemon's own counters since it started.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":     true,
+		"server": s.metrics.Server().Snapshot(),
+	})
+}
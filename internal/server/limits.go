@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// Body limits of the endpoints that take JSON. A router has little memory
+// to spare, so a body is never read past its endpoint's limit.
+const (
+	maxSmallBody     = 8 << 10  // Feedback, job stop and token requests
+	maxPlanBody      = 64 << 10 // Prompt, provider keys and clarifications
+	maxExecuteBody   = 1 << 20  // Commands, including file contents
+	maxSummarizeBody = 1 << 20  // Command output
+	maxMCPBody       = 1 << 20
+	// maxWSMessage bounds a WebSocket message, however many frames it
+	// comes in. Messages carry the same requests as the HTTP endpoints, so
+	// it is the largest of their limits.
+	maxWSMessage = maxExecuteBody
+)
+
+// Field limits, in characters.
+const (
+	maxPromptChars = 4096
+	maxNoteChars   = 1024
+	// Client hints kept for the audit log (see actor)
+	maxUserAgent   = 256
+	maxSessionHint = 64
+)
+
+// withBodyLimit caps the body of requests to handler at limit bytes and
+// refuses POST and PUT requests whose Content-Type is not application/json,
+// including those that send none.
+func withBodyLimit(limit int64, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			ct := r.Header.Get("Content-Type")
+			if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != "application/json" {
+				errcode.WriteHTTP(w, errcode.UnsupportedMediaType, fmt.Sprintf("Unsupported Content-Type %q; send application/json", ct))
+				return
+			}
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		handler(w, r)
+	}
+}
+
+// decodeBody decodes the JSON body of r into v. On failure it writes the
+// error response, REQUEST_TOO_LARGE for a body over the endpoint's limit,
+// and returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeBodyError(w, err)
+		return false
+	}
+	return true
+}
+
+// readBody is decodeBody for handlers that need the body itself.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return nil, false
+	}
+	return body, true
+}
+
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		errcode.WriteHTTP(w, errcode.RequestTooLarge, fmt.Sprintf("Request body larger than %d bytes", tooLarge.Limit))
+		return
+	}
+	errcode.WriteHTTP(w, errcode.InvalidRequest, "Invalid request body")
+}
+
+// checkLength returns an INVALID_REQUEST error if the field name is longer
+// than max characters.
+func checkLength(name, value string, max int) error {
+	if utf8.RuneCountInString(value) > max {
+		return errcode.Errorf(errcode.InvalidRequest, "%s too long (max %d chars)", name, max)
+	}
+	return nil
+}
+
+// headerHint returns the header value v for the audit log: printable ASCII
+// only, cut to max bytes.
+func headerHint(v string, max int) string {
+	v = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, v)
+	if len(v) > max {
+		v = v[:max]
+	}
+	return strings.TrimSpace(v)
+}
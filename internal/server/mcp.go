@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,10 +11,16 @@ import (
 	"strings"
 	"time"
 
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
 	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/files"
+	"github.com/aezizhu/LuciCodex/internal/logging"
 	"github.com/aezizhu/LuciCodex/internal/openwrt"
 	"github.com/aezizhu/LuciCodex/internal/plan"
 	"github.com/aezizhu/LuciCodex/internal/policy"
+	"github.com/aezizhu/LuciCodex/internal/redact"
+	"github.com/aezizhu/LuciCodex/internal/services"
 )
 
 // MCP (Model Context Protocol) implementation
@@ -49,8 +56,15 @@ const (
 	MCPMethodNotFound = -32601
 	MCPInvalidParams  = -32602
 	MCPInternalError  = -32603
+	MCPRateLimited    = -32000 // Server-defined: a per-tool rate limit was hit
 )
 
+// mcpSessionHeader carries the session ID issued by initialize
+const mcpSessionHeader = "Mcp-Session-Id"
+
+// mcpMaxSessions bounds the remembered client identities
+const mcpMaxSessions = 64
+
 // MCPServerInfo represents server information
 type MCPServerInfo struct {
 	Name         string   `json:"name"`
@@ -73,15 +87,37 @@ type MCPResource struct {
 	MimeType    string `json:"mimeType,omitempty"`
 }
 
+// MCPPrompt represents a prompt template definition
+type MCPPrompt struct {
+	Name        string              `json:"name"`
+	Description string              `json:"description,omitempty"`
+	Arguments   []MCPPromptArgument `json:"arguments,omitempty"`
+}
+
+// MCPPromptArgument represents an argument of a prompt template
+type MCPPromptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// historyLimit is the number of log entries served by history://recent
+const historyLimit = 20
+
 // handleMCP handles MCP JSON-RPC requests
 func (s *Server) handleMCP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	var req MCPRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			sendMCPError(w, nil, MCPInvalidRequest, fmt.Sprintf("Request larger than %d bytes", tooLarge.Limit), nil)
+			return
+		}
 		sendMCPError(w, nil, MCPParseError, "Parse error", nil)
 		return
 	}
@@ -94,23 +130,30 @@ func (s *Server) handleMCP(w http.ResponseWriter, r *http.Request) {
 	// Route to appropriate handler
 	var result interface{}
 	var mcpErr *MCPError
+	method := req.Method
 
 	switch req.Method {
 	case "initialize":
-		result, mcpErr = s.mcpInitialize(req.Params)
+		result, mcpErr = s.mcpInitialize(w, req.Params)
 	case "tools/list":
 		result, mcpErr = s.mcpListTools()
 	case "tools/call":
-		result, mcpErr = s.mcpCallTool(r.Context(), req.Params)
+		result, mcpErr = s.mcpCallTool(r.Context(), s.mcpClient(r), req.Params)
 	case "resources/list":
 		result, mcpErr = s.mcpListResources()
 	case "resources/read":
-		result, mcpErr = s.mcpReadResource(req.Params)
+		result, mcpErr = s.mcpReadResource(r.Context(), req.Params)
+	case "prompts/list":
+		result, mcpErr = s.mcpListPrompts()
+	case "prompts/get":
+		result, mcpErr = s.mcpGetPrompt(req.Params)
 	case "ping":
 		result = map[string]string{"status": "ok"}
 	default:
 		mcpErr = &MCPError{Code: MCPMethodNotFound, Message: "Method not found: " + req.Method}
+		method = "unknown" // Counted together, whatever clients send
 	}
+	s.metrics.Server().CountMCP(method)
 
 	if mcpErr != nil {
 		sendMCPError(w, req.ID, mcpErr.Code, mcpErr.Message, mcpErr.Data)
@@ -120,8 +163,37 @@ func (s *Server) handleMCP(w http.ResponseWriter, r *http.Request) {
 	sendMCPResponse(w, req.ID, result)
 }
 
-// mcpInitialize handles the initialize request
-func (s *Server) mcpInitialize(params json.RawMessage) (interface{}, *MCPError) {
+// mcpInitialize handles the initialize request. The client's name and
+// version are remembered under a new session ID, which the client sends back
+// in the Mcp-Session-Id header so its executions can be attributed to it.
+func (s *Server) mcpInitialize(w http.ResponseWriter, params json.RawMessage) (interface{}, *MCPError) {
+	var req struct {
+		ClientInfo struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"clientInfo"`
+	}
+	json.Unmarshal(params, &req)
+	client := req.ClientInfo.Name
+	if client == "" {
+		client = "unknown"
+	}
+	if req.ClientInfo.Version != "" {
+		client += "/" + req.ClientInfo.Version
+	}
+	if id, err := generateToken(); err == nil {
+		s.mcpMu.Lock()
+		if len(s.mcpClients) >= mcpMaxSessions {
+			for k := range s.mcpClients {
+				delete(s.mcpClients, k)
+				break
+			}
+		}
+		s.mcpClients[id] = client
+		s.mcpMu.Unlock()
+		w.Header().Set(mcpSessionHeader, id)
+	}
+
 	return map[string]interface{}{
 		"protocolVersion": "2024-11-05",
 		"serverInfo": MCPServerInfo{
@@ -130,11 +202,13 @@ func (s *Server) mcpInitialize(params json.RawMessage) (interface{}, *MCPError)
 			Capabilities: []string{
 				"tools",
 				"resources",
+				"prompts",
 			},
 		},
 		"capabilities": map[string]interface{}{
 			"tools":     map[string]bool{"listChanged": false},
 			"resources": map[string]bool{"subscribe": false, "listChanged": false},
+			"prompts":   map[string]bool{"listChanged": false},
 		},
 	}, nil
 }
@@ -171,7 +245,7 @@ func (s *Server) mcpListTools() (interface{}, *MCPError) {
 		},
 		{
 			Name:        "uci_commit",
-			Description: "Commit UCI changes and optionally reload services",
+			Description: "Commit UCI changes and optionally reload services (requires approval)",
 			InputSchema: map[string]interface{}{
 				"type": "object",
 				"properties": map[string]interface{}{
@@ -181,9 +255,20 @@ func (s *Server) mcpListTools() (interface{}, *MCPError) {
 				"required": []string{"config"},
 			},
 		},
+		{
+			Name:        "uci_revert",
+			Description: "Discard staged (uncommitted) UCI changes of a config (requires approval); see resource uci://changes",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"config": map[string]string{"type": "string", "description": "Config file whose staged changes are discarded"},
+				},
+				"required": []string{"config"},
+			},
+		},
 		{
 			Name:        "exec",
-			Description: "Execute a command (validated against policy)",
+			Description: "Prepare a command for execution (validated against policy; requires approval)",
 			InputSchema: map[string]interface{}{
 				"type": "object",
 				"properties": map[string]interface{}{
@@ -192,11 +277,61 @@ func (s *Server) mcpListTools() (interface{}, *MCPError) {
 						"items":       map[string]string{"type": "string"},
 						"description": "Command as array of arguments",
 					},
-					"description": map[string]string{"type": "string", "description": "Description of what the command does"},
+					"description":  map[string]string{"type": "string", "description": "Description of what the command does"},
+					"ack_warnings": map[string]string{"type": "boolean", "description": "Acknowledge policy warnings for this command"},
 				},
 				"required": []string{"command"},
 			},
 		},
+		{
+			Name:        "approve",
+			Description: "Run the commands a tool prepared, by the approvalToken it returned. Tokens can be used once and expire after a few minutes; the commands are checked against the policy again.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"token":        map[string]string{"type": "string", "description": "approvalToken returned by the tool that prepared the commands"},
+					"ack_warnings": map[string]string{"type": "boolean", "description": "Acknowledge policy warnings of the prepared commands"},
+				},
+				"required": []string{"token"},
+			},
+		},
+		{
+			Name:        "file_read",
+			Description: "Read a file within the allowed file paths (file_paths, default /etc/config and /tmp)",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]string{"type": "string", "description": "Absolute path of the file"},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "file_write",
+			Description: "Replace a file within the allowed file paths (requires approval). Returns a diff of the change; the old file is backed up when it is written.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path":         map[string]string{"type": "string", "description": "Absolute path of the file"},
+					"content":      map[string]string{"type": "string", "description": "New contents of the file"},
+					"ack_warnings": map[string]string{"type": "boolean", "description": "Acknowledge policy warnings for this write"},
+				},
+				"required": []string{"path", "content"},
+			},
+		},
+		{
+			Name:        "service_control",
+			Description: "List init services, show the status of one, or start, stop, restart, reload, enable or disable it through procd. Actions other than list and status require approval.",
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"action":       map[string]interface{}{"type": "string", "enum": []string{"list", "status", "start", "stop", "restart", "reload", "enable", "disable"}},
+					"name":         map[string]string{"type": "string", "description": "Service name, as in /etc/init.d (e.g. dnsmasq); required except for list"},
+					"ack_warnings": map[string]string{"type": "boolean", "description": "Acknowledge policy warnings for this action"},
+				},
+				"required": []string{"action"},
+			},
+		},
 		{
 			Name:        "diagnostics",
 			Description: "Run network diagnostics",
@@ -209,6 +344,19 @@ func (s *Server) mcpListTools() (interface{}, *MCPError) {
 				"required": []string{"type"},
 			},
 		},
+		{
+			Name:        "log_tail",
+			Description: fmt.Sprintf("Follow the system log (logread -f) for a few seconds and return new lines, optionally only those of one service or matching a pattern (secrets redacted; at most %ds and %d lines)", mcpTailMaxSeconds, mcpTailMaxLines),
+			InputSchema: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"service":   map[string]string{"type": "string", "description": "Only lines logged by this program, e.g. dnsmasq or netifd"},
+					"pattern":   map[string]string{"type": "string", "description": "Only lines matching this regular expression"},
+					"seconds":   map[string]interface{}{"type": "integer", "description": fmt.Sprintf("How long to follow the log (default %d)", mcpTailSeconds)},
+					"max_lines": map[string]interface{}{"type": "integer", "description": fmt.Sprintf("Stop after this many lines (default %d)", mcpTailLines)},
+				},
+			},
+		},
 		{
 			Name:        "facts",
 			Description: "Collect system facts (hostname, interfaces, etc.)",
@@ -223,7 +371,7 @@ func (s *Server) mcpListTools() (interface{}, *MCPError) {
 }
 
 // mcpCallTool executes a tool
-func (s *Server) mcpCallTool(ctx context.Context, params json.RawMessage) (interface{}, *MCPError) {
+func (s *Server) mcpCallTool(ctx context.Context, client string, params json.RawMessage) (interface{}, *MCPError) {
 	var req struct {
 		Name      string          `json:"name"`
 		Arguments json.RawMessage `json:"arguments"`
@@ -231,18 +379,33 @@ func (s *Server) mcpCallTool(ctx context.Context, params json.RawMessage) (inter
 	if err := json.Unmarshal(params, &req); err != nil {
 		return nil, &MCPError{Code: MCPInvalidParams, Message: "Invalid params"}
 	}
+	if l := s.toolLimiters[req.Name]; l != nil && !l.allow() {
+		return nil, &MCPError{Code: MCPRateLimited, Message: "Rate limit exceeded for tool " + req.Name, Data: map[string]string{"code": string(errcode.RateLimited)}}
+	}
 
 	switch req.Name {
 	case "uci_get":
-		return s.toolUCIGet(req.Arguments)
+		return s.toolUCIGet(ctx, req.Arguments)
 	case "uci_set":
-		return s.toolUCISet(ctx, req.Arguments)
+		return s.toolUCISet(ctx, client, req.Arguments)
 	case "uci_commit":
-		return s.toolUCICommit(ctx, req.Arguments)
+		return s.toolUCICommit(ctx, client, req.Arguments)
+	case "uci_revert":
+		return s.toolUCIRevert(ctx, client, req.Arguments)
 	case "exec":
-		return s.toolExec(ctx, req.Arguments)
+		return s.toolExec(ctx, client, req.Arguments)
+	case "approve":
+		return s.toolApprove(ctx, client, req.Arguments)
+	case "file_read":
+		return s.toolFileRead(ctx, client, req.Arguments)
+	case "file_write":
+		return s.toolFileWrite(ctx, client, req.Arguments)
+	case "service_control":
+		return s.toolServiceControl(ctx, client, req.Arguments)
 	case "diagnostics":
-		return s.toolDiagnostics(ctx, req.Arguments)
+		return s.toolDiagnostics(ctx, client, req.Arguments)
+	case "log_tail":
+		return s.toolLogTail(ctx, client, req.Arguments)
 	case "facts":
 		return s.toolFacts(ctx)
 	default:
@@ -251,7 +414,7 @@ func (s *Server) mcpCallTool(ctx context.Context, params json.RawMessage) (inter
 }
 
 // toolUCIGet reads a UCI value
-func (s *Server) toolUCIGet(args json.RawMessage) (interface{}, *MCPError) {
+func (s *Server) toolUCIGet(ctx context.Context, args json.RawMessage) (interface{}, *MCPError) {
 	var params struct {
 		Config  string `json:"config"`
 		Section string `json:"section"`
@@ -268,7 +431,7 @@ func (s *Server) toolUCIGet(args json.RawMessage) (interface{}, *MCPError) {
 	}
 
 	// Execute uci get
-	output, err := executor.DefaultRunCommand(context.Background(), []string{"uci", "get", path})
+	output, err := executor.DefaultRunCommand(ctx, []string{"uci", "get", path})
 	if err != nil {
 		return map[string]interface{}{
 			"content": []map[string]string{{"type": "text", "text": "Error: " + err.Error()}},
@@ -281,8 +444,8 @@ func (s *Server) toolUCIGet(args json.RawMessage) (interface{}, *MCPError) {
 	}, nil
 }
 
-// toolUCISet sets a UCI value (dry-run only, returns command for approval)
-func (s *Server) toolUCISet(ctx context.Context, args json.RawMessage) (interface{}, *MCPError) {
+// toolUCISet prepares setting a UCI value for approval
+func (s *Server) toolUCISet(ctx context.Context, client string, args json.RawMessage) (interface{}, *MCPError) {
 	var params struct {
 		Config  string `json:"config"`
 		Section string `json:"section"`
@@ -295,19 +458,13 @@ func (s *Server) toolUCISet(ctx context.Context, args json.RawMessage) (interfac
 
 	path := params.Config + "." + params.Section + "." + params.Option
 	cmd := []string{"uci", "set", path + "=" + params.Value}
-
-	// Return the command for approval (dry-run mode)
-	return map[string]interface{}{
-		"content": []map[string]string{
-			{"type": "text", "text": fmt.Sprintf("Command prepared (requires approval): %s", executor.FormatCommand(cmd))},
-		},
-		"pendingCommand": cmd,
-		"requiresApproval": true,
-	}, nil
+	text := fmt.Sprintf("Command prepared (requires approval): %s", executor.FormatCommand(cmd))
+	return s.prepareApproval(ctx, client, "mcp uci_set: "+path, text, []plan.PlannedCommand{{Command: cmd}}, false), nil
 }
 
-// toolUCICommit commits UCI changes
-func (s *Server) toolUCICommit(ctx context.Context, args json.RawMessage) (interface{}, *MCPError) {
+// toolUCICommit prepares committing UCI changes, and optionally reloading
+// the service, for approval
+func (s *Server) toolUCICommit(ctx context.Context, client string, args json.RawMessage) (interface{}, *MCPError) {
 	var params struct {
 		Config string `json:"config"`
 		Reload bool   `json:"reload"`
@@ -317,29 +474,78 @@ func (s *Server) toolUCICommit(ctx context.Context, args json.RawMessage) (inter
 	}
 
 	cmd := []string{"uci", "commit", params.Config}
+	commands := []plan.PlannedCommand{{Command: cmd}}
+	if params.Reload {
+		commands = append(commands, plan.PlannedCommand{Command: []string{"/etc/init.d/" + params.Config, "reload"}})
+	}
+	text := fmt.Sprintf("Commit command prepared (requires approval): %s", executor.FormatCommand(cmd))
+	return s.prepareApproval(ctx, client, "mcp uci_commit: "+params.Config, text, commands, false), nil
+}
 
-	// Return for approval
-	result := map[string]interface{}{
-		"content": []map[string]string{
-			{"type": "text", "text": fmt.Sprintf("Commit command prepared (requires approval): %s", executor.FormatCommand(cmd))},
-		},
-		"pendingCommands": [][]string{cmd},
-		"requiresApproval": true,
+// toolUCIRevert prepares `uci revert` for a config for approval, listing
+// the staged changes it would discard
+func (s *Server) toolUCIRevert(ctx context.Context, client string, args json.RawMessage) (interface{}, *MCPError) {
+	var params struct {
+		Config string `json:"config"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return nil, &MCPError{Code: MCPInvalidParams, Message: err.Error()}
+	}
+	if !validUCIConfig(params.Config) {
+		return nil, &MCPError{Code: MCPInvalidParams, Message: fmt.Sprintf("Invalid config name %q", params.Config)}
 	}
 
-	if params.Reload {
-		reloadCmd := []string{"/etc/init.d/" + params.Config, "reload"}
-		result["pendingCommands"] = [][]string{cmd, reloadCmd}
+	changes, err := stagedChanges(ctx, params.Config)
+	if err != nil {
+		return map[string]interface{}{
+			"content": []map[string]string{{"type": "text", "text": "Error: " + err.Error()}},
+			"isError": true,
+		}, nil
+	}
+	if changes == "" {
+		return map[string]interface{}{
+			"content": []map[string]string{{"type": "text", "text": "No staged changes in " + params.Config}},
+		}, nil
 	}
 
-	return result, nil
+	cmd := []string{"uci", "revert", params.Config}
+	text := fmt.Sprintf("Revert command prepared (requires approval): %s\nDiscards:\n%s", executor.FormatCommand(cmd), changes)
+	return s.prepareApproval(ctx, client, "mcp uci_revert: "+params.Config, text, []plan.PlannedCommand{{Command: cmd}}, false), nil
 }
 
-// toolExec executes a validated command
-func (s *Server) toolExec(ctx context.Context, args json.RawMessage) (interface{}, *MCPError) {
+// stagedChanges returns `uci changes` for config, or for every config if it
+// is empty, with secrets redacted.
+func stagedChanges(ctx context.Context, config string) (string, error) {
+	argv := []string{"uci", "changes"}
+	if config != "" {
+		argv = append(argv, config)
+	}
+	out, err := executor.DefaultRunCommand(ctx, argv)
+	if err != nil {
+		return "", err
+	}
+	return redact.String(strings.TrimSpace(out)), nil
+}
+
+// validUCIConfig accepts names of files in /etc/config.
+func validUCIConfig(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// toolExec prepares a command for approval
+func (s *Server) toolExec(ctx context.Context, client string, args json.RawMessage) (interface{}, *MCPError) {
 	var params struct {
 		Command     []string `json:"command"`
 		Description string   `json:"description"`
+		AckWarnings bool     `json:"ack_warnings"`
 	}
 	if err := json.Unmarshal(args, &params); err != nil {
 		return nil, &MCPError{Code: MCPInvalidParams, Message: err.Error()}
@@ -348,48 +554,143 @@ func (s *Server) toolExec(ctx context.Context, args json.RawMessage) (interface{
 	if len(params.Command) == 0 {
 		return nil, &MCPError{Code: MCPInvalidParams, Message: "Empty command"}
 	}
+	pc := plan.PlannedCommand{Command: params.Command, Description: params.Description}
+	text := fmt.Sprintf("Command prepared (requires approval): %s", executor.FormatCommand(pc.Command))
+	return s.prepareApproval(ctx, client, "mcp exec: "+params.Description, text, []plan.PlannedCommand{pc}, params.AckWarnings), nil
+}
 
-	// Validate against policy
-	p := plan.Plan{
-		Commands: []plan.PlannedCommand{{
-			Command:     params.Command,
-			Description: params.Description,
-		}},
-	}
+// runToolCommand validates pc against the policy and runs it under the
+// execution lock, recording it in the audit log as prompt.
+func (s *Server) runToolCommand(ctx context.Context, client, prompt string, pc plan.PlannedCommand, ackWarnings bool) interface{} {
+	result, _ := s.runToolPlan(ctx, client, prompt, plan.Plan{Commands: []plan.PlannedCommand{pc}}, ackWarnings)
+	return result
+}
 
-	policyEngine := policy.New(s.cfg)
+// runToolPlan validates p against the policy and runs its commands under
+// the execution lock, recording them in the audit log as prompt. ran is
+// false if nothing was run.
+func (s *Server) runToolPlan(ctx context.Context, client, prompt string, p plan.Plan, ackWarnings bool) (result interface{}, ran bool) {
+	logger := s.auditLogger(ctx).WithClient(mcpClientTag(client))
+	policyEngine := policy.New(s.cfg).WithControl(controlPath(ctx, s.cfg, clientAddrFrom(ctx), localAddrFrom(ctx))).WithTopology(deviceTopology(ctx, s.cfg)).WithFirewall(deviceFirewall(ctx, s.cfg))
 	if err := policyEngine.ValidatePlan(p); err != nil {
+		logger.Rejected(prompt, p, err.Error())
 		return map[string]interface{}{
-			"content": []map[string]string{{"type": "text", "text": "Policy violation: " + err.Error()}},
+			"content": []map[string]string{{"type": "text", "text": "Policy violation: " + policy.Explain(err)}},
 			"isError": true,
-		}, nil
+		}, false
+	}
+	p.PolicyWarnings = policyEngine.Warnings(p)
+	if err := policy.RequireAck(p, ackWarnings); err != nil {
+		return map[string]interface{}{
+			"content": []map[string]string{{"type": "text", "text": "Policy warning: " + p.PolicyWarnings[0].Message + "; call again with ack_warnings=true to run it"}},
+			"isError": true,
+		}, false
+	}
+
+	lock, err := execlock.Acquire(mcpClientTag(client))
+	if err != nil {
+		return mcpLockedResult(err), false
 	}
+	defer lock.Release()
 
 	// Execute
+	logger.Plan(prompt, p)
 	execEngine := executor.New(s.cfg)
 	results := execEngine.RunPlan(ctx, p)
+	logResults(logger, results)
+	s.factsChanged(results)
 
 	if len(results.Items) == 0 {
 		return map[string]interface{}{
 			"content": []map[string]string{{"type": "text", "text": "No output"}},
-		}, nil
+		}, true
 	}
 
-	r := results.Items[0]
-	if r.Err != nil {
-		return map[string]interface{}{
-			"content": []map[string]string{{"type": "text", "text": r.Output + "\nError: " + r.Err.Error()}},
-			"isError": true,
-		}, nil
+	var out strings.Builder
+	failed := false
+	for _, r := range results.Items {
+		if len(results.Items) > 1 {
+			fmt.Fprintf(&out, "$ %s\n", executor.FormatCommand(r.Command))
+		}
+		out.WriteString(r.Output)
+		if r.Err != nil {
+			out.WriteString("\nError: " + r.Err.Error())
+			failed = true
+		}
+		if len(results.Items) > 1 {
+			out.WriteString("\n")
+		}
 	}
+	res := map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": out.String()}},
+	}
+	if failed {
+		res["isError"] = true
+	}
+	return res, true
+}
 
-	return map[string]interface{}{
-		"content": []map[string]string{{"type": "text", "text": r.Output}},
-	}, nil
+// toolFileRead returns a file through the built-in file.read command
+func (s *Server) toolFileRead(ctx context.Context, client string, args json.RawMessage) (interface{}, *MCPError) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil || params.Path == "" {
+		return nil, &MCPError{Code: MCPInvalidParams, Message: "path is required"}
+	}
+	pc := plan.PlannedCommand{Command: []string{plan.FileRead, params.Path}, Description: "Read " + params.Path}
+	return s.runToolCommand(ctx, client, "mcp file_read: "+params.Path, pc, false), nil
+}
+
+// toolFileWrite prepares a file.write command for approval, showing the
+// diff of the change
+func (s *Server) toolFileWrite(ctx context.Context, client string, args json.RawMessage) (interface{}, *MCPError) {
+	var params struct {
+		Path        string `json:"path"`
+		Content     string `json:"content"`
+		AckWarnings bool   `json:"ack_warnings"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil || params.Path == "" {
+		return nil, &MCPError{Code: MCPInvalidParams, Message: "path is required"}
+	}
+	pc := plan.PlannedCommand{Command: []string{plan.FileWrite, params.Path}, Content: params.Content, Description: "Write " + params.Path}
+	text := "Changes to " + params.Path + " (requires approval):\n" + files.Preview(params.Path, params.Content)
+	return s.prepareApproval(ctx, client, "mcp file_write: "+params.Path, text, []plan.PlannedCommand{pc}, params.AckWarnings), nil
+}
+
+// toolServiceControl lists or inspects services through the built-in
+// service commands, and prepares the others for approval
+func (s *Server) toolServiceControl(ctx context.Context, client string, args json.RawMessage) (interface{}, *MCPError) {
+	var params struct {
+		Action      string `json:"action"`
+		Name        string `json:"name"`
+		AckWarnings bool   `json:"ack_warnings"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return nil, &MCPError{Code: MCPInvalidParams, Message: err.Error()}
+	}
+	op := plan.ServiceCommand(params.Action)
+	switch {
+	case op == "":
+		return nil, &MCPError{Code: MCPInvalidParams, Message: "Unknown service action: " + params.Action}
+	case op == plan.ServiceList:
+		pc := plan.PlannedCommand{Command: []string{op}, Description: "List services"}
+		return s.runToolCommand(ctx, client, "mcp service_control: list", pc, false), nil
+	case !services.ValidName(params.Name):
+		return nil, &MCPError{Code: MCPInvalidParams, Message: "a valid service name is required"}
+	}
+	verb := strings.ToUpper(params.Action[:1]) + params.Action[1:]
+	pc := plan.PlannedCommand{Command: []string{op, params.Name}, Description: verb + " " + params.Name}
+	prompt := "mcp service_control: " + params.Action + " " + params.Name
+	if op == plan.ServiceStatus {
+		return s.runToolCommand(ctx, client, prompt, pc, false), nil
+	}
+	text := fmt.Sprintf("%s service %s (requires approval)", verb, params.Name)
+	return s.prepareApproval(ctx, client, prompt, text, []plan.PlannedCommand{pc}, params.AckWarnings), nil
 }
 
 // toolDiagnostics runs network diagnostics
-func (s *Server) toolDiagnostics(ctx context.Context, args json.RawMessage) (interface{}, *MCPError) {
+func (s *Server) toolDiagnostics(ctx context.Context, client string, args json.RawMessage) (interface{}, *MCPError) {
 	var params struct {
 		Type   string `json:"type"`
 		Target string `json:"target"`
@@ -398,37 +699,27 @@ func (s *Server) toolDiagnostics(ctx context.Context, args json.RawMessage) (int
 		return nil, &MCPError{Code: MCPInvalidParams, Message: err.Error()}
 	}
 
-	var cmd []string
-	switch params.Type {
-	case "ping":
-		target := params.Target
-		if target == "" {
-			target = "8.8.8.8"
-		}
-		cmd = []string{"ping", "-c", "4", target}
-	case "traceroute":
-		target := params.Target
-		if target == "" {
-			target = "8.8.8.8"
-		}
-		cmd = []string{"traceroute", "-m", "10", target}
-	case "nslookup":
-		target := params.Target
-		if target == "" {
-			target = "google.com"
-		}
-		cmd = []string{"nslookup", target}
-	case "ifconfig":
-		if params.Target != "" {
-			cmd = []string{"ifconfig", params.Target}
-		} else {
-			cmd = []string{"ifconfig"}
-		}
-	default:
+	cmd, err := openwrt.DiagnosticCommand(params.Type, params.Target)
+	if err != nil {
 		return nil, &MCPError{Code: MCPInvalidParams, Message: "Unknown diagnostic type: " + params.Type}
 	}
 
+	lock, err := execlock.Acquire(mcpClientTag(client))
+	if err != nil {
+		return mcpLockedResult(err), nil
+	}
+	defer lock.Release()
+
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: cmd, Description: params.Type + " diagnostic"}}}
+	logger := s.auditLogger(ctx).WithClient(mcpClientTag(client))
+	logger.Plan("mcp diagnostics: "+params.Type, p)
+	start := time.Now()
 	output, err := executor.DefaultRunCommand(ctx, cmd)
+	item := logging.ResultItem{Command: cmd, Output: output, Elapsed: time.Since(start)}
+	if err != nil {
+		item.Error = err.Error()
+	}
+	logger.Results([]logging.ResultItem{item})
 	if err != nil {
 		return map[string]interface{}{
 			"content": []map[string]string{{"type": "text", "text": output + "\nError: " + err.Error()}},
@@ -479,13 +770,25 @@ func (s *Server) mcpListResources() (interface{}, *MCPError) {
 			Description: "Last 50 lines of system log",
 			MimeType:    "text/plain",
 		},
+		{
+			URI:         "uci://changes",
+			Name:        "Staged UCI Changes",
+			Description: "Uncommitted UCI changes across all configs, i.e. what uci_commit would apply (secrets redacted)",
+			MimeType:    "text/plain",
+		},
+		{
+			URI:         "history://recent",
+			Name:        "Recent Executions",
+			Description: fmt.Sprintf("Last %d plans from the audit log with their results (secrets redacted)", historyLimit),
+			MimeType:    "application/json",
+		},
 	}
 
 	return map[string]interface{}{"resources": resources}, nil
 }
 
 // mcpReadResource reads a resource
-func (s *Server) mcpReadResource(params json.RawMessage) (interface{}, *MCPError) {
+func (s *Server) mcpReadResource(ctx context.Context, params json.RawMessage) (interface{}, *MCPError) {
 	var req struct {
 		URI string `json:"uri"`
 	}
@@ -499,7 +802,7 @@ func (s *Server) mcpReadResource(params json.RawMessage) (interface{}, *MCPError
 	switch {
 	case strings.HasPrefix(req.URI, "config://"):
 		configName := strings.TrimPrefix(req.URI, "config://")
-		output, err := executor.DefaultRunCommand(context.Background(), []string{"uci", "export", configName})
+		output, err := executor.DefaultRunCommand(ctx, []string{"uci", "export", configName})
 		if err != nil {
 			return nil, &MCPError{Code: MCPInternalError, Message: err.Error()}
 		}
@@ -507,13 +810,31 @@ func (s *Server) mcpReadResource(params json.RawMessage) (interface{}, *MCPError
 		content = sanitizeConfig(output)
 
 	case req.URI == "syslog://recent":
-		output, err := executor.DefaultRunCommand(context.Background(), []string{"logread", "-l", "50"})
+		output, err := executor.DefaultRunCommand(ctx, []string{"logread", "-l", "50"})
 		if err != nil {
 			// Try dmesg as fallback
-			output, _ = executor.DefaultRunCommand(context.Background(), []string{"dmesg"})
+			output, _ = executor.DefaultRunCommand(ctx, []string{"dmesg"})
 		}
 		content = output
 
+	case req.URI == "uci://changes":
+		changes, err := stagedChanges(ctx, "")
+		if err != nil {
+			return nil, &MCPError{Code: MCPInternalError, Message: err.Error()}
+		}
+		content = changes
+		if content == "" {
+			content = "No staged changes"
+		}
+
+	case req.URI == "history://recent":
+		history, err := s.recentHistory()
+		if err != nil {
+			return nil, &MCPError{Code: MCPInternalError, Message: err.Error()}
+		}
+		content = history
+		mimeType = "application/json"
+
 	default:
 		return nil, &MCPError{Code: MCPInvalidParams, Message: "Unknown resource: " + req.URI}
 	}
@@ -529,6 +850,157 @@ func (s *Server) mcpReadResource(params json.RawMessage) (interface{}, *MCPError
 	}, nil
 }
 
+// recentHistory returns the last historyLimit entries of the history as
+// JSON, with prompts and command output redacted.
+func (s *Server) recentHistory() (string, error) {
+	entries, err := logging.History(s.cfg)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) > historyLimit {
+		entries = entries[len(entries)-historyLimit:]
+	}
+	for i := range entries {
+		e := &entries[i]
+		e.Prompt = redact.String(e.Prompt)
+		results := make([]logging.ResultItem, len(e.Results))
+		for j, r := range e.Results {
+			r.Output = redact.String(r.Output)
+			r.Stderr = redact.String(r.Stderr)
+			r.Error = redact.String(r.Error)
+			results[j] = r
+		}
+		e.Results = results
+	}
+	if entries == nil {
+		entries = []logging.HistoryEntry{}
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// mcpPrompt is a prompt template: render builds the user message from the
+// arguments, which have been checked against Arguments.
+type mcpPrompt struct {
+	MCPPrompt
+	render func(args map[string]string) string
+}
+
+var mcpPrompts = []mcpPrompt{
+	{
+		MCPPrompt: MCPPrompt{
+			Name:        "diagnose-wifi",
+			Description: "Find out why wireless clients cannot connect or have poor performance",
+			Arguments: []MCPPromptArgument{
+				{Name: "radio", Description: "Radio to focus on, e.g. radio0 (default: all)"},
+				{Name: "symptom", Description: "What the user observes, e.g. \"clients drop every few minutes\""},
+			},
+		},
+		render: func(args map[string]string) string {
+			var b strings.Builder
+			b.WriteString("Diagnose the wireless setup of this OpenWrt router")
+			if r := args["radio"]; r != "" {
+				fmt.Fprintf(&b, ", focusing on %s", r)
+			}
+			b.WriteString(".\n")
+			if s := args["symptom"]; s != "" {
+				fmt.Fprintf(&b, "Reported symptom: %s\n", s)
+			}
+			b.WriteString("Read the config://wireless resource, then use the exec tool with read-only commands " +
+				"(wifi status, iwinfo, logread with a filter) to check radio state, channel, country code, " +
+				"encryption and associated clients. Report the likely cause and propose uci_set changes, " +
+				"but do not apply them without approval.")
+			return b.String()
+		},
+	},
+	{
+		MCPPrompt: MCPPrompt{
+			Name:        "harden-firewall",
+			Description: "Review the firewall for exposed services and propose safer settings",
+			Arguments: []MCPPromptArgument{
+				{Name: "wan_zone", Description: "Name of the upstream firewall zone (default: wan)"},
+			},
+		},
+		render: func(args map[string]string) string {
+			zone := args["wan_zone"]
+			if zone == "" {
+				zone = "wan"
+			}
+			return fmt.Sprintf("Review the firewall of this OpenWrt router for exposure on the %q zone.\n"+
+				"Read the config://firewall resource and check the zone input/forward policies, "+
+				"redirects and rules that accept traffic from %q, and whether SSH or LuCI are reachable from it. "+
+				"List each finding with its risk, then propose the uci_set changes that fix it. "+
+				"Do not commit anything without approval.", zone, zone)
+		},
+	},
+	{
+		MCPPrompt: MCPPrompt{
+			Name:        "diagnose-internet",
+			Description: "Find out why the router or its clients cannot reach the internet",
+			Arguments: []MCPPromptArgument{
+				{Name: "target", Description: "Host that should be reachable (default: openwrt.org)"},
+			},
+		},
+		render: func(args map[string]string) string {
+			target := args["target"]
+			if target == "" {
+				target = "openwrt.org"
+			}
+			return fmt.Sprintf("Find out why %s is not reachable from this OpenWrt router.\n"+
+				"Use the facts tool, read the config://network resource, and run the diagnostics tool "+
+				"(ifconfig, ping, nslookup, traceroute) to check the WAN link, default route and DNS in that order. "+
+				"Stop at the first failing layer, explain it and propose a fix.", target)
+		},
+	},
+}
+
+// mcpListPrompts returns available prompt templates
+func (s *Server) mcpListPrompts() (interface{}, *MCPError) {
+	prompts := make([]MCPPrompt, len(mcpPrompts))
+	for i, p := range mcpPrompts {
+		prompts[i] = p.MCPPrompt
+	}
+	return map[string]interface{}{"prompts": prompts}, nil
+}
+
+// mcpGetPrompt renders a prompt template
+func (s *Server) mcpGetPrompt(params json.RawMessage) (interface{}, *MCPError) {
+	var req struct {
+		Name      string            `json:"name"`
+		Arguments map[string]string `json:"arguments"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil {
+		return nil, &MCPError{Code: MCPInvalidParams, Message: err.Error()}
+	}
+
+	for _, p := range mcpPrompts {
+		if p.Name != req.Name {
+			continue
+		}
+		args := map[string]string{}
+		for _, a := range p.Arguments {
+			v := strings.TrimSpace(req.Arguments[a.Name])
+			if a.Required && v == "" {
+				return nil, &MCPError{Code: MCPInvalidParams, Message: "Missing argument: " + a.Name}
+			}
+			args[a.Name] = v
+		}
+		return map[string]interface{}{
+			"description": p.Description,
+			"messages": []map[string]interface{}{
+				{
+					"role":    "user",
+					"content": map[string]string{"type": "text", "text": p.render(args)},
+				},
+			},
+		}, nil
+	}
+	return nil, &MCPError{Code: MCPInvalidParams, Message: "Unknown prompt: " + req.Name}
+}
+
 // sanitizeConfig removes sensitive data from configuration
 func sanitizeConfig(config string) string {
 	lines := strings.Split(config, "\n")
@@ -597,3 +1069,64 @@ func readFileContent(path string, maxSize int64) (string, error) {
 	}
 	return string(data), nil
 }
+
+// mcpToolLimits are the per-tool limits for tools/call: a burst size and the
+// interval at which one more call is allowed. Tools that run commands on the
+// router are throttled harder than reads; unlisted tools only hit the global
+// request limit.
+var mcpToolLimits = map[string]struct {
+	burst    int
+	interval time.Duration
+}{
+	"exec":            {5, 6 * time.Second},
+	"approve":         {5, 6 * time.Second},
+	"diagnostics":     {3, 10 * time.Second},
+	"log_tail":        {3, 10 * time.Second},
+	"file_write":      {5, 6 * time.Second},
+	"service_control": {5, 6 * time.Second},
+	"uci_set":         {20, time.Second},
+	"uci_commit":      {5, 6 * time.Second},
+	"uci_revert":      {5, 6 * time.Second},
+}
+
+func newToolLimiters() map[string]*rateLimiter {
+	limiters := make(map[string]*rateLimiter, len(mcpToolLimits))
+	for name, l := range mcpToolLimits {
+		limiters[name] = newRateLimiterPer(l.burst, l.interval)
+	}
+	return limiters
+}
+
+// mcpClient returns the name/version the calling client announced at
+// initialize, or "unknown" if the request carries no known session.
+func (s *Server) mcpClient(r *http.Request) string {
+	id := r.Header.Get(mcpSessionHeader)
+	s.mcpMu.Lock()
+	defer s.mcpMu.Unlock()
+	if client, ok := s.mcpClients[id]; ok && id != "" {
+		return client
+	}
+	return "unknown"
+}
+
+// mcpClientTag identifies an MCP client in the lock file and the log.
+func mcpClientTag(client string) string {
+	return "mcp:" + client
+}
+
+// mcpLockedResult reports that another execution holds the lock.
+func mcpLockedResult(err error) map[string]interface{} {
+	return map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": fmt.Sprintf("%s: %v; retry when it has finished", errcode.Of(err), err)}},
+		"isError": true,
+	}
+}
+
+// logResults records executed commands in the audit log.
+func logResults(logger *logging.Logger, results executor.Results) {
+	items := make([]logging.ResultItem, 0, len(results.Items))
+	for _, it := range results.Items {
+		items = append(items, it.LogItem())
+	}
+	logger.Results(items)
+}
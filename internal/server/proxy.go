@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/firewall"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+)
+
+// unixPeer identifies clients of the Unix socket, which have no address.
+const unixPeer = "unix"
+
+// trustedProxies are the reverse proxies (cfg.TrustedProxies) whose
+// forwarding headers name the real client.
+type trustedProxies struct {
+	nets []*net.IPNet
+	unix bool // Unix socket peers, e.g. uhttpd on the router
+}
+
+// parseTrustedProxies parses IPs, CIDRs and "unix". Invalid entries are
+// rejected by config.Validate; any that get here are ignored.
+func parseTrustedProxies(entries []string) trustedProxies {
+	var tp trustedProxies
+	for _, e := range entries {
+		if e == unixPeer {
+			tp.unix = true
+			continue
+		}
+		if ip := net.ParseIP(e); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			tp.nets = append(tp.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if _, n, err := net.ParseCIDR(e); err == nil {
+			tp.nets = append(tp.nets, n)
+		}
+	}
+	return tp
+}
+
+// trusts reports whether addr, an IP or unixPeer, is a trusted proxy.
+func (tp trustedProxies) trusts(addr string) bool {
+	if addr == unixPeer {
+		return tp.unix
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range tp.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerAddr returns the IP of the connection r arrived on, or unixPeer.
+func peerAddr(r *http.Request) string {
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return unixPeer
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientAddr identifies the client of r for rate limiting, role checks and
+// auditing. Forwarding headers are only believed when the connection comes
+// from a trusted proxy. X-Forwarded-For is read right to left, skipping
+// trusted proxies, so a client cannot pick its address by sending the
+// header itself; a malformed entry makes the whole header untrusted.
+func (s *Server) clientAddr(r *http.Request) string {
+	peer := peerAddr(r)
+	if !s.proxies.trusts(peer) {
+		return peer
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				return peer
+			}
+			if !s.proxies.trusts(ip.String()) {
+				return ip.String()
+			}
+		}
+		return peer
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
+
+type clientAddrKey struct{}
+
+// withClientAddr returns r with its client address in the context, for
+// handlers that log it.
+func (s *Server) withClientAddr(r *http.Request) (*http.Request, string) {
+	if addr, ok := r.Context().Value(clientAddrKey{}).(string); ok {
+		return r, addr
+	}
+	addr := s.clientAddr(r)
+	return r.WithContext(context.WithValue(r.Context(), clientAddrKey{}, addr)), addr
+}
+
+// clientAddrFrom returns the client address stored by withClientAddr.
+func clientAddrFrom(ctx context.Context) string {
+	addr, _ := ctx.Value(clientAddrKey{}).(string)
+	return addr
+}
+
+// localAddrFrom returns the router address the request arrived at, or ""
+// for the Unix socket.
+func localAddrFrom(ctx context.Context) string {
+	addr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// controlPath returns the path on which client reaches the router at local,
+// for the policy to guard, or nil with control_guard "off".
+func controlPath(ctx context.Context, cfg config.Config, client, local string) *openwrt.ControlPath {
+	if cfg.ControlGuard == "off" {
+		return nil
+	}
+	return openwrt.FindControlPath(ctx, client, local)
+}
+
+// topologyTTL is how long the daemon reuses the detected topology, which
+// changes rarely, instead of running uci, iw and batctl for every plan.
+const topologyTTL = time.Minute
+
+var topologyCache struct {
+	sync.Mutex
+	at       time.Time
+	topology *openwrt.Topology
+}
+
+// deviceTopology returns the device's place in the network for the policy
+// (see policy.Engine.WithTopology), or nil with ap_guard "off".
+func deviceTopology(ctx context.Context, cfg config.Config) *openwrt.Topology {
+	if cfg.APGuard == "off" {
+		return nil
+	}
+	topologyCache.Lock()
+	defer topologyCache.Unlock()
+	if time.Since(topologyCache.at) > topologyTTL {
+		topologyCache.topology = openwrt.DetectTopology(ctx)
+		topologyCache.at = time.Now()
+	}
+	return topologyCache.topology
+}
+
+// deviceFirewall returns the redirect and rule sections of the firewall for
+// the policy (see policy.Engine.WithFirewall), or nil with firewall_guard
+// "off". Unlike the topology they are read for every plan, since plans
+// change them.
+func deviceFirewall(ctx context.Context, cfg config.Config) []firewall.Rule {
+	if cfg.FirewallGuard == "off" {
+		return nil
+	}
+	return firewall.Load(ctx)
+}
+
+// clientLimiters rate limits each client address separately, so one client
+// behind a proxy cannot exhaust the others' budget.
+type clientLimiters struct {
+	mu        sync.Mutex
+	max       int
+	perSecond int
+	m         map[string]*rateLimiter
+}
+
+// maxClientLimiters bounds the buckets kept; full buckets are dropped first
+// since a new bucket starts full anyway.
+const maxClientLimiters = 256
+
+func newClientLimiters(max, refillPerSecond int) *clientLimiters {
+	return &clientLimiters{max: max, perSecond: refillPerSecond, m: map[string]*rateLimiter{}}
+}
+
+// get returns the limiter of client, creating it if needed.
+func (cl *clientLimiters) get(client string) *rateLimiter {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if rl := cl.m[client]; rl != nil {
+		return rl
+	}
+	if len(cl.m) >= maxClientLimiters {
+		for c, rl := range cl.m {
+			if rl.level() >= float64(cl.max) {
+				delete(cl.m, c)
+			}
+		}
+	}
+	rl := newRateLimiter(cl.max, cl.perSecond)
+	cl.m[client] = rl
+	return rl
+}
+
+// levels returns the tokens available to each client.
+func (cl *clientLimiters) levels() map[string]float64 {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	levels := make(map[string]float64, len(cl.m))
+	for c, rl := range cl.m {
+		levels[c] = rl.level()
+	}
+	return levels
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+func TestClientAddr(t *testing.T) {
+	s := New(config.Config{TrustedProxies: []string{"127.0.0.1", "10.0.0.0/8", "unix"}})
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{"direct", "192.0.2.1:4000", nil, "", "192.0.2.1"},
+		{"untrusted peer spoofing", "192.0.2.1:4000", []string{"203.0.113.9"}, "203.0.113.8", "192.0.2.1"},
+		{"trusted proxy", "127.0.0.1:4000", []string{"203.0.113.9"}, "", "203.0.113.9"},
+		{"client-supplied entry ignored", "127.0.0.1:4000", []string{"6.6.6.6, 203.0.113.9"}, "", "203.0.113.9"},
+		{"proxy chain", "127.0.0.1:4000", []string{"203.0.113.9", "10.1.2.3"}, "", "203.0.113.9"},
+		{"only proxies", "127.0.0.1:4000", []string{"10.1.2.3"}, "", "127.0.0.1"},
+		{"malformed entry", "127.0.0.1:4000", []string{"203.0.113.9, bogus"}, "", "127.0.0.1"},
+		{"real ip", "127.0.0.1:4000", nil, "203.0.113.7", "203.0.113.7"},
+		{"ipv6", "[::1]:4000", []string{"203.0.113.9"}, "", "::1"},
+		{"unix socket", "@", []string{"2001:db8::1"}, "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/v1/jobs", nil)
+		r.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := s.clientAddr(r); got != tt.want {
+			t.Errorf("%s: clientAddr = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Without trusted proxies the headers are never believed
+	r := httptest.NewRequest("GET", "/v1/jobs", nil)
+	r.RemoteAddr = "127.0.0.1:4000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if got := New(config.Config{}).clientAddr(r); got != "127.0.0.1" {
+		t.Errorf("untrusted proxy: clientAddr = %q", got)
+	}
+}
+
+func TestServer_RateLimitPerClient(t *testing.T) {
+	s := New(config.Config{JobsDir: t.TempDir(), TrustedProxies: []string{"127.0.0.1"}})
+	get := func(remote, xff string) int {
+		r := httptest.NewRequest("GET", "/v1/jobs", nil)
+		r.RemoteAddr = remote
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		r.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	limited := false
+	for i := 0; i < 40 && !limited; i++ {
+		limited = get("127.0.0.1:4000", "203.0.113.9") == http.StatusTooManyRequests
+	}
+	if !limited {
+		t.Fatal("forwarded client was never rate limited")
+	}
+	if code := get("127.0.0.1:4000", "203.0.113.10"); code != http.StatusOK {
+		t.Errorf("other client behind the proxy limited: %d", code)
+	}
+	// A direct client cannot escape its own bucket by forwarding headers
+	for i := 0; i < 40; i++ {
+		get("192.0.2.1:4000", "")
+	}
+	if code := get("192.0.2.1:4000", "203.0.113.11"); code != http.StatusTooManyRequests {
+		t.Errorf("spoofed X-Forwarded-For escaped the rate limit: %d", code)
+	}
+}
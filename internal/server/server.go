@@ -6,19 +6,40 @@ import (
 	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/aezizhu/LuciCodex/internal/approver"
+	"github.com/aezizhu/LuciCodex/internal/artifacts"
+	"github.com/aezizhu/LuciCodex/internal/auth"
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/digest"
+	"github.com/aezizhu/LuciCodex/internal/docs"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
 	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/export"
+	"github.com/aezizhu/LuciCodex/internal/files"
+	"github.com/aezizhu/LuciCodex/internal/firewall"
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/intent"
+	"github.com/aezizhu/LuciCodex/internal/jobs"
 	"github.com/aezizhu/LuciCodex/internal/llm"
 	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
 	"github.com/aezizhu/LuciCodex/internal/openwrt"
 	"github.com/aezizhu/LuciCodex/internal/plan"
 	"github.com/aezizhu/LuciCodex/internal/policy"
+	"github.com/aezizhu/LuciCodex/internal/rollback"
 )
 
 // TokenFile is the path where the authentication token is stored
@@ -27,17 +48,23 @@ const TokenFile = "/tmp/.lucicodex.token"
 // rateLimiter implements a simple token bucket rate limiter
 type rateLimiter struct {
 	mu       sync.Mutex
-	tokens   int
-	max      int
-	refill   int
+	tokens   float64
+	max      float64
+	refill   float64 // Tokens per second
 	lastTime time.Time
 }
 
 func newRateLimiter(max, refillPerSecond int) *rateLimiter {
+	return newRateLimiterPer(max, time.Second/time.Duration(refillPerSecond))
+}
+
+// newRateLimiterPer returns a limiter allowing bursts of max that regains one
+// token every interval.
+func newRateLimiterPer(max int, interval time.Duration) *rateLimiter {
 	return &rateLimiter{
-		tokens:   max,
-		max:      max,
-		refill:   refillPerSecond,
+		tokens:   float64(max),
+		max:      float64(max),
+		refill:   float64(time.Second) / float64(interval),
 		lastTime: time.Now(),
 	}
 }
@@ -48,27 +75,75 @@ func (rl *rateLimiter) allow() bool {
 
 	// Refill tokens based on elapsed time
 	now := time.Now()
-	elapsed := now.Sub(rl.lastTime).Seconds()
-	rl.tokens += int(elapsed * float64(rl.refill))
+	rl.tokens += now.Sub(rl.lastTime).Seconds() * rl.refill
 	if rl.tokens > rl.max {
 		rl.tokens = rl.max
 	}
 	rl.lastTime = now
 
-	if rl.tokens > 0 {
+	if rl.tokens >= 1 {
 		rl.tokens--
 		return true
 	}
 	return false
 }
 
+// level returns the tokens currently available.
+func (rl *rateLimiter) level() float64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	tokens := rl.tokens + time.Since(rl.lastTime).Seconds()*rl.refill
+	if tokens > rl.max {
+		tokens = rl.max
+	}
+	return tokens
+}
+
+// setLevel sets the tokens available, e.g. to those of a previous daemon.
+func (rl *rateLimiter) setLevel(tokens float64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.tokens = tokens
+	if rl.tokens > rl.max {
+		rl.tokens = rl.max
+	}
+	if rl.tokens < 0 {
+		rl.tokens = 0
+	}
+	rl.lastTime = time.Now()
+}
+
 type Server struct {
-	cfg     config.Config
-	mux     *http.ServeMux
-	token   string       // Authentication token
-	limiter *rateLimiter // Rate limiter
+	cfg      config.Config
+	mux      *http.ServeMux
+	token    string          // Authentication token, with the admin role
+	limiters *clientLimiters // Rate limiter per client address
+	proxies  trustedProxies  // Proxies whose X-Forwarded-For is believed
+
+	apiTokens *auth.APITokenStore // Named tokens with roles; nil if api_tokens_file is unset
+
+	toolLimiters map[string]*rateLimiter // Per-tool limits for MCP tools/call
+	idempotency  *idempotencyCache       // /v1/execute results by Idempotency-Key
+	mcpMu        sync.Mutex
+	mcpClients   map[string]string // MCP session ID -> client name/version
+
+	factsMu sync.Mutex
+	facts   *openwrt.SystemFacts // Last GET /v1/facts collection, reused for factsCacheTTL
+	touched []string             // Configs changed since the last plan prompt (see factsChanged)
+	changes uint64               // Calls of factsChanged that found changed configs
+
+	inherited bool           // Started by a handover (see handover.go)
+	streams   sync.WaitGroup // Open WebSocket streams, waited for when draining
+
+	metrics *metrics.Collector // Request, WebSocket and MCP counters (see instrument.go)
+
+	approvals approvals     // Commands prepared by MCP tools, by approval token
+	probe     providerProbe // Last provider probe of /health
 }
 
+// factsCacheTTL is how long GET /v1/facts serves a previous collection
+const factsCacheTTL = 30 * time.Second
+
 // generateToken creates a cryptographically secure random token
 func generateToken() (string, error) {
 	b := make([]byte, 32)
@@ -79,11 +154,17 @@ func generateToken() (string, error) {
 }
 
 func New(cfg config.Config) *Server {
-	// Generate authentication token
-	token, err := generateToken()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Failed to generate auth token: %v\n", err)
-		token = "" // Disable auth if token generation fails
+	// Generate authentication token, or keep the previous daemon's
+	handover, inherited, ok := readHandoverState()
+	token := handover.Token
+	if token == "" {
+		// Not handed over, or the state was lost: never run without one
+		var err error
+		token, err = generateToken()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to generate auth token: %v\n", err)
+			token = "" // Disable auth if token generation fails
+		}
 	}
 
 	// Write token to file for LuCI to read
@@ -94,51 +175,186 @@ func New(cfg config.Config) *Server {
 	}
 
 	s := &Server{
-		cfg:     cfg,
-		mux:     http.NewServeMux(),
-		token:   token,
-		limiter: newRateLimiter(30, 2), // 30 requests burst, 2 per second refill
-	}
-
-	// Wrap handlers with middleware
-	s.mux.HandleFunc("/v1/plan", s.withMiddleware(s.handlePlan))
-	s.mux.HandleFunc("/v1/execute", s.withMiddleware(s.handleExecute))
-	s.mux.HandleFunc("/v1/summarize", s.withMiddleware(s.handleSummarize))
-	s.mux.HandleFunc("/v1/ws", s.handleWebSocket)       // WebSocket streaming endpoint
-	s.mux.HandleFunc("/v1/mcp", s.withMiddleware(s.handleMCP)) // MCP protocol endpoint
-	s.mux.HandleFunc("/health", s.handleHealth)         // Health check doesn't need auth
+		cfg:      cfg,
+		mux:      http.NewServeMux(),
+		token:    token,
+		limiters: newClientLimiters(30, 2), // 30 requests burst, 2 per second refill
+		proxies:  parseTrustedProxies(cfg.TrustedProxies),
+
+		toolLimiters: newToolLimiters(),
+		idempotency:  newIdempotencyCache(),
+		mcpClients:   map[string]string{},
+		inherited:    inherited,
+		metrics:      metrics.NewCollector(""),
+	}
+	if ok {
+		s.adoptHandoverState(handover)
+	}
+	if cfg.APITokensFile != "" {
+		s.apiTokens = auth.OpenAPITokenStore(cfg)
+		if err := s.apiTokens.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to load API tokens: %v\n", err)
+		}
+	}
+
+	// Wrap handlers with middleware and the role each route requires; GET
+	// endpoints LuCI polls answer If-None-Match (see withETag)
+	s.mux.HandleFunc("/v1/plan", s.withMiddleware(auth.RoleViewer, withBodyLimit(maxPlanBody, s.handlePlan)))
+	s.mux.HandleFunc("/v1/execute", s.withMiddleware(auth.RoleOperator, withBodyLimit(maxExecuteBody, s.withIdempotency(s.handleExecute))))
+	s.mux.HandleFunc("/v1/summarize", s.withMiddleware(auth.RoleViewer, withBodyLimit(maxSummarizeBody, s.handleSummarize)))
+	s.mux.HandleFunc("/v1/metrics", s.withMiddleware(auth.RoleViewer, s.handleMetrics))
+	s.mux.HandleFunc("/v1/metrics/summary", s.withMiddleware(auth.RoleViewer, withETag(s.handleMetricsSummary)))
+	s.mux.HandleFunc("/v1/metrics/export", s.withMiddleware(auth.RoleViewer, withETag(s.handleMetricsExport)))
+	s.mux.HandleFunc("/v1/dashboard", s.withMiddleware(auth.RoleViewer, withETag(s.handleDashboard)))
+	s.mux.HandleFunc("/v1/facts", s.withMiddleware(auth.RoleViewer, withETag(s.handleFacts)))
+	s.mux.HandleFunc("/v1/providers/health", s.withMiddleware(auth.RoleViewer, withETag(s.handleProvidersHealth)))
+	s.mux.HandleFunc("/v1/digest", s.withMiddleware(auth.RoleViewer, s.handleDigest))
+	s.mux.HandleFunc("/v1/history/export", s.withMiddleware(auth.RoleViewer, withETag(s.handleHistoryExport)))
+	s.mux.HandleFunc("/v1/history/", s.historyRoutes(
+		s.withMiddleware(auth.RoleViewer, s.handleArtifacts),
+		s.withMiddleware(auth.RoleOperator, withBodyLimit(maxSmallBody, s.handleFeedback))))
+	s.mux.HandleFunc("/v1/confirm", s.withMiddleware(auth.RoleOperator, s.handleConfirm))
+	s.mux.HandleFunc("/v1/jobs", s.withMiddleware(auth.RoleViewer, withETag(s.handleJobs)))
+	s.mux.HandleFunc("/v1/jobs/tail", s.withMiddleware(auth.RoleViewer, withETag(s.handleJobTail)))
+	s.mux.HandleFunc("/v1/jobs/stop", s.withMiddleware(auth.RoleOperator, withBodyLimit(maxSmallBody, s.handleJobStop)))
+	s.mux.HandleFunc("/v1/tokens", s.withMiddleware(auth.RoleAdmin, withBodyLimit(maxSmallBody, s.handleTokens)))
+	s.mux.HandleFunc("/v1/ws", s.handleWebSocket)                                                            // WebSocket streaming endpoint
+	s.mux.HandleFunc("/v1/mcp", s.withMiddleware(auth.RoleOperator, withBodyLimit(maxMCPBody, s.handleMCP))) // MCP protocol endpoint
+	s.mux.HandleFunc("/health", s.handleHealth)                                                              // Health check doesn't need auth
 	return s
 }
 
-// withMiddleware wraps a handler with authentication and rate limiting
-func (s *Server) withMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+// withMiddleware wraps a handler with authentication, authorization for
+// role and rate limiting per client address (see clientAddr)
+func (s *Server) withMiddleware(role auth.Role, handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		r, client := s.withClientAddr(r)
 		// Rate limiting
-		if !s.limiter.allow() {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		if !s.limiters.get(client).allow() {
+			fmt.Printf("Rate limit exceeded for %s\n", client)
+			errcode.WriteHTTP(w, errcode.RateLimited, "Rate limit exceeded")
 			return
 		}
 
-		// Authentication (if token is configured)
-		if s.token != "" {
-			authToken := r.Header.Get("X-Auth-Token")
-			if authToken == "" {
-				// Also check Authorization header for Bearer token
-				authHeader := r.Header.Get("Authorization")
-				if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-					authToken = authHeader[7:]
-				}
-			}
+		token := requestToken(r)
+		if !s.authorize(w, client, token, role) {
+			return
+		}
 
-			// Use constant-time comparison to prevent timing attacks
-			if subtle.ConstantTimeCompare([]byte(authToken), []byte(s.token)) != 1 {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
+		handler(w, s.withActor(r, token))
+	}
+}
+
+// requestToken returns the token of r from X-Auth-Token or a Bearer
+// Authorization header.
+func requestToken(r *http.Request) string {
+	authToken := r.Header.Get("X-Auth-Token")
+	if authToken == "" {
+		// Also check Authorization header for Bearer token
+		authHeader := r.Header.Get("Authorization")
+		if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
+			authToken = authHeader[7:]
 		}
+	}
+	return authToken
+}
+
+// authorize checks that token grants role and writes the error response if
+// it does not; refusals are logged with the client address. Without a
+// daemon token (generation failed) auth is disabled.
+func (s *Server) authorize(w http.ResponseWriter, client, token string, role auth.Role) bool {
+	granted, ok := s.roleOf(token)
+	if !ok {
+		fmt.Printf("Unauthorized request from %s\n", client)
+		errcode.WriteHTTP(w, errcode.Unauthorized, "Unauthorized")
+		return false
+	}
+	if !granted.Allows(role) {
+		fmt.Printf("Forbidden request from %s: requires %s, token has %s\n", client, role, granted)
+		errcode.WriteHTTP(w, errcode.Forbidden, fmt.Sprintf("Forbidden: requires the %s role, token has %s", role, granted))
+		return false
+	}
+	return true
+}
+
+// roleOf returns the role of token: admin for the daemon token, the stored
+// role for API tokens.
+func (s *Server) roleOf(token string) (auth.Role, bool) {
+	_, role, ok := s.identify(token)
+	return role, ok
+}
 
-		handler(w, r)
+// identify returns the name and role of token. The daemon token is named
+// "daemon", as is every request when auth is disabled.
+func (s *Server) identify(token string) (string, auth.Role, bool) {
+	if s.token == "" {
+		return "daemon", auth.RoleAdmin, true
+	}
+	// Use constant-time comparison to prevent timing attacks
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+		return "daemon", auth.RoleAdmin, true
+	}
+	if s.apiTokens != nil {
+		if t, ok := s.apiTokens.Lookup(token); ok {
+			return t.Name, t.Role, true
+		}
 	}
+	return "", "", false
+}
+
+type actorKey struct{}
+
+// actor is the token that authorized a request, and what the client said
+// about itself: its User-Agent and the X-LuCI-Session header, which LuCI
+// sets to the user and the start of the session ID of the admin using it.
+type actor struct {
+	name    string
+	role    auth.Role
+	agent   string
+	session string
+}
+
+// withActor returns r with the name and role of its token and the client's
+// hints in the context, for the audit log (see auditLogger).
+func (s *Server) withActor(r *http.Request, token string) *http.Request {
+	name, role, _ := s.identify(token)
+	a := actor{
+		name:    name,
+		role:    role,
+		agent:   headerHint(r.UserAgent(), maxUserAgent),
+		session: headerHint(r.Header.Get("X-LuCI-Session"), maxSessionHint),
+	}
+	return r.WithContext(context.WithValue(r.Context(), actorKey{}, a))
+}
+
+// auditLogger returns a logger that tags entries with the client address,
+// the token and the client's hints of the request in ctx.
+func (s *Server) auditLogger(ctx context.Context) *logging.Logger {
+	l := logging.Open(s.cfg).WithRemote(clientAddrFrom(ctx))
+	if a, ok := ctx.Value(actorKey{}).(actor); ok {
+		l = l.WithActor(a.name, string(a.role)).WithDevice(a.agent, a.session)
+	}
+	return l
+}
+
+// mayStage reports whether the client of ctx may have the file writes of
+// its plans staged. Staging runs the commands feeding them, so it takes an
+// operator, as running the plan does.
+func mayStage(ctx context.Context) bool {
+	a, ok := ctx.Value(actorKey{}).(actor)
+	return ok && a.role.Allows(auth.RoleOperator)
+}
+
+// approvalRequest returns the request for the approval command of a plan
+// the client of ctx asked for.
+func approvalRequest(ctx context.Context, prompt string, p plan.Plan) approver.Request {
+	req := approver.Request{Source: "daemon", Client: clientAddrFrom(ctx), Prompt: prompt, Plan: p}
+	if a, ok := ctx.Value(actorKey{}).(actor); ok {
+		req.Actor, req.Role = a.name, string(a.role)
+		req.UserAgent, req.Session = a.agent, a.session
+		req.Device = logging.Device(req.Client, a.agent)
+	}
+	return req
 }
 
 // GetToken returns the server's authentication token
@@ -148,21 +364,100 @@ func (s *Server) GetToken() string {
 
 func (s *Server) Start(port int) error {
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	ln, err := s.listen(func() (net.Listener, error) { return net.Listen("tcp", addr) })
+	if err != nil {
+		return err
+	}
 	fmt.Printf("LuciCodex Daemon listening on %s\n", addr)
+	s.printAuth()
+	return s.serve(context.Background(), s.httpServer(), ln)
+}
+
+// StartUnix serves the API on a Unix domain socket at path, readable and
+// writable only by the daemon's user, until ctx is done. A stale socket left
+// by a crashed daemon is replaced; the socket is removed on shutdown. The
+// credentials of each connecting process are logged.
+func (s *Server) StartUnix(ctx context.Context, path string) error {
+	ln, err := s.listen(func() (net.Listener, error) {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		return listenUnix(path)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("LuciCodex Daemon listening on unix:%s\n", path)
+	s.printAuth()
+
+	srv := s.httpServer()
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if cred, err := peerCred(c); err == nil {
+			fmt.Printf("Connection from pid %d uid %d gid %d\n", cred.Pid, cred.Uid, cred.Gid)
+		} else {
+			fmt.Printf("Connection from unknown peer: %v\n", err)
+		}
+		return ctx
+	}
+	// Closing the listener on shutdown unlinks the socket
+	return s.serve(ctx, srv, ln)
+}
+
+// directPlan decodes the plan of an ExecuteRequest with commands. The
+// request has the fields of a plan, so older plan versions are migrated like
+// stored plans.
+func directPlan(body []byte) (plan.Plan, error) {
+	p, err := plan.Decode(body)
+	if err != nil {
+		return p, err
+	}
+	p.Summary = "Direct execution"
+	// Computed locally before execution, never taken from the client
+	p.PolicyWarnings = nil
+	p.Estimate = nil
+	p.MissingTools = nil
+	p.Lint = nil
+	p.PolicyTrace = nil
+	p.FileChanges = nil
+	return p, nil
+}
+
+// removeStaleSocket removes a socket at path that nothing is listening on.
+// Other files, and sockets of a running daemon, are left alone.
+func removeStaleSocket(path string) error {
+	st, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if st.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another daemon", path)
+	}
+	return os.Remove(path)
+}
+
+func (s *Server) printAuth() {
 	if s.token != "" {
 		fmt.Printf("Auth token written to %s\n", TokenFile)
 	} else {
 		fmt.Println("Warning: Running without authentication")
 	}
-	// Configure HTTP server with timeouts to prevent resource exhaustion
-	srv := &http.Server{
-		Addr:         addr,
-		Handler:      s.mux,
+}
+
+// httpServer configures an HTTP server with timeouts to prevent resource exhaustion
+func (s *Server) httpServer() *http.Server {
+	return &http.Server{
+		Handler:      s,
 		ReadTimeout:  10 * time.Second,  // Time to read request headers + body
 		WriteTimeout: 120 * time.Second, // Time to write response (LLM calls can be slow)
 		IdleTimeout:  120 * time.Second, // Keep-alive timeout
 	}
-	return srv.ListenAndServe()
 }
 
 type PlanRequest struct {
@@ -170,6 +465,18 @@ type PlanRequest struct {
 	Provider string            `json:"provider"`
 	Model    string            `json:"model"`
 	Config   map[string]string `json:"config"` // API keys override
+	// Answers to the questions of earlier responses to the same prompt, and
+	// the number of rounds they took (1 if unset)
+	Clarifications []prompts.Clarification `json:"clarifications,omitempty"`
+	ClarifyRound   int                     `json:"clarify_round,omitempty"`
+}
+
+// validate checks the fields of a plan request before a model is asked.
+func (r PlanRequest) validate() error {
+	if r.Prompt == "" {
+		return errcode.Errorf(errcode.InvalidRequest, "Prompt is required")
+	}
+	return checkLength("prompt", r.Prompt, maxPromptChars)
 }
 
 type ExecuteRequest struct {
@@ -180,6 +487,22 @@ type ExecuteRequest struct {
 	DryRun   bool                  `json:"dry_run"`
 	Timeout  int                   `json:"timeout"`
 	Commands []plan.PlannedCommand `json:"commands"` // Optional: Direct execution
+	// Version is the plan schema version of Commands and Facts, as in the
+	// plan they came from. Older versions are migrated and newer ones
+	// refused; without it the plan predates versioning.
+	Version int `json:"version,omitempty"`
+	// Facts is the stamp of the plan the commands came from. When present the
+	// plan is refused if the router has drifted from it (see openwrt.CheckStamp).
+	Facts *openwrt.Stamp `json:"facts,omitempty"`
+	// AckWarnings acknowledges the plan's policy warnings; without it a plan
+	// that matches a warnlist rule is not executed.
+	AckWarnings bool `json:"ack_warnings"`
+}
+
+// validate checks the fields of an execute request; the commands are left
+// to plan.Decode and the policy.
+func (r ExecuteRequest) validate() error {
+	return checkLength("prompt", r.Prompt, maxPromptChars)
 }
 
 type SummarizeRequest struct {
@@ -191,26 +514,525 @@ type SummarizeRequest struct {
 	Commands []llm.SummaryCommand `json:"commands"`
 }
 
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("ok"))
+// handleArtifacts lists the files an execution created
+// (GET /v1/history/{id}/artifacts) or downloads one of them
+// (GET /v1/history/{id}/artifacts/{name}).
+func (s *Server) handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/history/"), "/")
+	name, isFile := strings.CutPrefix(rest, "artifacts/")
+	if rest != "artifacts" && !isFile {
+		errcode.WriteHTTP(w, errcode.NotFound, "Unknown history resource")
+		return
+	}
+	store := artifacts.NewStore(s.cfg.ArtifactsDir, s.cfg.ArtifactsMaxMB, s.cfg.ArtifactsRetentionDays)
+	if store == nil {
+		errcode.WriteHTTP(w, errcode.NotFound, "Artifacts are disabled (artifacts_dir not set)")
+		return
+	}
+
+	if isFile {
+		f, err := store.Open(id, name)
+		if err != nil {
+			errcode.WriteHTTP(w, errcode.NotFound, "Artifact not found")
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(name)))
+		io.Copy(w, f)
+		return
+	}
+
+	files, err := store.List(id)
+	if err != nil {
+		errcode.WriteHTTP(w, errcode.NotFound, "No artifacts for execution "+id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":    true,
+		"id":    id,
+		"files": files,
+	})
+}
+
+// historyRoutes sends /v1/history/{id}/feedback to feedback and everything
+// else under /v1/history/ to artifacts, so rating an execution can require
+// a different role than reading it.
+func (s *Server) historyRoutes(artifacts, feedback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/history/"), "/"); rest == "feedback" {
+			feedback(w, r)
+			return
+		}
+		artifacts(w, r)
+	}
+}
+
+// FeedbackRequest rates an execution via POST /v1/history/{id}/feedback.
+type FeedbackRequest struct {
+	Rating string `json:"rating"` // "good" or "bad"
+	Note   string `json:"note,omitempty"`
+}
+
+// handleFeedback records whether an execution worked
+// (POST /v1/history/{id}/feedback).
+func (s *Server) handleFeedback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/history/"), "/")
+	if s.cfg.LogFile == "" {
+		errcode.WriteHTTP(w, errcode.NotFound, "History is disabled (log_file not set)")
+		return
+	}
+	var req FeedbackRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if err := checkLength("note", req.Note, maxNoteChars); err != nil {
+		errcode.WriteHTTPError(w, "", err)
+		return
+	}
+	entry, err := logging.RecordFeedback(s.cfg, id, req.Rating, req.Note)
+	if err != nil {
+		errcode.WriteHTTP(w, errcode.Of(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":       true,
+		"id":       id,
+		"feedback": entry.Feedback,
+	})
+}
+
+// handleFacts serves the router state as structured JSON. Collections are
+// cached for factsCacheTTL unless ?refresh=1 is given; ?redact=ssid,ipv4
+// hides fields in addition to those in facts_redact.
+func (s *Server) handleFacts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	fields := append([]string{}, s.cfg.FactsRedact...)
+	if v := r.URL.Query().Get("redact"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			if !isRedactableField(name) {
+				errcode.WriteHTTP(w, errcode.InvalidRequest, "redact accepts "+strings.Join(openwrt.RedactableFields, ", "))
+				return
+			}
+			fields = append(fields, name)
+		}
+	}
+
+	s.factsMu.Lock()
+	if s.facts == nil || time.Since(s.facts.Collected) > factsCacheTTL || r.URL.Query().Get("refresh") == "1" {
+		f := openwrt.CollectSystemFacts(r.Context())
+		s.facts = &f
+	}
+	facts := *s.facts
+	s.factsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":    true,
+		"facts": facts.Redact(fields),
+	})
+}
+
+// factsChanged invalidates the cached facts and topology when commands of
+// results changed configs (see rollback.Touched), and keeps the configs for
+// the notice of the next plan prompt (see factsBlock).
+func (s *Server) factsChanged(results executor.Results) {
+	var done plan.Plan
+	for _, it := range results.Items {
+		if it.Err == nil {
+			done.Commands = append(done.Commands, plan.PlannedCommand{Command: it.Command})
+		}
+	}
+	touched := rollback.Touched(done)
+	if len(touched) == 0 {
+		return
+	}
+	s.factsMu.Lock()
+	s.facts = nil
+	s.changes++
+	for _, name := range touched {
+		if !containsString(s.touched, name) {
+			s.touched = append(s.touched, name)
+		}
+	}
+	s.factsMu.Unlock()
+
+	topologyCache.Lock()
+	topologyCache.at = time.Time{}
+	topologyCache.Unlock()
+}
+
+// factsBlock is the facts section of a plan prompt, noting the configs
+// changed since the previous plan prompt.
+func (s *Server) factsBlock(f openwrt.Facts) string {
+	block := f.PromptBlock()
+	if block == "" {
+		return ""
+	}
+	s.factsMu.Lock()
+	touched := s.touched
+	s.touched = nil
+	s.factsMu.Unlock()
+	return "\n\n" + block + prompts.FactsRefreshedNotice(touched)
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func isRedactableField(name string) bool {
+	for _, f := range openwrt.RedactableFields {
+		if f == strings.ToLower(strings.TrimSpace(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMetricsSummary serves per-day success rates and per-provider LLM
+// latency from the daily rollups. ?days=N selects the window (default 7).
+func (s *Server) handleMetricsSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	store := metrics.OpenRollupStore(s.cfg)
+	if store == nil {
+		errcode.WriteHTTP(w, errcode.NotFound, "Metrics persistence is disabled (metrics_dir not set)")
+		return
+	}
+	days := 7
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 366 {
+			errcode.WriteHTTP(w, errcode.InvalidRequest, "days must be between 1 and 366")
+			return
+		}
+		days = n
+	}
+	rollups, err := store.Days(days)
+	if err != nil {
+		errcode.WriteHTTP(w, errcode.Internal, fmt.Sprintf("Failed to read metrics: %v", err))
+		return
+	}
+	sum := metrics.Summarize(rollups)
+	if s.cfg.LogFile != "" {
+		if entries, err := logging.History(s.cfg); err == nil {
+			sum.Commands = metrics.CommandOutcomes(entries, time.Now().AddDate(0, 0, -days))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":      true,
+		"window":  days,
+		"summary": sum,
+	})
+}
+
+// handleDigest reports on the executions of the last ?since (default 24h)
+// as digest.Generate does; ?summarize=0 skips the model.
+func (s *Server) handleDigest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	since := 24 * time.Hour
+	if v := r.URL.Query().Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			errcode.WriteHTTP(w, errcode.InvalidRequest, "since must be a positive duration such as 24h")
+			return
+		}
+		since = d
+	}
+	summarize := r.URL.Query().Get("summarize") != "0"
+	report, err := digest.Generate(r.Context(), s.cfg, time.Now().Add(-since), summarize)
+	if err != nil {
+		errcode.WriteHTTPError(w, "Digest failed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":     true,
+		"digest": report,
+	})
+}
+
+// exportParams reads ?format (csv or json, default csv) and ?since (such as
+// 7d or 12h, default 30d) of the export endpoints. It writes the error and
+// returns false if they are invalid.
+func exportParams(w http.ResponseWriter, r *http.Request) (format string, since time.Duration, ok bool) {
+	if r.Method != http.MethodGet {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return "", 0, false
+	}
+	format, since = export.FormatCSV, 30*24*time.Hour
+	if v := r.URL.Query().Get("format"); v != "" {
+		format = v
+	}
+	if err := export.CheckFormat(format); err != nil {
+		errcode.WriteHTTP(w, errcode.InvalidRequest, err.Error())
+		return "", 0, false
+	}
+	if v := r.URL.Query().Get("since"); v != "" {
+		d, err := export.ParseSince(v)
+		if err != nil {
+			errcode.WriteHTTP(w, errcode.InvalidRequest, err.Error())
+			return "", 0, false
+		}
+		since = d
+	}
+	return format, since, true
+}
+
+// writeExport sets the headers of an export download named name.
+func writeExport(w http.ResponseWriter, name, format string) {
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+}
+
+// handleHistoryExport serves the executions of the audit log as rows of
+// time, ID, prompt, commands, status and duration, as `lucicodex history
+// export` prints them.
+func (s *Server) handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	format, since, ok := exportParams(w, r)
+	if !ok {
+		return
+	}
+	if s.cfg.LogFile == "" {
+		errcode.WriteHTTP(w, errcode.NotFound, "History is disabled (log_file not set)")
+		return
+	}
+	entries, err := logging.History(s.cfg)
+	if err != nil {
+		errcode.WriteHTTP(w, errcode.Internal, fmt.Sprintf("Failed to read history: %v", err))
+		return
+	}
+	writeExport(w, "lucicodex-history", format)
+	export.WriteExecutions(w, export.Executions(entries, time.Now().Add(-since)), format)
+}
+
+// handleMetricsExport serves the daily rollups as one row per day, as
+// `lucicodex metrics export` prints them.
+func (s *Server) handleMetricsExport(w http.ResponseWriter, r *http.Request) {
+	format, since, ok := exportParams(w, r)
+	if !ok {
+		return
+	}
+	store := metrics.OpenRollupStore(s.cfg)
+	if store == nil {
+		errcode.WriteHTTP(w, errcode.NotFound, "Metrics persistence is disabled (metrics_dir not set)")
+		return
+	}
+	rollups, err := store.Days(export.WindowDays(since))
+	if err != nil {
+		errcode.WriteHTTP(w, errcode.Internal, fmt.Sprintf("Failed to read metrics: %v", err))
+		return
+	}
+	writeExport(w, "lucicodex-metrics", format)
+	export.WriteDays(w, export.Rollups(rollups), format)
+}
+
+// handleJobs lists background jobs started by executed plans.
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	list, err := jobs.Open(s.cfg).List()
+	if err != nil {
+		errcode.WriteHTTP(w, errcode.Internal, fmt.Sprintf("Failed to list jobs: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":   true,
+		"jobs": list,
+	})
+}
+
+// handleJobTail returns the last ?lines=N (default 50) lines of a job's output.
+func (s *Server) handleJobTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	id := r.URL.Query().Get("id")
+	lines := 50
+	if v := r.URL.Query().Get("lines"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errcode.WriteHTTP(w, errcode.InvalidRequest, "lines must be a non-negative integer")
+			return
+		}
+		lines = n
+	}
+	m := jobs.Open(s.cfg)
+	j, err := m.Get(id)
+	if err != nil {
+		jobError(w, err)
+		return
+	}
+	out, err := m.Tail(id, lines)
+	if err != nil {
+		jobError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":     true,
+		"job":    j,
+		"output": out,
+	})
+}
+
+// JobStopRequest is the body of POST /v1/jobs/stop.
+type JobStopRequest struct {
+	ID string `json:"id"`
+}
+
+func (s *Server) handleJobStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req JobStopRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	fmt.Printf("Stopping job %s\n", req.ID)
+	j, err := jobs.Open(s.cfg).Stop(req.ID)
+	if err != nil {
+		jobError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":  true,
+		"job": j,
+	})
+}
+
+// TokenRequest creates an API token via POST /v1/tokens.
+type TokenRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// tokenInfo is an API token as listed by GET /v1/tokens, without its hash.
+type tokenInfo struct {
+	Name    string    `json:"name"`
+	Role    auth.Role `json:"role"`
+	Created time.Time `json:"created"`
+}
+
+// handleTokens lists (GET), creates (POST) and deletes (DELETE ?name=) the
+// daemon's API tokens. A created token's secret is only returned once.
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if s.apiTokens == nil {
+		errcode.WriteHTTP(w, errcode.ConfigInvalid, "API tokens are disabled (set api_tokens_file)")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		if err := s.apiTokens.Load(); err != nil {
+			errcode.WriteHTTP(w, errcode.Internal, fmt.Sprintf("Failed to read API tokens: %v", err))
+			return
+		}
+		list := []tokenInfo{}
+		for _, t := range s.apiTokens.List() {
+			list = append(list, tokenInfo{Name: t.Name, Role: t.Role, Created: t.Created})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "tokens": list})
+	case http.MethodPost:
+		var req TokenRequest
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		role, err := auth.ParseRole(req.Role)
+		if err != nil {
+			errcode.WriteHTTP(w, errcode.InvalidRequest, err.Error())
+			return
+		}
+		if err := s.apiTokens.Load(); err != nil {
+			errcode.WriteHTTP(w, errcode.Internal, fmt.Sprintf("Failed to read API tokens: %v", err))
+			return
+		}
+		secret, err := s.apiTokens.Create(req.Name, role)
+		if errors.Is(err, auth.ErrTokenExists) {
+			errcode.WriteHTTP(w, errcode.Conflict, err.Error())
+			return
+		} else if err != nil {
+			errcode.WriteHTTP(w, errcode.InvalidRequest, err.Error())
+			return
+		}
+		if err := s.apiTokens.Save(); err != nil {
+			errcode.WriteHTTP(w, errcode.Internal, fmt.Sprintf("Failed to save API tokens: %v", err))
+			return
+		}
+		fmt.Printf("Created API token %s (%s)\n", req.Name, role)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "name": req.Name, "role": role, "token": secret})
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if err := s.apiTokens.Load(); err != nil {
+			errcode.WriteHTTP(w, errcode.Internal, fmt.Sprintf("Failed to read API tokens: %v", err))
+			return
+		}
+		if !s.apiTokens.Delete(name) {
+			errcode.WriteHTTP(w, errcode.NotFound, "No API token named "+name)
+			return
+		}
+		if err := s.apiTokens.Save(); err != nil {
+			errcode.WriteHTTP(w, errcode.Internal, fmt.Sprintf("Failed to save API tokens: %v", err))
+			return
+		}
+		fmt.Printf("Deleted API token %s\n", name)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+	default:
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+	}
+}
+
+func jobError(w http.ResponseWriter, err error) {
+	if errors.Is(err, jobs.ErrNotFound) {
+		errcode.WriteHTTP(w, errcode.NotFound, err.Error())
+		return
+	}
+	errcode.WriteHTTP(w, errcode.Conflict, err.Error())
 }
 
 func (s *Server) handlePlan(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received /v1/plan request")
+	fmt.Printf("Received /v1/plan request from %s\n", clientAddrFrom(r.Context()))
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	var req PlanRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeBody(w, r, &req) {
 		return
 	}
-
-	if req.Prompt == "" {
-		http.Error(w, "Prompt is required", http.StatusBadRequest)
+	if err := req.validate(); err != nil {
+		errcode.WriteHTTPError(w, "", err)
 		return
 	}
 
@@ -258,13 +1080,34 @@ func (s *Server) handlePlan(w http.ResponseWriter, r *http.Request) {
 	// Collect facts
 	factsCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
-	envFacts := openwrt.CollectFacts(factsCtx)
+	envFacts := openwrt.CollectSignedFacts(factsCtx, cfg.FactsKeyFile)
 
-	instruction := prompts.GenerateSurvivalPrompt(cfg.MaxCommands)
-	if envFacts != "" {
-		instruction += "\n\nEnvironment facts (read-only):\n" + envFacts
+	kind, limit := intent.ForPrompt(cfg, req.Prompt)
+	instruction := prompts.GeneratePlanPrompt(kind, limit)
+	instruction += prompts.ExamplesBlock(req.Prompt, cfg.FewShotExamples)
+	instruction += prompts.CommandsBlock(req.Prompt, cfg.CommandSnippets)
+	instruction += firewall.PromptBlock(ctx, req.Prompt)
+	instruction += prompts.FeedbackBlock(cfg, cfg.FeedbackHints)
+	instruction += s.factsBlock(envFacts)
+	if cfg.DocsRetrieval {
+		docsCtx, docsCancel := context.WithTimeout(ctx, 15*time.Second)
+		if block, err := docs.Retrieve(docsCtx, llmProvider, req.Prompt, cfg.DocsTopK); err == nil {
+			instruction += block
+		} else {
+			fmt.Printf("Documentation retrieval skipped: %v\n", err)
+		}
+		docsCancel()
 	}
 	fullPrompt := instruction + "\n\nUser request: " + req.Prompt
+	if cfg.ClarifyRounds == 0 {
+		fullPrompt += prompts.NoQuestionsNotice
+	} else if len(req.Clarifications) > 0 {
+		round := req.ClarifyRound
+		if round < 1 {
+			round = 1
+		}
+		fullPrompt += prompts.ClarificationBlock(req.Clarifications, round >= cfg.ClarifyRounds)
+	}
 
 	// Generate plan with minimum 60 second timeout
 	llmTimeout := cfg.TimeoutSeconds
@@ -275,32 +1118,114 @@ func (s *Server) handlePlan(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 
 	fmt.Printf("Calling LLM with timeout: %ds\n", llmTimeout)
+	planStart := time.Now()
 	p, err := llmProvider.GeneratePlan(planCtx, fullPrompt)
+	if mErr := metrics.OpenRollupStore(cfg).Record(cfg.Provider, len(p.Commands), time.Since(planStart), err); mErr != nil {
+		fmt.Printf("Metrics rollup failed: %v\n", mErr)
+	}
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("LLM error: %v", err)})
+		errcode.WriteHTTPError(w, "LLM error", err)
+		return
+	}
+	if p, err = llm.FitLimit(planCtx, llmProvider, fullPrompt, p, limit); err != nil {
+		errcode.WriteHTTPError(w, "Plan rejected", err)
 		return
 	}
+	p.Facts = &envFacts.Stamp
+	policyEngine := policy.New(cfg).WithControl(controlPath(r.Context(), cfg, clientAddrFrom(r.Context()), localAddrFrom(r.Context()))).WithTopology(deviceTopology(r.Context(), cfg)).WithFirewall(deviceFirewall(r.Context(), cfg))
+	p = policyEngine.CheckTools(p)
+	p.PolicyWarnings = policyEngine.Warnings(p)
+	p.Lint = policy.LintPlan(p)
+	p.Estimate = impact.Estimate(cfg, p, llm.TokensUsed(llmProvider))
+	p.PolicyTrace = policyEngine.Trace(p)
+	valid := policyEngine.ValidatePlan(p) == nil
+	if valid && mayStage(ctx) {
+		p.FileChanges = executor.New(cfg).Stage(ctx, p)
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	resp := map[string]interface{}{
 		"ok":   true,
 		"plan": p,
-	})
+	}
+	if valid {
+		if previews := filePreviews(p, cfg.FilePaths); len(previews) > 0 {
+			resp["file_previews"] = previews
+		}
+	}
+	if len(p.Questions) > 0 {
+		// Lets the client tell whether it may answer again
+		resp["clarify_rounds"] = cfg.ClarifyRounds
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// filePreviews returns the diff of each file.write command of p to a file
+// under roots, and of the staged file changes, by command index, for review
+// before the plan is executed. A command changing several files gets the
+// diff of each under its path.
+func filePreviews(p plan.Plan, roots []string) map[int]string {
+	previews := map[int]string{}
+	for i, c := range p.Commands {
+		if op, path, ok := c.FileOp(); ok && op == plan.FileWrite {
+			if _, err := files.Check(path, roots); err != nil {
+				previews[i] = "not shown: " + err.Error()
+				continue
+			}
+			previews[i] = files.Preview(path, c.Content)
+		}
+	}
+	byCommand := map[int][]plan.FileChange{}
+	for _, fc := range p.FileChanges {
+		byCommand[fc.Command] = append(byCommand[fc.Command], fc)
+	}
+	for i, changes := range byCommand {
+		var parts []string
+		for _, fc := range changes {
+			text := fc.Diff
+			if fc.Error != "" {
+				text = "not shown: " + fc.Error
+			}
+			if len(changes) > 1 {
+				text = fc.Path + ":\n" + text
+			}
+			parts = append(parts, text)
+		}
+		previews[i] = strings.Join(parts, "\n")
+	}
+	return previews
+}
+
+// checkPlanFacts refuses a stored plan whose facts stamp was not issued by
+// this router or no longer matches its current environment.
+func (s *Server) checkPlanFacts(ctx context.Context, cfg config.Config, stored openwrt.Stamp) error {
+	key, err := openwrt.LoadFactsKey(cfg.FactsKeyFile)
+	if err != nil {
+		return errcode.Wrap(errcode.FactsMismatch, fmt.Errorf("facts key: %w", err))
+	}
+	current := openwrt.CollectSignedFacts(ctx, cfg.FactsKeyFile)
+	return openwrt.CheckStamp(stored, current.Stamp, key, cfg.FactsMaxDrift)
 }
 
 func (s *Server) handleExecute(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received /v1/execute request")
+	fmt.Printf("Received /v1/execute request from %s\n", clientAddrFrom(r.Context()))
 	if r.Method != http.MethodPost {
 		fmt.Println("Error: Method not allowed")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
 		return
 	}
 
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
 	var req ExecuteRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := json.Unmarshal(body, &req); err != nil {
+		errcode.WriteHTTP(w, errcode.InvalidRequest, "Invalid request body")
+		return
+	}
+	if err := req.validate(); err != nil {
+		errcode.WriteHTTPError(w, "", err)
 		return
 	}
 
@@ -330,7 +1255,7 @@ func (s *Server) handleExecute(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 	llmProvider := llm.NewProvider(cfg)
-	policyEngine := policy.New(cfg)
+	policyEngine := policy.New(cfg).WithControl(controlPath(ctx, cfg, clientAddrFrom(ctx), localAddrFrom(ctx))).WithTopology(deviceTopology(ctx, cfg)).WithFirewall(deviceFirewall(ctx, cfg))
 	execEngine := executor.New(cfg)
 
 	var p plan.Plan
@@ -339,21 +1264,31 @@ func (s *Server) handleExecute(w http.ResponseWriter, r *http.Request) {
 	// Check if commands are provided directly (Stateless Execution)
 	if len(req.Commands) > 0 {
 		fmt.Println("Executing provided plan directly (skipping LLM)...")
-		p = plan.Plan{
-			Summary:  "Direct execution",
-			Commands: req.Commands,
+		if p, err = directPlan(body); err != nil {
+			errcode.WriteHTTPError(w, "Plan error", err)
+			return
+		}
+		if req.Facts != nil {
+			if err := s.checkPlanFacts(ctx, cfg, *req.Facts); err != nil {
+				fmt.Printf("Facts check failed: %v\n", err)
+				errcode.WriteHTTPError(w, "Facts error", err)
+				return
+			}
 		}
 	} else {
 		// Legacy: Re-generate plan
 		// Collect facts
 		factsCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
 		defer cancel()
-		envFacts := openwrt.CollectFacts(factsCtx)
+		envFacts := openwrt.CollectSignedFacts(factsCtx, cfg.FactsKeyFile)
 
-		instruction := prompts.GenerateSurvivalPrompt(cfg.MaxCommands)
-		if envFacts != "" {
-			instruction += "\n\nEnvironment facts (read-only):\n" + envFacts
-		}
+		kind, limit := intent.ForPrompt(cfg, req.Prompt)
+		instruction := prompts.GeneratePlanPrompt(kind, limit)
+		instruction += prompts.ExamplesBlock(req.Prompt, cfg.FewShotExamples)
+		instruction += prompts.CommandsBlock(req.Prompt, cfg.CommandSnippets)
+		instruction += firewall.PromptBlock(ctx, req.Prompt)
+		instruction += prompts.FeedbackBlock(cfg, cfg.FeedbackHints)
+		instruction += s.factsBlock(envFacts)
 		fullPrompt := instruction + "\n\nUser request: " + req.Prompt
 
 		// Generate plan with minimum 60 second timeout
@@ -369,9 +1304,14 @@ func (s *Server) handleExecute(w http.ResponseWriter, r *http.Request) {
 		p, err = llmProvider.GeneratePlan(planCtx, fullPrompt)
 		if err != nil {
 			fmt.Printf("Plan generation failed: %v\n", err)
-			http.Error(w, fmt.Sprintf("Failed to generate plan: %v", err), http.StatusInternalServerError)
+			errcode.WriteHTTPError(w, "Failed to generate plan", err)
+			return
+		}
+		if p, err = llm.FitLimit(planCtx, llmProvider, fullPrompt, p, limit); err != nil {
+			errcode.WriteHTTPError(w, "Plan rejected", err)
 			return
 		}
+		p.Facts = &envFacts.Stamp
 		fmt.Printf("Plan generated in %v\n", time.Since(start))
 	}
 
@@ -387,11 +1327,15 @@ func (s *Server) handleExecute(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate
+	p = policyEngine.CheckTools(p)
 	if err := policyEngine.ValidatePlan(p); err != nil {
 		fmt.Printf("Policy validation failed: %v\n", err)
-		http.Error(w, fmt.Sprintf("Policy error: %v", err), http.StatusForbidden)
+		s.auditLogger(ctx).Rejected(req.Prompt, p, err.Error())
+		errcode.WriteHTTP(w, errcode.Of(err), "Policy error: "+policy.Explain(err))
 		return
 	}
+	p.PolicyWarnings = policyEngine.Warnings(p)
+	p.Lint = policy.LintPlan(p)
 
 	if cfg.DryRun {
 		w.Header().Set("Content-Type", "application/json")
@@ -403,32 +1347,115 @@ func (s *Server) handleExecute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ack := req.AckWarnings
+	if approver.Enabled(cfg) {
+		fmt.Println("Waiting for the approval command...")
+		if err := approver.Ask(ctx, cfg, approvalRequest(ctx, req.Prompt, p)); err != nil {
+			fmt.Printf("Execution not approved: %v\n", err)
+			errcode.WriteHTTPError(w, "Approval", err)
+			return
+		}
+		// The approver saw the warnings
+		ack = true
+	}
+	if err := policy.RequireAck(p, ack); err != nil {
+		fmt.Printf("Execution refused: %v\n", err)
+		errcode.WriteHTTPError(w, "Policy warning", err)
+		return
+	}
+
+	st, armed, err := rollback.Guard(cfg.RollbackDir, cfg.RollbackTimeout, p)
+	if err != nil {
+		errcode.WriteHTTP(w, errcode.Conflict, fmt.Sprintf("Cannot arm network rollback: %v", err))
+		return
+	}
+
+	execID := artifacts.NewID()
+	if store := artifacts.NewStore(cfg.ArtifactsDir, cfg.ArtifactsMaxMB, cfg.ArtifactsRetentionDays); store != nil {
+		if dir, err := store.Create(execID); err == nil {
+			execEngine.UseArtifacts(dir)
+		} else {
+			fmt.Printf("Warning: no artifacts directory: %v\n", err)
+		}
+	}
+
 	// Execute
+	logger := s.auditLogger(ctx).WithExecution(execID)
+	logger.Plan(req.Prompt, p)
 	results := execEngine.RunPlan(ctx, p)
 
 	results = execEngine.AutoRetry(ctx, llmProvider, policyEngine, results, nil)
+	logResults(logger, results)
+	s.factsChanged(results)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	resp := map[string]interface{}{
 		"ok":     true,
+		"id":     execID,
 		"result": results,
-	})
+	}
+	if armed {
+		// The client must POST /v1/confirm before the deadline to keep the change
+		resp["rollback"] = st
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleConfirm reports (GET) or confirms (POST) a pending network change so
+// the automatic revert is cancelled.
+func (s *Server) handleConfirm(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		st, ok, err := rollback.Pending(s.cfg.RollbackDir)
+		if err != nil {
+			errcode.WriteHTTP(w, errcode.Internal, err.Error())
+			return
+		}
+		resp := map[string]interface{}{"ok": true, "pending": ok}
+		if ok {
+			resp["rollback"] = st
+			resp["remaining_seconds"] = int(st.Remaining().Seconds())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	case http.MethodPost:
+		st, err := rollback.Confirm(s.cfg.RollbackDir)
+		if err != nil {
+			if errors.Is(err, rollback.ErrNothingPending) {
+				errcode.WriteHTTP(w, errcode.NotFound, err.Error())
+				return
+			}
+			errcode.WriteHTTP(w, errcode.Internal, err.Error())
+			return
+		}
+		fmt.Printf("Network change %s confirmed\n", st.ID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":        true,
+			"confirmed": st.ID,
+		})
+	default:
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
+	}
 }
 
 func (s *Server) handleSummarize(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received /v1/summarize request")
+	fmt.Printf("Received /v1/summarize request from %s\n", clientAddrFrom(r.Context()))
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		errcode.WriteHTTP(w, errcode.MethodNotAllowed, "Method not allowed")
 		return
 	}
 
 	var req SummarizeRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if err := checkLength("prompt", req.Prompt, maxPromptChars); err != nil {
+		errcode.WriteHTTPError(w, "", err)
 		return
 	}
 	if len(req.Commands) == 0 {
-		http.Error(w, "Commands are required for summarization", http.StatusBadRequest)
+		errcode.WriteHTTP(w, errcode.InvalidRequest, "Commands are required for summarization")
 		return
 	}
 
@@ -456,31 +1483,38 @@ func (s *Server) handleSummarize(w http.ResponseWriter, r *http.Request) {
 	switch cfg.Provider {
 	case "openai":
 		if cfg.OpenAIAPIKey == "" {
-			http.Error(w, "Summarize: missing OpenAI API key", http.StatusBadRequest)
+			errcode.WriteHTTP(w, errcode.LLMNoKey, "Summarize: missing OpenAI API key")
 			return
 		}
 	case "gemini":
 		if cfg.APIKey == "" {
-			http.Error(w, "Summarize: missing Gemini API key", http.StatusBadRequest)
+			errcode.WriteHTTP(w, errcode.LLMNoKey, "Summarize: missing Gemini API key")
 			return
 		}
 	case "anthropic":
 		if cfg.AnthropicAPIKey == "" {
-			http.Error(w, "Summarize: missing Anthropic API key", http.StatusBadRequest)
+			errcode.WriteHTTP(w, errcode.LLMNoKey, "Summarize: missing Anthropic API key")
 			return
 		}
+	case "local":
+		// The local model needs no key
 	default:
-		http.Error(w, fmt.Sprintf("Summarize: unsupported provider %s", cfg.Provider), http.StatusBadRequest)
+		errcode.WriteHTTP(w, errcode.InvalidRequest, fmt.Sprintf("Summarize: unsupported provider %s", cfg.Provider))
 		return
 	}
 
+	ran := make([][]string, 0, len(req.Commands))
+	for _, c := range req.Commands {
+		ran = append(ran, c.Command)
+	}
 	summary, details, err := llm.Summarize(ctx, cfg, llm.SummaryInput{
 		Commands: req.Commands,
 		Context:  req.Context,
 		Prompt:   req.Prompt,
+		History:  prompts.SummaryHistoryBlock(cfg, req.Prompt, ran, cfg.SummaryHistory),
 	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to summarize: %v", err), http.StatusInternalServerError)
+		errcode.WriteHTTPError(w, "Failed to summarize", err)
 		return
 	}
 
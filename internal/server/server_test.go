@@ -2,34 +2,35 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aezizhu/LuciCodex/internal/approver"
+	"github.com/aezizhu/LuciCodex/internal/auth"
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/execlock"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/export"
+	"github.com/aezizhu/LuciCodex/internal/jobs"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/logtail"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/rollback"
+	"github.com/aezizhu/LuciCodex/internal/services"
 )
 
-func TestServer_Health(t *testing.T) {
-	cfg := config.Config{}
-	s := New(cfg)
-
-	req, _ := http.NewRequest("GET", "/health", nil)
-	rr := httptest.NewRecorder()
-
-	s.mux.ServeHTTP(rr, req)
-
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
-	}
-
-	expected := "ok"
-	if rr.Body.String() != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), expected)
-	}
-}
-
 func TestServer_Plan_InvalidMethod(t *testing.T) {
 	cfg := config.Config{}
 	s := New(cfg)
@@ -51,6 +52,7 @@ func TestServer_Plan_EmptyBody(t *testing.T) {
 	s := New(cfg)
 
 	req, _ := http.NewRequest("POST", "/v1/plan", bytes.NewReader([]byte{}))
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Auth-Token", s.GetToken())
 	rr := httptest.NewRecorder()
 
@@ -68,6 +70,7 @@ func TestServer_Plan_MissingPrompt(t *testing.T) {
 
 	body := []byte(`{"model": "test"}`)
 	req, _ := http.NewRequest("POST", "/v1/plan", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Auth-Token", s.GetToken())
 	rr := httptest.NewRecorder()
 
@@ -79,12 +82,66 @@ func TestServer_Plan_MissingPrompt(t *testing.T) {
 	}
 }
 
+func TestServer_RequestLimits(t *testing.T) {
+	s := New(config.Config{APITokensFile: filepath.Join(t.TempDir(), "api_tokens.json"), JobsDir: t.TempDir()})
+	do := func(path, contentType, body string, header ...string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		var resp map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp
+	}
+
+	big := `{"prompt":"` + strings.Repeat("a", maxPlanBody) + `"}`
+	if code, resp := do("/v1/plan", "application/json", big); code != http.StatusRequestEntityTooLarge || resp["code"] != "REQUEST_TOO_LARGE" {
+		t.Errorf("oversized plan: %d %v", code, resp)
+	}
+	if code, resp := do("/v1/jobs/stop", "application/json", `{"id":"`+strings.Repeat("j", maxSmallBody)+`"}`); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized job stop: %d %v", code, resp)
+	}
+	// The limit holds before the idempotency cache reads the body
+	if code, resp := do("/v1/execute", "application/json", `{"prompt":"`+strings.Repeat("a", maxExecuteBody)+`"}`, "Idempotency-Key", "k1"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized execute: %d %v", code, resp)
+	}
+
+	if code, resp := do("/v1/plan", "application/x-www-form-urlencoded", `prompt=hi`); code != http.StatusUnsupportedMediaType || resp["code"] != "UNSUPPORTED_MEDIA_TYPE" {
+		t.Errorf("form body: %d %v", code, resp)
+	}
+	if code, resp := do("/v1/tokens", "text/plain", `{"name":"ci","role":"viewer"}`); code != http.StatusUnsupportedMediaType {
+		t.Errorf("text body: %d %v", code, resp)
+	}
+	if code, resp := do("/v1/execute", "", `{"commands":[{"command":["true"]}]}`); code != http.StatusUnsupportedMediaType {
+		t.Errorf("body without a Content-Type: %d %v", code, resp)
+	}
+
+	long := strings.Repeat("é", maxPromptChars+1)
+	for _, path := range []string{"/v1/plan", "/v1/execute", "/v1/summarize"} {
+		code, resp := do(path, "application/json; charset=utf-8", `{"prompt":"`+long+`","commands":[{"command":["true"]}]}`)
+		if code != http.StatusBadRequest || resp["error"] != "prompt too long (max 4096 chars)" {
+			t.Errorf("%s: long prompt: %d %v", path, code, resp)
+		}
+	}
+	// Characters are counted, not bytes
+	if code, resp := do("/v1/plan", "application/json", `{"prompt":"`+long[2:]+`","provider":"bogus"}`); resp["error"] == "prompt too long (max 4096 chars)" {
+		t.Errorf("prompt at the limit refused: %d %v", code, resp)
+	}
+}
+
 func TestServer_Unauthorized(t *testing.T) {
 	cfg := config.Config{}
 	s := New(cfg)
 
 	// Request without auth token
 	req, _ := http.NewRequest("POST", "/v1/plan", bytes.NewReader([]byte(`{}`)))
+	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 
 	s.mux.ServeHTTP(rr, req)
@@ -94,3 +151,1104 @@ func TestServer_Unauthorized(t *testing.T) {
 			status, http.StatusUnauthorized)
 	}
 }
+
+func TestServer_Roles(t *testing.T) {
+	cfg := config.Config{APITokensFile: filepath.Join(t.TempDir(), "api_tokens.json"), JobsDir: t.TempDir()}
+	s := New(cfg)
+
+	do := func(method, path, token, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		var resp map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp
+	}
+
+	// The daemon token is admin and manages the other tokens
+	code, resp := do("POST", "/v1/tokens", s.GetToken(), `{"name": "dashboard", "role": "viewer"}`)
+	if code != http.StatusOK {
+		t.Fatalf("token creation failed: %d %v", code, resp)
+	}
+	viewer, _ := resp["token"].(string)
+	_, resp = do("POST", "/v1/tokens", s.GetToken(), `{"name": "ops", "role": "operator"}`)
+	operator, _ := resp["token"].(string)
+	if code, _ := do("POST", "/v1/tokens", s.GetToken(), `{"name": "ops", "role": "operator"}`); code != http.StatusConflict {
+		t.Errorf("expected duplicate name to conflict, got %d", code)
+	}
+
+	if code, _ := do("GET", "/v1/jobs", viewer, ""); code != http.StatusOK {
+		t.Errorf("viewer should list jobs, got %d", code)
+	}
+	code, resp = do("POST", "/v1/execute", viewer, `{}`)
+	if code != http.StatusForbidden || resp["code"] != "FORBIDDEN" {
+		t.Errorf("viewer should not execute, got %d %v", code, resp)
+	}
+	if code, _ := do("POST", "/v1/execute", operator, `{}`); code == http.StatusForbidden || code == http.StatusUnauthorized {
+		t.Errorf("operator should reach execute, got %d", code)
+	}
+	if code, _ := do("GET", "/v1/tokens", operator, ""); code != http.StatusForbidden {
+		t.Errorf("operator should not manage tokens, got %d", code)
+	}
+
+	code, resp = do("GET", "/v1/tokens", s.GetToken(), "")
+	if code != http.StatusOK || !strings.Contains(mustJSON(t, resp), `"dashboard"`) || strings.Contains(mustJSON(t, resp), "hash") {
+		t.Errorf("unexpected token list: %d %v", code, resp)
+	}
+	if code, _ := do("DELETE", "/v1/tokens?name=dashboard", s.GetToken(), ""); code != http.StatusOK {
+		t.Errorf("token deletion failed: %d", code)
+	}
+	if code, _ := do("GET", "/v1/jobs", viewer, ""); code != http.StatusUnauthorized {
+		t.Errorf("deleted token should be rejected, got %d", code)
+	}
+}
+
+func TestServer_MetricsSummary(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{MetricsDir: dir}
+	metrics.OpenRollupStore(cfg).Record("gemini", 3, 200*time.Millisecond, nil)
+
+	s := New(cfg)
+	req, _ := http.NewRequest("GET", "/v1/metrics/summary?days=3", nil)
+	req.Header.Set("X-Auth-Token", s.GetToken())
+	rr := httptest.NewRecorder()
+	s.mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var resp struct {
+		Window  int                  `json:"window"`
+		Summary metrics.StatsSummary `json:"summary"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if resp.Window != 3 || resp.Summary.Requests != 1 || resp.Summary.Providers["gemini"].AvgLatencyMs != 200 {
+		t.Errorf("unexpected summary: %s", rr.Body.String())
+	}
+
+	// Disabled persistence
+	s = New(config.Config{})
+	req.Header.Set("X-Auth-Token", s.GetToken())
+	rr = httptest.NewRecorder()
+	s.mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without metrics_dir, got %v", rr.Code)
+	}
+}
+
+func TestServer_Digest(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "audit.log")
+	l := logging.New(logFile)
+	l.Plan("restart wifi", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}})
+	l.Results([]logging.ResultItem{{Command: []string{"wifi", "reload"}}})
+
+	s := New(config.Config{LogFile: logFile, Denylist: []string{"^logread"}})
+	get := func(query string) (int, string) {
+		req, _ := http.NewRequest("GET", "/v1/digest"+query, nil)
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+	code, body := get("?since=1h&summarize=0")
+	if code != http.StatusOK || !strings.Contains(body, `"runs":1`) || !strings.Contains(body, `"wifi reload"`) {
+		t.Errorf("unexpected digest: %d %s", code, body)
+	}
+	if code, _ := get("?since=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid since, got %d", code)
+	}
+}
+
+func TestServer_Exports(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "audit.log")
+	l := logging.New(logFile)
+	l.Plan("restart wifi", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}})
+	l.Results([]logging.ResultItem{{Command: []string{"wifi", "reload"}, Elapsed: 1500 * time.Millisecond}})
+	cfg := config.Config{LogFile: logFile, MetricsDir: filepath.Join(dir, "metrics")}
+	metrics.OpenRollupStore(cfg).Record("gemini", 1, 100*time.Millisecond, nil)
+
+	s := New(cfg)
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := get("/v1/history/export?since=7d")
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("unexpected history export: %d %v", rr.Code, rr.Header())
+	}
+	if body := rr.Body.String(); !strings.HasPrefix(body, "time,id,prompt,commands,status,duration_ms\n") || !strings.Contains(body, ",restart wifi,wifi reload,ok,1500\n") {
+		t.Errorf("unexpected CSV: %s", body)
+	}
+
+	rr = get("/v1/metrics/export?format=json&since=2d")
+	var days []export.Day
+	if err := json.Unmarshal(rr.Body.Bytes(), &days); err != nil || len(days) != 1 || days[0].LLMRequests != 1 || days[0].AvgLatencyMs != 100 {
+		t.Errorf("unexpected metrics export: %v %s", err, rr.Body.String())
+	}
+
+	if rr := get("/v1/history/export?format=xlsx"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %d", rr.Code)
+	}
+	if rr := get("/v1/metrics/export?since=soon"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid since, got %d", rr.Code)
+	}
+}
+
+func TestServer_Jobs(t *testing.T) {
+	cfg := config.Config{JobsDir: t.TempDir()}
+	m := jobs.Open(cfg)
+	j, err := m.Start([]string{"sh", "-c", "echo ready; sleep 30"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop(j.ID)
+
+	s := New(cfg)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("GET", "/v1/jobs", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), j.ID) {
+		t.Fatalf("list: %d %s", rr.Code, rr.Body.String())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr = do("GET", "/v1/jobs/tail?id="+j.ID+"&lines=5", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("tail: %d %s", rr.Code, rr.Body.String())
+		}
+		if strings.Contains(rr.Body.String(), `"output":"ready\n"`) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !strings.Contains(rr.Body.String(), `"output":"ready\n"`) {
+		t.Errorf("tail output missing: %s", rr.Body.String())
+	}
+
+	if rr = do("GET", "/v1/jobs/tail?id=unknown", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown job, got %d", rr.Code)
+	}
+	if rr = do("GET", "/v1/jobs/stop", ""); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET stop, got %d", rr.Code)
+	}
+	if rr = do("POST", "/v1/jobs/stop", `{"id":"`+j.ID+`"}`); rr.Code != http.StatusOK {
+		t.Fatalf("stop: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr = do("POST", "/v1/jobs/stop", `{"id":"`+j.ID+`"}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 stopping a stopped job, got %d", rr.Code)
+	}
+	// Let the job be reaped before its directory is removed
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cur, err := m.Get(j.ID); err != nil || cur.ExitCode != nil {
+			break
+		}
+	}
+}
+
+func TestServer_Confirm(t *testing.T) {
+	dir := t.TempDir()
+	oldConfigDir := rollback.ConfigDir
+	rollback.ConfigDir = t.TempDir()
+	defer func() { rollback.ConfigDir = oldConfigDir }()
+
+	s := New(config.Config{RollbackDir: dir})
+	do := func(method string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/v1/confirm", nil)
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do("POST"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 with nothing pending, got %d", rr.Code)
+	}
+
+	st, err := rollback.Arm(dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := do("GET")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"pending":true`) {
+		t.Fatalf("status: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = do("POST")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), st.ID) {
+		t.Fatalf("confirm: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr = do("GET"); !strings.Contains(rr.Body.String(), `"pending":false`) {
+		t.Errorf("expected nothing pending after confirm: %s", rr.Body.String())
+	}
+}
+
+func TestServer_ErrorBody(t *testing.T) {
+	s := New(config.Config{Denylist: []string{`^rm\b`}})
+	do := func(token, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", "/v1/execute", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", token)
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		var resp map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("non-JSON error body %q: %v", rr.Body.String(), err)
+		}
+		return rr.Code, resp
+	}
+
+	code, resp := do("wrong", "{}")
+	if code != http.StatusUnauthorized || resp["code"] != "UNAUTHORIZED" || resp["error"] != "Unauthorized" {
+		t.Errorf("unauthorized: %d %v", code, resp)
+	}
+
+	code, resp = do(s.GetToken(), "{")
+	if code != http.StatusBadRequest || resp["code"] != "INVALID_REQUEST" {
+		t.Errorf("invalid body: %d %v", code, resp)
+	}
+
+	code, resp = do(s.GetToken(), `{"commands":[{"command":["rm","-rf","/tmp/x"]}]}`)
+	if code != http.StatusForbidden || resp["code"] != "POLICY_DENY" || resp["ok"] != false || resp["hint"] == "" {
+		t.Errorf("policy deny: %d %v", code, resp)
+	}
+}
+
+func TestServer_ExecuteFactsCheck(t *testing.T) {
+	network := "network.lan.ipaddr='192.168.1.1'"
+	original := openwrt.GetRunCommand()
+	defer openwrt.SetRunCommand(original)
+	openwrt.SetRunCommand(func(ctx context.Context, name string, args ...string) string {
+		if name == "uci" && args[2] == "network" {
+			return network
+		}
+		return name + " output"
+	})
+
+	keyFile := filepath.Join(t.TempDir(), "facts.key")
+	s := New(config.Config{FactsKeyFile: keyFile, FactsMaxDrift: 10})
+	stamp := openwrt.CollectSignedFacts(context.Background(), keyFile).Stamp
+	do := func(st openwrt.Stamp) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"dry_run":  true,
+			"commands": []map[string]interface{}{{"command": []string{"echo", "hi"}}},
+			"facts":    st,
+		})
+		req, _ := http.NewRequest("POST", "/v1/execute", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(stamp); rr.Code != http.StatusOK {
+		t.Fatalf("matching facts refused: %d %s", rr.Code, rr.Body.String())
+	}
+
+	forged := stamp
+	forged.Board = "other-board"
+	if rr := do(forged); rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "FACTS_MISMATCH") {
+		t.Errorf("forged stamp: %d %s", rr.Code, rr.Body.String())
+	}
+
+	network = "network.lan.ipaddr='10.0.0.1'"
+	rr := do(stamp)
+	if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "environment changed") {
+		t.Errorf("drifted router: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestServer_ExecutePolicyWarnings(t *testing.T) {
+	s := New(config.Config{Warnlist: []string{`^echo warned`}, TimeoutSeconds: 10})
+	do := func(dryRun, ack bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"dry_run":      dryRun,
+			"ack_warnings": ack,
+			"commands":     []map[string]interface{}{{"command": []string{"echo", "warned"}}},
+		})
+		req, _ := http.NewRequest("POST", "/v1/execute", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(true, false)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"policy_warnings"`) {
+		t.Errorf("dry run should return the plan with warnings: %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = do(false, false)
+	if rr.Code != http.StatusPreconditionRequired || !strings.Contains(rr.Body.String(), "POLICY_ACK_REQUIRED") {
+		t.Errorf("unacknowledged warnings: %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = do(false, true)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "warned") {
+		t.Errorf("acknowledged warnings: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestServer_ExecuteApprovalCommand(t *testing.T) {
+	approve := filepath.Join(t.TempDir(), "approve.sh")
+	s := New(config.Config{ApprovalCommand: "sh " + approve, Warnlist: []string{`^echo warned`}, TimeoutSeconds: 10})
+	do := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"commands": []map[string]interface{}{{"command": []string{"echo", "warned"}}},
+		})
+		req, _ := http.NewRequest("POST", "/v1/execute", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	os.WriteFile(approve, []byte("echo 'not now'; exit 1\n"), 0700)
+	if rr := do(); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "APPROVAL_DENIED") || !strings.Contains(rr.Body.String(), "not now") {
+		t.Errorf("rejected plan: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// An approval also acknowledges the warnings the approver was shown
+	os.WriteFile(approve, []byte("cat >/dev/null\n"), 0700)
+	if rr := do(); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "warned") {
+		t.Errorf("approved plan: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestServer_ExecuteClientHints(t *testing.T) {
+	dir := t.TempDir()
+	approve := filepath.Join(dir, "approve.sh")
+	os.WriteFile(approve, []byte("cat >"+filepath.Join(dir, "request.json")+"\n"), 0700)
+	cfg := config.Config{LogFile: filepath.Join(dir, "audit.log"), APITokensFile: filepath.Join(dir, "api_tokens.json"), ApprovalCommand: "sh " + approve, TimeoutSeconds: 10}
+	s := New(cfg)
+	token, _ := s.apiTokens.Create("alice", auth.RoleOperator)
+	s.apiTokens.Save()
+
+	body := `{"prompt":"say hi","commands":[{"command":["echo","hi"]}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/execute", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)\x01")
+	req.Header.Set("X-LuCI-Session", "root:1a2b3c4d")
+	rr := httptest.NewRecorder()
+	s.mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("execute = %d %s", rr.Code, rr.Body.String())
+	}
+
+	entries, err := logging.ReadHistory(cfg.LogFile)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("history = %+v, %v", entries, err)
+	}
+	h := entries[0]
+	if h.Actor != "alice" || h.Remote != "192.0.2.1" || h.UserAgent != "Mozilla/5.0 (X11; Linux x86_64)" || h.Session != "root:1a2b3c4d" {
+		t.Errorf("client not recorded: %+v", h)
+	}
+	if h.Device != logging.Device("192.0.2.1", h.UserAgent) {
+		t.Errorf("unexpected device %q", h.Device)
+	}
+
+	var seen approver.Request
+	data, _ := os.ReadFile(filepath.Join(dir, "request.json"))
+	if err := json.Unmarshal(data, &seen); err != nil {
+		t.Fatal(err)
+	}
+	if seen.Actor != "alice" || seen.Role != "operator" || seen.Session != h.Session || seen.Device != h.Device || seen.Client != "192.0.2.1" {
+		t.Errorf("approval request = %+v", seen)
+	}
+}
+
+func TestServer_ExecutePlanVersion(t *testing.T) {
+	s := New(config.Config{TimeoutSeconds: 10})
+	do := func(version interface{}) *httptest.ResponseRecorder {
+		body := map[string]interface{}{
+			"dry_run":  true,
+			"commands": []map[string]interface{}{{"command": []string{"echo", "hi"}}},
+		}
+		if version != nil {
+			body["version"] = version
+		}
+		b, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/v1/execute", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Unversioned plans predate versioning and are migrated
+	for _, v := range []interface{}{nil, plan.SchemaVersion} {
+		rr := do(v)
+		var resp struct {
+			Plan plan.Plan `json:"plan"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		if rr.Code != http.StatusOK || resp.Plan.Version != plan.SchemaVersion {
+			t.Errorf("version %v: %d %s", v, rr.Code, rr.Body.String())
+		}
+	}
+	rr := do(plan.SchemaVersion + 1)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "unsupported plan schema version") {
+		t.Errorf("newer version should be refused: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestServer_MCPPromptsAndHistory(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{LogFile: filepath.Join(dir, "lucicodex.log")}
+	s := New(cfg)
+
+	call := func(method, params string) MCPResponse {
+		t.Helper()
+		body := `{"jsonrpc":"2.0","id":1,"method":"` + method + `","params":` + params + `}`
+		req, _ := http.NewRequest("POST", "/v1/mcp", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		var resp MCPResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: bad response %q", method, rr.Body.String())
+		}
+		return resp
+	}
+
+	resp := call("prompts/list", "{}")
+	if resp.Error != nil || !strings.Contains(mustJSON(t, resp.Result), `"harden-firewall"`) {
+		t.Fatalf("prompts/list = %+v", resp)
+	}
+
+	resp = call("prompts/get", `{"name":"harden-firewall","arguments":{"wan_zone":"wan6"}}`)
+	if resp.Error != nil || !strings.Contains(mustJSON(t, resp.Result), `\"wan6\" zone`) {
+		t.Fatalf("prompts/get = %+v", resp)
+	}
+	resp = call("prompts/get", `{"name":"nope"}`)
+	if resp.Error == nil || resp.Error.Code != MCPInvalidParams {
+		t.Fatalf("unknown prompt = %+v", resp)
+	}
+
+	// No log yet: an empty history rather than an error
+	resp = call("resources/read", `{"uri":"history://recent"}`)
+	if resp.Error != nil || !strings.Contains(mustJSON(t, resp.Result), `"text":"[]"`) {
+		t.Fatalf("empty history = %+v", resp)
+	}
+
+	logger := logging.Open(cfg)
+	logger.Plan("show wifi password", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"uci", "get", "wireless.default_radio0.key"}}}})
+	logger.Results([]logging.ResultItem{{Command: []string{"uci", "get", "wireless.default_radio0.key"}, Output: "option key 'hunter22'"}})
+	resp = call("resources/read", `{"uri":"history://recent"}`)
+	out := mustJSON(t, resp.Result)
+	if resp.Error != nil || !strings.Contains(out, "show wifi password") || strings.Contains(out, "hunter22") {
+		t.Fatalf("history = %s", out)
+	}
+}
+
+func TestServer_MCPUCIChanges(t *testing.T) {
+	bin := t.TempDir()
+	script := `#!/bin/sh
+if [ "$1" = changes ] && [ -z "$2" -o "$2" = wireless ]; then
+	echo "wireless.default_radio0.ssid='guest'"
+	echo "wireless.default_radio0.key='hunter22'"
+fi
+`
+	if err := os.WriteFile(filepath.Join(bin, "uci"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	s := New(config.Config{})
+
+	call := func(method, params string) MCPResponse {
+		t.Helper()
+		body := `{"jsonrpc":"2.0","id":1,"method":"` + method + `","params":` + params + `}`
+		req, _ := http.NewRequest("POST", "/v1/mcp", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		var resp MCPResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: bad response %q", method, rr.Body.String())
+		}
+		return resp
+	}
+
+	resp := call("resources/read", `{"uri":"uci://changes"}`)
+	out := mustJSON(t, resp.Result)
+	if resp.Error != nil || !strings.Contains(out, "ssid='guest'") || strings.Contains(out, "hunter22") {
+		t.Fatalf("uci://changes = %s", out)
+	}
+
+	resp = call("tools/call", `{"name":"uci_revert","arguments":{"config":"wireless"}}`)
+	out = mustJSON(t, resp.Result)
+	if resp.Error != nil || !strings.Contains(out, `"requiresApproval":true`) || !strings.Contains(out, `["uci","revert","wireless"]`) || !strings.Contains(out, "ssid='guest'") {
+		t.Fatalf("uci_revert = %s", out)
+	}
+	resp = call("tools/call", `{"name":"uci_revert","arguments":{"config":"network"}}`)
+	if out := mustJSON(t, resp.Result); resp.Error != nil || !strings.Contains(out, "No staged changes in network") || strings.Contains(out, "pendingCommand") {
+		t.Fatalf("uci_revert without changes = %s", out)
+	}
+	resp = call("tools/call", `{"name":"uci_revert","arguments":{"config":"../etc/passwd"}}`)
+	if resp.Error == nil || resp.Error.Code != MCPInvalidParams {
+		t.Fatalf("invalid config = %+v", resp)
+	}
+}
+
+func TestServer_MCPExecLockAndHistory(t *testing.T) {
+	dir := t.TempDir()
+	origPaths := execlock.Paths
+	execlock.Paths = []string{filepath.Join(dir, "lucicodex.lock")}
+	defer func() { execlock.Paths = origPaths }()
+
+	cfg := config.Config{LogFile: filepath.Join(dir, "lucicodex.log"), Allowlist: []string{"^echo"}, TimeoutSeconds: 5}
+	s := New(cfg)
+	session := ""
+	call := func(method, params string) MCPResponse {
+		t.Helper()
+		body := `{"jsonrpc":"2.0","id":1,"method":"` + method + `","params":` + params + `}`
+		req, _ := http.NewRequest("POST", "/v1/mcp", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		req.Header.Set(mcpSessionHeader, session)
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		if id := rr.Header().Get(mcpSessionHeader); id != "" {
+			session = id
+		}
+		var resp MCPResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: bad response %q", method, rr.Body.String())
+		}
+		return resp
+	}
+	exec := `{"name":"exec","arguments":{"command":["echo","hi"],"description":"greet"}}`
+
+	call("initialize", `{"clientInfo":{"name":"inspector","version":"1.0"}}`)
+	if session == "" {
+		t.Fatal("initialize did not issue a session ID")
+	}
+	approve := func(resp MCPResponse) MCPResponse {
+		t.Helper()
+		var result struct {
+			ApprovalToken string `json:"approvalToken"`
+		}
+		json.Unmarshal([]byte(mustJSON(t, resp.Result)), &result)
+		if resp.Error != nil || result.ApprovalToken == "" {
+			t.Fatalf("expected an approval token, got %+v", resp)
+		}
+		return call("tools/call", `{"name":"approve","arguments":{"token":"`+result.ApprovalToken+`"}}`)
+	}
+	prepared := call("tools/call", exec)
+	if _, err := os.Stat(cfg.LogFile); !os.IsNotExist(err) {
+		t.Fatal("exec ran before approval")
+	}
+	resp := approve(prepared)
+	if out := mustJSON(t, resp.Result); resp.Error != nil || strings.Contains(out, "isError") || !strings.Contains(out, "hi") {
+		t.Fatalf("approve = %+v", resp)
+	}
+	entries, err := logging.ReadHistory(cfg.LogFile)
+	if err != nil || len(entries) != 1 || entries[0].Client != "mcp:inspector/1.0" || entries[0].Remote != "unix" || len(entries[0].Results) != 1 {
+		t.Fatalf("history = %+v, %v", entries, err)
+	}
+
+	// A CLI run holding the lock blocks the tool
+	lock, err := execlock.Acquire("cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepared = call("tools/call", exec)
+	resp = approve(prepared)
+	if out := mustJSON(t, resp.Result); !strings.Contains(out, "EXEC_LOCKED") || !strings.Contains(out, "owner=cli") {
+		t.Fatalf("locked exec = %s", out)
+	}
+	lock.Release()
+	// Nothing ran, so the token can be used again, but only once
+	if out := mustJSON(t, approve(prepared).Result); strings.Contains(out, "isError") {
+		t.Fatalf("approve after the lock was released = %s", out)
+	}
+	if out := mustJSON(t, approve(prepared).Result); !strings.Contains(out, "Unknown or expired approval token") {
+		t.Fatalf("second approve = %s", out)
+	}
+
+	// exec allows a burst of five calls
+	for i := 0; i < 3; i++ {
+		call("tools/call", exec)
+	}
+	resp = call("tools/call", exec)
+	if resp.Error == nil || resp.Error.Code != MCPRateLimited {
+		t.Fatalf("expected rate limit, got %+v", resp)
+	}
+	// Other tools have their own budget
+	if resp = call("tools/call", `{"name":"uci_set","arguments":{"config":"x","section":"y","option":"z","value":"1"}}`); resp.Error != nil {
+		t.Fatalf("uci_set = %+v", resp)
+	}
+}
+
+func TestServer_Facts(t *testing.T) {
+	original := openwrt.GetRunCommand()
+	defer openwrt.SetRunCommand(original)
+	var calls int
+	var mu sync.Mutex
+	openwrt.SetRunCommand(func(ctx context.Context, name string, args ...string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		switch {
+		case name == "ubus" && args[1] == "system" && args[2] == "board":
+			return `{"hostname": "gw", "board_name": "test-board"}`
+		case name == "uci":
+			return "wireless.radio0=wifi-device\nwireless.wl=wifi-iface\nwireless.wl.device='radio0'\nwireless.wl.ssid='Home'\n"
+		}
+		return ""
+	})
+
+	s := New(config.Config{FactsRedact: []string{"hostname"}})
+	get := func(query string) (int, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/v1/facts"+query, nil)
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		var body map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		return rr.Code, body
+	}
+
+	code, body := get("")
+	out := mustJSON(t, body)
+	if code != http.StatusOK || !strings.Contains(out, `"board":"test-board"`) || !strings.Contains(out, `"ssid":"Home"`) || strings.Contains(out, `"gw"`) {
+		t.Fatalf("facts = %d %s", code, out)
+	}
+	first := calls
+
+	// Served from the cache, with per-request redaction on top
+	_, body = get("?redact=ssid")
+	if out := mustJSON(t, body); calls != first || strings.Contains(out, "Home") || !strings.Contains(out, `"redacted":["hostname","ssid"]`) {
+		t.Fatalf("cached facts = %s (calls %d -> %d)", out, first, calls)
+	}
+	get("?refresh=1")
+	if calls != 2*first {
+		t.Errorf("refresh did not collect again: %d calls", calls)
+	}
+
+	if code, _ := get("?redact=key"); code != http.StatusBadRequest {
+		t.Errorf("unknown redact field = %d", code)
+	}
+
+	// A read-only command keeps the cache; a successful write drops it
+	s.factsChanged(executor.Results{Items: []executor.Result{{Command: []string{"uci", "show", "wireless"}}}})
+	get("")
+	if calls != 2*first {
+		t.Errorf("read-only command invalidated the facts: %d calls", calls)
+	}
+	s.factsChanged(executor.Results{Items: []executor.Result{
+		{Command: []string{"uci", "set", "network.lan.ipaddr=10.0.0.1"}, Err: errors.New("exit status 1")},
+		{Command: []string{"wifi", "reload"}},
+	}})
+	get("")
+	if calls != 3*first {
+		t.Errorf("write did not invalidate the facts: %d calls", calls)
+	}
+	facts := openwrt.Facts{Text: "uname -a:\nLinux"}
+	if block := s.factsBlock(facts); !strings.Contains(block, "changed the wireless configuration") || strings.Contains(block, "network") {
+		t.Errorf("expected a notice for the succeeded write only: %q", block)
+	}
+	if block := s.factsBlock(facts); strings.Contains(block, "Facts refreshed") {
+		t.Errorf("the notice should only follow the next prompt: %q", block)
+	}
+}
+
+func TestServer_Artifacts(t *testing.T) {
+	cfg := config.Config{ArtifactsDir: t.TempDir(), ArtifactsMaxMB: 1, ArtifactsRetentionDays: 1}
+	s := New(cfg)
+	dir := filepath.Join(cfg.ArtifactsDir, "20261016-120000-abcdef")
+	os.MkdirAll(dir, 0o700)
+	os.WriteFile(filepath.Join(dir, "backup.tar.gz"), []byte("backup"), 0o600)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/v1/history/20261016-120000-abcdef/artifacts")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"name":"backup.tar.gz"`) {
+		t.Fatalf("list = %d %s", rr.Code, rr.Body.String())
+	}
+	rr = get("/v1/history/20261016-120000-abcdef/artifacts/backup.tar.gz")
+	if rr.Code != http.StatusOK || rr.Body.String() != "backup" || !strings.Contains(rr.Header().Get("Content-Disposition"), "backup.tar.gz") {
+		t.Fatalf("download = %d %s", rr.Code, rr.Body.String())
+	}
+	for _, path := range []string{"/v1/history/unknown/artifacts", "/v1/history/20261016-120000-abcdef/other"} {
+		if rr := get(path); rr.Code != http.StatusNotFound {
+			t.Errorf("%s = %d", path, rr.Code)
+		}
+	}
+
+	// The mux cleans dot segments; the handler must not rely on that
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.URL.Path = "/v1/history/20261016-120000-abcdef/artifacts/../../../../etc/passwd"
+	rr = httptest.NewRecorder()
+	s.handleArtifacts(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("traversal = %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestServer_Feedback(t *testing.T) {
+	cfg := config.Config{LogFile: filepath.Join(t.TempDir(), "audit.log"), APITokensFile: filepath.Join(t.TempDir(), "api_tokens.json")}
+	s := New(cfg)
+	exec := logging.Open(cfg).WithExecution("20261016-120000-abcdef")
+	exec.Plan("fix wifi", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"wifi", "reload"}}}})
+	exec.Results([]logging.ResultItem{{Command: []string{"wifi", "reload"}}})
+
+	post := func(path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", token)
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr
+	}
+	viewer, _ := s.apiTokens.Create("dashboard", auth.RoleViewer)
+	s.apiTokens.Save()
+	if rr := post("/v1/history/20261016-120000-abcdef/feedback", viewer, `{"rating":"good"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("viewer rated an execution: %d", rr.Code)
+	}
+	if rr := post("/v1/history/20261016-120000-abcdef/feedback", s.GetToken(), `{"rating":"great"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid rating = %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := post("/v1/history/unknown/feedback", s.GetToken(), `{"rating":"bad"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown execution = %d %s", rr.Code, rr.Body.String())
+	}
+	rr := post("/v1/history/20261016-120000-abcdef/feedback", s.GetToken(), `{"rating":"bad","note":"still drops"}`)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"rating":"bad"`) {
+		t.Fatalf("feedback = %d %s", rr.Code, rr.Body.String())
+	}
+	entries, _ := logging.ReadHistory(cfg.LogFile)
+	if len(entries) != 1 || entries[0].Feedback == nil || entries[0].Feedback.Note != "still drops" {
+		t.Errorf("feedback not logged: %+v", entries)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestServer_StartUnix(t *testing.T) {
+	stubProbe(t, nil)
+	path := filepath.Join(t.TempDir(), "lucicodex.sock")
+	s := New(config.Config{})
+
+	// A leftover regular file is not replaced
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartUnix(context.Background(), path); err == nil {
+		t.Fatal("expected error for non-socket path")
+	}
+	os.Remove(path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- s.StartUnix(ctx, path) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("http://lucicodex/health"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("health over socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	st, err := os.Stat(path)
+	if err != nil || st.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode = %v, %v", st.Mode(), err)
+	}
+
+	// A second daemon must not steal the socket
+	if err := New(config.Config{}).StartUnix(context.Background(), path); err == nil {
+		t.Fatal("expected error for socket in use")
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("StartUnix: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket not removed: %v", err)
+	}
+}
+
+func TestServer_Instrumentation(t *testing.T) {
+	stubProbe(t, nil)
+	s := New(config.Config{})
+
+	do := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do("GET", "/health", "")
+		}()
+	}
+	wg.Wait()
+	do("GET", "/nope/1", "")
+	do("GET", "/nope/2", "")
+	do("POST", "/v1/mcp", `{"jsonrpc": "2.0", "id": 1, "method": "ping"}`)
+	do("POST", "/v1/mcp", `{"jsonrpc": "2.0", "id": 2, "method": "x-made-up"}`)
+
+	req, _ := http.NewRequest("GET", "/v1/metrics", nil)
+	req.Header.Set("X-Auth-Token", s.GetToken())
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /v1/metrics: %d %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Server metrics.ServerSnapshot `json:"server"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	st := resp.Server
+
+	if h := st.Endpoints["/health"]; h.Requests != 20 || h.Statuses["200"] != 20 || h.InFlight != 0 {
+		t.Errorf("unexpected /health stats: %+v", h)
+	}
+	if u := st.Endpoints["unmatched"]; u.Requests != 2 || u.Statuses["404"] != 2 {
+		t.Errorf("unknown paths should share one entry: %+v", st.Endpoints)
+	}
+	if m := st.Endpoints["/v1/metrics"]; m.InFlight != 1 || st.InFlight != 1 {
+		t.Errorf("the metrics request itself should be in flight: %+v, total %d", m, st.InFlight)
+	}
+	if st.MCPMethods["ping"] != 1 || st.MCPMethods["unknown"] != 1 || len(st.MCPMethods) != 2 {
+		t.Errorf("unexpected MCP method counts: %v", st.MCPMethods)
+	}
+}
+
+func TestServer_MCPLogTail(t *testing.T) {
+	origCommand := logtail.Command
+	logtail.Command = []string{"printf", "%s", "daemon.info dnsmasq[1]: query A example.com\ndaemon.err netifd: wan: failed\ndaemon.info dnsmasq[1]: reply example.com is 192.0.2.1\n"}
+	defer func() { logtail.Command = origCommand }()
+
+	s := New(config.Config{TimeoutSeconds: 5})
+	call := func(args map[string]interface{}) string {
+		t.Helper()
+		params, _ := json.Marshal(map[string]interface{}{"name": "log_tail", "arguments": args})
+		req, _ := http.NewRequest("POST", "/v1/mcp", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":`+string(params)+`}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	out := call(map[string]interface{}{"service": "dnsmasq"})
+	if !strings.Contains(out, "query A example.com") || !strings.Contains(out, "reply example.com") || strings.Contains(out, "netifd") {
+		t.Errorf("service filter: %s", out)
+	}
+	if out := call(map[string]interface{}{"service": "dnsmasq", "max_lines": 1}); strings.Contains(out, "reply example.com") {
+		t.Errorf("max_lines: %s", out)
+	}
+	if out := call(map[string]interface{}{"service": "bad name"}); !strings.Contains(out, `"isError":true`) {
+		t.Errorf("invalid service: %s", out)
+	}
+}
+
+func TestServer_MCPFileTools(t *testing.T) {
+	dir := t.TempDir()
+	origPaths := execlock.Paths
+	execlock.Paths = []string{filepath.Join(dir, "lucicodex.lock")}
+	defer func() { execlock.Paths = origPaths }()
+
+	root := filepath.Join(dir, "config")
+	os.Mkdir(root, 0o755)
+	path := filepath.Join(root, "dhcp")
+	os.WriteFile(path, []byte("config dnsmasq\n\toption domain 'lan'\n"), 0o644)
+	cfg := config.Config{FilePaths: []string{root}, FileMaxBytes: 1024, FileBackupDir: filepath.Join(dir, "backups"), TimeoutSeconds: 5}
+	s := New(cfg)
+	call := func(name string, args map[string]interface{}) string {
+		t.Helper()
+		params, _ := json.Marshal(map[string]interface{}{"name": name, "arguments": args})
+		body := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":` + string(params) + `}`
+		req, _ := http.NewRequest("POST", "/v1/mcp", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		var resp MCPResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Error != nil {
+			t.Fatalf("%s: bad response %q", name, rr.Body.String())
+		}
+		return mustJSON(t, resp.Result)
+	}
+	updated := "config dnsmasq\n\toption domain 'home'\n"
+
+	if out := call("file_read", map[string]interface{}{"path": path}); !strings.Contains(out, "option domain 'lan'") {
+		t.Fatalf("file_read = %s", out)
+	}
+	out := call("file_write", map[string]interface{}{"path": path, "content": updated})
+	if !strings.Contains(out, `-\toption domain 'lan'`) || !strings.Contains(out, `+\toption domain 'home'`) || !strings.Contains(out, `"approvalToken"`) {
+		t.Fatalf("file_write preview = %s", out)
+	}
+	if data, _ := os.ReadFile(path); string(data) == updated {
+		t.Fatal("preview wrote the file")
+	}
+	var prepared struct {
+		ApprovalToken string `json:"approvalToken"`
+	}
+	json.Unmarshal([]byte(out), &prepared)
+	if out := call("approve", map[string]interface{}{"token": prepared.ApprovalToken}); strings.Contains(out, "isError") || !strings.Contains(out, "previous version saved") {
+		t.Fatalf("file_write = %s", out)
+	}
+	if data, _ := os.ReadFile(path); string(data) != updated {
+		t.Fatalf("file not written: %q", data)
+	}
+	if backups, _ := os.ReadDir(cfg.FileBackupDir); len(backups) != 1 {
+		t.Fatalf("backups = %v", backups)
+	}
+	if out := call("file_read", map[string]interface{}{"path": "/etc/passwd"}); !strings.Contains(out, "isError") || !strings.Contains(out, "outside the allowed file paths") {
+		t.Fatalf("file_read outside file_paths = %s", out)
+	}
+}
+
+func TestServer_MCPServiceControl(t *testing.T) {
+	dir := t.TempDir()
+	origPaths := execlock.Paths
+	execlock.Paths = []string{filepath.Join(dir, "lucicodex.lock")}
+	defer func() { execlock.Paths = origPaths }()
+	origCall := services.GetUbusCall()
+	defer services.SetUbusCall(origCall)
+	var inits []string
+	services.SetUbusCall(func(ctx context.Context, object, method string, args interface{}) ([]byte, error) {
+		if object == "rc" && method == "init" {
+			data, _ := json.Marshal(args)
+			inits = append(inits, string(data))
+		}
+		if object == "rc" {
+			return []byte(`{"dnsmasq":{"start":19,"enabled":true,"running":true}}`), nil
+		}
+		return []byte(`{}`), nil
+	})
+
+	s := New(config.Config{TimeoutSeconds: 5})
+	call := func(args map[string]interface{}) string {
+		t.Helper()
+		params, _ := json.Marshal(map[string]interface{}{"name": "service_control", "arguments": args})
+		body := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":` + string(params) + `}`
+		req, _ := http.NewRequest("POST", "/v1/mcp", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Auth-Token", s.GetToken())
+		rr := httptest.NewRecorder()
+		s.mux.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	if out := call(map[string]interface{}{"action": "list"}); !strings.Contains(out, "dnsmasq: enabled, running") {
+		t.Fatalf("list = %s", out)
+	}
+	if out := call(map[string]interface{}{"action": "status", "name": "dnsmasq"}); !strings.Contains(out, "dnsmasq: enabled, running") {
+		t.Fatalf("status = %s", out)
+	}
+	out := call(map[string]interface{}{"action": "restart", "name": "dnsmasq"})
+	if !strings.Contains(out, `approvalToken`) || len(inits) != 0 {
+		t.Fatalf("restart should await approval: %s (inits %v)", out, inits)
+	}
+	var resp MCPResponse
+	json.Unmarshal([]byte(out), &resp)
+	var prepared struct {
+		ApprovalToken string `json:"approvalToken"`
+	}
+	json.Unmarshal([]byte(mustJSON(t, resp.Result)), &prepared)
+	params, _ := json.Marshal(map[string]interface{}{"name": "approve", "arguments": map[string]string{"token": prepared.ApprovalToken}})
+	req, _ := http.NewRequest("POST", "/v1/mcp", strings.NewReader(`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":`+string(params)+`}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Auth-Token", s.GetToken())
+	rr := httptest.NewRecorder()
+	s.mux.ServeHTTP(rr, req)
+	if len(inits) != 1 || inits[0] != `{"action":"restart","name":"dnsmasq"}` {
+		t.Fatalf("approve = %s (inits %v)", rr.Body.String(), inits)
+	}
+
+	for _, args := range []map[string]interface{}{{"action": "kill", "name": "dnsmasq"}, {"action": "stop", "name": "../sh"}} {
+		if out := call(args); !strings.Contains(out, `"error"`) {
+			t.Errorf("%v: expected invalid params, got %s", args, out)
+		}
+	}
+}
+
+func TestMayStage(t *testing.T) {
+	for role, want := range map[auth.Role]bool{auth.RoleViewer: false, auth.RoleOperator: true, auth.RoleAdmin: true} {
+		ctx := context.WithValue(context.Background(), actorKey{}, actor{name: "t", role: role})
+		if got := mayStage(ctx); got != want {
+			t.Errorf("%s: got %v, want %v", role, got, want)
+		}
+	}
+	if mayStage(context.Background()) {
+		t.Error("a request without a token may not stage")
+	}
+}
+
+func TestFilePreviews_Confined(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	inside, outside := filepath.Join(dir, "hosts"), filepath.Join(other, "shadow")
+	os.WriteFile(inside, []byte("old\n"), 0o644)
+	os.WriteFile(outside, []byte("root:secret:19000::::::\n"), 0o600)
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{plan.FileWrite, inside}, Content: "new\n"},
+		{Command: []string{plan.FileWrite, outside}, Content: "x\n"},
+	}}
+	previews := filePreviews(p, []string{dir})
+	if !strings.Contains(previews[0], "-old\n+new") {
+		t.Errorf("unexpected preview %q", previews[0])
+	}
+	if strings.Contains(previews[1], "secret") || !strings.HasPrefix(previews[1], "not shown: ") {
+		t.Errorf("file outside file_paths previewed: %q", previews[1])
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/logtail"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+// Limits of log tailing requests.
+const (
+	mcpTailSeconds    = 10 // default follow time of log_tail
+	mcpTailMaxSeconds = 60
+	mcpTailLines      = 200 // default line cap of log_tail
+	mcpTailMaxLines   = 1000
+	wsTailSeconds     = 60 // default length of a WebSocket tail session
+	wsTailMaxSeconds  = 600
+)
+
+// TailRequest is the payload of a WebSocket "tail" message and the
+// arguments of the log_tail MCP tool.
+type TailRequest struct {
+	Service string `json:"service,omitempty"` // e.g. dnsmasq
+	Pattern string `json:"pattern,omitempty"` // regular expression
+	Seconds int    `json:"seconds,omitempty"`
+	// log_tail only: stop after this many lines
+	MaxLines int `json:"max_lines,omitempty"`
+	// WebSocket only: error lines within WindowSeconds that raise an alert,
+	// and whether to ask the model about them
+	Threshold     int  `json:"threshold,omitempty"`
+	WindowSeconds int  `json:"window_seconds,omitempty"`
+	Analyze       bool `json:"analyze,omitempty"`
+}
+
+// tailOptions validates req and checks the log command against the policy.
+func (s *Server) tailOptions(req TailRequest) (logtail.Options, error) {
+	opts := logtail.Options{Service: req.Service, Threshold: req.Threshold, Window: time.Duration(req.WindowSeconds) * time.Second}
+	if req.Service != "" && !logtail.ValidService(req.Service) {
+		return opts, errcode.Errorf(errcode.InvalidRequest, "invalid service name %q", req.Service)
+	}
+	if req.Pattern != "" {
+		re, err := regexp.Compile(req.Pattern)
+		if err != nil {
+			return opts, errcode.Errorf(errcode.InvalidRequest, "invalid pattern: %v", err)
+		}
+		opts.Pattern = re
+	}
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: logtail.Command}}}
+	if err := policy.New(s.cfg).ValidatePlan(p); err != nil {
+		return opts, errcode.Wrap(errcode.PolicyDeny, err)
+	}
+	return opts, nil
+}
+
+// clamp returns def for n <= 0 and limit for n > limit.
+func clamp(n, def, limit int) int {
+	if n <= 0 {
+		return def
+	}
+	if n > limit {
+		return limit
+	}
+	return n
+}
+
+// toolLogTail follows the system log for a few seconds and returns the
+// matching lines.
+func (s *Server) toolLogTail(ctx context.Context, client string, args json.RawMessage) (interface{}, *MCPError) {
+	var req TailRequest
+	if err := json.Unmarshal(args, &req); err != nil {
+		return nil, &MCPError{Code: MCPInvalidParams, Message: err.Error()}
+	}
+	opts, err := s.tailOptions(req)
+	if err != nil {
+		return map[string]interface{}{
+			"content": []map[string]string{{"type": "text", "text": "Error: " + err.Error()}},
+			"isError": true,
+		}, nil
+	}
+	maxLines := clamp(req.MaxLines, mcpTailLines, mcpTailMaxLines)
+	seconds := clamp(req.Seconds, mcpTailSeconds, mcpTailMaxSeconds)
+
+	tctx, cancel := context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+	defer cancel()
+	var lines []string
+	var dropped int64
+	start := time.Now()
+	err = logtail.Follow(tctx, opts, func(l logtail.Line) {
+		dropped += l.Dropped
+		if l.Text != "" && len(lines) < maxLines {
+			lines = append(lines, l.Text)
+			if len(lines) == maxLines {
+				cancel()
+			}
+		}
+	}, nil)
+
+	text := strings.Join(lines, "\n")
+	if len(lines) == 0 {
+		text = fmt.Sprintf("No matching log lines within %ds", seconds)
+	}
+	if dropped > 0 {
+		text += fmt.Sprintf("\n[%d lines dropped]", dropped)
+	}
+	p := plan.Plan{Commands: []plan.PlannedCommand{{Command: logtail.Command, Description: "follow the system log"}}}
+	logger := s.auditLogger(ctx).WithClient(mcpClientTag(client))
+	logger.Plan("mcp log_tail: "+req.Service, p)
+	item := logging.ResultItem{Command: logtail.Command, Output: text, Elapsed: time.Since(start)}
+	if err != nil {
+		item.Error = err.Error()
+	}
+	logger.Results([]logging.ResultItem{item})
+	if err != nil {
+		return map[string]interface{}{
+			"content": []map[string]string{{"type": "text", "text": text + "\nError: " + err.Error()}},
+			"isError": true,
+		}, nil
+	}
+	return map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": text}},
+	}, nil
+}
+
+// handleWSTail streams log lines as "log_line" events until the requested
+// time is up or the client goes away. Alerts are sent as "log_alert" events,
+// followed by a "log_analysis" event if the client asked for one.
+func (s *Server) handleWSTail(ctx context.Context, ws *WSConn, msg WSMessage) {
+	var req TailRequest
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		ws.WriteJSON(wsError(msg.ID, errcode.InvalidRequest, "Invalid payload"))
+		return
+	}
+	opts, err := s.tailOptions(req)
+	if err != nil {
+		ws.WriteJSON(wsError(msg.ID, errcode.Of(err), err.Error()))
+		return
+	}
+	seconds := clamp(req.Seconds, wsTailSeconds, wsTailMaxSeconds)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+	defer cancel()
+
+	// Analyses use the provider of the session
+	cfg := s.wsConfig(ws, "", "", nil)
+	send := func(ev StreamEvent) {
+		if err := ws.WriteJSON(ev); err != nil {
+			cancel()
+		}
+	}
+	err = logtail.Follow(ctx, opts, func(l logtail.Line) {
+		send(StreamEvent{Type: "log_line", Data: l})
+	}, func(tr logtail.Trigger) {
+		send(StreamEvent{Type: "log_alert", Data: tr})
+		if !req.Analyze {
+			return
+		}
+		actx, acancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+		defer acancel()
+		summary, details, err := logtail.Analyze(actx, cfg, req.Service, tr)
+		if err != nil {
+			send(StreamEvent{Type: "log_analysis", Data: map[string]string{"error": err.Error()}})
+			return
+		}
+		send(StreamEvent{Type: "log_analysis", Data: map[string]interface{}{"summary": summary, "details": details}})
+	})
+	if err != nil {
+		ws.WriteJSON(wsError(msg.ID, errcode.Internal, err.Error()))
+		return
+	}
+	ws.WriteJSON(StreamEvent{Type: "done"})
+}
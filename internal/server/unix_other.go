@@ -0,0 +1,43 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// ucred mirrors the fields of syscall.Ucred that are logged.
+type ucred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// peerCred is only implemented on Linux (SO_PEERCRED).
+func peerCred(c net.Conn) (*ucred, error) {
+	return nil, errors.New("peer credentials not supported on this platform")
+}
+
+// setSubreaper is only implemented on Linux.
+func setSubreaper() error {
+	return errors.New("child subreaper not supported on this platform")
+}
+
+// diskSpace is only implemented on Linux.
+func diskSpace(path string) (free, total uint64, err error) {
+	return 0, 0, errors.New("disk space not supported on this platform")
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,29 +15,69 @@ import (
 	"sync"
 	"time"
 
+	"github.com/aezizhu/LuciCodex/internal/approver"
+	"github.com/aezizhu/LuciCodex/internal/artifacts"
+	"github.com/aezizhu/LuciCodex/internal/auth"
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
 	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/firewall"
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/intent"
 	"github.com/aezizhu/LuciCodex/internal/llm"
 	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
 	"github.com/aezizhu/LuciCodex/internal/openwrt"
 	"github.com/aezizhu/LuciCodex/internal/plan"
 	"github.com/aezizhu/LuciCodex/internal/policy"
+	"github.com/aezizhu/LuciCodex/internal/rollback"
 )
 
 // WebSocket opcodes
 const (
-	wsOpText   = 1
-	wsOpBinary = 2
-	wsOpClose  = 8
-	wsOpPing   = 9
-	wsOpPong   = 10
+	wsOpContinuation = 0
+	wsOpText         = 1
+	wsOpBinary       = 2
+	wsOpClose        = 8
+	wsOpPing         = 9
+	wsOpPong         = 10
 )
 
+// wsCloseTooBig is the close status for a message over maxWSMessage.
+const wsCloseTooBig = 1009
+
+// maxWSControl is the largest payload of a control frame (RFC 6455 5.5).
+const maxWSControl = 125
+
+// errWSTooLarge is returned by ReadMessage for a message over maxWSMessage.
+var errWSTooLarge = fmt.Errorf("websocket message larger than %d bytes", maxWSMessage)
+
 // WSConn represents a WebSocket connection (minimal implementation)
 type WSConn struct {
 	conn   net.Conn
 	reader *bufio.Reader
 	mu     sync.Mutex
+	// Addresses of the client and of the router it connected to
+	client, local string
+	session       wsSession
+	closeSent     bool // Guarded by mu
+}
+
+// wsSession is what a session message establishes for the later messages of
+// a connection: the provider configuration, so keys are not sent with every
+// message, and the environment facts, collected once and again only after
+// commands changed configs. Messages are handled one at a time, so it needs
+// no lock.
+type wsSession struct {
+	cfg     *config.Config // nil without a session message
+	facts   *openwrt.Facts
+	changes uint64 // Server.changes when facts were collected
+}
+
+// SessionRequest is the payload of a session message.
+type SessionRequest struct {
+	Provider string            `json:"provider"`
+	Model    string            `json:"model"`
+	Config   map[string]string `json:"config"` // API keys override
 }
 
 // WSMessage represents a WebSocket message
@@ -45,11 +86,18 @@ type WSMessage struct {
 	ID      string          `json:"id,omitempty"`
 	Payload json.RawMessage `json:"payload,omitempty"`
 	Error   string          `json:"error,omitempty"`
+	Code    errcode.Code    `json:"code,omitempty"`
+	Hint    string          `json:"hint,omitempty"`
+}
+
+// wsError builds an error message classified under code.
+func wsError(id string, code errcode.Code, msg string) WSMessage {
+	return WSMessage{Type: "error", ID: id, Error: msg, Code: code, Hint: code.Hint()}
 }
 
 // StreamEvent represents a streaming event sent to the client
 type StreamEvent struct {
-	Type    string      `json:"type"` // "token", "plan", "exec_start", "exec_output", "exec_end", "error", "done"
+	Type    string      `json:"type"` // "token", "plan", "exec_start", "exec_output", "exec_end", "log_line", "log_alert", "log_analysis", "error", "done"
 	Data    interface{} `json:"data,omitempty"`
 	Index   int         `json:"index,omitempty"`   // Command index for exec events
 	Command string      `json:"command,omitempty"` // Command being executed
@@ -96,46 +144,78 @@ func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WSConn, error) {
 	return &WSConn{conn: conn, reader: buf.Reader}, nil
 }
 
-// ReadMessage reads a WebSocket frame
+// ReadMessage reads the next data message, joining the frames of a
+// fragmented one. Pings are answered and pongs skipped on the way. A
+// message over maxWSMessage is not read further: errWSTooLarge is
+// returned, and the connection should be closed (see closeWith).
 func (ws *WSConn) ReadMessage() ([]byte, error) {
-	// Read first 2 bytes
+	var message []byte
+	fragmented := false
+	for {
+		fin, opcode, payload, err := ws.readFrame(maxWSMessage - len(message))
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpClose:
+			return nil, io.EOF
+		case wsOpPing:
+			ws.writePong()
+			continue
+		case wsOpPong:
+			continue
+		case wsOpContinuation:
+			if !fragmented {
+				return nil, fmt.Errorf("websocket continuation frame outside a message")
+			}
+		case wsOpText, wsOpBinary:
+			if fragmented {
+				return nil, fmt.Errorf("websocket message started before the previous one ended")
+			}
+		default:
+			return nil, fmt.Errorf("websocket frame with unknown opcode %d", opcode)
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+		fragmented = true
+	}
+}
+
+// readFrame reads one frame, unmasking its payload. Data frames may carry
+// at most limit bytes, control frames maxWSControl; the payload of a larger
+// frame is left unread.
+func (ws *WSConn) readFrame(limit int) (fin bool, opcode byte, payload []byte, err error) {
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(ws.reader, header); err != nil {
-		return nil, err
+		return false, 0, nil, err
 	}
-
-	fin := header[0]&0x80 != 0
-	opcode := header[0] & 0x0F
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
 	masked := header[1]&0x80 != 0
-	payloadLen := int(header[1] & 0x7F)
-
-	// Handle control frames
-	if opcode == wsOpClose {
-		return nil, io.EOF
-	}
-	if opcode == wsOpPing {
-		// Read ping payload and send pong
-		if payloadLen > 0 {
-			payload := make([]byte, payloadLen)
-			io.ReadFull(ws.reader, payload)
-		}
-		ws.writePong()
-		return ws.ReadMessage()
-	}
+	payloadLen := uint64(header[1] & 0x7F)
 
 	// Extended payload length
 	if payloadLen == 126 {
 		ext := make([]byte, 2)
 		if _, err := io.ReadFull(ws.reader, ext); err != nil {
-			return nil, err
+			return false, 0, nil, err
 		}
-		payloadLen = int(ext[0])<<8 | int(ext[1])
+		payloadLen = uint64(binary.BigEndian.Uint16(ext))
 	} else if payloadLen == 127 {
 		ext := make([]byte, 8)
 		if _, err := io.ReadFull(ws.reader, ext); err != nil {
-			return nil, err
+			return false, 0, nil, err
 		}
-		payloadLen = int(ext[4])<<24 | int(ext[5])<<16 | int(ext[6])<<8 | int(ext[7])
+		payloadLen = binary.BigEndian.Uint64(ext)
+	}
+	if opcode >= wsOpClose {
+		if payloadLen > maxWSControl || !fin {
+			return false, 0, nil, fmt.Errorf("websocket control frame too large or fragmented")
+		}
+	} else if payloadLen > uint64(limit) {
+		return false, 0, nil, errWSTooLarge
 	}
 
 	// Read mask key if masked
@@ -143,25 +223,20 @@ func (ws *WSConn) ReadMessage() ([]byte, error) {
 	if masked {
 		maskKey = make([]byte, 4)
 		if _, err := io.ReadFull(ws.reader, maskKey); err != nil {
-			return nil, err
+			return false, 0, nil, err
 		}
 	}
 
-	// Read payload
-	payload := make([]byte, payloadLen)
+	payload = make([]byte, payloadLen)
 	if _, err := io.ReadFull(ws.reader, payload); err != nil {
-		return nil, err
+		return false, 0, nil, err
 	}
-
-	// Unmask if needed
 	if masked {
 		for i := range payload {
 			payload[i] ^= maskKey[i%4]
 		}
 	}
-
-	_ = fin // Handle fragmentation if needed in future
-	return payload, nil
+	return fin, opcode, payload, nil
 }
 
 // WriteMessage writes a WebSocket frame
@@ -202,12 +277,28 @@ func (ws *WSConn) writePong() {
 	ws.conn.Write([]byte{0x8A, 0}) // Pong frame
 }
 
+// closeWith sends a close frame with status code and reason; the
+// connection is closed by Close.
+func (ws *WSConn) closeWith(code int, reason string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closeSent {
+		return
+	}
+	ws.closeSent = true
+	payload := append([]byte{byte(code >> 8), byte(code)}, reason...)
+	ws.conn.Write(append([]byte{0x88, byte(len(payload))}, payload...))
+}
+
 // Close closes the WebSocket connection
 func (ws *WSConn) Close() error {
 	ws.mu.Lock()
 	defer ws.mu.Unlock()
-	// Send close frame
-	ws.conn.Write([]byte{0x88, 0})
+	// Send close frame, unless closeWith did
+	if !ws.closeSent {
+		ws.closeSent = true
+		ws.conn.Write([]byte{0x88, 0})
+	}
 	return ws.conn.Close()
 }
 
@@ -218,135 +309,268 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	if token == "" {
 		token = r.Header.Get("X-Auth-Token")
 	}
-	if s.token != "" && token != s.token {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	r, client := s.withClientAddr(r)
+	if !s.authorize(w, client, token, auth.RoleOperator) {
 		return
 	}
+	r = s.withActor(r, token)
 
 	ws, err := upgradeWebSocket(w, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		errcode.WriteHTTP(w, errcode.InvalidRequest, err.Error())
 		return
 	}
 	defer ws.Close()
+	ws.client, ws.local = client, localAddrFrom(r.Context())
+	// Hijacked connections are invisible to Shutdown; a restart waits for them
+	s.streams.Add(1)
+	defer s.streams.Done()
+	defer s.metrics.Server().SessionOpened()()
 
 	fmt.Println("WebSocket client connected")
+	s.serveWS(r.Context(), ws)
+	fmt.Println("WebSocket client disconnected")
+}
 
-	// Message handling loop
-	for {
-		data, err := ws.ReadMessage()
-		if err != nil {
-			if err != io.EOF {
-				fmt.Printf("WebSocket read error: %v\n", err)
+// serveWS handles the messages of ws until the client disconnects. Messages
+// are handled one at a time, but read meanwhile, so that the work of a
+// message stops, commands and all, once the client goes away: the context
+// of every message is cancelled then.
+func (s *Server) serveWS(ctx context.Context, ws *WSConn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	messages := make(chan []byte)
+	go func() {
+		defer close(messages)
+		defer cancel()
+		for {
+			data, err := ws.ReadMessage()
+			if err == errWSTooLarge {
+				ws.WriteJSON(wsError("", errcode.RequestTooLarge, fmt.Sprintf("Message larger than %d bytes", maxWSMessage)))
+				ws.closeWith(wsCloseTooBig, "message too large")
+			}
+			if err != nil {
+				if err != io.EOF {
+					fmt.Printf("WebSocket read error: %v\n", err)
+				}
+				return
+			}
+			select {
+			case messages <- data:
+			case <-ctx.Done():
+				return
 			}
-			break
 		}
+	}()
 
+	// Message handling loop
+	for data := range messages {
 		var msg WSMessage
 		if err := json.Unmarshal(data, &msg); err != nil {
-			ws.WriteJSON(WSMessage{Type: "error", Error: "Invalid JSON"})
+			ws.WriteJSON(wsError("", errcode.InvalidRequest, "Invalid JSON"))
 			continue
 		}
 
 		// Handle message based on type
 		switch msg.Type {
+		case "session":
+			s.handleWSSession(ctx, ws, msg)
 		case "plan":
-			s.handleWSPlan(ws, msg)
+			s.handleWSPlan(ctx, ws, msg)
 		case "execute":
-			s.handleWSExecute(ws, msg)
+			s.handleWSExecute(ctx, ws, msg)
 		case "chat":
-			s.handleWSChat(ws, msg)
+			s.handleWSChat(ctx, ws, msg)
+		case "tail":
+			s.handleWSTail(ctx, ws, msg)
 		case "ping":
 			ws.WriteJSON(WSMessage{Type: "pong", ID: msg.ID})
 		default:
-			ws.WriteJSON(WSMessage{Type: "error", ID: msg.ID, Error: "Unknown message type"})
+			ws.WriteJSON(wsError(msg.ID, errcode.InvalidRequest, "Unknown message type"))
 		}
 	}
+}
 
-	fmt.Println("WebSocket client disconnected")
+// handleWSSession establishes the session of the connection, replacing an
+// earlier one, and collects the facts its plans start from. The reply names
+// the provider and model in effect.
+func (s *Server) handleWSSession(ctx context.Context, ws *WSConn, msg WSMessage) {
+	var req SessionRequest
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			ws.WriteJSON(wsError(msg.ID, errcode.InvalidRequest, "Invalid payload"))
+			return
+		}
+	}
+	cfg := s.mergeConfig(req.Provider, req.Model, req.Config)
+	ws.session = wsSession{cfg: &cfg}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	facts := s.wsFacts(ctx, ws, cfg)
+	cancel()
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"provider":        cfg.Provider,
+		"model":           cfg.Model,
+		"facts_collected": facts.Stamp.Collected,
+	})
+	ws.WriteJSON(WSMessage{Type: "session", ID: msg.ID, Payload: payload})
+}
+
+// wsConfig returns the configuration of a message: that of the session, or
+// of the daemon without one, with the provider, model and keys the message
+// itself names applied.
+func (s *Server) wsConfig(ws *WSConn, provider, model string, cfgMap map[string]string) config.Config {
+	base := s.cfg
+	if ws.session.cfg != nil {
+		base = *ws.session.cfg
+	}
+	return mergeInto(base, provider, model, cfgMap)
+}
+
+// wsFacts returns the environment facts of a plan prompt: those of the
+// session while no command changed configs since they were collected, or
+// freshly collected ones. Without a session every message collects them.
+func (s *Server) wsFacts(ctx context.Context, ws *WSConn, cfg config.Config) openwrt.Facts {
+	s.factsMu.Lock()
+	changes := s.changes
+	s.factsMu.Unlock()
+	if ws.session.cfg != nil && ws.session.facts != nil && ws.session.changes == changes {
+		return *ws.session.facts
+	}
+	factsCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	f := openwrt.CollectSignedFacts(factsCtx, cfg.FactsKeyFile)
+	cancel()
+	if ws.session.cfg != nil {
+		ws.session.facts, ws.session.changes = &f, changes
+	}
+	return f
 }
 
 // handleWSPlan handles plan generation with streaming
-func (s *Server) handleWSPlan(ws *WSConn, msg WSMessage) {
+func (s *Server) handleWSPlan(ctx context.Context, ws *WSConn, msg WSMessage) {
 	var req PlanRequest
 	if err := json.Unmarshal(msg.Payload, &req); err != nil {
-		ws.WriteJSON(WSMessage{Type: "error", ID: msg.ID, Error: "Invalid payload"})
+		ws.WriteJSON(wsError(msg.ID, errcode.InvalidRequest, "Invalid payload"))
+		return
+	}
+	if err := req.validate(); err != nil {
+		ws.WriteJSON(wsError(msg.ID, errcode.Of(err), err.Error()))
 		return
 	}
 
-	cfg := s.mergeConfig(req.Provider, req.Model, req.Config)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.TimeoutSeconds)*time.Second)
+	cfg := s.wsConfig(ws, req.Provider, req.Model, req.Config)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
 	defer cancel()
 
 	// Stream status updates
 	ws.WriteJSON(StreamEvent{Type: "status", Data: "Collecting environment facts..."})
-
-	factsCtx, factsCancel := context.WithTimeout(ctx, 3*time.Second)
-	envFacts := openwrt.CollectFacts(factsCtx)
-	factsCancel()
+	envFacts := s.wsFacts(ctx, ws, cfg)
 
 	ws.WriteJSON(StreamEvent{Type: "status", Data: "Generating plan..."})
 
-	instruction := prompts.GenerateSurvivalPrompt(cfg.MaxCommands)
-	if envFacts != "" {
-		instruction += "\n\nEnvironment facts (read-only):\n" + envFacts
-	}
+	kind, limit := intent.ForPrompt(cfg, req.Prompt)
+	instruction := prompts.GeneratePlanPrompt(kind, limit)
+	instruction += prompts.ExamplesBlock(req.Prompt, cfg.FewShotExamples)
+	instruction += prompts.CommandsBlock(req.Prompt, cfg.CommandSnippets)
+	instruction += firewall.PromptBlock(ctx, req.Prompt)
+	instruction += prompts.FeedbackBlock(cfg, cfg.FeedbackHints)
+	instruction += s.factsBlock(envFacts)
 	fullPrompt := instruction + "\n\nUser request: " + req.Prompt
 
 	llmProvider := llm.NewProvider(cfg)
 	p, err := llmProvider.GeneratePlan(ctx, fullPrompt)
 	if err != nil {
-		ws.WriteJSON(WSMessage{Type: "error", ID: msg.ID, Error: err.Error()})
+		ws.WriteJSON(wsError(msg.ID, errcode.Of(err), err.Error()))
 		return
 	}
+	if limit > 0 && len(p.Commands) > limit {
+		ws.WriteJSON(StreamEvent{Type: "status", Data: "Plan over the command limit; asking for a shorter one..."})
+		if p, err = llm.FitLimit(ctx, llmProvider, fullPrompt, p, limit); err != nil {
+			ws.WriteJSON(wsError(msg.ID, errcode.Of(err), err.Error()))
+			return
+		}
+	}
+	p.Facts = &envFacts.Stamp
+	policyEngine := policy.New(cfg).WithControl(controlPath(ctx, cfg, ws.client, ws.local)).WithTopology(deviceTopology(ctx, cfg)).WithFirewall(deviceFirewall(ctx, cfg))
+	p = policyEngine.CheckTools(p)
+	p.PolicyWarnings = policyEngine.Warnings(p)
+	p.Lint = policy.LintPlan(p)
+	p.Estimate = impact.Estimate(cfg, p, llm.TokensUsed(llmProvider))
+	p.PolicyTrace = policyEngine.Trace(p)
+	if policyEngine.ValidatePlan(p) == nil && mayStage(ctx) {
+		p.FileChanges = executor.New(cfg).Stage(ctx, p)
+	}
 
 	ws.WriteJSON(StreamEvent{Type: "plan", Data: p})
 	ws.WriteJSON(StreamEvent{Type: "done"})
 }
 
 // handleWSExecute handles execution with real-time streaming
-func (s *Server) handleWSExecute(ws *WSConn, msg WSMessage) {
+func (s *Server) handleWSExecute(ctx context.Context, ws *WSConn, msg WSMessage) {
 	var req ExecuteRequest
 	if err := json.Unmarshal(msg.Payload, &req); err != nil {
-		ws.WriteJSON(WSMessage{Type: "error", ID: msg.ID, Error: "Invalid payload"})
+		ws.WriteJSON(wsError(msg.ID, errcode.InvalidRequest, "Invalid payload"))
+		return
+	}
+	if err := req.validate(); err != nil {
+		ws.WriteJSON(wsError(msg.ID, errcode.Of(err), err.Error()))
 		return
 	}
 
-	cfg := s.mergeConfig(req.Provider, req.Model, req.Config)
+	cfg := s.wsConfig(ws, req.Provider, req.Model, req.Config)
 	cfg.DryRun = req.DryRun
 	if req.Timeout > 0 {
 		cfg.TimeoutSeconds = req.Timeout
 	}
 
-	ctx := context.Background()
-	policyEngine := policy.New(cfg)
+	policyEngine := policy.New(cfg).WithControl(controlPath(ctx, cfg, ws.client, ws.local)).WithTopology(deviceTopology(ctx, cfg)).WithFirewall(deviceFirewall(ctx, cfg))
 
 	var p plan.Plan
 	if len(req.Commands) > 0 {
-		p = plan.Plan{Summary: "Direct execution", Commands: req.Commands}
+		var err error
+		if p, err = directPlan(msg.Payload); err != nil {
+			ws.WriteJSON(wsError(msg.ID, errcode.Of(err), "Plan: "+err.Error()))
+			return
+		}
+		if req.Facts != nil {
+			if err := s.checkPlanFacts(ctx, cfg, *req.Facts); err != nil {
+				ws.WriteJSON(wsError(msg.ID, errcode.Of(err), "Facts: "+err.Error()))
+				return
+			}
+		}
 	} else {
 		// Generate plan first
 		ws.WriteJSON(StreamEvent{Type: "status", Data: "Generating plan..."})
 		llmProvider := llm.NewProvider(cfg)
 
-		factsCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
-		envFacts := openwrt.CollectFacts(factsCtx)
-		cancel()
+		envFacts := s.wsFacts(ctx, ws, cfg)
 
-		instruction := prompts.GenerateSurvivalPrompt(cfg.MaxCommands)
-		if envFacts != "" {
-			instruction += "\n\nEnvironment facts (read-only):\n" + envFacts
-		}
+		kind, limit := intent.ForPrompt(cfg, req.Prompt)
+		instruction := prompts.GeneratePlanPrompt(kind, limit)
+		instruction += prompts.ExamplesBlock(req.Prompt, cfg.FewShotExamples)
+		instruction += prompts.CommandsBlock(req.Prompt, cfg.CommandSnippets)
+		instruction += firewall.PromptBlock(ctx, req.Prompt)
+		instruction += prompts.FeedbackBlock(cfg, cfg.FeedbackHints)
+		instruction += s.factsBlock(envFacts)
 		fullPrompt := instruction + "\n\nUser request: " + req.Prompt
 
 		planCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
 		var err error
 		p, err = llmProvider.GeneratePlan(planCtx, fullPrompt)
+		if err == nil {
+			p, err = llm.FitLimit(planCtx, llmProvider, fullPrompt, p, limit)
+		}
 		cancel()
 		if err != nil {
-			ws.WriteJSON(WSMessage{Type: "error", ID: msg.ID, Error: err.Error()})
+			ws.WriteJSON(wsError(msg.ID, errcode.Of(err), err.Error()))
 			return
 		}
+		p.Facts = &envFacts.Stamp
+		p = policyEngine.CheckTools(p)
+		p.PolicyWarnings = policyEngine.Warnings(p)
+		p.Lint = policy.LintPlan(p)
+		p.Estimate = impact.Estimate(cfg, p, llm.TokensUsed(llmProvider))
+		p.PolicyTrace = policyEngine.Trace(p)
 		ws.WriteJSON(StreamEvent{Type: "plan", Data: p})
 	}
 
@@ -355,11 +579,15 @@ func (s *Server) handleWSExecute(ws *WSConn, msg WSMessage) {
 		return
 	}
 
-	// Validate
+	// Validate; CheckTools is idempotent, so generated plans are unchanged
+	p = policyEngine.CheckTools(p)
 	if err := policyEngine.ValidatePlan(p); err != nil {
-		ws.WriteJSON(WSMessage{Type: "error", ID: msg.ID, Error: "Policy: " + err.Error()})
+		s.auditLogger(ctx).Rejected(req.Prompt, p, err.Error())
+		ws.WriteJSON(wsError(msg.ID, errcode.PolicyDeny, "Policy: "+policy.Explain(err)))
 		return
 	}
+	p.PolicyWarnings = policyEngine.Warnings(p)
+	p.Lint = policy.LintPlan(p)
 
 	if cfg.DryRun {
 		ws.WriteJSON(StreamEvent{Type: "dry_run", Data: p})
@@ -367,12 +595,43 @@ func (s *Server) handleWSExecute(ws *WSConn, msg WSMessage) {
 		return
 	}
 
+	ack := req.AckWarnings
+	if approver.Enabled(cfg) {
+		ws.WriteJSON(StreamEvent{Type: "approval_pending"})
+		if err := approver.Ask(ctx, cfg, approvalRequest(ctx, req.Prompt, p)); err != nil {
+			ws.WriteJSON(wsError(msg.ID, errcode.Of(err), "Approval: "+err.Error()))
+			return
+		}
+		// The approver saw the warnings
+		ack = true
+	}
+	if err := policy.RequireAck(p, ack); err != nil {
+		ws.WriteJSON(wsError(msg.ID, errcode.Of(err), "Policy: "+err.Error()))
+		return
+	}
+
+	if st, armed, err := rollback.Guard(cfg.RollbackDir, cfg.RollbackTimeout, p); err != nil {
+		ws.WriteJSON(wsError(msg.ID, errcode.Conflict, "Rollback: "+err.Error()))
+		return
+	} else if armed {
+		ws.WriteJSON(StreamEvent{Type: "rollback_armed", Data: st})
+	}
+
 	// Execute with streaming output
 	execEngine := executor.New(cfg)
+	logger := s.auditLogger(ctx).WithExecution(artifacts.NewID())
+	logger.Plan(req.Prompt, p)
+	var executed executor.Results
+	// Logged even if the client goes away midway
+	defer func() { logResults(logger, executed) }()
 	ws.WriteJSON(StreamEvent{Type: "exec_start", Data: len(p.Commands)})
 
 	for i, cmd := range p.Commands {
-		cmdStr := executor.FormatCommand(cmd.Command)
+		if ctx.Err() != nil {
+			// The client went away; nobody would see the rest
+			return
+		}
+		cmdStr := executor.FormatPlanned(cmd)
 		ws.WriteJSON(StreamEvent{
 			Type:    "exec_cmd",
 			Index:   i,
@@ -383,26 +642,47 @@ func (s *Server) handleWSExecute(ws *WSConn, msg WSMessage) {
 		// Create a writer that streams to WebSocket
 		streamWriter := &wsStreamWriter{ws: ws, index: i}
 		result := execEngine.RunPlanStreaming(ctx, plan.Plan{Commands: []plan.PlannedCommand{cmd}}, streamWriter)
+		s.factsChanged(result)
 
 		if len(result.Items) > 0 {
 			r := result.Items[0]
+			r.Index = i
+			executed.Items = append(executed.Items, r)
+			data := map[string]interface{}{
+				"success":   r.Err == nil,
+				"output":    r.Output,
+				"stderr":    r.Stderr,
+				"exit_code": r.ExitCode,
+				"elapsed":   r.Elapsed.String(),
+			}
+			if r.Signal != "" {
+				data["signal"] = r.Signal
+			}
+			if r.JobID != "" {
+				data["job_id"] = r.JobID
+			}
 			ws.WriteJSON(StreamEvent{
 				Type:  "exec_result",
 				Index: i,
-				Data: map[string]interface{}{
-					"success": r.Err == nil,
-					"output":  r.Output,
-					"elapsed": r.Elapsed.String(),
-				},
+				Data:  data,
 			})
 		}
 	}
 
+	if len(p.Verify) > 0 {
+		var results executor.Results
+		execEngine.Verify(ctx, p, &results)
+		ws.WriteJSON(StreamEvent{Type: "verify", Data: map[string]interface{}{
+			"verified": results.Verified,
+			"checks":   results.Checks,
+		}})
+	}
+
 	ws.WriteJSON(StreamEvent{Type: "done"})
 }
 
 // handleWSChat handles interactive chat with streaming
-func (s *Server) handleWSChat(ws *WSConn, msg WSMessage) {
+func (s *Server) handleWSChat(ctx context.Context, ws *WSConn, msg WSMessage) {
 	var req struct {
 		Message  string            `json:"message"`
 		Provider string            `json:"provider"`
@@ -410,31 +690,49 @@ func (s *Server) handleWSChat(ws *WSConn, msg WSMessage) {
 		Config   map[string]string `json:"config"`
 	}
 	if err := json.Unmarshal(msg.Payload, &req); err != nil {
-		ws.WriteJSON(WSMessage{Type: "error", ID: msg.ID, Error: "Invalid payload"})
+		ws.WriteJSON(wsError(msg.ID, errcode.InvalidRequest, "Invalid payload"))
+		return
+	}
+	if err := checkLength("message", req.Message, maxPromptChars); err != nil {
+		ws.WriteJSON(wsError(msg.ID, errcode.Of(err), err.Error()))
 		return
 	}
 
-	cfg := s.mergeConfig(req.Provider, req.Model, req.Config)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.TimeoutSeconds)*time.Second)
+	cfg := s.wsConfig(ws, req.Provider, req.Model, req.Config)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
 	defer cancel()
 
-	// Collect facts
-	factsCtx, factsCancel := context.WithTimeout(ctx, 3*time.Second)
-	envFacts := openwrt.CollectFacts(factsCtx)
-	factsCancel()
+	envFacts := s.wsFacts(ctx, ws, cfg)
 
-	instruction := prompts.GenerateSurvivalPrompt(cfg.MaxCommands)
-	if envFacts != "" {
-		instruction += "\n\nEnvironment facts (read-only):\n" + envFacts
-	}
+	kind, limit := intent.ForPrompt(cfg, req.Message)
+	instruction := prompts.GeneratePlanPrompt(kind, limit)
+	instruction += prompts.ExamplesBlock(req.Message, cfg.FewShotExamples)
+	instruction += prompts.CommandsBlock(req.Message, cfg.CommandSnippets)
+	instruction += firewall.PromptBlock(ctx, req.Message)
+	instruction += prompts.FeedbackBlock(cfg, cfg.FeedbackHints)
+	instruction += s.factsBlock(envFacts)
 	fullPrompt := instruction + "\n\nUser request: " + req.Message
 
 	llmProvider := llm.NewProvider(cfg)
 	p, err := llmProvider.GeneratePlan(ctx, fullPrompt)
 	if err != nil {
-		ws.WriteJSON(WSMessage{Type: "error", ID: msg.ID, Error: err.Error()})
+		ws.WriteJSON(wsError(msg.ID, errcode.Of(err), err.Error()))
 		return
 	}
+	if limit > 0 && len(p.Commands) > limit {
+		ws.WriteJSON(StreamEvent{Type: "status", Data: "Plan over the command limit; asking for a shorter one..."})
+		if p, err = llm.FitLimit(ctx, llmProvider, fullPrompt, p, limit); err != nil {
+			ws.WriteJSON(wsError(msg.ID, errcode.Of(err), err.Error()))
+			return
+		}
+	}
+	p.Facts = &envFacts.Stamp
+	policyEngine := policy.New(cfg).WithControl(controlPath(ctx, cfg, ws.client, ws.local)).WithTopology(deviceTopology(ctx, cfg)).WithFirewall(deviceFirewall(ctx, cfg))
+	p = policyEngine.CheckTools(p)
+	p.PolicyWarnings = policyEngine.Warnings(p)
+	p.Lint = policy.LintPlan(p)
+	p.Estimate = impact.Estimate(cfg, p, llm.TokensUsed(llmProvider))
+	p.PolicyTrace = policyEngine.Trace(p)
 
 	// Stream the response
 	ws.WriteJSON(StreamEvent{Type: "chat_response", Data: p})
@@ -463,7 +761,11 @@ func (w *wsStreamWriter) Write(p []byte) (n int, err error) {
 
 // mergeConfig merges request config with server config
 func (s *Server) mergeConfig(provider, model string, cfgMap map[string]string) config.Config {
-	cfg := s.cfg
+	return mergeInto(s.cfg, provider, model, cfgMap)
+}
+
+// mergeInto applies the provider, model and API keys of a request to cfg.
+func mergeInto(cfg config.Config, provider, model string, cfgMap map[string]string) config.Config {
 	if provider != "" {
 		cfg.Provider = provider
 	}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+)
+
+// pipeWS returns a server end of a WebSocket connection and the payloads of
+// the frames it writes.
+func pipeWS(t *testing.T) (*WSConn, <-chan []byte) {
+	ws, _, frames := clientWS(t)
+	return ws, frames
+}
+
+// clientWS is pipeWS with the client end of the connection too.
+func clientWS(t *testing.T) (*WSConn, net.Conn, <-chan []byte) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close(); client.Close() })
+	frames := make(chan []byte, 16)
+	go func() {
+		r := bufio.NewReader(client)
+		for {
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(r, header); err != nil {
+				return
+			}
+			n := int(header[1] & 0x7F)
+			if n == 126 {
+				ext := make([]byte, 2)
+				io.ReadFull(r, ext)
+				n = int(ext[0])<<8 | int(ext[1])
+			}
+			payload := make([]byte, n)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			frames <- payload
+		}
+	}()
+	return &WSConn{conn: server, reader: bufio.NewReader(server)}, client, frames
+}
+
+func TestWebSocket_Session(t *testing.T) {
+	cfg := config.Config{Provider: "gemini", APIKey: "daemon-key", TimeoutSeconds: 30, JobsDir: t.TempDir(), RollbackDir: t.TempDir()}
+	s := New(cfg)
+	ws, frames := pipeWS(t)
+
+	// Without a session messages use the daemon's configuration
+	if got := s.wsConfig(ws, "", "", nil); got.Provider != "gemini" || got.APIKey != "daemon-key" {
+		t.Fatalf("unexpected config without a session: %+v", got)
+	}
+
+	s.handleWSSession(context.Background(), ws, WSMessage{Type: "session", ID: "s1", Payload: json.RawMessage(`{"provider":"openai","model":"gpt-5","config":{"openai_key":"session-key"}}`)})
+	var reply WSMessage
+	select {
+	case data := <-frames:
+		json.Unmarshal(data, &reply)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply to the session message")
+	}
+	var info struct {
+		Provider string `json:"provider"`
+		Model    string `json:"model"`
+	}
+	json.Unmarshal(reply.Payload, &info)
+	if reply.Type != "session" || reply.ID != "s1" || info.Provider != "openai" || info.Model != "gpt-5" {
+		t.Fatalf("unexpected reply %+v (%s)", reply, reply.Payload)
+	}
+
+	got := s.wsConfig(ws, "", "", nil)
+	if got.Provider != "openai" || got.Model != "gpt-5" || got.OpenAIAPIKey != "session-key" {
+		t.Errorf("expected the session's provider and key, got %+v", got)
+	}
+	if got := s.wsConfig(ws, "", "gpt-5-mini", nil); got.Model != "gpt-5-mini" || got.OpenAIAPIKey != "session-key" {
+		t.Errorf("expected a message to override the model only, got %+v", got)
+	}
+
+	// Facts are reused until commands change configs
+	first := ws.session.facts
+	if first == nil {
+		t.Fatal("expected the session to collect facts")
+	}
+	if f := s.wsFacts(context.Background(), ws, got); f.Stamp.Collected != first.Stamp.Collected {
+		t.Error("expected the session's facts to be reused")
+	}
+	s.factsChanged(executor.Results{Items: []executor.Result{{Command: []string{"uci", "commit", "network"}}}})
+	time.Sleep(10 * time.Millisecond)
+	if f := s.wsFacts(context.Background(), ws, got); !f.Stamp.Collected.After(first.Stamp.Collected) || ws.session.facts == first {
+		t.Error("expected facts to be collected again after a config change")
+	}
+
+	// Invalid payloads keep the session
+	s.handleWSSession(context.Background(), ws, WSMessage{Type: "session", ID: "s2", Payload: json.RawMessage(`[]`)})
+	if data := <-frames; !json.Valid(data) || ws.session.cfg.Provider != "openai" {
+		t.Errorf("unexpected reply %s or session %+v", data, ws.session.cfg)
+	}
+}
+
+func TestWebSocket_DisconnectCancelsExecution(t *testing.T) {
+	cfg := config.Config{TimeoutSeconds: 60, JobsDir: t.TempDir(), RollbackDir: t.TempDir(), LogFile: filepath.Join(t.TempDir(), "audit.log")}
+	s := New(cfg)
+	ws, client, frames := clientWS(t)
+	served := make(chan struct{})
+	go func() {
+		s.serveWS(context.Background(), ws)
+		close(served)
+	}()
+
+	msg, _ := json.Marshal(WSMessage{Type: "execute", ID: "e1", Payload: json.RawMessage(`{"commands":[{"command":["sleep","30"]},{"command":["true"]}]}`)})
+	frame := append([]byte{0x81, 126, byte(len(msg) >> 8), byte(len(msg))}, msg...)
+	if _, err := client.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for started := false; !started; {
+		select {
+		case data := <-frames:
+			var ev StreamEvent
+			json.Unmarshal(data, &ev)
+			started = ev.Type == "exec_cmd"
+		case <-timeout:
+			t.Fatal("the command did not start")
+		}
+	}
+
+	// The client goes away while the command runs
+	client.Close()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the command outlived the connection")
+	}
+
+	// What ran before the client went away is in the audit log
+	entries, err := logging.ReadHistory(cfg.LogFile)
+	if err != nil || len(entries) != 1 || len(entries[0].Results) != 1 || entries[0].Status() != "failed" {
+		t.Errorf("history = %+v, %v", entries, err)
+	}
+}
+
+// clientFrame is a masked frame as a client sends it.
+func clientFrame(first byte, payload []byte) []byte {
+	frame := []byte{first}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n < 65536:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestWebSocket_ReadMessage(t *testing.T) {
+	ws, client, frames := clientWS(t)
+	go func() {
+		// A message in three frames, with a ping between them
+		client.Write(clientFrame(0x01, []byte(`{"type":`)))
+		client.Write(clientFrame(0x89, []byte("hi")))
+		client.Write(clientFrame(0x00, []byte(`"ping",`)))
+		client.Write(clientFrame(0x80, []byte(`"id":"p1"}`)))
+	}()
+	data, err := ws.ReadMessage()
+	if err != nil || string(data) != `{"type":"ping","id":"p1"}` {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if pong := <-frames; len(pong) != 0 {
+		t.Errorf("unexpected pong payload %q", pong)
+	}
+
+	// A continuation without a message is refused
+	go client.Write(clientFrame(0x80, []byte("x")))
+	if _, err := ws.ReadMessage(); err == nil {
+		t.Error("expected an error for a stray continuation frame")
+	}
+}
+
+func TestWebSocket_MessageTooLarge(t *testing.T) {
+	s := New(config.Config{TimeoutSeconds: 30, JobsDir: t.TempDir(), RollbackDir: t.TempDir()})
+	ws, client, frames := clientWS(t)
+	served := make(chan struct{})
+	go func() {
+		s.serveWS(context.Background(), ws)
+		close(served)
+	}()
+
+	// Fragments under the limit that add up to more than it
+	half := make([]byte, maxWSMessage/2+1)
+	go func() {
+		client.Write(clientFrame(0x01, half))
+		client.Write(clientFrame(0x80, half))
+	}()
+	var reply WSMessage
+	select {
+	case data := <-frames:
+		json.Unmarshal(data, &reply)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply to the oversized message")
+	}
+	if reply.Type != "error" || reply.Code != errcode.RequestTooLarge {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	if closing := <-frames; len(closing) < 2 || int(closing[0])<<8|int(closing[1]) != wsCloseTooBig {
+		t.Errorf("expected a close frame with status %d, got %q", wsCloseTooBig, closing)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed")
+	}
+}
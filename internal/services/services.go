@@ -0,0 +1,198 @@
+// Package services implements the built-in service commands (see
+// plan.ServiceList): listing, inspecting and controlling init services
+// through procd's ubus objects rather than by running /etc/init.d scripts
+// through a shell.
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// Service is an init service known to procd.
+type Service struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"` // Started at boot
+	Running bool   `json:"running"`
+	// Start is the boot order of the service, the START of its init script
+	Start     int        `json:"start,omitempty"`
+	Instances []Instance `json:"instances,omitempty"`
+}
+
+// Instance is a process procd supervises for a service.
+type Instance struct {
+	Name    string   `json:"name"`
+	Running bool     `json:"running"`
+	PID     int      `json:"pid,omitempty"`
+	Command []string `json:"command,omitempty"`
+}
+
+// Actions are the actions Control accepts, as understood by `ubus call rc
+// init`.
+var Actions = []string{"start", "stop", "restart", "reload", "enable", "disable"}
+
+// IsAction reports whether action is one of Actions.
+func IsAction(action string) bool {
+	for _, a := range Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+var nameRE = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+-]*$`)
+
+// ValidName reports whether name can be an init script in /etc/init.d.
+func ValidName(name string) bool {
+	return nameRE.MatchString(name)
+}
+
+// UbusFn runs `ubus call <object> <method> <args>` with args encoded as
+// JSON and returns its output.
+type UbusFn func(ctx context.Context, object, method string, args interface{}) ([]byte, error)
+
+// ubusCall is the UbusFn in use; tests replace it (see SetUbusCall).
+var ubusCall UbusFn = defaultUbusCall
+
+// GetUbusCall returns the current ubus call function.
+func GetUbusCall() UbusFn {
+	return ubusCall
+}
+
+// SetUbusCall sets the ubus call function for testing.
+func SetUbusCall(fn UbusFn) {
+	ubusCall = fn
+}
+
+func defaultUbusCall(ctx context.Context, object, method string, args interface{}) ([]byte, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.CommandContext(ctx, "ubus", "call", object, method, string(data)).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return nil, fmt.Errorf("ubus call %s %s: %s", object, method, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return nil, fmt.Errorf("ubus call %s %s: %w", object, method, err)
+	}
+	return out, nil
+}
+
+type rcEntry struct {
+	Start   int  `json:"start"`
+	Enabled bool `json:"enabled"`
+	Running bool `json:"running"`
+}
+
+type procdService struct {
+	Instances map[string]struct {
+		Running bool     `json:"running"`
+		PID     int      `json:"pid"`
+		Command []string `json:"command"`
+	} `json:"instances"`
+}
+
+// List returns every service with an init script, sorted by name. Whether
+// it is enabled and running comes from `ubus call rc list`, its instances
+// from `ubus call service list`.
+func List(ctx context.Context) ([]Service, error) {
+	return list(ctx, "")
+}
+
+// Status returns the service called name. Services without an init script are an
+// errcode.NotFound error.
+func Status(ctx context.Context, name string) (Service, error) {
+	if !ValidName(name) {
+		return Service{}, errcode.Errorf(errcode.InvalidRequest, "invalid service name %q", name)
+	}
+	list, err := list(ctx, name)
+	if err != nil {
+		return Service{}, err
+	}
+	for _, s := range list {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return Service{}, errcode.Errorf(errcode.NotFound, "no service %q in /etc/init.d", name)
+}
+
+// list returns the service name, or all services if name is "".
+func list(ctx context.Context, name string) ([]Service, error) {
+	args := map[string]string{}
+	if name != "" {
+		args["name"] = name
+	}
+	out, err := ubusCall(ctx, "rc", "list", args)
+	if err != nil {
+		return nil, err
+	}
+	rc := map[string]rcEntry{}
+	if err := json.Unmarshal(out, &rc); err != nil {
+		return nil, fmt.Errorf("ubus call rc list: %w", err)
+	}
+	procd := map[string]procdService{}
+	if out, err := ubusCall(ctx, "service", "list", args); err == nil {
+		// Services procd does not supervise are left without instances
+		json.Unmarshal(out, &procd)
+	}
+	var services []Service
+	for n, e := range rc {
+		if name != "" && n != name {
+			continue
+		}
+		s := Service{Name: n, Enabled: e.Enabled, Running: e.Running, Start: e.Start}
+		for in, i := range procd[n].Instances {
+			s.Instances = append(s.Instances, Instance{Name: in, Running: i.Running, PID: i.PID, Command: i.Command})
+		}
+		sort.Slice(s.Instances, func(a, b int) bool { return s.Instances[a].Name < s.Instances[b].Name })
+		services = append(services, s)
+	}
+	sort.Slice(services, func(a, b int) bool { return services[a].Name < services[b].Name })
+	return services, nil
+}
+
+// Control runs action, one of Actions, on the service name through `ubus
+// call rc init`, which runs its init script under procd.
+func Control(ctx context.Context, name, action string) error {
+	if !IsAction(action) {
+		return errcode.Errorf(errcode.InvalidRequest, "unknown service action %q (want one of %s)", action, strings.Join(Actions, ", "))
+	}
+	if _, err := Status(ctx, name); err != nil {
+		return err
+	}
+	_, err := ubusCall(ctx, "rc", "init", map[string]string{"name": name, "action": action})
+	return err
+}
+
+// String renders s as one line, such as
+// "dnsmasq: enabled, running (pid 1234)".
+func (s Service) String() string {
+	state := []string{"disabled", "stopped"}
+	if s.Enabled {
+		state[0] = "enabled"
+	}
+	if s.Running {
+		state[1] = "running"
+	}
+	line := s.Name + ": " + strings.Join(state, ", ")
+	var pids []string
+	for _, i := range s.Instances {
+		if i.Running && i.PID > 0 {
+			pids = append(pids, fmt.Sprint(i.PID))
+		}
+	}
+	if len(pids) > 0 {
+		line += " (pid " + strings.Join(pids, ", ") + ")"
+	}
+	return line
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// stubUbus replaces ubusCall with canned replies of rc list and service
+// list, recording the calls made.
+func stubUbus(t *testing.T) *[]string {
+	orig := ubusCall
+	t.Cleanup(func() { ubusCall = orig })
+	var calls []string
+	ubusCall = func(ctx context.Context, object, method string, args interface{}) ([]byte, error) {
+		data, _ := json.Marshal(args)
+		calls = append(calls, object+" "+method+" "+string(data))
+		switch object + " " + method {
+		case "rc list":
+			return []byte(`{"dnsmasq":{"start":19,"enabled":true,"running":true},"sqm":{"start":50,"enabled":false,"running":false}}`), nil
+		case "service list":
+			return []byte(`{"dnsmasq":{"instances":{"cfg01411c":{"running":true,"pid":1234,"command":["/usr/sbin/dnsmasq","-C","/var/etc/dnsmasq.conf"]}}}}`), nil
+		}
+		return []byte(`{}`), nil
+	}
+	return &calls
+}
+
+func TestList(t *testing.T) {
+	stubUbus(t)
+	list, err := List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Service{
+		{Name: "dnsmasq", Enabled: true, Running: true, Start: 19, Instances: []Instance{
+			{Name: "cfg01411c", Running: true, PID: 1234, Command: []string{"/usr/sbin/dnsmasq", "-C", "/var/etc/dnsmasq.conf"}},
+		}},
+		{Name: "sqm", Start: 50},
+	}
+	if !reflect.DeepEqual(list, want) {
+		t.Fatalf("got %+v, want %+v", list, want)
+	}
+	if got := list[0].String(); got != "dnsmasq: enabled, running (pid 1234)" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := list[1].String(); got != "sqm: disabled, stopped" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestStatusAndControl(t *testing.T) {
+	calls := stubUbus(t)
+	if s, err := Status(context.Background(), "dnsmasq"); err != nil || !s.Running {
+		t.Fatalf("Status = %+v, %v", s, err)
+	}
+	if _, err := Status(context.Background(), "nope"); errcode.Of(err) != errcode.NotFound {
+		t.Errorf("expected NotFound for an unknown service, got %v", err)
+	}
+	if _, err := Status(context.Background(), "../bin/sh"); errcode.Of(err) != errcode.InvalidRequest {
+		t.Errorf("expected InvalidRequest for a path, got %v", err)
+	}
+
+	*calls = nil
+	if err := Control(context.Background(), "dnsmasq", "restart"); err != nil {
+		t.Fatal(err)
+	}
+	if last := (*calls)[len(*calls)-1]; last != `rc init {"action":"restart","name":"dnsmasq"}` {
+		t.Errorf("unexpected call %q", last)
+	}
+	if err := Control(context.Background(), "dnsmasq", "kill"); errcode.Of(err) != errcode.InvalidRequest {
+		t.Errorf("expected InvalidRequest for an unknown action, got %v", err)
+	}
+	if err := Control(context.Background(), "nope", "start"); errcode.Of(err) != errcode.NotFound {
+		t.Errorf("expected NotFound for an unknown service, got %v", err)
+	}
+}
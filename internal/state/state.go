@@ -0,0 +1,447 @@
+// Package state exports and imports LuciCodex's persistent state (config,
+// policy lists, history, metrics, OAuth tokens and keys) as a single
+// tar.gz archive, so a replaced or reflashed router can pick up where the old
+// one left off. Secrets are encrypted with a key derived from a passphrase.
+package state
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/auth"
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/storage"
+)
+
+// UCIConfigFile is the UCI package holding LuciCodex settings, including the
+// allow and deny lists.
+var UCIConfigFile = "/etc/config/lucicodex"
+
+// Version is the archive format version written to the manifest.
+const Version = 1
+
+// Archive limits guard against decompression bombs.
+const (
+	maxEntrySize   = 16 << 20
+	maxArchiveSize = 64 << 20
+)
+
+// kdfIterations is the PBKDF2 cost. Routers have slow CPUs, so it is lower
+// than desktop recommendations; var so tests can lower it further.
+var kdfIterations = 50000
+
+// ErrPassphrase is returned when encrypted entries cannot be decrypted.
+var ErrPassphrase = errors.New("wrong passphrase or corrupted archive")
+
+// Item is one piece of persistent state.
+type Item struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Dir    bool   `json:"dir,omitempty"`
+	Secret bool   `json:"secret,omitempty"` // Encrypted in the archive
+}
+
+// Items lists the state to export for cfg. configFile is the JSON config file
+// in use (see config.FilePath); items with no location are omitted.
+func Items(cfg config.Config, configFile string) []Item {
+	metrics := Item{Name: "metrics", Path: cfg.MetricsDir, Dir: true}
+	history := Item{Name: "history-store", Path: historyDir(cfg.LogFile), Dir: true}
+	if cfg.StorageBackend == storage.BackendSQLite {
+		// The rollups and the history are kept in the database, along with
+		// API tokens
+		metrics = Item{Name: "storage", Path: cfg.StoragePath}
+		history.Path = ""
+	}
+	items := []Item{
+		{Name: "config", Path: configFile},
+		{Name: "uci", Path: UCIConfigFile},
+		{Name: "history", Path: cfg.LogFile},
+		{Name: "history-head", Path: auditHead(cfg.LogFile)},
+		history,
+		metrics,
+		{Name: "tokens", Path: auth.NewStore(cfg.TokenFile).PathOrDefault(), Secret: true},
+		{Name: "facts-key", Path: cfg.FactsKeyFile, Secret: true},
+		{Name: "api-keys", Path: cfg.APIKeyFile, Secret: true},
+	}
+	out := items[:0]
+	for _, it := range items {
+		if it.Path != "" {
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+// auditHead returns the head file of the audit log, which must move with
+// it for `lucicodex audit verify` to pass.
+func auditHead(logFile string) string {
+	if logFile == "" {
+		return ""
+	}
+	return logging.HeadPath(logFile)
+}
+
+// historyDir returns the history kept alongside the audit log.
+func historyDir(logFile string) string {
+	if logFile == "" {
+		return ""
+	}
+	return logging.HistoryDir(logFile)
+}
+
+// Entry is an item recorded in an archive.
+type Entry struct {
+	Item
+	Files []string `json:"files"` // Relative paths for Dir items; the item name otherwise
+}
+
+// Manifest is the first file of an archive.
+type Manifest struct {
+	Version    int       `json:"version"`
+	Created    time.Time `json:"created"`
+	Salt       []byte    `json:"salt,omitempty"`
+	Iterations int       `json:"iterations,omitempty"`
+	Entries    []Entry   `json:"entries"`
+	Skipped    []string  `json:"skipped,omitempty"` // Secret items left out for lack of a passphrase
+}
+
+// Export writes the items that exist on disk to w. Secret items are encrypted
+// with passphrase, or skipped (and listed in Manifest.Skipped) if it is empty.
+func Export(w io.Writer, items []Item, passphrase string) (Manifest, error) {
+	m := Manifest{Version: Version, Created: time.Now().UTC(), Entries: []Entry{}}
+	var key []byte
+	if passphrase != "" {
+		m.Salt = make([]byte, 16)
+		if _, err := rand.Read(m.Salt); err != nil {
+			return m, err
+		}
+		m.Iterations = kdfIterations
+		key = deriveKey(passphrase, m.Salt, m.Iterations)
+	}
+
+	type file struct {
+		name string
+		data []byte
+		mode fs.FileMode
+	}
+	var files []file
+	for _, it := range items {
+		if it.Secret && key == nil {
+			if exists(it.Path) {
+				m.Skipped = append(m.Skipped, it.Name)
+			}
+			continue
+		}
+		rels, err := collect(it)
+		if err != nil {
+			return m, fmt.Errorf("%s: %w", it.Name, err)
+		}
+		if len(rels) == 0 {
+			continue
+		}
+		for _, rel := range rels {
+			src := it.Path
+			if it.Dir {
+				src = filepath.Join(it.Path, filepath.FromSlash(rel))
+			}
+			st, err := os.Stat(src)
+			if err != nil {
+				return m, err
+			}
+			data, err := os.ReadFile(src)
+			if err != nil {
+				return m, err
+			}
+			name := entryName(it, rel)
+			if it.Secret {
+				if data, err = seal(key, name, data); err != nil {
+					return m, err
+				}
+			}
+			files = append(files, file{name: name, data: data, mode: st.Mode().Perm()})
+		}
+		m.Entries = append(m.Entries, Entry{Item: it, Files: rels})
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return m, err
+	}
+	if err := writeFile(tw, "manifest.json", manifest, 0o644, m.Created); err != nil {
+		return m, err
+	}
+	for _, f := range files {
+		if err := writeFile(tw, f.name, f.data, f.mode, m.Created); err != nil {
+			return m, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return m, err
+	}
+	return m, gz.Close()
+}
+
+// collect returns the files of an item: the item itself for a regular file,
+// or the regular files below it (slash separated, sorted) for a directory.
+func collect(it Item) ([]string, error) {
+	if !it.Dir {
+		if !exists(it.Path) {
+			return nil, nil
+		}
+		return []string{it.Name}, nil
+	}
+	var rels []string
+	err := filepath.WalkDir(it.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(it.Path, p)
+		if err != nil {
+			return err
+		}
+		rels = append(rels, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(rels)
+	return rels, err
+}
+
+func exists(p string) bool {
+	st, err := os.Stat(p)
+	return err == nil && st.Mode().IsRegular()
+}
+
+func entryName(it Item, rel string) string {
+	if it.Dir {
+		return "data/" + it.Name + "/" + rel
+	}
+	return "data/" + it.Name
+}
+
+func writeFile(tw *tar.Writer, name string, data []byte, mode fs.FileMode, mtime time.Time) error {
+	hdr := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(data)), ModTime: mtime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Import restores an archive written by Export. Each entry goes to the path
+// of the same-named item in items, falling back to the path recorded at
+// export time. The whole archive is read and decrypted before anything is
+// written, so a wrong passphrase leaves the router untouched.
+func Import(r io.Reader, items []Item, passphrase string) (Manifest, error) {
+	var m Manifest
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return m, fmt.Errorf("not a state archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	total := int64(0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if hdr.Size > maxEntrySize || total+hdr.Size > maxArchiveSize {
+			return m, fmt.Errorf("archive entry %s is too large", hdr.Name)
+		}
+		total += hdr.Size
+		data, err := io.ReadAll(io.LimitReader(tr, maxEntrySize))
+		if err != nil {
+			return m, err
+		}
+		files[hdr.Name] = data
+	}
+	raw, ok := files["manifest.json"]
+	if !ok {
+		return m, errors.New("not a state archive: manifest.json missing")
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return m, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Version != Version {
+		return m, fmt.Errorf("unsupported state archive version %d", m.Version)
+	}
+
+	current := map[string]Item{}
+	for _, it := range items {
+		current[it.Name] = it
+	}
+
+	var key []byte
+	type restore struct {
+		dst  string
+		data []byte
+		mode fs.FileMode
+	}
+	var plan []restore
+	for _, e := range m.Entries {
+		if e.Secret && key == nil {
+			if passphrase == "" || len(m.Salt) == 0 {
+				return m, fmt.Errorf("%s is encrypted: a passphrase is required", e.Name)
+			}
+			key = deriveKey(passphrase, m.Salt, m.Iterations)
+		}
+		base := e.Path
+		if it, ok := current[e.Name]; ok && it.Path != "" {
+			base = it.Path
+		}
+		if base == "" {
+			continue
+		}
+		for _, rel := range e.Files {
+			if !safeRel(rel) {
+				return m, fmt.Errorf("%s: unsafe path %q in archive", e.Name, rel)
+			}
+			name := entryName(e.Item, rel)
+			data, ok := files[name]
+			if !ok {
+				return m, fmt.Errorf("%s: %s missing from archive", e.Name, name)
+			}
+			mode := fs.FileMode(0o644)
+			if e.Secret {
+				if data, err = open(key, name, data); err != nil {
+					return m, err
+				}
+				mode = 0o600
+			}
+			dst := base
+			if e.Dir {
+				dst = filepath.Join(base, filepath.FromSlash(rel))
+			}
+			plan = append(plan, restore{dst: dst, data: data, mode: mode})
+		}
+	}
+
+	for _, f := range plan {
+		if err := writeAtomic(f.dst, f.data, f.mode); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+func safeRel(rel string) bool {
+	if rel == "" || strings.HasPrefix(rel, "/") || strings.Contains(rel, `\`) {
+		return false
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if part == ".." || part == "." || part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func writeAtomic(dst string, data []byte, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".import-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// seal encrypts data with AES-256-GCM, binding it to the entry name so
+// encrypted entries cannot be swapped inside an archive.
+func seal(key []byte, name string, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+func open(key []byte, name string, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrPassphrase
+	}
+	out, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	return out, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey is PBKDF2-HMAC-SHA256 (RFC 8018) producing a 32-byte key.
+func deriveKey(passphrase string, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, []byte(passphrase))
+	prf.Write(salt)
+	prf.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := prf.Sum(nil)
+	out := bytes.Clone(u)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
@@ -0,0 +1,147 @@
+package state
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func init() { kdfIterations = 10 }
+
+func fixture(t *testing.T) (string, []Item) {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(rel, content string) {
+		p := filepath.Join(dir, rel)
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("config.json", `{"denylist": ["^rm"]}`)
+	write("lucicodex.log", `{"event":"plan"}`+"\n")
+	write("metrics/2026-10-15.json", `{}`)
+	write("metrics/sub/2026-10-16.json", `{}`)
+	write("tokens.json", `{"gemini": {"access_token": "secret"}}`)
+	return dir, []Item{
+		{Name: "config", Path: filepath.Join(dir, "config.json")},
+		{Name: "history", Path: filepath.Join(dir, "lucicodex.log")},
+		{Name: "metrics", Path: filepath.Join(dir, "metrics"), Dir: true},
+		{Name: "tokens", Path: filepath.Join(dir, "tokens.json"), Secret: true},
+		{Name: "facts-key", Path: filepath.Join(dir, "missing.key"), Secret: true},
+	}
+}
+
+// relocate points items at a fresh directory, as on a replacement router.
+func relocate(t *testing.T, items []Item) (string, []Item) {
+	dir := t.TempDir()
+	out := make([]Item, len(items))
+	for i, it := range items {
+		it.Path = filepath.Join(dir, filepath.Base(it.Path))
+		out[i] = it
+	}
+	return dir, out
+}
+
+func TestExportImport_RoundTrip(t *testing.T) {
+	_, items := fixture(t)
+	var buf bytes.Buffer
+	m, err := Export(&buf, items, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Entries) != 4 || len(m.Skipped) != 0 {
+		t.Fatalf("entries=%d skipped=%v", len(m.Entries), m.Skipped)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("secret")) {
+		t.Error("archive should not be readable as plain text")
+	}
+
+	dir, target := relocate(t, items)
+	if _, err := Import(bytes.NewReader(buf.Bytes()), target, "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range map[string]string{
+		"config.json":                 `{"denylist": ["^rm"]}`,
+		"metrics/sub/2026-10-16.json": `{}`,
+		"tokens.json":                 `{"gemini": {"access_token": "secret"}}`,
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, rel))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v", rel, got, err)
+		}
+	}
+	if st, _ := os.Stat(filepath.Join(dir, "tokens.json")); st.Mode().Perm() != 0o600 {
+		t.Errorf("tokens restored with mode %v", st.Mode().Perm())
+	}
+}
+
+func TestImport_WrongPassphraseWritesNothing(t *testing.T) {
+	_, items := fixture(t)
+	var buf bytes.Buffer
+	if _, err := Export(&buf, items, "right"); err != nil {
+		t.Fatal(err)
+	}
+	dir, target := relocate(t, items)
+	if _, err := Import(bytes.NewReader(buf.Bytes()), target, "wrong"); !errors.Is(err, ErrPassphrase) {
+		t.Fatalf("expected ErrPassphrase, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("files written despite failed import: %v", entries)
+	}
+	if _, err := Import(bytes.NewReader(buf.Bytes()), target, ""); err == nil {
+		t.Error("encrypted archive imported without a passphrase")
+	}
+}
+
+func TestExport_NoPassphraseSkipsSecrets(t *testing.T) {
+	_, items := fixture(t)
+	var buf bytes.Buffer
+	m, err := Export(&buf, items, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Skipped) != 1 || m.Skipped[0] != "tokens" {
+		t.Errorf("skipped = %v", m.Skipped)
+	}
+	dir, target := relocate(t, items)
+	if _, err := Import(&buf, target, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tokens.json")); !os.IsNotExist(err) {
+		t.Error("tokens restored from an archive that should not contain them")
+	}
+}
+
+func TestImport_RejectsUnsafePaths(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	manifest, _ := json.Marshal(Manifest{Version: Version, Entries: []Entry{{
+		Item: Item{Name: "metrics", Path: "/tmp/m", Dir: true}, Files: []string{"../../etc/passwd"},
+	}}})
+	tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0o644, Size: int64(len(manifest))})
+	tw.Write(manifest)
+	tw.Close()
+	gz.Close()
+
+	_, target := relocate(t, []Item{{Name: "metrics", Path: "/tmp/m", Dir: true}})
+	if _, err := Import(&buf, target, ""); err == nil {
+		t.Fatal("path traversal accepted")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	// RFC 7914 section 11 PBKDF2-HMAC-SHA256 test vector (first 32 bytes)
+	got := deriveKey("passwd", []byte("salt"), 1)
+	want := []byte{0x55, 0xac, 0x04, 0x6e, 0x56, 0xe3, 0x08, 0x9f, 0xec, 0x16, 0x91, 0xc2, 0x25, 0x44, 0xb6, 0x05,
+		0xf9, 0x41, 0x85, 0x21, 0x6d, 0xde, 0x04, 0x65, 0xe6, 0x8b, 0x9d, 0x57, 0xc2, 0x0d, 0xac, 0xbc}
+	if !bytes.Equal(got, want) {
+		t.Errorf("deriveKey = %x", got)
+	}
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileStore keeps each document in its own file, Dir/ns/key. Writes go to
+// a temporary file that is synced and renamed over the document, and the
+// previous version is kept as .key.bak. A document that fails to decode is
+// renamed to .key.corrupt and the backup, if it decodes, takes its place.
+type FileStore struct {
+	Dir string
+
+	mu sync.Mutex // serializes Updates within the process; flock across processes
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{Dir: dir}
+}
+
+// path returns the file of a document, rejecting keys and namespaces that
+// would escape Dir.
+func (s *FileStore) path(ns, key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, ".") || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	dir, err := s.nsDir(ns)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, key), nil
+}
+
+func (s *FileStore) nsDir(ns string) (string, error) {
+	if ns == "" {
+		return s.Dir, nil
+	}
+	for _, part := range strings.Split(ns, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.Contains(part, `\`) {
+			return "", fmt.Errorf("invalid storage namespace %q", ns)
+		}
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(ns)), nil
+}
+
+// Get reads the document into v.
+func (s *FileStore) Get(ns, key string, v interface{}) error {
+	p, err := s.path(ns, key)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return s.recover(p, v, err)
+	}
+	return nil
+}
+
+// recover sets a corrupt document aside and restores its backup into v and
+// on disk. Without a usable backup it reports ErrCorrupt.
+func (s *FileStore) recover(p string, v interface{}, decodeErr error) error {
+	dir, name := filepath.Split(p)
+	quarantine := filepath.Join(dir, "."+name+".corrupt")
+	if err := os.Rename(p, quarantine); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrCorrupt, p, decodeErr)
+	}
+	if data, err := os.ReadFile(backupPath(p)); err == nil && json.Unmarshal(data, v) == nil {
+		if err := writeFile(p, data); err != nil {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s (moved to %s): %v", ErrCorrupt, p, quarantine, decodeErr)
+}
+
+func backupPath(p string) string {
+	dir, name := filepath.Split(p)
+	return filepath.Join(dir, "."+name+".bak")
+}
+
+// Put writes the document with mode 0600, creating its directory.
+func (s *FileStore) Put(ns, key string, v interface{}) error {
+	p, err := s.path(ns, key)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", key, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	// The previous version is the fallback for a document found corrupt
+	_ = os.Remove(backupPath(p))
+	_ = os.Link(p, backupPath(p))
+	return writeFile(p, append(data, '\n'))
+}
+
+// writeFile replaces p atomically and durably: a reader sees either the
+// old or the new content, also after a power loss.
+func writeFile(p string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(p)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// List returns the documents of a namespace. Subdirectories and dot files
+// are not documents.
+func (s *FileStore) List(ns string) ([]string, error) {
+	dir, err := s.nsDir(ns)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			keys = append(keys, e.Name())
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the document and its backup.
+func (s *FileStore) Delete(ns, key string) error {
+	p, err := s.path(ns, key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	_ = os.Remove(backupPath(p))
+	return nil
+}
+
+// Update runs fn on the document while holding the namespace lock, an
+// flock on Dir/ns/.lock shared with other processes.
+func (s *FileStore) Update(ns, key string, v interface{}, fn func() error) error {
+	dir, err := s.nsDir(ns)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	if err := s.Get(ns, key, v); err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return s.Put(ns, key, v)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package storage
+
+import "os"
+
+// lockFile is only implemented on Unix (flock). Elsewhere Updates are
+// serialized within the process only.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
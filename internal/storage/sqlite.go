@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+// ErrNoSQLite is returned by every operation of a SQLiteStore in a build
+// without config.SQLiteDriver. Config validation refuses the sqlite backend
+// in such a build, so only stores opened directly see it.
+var ErrNoSQLite = errors.New("the sqlite storage backend is not available in this build")
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS documents (
+	ns    TEXT NOT NULL,
+	key   TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (ns, key)
+)`
+
+// SQLiteStore keeps documents as rows of one table in the database at
+// Path. The database is opened on first use with a single connection, full
+// sync and a busy timeout, so other processes wait for an Update instead of
+// failing. A row that does not decode is deleted and reported as ErrCorrupt.
+type SQLiteStore struct {
+	Path string
+
+	once sync.Once
+	db   *sql.DB
+	err  error
+}
+
+func NewSQLiteStore(path string) *SQLiteStore {
+	return &SQLiteStore{Path: path}
+}
+
+func (s *SQLiteStore) open() (*sql.DB, error) {
+	s.once.Do(func() {
+		if !driverRegistered(config.SQLiteDriver) {
+			s.err = ErrNoSQLite
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(s.Path), 0o700); err != nil {
+			s.err = err
+			return
+		}
+		db, err := sql.Open(config.SQLiteDriver, s.Path)
+		if err != nil {
+			s.err = err
+			return
+		}
+		db.SetMaxOpenConns(1)
+		for _, stmt := range []string{"PRAGMA busy_timeout = 5000", "PRAGMA synchronous = FULL", sqliteSchema} {
+			if _, err := db.Exec(stmt); err != nil {
+				db.Close()
+				s.err = fmt.Errorf("open %s: %w", s.Path, err)
+				return
+			}
+		}
+		os.Chmod(s.Path, 0o600)
+		s.db = db
+	})
+	return s.db, s.err
+}
+
+func driverRegistered(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// queryer is what Get needs of a *sql.DB or *sql.Tx.
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLiteStore) Get(ns, key string, v interface{}) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return get(db, ns, key, v)
+}
+
+func get(q queryer, ns, key string, v interface{}) error {
+	var value string
+	err := q.QueryRow(`SELECT value FROM documents WHERE ns = ? AND key = ?`, ns, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		q.Exec(`DELETE FROM documents WHERE ns = ? AND key = ?`, ns, key)
+		return fmt.Errorf("%w: %s/%s: %v", ErrCorrupt, ns, key, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Put(ns, key string, v interface{}) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return put(db, ns, key, v)
+}
+
+func put(q queryer, ns, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", key, err)
+	}
+	_, err = q.Exec(`INSERT OR REPLACE INTO documents (ns, key, value) VALUES (?, ?, ?)`, ns, key, string(data))
+	return err
+}
+
+func (s *SQLiteStore) List(ns string) ([]string, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT key FROM documents WHERE ns = ? ORDER BY key`, ns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteStore) Delete(ns, key string) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM documents WHERE ns = ? AND key = ?`, ns, key)
+	return err
+}
+
+// Update runs fn inside a transaction.
+func (s *SQLiteStore) Update(ns, key string, v interface{}, fn func() error) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := get(tx, ns, key, v); err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	if err := put(tx, ns, key, v); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
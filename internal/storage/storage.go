@@ -0,0 +1,99 @@
+// Package storage is the persistence layer shared by the subsystems that
+// keep state between runs: API tokens, metrics rollups, job records, plan
+// templates and the execution history. A Store holds JSON documents by
+// namespace and key. The file backend keeps one file per document in the
+// subsystem's own directory, so the layout on disk is what it always was;
+// the SQLite backend keeps everything in one database. Both write durably,
+// serialize read-modify-write updates across processes, and recover from
+// corrupt documents instead of failing forever.
+package storage
+
+import (
+	"errors"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+// Backends selectable with config.StorageBackend.
+const (
+	BackendFile   = "file"
+	BackendSQLite = "sqlite"
+)
+
+var (
+	// ErrNotFound is returned by Get for a missing document.
+	ErrNotFound = errors.New("not found")
+	// ErrCorrupt is returned by Get for a document that could not be
+	// decoded. The document has been set aside, so the next Get reports
+	// ErrNotFound and the next Put starts over.
+	ErrCorrupt = errors.New("corrupt document")
+)
+
+// Store keeps JSON documents by namespace and key. The empty namespace is
+// valid. Keys are plain names such as "api_tokens.json"; they may not
+// contain slashes or start with a dot.
+type Store interface {
+	// Get decodes the document into v.
+	Get(ns, key string, v interface{}) error
+	// Put encodes v and replaces the document.
+	Put(ns, key string, v interface{}) error
+	// List returns the keys of a namespace in order.
+	List(ns string) ([]string, error)
+	// Delete removes the document. Deleting a missing one is not an error.
+	Delete(ns, key string) error
+	// Update decodes the document into v, leaving v as is when it is
+	// missing, calls fn and stores v unless fn fails. No other Update of
+	// the namespace, in this or another process, runs in between.
+	Update(ns, key string, v interface{}, fn func() error) error
+}
+
+var (
+	storesMu sync.Mutex
+	files    = map[string]*FileStore{}
+	sqlites  = map[string]*SQLiteStore{}
+)
+
+// Open returns the process-wide store of a subsystem whose files live in
+// dir: a FileStore for dir, or, with the sqlite backend, the database at
+// cfg.StoragePath with the subsystem's namespaces kept apart under dir.
+func Open(cfg config.Config, dir string) Store {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if cfg.StorageBackend == BackendSQLite {
+		db, ok := sqlites[cfg.StoragePath]
+		if !ok {
+			db = NewSQLiteStore(cfg.StoragePath)
+			sqlites[cfg.StoragePath] = db
+		}
+		return Sub(db, filepath.Clean(dir))
+	}
+	fs, ok := files[dir]
+	if !ok {
+		fs = NewFileStore(dir)
+		files[dir] = fs
+	}
+	return fs
+}
+
+// Sub returns a view of st whose namespaces are under prefix.
+func Sub(st Store, prefix string) Store {
+	return sub{st: st, prefix: prefix}
+}
+
+type sub struct {
+	st     Store
+	prefix string
+}
+
+func (s sub) ns(ns string) string { return path.Join(s.prefix, ns) }
+
+func (s sub) Get(ns, key string, v interface{}) error { return s.st.Get(s.ns(ns), key, v) }
+func (s sub) Put(ns, key string, v interface{}) error { return s.st.Put(s.ns(ns), key, v) }
+func (s sub) List(ns string) ([]string, error)        { return s.st.List(s.ns(ns)) }
+func (s sub) Delete(ns, key string) error             { return s.st.Delete(s.ns(ns), key) }
+func (s sub) Update(ns, key string, v interface{}, fn func() error) error {
+	return s.st.Update(s.ns(ns), key, v, fn)
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+type doc struct {
+	N int `json:"n"`
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStore(dir)
+
+	var d doc
+	if err := s.Get("", "a.json", &d); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.Put("", "a.json", doc{N: 1}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Put("", "b.json", doc{N: 2}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Put("sub", "c.json", doc{N: 3}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Get("", "a.json", &d); err != nil || d.N != 1 {
+		t.Fatalf("Get = %+v, %v", d, err)
+	}
+	if st, _ := os.Stat(filepath.Join(dir, "a.json")); st.Mode().Perm() != 0o600 {
+		t.Errorf("expected mode 0600, got %v", st.Mode().Perm())
+	}
+
+	keys, err := s.List("")
+	if err != nil || !reflect.DeepEqual(keys, []string{"a.json", "b.json"}) {
+		t.Errorf("List = %v, %v", keys, err)
+	}
+	if keys, _ := s.List("missing"); len(keys) != 0 {
+		t.Errorf("expected empty namespace, got %v", keys)
+	}
+
+	if err := s.Delete("", "a.json"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := s.Delete("", "a.json"); err != nil {
+		t.Errorf("deleting a missing document: %v", err)
+	}
+	if err := s.Get("", "a.json", &d); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after Delete, got %v", err)
+	}
+
+	for _, key := range []string{"", ".lock", "../x", "a/b"} {
+		if err := s.Put("", key, doc{}); err == nil {
+			t.Errorf("key %q accepted", key)
+		}
+	}
+	if err := s.Put("../up", "x", doc{}); err == nil {
+		t.Error("namespace escaping the directory accepted")
+	}
+}
+
+func TestFileStore_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFileStore(dir)
+	path := filepath.Join(dir, "a.json")
+
+	// A torn write is replaced by the previous version
+	s.Put("", "a.json", doc{N: 1})
+	s.Put("", "a.json", doc{N: 2})
+	os.WriteFile(path, []byte(`{"n": `), 0o600)
+	var d doc
+	if err := s.Get("", "a.json", &d); err != nil || d.N != 1 {
+		t.Fatalf("expected the backup, got %+v, %v", d, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".a.json.corrupt")); err != nil {
+		t.Errorf("corrupt document not kept: %v", err)
+	}
+	if err := s.Get("", "a.json", &d); err != nil || d.N != 1 {
+		t.Errorf("backup not restored: %+v, %v", d, err)
+	}
+
+	// Without a backup the document is reported once and then missing
+	os.WriteFile(filepath.Join(dir, "b.json"), []byte("garbage"), 0o600)
+	if err := s.Get("", "b.json", &d); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if err := s.Get("", "b.json", &d); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after recovery, got %v", err)
+	}
+	if err := s.Update("", "b.json", &d, func() error { d.N = 5; return nil }); err != nil {
+		t.Errorf("Update after recovery: %v", err)
+	}
+}
+
+func TestFileStore_Update(t *testing.T) {
+	dir := t.TempDir()
+	// Separate stores, like separate processes, share the lock file
+	stores := []*FileStore{NewFileStore(dir), NewFileStore(dir)}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(s *FileStore) {
+			defer wg.Done()
+			var d doc
+			if err := s.Update("", "counter.json", &d, func() error { d.N++; return nil }); err != nil {
+				t.Error(err)
+			}
+		}(stores[i%2])
+	}
+	wg.Wait()
+	var d doc
+	if err := stores[0].Get("", "counter.json", &d); err != nil || d.N != 20 {
+		t.Errorf("expected 20 updates, got %+v, %v", d, err)
+	}
+
+	failed := errors.New("no")
+	if err := stores[0].Update("", "counter.json", &d, func() error { d.N = 0; return failed }); !errors.Is(err, failed) {
+		t.Errorf("expected fn error, got %v", err)
+	}
+	stores[0].Get("", "counter.json", &d)
+	if d.N != 20 {
+		t.Errorf("failed update was stored: %+v", d)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{StorageBackend: BackendFile}
+	if Open(cfg, dir) != Open(cfg, dir) {
+		t.Error("expected the same store for the same dir")
+	}
+
+	cfg = config.Config{StorageBackend: BackendSQLite, StoragePath: filepath.Join(dir, "state.db")}
+	st := Open(cfg, dir)
+	if err := st.Put("", "a.json", doc{}); !errors.Is(err, ErrNoSQLite) {
+		t.Errorf("expected ErrNoSQLite without a driver, got %v", err)
+	}
+}
+
+func TestSub(t *testing.T) {
+	s := NewFileStore(t.TempDir())
+	a, b := Sub(s, "a"), Sub(s, "b")
+	a.Put("", "x.json", doc{N: 1})
+	b.Put("", "x.json", doc{N: 2})
+	var d doc
+	if err := s.Get("a", "x.json", &d); err != nil || d.N != 1 {
+		t.Errorf("Get(a) = %+v, %v", d, err)
+	}
+	if err := b.Get("", "x.json", &d); err != nil || d.N != 2 {
+		t.Errorf("Get(b) = %+v, %v", d, err)
+	}
+}
@@ -0,0 +1,162 @@
+// Package support builds the support bundle of `lucicodex support-bundle`:
+// the configuration, recent history, metrics, the last LLM exchange, version
+// information and router facts, redacted and packed into one archive that
+// can be attached to a bug report.
+package support
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/llm/llmdebug"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/metrics"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/redact"
+)
+
+// HistoryLimit is how many of the latest audit log entries are included.
+const HistoryLimit = 20
+
+// MetricsDays is the period of the included metrics summary.
+const MetricsDays = 7
+
+// collectFacts is openwrt.CollectSystemFacts; tests replace it.
+var collectFacts = openwrt.CollectSystemFacts
+
+// File is one file of the bundle.
+type File struct {
+	Name       string `json:"name"`
+	Data       []byte `json:"-"`
+	Redactions int    `json:"redactions"` // Values replaced by redact.Marker
+}
+
+// Collect gathers the files of a bundle for cfg. Sources that are disabled
+// or unreadable are left out and noted in errors.txt, so a bundle can be
+// built from a broken installation.
+func Collect(ctx context.Context, cfg config.Config, version string) []File {
+	var files []File
+	var errs []string
+	add := func(name string, v interface{}, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			return
+		}
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			return
+		}
+		text := redact.String(string(data))
+		files = append(files, File{Name: name, Data: []byte(text + "\n"), Redactions: strings.Count(text, redact.Marker)})
+	}
+
+	add("version.json", map[string]string{
+		"version": version,
+		"go":      runtime.Version(),
+		"os":      runtime.GOOS,
+		"arch":    runtime.GOARCH,
+		"created": time.Now().UTC().Format(time.RFC3339),
+	}, nil)
+	add("config.json", redactConfig(cfg), nil)
+
+	if cfg.LogFile == "" {
+		errs = append(errs, "history.json: audit log disabled (log_file not set)")
+	} else {
+		entries, err := logging.History(cfg)
+		if len(entries) > HistoryLimit {
+			entries = entries[len(entries)-HistoryLimit:]
+		}
+		add("history.json", entries, err)
+	}
+
+	if store := metrics.OpenRollupStore(cfg); store == nil {
+		errs = append(errs, "metrics.json: metrics persistence disabled (metrics_dir not set)")
+	} else {
+		rollups, err := store.Days(MetricsDays)
+		add("metrics.json", metrics.Summarize(rollups), err)
+	}
+
+	dir := cfg.DebugDir
+	if dir == "" {
+		dir = llmdebug.DefaultDir
+	}
+	ex, err := llmdebug.Last(dir)
+	add("llm-debug.json", ex, err)
+
+	// Addresses, hostnames and SSIDs identify the network
+	add("facts.json", collectFacts(ctx).Redact(openwrt.RedactableFields), nil)
+
+	if len(errs) > 0 {
+		files = append(files, File{Name: "errors.txt", Data: []byte(strings.Join(errs, "\n") + "\n")})
+	}
+	return files
+}
+
+// redactConfig returns cfg without its secrets. Webhook URLs often carry a
+// token in their path, so only their host is kept.
+func redactConfig(cfg config.Config) config.Config {
+	for _, s := range []*string{&cfg.APIKey, &cfg.OpenAIAPIKey, &cfg.AnthropicAPIKey, &cfg.OAuthClientSecret} {
+		if *s != "" {
+			*s = redact.Marker
+		}
+	}
+	cfg.WatchWebhooks = redactURLs(cfg.WatchWebhooks)
+	cfg.DigestWebhooks = redactURLs(cfg.DigestWebhooks)
+	// Values may hold proxy credentials
+	env := make([]string, len(cfg.CommandEnv))
+	for i, entry := range cfg.CommandEnv {
+		name, _, _ := strings.Cut(entry, "=")
+		env[i] = name + "=" + redact.Marker
+	}
+	cfg.CommandEnv = env
+	return cfg
+}
+
+func redactURLs(urls []string) []string {
+	out := make([]string, len(urls))
+	for i, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			out[i] = redact.Marker
+			continue
+		}
+		out[i] = u.Scheme + "://" + u.Host + "/" + redact.Marker
+	}
+	return out
+}
+
+// WriteArchive writes files to w as a gzipped tar archive under the
+// directory prefix.
+func WriteArchive(w io.Writer, prefix string, files []File) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    prefix + "/" + f.Name,
+			Mode:    0600,
+			Size:    int64(len(f.Data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
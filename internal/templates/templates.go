@@ -0,0 +1,390 @@
+// Package templates stores approved plans with typed placeholders, such as
+// {{mac}} or {{iface}}, so they can be run again for other values without
+// the model: `lucicodex template save` turns an execution from the log
+// into a template, `lucicodex run-plan` fills it in and runs it.
+//
+// Every value is checked against the format of its parameter's type before
+// it is substituted, and the resulting plan goes through the policy like
+// any other.
+package templates
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/storage"
+)
+
+// Version is the template format written by this build.
+const Version = 1
+
+// Parameter types and the values they accept.
+const (
+	TypeMAC      = "mac"      // aa:bb:cc:dd:ee:ff
+	TypeIface    = "iface"    // Interface, device or UCI section name, e.g. lan or br-lan
+	TypeIP       = "ip"       // IPv4 or IPv6 address
+	TypeIPv4     = "ipv4"     // IPv4 address
+	TypeIPv6     = "ipv6"     // IPv6 address
+	TypeCIDR     = "cidr"     // Network in CIDR notation, e.g. 192.168.1.0/24
+	TypeHostname = "hostname" // DNS name
+	TypePort     = "port"     // 1 to 65535
+	TypeInt      = "int"      // Decimal integer
+	TypeString   = "string"   // Any text without control or shell characters
+)
+
+// Types lists the parameter types in the order they are documented.
+var Types = []string{TypeMAC, TypeIface, TypeIP, TypeIPv4, TypeIPv6, TypeCIDR, TypeHostname, TypePort, TypeInt, TypeString}
+
+var (
+	nameRe        = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	paramRe       = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+	placeholderRe = regexp.MustCompile(`\{\{\s*([a-z][a-z0-9_]*)\s*\}\}`)
+	macRe         = regexp.MustCompile(`^[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){5}$`)
+	ifaceRe       = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.@-]{0,14}$`)
+	labelRe       = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+)
+
+// Template is an approved plan whose commands contain placeholders.
+type Template struct {
+	Version int       `json:"version"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Prompt  string    `json:"prompt,omitempty"` // Request the plan was approved for, with placeholders
+	Source  string    `json:"source,omitempty"` // Execution ID the template was made from
+	Params  []Param   `json:"params"`
+	Plan    plan.Plan `json:"plan"`
+}
+
+// Param is a placeholder of a template.
+type Param struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Binding gives a parameter its value.
+type Binding struct {
+	Param
+	Value string
+}
+
+// ParseBinding parses "name=value" or "name:type=value". Without a type,
+// the name is the type, as in "mac=aa:bb:cc:dd:ee:ff".
+func ParseBinding(s string) (Binding, error) {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return Binding{}, errcode.Errorf(errcode.InvalidRequest, "parameter %q is not name=value", s)
+	}
+	name, typ, typed := strings.Cut(name, ":")
+	if !typed {
+		typ = name
+	}
+	b := Binding{Param{Name: name, Type: typ}, value}
+	return b, b.Param.check()
+}
+
+func (p Param) check() error {
+	if !paramRe.MatchString(p.Name) {
+		return errcode.Errorf(errcode.InvalidRequest, "invalid parameter name %q", p.Name)
+	}
+	for _, t := range Types {
+		if p.Type == t {
+			return nil
+		}
+	}
+	return errcode.Errorf(errcode.InvalidRequest, "parameter %s has unknown type %q (one of %s)", p.Name, p.Type, strings.Join(Types, ", "))
+}
+
+// CheckValue reports whether value is in the format of type typ.
+func CheckValue(typ, value string) error {
+	ok := false
+	switch typ {
+	case TypeMAC:
+		ok = macRe.MatchString(value)
+	case TypeIface:
+		ok = ifaceRe.MatchString(value)
+	case TypeIP:
+		ok = net.ParseIP(value) != nil
+	case TypeIPv4:
+		ip := net.ParseIP(value)
+		ok = ip != nil && ip.To4() != nil && !strings.Contains(value, ":")
+	case TypeIPv6:
+		ok = net.ParseIP(value) != nil && strings.Contains(value, ":")
+	case TypeCIDR:
+		_, _, err := net.ParseCIDR(value)
+		ok = err == nil
+	case TypeHostname:
+		ok = len(value) <= 253
+		for _, l := range strings.Split(strings.TrimSuffix(value, "."), ".") {
+			ok = ok && labelRe.MatchString(l)
+		}
+	case TypePort:
+		n, err := strconv.Atoi(value)
+		ok = err == nil && n >= 1 && n <= 65535
+	case TypeInt:
+		_, err := strconv.ParseInt(value, 10, 64)
+		ok = err == nil
+	case TypeString:
+		ok = value != "" && !strings.ContainsAny(value, ";&|$`<>\\'\"")
+		for _, r := range value {
+			ok = ok && r >= 0x20 && r != 0x7f
+		}
+	default:
+		return errcode.Errorf(errcode.InvalidRequest, "unknown parameter type %q", typ)
+	}
+	if !ok {
+		return errcode.Errorf(errcode.InvalidRequest, "%q is not a valid %s", value, typ)
+	}
+	return nil
+}
+
+// New makes a template named name from an approved plan, replacing every
+// occurrence of each bound value with the placeholder of its parameter.
+// Each value must be valid for its type and occur in the commands.
+func New(name, prompt string, p plan.Plan, bindings []Binding) (Template, error) {
+	if !nameRe.MatchString(name) {
+		return Template{}, errcode.Errorf(errcode.InvalidRequest, "invalid template name %q (lowercase letters, digits, - and _)", name)
+	}
+	if len(p.Commands) == 0 {
+		return Template{}, errcode.Wrap(errcode.InvalidRequest, errors.New("the plan has no commands"))
+	}
+	t := Template{
+		Version: Version,
+		Name:    name,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Prompt:  prompt,
+		Plan: plan.Plan{
+			Version:  plan.SchemaVersion,
+			Summary:  p.Summary,
+			Commands: p.Commands,
+			Verify:   p.Verify,
+		},
+	}
+	// Longest values first, so a value that contains another is replaced whole
+	bindings = append([]Binding(nil), bindings...)
+	sort.SliceStable(bindings, func(i, j int) bool { return len(bindings[i].Value) > len(bindings[j].Value) })
+	seen := map[string]bool{}
+	for _, b := range bindings {
+		if err := b.Param.check(); err != nil {
+			return Template{}, err
+		}
+		if seen[b.Name] {
+			return Template{}, errcode.Errorf(errcode.InvalidRequest, "parameter %s given twice", b.Name)
+		}
+		seen[b.Name] = true
+		if err := CheckValue(b.Type, b.Value); err != nil {
+			return Template{}, fmt.Errorf("parameter %s: %w", b.Name, err)
+		}
+		placeholder := "{{" + b.Name + "}}"
+		found := false
+		t.Plan = mapPlan(t.Plan, func(s string, _ bool) string {
+			if strings.Contains(s, b.Value) {
+				found = true
+				return strings.ReplaceAll(s, b.Value, placeholder)
+			}
+			return s
+		})
+		if !found {
+			return Template{}, errcode.Errorf(errcode.InvalidRequest, "parameter %s: %q does not occur in the commands", b.Name, b.Value)
+		}
+		t.Prompt = strings.ReplaceAll(t.Prompt, b.Value, placeholder)
+		t.Params = append(t.Params, b.Param)
+	}
+	sort.Slice(t.Params, func(i, j int) bool { return t.Params[i].Name < t.Params[j].Name })
+	return t, t.check()
+}
+
+// check reports placeholders without a declared parameter.
+func (t Template) check() error {
+	declared := map[string]bool{}
+	for _, p := range t.Params {
+		if err := p.check(); err != nil {
+			return err
+		}
+		declared[p.Name] = true
+	}
+	var err error
+	mapPlan(t.Plan, func(s string, _ bool) string {
+		for _, m := range placeholderRe.FindAllStringSubmatch(s, -1) {
+			if !declared[m[1]] && err == nil {
+				err = errcode.Errorf(errcode.InvalidRequest, "template %s uses undeclared parameter {{%s}}", t.Name, m[1])
+			}
+		}
+		return s
+	})
+	return err
+}
+
+// Instantiate returns the plan of t with values substituted for its
+// placeholders, and the prompt likewise. Every parameter must be given a
+// value valid for its type, and no other values are accepted.
+func (t Template) Instantiate(values map[string]string) (plan.Plan, string, error) {
+	types := map[string]string{}
+	for _, p := range t.Params {
+		types[p.Name] = p.Type
+		v, ok := values[p.Name]
+		if !ok {
+			return plan.Plan{}, "", errcode.Errorf(errcode.InvalidRequest, "missing parameter --%s (%s)", p.Name, p.Type)
+		}
+		if err := CheckValue(p.Type, v); err != nil {
+			return plan.Plan{}, "", fmt.Errorf("parameter %s: %w", p.Name, err)
+		}
+	}
+	for name := range values {
+		if _, ok := types[name]; !ok {
+			return plan.Plan{}, "", errcode.Errorf(errcode.InvalidRequest, "template %s has no parameter %s", t.Name, name)
+		}
+	}
+	fill := func(s string, regex bool) string {
+		return placeholderRe.ReplaceAllStringFunc(s, func(m string) string {
+			v := values[placeholderRe.FindStringSubmatch(m)[1]]
+			if regex {
+				return regexp.QuoteMeta(v)
+			}
+			return v
+		})
+	}
+	return mapPlan(t.Plan, fill), fill(t.Prompt, false), nil
+}
+
+// mapPlan returns a copy of p with f applied to the summary and to every
+// argument, description, file content and expected output of its commands.
+// regex is set for Expect.Regex.
+func mapPlan(p plan.Plan, f func(s string, regex bool) string) plan.Plan {
+	mapCmds := func(cmds []plan.PlannedCommand) []plan.PlannedCommand {
+		if cmds == nil {
+			return nil
+		}
+		out := make([]plan.PlannedCommand, len(cmds))
+		for i, c := range cmds {
+			c.Command = mapArgv(c.Command, f)
+			if c.Pipe != nil {
+				pipe := make([][]string, len(c.Pipe))
+				for j, argv := range c.Pipe {
+					pipe[j] = mapArgv(argv, f)
+				}
+				c.Pipe = pipe
+			}
+			c.Description = f(c.Description, false)
+			c.Content = f(c.Content, false)
+			if c.Expect != nil {
+				x := *c.Expect
+				x.Contains = f(x.Contains, false)
+				x.Regex = f(x.Regex, true)
+				x.Equals = f(x.Equals, false)
+				c.Expect = &x
+			}
+			out[i] = c
+		}
+		return out
+	}
+	p.Summary = f(p.Summary, false)
+	p.Commands = mapCmds(p.Commands)
+	p.Verify = mapCmds(p.Verify)
+	return p
+}
+
+func mapArgv(argv []string, f func(string, bool) string) []string {
+	out := make([]string, len(argv))
+	for i, a := range argv {
+		out[i] = f(a, false)
+	}
+	return out
+}
+
+// Store keeps templates as one document each under cfg.TemplatesDir.
+type Store struct {
+	st storage.Store
+}
+
+// Open returns the template store of cfg.
+func Open(cfg config.Config) *Store {
+	return &Store{st: storage.Open(cfg, cfg.TemplatesDir)}
+}
+
+func key(name string) string { return name + ".json" }
+
+// Save stores t, replacing a template of the same name.
+func (s *Store) Save(t Template) error {
+	if !nameRe.MatchString(t.Name) {
+		return errcode.Errorf(errcode.InvalidRequest, "invalid template name %q", t.Name)
+	}
+	return s.st.Put("", key(t.Name), t)
+}
+
+// Get loads a template. Plans of an older schema version are migrated;
+// newer template or plan versions are refused.
+func (s *Store) Get(name string) (Template, error) {
+	if !nameRe.MatchString(name) {
+		return Template{}, errcode.Errorf(errcode.InvalidRequest, "invalid template name %q", name)
+	}
+	var raw struct {
+		Template
+		Plan json.RawMessage `json:"plan"`
+	}
+	if err := s.st.Get("", key(name), &raw); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return Template{}, errcode.Errorf(errcode.NotFound, "no template %s", name)
+		}
+		return Template{}, err
+	}
+	t := raw.Template
+	if t.Version < 1 || t.Version > Version {
+		return Template{}, errcode.Errorf(errcode.InvalidRequest, "unsupported template version %d (this build supports up to %d)", t.Version, Version)
+	}
+	p, err := plan.Decode(raw.Plan)
+	if err != nil {
+		return Template{}, fmt.Errorf("template %s: %w", name, err)
+	}
+	// Computed locally before execution, never taken from the store
+	p.Facts = nil
+	p.PolicyWarnings = nil
+	p.PolicyTrace = nil
+	p.Estimate = nil
+	p.MissingTools = nil
+	p.Lint = nil
+	p.FileChanges = nil
+	t.Plan = p
+	return t, t.check()
+}
+
+// List returns the stored templates by name. Templates that cannot be
+// loaded are skipped.
+func (s *Store) List() ([]Template, error) {
+	keys, err := s.st.List("")
+	if err != nil {
+		return nil, err
+	}
+	var out []Template
+	for _, k := range keys {
+		name, ok := strings.CutSuffix(k, ".json")
+		if !ok {
+			continue
+		}
+		if t, err := s.Get(name); err == nil {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// Delete removes a template.
+func (s *Store) Delete(name string) error {
+	if !nameRe.MatchString(name) {
+		return errcode.Errorf(errcode.InvalidRequest, "invalid template name %q", name)
+	}
+	var raw json.RawMessage
+	if err := s.st.Get("", key(name), &raw); errors.Is(err, storage.ErrNotFound) {
+		return errcode.Errorf(errcode.NotFound, "no template %s", name)
+	}
+	return s.st.Delete("", key(name))
+}
@@ -0,0 +1,192 @@
+package templates
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestCheckValue(t *testing.T) {
+	tests := []struct {
+		typ, value string
+		ok         bool
+	}{
+		{TypeMAC, "aa:bb:cc:DD:ee:ff", true},
+		{TypeMAC, "aa-bb-cc-dd-ee-ff", false},
+		{TypeMAC, "aa:bb:cc:dd:ee", false},
+		{TypeIface, "br-lan", true},
+		{TypeIface, "eth0.2", true},
+		{TypeIface, "lan; reboot", false},
+		{TypeIface, "averyveryverylongname", false},
+		{TypeIP, "192.168.1.1", true},
+		{TypeIP, "fd00::1", true},
+		{TypeIPv4, "fd00::1", false},
+		{TypeIPv4, "::ffff:10.0.0.1", false},
+		{TypeIPv6, "10.0.0.1", false},
+		{TypeCIDR, "192.168.1.0/24", true},
+		{TypeCIDR, "192.168.1.0", false},
+		{TypeHostname, "router.lan", true},
+		{TypeHostname, "-bad.lan", false},
+		{TypePort, "8080", true},
+		{TypePort, "0", false},
+		{TypePort, "65536", false},
+		{TypeInt, "-3", true},
+		{TypeInt, "3.5", false},
+		{TypeString, "Guest WiFi", true},
+		{TypeString, "x; reboot", false},
+		{TypeString, "$(reboot)", false},
+		{TypeString, "a\nb", false},
+		{TypeString, "", false},
+	}
+	for _, tt := range tests {
+		err := CheckValue(tt.typ, tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckValue(%s, %q) = %v, want ok=%v", tt.typ, tt.value, err, tt.ok)
+		}
+		if err != nil && errcode.Of(err) != errcode.InvalidRequest {
+			t.Errorf("CheckValue(%s, %q): expected %s, got %s", tt.typ, tt.value, errcode.InvalidRequest, errcode.Of(err))
+		}
+	}
+	if err := CheckValue("url", "x"); err == nil {
+		t.Error("expected an unknown type to be rejected")
+	}
+}
+
+func TestParseBinding(t *testing.T) {
+	b, err := ParseBinding("mac=aa:bb:cc:dd:ee:ff")
+	if err != nil || b.Name != "mac" || b.Type != TypeMAC || b.Value != "aa:bb:cc:dd:ee:ff" {
+		t.Fatalf("unexpected binding %+v, %v", b, err)
+	}
+	b, err = ParseBinding("guest:iface=wlan1")
+	if err != nil || b.Name != "guest" || b.Type != TypeIface || b.Value != "wlan1" {
+		t.Fatalf("unexpected binding %+v, %v", b, err)
+	}
+	for _, s := range []string{"mac", "client=aa:bb:cc:dd:ee:ff", "x:url=y", "Bad:mac=aa:bb:cc:dd:ee:ff"} {
+		if _, err := ParseBinding(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func blockPlan() plan.Plan {
+	return plan.Plan{
+		Summary: "Block aa:bb:cc:dd:ee:ff on lan",
+		Commands: []plan.PlannedCommand{
+			{Command: []string{"uci", "add_list", "wireless.default_radio0.maclist=aa:bb:cc:dd:ee:ff"}},
+			{Command: []string{"uci", "commit", "wireless"}},
+			{Command: []string{"wifi", "reload"}},
+		},
+		Verify: []plan.PlannedCommand{
+			{Command: []string{"uci", "get", "wireless.default_radio0.maclist"}, Expect: &plan.Expect{Regex: "aa:bb:cc:dd:ee:ff"}},
+		},
+		PolicyWarnings: []plan.PolicyWarning{{Rule: "uci"}},
+	}
+}
+
+func TestNewInstantiate(t *testing.T) {
+	mac, _ := ParseBinding("mac=aa:bb:cc:dd:ee:ff")
+	tmpl, err := New("block-client", "block aa:bb:cc:dd:ee:ff", blockPlan(), []Binding{mac})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tmpl.Plan.Commands[0].Command[2]; got != "wireless.default_radio0.maclist={{mac}}" {
+		t.Fatalf("value not replaced: %q", got)
+	}
+	if tmpl.Prompt != "block {{mac}}" || len(tmpl.Params) != 1 || tmpl.Plan.PolicyWarnings != nil {
+		t.Fatalf("unexpected template %+v", tmpl)
+	}
+
+	p, prompt, err := tmpl.Instantiate(map[string]string{"mac": "11:22:33:44:55:66"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt != "block 11:22:33:44:55:66" || p.Summary != "Block 11:22:33:44:55:66 on lan" {
+		t.Errorf("unexpected prompt %q and summary %q", prompt, p.Summary)
+	}
+	if got := p.Commands[0].Command[2]; got != "wireless.default_radio0.maclist=11:22:33:44:55:66" {
+		t.Errorf("unexpected command %q", got)
+	}
+	if tmpl.Plan.Commands[0].Command[2] != "wireless.default_radio0.maclist={{mac}}" {
+		t.Error("Instantiate modified the template")
+	}
+
+	for _, values := range []map[string]string{
+		{},
+		{"mac": "11:22:33:44:55"},
+		{"mac": "11:22:33:44:55:66", "iface": "lan"},
+	} {
+		if _, _, err := tmpl.Instantiate(values); errcode.Of(err) != errcode.InvalidRequest {
+			t.Errorf("expected %v to be rejected, got %v", values, err)
+		}
+	}
+
+	missing, _ := ParseBinding("ip=10.0.0.1")
+	if _, err := New("block-client", "", blockPlan(), []Binding{missing}); err == nil || !strings.Contains(err.Error(), "does not occur") {
+		t.Errorf("expected a value not in the plan to be rejected, got %v", err)
+	}
+	if _, err := New("Block Client", "", blockPlan(), nil); err == nil {
+		t.Error("expected an invalid name to be rejected")
+	}
+}
+
+func TestInstantiate_QuotesRegex(t *testing.T) {
+	tmpl := Template{
+		Name:   "check",
+		Params: []Param{{Name: "host", Type: TypeHostname}},
+		Plan: plan.Plan{
+			Commands: []plan.PlannedCommand{{Command: []string{"nslookup", "{{ host }}"}}},
+			Verify:   []plan.PlannedCommand{{Command: []string{"nslookup", "{{host}}"}, Expect: &plan.Expect{Regex: "Name:\\s+{{host}}"}}},
+		},
+	}
+	p, _, err := tmpl.Instantiate(map[string]string{"host": "router.lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Commands[0].Command[1] != "router.lan" || p.Verify[0].Expect.Regex != `Name:\s+router\.lan` {
+		t.Errorf("unexpected plan %+v %+v", p.Commands[0], p.Verify[0].Expect)
+	}
+
+	tmpl.Params = nil
+	if err := tmpl.check(); err == nil || !strings.Contains(err.Error(), "undeclared parameter {{host}}") {
+		t.Errorf("expected the undeclared placeholder to be reported, got %v", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	store := Open(config.Config{TemplatesDir: t.TempDir()})
+	mac, _ := ParseBinding("mac=aa:bb:cc:dd:ee:ff")
+	tmpl, err := New("block-client", "block aa:bb:cc:dd:ee:ff", blockPlan(), []Binding{mac})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(tmpl); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get("block-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Plan.Commands) != 3 || got.Params[0] != (Param{Name: "mac", Type: TypeMAC}) || got.Plan.Verify[0].Expect == nil {
+		t.Fatalf("unexpected template %+v", got)
+	}
+	list, err := store.List()
+	if err != nil || len(list) != 1 || list[0].Name != "block-client" {
+		t.Fatalf("unexpected list %+v, %v", list, err)
+	}
+
+	if err := store.Delete("block-client"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("block-client"); errcode.Of(err) != errcode.NotFound {
+		t.Errorf("expected %s after delete, got %v", errcode.NotFound, err)
+	}
+	if err := store.Delete("block-client"); errcode.Of(err) != errcode.NotFound {
+		t.Errorf("expected %s deleting a missing template, got %v", errcode.NotFound, err)
+	}
+	if _, err := store.Get("../config"); errcode.Of(err) != errcode.InvalidRequest {
+		t.Errorf("expected a path to be rejected, got %v", err)
+	}
+}
@@ -1,7 +1,7 @@
 // Package testutil provides testing utilities and helpers for LuciCodex tests.
 //
 // This package includes:
-// - Mock HTTP servers for testing LLM providers
+// - Mock HTTP servers for testing LLM providers (see FakeProvider)
 // - Temporary file and config helpers
 // - Assertion utilities
 // - Default test configurations
@@ -0,0 +1,263 @@
+package testutil
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+// Wire formats understood by FakeProvider, named like config.Provider values.
+const (
+	WireGemini    = "gemini"
+	WireOpenAI    = "openai"
+	WireAnthropic = "anthropic"
+)
+
+// Faults a FakeResponse can induce.
+const (
+	FaultTruncate  = "truncate"  // Body cut off halfway, as if the connection dropped
+	FaultMalformed = "malformed" // Body is not valid JSON
+)
+
+// DefaultFakePlan is the model output returned when no response is scripted.
+const DefaultFakePlan = `{"summary": "Fake plan", "commands": [{"command": ["echo", "hello"], "description": "Say hello"}]}`
+
+// FakeResponse is one scripted reply of a FakeProvider.
+type FakeResponse struct {
+	Text    string `json:"text"`     // Model output; DefaultFakePlan if empty
+	Status  int    `json:"status"`   // HTTP status; 0 means 200
+	Fault   string `json:"fault"`    // FaultTruncate, FaultMalformed or empty
+	DelayMS int    `json:"delay_ms"` // Latency before replying
+	Tokens  int    `json:"tokens"`   // Reported token usage
+}
+
+// FakeRequest is a request received by a FakeProvider.
+type FakeRequest struct {
+	Wire string
+	Path string
+	Body string
+}
+
+// FakeProvider is an HTTP server speaking the Gemini, OpenAI and Anthropic
+// wire formats. Generation requests consume the scripted responses in order;
+// once they run out the last one repeats. Embedding requests always succeed
+// with small deterministic vectors.
+type FakeProvider struct {
+	mu        sync.Mutex
+	responses []FakeResponse
+	next      int
+	requests  []FakeRequest
+}
+
+// NewFakeProvider returns a FakeProvider scripted with responses.
+func NewFakeProvider(responses ...FakeResponse) *FakeProvider {
+	return &FakeProvider{responses: responses}
+}
+
+// MockProviderServer starts a FakeProvider scripted with responses.
+// The caller is responsible for closing the server
+func MockProviderServer(t TestingT, responses ...FakeResponse) (*httptest.Server, *FakeProvider) {
+	t.Helper()
+	f := NewFakeProvider(responses...)
+	return httptest.NewServer(f), f
+}
+
+// FakeProviderConfig points cfg at a FakeProvider listening on url, using the
+// wire format of provider.
+func FakeProviderConfig(cfg config.Config, provider, url string) config.Config {
+	cfg.Provider = provider
+	cfg.Endpoint = url
+	cfg.OpenAIEndpoint = url
+	cfg.AnthropicEndpoint = url
+	cfg.APIKey = "fake-key"
+	cfg.OpenAIAPIKey = "fake-key"
+	cfg.AnthropicAPIKey = "fake-key"
+	return cfg
+}
+
+// Push appends responses to the script.
+func (f *FakeProvider) Push(responses ...FakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, responses...)
+}
+
+// Requests returns the requests received so far.
+func (f *FakeProvider) Requests() []FakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeRequest(nil), f.requests...)
+}
+
+func (f *FakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	wire, embed := fakeWire(r.URL.Path)
+	f.mu.Lock()
+	f.requests = append(f.requests, FakeRequest{Wire: wire, Path: r.URL.Path, Body: string(body)})
+	f.mu.Unlock()
+
+	if wire == "" {
+		http.Error(w, `{"error": {"message": "unknown endpoint"}}`, http.StatusNotFound)
+		return
+	}
+	if embed {
+		writeFakeJSON(w, http.StatusOK, fakeEmbeddings(wire, body), "")
+		return
+	}
+
+	resp := f.nextResponse()
+	if resp.DelayMS > 0 {
+		select {
+		case <-time.After(time.Duration(resp.DelayMS) * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if resp.Status != 0 && resp.Status != http.StatusOK {
+		writeFakeJSON(w, resp.Status, fakeError(wire, resp.Status), resp.Fault)
+		return
+	}
+	text := resp.Text
+	if text == "" {
+		text = DefaultFakePlan
+	}
+	writeFakeJSON(w, http.StatusOK, fakeReply(wire, text, resp.Tokens), resp.Fault)
+}
+
+func (f *FakeProvider) nextResponse() FakeResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.responses) == 0 {
+		return FakeResponse{}
+	}
+	resp := f.responses[f.next]
+	if f.next < len(f.responses)-1 {
+		f.next++
+	}
+	return resp
+}
+
+// fakeWire identifies the wire format from the request path.
+func fakeWire(path string) (wire string, embed bool) {
+	switch {
+	case strings.HasSuffix(path, ":generateContent"):
+		return WireGemini, false
+	case strings.HasSuffix(path, ":batchEmbedContents"):
+		return WireGemini, true
+	case strings.HasSuffix(path, "/chat/completions"):
+		return WireOpenAI, false
+	case strings.HasSuffix(path, "/embeddings"):
+		return WireOpenAI, true
+	case strings.HasSuffix(path, "/messages"):
+		return WireAnthropic, false
+	}
+	return "", false
+}
+
+func fakeReply(wire, text string, tokens int) interface{} {
+	switch wire {
+	case WireOpenAI:
+		return map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{"message": map[string]string{"role": "assistant", "content": text}}},
+			"usage":   map[string]int{"total_tokens": tokens},
+		}
+	case WireAnthropic:
+		return map[string]interface{}{
+			"content": []interface{}{map[string]string{"type": "text", "text": text}},
+			"usage":   map[string]int{"input_tokens": tokens / 2, "output_tokens": tokens - tokens/2},
+		}
+	default:
+		return map[string]interface{}{
+			"candidates":    []interface{}{map[string]interface{}{"content": map[string]interface{}{"parts": []interface{}{map[string]string{"text": text}}}}},
+			"usageMetadata": map[string]int{"totalTokenCount": tokens},
+		}
+	}
+}
+
+func fakeError(wire string, status int) interface{} {
+	msg := "fake provider error " + strconv.Itoa(status)
+	if wire == WireAnthropic {
+		return map[string]interface{}{"type": "error", "error": map[string]string{"type": "api_error", "message": msg}}
+	}
+	return map[string]interface{}{"error": map[string]interface{}{"code": status, "message": msg}}
+}
+
+// fakeEmbeddings returns one vector per input text, derived from its hash.
+func fakeEmbeddings(wire string, body []byte) interface{} {
+	var texts []string
+	if wire == WireOpenAI {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.Unmarshal(body, &req)
+		texts = req.Input
+	} else {
+		var req struct {
+			Requests []struct {
+				Content struct {
+					Parts []struct {
+						Text string `json:"text"`
+					} `json:"parts"`
+				} `json:"content"`
+			} `json:"requests"`
+		}
+		json.Unmarshal(body, &req)
+		for _, r := range req.Requests {
+			var b strings.Builder
+			for _, p := range r.Content.Parts {
+				b.WriteString(p.Text)
+			}
+			texts = append(texts, b.String())
+		}
+	}
+
+	vectors := make([][]float32, len(texts))
+	for i, t := range texts {
+		h := fnv.New64a()
+		h.Write([]byte(t))
+		sum := h.Sum64()
+		v := make([]float32, 8)
+		for j := range v {
+			v[j] = float32((sum>>(8*j))&0xff)/255 - 0.5
+		}
+		vectors[i] = v
+	}
+
+	if wire == WireOpenAI {
+		data := make([]interface{}, len(vectors))
+		for i, v := range vectors {
+			data[i] = map[string]interface{}{"index": i, "embedding": v}
+		}
+		return map[string]interface{}{"data": data}
+	}
+	embeddings := make([]interface{}, len(vectors))
+	for i, v := range vectors {
+		embeddings[i] = map[string]interface{}{"values": v}
+	}
+	return map[string]interface{}{"embeddings": embeddings}
+}
+
+func writeFakeJSON(w http.ResponseWriter, status int, v interface{}, fault string) {
+	data, _ := json.Marshal(v)
+	switch fault {
+	case FaultMalformed:
+		data = data[:len(data)-1]
+		data = append(data, []byte(", oops")...)
+	case FaultTruncate:
+		// Announce the full length but stop halfway; the server then drops
+		// the connection and the client sees an unexpected EOF.
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		data = data[:len(data)/2]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -194,3 +195,36 @@ func TestMockHTTPServerJSON_Error(t *testing.T) {
 	// Server logs error but returns 200 (and partial/empty body)
 	// We just want to ensure it doesn't panic and hits the error path
 }
+
+func TestMockProviderServer(t *testing.T) {
+	server, fake := MockProviderServer(t, FakeResponse{Text: "first"}, FakeResponse{Text: "second", Tokens: 7})
+	defer server.Close()
+
+	post := func(path, body string) string {
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		AssertNoError(t, err)
+		defer resp.Body.Close()
+		AssertEqual(t, resp.StatusCode, 200)
+		return ReadBody(t, resp.Body)
+	}
+	AssertContains(t, post("/models/m:generateContent", "{}"), `"text":"first"`)
+	AssertContains(t, post("/chat/completions", "{}"), `"content":"second"`)
+	// The last response repeats once the script runs out
+	body := post("/messages", "{}")
+	AssertContains(t, body, `"text":"second"`)
+	AssertContains(t, body, `"output_tokens":4`)
+
+	emb := post("/embeddings", `{"input": ["a", "b"]}`)
+	AssertContains(t, emb, `"index":1`)
+	AssertEqual(t, post("/embeddings", `{"input": ["a", "b"]}`), emb)
+
+	reqs := fake.Requests()
+	AssertEqual(t, len(reqs), 5)
+	AssertEqual(t, reqs[0].Wire, WireGemini)
+	AssertEqual(t, reqs[2].Wire, WireAnthropic)
+
+	resp, err := http.Post(server.URL+"/unknown", "application/json", nil)
+	AssertNoError(t, err)
+	resp.Body.Close()
+	AssertEqual(t, resp.StatusCode, 404)
+}
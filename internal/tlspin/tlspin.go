@@ -0,0 +1,193 @@
+// Package tlspin pins the TLS certificates of self-hosted LLM endpoints on
+// first use. A pin is added explicitly with `lucicodex pin add`, after the
+// user has seen the certificate. From then on a connection to that host
+// must present exactly the pinned certificate; the CA system is not asked,
+// so self-signed certificates work without disabling verification. Hosts
+// without a pin are verified as usual.
+package tlspin
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/storage"
+)
+
+// Pin is the certificate trusted for a host.
+type Pin struct {
+	Host        string    `json:"host"`   // Host name or IP, without port
+	Fingerprint string    `json:"sha256"` // Hex SHA-256 of the DER certificate
+	Subject     string    `json:"subject"`
+	NotAfter    time.Time `json:"not_after"`
+	Added       time.Time `json:"added"`
+}
+
+// ErrMismatch is returned when a pinned host presents another certificate.
+var ErrMismatch = errors.New("certificate does not match the pinned one")
+
+// Store keeps the pins in the document at config.PinsFile.
+type Store struct {
+	st  storage.Store
+	key string
+}
+
+// Open returns the pin store of cfg on the configured storage backend, or
+// nil if pinning is disabled (no pins_file).
+func Open(cfg config.Config) *Store {
+	if cfg.PinsFile == "" {
+		return nil
+	}
+	return &Store{st: storage.Open(cfg, filepath.Dir(cfg.PinsFile)), key: filepath.Base(cfg.PinsFile)}
+}
+
+// List returns the pins ordered by host. A nil store has none.
+func (s *Store) List() ([]Pin, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var pins []Pin
+	if err := s.st.Get("", s.key, &pins); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("load pins: %w", err)
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Host < pins[j].Host })
+	return pins, nil
+}
+
+// Add stores p, replacing an earlier pin of the same host.
+func (s *Store) Add(p Pin) error {
+	var pins []Pin
+	return s.st.Update("", s.key, &pins, func() error {
+		for i := range pins {
+			if pins[i].Host == p.Host {
+				pins[i] = p
+				return nil
+			}
+		}
+		pins = append(pins, p)
+		return nil
+	})
+}
+
+// Remove deletes the pin of host and reports whether there was one.
+func (s *Store) Remove(host string) (bool, error) {
+	var pins []Pin
+	found := false
+	err := s.st.Update("", s.key, &pins, func() error {
+		for i := range pins {
+			if pins[i].Host == host {
+				pins = append(pins[:i:i], pins[i+1:]...)
+				found = true
+				return nil
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Fingerprint returns the hex SHA-256 of a certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// FormatFingerprint groups a fingerprint in colon-separated bytes, as
+// browsers and openssl show it.
+func FormatFingerprint(fp string) string {
+	var parts []string
+	for i := 0; i+2 <= len(fp); i += 2 {
+		parts = append(parts, strings.ToUpper(fp[i:i+2]))
+	}
+	return strings.Join(parts, ":")
+}
+
+// Address returns the host and host:port of an endpoint, which may be a
+// URL or a bare host with an optional port (443 by default).
+func Address(endpoint string) (host, addr string, err error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Hostname() == "" {
+		return "", "", fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if u.Scheme != "https" {
+		return "", "", fmt.Errorf("endpoint %s does not use TLS", endpoint)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return u.Hostname(), net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// Fetch connects to addr and returns the certificate it presents, and
+// whether the system CAs trust it for host.
+func Fetch(ctx context.Context, host, addr string) (*x509.Certificate, bool, error) {
+	d := tls.Dialer{Config: &tls.Config{ServerName: host, InsecureSkipVerify: true}}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, false, fmt.Errorf("%s presented no certificate", addr)
+	}
+	opts := x509.VerifyOptions{DNSName: host, Intermediates: x509.NewCertPool()}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err = certs[0].Verify(opts)
+	return certs[0], err == nil, nil
+}
+
+// DialTLSContext returns a dial function for http.Transport.DialTLSContext
+// that connects like the transport would with base, except that a pinned
+// host must present exactly its pinned certificate. The transport does not
+// use it for requests through a proxy, so pinned hosts should be listed in
+// no_proxy.
+func DialTLSContext(base *tls.Config, pins []Pin) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	byHost := map[string]string{}
+	for _, p := range pins {
+		byHost[p.Host] = p.Fingerprint
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		tc := base.Clone()
+		if tc.ServerName == "" {
+			tc.ServerName = host
+		}
+		if want, ok := byHost[host]; ok {
+			// The pin replaces the CA system and the host name check
+			tc.InsecureSkipVerify = true
+			tc.VerifyConnection = func(cs tls.ConnectionState) error {
+				if len(cs.PeerCertificates) == 0 {
+					return fmt.Errorf("%s presented no certificate", addr)
+				}
+				if got := Fingerprint(cs.PeerCertificates[0]); got != want {
+					return fmt.Errorf("%s: %w (pinned %s, got %s); if the certificate was replaced on purpose, run `lucicodex pin add %s` again",
+						host, ErrMismatch, FormatFingerprint(want), FormatFingerprint(got), host)
+				}
+				return nil
+			}
+		}
+		d := tls.Dialer{NetDialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}, Config: tc}
+		return d.DialContext(ctx, network, addr)
+	}
+}
@@ -0,0 +1,81 @@
+package tlspin
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+)
+
+func TestStore(t *testing.T) {
+	s := Open(config.Config{PinsFile: filepath.Join(t.TempDir(), "pins.json")})
+	if pins, err := s.List(); err != nil || len(pins) != 0 {
+		t.Fatalf("expected no pins, got %v, %v", pins, err)
+	}
+	s.Add(Pin{Host: "llm.lan", Fingerprint: "aa"})
+	s.Add(Pin{Host: "10.0.0.2", Fingerprint: "bb"})
+	s.Add(Pin{Host: "llm.lan", Fingerprint: "cc"})
+	pins, err := s.List()
+	if err != nil || len(pins) != 2 || pins[0].Host != "10.0.0.2" || pins[1].Fingerprint != "cc" {
+		t.Fatalf("unexpected pins: %+v, %v", pins, err)
+	}
+	if found, err := s.Remove("llm.lan"); !found || err != nil {
+		t.Errorf("Remove = %v, %v", found, err)
+	}
+	if found, _ := s.Remove("llm.lan"); found {
+		t.Error("removed a missing pin")
+	}
+	if pins, _ := Open(config.Config{}).List(); pins != nil {
+		t.Errorf("expected no pins when disabled, got %v", pins)
+	}
+}
+
+func TestAddress(t *testing.T) {
+	for endpoint, want := range map[string]string{
+		"https://llm.lan/v1":    "llm.lan:443",
+		"https://10.0.0.2:8443": "10.0.0.2:8443",
+		"llm.lan:8443":          "llm.lan:8443",
+	} {
+		if _, addr, err := Address(endpoint); err != nil || addr != want {
+			t.Errorf("Address(%q) = %q, %v; want %q", endpoint, addr, err, want)
+		}
+	}
+	if _, _, err := Address("http://llm.lan"); err == nil {
+		t.Error("expected a plain HTTP endpoint to fail")
+	}
+}
+
+func TestDialTLSContext(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	host, addr, _ := Address(srv.URL)
+
+	cert, trusted, err := Fetch(context.Background(), host, addr)
+	if err != nil || trusted {
+		t.Fatalf("Fetch = %v, %v", trusted, err)
+	}
+	get := func(pins []Pin) error {
+		transport := &http.Transport{DialTLSContext: DialTLSContext(&tls.Config{}, pins)}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(nil); err == nil {
+		t.Error("expected the self-signed certificate to be rejected without a pin")
+	}
+	if err := get([]Pin{{Host: host, Fingerprint: Fingerprint(cert)}}); err != nil {
+		t.Errorf("pinned request failed: %v", err)
+	}
+	if err := get([]Pin{{Host: host, Fingerprint: "00"}}); !errors.Is(err, ErrMismatch) {
+		t.Errorf("expected ErrMismatch, got %v", err)
+	}
+}
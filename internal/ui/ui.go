@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/files"
 	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
 )
 
 const (
@@ -42,9 +45,38 @@ func PrintResponse(w io.Writer, p plan.Plan) {
 			fmt.Fprintf(w, "%s %s\n", colorize(Yellow, "Note:"), wmsg)
 		}
 	}
+	if len(p.Questions) > 0 {
+		fmt.Fprintln(w)
+		for _, q := range p.Questions {
+			fmt.Fprintf(w, "%s %s\n", colorize(Blue, "?"), q)
+		}
+	}
 }
 
+// PrintPlan prints p without the diffs of its file.write commands.
 func PrintPlan(w io.Writer, p plan.Plan) {
+	printPlan(w, p, false, "", nil)
+}
+
+// PrintPlanElevated prints the plan like PrintPlan and additionally shows, for
+// each command that needs root, whether elevateCommand will be prefixed, and
+// the diff of each file.write command to a file under filePaths.
+func PrintPlanElevated(w io.Writer, p plan.Plan, elevateCommand string, filePaths []string) {
+	printPlan(w, p, true, elevateCommand, filePaths)
+}
+
+func printPlan(w io.Writer, p plan.Plan, showElevation bool, elevateCommand string, filePaths []string) {
+	if p.AlternativeTo != "" {
+		fmt.Fprintln(w, colorize(Yellow+Bold, "Alternative plan: the policy rejected the original plan, so a different one was proposed. Check that it still does what you want."))
+		fmt.Fprintln(w, indent(p.AlternativeTo, 2))
+		fmt.Fprintln(w)
+	}
+	if p.EscalatedTo != "" {
+		fmt.Fprintf(w, "%s\n\n", colorize(Blue, "Planned by "+p.EscalatedTo+": the configured model was not confident in its plan."))
+	}
+	if p.FallbackFrom != "" {
+		fmt.Fprintf(w, "%s\n\n", colorize(Yellow, "Planned by the local model: "+p.FallbackFrom+" could not be reached. Small models make more mistakes; review the plan carefully."))
+	}
 	if p.Summary != "" {
 		fmt.Fprintf(w, "%s %s\n\n", colorize(Blue+Bold, "Summary:"), p.Summary)
 	}
@@ -54,10 +86,38 @@ func PrintPlan(w io.Writer, p plan.Plan) {
 	}
 	fmt.Fprintln(w, colorize(Bold, "Proposed commands:"))
 	for i, c := range p.Commands {
-		fmt.Fprintf(w, "%s %s\n", colorize(Green, fmt.Sprintf("[%d]", i+1)), executor.FormatCommand(c.Command))
+		fmt.Fprintf(w, "%s %s\n", colorize(Green, fmt.Sprintf("[%d]", i+1)), executor.FormatPlanned(c))
 		if strings.TrimSpace(c.Description) != "" {
 			fmt.Fprintf(w, "    %s %s\n", colorize(Blue, "→"), c.Description)
 		}
+		printPrivilegeAudit(w, policy.AuditCommand(i, c), showElevation, elevateCommand)
+		if op, path, ok := c.FileOp(); ok && op == plan.FileWrite && filePaths != nil {
+			if _, err := files.Check(path, filePaths); err != nil {
+				fmt.Fprintf(w, "    %s %s\n", colorize(Yellow, "changes to "+path+" not shown:"), err)
+			} else {
+				printFilePreview(w, files.Preview(path, c.Content))
+			}
+		}
+		for _, fc := range p.FileChanges {
+			if fc.Command != i {
+				continue
+			}
+			if fc.Error != "" {
+				fmt.Fprintf(w, "    %s %s\n", colorize(Yellow, "changes to "+fc.Path+" not shown:"), fc.Error)
+				continue
+			}
+			fmt.Fprintf(w, "    %s\n", colorize(Bold, "changes to "+fc.Path+":"))
+			printFilePreview(w, fc.Diff)
+		}
+	}
+	if len(p.Verify) > 0 {
+		fmt.Fprintln(w, "\n"+colorize(Bold, "Verification (read-only, run afterwards):"))
+		for i, c := range p.Verify {
+			fmt.Fprintf(w, "%s %s\n", colorize(Blue, fmt.Sprintf("[v%d]", i+1)), executor.FormatPlanned(c))
+			if c.Expect != nil {
+				fmt.Fprintf(w, "    %s %s\n", colorize(Blue, "expect"), describeExpect(*c.Expect))
+			}
+		}
 	}
 	if len(p.Warnings) > 0 {
 		fmt.Fprintln(w, "\n"+colorize(Yellow+Bold, "Warnings:"))
@@ -65,6 +125,137 @@ func PrintPlan(w io.Writer, p plan.Plan) {
 			fmt.Fprintf(w, "%s %s\n", colorize(Yellow, "⚠"), wmsg)
 		}
 	}
+	if len(p.PolicyWarnings) > 0 {
+		fmt.Fprintln(w, "\n"+colorize(Yellow+Bold, "Policy warnings (acknowledge before executing):"))
+		for _, pw := range p.PolicyWarnings {
+			cmd := ""
+			if pw.Command >= 0 && pw.Command < len(p.Commands) {
+				cmd = executor.FormatPlanned(p.Commands[pw.Command])
+			}
+			detail := "matches warn rule " + pw.Rule
+			if pw.Message != "" && !strings.Contains(pw.Message, "matches warn rule") {
+				// Built-in checks explain themselves
+				detail = "- " + strings.TrimPrefix(pw.Message, fmt.Sprintf("command %d ", pw.Command))
+			} else if _, rest, ok := strings.Cut(pw.Message, fmt.Sprintf("%q", pw.Rule)); ok {
+				// The system policy the rule comes from, and why it exists
+				from, why, _ := strings.Cut(rest, ": ")
+				detail += from
+				if why != "" {
+					detail += " - " + why
+				}
+			}
+			fmt.Fprintf(w, "%s %s %s %s\n", colorize(Yellow, "⚠"), colorize(Green, fmt.Sprintf("[%d]", pw.Command+1)), cmd, detail)
+		}
+	}
+	if len(p.MissingTools) > 0 {
+		fmt.Fprintln(w, "\n"+colorize(Yellow+Bold, "Missing tools:"))
+		for _, m := range p.MissingTools {
+			hint := "not installed"
+			if m.Package != "" {
+				hint += "; install it with: opkg update && opkg install " + m.Package
+			}
+			fmt.Fprintf(w, "%s %s %s %s\n", colorize(Yellow, "⚠"), colorize(Green, fmt.Sprintf("[%d]", m.Command+1)), m.Tool, hint)
+		}
+	}
+	if len(p.Lint) > 0 {
+		fmt.Fprintln(w, "\n"+colorize(Yellow+Bold, "Lint findings:"))
+		for _, f := range p.Lint {
+			icon := colorize(Blue, "ℹ")
+			switch f.Severity {
+			case plan.LintWarning:
+				icon = colorize(Yellow, "⚠")
+			case plan.LintError:
+				icon = colorize(Red, "✗")
+			}
+			detail := strings.TrimPrefix(f.Message, fmt.Sprintf("command %d ", f.Command))
+			fmt.Fprintf(w, "%s %s %s (%s)\n", icon, colorize(Green, fmt.Sprintf("[%d]", f.Command+1)), detail, f.Rule)
+		}
+	}
+	if p.Estimate != nil {
+		printEstimate(w, *p.Estimate)
+	}
+}
+
+// describeExpect is the one-line form of a check's expectation.
+func describeExpect(x plan.Expect) string {
+	var parts []string
+	if x.Contains != "" {
+		parts = append(parts, fmt.Sprintf("contains %q", x.Contains))
+	}
+	if x.Regex != "" {
+		parts = append(parts, "matches /"+x.Regex+"/")
+	}
+	if x.JSONPath != "" {
+		if x.Equals != "" {
+			parts = append(parts, x.JSONPath+" = "+x.Equals)
+		} else {
+			parts = append(parts, "has "+x.JSONPath)
+		}
+	}
+	if len(parts) == 0 {
+		return "succeeds"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// printEstimate shows the impact block that precedes the approval question.
+func printEstimate(w io.Writer, e plan.Estimate) {
+	fmt.Fprintln(w, "\n"+colorize(Bold, "Impact estimate:"))
+	fmt.Fprintf(w, "  Writes:      %d of %d commands\n", e.WriteCommands, e.Commands)
+	switch {
+	case e.Reboot:
+		fmt.Fprintf(w, "  Restarts:    %s\n", colorize(Red, "reboots the router"))
+	case len(e.Services) > 0:
+		fmt.Fprintf(w, "  Restarts:    %s\n", strings.Join(e.Services, ", "))
+	}
+	if e.DowntimeSeconds > 0 {
+		fmt.Fprintf(w, "  Downtime:    %s\n", colorize(Yellow, fmt.Sprintf("~%s", time.Duration(e.DowntimeSeconds)*time.Second)))
+	} else {
+		fmt.Fprintln(w, "  Downtime:    none expected")
+	}
+	if e.TokensUsed > 0 {
+		fmt.Fprintf(w, "  LLM tokens:  %d so far\n", e.TokensUsed)
+	}
+	fmt.Fprintf(w, "  Time budget: up to %s\n", time.Duration(e.TimeBudgetSeconds)*time.Second)
+}
+
+// printFilePreview shows the diff a file.write command would apply, so it
+// is reviewed before approval.
+func printFilePreview(w io.Writer, preview string) {
+	for _, line := range strings.Split(preview, "\n") {
+		switch {
+		case strings.HasPrefix(line, "+"):
+			line = colorize(Green, line)
+		case strings.HasPrefix(line, "-"):
+			line = colorize(Red, line)
+		case strings.HasPrefix(line, "@@"):
+			line = colorize(Blue, line)
+		}
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+}
+
+// printPrivilegeAudit shows why a command needs root and flags needs_root
+// claims that disagree with the capability table.
+func printPrivilegeAudit(w io.Writer, a policy.PrivilegeAudit, showElevation bool, elevateCommand string) {
+	if a.RequiresRoot() || a.Claimed {
+		reason := "model requested root"
+		if a.RequiresRoot() {
+			reason = strings.Join(a.Reasons, ", ")
+		}
+		line := fmt.Sprintf("root: %s", reason)
+		if showElevation && a.Claimed {
+			if strings.TrimSpace(elevateCommand) != "" {
+				line += fmt.Sprintf(" (elevated via %q)", strings.TrimSpace(elevateCommand))
+			} else {
+				line += " (no elevate_command; runs as current user)"
+			}
+		}
+		fmt.Fprintf(w, "    %s %s\n", colorize(Yellow, "#"), line)
+	}
+	if a.Conflict != "" {
+		fmt.Fprintf(w, "    %s %s\n", colorize(Red+Bold, "! privilege conflict:"), a.Conflict)
+	}
 }
 
 func Confirm(r *bufio.Reader, w io.Writer, msg string) (bool, error) {
@@ -77,29 +268,67 @@ func Confirm(r *bufio.Reader, w io.Writer, msg string) (bool, error) {
 	return line == "y" || line == "yes", nil
 }
 
+// Ask prints a question the model asked and returns the user's answer.
+func Ask(r *bufio.Reader, w io.Writer, question string) (string, error) {
+	fmt.Fprintf(w, "%s %s\n%s ", colorize(Blue, "?"), colorize(Bold, question), colorize(Blue, ">"))
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
 type Results = executor.Results
 
 func PrintResults(w io.Writer, res Results) {
 	for _, item := range res.Items {
 		status := colorize(Green, "ok")
-		if item.Err != nil {
+		if item.Skipped {
+			status = colorize(Yellow, "skipped")
+		} else if item.Err != nil {
 			status = colorize(Red, "error")
 		}
-		fmt.Fprintf(w, "%s (%s, %s) %s\n", colorize(Bold, fmt.Sprintf("[%d]", item.Index+1)), status, item.Elapsed, executor.FormatCommand(item.Command))
+		fmt.Fprintf(w, "%s (%s, %s) %s\n", colorize(Bold, fmt.Sprintf("[%d]", item.Index+1)), status, item.Elapsed, executor.FormatPlanned(plan.PlannedCommand{Command: item.Command, Pipe: item.Pipe}))
 		if strings.TrimSpace(item.Output) != "" {
 			fmt.Fprintln(w, indent(item.Output, 2))
 		}
 		if item.Err != nil {
 			fmt.Fprintf(w, "  %s %v\n", colorize(Red, "Error:"), item.Err)
 		}
+		if len(item.Artifacts) > 0 {
+			fmt.Fprintf(w, "  %s %s\n", colorize(Blue, "Files:"), strings.Join(item.Artifacts, ", "))
+		}
+	}
+	if len(res.Checks) > 0 {
+		fmt.Fprintln(w, "\n"+colorize(Bold, "Verification:"))
+		for _, c := range res.Checks {
+			if c.Passed {
+				fmt.Fprintf(w, "  %s %s\n", colorize(Green, "✓"), executor.FormatPlanned(c.Command))
+			} else {
+				fmt.Fprintf(w, "  %s %s: %s\n", colorize(Red, "✗"), executor.FormatPlanned(c.Command), c.Reason)
+			}
+		}
 	}
 	if res.Failed > 0 {
 		fmt.Fprintf(w, "\n%s %d command(s) failed.\n", colorize(Red+Bold, "FAILED:"), res.Failed)
+	} else if res.Unverified() {
+		fmt.Fprintf(w, "\n%s the commands ran, but %s\n", colorize(Red+Bold, "UNVERIFIED:"), failedChecks(res))
 	} else {
 		fmt.Fprintln(w, "\n"+colorize(Green+Bold, "All commands executed successfully."))
 	}
 }
 
+// failedChecks says how many checks of res failed.
+func failedChecks(res Results) string {
+	n := 0
+	for _, c := range res.Checks {
+		if !c.Passed {
+			n++
+		}
+	}
+	return fmt.Sprintf("%d of %d verification check(s) failed.", n, len(res.Checks))
+}
+
 func indent(s string, n int) string {
 	pad := strings.Repeat(" ", n)
 	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
@@ -114,6 +343,10 @@ func PrintSummary(w io.Writer, res Results) {
 	total := len(res.Items)
 	if res.Failed > 0 {
 		fmt.Fprintf(w, "\n%s %d of %d command(s) failed.\n", colorize(Red+Bold, "FAILED:"), res.Failed, total)
+	} else if res.Unverified() {
+		fmt.Fprintf(w, "\n%s All %d command(s) ran, but %s\n", colorize(Red+Bold, "✗"), total, failedChecks(res))
+	} else if res.Verified {
+		fmt.Fprintf(w, "\n%s All %d command(s) executed successfully and the change is verified.\n", colorize(Green+Bold, "✓"), total)
 	} else if total > 0 {
 		fmt.Fprintf(w, "\n%s All %d command(s) executed successfully.\n", colorize(Green+Bold, "✓"), total)
 	}
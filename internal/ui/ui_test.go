@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -80,6 +82,91 @@ func TestPrintPlan_NoWarnings(t *testing.T) {
 	}
 }
 
+func TestPrintPlan_PolicyWarnings(t *testing.T) {
+	var buf bytes.Buffer
+
+	p := plan.Plan{
+		Commands: []plan.PlannedCommand{
+			{Command: []string{"uci", "show"}},
+			{Command: []string{"uci", "commit", "firewall"}},
+		},
+		PolicyWarnings: []plan.PolicyWarning{{Command: 1, Rule: `^uci commit`}},
+	}
+
+	PrintPlan(&buf, p)
+	output := stripAnsi(buf.String())
+
+	if !strings.Contains(output, "Policy warnings") {
+		t.Errorf("expected policy warnings section, got:\n%s", output)
+	}
+	if !strings.Contains(output, "⚠ [2] uci commit firewall matches warn rule ^uci commit") {
+		t.Errorf("expected warning for the second command, got:\n%s", output)
+	}
+
+	buf.Reset()
+	p.PolicyWarnings[0].Message = `command 1 matches warn rule "^uci commit" (system policy /etc/lucicodex/policy.d/base.json): reloads services`
+	PrintPlan(&buf, p)
+	output = stripAnsi(buf.String())
+	if !strings.Contains(output, "matches warn rule ^uci commit (system policy /etc/lucicodex/policy.d/base.json) - reloads services") {
+		t.Errorf("expected the system policy and the description, got:\n%s", output)
+	}
+}
+
+func TestPrintPlan_Estimate(t *testing.T) {
+	var buf bytes.Buffer
+
+	p := plan.Plan{
+		Commands: []plan.PlannedCommand{{Command: []string{"/etc/init.d/network", "restart"}}},
+		Estimate: &plan.Estimate{
+			Commands:          1,
+			WriteCommands:     1,
+			Services:          []string{"network"},
+			DowntimeSeconds:   30,
+			TokensUsed:        812,
+			TimeBudgetSeconds: 90,
+		},
+	}
+
+	PrintPlan(&buf, p)
+	output := stripAnsi(buf.String())
+
+	for _, want := range []string{"Impact estimate:", "1 of 1 commands", "Restarts:    network", "~30s", "812 so far", "up to 1m30s"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, output)
+		}
+	}
+}
+
+func TestPrintPlanElevated(t *testing.T) {
+	p := plan.Plan{
+		Commands: []plan.PlannedCommand{
+			{Command: []string{"uci", "commit", "network"}, NeedsRoot: true},
+			{Command: []string{"cat", "/proc/uptime"}, NeedsRoot: true},
+			{Command: []string{"echo", "hi"}},
+		},
+	}
+
+	var buf bytes.Buffer
+	PrintPlanElevated(&buf, p, "sudo -n", nil)
+	output := stripAnsi(buf.String())
+
+	if !strings.Contains(output, "# root: writes /etc/config (elevated via \"sudo -n\")") {
+		t.Errorf("expected root reason with elevation, got:\n%s", output)
+	}
+	if !strings.Contains(output, "! privilege conflict: needs_root is true but command is read-only") {
+		t.Errorf("expected over-claim conflict, got:\n%s", output)
+	}
+	if strings.Count(output, "# root:") != 2 {
+		t.Errorf("expected only root commands to be annotated, got:\n%s", output)
+	}
+
+	buf.Reset()
+	PrintPlanElevated(&buf, p, "", nil)
+	if !strings.Contains(stripAnsi(buf.String()), "no elevate_command; runs as current user") {
+		t.Errorf("expected note about missing elevate_command, got:\n%s", buf.String())
+	}
+}
+
 func TestConfirm_Yes(t *testing.T) {
 	testCases := []struct {
 		input    string
@@ -266,3 +353,40 @@ func TestPrintResultsJSON(t *testing.T) {
 		t.Errorf("expected 0 failures, got %d", decoded.Failed)
 	}
 }
+
+func TestVerbosity(t *testing.T) {
+	var buf bytes.Buffer
+	Quiet.Logf(Normal, &buf, "hidden\n")
+	Verbose.Logf(Verbose, &buf, "shown %d\n", 1)
+	Verbose.Logf(Debug, &buf, "hidden\n")
+	Normal.Writer(Verbose, &buf).Write([]byte("hidden\n"))
+	if buf.String() != "shown 1\n" {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+
+	buf.Reset()
+	PrintFailures(&buf, Results{Failed: 1, Items: []executor.Result{
+		{Index: 0, Command: []string{"echo", "ok"}, Output: "ok"},
+		{Index: 1, Command: []string{"false"}, Output: "1\n2\n3\n4\n5\n6", Err: errors.New("exit status 1")},
+	}})
+	out := stripAnsi(buf.String())
+	if strings.Contains(out, "echo") || !strings.Contains(out, "[2] false: exit status 1") || strings.Contains(out, "  1\n") || !strings.Contains(out, "  6") {
+		t.Errorf("unexpected failures output:\n%s", out)
+	}
+}
+
+func TestPrintPlanElevated_FilePreviewConfined(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	outside := filepath.Join(other, "shadow")
+	os.WriteFile(outside, []byte("root:secret:19000::::::\n"), 0o600)
+	p := plan.Plan{Commands: []plan.PlannedCommand{
+		{Command: []string{plan.FileWrite, filepath.Join(dir, "new")}, Content: "hello\n"},
+		{Command: []string{plan.FileWrite, outside}, Content: "x\n"},
+	}}
+	var buf bytes.Buffer
+	PrintPlanElevated(&buf, p, "", []string{dir})
+	out := buf.String()
+	if !strings.Contains(out, "new file, 1 line(s)") || strings.Contains(out, "secret") || !strings.Contains(out, "changes to "+outside+" not shown:") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
@@ -0,0 +1,60 @@
+package ui
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+// Verbosity selects which progress messages the CLI prints. Results, errors
+// and answers to questions are printed at every level.
+type Verbosity int
+
+const (
+	Quiet   Verbosity = -1 // Only the final summary and errors, for cron
+	Normal  Verbosity = 0
+	Verbose Verbosity = 1 // Adds timing and policy decisions
+	Debug   Verbosity = 2 // Adds provider HTTP and LLM tracing
+)
+
+// Writer returns w if messages of level are shown at v, io.Discard otherwise.
+func (v Verbosity) Writer(level Verbosity, w io.Writer) io.Writer {
+	if v < level {
+		return io.Discard
+	}
+	return w
+}
+
+// Logf prints a message of level to w if it is shown at v.
+func (v Verbosity) Logf(level Verbosity, w io.Writer, format string, args ...interface{}) {
+	if v >= level {
+		fmt.Fprintf(w, format, args...)
+	}
+}
+
+// PrintFailures prints the failed commands of res with their errors and the
+// last lines of their output. It is what quiet mode shows instead of
+// PrintResults.
+func PrintFailures(w io.Writer, res Results) {
+	for _, item := range res.Items {
+		if item.Err == nil {
+			continue
+		}
+		fmt.Fprintf(w, "%s %s: %v\n", colorize(Red+Bold, fmt.Sprintf("[%d]", item.Index+1)), executor.FormatPlanned(plan.PlannedCommand{Command: item.Command, Pipe: item.Pipe}), item.Err)
+		if out := strings.TrimSpace(item.Output); out != "" {
+			lines := strings.Split(out, "\n")
+			if len(lines) > 5 {
+				lines = lines[len(lines)-5:]
+			}
+			fmt.Fprintln(w, indent(strings.Join(lines, "\n"), 2))
+		}
+	}
+	for _, c := range res.Checks {
+		if !c.Passed {
+			fmt.Fprintf(w, "%s %s: %s\n", colorize(Red+Bold, fmt.Sprintf("[v%d]", c.Index+1)), executor.FormatPlanned(c.Command), c.Reason)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Package update replaces the running binary with a newer signed release.
+//
+// A release publishes a manifest (manifest.json) listing one binary per
+// platform with its SHA-256, and a detached ed25519 signature of the manifest
+// (manifest.json.sig, base64). The public key is embedded at build time:
+//
+//	go build -ldflags "-X github.com/aezizhu/LuciCodex/internal/update.PublicKey=<base64 key>"
+//
+// Install only accepts a manifest signed by that key and newer than the
+// running version, checks the downloaded binary's hash, runs it once with
+// -version, then swaps it in with a rename. The replaced binary is kept next
+// to it with the suffix ".prev" so Rollback can restore it.
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PublicKey is the base64 ed25519 key that signs release manifests, set with
+// -ldflags -X at build time. Builds without it cannot self-update.
+var PublicKey string
+
+const (
+	maxManifestSize = 64 * 1024
+	maxBinarySize   = 64 * 1024 * 1024
+	// PrevSuffix names the previous binary kept for Rollback.
+	PrevSuffix = ".prev"
+)
+
+var (
+	ErrNoPublicKey  = errors.New("this build has no release signing key; install updates with opkg")
+	ErrBadSignature = errors.New("release manifest signature is invalid")
+	ErrNoPlatform   = errors.New("release has no binary for this platform")
+	ErrNoPrevious   = errors.New("no previous binary to roll back to")
+)
+
+// Binary is a release binary listed in the manifest.
+type Binary struct {
+	Name   string `json:"name"` // Resolved against the manifest URL
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// Manifest describes a release.
+type Manifest struct {
+	Version  string            `json:"version"`
+	Binaries map[string]Binary `json:"binaries"` // Keyed by Platform()
+}
+
+// Platform returns the manifest key of the running binary, matching the
+// release asset names: linux-mips, linux-mipsle, linux-armv7, linux-arm64...
+func Platform() string {
+	arch := runtime.GOARCH
+	if arch == "arm" {
+		goarm := "7"
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range bi.Settings {
+				if s.Key == "GOARM" && s.Value != "" {
+					goarm = s.Value
+				}
+			}
+		}
+		arch += "v" + goarm
+	}
+	return runtime.GOOS + "-" + arch
+}
+
+// Check fetches the manifest at manifestURL and verifies its signature.
+func Check(ctx context.Context, client *http.Client, manifestURL string) (Manifest, error) {
+	var m Manifest
+	key, err := publicKey()
+	if err != nil {
+		return m, err
+	}
+	body, err := fetch(ctx, client, manifestURL, maxManifestSize)
+	if err != nil {
+		return m, err
+	}
+	sigText, err := fetch(ctx, client, manifestURL+".sig", 1024)
+	if err != nil {
+		return m, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigText)))
+	if err != nil || !ed25519.Verify(key, body, sig) {
+		return m, ErrBadSignature
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return m, fmt.Errorf("release manifest: %w", err)
+	}
+	if m.Version == "" {
+		return m, errors.New("release manifest has no version")
+	}
+	return m, nil
+}
+
+func publicKey() (ed25519.PublicKey, error) {
+	if PublicKey == "" {
+		return nil, ErrNoPublicKey
+	}
+	b, err := base64.StdEncoding.DecodeString(PublicKey)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("embedded release signing key is malformed")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// Newer reports whether version a is newer than b. Versions are dotted
+// numbers with an optional leading "v"; a pre-release suffix ("-rc1") is
+// ignored.
+func Newer(a, b string) bool {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, s := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(s)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// Install downloads the binary for this platform from m, verifies it and
+// atomically replaces exe with it, keeping the old binary as exe+PrevSuffix.
+func Install(ctx context.Context, client *http.Client, manifestURL string, m Manifest, exe string) error {
+	bin, ok := m.Binaries[Platform()]
+	if !ok {
+		return fmt.Errorf("%w (%s)", ErrNoPlatform, Platform())
+	}
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return err
+	}
+	ref, err := url.Parse(bin.Name)
+	if err != nil {
+		return err
+	}
+	data, err := fetch(ctx, client, base.ResolveReference(ref).String(), maxBinarySize)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), bin.SHA256) || (bin.Size > 0 && int64(len(data)) != bin.Size) {
+		return fmt.Errorf("downloaded %s does not match the signed manifest", bin.Name)
+	}
+
+	// Stage next to exe so the final rename stays on one filesystem
+	dir := filepath.Dir(exe)
+	tmp, err := os.CreateTemp(dir, ".lucicodex-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return err
+	}
+	if err := selfTest(ctx, tmp.Name(), m.Version); err != nil {
+		return err
+	}
+
+	prev := exe + PrevSuffix
+	os.Remove(prev)
+	if err := os.Link(exe, prev); err != nil {
+		return fmt.Errorf("keeping previous binary: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		os.Remove(prev)
+		return err
+	}
+	return nil
+}
+
+// selfTest runs the new binary once, which catches a wrong architecture or a
+// truncated file before it replaces the working one.
+func selfTest(ctx context.Context, path, version string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("new binary does not run on this router: %v", err)
+	}
+	if !strings.Contains(string(out), strings.TrimPrefix(version, "v")) {
+		return fmt.Errorf("new binary reports %q, expected version %s", strings.TrimSpace(string(out)), version)
+	}
+	return nil
+}
+
+// Rollback restores the binary replaced by the last Install.
+func Rollback(exe string) error {
+	prev := exe + PrevSuffix
+	if _, err := os.Stat(prev); err != nil {
+		return ErrNoPrevious
+	}
+	return os.Rename(prev, exe)
+}
+
+func fetch(ctx context.Context, client *http.Client, u string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("GET %s: response larger than %d bytes", u, limit)
+	}
+	return data, nil
+}
@@ -0,0 +1,140 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// release serves a signed manifest for one binary and returns its URL.
+func release(t *testing.T, version string, binary []byte, sign ed25519.PrivateKey) string {
+	t.Helper()
+	sum := sha256.Sum256(binary)
+	manifest, _ := json.Marshal(Manifest{
+		Version: version,
+		Binaries: map[string]Binary{
+			Platform(): {Name: "lucicodex-" + Platform(), SHA256: hex.EncodeToString(sum[:]), Size: int64(len(binary))},
+		},
+	})
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(sign, manifest))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/manifest.json", func(w http.ResponseWriter, r *http.Request) { w.Write(manifest) })
+	mux.HandleFunc("/latest/manifest.json.sig", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(sig)) })
+	mux.HandleFunc("/latest/lucicodex-"+Platform(), func(w http.ResponseWriter, r *http.Request) { w.Write(binary) })
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL + "/latest/manifest.json"
+}
+
+func TestInstallAndRollback(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	old := PublicKey
+	PublicKey = base64.StdEncoding.EncodeToString(pub)
+	defer func() { PublicKey = old }()
+
+	exe := filepath.Join(t.TempDir(), "lucicodex")
+	oldBinary := []byte("#!/bin/sh\necho LuciCodex version 1.0.0\n")
+	if err := os.WriteFile(exe, oldBinary, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	newBinary := []byte("#!/bin/sh\necho LuciCodex version 1.1.0\n")
+	u := release(t, "1.1.0", newBinary, priv)
+
+	ctx := context.Background()
+	m, err := Check(ctx, http.DefaultClient, u)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if m.Version != "1.1.0" {
+		t.Fatalf("version = %q", m.Version)
+	}
+	if err := Install(ctx, http.DefaultClient, u, m, exe); err != nil {
+		t.Fatalf("Install: %v", err)
+	}
+	if got, _ := os.ReadFile(exe); string(got) != string(newBinary) {
+		t.Errorf("binary not replaced: %q", got)
+	}
+	if got, _ := os.ReadFile(exe + PrevSuffix); string(got) != string(oldBinary) {
+		t.Errorf("previous binary not kept: %q", got)
+	}
+
+	if err := Rollback(exe); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if got, _ := os.ReadFile(exe); string(got) != string(oldBinary) {
+		t.Errorf("rollback did not restore: %q", got)
+	}
+	if err := Rollback(exe); !errors.Is(err, ErrNoPrevious) {
+		t.Errorf("second rollback = %v", err)
+	}
+}
+
+func TestCheck_RejectsForeignSignature(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	old := PublicKey
+	defer func() { PublicKey = old }()
+
+	u := release(t, "9.9.9", []byte("x"), other)
+	PublicKey = ""
+	if _, err := Check(context.Background(), http.DefaultClient, u); !errors.Is(err, ErrNoPublicKey) {
+		t.Errorf("without key: %v", err)
+	}
+	PublicKey = base64.StdEncoding.EncodeToString(pub)
+	if _, err := Check(context.Background(), http.DefaultClient, u); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("foreign signature: %v", err)
+	}
+}
+
+func TestInstall_RejectsTamperedBinary(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	old := PublicKey
+	PublicKey = base64.StdEncoding.EncodeToString(pub)
+	defer func() { PublicKey = old }()
+
+	exe := filepath.Join(t.TempDir(), "lucicodex")
+	os.WriteFile(exe, []byte("old"), 0o755)
+	u := release(t, "1.1.0", []byte("#!/bin/sh\necho 1.1.0\n"), priv)
+	m, err := Check(context.Background(), http.DefaultClient, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := m.Binaries[Platform()]
+	b.SHA256 = hex.EncodeToString(make([]byte, 32))
+	m.Binaries[Platform()] = b
+	if err := Install(context.Background(), http.DefaultClient, u, m, exe); err == nil {
+		t.Fatal("expected hash mismatch")
+	}
+	if got, _ := os.ReadFile(exe); string(got) != "old" {
+		t.Errorf("binary replaced despite mismatch")
+	}
+}
+
+func TestNewer(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"1.1.0", "1.0.0", true},
+		{"v1.10.0", "1.9.3", true},
+		{"1.0", "1.0.0", false},
+		{"1.0.0", "1.0.1", false},
+		{"2.0.0-rc1", "1.9.9", true},
+	}
+	for _, c := range cases {
+		if got := Newer(c.a, c.b); got != c.want {
+			t.Errorf("Newer(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
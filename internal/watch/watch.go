@@ -0,0 +1,281 @@
+// Package watch runs read-only probe plans periodically and raises alerts
+// when their conditions change (see `lucicodex watch`).
+package watch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/impact"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/redact"
+)
+
+// Alert states.
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+// maxEventOutput bounds the probe output attached to an event.
+const maxEventOutput = 2048
+
+// Event reports that a probe's alert started or stopped firing.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Probe   int       `json:"probe"`
+	Command string    `json:"command"`
+	State   string    `json:"state"`
+	Message string    `json:"message"`
+	Output  string    `json:"output,omitempty"` // Redacted and truncated
+	Error   string    `json:"error,omitempty"`
+}
+
+// Validate checks that every command of p is a usable probe: it has an alert
+// with at least one valid criterion and is read-only.
+func Validate(p plan.Plan) error {
+	if len(p.Commands) == 0 {
+		return fmt.Errorf("no probes")
+	}
+	for i, c := range p.Commands {
+		if c.Alert == nil {
+			return fmt.Errorf("probe %d has no alert condition", i)
+		}
+		if c.Background {
+			return fmt.Errorf("probe %d: background commands cannot be probes", i)
+		}
+		for _, argv := range c.Stages() {
+			if impact.IsWrite(argv) {
+				return fmt.Errorf("probe %d is not read-only: %s", i, strings.Join(argv, " "))
+			}
+		}
+		a := c.Alert
+		if !a.Failed && a.Contains == "" && a.Missing == "" && a.Pattern == "" {
+			return fmt.Errorf("probe %d alert has no criteria", i)
+		}
+		if a.Pattern != "" {
+			if _, err := regexp.Compile(a.Pattern); err != nil {
+				return fmt.Errorf("probe %d alert pattern: %v", i, err)
+			}
+		}
+		if a.Op != "" {
+			if a.Pattern == "" {
+				return fmt.Errorf("probe %d alert has op %q without a pattern", i, a.Op)
+			}
+			if _, err := compare(a.Op, 0, 0); err != nil {
+				return fmt.Errorf("probe %d alert: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate reports whether the alert condition holds for a probe result.
+func Evaluate(a plan.Alert, output string, failed bool) (bool, error) {
+	if a.Failed && failed {
+		return true, nil
+	}
+	if a.Contains != "" && strings.Contains(output, a.Contains) {
+		return true, nil
+	}
+	if a.Missing != "" && !strings.Contains(output, a.Missing) {
+		return true, nil
+	}
+	if a.Pattern == "" {
+		return false, nil
+	}
+	re, err := regexp.Compile(a.Pattern)
+	if err != nil {
+		return false, err
+	}
+	if a.Op == "" {
+		return re.MatchString(output), nil
+	}
+	var v float64
+	if re.NumSubexp() == 0 {
+		v = float64(len(re.FindAllStringIndex(output, -1)))
+	} else {
+		m := re.FindStringSubmatch(output)
+		if m == nil {
+			return false, nil
+		}
+		v, err = strconv.ParseFloat(strings.TrimSpace(m[1]), 64)
+		if err != nil {
+			return false, fmt.Errorf("pattern %q captured %q, not a number", a.Pattern, m[1])
+		}
+	}
+	return compare(a.Op, v, a.Value)
+}
+
+func compare(op string, a, b float64) (bool, error) {
+	switch op {
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	default:
+		return false, fmt.Errorf("unknown op %q", op)
+	}
+}
+
+// Notifier delivers alert events.
+type Notifier interface {
+	Notify(ctx context.Context, ev Event) error
+}
+
+// WriterNotifier prints events to W, one line each, or as JSON lines.
+type WriterNotifier struct {
+	W    io.Writer
+	JSON bool
+}
+
+func (n WriterNotifier) Notify(ctx context.Context, ev Event) error {
+	if n.JSON {
+		return json.NewEncoder(n.W).Encode(ev)
+	}
+	label := "ALERT"
+	if ev.State == Resolved {
+		label = "RESOLVED"
+	}
+	_, err := fmt.Fprintf(n.W, "%s [%s] %s (probe %d: %s)\n", ev.Time.Local().Format("2006-01-02 15:04:05"), label, ev.Message, ev.Probe, ev.Command)
+	return err
+}
+
+// Webhook POSTs events as JSON to URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (n Webhook) Notify(ctx context.Context, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: HTTP %d", n.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// Watcher runs probes and notifies on alert state changes. An alert is sent
+// once when its condition starts to hold and once when it clears, never for
+// every round in between.
+type Watcher struct {
+	Probes    []plan.PlannedCommand
+	Exec      func(ctx context.Context, index int, pc plan.PlannedCommand) executor.Result
+	Notifiers []Notifier
+	Interval  time.Duration
+	// OnError receives probe evaluation and delivery errors; they never stop
+	// the watch.
+	OnError func(error)
+
+	firing []bool
+}
+
+// Check runs every probe once and returns the resulting state changes after
+// notifying them.
+func (w *Watcher) Check(ctx context.Context) []Event {
+	if w.firing == nil {
+		w.firing = make([]bool, len(w.Probes))
+	}
+	var events []Event
+	for i, pc := range w.Probes {
+		res := w.Exec(ctx, i, pc)
+		if ctx.Err() != nil {
+			return events
+		}
+		holds, err := Evaluate(*pc.Alert, res.Output, res.Err != nil)
+		if err != nil {
+			w.reportError(fmt.Errorf("probe %d: %w", i, err))
+			continue
+		}
+		if holds == w.firing[i] {
+			continue
+		}
+		w.firing[i] = holds
+		ev := Event{
+			Time:    time.Now().UTC(),
+			Probe:   i,
+			Command: executor.FormatPlanned(pc),
+			State:   Firing,
+			Message: pc.Alert.Message,
+		}
+		if holds {
+			ev.Output = redact.String(truncate(res.Output, maxEventOutput))
+			if res.Err != nil {
+				ev.Error = redact.String(res.Err.Error())
+			}
+		} else {
+			ev.State = Resolved
+		}
+		events = append(events, ev)
+		for _, n := range w.Notifiers {
+			if err := n.Notify(ctx, ev); err != nil {
+				w.reportError(err)
+			}
+		}
+	}
+	return events
+}
+
+// Run checks the probes every Interval until ctx is done or, if rounds is
+// positive, after that many rounds.
+func (w *Watcher) Run(ctx context.Context, rounds int) {
+	for n := 1; ; n++ {
+		w.Check(ctx)
+		if rounds > 0 && n >= rounds {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.Interval):
+		}
+	}
+}
+
+func (w *Watcher) reportError(err error) {
+	if w.OnError != nil {
+		w.OnError(err)
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,161 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+)
+
+func TestValidate(t *testing.T) {
+	probe := func(argv []string, a *plan.Alert) plan.Plan {
+		return plan.Plan{Commands: []plan.PlannedCommand{{Command: argv, Alert: a}}}
+	}
+	cases := []struct {
+		name string
+		p    plan.Plan
+		ok   bool
+	}{
+		{"ok", probe([]string{"ubus", "call", "network.interface.wan", "status"}, &plan.Alert{Missing: `"up": true`}), true},
+		{"no probes", plan.Plan{}, false},
+		{"no alert", probe([]string{"uptime"}, nil), false},
+		{"no criteria", probe([]string{"uptime"}, &plan.Alert{Message: "x"}), false},
+		{"write", probe([]string{"uci", "set", "network.wan.proto=dhcp"}, &plan.Alert{Failed: true}), false},
+		{"bad pattern", probe([]string{"uptime"}, &plan.Alert{Pattern: "("}), false},
+		{"bad op", probe([]string{"uptime"}, &plan.Alert{Pattern: "x", Op: "=~"}), false},
+		{"op without pattern", probe([]string{"uptime"}, &plan.Alert{Failed: true, Op: ">"}), false},
+	}
+	for _, c := range cases {
+		err := Validate(c.p)
+		if c.ok != (err == nil) {
+			t.Errorf("%s: Validate() = %v", c.name, err)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	leases := "1700000000 aa:bb a b *\n1700000001 cc:dd c d *\n1700000002 ee:ff e f *\n"
+	cases := []struct {
+		name   string
+		a      plan.Alert
+		output string
+		failed bool
+		want   bool
+	}{
+		{"failed", plan.Alert{Failed: true}, "", true, true},
+		{"not failed", plan.Alert{Failed: true}, "", false, false},
+		{"contains", plan.Alert{Contains: "DOWN"}, "eth1: DOWN", false, true},
+		{"missing", plan.Alert{Missing: `"up": true`}, `{"up": false}`, false, true},
+		{"present", plan.Alert{Missing: `"up": true`}, `{"up": true}`, false, false},
+		{"match", plan.Alert{Pattern: `(?i)link is down`}, "Link is down", false, true},
+		{"count", plan.Alert{Pattern: `(?m)^\d+ `, Op: ">=", Value: 3}, leases, false, true},
+		{"count below", plan.Alert{Pattern: `(?m)^\d+ `, Op: ">=", Value: 4}, leases, false, false},
+		{"capture", plan.Alert{Pattern: `MemAvailable:\s+(\d+)`, Op: "<", Value: 10240}, "MemAvailable:    8000 kB", false, true},
+		{"capture ok", plan.Alert{Pattern: `MemAvailable:\s+(\d+)`, Op: "<", Value: 10240}, "MemAvailable:   50000 kB", false, false},
+		{"capture missing", plan.Alert{Pattern: `MemAvailable:\s+(\d+)`, Op: "<", Value: 10240}, "", false, false},
+	}
+	for _, c := range cases {
+		got, err := Evaluate(c.a, c.output, c.failed)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got != c.want {
+			t.Errorf("%s: Evaluate() = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	if _, err := Evaluate(plan.Alert{Pattern: `state: (\w+)`, Op: ">", Value: 1}, "state: up", false); err == nil {
+		t.Error("expected error for non-numeric capture")
+	}
+}
+
+type recorder struct{ events []Event }
+
+func (r *recorder) Notify(ctx context.Context, ev Event) error {
+	r.events = append(r.events, ev)
+	return nil
+}
+
+func TestWatcher_StateChanges(t *testing.T) {
+	// WAN status per round: up, down, down, up
+	outputs := []string{`{"up": true}`, `{"up": false}`, `{"up": false}`, `{"up": true}`}
+	round := 0
+	rec := &recorder{}
+	var out strings.Builder
+	w := &Watcher{
+		Probes: []plan.PlannedCommand{{
+			Command: []string{"ubus", "call", "network.interface.wan", "status"},
+			Alert:   &plan.Alert{Message: "WAN is down", Missing: `"up": true`},
+		}},
+		Exec: func(ctx context.Context, i int, pc plan.PlannedCommand) executor.Result {
+			return executor.Result{Index: i, Command: pc.Command, Output: outputs[round]}
+		},
+		Notifiers: []Notifier{rec, WriterNotifier{W: &out}},
+	}
+	var states []string
+	for round = range outputs {
+		for _, ev := range w.Check(context.Background()) {
+			states = append(states, ev.State)
+		}
+	}
+	if strings.Join(states, ",") != "firing,resolved" {
+		t.Fatalf("unexpected transitions %v", states)
+	}
+	if len(rec.events) != 2 || rec.events[0].Message != "WAN is down" || rec.events[0].Output != `{"up": false}` {
+		t.Fatalf("unexpected events %+v", rec.events)
+	}
+	if !strings.Contains(out.String(), "[ALERT] WAN is down") || !strings.Contains(out.String(), "[RESOLVED] WAN is down") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var got Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	if err := (Webhook{URL: srv.URL}).Notify(context.Background(), Event{Probe: 1, State: Firing, Message: "Low memory"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got.Probe != 1 || got.Message != "Low memory" {
+		t.Fatalf("unexpected payload %+v", got)
+	}
+
+	fail := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer fail.Close()
+	err := (Webhook{URL: fail.URL}).Notify(context.Background(), Event{})
+	if err == nil || !strings.Contains(err.Error(), "HTTP 500") {
+		t.Fatalf("expected HTTP error, got %v", err)
+	}
+}
+
+func TestWatcher_ReportsErrors(t *testing.T) {
+	var errs []error
+	w := &Watcher{
+		Probes: []plan.PlannedCommand{{Command: []string{"cat", "/proc/meminfo"}, Alert: &plan.Alert{Pattern: `(\w+)`, Op: "<", Value: 1}}},
+		Exec: func(ctx context.Context, i int, pc plan.PlannedCommand) executor.Result {
+			return executor.Result{Output: "abc", Err: errors.New("boom")}
+		},
+		OnError: func(err error) { errs = append(errs, err) },
+	}
+	if evs := w.Check(context.Background()); len(evs) != 0 {
+		t.Fatalf("unexpected events %+v", evs)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected one reported error, got %v", errs)
+	}
+}
@@ -0,0 +1,269 @@
+package wizard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+// Answers are the answers to the wizard's questions, for setting up
+// LuciCodex without a terminal, as image builders and provisioning tools
+// do (see RunAnswers). Unset answers take the wizard's defaults.
+type Answers struct {
+	// Target is where the configuration goes: "json" (the default), the
+	// config file Path, or "uci", the lucicodex.main section
+	Target   string `json:"target,omitempty"`
+	Path     string `json:"path,omitempty"` // Default /etc/lucicodex/config.json
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	APIKey   string `json:"api_key"`
+	// KeyFile keeps the API key out of the configuration, in a file
+	// readable only by its owner
+	KeyFile        string `json:"key_file,omitempty"`
+	DryRun         *bool  `json:"dry_run,omitempty"` // Default true
+	AutoApprove    bool   `json:"auto_approve,omitempty"`
+	MaxCommands    int    `json:"max_commands,omitempty"`
+	Timeout        int    `json:"timeout,omitempty"`
+	ElevateCommand string `json:"elevate_command,omitempty"`
+	// SkipProviderTest saves the configuration without checking that the
+	// provider can be reached, as for an image built offline
+	SkipProviderTest bool `json:"skip_provider_test,omitempty"`
+}
+
+// AnswersEnvPrefix starts the environment variables that answer the
+// wizard's questions, such as LUCICODEX_SETUP_PROVIDER for Provider: the
+// JSON name of the answer in upper case.
+const AnswersEnvPrefix = "LUCICODEX_SETUP_"
+
+// LoadAnswers reads the answers in the JSON file path, "-" for stdin or ""
+// for none, and overrides them with the LUCICODEX_SETUP_* variables found
+// by getenv.
+func LoadAnswers(path string, stdin io.Reader, getenv func(string) string) (Answers, error) {
+	var a Answers
+	if path != "" {
+		var data []byte
+		var err error
+		if path == "-" {
+			data, err = io.ReadAll(stdin)
+		} else {
+			data, err = os.ReadFile(path)
+		}
+		if err != nil {
+			return a, errcode.Errorf(errcode.InvalidRequest, "read answers: %v", err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&a); err != nil {
+			return a, errcode.Errorf(errcode.InvalidRequest, "parse answers %s: %v", path, err)
+		}
+	}
+
+	var errs []error
+	str := func(name string, dst *string) {
+		if v := getenv(AnswersEnvPrefix + name); v != "" {
+			*dst = v
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v := getenv(AnswersEnvPrefix + name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s%s: %q is not a boolean", AnswersEnvPrefix, name, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v := getenv(AnswersEnvPrefix + name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s%s: %q is not a number", AnswersEnvPrefix, name, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	str("TARGET", &a.Target)
+	str("PATH", &a.Path)
+	str("PROVIDER", &a.Provider)
+	str("MODEL", &a.Model)
+	str("ENDPOINT", &a.Endpoint)
+	str("API_KEY", &a.APIKey)
+	str("KEY_FILE", &a.KeyFile)
+	if v := getenv(AnswersEnvPrefix + "DRY_RUN"); v != "" {
+		var dryRun bool
+		boolean("DRY_RUN", &dryRun)
+		a.DryRun = &dryRun
+	}
+	boolean("AUTO_APPROVE", &a.AutoApprove)
+	integer("MAX_COMMANDS", &a.MaxCommands)
+	integer("TIMEOUT", &a.Timeout)
+	str("ELEVATE_COMMAND", &a.ElevateCommand)
+	boolean("SKIP_PROVIDER_TEST", &a.SkipProviderTest)
+	if len(errs) > 0 {
+		return a, errcode.Wrap(errcode.InvalidRequest, errors.Join(errs...))
+	}
+	return a, nil
+}
+
+// defaultModels are the models the wizard proposes.
+var defaultModels = map[string]string{
+	"gemini":    "gemini-3-flash",
+	"openai":    "gpt-5-mini",
+	"anthropic": "claude-haiku-4-5-20251001",
+}
+
+// Validate checks every answer and reports all the problems at once.
+func (a Answers) Validate() error {
+	var errs []error
+	switch a.Target {
+	case "", "json":
+	case "uci":
+		if a.Path != "" {
+			errs = append(errs, errors.New("path is only valid for target json"))
+		}
+		if a.AutoApprove || a.ElevateCommand != "" {
+			errs = append(errs, errors.New("auto_approve and elevate_command have no UCI option; use target json"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("target must be json or uci, got %q", a.Target))
+	}
+	if _, ok := defaultModels[a.Provider]; !ok {
+		errs = append(errs, fmt.Errorf("provider must be gemini, openai or anthropic, got %q", a.Provider))
+	}
+	if strings.TrimSpace(a.APIKey) == "" {
+		errs = append(errs, errors.New("api_key is required"))
+	}
+	if a.AutoApprove && (a.DryRun == nil || *a.DryRun) {
+		errs = append(errs, errors.New("auto_approve requires dry_run false"))
+	}
+	if a.MaxCommands != 0 && (a.MaxCommands < 1 || a.MaxCommands > 50) {
+		errs = append(errs, fmt.Errorf("max_commands must be between 1 and 50, got %d", a.MaxCommands))
+	}
+	if a.Timeout != 0 && (a.Timeout < 5 || a.Timeout > 300) {
+		errs = append(errs, fmt.Errorf("timeout must be between 5 and 300 seconds, got %d", a.Timeout))
+	}
+	if len(errs) > 0 {
+		return errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("invalid answers: %w", errors.Join(errs...)))
+	}
+	return nil
+}
+
+// config returns the wizard's configuration with the answers applied.
+func (a Answers) config() config.Config {
+	cfg := defaults()
+	cfg.Provider = a.Provider
+	cfg.Model = a.Model
+	if cfg.Model == "" {
+		cfg.Model = defaultModels[a.Provider]
+	}
+	switch a.Provider {
+	case "openai":
+		cfg.OpenAIAPIKey, cfg.OpenAIEndpoint = a.APIKey, a.Endpoint
+	case "anthropic":
+		cfg.AnthropicAPIKey, cfg.AnthropicEndpoint = a.APIKey, a.Endpoint
+	default:
+		cfg.APIKey = a.APIKey
+		if a.Endpoint != "" {
+			cfg.Endpoint = a.Endpoint
+		}
+	}
+	if a.DryRun != nil {
+		cfg.DryRun = *a.DryRun
+	}
+	cfg.AutoApprove = a.AutoApprove
+	if a.MaxCommands != 0 {
+		cfg.MaxCommands = a.MaxCommands
+	}
+	if a.Timeout != 0 {
+		cfg.TimeoutSeconds = a.Timeout
+	}
+	cfg.ElevateCommand = a.ElevateCommand
+	return cfg
+}
+
+// writeUCI is config.SetUCI; tests replace it.
+var writeUCI = config.SetUCI
+
+// uciOptions returns the lucicodex.main options for cfg, with the API key
+// replaced by api_key_file if keyFile is set.
+func uciOptions(cfg config.Config, keyFile string) map[string]string {
+	prefix := map[string]string{"openai": "openai_", "anthropic": "anthropic_"}[cfg.Provider]
+	keyOption := map[string]string{"openai": "openai_key", "anthropic": "anthropic_key"}[cfg.Provider]
+	if keyOption == "" {
+		keyOption = "key"
+	}
+	opts := map[string]string{
+		"provider":       cfg.Provider,
+		prefix + "model": cfg.Model,
+		"dry_run":        "0",
+		"timeout":        strconv.Itoa(cfg.TimeoutSeconds),
+		"max_commands":   strconv.Itoa(cfg.MaxCommands),
+	}
+	if cfg.DryRun {
+		opts["dry_run"] = "1"
+	}
+	endpoint := cfg.Endpoint
+	switch cfg.Provider {
+	case "openai":
+		endpoint = cfg.OpenAIEndpoint
+	case "anthropic":
+		endpoint = cfg.AnthropicEndpoint
+	}
+	if endpoint != "" {
+		opts[prefix+"endpoint"] = endpoint
+	}
+	if keyFile != "" {
+		opts["api_key_file"] = keyFile
+	} else {
+		opts[keyOption] = providerKey(cfg)
+	}
+	return opts
+}
+
+// RunAnswers sets LuciCodex up from a without asking anything: it checks
+// every answer, tests the provider like the interactive wizard unless
+// SkipProviderTest is set, and saves the configuration to the target.
+func (w *Wizard) RunAnswers(a Answers) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	cfg := a.config()
+	if a.SkipProviderTest {
+		fmt.Fprintf(w.writer, "Skipping the provider test\n")
+	} else {
+		if err := checkProvider(cfg); err != nil {
+			return err
+		}
+		fmt.Fprintf(w.writer, "✓ %s endpoint reachable\n", cfg.Provider)
+	}
+
+	if a.Target == "uci" {
+		if a.KeyFile != "" {
+			if err := config.WriteKeyFile(a.KeyFile, map[string]string{config.ProviderKeyName(cfg.Provider): providerKey(cfg)}); err != nil {
+				return fmt.Errorf("write key file: %w", err)
+			}
+			fmt.Fprintf(w.writer, "✓ API key saved to %s\n", a.KeyFile)
+		}
+		if err := writeUCI(uciOptions(cfg, a.KeyFile)); err != nil {
+			return err
+		}
+		fmt.Fprintf(w.writer, "✓ Configuration saved to UCI (lucicodex.main)\n")
+		return nil
+	}
+	path := a.Path
+	if path == "" {
+		path = "/etc/lucicodex/config.json"
+	}
+	return w.writeJSON(path, cfg, a.KeyFile)
+}
@@ -0,0 +1,148 @@
+package wizard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+)
+
+func TestLoadAnswers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "answers.json")
+	os.WriteFile(path, []byte(`{"target": "uci", "provider": "gemini", "api_key": "file-key", "max_commands": 5}`), 0o600)
+	env := map[string]string{
+		"LUCICODEX_SETUP_PROVIDER": "openai",
+		"LUCICODEX_SETUP_DRY_RUN":  "false",
+		"LUCICODEX_SETUP_TIMEOUT":  "60",
+	}
+	a, err := LoadAnswers(path, nil, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Target != "uci" || a.Provider != "openai" || a.APIKey != "file-key" || a.MaxCommands != 5 || a.Timeout != 60 || a.DryRun == nil || *a.DryRun {
+		t.Errorf("unexpected answers %+v", a)
+	}
+
+	// Answers on stdin, and only from the environment
+	if a, err := LoadAnswers("-", strings.NewReader(`{"provider": "anthropic"}`), func(string) string { return "" }); err != nil || a.Provider != "anthropic" {
+		t.Errorf("stdin answers = %+v, %v", a, err)
+	}
+	if a, err := LoadAnswers("", nil, func(k string) string { return env[k] }); err != nil || a.Provider != "openai" {
+		t.Errorf("environment answers = %+v, %v", a, err)
+	}
+
+	os.WriteFile(path, []byte(`{"provider": "gemini", "max_cmds": 5}`), 0o600)
+	if _, err := LoadAnswers(path, nil, func(string) string { return "" }); errcode.Of(err) != errcode.InvalidRequest || !strings.Contains(err.Error(), "max_cmds") {
+		t.Errorf("expected unknown answers to be rejected, got %v", err)
+	}
+	env["LUCICODEX_SETUP_AUTO_APPROVE"] = "maybe"
+	if _, err := LoadAnswers("", nil, func(k string) string { return env[k] }); err == nil || !strings.Contains(err.Error(), "LUCICODEX_SETUP_AUTO_APPROVE") {
+		t.Errorf("expected a bad boolean to be rejected, got %v", err)
+	}
+}
+
+func TestAnswers_Validate(t *testing.T) {
+	yes := true
+	a := Answers{Target: "uci", Path: "/tmp/x.json", Provider: "mistral", AutoApprove: true, DryRun: &yes, MaxCommands: 99, Timeout: 1}
+	err := a.Validate()
+	if errcode.Of(err) != errcode.InvalidRequest {
+		t.Fatalf("expected an invalid request, got %v", err)
+	}
+	for _, want := range []string{"path is only valid", "no UCI option", "provider must be", "api_key is required", "requires dry_run false", "max_commands", "timeout"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error lacks %q: %v", want, err)
+		}
+	}
+	if err := (Answers{Provider: "gemini", APIKey: "k"}).Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestWizard_RunAnswers_JSON(t *testing.T) {
+	dir := t.TempDir()
+	no := false
+	a := Answers{
+		Path:        filepath.Join(dir, "config.json"),
+		Provider:    "anthropic",
+		APIKey:      "sk-ant",
+		KeyFile:     filepath.Join(dir, "keys"),
+		DryRun:      &no,
+		AutoApprove: true,
+		MaxCommands: 7,
+	}
+	var out bytes.Buffer
+	if err := New(strings.NewReader(""), &out).RunAnswers(a); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(a.Path)
+	var cfg config.Config
+	json.Unmarshal(data, &cfg)
+	if cfg.Provider != "anthropic" || cfg.Model != "claude-haiku-4-5-20251001" || cfg.DryRun || !cfg.AutoApprove || cfg.MaxCommands != 7 || cfg.TimeoutSeconds != 30 {
+		t.Errorf("unexpected config %s", data)
+	}
+	if cfg.AnthropicAPIKey != "" || cfg.APIKeyFile != a.KeyFile {
+		t.Errorf("expected the key in the key file, got %s", data)
+	}
+	if keys, _ := config.ReadKeyFile(a.KeyFile); keys[config.KeyAnthropic] != "sk-ant" {
+		t.Errorf("key file = %v", keys)
+	}
+	if !strings.Contains(out.String(), "anthropic endpoint reachable") {
+		t.Errorf("expected the provider test to be reported:\n%s", out.String())
+	}
+}
+
+func TestWizard_RunAnswers_UCI(t *testing.T) {
+	var got map[string]string
+	orig := writeUCI
+	writeUCI = func(options map[string]string) error { got = options; return nil }
+	defer func() { writeUCI = orig }()
+
+	a := Answers{Target: "uci", Provider: "openai", APIKey: "sk-1", Endpoint: "https://proxy.example/v1", SkipProviderTest: true}
+	var out bytes.Buffer
+	if err := New(strings.NewReader(""), &out).RunAnswers(a); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"provider": "openai", "openai_key": "sk-1", "openai_model": "gpt-5-mini",
+		"openai_endpoint": "https://proxy.example/v1", "dry_run": "1", "timeout": "30", "max_commands": "10",
+	}
+	if len(got) != len(want) {
+		t.Errorf("options = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("option %s = %q, want %q", k, got[k], v)
+		}
+	}
+	if !strings.Contains(out.String(), "Skipping the provider test") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestWizard_RunAnswers_ProviderTestFails(t *testing.T) {
+	orig := probeProvider
+	probeProvider = func(ctx context.Context, cfg config.Config) error { return errors.New("no route to host") }
+	defer func() { probeProvider = orig }()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := New(strings.NewReader(""), &bytes.Buffer{}).RunAnswers(Answers{Path: path, Provider: "gemini", APIKey: "k"})
+	if errcode.Of(err) != errcode.LLMUnavailable {
+		t.Errorf("expected LLM_UNAVAILABLE, got %v", err)
+	}
+	if _, statErr := os.Stat(path); statErr == nil {
+		t.Error("nothing may be written when the provider test fails")
+	}
+
+	// The interactive wizard asks whether to go on
+	input := "1\n\nkey\nn\n"
+	if err := New(strings.NewReader(input), &bytes.Buffer{}).Run(); errcode.Of(err) != errcode.LLMUnavailable {
+		t.Errorf("expected the interactive wizard to stop, got %v", err)
+	}
+}
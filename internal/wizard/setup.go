@@ -2,26 +2,44 @@ package wizard
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/llm"
 )
 
+// errInterrupted is returned when Ctrl-C is pressed at a secret prompt.
+var errInterrupted = errors.New("setup interrupted")
+
+// rawMode switches a terminal to raw mode; a var so tests can fake a terminal.
+var rawMode = makeRaw
+
 type Wizard struct {
 	reader *bufio.Reader
 	writer io.Writer
+	fd     int // Terminal file descriptor of reader, -1 if not a file
 }
 
 func New(reader io.Reader, writer io.Writer) *Wizard {
+	fd := -1
+	if f, ok := reader.(*os.File); ok {
+		fd = int(f.Fd())
+	}
 	return &Wizard{
 		reader: bufio.NewReader(reader),
 		writer: writer,
+		fd:     fd,
 	}
 }
 
@@ -30,7 +48,35 @@ func (w *Wizard) Run() error {
 	fmt.Fprintf(w.writer, "===============\n\n")
 	fmt.Fprintf(w.writer, "This wizard will help you configure LuciCodex for your OpenWrt router.\n\n")
 
-	cfg := config.Config{
+	cfg := defaults()
+
+	// Step 1: Choose provider
+	if err := w.setupProvider(&cfg); err != nil {
+		return err
+	}
+
+	// Step 2: Configure API credentials
+	if err := w.setupCredentials(&cfg); err != nil {
+		return err
+	}
+
+	// Step 3: Test the provider
+	if err := w.testProvider(cfg); err != nil {
+		return err
+	}
+
+	// Step 4: Security settings
+	if err := w.setupSecurity(&cfg); err != nil {
+		return err
+	}
+
+	// Step 5: Save configuration
+	return w.saveConfig(cfg)
+}
+
+// defaults returns the configuration the wizard starts from.
+func defaults() config.Config {
+	return config.Config{
 		Author:         "AZ <Aezi.zhu@icloud.com>",
 		Endpoint:       "https://generativelanguage.googleapis.com/v1beta",
 		Model:          "gemini-3-flash",
@@ -63,24 +109,6 @@ func (w *Wizard) Run() error {
 		LogFile:        "/tmp/lucicodex.log",
 		ElevateCommand: "",
 	}
-
-	// Step 1: Choose provider
-	if err := w.setupProvider(&cfg); err != nil {
-		return err
-	}
-
-	// Step 2: Configure API credentials
-	if err := w.setupCredentials(&cfg); err != nil {
-		return err
-	}
-
-	// Step 3: Security settings
-	if err := w.setupSecurity(&cfg); err != nil {
-		return err
-	}
-
-	// Step 4: Save configuration
-	return w.saveConfig(cfg)
 }
 
 func (w *Wizard) setupProvider(cfg *config.Config) error {
@@ -113,24 +141,59 @@ func (w *Wizard) setupProvider(cfg *config.Config) error {
 func (w *Wizard) setupCredentials(cfg *config.Config) error {
 	fmt.Fprintf(w.writer, "Step 2: Configure Credentials\n")
 
+	var err error
 	switch cfg.Provider {
 	case "gemini":
 		fmt.Fprintf(w.writer, "Get your API key from: https://aistudio.google.com/app/apikey\n")
-		cfg.APIKey = w.readString("Gemini API key", "")
+		cfg.APIKey, err = w.readSecret("Gemini API key (input hidden)")
 	case "openai":
 		fmt.Fprintf(w.writer, "Get your API key from: https://platform.openai.com/api-keys\n")
-		cfg.OpenAIAPIKey = w.readString("OpenAI API key", "")
+		cfg.OpenAIAPIKey, err = w.readSecret("OpenAI API key (input hidden)")
 	case "anthropic":
 		fmt.Fprintf(w.writer, "Get your API key from: https://console.anthropic.com/\n")
-		cfg.AnthropicAPIKey = w.readString("Anthropic API key", "")
+		cfg.AnthropicAPIKey, err = w.readSecret("Anthropic API key (input hidden)")
+	}
+	if err != nil {
+		return err
 	}
 
 	fmt.Fprintf(w.writer, "✓ Credentials configured\n\n")
 	return nil
 }
 
+// probeProvider is llm.Probe; tests replace it.
+var probeProvider = llm.Probe
+
+// testProvider checks that the endpoint of the provider answers. If it does
+// not, the user decides whether to go on anyway, as for a router that is
+// set up before it is connected.
+func (w *Wizard) testProvider(cfg config.Config) error {
+	fmt.Fprintf(w.writer, "Step 3: Test Provider\n")
+	if err := checkProvider(cfg); err != nil {
+		fmt.Fprintf(w.writer, "✗ %v\n", err)
+		if !w.readBool("Continue anyway?", false) {
+			return err
+		}
+		fmt.Fprintf(w.writer, "\n")
+		return nil
+	}
+	fmt.Fprintf(w.writer, "✓ %s endpoint reachable\n\n", cfg.Provider)
+	return nil
+}
+
+// checkProvider is the provider test of the interactive and the
+// non-interactive setup (see llm.Probe).
+func checkProvider(cfg config.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := probeProvider(ctx, cfg); err != nil {
+		return errcode.Wrap(errcode.LLMUnavailable, err)
+	}
+	return nil
+}
+
 func (w *Wizard) setupSecurity(cfg *config.Config) error {
-	fmt.Fprintf(w.writer, "Step 3: Security Settings\n")
+	fmt.Fprintf(w.writer, "Step 4: Security Settings\n")
 
 	dryRun := w.readBool("Enable dry-run mode by default? (recommended)", true)
 	cfg.DryRun = dryRun
@@ -156,7 +219,7 @@ func (w *Wizard) setupSecurity(cfg *config.Config) error {
 }
 
 func (w *Wizard) saveConfig(cfg config.Config) error {
-	fmt.Fprintf(w.writer, "Step 4: Save Configuration\n")
+	fmt.Fprintf(w.writer, "Step 5: Save Configuration\n")
 
 	paths := []string{
 		"/etc/lucicodex/config.json",
@@ -175,26 +238,45 @@ func (w *Wizard) saveConfig(cfg config.Config) error {
 
 	configPath := paths[choice-1]
 
-	// Create directory if needed
+	// Keep the key out of the config so it can be shared or backed up freely
+	keyFile := filepath.Join(filepath.Dir(configPath), "keys")
+	if providerKey(cfg) == "" || !w.readBool(fmt.Sprintf("Store the API key in %s, readable only by its owner?", keyFile), true) {
+		keyFile = ""
+	}
+	if err := w.writeJSON(configPath, cfg, keyFile); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w.writer, "Setup complete! You can now run:\n")
+	fmt.Fprintf(w.writer, "  lucicodex \"restart wifi\"\n")
+	fmt.Fprintf(w.writer, "  lucicodex -interactive\n\n")
+
+	return nil
+}
+
+// writeJSON saves cfg as the JSON config file configPath. With a keyFile,
+// the API key goes there instead, readable only by its owner.
+func (w *Wizard) writeJSON(configPath string, cfg config.Config, keyFile string) error {
 	if err := os.MkdirAll(filepath.Dir(configPath), 0o755); err != nil {
 		return fmt.Errorf("create config directory: %w", err)
 	}
+	if key := providerKey(cfg); key != "" && keyFile != "" {
+		if err := config.WriteKeyFile(keyFile, map[string]string{config.ProviderKeyName(cfg.Provider): key}); err != nil {
+			return fmt.Errorf("write key file: %w", err)
+		}
+		cfg.APIKeyFile = keyFile
+		cfg.APIKey, cfg.OpenAIAPIKey, cfg.AnthropicAPIKey = "", "", ""
+		fmt.Fprintf(w.writer, "✓ API key saved to %s\n", keyFile)
+	}
 
-	// Save config
 	data, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshal config: %w", err)
 	}
-
 	if err := os.WriteFile(configPath, data, 0o600); err != nil {
 		return fmt.Errorf("write config: %w", err)
 	}
-
 	fmt.Fprintf(w.writer, "✓ Configuration saved to %s\n\n", configPath)
-	fmt.Fprintf(w.writer, "Setup complete! You can now run:\n")
-	fmt.Fprintf(w.writer, "  lucicodex \"restart wifi\"\n")
-	fmt.Fprintf(w.writer, "  lucicodex -interactive\n\n")
-
 	return nil
 }
 
@@ -218,6 +300,64 @@ func (w *Wizard) readString(prompt, defaultValue string) string {
 	return line
 }
 
+// providerKey returns the API key entered for the selected provider.
+func providerKey(cfg config.Config) string {
+	switch cfg.Provider {
+	case "openai":
+		return cfg.OpenAIAPIKey
+	case "anthropic":
+		return cfg.AnthropicAPIKey
+	default:
+		return cfg.APIKey
+	}
+}
+
+// readSecret reads a value without echoing it. On a terminal the input is read
+// in raw mode, handling backspace, Ctrl-U and Ctrl-C here; otherwise (piped
+// input, unsupported platforms) it falls back to reading a plain line.
+func (w *Wizard) readSecret(prompt string) (string, error) {
+	fmt.Fprintf(w.writer, "%s: ", prompt)
+
+	restore, err := rawMode(w.fd)
+	if err != nil {
+		line, _ := w.reader.ReadString('\n')
+		return strings.TrimSpace(line), nil
+	}
+	defer func() {
+		restore()
+		fmt.Fprintln(w.writer)
+	}()
+
+	var buf []byte
+	for {
+		b, err := w.reader.ReadByte()
+		if err != nil {
+			return strings.TrimSpace(string(buf)), nil
+		}
+		switch b {
+		case '\r', '\n':
+			return strings.TrimSpace(string(buf)), nil
+		case 0x03: // Ctrl-C
+			return "", errInterrupted
+		case 0x04: // Ctrl-D
+			if len(buf) == 0 {
+				return "", nil
+			}
+		case 0x7f, 0x08: // Backspace
+			if len(buf) > 0 {
+				_, size := utf8.DecodeLastRune(buf)
+				buf = buf[:len(buf)-size]
+			}
+		case 0x15: // Ctrl-U
+			buf = buf[:0]
+		default:
+			if b >= 0x20 {
+				buf = append(buf, b)
+			}
+		}
+	}
+}
+
 func (w *Wizard) readBool(prompt string, defaultValue bool) bool {
 	defaultStr := "n"
 	if defaultValue {
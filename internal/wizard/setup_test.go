@@ -2,6 +2,8 @@ package wizard
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -11,6 +13,12 @@ import (
 	"github.com/aezizhu/LuciCodex/internal/config"
 )
 
+func TestMain(m *testing.M) {
+	// The provider test must not depend on the network
+	probeProvider = func(ctx context.Context, cfg config.Config) error { return nil }
+	os.Exit(m.Run())
+}
+
 func TestWizard_Retry(t *testing.T) {
 	// Test readBool retry
 	input := "invalid\ny\n"
@@ -402,3 +410,76 @@ type errorReader struct {
 func (e *errorReader) Read(p []byte) (n int, err error) {
 	return 0, e.err
 }
+
+func TestWizard_readSecret(t *testing.T) {
+	orig := rawMode
+	defer func() { rawMode = orig }()
+
+	// Piped input falls back to a plain line
+	rawMode = func(fd int) (func(), error) { return nil, errors.New("not a terminal") }
+	w := New(strings.NewReader("piped-key\n"), io.Discard)
+	if got, err := w.readSecret("Key"); err != nil || got != "piped-key" {
+		t.Errorf("fallback: got %q, %v", got, err)
+	}
+
+	restored := 0
+	rawMode = func(fd int) (func(), error) { return func() { restored++ }, nil }
+	var out bytes.Buffer
+	w = New(strings.NewReader("abx\x7fc\x15sk-12\x7f3\r"), &out)
+	got, err := w.readSecret("Key")
+	if err != nil || got != "sk-13" {
+		t.Errorf("raw mode editing: got %q, %v", got, err)
+	}
+	if strings.Contains(out.String(), "sk-1") {
+		t.Errorf("secret echoed: %q", out.String())
+	}
+
+	w = New(strings.NewReader("abc\x03"), io.Discard)
+	if _, err := w.readSecret("Key"); err != errInterrupted {
+		t.Errorf("expected errInterrupted on Ctrl-C, got %v", err)
+	}
+	if restored != 2 {
+		t.Errorf("terminal restored %d times, want 2", restored)
+	}
+}
+
+func TestWizard_Run_KeyFile(t *testing.T) {
+	input := "1\n" + // Provider: Gemini
+		"\n" + // Model default
+		"secret-key\n" + // API Key
+		"\n" + // Dry run default
+		"\n" + // Max commands default
+		"\n" + // Timeout default
+		"\n" + // Elevation default
+		"2\n" + // Save to HOME/.config
+		"y\n" // Store key in key file
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("GEMINI_API_KEY", "")
+
+	if err := New(strings.NewReader(input), io.Discard).Run(); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	dir := filepath.Join(home, ".config", "lucicodex")
+	raw, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "secret-key") {
+		t.Errorf("API key written to the config file: %s", raw)
+	}
+	st, err := os.Stat(filepath.Join(dir, "keys"))
+	if err != nil || st.Mode().Perm() != 0o600 {
+		t.Fatalf("expected key file with mode 0600, got %v, %v", st, err)
+	}
+
+	cfg, err := config.Load(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.APIKey != "secret-key" {
+		t.Errorf("expected key from key file, got %q", cfg.APIKey)
+	}
+}
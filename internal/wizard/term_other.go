@@ -0,0 +1,11 @@
+//go:build !linux
+
+package wizard
+
+import "errors"
+
+// makeRaw is only implemented for Linux; elsewhere secrets are read as
+// plain lines.
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode not supported on this platform")
+}
@@ -108,8 +108,21 @@ local function get_auth_token()
     return ""
 end
 
+-- Helper to get the daemon's Unix socket path from UCI ("" means TCP)
+local function get_socket_path()
+    local uci = require "luci.model.uci".cursor()
+    for _, section in ipairs({ "main", "@settings[0]", "@api[0]" }) do
+        local val = uci:get("lucicodex", section, "socket_path")
+        -- The path is quoted for the shell below, so refuse embedded quotes
+        if val and val ~= "" and not val:find("'", 1, true) then
+            return val
+        end
+    end
+    return ""
+end
+
 -- Helper to call local daemon
-local function call_daemon(endpoint, payload)
+local function call_daemon(endpoint, payload, idempotency_key)
     local json = require "luci.jsonc"
     local os = require "os"
     local io = require "io"
@@ -140,10 +153,37 @@ local function call_daemon(endpoint, payload)
     if auth_token ~= "" then
         auth_header = string.format("-H 'X-Auth-Token: %s' ", auth_token)
     end
+    -- Lets the daemon replay the result instead of running a plan twice
+    if idempotency_key and idempotency_key:match("^[%w%-_.:]+$") then
+        auth_header = auth_header .. string.format("-H 'Idempotency-Key: %s' ", idempotency_key)
+    end
+    -- Tells the daemon's audit log which admin and device asked: the
+    -- browser's user agent, the LuCI user with the start of the session ID,
+    -- and the browser's address (used when the daemon trusts this proxy)
+    local http = require "luci.http"
+    local ua = (http.getenv("HTTP_USER_AGENT") or ""):gsub("[^%w %.%-_/;:,()+]", ""):sub(1, 256)
+    if ua ~= "" then
+        auth_header = auth_header .. string.format("-A '%s' ", ua)
+    end
+    local ctx = require("luci.dispatcher").context
+    local user, sid = ctx.authuser or "", ctx.authsession or ""
+    if user:match("^[%w%-_.]+$") and sid:match("^%x+$") then
+        auth_header = auth_header .. string.format("-H 'X-LuCI-Session: %s:%s' ", user, sid:sub(1, 8))
+    end
+    local remote = http.getenv("REMOTE_ADDR") or ""
+    if remote:match("^[%x.:]+$") then
+        auth_header = auth_header .. string.format("-H 'X-Forwarded-For: %s' ", remote)
+    end
 
     -- Use curl to talk to daemon (timeout 300s)
     -- Use -sS for silent but show errors
-    local cmd = string.format("curl -sS -m 300 -X POST %s-H 'Content-Type: application/json' --data-binary @%s http://127.0.0.1:9999%s 2>&1", auth_header, tmpfile, endpoint)
+    -- Connect through the daemon's Unix socket when one is configured
+    local target = "http://127.0.0.1:9999"
+    local socket_path = get_socket_path()
+    if socket_path ~= "" then
+        target = string.format("--unix-socket '%s' http://localhost", socket_path)
+    end
+    local cmd = string.format("curl -sS -m 300 -X POST %s-H 'Content-Type: application/json' --data-binary @%s %s%s 2>&1", auth_header, tmpfile, target, endpoint)
     local handle = io.popen(cmd)
     local result = handle:read("*a")
     handle:close()
@@ -205,7 +245,8 @@ function action_plan()
         provider_name = "Anthropic"
     end
 
-    if not provider_key or provider_key == "" then
+    -- The local model needs no key
+    if provider ~= "local" and (not provider_key or provider_key == "") then
         http.status(400, "Bad Request")
         http.write_json({
             error = "Missing " .. provider_name .. " API key",
@@ -226,7 +267,9 @@ function action_plan()
             gemini_key = keys.gemini,
             openai_key = keys.openai,
             anthropic_key = keys.anthropic
-        }
+        },
+        clarifications = data.clarifications,
+        clarify_round = data.clarify_round
     }
     
     local resp, err = call_daemon("/v1/plan", payload)
@@ -255,7 +298,15 @@ function action_plan()
     local argv = {"/usr/bin/lucicodex", "-json", "-dry-run"}
     if data.provider and data.provider ~= "" then table.insert(argv, "-provider=" .. data.provider) end
     if data.model and data.model ~= "" then table.insert(argv, "-model=" .. data.model) end
-    table.insert(argv, data.prompt)
+    -- The CLI takes the answers to the model's questions as part of the prompt
+    local prompt = data.prompt
+    if type(data.clarifications) == "table" and #data.clarifications > 0 then
+        prompt = prompt .. "\n\nClarifications:"
+        for _, c in ipairs(data.clarifications) do
+            prompt = prompt .. "\nQ: " .. tostring(c.question or "") .. "\nA: " .. tostring(c.answer or "")
+        end
+    end
+    table.insert(argv, prompt)
     
     local stdout_r, stdout_w = nixio.pipe()
     local stderr_r, stderr_w = nixio.pipe()
@@ -330,6 +381,8 @@ function action_execute()
         dry_run = data.dry_run,
         timeout = tonumber(data.timeout),
         commands = data.commands,  -- Pass commands for direct execution
+        facts = data.facts,  -- Stamp of the plan the commands came from
+        ack_warnings = data.ack_warnings,  -- User reviewed the plan's policy warnings
         config = {
             gemini_key = keys.gemini,
             openai_key = keys.openai,
@@ -337,7 +390,7 @@ function action_execute()
         }
     }
 
-    local resp, err = call_daemon("/v1/execute", payload)
+    local resp, err = call_daemon("/v1/execute", payload, data.idempotency_key)
     if resp then
         http.prepare_content("application/json")
         http.write_json(resp)
@@ -69,6 +69,7 @@ o = s:option(ListValue, "provider", translate("Active Provider"))
 o:value("gemini", label("Google Gemini", has_gemini))
 o:value("openai", label("OpenAI (GPT-5)", has_openai))
 o:value("anthropic", label("Anthropic (Claude)", has_anthropic))
+o:value("local", translate("Local model (offline)"))
 o.default = "gemini"
 o.description = translate("Select your preferred AI provider. Make sure to configure the corresponding API key below.")
 
@@ -168,6 +169,61 @@ o.default = "10"
 o.rmempty = true
 o.description = translate("Maximum number of commands the AI can generate in a single plan. Default: 10")
 
+o = s:option(Value, "max_read_commands", translate("Maximum Diagnostic Commands"))
+o.datatype = "uinteger"
+o.placeholder = "20"
+o.rmempty = true
+o.description = translate("Limit for read-only requests such as status checks and troubleshooting. 0 uses Maximum Commands. Default: 20")
+
+o = s:option(Value, "max_write_commands", translate("Maximum Change Commands"))
+o.datatype = "uinteger"
+o.placeholder = "5"
+o.rmempty = true
+o.description = translate("Limit for requests that change configuration or restart services. 0 uses Maximum Commands. Default: 5")
+
+o = s:option(ListValue, "control_guard", translate("Protect Own Connection"))
+o:value("confirm", translate("Ask twice"))
+o:value("block", translate("Block"))
+o:value("off", translate("Off"))
+o.default = "confirm"
+o.rmempty = true
+o.description = translate("What to do with commands that would take down the interface or firewall zone your SSH or web session uses. Default: ask twice")
+
+o = s:option(ListValue, "ap_guard", translate("Access Point Guard"))
+o:value("confirm", translate("Ask"))
+o:value("block", translate("Block"))
+o:value("off", translate("Off"))
+o.default = "confirm"
+o.rmempty = true
+o.description = translate("What to do with DHCP and firewall changes when this device is a dumb access point, whose upstream router owns them. Default: ask")
+
+o = s:option(ListValue, "firewall_guard", translate("Firewall Conflict Guard"))
+o:value("block", translate("Block"))
+o:value("confirm", translate("Ask"))
+o:value("off", translate("Off"))
+o.default = "block"
+o.rmempty = true
+o.description = translate("What to do with plans adding a port forward or firewall rule that duplicates an existing one or is shadowed by it. Default: block")
+
+o = s:option(Value, "approval_command", translate("Approval Command"))
+o.placeholder = "/usr/bin/approve-via-telegram"
+o.rmempty = true
+o.description = translate("Program asked to approve every plan before it runs, e.g. through a push notification or chat bot. It reads the plan as JSON on stdin; exit status 0 approves it")
+
+o = s:option(Value, "approval_timeout", translate("Approval Timeout"))
+o.datatype = "uinteger"
+o.placeholder = "300"
+o.rmempty = true
+o.description = translate("Seconds to wait for the approval command before rejecting the plan")
+
+o = s:option(ListValue, "lint_block", translate("Block Lint Findings"))
+o:value("off", translate("Never"))
+o:value("error", translate("Errors"))
+o:value("warning", translate("Warnings and errors"))
+o.default = "off"
+o.rmempty = true
+o.description = translate("Reject plans with likely mistakes, such as quotes in UCI values or opening the wan zone, of this severity. Findings are always shown")
+
 --[[
 ================================================================================
 SECTION 4: Advanced Settings (collapsed by default conceptually)
@@ -209,6 +265,148 @@ o = s:option(Value, "anthropic_endpoint", translate("Anthropic API Endpoint"))
 o.placeholder = "https://api.anthropic.com/v1"
 o.rmempty = true
 
+-- Local model
+o = s:option(Value, "local_endpoint", translate("Local Model Server"))
+o.placeholder = "http://127.0.0.1:8080"
+o.rmempty = true
+o.description = translate("llama.cpp server used by the local provider")
+
+o = s:option(Value, "local_command", translate("Local Model Command"))
+o.rmempty = true
+o.description = translate("Runs instead of the server, with the prompt on stdin, e.g. llama-cli -m model.gguf -f /dev/stdin")
+
+o = s:option(Flag, "local_fallback", translate("Fall Back to the Local Model"))
+o.rmempty = false
+o.description = translate("Plan with the local model when the cloud provider cannot be reached")
+
+-- Generation parameters
+o = s:option(Value, "temperature", translate("Temperature"))
+o.datatype = "range(0,2)"
+o.placeholder = translate("provider default")
+o.rmempty = true
+o.description = translate("Sampling temperature from 0 to 2. Lower values give tighter, more deterministic plans.")
+
+o = s:option(Value, "top_p", translate("Top P"))
+o.datatype = "and(ufloat,max(1))"
+o.placeholder = translate("provider default")
+o.rmempty = true
+
+o = s:option(Value, "max_output_tokens", translate("Maximum Output Tokens"))
+o.datatype = "uinteger"
+o.placeholder = translate("provider default")
+o.rmempty = true
+
+o = s:option(ListValue, "reasoning_effort", translate("Reasoning Effort (OpenAI)"))
+o:value("", translate("Provider default"))
+o:value("minimal", "minimal")
+o:value("low", "low")
+o:value("medium", "medium")
+o:value("high", "high")
+o.rmempty = true
+o.description = translate("Only for OpenAI reasoning models.")
+
+o = s:option(Value, "thinking_budget", translate("Thinking Budget (Anthropic/Gemini)"))
+o.datatype = "uinteger"
+o.placeholder = "0"
+o.rmempty = true
+o.description = translate("Tokens the model may spend thinking before answering. 0 disables extended thinking.")
+
+-- Key file
+o = s:option(Value, "api_key_file", translate("API Key File"))
+o.placeholder = "/etc/lucicodex/keys"
+o.rmempty = true
+o.description = translate("Optional owner-only (chmod 600) file with GEMINI_API_KEY=, OPENAI_API_KEY= and ANTHROPIC_API_KEY= lines. Keys in it override the ones above, so they need not be stored in UCI.")
+
+-- File commands
+o = s:option(DynamicList, "file_paths", translate("File Paths"))
+o.placeholder = "/etc/config"
+o.rmempty = true
+o.description = translate("Directories the built-in file.read/file.write commands and MCP file tools may access. Default: /etc/config and /tmp.")
+
+o = s:option(Value, "file_max_bytes", translate("Maximum File Size"))
+o.datatype = "uinteger"
+o.placeholder = "65536"
+o.rmempty = true
+o.description = translate("Largest file, in bytes, that can be read or written.")
+
+o = s:option(Value, "file_backup_dir", translate("File Backup Directory"))
+o.placeholder = "/tmp/lucicodex-backups"
+o.rmempty = true
+o.description = translate("Overwritten files are copied here first.")
+
+-- Command environment
+o = s:option(DynamicList, "env_passthrough", translate("Passed Environment Variables"))
+o.placeholder = "http_proxy"
+o.rmempty = true
+o.description = translate("Commands only get PATH. These variables of the LuciCodex environment, e.g. TERM, HOME or http_proxy, are passed on as well.")
+
+o = s:option(DynamicList, "command_env", translate("Command Environment"))
+o.placeholder = "opkg:http_proxy=http://proxy:3128"
+o.rmempty = true
+o.description = translate("Variables set for one command, as command:NAME=value; use * as the command to set them for all. Values cannot contain spaces.")
+
+-- Daemon transport
+o = s:option(Value, "socket_path", translate("Daemon Socket"))
+o.placeholder = "/var/run/lucicodex.sock"
+o.rmempty = true
+o.description = translate("Serve the daemon API on this Unix socket (owner-only) instead of 127.0.0.1:9999, so other local users cannot reach it. Restart the lucicodex service after changing it.")
+
+o = s:option(DynamicList, "trusted_proxies", translate("Trusted Proxies"))
+o.placeholder = "127.0.0.1"
+o.rmempty = true
+o.description = translate("Reverse proxies (IP, CIDR, or 'unix' for socket peers) whose X-Forwarded-For header identifies the real client for rate limiting and logs. Restart the lucicodex service after changing it.")
+
+-- Watch mode
+o = s:option(Value, "watch_interval", translate("Watch Interval"))
+o.datatype = "uinteger"
+o.placeholder = "60"
+o.rmempty = true
+o.description = translate("Seconds between probe rounds of 'lucicodex watch'.")
+
+o = s:option(DynamicList, "watch_webhook", translate("Watch Webhooks"))
+o.datatype = "string"
+o.placeholder = "https://hooks.example.com/router"
+o.rmempty = true
+o.description = translate("URLs that receive 'lucicodex watch' alerts as JSON POST requests.")
+
+-- Digest
+o = s:option(Value, "digest_interval", translate("Digest Interval"))
+o.datatype = "uinteger"
+o.placeholder = "86400"
+o.rmempty = true
+o.description = translate("Seconds between digests sent by 'lucicodex schedule digest'.")
+
+o = s:option(DynamicList, "digest_webhook", translate("Digest Webhooks"))
+o.datatype = "string"
+o.placeholder = "https://hooks.example.com/daily"
+o.rmempty = true
+o.description = translate("URLs that receive each digest of recent activity as a JSON POST request.")
+
+-- Execution artifacts
+o = s:option(Value, "artifacts_dir", translate("Artifacts Directory"))
+o.placeholder = "/tmp/lucicodex-artifacts"
+o.rmempty = true
+o.description = translate("Each execution runs its commands in a subdirectory of this path, which keeps the files they create.")
+
+o = s:option(Value, "artifacts_max_mb", translate("Artifacts Size Limit (MB)"))
+o.datatype = "uinteger"
+o.placeholder = "16"
+o.rmempty = true
+
+o = s:option(Value, "artifacts_retention_days", translate("Artifacts Retention (days)"))
+o.datatype = "uinteger"
+o.placeholder = "7"
+o.rmempty = true
+
+-- Facts API
+o = s:option(MultiValue, "facts_redact", translate("Redact Facts Fields"))
+o:value("hostname", translate("Hostname"))
+o:value("ssid", translate("Wireless SSIDs"))
+o:value("ipv4", translate("IPv4 addresses"))
+o:value("ipv6", translate("IPv6 addresses"))
+o.rmempty = true
+o.description = translate("Fields hidden from the daemon's GET /v1/facts endpoint. Wireless keys are never included.")
+
 -- Logging
 o = s:option(Value, "log_file", translate("Log File Path"))
 o.placeholder = "/tmp/lucicodex.log"
@@ -0,0 +1,477 @@
+// Package client is a typed Go client of the LuciCodex daemon API, for the
+// LuCI backend, test harnesses and other tools that talk to a running
+// `lucicodex serve` instead of embedding LuciCodex (see pkg/lucicodex).
+//
+//	c := client.New("http://127.0.0.1:9999", "")  // reads the daemon's token file
+//	prompt := "show the WAN address"
+//	resp, err := c.Plan(ctx, client.PlanRequest{Prompt: prompt})
+//	if err != nil {
+//	    log.Fatal(err) // client.CodeOf(err) classifies it
+//	}
+//	// Review resp.Plan.Commands and resp.Plan.PolicyWarnings, then
+//	res, err := c.Execute(ctx, client.ForPlan(prompt, resp.Plan, true))
+//
+// Failures that are safe to repeat (connection errors, 429 and 502 to 504)
+// are retried; executions carry an Idempotency-Key, so the daemon runs a
+// retried plan at most once.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/dashboard"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/export"
+	"github.com/aezizhu/LuciCodex/internal/llm"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/rollback"
+)
+
+// DefaultTokenFile is where the daemon writes its own token.
+const DefaultTokenFile = "/tmp/.lucicodex.token"
+
+// Defaults of Client.Retries and Client.RetryWait.
+const (
+	DefaultRetries   = 2
+	DefaultRetryWait = 500 * time.Millisecond
+)
+
+// Plan is the plan of a request, as in the CLI's JSON output.
+type Plan = plan.Plan
+
+// Command is one planned command.
+type Command = plan.PlannedCommand
+
+// Check is the outcome of a verification command of the plan.
+type Check = executor.Check
+
+// SummaryCommand is an executed command and its output, for Summarize.
+type SummaryCommand = llm.SummaryCommand
+
+// Execution is one execution of the audit log, as History returns it.
+type Execution = export.Execution
+
+// Dashboard is what `lucicodex top` shows of the daemon.
+type Dashboard = dashboard.Snapshot
+
+// Health is the outcome of the daemon's health checks.
+type Health = dashboard.Health
+
+// Code classifies a failure; see the error codes table of the README.
+type Code = errcode.Code
+
+// Rollback is a pending network change that the daemon reverts unless it
+// is confirmed before Deadline.
+type Rollback = rollback.State
+
+// Client calls one daemon. Its fields may be changed until the first call.
+type Client struct {
+	// BaseURL is the daemon's address, such as "http://127.0.0.1:9999", or
+	// "unix:///var/run/lucicodex.sock" for a daemon on a Unix socket.
+	BaseURL string
+	// Token is the daemon token or an API token. If it is empty it is read
+	// from TokenFile, and read again when the daemon refuses it, since a
+	// restarted daemon has a new one.
+	Token     string
+	TokenFile string
+	// HTTPClient sends the requests; nil uses one made for BaseURL.
+	HTTPClient *http.Client
+	// Retries is the number of attempts after the first for failures that
+	// are safe to repeat, waiting RetryWait, then twice as long each time.
+	Retries   int
+	RetryWait time.Duration
+}
+
+// New returns a client of the daemon at baseURL. With an empty token it
+// uses the token the daemon writes to DefaultTokenFile, which works on the
+// router itself.
+func New(baseURL, token string) *Client {
+	c := &Client{BaseURL: strings.TrimRight(baseURL, "/"), Token: token, Retries: DefaultRetries, RetryWait: DefaultRetryWait}
+	if token == "" {
+		c.TokenFile = DefaultTokenFile
+	}
+	return c
+}
+
+// Error is a request the daemon refused or failed, with its error code.
+type Error struct {
+	StatusCode int // HTTP status; 0 for errors on the WebSocket
+	Code       Code
+	Message    string
+	Hint       string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// CodeOf returns the error code of err if it is an *Error, and "" otherwise.
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// PlanRequest asks for a plan (POST /v1/plan). Provider, Model and the API
+// keys in Config ("gemini_key", "openai_key", "anthropic_key") override the
+// daemon's configuration for this request.
+type PlanRequest struct {
+	Prompt   string            `json:"prompt"`
+	Provider string            `json:"provider,omitempty"`
+	Model    string            `json:"model,omitempty"`
+	Config   map[string]string `json:"config,omitempty"`
+	// Answers to the questions of earlier responses to the same prompt, and
+	// the number of rounds they took
+	Clarifications []prompts.Clarification `json:"clarifications,omitempty"`
+	ClarifyRound   int                     `json:"clarify_round,omitempty"`
+}
+
+// PlanResponse is the daemon's plan, checked against its policy.
+type PlanResponse struct {
+	Plan Plan `json:"plan"`
+	// Diffs of the files that file.write commands would change, by command
+	FilePreviews map[int]string `json:"file_previews,omitempty"`
+	// Set when the plan asks questions: how many rounds of answers the
+	// daemon accepts
+	ClarifyRounds int `json:"clarify_rounds,omitempty"`
+}
+
+// ExecuteRequest runs a plan (POST /v1/execute): Commands of an earlier
+// plan with its Version and Facts, or, without Commands, a plan the daemon
+// generates for Prompt.
+type ExecuteRequest struct {
+	Prompt      string            `json:"prompt,omitempty"`
+	Provider    string            `json:"provider,omitempty"`
+	Model       string            `json:"model,omitempty"`
+	Config      map[string]string `json:"config,omitempty"`
+	DryRun      bool              `json:"dry_run,omitempty"`
+	Timeout     int               `json:"timeout,omitempty"` // Seconds per command
+	Commands    []Command         `json:"commands,omitempty"`
+	Version     int               `json:"version,omitempty"`
+	Facts       *openwrt.Stamp    `json:"facts,omitempty"`
+	AckWarnings bool              `json:"ack_warnings,omitempty"`
+}
+
+// ForPlan returns the request executing p as planned, acknowledging its
+// policy warnings if ack is set.
+func ForPlan(prompt string, p Plan, ack bool) ExecuteRequest {
+	return ExecuteRequest{Prompt: prompt, Commands: p.Commands, Version: p.Version, Facts: p.Facts, AckWarnings: ack}
+}
+
+// ExecuteResponse is the outcome of an execution.
+type ExecuteResponse struct {
+	ID     string  `json:"id"` // Execution ID in the audit log and artifacts
+	Result Results `json:"result"`
+	// The checked plan, for dry runs and plans without commands
+	Plan    *Plan  `json:"plan,omitempty"`
+	DryRun  bool   `json:"dry_run,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Set when the plan changed the network: POST /v1/confirm before the
+	// deadline keeps the change
+	Rollback *Rollback `json:"rollback,omitempty"`
+}
+
+// Results are the outcomes of the commands of a plan.
+type Results struct {
+	Items  []Result `json:"Items"`
+	Failed int      `json:"Failed"`
+	// Checks are the outcomes of the plan's verify commands; Verified is
+	// set when there were some and all passed
+	Checks   []Check `json:"Checks"`
+	Verified bool    `json:"Verified"`
+}
+
+// Result is the outcome of one command.
+type Result struct {
+	Index     int           `json:"Index"`
+	Command   []string      `json:"Command"`
+	Output    string        `json:"Output"` // Stdout and stderr combined
+	Stdout    string        `json:"Stdout"`
+	Stderr    string        `json:"Stderr"`
+	ExitCode  int           `json:"ExitCode"` // -1 if the command did not exit by itself
+	Signal    string        `json:"Signal"`
+	Elapsed   time.Duration `json:"Elapsed"`
+	Truncated bool          `json:"Truncated"`
+	JobID     string        `json:"JobID"` // Set for background jobs
+	Artifacts []string      `json:"Artifacts"`
+	Skipped   bool          `json:"Skipped"` // Not run because the plan's time budget was spent
+	Started   time.Time     `json:"Started"`
+	Finished  time.Time     `json:"Finished"`
+	// Failed is set when the command returned an error; the daemon does not
+	// send its text, so see ExitCode, Signal and Stderr
+	Failed bool `json:"-"`
+}
+
+// UnmarshalJSON decodes a result of the daemon, which encodes the error of
+// a failed command as a non-null Err.
+func (r *Result) UnmarshalJSON(b []byte) error {
+	type plain Result
+	var v struct {
+		plain
+		Err json.RawMessage `json:"Err"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*r = Result(v.plain)
+	r.Failed = len(v.Err) > 0 && string(v.Err) != "null"
+	return nil
+}
+
+// SummarizeRequest asks for a summary of executed commands (POST
+// /v1/summarize).
+type SummarizeRequest struct {
+	Prompt   string            `json:"prompt"`
+	Context  string            `json:"context,omitempty"`
+	Provider string            `json:"provider,omitempty"`
+	Model    string            `json:"model,omitempty"`
+	Config   map[string]string `json:"config,omitempty"`
+	Commands []SummaryCommand  `json:"commands"`
+}
+
+// SummarizeResponse is the model's answer to the request from the outputs.
+type SummarizeResponse struct {
+	Summary string   `json:"summary"`
+	Details []string `json:"details"`
+}
+
+// Plan asks the daemon for a plan. It runs nothing.
+func (c *Client) Plan(ctx context.Context, req PlanRequest) (*PlanResponse, error) {
+	var resp PlanResponse
+	if err := c.call(ctx, http.MethodPost, "/v1/plan", req, "", &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Execute runs a plan and returns when all its commands have finished.
+// A plan with policy warnings needs AckWarnings.
+func (c *Client) Execute(ctx context.Context, req ExecuteRequest) (*ExecuteResponse, error) {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+	var resp ExecuteResponse
+	if err := c.call(ctx, http.MethodPost, "/v1/execute", req, key, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Summarize asks the model to answer the request from the outputs of the
+// commands.
+func (c *Client) Summarize(ctx context.Context, req SummarizeRequest) (*SummarizeResponse, error) {
+	var resp SummarizeResponse
+	if err := c.call(ctx, http.MethodPost, "/v1/summarize", req, "", &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// History returns the executions of the audit log in the last since,
+// oldest first (GET /v1/history/export).
+func (c *Client) History(ctx context.Context, since time.Duration) ([]Execution, error) {
+	q := url.Values{"format": {"json"}, "since": {since.String()}}
+	var out []Execution
+	if err := c.call(ctx, http.MethodGet, "/v1/history/export?"+q.Encode(), nil, "", &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Dashboard returns the daemon's health, the execution in progress, jobs,
+// recent LLM latency and recent executions (GET /v1/dashboard).
+func (c *Client) Dashboard(ctx context.Context) (*Dashboard, error) {
+	var out struct {
+		Dashboard Dashboard `json:"dashboard"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/v1/dashboard", nil, "", &out); err != nil {
+		return nil, err
+	}
+	return &out.Dashboard, nil
+}
+
+// Health runs the daemon's health checks (GET /health?verbose=1). It needs
+// no token, and a daemon whose checks failed answers too.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	base, httpClient := c.transport()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/health?verbose=1", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var h Health
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		return nil, fmt.Errorf("invalid response from /health: %w", err)
+	}
+	return &h, nil
+}
+
+// call sends a request with body as JSON and decodes the response into out,
+// retrying the failures that are safe to repeat.
+func (c *Client) call(ctx context.Context, method, path string, body interface{}, idempotencyKey string, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	wait := c.RetryWait
+	if wait <= 0 {
+		wait = DefaultRetryWait
+	}
+	reread := c.TokenFile != ""
+	for attempt := 0; ; attempt++ {
+		status, data, err := c.send(ctx, method, path, payload, idempotencyKey)
+		if err == nil && status == http.StatusUnauthorized && reread {
+			// A restarted daemon has a new token; this does not count as a retry
+			reread = false
+			c.Token = ""
+			attempt--
+			continue
+		}
+		if err == nil && status < 300 {
+			if err := json.Unmarshal(data, out); err != nil {
+				return fmt.Errorf("invalid response from %s: %w", path, err)
+			}
+			return nil
+		}
+		if err == nil {
+			err = responseError(status, data)
+		}
+		if attempt >= c.Retries || !retryable(status, err) || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(wait << attempt):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// send makes one attempt; a status of 0 means no response arrived.
+func (c *Client) send(ctx context.Context, method, path string, payload []byte, idempotencyKey string) (int, []byte, error) {
+	base, httpClient := c.transport()
+	req, err := http.NewRequestWithContext(ctx, method, base+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	token, err := c.token()
+	if err != nil {
+		return 0, nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+// token returns Token, reading it from TokenFile first if it is empty.
+func (c *Client) token() (string, error) {
+	if c.Token == "" && c.TokenFile != "" {
+		b, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return "", &Error{Code: errcode.Unauthorized, Message: "no daemon token: " + err.Error()}
+		}
+		c.Token = strings.TrimSpace(string(b))
+	}
+	return c.Token, nil
+}
+
+// transport returns the URL prefix of requests and the HTTP client sending
+// them, which dials the socket for a unix:// BaseURL.
+func (c *Client) transport() (string, *http.Client) {
+	socket, isUnix := strings.CutPrefix(c.BaseURL, "unix://")
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{}
+		if isUnix {
+			c.HTTPClient.Transport = &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			}
+		}
+	}
+	if isUnix {
+		return "http://unix", c.HTTPClient
+	}
+	return c.BaseURL, c.HTTPClient
+}
+
+// retryable reports whether a failed attempt may be repeated: the request
+// did not get an answer, or the daemon was overloaded or unavailable.
+func retryable(status int, err error) bool {
+	switch status {
+	case 0:
+		var e *Error
+		return !errors.As(err, &e) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// responseError decodes the error body of a response with status.
+func responseError(status int, data []byte) error {
+	var body errcode.Body
+	if err := json.Unmarshal(data, &body); err != nil || body.Error == "" {
+		msg := strings.TrimSpace(string(data))
+		if msg == "" {
+			msg = http.StatusText(status)
+		}
+		return &Error{StatusCode: status, Message: "HTTP " + strconv.Itoa(status) + ": " + msg}
+	}
+	return &Error{StatusCode: status, Code: body.Code, Message: body.Error, Hint: body.Hint}
+}
+
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "client-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,169 @@
+package client_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/logging"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/server"
+	"github.com/aezizhu/LuciCodex/pkg/client"
+)
+
+func newDaemon(t *testing.T) (*server.Server, *client.Client) {
+	t.Helper()
+	logFile := filepath.Join(t.TempDir(), "history.log")
+	logger := logging.New(logFile).WithExecution("logged")
+	logger.Plan("show the time", plan.Plan{Commands: []plan.PlannedCommand{{Command: []string{"date"}}}})
+	logger.Results([]logging.ResultItem{{Command: []string{"date"}, Elapsed: time.Second}})
+	s := server.New(config.Config{
+		Denylist:       []string{`^rm(\s|$)`},
+		TimeoutSeconds: 10,
+		LogFile:        logFile,
+	})
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, client.New(ts.URL, s.GetToken())
+}
+
+func TestExecuteAndHistory(t *testing.T) {
+	_, c := newDaemon(t)
+	ctx := context.Background()
+
+	resp, err := c.Execute(ctx, client.ExecuteRequest{Prompt: "greet", Commands: []client.Command{
+		{Command: []string{"echo", "hello"}},
+		{Command: []string{"false"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := resp.Result.Items
+	if resp.ID == "" || len(items) != 2 || resp.Result.Failed != 1 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if items[0].Failed || !strings.Contains(items[0].Output, "hello") || !items[1].Failed || items[1].ExitCode != 1 {
+		t.Errorf("unexpected results: %+v", items)
+	}
+
+	_, err = c.Execute(ctx, client.ExecuteRequest{Commands: []client.Command{{Command: []string{"rm", "-rf", "/tmp/x"}}}})
+	if client.CodeOf(err) != "POLICY_DENY" {
+		t.Errorf("expected a policy denial, got %v", err)
+	}
+
+	history, err := c.History(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].ID != "logged" || history[0].Commands[0] != "date" || history[0].DurationMs != 1000 {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	// Executions through the daemon are logged too
+	if history[1].ID != resp.ID || history[1].Status != "failed" || history[2].Status != "rejected" {
+		t.Errorf("unexpected history: %+v", history)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	_, c := newDaemon(t)
+	d, err := c.Dashboard(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Source != "daemon" || d.Daemon == nil || len(d.Recent) != 1 || d.Recent[0].Prompt != "show the time" {
+		t.Errorf("unexpected dashboard: %+v", d)
+	}
+
+	// Health needs no token
+	h, err := client.New(c.BaseURL, "unused").Health(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Status != d.Daemon.Status || h.Checks["lock"].Status != "ok" {
+		t.Errorf("unexpected health: %+v", h)
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	s, c := newDaemon(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	c.Token = "stale"
+	c.TokenFile = tokenFile
+	if _, err := c.History(context.Background(), time.Hour); client.CodeOf(err) != "UNAUTHORIZED" {
+		t.Fatalf("missing token file: %v", err)
+	}
+
+	if err := os.WriteFile(tokenFile, []byte(s.GetToken()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.Token = "stale"
+	if _, err := c.History(context.Background(), time.Hour); err != nil {
+		t.Errorf("token should be read again after a 401: %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Idempotency-Key") == "" {
+			t.Error("execute should carry an Idempotency-Key")
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id":"x","result":{"Items":[{"Index":0,"Err":null}],"Failed":0}}`))
+	}))
+	defer ts.Close()
+
+	c := client.New(ts.URL, "token")
+	c.RetryWait = time.Millisecond
+	resp, err := c.Execute(context.Background(), client.ExecuteRequest{Prompt: "x"})
+	if err != nil || resp.ID != "x" || resp.Result.Items[0].Failed || calls != 3 {
+		t.Fatalf("expected success on the third attempt: %v %+v (%d calls)", err, resp, calls)
+	}
+
+	calls = 0
+	c.Retries = 1
+	if _, err := c.Execute(context.Background(), client.ExecuteRequest{Prompt: "x"}); err == nil || calls != 2 {
+		t.Errorf("expected failure after one retry: %v (%d calls)", err, calls)
+	}
+}
+
+func TestExecuteStream(t *testing.T) {
+	_, c := newDaemon(t)
+	var types []string
+	var output []string
+	var result client.CommandResult
+	err := c.ExecuteStream(context.Background(), client.ExecuteRequest{Commands: []client.Command{
+		{Command: []string{"echo", "streamed"}},
+	}}, func(e client.Event) error {
+		types = append(types, e.Type)
+		switch e.Type {
+		case "exec_output":
+			output = append(output, e.Text())
+		case "exec_result":
+			return e.Decode(&result)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types[len(types)-1] != "done" || !strings.Contains(strings.Join(output, "\n"), "streamed") || !result.Success {
+		t.Errorf("unexpected stream: %v %q %+v", types, output, result)
+	}
+
+	c.Token = "wrong"
+	err = c.ExecuteStream(context.Background(), client.ExecuteRequest{Prompt: "x"}, func(client.Event) error { return nil })
+	if client.CodeOf(err) != "UNAUTHORIZED" {
+		t.Errorf("expected an unauthorized error, got %v", err)
+	}
+}
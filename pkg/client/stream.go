@@ -0,0 +1,308 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Event is a message of a streamed execution. Its Type is one of "status",
+// "plan", "dry_run", "approval_pending", "rollback_armed", "exec_start",
+// "exec_cmd", "exec_output", "exec_result", "verify" and "done".
+type Event struct {
+	Type    string          `json:"type"`
+	Index   int             `json:"index,omitempty"`   // Command index of exec_* events
+	Command string          `json:"command,omitempty"` // Command of exec_cmd events
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Decode decodes the data of e into v: a Plan for plan and dry_run events,
+// a CommandResult for exec_result, a Verification for verify, a string for
+// status and exec_output.
+func (e Event) Decode(v interface{}) error {
+	if len(e.Data) == 0 {
+		return fmt.Errorf("%s event has no data", e.Type)
+	}
+	return json.Unmarshal(e.Data, v)
+}
+
+// Text returns the data of e if it is a string, such as the output line of
+// an exec_output event, and "" otherwise.
+func (e Event) Text() string {
+	var s string
+	if json.Unmarshal(e.Data, &s) != nil {
+		return ""
+	}
+	return s
+}
+
+// CommandResult is the data of an exec_result event.
+type CommandResult struct {
+	Success  bool   `json:"success"`
+	Output   string `json:"output"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+	Signal   string `json:"signal,omitempty"`
+	JobID    string `json:"job_id,omitempty"`
+	Elapsed  string `json:"elapsed"`
+}
+
+// Verification is the data of a verify event, sent after the commands when
+// the plan has verify commands.
+type Verification struct {
+	Verified bool    `json:"verified"`
+	Checks   []Check `json:"checks"`
+}
+
+// ExecuteStream runs a plan like Execute over the WebSocket API (/v1/ws),
+// passing each event to handle as it arrives, the output of the commands
+// line by line included. It returns nil after the done event, or the first
+// error of the daemon or of handle. It is not retried, since the plan may
+// have started running.
+func (c *Client) ExecuteStream(ctx context.Context, req ExecuteRequest, handle func(Event) error) error {
+	ws, err := c.dialWS(ctx)
+	if err != nil {
+		return err
+	}
+	defer ws.conn.Close()
+	stop := context.AfterFunc(ctx, func() { ws.conn.Close() })
+	defer stop()
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	id, err := newIdempotencyKey()
+	if err != nil {
+		return err
+	}
+	msg, _ := json.Marshal(map[string]interface{}{"type": "execute", "id": id, "payload": json.RawMessage(payload)})
+	if err := ws.write(wsOpText, msg); err != nil {
+		return err
+	}
+	for {
+		data, err := ws.read()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				return errors.New("daemon closed the stream before the execution was done")
+			}
+			return err
+		}
+		var m struct {
+			Event
+			Error string `json:"error"`
+			Code  Code   `json:"code"`
+			Hint  string `json:"hint"`
+		}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("invalid event: %w", err)
+		}
+		if m.Type == "error" {
+			return &Error{Code: m.Code, Message: m.Error, Hint: m.Hint}
+		}
+		if err := handle(m.Event); err != nil {
+			return err
+		}
+		if m.Type == "done" {
+			return nil
+		}
+	}
+}
+
+// WebSocket opcodes used by the daemon.
+const (
+	wsOpText  = 1
+	wsOpClose = 8
+	wsOpPing  = 9
+	wsOpPong  = 10
+)
+
+// maxFrameSize bounds the frames read, which carry a plan or an output line.
+const maxFrameSize = 16 << 20
+
+// wsConn is the client end of a WebSocket connection to the daemon.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialWS connects to /v1/ws, reading the token again once if the daemon
+// refuses it, as call does.
+func (c *Client) dialWS(ctx context.Context) (*wsConn, error) {
+	ws, status, err := c.handshake(ctx)
+	if status == http.StatusUnauthorized && c.TokenFile != "" {
+		c.Token = ""
+		ws, _, err = c.handshake(ctx)
+	}
+	return ws, err
+}
+
+// handshake opens the connection and upgrades it. The status is that of a
+// refused upgrade.
+func (c *Client) handshake(ctx context.Context) (*wsConn, int, error) {
+	token, err := c.token()
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, host, err := c.dial(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	key := make([]byte, 16)
+	rand.Read(key)
+	req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/v1/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if token != "" {
+		req.Header.Set("X-Auth-Token", token)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+		return nil, resp.StatusCode, responseError(resp.StatusCode, body)
+	}
+	h := sha1.New()
+	h.Write([]byte(base64.StdEncoding.EncodeToString(key) + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(h.Sum(nil)) {
+		conn.Close()
+		return nil, 0, errors.New("invalid WebSocket handshake")
+	}
+	return &wsConn{conn: conn, r: r}, 0, nil
+}
+
+// dial connects to the daemon of BaseURL and returns the Host of requests.
+func (c *Client) dial(ctx context.Context) (net.Conn, string, error) {
+	if socket, ok := strings.CutPrefix(c.BaseURL, "unix://"); ok {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", socket)
+		return conn, "unix", err
+	}
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return nil, "", err
+	}
+	addr := u.Host
+	switch {
+	case u.Scheme == "https":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+		d := tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		return conn, u.Host, err
+	case u.Scheme == "http":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		return conn, u.Host, err
+	}
+	return nil, "", fmt.Errorf("unsupported daemon URL %q", c.BaseURL)
+}
+
+// write sends one frame, masked as clients must.
+func (ws *wsConn) write(opcode byte, data []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(data); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n < 65536:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+	for i, b := range data {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// read returns the payload of the next data frame, answering pings. A close
+// frame is io.EOF.
+func (ws *wsConn) read() ([]byte, error) {
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(ws.r, header); err != nil {
+			return nil, err
+		}
+		opcode := header[0] & 0x0F
+		n := uint64(header[1] & 0x7F)
+		switch n {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(ws.r, ext); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(ws.r, ext); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext)
+		}
+		var mask []byte
+		if header[1]&0x80 != 0 {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(ws.r, mask); err != nil {
+				return nil, err
+			}
+		}
+		if n > maxFrameSize {
+			return nil, fmt.Errorf("WebSocket frame of %d bytes is too large", n)
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(ws.r, payload); err != nil {
+			return nil, err
+		}
+		if mask != nil {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch opcode {
+		case wsOpClose:
+			return nil, io.EOF
+		case wsOpPing:
+			if err := ws.write(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+		case wsOpPong:
+		default:
+			return payload, nil
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Package lucicodex is the public Go API of LuciCodex, for programs that
+// want plan generation and policy-checked execution without running the
+// CLI or the daemon.
+//
+// A request goes through the same steps as `lucicodex run`:
+//
+//	cfg, err := lucicodex.LoadConfig("")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	pol := lucicodex.NewPolicyEngine(cfg)
+//	planner := lucicodex.NewPlanner(cfg, lucicodex.NewProvider(cfg), pol)
+//	p, err := planner.Plan(ctx, "show the WAN address")
+//	if err != nil {
+//	    log.Fatal(err) // lucicodex.CodeOf(err) classifies it
+//	}
+//	// Review p.Commands and p.PolicyWarnings, then
+//	results := lucicodex.NewExecutor(cfg).RunPlan(ctx, p)
+//
+// The names in this package keep their meaning across releases. Config,
+// Plan and the result types are the ones LuciCodex uses internally, so
+// fields may be added to them; none are removed or change meaning.
+package lucicodex
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/aezizhu/LuciCodex/internal/config"
+	"github.com/aezizhu/LuciCodex/internal/errcode"
+	"github.com/aezizhu/LuciCodex/internal/executor"
+	"github.com/aezizhu/LuciCodex/internal/firewall"
+	"github.com/aezizhu/LuciCodex/internal/intent"
+	"github.com/aezizhu/LuciCodex/internal/llm"
+	"github.com/aezizhu/LuciCodex/internal/llm/prompts"
+	"github.com/aezizhu/LuciCodex/internal/openwrt"
+	"github.com/aezizhu/LuciCodex/internal/plan"
+	"github.com/aezizhu/LuciCodex/internal/policy"
+)
+
+// Config is the LuciCodex configuration: provider and credentials, policy
+// lists, timeouts and file locations.
+type Config = config.Config
+
+// Plan is a model's answer to a request: a summary and the commands to run.
+type Plan = plan.Plan
+
+// Command is one planned command. Command holds the argv, which is run
+// without a shell.
+type Command = plan.PlannedCommand
+
+// PolicyWarning is a command the policy allows but wants acknowledged.
+type PolicyWarning = plan.PolicyWarning
+
+// Result is the outcome of one command.
+type Result = executor.Result
+
+// Results are the outcomes of a plan; Failed counts the commands with an
+// error.
+type Results = executor.Results
+
+// Code classifies a failure, as in the CLI's JSON output and exit codes.
+type Code = errcode.Code
+
+// LoadConfig loads the configuration like the CLI does: environment, then
+// UCI, then the JSON file at path (or the default locations if empty),
+// then the built-in defaults.
+func LoadConfig(path string) (Config, error) {
+	return config.Load(path)
+}
+
+// CodeOf returns the Code of an error returned by this package: its own
+// code if it carries one, Internal otherwise, and empty for nil.
+func CodeOf(err error) Code {
+	return errcode.Of(err)
+}
+
+// Provider is a language model client that turns prompts into plans.
+// Implement it to plug in another model.
+type Provider interface {
+	GeneratePlan(ctx context.Context, prompt string) (Plan, error)
+	GenerateErrorFix(ctx context.Context, originalCommand string, errorOutput string, attempt int) (Plan, error)
+}
+
+// NewProvider returns the client of cfg.Provider (gemini, openai or
+// anthropic).
+func NewProvider(cfg Config) Provider {
+	return llm.NewProvider(cfg)
+}
+
+// PolicyEngine decides which commands may run. ValidatePlan and
+// ValidateCommand return an error with Code POLICY_DENY for a blocked
+// command.
+type PolicyEngine interface {
+	ValidatePlan(p Plan) error
+	ValidateCommand(i int, c Command) error
+	Warnings(p Plan) []PolicyWarning
+}
+
+// NewPolicyEngine returns the engine enforcing the allowlist, denylist,
+// warnlist and rules of cfg.
+func NewPolicyEngine(cfg Config) PolicyEngine {
+	return policy.New(cfg)
+}
+
+// Planner turns a request in plain language into a plan that has passed
+// the policy. Plan never runs anything.
+type Planner interface {
+	Plan(ctx context.Context, request string) (Plan, error)
+}
+
+// NewPlanner returns a Planner that prompts provider with the request and
+// the router's facts, and checks the answer with pol.
+func NewPlanner(cfg Config, provider Provider, pol PolicyEngine) Planner {
+	return &planner{cfg: cfg, provider: provider, pol: pol}
+}
+
+type planner struct {
+	cfg      Config
+	provider Provider
+	pol      PolicyEngine
+}
+
+func (p *planner) Plan(ctx context.Context, request string) (Plan, error) {
+	kind, limit := intent.ForPrompt(p.cfg, request)
+	instruction := prompts.GeneratePlanPrompt(kind, limit)
+	instruction += prompts.ExamplesBlock(request, p.cfg.FewShotExamples)
+	instruction += prompts.CommandsBlock(request, p.cfg.CommandSnippets)
+	instruction += firewall.PromptBlock(ctx, request)
+	factsCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	facts := openwrt.CollectSignedFacts(factsCtx, p.cfg.FactsKeyFile)
+	cancel()
+	if block := facts.PromptBlock(); block != "" {
+		instruction += "\n\n" + block
+	}
+
+	out, err := p.provider.GeneratePlan(ctx, instruction+"\n\nUser request: "+request)
+	if err != nil {
+		return out, err
+	}
+	if out, err = llm.FitLimit(ctx, p.provider, instruction+"\n\nUser request: "+request, out, limit); err != nil {
+		return out, err
+	}
+	out.Facts = &facts.Stamp
+	if err := p.pol.ValidatePlan(out); err != nil {
+		return out, err
+	}
+	out.PolicyWarnings = p.pol.Warnings(out)
+	out.Lint = policy.LintPlan(out)
+	return out, nil
+}
+
+// Executor runs commands without a shell, with a minimal environment, the
+// per-command timeout and output limits of the config. It does not check
+// the policy; pass it plans from a Planner or check them first.
+type Executor interface {
+	RunPlan(ctx context.Context, p Plan) Results
+	// RunPlanStreaming is RunPlan writing each command's output to w as
+	// it runs.
+	RunPlanStreaming(ctx context.Context, p Plan, w io.Writer) Results
+	RunCommand(ctx context.Context, index int, c Command) Result
+}
+
+// NewExecutor returns an Executor for cfg.
+func NewExecutor(cfg Config) Executor {
+	return executor.New(cfg)
+}
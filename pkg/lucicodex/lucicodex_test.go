@@ -0,0 +1,60 @@
+package lucicodex_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aezizhu/LuciCodex/pkg/lucicodex"
+)
+
+// fakeProvider answers every request with the same plan.
+type fakeProvider struct {
+	plan   lucicodex.Plan
+	prompt string
+}
+
+func (f *fakeProvider) GeneratePlan(ctx context.Context, prompt string) (lucicodex.Plan, error) {
+	f.prompt = prompt
+	return f.plan, nil
+}
+
+func (f *fakeProvider) GenerateErrorFix(ctx context.Context, cmd, output string, attempt int) (lucicodex.Plan, error) {
+	return lucicodex.Plan{}, nil
+}
+
+func TestPlanAndRun(t *testing.T) {
+	cfg := lucicodex.Config{
+		Provider:       "gemini",
+		TimeoutSeconds: 10,
+		MaxCommands:    5,
+		Denylist:       []string{`^rm(\s|$)`},
+		Warnlist:       []string{`^reboot(\s|$)`},
+	}
+	provider := &fakeProvider{plan: lucicodex.Plan{Summary: "Greet", Commands: []lucicodex.Command{
+		{Command: []string{"echo", "hello"}},
+	}}}
+	pol := lucicodex.NewPolicyEngine(cfg)
+	planner := lucicodex.NewPlanner(cfg, provider, pol)
+
+	p, err := planner.Plan(context.Background(), "say hello")
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if !strings.Contains(provider.prompt, "User request: say hello") || p.Facts == nil {
+		t.Errorf("unexpected prompt or plan: %q, %+v", provider.prompt, p)
+	}
+	results := lucicodex.NewExecutor(cfg).RunPlan(context.Background(), p)
+	if results.Failed != 0 || strings.TrimSpace(results.Items[0].Output) != "hello" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+
+	provider.plan.Commands = []lucicodex.Command{{Command: []string{"rm", "-rf", "/tmp/x"}}}
+	if _, err := planner.Plan(context.Background(), "clean up"); lucicodex.CodeOf(err) != "POLICY_DENY" {
+		t.Errorf("expected POLICY_DENY, got %v", err)
+	}
+	provider.plan.Commands = []lucicodex.Command{{Command: []string{"reboot"}}}
+	if p, err := planner.Plan(context.Background(), "restart"); err != nil || len(p.PolicyWarnings) != 1 {
+		t.Errorf("expected one warning, got %+v, %v", p.PolicyWarnings, err)
+	}
+}
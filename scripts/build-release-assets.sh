@@ -6,6 +6,13 @@ set -euo pipefail
 
 VERSION=${VERSION:-"1.0.0"}
 OUT=${OUT:-"dist"}
+# Self-update signing (optional): RELEASE_PUBLIC_KEY is the base64 ed25519
+# public key embedded in the binaries, RELEASE_SIGNING_KEY the PEM private key
+# that signs manifest.json. Derive the public key from the private one with:
+#   openssl pkey -in key.pem -pubout -outform DER | tail -c 32 | base64
+RELEASE_PUBLIC_KEY=${RELEASE_PUBLIC_KEY:-""}
+RELEASE_SIGNING_KEY=${RELEASE_SIGNING_KEY:-""}
+LDFLAGS="-s -w -X main.version=${VERSION} -X github.com/aezizhu/LuciCodex/internal/update.PublicKey=${RELEASE_PUBLIC_KEY}"
 ARCHES=(amd64 arm64 arm mipsle mips)
 GOARM_DEFAULT=7
 
@@ -35,11 +42,11 @@ build_bin() {
   # -trimpath removes build paths
   if [[ "$arch" == "arm" ]]; then
     CGO_ENABLED=0 GOOS=linux GOARCH=arm GOARM=${GOARM:-$GOARM_DEFAULT} \
-      go build -trimpath -ldflags "-s -w -X main.version=${VERSION}" -o "$OUT/lucicodex-linux-${arch}v${GOARM:-$GOARM_DEFAULT}" ./cmd/lucicodex
+      go build -trimpath -ldflags "$LDFLAGS" -o "$OUT/lucicodex-linux-${arch}v${GOARM:-$GOARM_DEFAULT}" ./cmd/lucicodex
     outbin="$OUT/lucicodex-linux-${arch}v${GOARM:-$GOARM_DEFAULT}"
   else
     CGO_ENABLED=0 GOOS=linux GOARCH="$arch" \
-      go build -trimpath -ldflags "-s -w -X main.version=${VERSION}" -o "$OUT/lucicodex-linux-${arch}" ./cmd/lucicodex
+      go build -trimpath -ldflags "$LDFLAGS" -o "$OUT/lucicodex-linux-${arch}" ./cmd/lucicodex
     outbin="$OUT/lucicodex-linux-${arch}"
   fi
   echo "$outbin"
@@ -178,12 +185,35 @@ sha256sum_all() {
   (cd "$OUT" && $SHASUM_CMD * > SHA256SUMS)
 }
 
+# write_manifest lists the raw binaries for `lucicodex self-update` and signs
+# the manifest when a signing key is configured.
+write_manifest() {
+  local entries=() bin name platform sum size
+  for bin in "$OUT"/lucicodex-linux-*; do
+    name=$(basename "$bin")
+    platform=${name#lucicodex-}
+    sum=$($SHASUM_CMD "$bin" | cut -d' ' -f1)
+    size=$(wc -c < "$bin" | tr -d ' ')
+    entries+=("\"$platform\": {\"name\": \"$name\", \"sha256\": \"$sum\", \"size\": $size}")
+  done
+  local joined
+  joined=$(printf ',\n    %s' "${entries[@]}")
+  printf '{\n  "version": "%s",\n  "binaries": {%s\n  }\n}\n' "$VERSION" "${joined:1}" > "$OUT/manifest.json"
+
+  if [[ -n "$RELEASE_SIGNING_KEY" ]]; then
+    openssl pkeyutl -sign -inkey "$RELEASE_SIGNING_KEY" -rawin -in "$OUT/manifest.json" | base64 | tr -d '\n' > "$OUT/manifest.json.sig"
+  else
+    echo "Warning: RELEASE_SIGNING_KEY not set; manifest.json is unsigned and self-update will reject it" >&2
+  fi
+}
+
 main() {
   for arch in "${ARCHES[@]}"; do
     bin=$(build_bin "$arch")
     ipk_pack_lucicodex "$arch" "$bin"
   done
   ipk_pack_luci
+  write_manifest
   sha256sum_all
 }
 